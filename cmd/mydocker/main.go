@@ -5,14 +5,21 @@ import (
 	"os"
 
 	"docker-impl/pkg/cli"
+	"docker-impl/pkg/network"
 	"github.com/sirupsen/logrus"
 )
 
 func main() {
+	// Published ports are served by the binary itself when the userland
+	// proxy is enabled
+	if len(os.Args) > 1 && os.Args[1] == network.ProxyCommand {
+		os.Exit(network.RunProxy(os.Args[2:]))
+	}
+
 	logrus.SetFormatter(&logrus.TextFormatter{
 		FullTimestamp: true,
-		Level:         logrus.InfoLevel,
 	})
+	logrus.SetLevel(logrus.InfoLevel)
 
 	app, err := cli.New()
 	if err != nil {
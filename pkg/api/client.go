@@ -0,0 +1,231 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"docker-impl/pkg/events"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultMinBackoff = 500 * time.Millisecond
+	defaultMaxBackoff = 30 * time.Second
+)
+
+// Client calls the API of a host, as served by mydocker serve.
+type Client struct {
+	// BaseURL is where the API is served, including its base path
+	BaseURL    string
+	HTTPClient *http.Client
+}
+
+// NewClient returns a client of the API at host, given like the --host of
+// mydocker serve (unix://PATH or tcp://HOST:PORT) or as an http(s) URL.
+func NewClient(host string) (*Client, error) {
+	scheme, address, ok := strings.Cut(host, "://")
+	if !ok {
+		return nil, fmt.Errorf("invalid host %q: expected unix://PATH, tcp://HOST:PORT or a URL", host)
+	}
+	switch scheme {
+	case "unix":
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", address)
+			},
+		}
+		return &Client{BaseURL: "http://mydocker", HTTPClient: &http.Client{Transport: transport}}, nil
+	case "tcp":
+		return &Client{BaseURL: "http://" + address, HTTPClient: &http.Client{}}, nil
+	case "http", "https":
+		return &Client{BaseURL: strings.TrimSuffix(host, "/"), HTTPClient: &http.Client{}}, nil
+	default:
+		return nil, fmt.Errorf("invalid host %q: unsupported scheme %s", host, scheme)
+	}
+}
+
+// EventsOptions selects the events a subscription receives.
+type EventsOptions struct {
+	// Types are the event types to receive, e.g. events.TypeContainer;
+	// empty receives all
+	Types []string
+	// Since resumes after the event with this sequence number; 0 starts
+	// with the events published from now on
+	Since uint64
+	// MinBackoff and MaxBackoff bound the wait between reconnects, which
+	// doubles with every failed attempt
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// statusError is a response the server refused the subscription with.
+type statusError struct {
+	code    int
+	message string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("server returned status %d: %s", e.code, e.message)
+}
+
+// retryable reports whether asking again may succeed, which it won't
+// for a request the server found wrong.
+func (e *statusError) retryable() bool {
+	return e.code >= 500 || e.code == http.StatusRequestTimeout || e.code == http.StatusTooManyRequests
+}
+
+// Events subscribes to the events of the host until ctx is done. Lost
+// connections are reopened with backoff, resuming after the last event
+// received, so no event still in the server's history is missed or seen
+// twice. The error channel receives why the subscription ended, ctx's
+// error or one the server won't recover from, and both channels are
+// closed then.
+func (c *Client) Events(ctx context.Context, opts EventsOptions) (<-chan events.Event, <-chan error) {
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = defaultMinBackoff
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = defaultMaxBackoff
+	}
+
+	out := make(chan events.Event)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(out)
+		defer close(errs)
+
+		last := opts.Since
+		resume := opts.Since > 0
+		backoff := opts.MinBackoff
+		for {
+			connected, err := c.streamEvents(ctx, opts.Types, last, resume, func(seq uint64, event *events.Event) error {
+				last = seq
+				resume = true
+				if event == nil {
+					return nil
+				}
+				select {
+				case out <- *event:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			})
+			if ctx.Err() != nil {
+				errs <- ctx.Err()
+				return
+			}
+			if status, ok := err.(*statusError); ok && !status.retryable() {
+				errs <- err
+				return
+			}
+			if connected {
+				backoff = opts.MinBackoff
+			}
+
+			logrus.Debugf("Event stream ended: %v; reconnecting in %s", err, backoff)
+			timer := time.NewTimer(backoff)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				errs <- ctx.Err()
+				return
+			}
+			backoff *= 2
+			if backoff > opts.MaxBackoff {
+				backoff = opts.MaxBackoff
+			}
+		}
+	}()
+	return out, errs
+}
+
+// streamEvents reads one event stream until it ends, handing fn the ID of
+// every message and the event it carries, if any. It reports whether the
+// server accepted the subscription.
+func (c *Client) streamEvents(ctx context.Context, types []string, last uint64, resume bool, fn func(seq uint64, event *events.Event) error) (bool, error) {
+	query := url.Values{}
+	for _, eventType := range types {
+		query.Add("type", eventType)
+	}
+	u := c.BaseURL + "/events"
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Accept", ContentTypeEventStream)
+	if resume {
+		req.Header.Set("Last-Event-ID", strconv.FormatUint(last, 10))
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var response APIResponse
+		json.NewDecoder(resp.Body).Decode(&response)
+		return false, &statusError{code: resp.StatusCode, message: response.Error}
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), maxFrameSize)
+	var id, data string
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			// A blank line ends the message
+			if id != "" {
+				seq, err := strconv.ParseUint(id, 10, 64)
+				if err != nil {
+					return true, fmt.Errorf("invalid event ID %q", id)
+				}
+				var event *events.Event
+				if data != "" {
+					event = &events.Event{}
+					if err := json.Unmarshal([]byte(data), event); err != nil {
+						return true, fmt.Errorf("failed to decode event: %v", err)
+					}
+				}
+				if err := fn(seq, event); err != nil {
+					return true, err
+				}
+			}
+			id, data = "", ""
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "id":
+			id = value
+		case "data":
+			if data != "" {
+				data += "\n"
+			}
+			data += value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return true, fmt.Errorf("event stream failed: %v", err)
+	}
+	return true, fmt.Errorf("event stream closed")
+}
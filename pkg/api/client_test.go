@@ -0,0 +1,106 @@
+package api
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"docker-impl/pkg/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func receiveEvent(t *testing.T, ch <-chan events.Event) events.Event {
+	t.Helper()
+	select {
+	case event, ok := <-ch:
+		require.True(t, ok, "event channel closed")
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an event")
+		return events.Event{}
+	}
+}
+
+func TestEventsResumeAfterReconnect(t *testing.T) {
+	s, err := NewServer(nil, ServerConfig{})
+	require.NoError(t, err)
+	bus := events.NewBus()
+	s.bus = bus
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	// Events up to Since aren't sent
+	bus.Publish(events.Event{Type: events.TypeContainer, Action: "create", ID: "c1"})
+
+	client, err := NewClient(ts.URL)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, errs := client.Events(ctx, EventsOptions{
+		Types:      []string{events.TypeContainer},
+		Since:      bus.LastSeq(),
+		MinBackoff: 10 * time.Millisecond,
+	})
+	bus.Publish(events.Event{Type: events.TypeContainer, Action: "start", ID: "c1"})
+	assert.Equal(t, "start", receiveEvent(t, ch).Action)
+
+	ts.CloseClientConnections()
+	bus.Publish(events.Event{Type: events.TypeContainer, Action: "die", ID: "c1"})
+	bus.Publish(events.Event{Type: events.TypeNode, Action: "down", ID: "n1"})
+	bus.Publish(events.Event{Type: events.TypeContainer, Action: "destroy", ID: "c1"})
+
+	die := receiveEvent(t, ch)
+	assert.Equal(t, "die", die.Action, "events published while disconnected are replayed")
+	destroy := receiveEvent(t, ch)
+	assert.Equal(t, "destroy", destroy.Action, "events of other types are filtered out")
+	assert.Equal(t, die.Seq+2, destroy.Seq)
+	select {
+	case event := <-ch:
+		t.Fatalf("unexpected event %s %s after resuming", event.Action, event.ID)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	cancel()
+	for range ch {
+	}
+	assert.Equal(t, context.Canceled, <-errs)
+}
+
+func TestEventsSince(t *testing.T) {
+	s, err := NewServer(nil, ServerConfig{})
+	require.NoError(t, err)
+	bus := events.NewBus()
+	s.bus = bus
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	for _, action := range []string{"create", "start", "die"} {
+		bus.Publish(events.Event{Type: events.TypeContainer, Action: action, ID: "c1"})
+	}
+
+	client, err := NewClient(ts.URL)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, _ := client.Events(ctx, EventsOptions{Since: 1})
+	assert.Equal(t, "start", receiveEvent(t, ch).Action)
+	assert.Equal(t, "die", receiveEvent(t, ch).Action)
+}
+
+func TestEventsRejected(t *testing.T) {
+	s, err := NewServer(nil, ServerConfig{BasePath: "/docker"})
+	require.NoError(t, err)
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	// Without the base path, the server has no events endpoint
+	client, err := NewClient(ts.URL)
+	require.NoError(t, err)
+	ch, errs := client.Events(context.Background(), EventsOptions{})
+	for range ch {
+	}
+	err = <-errs
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "404")
+}
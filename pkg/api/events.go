@@ -0,0 +1,123 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"docker-impl/pkg/events"
+)
+
+// ContentTypeEventStream is the content type of server-sent events.
+const ContentTypeEventStream = "text/event-stream"
+
+const (
+	// eventsKeepAlive is how often an idle event stream gets a comment,
+	// so proxies and clients don't take it for dead
+	eventsKeepAlive = 15 * time.Second
+	// eventsRetry is how long clients are asked to wait before
+	// reconnecting, in milliseconds
+	eventsRetry = 1000
+)
+
+// handleEvents streams the events of the host as server-sent events, each
+// with its sequence number as ID. The stream starts with the ID of the
+// last event, so a client that reconnects with it in Last-Event-ID, or
+// ?since=SEQ, gets the events it missed first. ?type= may be repeated to
+// only stream events of those types.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	since := s.bus.LastSeq()
+	resume := r.Header.Get("Last-Event-ID")
+	if resume == "" {
+		resume = r.URL.Query().Get("since")
+	}
+	if resume != "" {
+		seq, err := strconv.ParseUint(resume, 10, 64)
+		if err != nil {
+			s.writeErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("invalid event ID %q", resume))
+			return
+		}
+		since = seq
+	}
+	types := make(map[string]bool)
+	for _, eventType := range r.URL.Query()["type"] {
+		types[eventType] = true
+	}
+
+	missed, ch, cancel := s.bus.SubscribeSince(since)
+	defer cancel()
+
+	w.Header().Set("Content-Type", ContentTypeEventStream)
+	w.Header().Set("Cache-Control", "no-cache")
+	// Keeps nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	out := &flushWriter{w: w}
+	if _, err := fmt.Fprintf(out, "retry: %d\nid: %d\n\n", eventsRetry, since); err != nil {
+		return
+	}
+
+	last := since
+	send := func(event events.Event) error {
+		if event.Seq <= last {
+			return nil
+		}
+		last = event.Seq
+		if len(types) > 0 && !types[event.Type] {
+			// Still moves the client's ID on, so it doesn't get the
+			// events it filtered out again when it reconnects
+			_, err := fmt.Fprintf(out, "id: %d\n\n", event.Seq)
+			return err
+		}
+		return writeEvent(out, event)
+	}
+	for _, event := range missed {
+		if err := send(event); err != nil {
+			return
+		}
+	}
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event, ok := <-ch:
+			if !ok {
+				return
+			}
+			// A gap means the subscription dropped events while the
+			// client was slow; they are read back from the history
+			if event.Seq > last+1 {
+				for _, dropped := range s.bus.History(last) {
+					if dropped.Seq >= event.Seq {
+						break
+					}
+					if err := send(dropped); err != nil {
+						return
+					}
+				}
+			}
+			if err := send(event); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := io.WriteString(out, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeEvent(w io.Writer, event events.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Seq, event.Type, data)
+	return err
+}
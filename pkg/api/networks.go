@@ -0,0 +1,164 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"docker-impl/pkg/network"
+	"github.com/gorilla/mux"
+)
+
+// NetworkConnectRequest connects a container to a network, or disconnects
+// it. IPAddress and Aliases are only read on connect.
+type NetworkConnectRequest struct {
+	Container string   `json:"container"`
+	IPAddress string   `json:"ip_address,omitempty"`
+	Aliases   []string `json:"aliases,omitempty"`
+}
+
+// SetNetwork serves the networks of the network manager get returns. It is
+// only called by the network endpoints, so the bridge isn't set up for a
+// server that never manages networks.
+func (s *Server) SetNetwork(get func() *network.Manager) {
+	s.network = get
+}
+
+func (s *Server) setupNetworkRoutes(router *mux.Router) {
+	router.HandleFunc("/networks", s.handleListNetworks).Methods("GET")
+	router.HandleFunc("/networks", s.handleCreateNetwork).Methods("POST")
+	router.HandleFunc("/networks/{id}", s.handleGetNetwork).Methods("GET")
+	router.HandleFunc("/networks/{id}", s.handleRemoveNetwork).Methods("DELETE")
+	router.HandleFunc("/networks/{id}/connect", s.handleConnectNetwork).Methods("POST")
+	router.HandleFunc("/networks/{id}/disconnect", s.handleDisconnectNetwork).Methods("POST")
+}
+
+// networks returns the network manager, or writes an error when the
+// server has none.
+func (s *Server) networks(w http.ResponseWriter) *network.Manager {
+	if s.network == nil {
+		s.writeErrorResponse(w, http.StatusServiceUnavailable, "networking is not available")
+		return nil
+	}
+	return s.network()
+}
+
+func (s *Server) handleListNetworks(w http.ResponseWriter, r *http.Request) {
+	networkMgr := s.networks(w)
+	if networkMgr == nil {
+		return
+	}
+	s.writeJSONResponse(w, http.StatusOK, APIResponse{Success: true, Data: networkMgr.ListNetworks()})
+}
+
+func (s *Server) handleCreateNetwork(w http.ResponseWriter, r *http.Request) {
+	networkMgr := s.networks(w)
+	if networkMgr == nil {
+		return
+	}
+
+	var opts network.CreateNetworkOptions
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+		s.writeErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("invalid network config: %v", err))
+		return
+	}
+	created, err := networkMgr.CreateNetwork(opts)
+	if err != nil {
+		status := http.StatusBadRequest
+		if strings.Contains(err.Error(), "already exists") {
+			status = http.StatusConflict
+		}
+		s.writeErrorResponse(w, status, err.Error())
+		return
+	}
+	s.writeJSONResponse(w, http.StatusCreated, APIResponse{Success: true, Data: created})
+}
+
+func (s *Server) handleGetNetwork(w http.ResponseWriter, r *http.Request) {
+	networkMgr := s.networks(w)
+	if networkMgr == nil {
+		return
+	}
+	n, err := networkMgr.GetNetwork(mux.Vars(r)["id"])
+	if err != nil {
+		s.writeErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+	s.writeJSONResponse(w, http.StatusOK, APIResponse{Success: true, Data: n})
+}
+
+func (s *Server) handleRemoveNetwork(w http.ResponseWriter, r *http.Request) {
+	networkMgr := s.networks(w)
+	if networkMgr == nil {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	if _, err := networkMgr.GetNetwork(id); err != nil {
+		s.writeErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err := networkMgr.RemoveNetwork(id); err != nil {
+		s.writeErrorResponse(w, http.StatusConflict, err.Error())
+		return
+	}
+	s.writeJSONResponse(w, http.StatusOK, APIResponse{Success: true, Message: "Network removed"})
+}
+
+func (s *Server) handleConnectNetwork(w http.ResponseWriter, r *http.Request) {
+	networkMgr := s.networks(w)
+	if networkMgr == nil {
+		return
+	}
+	request, ok := s.decodeConnectRequest(w, r)
+	if !ok {
+		return
+	}
+	container, err := s.containers.ResolveContainer(request.Container)
+	if err != nil {
+		s.writeErrorResponse(w, http.StatusNotFound, fmt.Sprintf("no such container: %s", request.Container))
+		return
+	}
+
+	endpoint, err := networkMgr.ConnectContainer(mux.Vars(r)["id"], container.ID, container.Name, request.IPAddress, request.Aliases)
+	if err != nil {
+		s.writeErrorResponse(w, http.StatusConflict, err.Error())
+		return
+	}
+	s.writeJSONResponse(w, http.StatusOK, APIResponse{Success: true, Data: endpoint})
+}
+
+func (s *Server) handleDisconnectNetwork(w http.ResponseWriter, r *http.Request) {
+	networkMgr := s.networks(w)
+	if networkMgr == nil {
+		return
+	}
+	request, ok := s.decodeConnectRequest(w, r)
+	if !ok {
+		return
+	}
+	// A removed container can still have an endpoint left behind
+	containerID := request.Container
+	if container, err := s.containers.ResolveContainer(containerID); err == nil {
+		containerID = container.ID
+	}
+
+	if err := networkMgr.DisconnectContainer(mux.Vars(r)["id"], containerID); err != nil {
+		s.writeErrorResponse(w, http.StatusConflict, err.Error())
+		return
+	}
+	s.writeJSONResponse(w, http.StatusOK, APIResponse{Success: true, Message: "Container disconnected"})
+}
+
+func (s *Server) decodeConnectRequest(w http.ResponseWriter, r *http.Request) (*NetworkConnectRequest, bool) {
+	var request NetworkConnectRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		s.writeErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("invalid request: %v", err))
+		return nil, false
+	}
+	if request.Container == "" {
+		s.writeErrorResponse(w, http.StatusBadRequest, "no container specified")
+		return nil, false
+	}
+	return &request, true
+}
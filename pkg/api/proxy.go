@@ -0,0 +1,183 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ServerConfig sets how the API can be reached from browsers and through
+// reverse proxies such as nginx or Traefik.
+type ServerConfig struct {
+	// CORSOrigins are the origins browsers may call the API from; "*"
+	// allows any. Empty, cross-origin requests are not allowed.
+	CORSOrigins []string
+	// TrustedProxies are the addresses or CIDRs whose X-Forwarded-*
+	// headers are believed. The headers are dropped from anyone else.
+	TrustedProxies []string
+	// BasePath is the prefix the API is served under, e.g. /docker when
+	// the proxy forwards that path without stripping it
+	BasePath string
+}
+
+var forwardedHeaders = []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "X-Forwarded-Prefix"}
+
+const (
+	corsAllowMethods = "GET, POST, PUT, DELETE, OPTIONS"
+	corsAllowHeaders = "Content-Type, Authorization, X-Requested-With"
+	corsMaxAge       = "600"
+)
+
+// normalizeBasePath turns "docker/" into "/docker"; "" and "/" mean the
+// root.
+func normalizeBasePath(basePath string) (string, error) {
+	basePath = strings.Trim(basePath, "/")
+	if basePath == "" {
+		return "", nil
+	}
+	if strings.ContainsAny(basePath, "?#{}") {
+		return "", fmt.Errorf("invalid base path %q", basePath)
+	}
+	return "/" + basePath, nil
+}
+
+// parseTrustedProxies reads addresses and CIDRs, a bare address being a
+// network of its own.
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: expected an IP address or CIDR", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", proxy, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func (s *Server) isTrustedProxy(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range s.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// withForwarded applies the X-Forwarded-* headers of trusted proxies to
+// the request, so handlers see the client's address, host and scheme, and
+// strips them from other peers so they can't be spoofed.
+func (s *Server) withForwarded(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.isTrustedProxy(r.RemoteAddr) {
+			for _, header := range forwardedHeaders {
+				r.Header.Del(header)
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if client := s.forwardedClient(r.Header.Values("X-Forwarded-For")); client != "" {
+			r.RemoteAddr = net.JoinHostPort(client, "0")
+		}
+		if host := firstForwarded(r.Header.Get("X-Forwarded-Host")); host != "" {
+			r.Host = host
+		}
+		if proto := firstForwarded(r.Header.Get("X-Forwarded-Proto")); proto == "http" || proto == "https" {
+			r.URL.Scheme = proto
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forwardedClient walks X-Forwarded-For from the nearest hop back and
+// returns the first address that isn't one of our proxies. Addresses
+// further back were added by the client and can't be trusted.
+func (s *Server) forwardedClient(values []string) string {
+	var hops []string
+	for _, value := range values {
+		for _, hop := range strings.Split(value, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if net.ParseIP(hops[i]) == nil {
+			return ""
+		}
+		if i == 0 || !s.isTrustedProxy(hops[i]) {
+			return hops[i]
+		}
+	}
+	return ""
+}
+
+func firstForwarded(value string) string {
+	first, _, _ := strings.Cut(value, ",")
+	return strings.TrimSpace(first)
+}
+
+func (s *Server) allowedOrigin(origin string) bool {
+	for _, allowed := range s.config.CORSOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// withCORS answers preflight requests and marks responses readable by the
+// allowed origins. Requests from other origins are still served, since
+// only browsers enforce CORS, but without the headers browsers need.
+func (s *Server) withCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		allowed := s.allowedOrigin(origin)
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			if !allowed {
+				s.writeErrorResponse(w, http.StatusForbidden, fmt.Sprintf("origin %s is not allowed", origin))
+				return
+			}
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+			w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCORS(t *testing.T) {
+	s, err := NewServer(nil, ServerConfig{CORSOrigins: []string{"https://dashboard.example.com"}})
+	require.NoError(t, err)
+
+	preflight := func(origin string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodOptions, "/exec/abc/json", nil)
+		r.Header.Set("Origin", origin)
+		r.Header.Set("Access-Control-Request-Method", "GET")
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, r)
+		return w
+	}
+
+	w := preflight("https://dashboard.example.com")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "https://dashboard.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Contains(t, w.Header().Get("Access-Control-Allow-Methods"), "POST")
+
+	w = preflight("https://evil.example.com")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	s, err := NewServer(nil, ServerConfig{TrustedProxies: []string{"10.0.0.0/8", "192.168.1.5"}})
+	require.NoError(t, err)
+
+	var seen *http.Request
+	handler := s.withForwarded(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { seen = r }))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.1.2.3:4567"
+	r.Header.Set("X-Forwarded-For", "1.2.3.4, 203.0.113.7, 192.168.1.5")
+	r.Header.Set("X-Forwarded-Host", "docker.example.com")
+	r.Header.Set("X-Forwarded-Proto", "https")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	assert.Equal(t, "203.0.113.7:0", seen.RemoteAddr, "addresses before the first untrusted hop are ignored")
+	assert.Equal(t, "docker.example.com", seen.Host)
+	assert.Equal(t, "https", seen.URL.Scheme)
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "203.0.113.9:4567"
+	r.Header.Set("X-Forwarded-For", "1.2.3.4")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	assert.Equal(t, "203.0.113.9:4567", seen.RemoteAddr)
+	assert.Empty(t, seen.Header.Get("X-Forwarded-For"))
+
+	_, err = NewServer(nil, ServerConfig{TrustedProxies: []string{"nginx"}})
+	assert.Error(t, err)
+}
+
+func TestBasePath(t *testing.T) {
+	s, err := NewServer(nil, ServerConfig{BasePath: "docker/"})
+	require.NoError(t, err)
+
+	var match mux.RouteMatch
+	assert.True(t, s.router.Match(httptest.NewRequest(http.MethodGet, "/docker/exec/abc/json", nil), &match))
+	assert.Equal(t, "abc", match.Vars["id"])
+	assert.False(t, s.router.Match(httptest.NewRequest(http.MethodGet, "/exec/abc/json", nil), &mux.RouteMatch{}))
+}
@@ -0,0 +1,215 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"docker-impl/pkg/container"
+	"docker-impl/pkg/events"
+	"docker-impl/pkg/network"
+	"docker-impl/pkg/types"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// Server is the HTTP API of the containers on this host, for tools that
+// drive them programmatically, such as CI runners.
+type Server struct {
+	containers     *container.Manager
+	network        func() *network.Manager
+	bus            *events.Bus
+	config         ServerConfig
+	trustedProxies []*net.IPNet
+	router         *mux.Router
+	handler        http.Handler
+	server         *http.Server
+}
+
+type APIResponse struct {
+	Success bool        `json:"success"`
+	Message string      `json:"message,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// ExecCreateResponse holds the ID of a new exec instance.
+type ExecCreateResponse struct {
+	ID string `json:"id"`
+}
+
+// ExecStartRequest starts an exec instance. Detached, the output is
+// discarded and the call returns at once; otherwise the output is streamed
+// back until the command exits.
+type ExecStartRequest struct {
+	Detach bool `json:"detach"`
+}
+
+func NewServer(containers *container.Manager, config ServerConfig) (*Server, error) {
+	basePath, err := normalizeBasePath(config.BasePath)
+	if err != nil {
+		return nil, err
+	}
+	config.BasePath = basePath
+	trustedProxies, err := parseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		containers:     containers,
+		bus:            events.GetEventBus(),
+		config:         config,
+		trustedProxies: trustedProxies,
+		router:         mux.NewRouter(),
+	}
+	// Forwarded headers are applied first, so everything after sees the
+	// real client
+	s.handler = s.withForwarded(s.withCORS(s.router))
+	s.server = &http.Server{
+		Handler:     s.handler,
+		ReadTimeout: 30 * time.Second,
+		// No write timeout: exec output is streamed for as long as the
+		// command runs
+		IdleTimeout: 60 * time.Second,
+	}
+	s.setupRoutes()
+	return s, nil
+}
+
+func (s *Server) setupRoutes() {
+	router := s.router
+	if s.config.BasePath != "" {
+		router = s.router.PathPrefix(s.config.BasePath).Subrouter()
+	}
+	router.HandleFunc("/containers/{id}/exec", s.handleExecCreate).Methods("POST")
+	router.HandleFunc("/exec/{id}/start", s.handleExecStart).Methods("POST")
+	router.HandleFunc("/exec/{id}/json", s.handleExecInspect).Methods("GET")
+	router.HandleFunc("/events", s.handleEvents).Methods("GET")
+	s.setupNetworkRoutes(router)
+}
+
+func (s *Server) Handler() http.Handler {
+	return s.handler
+}
+
+// Serve serves the API on listener until Stop is called.
+func (s *Server) Serve(listener net.Listener) error {
+	logrus.Infof("Starting API server on %s", listener.Addr())
+	if err := s.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) Stop() error {
+	return s.server.Close()
+}
+
+func (s *Server) handleExecCreate(w http.ResponseWriter, r *http.Request) {
+	containerID := mux.Vars(r)["id"]
+
+	var config types.ExecConfig
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		s.writeErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("invalid exec config: %v", err))
+		return
+	}
+	if len(config.Cmd) == 0 {
+		s.writeErrorResponse(w, http.StatusBadRequest, "no command specified")
+		return
+	}
+	if _, err := s.containers.GetContainer(containerID); err != nil {
+		s.writeErrorResponse(w, http.StatusNotFound, fmt.Sprintf("no such container: %s", containerID))
+		return
+	}
+
+	execID, err := s.containers.CreateExec(containerID, config)
+	if err != nil {
+		s.writeErrorResponse(w, http.StatusConflict, err.Error())
+		return
+	}
+	s.writeJSONResponse(w, http.StatusCreated, APIResponse{
+		Success: true,
+		Data:    ExecCreateResponse{ID: execID},
+	})
+}
+
+// handleExecStart runs an exec instance. Attached, its output is the
+// response body: multiplexed frames, or the raw terminal output for a
+// TTY. Its exit code is read afterwards from /exec/{id}/json.
+func (s *Server) handleExecStart(w http.ResponseWriter, r *http.Request) {
+	execID := mux.Vars(r)["id"]
+
+	var request ExecStartRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && err != io.EOF {
+		s.writeErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("invalid request: %v", err))
+		return
+	}
+	inspect, err := s.containers.InspectExec(execID)
+	if err != nil {
+		s.writeErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if !inspect.StartedAt.IsZero() {
+		s.writeErrorResponse(w, http.StatusConflict, fmt.Sprintf("exec %s has already been started", execID))
+		return
+	}
+
+	if request.Detach {
+		go func() {
+			if _, err := s.containers.StartExec(execID, io.Discard, io.Discard); err != nil {
+				logrus.Warnf("Failed to start exec %s: %v", execID, err)
+			}
+		}()
+		s.writeJSONResponse(w, http.StatusOK, APIResponse{Success: true, Message: "Exec started"})
+		return
+	}
+
+	var stdout, stderr io.Writer
+	var frames *Multiplexer
+	if inspect.Config.Tty {
+		w.Header().Set("Content-Type", ContentTypeRaw)
+		stdout = &flushWriter{w: w}
+	} else {
+		w.Header().Set("Content-Type", ContentTypeMultiplexed)
+		frames = NewMultiplexer(w)
+		stdout = frames.Stream(Stdout)
+		stderr = frames.Stream(Stderr)
+	}
+	w.WriteHeader(http.StatusOK)
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	if _, err := s.containers.StartExec(execID, stdout, stderr); err != nil {
+		logrus.Warnf("Failed to start exec %s: %v", execID, err)
+		if frames != nil {
+			frames.Stream(Systemerr).Write([]byte(err.Error()))
+		}
+	}
+}
+
+func (s *Server) handleExecInspect(w http.ResponseWriter, r *http.Request) {
+	inspect, err := s.containers.InspectExec(mux.Vars(r)["id"])
+	if err != nil {
+		s.writeErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+	s.writeJSONResponse(w, http.StatusOK, APIResponse{Success: true, Data: inspect})
+}
+
+func (s *Server) writeJSONResponse(w http.ResponseWriter, statusCode int, response APIResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) writeErrorResponse(w http.ResponseWriter, statusCode int, message string) {
+	s.writeJSONResponse(w, statusCode, APIResponse{
+		Success: false,
+		Error:   message,
+	})
+}
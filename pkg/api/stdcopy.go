@@ -0,0 +1,142 @@
+package api
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// Exec output without a TTY is multiplexed onto one stream in frames, each
+// an 8 byte header followed by the payload. The first byte of the header
+// says which stream the payload belongs to and the last four hold its size
+// as a big-endian uint32, as in Docker's attach protocol.
+const (
+	Stdout byte = 1
+	Stderr byte = 2
+	// Systemerr carries an error that ended the output early
+	Systemerr byte = 3
+)
+
+const (
+	ContentTypeMultiplexed = "application/vnd.docker.multiplexed-stream"
+	ContentTypeRaw         = "application/vnd.docker.raw-stream"
+)
+
+const frameHeaderLen = 8
+
+// maxFrameSize bounds the frames Demultiplex accepts, so a corrupt header
+// can't make it allocate without limit
+const maxFrameSize = 16 << 20
+
+// Multiplexer writes several streams to one writer in frames, flushing
+// after each one if the writer can be flushed, so output reaches clients
+// as it is produced.
+type Multiplexer struct {
+	w  io.Writer
+	mu sync.Mutex
+}
+
+func NewMultiplexer(w io.Writer) *Multiplexer {
+	return &Multiplexer{w: w}
+}
+
+// Stream returns a writer whose writes become frames of stream.
+func (m *Multiplexer) Stream(stream byte) io.Writer {
+	return &streamWriter{mux: m, stream: stream}
+}
+
+func (m *Multiplexer) writeFrame(stream byte, p []byte) error {
+	header := make([]byte, frameHeaderLen)
+	header[0] = stream
+	binary.BigEndian.PutUint32(header[4:], uint32(len(p)))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := m.w.Write(header); err != nil {
+		return err
+	}
+	if _, err := m.w.Write(p); err != nil {
+		return err
+	}
+	if flusher, ok := m.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
+
+type streamWriter struct {
+	mux    *Multiplexer
+	stream byte
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	for written := 0; written < len(p); {
+		chunk := p[written:]
+		if len(chunk) > maxFrameSize {
+			chunk = chunk[:maxFrameSize]
+		}
+		if err := w.mux.writeFrame(w.stream, chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+	}
+	return len(p), nil
+}
+
+// flushWriter flushes after every write, for output sent without frames.
+type flushWriter struct {
+	w  io.Writer
+	mu sync.Mutex
+}
+
+func (w *flushWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n, err := w.w.Write(p)
+	if flusher, ok := w.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
+
+// Demultiplex copies the frames read from src to stdout and stderr until
+// src ends. A Systemerr frame is returned as an error.
+func Demultiplex(stdout, stderr io.Writer, src io.Reader) error {
+	header := make([]byte, frameHeaderLen)
+	for {
+		if _, err := io.ReadFull(src, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("failed to read frame header: %v", err)
+		}
+		size := binary.BigEndian.Uint32(header[4:])
+		if size > maxFrameSize {
+			return fmt.Errorf("frame of %d bytes is too large", size)
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(src, payload); err != nil {
+			return fmt.Errorf("failed to read frame: %v", err)
+		}
+
+		var dst io.Writer
+		switch header[0] {
+		case Stdout:
+			dst = stdout
+		case Stderr:
+			dst = stderr
+		case Systemerr:
+			return fmt.Errorf("%s", payload)
+		default:
+			return fmt.Errorf("unknown stream %d", header[0])
+		}
+		if dst == nil {
+			continue
+		}
+		if _, err := dst.Write(payload); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultiplexRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	mux := NewMultiplexer(&buf)
+	stdout := mux.Stream(Stdout)
+	stderr := mux.Stream(Stderr)
+
+	_, err := stdout.Write([]byte("hello "))
+	require.NoError(t, err)
+	_, err = stderr.Write([]byte("oops\n"))
+	require.NoError(t, err)
+	_, err = stdout.Write([]byte("world\n"))
+	require.NoError(t, err)
+
+	header := buf.Bytes()[:frameHeaderLen]
+	assert.Equal(t, Stdout, header[0])
+	assert.Equal(t, uint32(6), binary.BigEndian.Uint32(header[4:]))
+
+	var out, errOut bytes.Buffer
+	require.NoError(t, Demultiplex(&out, &errOut, &buf))
+	assert.Equal(t, "hello world\n", out.String())
+	assert.Equal(t, "oops\n", errOut.String())
+}
+
+func TestDemultiplexErrors(t *testing.T) {
+	var buf bytes.Buffer
+	mux := NewMultiplexer(&buf)
+	mux.Stream(Stdout).Write([]byte("partial"))
+	mux.Stream(Systemerr).Write([]byte("container is not running"))
+
+	var out bytes.Buffer
+	err := Demultiplex(&out, nil, &buf)
+	assert.EqualError(t, err, "container is not running")
+	assert.Equal(t, "partial", out.String())
+
+	// A frame cut short is an error, not the end of the output
+	buf.Reset()
+	mux.Stream(Stdout).Write([]byte("truncated"))
+	buf.Truncate(buf.Len() - 3)
+	assert.Error(t, Demultiplex(&out, nil, &buf))
+
+	assert.Error(t, Demultiplex(&out, nil, bytes.NewReader([]byte{9, 0, 0, 0, 0, 0, 0, 1, 'x'})))
+}
@@ -0,0 +1,99 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"docker-impl/pkg/types"
+	"github.com/urfave/cli/v2"
+)
+
+func (app *App) createCheckpoint(c *cli.Context) error {
+	if c.NArg() < 2 {
+		return fmt.Errorf("container and checkpoint name are required")
+	}
+	container, err := app.containerMgr.ResolveContainer(c.Args().Get(0))
+	if err != nil {
+		return err
+	}
+
+	checkpoint, err := app.containerMgr.CreateCheckpoint(container.ID, types.CheckpointCreateOptions{
+		Name: c.Args().Get(1),
+		Exit: c.Bool("exit"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to checkpoint container: %v", err)
+	}
+	fmt.Println(checkpoint.Name)
+	return nil
+}
+
+func (app *App) listCheckpoints(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("container ID is required")
+	}
+	container, err := app.containerMgr.ResolveContainer(c.Args().First())
+	if err != nil {
+		return err
+	}
+
+	checkpoints, err := app.containerMgr.ListCheckpoints(container.ID)
+	if err != nil {
+		return err
+	}
+	if checkpoints == nil {
+		checkpoints = []*types.Checkpoint{}
+	}
+	if ok, err := printFormatted(c, checkpoints); ok {
+		return err
+	}
+
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "CHECKPOINT NAME\tCREATED\tSIZE\tAUTO")
+	for _, checkpoint := range checkpoints {
+		fmt.Fprintf(w, "%s\t%s ago\t%s\t%v\n", checkpoint.Name,
+			humanDuration(now.Sub(checkpoint.CreatedAt)), humanSize(checkpoint.Size), checkpoint.Auto)
+	}
+	return w.Flush()
+}
+
+func (app *App) removeCheckpoint(c *cli.Context) error {
+	if c.NArg() < 2 {
+		return fmt.Errorf("container and checkpoint name are required")
+	}
+	container, err := app.containerMgr.ResolveContainer(c.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	return app.containerMgr.RemoveCheckpoint(container.ID, c.Args().Get(1))
+}
+
+func (app *App) scheduleCheckpoints(c *cli.Context) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	fmt.Println("Taking scheduled checkpoints (press Ctrl+C to stop)")
+	return app.containerMgr.RunCheckpointPolicies(ctx, c.Duration("interval"))
+}
+
+func (app *App) restoreContainer(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("container ID is required")
+	}
+	container, err := app.containerMgr.ResolveContainer(c.Args().First())
+	if err != nil {
+		return err
+	}
+
+	if err := app.containerMgr.RestoreContainer(container.ID, c.String("checkpoint")); err != nil {
+		return fmt.Errorf("failed to restore container: %v", err)
+	}
+	fmt.Println(container.ID)
+	return nil
+}
@@ -1,13 +1,25 @@
 package cli
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/urfave/cli/v2"
 	"github.com/sirupsen/logrus"
 	"docker-impl/pkg/cluster"
+	"docker-impl/pkg/network"
+	"docker-impl/pkg/reference"
+	"docker-impl/pkg/storage"
+	"docker-impl/pkg/types"
 )
 
 func addClusterCommands(app *App) {
@@ -19,7 +31,7 @@ func addClusterCommands(app *App) {
 			{
 				Name:    "init",
 				Usage:   "Initialize a new cluster",
-				Flags: []cli.Flag{
+				Flags: append([]cli.Flag{
 					&cli.StringFlag{
 						Name:  "advertise-addr",
 						Usage: "Advertised address",
@@ -40,7 +52,8 @@ func addClusterCommands(app *App) {
 						Usage: "Data directory",
 						Value: "/var/lib/mydocker/cluster",
 					},
-				},
+					forceNewClusterFlag(),
+				}, append(append(append(authFlags(), schedulerPluginFlags()...), heartbeatFlags()...), joinTokenFlags()...)...),
 				Action: app.initCluster,
 			},
 			{
@@ -92,12 +105,14 @@ func addClusterCommands(app *App) {
 				Subcommands: []*cli.Command{
 					{
 						Name:   "create",
-						Usage:  "Create a new join token",
+						Usage:  "Show the join token, creating it if it is missing or expired",
+						Flags:  []cli.Flag{joinTokenRoleFlag()},
 						Action: app.createJoinToken,
 					},
 					{
 						Name:   "rotate",
-						Usage:  "Rotate the join token",
+						Usage:  "Replace the join token, revoking the old one; nodes that already joined are unaffected",
+						Flags:  []cli.Flag{joinTokenRoleFlag()},
 						Action: app.rotateJoinToken,
 					},
 				},
@@ -114,6 +129,55 @@ func addClusterCommands(app *App) {
 				},
 				Action: app.scaleCluster,
 			},
+			{
+				Name:    "upgrade",
+				Usage:   "Upgrade cluster nodes to a new version",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "version",
+						Usage:    "Target version",
+						Required: true,
+					},
+					&cli.IntFlag{
+						Name:  "batch-size",
+						Usage: "Number of workers upgraded at a time",
+						Value: 1,
+					},
+					&cli.DurationFlag{
+						Name:  "timeout",
+						Usage: "How long to wait for each node to report healthy",
+						Value: 60 * time.Second,
+					},
+				},
+				Action: app.upgradeCluster,
+			},
+			{
+				Name:  "prune",
+				Usage: "Remove unused containers, images and optionally volumes on every node",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:    "all",
+						Aliases: []string{"a"},
+						Usage:   "Remove all unused images, not just dangling ones",
+					},
+					&cli.BoolFlag{
+						Name:  "volumes",
+						Usage: "Prune unused volumes",
+					},
+					&cli.StringSliceFlag{
+						Name:  "filter",
+						Usage: "Provide filter values (e.g. until=24h)",
+					},
+				},
+				Action: app.pruneCluster,
+			},
+			{
+				Name:   "rebalance",
+				Usage:  "Move replicas of services with a rebalance policy onto underutilized nodes",
+				Action: app.rebalanceCluster,
+			},
+			prepullCommand(app),
+			imageGCCommand(app),
 		},
 	}
 
@@ -126,6 +190,7 @@ func addClusterCommands(app *App) {
 				Name:    "ls",
 				Usage:   "List nodes in the cluster",
 				Aliases: []string{"list"},
+				Flags:   append(timeRangeFlags(), clusterListFlags()...),
 				Action:  app.listNodes,
 			},
 			{
@@ -151,6 +216,23 @@ func addClusterCommands(app *App) {
 						Name:  "availability",
 						Usage: "Node availability (active/pause/drain)",
 					},
+					&cli.BoolFlag{
+						Name:  "wait",
+						Usage: "With drain, wait until the node's tasks have been evicted and rescheduled",
+					},
+					&cli.DurationFlag{
+						Name:  "timeout",
+						Usage: "How long --wait waits for the drain",
+						Value: 10 * time.Minute,
+					},
+					&cli.StringSliceFlag{
+						Name:  "label-add",
+						Usage: "Add or change a node label (KEY=VALUE)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "label-rm",
+						Usage: "Remove a node label (KEY)",
+					},
 				},
 				Action: app.updateNode,
 			},
@@ -159,6 +241,14 @@ func addClusterCommands(app *App) {
 				Usage:   "Show tasks running on a node",
 				Action:  app.nodeTasks,
 			},
+			{
+				Name:      "drain-status",
+				Usage:     "Show the tasks a draining node still runs and those being rescheduled",
+				ArgsUsage: "NODE",
+				Action:    app.nodeDrainStatus,
+			},
+			nodeEventsCommand(app),
+			agentCommand(app),
 		},
 	}
 
@@ -171,7 +261,7 @@ func addClusterCommands(app *App) {
 				Name:    "ls",
 				Usage:   "List tasks",
 				Aliases: []string{"list"},
-				Flags: []cli.Flag{
+				Flags: append([]cli.Flag{
 					&cli.StringFlag{
 						Name:  "filter",
 						Usage: "Filter output based on conditions provided",
@@ -184,7 +274,7 @@ func addClusterCommands(app *App) {
 						Name:  "status",
 						Usage: "Filter tasks by status",
 					},
-				},
+				}, append(timeRangeFlags(), clusterListFlags()...)...),
 				Action: app.listTasks,
 			},
 			{
@@ -206,48 +296,72 @@ func addClusterCommands(app *App) {
 		},
 	}
 
-	// Add service command group (placeholder)
+	// Add service command group
 	serviceCmd := &cli.Command{
 		Name:  "service",
 		Usage: "Manage services",
-		Subcommands: []*cli.Command{
-			{
-				Name:    "ls",
-				Usage:   "List services",
-				Aliases: []string{"list"},
-				Action:  app.listServices,
+		Subcommands: append(serviceCommands(app),
+			&cli.Command{
+				Name:      "status",
+				Usage:     "Show a service's task failures, probe failures and restarts over its SLO window",
+				ArgsUsage: "SERVICE",
+				Flags:     formatFlags(),
+				Action:    app.serviceStatus,
 			},
-			{
-				Name:    "create",
-				Usage:   "Create a new service",
-				Action:  app.createService,
+			&cli.Command{
+				Name:      "recommend",
+				Usage:     "Suggest CPU and memory reservations and limits from a service's p95 usage",
+				ArgsUsage: "SERVICE",
+				Flags:     formatFlags(),
+				Action:    app.serviceRecommend,
 			},
-			{
-				Name:    "inspect",
-				Usage:   "Inspect a service",
-				Action:  app.inspectService,
+			reloadPolicyCommand(app),
+			rebalancePolicyCommand(app),
+			disruptionBudgetCommand(app),
+			sloPolicyCommand(app),
+		),
+	}
+
+	// Add commands to CLI app
+	app.cliApp.Commands = append(app.cliApp.Commands, clusterCmd, nodeCmd, taskCmd, serviceCmd,
+		secretCommand(app, cluster.KindSecret), secretCommand(app, cluster.KindConfig), runAgentCommand(app))
+}
+
+// runAgentCommand runs this host as a worker of a cluster: it joins the
+// manager and runs the tasks the manager assigns to it until stopped.
+func runAgentCommand(app *App) *cli.Command {
+	return &cli.Command{
+		Name:  "agent",
+		Usage: "Join a cluster as a worker and run the tasks assigned to this node",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "manager",
+				Usage:    "Address of the manager to join (host:port)",
+				Required: true,
 			},
-			{
-				Name:    "rm",
-				Usage:   "Remove a service",
-				Aliases: []string{"remove"},
-				Action:  app.removeService,
+			&cli.StringFlag{
+				Name:     "join-token",
+				Usage:    "Join token",
+				Required: true,
 			},
-			{
-				Name:    "scale",
-				Usage:   "Scale a service",
-				Action:  app.scaleService,
+			&cli.StringFlag{
+				Name:     "advertise-addr",
+				Usage:    "Address the manager reaches this node at",
+				Required: true,
 			},
-			{
-				Name:    "ps",
-				Usage:   "List the tasks of a service",
-				Action:  app.serviceTasks,
+			&cli.IntFlag{
+				Name:  "advertise-port",
+				Usage: "Port the manager reaches this node at",
+				Value: 2377,
+			},
+			&cli.StringFlag{
+				Name:  "data-dir",
+				Usage: "Data directory",
+				Value: "/var/lib/mydocker/cluster",
 			},
 		},
+		Action: app.runAgent,
 	}
-
-	// Add commands to CLI app
-	app.cliApp.Commands = append(app.cliApp.Commands, clusterCmd, nodeCmd, taskCmd, serviceCmd)
 }
 
 // Cluster commands
@@ -258,7 +372,30 @@ func (a *App) initCluster(c *cli.Context) error {
 		DataDir:       c.String("data-dir"),
 	}
 
+	authConfig, err := authConfigFromFlags(c)
+	if err != nil {
+		return err
+	}
+
 	clusterMgr := cluster.GetClusterManager()
+	clusterMgr.Config.HeartbeatInterval = c.Duration("heartbeat-interval")
+	clusterMgr.Config.HeartbeatMisses = c.Int("heartbeat-misses")
+	clusterMgr.Config.SchedulingStrategy = c.String("scheduling-strategy")
+	clusterMgr.Config.JoinTokenTTL = c.Duration("join-token-ttl")
+	clusterMgr.Config.ForceNewCluster = c.Bool("force-new-cluster")
+	if err := clusterMgr.Auth.Configure(authConfig); err != nil {
+		return fmt.Errorf("failed to configure API authentication: %v", err)
+	}
+	if err := clusterMgr.SchedulerPlugins.Configure(schedulerPluginsFromFlags(c)); err != nil {
+		return fmt.Errorf("failed to configure scheduler plugins: %v", err)
+	}
+	clusterMgr.SetLocalPruner(a.pruneNode)
+	clusterMgr.SetLocalTaskRunner(a.runTask)
+	clusterMgr.SetLocalTaskInspector(a.inspectTaskContainer)
+	clusterMgr.SetLocalTaskStopper(a.stopTaskContainer)
+	clusterMgr.SetLocalOverlayDriver(overlayDriver{})
+	clusterMgr.SetLocalImageStore(&nodeImages{app: a})
+	clusterMgr.SetLocalUsageSampler(a.sampleTaskUsage)
 	if err := clusterMgr.Initialize(); err != nil {
 		return fmt.Errorf("failed to initialize cluster: %v", err)
 	}
@@ -266,22 +403,164 @@ func (a *App) initCluster(c *cli.Context) error {
 	fmt.Println("Cluster initialized successfully")
 	fmt.Printf("Cluster ID: %s\n", clusterMgr.ID)
 	fmt.Printf("Advertise address: %s:%d\n", config.AdvertiseAddr, config.AdvertisePort)
+	if providers := clusterMgr.Auth.Providers(); len(providers) > 0 {
+		fmt.Printf("Auth providers: %s\n", strings.Join(providers, ", "))
+	}
+	if plugins := clusterMgr.SchedulerPlugins.Names(); len(plugins) > 0 {
+		fmt.Printf("Scheduler plugins: %s\n", strings.Join(plugins, ", "))
+	}
+	fmt.Printf("Scheduling strategy: %s\n", clusterMgr.Config.SchedulingStrategy)
 
-	token, err := clusterMgr.GetJoinToken()
-	if err != nil {
-		logrus.Warnf("Failed to get join token: %v", err)
-	} else {
-		fmt.Printf("Join token: %s\n", token)
+	for _, role := range []cluster.NodeRole{cluster.RoleWorker, cluster.RoleManager} {
+		token, err := clusterMgr.GetJoinToken(role)
+		if err != nil {
+			logrus.Warnf("Failed to get %s join token: %v", role, err)
+			continue
+		}
+		fmt.Printf("Join token (%s): %s\n", role, token)
 	}
 
 	return nil
 }
 
+func joinTokenFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.DurationFlag{
+			Name:  "join-token-ttl",
+			Usage: "How long join tokens are good for (0 for no expiry)",
+		},
+	}
+}
+
+func joinTokenRoleFlag() cli.Flag {
+	return &cli.StringFlag{
+		Name:  "role",
+		Usage: "Role the token joins nodes as (worker/manager)",
+		Value: string(cluster.RoleWorker),
+	}
+}
+
+func forceNewClusterFlag() cli.Flag {
+	return &cli.BoolFlag{
+		Name:  "force-new-cluster",
+		Usage: "Take over the cluster from the replica of its state this manager holds, once the leader is lost",
+	}
+}
+
+func authFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "auth-htpasswd",
+			Usage: "Authenticate API users by basic auth against an htpasswd file",
+		},
+		&cli.StringFlag{
+			Name:  "oidc-issuer",
+			Usage: "Accept ID tokens of this OpenID Connect issuer as bearer tokens",
+		},
+		&cli.StringFlag{
+			Name:  "oidc-client-id",
+			Usage: "Client ID the ID tokens must be issued for",
+		},
+		&cli.StringFlag{
+			Name:  "oidc-username-claim",
+			Usage: "Claim naming the user",
+			Value: "sub",
+		},
+		&cli.StringFlag{
+			Name:  "oidc-groups-claim",
+			Usage: "Claim listing the user's groups",
+			Value: "groups",
+		},
+		&cli.StringSliceFlag{
+			Name:  "auth-role",
+			Usage: "Bind a user, or a group as group:NAME, to a role: viewer, operator or admin (e.g. group:sre=admin)",
+		},
+	}
+}
+
+func heartbeatFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.DurationFlag{
+			Name:  "heartbeat-interval",
+			Usage: "How often workers send the manager a heartbeat",
+			Value: 5 * time.Second,
+		},
+		&cli.IntFlag{
+			Name:  "heartbeat-misses",
+			Usage: "Heartbeats in a row a worker may miss before it is marked down and its tasks are rescheduled",
+			Value: 3,
+		},
+	}
+}
+
+func schedulerPluginFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "scheduler-plugin",
+			Usage: "Let an HTTP extender (http(s)://...) or a Go plugin (path to a .so) filter and score nodes when placing tasks",
+		},
+		&cli.DurationFlag{
+			Name:  "scheduler-plugin-timeout",
+			Usage: "Time a scheduler plugin has to answer before placement goes on without it",
+			Value: 2 * time.Second,
+		},
+		&cli.StringFlag{
+			Name:  "scheduling-strategy",
+			Usage: "How to rank the nodes that fit a task: spread (balance task counts), binpack (fill nodes) or random",
+			Value: cluster.StrategySpread,
+		},
+	}
+}
+
+func schedulerPluginsFromFlags(c *cli.Context) []cluster.SchedulerPluginConfig {
+	var configs []cluster.SchedulerPluginConfig
+	for _, location := range c.StringSlice("scheduler-plugin") {
+		config := cluster.SchedulerPluginConfig{Timeout: c.Duration("scheduler-plugin-timeout")}
+		if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+			config.URL = location
+		} else {
+			config.Path = location
+		}
+		configs = append(configs, config)
+	}
+	return configs
+}
+
+func authConfigFromFlags(c *cli.Context) (cluster.AuthConfig, error) {
+	config := cluster.AuthConfig{HtpasswdFile: c.String("auth-htpasswd")}
+	if issuer := c.String("oidc-issuer"); issuer != "" {
+		config.OIDC = &cluster.OIDCConfig{
+			IssuerURL:     issuer,
+			ClientID:      c.String("oidc-client-id"),
+			UsernameClaim: c.String("oidc-username-claim"),
+			GroupsClaim:   c.String("oidc-groups-claim"),
+		}
+	}
+	for _, binding := range c.StringSlice("auth-role") {
+		subject, role, ok := strings.Cut(binding, "=")
+		if !ok || subject == "" {
+			return config, fmt.Errorf("invalid --auth-role %q (expected SUBJECT=ROLE)", binding)
+		}
+		if config.Roles == nil {
+			config.Roles = make(map[string]cluster.APIRole)
+		}
+		config.Roles[subject] = cluster.APIRole(role)
+	}
+	return config, nil
+}
+
 func (a *App) joinCluster(c *cli.Context) error {
 	joinAddr := c.String("advertise-addr")
 	joinToken := c.String("join-token")
 
 	clusterMgr := cluster.GetClusterManager()
+	clusterMgr.SetLocalPruner(a.pruneNode)
+	clusterMgr.SetLocalTaskRunner(a.runTask)
+	clusterMgr.SetLocalTaskInspector(a.inspectTaskContainer)
+	clusterMgr.SetLocalTaskStopper(a.stopTaskContainer)
+	clusterMgr.SetLocalOverlayDriver(overlayDriver{})
+	clusterMgr.SetLocalImageStore(&nodeImages{app: a})
+	clusterMgr.SetLocalUsageSampler(a.sampleTaskUsage)
 	if err := clusterMgr.JoinCluster(joinAddr, joinToken); err != nil {
 		return fmt.Errorf("failed to join cluster: %v", err)
 	}
@@ -290,6 +569,36 @@ func (a *App) joinCluster(c *cli.Context) error {
 	return nil
 }
 
+// runAgent joins the cluster as a worker and runs the tasks the manager
+// assigns to this node until interrupted.
+func (a *App) runAgent(c *cli.Context) error {
+	managerAddr := c.String("manager")
+
+	clusterMgr := cluster.GetClusterManager()
+	clusterMgr.Config.AdvertiseAddr = c.String("advertise-addr")
+	clusterMgr.Config.AdvertisePort = c.Int("advertise-port")
+	clusterMgr.Config.DataDir = c.String("data-dir")
+	clusterMgr.SetLocalPruner(a.pruneNode)
+	clusterMgr.SetLocalTaskRunner(a.runTask)
+	clusterMgr.SetLocalTaskInspector(a.inspectTaskContainer)
+	clusterMgr.SetLocalTaskStopper(a.stopTaskContainer)
+	clusterMgr.SetLocalOverlayDriver(overlayDriver{})
+	clusterMgr.SetLocalImageStore(&nodeImages{app: a})
+	clusterMgr.SetLocalUsageSampler(a.sampleTaskUsage)
+	if err := clusterMgr.JoinCluster(managerAddr, c.String("join-token")); err != nil {
+		return fmt.Errorf("failed to join cluster: %v", err)
+	}
+
+	fmt.Printf("Agent %s running tasks for manager %s\n", clusterMgr.Identity.ID, managerAddr)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+
+	logrus.Infof("Stopping agent")
+	return clusterMgr.Shutdown()
+}
+
 func (a *App) leaveCluster(c *cli.Context) error {
 	force := c.Bool("force")
 
@@ -327,15 +636,15 @@ func (a *App) clusterStatus(c *cli.Context) error {
 	fmt.Printf("Workers: %d\n", status.Workers)
 	fmt.Printf("Active tasks: %d\n", status.ActiveTasks)
 	fmt.Printf("Completed tasks: %d\n", status.CompletedTasks)
-	fmt.Printf("Created at: %s\n", status.CreatedAt)
-	fmt.Printf("Updated at: %s\n", status.UpdatedAt)
+	fmt.Printf("Created at: %s\n", formatTime(status.CreatedAt))
+	fmt.Printf("Updated at: %s\n", formatTime(status.UpdatedAt))
 
 	return nil
 }
 
 func (a *App) createJoinToken(c *cli.Context) error {
 	clusterMgr := cluster.GetClusterManager()
-	token, err := clusterMgr.GetJoinToken()
+	token, err := clusterMgr.GetJoinToken(cluster.NodeRole(c.String("role")))
 	if err != nil {
 		return fmt.Errorf("failed to get join token: %v", err)
 	}
@@ -346,7 +655,7 @@ func (a *App) createJoinToken(c *cli.Context) error {
 
 func (a *App) rotateJoinToken(c *cli.Context) error {
 	clusterMgr := cluster.GetClusterManager()
-	token, err := clusterMgr.RotateJoinToken()
+	token, err := clusterMgr.RotateJoinToken(cluster.NodeRole(c.String("role")))
 	if err != nil {
 		return fmt.Errorf("failed to rotate join token: %v", err)
 	}
@@ -367,25 +676,652 @@ func (a *App) scaleCluster(c *cli.Context) error {
 	return nil
 }
 
+func (a *App) upgradeCluster(c *cli.Context) error {
+	clusterMgr := cluster.GetClusterManager()
+	report, err := clusterMgr.Upgrade(cluster.UpgradeOptions{
+		Version:       c.String("version"),
+		BatchSize:     c.Int("batch-size"),
+		HealthTimeout: c.Duration("timeout"),
+	})
+	if report != nil {
+		for _, id := range report.Upgraded {
+			fmt.Printf("Upgraded node %s\n", id)
+		}
+		if len(report.Skipped) > 0 {
+			fmt.Printf("%d node(s) already at %s\n", len(report.Skipped), report.Version)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to upgrade cluster: %v", err)
+	}
+
+	fmt.Printf("Cluster upgraded to %s\n", report.Version)
+	return nil
+}
+
+func (a *App) pruneCluster(c *cli.Context) error {
+	until, err := parsePruneFilters(c.StringSlice("filter"))
+	if err != nil {
+		return err
+	}
+
+	clusterMgr := cluster.GetClusterManager()
+	clusterMgr.SetLocalPruner(a.pruneNode)
+	report, err := clusterMgr.Prune(cluster.PrunePolicy{
+		Containers: true,
+		Images:     true,
+		AllImages:  c.Bool("all"),
+		Volumes:    c.Bool("volumes"),
+		Until:      until,
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to prune cluster: %v", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "NODE\tCONTAINERS\tIMAGES\tVOLUMES\tRECLAIMED\tERROR")
+	for _, result := range report.Nodes {
+		if result.Error != "" {
+			fmt.Fprintf(w, "%s\t-\t-\t-\t-\t%s\n", result.NodeID, result.Error)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\t\n", result.NodeID, result.ContainersDeleted,
+			result.ImagesDeleted, result.VolumesDeleted, humanSize(result.SpaceReclaimed))
+	}
+	w.Flush()
+
+	fmt.Printf("\nTotal reclaimed space: %s\n", humanSize(report.SpaceReclaimed))
+	if report.Failed > 0 {
+		return fmt.Errorf("prune failed on %d node(s)", report.Failed)
+	}
+	return nil
+}
+
+func (a *App) rebalanceCluster(c *cli.Context) error {
+	clusterMgr := cluster.GetClusterManager()
+	report := clusterMgr.Rebalancer.Rebalance()
+	if len(report.Moves) == 0 {
+		fmt.Println("Cluster is balanced, nothing to move")
+		return nil
+	}
+
+	failed := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "SERVICE\tTASK\tFROM\tTO\tERROR")
+	for _, move := range report.Moves {
+		if move.Error != "" {
+			failed++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", move.ServiceID, shortID(move.TaskID),
+			shortID(move.From), shortID(move.To), move.Error)
+	}
+	w.Flush()
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d move(s) failed", failed, len(report.Moves))
+	}
+	return nil
+}
+
+func rebalancePolicyCommand(a *App) *cli.Command {
+	return &cli.Command{
+		Name:      "rebalance-policy",
+		Usage:     "Allow a service's replicas to be moved onto underutilized nodes",
+		ArgsUsage: "SERVICE",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "enable",
+				Usage: "Enable or disable rebalancing (unset shows the current policy)",
+			},
+			&cli.IntFlag{
+				Name:  "max-moves",
+				Usage: "Replicas moved per rebalance round",
+				Value: 1,
+			},
+			&cli.DurationFlag{
+				Name:  "delay",
+				Usage: "Pause after each move",
+				Value: 10 * time.Second,
+			},
+		},
+		Action: a.serviceRebalancePolicy,
+	}
+}
+
+func (a *App) serviceRebalancePolicy(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("please specify a service ID")
+	}
+	serviceID := c.Args().First()
+
+	clusterMgr := cluster.GetClusterManager()
+	if !c.IsSet("enable") {
+		policy := clusterMgr.Rebalancer.GetPolicy(serviceID)
+		fmt.Printf("Enabled: %t\n", policy.Enabled)
+		if policy.Enabled {
+			fmt.Printf("Max moves: %d\n", policy.MaxMoves)
+			fmt.Printf("Delay: %s\n", policy.Delay)
+		}
+		return nil
+	}
+
+	policy := cluster.RebalancePolicy{
+		Enabled:  c.Bool("enable"),
+		MaxMoves: c.Int("max-moves"),
+		Delay:    c.Duration("delay"),
+	}
+	if err := clusterMgr.Rebalancer.SetPolicy(serviceID, policy); err != nil {
+		return fmt.Errorf("failed to set rebalance policy: %v", err)
+	}
+
+	if policy.Enabled {
+		fmt.Printf("Service %s will be rebalanced\n", serviceID)
+	} else {
+		fmt.Printf("Service %s will not be rebalanced\n", serviceID)
+	}
+	return nil
+}
+
+func disruptionBudgetCommand(a *App) *cli.Command {
+	return &cli.Command{
+		Name:      "budget",
+		Usage:     "Limit how many replicas drains, rebalancing and rolling restarts may take down",
+		ArgsUsage: "SERVICE",
+		Flags: []cli.Flag{
+			&cli.IntFlag{
+				Name:  "max-unavailable",
+				Usage: "Replicas that may be unavailable at once, 0 removes the budget (unset shows the current budget)",
+			},
+		},
+		Action: a.serviceDisruptionBudget,
+	}
+}
+
+func (a *App) serviceDisruptionBudget(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("please specify a service ID")
+	}
+	serviceID := c.Args().First()
+
+	clusterMgr := cluster.GetClusterManager()
+	if !c.IsSet("max-unavailable") {
+		if maxUnavailable := clusterMgr.Budgets.Get(serviceID); maxUnavailable > 0 {
+			fmt.Printf("Max unavailable: %d\n", maxUnavailable)
+		} else {
+			fmt.Println("No disruption budget")
+		}
+		return nil
+	}
+
+	maxUnavailable := c.Int("max-unavailable")
+	if err := clusterMgr.Budgets.Set(serviceID, maxUnavailable); err != nil {
+		return fmt.Errorf("failed to set disruption budget: %v", err)
+	}
+
+	if maxUnavailable > 0 {
+		fmt.Printf("Service %s allows %d unavailable replica(s) during disruptions\n", serviceID, maxUnavailable)
+	} else {
+		fmt.Printf("Removed the disruption budget of service %s\n", serviceID)
+	}
+	return nil
+}
+
+func sloPolicyCommand(a *App) *cli.Command {
+	return &cli.Command{
+		Name:      "slo",
+		Usage:     "Set the objective a service's task starts and health probes are held to",
+		ArgsUsage: "SERVICE",
+		Flags: []cli.Flag{
+			&cli.Float64Flag{
+				Name:  "objective",
+				Usage: "Share of task starts and probes that must succeed, e.g. 0.99; 0 removes the SLO (unset shows the current SLO)",
+			},
+			&cli.DurationFlag{
+				Name:  "window",
+				Usage: "Rolling window the objective is measured over",
+				Value: time.Hour,
+			},
+			&cli.BoolFlag{
+				Name:  "pause-updates",
+				Usage: "Pause rolling restarts and rebalancing while the error budget is exhausted",
+			},
+		},
+		Action: a.serviceSLOPolicy,
+	}
+}
+
+func (a *App) serviceSLOPolicy(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("please specify a service ID")
+	}
+	serviceID := c.Args().First()
+
+	clusterMgr := cluster.GetClusterManager()
+	if !c.IsSet("objective") {
+		policy := clusterMgr.SLOs.GetPolicy(serviceID)
+		if policy.Objective == 0 {
+			fmt.Println("No SLO")
+			return nil
+		}
+		fmt.Printf("Objective: %.4g%%\n", policy.Objective*100)
+		fmt.Printf("Window: %s\n", policy.Window)
+		fmt.Printf("Pause updates: %t\n", policy.PauseUpdates)
+		return nil
+	}
+
+	policy := cluster.SLOPolicy{
+		Objective:    c.Float64("objective"),
+		Window:       c.Duration("window"),
+		PauseUpdates: c.Bool("pause-updates"),
+	}
+	if err := clusterMgr.SLOs.SetPolicy(serviceID, policy); err != nil {
+		return fmt.Errorf("failed to set SLO: %v", err)
+	}
+
+	if policy.Objective > 0 {
+		fmt.Printf("Service %s has an objective of %.4g%% over %s\n", serviceID, policy.Objective*100, policy.Window)
+	} else {
+		fmt.Printf("Removed the SLO of service %s\n", serviceID)
+	}
+	return nil
+}
+
+func (a *App) serviceStatus(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("please specify a service ID")
+	}
+
+	clusterMgr := cluster.GetClusterManager()
+	status := clusterMgr.SLOs.Status(c.Args().First())
+	if ok, err := printFormatted(c, status); ok {
+		return err
+	}
+
+	fmt.Printf("Service: %s\n", status.ServiceID)
+	fmt.Printf("Window: %s\n", status.Window)
+	fmt.Printf("Task starts: %d\n", status.TaskStarts)
+	fmt.Printf("Task failures: %d\n", status.TaskFailures)
+	fmt.Printf("Health probes: %d (%d failed)\n", status.ProbeChecks, status.ProbeFailures)
+	fmt.Printf("Restarts: %d\n", status.Restarts)
+	fmt.Printf("Failure rate: %.2f%%\n", status.FailureRate*100)
+	if status.Objective > 0 {
+		fmt.Printf("Objective: %.4g%%\n", status.Objective*100)
+		fmt.Printf("Error budget remaining: %.1f%%\n", status.BudgetRemaining*100)
+		if status.UpdatesPaused {
+			fmt.Println("Automatic updates: paused (error budget exhausted)")
+		} else if status.Exhausted {
+			fmt.Println("Error budget exhausted")
+		}
+	}
+	return nil
+}
+
+func (a *App) serviceRecommend(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("please specify a service")
+	}
+
+	clusterMgr := cluster.GetClusterManager()
+	rec, err := clusterMgr.Usage.Recommend(c.Args().First())
+	if err != nil {
+		return err
+	}
+	if ok, err := printFormatted(c, rec); ok {
+		return err
+	}
+
+	fmt.Printf("Service: %s\n", rec.ServiceID)
+	fmt.Printf("Usage since %s: %d samples from %d tasks\n\n", formatTime(rec.Since), rec.Samples, rec.Tasks)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "RESOURCE\tCURRENT\tP50\tP95\tP99\tMAX\tRESERVATION\tLIMIT")
+	cpu := func(millicores int64) string { return fmt.Sprintf("%dm", millicores) }
+	for _, row := range []struct {
+		name   string
+		rec    cluster.ResourceRecommendation
+		format func(int64) string
+	}{
+		{"cpu", rec.CPU, cpu},
+		{"memory", rec.Memory, humanSize},
+	} {
+		current := "-"
+		if row.rec.Current > 0 {
+			current = row.format(row.rec.Current)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", row.name, current,
+			row.format(row.rec.Usage.P50), row.format(row.rec.Usage.P95), row.format(row.rec.Usage.P99),
+			row.format(row.rec.Usage.Max), row.format(row.rec.Reservation), row.format(row.rec.Limit))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if rec.CPU.Reclaimable > 0 || rec.Memory.Reclaimable > 0 {
+		fmt.Printf("\nReserving the recommendation frees %s CPU and %s memory across running tasks\n",
+			cpu(rec.CPU.Reclaimable), humanSize(rec.Memory.Reclaimable))
+	}
+	return nil
+}
+
+// sampleTaskUsage reads the usage of a local task's container for the
+// cluster's recommendations.
+func (a *App) sampleTaskUsage(task *cluster.Task) (*cluster.TaskUsage, error) {
+	container, err := a.containerMgr.ResolveContainer(task.ContainerName())
+	if err != nil {
+		return nil, err
+	}
+	cpuTime, memory, err := a.containerMgr.ResourceUsage(container.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &cluster.TaskUsage{CPUTime: cpuTime, Memory: memory}, nil
+}
+
+func agentCommand(a *App) *cli.Command {
+	return &cli.Command{
+		Name:  "agent",
+		Usage: "Manage the agents running on cluster nodes",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "update",
+				Usage: "Update every node's agent from a signed agent image",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "image",
+						Usage:    "Agent image (e.g. mydocker/agent:v2)",
+						Required: true,
+					},
+					&cli.IntFlag{
+						Name:  "batch-size",
+						Usage: "Number of workers updated at a time",
+						Value: 1,
+					},
+					&cli.DurationFlag{
+						Name:  "timeout",
+						Usage: "How long each agent has to come back at the new version",
+						Value: 2 * time.Minute,
+					},
+				},
+				Action: a.updateAgents,
+			},
+		},
+	}
+}
+
+func (a *App) updateAgents(c *cli.Context) error {
+	clusterMgr := cluster.GetClusterManager()
+	report, err := clusterMgr.UpdateAgents(cluster.AgentUpdateOptions{
+		Image:         c.String("image"),
+		BatchSize:     c.Int("batch-size"),
+		HealthTimeout: c.Duration("timeout"),
+	})
+	if report != nil {
+		for _, id := range report.Upgraded {
+			fmt.Printf("Updated agent on node %s\n", id)
+		}
+		if len(report.Skipped) > 0 {
+			fmt.Printf("%d node(s) already run agent %s\n", len(report.Skipped), report.Version)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update agents: %v", err)
+	}
+
+	fmt.Printf("Agents updated to %s\n", report.Version)
+	return nil
+}
+
+// resolveAgentImage pulls an agent image for the cluster, which checks
+// its signature when the registry is under the signature policy.
+func (a *App) resolveAgentImage(ref string) (*cluster.AgentImage, error) {
+	parsed, err := reference.ParseNormalized(ref)
+	if err != nil {
+		return nil, err
+	}
+	img, err := a.imageMgr.PullReference(parsed, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to pull agent image: %v", err)
+	}
+
+	version := img.Labels[cluster.AgentVersionLabel]
+	if version == "" {
+		version = parsed.Tag
+	}
+	return &cluster.AgentImage{
+		Ref:      ref,
+		Version:  version,
+		Labels:   img.Labels,
+		SignedBy: img.SignedBy,
+	}, nil
+}
+
+// runTask starts a task scheduled on this node as a container labeled
+// with the task's cluster metadata.
+func (a *App) runTask(task *cluster.Task) error {
+	img, err := a.resolveImageForRun(task.Image, "")
+	if err != nil {
+		return err
+	}
+	hostname, err := task.Hostname()
+	if err != nil {
+		return err
+	}
+
+	// Ports without a published port are published on any free one
+	var portBindings map[string][]types.PortBinding
+	for _, port := range task.Ports {
+		if portBindings == nil {
+			portBindings = make(map[string][]types.PortBinding)
+		}
+		binding := types.PortBinding{}
+		if port.PublishedPort != 0 {
+			binding.HostPort = strconv.Itoa(port.PublishedPort)
+		}
+		protocol := port.Protocol
+		if protocol == "" {
+			protocol = "tcp"
+		}
+		key := fmt.Sprintf("%d/%s", port.TargetPort, protocol)
+		portBindings[key] = append(portBindings[key], binding)
+	}
+
+	container, err := a.containerMgr.CreateContainer(types.ContainerCreateOptions{
+		Name: task.ContainerName(),
+		Config: types.ContainerConfig{
+			Image:    img.ID,
+			Hostname: hostname,
+			Cmd:      task.Command,
+			Env:      task.ContainerEnv(),
+			Labels:   task.ContainerLabels(),
+		},
+		HostConfig: types.HostConfig{
+			PortBindings: portBindings,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create container for task %s: %v", task.ID, err)
+	}
+	if err := a.containerMgr.StartContainer(container.ID); err != nil {
+		return fmt.Errorf("failed to start container for task %s: %v", task.ID, err)
+	}
+	for _, n := range task.Networks {
+		var aliases []string
+		if n.Alias != "" {
+			aliases = []string{n.Alias}
+		}
+		if _, err := network.GetNetworkManager().ConnectContainer(n.Target, container.ID, container.Name, n.Address, aliases); err != nil {
+			return fmt.Errorf("failed to connect task %s to network %s: %v", task.ID, n.Target, err)
+		}
+	}
+	return nil
+}
+
+// inspectTaskContainer reports how the container of a task started by
+// runTask is doing.
+func (a *App) inspectTaskContainer(task *cluster.Task) (*cluster.TaskStatusReport, error) {
+	container, err := a.containerMgr.ResolveContainer(task.ContainerName())
+	if err != nil {
+		return nil, err
+	}
+
+	switch container.Status {
+	case types.StatusExited, types.StatusStopped, types.StatusDead:
+		if container.ExitCode == 0 && container.Status != types.StatusDead {
+			return &cluster.TaskStatusReport{Status: cluster.TaskComplete}, nil
+		}
+		message := container.Error
+		if message == "" {
+			message = fmt.Sprintf("container exited with code %d", container.ExitCode)
+		}
+		return &cluster.TaskStatusReport{Status: cluster.TaskFailed, Error: message}, nil
+	default:
+		return &cluster.TaskStatusReport{Status: cluster.TaskRunning}, nil
+	}
+}
+
+// overlayDriver creates the overlay networks of the cluster on this node
+// when a task on them lands here.
+type overlayDriver struct{}
+
+func (overlayDriver) EnsureNetwork(overlay *cluster.OverlayNetwork) error {
+	existing, err := network.GetNetworkManager().GetNetwork(overlay.Name)
+	if err == nil {
+		if existing.Driver != network.OverlayDriver || existing.VNI != overlay.VNI || existing.Subnet != overlay.Subnet {
+			return fmt.Errorf("network %s already exists on this node and isn't the cluster's", overlay.Name)
+		}
+		return nil
+	}
+	_, err = network.GetNetworkManager().CreateNetwork(network.CreateNetworkOptions{
+		Name:    overlay.Name,
+		Driver:  network.OverlayDriver,
+		Subnet:  overlay.Subnet,
+		Gateway: overlay.Gateway,
+		VNI:     overlay.VNI,
+		Labels:  overlay.Labels,
+	})
+	return err
+}
+
+func (overlayDriver) SyncPeers(overlay *cluster.OverlayNetwork, peers []cluster.OverlayEndpoint) error {
+	remote := make([]network.RemoteEndpoint, 0, len(peers))
+	for _, peer := range peers {
+		remote = append(remote, network.RemoteEndpoint{
+			Name:      peer.TaskName,
+			IPAddress: peer.IPAddress,
+			VTEP:      peer.VTEP,
+		})
+	}
+	return network.GetNetworkManager().SyncOverlayPeers(overlay.Name, remote)
+}
+
+// pruneNode is this node's share of a cluster prune: stopped containers
+// go first so the images they held can be pruned too.
+func (a *App) pruneNode(policy cluster.PrunePolicy) (*cluster.NodePruneResult, error) {
+	result := &cluster.NodePruneResult{}
+	cutoff := time.Now().Add(-policy.Until)
+
+	containers, err := a.containerMgr.ListContainers(types.ContainerListOptions{All: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %v", err)
+	}
+
+	inUse := make(map[string]bool, len(containers))
+	for _, container := range containers {
+		removable := policy.Containers && container.Status != types.StatusRunning &&
+			container.Status != types.StatusPaused && container.Status != types.StatusRestarting &&
+			(policy.Until <= 0 || container.CreatedAt.Before(cutoff))
+		if !removable {
+			inUse[container.Image] = true
+			continue
+		}
+
+		size := diskUsage(filepath.Join(a.store.GetContainersDir(), container.ID))
+		if err := a.containerMgr.RemoveContainer(container.ID, types.ContainerRemoveOptions{}); err != nil {
+			logrus.Warnf("Failed to remove container %s: %v", container.ID, err)
+			inUse[container.Image] = true
+			continue
+		}
+		result.ContainersDeleted++
+		result.SpaceReclaimed += size
+	}
+
+	if policy.Images {
+		report, err := a.imageMgr.PruneImages(types.ImagePruneOptions{All: policy.AllImages, Until: policy.Until}, inUse)
+		if err != nil {
+			return nil, fmt.Errorf("failed to prune images: %v", err)
+		}
+		result.ImagesDeleted = len(report.ImagesDeleted)
+		result.SpaceReclaimed += report.SpaceReclaimed
+	}
+
+	if policy.Volumes {
+		volumeMgr, err := storage.NewVolumeManager(filepath.Join(a.store.GetDataDir(), "volumes"))
+		if err != nil {
+			return nil, err
+		}
+		before, _ := volumeMgr.ListVolumes()
+		reclaimed, err := volumeMgr.PruneVolumes()
+		if err != nil {
+			return nil, fmt.Errorf("failed to prune volumes: %v", err)
+		}
+		after, _ := volumeMgr.ListVolumes()
+		result.VolumesDeleted = len(before) - len(after)
+		result.SpaceReclaimed += reclaimed
+	}
+
+	return result, nil
+}
+
+func diskUsage(root string) int64 {
+	var size int64
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
 // Node commands
 func (a *App) listNodes(c *cli.Context) error {
-	clusterMgr := cluster.GetClusterManager()
-	nodes, err := clusterMgr.NodeManager.ListNodes()
+	created, err := timeRangeFromFlags(c)
 	if err != nil {
-		return fmt.Errorf("failed to list nodes: %v", err)
+		return err
 	}
+	filter := cluster.NodeFilter{Created: created}
 
 	fmt.Printf("%-12s %-15s %-8s %-10s %-10s\n", "ID", "NAME", "STATUS", "ROLE", "ADDRESS")
 	fmt.Println("----------------------------------------------------")
 
-	for _, node := range nodes {
+	printNode := func(node *cluster.Node) error {
 		fmt.Printf("%-12s %-15s %-8s %-10s %-15s:%d\n",
-			node.ID[:12],
+			shortID(node.ID),
 			node.Name,
 			node.Status,
 			node.Role,
 			node.Address,
 			node.Port)
+		return nil
+	}
+
+	// Rows are printed as they arrive from a remote manager
+	if client := clusterListClient(c); client != nil {
+		if err := client.StreamNodes(filter, printNode); err != nil {
+			return fmt.Errorf("failed to list nodes: %v", err)
+		}
+		return nil
+	}
+
+	clusterMgr := cluster.GetClusterManager()
+	nodes, err := clusterMgr.NodeManager.ListNodes()
+	if err != nil {
+		return fmt.Errorf("failed to list nodes: %v", err)
+	}
+	for _, node := range nodes {
+		if filter.Created.Contains(node.CreatedAt) {
+			printNode(node)
+		}
 	}
 
 	return nil
@@ -438,6 +1374,29 @@ func (a *App) updateNode(c *cli.Context) error {
 
 	clusterMgr := cluster.GetClusterManager()
 
+	// Update labels if specified
+	if c.IsSet("label-add") || c.IsSet("label-rm") {
+		node, err := clusterMgr.NodeManager.GetNode(nodeID)
+		if err != nil {
+			return fmt.Errorf("failed to get node: %v", err)
+		}
+		labels := make(map[string]string)
+		for key, value := range node.Labels {
+			labels[key] = value
+		}
+		for _, key := range c.StringSlice("label-rm") {
+			delete(labels, key)
+		}
+		for _, label := range c.StringSlice("label-add") {
+			key, value, _ := strings.Cut(label, "=")
+			labels[key] = value
+		}
+		if err := clusterMgr.NodeManager.SetNodeLabels(nodeID, labels); err != nil {
+			return fmt.Errorf("failed to update node labels: %v", err)
+		}
+		fmt.Printf("Updated node %s labels\n", nodeID)
+	}
+
 	// Update role if specified
 	if role := c.String("role"); role != "" {
 		// In real implementation, this would update node role
@@ -456,6 +1415,18 @@ func (a *App) updateNode(c *cli.Context) error {
 			if err := clusterMgr.NodeManager.DrainNode(nodeID); err != nil {
 				return fmt.Errorf("failed to drain node: %v", err)
 			}
+			if !c.Bool("wait") {
+				fmt.Printf("Node %s draining\n", nodeID)
+				break
+			}
+			fmt.Printf("Waiting for node %s to drain...\n", nodeID)
+			status, err := clusterMgr.WaitForDrain(nodeID, c.Duration("timeout"))
+			if err != nil {
+				if status != nil {
+					printDrainStatus(status)
+				}
+				return err
+			}
 			fmt.Printf("Node %s drained\n", nodeID)
 		default:
 			return fmt.Errorf("invalid availability: %s", availability)
@@ -465,6 +1436,38 @@ func (a *App) updateNode(c *cli.Context) error {
 	return nil
 }
 
+func (a *App) nodeDrainStatus(c *cli.Context) error {
+	if c.Args().Len() < 1 {
+		return fmt.Errorf("please specify a node ID")
+	}
+
+	clusterMgr := cluster.GetClusterManager()
+	status, err := clusterMgr.DrainStatus(c.Args().First())
+	if err != nil {
+		return fmt.Errorf("failed to get drain status: %v", err)
+	}
+
+	switch {
+	case status.Status != cluster.StatusDraining:
+		fmt.Printf("Node %s is not draining (status %s)\n", status.NodeID, status.Status)
+	case status.Complete:
+		fmt.Printf("Node %s drained\n", status.NodeID)
+	default:
+		fmt.Printf("Node %s draining: %d tasks remaining, %d rescheduling\n", status.NodeID, len(status.Remaining), len(status.Rescheduling))
+	}
+	printDrainStatus(status)
+	return nil
+}
+
+func printDrainStatus(status *cluster.DrainStatus) {
+	for _, task := range status.Remaining {
+		fmt.Printf("  remaining: %s (%s)\n", task.ID, task.Status)
+	}
+	for _, task := range status.Rescheduling {
+		fmt.Printf("  rescheduling: %s on %s (%s)\n", task.ID, task.NodeID, task.Status)
+	}
+}
+
 func (a *App) nodeTasks(c *cli.Context) error {
 	if c.Args().Len() < 1 {
 		return fmt.Errorf("please specify a node ID")
@@ -494,40 +1497,90 @@ func (a *App) nodeTasks(c *cli.Context) error {
 
 // Task commands
 func (a *App) listTasks(c *cli.Context) error {
-	clusterMgr := cluster.GetClusterManager()
-	tasks, err := clusterMgr.TaskManager.ListTasks()
+	created, err := timeRangeFromFlags(c)
 	if err != nil {
-		return fmt.Errorf("failed to list tasks: %v", err)
+		return err
+	}
+	filter := cluster.TaskFilter{
+		NodeID:  c.String("node"),
+		Status:  cluster.TaskStatus(c.String("status")),
+		Created: created,
 	}
-
-	// Apply filters
-	nodeFilter := c.String("node")
-	statusFilter := c.String("status")
 
 	fmt.Printf("%-12s %-15s %-10s %-15s\n", "ID", "NAME", "STATUS", "NODE")
 	fmt.Println("----------------------------------------")
 
+	printTask := func(task *cluster.Task) error {
+		fmt.Printf("%-12s %-15s %-10s %-15s\n",
+			shortID(task.ID),
+			task.Name,
+			task.Status,
+			shortID(task.NodeID))
+		return nil
+	}
+
+	// Remote managers apply the filter before sending anything
+	if client := clusterListClient(c); client != nil {
+		if err := client.StreamTasks(filter, printTask); err != nil {
+			return fmt.Errorf("failed to list tasks: %v", err)
+		}
+		return nil
+	}
+
+	clusterMgr := cluster.GetClusterManager()
+	tasks, err := clusterMgr.TaskManager.ListTasks()
+	if err != nil {
+		return fmt.Errorf("failed to list tasks: %v", err)
+	}
+
 	for _, task := range tasks {
-		// Apply node filter
-		if nodeFilter != "" && task.NodeID != nodeFilter {
+		if filter.NodeID != "" && task.NodeID != filter.NodeID {
 			continue
 		}
-
-		// Apply status filter
-		if statusFilter != "" && string(task.Status) != statusFilter {
+		if filter.Status != "" && task.Status != filter.Status {
 			continue
 		}
-
-		fmt.Printf("%-12s %-15s %-10s %-15s\n",
-			task.ID[:12],
-			task.Name,
-			task.Status,
-			task.NodeID[:12])
+		if !filter.Created.Contains(task.CreatedAt) {
+			continue
+		}
+		printTask(task)
 	}
 
 	return nil
 }
 
+// clusterListFlags select a remote manager to stream lists from instead
+// of the local cluster state.
+func clusterListFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    "host",
+			Usage:   "Manager API address (host:port) to list from",
+			EnvVars: []string{"MYDOCKER_CLUSTER_HOST"},
+		},
+		&cli.StringFlag{
+			Name:    "token",
+			Usage:   "Cluster token for the manager API",
+			EnvVars: []string{"MYDOCKER_CLUSTER_TOKEN"},
+		},
+		&cli.BoolFlag{
+			Name:  "protobuf",
+			Usage: "Stream the list as protobuf instead of NDJSON",
+		},
+	}
+}
+
+func clusterListClient(c *cli.Context) *cluster.ListClient {
+	if c.String("host") == "" {
+		return nil
+	}
+	client := cluster.NewListClient(c.String("host"), c.String("token"))
+	if c.Bool("protobuf") {
+		client.ContentType = cluster.ContentTypeProtobuf
+	}
+	return client
+}
+
 func (a *App) inspectTask(c *cli.Context) error {
 	if c.Args().Len() < 1 {
 		return fmt.Errorf("please specify a task ID")
@@ -578,42 +1631,4 @@ func (a *App) taskLogs(c *cli.Context) error {
 	fmt.Println("Task logs not implemented yet")
 
 	return nil
-}
-
-// Service commands (placeholders)
-func (a *App) listServices(c *cli.Context) error {
-	fmt.Println("No services found")
-	return nil
-}
-
-func (a *App) createService(c *cli.Context) error {
-	return fmt.Errorf("service creation not implemented yet")
-}
-
-func (a *App) inspectService(c *cli.Context) error {
-	if c.Args().Len() < 1 {
-		return fmt.Errorf("please specify a service ID")
-	}
-	return fmt.Errorf("service inspection not implemented yet")
-}
-
-func (a *App) removeService(c *cli.Context) error {
-	if c.Args().Len() < 1 {
-		return fmt.Errorf("please specify a service ID")
-	}
-	return fmt.Errorf("service removal not implemented yet")
-}
-
-func (a *App) scaleService(c *cli.Context) error {
-	if c.Args().Len() < 1 {
-		return fmt.Errorf("please specify a service ID")
-	}
-	return fmt.Errorf("service scaling not implemented yet")
-}
-
-func (a *App) serviceTasks(c *cli.Context) error {
-	if c.Args().Len() < 1 {
-		return fmt.Errorf("please specify a service ID")
-	}
-	return fmt.Errorf("service tasks listing not implemented yet")
 }
\ No newline at end of file
@@ -1,17 +1,22 @@
 package cli
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
-	"text/tabwriter"
+	"path/filepath"
+	"time"
 
 	"github.com/urfave/cli/v2"
 	"github.com/sirupsen/logrus"
+	"docker-impl/pkg/cluster"
+	"docker-impl/pkg/config"
 	"docker-impl/pkg/container"
 	"docker-impl/pkg/image"
+	"docker-impl/pkg/network"
+	"docker-impl/pkg/performance"
+	"docker-impl/pkg/storage"
 	"docker-impl/pkg/store"
-	"docker-impl/pkg/types"
+	"docker-impl/pkg/telemetry"
 )
 
 type App struct {
@@ -19,6 +24,13 @@ type App struct {
 	store        *store.Store
 	imageMgr     *image.Manager
 	containerMgr *container.Manager
+	storageMgr   *storage.StorageManager
+	telemetry    *telemetry.Recorder
+	prefetcher   *performance.PrefetchManager
+	// prefetchWorkers is the number of workers enableLazyPull starts
+	prefetchWorkers int
+	// ipv6 publishes ports on IPv6 as well as IPv4
+	ipv6 bool
 }
 
 func New() (*App, error) {
@@ -30,10 +42,74 @@ func New() (*App, error) {
 	imageMgr := image.NewManager(store)
 	containerMgr := container.NewManager(store, imageMgr)
 
+	daemonConfig, err := config.Load("")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load daemon config: %v", err)
+	}
+
+	storageMgr, err := storage.NewStorageManager(&storage.StorageConfig{
+		RootDir:              filepath.Join(store.GetDataDir(), "storage"),
+		OverlayDriver:        daemonConfig.StorageDriver,
+		VolumeDriver:         daemonConfig.VolumeDriver,
+		EnableQuotas:         daemonConfig.StorageQuotas,
+		EnableEncryption:     daemonConfig.StorageEncryption,
+		EncryptionKeyFile:    daemonConfig.EncryptionKeyFile,
+		EncryptionKeyCommand: daemonConfig.EncryptionKeyCommand,
+		EncryptLayers:        daemonConfig.EncryptLayers,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage manager: %v", err)
+	}
+	containerMgr.SetStorage(storageMgr)
+	network.Configure(network.NetworkConfig{
+		Mode:          network.NetworkModeBridge,
+		EnableIPv6:    daemonConfig.IPv6,
+		IPv6Subnet:    daemonConfig.FixedCIDRv6,
+		UserlandProxy: daemonConfig.UserlandProxy,
+	})
+	containerMgr.SetNetwork(network.GetNetworkManager)
+
+	containerMgr.SetDefaultHooks(daemonConfig.Hooks)
+	containerMgr.SetCrashLoopPolicy(daemonConfig.CrashLoopThreshold, time.Duration(daemonConfig.CrashLoopWindow)*time.Second)
+	if err := containerMgr.RecoverContainers(); err != nil {
+		logrus.Warnf("Failed to recover container states: %v", err)
+	}
+	if daemonConfig.Registry != "" {
+		registry := image.NewRegistryClient(daemonConfig.Registry)
+		registry.SetMirrors(daemonConfig.RegistryMirrors)
+		registry.SetRetryPolicy(image.RetryPolicy{
+			Attempts:   daemonConfig.RegistryAttempts,
+			MaxBackoff: time.Duration(daemonConfig.RegistryMaxBackoff) * time.Second,
+		})
+		if daemonConfig.BlobCache != "" {
+			cache, err := image.NewBlobCache(daemonConfig.BlobCache, daemonConfig.BlobCacheSize)
+			if err != nil {
+				return nil, err
+			}
+			registry.SetCache(cache)
+		}
+		imageMgr.SetRegistry(registry)
+	}
+	if daemonConfig.SignaturePolicy != "" {
+		policy, err := image.LoadTrustPolicy(daemonConfig.SignaturePolicy)
+		if err != nil {
+			return nil, err
+		}
+		imageMgr.SetTrustPolicy(policy)
+		imageMgr.SetTrustCacheTTL(time.Duration(daemonConfig.TrustCacheTTL) * time.Second)
+		imageMgr.SetTrustOffline(daemonConfig.TrustOffline)
+	}
+
 	app := &App{
-		store:        store,
-		imageMgr:     imageMgr,
-		containerMgr: containerMgr,
+		store:           store,
+		imageMgr:        imageMgr,
+		containerMgr:    containerMgr,
+		storageMgr:      storageMgr,
+		prefetchWorkers: daemonConfig.PrefetchWorkers,
+		ipv6:            daemonConfig.IPv6,
+	}
+	if daemonConfig.LazyPull {
+		app.enableLazyPull()
 	}
 
 	app.cliApp = &cli.App{
@@ -44,11 +120,23 @@ func New() (*App, error) {
 			app.createImageCommands(),
 			app.createContainerCommands(),
 			app.createSystemCommands(),
+			app.createNetworkCommands(),
+			app.createComposeCommands(),
+			app.createDevCommands(),
+			app.createStorageCommands(),
+			app.createVolumeCommands(),
+			app.createSearchCommands(),
 		},
 	}
 
 	// Add cluster commands
 	app.addClusterCommands()
+	cluster.GetClusterManager().SetAgentImageResolver(app.resolveAgentImage)
+
+	if daemonConfig.Telemetry || os.Getenv("MYDOCKER_TELEMETRY") == "1" {
+		app.telemetry = telemetry.NewRecorder(app.telemetryPath())
+		app.instrumentCommands(app.cliApp.Commands, "")
+	}
 
 	return app, nil
 }
@@ -72,6 +160,25 @@ func (app *App) createImageCommands() *cli.Command {
 						Usage: "Image tag",
 						Value: "latest",
 					},
+					&cli.StringFlag{
+						Name:  "platform",
+						Usage: "Pull the image for a specific platform (os/arch[/variant])",
+					},
+					offlineFlag(),
+					&cli.BoolFlag{
+						Name:  "lazy",
+						Usage: "Only fetch the table of contents and startup files of eStargz layers; fetch the rest when read",
+					},
+					&cli.StringFlag{
+						Name:    "file",
+						Usage:   "Pull the images listed in a file, one reference per line (- for stdin)",
+						Aliases: []string{"f"},
+					},
+					&cli.IntFlag{
+						Name:  "parallel",
+						Usage: "Number of images pulled at once with --file",
+						Value: image.DefaultPullParallelism,
+					},
 				},
 				Action: app.pullImage,
 			},
@@ -82,10 +189,127 @@ func (app *App) createImageCommands() *cli.Command {
 				Action:  app.listImages,
 			},
 			{
-				Name:    "remove",
-				Usage:   "Remove an image",
-				Aliases: []string{"rm"},
-				Action:  app.removeImage,
+				Name:      "remove",
+				Usage:     "Remove one or more images, or untag them when given a tag",
+				Aliases:   []string{"rm"},
+				ArgsUsage: "IMAGE [IMAGE...]",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:    "force",
+						Aliases: []string{"f"},
+						Usage:   "Remove an image by ID even if it is tagged in several repositories",
+					},
+				},
+				Action: app.removeImage,
+			},
+			{
+				Name:      "tag",
+				Usage:     "Add one or more tags to an image",
+				ArgsUsage: "SOURCE_IMAGE TARGET_IMAGE[:TAG] [TARGET_IMAGE[:TAG]...]",
+				Action:    app.tagImage,
+			},
+			{
+				Name:      "untag",
+				Usage:     "Remove tags from images without removing the images",
+				ArgsUsage: "IMAGE[:TAG] [IMAGE[:TAG]...]",
+				Action:    app.untagImage,
+			},
+			{
+				Name:      "verify",
+				Usage:     "Verify the signatures of local images against the trust policy",
+				ArgsUsage: "IMAGE [IMAGE...]",
+				Flags: []cli.Flag{
+					offlineFlag(),
+				},
+				Action: app.verifyImage,
+			},
+			{
+				Name:  "prune",
+				Usage: "Remove dangling images",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:    "all",
+						Aliases: []string{"a"},
+						Usage:   "Remove all images not used by a container, not just dangling ones",
+					},
+					&cli.StringSliceFlag{
+						Name:  "filter",
+						Usage: "Filter images to remove (until=<duration>)",
+					},
+				},
+				Action: app.pruneImages,
+			},
+			{
+				Name:      "inspect",
+				Usage:     "Display detailed information on one or more images",
+				ArgsUsage: "IMAGE [IMAGE...]",
+				Action:    app.inspectImage,
+			},
+			{
+				Name:      "history",
+				Usage:     "Show the history of an image",
+				ArgsUsage: "IMAGE",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "no-trunc",
+						Usage: "Don't truncate output",
+					},
+				},
+				Action: app.imageHistory,
+			},
+			{
+				Name:      "scan",
+				Usage:     "Scan an image for known vulnerabilities",
+				ArgsUsage: "IMAGE",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "severity",
+						Usage: "Only report vulnerabilities of this severity or higher (low, medium, high, critical)",
+					},
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "Print the report as JSON",
+					},
+					&cli.BoolFlag{
+						Name:  "update-db",
+						Usage: "Download the vulnerability database before scanning",
+					},
+					&cli.StringFlag{
+						Name:  "scanner",
+						Usage: "Scan with an external program instead of the built-in scanner",
+					},
+				},
+				Action: app.scanImage,
+			},
+			{
+				Name:      "save",
+				Usage:     "Save one or more images to a tar archive or OCI layout",
+				ArgsUsage: "IMAGE [IMAGE...]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "Write to a file (or, for --format oci, a directory) instead of STDOUT",
+					},
+					&cli.StringFlag{
+						Name:  "format",
+						Usage: "Archive format (docker-archive or oci)",
+						Value: "docker-archive",
+					},
+				},
+				Action: app.saveImages,
+			},
+			{
+				Name:  "load",
+				Usage: "Load images from a tar archive or OCI layout",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "input",
+						Aliases: []string{"i"},
+						Usage:   "Read from a tar archive or OCI layout directory instead of STDIN",
+					},
+				},
+				Action: app.loadImages,
 			},
 			{
 				Name:    "build",
@@ -101,8 +325,42 @@ func (app *App) createImageCommands() *cli.Command {
 						Usage: "Name of the Dockerfile",
 						Value: "Dockerfile",
 					},
+					&cli.BoolFlag{
+						Name:  "no-cache",
+						Usage: "Do not use cache when building the image",
+					},
+					&cli.StringFlag{
+						Name:  "target",
+						Usage: "Set the target build stage to build",
+					},
+					&cli.StringSliceFlag{
+						Name:  "build-arg",
+						Usage: "Set build-time variables (KEY=value, or KEY to take it from the environment)",
+					},
+					&cli.BoolFlag{
+						Name:  "squash",
+						Usage: "Merge the layers added by the build into a single layer",
+					},
+					&cli.StringFlag{
+						Name:  "progress",
+						Usage: "Set the type of progress output (plain, json)",
+						Value: "plain",
+					},
 				},
 			},
+			{
+				Name:      "flatten",
+				Usage:     "Combine all layers of an image into a single layer",
+				ArgsUsage: "IMAGE",
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{
+						Name:    "tag",
+						Aliases: []string{"t"},
+						Usage:   "Name the flattened image in the 'name:tag' format",
+					},
+				},
+				Action: app.flattenImage,
+			},
 		},
 	}
 }
@@ -116,55 +374,43 @@ func (app *App) createContainerCommands() *cli.Command {
 				Name:    "run",
 				Usage:   "Run a command in a new container",
 				Aliases: []string{"r"},
-				Flags: []cli.Flag{
-					&cli.StringFlag{
-						Name:  "name",
-						Usage: "Assign a name to the container",
-					},
-					&cli.StringFlag{
-						Name:  "network",
-						Usage: "Connect a container to a network",
-						Value: "bridge",
-					},
-					&cli.BoolFlag{
-						Name:  "interactive",
-						Usage: "Keep STDIN open even if not attached",
-						Aliases: []string{"i"},
-					},
+				Flags: append(append(containerCreateFlags(),
 					&cli.BoolFlag{
-						Name:  "tty",
-						Usage: "Allocate a pseudo-TTY",
-						Aliases: []string{"t"},
-					},
-					&cli.StringSliceFlag{
-						Name:  "publish",
-						Usage: "Publish a container's port(s) to the host",
-						Aliases: []string{"p"},
-					},
-					&cli.StringSliceFlag{
-						Name:  "volume",
-						Usage: "Bind mount a volume",
-						Aliases: []string{"v"},
-					},
-					&cli.BoolFlag{
-						Name:  "detach",
-						Usage: "Run container in background and print container ID",
+						Name:    "detach",
+						Usage:   "Run container in background and print container ID",
 						Aliases: []string{"d"},
 					},
-				},
+				), formatFlags()...),
 				Action: app.runContainer,
 			},
+			{
+				Name:      "create",
+				Usage:     "Create a new container without starting it",
+				ArgsUsage: "IMAGE [COMMAND] [ARG...]",
+				Flags:     append(containerCreateFlags(), formatFlags()...),
+				Action:    app.createContainer,
+			},
 			{
 				Name:    "list",
 				Usage:   "List containers",
 				Aliases: []string{"ls", "ps"},
-				Flags: []cli.Flag{
+				Flags: append([]cli.Flag{
 					&cli.BoolFlag{
 						Name:  "all",
 						Usage: "Show all containers (default shows just running)",
 						Aliases: []string{"a"},
 					},
-				},
+					&cli.BoolFlag{
+						Name:    "quiet",
+						Usage:   "Only display container IDs",
+						Aliases: []string{"q"},
+					},
+					&cli.BoolFlag{
+						Name:    "size",
+						Usage:   "Display what each container wrote and its virtual size",
+						Aliases: []string{"s"},
+					},
+				}, formatFlags()...),
 				Action: app.listContainers,
 			},
 			{
@@ -195,6 +441,11 @@ func (app *App) createContainerCommands() *cli.Command {
 						Usage: "Force the removal of a running container",
 						Aliases: []string{"f"},
 					},
+					&cli.BoolFlag{
+						Name:    "volumes",
+						Usage:   "Remove the anonymous volumes of the container",
+						Aliases: []string{"v"},
+					},
 				},
 				Action: app.removeContainer,
 			},
@@ -203,11 +454,254 @@ func (app *App) createContainerCommands() *cli.Command {
 				Usage:   "Fetch the logs of a container",
 				Action:  app.containerLogs,
 			},
+			{
+				Name:      "buildfrom",
+				Usage:     "Build an image from a container's filesystem and a Dockerfile without FROM",
+				ArgsUsage: "CONTAINER [CONTEXT]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "file",
+						Aliases:  []string{"f"},
+						Usage:    "Dockerfile instructions to apply to the container",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:    "tag",
+						Aliases: []string{"t"},
+						Usage:   "Name and optionally a tag in the 'name:tag' format",
+					},
+					&cli.BoolFlag{
+						Name:  "no-cache",
+						Usage: "Do not use cache when building the image",
+					},
+					&cli.StringSliceFlag{
+						Name:  "build-arg",
+						Usage: "Set build-time variables (KEY=value, or KEY to take it from the environment)",
+					},
+					&cli.StringFlag{
+						Name:  "progress",
+						Usage: "Set the type of progress output (plain, json)",
+						Value: "plain",
+					},
+				},
+				Action: app.buildFromContainer,
+			},
 			{
 				Name:    "inspect",
 				Usage:   "Return low-level information on Docker objects",
-				Action:  app.inspectContainer,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:    "size",
+						Usage:   "Display the size_rw and size_root_fs of the container",
+						Aliases: []string{"s"},
+					},
+				},
+				Action: app.inspectContainer,
+			},
+			{
+				Name:      "port",
+				Usage:     "List the port mappings of a container",
+				ArgsUsage: "CONTAINER [PRIVATE_PORT[/PROTO]]",
+				Action:    app.containerPort,
 			},
+			{
+				Name:      "exec",
+				Usage:     "Run a command in a running container",
+				ArgsUsage: "CONTAINER COMMAND [ARG...]",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:    "tty",
+						Aliases: []string{"t"},
+						Usage:   "Allocate a pseudo-TTY",
+					},
+					&cli.StringSliceFlag{
+						Name:    "env",
+						Aliases: []string{"e"},
+						Usage:   "Set environment variables",
+					},
+					&cli.StringFlag{
+						Name:    "workdir",
+						Aliases: []string{"w"},
+						Usage:   "Working directory inside the container",
+					},
+					&cli.StringFlag{
+						Name:    "user",
+						Aliases: []string{"u"},
+						Usage:   "Username or UID (format: <name|uid>[:<group|gid>])",
+					},
+				},
+				Action: app.execContainer,
+			},
+			{
+				Name:      "stats",
+				Usage:     "Display memory and swap usage of running containers",
+				ArgsUsage: "CONTAINER [CONTAINER...]",
+				Action:    app.containerStats,
+			},
+			{
+				Name:  "checkpoint",
+				Usage: "Manage checkpoints of containers",
+				Subcommands: []*cli.Command{
+					{
+						Name:      "create",
+						Usage:     "Checkpoint a running container",
+						ArgsUsage: "CONTAINER NAME",
+						Flags: []cli.Flag{
+							&cli.BoolFlag{
+								Name:  "exit",
+								Usage: "Stop the container once it is checkpointed",
+							},
+						},
+						Action: app.createCheckpoint,
+					},
+					{
+						Name:      "list",
+						Usage:     "List the checkpoints of a container",
+						Aliases:   []string{"ls"},
+						ArgsUsage: "CONTAINER",
+						Flags:     formatFlags(),
+						Action:    app.listCheckpoints,
+					},
+					{
+						Name:      "remove",
+						Usage:     "Remove a checkpoint",
+						Aliases:   []string{"rm"},
+						ArgsUsage: "CONTAINER NAME",
+						Action:    app.removeCheckpoint,
+					},
+					{
+						Name:  "schedule",
+						Usage: "Take the checkpoints of containers with a checkpoint policy until interrupted",
+						Flags: []cli.Flag{
+							&cli.DurationFlag{
+								Name:  "interval",
+								Usage: "How often to check whether a checkpoint is due",
+								Value: 30 * time.Second,
+							},
+						},
+						Action: app.scheduleCheckpoints,
+					},
+				},
+			},
+			{
+				Name:      "restore",
+				Usage:     "Start a container from a checkpoint",
+				ArgsUsage: "CONTAINER",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "checkpoint",
+						Usage: "Checkpoint to restore (default: the newest)",
+					},
+				},
+				Action: app.restoreContainer,
+			},
+		},
+	}
+}
+
+// containerCreateFlags configure a new container for run and create.
+func containerCreateFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "name",
+			Usage: "Assign a name to the container",
+		},
+		&cli.StringFlag{
+			Name:  "network",
+			Usage: "Connect a container to a network: bridge, host to share the host's, none for only loopback, or a user-defined network",
+			Value: "bridge",
+		},
+		&cli.StringSliceFlag{
+			Name:  "network-alias",
+			Usage: "Another name the container is found by on its network",
+		},
+		&cli.StringSliceFlag{
+			Name:  "link",
+			Usage: "Link to another container as NAME[:ALIAS], which it then resolves and gets the environment of",
+		},
+		&cli.StringSliceFlag{
+			Name:  "dns",
+			Usage: "Forward the names the container's networks don't resolve to this DNS server (default: the host's)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "dns-search",
+			Usage: "Set a DNS search domain",
+		},
+		&cli.StringSliceFlag{
+			Name:  "dns-opt",
+			Usage: "Set a DNS resolver option, e.g. ndots:2",
+		},
+		&cli.BoolFlag{
+			Name:    "interactive",
+			Usage:   "Keep STDIN open even if not attached",
+			Aliases: []string{"i"},
+		},
+		&cli.BoolFlag{
+			Name:    "tty",
+			Usage:   "Allocate a pseudo-TTY",
+			Aliases: []string{"t"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "publish",
+			Usage:   "Publish a container's port(s) to the host ([host-ip:][host-port:]container-port[/proto] with ports or ranges such as 8000-8010, or target=,published=,protocol=,host_ip=,family=ipv4|ipv6|dual)",
+			Aliases: []string{"p"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "volume",
+			Usage:   "Bind mount a host path or named volume (SRC:DST[:ro|rw][,propagation])",
+			Aliases: []string{"v"},
+		},
+		&cli.StringSliceFlag{
+			Name:  "mount",
+			Usage: "Attach a mount: type=bind|volume|tmpfs,src=...,dst=...[,ro][,bind-propagation=...][,volume-driver=...][,volume-opt=k=v][,volume-label=k=v][,tmpfs-size=...][,tmpfs-mode=...]",
+		},
+		&cli.StringFlag{
+			Name:  "platform",
+			Usage: "Use the image for a specific platform (os/arch[/variant])",
+		},
+		&cli.StringFlag{
+			Name:  "restart",
+			Usage: "Restart policy: no, always, unless-stopped, on-failure[:max-retries]",
+			Value: "no",
+		},
+		&cli.StringSliceFlag{
+			Name:  "hook",
+			Usage: "Add a lifecycle hook in 'stage=command [args...]' format (stage: prestart, poststart, prestop)",
+		},
+		&cli.IntFlag{
+			Name:  "hook-timeout",
+			Usage: "Seconds before a hook is killed (0 uses the default)",
+		},
+		&cli.StringFlag{
+			Name:  "hook-failure",
+			Usage: "Hook failure policy: fail or ignore (default depends on stage)",
+		},
+		&cli.StringFlag{
+			Name:    "memory",
+			Usage:   "Memory limit (e.g. 512m, 1g)",
+			Aliases: []string{"m"},
+		},
+		&cli.StringFlag{
+			Name:  "memory-swap",
+			Usage: "Swap limit equal to memory plus swap: '-1' to enable unlimited swap",
+		},
+		&cli.IntFlag{
+			Name:  "memory-swappiness",
+			Usage: "Tune container memory swappiness (0 to 100)",
+			Value: -1,
+		},
+		&cli.StringSliceFlag{
+			Name:  "storage-opt",
+			Usage: "Storage driver options, e.g. size=10G to limit the container's writable layer",
+		},
+		&cli.DurationFlag{
+			Name:  "checkpoint-interval",
+			Usage: "Checkpoint the container this often while it runs (see container checkpoint schedule)",
+		},
+		&cli.IntFlag{
+			Name:  "checkpoint-keep",
+			Usage: "Number of automatic checkpoints to keep",
+			Value: 3,
 		},
 	}
 }
@@ -226,6 +720,262 @@ func (app *App) createSystemCommands() *cli.Command {
 				Name:    "prune",
 				Usage:   "Remove unused data",
 				Action:  app.systemPrune,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:    "all",
+						Aliases: []string{"a"},
+						Usage:   "Remove all unused images, not just dangling ones",
+					},
+				},
+			},
+			{
+				Name:  "serve",
+				Usage: "Serve the container API, e.g. for exec from CI tools",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "host",
+						Usage: "Address to listen on, unix://PATH or tcp://HOST:PORT",
+						Value: "unix:///var/run/mydocker.sock",
+					},
+					&cli.StringSliceFlag{
+						Name:  "cors-origin",
+						Usage: "Origin browsers may call the API from, or * for any (can be repeated)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "trusted-proxy",
+						Usage: "Address or CIDR of a reverse proxy whose X-Forwarded-* headers are trusted (can be repeated)",
+					},
+					&cli.StringFlag{
+						Name:  "base-path",
+						Usage: "Path prefix to serve the API under when a proxy forwards it unstripped (e.g. /docker)",
+					},
+				},
+				Action: app.serveAPI,
+			},
+			{
+				Name:  "telemetry",
+				Usage: "Inspect the local operation log",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "report",
+						Usage: "Summarize recorded operations, slowest first",
+						Flags: []cli.Flag{
+							&cli.DurationFlag{
+								Name:  "since",
+								Usage: "Only include operations from this long ago (e.g. 24h)",
+							},
+							&cli.BoolFlag{
+								Name:  "json",
+								Usage: "Print the summary as JSON",
+							},
+						},
+						Action: app.telemetryReport,
+					},
+				},
+			},
+		},
+	}
+}
+
+func (app *App) createNetworkCommands() *cli.Command {
+	return &cli.Command{
+		Name:  "network",
+		Usage: "Manage container networking",
+		Subcommands: []*cli.Command{
+			{
+				Name:      "create",
+				Usage:     "Create a user-defined bridge network, a macvlan or ipvlan network on a host interface, or an overlay network across the cluster",
+				ArgsUsage: "NETWORK",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "driver",
+						Usage:   "Network driver",
+						Aliases: []string{"d"},
+						Value:   "bridge",
+					},
+					&cli.StringFlag{
+						Name:  "subnet",
+						Usage: "Subnet in CIDR format (default: the next free one)",
+					},
+					&cli.StringFlag{
+						Name:  "gateway",
+						Usage: "Gateway of the subnet (default: its first address)",
+					},
+					&cli.BoolFlag{
+						Name:  "internal",
+						Usage: "Keep the network's containers from reaching outside it",
+					},
+					&cli.BoolFlag{
+						Name:  "icc",
+						Usage: "Let the network's containers reach each other; with --icc=false only policies let them",
+						Value: true,
+					},
+					&cli.IntFlag{
+						Name:  "vni",
+						Usage: "VXLAN ID of an overlay network (default: the next free one)",
+					},
+					&cli.StringSliceFlag{
+						Name:    "opt",
+						Usage:   "Set a driver option in key=value format, e.g. parent=eth0 for macvlan and ipvlan",
+						Aliases: []string{"o"},
+					},
+					&cli.StringSliceFlag{
+						Name:  "label",
+						Usage: "Set a label in key=value format",
+					},
+				},
+				Action: app.createNetwork,
+			},
+			{
+				Name:    "ls",
+				Aliases: []string{"list"},
+				Usage:   "List networks",
+				Flags: append([]cli.Flag{
+					&cli.BoolFlag{
+						Name:    "quiet",
+						Usage:   "Only display network IDs",
+						Aliases: []string{"q"},
+					},
+				}, formatFlags()...),
+				Action: app.listNetworks,
+			},
+			{
+				Name:      "inspect",
+				Usage:     "Display the subnet, options and connected containers of one or more networks",
+				ArgsUsage: "NETWORK [NETWORK...]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "format",
+						Usage: "Format the output using a Go template (e.g. '{{.Subnet}}')",
+					},
+				},
+				Action: app.inspectNetworks,
+			},
+			{
+				Name:      "rm",
+				Aliases:   []string{"remove"},
+				Usage:     "Remove one or more networks",
+				ArgsUsage: "NETWORK [NETWORK...]",
+				Action:    app.removeNetworks,
+			},
+			{
+				Name:      "update",
+				Usage:     "Change the settings of a network",
+				ArgsUsage: "NETWORK",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "icc",
+						Usage: "Let the network's containers reach each other without a policy",
+					},
+				},
+				Action: app.updateNetwork,
+			},
+			{
+				Name:  "policy",
+				Usage: "Manage the policies allowing or denying traffic into a network",
+				Subcommands: []*cli.Command{
+					{
+						Name:      "add",
+						Usage:     "Allow or deny the traffic from a container, or a whole network as network:NAME, into a network",
+						ArgsUsage: "NETWORK",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "from",
+								Usage:    "Container, or network:NAME, the traffic comes from",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:  "to",
+								Usage: "Container of the network the traffic goes to (default: all of them)",
+							},
+							&cli.BoolFlag{
+								Name:  "deny",
+								Usage: "Deny the traffic instead of allowing it",
+							},
+						},
+						Action: app.addNetworkPolicy,
+					},
+					{
+						Name:      "ls",
+						Aliases:   []string{"list"},
+						Usage:     "List the policies of a network",
+						ArgsUsage: "NETWORK",
+						Flags:     formatFlags(),
+						Action:    app.listNetworkPolicies,
+					},
+					{
+						Name:      "rm",
+						Aliases:   []string{"remove"},
+						Usage:     "Remove policies from a network",
+						ArgsUsage: "NETWORK POLICY [POLICY...]",
+						Action:    app.removeNetworkPolicies,
+					},
+				},
+			},
+			{
+				Name:      "connect",
+				Usage:     "Connect a running container to a network",
+				ArgsUsage: "NETWORK CONTAINER",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "ip",
+						Usage: "IPv4 address of the container on the network",
+					},
+					&cli.StringSliceFlag{
+						Name:  "alias",
+						Usage: "Another name the container is found by on the network",
+					},
+				},
+				Action: app.connectNetwork,
+			},
+			{
+				Name:      "disconnect",
+				Usage:     "Disconnect a container from a network",
+				ArgsUsage: "NETWORK CONTAINER",
+				Action:    app.disconnectNetwork,
+			},
+			{
+				Name:      "capture",
+				Usage:     "Capture packets in a container's network namespace",
+				ArgsUsage: "CONTAINER",
+				Flags: []cli.Flag{
+					&cli.DurationFlag{
+						Name:  "duration",
+						Usage: "How long to capture for",
+						Value: 30 * time.Second,
+					},
+					&cli.StringFlag{
+						Name:     "output",
+						Aliases:  []string{"o"},
+						Usage:    "Write the pcap to this file, or - for stdout",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "interface",
+						Usage: "Interface inside the container (default: all)",
+					},
+					&cli.StringFlag{
+						Name:  "filter",
+						Usage: "tcpdump filter expression",
+					},
+				},
+				Action: app.captureNetwork,
+			},
+			{
+				Name:      "rules",
+				Usage:     "List the iptables rules installed for a network or container",
+				ArgsUsage: "[NETWORK]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "container",
+						Usage: "Only list the rules of this container",
+					},
+					&cli.BoolFlag{
+						Name:  "verify",
+						Usage: "Compare the rules with the ones in the kernel",
+					},
+				},
+				Action: app.networkRules,
 			},
 		},
 	}
@@ -240,6 +990,7 @@ func (app *App) addClusterCommands() {
 			{
 				Name:    "init",
 				Usage:   "Initialize a new cluster",
+				Flags:   append(append(append(append(authFlags(), schedulerPluginFlags()...), heartbeatFlags()...), joinTokenFlags()...), forceNewClusterFlag()),
 				Action:  app.initCluster,
 			},
 			{
@@ -252,6 +1003,53 @@ func (app *App) addClusterCommands() {
 				Usage:   "Show cluster status",
 				Action:  app.clusterStatus,
 			},
+			{
+				Name:    "upgrade",
+				Usage:   "Upgrade cluster nodes to a new version",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "version",
+						Usage:    "Target version",
+						Required: true,
+					},
+					&cli.IntFlag{
+						Name:  "batch-size",
+						Usage: "Number of workers upgraded at a time",
+						Value: 1,
+					},
+					&cli.DurationFlag{
+						Name:  "timeout",
+						Usage: "How long to wait for each node to report healthy",
+						Value: 60 * time.Second,
+					},
+				},
+				Action: app.upgradeCluster,
+			},
+			{
+				Name:  "prune",
+				Usage: "Remove unused containers, images and optionally volumes on every node",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:    "all",
+						Aliases: []string{"a"},
+						Usage:   "Remove all unused images, not just dangling ones",
+					},
+					&cli.BoolFlag{
+						Name:  "volumes",
+						Usage: "Prune unused volumes",
+					},
+					&cli.StringSliceFlag{
+						Name:  "filter",
+						Usage: "Provide filter values (e.g. until=24h)",
+					},
+				},
+				Action: app.pruneCluster,
+			},
+			{
+				Name:   "rebalance",
+				Usage:  "Move replicas of services with a rebalance policy onto underutilized nodes",
+				Action: app.rebalanceCluster,
+			},
 		},
 	}
 
@@ -264,8 +1062,10 @@ func (app *App) addClusterCommands() {
 				Name:    "ls",
 				Usage:   "List nodes in the cluster",
 				Aliases: []string{"list"},
+				Flags:   append(timeRangeFlags(), clusterListFlags()...),
 				Action:  app.listNodes,
 			},
+			agentCommand(app),
 		},
 	}
 
@@ -278,11 +1078,40 @@ func (app *App) addClusterCommands() {
 				Name:    "ls",
 				Usage:   "List tasks",
 				Aliases: []string{"list"},
-				Action:  app.listTasks,
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:  "node",
+						Usage: "Filter tasks by node",
+					},
+					&cli.StringFlag{
+						Name:  "status",
+						Usage: "Filter tasks by status",
+					},
+				}, append(timeRangeFlags(), clusterListFlags()...)...),
+				Action: app.listTasks,
 			},
 		},
 	}
 
+	// Add service command group
+	serviceCmd := &cli.Command{
+		Name:  "service",
+		Usage: "Manage services",
+		Subcommands: append(serviceCommands(app),
+			&cli.Command{
+				Name:      "recommend",
+				Usage:     "Suggest CPU and memory reservations and limits from a service's p95 usage",
+				ArgsUsage: "SERVICE",
+				Flags:     formatFlags(),
+				Action:    app.serviceRecommend,
+			},
+			reloadPolicyCommand(app),
+			rebalancePolicyCommand(app),
+			disruptionBudgetCommand(app),
+		),
+	}
+
 	// Add commands to CLI app
-	app.cliApp.Commands = append(app.cliApp.Commands, clusterCmd, nodeCmd, taskCmd)
+	app.cliApp.Commands = append(app.cliApp.Commands, clusterCmd, nodeCmd, taskCmd, serviceCmd,
+		secretCommand(app, cluster.KindSecret), secretCommand(app, cluster.KindConfig), runAgentCommand(app))
 }
\ No newline at end of file
@@ -0,0 +1,96 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	"docker-impl/pkg/compose"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+func (app *App) createComposeCommands() *cli.Command {
+	return &cli.Command{
+		Name:  "compose",
+		Usage: "Work with compose files",
+		Flags: []cli.Flag{
+			&cli.StringSliceFlag{
+				Name:    "file",
+				Aliases: []string{"f"},
+				Usage:   "Compose file; later files override earlier ones",
+			},
+			&cli.StringFlag{
+				Name:    "project-name",
+				Aliases: []string{"p"},
+				Usage:   "Project name",
+			},
+			&cli.StringFlag{
+				Name:  "project-directory",
+				Usage: "Project directory (default: the directory of the first file)",
+			},
+			&cli.StringSliceFlag{
+				Name:  "profile",
+				Usage: "Enable services with this profile (* for all)",
+			},
+			&cli.StringSliceFlag{
+				Name:  "env-file",
+				Usage: "Read variables for interpolation from this file (default: .env)",
+			},
+		},
+		Subcommands: []*cli.Command{
+			{
+				Name:  "config",
+				Usage: "Validate and print the resolved compose configuration",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "services",
+						Usage: "Only print the enabled service names",
+					},
+					&cli.BoolFlag{
+						Name:    "quiet",
+						Aliases: []string{"q"},
+						Usage:   "Only validate the configuration",
+					},
+				},
+				Action: app.composeConfig,
+			},
+		},
+	}
+}
+
+// loadComposeProject loads the project described by the compose flags,
+// which are set on the parent command.
+func loadComposeProject(c *cli.Context) (*compose.Project, error) {
+	options := compose.Options{
+		Files:       c.StringSlice("file"),
+		WorkingDir:  c.String("project-directory"),
+		EnvFiles:    c.StringSlice("env-file"),
+		Profiles:    c.StringSlice("profile"),
+		ProjectName: c.String("project-name"),
+	}
+	return compose.Load(options)
+}
+
+func (app *App) composeConfig(c *cli.Context) error {
+	project, err := loadComposeProject(c)
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("quiet") {
+		return nil
+	}
+	if c.Bool("services") {
+		for _, name := range project.ServiceNames() {
+			fmt.Println(name)
+		}
+		return nil
+	}
+
+	encoder := yaml.NewEncoder(os.Stdout)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(project); err != nil {
+		return fmt.Errorf("failed to print configuration: %v", err)
+	}
+	return encoder.Close()
+}
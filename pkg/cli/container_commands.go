@@ -0,0 +1,704 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"docker-impl/pkg/container"
+	"docker-impl/pkg/image"
+	"docker-impl/pkg/network"
+	"docker-impl/pkg/reference"
+	"docker-impl/pkg/types"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// containerCreateOptions builds the options of a new container from the
+// flags shared by run and create.
+func (app *App) containerCreateOptions(c *cli.Context) (types.ContainerCreateOptions, error) {
+	if c.NArg() < 1 {
+		return types.ContainerCreateOptions{}, fmt.Errorf("image name is required")
+	}
+
+	img, err := app.resolveImageForRun(c.Args().First(), c.String("platform"))
+	if err != nil {
+		return types.ContainerCreateOptions{}, err
+	}
+
+	restartPolicy, err := parseRestartPolicy(c.String("restart"))
+	if err != nil {
+		return types.ContainerCreateOptions{}, err
+	}
+
+	hooks, err := parseHookFlags(c.StringSlice("hook"), c.Int("hook-timeout"), c.String("hook-failure"))
+	if err != nil {
+		return types.ContainerCreateOptions{}, err
+	}
+
+	memory, memorySwap, swappiness, err := parseMemoryFlags(c)
+	if err != nil {
+		return types.ContainerCreateOptions{}, err
+	}
+
+	storageOpt, err := parseStorageOpts(c.StringSlice("storage-opt"))
+	if err != nil {
+		return types.ContainerCreateOptions{}, err
+	}
+
+	portBindings, err := parsePublishFlags(c.StringSlice("publish"), app.ipv6)
+	if err != nil {
+		return types.ContainerCreateOptions{}, err
+	}
+
+	var mounts []types.MountSpec
+	for _, value := range c.StringSlice("mount") {
+		mount, err := container.ParseMount(value)
+		if err != nil {
+			return types.ContainerCreateOptions{}, err
+		}
+		mounts = append(mounts, mount)
+	}
+
+	options := types.ContainerCreateOptions{
+		Name: c.String("name"),
+		Config: types.ContainerConfig{
+			Image:     img.ID,
+			Cmd:       c.Args().Tail(),
+			Tty:       c.Bool("tty"),
+			OpenStdin: c.Bool("interactive"),
+		},
+		HostConfig: types.HostConfig{
+			Binds:            c.StringSlice("volume"),
+			Mounts:           mounts,
+			NetworkMode:      c.String("network"),
+			RestartPolicy:    restartPolicy,
+			Hooks:            hooks,
+			Memory:           memory,
+			MemorySwap:       memorySwap,
+			MemorySwappiness: swappiness,
+			StorageOpt:       storageOpt,
+			PortBindings:     portBindings,
+			DNS:              c.StringSlice("dns"),
+			DNSSearch:        c.StringSlice("dns-search"),
+			DNSOptions:       c.StringSlice("dns-opt"),
+			NetworkAliases:   c.StringSlice("network-alias"),
+			Links:            c.StringSlice("link"),
+		},
+	}
+	if interval := c.Duration("checkpoint-interval"); interval > 0 {
+		if interval < time.Second {
+			return types.ContainerCreateOptions{}, fmt.Errorf("checkpoint interval must be at least 1s")
+		}
+		options.HostConfig.CheckpointPolicy = &types.CheckpointPolicy{
+			Interval: int(interval / time.Second),
+			Keep:     c.Int("checkpoint-keep"),
+		}
+	}
+
+	return options, nil
+}
+
+func (app *App) createContainer(c *cli.Context) error {
+	options, err := app.containerCreateOptions(c)
+	if err != nil {
+		return err
+	}
+
+	container, err := app.containerMgr.CreateContainer(options)
+	if err != nil {
+		return fmt.Errorf("failed to create container: %v", err)
+	}
+
+	if ok, err := printFormatted(c, container); ok {
+		return err
+	}
+	fmt.Println(container.ID)
+	return nil
+}
+
+func (app *App) runContainer(c *cli.Context) error {
+	options, err := app.containerCreateOptions(c)
+	if err != nil {
+		return err
+	}
+
+	container, err := app.containerMgr.CreateContainer(options)
+	if err != nil {
+		return fmt.Errorf("failed to create container: %v", err)
+	}
+
+	if err := app.containerMgr.StartContainer(container.ID); err != nil {
+		return fmt.Errorf("failed to start container: %v", err)
+	}
+
+	// Report the state after starting rather than the one at creation
+	if started, err := app.containerMgr.GetContainer(container.ID); err == nil {
+		container = started
+	}
+	if ok, err := printFormatted(c, container); ok {
+		return err
+	}
+	fmt.Println(container.ID)
+	return nil
+}
+
+// resolveImage accepts an image ID or a name[:tag] or name@digest
+// reference.
+func (app *App) resolveImage(ref string) (*types.Image, error) {
+	img, err := app.imageMgr.ResolveImage(ref)
+	if err != nil {
+		return nil, fmt.Errorf("image not found: %s", ref)
+	}
+	return img, nil
+}
+
+// resolveImageForRun resolves a local image, pulling it when it is missing
+// or when --platform asks for a platform the local copy was not built for.
+func (app *App) resolveImageForRun(ref, platform string) (*types.Image, error) {
+	img, err := app.resolveImage(ref)
+	if err == nil && platform == "" {
+		return img, nil
+	}
+
+	if err == nil {
+		want, err := image.ParsePlatform(platform)
+		if err != nil {
+			return nil, err
+		}
+		if img.Platform.String() == "" || img.Platform == want {
+			return img, nil
+		}
+		logrus.Infof("Local image %s is %s, pulling %s", ref, img.Platform, want)
+	}
+
+	parsed, err := reference.ParseNormalized(ref)
+	if err != nil {
+		return nil, err
+	}
+	img, err = app.imageMgr.PullReference(parsed, platform)
+	if err != nil {
+		return nil, fmt.Errorf("failed to pull image: %v", err)
+	}
+	return img, nil
+}
+
+func (app *App) listContainers(c *cli.Context) error {
+	containers, err := app.containerMgr.ListContainers(types.ContainerListOptions{All: c.Bool("all"), Size: c.Bool("size")})
+	if err != nil {
+		return fmt.Errorf("failed to list containers: %v", err)
+	}
+	if containers == nil {
+		containers = []*types.Container{}
+	}
+
+	if c.Bool("quiet") {
+		for _, container := range containers {
+			fmt.Println(container.ID)
+		}
+		return nil
+	}
+	if ok, err := printFormatted(c, containers); ok {
+		return err
+	}
+
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	header := "CONTAINER ID\tIMAGE\tCOMMAND\tCREATED\tSTATUS\tRESTARTS\tNAMES"
+	if c.Bool("size") {
+		header += "\tSIZE"
+	}
+	fmt.Fprintln(w, header)
+	for _, container := range containers {
+		fmt.Fprintf(w, "%s\t%s\t%q\t%s ago\t%s\t%d\t%s",
+			shortID(container.ID),
+			app.imageDisplayName(container.Image),
+			strings.Join(container.Config.Cmd, " "),
+			humanDuration(now.Sub(container.CreatedAt)),
+			formatContainerStatus(container, now),
+			container.RestartCount,
+			container.Name,
+		)
+		if c.Bool("size") {
+			fmt.Fprintf(w, "\t%s (virtual %s)", humanSize(container.SizeRw), humanSize(container.SizeRootFs))
+		}
+		fmt.Fprintln(w)
+	}
+	return w.Flush()
+}
+
+func (app *App) startContainer(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("container ID is required")
+	}
+
+	var failed []string
+	for _, id := range c.Args().Slice() {
+		if err := app.containerMgr.StartContainer(id); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", id, err)
+			failed = append(failed, id)
+			continue
+		}
+		fmt.Println(id)
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to start containers: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func (app *App) stopContainer(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("container ID is required")
+	}
+
+	var failed []string
+	for _, id := range c.Args().Slice() {
+		if err := app.containerMgr.StopContainer(id, c.Int("time")); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", id, err)
+			failed = append(failed, id)
+			continue
+		}
+		fmt.Println(id)
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to stop containers: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func (app *App) removeContainer(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("container ID is required")
+	}
+
+	options := types.ContainerRemoveOptions{
+		Force:         c.Bool("force"),
+		RemoveVolumes: c.Bool("volumes"),
+	}
+	var failed []string
+	for _, id := range c.Args().Slice() {
+		if err := app.containerMgr.RemoveContainer(id, options); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", id, err)
+			failed = append(failed, id)
+			continue
+		}
+		fmt.Println(id)
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to remove containers: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func (app *App) containerLogs(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("container ID is required")
+	}
+
+	logs, err := app.containerMgr.GetContainerLogs(c.Args().First())
+	if err != nil {
+		return fmt.Errorf("failed to get logs: %v", err)
+	}
+	fmt.Print(logs)
+	return nil
+}
+
+func (app *App) inspectContainer(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("container ID is required")
+	}
+
+	var results []*types.Container
+	for _, id := range c.Args().Slice() {
+		container, err := app.containerMgr.GetContainer(id)
+		if err != nil {
+			return fmt.Errorf("failed to inspect container %s: %v", id, err)
+		}
+		if c.Bool("size") {
+			if err := app.containerMgr.FillSize(container); err != nil {
+				return fmt.Errorf("failed to measure container %s: %v", id, err)
+			}
+		}
+		results = append(results, container)
+	}
+
+	data, err := json.MarshalIndent(results, "", "    ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal container: %v", err)
+	}
+
+	fmt.Println(string(data))
+	return nil
+}
+
+// buildFromContainer builds an image from a container's current
+// filesystem plus a Dockerfile snippet. COPY and ADD read from CONTEXT,
+// the current directory by default.
+func (app *App) buildFromContainer(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("container ID is required")
+	}
+	contextDir := "."
+	if c.NArg() > 1 {
+		contextDir = c.Args().Get(1)
+	}
+	// The snippet is found from where the command runs, not in the context
+	dockerfile, err := filepath.Abs(c.String("file"))
+	if err != nil {
+		return err
+	}
+
+	options := types.ImageBuildOptions{
+		ContextDir: contextDir,
+		Dockerfile: dockerfile,
+		NoCache:    c.Bool("no-cache"),
+	}
+	if tag := c.String("tag"); tag != "" {
+		options.Tags = []string{tag}
+	}
+	if args := c.StringSlice("build-arg"); len(args) > 0 {
+		options.BuildArgs = parseBuildArgs(args)
+	}
+	progress, err := image.NewBuildProgress(c.String("progress"), os.Stdout)
+	if err != nil {
+		return err
+	}
+	options.Progress = progress
+
+	img, err := app.containerMgr.BuildFrom(c.Args().First(), options)
+	if err != nil {
+		return err
+	}
+
+	if len(options.Tags) > 0 && c.String("progress") != "json" {
+		fmt.Printf("Successfully tagged %s:%s\n", img.Name, img.Tag)
+	}
+	return nil
+}
+
+// containerPort prints where the ports of a container are published, one
+// line per binding, so a port published on IPv4 and IPv6 is listed twice.
+func (app *App) containerPort(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("container ID is required")
+	}
+
+	container, err := app.containerMgr.GetContainer(c.Args().First())
+	if err != nil {
+		return fmt.Errorf("failed to get container: %v", err)
+	}
+
+	ports := container.Network.Ports
+	if len(ports) == 0 {
+		ports = container.HostConfig.PortBindings
+	}
+
+	var keys []string
+	if c.NArg() > 1 {
+		key := c.Args().Get(1)
+		if !strings.Contains(key, "/") {
+			key += "/tcp"
+		}
+		if _, ok := ports[key]; !ok {
+			return fmt.Errorf("no public port '%s' published for %s", key, container.Name)
+		}
+		keys = []string{key}
+	} else {
+		for key := range ports {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+	}
+
+	for _, key := range keys {
+		for _, binding := range ports[key] {
+			fmt.Printf("%s -> %s\n", key, net.JoinHostPort(binding.HostIP, binding.HostPort))
+		}
+	}
+	return nil
+}
+
+func (app *App) containerStats(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("container ID is required")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "CONTAINER ID\tNAME\tMEM USAGE / LIMIT\tSWAP USAGE / LIMIT")
+	for _, id := range c.Args().Slice() {
+		stats, err := app.containerMgr.GetContainerStats(id)
+		if err != nil {
+			return fmt.Errorf("failed to get stats of container %s: %v", id, err)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s / %s\t%s / %s\n", shortID(fmt.Sprint(stats["id"])), stats["name"],
+			statBytes(stats["memory_usage"]), statBytes(stats["memory_limit"]),
+			statBytes(stats["swap_usage"]), statBytes(stats["swap_limit"]))
+	}
+	return w.Flush()
+}
+
+// statBytes formats a cgroup value; -1 is unlimited and a missing value
+// means the kernel doesn't report it.
+func statBytes(value interface{}) string {
+	n, ok := value.(int64)
+	switch {
+	case !ok:
+		return "--"
+	case n < 0:
+		return "unlimited"
+	default:
+		return humanSize(n)
+	}
+}
+
+// parseMemoryFlags reads --memory, --memory-swap and --memory-swappiness.
+// A swappiness of -1 leaves the kernel default.
+func parseMemoryFlags(c *cli.Context) (int64, int64, *int64, error) {
+	var memory, memorySwap int64
+	var err error
+
+	if value := c.String("memory"); value != "" {
+		if memory, err = parseBytes(value); err != nil {
+			return 0, 0, nil, fmt.Errorf("invalid --memory: %v", err)
+		}
+	}
+	if value := c.String("memory-swap"); value == "-1" {
+		memorySwap = -1
+	} else if value != "" {
+		if memorySwap, err = parseBytes(value); err != nil {
+			return 0, 0, nil, fmt.Errorf("invalid --memory-swap: %v", err)
+		}
+	}
+
+	var swappiness *int64
+	if value := int64(c.Int("memory-swappiness")); value != -1 {
+		swappiness = &value
+	}
+	return memory, memorySwap, swappiness, nil
+}
+
+// parseStorageOpts reads --storage-opt values in key=value format.
+func parseStorageOpts(values []string) (map[string]string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	opts := make(map[string]string, len(values))
+	for _, value := range values {
+		key, val, ok := strings.Cut(value, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid --storage-opt %q: expected key=value", value)
+		}
+		opts[key] = val
+	}
+	return opts, nil
+}
+
+// parsePublishFlags reads --publish values into port bindings keyed by
+// container port and protocol. Ports are published on IPv6 too when ipv6
+// is set, unless a value picks a host address or family.
+func parsePublishFlags(values []string, ipv6 bool) (map[string][]types.PortBinding, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	bindings := make(map[string][]types.PortBinding)
+	for _, value := range values {
+		mappings, err := network.ParsePublish(value, ipv6)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --publish: %v", err)
+		}
+		for _, mapping := range mappings {
+			binding := types.PortBinding{HostIP: mapping.HostIP, HostPort: mapping.HostPortRange()}
+			bindings[mapping.PortKey()] = append(bindings[mapping.PortKey()], binding)
+		}
+	}
+	return bindings, nil
+}
+
+// parseBytes parses sizes such as 512m or 1g using binary units.
+func parseBytes(value string) (int64, error) {
+	s := strings.ToLower(strings.TrimSpace(value))
+	s = strings.TrimSuffix(s, "b")
+
+	multiplier := int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'k':
+			multiplier = 1 << 10
+		case 'm':
+			multiplier = 1 << 20
+		case 'g':
+			multiplier = 1 << 30
+		case 't':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			s = s[:len(s)-1]
+		}
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size: %s", value)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+func (app *App) imageDisplayName(imageID string) string {
+	img, err := app.imageMgr.GetImage(imageID)
+	if err != nil {
+		return shortID(imageID)
+	}
+	return img.Name + ":" + img.Tag
+}
+
+// formatContainerStatus renders the STATUS column, e.g. "Up 5m" or "Exited (137) 2m ago".
+func formatContainerStatus(container *types.Container, now time.Time) string {
+	switch container.Status {
+	case types.StatusRunning:
+		return "Up " + humanDuration(now.Sub(container.StartedAt))
+	case types.StatusRestarting:
+		return fmt.Sprintf("Restarting (%d) %s ago", container.ExitCode, humanDuration(now.Sub(container.FinishedAt)))
+	case types.StatusExited, types.StatusStopped, types.StatusDead:
+		status := fmt.Sprintf("Exited (%d) %s ago", container.ExitCode, humanDuration(now.Sub(container.FinishedAt)))
+		if container.OOMKilled {
+			status += " (OOMKilled)"
+		}
+		return status
+	case types.StatusCreated:
+		return "Created"
+	default:
+		return string(container.Status)
+	}
+}
+
+func humanDuration(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%dd", int(d.Hours()/24))
+	}
+}
+
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+func parseRestartPolicy(value string) (types.RestartPolicy, error) {
+	parts := strings.SplitN(value, ":", 2)
+	policy := types.RestartPolicy{Name: parts[0]}
+
+	switch policy.Name {
+	case "", "no":
+		policy.Name = "no"
+	case "always", "unless-stopped":
+	case "on-failure":
+		if len(parts) == 2 {
+			retries, err := strconv.Atoi(parts[1])
+			if err != nil || retries < 0 {
+				return policy, fmt.Errorf("invalid restart max retries: %s", parts[1])
+			}
+			policy.MaximumRetryCount = retries
+		}
+		return policy, nil
+	default:
+		return policy, fmt.Errorf("invalid restart policy: %s", value)
+	}
+
+	if len(parts) == 2 {
+		return policy, fmt.Errorf("max retries is only valid with on-failure: %s", value)
+	}
+	return policy, nil
+}
+
+func parseHookFlags(specs []string, timeout int, failure string) (types.Hooks, error) {
+	var hooks types.Hooks
+
+	policy := types.HookFailurePolicy(failure)
+	switch policy {
+	case "", types.HookFailurePolicyFail, types.HookFailurePolicyIgnore:
+	default:
+		return hooks, fmt.Errorf("invalid hook failure policy: %s", failure)
+	}
+
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 {
+			return hooks, fmt.Errorf("invalid hook format: %s (expected stage=command)", spec)
+		}
+
+		fields := strings.Fields(parts[1])
+		if len(fields) == 0 {
+			return hooks, fmt.Errorf("hook command is required: %s", spec)
+		}
+
+		hook := types.Hook{
+			Path:      fields[0],
+			Args:      fields[1:],
+			Timeout:   timeout,
+			OnFailure: policy,
+		}
+
+		switch parts[0] {
+		case "prestart":
+			hooks.Prestart = append(hooks.Prestart, hook)
+		case "poststart":
+			hooks.Poststart = append(hooks.Poststart, hook)
+		case "prestop":
+			hooks.Prestop = append(hooks.Prestop, hook)
+		default:
+			return hooks, fmt.Errorf("unknown hook stage: %s", parts[0])
+		}
+	}
+
+	return hooks, nil
+}
+
+// execContainer runs a command in a running container and exits with the
+// command's exit code.
+func (app *App) execContainer(c *cli.Context) error {
+	if c.NArg() < 2 {
+		return fmt.Errorf("container and command are required")
+	}
+
+	config := types.ExecConfig{
+		Cmd:          c.Args().Tail(),
+		Env:          c.StringSlice("env"),
+		User:         c.String("user"),
+		WorkingDir:   c.String("workdir"),
+		Tty:          c.Bool("tty"),
+		AttachStdout: true,
+		AttachStderr: true,
+	}
+	execID, err := app.containerMgr.CreateExec(c.Args().First(), config)
+	if err != nil {
+		return fmt.Errorf("failed to create exec: %v", err)
+	}
+
+	exitCode, err := app.containerMgr.StartExec(execID, os.Stdout, os.Stderr)
+	if err != nil {
+		return fmt.Errorf("failed to start exec: %v", err)
+	}
+	if exitCode != 0 {
+		return cli.Exit("", exitCode)
+	}
+	return nil
+}
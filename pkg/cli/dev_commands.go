@@ -0,0 +1,142 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"docker-impl/pkg/dev"
+	"github.com/urfave/cli/v2"
+)
+
+var devSignals = map[string]syscall.Signal{
+	"SIGHUP": syscall.SIGHUP, "SIGINT": syscall.SIGINT, "SIGQUIT": syscall.SIGQUIT,
+	"SIGUSR1": syscall.SIGUSR1, "SIGUSR2": syscall.SIGUSR2, "SIGTERM": syscall.SIGTERM,
+	"SIGWINCH": syscall.SIGWINCH,
+}
+
+func (app *App) createDevCommands() *cli.Command {
+	return &cli.Command{
+		Name:  "dev",
+		Usage: "Developer workflow commands",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "watch",
+				Usage: "Sync source changes into a container and restart or reload it",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "container",
+						Usage:    "Container to sync into (ID or name)",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "path",
+						Usage: "Host directory to watch",
+						Value: ".",
+					},
+					&cli.StringFlag{
+						Name:     "sync",
+						Usage:    "Directory in the container to sync to",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "mode",
+						Usage: "How files reach the container (copy, bind)",
+						Value: dev.SyncCopy,
+					},
+					&cli.StringFlag{
+						Name:  "action",
+						Usage: "What to do after a sync (restart, reload, none)",
+						Value: dev.ActionRestart,
+					},
+					&cli.StringFlag{
+						Name:  "signal",
+						Usage: "Signal sent to the container on reload",
+						Value: "SIGHUP",
+					},
+					&cli.DurationFlag{
+						Name:  "interval",
+						Usage: "How often to check for changes",
+						Value: 500 * time.Millisecond,
+					},
+					&cli.DurationFlag{
+						Name:  "debounce",
+						Usage: "Wait this long after the last change before syncing",
+						Value: 300 * time.Millisecond,
+					},
+					&cli.StringSliceFlag{
+						Name:  "ignore",
+						Usage: "Paths or base name patterns to leave out",
+						Value: cli.NewStringSlice(".git", "*.swp", "*~"),
+					},
+					&cli.IntFlag{
+						Name:  "stop-timeout",
+						Usage: "Seconds to wait for the container to stop on restart",
+						Value: 10,
+					},
+				},
+				Action: app.devWatch,
+			},
+		},
+	}
+}
+
+func (app *App) devWatch(c *cli.Context) error {
+	container, err := app.containerMgr.ResolveContainer(c.String("container"))
+	if err != nil {
+		return err
+	}
+	sig, err := parseDevSignal(c.String("signal"))
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	options := dev.Options{
+		Path:        c.String("path"),
+		Target:      c.String("sync"),
+		Mode:        c.String("mode"),
+		Action:      c.String("action"),
+		Signal:      sig,
+		Interval:    c.Duration("interval"),
+		Debounce:    c.Duration("debounce"),
+		Ignore:      c.StringSlice("ignore"),
+		StopTimeout: c.Int("stop-timeout"),
+		OnSync: func(report dev.SyncReport) {
+			timestamp := time.Now().Format("15:04:05")
+			if report.Err != nil {
+				fmt.Printf("%s  %d changed, %s failed: %v\n", timestamp, len(report.Changes), report.Action, report.Err)
+				return
+			}
+			fmt.Printf("%s  %d changed, %s\n", timestamp, len(report.Changes), report.Action)
+		},
+	}
+	fmt.Printf("Watching %s for %s (press Ctrl+C to stop)\n", options.Path, container.Name)
+	return dev.Watch(ctx, app.containerMgr, container.ID, options)
+}
+
+// parseDevSignal accepts HUP, SIGHUP or a signal number.
+func parseDevSignal(name string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(name); err == nil {
+		if n <= 0 || n > 64 {
+			return 0, fmt.Errorf("invalid signal number: %d", n)
+		}
+		return syscall.Signal(n), nil
+	}
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	sig, ok := devSignals[name]
+	if !ok {
+		return 0, fmt.Errorf("unsupported signal: %s", name)
+	}
+	return sig, nil
+}
@@ -0,0 +1,104 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"text/template"
+	"time"
+
+	"docker-impl/pkg/timeutil"
+	"github.com/urfave/cli/v2"
+)
+
+// formatFlags are shared by the commands whose output scripts parse.
+func formatFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "format",
+			Usage: "Format the output using a Go template (e.g. '{{.ID}}'), or 'json'",
+		},
+		&cli.BoolFlag{
+			Name:  "json",
+			Usage: "Print the output as JSON",
+		},
+	}
+}
+
+// timeRangeFlags filter lists by when their entries were created, or for
+// event logs when they happened.
+func timeRangeFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "since",
+			Usage: "Only show entries from this time on (RFC3339, YYYY-MM-DD, unix seconds, or a duration like 24h)",
+		},
+		&cli.StringFlag{
+			Name:  "until",
+			Usage: "Only show entries up to this time (same formats as --since)",
+		},
+	}
+}
+
+func timeRangeFromFlags(c *cli.Context) (timeutil.Range, error) {
+	return timeutil.ParseRange(c.String("since"), c.String("until"), time.Now())
+}
+
+// formatTime prints a record timestamp, leaving unknown times blank.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Local().Format(time.RFC3339)
+}
+
+var formatFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"join":  strings.Join,
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+}
+
+// printFormatted writes v as requested by --format or --json and reports
+// whether it did; without either flag the caller prints its usual output.
+// When v is a slice, a template is applied to each element on its own line
+// and JSON is written as an array.
+func printFormatted(c *cli.Context, v interface{}) (bool, error) {
+	format := c.String("format")
+	if c.Bool("json") || format == "json" {
+		data, err := json.MarshalIndent(v, "", "    ")
+		if err != nil {
+			return true, fmt.Errorf("failed to marshal output: %v", err)
+		}
+		fmt.Println(string(data))
+		return true, nil
+	}
+	if format == "" {
+		return false, nil
+	}
+
+	tmpl, err := template.New("format").Funcs(formatFuncs).Parse(format)
+	if err != nil {
+		return true, fmt.Errorf("invalid format template: %v", err)
+	}
+
+	items := []interface{}{v}
+	if value := reflect.ValueOf(v); value.Kind() == reflect.Slice {
+		items = make([]interface{}, value.Len())
+		for i := range items {
+			items[i] = value.Index(i).Interface()
+		}
+	}
+	for _, item := range items {
+		if err := tmpl.Execute(os.Stdout, item); err != nil {
+			return true, fmt.Errorf("failed to format output: %v", err)
+		}
+		fmt.Println()
+	}
+	return true, nil
+}
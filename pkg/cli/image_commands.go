@@ -0,0 +1,637 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"docker-impl/pkg/config"
+	"docker-impl/pkg/image"
+	"docker-impl/pkg/performance"
+	"docker-impl/pkg/reference"
+	"docker-impl/pkg/scan"
+	"docker-impl/pkg/types"
+	"github.com/urfave/cli/v2"
+)
+
+func (app *App) pullImage(c *cli.Context) error {
+	if c.String("file") != "" {
+		return app.pullImageList(c)
+	}
+	if c.NArg() < 1 {
+		return fmt.Errorf("image name is required")
+	}
+
+	arg := c.Args().First()
+	// --tag only applies when the reference doesn't carry its own
+	if parsed, err := reference.Parse(arg); err == nil && parsed.Tag == "" && parsed.Digest == "" && c.String("tag") != "" {
+		arg += ":" + c.String("tag")
+	}
+	ref, err := reference.ParseNormalized(arg)
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("offline") {
+		app.imageMgr.SetTrustOffline(true)
+	}
+	if c.Bool("lazy") {
+		app.enableLazyPull()
+	}
+
+	img, err := app.imageMgr.PullReference(ref, c.String("platform"))
+	if err != nil {
+		return fmt.Errorf("failed to pull image: %v", err)
+	}
+	if app.prefetcher != nil {
+		// The process exits after the pull, so wait for the startup files
+		app.prefetcher.Wait()
+	}
+
+	fmt.Printf("Pulled %s (%s)\n", ref.FamiliarString(), img.Platform)
+	for _, digest := range img.RepoDigests {
+		fmt.Printf("Digest: %s\n", digest)
+	}
+	fmt.Printf("ID: %s\n", img.ID)
+	return nil
+}
+
+// pullImageList pulls the images listed in --file in parallel, printing
+// each as it starts and ends, then a summary of those that failed.
+func (app *App) pullImageList(c *cli.Context) error {
+	refs, err := readPullList(c.String("file"))
+	if err != nil {
+		return err
+	}
+	if len(refs) == 0 {
+		return fmt.Errorf("no images listed in %s", c.String("file"))
+	}
+
+	if c.Bool("offline") {
+		app.imageMgr.SetTrustOffline(true)
+	}
+	if c.Bool("lazy") {
+		app.enableLazyPull()
+	}
+
+	results := app.imageMgr.PullAll(refs, c.String("platform"), c.Int("parallel"), func(event image.PullEvent) {
+		switch event.Status {
+		case "pulling":
+			fmt.Printf("[%d/%d] Pulling %s\n", event.Done, event.Total, event.Reference)
+		case "pulled":
+			fmt.Printf("[%d/%d] Pulled %s (%s) in %s\n", event.Done, event.Total, event.Reference,
+				shortID(event.Image.ID), event.Duration.Round(time.Millisecond))
+		default:
+			fmt.Printf("[%d/%d] Failed %s: %v\n", event.Done, event.Total, event.Reference, event.Error)
+		}
+	})
+	if app.prefetcher != nil {
+		app.prefetcher.Wait()
+	}
+
+	var failed []image.PullResult
+	for _, result := range results {
+		if result.Error != nil {
+			failed = append(failed, result)
+		}
+	}
+	fmt.Printf("\nPulled %d of %d images\n", len(results)-len(failed), len(results))
+	if len(failed) == 0 {
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "FAILED\tERROR")
+	for _, result := range failed {
+		fmt.Fprintf(w, "%s\t%v\n", result.Reference, result.Error)
+	}
+	w.Flush()
+	return fmt.Errorf("failed to pull %d image(s)", len(failed))
+}
+
+// readPullList reads a pull list from path, or stdin for "-".
+func readPullList(path string) ([]string, error) {
+	if path == "-" {
+		return image.ReadPullList(os.Stdin)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open pull list: %v", err)
+	}
+	defer file.Close()
+	refs, err := image.ReadPullList(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return refs, nil
+}
+
+func (app *App) buildImage(c *cli.Context) error {
+	contextDir := "."
+	if c.NArg() > 0 {
+		contextDir = c.Args().First()
+	}
+
+	options := types.ImageBuildOptions{
+		ContextDir: contextDir,
+		Dockerfile: c.String("file"),
+		NoCache:    c.Bool("no-cache"),
+		Target:     c.String("target"),
+		Squash:     c.Bool("squash"),
+	}
+	if tag := c.String("tag"); tag != "" {
+		options.Tags = []string{tag}
+	}
+	if args := c.StringSlice("build-arg"); len(args) > 0 {
+		options.BuildArgs = parseBuildArgs(args)
+	}
+	progress, err := image.NewBuildProgress(c.String("progress"), os.Stdout)
+	if err != nil {
+		return err
+	}
+	options.Progress = progress
+
+	img, err := app.imageMgr.BuildImage(options)
+	if err != nil {
+		return err
+	}
+
+	// JSON progress already names the tags in its complete event
+	if len(options.Tags) > 0 && c.String("progress") != "json" {
+		fmt.Printf("Successfully tagged %s:%s\n", img.Name, img.Tag)
+	}
+	return nil
+}
+
+func (app *App) flattenImage(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("image name is required")
+	}
+
+	source, err := app.resolveImage(c.Args().First())
+	if err != nil {
+		return err
+	}
+
+	img, err := app.imageMgr.FlattenImage(source.ID, c.StringSlice("tag"))
+	if err != nil {
+		return fmt.Errorf("failed to flatten image: %v", err)
+	}
+
+	fmt.Printf("Flattened %d layers into %d\n", len(source.Layers), len(img.Layers))
+	for _, tag := range img.RepoTags {
+		fmt.Printf("Tagged %s\n", tag)
+	}
+	fmt.Printf("ID: %s\n", img.ID)
+	return nil
+}
+
+func (app *App) listImages(c *cli.Context) error {
+	images, err := app.imageMgr.ListImages()
+	if err != nil {
+		return fmt.Errorf("failed to list images: %v", err)
+	}
+
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "REPOSITORY\tTAG\tIMAGE ID\tCREATED\tSIZE")
+	for _, img := range images {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s ago\t%s\n",
+			img.Name,
+			img.Tag,
+			shortID(img.ID),
+			humanDuration(now.Sub(img.CreatedAt)),
+			humanSize(img.Size),
+		)
+	}
+	return w.Flush()
+}
+
+func (app *App) removeImage(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("image name is required")
+	}
+
+	var failed []string
+	for _, name := range c.Args().Slice() {
+		report, err := app.imageMgr.RemoveImageReference(name, c.Bool("force"))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", name, err)
+			failed = append(failed, name)
+			continue
+		}
+		for _, ref := range report.Untagged {
+			fmt.Printf("Untagged: %s\n", ref)
+		}
+		if report.Deleted != "" {
+			fmt.Printf("Deleted: sha256:%s\n", report.Deleted)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to remove images: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func (app *App) tagImage(c *cli.Context) error {
+	if c.NArg() < 2 {
+		return fmt.Errorf("source image and at least one target are required")
+	}
+
+	source, err := app.resolveImage(c.Args().First())
+	if err != nil {
+		return err
+	}
+
+	for _, target := range c.Args().Tail() {
+		if err := app.imageMgr.TagImage(source.ID, target, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (app *App) untagImage(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("image name is required")
+	}
+
+	for _, name := range c.Args().Slice() {
+		if _, err := app.imageMgr.UntagImage(name); err != nil {
+			return fmt.Errorf("failed to untag %s: %v", name, err)
+		}
+		fmt.Printf("Untagged: %s\n", name)
+	}
+	return nil
+}
+
+// enableLazyPull turns on lazy pulling of eStargz layers, with prefetch
+// workers warming the files images need to start.
+func (app *App) enableLazyPull() {
+	if app.prefetcher != nil {
+		return
+	}
+	workers := app.prefetchWorkers
+	if workers <= 0 {
+		workers = 4
+	}
+	app.prefetcher = performance.NewPrefetchManager(workers)
+	app.prefetcher.Start()
+	app.imageMgr.SetLazyPull(true)
+	app.imageMgr.SetPrefetcher(app.prefetcher)
+}
+
+// offlineFlag is shared by the commands that verify signatures.
+func offlineFlag() cli.Flag {
+	return &cli.BoolFlag{
+		Name:  "offline",
+		Usage: "Verify signatures only against cached trust data, failing when it is missing or expired",
+	}
+}
+
+func (app *App) verifyImage(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("image name is required")
+	}
+	if c.Bool("offline") {
+		app.imageMgr.SetTrustOffline(true)
+	}
+
+	for _, name := range c.Args().Slice() {
+		keyID, err := app.imageMgr.VerifyImage(name)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Verified %s: signed by %s\n", name, keyID)
+	}
+	return nil
+}
+
+func (app *App) inspectImage(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("image name is required")
+	}
+
+	var results []*types.ImageInspect
+	for _, name := range c.Args().Slice() {
+		inspect, err := app.imageMgr.InspectImage(name)
+		if err != nil {
+			return fmt.Errorf("failed to inspect image %s: %v", name, err)
+		}
+		results = append(results, inspect)
+	}
+
+	data, err := json.MarshalIndent(results, "", "    ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal image: %v", err)
+	}
+
+	fmt.Println(string(data))
+	return nil
+}
+
+func (app *App) imageHistory(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("image name is required")
+	}
+
+	img, err := app.resolveImage(c.Args().First())
+	if err != nil {
+		return err
+	}
+
+	history, err := app.imageMgr.GetHistory(img.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get image history: %v", err)
+	}
+
+	noTrunc := c.Bool("no-trunc")
+	now := time.Now()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "LAYER\tCREATED\tCREATED BY\tSIZE\tCOMMENT")
+	for _, entry := range history {
+		layer := "<missing>"
+		if entry.LayerID != "" {
+			layer = entry.LayerID
+			if !noTrunc {
+				layer = shortID(strings.TrimPrefix(layer, "sha256:"))
+			}
+		}
+
+		created := "N/A"
+		if !entry.Created.IsZero() {
+			created = humanDuration(now.Sub(entry.Created)) + " ago"
+		}
+
+		createdBy := entry.CreatedBy
+		if !noTrunc && len(createdBy) > 45 {
+			createdBy = createdBy[:44] + "…"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", layer, created, createdBy, humanSize(entry.Size), entry.Comment)
+	}
+	return w.Flush()
+}
+
+func (app *App) scanImage(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("image name is required")
+	}
+
+	minSeverity := scan.SeverityUnknown
+	if c.String("severity") != "" {
+		severity, err := scan.ParseSeverity(c.String("severity"))
+		if err != nil {
+			return err
+		}
+		minSeverity = severity
+	}
+
+	img, err := app.resolveImage(c.Args().First())
+	if err != nil {
+		return err
+	}
+
+	target := scan.Target{Image: img}
+	for _, layerID := range img.Layers {
+		if app.imageMgr.LayerExists(layerID) {
+			target.Layers = append(target.Layers, app.imageMgr.GetLayerDir(layerID))
+		}
+	}
+
+	var scanner scan.Scanner
+	if path := c.String("scanner"); path != "" {
+		scanner = &scan.ExternalScanner{Path: path}
+	} else {
+		db, err := app.loadVulnerabilityDB(c.Bool("update-db"))
+		if err != nil {
+			return err
+		}
+		scanner = scan.NewBuiltinScanner(db)
+	}
+
+	report, err := scanner.Scan(target)
+	if err != nil {
+		return fmt.Errorf("failed to scan image: %v", err)
+	}
+	report.Filter(minSeverity)
+
+	if c.Bool("json") {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+
+	fmt.Printf("Image: %s\n", shortID(strings.TrimPrefix(report.ImageID, "sha256:")))
+	if report.OS != "" {
+		fmt.Printf("OS: %s\n", report.OS)
+	}
+	fmt.Printf("Packages: %d\n\n", report.Packages)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "VULNERABILITY\tPACKAGE\tINSTALLED\tFIXED\tSEVERITY")
+	for _, finding := range report.Findings {
+		fixed := finding.FixedVersion
+		if fixed == "" {
+			fixed = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", finding.VulnerabilityID, finding.Package, finding.InstalledVersion, fixed, finding.Severity)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	counts := report.Counts()
+	fmt.Printf("\nTotal: %d (CRITICAL: %d, HIGH: %d, MEDIUM: %d, LOW: %d, UNKNOWN: %d)\n",
+		len(report.Findings), counts[scan.SeverityCritical], counts[scan.SeverityHigh],
+		counts[scan.SeverityMedium], counts[scan.SeverityLow], counts[scan.SeverityUnknown])
+	for _, warning := range report.Warnings {
+		fmt.Printf("Warning: %s\n", warning)
+	}
+	return nil
+}
+
+// loadVulnerabilityDB reads the database from the data directory, first
+// downloading it from the configured URL when update is set.
+func (app *App) loadVulnerabilityDB(update bool) (*scan.Database, error) {
+	path := filepath.Join(app.store.GetDataDir(), scan.DatabaseFile)
+	if !update {
+		return scan.LoadDatabase(path)
+	}
+
+	daemonConfig, err := config.Load("")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load daemon config: %v", err)
+	}
+	if daemonConfig.VulnerabilityDB == "" {
+		return nil, fmt.Errorf("no vulnerability_db URL is configured")
+	}
+	fmt.Printf("Downloading vulnerability database from %s\n", daemonConfig.VulnerabilityDB)
+	return scan.DownloadDatabase(daemonConfig.VulnerabilityDB, path)
+}
+
+func (app *App) saveImages(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("at least one image is required")
+	}
+
+	var images []*types.Image
+	for _, ref := range c.Args().Slice() {
+		img, err := app.resolveImage(ref)
+		if err != nil {
+			return err
+		}
+		images = append(images, img)
+	}
+
+	format := c.String("format")
+	output := c.String("output")
+
+	// An OCI layout is a directory unless a .tar file is asked for
+	if format == image.ArchiveFormatOCI && output != "" && !strings.HasSuffix(output, ".tar") {
+		if err := app.imageMgr.SaveImagesToDir(images, output); err != nil {
+			return fmt.Errorf("failed to save images: %v", err)
+		}
+		return nil
+	}
+
+	if output == "" {
+		if info, err := os.Stdout.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+			return fmt.Errorf("refusing to write the archive to a terminal, use --output or redirect STDOUT")
+		}
+		return app.imageMgr.SaveImages(images, format, os.Stdout)
+	}
+
+	file, err := os.Create(output)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", output, err)
+	}
+	if err := app.imageMgr.SaveImages(images, format, file); err != nil {
+		file.Close()
+		os.Remove(output)
+		return fmt.Errorf("failed to save images: %v", err)
+	}
+	return file.Close()
+}
+
+func (app *App) loadImages(c *cli.Context) error {
+	input := c.String("input")
+
+	var (
+		images []*types.Image
+		err    error
+	)
+	switch info, statErr := os.Stat(input); {
+	case input == "":
+		images, err = app.imageMgr.LoadImages(os.Stdin)
+	case statErr != nil:
+		return fmt.Errorf("failed to open %s: %v", input, statErr)
+	case info.IsDir():
+		images, err = app.imageMgr.LoadImagesFromDir(input)
+	default:
+		file, openErr := os.Open(input)
+		if openErr != nil {
+			return fmt.Errorf("failed to open %s: %v", input, openErr)
+		}
+		defer file.Close()
+		images, err = app.imageMgr.LoadImages(file)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load images: %v", err)
+	}
+
+	for _, img := range images {
+		if img.Name == "<none>" {
+			fmt.Printf("Loaded image ID: %s\n", img.ID)
+			continue
+		}
+		fmt.Printf("Loaded image: %s:%s\n", img.Name, img.Tag)
+	}
+	return nil
+}
+
+func (app *App) pruneImages(c *cli.Context) error {
+	until, err := parsePruneFilters(c.StringSlice("filter"))
+	if err != nil {
+		return err
+	}
+	options := types.ImagePruneOptions{All: c.Bool("all"), Until: until}
+
+	containers, err := app.containerMgr.ListContainers(types.ContainerListOptions{All: true})
+	if err != nil {
+		return fmt.Errorf("failed to list containers: %v", err)
+	}
+	inUse := make(map[string]bool, len(containers))
+	for _, container := range containers {
+		inUse[container.Image] = true
+	}
+
+	report, err := app.imageMgr.PruneImages(options, inUse)
+	if err != nil {
+		return fmt.Errorf("failed to prune images: %v", err)
+	}
+
+	if len(report.ImagesDeleted) > 0 {
+		fmt.Println("Deleted Images:")
+		for _, id := range report.ImagesDeleted {
+			fmt.Printf("deleted: %s\n", id)
+		}
+		fmt.Println()
+	}
+	fmt.Printf("Total reclaimed space: %s\n", humanSize(report.SpaceReclaimed))
+	return nil
+}
+
+// parsePruneFilters reads --filter values of prune commands; only
+// until=<duration> is supported.
+func parsePruneFilters(filters []string) (time.Duration, error) {
+	var until time.Duration
+	for _, filter := range filters {
+		key, value, _ := strings.Cut(filter, "=")
+		switch key {
+		case "until":
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return 0, fmt.Errorf("invalid until filter %q: %v", value, err)
+			}
+			until = d
+		default:
+			return 0, fmt.Errorf("unsupported filter %q", filter)
+		}
+	}
+	return until, nil
+}
+
+// parseBuildArgs turns --build-arg values into a map. A bare KEY takes its
+// value from the environment and is dropped when the variable is unset.
+func parseBuildArgs(args []string) map[string]string {
+	buildArgs := make(map[string]string, len(args))
+	for _, arg := range args {
+		if name, value, ok := strings.Cut(arg, "="); ok {
+			buildArgs[name] = value
+			continue
+		}
+		if value, ok := os.LookupEnv(arg); ok {
+			buildArgs[arg] = value
+		}
+	}
+	return buildArgs
+}
+
+func humanSize(size int64) string {
+	const unit = 1000
+	if size < unit {
+		return fmt.Sprintf("%dB", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.3g%cB", float64(size)/float64(div), "kMGTPE"[exp])
+}
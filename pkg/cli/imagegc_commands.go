@@ -0,0 +1,281 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"docker-impl/pkg/cluster"
+	"docker-impl/pkg/reference"
+	"docker-impl/pkg/types"
+	"github.com/urfave/cli/v2"
+)
+
+func prepullCommand(a *App) *cli.Command {
+	return &cli.Command{
+		Name:      "prepull",
+		Usage:     "Pull images on every node and keep them from the image GC",
+		ArgsUsage: "IMAGE [IMAGE...]",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "unpin",
+				Usage: "Let the image GC remove the images again instead of pulling them",
+			},
+			&cli.StringFlag{
+				Name:    "file",
+				Usage:   "Also take the images listed in a file, one reference per line (- for stdin)",
+				Aliases: []string{"f"},
+			},
+		},
+		Action: a.prepullImages,
+	}
+}
+
+func imageGCCommand(a *App) *cli.Command {
+	return &cli.Command{
+		Name:  "image-gc",
+		Usage: "Remove images no task on a node has used for a retention period",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "enable",
+				Usage: "Enable or disable the image GC on every node (unset shows this node's policy)",
+			},
+			&cli.DurationFlag{
+				Name:  "retention",
+				Usage: "How long an image must have gone unused",
+				Value: 24 * time.Hour,
+			},
+			&cli.DurationFlag{
+				Name:  "interval",
+				Usage: "How often nodes collect",
+				Value: time.Hour,
+			},
+			&cli.StringSliceFlag{
+				Name:  "pin",
+				Usage: "Image never to collect (can be repeated)",
+			},
+			&cli.BoolFlag{
+				Name:  "now",
+				Usage: "Collect on this node right away",
+			},
+		},
+		Action: a.imageGC,
+	}
+}
+
+func nodeEventsCommand(a *App) *cli.Command {
+	return &cli.Command{
+		Name:      "events",
+		Usage:     "Show what a node did on its own, such as image GC",
+		ArgsUsage: "NODE",
+		Flags:     append(timeRangeFlags(), formatFlags()...),
+		Action:    a.nodeEvents,
+	}
+}
+
+func (a *App) prepullImages(c *cli.Context) error {
+	images := c.Args().Slice()
+	if path := c.String("file"); path != "" {
+		listed, err := readPullList(path)
+		if err != nil {
+			return err
+		}
+		images = append(images, listed...)
+	}
+	if len(images) == 0 {
+		return fmt.Errorf("please specify at least one image")
+	}
+
+	clusterMgr := cluster.GetClusterManager()
+	clusterMgr.SetLocalImageStore(&nodeImages{app: a})
+	results, err := clusterMgr.Prepull(cluster.PrepullRequest{Images: images, Unpin: c.Bool("unpin")})
+	if err != nil {
+		return fmt.Errorf("failed to prepull images: %v", err)
+	}
+
+	failed := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "NODE\tPULLED\tERROR")
+	for _, result := range results {
+		if result.Error != "" {
+			failed++
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\n", result.NodeID, len(result.Pulled), result.Error)
+	}
+	w.Flush()
+
+	if failed > 0 {
+		return fmt.Errorf("prepull failed on %d node(s)", failed)
+	}
+	return nil
+}
+
+func (a *App) imageGC(c *cli.Context) error {
+	clusterMgr := cluster.GetClusterManager()
+	clusterMgr.SetLocalImageStore(&nodeImages{app: a})
+
+	if c.IsSet("enable") {
+		policy := cluster.ImageGCPolicy{
+			Enabled:   c.Bool("enable"),
+			Retention: c.Duration("retention"),
+			Interval:  c.Duration("interval"),
+			Pinned:    c.StringSlice("pin"),
+		}
+		results, err := clusterMgr.SetImageGCPolicy(policy)
+		if err != nil {
+			return fmt.Errorf("failed to set image GC policy: %v", err)
+		}
+		failed := 0
+		for _, result := range results {
+			if result.Error != "" {
+				fmt.Printf("Node %s: %s\n", result.NodeID, result.Error)
+				failed++
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("image GC policy not set on %d node(s)", failed)
+		}
+		if policy.Enabled {
+			fmt.Printf("Nodes remove images unused for %s every %s\n", policy.Retention, policy.Interval)
+		} else {
+			fmt.Println("Image GC disabled")
+		}
+	}
+
+	if c.Bool("now") {
+		report, err := clusterMgr.ImageGC.Collect()
+		if err != nil {
+			return fmt.Errorf("failed to collect images: %v", err)
+		}
+		fmt.Printf("Removed %d image(s), reclaimed %s\n", len(report.ImagesDeleted), humanSize(report.SpaceReclaimed))
+		if report.Error != "" {
+			return fmt.Errorf("image GC failed: %s", report.Error)
+		}
+		return nil
+	}
+	if c.IsSet("enable") {
+		return nil
+	}
+
+	status := clusterMgr.ImageGC.Status()
+	fmt.Printf("Enabled: %t\n", status.Policy.Enabled)
+	if status.Policy.Enabled {
+		fmt.Printf("Retention: %s\n", nonZeroDuration(status.Policy.Retention, 24*time.Hour))
+		fmt.Printf("Interval: %s\n", nonZeroDuration(status.Policy.Interval, time.Hour))
+	}
+	if len(status.Policy.Pinned) > 0 {
+		fmt.Printf("Pinned: %s\n", strings.Join(status.Policy.Pinned, ", "))
+	}
+	if len(status.Prepulled) > 0 {
+		fmt.Printf("Prepulled: %s\n", strings.Join(status.Prepulled, ", "))
+	}
+	return nil
+}
+
+func nonZeroDuration(d, fallback time.Duration) time.Duration {
+	if d <= 0 {
+		return fallback
+	}
+	return d
+}
+
+func (a *App) nodeEvents(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("please specify a node ID")
+	}
+
+	window, err := timeRangeFromFlags(c)
+	if err != nil {
+		return err
+	}
+	allEvents, err := cluster.GetClusterManager().NodeEvents(c.Args().First())
+	if err != nil {
+		return err
+	}
+	nodeEvents := make([]cluster.NodeEvent, 0, len(allEvents))
+	for _, event := range allEvents {
+		if window.Contains(event.Time) {
+			nodeEvents = append(nodeEvents, event)
+		}
+	}
+	if ok, err := printFormatted(c, nodeEvents); ok {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "TIME\tACTION\tMESSAGE")
+	for _, event := range nodeEvents {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", formatTime(event.Time), event.Action, event.Message)
+	}
+	return w.Flush()
+}
+
+// nodeImages gives the cluster's image GC and prepulls access to the
+// images of this node.
+type nodeImages struct {
+	app *App
+}
+
+func (n *nodeImages) ListImages() ([]cluster.LocalImage, error) {
+	images, err := n.app.imageMgr.ListImages()
+	if err != nil {
+		return nil, err
+	}
+	local := make([]cluster.LocalImage, 0, len(images))
+	for _, image := range images {
+		local = append(local, cluster.LocalImage{ID: image.ID, Names: image.RepoTags, Size: image.Size})
+	}
+	return local, nil
+}
+
+func (n *nodeImages) ResolveImage(ref string) (string, error) {
+	image, err := n.app.resolveImage(ref)
+	if err != nil {
+		return "", err
+	}
+	return image.ID, nil
+}
+
+// RemoveImages prunes the images given, leaving every other image and
+// those of containers in place.
+func (n *nodeImages) RemoveImages(ids []string) ([]string, int64, error) {
+	remove := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		remove[id] = true
+	}
+
+	keep := make(map[string]bool)
+	images, err := n.app.imageMgr.ListImages()
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, image := range images {
+		if !remove[image.ID] {
+			keep[image.ID] = true
+		}
+	}
+	containers, err := n.app.containerMgr.ListContainers(types.ContainerListOptions{All: true})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list containers: %v", err)
+	}
+	for _, container := range containers {
+		keep[container.Image] = true
+	}
+
+	report, err := n.app.imageMgr.PruneImages(types.ImagePruneOptions{All: true}, keep)
+	if report == nil {
+		return nil, 0, err
+	}
+	return report.ImagesDeleted, report.SpaceReclaimed, err
+}
+
+func (n *nodeImages) PullImage(ref string) error {
+	parsed, err := reference.ParseNormalized(ref)
+	if err != nil {
+		return err
+	}
+	_, err = n.app.imageMgr.PullReference(parsed, "")
+	return err
+}
@@ -0,0 +1,407 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"docker-impl/pkg/cluster"
+	"docker-impl/pkg/ids"
+	"docker-impl/pkg/network"
+	"docker-impl/pkg/types"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+func (app *App) captureNetwork(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("exactly one container is required")
+	}
+
+	container, err := app.containerMgr.GetContainer(c.Args().First())
+	if err != nil {
+		return fmt.Errorf("failed to get container: %v", err)
+	}
+	if container.Status != types.StatusRunning || container.PID <= 0 {
+		return fmt.Errorf("container %s is not running", container.ID)
+	}
+
+	var w io.Writer = os.Stdout
+	output := c.String("output")
+	if output != "-" {
+		file, err := os.Create(output)
+		if err != nil {
+			return fmt.Errorf("failed to create output file: %v", err)
+		}
+		defer file.Close()
+		w = file
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	options := network.CaptureOptions{
+		PID:       container.PID,
+		Interface: c.String("interface"),
+		Duration:  c.Duration("duration"),
+		Filter:    c.String("filter"),
+	}
+	logrus.Infof("Capturing packets of container %s for %s", container.ID, options.Duration)
+	if err := network.Capture(ctx, options, w); err != nil {
+		return fmt.Errorf("failed to capture packets: %v", err)
+	}
+
+	if output != "-" {
+		fmt.Printf("Capture written to %s\n", output)
+	}
+	return nil
+}
+
+func (app *App) networkRules(c *cli.Context) error {
+	if c.NArg() > 1 {
+		return fmt.Errorf("at most one network can be given")
+	}
+
+	containerID := c.String("container")
+	if containerID != "" {
+		// Rules of a removed container can still be around, so an ID that
+		// doesn't resolve is used as given
+		if container, err := app.containerMgr.ResolveContainer(containerID); err == nil {
+			containerID = container.ID
+		}
+	}
+
+	store, err := network.LoadRuleStore(network.DefaultStateDir)
+	if err != nil {
+		return err
+	}
+	rules := store.List(c.Args().First(), containerID)
+
+	var diff *network.RuleDiff
+	missing := make(map[string]bool)
+	if c.Bool("verify") {
+		diff, err = store.Verify(c.Args().First(), containerID)
+		if err != nil {
+			return err
+		}
+		for _, rule := range diff.Missing {
+			missing[rule.ID] = true
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	header := "ID\tNETWORK\tCONTAINER\tPURPOSE\tRULE"
+	if diff != nil {
+		header += "\tSTATE"
+	}
+	fmt.Fprintln(w, header)
+	for _, rule := range rules {
+		container := "-"
+		if rule.ContainerID != "" {
+			container = ids.TruncateID(rule.ContainerID)
+		}
+		line := fmt.Sprintf("%s\t%s\t%s\t%s\t%s", rule.ID, rule.Network, container, rule.Purpose, rule.String())
+		if diff != nil {
+			state := "installed"
+			if missing[rule.ID] {
+				state = "missing"
+			}
+			line += "\t" + state
+		}
+		fmt.Fprintln(w, line)
+	}
+	w.Flush()
+
+	if diff == nil {
+		return nil
+	}
+	if len(diff.Stale) > 0 {
+		fmt.Println("\nRules in the kernel that aren't tracked:")
+		for _, rule := range diff.Stale {
+			fmt.Printf("  %s (%s %s)\n", rule.Spec, rule.Binary, rule.Table)
+		}
+	}
+	if !diff.InSync() {
+		return fmt.Errorf("%d rules missing, %d untracked rules in the kernel", len(diff.Missing), len(diff.Stale))
+	}
+	fmt.Println("\nAll rules are installed")
+	return nil
+}
+
+func (app *App) createNetwork(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("exactly one network name is required")
+	}
+	labels, err := parseKeyValues("--label", c.StringSlice("label"))
+	if err != nil {
+		return err
+	}
+	options, err := parseKeyValues("--opt", c.StringSlice("opt"))
+	if err != nil {
+		return err
+	}
+	if !c.Bool("icc") {
+		options[network.ICCOption] = "false"
+	}
+
+	// Overlay networks belong to the cluster; nodes create them as tasks
+	// on them are scheduled
+	if c.String("driver") == network.OverlayDriver {
+		overlay, err := cluster.GetClusterManager().Overlays.Create(cluster.OverlayNetworkOptions{
+			Name:    c.Args().First(),
+			Subnet:  c.String("subnet"),
+			Gateway: c.String("gateway"),
+			VNI:     c.Int("vni"),
+			Labels:  labels,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create network: %v", err)
+		}
+		fmt.Println(overlay.ID)
+		return nil
+	}
+
+	created, err := network.GetNetworkManager().CreateNetwork(network.CreateNetworkOptions{
+		Name:     c.Args().First(),
+		Driver:   c.String("driver"),
+		Subnet:   c.String("subnet"),
+		Gateway:  c.String("gateway"),
+		Internal: c.Bool("internal"),
+		Labels:   labels,
+		Options:  options,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create network: %v", err)
+	}
+
+	fmt.Println(created.ID)
+	return nil
+}
+
+func (app *App) listNetworks(c *cli.Context) error {
+	networks := network.GetNetworkManager().ListNetworks()
+	if ok, err := printFormatted(c, networks); ok {
+		return err
+	}
+
+	if c.Bool("quiet") {
+		for _, n := range networks {
+			fmt.Println(ids.TruncateID(n.ID))
+		}
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "NETWORK ID\tNAME\tDRIVER\tSUBNET\tCONTAINERS")
+	for _, n := range networks {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n", ids.TruncateID(n.ID), n.Name, n.Driver, n.Subnet, len(n.Containers))
+	}
+	return w.Flush()
+}
+
+// inspectNetworks shows networks with their containers' endpoints. An
+// overlay network the node has no task on is shown as the cluster has it.
+func (app *App) inspectNetworks(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("network name is required")
+	}
+
+	var networks []interface{}
+	for _, name := range c.Args().Slice() {
+		n, err := network.GetNetworkManager().GetNetwork(name)
+		if err == nil {
+			networks = append(networks, n)
+			continue
+		}
+		if overlay, overlayErr := cluster.GetClusterManager().Overlays.Get(name); overlayErr == nil {
+			networks = append(networks, overlay)
+			continue
+		}
+		return fmt.Errorf("failed to inspect network: %v", err)
+	}
+	if c.String("format") != "" {
+		_, err := printFormatted(c, networks)
+		return err
+	}
+
+	data, err := json.MarshalIndent(networks, "", "    ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal network: %v", err)
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// removeNetworks tries every network before reporting the failures.
+func (app *App) removeNetworks(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("network name is required")
+	}
+
+	var failures []string
+	for _, name := range c.Args().Slice() {
+		if _, err := cluster.GetClusterManager().Overlays.Get(name); err == nil {
+			if err := cluster.GetClusterManager().Overlays.Remove(name); err != nil {
+				failures = append(failures, fmt.Sprintf("failed to remove network %s: %v", name, err))
+				continue
+			}
+			// The node may never have had a task on it
+			if _, err := network.GetNetworkManager().GetNetwork(name); err != nil {
+				fmt.Println(name)
+				continue
+			}
+		}
+		if err := network.GetNetworkManager().RemoveNetwork(name); err != nil {
+			failures = append(failures, fmt.Sprintf("failed to remove network %s: %v", name, err))
+			continue
+		}
+		fmt.Println(name)
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%s", strings.Join(failures, "\n"))
+	}
+	return nil
+}
+
+func (app *App) updateNetwork(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("exactly one network is required")
+	}
+	if !c.IsSet("icc") {
+		return fmt.Errorf("nothing to update: set --icc")
+	}
+	if err := network.GetNetworkManager().SetICC(c.Args().First(), c.Bool("icc")); err != nil {
+		return fmt.Errorf("failed to update network: %v", err)
+	}
+	fmt.Println(c.Args().First())
+	return nil
+}
+
+func (app *App) addNetworkPolicy(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("exactly one network is required")
+	}
+
+	policy := network.Policy{Action: network.PolicyAllow}
+	if c.Bool("deny") {
+		policy.Action = network.PolicyDeny
+	}
+	if ref := strings.TrimPrefix(c.String("from"), "network:"); ref != c.String("from") {
+		policy.From = network.PolicyPeer{Type: network.PeerNetwork, ID: ref}
+	} else {
+		container, err := app.containerMgr.ResolveContainer(c.String("from"))
+		if err != nil {
+			return fmt.Errorf("failed to get container: %v", err)
+		}
+		policy.From = network.PolicyPeer{Type: network.PeerContainer, ID: container.ID, Name: container.Name}
+	}
+	if c.String("to") != "" {
+		container, err := app.containerMgr.ResolveContainer(c.String("to"))
+		if err != nil {
+			return fmt.Errorf("failed to get container: %v", err)
+		}
+		policy.To = &network.PolicyPeer{Type: network.PeerContainer, ID: container.ID, Name: container.Name}
+	}
+
+	added, err := network.GetNetworkManager().AddPolicy(c.Args().First(), policy)
+	if err != nil {
+		return fmt.Errorf("failed to add policy: %v", err)
+	}
+	fmt.Println(added.ID)
+	return nil
+}
+
+func (app *App) listNetworkPolicies(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("exactly one network is required")
+	}
+	n, err := network.GetNetworkManager().GetNetwork(c.Args().First())
+	if err != nil {
+		return err
+	}
+	policies := n.Policies
+	if policies == nil {
+		policies = []network.Policy{}
+	}
+	if ok, err := printFormatted(c, policies); ok {
+		return err
+	}
+
+	icc := "enabled"
+	if n.Options[network.ICCOption] == "false" {
+		icc = "disabled"
+	}
+	fmt.Printf("Inter-container communication: %s\n\n", icc)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "POLICY ID\tACTION\tFROM\tTO")
+	for _, policy := range policies {
+		to := "all containers"
+		if policy.To != nil {
+			to = policy.To.String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", policy.ID, policy.Action, policy.From, to)
+	}
+	return w.Flush()
+}
+
+// removeNetworkPolicies tries every policy before reporting the failures.
+func (app *App) removeNetworkPolicies(c *cli.Context) error {
+	if c.NArg() < 2 {
+		return fmt.Errorf("a network and at least one policy are required")
+	}
+
+	var failures []string
+	for _, id := range c.Args().Slice()[1:] {
+		if err := network.GetNetworkManager().RemovePolicy(c.Args().First(), id); err != nil {
+			failures = append(failures, fmt.Sprintf("failed to remove policy %s: %v", id, err))
+			continue
+		}
+		fmt.Println(id)
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%s", strings.Join(failures, "\n"))
+	}
+	return nil
+}
+
+func (app *App) connectNetwork(c *cli.Context) error {
+	if c.NArg() != 2 {
+		return fmt.Errorf("a network and a container are required")
+	}
+	container, err := app.containerMgr.ResolveContainer(c.Args().Get(1))
+	if err != nil {
+		return fmt.Errorf("failed to get container: %v", err)
+	}
+	if container.Status != types.StatusRunning {
+		return fmt.Errorf("container %s is not running", container.ID)
+	}
+
+	endpoint, err := network.GetNetworkManager().ConnectContainer(c.Args().First(), container.ID, container.Name, c.String("ip"), c.StringSlice("alias"))
+	if err != nil {
+		return fmt.Errorf("failed to connect container: %v", err)
+	}
+	fmt.Printf("Connected %s to %s as %s on %s\n", container.Name, c.Args().First(), endpoint.IPAddress, endpoint.Interface)
+	return nil
+}
+
+func (app *App) disconnectNetwork(c *cli.Context) error {
+	if c.NArg() != 2 {
+		return fmt.Errorf("a network and a container are required")
+	}
+	// A removed container can still have an endpoint left behind, so an
+	// ID that doesn't resolve is used as given
+	containerID := c.Args().Get(1)
+	if container, err := app.containerMgr.ResolveContainer(containerID); err == nil {
+		containerID = container.ID
+	}
+
+	if err := network.GetNetworkManager().DisconnectContainer(c.Args().First(), containerID); err != nil {
+		return fmt.Errorf("failed to disconnect container: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"docker-impl/pkg/store"
+	"github.com/urfave/cli/v2"
+)
+
+func (app *App) createSearchCommands() *cli.Command {
+	return &cli.Command{
+		Name:  "search",
+		Usage: "Search images and containers",
+		Subcommands: []*cli.Command{
+			{
+				Name:      "local",
+				Usage:     "Search local image names, labels and env, and container names, labels and env",
+				ArgsUsage: "QUERY...",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:  "type",
+						Usage: "Only return results of this type: image or container",
+					},
+					&cli.IntFlag{
+						Name:  "limit",
+						Usage: "Return at most this many results (0 for all)",
+					},
+					&cli.BoolFlag{
+						Name:  "reindex",
+						Usage: "Rebuild the search index before searching",
+					},
+				}, formatFlags()...),
+				Action: app.searchLocal,
+			},
+		},
+	}
+}
+
+func (app *App) searchLocal(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("search query is required")
+	}
+	kind := c.String("type")
+	if kind != "" && kind != store.KindImage && kind != store.KindContainer {
+		return fmt.Errorf("invalid type %q: expected image or container", kind)
+	}
+
+	// Stores created before the index existed are indexed on first search
+	if c.Bool("reindex") || !app.store.IndexExists() {
+		if err := app.imageMgr.RebuildIndex(); err != nil {
+			return fmt.Errorf("failed to index images: %v", err)
+		}
+		if err := app.containerMgr.RebuildIndex(); err != nil {
+			return fmt.Errorf("failed to index containers: %v", err)
+		}
+	}
+
+	results, err := app.store.Search(strings.Join(c.Args().Slice(), " "), kind)
+	if err != nil {
+		return err
+	}
+	if limit := c.Int("limit"); limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	if ok, err := printFormatted(c, results); ok {
+		return err
+	}
+
+	if len(results) == 0 {
+		fmt.Println("No results")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "TYPE\tID\tNAME\tMATCHES")
+	for _, result := range results {
+		id := result.ID
+		if len(id) > 12 {
+			id = id[:12]
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", result.Kind, id, result.Name, strings.Join(result.Matches, ", "))
+	}
+	return w.Flush()
+}
@@ -0,0 +1,252 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"docker-impl/pkg/cluster"
+	"github.com/urfave/cli/v2"
+)
+
+// secretCommand builds the command group for secrets or configs; both
+// kinds share the same subcommands.
+func secretCommand(a *App, kind cluster.SecretKind) *cli.Command {
+	noun := string(kind)
+	return &cli.Command{
+		Name:  noun,
+		Usage: fmt.Sprintf("Manage cluster %ss", noun),
+		Subcommands: []*cli.Command{
+			{
+				Name:      "create",
+				Usage:     fmt.Sprintf("Create a %s from a file or STDIN", noun),
+				ArgsUsage: "NAME FILE|-",
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{
+						Name:    "label",
+						Aliases: []string{"l"},
+						Usage:   "Set metadata (key=value)",
+					},
+				},
+				Action: a.secretAction(kind, a.createSecret),
+			},
+			{
+				Name:    "ls",
+				Usage:   fmt.Sprintf("List %ss", noun),
+				Aliases: []string{"list"},
+				Flags:   timeRangeFlags(),
+				Action:  a.secretAction(kind, a.listSecrets),
+			},
+			{
+				Name:      "inspect",
+				Usage:     fmt.Sprintf("Display details of a %s", noun),
+				ArgsUsage: "NAME",
+				Action:    a.secretAction(kind, a.inspectSecret),
+			},
+			{
+				Name:      "rotate",
+				Usage:     fmt.Sprintf("Replace the content of a %s and apply service reload policies", noun),
+				ArgsUsage: "NAME FILE|-",
+				Action:    a.secretAction(kind, a.rotateSecret),
+			},
+			{
+				Name:      "rm",
+				Usage:     fmt.Sprintf("Remove a %s", noun),
+				Aliases:   []string{"remove"},
+				ArgsUsage: "NAME",
+				Action:    a.secretAction(kind, a.removeSecret),
+			},
+		},
+	}
+}
+
+func reloadPolicyCommand(a *App) *cli.Command {
+	return &cli.Command{
+		Name:      "reload-policy",
+		Usage:     "Choose how a service reacts when its secrets or configs are rotated",
+		ArgsUsage: "SERVICE",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "action",
+				Usage: "none, signal or restart (empty shows the current policy)",
+			},
+			&cli.StringFlag{
+				Name:  "signal",
+				Usage: "Signal sent with --action signal",
+				Value: "SIGHUP",
+			},
+			&cli.DurationFlag{
+				Name:  "delay",
+				Usage: "Pause between task restarts with --action restart",
+				Value: 5 * time.Second,
+			},
+		},
+		Action: a.serviceReloadPolicy,
+	}
+}
+
+func (a *App) secretAction(kind cluster.SecretKind, action func(*cli.Context, cluster.SecretKind) error) cli.ActionFunc {
+	return func(c *cli.Context) error {
+		return action(c, kind)
+	}
+}
+
+func (a *App) createSecret(c *cli.Context, kind cluster.SecretKind) error {
+	if c.NArg() != 2 {
+		return fmt.Errorf("%s create requires a name and a file (or - for STDIN)", kind)
+	}
+
+	data, err := readSecretData(c.Args().Get(1))
+	if err != nil {
+		return err
+	}
+
+	labels := make(map[string]string)
+	for _, label := range c.StringSlice("label") {
+		key, value, _ := strings.Cut(label, "=")
+		labels[key] = value
+	}
+
+	clusterMgr := cluster.GetClusterManager()
+	secret, err := clusterMgr.SecretManager.Create(kind, c.Args().First(), data, labels)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", kind, err)
+	}
+
+	fmt.Println(secret.ID)
+	return nil
+}
+
+func (a *App) listSecrets(c *cli.Context, kind cluster.SecretKind) error {
+	created, err := timeRangeFromFlags(c)
+	if err != nil {
+		return err
+	}
+	clusterMgr := cluster.GetClusterManager()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tVERSION\tUPDATED")
+	for _, secret := range clusterMgr.SecretManager.List(kind) {
+		if !created.Contains(secret.CreatedAt) {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", secret.ID, secret.Name, secret.Version, formatTime(secret.UpdatedAt))
+	}
+	return w.Flush()
+}
+
+func (a *App) inspectSecret(c *cli.Context, kind cluster.SecretKind) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("please specify a %s", kind)
+	}
+
+	clusterMgr := cluster.GetClusterManager()
+	secret, err := clusterMgr.SecretManager.Get(kind, c.Args().First())
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(secret.Redacted(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %v", kind, err)
+	}
+
+	fmt.Println(string(data))
+	return nil
+}
+
+func (a *App) rotateSecret(c *cli.Context, kind cluster.SecretKind) error {
+	if c.NArg() != 2 {
+		return fmt.Errorf("%s rotate requires a name and a file (or - for STDIN)", kind)
+	}
+
+	data, err := readSecretData(c.Args().Get(1))
+	if err != nil {
+		return err
+	}
+
+	clusterMgr := cluster.GetClusterManager()
+	report, err := clusterMgr.SecretManager.Rotate(kind, c.Args().First(), data)
+	if err != nil {
+		return fmt.Errorf("failed to rotate %s: %v", kind, err)
+	}
+
+	fmt.Printf("Rotated %s %s to version %d\n", kind, report.Secret.Name, report.Secret.Version)
+	if len(report.Signaled) > 0 {
+		fmt.Printf("Signaled %d task(s)\n", len(report.Signaled))
+	}
+	if len(report.Restarting) > 0 {
+		fmt.Printf("Restarting %d task(s) one at a time\n", len(report.Restarting))
+	}
+	if len(report.Unchanged) > 0 {
+		fmt.Printf("%d task(s) will see the new content on their next restart\n", len(report.Unchanged))
+	}
+	return nil
+}
+
+func (a *App) removeSecret(c *cli.Context, kind cluster.SecretKind) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("please specify a %s", kind)
+	}
+
+	clusterMgr := cluster.GetClusterManager()
+	for _, ref := range c.Args().Slice() {
+		if err := clusterMgr.SecretManager.Remove(kind, ref); err != nil {
+			return fmt.Errorf("failed to remove %s %s: %v", kind, ref, err)
+		}
+		fmt.Println(ref)
+	}
+	return nil
+}
+
+func (a *App) serviceReloadPolicy(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("please specify a service ID")
+	}
+	serviceID := c.Args().First()
+
+	clusterMgr := cluster.GetClusterManager()
+	if !c.IsSet("action") {
+		policy := clusterMgr.SecretManager.GetReloadPolicy(serviceID)
+		fmt.Printf("Action: %s\n", policy.Action)
+		switch policy.Action {
+		case cluster.ReloadSignal:
+			fmt.Printf("Signal: %s\n", policy.Signal)
+		case cluster.ReloadRestart:
+			fmt.Printf("Delay: %s\n", policy.Delay)
+		}
+		return nil
+	}
+
+	policy := cluster.ReloadPolicy{
+		Action: cluster.ReloadAction(c.String("action")),
+		Signal: c.String("signal"),
+		Delay:  c.Duration("delay"),
+	}
+	if err := clusterMgr.SecretManager.SetReloadPolicy(serviceID, policy); err != nil {
+		return fmt.Errorf("failed to set reload policy: %v", err)
+	}
+
+	fmt.Printf("Service %s will use reload action %s\n", serviceID, policy.Action)
+	return nil
+}
+
+func readSecretData(path string) ([]byte, error) {
+	var (
+		data []byte
+		err  error
+	)
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	return data, nil
+}
@@ -0,0 +1,523 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"docker-impl/pkg/cluster"
+	"github.com/urfave/cli/v2"
+)
+
+// serviceCommands are the subcommands of `service` that manage the
+// services themselves.
+func serviceCommands(a *App) []*cli.Command {
+	return []*cli.Command{
+		{
+			Name:    "ls",
+			Usage:   "List services",
+			Aliases: []string{"list"},
+			Flags:   formatFlags(),
+			Action:  a.listServices,
+		},
+		serviceCreateCommand(a),
+		{
+			Name:      "inspect",
+			Usage:     "Inspect a service",
+			ArgsUsage: "SERVICE",
+			Action:    a.inspectService,
+		},
+		{
+			Name:      "rm",
+			Usage:     "Remove one or more services",
+			Aliases:   []string{"remove"},
+			ArgsUsage: "SERVICE...",
+			Action:    a.removeService,
+		},
+		{
+			Name:      "scale",
+			Usage:     "Scale one or more services",
+			ArgsUsage: "SERVICE=REPLICAS...",
+			Action:    a.scaleService,
+		},
+		serviceUpdateCommand(a),
+		{
+			Name:      "rollback",
+			Usage:     "Roll a service back to its spec before the last update",
+			ArgsUsage: "SERVICE",
+			Action:    a.rollbackService,
+		},
+		{
+			Name:      "ps",
+			Usage:     "List the tasks of a service",
+			ArgsUsage: "SERVICE",
+			Flags:     formatFlags(),
+			Action:    a.serviceTasks,
+		},
+	}
+}
+
+func serviceCreateCommand(a *App) *cli.Command {
+	return &cli.Command{
+		Name:      "create",
+		Usage:     "Create a service that keeps replicas of a task running",
+		ArgsUsage: "IMAGE [COMMAND] [ARG...]",
+		Flags: append([]cli.Flag{
+			&cli.StringFlag{
+				Name:     "name",
+				Usage:    "Service name",
+				Required: true,
+			},
+			&cli.IntFlag{
+				Name:  "replicas",
+				Usage: "Number of tasks to keep running",
+				Value: 1,
+			},
+			&cli.IntFlag{
+				Name:  "max-unavailable",
+				Usage: "Replicas that drains, rebalancing and rolling restarts may take down at once (0 for no budget)",
+			},
+			&cli.StringSliceFlag{
+				Name:    "env",
+				Usage:   "Set environment variables (KEY=VALUE)",
+				Aliases: []string{"e"},
+			},
+			&cli.StringSliceFlag{
+				Name:  "label",
+				Usage: "Set labels on the tasks (KEY=VALUE)",
+			},
+			&cli.StringSliceFlag{
+				Name:  "network",
+				Usage: "Attach the tasks to an overlay network (NAME[:ALIAS])",
+			},
+			&cli.StringSliceFlag{
+				Name:    "publish",
+				Usage:   "Publish a port of the tasks on their nodes ([PUBLISHED:]TARGET[/PROTOCOL])",
+				Aliases: []string{"p"},
+			},
+			&cli.Int64Flag{
+				Name:  "cpu",
+				Usage: "CPU reserved per task in millicores",
+				Value: 100,
+			},
+			&cli.StringFlag{
+				Name:  "memory",
+				Usage: "Memory reserved per task (e.g. 64m, 1g)",
+				Value: "64m",
+			},
+			&cli.StringSliceFlag{
+				Name:  "constraint",
+				Usage: "Only place tasks on matching nodes (e.g. node.role==worker, node.labels.zone!=a)",
+			},
+			&cli.StringSliceFlag{
+				Name:  "placement-pref",
+				Usage: "Spread tasks evenly over the values of a node label (spread=node.labels.<label>)",
+			},
+			&cli.IntFlag{
+				Name:  "replicas-max-per-node",
+				Usage: "Run at most this many tasks of the service on a node (0 for no limit)",
+			},
+			&cli.StringFlag{
+				Name:  "scheduling-strategy",
+				Usage: "Rank nodes by spread, binpack or random instead of the cluster's strategy",
+			},
+			&cli.StringFlag{
+				Name:  "namespace",
+				Usage: "Namespace of the service",
+			},
+			&cli.StringFlag{
+				Name:  "hostname",
+				Usage: "Hostname template of the tasks (e.g. {{.Service.Name}}-{{.Task.Slot}})",
+			},
+			&cli.StringFlag{
+				Name:  "restart-condition",
+				Usage: "Replace tasks that end: any, on-failure or none",
+				Value: cluster.RestartConditionAny,
+			},
+			&cli.DurationFlag{
+				Name:  "restart-delay",
+				Usage: "Wait between a task ending and its replacement",
+			},
+			&cli.IntFlag{
+				Name:  "restart-max-attempts",
+				Usage: "Give up on a slot after this many restarts (0 for no limit)",
+			},
+		}, updateConfigFlags()...),
+		Action: a.createService,
+	}
+}
+
+// updateConfigFlags set how the tasks of a service are replaced when it
+// is updated.
+func updateConfigFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.IntFlag{
+			Name:  "update-parallelism",
+			Usage: "Tasks replaced at once when the service is updated",
+			Value: 1,
+		},
+		&cli.DurationFlag{
+			Name:  "update-delay",
+			Usage: "Pause between batches of an update",
+		},
+		&cli.DurationFlag{
+			Name:  "update-monitor",
+			Usage: "How long a new task has to run to count as updated",
+			Value: 5 * time.Second,
+		},
+		&cli.Float64Flag{
+			Name:  "update-max-failure-ratio",
+			Usage: "Share of the replicas that may fail during an update",
+		},
+		&cli.StringFlag{
+			Name:  "update-failure-action",
+			Usage: "When an update fails: pause, continue or rollback",
+			Value: cluster.UpdateFailurePause,
+		},
+	}
+}
+
+// applyUpdateConfigFlags sets the update config from the flags given, or
+// from all of them with defaults.
+func applyUpdateConfigFlags(c *cli.Context, config *cluster.UpdateConfig, defaults bool) {
+	if defaults || c.IsSet("update-parallelism") {
+		config.Parallelism = c.Int("update-parallelism")
+	}
+	if defaults || c.IsSet("update-delay") {
+		config.Delay = c.Duration("update-delay")
+	}
+	if defaults || c.IsSet("update-monitor") {
+		config.Monitor = c.Duration("update-monitor")
+	}
+	if defaults || c.IsSet("update-max-failure-ratio") {
+		config.MaxFailureRatio = c.Float64("update-max-failure-ratio")
+	}
+	if defaults || c.IsSet("update-failure-action") {
+		config.FailureAction = c.String("update-failure-action")
+	}
+}
+
+func serviceUpdateCommand(a *App) *cli.Command {
+	return &cli.Command{
+		Name:      "update",
+		Usage:     "Update a service, replacing its tasks in batches",
+		ArgsUsage: "SERVICE",
+		Flags: append([]cli.Flag{
+			&cli.StringFlag{
+				Name:  "image",
+				Usage: "Image of the tasks",
+			},
+			&cli.StringSliceFlag{
+				Name:  "args",
+				Usage: "Command of the tasks, one flag per argument",
+			},
+			&cli.StringSliceFlag{
+				Name:  "env-add",
+				Usage: "Add or change environment variables (KEY=VALUE)",
+			},
+			&cli.StringSliceFlag{
+				Name:  "env-rm",
+				Usage: "Remove environment variables (KEY)",
+			},
+			&cli.IntFlag{
+				Name:  "replicas",
+				Usage: "Number of tasks to keep running",
+			},
+			&cli.IntFlag{
+				Name:  "max-unavailable",
+				Usage: "Replicas that drains, rebalancing and rolling restarts may take down at once (0 for no budget)",
+			},
+			&cli.Int64Flag{
+				Name:  "cpu",
+				Usage: "CPU reserved per task in millicores",
+			},
+			&cli.StringFlag{
+				Name:  "memory",
+				Usage: "Memory reserved per task (e.g. 64m, 1g)",
+			},
+			&cli.StringFlag{
+				Name:  "scheduling-strategy",
+				Usage: "Rank nodes by spread, binpack or random (empty for the cluster's strategy)",
+			},
+		}, updateConfigFlags()...),
+		Action: a.updateService,
+	}
+}
+
+func (a *App) createService(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("please specify an image")
+	}
+
+	memory, err := parseBytes(c.String("memory"))
+	if err != nil {
+		return fmt.Errorf("invalid memory: %v", err)
+	}
+
+	service := &cluster.Service{
+		Name:      c.String("name"),
+		Namespace: c.String("namespace"),
+		Image:     c.Args().First(),
+		Command:   c.Args().Tail(),
+		Env:       c.StringSlice("env"),
+		Replicas:  c.Int("replicas"),
+		Resources: cluster.Resources{CPU: c.Int64("cpu"), Memory: memory},
+		Placement: cluster.Placement{
+			Constraints: c.StringSlice("constraint"),
+			MaxReplicas: c.Int("replicas-max-per-node"),
+			Strategy:    c.String("scheduling-strategy"),
+		},
+		HostnameTemplate: c.String("hostname"),
+		MaxUnavailable:   c.Int("max-unavailable"),
+		RestartPolicy: cluster.RestartPolicy{
+			Condition:   c.String("restart-condition"),
+			MaxAttempts: c.Int("restart-max-attempts"),
+		},
+	}
+	applyUpdateConfigFlags(c, &service.UpdateConfig, true)
+	for _, pref := range c.StringSlice("placement-pref") {
+		strategy, label, _ := strings.Cut(pref, "=")
+		if strategy != "spread" || label == "" {
+			return fmt.Errorf("invalid placement preference %q: expected spread=node.labels.<label>", pref)
+		}
+		service.Placement.Preferences = append(service.Placement.Preferences, cluster.Preference{Spread: label})
+	}
+	if delay := c.Duration("restart-delay"); delay > 0 {
+		service.RestartPolicy.Delay = delay.String()
+	}
+	if labels := c.StringSlice("label"); len(labels) > 0 {
+		service.Labels = make(map[string]string)
+		for _, label := range labels {
+			key, value, _ := strings.Cut(label, "=")
+			service.Labels[key] = value
+		}
+	}
+	for _, value := range c.StringSlice("network") {
+		target, alias, _ := strings.Cut(value, ":")
+		service.Networks = append(service.Networks, cluster.NetworkConfig{Target: target, Alias: alias})
+	}
+	for _, value := range c.StringSlice("publish") {
+		port, err := cluster.ParsePortConfig(value)
+		if err != nil {
+			return err
+		}
+		service.Ports = append(service.Ports, port)
+	}
+
+	created, err := cluster.GetClusterManager().Services.CreateService(service)
+	if err != nil {
+		return fmt.Errorf("failed to create service: %v", err)
+	}
+
+	fmt.Println(created.ID)
+	return nil
+}
+
+func (a *App) updateService(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("please specify a service")
+	}
+
+	clusterMgr := cluster.GetClusterManager()
+	spec, err := clusterMgr.Services.GetService(c.Args().First())
+	if err != nil {
+		return fmt.Errorf("failed to get service: %v", err)
+	}
+
+	if c.IsSet("image") {
+		spec.Image = c.String("image")
+	}
+	if c.IsSet("args") {
+		spec.Command = c.StringSlice("args")
+	}
+	if c.IsSet("env-add") || c.IsSet("env-rm") {
+		spec.Env = updateEnv(spec.Env, c.StringSlice("env-add"), c.StringSlice("env-rm"))
+	}
+	if c.IsSet("replicas") {
+		spec.Replicas = c.Int("replicas")
+	}
+	if c.IsSet("max-unavailable") {
+		spec.MaxUnavailable = c.Int("max-unavailable")
+	}
+	if c.IsSet("cpu") {
+		spec.Resources.CPU = c.Int64("cpu")
+	}
+	if c.IsSet("memory") {
+		if spec.Resources.Memory, err = parseBytes(c.String("memory")); err != nil {
+			return fmt.Errorf("invalid memory: %v", err)
+		}
+	}
+	if c.IsSet("scheduling-strategy") {
+		spec.Placement.Strategy = c.String("scheduling-strategy")
+	}
+	applyUpdateConfigFlags(c, &spec.UpdateConfig, false)
+
+	updated, err := clusterMgr.Services.UpdateService(spec.ID, spec)
+	if err != nil {
+		return fmt.Errorf("failed to update service: %v", err)
+	}
+
+	fmt.Printf("%s updating to version %d\n", updated.Name, updated.Version)
+	return nil
+}
+
+// updateEnv removes the variables named in remove from env and then sets
+// those in add, replacing earlier values of the same variable.
+func updateEnv(env, add, remove []string) []string {
+	drop := make(map[string]bool)
+	for _, name := range remove {
+		drop[name] = true
+	}
+	for _, value := range add {
+		name, _, _ := strings.Cut(value, "=")
+		drop[name] = true
+	}
+
+	var result []string
+	for _, value := range env {
+		name, _, _ := strings.Cut(value, "=")
+		if !drop[name] {
+			result = append(result, value)
+		}
+	}
+	return append(result, add...)
+}
+
+func (a *App) rollbackService(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("please specify a service")
+	}
+
+	service, err := cluster.GetClusterManager().Services.RollbackService(c.Args().First())
+	if err != nil {
+		return fmt.Errorf("failed to roll back service: %v", err)
+	}
+
+	fmt.Printf("%s rolling back to the spec of version %d\n", service.Name, service.SpecVersion)
+	return nil
+}
+
+func (a *App) listServices(c *cli.Context) error {
+	clusterMgr := cluster.GetClusterManager()
+	services := clusterMgr.Services.ListServices()
+	if ok, err := printFormatted(c, services); ok {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tREPLICAS\tIMAGE\tPORTS")
+	for _, service := range services {
+		var ports []string
+		for _, port := range service.Ports {
+			ports = append(ports, port.String())
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d/%d\t%s\t%s\n", shortID(service.ID), service.Name,
+			clusterMgr.Services.RunningReplicas(service.ID), service.Replicas, service.Image, strings.Join(ports, ", "))
+	}
+	return w.Flush()
+}
+
+func (a *App) inspectService(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("please specify a service")
+	}
+
+	service, err := cluster.GetClusterManager().Services.GetService(c.Args().First())
+	if err != nil {
+		return fmt.Errorf("failed to get service: %v", err)
+	}
+
+	data, err := json.MarshalIndent(service, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal service data: %v", err)
+	}
+
+	fmt.Println(string(data))
+	return nil
+}
+
+func (a *App) removeService(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("please specify a service")
+	}
+
+	clusterMgr := cluster.GetClusterManager()
+	for _, ref := range c.Args().Slice() {
+		if err := clusterMgr.Services.RemoveService(ref); err != nil {
+			return fmt.Errorf("failed to remove service: %v", err)
+		}
+		fmt.Println(ref)
+	}
+	return nil
+}
+
+// scaleService takes SERVICE=REPLICAS pairs, or a single SERVICE
+// REPLICAS.
+func (a *App) scaleService(c *cli.Context) error {
+	args := c.Args().Slice()
+	if len(args) == 2 && !strings.Contains(args[0], "=") && !strings.Contains(args[1], "=") {
+		args = []string{args[0] + "=" + args[1]}
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("please specify a service and its number of replicas")
+	}
+
+	clusterMgr := cluster.GetClusterManager()
+	for _, arg := range args {
+		ref, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return fmt.Errorf("invalid scale %q: expected SERVICE=REPLICAS", arg)
+		}
+		replicas, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid number of replicas %q for service %s", value, ref)
+		}
+		service, err := clusterMgr.Services.ScaleService(ref, replicas)
+		if err != nil {
+			return fmt.Errorf("failed to scale service: %v", err)
+		}
+		fmt.Printf("%s scaled to %d\n", service.Name, service.Replicas)
+	}
+	return nil
+}
+
+func (a *App) serviceTasks(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("please specify a service")
+	}
+
+	clusterMgr := cluster.GetClusterManager()
+	service, err := clusterMgr.Services.GetService(c.Args().First())
+	if err != nil {
+		return fmt.Errorf("failed to get service: %v", err)
+	}
+	tasks := clusterMgr.Services.ServiceTasks(service.ID)
+	if ok, err := printFormatted(c, tasks); ok {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tNODE\tDESIRED STATE\tCURRENT STATE\tERROR")
+	for _, task := range tasks {
+		node := task.NodeID
+		if n, err := clusterMgr.NodeManager.GetNode(task.NodeID); err == nil {
+			node = n.Name
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", shortID(task.ID), task.Name, node,
+			task.DesiredState, task.Status, task.Error)
+	}
+	return w.Flush()
+}
+
+// stopTaskContainer stops the container of a task started by runTask.
+func (a *App) stopTaskContainer(task *cluster.Task) error {
+	container, err := a.containerMgr.ResolveContainer(task.ContainerName())
+	if err != nil {
+		return err
+	}
+	return a.containerMgr.StopContainer(container.ID, 10)
+}
@@ -0,0 +1,246 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"docker-impl/pkg/api"
+	"docker-impl/pkg/network"
+	"docker-impl/pkg/telemetry"
+	"docker-impl/pkg/types"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+func (app *App) telemetryPath() string {
+	return filepath.Join(app.store.GetDataDir(), telemetry.FileName)
+}
+
+// instrumentCommands wraps every command action so that its duration,
+// result and the resource counts afterwards are recorded.
+func (app *App) instrumentCommands(commands []*cli.Command, prefix string) {
+	for _, cmd := range commands {
+		name := strings.TrimSpace(prefix + " " + cmd.Name)
+		if cmd.Action != nil {
+			cmd.Action = app.recordAction(name, cmd.Action)
+		}
+		app.instrumentCommands(cmd.Subcommands, name)
+	}
+}
+
+func (app *App) recordAction(name string, action cli.ActionFunc) cli.ActionFunc {
+	return func(c *cli.Context) error {
+		start := time.Now()
+		err := action(c)
+
+		record := telemetry.Record{
+			Time:       start,
+			Command:    name,
+			DurationMS: time.Since(start).Milliseconds(),
+			Result:     telemetry.ResultOK,
+			Counts:     app.resourceCounts(),
+		}
+		if err != nil {
+			record.Result = telemetry.ResultError
+		}
+		if recordErr := app.telemetry.Record(record); recordErr != nil {
+			logrus.Debugf("Failed to record telemetry: %v", recordErr)
+		}
+
+		return err
+	}
+}
+
+func (app *App) resourceCounts() map[string]int {
+	counts := make(map[string]int)
+	if images, err := app.imageMgr.ListImages(); err == nil {
+		counts["images"] = len(images)
+	}
+	if containers, err := app.containerMgr.ListContainers(types.ContainerListOptions{All: true}); err == nil {
+		counts["containers"] = len(containers)
+	}
+	return counts
+}
+
+func (app *App) systemInfo(c *cli.Context) error {
+	counts := app.resourceCounts()
+	fmt.Printf("Images: %d\n", counts["images"])
+	fmt.Printf("Containers: %d\n", counts["containers"])
+	fmt.Printf("Data Dir: %s\n", app.store.GetDataDir())
+
+	registry := app.imageMgr.Registry()
+	if registry == nil {
+		fmt.Println("Registry: none")
+		return nil
+	}
+	fmt.Printf("Registry: %s\n", registry.Endpoint())
+	if mirrors := registry.Mirrors(); len(mirrors) > 0 {
+		fmt.Println("Registry Mirrors:")
+		for _, mirror := range mirrors {
+			fmt.Printf(" %s\n", mirror)
+		}
+	}
+
+	if cache := registry.Cache(); cache != nil {
+		stats := cache.Stats()
+		limit := "unlimited"
+		if stats.MaxSize > 0 {
+			limit = humanSize(stats.MaxSize)
+		}
+		fmt.Println("Blob Cache:")
+		fmt.Printf(" Dir: %s\n", cache.Dir())
+		fmt.Printf(" Blobs: %d\n", stats.Entries)
+		fmt.Printf(" Size: %s / %s\n", humanSize(stats.Size), limit)
+		fmt.Printf(" Hits: %d\n", stats.Hits)
+		fmt.Printf(" Misses: %d\n", stats.Misses)
+		fmt.Printf(" Served: %s\n", humanSize(stats.BytesServed))
+	}
+	return nil
+}
+
+// systemPrune removes unused images and the build cache, then deletes the
+// layers nothing refers to any more.
+func (app *App) systemPrune(c *cli.Context) error {
+	containers, err := app.containerMgr.ListContainers(types.ContainerListOptions{All: true})
+	if err != nil {
+		return fmt.Errorf("failed to list containers: %v", err)
+	}
+	inUse := make(map[string]bool, len(containers))
+	for _, container := range containers {
+		inUse[container.Image] = true
+	}
+
+	images, err := app.imageMgr.PruneImages(types.ImagePruneOptions{All: c.Bool("all")}, inUse)
+	if err != nil {
+		return fmt.Errorf("failed to prune images: %v", err)
+	}
+	cacheEntries, err := app.imageMgr.PruneBuildCache()
+	if err != nil {
+		return fmt.Errorf("failed to prune build cache: %v", err)
+	}
+	layers, err := app.imageMgr.GarbageCollectLayers()
+	if err != nil {
+		return fmt.Errorf("failed to remove unused layers: %v", err)
+	}
+
+	if len(images.ImagesDeleted) > 0 {
+		fmt.Println("Deleted Images:")
+		for _, id := range images.ImagesDeleted {
+			fmt.Printf("deleted: %s\n", id)
+		}
+		fmt.Println()
+	}
+	deleted := append(images.LayersDeleted, layers.LayersDeleted...)
+	if len(deleted) > 0 {
+		fmt.Println("Deleted Layers:")
+		for _, id := range deleted {
+			fmt.Printf("deleted: %s\n", id)
+		}
+		fmt.Println()
+	}
+	if cacheEntries > 0 {
+		fmt.Printf("Deleted build cache entries: %d\n", cacheEntries)
+	}
+	fmt.Printf("Total reclaimed space: %s\n", humanSize(images.SpaceReclaimed+layers.SpaceReclaimed))
+	return nil
+}
+
+func (app *App) telemetryReport(c *cli.Context) error {
+	records, err := telemetry.Load(app.telemetryPath())
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		if app.telemetry == nil {
+			fmt.Println("Telemetry is disabled. Set \"telemetry\": true in the daemon config or MYDOCKER_TELEMETRY=1 to enable it.")
+		} else {
+			fmt.Println("No operations recorded yet.")
+		}
+		return nil
+	}
+
+	var since time.Time
+	if d := c.Duration("since"); d > 0 {
+		since = time.Now().Add(-d)
+	}
+	summaries := telemetry.Summarize(records, since)
+
+	if c.Bool("json") {
+		data, err := json.MarshalIndent(summaries, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal telemetry report: %v", err)
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "COMMAND\tCOUNT\tERRORS\tMEAN\tP50\tP95\tMAX")
+	for _, s := range summaries {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\t%s\n", s.Command, s.Count, s.Errors,
+			roundDuration(s.Mean), roundDuration(s.P50), roundDuration(s.P95), roundDuration(s.Max))
+	}
+	return w.Flush()
+}
+
+func roundDuration(d time.Duration) time.Duration {
+	if d < time.Second {
+		return d.Round(time.Millisecond)
+	}
+	return d.Round(10 * time.Millisecond)
+}
+
+// serveAPI serves the container API until interrupted.
+func (app *App) serveAPI(c *cli.Context) error {
+	proto, address, ok := strings.Cut(c.String("host"), "://")
+	if !ok || proto != "unix" && proto != "tcp" {
+		return fmt.Errorf("invalid host %q: expected unix://PATH or tcp://HOST:PORT", c.String("host"))
+	}
+	if proto == "unix" {
+		if err := os.MkdirAll(filepath.Dir(address), 0755); err != nil {
+			return fmt.Errorf("failed to create socket directory: %v", err)
+		}
+		// A socket left by a server that didn't shut down cleanly
+		os.Remove(address)
+	}
+	listener, err := net.Listen(proto, address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", c.String("host"), err)
+	}
+	if proto == "unix" {
+		defer os.Remove(address)
+		if err := os.Chmod(address, 0660); err != nil {
+			listener.Close()
+			return fmt.Errorf("failed to set socket permissions: %v", err)
+		}
+	}
+
+	server, err := api.NewServer(app.containerMgr, api.ServerConfig{
+		CORSOrigins:    c.StringSlice("cors-origin"),
+		TrustedProxies: c.StringSlice("trusted-proxy"),
+		BasePath:       c.String("base-path"),
+	})
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	server.SetNetwork(network.GetNetworkManager)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		<-signals
+		server.Stop()
+	}()
+
+	fmt.Printf("API listening on %s\n", c.String("host"))
+	return server.Serve(listener)
+}
@@ -0,0 +1,370 @@
+package cli
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"docker-impl/pkg/storage"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+func (app *App) createVolumeCommands() *cli.Command {
+	return &cli.Command{
+		Name:  "volume",
+		Usage: "Manage volumes",
+		Subcommands: []*cli.Command{
+			{
+				Name:      "create",
+				Usage:     "Create a volume",
+				ArgsUsage: "[VOLUME]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "driver",
+						Usage:   fmt.Sprintf("Volume driver: %s", strings.Join(storage.VolumeDrivers(), ", ")),
+						Aliases: []string{"d"},
+					},
+					&cli.StringSliceFlag{
+						Name:    "opt",
+						Usage:   "Set a driver option in key=value format (e.g. device=:/exports/data, size=64m)",
+						Aliases: []string{"o"},
+					},
+					&cli.StringSliceFlag{
+						Name:  "label",
+						Usage: "Set a label in key=value format",
+					},
+				},
+				Action: app.createVolume,
+			},
+			{
+				Name:    "ls",
+				Aliases: []string{"list"},
+				Usage:   "List volumes",
+				Flags: append([]cli.Flag{
+					&cli.StringSliceFlag{
+						Name:    "filter",
+						Usage:   "Filter volumes (dangling=true|false, label=<key>[=<value>], driver=<driver>, name=<name>)",
+						Aliases: []string{"f"},
+					},
+					&cli.BoolFlag{
+						Name:    "quiet",
+						Usage:   "Only display volume names",
+						Aliases: []string{"q"},
+					},
+				}, append(timeRangeFlags(), formatFlags()...)...),
+				Action: app.listVolumes,
+			},
+			{
+				Name:      "inspect",
+				Usage:     "Display detailed information on one or more volumes",
+				ArgsUsage: "VOLUME [VOLUME...]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "format",
+						Usage: "Format the output using a Go template (e.g. '{{.Mountpoint}}')",
+					},
+				},
+				Action: app.inspectVolumes,
+			},
+			{
+				Name:      "rm",
+				Aliases:   []string{"remove"},
+				Usage:     "Remove one or more volumes; volumes in use by containers are kept",
+				ArgsUsage: "VOLUME [VOLUME...]",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:    "force",
+						Usage:   "Do not fail on volumes that do not exist",
+						Aliases: []string{"f"},
+					},
+				},
+				Action: app.removeVolumes,
+			},
+			{
+				Name:  "prune",
+				Usage: "Remove volumes not used by any container",
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{
+						Name:  "filter",
+						Usage: "Filter volumes to remove (label=<key>[=<value>], driver=<driver>)",
+					},
+					&cli.BoolFlag{
+						Name:    "force",
+						Usage:   "Do not prompt for confirmation",
+						Aliases: []string{"f"},
+					},
+				},
+				Action: app.pruneVolumes,
+			},
+		},
+	}
+}
+
+func (app *App) createVolume(c *cli.Context) error {
+	name := c.Args().First()
+	if name == "" {
+		id := make([]byte, 32)
+		if _, err := rand.Read(id); err != nil {
+			return fmt.Errorf("failed to generate volume name: %v", err)
+		}
+		name = hex.EncodeToString(id)
+	}
+
+	options, err := parseKeyValues("--opt", c.StringSlice("opt"))
+	if err != nil {
+		return err
+	}
+	labels, err := parseKeyValues("--label", c.StringSlice("label"))
+	if err != nil {
+		return err
+	}
+
+	volume, err := app.storageMgr.CreateVolume(name, c.String("driver"), options, labels)
+	if err != nil {
+		return fmt.Errorf("failed to create volume: %v", err)
+	}
+
+	fmt.Println(volume.Name)
+	return nil
+}
+
+// volumeFilter selects volumes by --filter values. Volumes must match
+// every label, and any of the names and drivers given.
+type volumeFilter struct {
+	dangling *bool
+	labels   map[string]*string
+	names    []string
+	drivers  []string
+}
+
+func parseVolumeFilters(filters []string) (*volumeFilter, error) {
+	filter := &volumeFilter{labels: make(map[string]*string)}
+	for _, f := range filters {
+		key, value, ok := strings.Cut(f, "=")
+		if !ok || value == "" {
+			return nil, fmt.Errorf("invalid filter %q: expected key=value", f)
+		}
+		switch key {
+		case "dangling":
+			dangling, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid dangling filter %q: expected true or false", value)
+			}
+			filter.dangling = &dangling
+		case "label":
+			label, labelValue, hasValue := strings.Cut(value, "=")
+			if hasValue {
+				filter.labels[label] = &labelValue
+			} else {
+				filter.labels[label] = nil
+			}
+		case "name":
+			filter.names = append(filter.names, value)
+		case "driver":
+			filter.drivers = append(filter.drivers, value)
+		default:
+			return nil, fmt.Errorf("unsupported filter %q", f)
+		}
+	}
+	return filter, nil
+}
+
+func (f *volumeFilter) match(volume *storage.Volume) bool {
+	if f.dangling != nil && *f.dangling != (volume.UsageData == nil || volume.UsageData.RefCount == 0) {
+		return false
+	}
+	for label, value := range f.labels {
+		actual, ok := volume.Labels[label]
+		if !ok || value != nil && actual != *value {
+			return false
+		}
+	}
+	if len(f.names) > 0 && !containsMatch(f.names, func(name string) bool { return strings.Contains(volume.Name, name) }) {
+		return false
+	}
+	if len(f.drivers) > 0 && !containsMatch(f.drivers, func(driver string) bool { return driver == volume.Driver }) {
+		return false
+	}
+	return true
+}
+
+func containsMatch(values []string, match func(string) bool) bool {
+	for _, value := range values {
+		if match(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterVolumes returns the volumes matching filters, ordered by name.
+func (app *App) filterVolumes(filters []string) ([]*storage.Volume, error) {
+	filter, err := parseVolumeFilters(filters)
+	if err != nil {
+		return nil, err
+	}
+	volumes, err := app.storageMgr.ListVolumes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list volumes: %v", err)
+	}
+
+	var matched []*storage.Volume
+	for _, volume := range volumes {
+		if filter.match(volume) {
+			matched = append(matched, volume)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].Name < matched[j].Name })
+	return matched, nil
+}
+
+func (app *App) listVolumes(c *cli.Context) error {
+	created, err := timeRangeFromFlags(c)
+	if err != nil {
+		return err
+	}
+	matched, err := app.filterVolumes(c.StringSlice("filter"))
+	if err != nil {
+		return err
+	}
+	volumes := make([]*storage.Volume, 0, len(matched))
+	for _, volume := range matched {
+		if created.Contains(volume.CreatedAt) {
+			volumes = append(volumes, volume)
+		}
+	}
+	if ok, err := printFormatted(c, volumes); ok {
+		return err
+	}
+
+	if c.Bool("quiet") {
+		for _, volume := range volumes {
+			fmt.Println(volume.Name)
+		}
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "DRIVER\tVOLUME NAME")
+	for _, volume := range volumes {
+		fmt.Fprintf(w, "%s\t%s\n", volume.Driver, volume.Name)
+	}
+	return w.Flush()
+}
+
+func (app *App) inspectVolumes(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("volume name is required")
+	}
+
+	var volumes []*storage.Volume
+	for _, name := range c.Args().Slice() {
+		volume, err := app.storageMgr.GetVolume(name)
+		if err != nil {
+			return fmt.Errorf("failed to inspect volume: %v", err)
+		}
+		volumes = append(volumes, volume)
+	}
+	if c.String("format") != "" {
+		_, err := printFormatted(c, volumes)
+		return err
+	}
+
+	data, err := json.MarshalIndent(volumes, "", "    ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal volume: %v", err)
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// removeVolumes removes volumes like "docker volume rm": volumes in use
+// are never removed, and --force only ignores volumes that don't exist.
+// Every volume is tried before the failures are reported.
+func (app *App) removeVolumes(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("volume name is required")
+	}
+
+	var failures []string
+	for _, name := range c.Args().Slice() {
+		if _, err := app.storageMgr.GetVolume(name); err != nil {
+			if !c.Bool("force") {
+				failures = append(failures, fmt.Sprintf("no such volume: %s", name))
+			}
+			continue
+		}
+		if err := app.storageMgr.RemoveVolume(name, false); err != nil {
+			failures = append(failures, fmt.Sprintf("failed to remove volume %s: %v", name, err))
+			continue
+		}
+		fmt.Println(name)
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%s", strings.Join(failures, "\n"))
+	}
+	return nil
+}
+
+func (app *App) pruneVolumes(c *cli.Context) error {
+	filters := append([]string{"dangling=true"}, c.StringSlice("filter")...)
+	for _, filter := range c.StringSlice("filter") {
+		if key, _, _ := strings.Cut(filter, "="); key != "label" && key != "driver" {
+			return fmt.Errorf("unsupported filter %q", filter)
+		}
+	}
+	volumes, err := app.filterVolumes(filters)
+	if err != nil {
+		return err
+	}
+
+	if !c.Bool("force") {
+		fmt.Print("WARNING! This will remove all volumes not used by at least one container.\nAre you sure you want to continue? [y/N] ")
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+			return nil
+		}
+	}
+
+	var deleted []string
+	var reclaimed int64
+	for _, volume := range volumes {
+		size := volume.UsageData.Size
+		if err := app.storageMgr.RemoveVolume(volume.Name, false); err != nil {
+			logrus.Warnf("Failed to remove volume %s: %v", volume.Name, err)
+			continue
+		}
+		deleted = append(deleted, volume.Name)
+		reclaimed += size
+	}
+
+	if len(deleted) > 0 {
+		fmt.Println("Deleted Volumes:")
+		for _, name := range deleted {
+			fmt.Println(name)
+		}
+		fmt.Println()
+	}
+	fmt.Printf("Total reclaimed space: %s\n", humanSize(reclaimed))
+	return nil
+}
+
+// parseKeyValues reads flag values in key=value format.
+func parseKeyValues(flag string, values []string) (map[string]string, error) {
+	result := make(map[string]string, len(values))
+	for _, value := range values {
+		key, val, ok := strings.Cut(value, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid %s %q: expected key=value", flag, value)
+		}
+		result[key] = val
+	}
+	return result, nil
+}
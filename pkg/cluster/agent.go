@@ -0,0 +1,357 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// agentMonitorInterval is how often the agent checks the containers
+	// of its tasks and resends the reports its manager missed
+	agentMonitorInterval = 5 * time.Second
+
+	// simulatedTaskDuration is how long a task runs on a node without a
+	// task runner
+	simulatedTaskDuration = 5 * time.Second
+)
+
+// TaskStatusReport is a node telling the manager how a task it was
+// assigned is doing.
+type TaskStatusReport struct {
+	NodeID string     `json:"node_id"`
+	Status TaskStatus `json:"status"`
+	// Error says why the task failed or was rejected
+	Error string `json:"error,omitempty"`
+}
+
+// LocalTaskInspector reports how the container of a task started by the
+// LocalTaskRunner is doing: running, or complete or failed once it
+// exited. Whoever registers the runner registers one with
+// SetLocalTaskInspector; without one, tasks are reported running until
+// they are reassigned.
+type LocalTaskInspector func(task *Task) (*TaskStatusReport, error)
+
+// LocalTaskStopper stops the container of a task started by the
+// LocalTaskRunner when the manager shuts the task down. Whoever registers
+// the runner registers one with SetLocalTaskStopper.
+type LocalTaskStopper func(task *Task) error
+
+// taskAgent runs the tasks assigned to this node and reports their
+// progress to the manager that assigned them: the one this node joined,
+// or this node itself.
+type taskAgent struct {
+	manager *ClusterManager
+	client  *http.Client
+	mu      sync.Mutex
+	// tasks holds the tasks assigned to this node by task ID, until the
+	// manager has their final report
+	tasks     map[string]*agentTask
+	inspector LocalTaskInspector
+	stopper   LocalTaskStopper
+}
+
+type agentTask struct {
+	task *Task
+	// report is the latest status of the task; it is resent until the
+	// manager has it
+	report   TaskStatusReport
+	reported bool
+}
+
+func newTaskAgent(manager *ClusterManager) *taskAgent {
+	return &taskAgent{
+		manager: manager,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		tasks:   make(map[string]*agentTask),
+	}
+}
+
+// SetLocalTaskInspector registers how this node checks on the containers
+// of its tasks.
+func (cm *ClusterManager) SetLocalTaskInspector(inspect LocalTaskInspector) {
+	cm.agent.mu.Lock()
+	defer cm.agent.mu.Unlock()
+	cm.agent.inspector = inspect
+}
+
+// SetLocalTaskStopper registers how this node stops the containers of its
+// tasks.
+func (cm *ClusterManager) SetLocalTaskStopper(stop LocalTaskStopper) {
+	cm.agent.mu.Lock()
+	defer cm.agent.mu.Unlock()
+	cm.agent.stopper = stop
+}
+
+func (a *taskAgent) start() {
+	go a.loop()
+}
+
+func (a *taskAgent) loop() {
+	ticker := a.manager.Clock.NewTicker(agentMonitorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			a.monitor()
+		case <-a.manager.shutdown:
+			return
+		}
+	}
+}
+
+// assign takes a task the manager assigned to this node and starts it in
+// the background. A task assigned again is left to the first assignment.
+func (a *taskAgent) assign(task *Task) error {
+	if task.ID == "" {
+		return fmt.Errorf("task ID is required")
+	}
+	if task.Image == "" {
+		return fmt.Errorf("task image is required")
+	}
+
+	a.mu.Lock()
+	if _, exists := a.tasks[task.ID]; exists {
+		a.mu.Unlock()
+		return nil
+	}
+	assigned := *task
+	a.tasks[task.ID] = &agentTask{task: &assigned}
+	a.mu.Unlock()
+
+	logrus.Infof("Accepted task %s (%s)", task.ID, task.Image)
+	go a.run(&assigned)
+	return nil
+}
+
+// run pulls the task's image and starts its container with the local
+// task runner. Without one the task is simulated: it runs for a while and
+// completes.
+func (a *taskAgent) run(task *Task) {
+	run := a.manager.taskRunner()
+	if run == nil {
+		a.report(task.ID, TaskRunning, "")
+		a.manager.Clock.Sleep(simulatedTaskDuration)
+		a.report(task.ID, TaskComplete, "")
+		return
+	}
+
+	a.report(task.ID, TaskPreparing, "")
+	if err := run(task); err != nil {
+		logrus.Errorf("Failed to start task %s: %v", task.ID, err)
+		a.report(task.ID, TaskFailed, err.Error())
+		return
+	}
+	a.report(task.ID, TaskRunning, "")
+}
+
+// shutdown stops a task the manager shut down and reports it shut down.
+// The agent may have forgotten the task, e.g. after a restart, so the
+// manager sends all of it.
+func (a *taskAgent) shutdown(task *Task) {
+	a.mu.Lock()
+	if _, exists := a.tasks[task.ID]; !exists {
+		stopped := *task
+		a.tasks[task.ID] = &agentTask{task: &stopped}
+	}
+	stop := a.stopper
+	a.mu.Unlock()
+
+	go func() {
+		if stop != nil && a.manager.taskRunner() != nil {
+			if err := stop(task); err != nil {
+				logrus.Errorf("Failed to stop task %s: %v", task.ID, err)
+				a.report(task.ID, TaskFailed, err.Error())
+				return
+			}
+		}
+		a.report(task.ID, TaskShutdown, "")
+	}()
+}
+
+// report records a new status of a task and sends it to the manager.
+func (a *taskAgent) report(taskID string, status TaskStatus, message string) {
+	a.mu.Lock()
+	t, exists := a.tasks[taskID]
+	if !exists {
+		a.mu.Unlock()
+		return
+	}
+	t.report = TaskStatusReport{NodeID: a.manager.localNodeID(), Status: status, Error: message}
+	t.reported = false
+	report := t.report
+	a.mu.Unlock()
+
+	a.send(taskID, report)
+}
+
+// send delivers a report. Once the manager has the final report of a task
+// the agent forgets it.
+func (a *taskAgent) send(taskID string, report TaskStatusReport) {
+	if err := a.deliver(taskID, report); err != nil {
+		logrus.Warnf("Failed to report task %s as %s: %v", taskID, report.Status, err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if t, exists := a.tasks[taskID]; exists && t.report == report {
+		t.reported = true
+		if isTerminalTaskStatus(report.Status) {
+			delete(a.tasks, taskID)
+		}
+	}
+}
+
+func (a *taskAgent) deliver(taskID string, report TaskStatusReport) error {
+	cm := a.manager
+	cm.mu.RLock()
+	managerAddr, token := cm.joinAddr, cm.Config.JoinToken
+	cm.mu.RUnlock()
+
+	// Tasks a manager runs itself are reported to it directly
+	if managerAddr == "" {
+		return cm.TaskManager.ReportTaskStatus(taskID, report)
+	}
+
+	url := fmt.Sprintf("http://%s/tasks/%s/status", managerAddr, taskID)
+	return postClusterRequest(a.client, url, token, &report)
+}
+
+// monitor resends the reports the manager missed and reports the tasks
+// whose containers exited.
+func (a *taskAgent) monitor() {
+	type pending struct {
+		task   *Task
+		report TaskStatusReport
+		resend bool
+	}
+
+	a.mu.Lock()
+	inspect := a.inspector
+	var tasks []pending
+	for _, t := range a.tasks {
+		tasks = append(tasks, pending{task: t.task, report: t.report, resend: !t.reported})
+	}
+	a.mu.Unlock()
+
+	for _, t := range tasks {
+		if t.resend {
+			a.send(t.task.ID, t.report)
+			continue
+		}
+		if t.report.Status != TaskRunning || inspect == nil || a.manager.taskRunner() == nil {
+			continue
+		}
+
+		current, err := inspect(t.task)
+		if err != nil {
+			logrus.Debugf("Failed to inspect task %s: %v", t.task.ID, err)
+			continue
+		}
+		if current.Status != TaskRunning {
+			logrus.Infof("Task %s is %s", t.task.ID, current.Status)
+			a.report(t.task.ID, current.Status, current.Error)
+		}
+	}
+}
+
+// dispatchTask sends a task to the agent of the node it was assigned to.
+func (cm *ClusterManager) dispatchTask(task *Task, node *Node) error {
+	cm.mu.RLock()
+	token := cm.nodeToken(node)
+	cm.mu.RUnlock()
+
+	url := fmt.Sprintf("http://%s:%d/agent/tasks", node.Address, node.Port)
+	return postClusterRequest(cm.agent.client, url, token, task)
+}
+
+// shutdownTaskOnNode tells the agent of the node running a task to stop
+// it.
+func (cm *ClusterManager) shutdownTaskOnNode(task *Task) error {
+	node, err := cm.NodeManager.GetNode(task.NodeID)
+	if err != nil {
+		return err
+	}
+	if cm.isLocalNode(node) {
+		cm.agent.shutdown(task)
+		return nil
+	}
+
+	cm.mu.RLock()
+	token := cm.nodeToken(node)
+	cm.mu.RUnlock()
+
+	url := fmt.Sprintf("http://%s:%d/agent/tasks/%s/shutdown", node.Address, node.Port, task.ID)
+	return postClusterRequest(cm.agent.client, url, token, task)
+}
+
+// postClusterRequest posts v to another node of the cluster, authenticated
+// with the token the node knows the cluster by.
+func postClusterRequest(client *http.Client, url, token string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %v", err)
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Cluster-Token", token)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	response := APIResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return fmt.Errorf("failed to decode response: %v", err)
+	}
+	if !response.Success {
+		return fmt.Errorf("%s returned status %d: %s", req.URL.Host, resp.StatusCode, response.Error)
+	}
+	return nil
+}
+
+// handleAgentAssignTask takes a task the manager assigned to this node.
+func (api *APIServer) handleAgentAssignTask(w http.ResponseWriter, r *http.Request) {
+	var task Task
+	if err := json.NewDecoder(r.Body).Decode(&task); err != nil {
+		api.writeErrorResponse(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if err := api.manager.agent.assign(&task); err != nil {
+		api.writeErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	api.writeJSONResponse(w, http.StatusAccepted, APIResponse{
+		Success: true,
+		Message: fmt.Sprintf("Task %s accepted", task.ID),
+	})
+}
+
+// handleAgentShutdownTask stops a task the manager shut down.
+func (api *APIServer) handleAgentShutdownTask(w http.ResponseWriter, r *http.Request) {
+	var task Task
+	if err := json.NewDecoder(r.Body).Decode(&task); err != nil || task.ID != mux.Vars(r)["taskID"] {
+		api.writeErrorResponse(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	api.manager.agent.shutdown(&task)
+	api.writeJSONResponse(w, http.StatusAccepted, APIResponse{
+		Success: true,
+		Message: fmt.Sprintf("Shutting down task %s", task.ID),
+	})
+}
@@ -0,0 +1,431 @@
+package cluster
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"docker-impl/pkg/timeutil"
+	"github.com/sirupsen/logrus"
+)
+
+// Agent images carry the agent binary by reference: the image config's
+// labels name where to download it and its digest. Since the signature
+// covers the manifest, which covers the config, a verified image vouches
+// for the binary.
+const (
+	AgentVersionLabel      = "org.mydocker.agent.version"
+	AgentBinaryURLLabel    = "org.mydocker.agent.url"
+	AgentBinaryDigestLabel = "org.mydocker.agent.sha256"
+)
+
+const (
+	// AgentShimEnv is set by a shim supervising the agent. The agent then
+	// exits with AgentRestartExitCode after an update and lets the shim
+	// start the new binary instead of replacing its own process.
+	AgentShimEnv         = "MYDOCKER_AGENT_SHIM"
+	AgentRestartExitCode = 75
+
+	agentStateFile = "agent.json"
+	agentDir       = "agent"
+)
+
+// AgentImage is a resolved agent image. SignedBy is empty when the image
+// was not verified against a trusted key.
+type AgentImage struct {
+	Ref      string            `json:"ref"`
+	Version  string            `json:"version"`
+	Labels   map[string]string `json:"labels"`
+	SignedBy string            `json:"signed_by"`
+}
+
+// AgentImageResolver pulls an agent image and verifies its signature. The
+// cluster package doesn't own images, so whoever does registers one with
+// SetAgentImageResolver.
+type AgentImageResolver func(ref string) (*AgentImage, error)
+
+// AgentRestarter restarts this node's agent into a staged update, which
+// has been recorded as the node's agent by then. Without one the process
+// installs the binary over its own executable and restarts into it;
+// agents embedded in another process, such as tests, register their own
+// with SetAgentRestarter.
+type AgentRestarter func(state *AgentState)
+
+// AgentState is the agent binary a node runs, persisted in the cluster
+// data dir so the version survives the restart into the new binary.
+type AgentState struct {
+	Version   string `json:"version"`
+	Image     string `json:"image"`
+	Binary    string `json:"binary"`
+	Digest    string `json:"digest"`
+	SignedBy  string `json:"signed_by"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type AgentUpdateOptions struct {
+	Image         string        `json:"image"`
+	BatchSize     int           `json:"batch_size"`
+	HealthTimeout time.Duration `json:"health_timeout"`
+}
+
+// SetAgentImageResolver registers how this node resolves agent images.
+func (cm *ClusterManager) SetAgentImageResolver(resolve AgentImageResolver) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.agentResolver = resolve
+}
+
+// SetAgentRestarter registers how this node restarts its agent after an
+// update.
+func (cm *ClusterManager) SetAgentRestarter(restart AgentRestarter) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.agentRestarter = restart
+}
+
+func (cm *ClusterManager) resolveAgentImage(ref string) (*AgentImage, error) {
+	cm.mu.RLock()
+	resolve := cm.agentResolver
+	cm.mu.RUnlock()
+
+	if resolve == nil {
+		return nil, fmt.Errorf("this node cannot resolve agent images")
+	}
+	image, err := resolve(ref)
+	if err != nil {
+		return nil, err
+	}
+	if image.SignedBy == "" {
+		return nil, fmt.Errorf("agent image %s is not signed by a trusted key", ref)
+	}
+	if image.Version == "" {
+		image.Version = image.Labels[AgentVersionLabel]
+	}
+	if image.Version == "" {
+		return nil, fmt.Errorf("agent image %s has no version", ref)
+	}
+	return image, nil
+}
+
+// UpdateAgents rolls every node onto the agent in the given image, with
+// the same ordering, draining and health checks as Upgrade. Each agent
+// downloads and verifies the image itself, restarts into it and must
+// report the new version before the rollout moves on. The node running
+// the rollout restarts last, once every other node is done.
+func (cm *ClusterManager) UpdateAgents(options AgentUpdateOptions) (*UpgradeReport, error) {
+	if options.Image == "" {
+		return nil, fmt.Errorf("agent image is required")
+	}
+	if options.HealthTimeout <= 0 {
+		options.HealthTimeout = 2 * time.Minute
+	}
+
+	// Check the image here first so a bad one never drains a node
+	image, err := cm.resolveAgentImage(options.Image)
+	if err != nil {
+		return nil, err
+	}
+
+	updater := &agentUpdater{
+		manager: cm,
+		image:   options.Image,
+		timeout: options.HealthTimeout,
+		client:  &http.Client{Timeout: 10 * time.Minute},
+	}
+	report, err := cm.Upgrade(UpgradeOptions{
+		Version:       image.Version,
+		BatchSize:     options.BatchSize,
+		HealthTimeout: options.HealthTimeout,
+		Updater:       updater,
+	})
+	if err == nil && updater.local != nil {
+		go func() {
+			// Let the caller see the report before the process goes away
+			cm.Clock.Sleep(time.Second)
+			cm.restartAgent(updater.local)
+		}()
+	}
+	return report, err
+}
+
+// StageAgentUpdate downloads and verifies the agent binary of an image
+// and records it as this node's agent. It does not restart the agent.
+func (cm *ClusterManager) StageAgentUpdate(ref string) (*AgentState, error) {
+	image, err := cm.resolveAgentImage(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	url := image.Labels[AgentBinaryURLLabel]
+	digest := image.Labels[AgentBinaryDigestLabel]
+	if url == "" || digest == "" {
+		return nil, fmt.Errorf("agent image %s does not name its binary (labels %s and %s)", ref, AgentBinaryURLLabel, AgentBinaryDigestLabel)
+	}
+
+	dir := filepath.Join(cm.Config.DataDir, agentDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create agent directory: %v", err)
+	}
+	binary := filepath.Join(dir, "mydocker-"+image.Version)
+	if err := downloadAgentBinary(url, digest, binary); err != nil {
+		return nil, err
+	}
+
+	state := &AgentState{
+		Version:   image.Version,
+		Image:     ref,
+		Binary:    binary,
+		Digest:    digest,
+		SignedBy:  image.SignedBy,
+		UpdatedAt: cm.Clock.Now(),
+	}
+	logrus.Infof("Staged agent %s from %s (signed by %s)", state.Version, ref, state.SignedBy)
+	return state, nil
+}
+
+func downloadAgentBinary(url, digest, path string) error {
+	client := &http.Client{Timeout: 10 * time.Minute}
+	resp, err := client.Get(url)
+	if err != nil {
+		return fmt.Errorf("failed to download agent binary: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download agent binary: %s returned %s", url, resp.Status)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".download-")
+	if err != nil {
+		return fmt.Errorf("failed to download agent binary: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hash), resp.Body)
+	tmp.Close()
+	if err != nil {
+		return fmt.Errorf("failed to download agent binary: %v", err)
+	}
+
+	if actual := hex.EncodeToString(hash.Sum(nil)); actual != digest {
+		return fmt.Errorf("agent binary from %s has digest %s, expected %s", url, actual, digest)
+	}
+	if err := os.Chmod(tmp.Name(), 0755); err != nil {
+		return fmt.Errorf("failed to install agent binary: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to install agent binary: %v", err)
+	}
+	return nil
+}
+
+// restartAgent swaps the running executable for the staged binary and
+// restarts into it, through the shim when one supervises the agent.
+func (cm *ClusterManager) restartAgent(state *AgentState) {
+	cm.mu.RLock()
+	restart := cm.agentRestarter
+	cm.mu.RUnlock()
+	if restart != nil {
+		if err := cm.saveAgentState(state); err != nil {
+			logrus.Errorf("Failed to record agent %s: %v", state.Version, err)
+			return
+		}
+		logrus.Infof("Agent updated to %s, restarting", state.Version)
+		restart(state)
+		return
+	}
+
+	exe, err := os.Executable()
+	if err == nil {
+		exe, err = filepath.EvalSymlinks(exe)
+	}
+	if err != nil {
+		logrus.Errorf("Failed to locate agent executable: %v", err)
+		return
+	}
+
+	// Copy next to the executable so the final rename is atomic
+	if err := copyAgentBinary(state.Binary, exe+".new"); err != nil {
+		logrus.Errorf("Failed to install agent %s: %v", state.Version, err)
+		return
+	}
+	if err := os.Rename(exe+".new", exe); err != nil {
+		os.Remove(exe + ".new")
+		logrus.Errorf("Failed to install agent %s: %v", state.Version, err)
+		return
+	}
+	if err := cm.saveAgentState(state); err != nil {
+		logrus.Errorf("Failed to record agent %s: %v", state.Version, err)
+		return
+	}
+
+	if os.Getenv(AgentShimEnv) != "" {
+		logrus.Infof("Agent updated to %s, exiting for the shim to restart it", state.Version)
+		os.Exit(AgentRestartExitCode)
+	}
+
+	logrus.Infof("Agent updated to %s, restarting", state.Version)
+	if err := syscall.Exec(exe, os.Args, os.Environ()); err != nil {
+		logrus.Errorf("Failed to restart agent: %v", err)
+	}
+}
+
+func copyAgentBinary(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func (cm *ClusterManager) saveAgentState(state *AgentState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(cm.Config.DataDir, agentStateFile)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// loadAgentVersion returns the version of the agent this node last
+// updated itself to, or "" when it never has.
+func (cm *ClusterManager) loadAgentVersion() string {
+	data, err := os.ReadFile(filepath.Join(cm.Config.DataDir, agentStateFile))
+	if err != nil {
+		return ""
+	}
+	var state AgentState
+	if _, err := timeutil.Unmarshal(data, &state, recordTimeKeys...); err != nil {
+		logrus.Warnf("Failed to parse agent state: %v", err)
+		return ""
+	}
+	return state.Version
+}
+
+// agentUpdater updates nodes by asking their agents to update themselves.
+type agentUpdater struct {
+	manager *ClusterManager
+	image   string
+	timeout time.Duration
+	client  *http.Client
+	// local is the update staged for this node, applied after the rollout
+	local *AgentState
+}
+
+func (u *agentUpdater) UpdateNode(node *Node, version string) error {
+	if u.manager.isLocalNode(node) {
+		state, err := u.manager.StageAgentUpdate(u.image)
+		if err != nil {
+			return err
+		}
+		if state.Version != version {
+			return fmt.Errorf("agent image resolved to version %s, expected %s", state.Version, version)
+		}
+		u.local = state
+		return u.manager.recordNodeVersion(node.ID, version)
+	}
+
+	u.manager.mu.RLock()
+	token := u.manager.nodeToken(node)
+	u.manager.mu.RUnlock()
+
+	url := fmt.Sprintf("http://%s:%d/agent/update", node.Address, node.Port)
+	if err := postClusterRequest(u.client, url, token, map[string]string{"image": u.image, "version": version}); err != nil {
+		return err
+	}
+
+	// The agent restarts after answering; wait for the new one to report
+	if err := u.waitForAgentVersion(node, version); err != nil {
+		return err
+	}
+	return u.manager.recordNodeVersion(node.ID, version)
+}
+
+func (u *agentUpdater) waitForAgentVersion(node *Node, version string) error {
+	url := fmt.Sprintf("http://%s:%d/health", node.Address, node.Port)
+	client := &http.Client{Timeout: 3 * time.Second}
+
+	deadline := u.manager.Clock.Now().Add(u.timeout)
+	reported := ""
+	for u.manager.Clock.Now().Before(deadline) {
+		u.manager.Clock.Sleep(time.Second)
+
+		resp, err := client.Get(url)
+		if err != nil {
+			continue
+		}
+		var health struct {
+			Version string `json:"version"`
+		}
+		response := APIResponse{Data: &health}
+		err = json.NewDecoder(resp.Body).Decode(&response)
+		resp.Body.Close()
+		if err != nil {
+			continue
+		}
+
+		reported = health.Version
+		if reported == version {
+			return nil
+		}
+	}
+	return fmt.Errorf("agent did not come back at version %s within %s (reported %q)", version, u.timeout, reported)
+}
+
+func (cm *ClusterManager) recordNodeVersion(nodeID, version string) error {
+	return (&recordUpdater{nodeManager: cm.NodeManager}).UpdateNode(&Node{ID: nodeID}, version)
+}
+
+// handleAgentUpdate stages an update requested by a manager and restarts
+// this node's agent into it once the manager has its answer.
+func (api *APIServer) handleAgentUpdate(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Image   string `json:"image"`
+		Version string `json:"version"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Image == "" {
+		api.writeErrorResponse(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	state, err := api.manager.StageAgentUpdate(req.Image)
+	if err != nil {
+		api.writeErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if req.Version != "" && state.Version != req.Version {
+		api.writeErrorResponse(w, http.StatusConflict, fmt.Sprintf("agent image resolved to version %s, expected %s", state.Version, req.Version))
+		return
+	}
+
+	api.writeJSONResponse(w, http.StatusAccepted, APIResponse{
+		Success: true,
+		Message: fmt.Sprintf("Restarting into agent %s", state.Version),
+		Data:    state,
+	})
+
+	go func() {
+		api.manager.Clock.Sleep(time.Second)
+		api.manager.restartAgent(state)
+	}()
+}
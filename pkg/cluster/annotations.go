@@ -0,0 +1,116 @@
+package cluster
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Labels every task container carries, so logs and metrics can tell which
+// service, task and node they come from. They can't be overridden by the
+// task's own labels.
+const (
+	LabelServiceID   = "org.mydocker.cluster.service.id"
+	LabelServiceName = "org.mydocker.cluster.service.name"
+	LabelTaskID      = "org.mydocker.cluster.task.id"
+	LabelTaskName    = "org.mydocker.cluster.task.name"
+	LabelTaskSlot    = "org.mydocker.cluster.task.slot"
+	LabelNodeID      = "org.mydocker.cluster.node.id"
+	LabelNamespace   = "org.mydocker.cluster.namespace"
+)
+
+// Environment variables set in task containers when Task.MetadataEnv is on.
+const (
+	EnvServiceID   = "MYDOCKER_SERVICE_ID"
+	EnvServiceName = "MYDOCKER_SERVICE_NAME"
+	EnvTaskID      = "MYDOCKER_TASK_ID"
+	EnvTaskName    = "MYDOCKER_TASK_NAME"
+	EnvTaskSlot    = "MYDOCKER_TASK_SLOT"
+	EnvNodeID      = "MYDOCKER_NODE_ID"
+	EnvNamespace   = "MYDOCKER_NAMESPACE"
+)
+
+// LocalTaskRunner starts a task's container on the node this process runs
+// on. Like pruning, the cluster package leaves containers to whoever
+// registers one with SetLocalTaskRunner. The task agent calls it for the
+// tasks assigned to this node; without one they are simulated.
+type LocalTaskRunner func(task *Task) error
+
+type taskMetadata struct {
+	label, env, value string
+}
+
+func (t *Task) metadata() []taskMetadata {
+	var slot string
+	if t.ServiceID != "" {
+		slot = strconv.Itoa(t.Slot)
+	}
+
+	var metadata []taskMetadata
+	for _, m := range []taskMetadata{
+		{LabelServiceID, EnvServiceID, t.ServiceID},
+		{LabelServiceName, EnvServiceName, t.ServiceName},
+		{LabelTaskID, EnvTaskID, t.ID},
+		{LabelTaskName, EnvTaskName, t.Name},
+		{LabelTaskSlot, EnvTaskSlot, slot},
+		{LabelNodeID, EnvNodeID, t.NodeID},
+		{LabelNamespace, EnvNamespace, t.Namespace},
+	} {
+		if m.value != "" {
+			metadata = append(metadata, m)
+		}
+	}
+	return metadata
+}
+
+// ContainerLabels returns the labels of the task's container: its
+// annotations, then its labels, then the cluster metadata.
+func (t *Task) ContainerLabels() map[string]string {
+	labels := make(map[string]string, len(t.Annotations)+len(t.Labels)+7)
+	for k, v := range t.Annotations {
+		labels[k] = v
+	}
+	for k, v := range t.Labels {
+		labels[k] = v
+	}
+	for _, m := range t.metadata() {
+		labels[m.label] = m.value
+	}
+	return labels
+}
+
+// ContainerEnv returns the environment of the task's container. With
+// MetadataEnv the cluster metadata comes first, so the task's own Env can
+// still override it.
+func (t *Task) ContainerEnv() []string {
+	if !t.MetadataEnv {
+		return t.Env
+	}
+
+	var env []string
+	for _, m := range t.metadata() {
+		env = append(env, fmt.Sprintf("%s=%s", m.env, m.value))
+	}
+	return append(env, t.Env...)
+}
+
+// ContainerName names the task's container after the task, or its service
+// and slot, so it can be picked out of a container list.
+func (t *Task) ContainerName() string {
+	if t.ServiceName != "" {
+		return fmt.Sprintf("%s.%d.%s", t.ServiceName, t.Slot, t.ID)
+	}
+	return fmt.Sprintf("%s.%s", t.Name, t.ID)
+}
+
+// SetLocalTaskRunner registers how this node starts task containers.
+func (cm *ClusterManager) SetLocalTaskRunner(run LocalTaskRunner) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.localTaskRunner = run
+}
+
+func (cm *ClusterManager) taskRunner() LocalTaskRunner {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	return cm.localTaskRunner
+}
@@ -34,6 +34,10 @@ func (api *APIServer) Start() error {
 	api.setupRoutes()
 
 	addr := fmt.Sprintf("%s:%d", api.manager.Config.AdvertiseAddr, api.manager.Config.AdvertisePort)
+	listener := api.manager.Config.Listener
+	if listener != nil {
+		addr = listener.Addr().String()
+	}
 
 	api.server = &http.Server{
 		Addr:         addr,
@@ -46,7 +50,13 @@ func (api *APIServer) Start() error {
 	logrus.Infof("Starting API server on %s", addr)
 
 	go func() {
-		if err := api.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if listener != nil {
+			err = api.server.Serve(listener)
+		} else {
+			err = api.server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			logrus.Errorf("API server error: %v", err)
 		}
 	}()
@@ -67,6 +77,12 @@ func (api *APIServer) setupRoutes() {
 	api.router.HandleFunc("/cluster/join", api.handleClusterJoin).Methods("POST")
 	api.router.HandleFunc("/cluster/leave", api.handleClusterLeave).Methods("POST")
 	api.router.HandleFunc("/cluster/status", api.handleClusterStatus).Methods("GET")
+	api.router.HandleFunc("/cluster/prune", api.handleClusterPrune).Methods("POST")
+	api.router.HandleFunc("/cluster/rebalance", api.handleClusterRebalance).Methods("POST")
+	api.router.HandleFunc("/cluster/prepull", api.handleClusterPrepull).Methods("POST")
+	api.router.HandleFunc("/cluster/image-gc", api.handleClusterImageGC).Methods("PUT")
+	api.router.HandleFunc("/cluster/metrics", api.handleClusterMetrics).Methods("GET")
+	api.router.HandleFunc("/cluster/state", api.handleReplicateState).Methods("POST")
 
 	// Node management
 	api.router.HandleFunc("/nodes", api.handleListNodes).Methods("GET")
@@ -75,7 +91,19 @@ func (api *APIServer) setupRoutes() {
 	api.router.HandleFunc("/nodes/{nodeID}", api.handleUpdateNode).Methods("PUT")
 	api.router.HandleFunc("/nodes/{nodeID}", api.handleDeleteNode).Methods("DELETE")
 	api.router.HandleFunc("/nodes/{nodeID}/drain", api.handleDrainNode).Methods("POST")
+	api.router.HandleFunc("/nodes/{nodeID}/drain-status", api.handleDrainStatus).Methods("GET")
 	api.router.HandleFunc("/nodes/{nodeID}/activate", api.handleActivateNode).Methods("POST")
+	api.router.HandleFunc("/nodes/{nodeID}/events", api.handleNodeEvents).Methods("GET")
+	api.router.HandleFunc("/nodes/{nodeID}/heartbeat", api.handleNodeHeartbeat).Methods("POST")
+	api.router.HandleFunc("/node/prune", api.handleNodePrune).Methods("POST")
+	api.router.HandleFunc("/node/prepull", api.handleNodePrepull).Methods("POST")
+	api.router.HandleFunc("/node/image-gc", api.handleGetNodeImageGC).Methods("GET")
+	api.router.HandleFunc("/node/image-gc", api.handleSetNodeImageGC).Methods("PUT")
+	api.router.HandleFunc("/node/image-gc/collect", api.handleNodeImageGCCollect).Methods("POST")
+	api.router.HandleFunc("/node/events", api.handleLocalNodeEvents).Methods("GET")
+	api.router.HandleFunc("/agent/update", api.handleAgentUpdate).Methods("POST")
+	api.router.HandleFunc("/agent/tasks", api.handleAgentAssignTask).Methods("POST")
+	api.router.HandleFunc("/agent/tasks/{taskID}/shutdown", api.handleAgentShutdownTask).Methods("POST")
 
 	// Task management
 	api.router.HandleFunc("/tasks", api.handleListTasks).Methods("GET")
@@ -86,16 +114,56 @@ func (api *APIServer) setupRoutes() {
 	api.router.HandleFunc("/tasks/{taskID}/start", api.handleStartTask).Methods("POST")
 	api.router.HandleFunc("/tasks/{taskID}/stop", api.handleStopTask).Methods("POST")
 	api.router.HandleFunc("/tasks/{taskID}/restart", api.handleRestartTask).Methods("POST")
+	api.router.HandleFunc("/tasks/{taskID}/status", api.handleReportTaskStatus).Methods("POST")
+	api.router.HandleFunc("/tasks/{taskID}/health", api.handleReportTaskHealth).Methods("POST")
+	api.router.HandleFunc("/tasks/{taskID}/usage", api.handleReportTaskUsage).Methods("POST")
 
-	// Service management (placeholder for future)
+	// Service management
 	api.router.HandleFunc("/services", api.handleListServices).Methods("GET")
 	api.router.HandleFunc("/services", api.handleCreateService).Methods("POST")
+	api.router.HandleFunc("/services/{serviceID}", api.handleGetService).Methods("GET")
+	api.router.HandleFunc("/services/{serviceID}", api.handleDeleteService).Methods("DELETE")
+	api.router.HandleFunc("/services/{serviceID}/scale", api.handleScaleService).Methods("POST")
+	api.router.HandleFunc("/services/{serviceID}/update", api.handleUpdateService).Methods("POST")
+	api.router.HandleFunc("/services/{serviceID}/rollback", api.handleRollbackService).Methods("POST")
+	api.router.HandleFunc("/services/{serviceID}/tasks", api.handleListServiceTasks).Methods("GET")
+	api.router.HandleFunc("/services/{serviceID}/reload-policy", api.handleGetReloadPolicy).Methods("GET")
+	api.router.HandleFunc("/services/{serviceID}/reload-policy", api.handleSetReloadPolicy).Methods("PUT")
+	api.router.HandleFunc("/services/{serviceID}/rebalance-policy", api.handleGetRebalancePolicy).Methods("GET")
+	api.router.HandleFunc("/services/{serviceID}/rebalance-policy", api.handleSetRebalancePolicy).Methods("PUT")
+	api.router.HandleFunc("/services/{serviceID}/disruption-budget", api.handleGetDisruptionBudget).Methods("GET")
+	api.router.HandleFunc("/services/{serviceID}/disruption-budget", api.handleSetDisruptionBudget).Methods("PUT")
+	api.router.HandleFunc("/services/{serviceID}/status", api.handleServiceStatus).Methods("GET")
+	api.router.HandleFunc("/services/{serviceID}/slo-policy", api.handleGetSLOPolicy).Methods("GET")
+	api.router.HandleFunc("/services/{serviceID}/slo-policy", api.handleSetSLOPolicy).Methods("PUT")
+	api.router.HandleFunc("/services/{serviceID}/recommendation", api.handleServiceRecommendation).Methods("GET")
+	api.router.HandleFunc("/metrics", api.handleMetrics).Methods("GET")
+
+	// Secrets and configs
+	for _, kind := range []SecretKind{KindSecret, KindConfig} {
+		base := "/" + string(kind) + "s"
+		api.router.HandleFunc(base, api.handleListSecrets(kind)).Methods("GET")
+		api.router.HandleFunc(base, api.handleCreateSecret(kind)).Methods("POST")
+		api.router.HandleFunc(base+"/{ref}", api.handleGetSecret(kind)).Methods("GET")
+		api.router.HandleFunc(base+"/{ref}", api.handleDeleteSecret(kind)).Methods("DELETE")
+		api.router.HandleFunc(base+"/{ref}/rotate", api.handleRotateSecret(kind)).Methods("POST")
+	}
+
+	// Overlay networks
+	api.router.HandleFunc("/networks", api.handleListNetworks).Methods("GET")
+	api.router.HandleFunc("/networks", api.handleCreateNetwork).Methods("POST")
+	api.router.HandleFunc("/networks/{ref}", api.handleGetNetwork).Methods("GET")
+	api.router.HandleFunc("/networks/{ref}", api.handleDeleteNetwork).Methods("DELETE")
 
 	// Health check
+	// Scheduler endpoints
+	api.router.HandleFunc("/scheduler/plan", api.handleSchedulerPlan).Methods("POST")
+
 	api.router.HandleFunc("/health", api.handleHealthCheck).Methods("GET")
 
 	// Middleware
 	api.router.Use(api.loggingMiddleware)
+	api.router.Use(api.faultMiddleware)
 	api.router.Use(api.authMiddleware)
 }
 
@@ -107,6 +175,13 @@ func (api *APIServer) handleClusterInfo(w http.ResponseWriter, r *http.Request)
 	})
 }
 
+func (api *APIServer) handleClusterMetrics(w http.ResponseWriter, r *http.Request) {
+	api.writeJSONResponse(w, http.StatusOK, APIResponse{
+		Success: true,
+		Data:    api.manager.Metrics.Snapshot(),
+	})
+}
+
 func (api *APIServer) handleClusterJoin(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		JoinAddr  string `json:"join_addr"`
@@ -158,8 +233,34 @@ func (api *APIServer) handleClusterStatus(w http.ResponseWriter, r *http.Request
 	})
 }
 
-func (api *APIServer) handleListNodes(w http.ResponseWriter, r *http.Request) {
-	nodes, err := api.manager.NodeManager.ListNodes()
+func (api *APIServer) handleClusterPrune(w http.ResponseWriter, r *http.Request) {
+	var policy PrunePolicy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		api.writeErrorResponse(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	report, err := api.manager.Prune(policy, nil)
+	if err != nil {
+		api.writeErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	api.writeJSONResponse(w, http.StatusOK, APIResponse{
+		Success: true,
+		Data:    report,
+	})
+}
+
+// handleNodePrune runs a prune requested by a manager on this node only.
+func (api *APIServer) handleNodePrune(w http.ResponseWriter, r *http.Request) {
+	var policy PrunePolicy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		api.writeErrorResponse(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	result, err := api.manager.pruneLocal(policy)
 	if err != nil {
 		api.writeErrorResponse(w, http.StatusInternalServerError, err.Error())
 		return
@@ -167,10 +268,176 @@ func (api *APIServer) handleListNodes(w http.ResponseWriter, r *http.Request) {
 
 	api.writeJSONResponse(w, http.StatusOK, APIResponse{
 		Success: true,
-		Data:    nodes,
+		Data:    result,
 	})
 }
 
+func (api *APIServer) handleClusterPrepull(w http.ResponseWriter, r *http.Request) {
+	var request PrepullRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		api.writeErrorResponse(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	results, err := api.manager.Prepull(request)
+	if err != nil {
+		api.writeErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	api.writeJSONResponse(w, http.StatusOK, APIResponse{
+		Success: true,
+		Data:    results,
+	})
+}
+
+func (api *APIServer) handleClusterImageGC(w http.ResponseWriter, r *http.Request) {
+	var policy ImageGCPolicy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		api.writeErrorResponse(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	results, err := api.manager.SetImageGCPolicy(policy)
+	if err != nil {
+		api.writeErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	api.writeJSONResponse(w, http.StatusOK, APIResponse{
+		Success: true,
+		Data:    results,
+	})
+}
+
+// handleNodePrepull pulls and pins images on this node for a manager.
+func (api *APIServer) handleNodePrepull(w http.ResponseWriter, r *http.Request) {
+	var request PrepullRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		api.writeErrorResponse(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	result, err := api.manager.prepullLocal(request)
+	if err != nil {
+		api.writeErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	api.writeJSONResponse(w, http.StatusOK, APIResponse{
+		Success: true,
+		Data:    result,
+	})
+}
+
+// handleGetNodeImageGC returns this node's image GC policy, prepulled
+// images and latest collection.
+func (api *APIServer) handleGetNodeImageGC(w http.ResponseWriter, r *http.Request) {
+	api.writeJSONResponse(w, http.StatusOK, APIResponse{
+		Success: true,
+		Data:    api.manager.ImageGC.Status(),
+	})
+}
+
+func (api *APIServer) handleSetNodeImageGC(w http.ResponseWriter, r *http.Request) {
+	var policy ImageGCPolicy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		api.writeErrorResponse(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if err := api.manager.ImageGC.SetPolicy(policy); err != nil {
+		api.writeErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	api.writeJSONResponse(w, http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Image GC policy updated",
+	})
+}
+
+func (api *APIServer) handleNodeImageGCCollect(w http.ResponseWriter, r *http.Request) {
+	report, err := api.manager.ImageGC.Collect()
+	if err != nil {
+		api.writeErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	api.writeJSONResponse(w, http.StatusOK, APIResponse{
+		Success: true,
+		Data:    report,
+	})
+}
+
+func (api *APIServer) handleNodeEvents(w http.ResponseWriter, r *http.Request) {
+	nodeEvents, err := api.manager.NodeEvents(mux.Vars(r)["nodeID"])
+	if err != nil {
+		api.writeErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	api.writeJSONResponse(w, http.StatusOK, APIResponse{
+		Success: true,
+		Data:    nodeEvents,
+	})
+}
+
+// handleLocalNodeEvents returns the events this node recorded about
+// itself.
+func (api *APIServer) handleLocalNodeEvents(w http.ResponseWriter, r *http.Request) {
+	api.writeJSONResponse(w, http.StatusOK, APIResponse{
+		Success: true,
+		Data:    api.manager.NodeManager.Events(api.manager.localNodeID()),
+	})
+}
+
+// handleNodeHeartbeat records a heartbeat of a worker.
+func (api *APIServer) handleNodeHeartbeat(w http.ResponseWriter, r *http.Request) {
+	if err := api.manager.Heartbeats.Record(mux.Vars(r)["nodeID"]); err != nil {
+		api.writeErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	api.writeJSONResponse(w, http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Heartbeat recorded",
+	})
+}
+
+func (api *APIServer) handleListNodes(w http.ResponseWriter, r *http.Request) {
+	filter, err := nodeFilterFromQuery(r.URL.Query(), api.manager.Clock.Now())
+	if err != nil {
+		api.writeErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	nodes, err := api.manager.NodeManager.ListNodes()
+	if err != nil {
+		api.writeErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	items := make([]protoMessage, 0, len(nodes))
+	for _, node := range nodes {
+		if filter.matches(node) {
+			items = append(items, node)
+		}
+	}
+	api.writeList(w, r, items)
+}
+
+// NodeRegistration answers a node registering. A node that joined with a
+// join token gets the cluster token to make its requests with from then
+// on.
+type NodeRegistration struct {
+	Node *Node `json:"node"`
+	// ClusterToken is the token the node presents to the cluster from
+	// then on: the cluster token for managers, one of its own for workers
+	ClusterToken string `json:"cluster_token,omitempty"`
+	// LeaderID is the node ID of the manager the node joined
+	LeaderID string `json:"leader_id,omitempty"`
+}
+
 func (api *APIServer) handleRegisterNode(w http.ResponseWriter, r *http.Request) {
 	var node Node
 	if err := json.NewDecoder(r.Body).Decode(&node); err != nil {
@@ -178,15 +445,41 @@ func (api *APIServer) handleRegisterNode(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// A join token only admits nodes in the role it was issued for
+	principal := PrincipalFromRequest(r)
+	joined := principal != nil && principal.JoinRole != ""
+	if joined && node.Role != principal.JoinRole {
+		api.manager.Metrics.JoinFailed()
+		api.writeErrorResponse(w, http.StatusForbidden, fmt.Sprintf("join token for %s nodes can't register a %s", principal.JoinRole, node.Role))
+		return
+	}
+
+	// A node that restarts keeps its ID, so a known ID means it is coming
+	// back rather than joining for the first time.
+	_, err := api.manager.NodeManager.GetNode(node.ID)
+	rejoined := err == nil
+
 	if err := api.manager.NodeManager.RegisterNode(&node); err != nil {
+		api.manager.Metrics.JoinFailed()
 		api.writeErrorResponse(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	if rejoined {
+		api.manager.reconcileNodeTasks(node.ID)
+	}
+
+	registration := NodeRegistration{Node: &node}
+	if joined {
+		api.manager.mu.RLock()
+		registration.ClusterToken = api.manager.nodeToken(&node)
+		api.manager.mu.RUnlock()
+		registration.LeaderID = api.manager.localNodeID()
+	}
 
 	api.writeJSONResponse(w, http.StatusCreated, APIResponse{
 		Success: true,
 		Message: "Node registered successfully",
-		Data:    node,
+		Data:    registration,
 	})
 }
 
@@ -224,6 +517,14 @@ func (api *APIServer) handleUpdateNode(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Replace node labels if provided
+	if updates.Labels != nil {
+		if err := api.manager.NodeManager.SetNodeLabels(nodeID, updates.Labels); err != nil {
+			api.writeErrorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
 	api.writeJSONResponse(w, http.StatusOK, APIResponse{
 		Success: true,
 		Message: "Node updated successfully",
@@ -254,9 +555,30 @@ func (api *APIServer) handleDrainNode(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The drain goes on in the background; GET drain-status follows it
+	status, err := api.manager.DrainStatus(nodeID)
+	if err != nil {
+		api.writeErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	api.writeJSONResponse(w, http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Node draining",
+		Data:    status,
+	})
+}
+
+func (api *APIServer) handleDrainStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := api.manager.DrainStatus(mux.Vars(r)["nodeID"])
+	if err != nil {
+		api.writeErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+
 	api.writeJSONResponse(w, http.StatusOK, APIResponse{
 		Success: true,
-		Message: "Node drained successfully",
+		Data:    status,
 	})
 }
 
@@ -276,16 +598,24 @@ func (api *APIServer) handleActivateNode(w http.ResponseWriter, r *http.Request)
 }
 
 func (api *APIServer) handleListTasks(w http.ResponseWriter, r *http.Request) {
+	filter, err := taskFilterFromQuery(r.URL.Query(), api.manager.Clock.Now())
+	if err != nil {
+		api.writeErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	tasks, err := api.manager.TaskManager.ListTasks()
 	if err != nil {
 		api.writeErrorResponse(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	api.writeJSONResponse(w, http.StatusOK, APIResponse{
-		Success: true,
-		Data:    tasks,
-	})
+	items := make([]protoMessage, 0, len(tasks))
+	for _, task := range tasks {
+		if filter.matches(task) {
+			items = append(items, task)
+		}
+	}
+	api.writeList(w, r, items)
 }
 
 func (api *APIServer) handleCreateTask(w http.ResponseWriter, r *http.Request) {
@@ -409,23 +739,337 @@ func (api *APIServer) handleRestartTask(w http.ResponseWriter, r *http.Request)
 }
 
 func (api *APIServer) handleListServices(w http.ResponseWriter, r *http.Request) {
-	// Placeholder for service management
 	api.writeJSONResponse(w, http.StatusOK, APIResponse{
 		Success: true,
-		Data:    []string{}, // Empty list for now
+		Data:    api.manager.Services.ListServices(),
 	})
 }
 
 func (api *APIServer) handleCreateService(w http.ResponseWriter, r *http.Request) {
-	// Placeholder for service management
-	api.writeErrorResponse(w, http.StatusNotImplemented, "Service management not implemented")
+	var service Service
+	if err := json.NewDecoder(r.Body).Decode(&service); err != nil {
+		api.writeErrorResponse(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	created, err := api.manager.Services.CreateService(&service)
+	if err != nil {
+		api.writeErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	api.writeJSONResponse(w, http.StatusCreated, APIResponse{
+		Success: true,
+		Message: "Service created successfully",
+		Data:    created,
+	})
+}
+
+func (api *APIServer) handleGetService(w http.ResponseWriter, r *http.Request) {
+	service, err := api.manager.Services.GetService(mux.Vars(r)["serviceID"])
+	if err != nil {
+		api.writeErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	api.writeJSONResponse(w, http.StatusOK, APIResponse{
+		Success: true,
+		Data:    service,
+	})
+}
+
+func (api *APIServer) handleDeleteService(w http.ResponseWriter, r *http.Request) {
+	if err := api.manager.Services.RemoveService(mux.Vars(r)["serviceID"]); err != nil {
+		api.writeErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	api.writeJSONResponse(w, http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Service removed successfully",
+	})
+}
+
+func (api *APIServer) handleScaleService(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Replicas *int `json:"replicas"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Replicas == nil {
+		api.writeErrorResponse(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	service, err := api.manager.Services.ScaleService(mux.Vars(r)["serviceID"], *req.Replicas)
+	if err != nil {
+		api.writeErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	api.writeJSONResponse(w, http.StatusOK, APIResponse{
+		Success: true,
+		Message: fmt.Sprintf("Service %s scaled to %d", service.Name, service.Replicas),
+		Data:    service,
+	})
+}
+
+// handleUpdateService takes the full new spec of a service.
+func (api *APIServer) handleUpdateService(w http.ResponseWriter, r *http.Request) {
+	var spec Service
+	if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+		api.writeErrorResponse(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	service, err := api.manager.Services.UpdateService(mux.Vars(r)["serviceID"], &spec)
+	if err != nil {
+		api.writeErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	api.writeJSONResponse(w, http.StatusOK, APIResponse{
+		Success: true,
+		Message: fmt.Sprintf("Updating service %s to version %d", service.Name, service.Version),
+		Data:    service,
+	})
+}
+
+func (api *APIServer) handleRollbackService(w http.ResponseWriter, r *http.Request) {
+	service, err := api.manager.Services.RollbackService(mux.Vars(r)["serviceID"])
+	if err != nil {
+		api.writeErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	api.writeJSONResponse(w, http.StatusOK, APIResponse{
+		Success: true,
+		Message: fmt.Sprintf("Rolling back service %s", service.Name),
+		Data:    service,
+	})
+}
+
+func (api *APIServer) handleListServiceTasks(w http.ResponseWriter, r *http.Request) {
+	service, err := api.manager.Services.GetService(mux.Vars(r)["serviceID"])
+	if err != nil {
+		api.writeErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	api.writeJSONResponse(w, http.StatusOK, APIResponse{
+		Success: true,
+		Data:    api.manager.Services.ServiceTasks(service.ID),
+	})
+}
+
+func (api *APIServer) handleSchedulerPlan(w http.ResponseWriter, r *http.Request) {
+	var request PlanRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		api.writeErrorResponse(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	plan, err := api.manager.Scheduler.Plan(request)
+	if err != nil {
+		api.writeErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	message := "All tasks fit with current capacity"
+	if !plan.Feasible {
+		message = "Some tasks do not fit with current capacity"
+	}
+
+	api.writeJSONResponse(w, http.StatusOK, APIResponse{
+		Success: true,
+		Message: message,
+		Data:    plan,
+	})
+}
+
+func (api *APIServer) handleClusterRebalance(w http.ResponseWriter, r *http.Request) {
+	report := api.manager.Rebalancer.Rebalance()
+	api.writeJSONResponse(w, http.StatusOK, APIResponse{
+		Success: true,
+		Data:    report,
+	})
+}
+
+func (api *APIServer) handleGetRebalancePolicy(w http.ResponseWriter, r *http.Request) {
+	policy := api.manager.Rebalancer.GetPolicy(mux.Vars(r)["serviceID"])
+	api.writeJSONResponse(w, http.StatusOK, APIResponse{
+		Success: true,
+		Data:    policy,
+	})
+}
+
+func (api *APIServer) handleSetRebalancePolicy(w http.ResponseWriter, r *http.Request) {
+	var policy RebalancePolicy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		api.writeErrorResponse(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if err := api.manager.Rebalancer.SetPolicy(mux.Vars(r)["serviceID"], policy); err != nil {
+		api.writeErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	api.writeJSONResponse(w, http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Rebalance policy updated",
+	})
+}
+
+func (api *APIServer) handleGetDisruptionBudget(w http.ResponseWriter, r *http.Request) {
+	api.writeJSONResponse(w, http.StatusOK, APIResponse{
+		Success: true,
+		Data: map[string]int{
+			"max_unavailable": api.manager.Budgets.Get(mux.Vars(r)["serviceID"]),
+		},
+	})
+}
+
+func (api *APIServer) handleSetDisruptionBudget(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		MaxUnavailable int `json:"max_unavailable"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		api.writeErrorResponse(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if err := api.manager.Budgets.Set(mux.Vars(r)["serviceID"], req.MaxUnavailable); err != nil {
+		api.writeErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	api.writeJSONResponse(w, http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Disruption budget updated",
+	})
+}
+
+func (api *APIServer) handleServiceStatus(w http.ResponseWriter, r *http.Request) {
+	api.writeJSONResponse(w, http.StatusOK, APIResponse{
+		Success: true,
+		Data:    api.manager.SLOs.Status(mux.Vars(r)["serviceID"]),
+	})
+}
+
+func (api *APIServer) handleGetSLOPolicy(w http.ResponseWriter, r *http.Request) {
+	api.writeJSONResponse(w, http.StatusOK, APIResponse{
+		Success: true,
+		Data:    api.manager.SLOs.GetPolicy(mux.Vars(r)["serviceID"]),
+	})
+}
+
+func (api *APIServer) handleSetSLOPolicy(w http.ResponseWriter, r *http.Request) {
+	var policy SLOPolicy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		api.writeErrorResponse(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if err := api.manager.SLOs.SetPolicy(mux.Vars(r)["serviceID"], policy); err != nil {
+		api.writeErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	api.writeJSONResponse(w, http.StatusOK, APIResponse{
+		Success: true,
+		Message: "SLO policy updated",
+	})
+}
+
+// handleReportTaskStatus records a status report of a task from the node
+// it was assigned to.
+func (api *APIServer) handleReportTaskStatus(w http.ResponseWriter, r *http.Request) {
+	var report TaskStatusReport
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+		api.writeErrorResponse(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if err := api.manager.TaskManager.ReportTaskStatus(mux.Vars(r)["taskID"], report); err != nil {
+		api.writeErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	api.writeJSONResponse(w, http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Task status recorded",
+	})
+}
+
+func (api *APIServer) handleReportTaskHealth(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Healthy bool `json:"healthy"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		api.writeErrorResponse(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if err := api.manager.TaskManager.ReportTaskHealth(mux.Vars(r)["taskID"], req.Healthy); err != nil {
+		api.writeErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	api.writeJSONResponse(w, http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Task health recorded",
+	})
+}
+
+// handleReportTaskUsage records a usage reading of a task from the node
+// running it.
+func (api *APIServer) handleReportTaskUsage(w http.ResponseWriter, r *http.Request) {
+	var usage TaskUsage
+	if err := json.NewDecoder(r.Body).Decode(&usage); err != nil {
+		api.writeErrorResponse(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if err := api.manager.Usage.Record(mux.Vars(r)["taskID"], usage); err != nil {
+		api.writeErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	api.writeJSONResponse(w, http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Task usage recorded",
+	})
+}
+
+func (api *APIServer) handleServiceRecommendation(w http.ResponseWriter, r *http.Request) {
+	rec, err := api.manager.Usage.Recommend(mux.Vars(r)["serviceID"])
+	if err != nil {
+		api.writeErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	api.writeJSONResponse(w, http.StatusOK, APIResponse{
+		Success: true,
+		Data:    rec,
+	})
+}
+
+// handleMetrics serves the SLO metrics of services for Prometheus.
+func (api *APIServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := api.manager.SLOs.WriteMetrics(w); err != nil {
+		logrus.Warnf("Failed to write metrics: %v", err)
+	}
 }
 
 func (api *APIServer) handleHealthCheck(w http.ResponseWriter, r *http.Request) {
+	api.manager.mu.RLock()
+	version := api.manager.Version
+	api.manager.mu.RUnlock()
+
 	health := map[string]interface{}{
 		"status": "healthy",
-		"timestamp": time.Now().Format(time.RFC3339),
-		"version": "1.0.0",
+		"timestamp": api.manager.Clock.Now().Format(time.RFC3339),
+		"version": version,
 	}
 
 	// Add cluster status
@@ -439,9 +1083,180 @@ func (api *APIServer) handleHealthCheck(w http.ResponseWriter, r *http.Request)
 	})
 }
 
+func (api *APIServer) handleListSecrets(kind SecretKind) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		secrets := api.manager.SecretManager.List(kind)
+		redacted := make([]*Secret, 0, len(secrets))
+		for _, secret := range secrets {
+			redacted = append(redacted, secret.Redacted())
+		}
+
+		api.writeJSONResponse(w, http.StatusOK, APIResponse{
+			Success: true,
+			Data:    redacted,
+		})
+	}
+}
+
+func (api *APIServer) handleCreateSecret(kind SecretKind) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Name   string            `json:"name"`
+			Data   []byte            `json:"data"`
+			Labels map[string]string `json:"labels"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			api.writeErrorResponse(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+
+		secret, err := api.manager.SecretManager.Create(kind, req.Name, req.Data, req.Labels)
+		if err != nil {
+			api.writeErrorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		api.writeJSONResponse(w, http.StatusCreated, APIResponse{
+			Success: true,
+			Data:    secret.Redacted(),
+		})
+	}
+}
+
+func (api *APIServer) handleGetSecret(kind SecretKind) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		secret, err := api.manager.SecretManager.Get(kind, mux.Vars(r)["ref"])
+		if err != nil {
+			api.writeErrorResponse(w, http.StatusNotFound, err.Error())
+			return
+		}
+
+		api.writeJSONResponse(w, http.StatusOK, APIResponse{
+			Success: true,
+			Data:    secret.Redacted(),
+		})
+	}
+}
+
+func (api *APIServer) handleDeleteSecret(kind SecretKind) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := api.manager.SecretManager.Remove(kind, mux.Vars(r)["ref"]); err != nil {
+			api.writeErrorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		api.writeJSONResponse(w, http.StatusOK, APIResponse{
+			Success: true,
+			Message: fmt.Sprintf("%s removed successfully", kind),
+		})
+	}
+}
+
+func (api *APIServer) handleListNetworks(w http.ResponseWriter, r *http.Request) {
+	api.writeJSONResponse(w, http.StatusOK, APIResponse{
+		Success: true,
+		Data:    api.manager.Overlays.List(),
+	})
+}
+
+func (api *APIServer) handleCreateNetwork(w http.ResponseWriter, r *http.Request) {
+	var opts OverlayNetworkOptions
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+		api.writeErrorResponse(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	network, err := api.manager.Overlays.Create(opts)
+	if err != nil {
+		api.writeErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	api.writeJSONResponse(w, http.StatusCreated, APIResponse{
+		Success: true,
+		Data:    network,
+	})
+}
+
+// handleGetNetwork returns an overlay network with its endpoints, which is
+// how nodes learn where the tasks on it are.
+func (api *APIServer) handleGetNetwork(w http.ResponseWriter, r *http.Request) {
+	network, err := api.manager.Overlays.Get(mux.Vars(r)["ref"])
+	if err != nil {
+		api.writeErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	api.writeJSONResponse(w, http.StatusOK, APIResponse{
+		Success: true,
+		Data:    network,
+	})
+}
+
+func (api *APIServer) handleDeleteNetwork(w http.ResponseWriter, r *http.Request) {
+	if err := api.manager.Overlays.Remove(mux.Vars(r)["ref"]); err != nil {
+		api.writeErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	api.writeJSONResponse(w, http.StatusOK, APIResponse{
+		Success: true,
+		Message: "network removed successfully",
+	})
+}
+
+func (api *APIServer) handleRotateSecret(kind SecretKind) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Data []byte `json:"data"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			api.writeErrorResponse(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+
+		report, err := api.manager.SecretManager.Rotate(kind, mux.Vars(r)["ref"], req.Data)
+		if err != nil {
+			api.writeErrorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		api.writeJSONResponse(w, http.StatusOK, APIResponse{
+			Success: true,
+			Data:    report,
+		})
+	}
+}
+
+func (api *APIServer) handleGetReloadPolicy(w http.ResponseWriter, r *http.Request) {
+	policy := api.manager.SecretManager.GetReloadPolicy(mux.Vars(r)["serviceID"])
+	api.writeJSONResponse(w, http.StatusOK, APIResponse{
+		Success: true,
+		Data:    policy,
+	})
+}
+
+func (api *APIServer) handleSetReloadPolicy(w http.ResponseWriter, r *http.Request) {
+	var policy ReloadPolicy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		api.writeErrorResponse(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if err := api.manager.SecretManager.SetReloadPolicy(mux.Vars(r)["serviceID"], policy); err != nil {
+		api.writeErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	api.writeJSONResponse(w, http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Reload policy updated",
+	})
+}
+
 func (api *APIServer) writeJSONResponse(w http.ResponseWriter, statusCode int, response APIResponse) {
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
+	w.WriteHeader(statusCode)
 	json.NewEncoder(w).Encode(response)
 }
 
@@ -454,7 +1269,7 @@ func (api *APIServer) writeErrorResponse(w http.ResponseWriter, statusCode int,
 
 func (api *APIServer) loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
+		start := api.manager.Clock.Now()
 
 		logrus.WithFields(logrus.Fields{
 			"method": r.Method,
@@ -467,23 +1282,33 @@ func (api *APIServer) loggingMiddleware(next http.Handler) http.Handler {
 		logrus.WithFields(logrus.Fields{
 			"method": r.Method,
 			"path":   r.URL.Path,
-			"duration": time.Since(start),
+			"duration": api.manager.Clock.Since(start),
 		}).Info("API request completed")
 	})
 }
 
 func (api *APIServer) authMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Simple token-based authentication
-		token := r.Header.Get("X-Cluster-Token")
-		if token == "" {
-			token = r.URL.Query().Get("token")
+		// Managers probe the health of nodes without their token
+		if r.URL.Path == "/health" {
+			next.ServeHTTP(w, r)
+			return
 		}
 
-		if token != api.manager.Config.JoinToken && api.manager.Config.JoinToken != "" {
+		principal, err := api.manager.Auth.Authenticate(r)
+		if err != nil {
+			if r.URL.Path == "/nodes" && r.Method == http.MethodPost {
+				api.manager.Metrics.JoinFailed()
+			}
+			logrus.Debugf("Rejected %s %s: %v", r.Method, r.URL.Path, err)
 			api.writeErrorResponse(w, http.StatusUnauthorized, "Invalid or missing authentication token")
 			return
 		}
+		if err := api.manager.Auth.Authorize(principal, r); err != nil {
+			api.writeErrorResponse(w, http.StatusForbidden, err.Error())
+			return
+		}
+		r = withPrincipal(r, principal)
 
 		next.ServeHTTP(w, r)
 	})
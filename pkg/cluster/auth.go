@@ -0,0 +1,271 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// APIRole is what a caller of the API may do. Each role can do what the
+// ones below it can.
+type APIRole string
+
+const (
+	// APIRoleViewer may only read
+	APIRoleViewer APIRole = "viewer"
+	// APIRoleOperator may also manage tasks, services, secrets and configs
+	APIRoleOperator APIRole = "operator"
+	// APIRoleAdmin may also manage the cluster and its nodes
+	APIRoleAdmin APIRole = "admin"
+	// APIRoleNode is a worker node, which may only make the requests of
+	// its agent: heartbeats and status reports of its own tasks. It is
+	// not one of the roles above and can't be bound to users.
+	APIRoleNode APIRole = "node"
+)
+
+var apiRoleRank = map[APIRole]int{
+	APIRoleViewer:   1,
+	APIRoleOperator: 2,
+	APIRoleAdmin:    3,
+}
+
+// adminPaths are only writable by admins.
+var adminPaths = []string{"/cluster/", "/nodes", "/node/", "/agent/"}
+
+// AuthConfig sets how callers of the API authenticate besides the
+// cluster's tokens, and which roles they get.
+type AuthConfig struct {
+	// HtpasswdFile lists static users, one user:hash per line
+	HtpasswdFile string `json:"htpasswd_file,omitempty"`
+	// OIDC validates bearer tokens issued by an OpenID Connect provider
+	OIDC *OIDCConfig `json:"oidc,omitempty"`
+	// Roles binds users, and groups as "group:NAME", to roles
+	Roles map[string]APIRole `json:"roles,omitempty"`
+}
+
+// Principal is who a request was authenticated as.
+type Principal struct {
+	Name     string   `json:"name"`
+	Groups   []string `json:"groups,omitempty"`
+	Provider string   `json:"provider"`
+	Role     APIRole  `json:"role"`
+	// JoinRole is the node role of the join token a joining node
+	// authenticated with
+	JoinRole NodeRole `json:"join_role,omitempty"`
+}
+
+// AuthProvider authenticates requests by the credentials it understands.
+// A request without any returns a nil principal, so the next provider is
+// tried; credentials it understands but rejects return an error.
+type AuthProvider interface {
+	Name() string
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// APIAuth authenticates the callers of the API with its providers, falling
+// back to the cluster's tokens, and authorizes them by role.
+type APIAuth struct {
+	manager   *ClusterManager
+	providers []AuthProvider
+	roles     map[string]APIRole
+	mu        sync.RWMutex
+}
+
+func NewAPIAuth(manager *ClusterManager) *APIAuth {
+	return &APIAuth{
+		manager: manager,
+		roles:   make(map[string]APIRole),
+	}
+}
+
+// Configure replaces the providers and role bindings with those of config.
+func (a *APIAuth) Configure(config AuthConfig) error {
+	for subject, role := range config.Roles {
+		if _, ok := apiRoleRank[role]; !ok {
+			return fmt.Errorf("invalid role %q for %s (expected viewer, operator or admin)", role, subject)
+		}
+	}
+
+	var providers []AuthProvider
+	if config.HtpasswdFile != "" {
+		provider, err := NewHtpasswdProvider(config.HtpasswdFile)
+		if err != nil {
+			return err
+		}
+		providers = append(providers, provider)
+	}
+	if config.OIDC != nil {
+		provider, err := NewOIDCProvider(*config.OIDC, a.manager.Clock)
+		if err != nil {
+			return err
+		}
+		providers = append(providers, provider)
+	}
+
+	roles := make(map[string]APIRole, len(config.Roles))
+	for subject, role := range config.Roles {
+		roles[subject] = role
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.providers = providers
+	a.roles = roles
+	return nil
+}
+
+// Register adds a provider, tried after those configured.
+func (a *APIAuth) Register(provider AuthProvider) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.providers = append(a.providers, provider)
+}
+
+// Authenticate returns who made the request. Without credentials any
+// provider understands, the request must carry the cluster token, which
+// grants admin, or the token of a worker node; without providers, that
+// is all there is to it, and a cluster that issued no token yet is open.
+func (a *APIAuth) Authenticate(r *http.Request) (*Principal, error) {
+	a.mu.RLock()
+	providers := a.providers
+	a.mu.RUnlock()
+
+	for _, provider := range providers {
+		principal, err := provider.Authenticate(r)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", provider.Name(), err)
+		}
+		if principal != nil {
+			principal.Provider = provider.Name()
+			principal.Role = a.role(principal)
+			return principal, nil
+		}
+	}
+
+	token := r.Header.Get("X-Cluster-Token")
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	if len(providers) > 0 {
+		if token == "" {
+			return nil, fmt.Errorf("missing credentials")
+		}
+		// Until a cluster token is issued any token would pass for one,
+		// which only a cluster without providers is open to
+		if a.manager.clusterToken() == "" {
+			return nil, fmt.Errorf("no cluster token issued yet")
+		}
+	}
+	if err := a.manager.ValidateClusterToken(token); err != nil {
+		if nodeID, err := a.manager.VerifyNodeToken(token); err == nil {
+			return &Principal{Name: nodeID, Provider: "token", Role: APIRoleNode}, nil
+		}
+		// Joining nodes only have a join token, which is good for
+		// registering and nothing else
+		if r.Method != http.MethodPost || r.URL.Path != "/nodes" {
+			return nil, err
+		}
+		role, err := a.manager.VerifyJoinToken(token)
+		if err != nil {
+			return nil, err
+		}
+		return &Principal{Name: "join-token", Provider: "token", Role: APIRoleAdmin, JoinRole: role}, nil
+	}
+	return &Principal{Name: "cluster-token", Provider: "token", Role: APIRoleAdmin}, nil
+}
+
+// role is the highest role bound to the principal or its groups.
+func (a *APIAuth) role(principal *Principal) APIRole {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	role := a.roles[principal.Name]
+	for _, group := range principal.Groups {
+		if bound := a.roles["group:"+group]; apiRoleRank[bound] > apiRoleRank[role] {
+			role = bound
+		}
+	}
+	return role
+}
+
+// Authorize reports whether principal may make the request.
+func (a *APIAuth) Authorize(principal *Principal, r *http.Request) error {
+	if principal.Role == APIRoleNode {
+		return a.authorizeNode(principal.Name, r)
+	}
+	if apiRoleRank[principal.Role] == 0 {
+		return fmt.Errorf("%s has no role", principal.Name)
+	}
+	if required := requiredRole(r.Method, r.URL.Path); apiRoleRank[principal.Role] < apiRoleRank[required] {
+		return fmt.Errorf("%s %s needs the %s role, %s has %s", r.Method, r.URL.Path, required, principal.Name, principal.Role)
+	}
+	return nil
+}
+
+// authorizeNode lets the agent of a worker node report its heartbeats and
+// the status of the tasks assigned to it.
+func (a *APIAuth) authorizeNode(nodeID string, r *http.Request) error {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if r.Method == http.MethodPost && len(parts) == 3 {
+		switch {
+		case parts[0] == "nodes" && parts[2] == "heartbeat":
+			if parts[1] == nodeID {
+				return nil
+			}
+		case parts[0] == "tasks" && parts[2] == "status":
+			tasks, _ := a.manager.TaskManager.GetTasksByNode(nodeID)
+			for _, task := range tasks {
+				if task.ID == parts[1] {
+					return nil
+				}
+			}
+		}
+	}
+	return fmt.Errorf("%s %s is not a request of the agent of node %s", r.Method, r.URL.Path, nodeID)
+}
+
+func requiredRole(method, path string) APIRole {
+	if method == http.MethodGet || method == http.MethodHead {
+		return APIRoleViewer
+	}
+	for _, prefix := range adminPaths {
+		if strings.HasPrefix(path, prefix) {
+			return APIRoleAdmin
+		}
+	}
+	return APIRoleOperator
+}
+
+// Providers lists the names of the configured providers.
+func (a *APIAuth) Providers() []string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	names := make([]string, 0, len(a.providers))
+	for _, provider := range a.providers {
+		names = append(names, provider.Name())
+	}
+	return names
+}
+
+type principalKey struct{}
+
+// PrincipalFromRequest returns who a request to the API was authenticated
+// as, or nil.
+func PrincipalFromRequest(r *http.Request) *Principal {
+	principal, _ := r.Context().Value(principalKey{}).(*Principal)
+	return principal
+}
+
+func withPrincipal(r *http.Request, principal *Principal) *http.Request {
+	logrus.WithFields(logrus.Fields{
+		"user":     principal.Name,
+		"provider": principal.Provider,
+		"role":     principal.Role,
+	}).Debugf("Authenticated %s %s", r.Method, r.URL.Path)
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, principal))
+}
@@ -0,0 +1,166 @@
+package cluster
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// BudgetError is returned when a voluntary disruption would take down
+// more replicas of a service than its budget allows.
+type BudgetError struct {
+	ServiceID      string
+	MaxUnavailable int
+	Unavailable    int
+	Disrupted      int
+}
+
+func (e *BudgetError) Error() string {
+	return fmt.Sprintf("disruption budget of service %s allows %d unavailable replica(s): %d already down, %d more would go down",
+		e.ServiceID, e.MaxUnavailable, e.Unavailable, e.Disrupted)
+}
+
+// DisruptionBudgets limit how many replicas of a service drains,
+// rebalancing and rolling restarts may take down at once. A service's
+// budget is the MaxUnavailable of its spec, so it is stored and restored
+// with the service. Failures are not voluntary and are not held back by
+// a budget, but replicas lost to them count against it.
+type DisruptionBudgets struct {
+	manager *ClusterManager
+}
+
+func NewDisruptionBudgets(manager *ClusterManager) *DisruptionBudgets {
+	return &DisruptionBudgets{
+		manager: manager,
+	}
+}
+
+// Set sets the budget of a service; zero removes it.
+func (b *DisruptionBudgets) Set(serviceID string, maxUnavailable int) error {
+	if serviceID == "" {
+		return fmt.Errorf("service ID is required")
+	}
+	_, err := b.manager.Services.SetMaxUnavailable(serviceID, maxUnavailable)
+	return err
+}
+
+// Get returns the budget of a service, or zero when it has none.
+func (b *DisruptionBudgets) Get(serviceID string) int {
+	service, err := b.manager.Services.GetService(serviceID)
+	if err != nil {
+		return 0
+	}
+	return service.MaxUnavailable
+}
+
+// CheckTask checks that the task's replica may be taken down.
+func (b *DisruptionBudgets) CheckTask(task *Task) error {
+	if task.ServiceID == "" {
+		return nil
+	}
+	return b.check(map[string]int{task.ServiceID: 1})
+}
+
+// CheckNode checks that every replica running on the node may be taken
+// down at the same time.
+func (b *DisruptionBudgets) CheckNode(nodeID string) error {
+	node, err := b.manager.NodeManager.GetNode(nodeID)
+	if err != nil {
+		return err
+	}
+	// Replicas on a node that is already out count as unavailable
+	if !nodeSchedulable(node) {
+		return nil
+	}
+
+	tasks, err := b.manager.TaskManager.GetTasksByNode(nodeID)
+	if err != nil {
+		return err
+	}
+
+	disrupted := make(map[string]int)
+	b.manager.TaskManager.mu.RLock()
+	for _, task := range tasks {
+		if task.ServiceID != "" && task.DesiredState == TaskRunning && task.Status == TaskRunning {
+			disrupted[task.ServiceID]++
+		}
+	}
+	b.manager.TaskManager.mu.RUnlock()
+
+	return b.check(disrupted)
+}
+
+// WaitForTask waits until the task's replica may be taken down, for
+// example while an earlier replacement is still starting.
+func (b *DisruptionBudgets) WaitForTask(task *Task, timeout time.Duration) error {
+	deadline := b.manager.Clock.Now().Add(timeout)
+	for {
+		err := b.CheckTask(task)
+		if err == nil || b.manager.Clock.Now().After(deadline) {
+			return err
+		}
+		b.manager.Clock.Sleep(time.Second)
+	}
+}
+
+func (b *DisruptionBudgets) check(disrupted map[string]int) error {
+	serviceIDs := make([]string, 0, len(disrupted))
+	for serviceID := range disrupted {
+		serviceIDs = append(serviceIDs, serviceID)
+	}
+	sort.Strings(serviceIDs)
+
+	for _, serviceID := range serviceIDs {
+		maxUnavailable := b.Get(serviceID)
+		if maxUnavailable == 0 {
+			continue
+		}
+		unavailable := b.unavailable(serviceID)
+		if unavailable+disrupted[serviceID] > maxUnavailable {
+			return &BudgetError{
+				ServiceID:      serviceID,
+				MaxUnavailable: maxUnavailable,
+				Unavailable:    unavailable,
+				Disrupted:      disrupted[serviceID],
+			}
+		}
+	}
+	return nil
+}
+
+// unavailable counts the replicas of a service that should be running
+// but are not, or that run on a node being drained or down.
+func (b *DisruptionBudgets) unavailable(serviceID string) int {
+	service, err := b.manager.Services.GetService(serviceID)
+	if err != nil {
+		return 0
+	}
+
+	nodes, _ := b.manager.NodeManager.ListNodes()
+	schedulable := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		schedulable[node.ID] = nodeSchedulable(node)
+	}
+
+	tasks, _ := b.manager.TaskManager.ListTasks()
+	b.manager.TaskManager.mu.RLock()
+	available := 0
+	for _, task := range tasks {
+		if task.ServiceID != serviceID || task.DesiredState != TaskRunning {
+			continue
+		}
+		if task.Status == TaskRunning && schedulable[task.NodeID] {
+			available++
+		}
+	}
+	b.manager.TaskManager.mu.RUnlock()
+
+	if available >= service.Replicas {
+		return 0
+	}
+	return service.Replicas - available
+}
+
+func nodeSchedulable(node *Node) bool {
+	return node.Status == StatusReady || node.Status == StatusActive
+}
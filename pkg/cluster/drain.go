@@ -0,0 +1,153 @@
+package cluster
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DrainTask is a task a drain is still waiting for.
+type DrainTask struct {
+	ID        string     `json:"id"`
+	ServiceID string     `json:"service_id,omitempty"`
+	Slot      int        `json:"slot,omitempty"`
+	NodeID    string     `json:"node_id,omitempty"`
+	Status    TaskStatus `json:"status"`
+}
+
+// DrainStatus is the progress of draining a node. Remaining tasks still
+// run on the node; Rescheduling are the replacements of its service
+// replicas that haven't started elsewhere yet. The node can be taken down
+// once Complete.
+type DrainStatus struct {
+	NodeID       string      `json:"node_id"`
+	Status       NodeStatus  `json:"status"`
+	Remaining    []DrainTask `json:"remaining"`
+	Rescheduling []DrainTask `json:"rescheduling"`
+	Complete     bool        `json:"complete"`
+}
+
+func drainTask(task *Task) DrainTask {
+	return DrainTask{
+		ID:        task.ID,
+		ServiceID: task.ServiceID,
+		Slot:      task.Slot,
+		NodeID:    task.NodeID,
+		Status:    task.Status,
+	}
+}
+
+// evictTasks moves the tasks meant to run on a draining node off it.
+// Service replicas are shut down for their service to start them again
+// on another node, as its restart policy allows. Other tasks are
+// restarted on another node, unless their restart policy is none and
+// they are only shut down.
+func (cm *ClusterManager) evictTasks(nodeID string) {
+	tasks, err := cm.TaskManager.GetTasksByNode(nodeID)
+	if err != nil {
+		logrus.Errorf("Failed to get tasks of draining node %s: %v", nodeID, err)
+		return
+	}
+
+	cm.TaskManager.mu.RLock()
+	var evicted []*Task
+	for _, task := range tasks {
+		if task.DesiredState == TaskRunning && isActiveTask(task) {
+			evicted = append(evicted, task)
+		}
+	}
+	cm.TaskManager.mu.RUnlock()
+
+	for _, task := range evicted {
+		if task.ServiceID == "" && task.RestartPolicy.Condition != RestartConditionNone {
+			replacement, err := cm.TaskManager.restartTask(task.ID)
+			if err != nil {
+				logrus.Errorf("Failed to reschedule task %s off draining node %s: %v", task.ID, nodeID, err)
+				continue
+			}
+			logrus.Infof("Rescheduling task %s off draining node %s as %s", task.ID, nodeID, replacement.ID)
+		} else {
+			logrus.Infof("Evicting task %s from draining node %s", task.ID, nodeID)
+		}
+		if err := cm.TaskManager.ShutdownTask(task.ID); err != nil {
+			logrus.Errorf("Failed to shut down task %s on draining node %s: %v", task.ID, nodeID, err)
+		}
+	}
+	cm.Services.wake()
+}
+
+// DrainStatus reports how far the drain of a node has got.
+func (cm *ClusterManager) DrainStatus(nodeID string) (*DrainStatus, error) {
+	node, err := cm.NodeManager.GetNode(nodeID)
+	if err != nil {
+		return nil, err
+	}
+	tasks, err := cm.TaskManager.ListTasks()
+	if err != nil {
+		return nil, err
+	}
+
+	status := &DrainStatus{
+		NodeID:       nodeID,
+		Status:       node.Status,
+		Remaining:    []DrainTask{},
+		Rescheduling: []DrainTask{},
+	}
+
+	cm.TaskManager.mu.RLock()
+	// Service slots that had a replica on the node
+	type slot struct {
+		serviceID string
+		slot      int
+	}
+	slots := make(map[slot]bool)
+	for _, task := range tasks {
+		if task.NodeID != nodeID {
+			continue
+		}
+		if task.ServiceID != "" {
+			slots[slot{task.ServiceID, task.Slot}] = true
+		}
+		if isActiveTask(task) {
+			status.Remaining = append(status.Remaining, drainTask(task))
+		}
+	}
+	for _, task := range tasks {
+		if task.NodeID == nodeID || task.DesiredState != TaskRunning || !slots[slot{task.ServiceID, task.Slot}] {
+			continue
+		}
+		if isActiveTask(task) && task.Status != TaskRunning {
+			status.Rescheduling = append(status.Rescheduling, drainTask(task))
+		}
+	}
+	cm.TaskManager.mu.RUnlock()
+
+	sort.Slice(status.Remaining, func(i, j int) bool { return status.Remaining[i].ID < status.Remaining[j].ID })
+	sort.Slice(status.Rescheduling, func(i, j int) bool { return status.Rescheduling[i].ID < status.Rescheduling[j].ID })
+	status.Complete = node.Status == StatusDraining && len(status.Remaining) == 0 && len(status.Rescheduling) == 0
+	return status, nil
+}
+
+// WaitForDrain waits up to timeout for the drain of a node to complete,
+// returning the last status either way.
+func (cm *ClusterManager) WaitForDrain(nodeID string, timeout time.Duration) (*DrainStatus, error) {
+	deadline := cm.Clock.Now().Add(timeout)
+	for {
+		status, err := cm.DrainStatus(nodeID)
+		if err != nil {
+			return nil, err
+		}
+		if status.Status != StatusDraining {
+			return status, fmt.Errorf("node %s is no longer draining (status %s)", nodeID, status.Status)
+		}
+		if status.Complete {
+			return status, nil
+		}
+		if cm.Clock.Now().After(deadline) {
+			return status, fmt.Errorf("node %s not drained within %s: %d tasks remaining, %d rescheduling", nodeID, timeout, len(status.Remaining), len(status.Rescheduling))
+		}
+		cm.Clock.Sleep(time.Second)
+	}
+}
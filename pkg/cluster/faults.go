@@ -0,0 +1,138 @@
+package cluster
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// FaultInjector lets integration tests break parts of the cluster on
+// purpose. Every fault is off until a test turns it on, and components
+// only consult the injector at the points where the real failure would
+// show up: heartbeats, health probes, API requests and task dispatch.
+type FaultInjector struct {
+	manager *ClusterManager
+	// droppedHeartbeats holds nodes whose heartbeats are lost and whose
+	// health probes go unanswered
+	droppedHeartbeats map[string]bool
+	// killedAgents holds nodes whose agent is gone: probes fail and no
+	// task can be sent to them
+	killedAgents map[string]bool
+	// apiDelays holds the delay added to API requests by path prefix
+	apiDelays map[string]time.Duration
+	mu        sync.RWMutex
+}
+
+func NewFaultInjector(manager *ClusterManager) *FaultInjector {
+	return &FaultInjector{
+		manager:           manager,
+		droppedHeartbeats: make(map[string]bool),
+		killedAgents:      make(map[string]bool),
+		apiDelays:         make(map[string]time.Duration),
+	}
+}
+
+// DropHeartbeats loses the node's heartbeats and makes its health probes
+// fail while drop is set.
+func (f *FaultInjector) DropHeartbeats(nodeID string, drop bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if drop {
+		f.droppedHeartbeats[nodeID] = true
+	} else {
+		delete(f.droppedHeartbeats, nodeID)
+	}
+	logrus.Debugf("Fault injection: heartbeats of node %s dropped=%t", nodeID, drop)
+}
+
+// KillAgent makes the node's agent unreachable until RestoreAgent.
+func (f *FaultInjector) KillAgent(nodeID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.killedAgents[nodeID] = true
+	logrus.Debugf("Fault injection: agent of node %s killed", nodeID)
+}
+
+func (f *FaultInjector) RestoreAgent(nodeID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.killedAgents, nodeID)
+	logrus.Debugf("Fault injection: agent of node %s restored", nodeID)
+}
+
+// DelayAPI holds API requests whose path starts with prefix for d, as
+// measured by the manager's clock; zero removes the delay.
+func (f *FaultInjector) DelayAPI(prefix string, d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if d <= 0 {
+		delete(f.apiDelays, prefix)
+		return
+	}
+	f.apiDelays[prefix] = d
+	logrus.Debugf("Fault injection: API requests under %s delayed by %s", prefix, d)
+}
+
+// Reset turns every fault off.
+func (f *FaultInjector) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.droppedHeartbeats = make(map[string]bool)
+	f.killedAgents = make(map[string]bool)
+	f.apiDelays = make(map[string]time.Duration)
+}
+
+// probeFault returns why a health probe of the node should fail, or "".
+func (f *FaultInjector) probeFault(nodeID string) string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	switch {
+	case f.killedAgents[nodeID]:
+		return "agent killed by fault injection"
+	case f.droppedHeartbeats[nodeID]:
+		return "heartbeat dropped by fault injection"
+	}
+	return ""
+}
+
+func (f *FaultInjector) dispatchFault(nodeID string) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if f.killedAgents[nodeID] {
+		return fmt.Errorf("agent on node %s is not responding", nodeID)
+	}
+	return nil
+}
+
+func (f *FaultInjector) apiDelay(path string) time.Duration {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	// The longest matching prefix wins
+	var delay time.Duration
+	longest := -1
+	for prefix, d := range f.apiDelays {
+		if strings.HasPrefix(path, prefix) && len(prefix) > longest {
+			delay, longest = d, len(prefix)
+		}
+	}
+	return delay
+}
+
+func (api *APIServer) faultMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if delay := api.manager.Faults.apiDelay(r.URL.Path); delay > 0 {
+			api.manager.Clock.Sleep(delay)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -16,6 +16,7 @@ type HealthChecker struct {
 	mu          sync.RWMutex
 	stopChan    chan struct{}
 	interval    time.Duration
+	clock       Clock
 }
 
 type HealthCheckConfig struct {
@@ -31,6 +32,7 @@ func NewHealthChecker(nodeManager *NodeManager) *HealthChecker {
 		healthData:  make(map[string]*NodeHealth),
 		stopChan:    make(chan struct{}),
 		interval:    10 * time.Second,
+		clock:       nodeManager.manager.Clock,
 	}
 
 	return hc
@@ -53,12 +55,12 @@ func (hc *HealthChecker) Stop() {
 }
 
 func (hc *HealthChecker) run() {
-	ticker := time.NewTicker(hc.interval)
+	ticker := hc.clock.NewTicker(hc.interval)
 	defer ticker.Stop()
 
 	for {
 		select {
-		case <-ticker.C:
+		case <-ticker.C():
 			hc.checkAllNodes()
 		case <-hc.stopChan:
 			return
@@ -76,6 +78,12 @@ func (hc *HealthChecker) checkAllNodes() {
 	var wg sync.WaitGroup
 
 	for _, node := range nodes {
+		// Check a copy, as drains and heartbeats change nodes meanwhile
+		hc.nodeManager.mu.RLock()
+		copied := *node
+		hc.nodeManager.mu.RUnlock()
+		node := &copied
+
 		wg.Add(1)
 		go func(node *Node) {
 			defer wg.Done()
@@ -87,7 +95,7 @@ func (hc *HealthChecker) checkAllNodes() {
 }
 
 func (hc *HealthChecker) checkNodeHealth(node *Node) {
-	start := time.Now()
+	start := hc.clock.Now()
 
 	health := &NodeHealth{
 		ID:        node.ID,
@@ -117,7 +125,7 @@ func (hc *HealthChecker) checkNodeHealth(node *Node) {
 
 	// Calculate overall health status
 	health.Status = hc.calculateOverallHealth(health.Checks)
-	health.ResponseTime = time.Since(start).Milliseconds()
+	health.ResponseTime = hc.clock.Since(start).Milliseconds()
 
 	// Store health data
 	hc.mu.Lock()
@@ -142,12 +150,18 @@ func (hc *HealthChecker) checkNodeHealth(node *Node) {
 }
 
 func (hc *HealthChecker) checkAPIConnectivity(ctx context.Context, node *Node) HealthCheck {
-	start := time.Now()
+	start := hc.clock.Now()
 
 	check := HealthCheck{
 		Name: "api_connectivity",
 	}
 
+	if reason := hc.nodeManager.manager.Faults.probeFault(node.ID); reason != "" {
+		check.Status = "failed"
+		check.Message = reason
+		return check
+	}
+
 	// Simulate API connectivity check
 	// In real implementation, this would make HTTP request to node's API
 	url := fmt.Sprintf("http://%s:%d/health", node.Address, node.Port)
@@ -156,7 +170,7 @@ func (hc *HealthChecker) checkAPIConnectivity(ctx context.Context, node *Node) H
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		check.Status = "failed"
-		check.Duration = time.Since(start).Milliseconds()
+		check.Duration = hc.clock.Since(start).Milliseconds()
 		check.Message = fmt.Sprintf("Failed to create request: %v", err)
 		return check
 	}
@@ -164,7 +178,7 @@ func (hc *HealthChecker) checkAPIConnectivity(ctx context.Context, node *Node) H
 	resp, err := client.Do(req)
 	if err != nil {
 		check.Status = "failed"
-		check.Duration = time.Since(start).Milliseconds()
+		check.Duration = hc.clock.Since(start).Milliseconds()
 		check.Message = fmt.Sprintf("Request failed: %v", err)
 		return check
 	}
@@ -178,12 +192,12 @@ func (hc *HealthChecker) checkAPIConnectivity(ctx context.Context, node *Node) H
 		check.Message = fmt.Sprintf("API returned status %d", resp.StatusCode)
 	}
 
-	check.Duration = time.Since(start).Milliseconds()
+	check.Duration = hc.clock.Since(start).Milliseconds()
 	return check
 }
 
 func (hc *HealthChecker) checkResourceAvailability(node *Node) HealthCheck {
-	start := time.Now()
+	start := hc.clock.Now()
 
 	check := HealthCheck{
 		Name: "resource_availability",
@@ -205,12 +219,12 @@ func (hc *HealthChecker) checkResourceAvailability(node *Node) HealthCheck {
 			cpuUsage, memoryUsage, diskUsage)
 	}
 
-	check.Duration = time.Since(start).Milliseconds()
+	check.Duration = hc.clock.Since(start).Milliseconds()
 	return check
 }
 
 func (hc *HealthChecker) checkDiskSpace(node *Node) HealthCheck {
-	start := time.Now()
+	start := hc.clock.Now()
 
 	check := HealthCheck{
 		Name: "disk_space",
@@ -231,12 +245,12 @@ func (hc *HealthChecker) checkDiskSpace(node *Node) HealthCheck {
 		check.Message = fmt.Sprintf("Disk space critical (%.1f%% used)", diskUsage)
 	}
 
-	check.Duration = time.Since(start).Milliseconds()
+	check.Duration = hc.clock.Since(start).Milliseconds()
 	return check
 }
 
 func (hc *HealthChecker) checkNetworkConnectivity(node *Node) HealthCheck {
-	start := time.Now()
+	start := hc.clock.Now()
 
 	check := HealthCheck{
 		Name: "network_connectivity",
@@ -257,7 +271,7 @@ func (hc *HealthChecker) checkNetworkConnectivity(node *Node) HealthCheck {
 		check.Message = fmt.Sprintf("Network connectivity issues: %v", networkLatency)
 	}
 
-	check.Duration = time.Since(start).Milliseconds()
+	check.Duration = hc.clock.Since(start).Milliseconds()
 	return check
 }
 
@@ -416,7 +430,7 @@ func (ds *DiscoveryService) initializeStaticDiscovery() error {
 		peer := &Peer{
 			ID:       generatePeerID(endpoint),
 			Address:  endpoint,
-			LastSeen: time.Now(),
+			LastSeen: ds.manager.Clock.Now(),
 			Status:   "active",
 		}
 		ds.peers[peer.ID] = peer
@@ -455,14 +469,14 @@ func (ds *DiscoveryService) Stop() error {
 }
 
 func (ds *DiscoveryService) broadcastLoop() {
-	ticker := time.NewTicker(30 * time.Second)
+	ticker := ds.manager.Clock.NewTicker(30 * time.Second)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case msg := <-ds.broadcastCh:
 			ds.broadcastMessage(msg)
-		case <-ticker.C:
+		case <-ticker.C():
 			ds.heartbeat()
 		case <-ds.stopChan:
 			return
@@ -480,11 +494,27 @@ func (ds *DiscoveryService) broadcastMessage(msg *DiscoveryMessage) {
 	// For simulation, we just log the message
 }
 
+// Publish announces payload to the peers. Messages are dropped while the
+// broadcast queue is full.
+func (ds *DiscoveryService) Publish(msgType string, payload interface{}) {
+	msg := &DiscoveryMessage{
+		Type:      msgType,
+		From:      ds.manager.ID,
+		Timestamp: ds.manager.Clock.Now(),
+		Payload:   payload,
+	}
+	select {
+	case ds.broadcastCh <- msg:
+	default:
+		logrus.Warnf("Discovery queue is full, dropping %s message", msgType)
+	}
+}
+
 func (ds *DiscoveryService) heartbeat() {
 	msg := &DiscoveryMessage{
 		Type:      "heartbeat",
 		From:      ds.manager.ID,
-		Timestamp: time.Now(),
+		Timestamp: ds.manager.Clock.Now(),
 		Payload: map[string]interface{}{
 			"status": "alive",
 			"version": ds.manager.Version,
@@ -495,12 +525,12 @@ func (ds *DiscoveryService) heartbeat() {
 }
 
 func (ds *DiscoveryService) peerHealthCheck() {
-	ticker := time.NewTicker(60 * time.Second)
+	ticker := ds.manager.Clock.NewTicker(60 * time.Second)
 	defer ticker.Stop()
 
 	for {
 		select {
-		case <-ticker.C:
+		case <-ticker.C():
 			ds.checkPeerHealth()
 		case <-ds.stopChan:
 			return
@@ -512,7 +542,7 @@ func (ds *DiscoveryService) checkPeerHealth() {
 	ds.mu.Lock()
 	defer ds.mu.Unlock()
 
-	now := time.Now()
+	now := ds.manager.Clock.Now()
 	for id, peer := range ds.peers {
 		if now.Sub(peer.LastSeen) > 120*time.Second {
 			peer.Status = "inactive"
@@ -525,7 +555,7 @@ func (ds *DiscoveryService) AddPeer(address string) error {
 	peer := &Peer{
 		ID:       generatePeerID(address),
 		Address:  address,
-		LastSeen: time.Now(),
+		LastSeen: ds.manager.Clock.Now(),
 		Status:   "active",
 	}
 
@@ -567,72 +597,24 @@ func generatePeerID(address string) string {
 	return fmt.Sprintf("peer-%x", address)[:12]
 }
 
-// Simple scheduler placeholder
+// Scheduler answers what-if placement questions. Tasks themselves are
+// placed by the task workers, one at a time under TaskManager.placing.
 type Scheduler struct {
 	manager *ClusterManager
-	stopChan chan struct{}
 }
 
 func NewScheduler(manager *ClusterManager) *Scheduler {
 	return &Scheduler{
-		manager:  manager,
-		stopChan: make(chan struct{}),
+		manager: manager,
 	}
 }
 
 func (s *Scheduler) Start() error {
 	logrus.Info("Starting scheduler")
-
-	// Start scheduling loop
-	go s.scheduleLoop()
-
 	return nil
 }
 
 func (s *Scheduler) Stop() error {
 	logrus.Info("Stopping scheduler")
-	close(s.stopChan)
 	return nil
 }
-
-func (s *Scheduler) scheduleLoop() {
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ticker.C:
-			s.scheduleTasks()
-		case <-s.stopChan:
-			return
-		}
-	}
-}
-
-func (s *Scheduler) scheduleTasks() {
-	// Get pending tasks
-	tasks, err := s.manager.TaskManager.GetTasksByStatus(TaskPending)
-	if err != nil {
-		logrus.Errorf("Failed to get pending tasks: %v", err)
-		return
-	}
-
-	// Schedule each task
-	for _, task := range tasks {
-		// Find suitable node
-		node, err := s.manager.NodeManager.SelectNodeForTask(task)
-		if err != nil {
-			logrus.Errorf("Failed to find node for task %s: %v", task.ID, err)
-			continue
-		}
-
-		// Assign task to node
-		task.NodeID = node.ID
-		if err := s.manager.TaskManager.UpdateTask(task.ID, task); err != nil {
-			logrus.Errorf("Failed to assign task %s to node %s: %v", task.ID, node.ID, err)
-			continue
-		}
-
-		logrus.Infof("Scheduled task %s on node %s", task.ID, node.ID)
-	}
-}
\ No newline at end of file
@@ -0,0 +1,149 @@
+package cluster
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultHeartbeatInterval = 5 * time.Second
+	defaultHeartbeatMisses   = 3
+)
+
+// HeartbeatMonitor has a worker tell the manager it joined that it is
+// alive every HeartbeatInterval. On the manager it fails the nodes that
+// missed HeartbeatMisses heartbeats in a row: they are marked down and
+// their tasks rescheduled on the rest of the cluster.
+type HeartbeatMonitor struct {
+	manager *ClusterManager
+	client  *http.Client
+	mu      sync.Mutex
+	// since is when the monitor started; nodes not heard from since a
+	// previous run are given the full window from then
+	since time.Time
+	// failed holds the nodes whose failure was handled, until they send
+	// a heartbeat again
+	failed map[string]bool
+}
+
+func NewHeartbeatMonitor(manager *ClusterManager) *HeartbeatMonitor {
+	return &HeartbeatMonitor{
+		manager: manager,
+		client:  &http.Client{Timeout: 5 * time.Second},
+		failed:  make(map[string]bool),
+	}
+}
+
+func (h *HeartbeatMonitor) Start() {
+	h.mu.Lock()
+	h.since = h.manager.Clock.Now()
+	h.mu.Unlock()
+
+	go h.loop()
+}
+
+func (h *HeartbeatMonitor) loop() {
+	ticker := h.manager.Clock.NewTicker(h.interval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			h.manager.mu.RLock()
+			managerAddr := h.manager.joinAddr
+			h.manager.mu.RUnlock()
+
+			if managerAddr != "" {
+				h.send(managerAddr)
+			} else {
+				h.checkNodes()
+			}
+		case <-h.manager.shutdown:
+			return
+		}
+	}
+}
+
+func (h *HeartbeatMonitor) interval() time.Duration {
+	if h.manager.Config.HeartbeatInterval > 0 {
+		return h.manager.Config.HeartbeatInterval
+	}
+	return defaultHeartbeatInterval
+}
+
+func (h *HeartbeatMonitor) misses() int {
+	if h.manager.Config.HeartbeatMisses > 0 {
+		return h.manager.Config.HeartbeatMisses
+	}
+	return defaultHeartbeatMisses
+}
+
+// send reports this node alive to the manager it joined.
+func (h *HeartbeatMonitor) send(managerAddr string) {
+	h.manager.mu.RLock()
+	token := h.manager.Config.JoinToken
+	h.manager.mu.RUnlock()
+
+	url := fmt.Sprintf("http://%s/nodes/%s/heartbeat", managerAddr, h.manager.localNodeID())
+	if err := postClusterRequest(h.client, url, token, struct{}{}); err != nil {
+		logrus.Warnf("Failed to send heartbeat to %s: %v", managerAddr, err)
+	}
+}
+
+// Record notes a heartbeat of a node. A node that was down is ready again.
+func (h *HeartbeatMonitor) Record(nodeID string) error {
+	if reason := h.manager.Faults.probeFault(nodeID); reason != "" {
+		return fmt.Errorf("%s", reason)
+	}
+	if err := h.manager.NodeManager.Heartbeat(nodeID); err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	delete(h.failed, nodeID)
+	h.mu.Unlock()
+	return nil
+}
+
+// checkNodes fails the nodes whose heartbeats lapsed.
+func (h *HeartbeatMonitor) checkNodes() {
+	nodes, err := h.manager.NodeManager.ListNodes()
+	if err != nil {
+		logrus.Errorf("Failed to list nodes for heartbeat check: %v", err)
+		return
+	}
+
+	localID := h.manager.localNodeID()
+	misses := h.misses()
+	window := h.interval() * time.Duration(misses)
+	now := h.manager.Clock.Now()
+
+	h.manager.NodeManager.mu.RLock()
+	h.mu.Lock()
+	var lapsed []string
+	for _, node := range nodes {
+		if node.ID == localID || h.failed[node.ID] {
+			continue
+		}
+		lastSeen := node.LastSeen
+		if lastSeen.Before(h.since) {
+			lastSeen = h.since
+		}
+		if now.Sub(lastSeen) > window {
+			h.failed[node.ID] = true
+			lapsed = append(lapsed, node.ID)
+		}
+	}
+	h.mu.Unlock()
+	h.manager.NodeManager.mu.RUnlock()
+
+	for _, nodeID := range lapsed {
+		logrus.Warnf("Node %s missed %d heartbeats", nodeID, misses)
+		if err := h.manager.HandleNodeFailure(nodeID); err != nil {
+			logrus.Errorf("Failed to handle failure of node %s: %v", nodeID, err)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package cluster
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// hostnamePattern is an RFC 1123 label, which is what resolvers accept as
+// a single DNS name component
+var hostnamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// HostnameContext is what hostname templates are executed against, e.g.
+// "{{.Service.Name}}-{{.Task.Slot}}" or "kafka-{{.Task.Slot}}".
+type HostnameContext struct {
+	Service struct {
+		ID   string
+		Name string
+	}
+	Task struct {
+		ID   string
+		Name string
+		Slot int
+	}
+	Node struct {
+		ID       string
+		Hostname string
+	}
+	Namespace string
+}
+
+func (t *Task) hostnameContext() HostnameContext {
+	var ctx HostnameContext
+	ctx.Service.ID = t.ServiceID
+	ctx.Service.Name = t.ServiceName
+	ctx.Task.ID = t.ID
+	ctx.Task.Name = t.Name
+	ctx.Task.Slot = t.Slot
+	ctx.Node.ID = t.NodeID
+	ctx.Node.Hostname = getLocalHostname()
+	ctx.Namespace = t.Namespace
+	return ctx
+}
+
+// Hostname is the hostname of the task's container. Tasks of a service
+// without a HostnameTemplate are named after the service and their slot,
+// which stays the same when a task is replaced, so every replica keeps a
+// stable identity. Other tasks get the container's default.
+func (t *Task) Hostname() (string, error) {
+	if t.HostnameTemplate == "" {
+		if t.ServiceName == "" {
+			return "", nil
+		}
+		return normalizeHostname(fmt.Sprintf("%s-%d", t.ServiceName, t.Slot)), nil
+	}
+	return renderHostname(t.HostnameTemplate, t.hostnameContext())
+}
+
+// ValidateHostnameTemplate checks that text parses and makes a valid
+// hostname for a sample task.
+func ValidateHostnameTemplate(text string) error {
+	var ctx HostnameContext
+	ctx.Service.ID = "svc1"
+	ctx.Service.Name = "service"
+	ctx.Task.ID = "task1"
+	ctx.Task.Name = "task"
+	ctx.Task.Slot = 1
+	ctx.Node.ID = "node1"
+	ctx.Node.Hostname = "node"
+	ctx.Namespace = "default"
+	_, err := renderHostname(text, ctx)
+	return err
+}
+
+func renderHostname(text string, ctx HostnameContext) (string, error) {
+	tmpl, err := template.New("hostname").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid hostname template: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, ctx); err != nil {
+		return "", fmt.Errorf("invalid hostname template: %v", err)
+	}
+	hostname := normalizeHostname(buf.String())
+	if !hostnamePattern.MatchString(hostname) {
+		return "", fmt.Errorf("hostname template %q gives invalid hostname %q", text, hostname)
+	}
+	return hostname, nil
+}
+
+// normalizeHostname lowercases name and replaces what hostnames can't
+// hold, such as the dots and underscores of service names, with dashes.
+func normalizeHostname(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' {
+			return r
+		}
+		return '-'
+	}, name)
+}
+
+// DNSNames are the names the task's container is registered under: the
+// service name, shared by every replica, and the task's own hostname.
+func (t *Task) DNSNames() ([]string, error) {
+	var names []string
+	if t.ServiceName != "" {
+		names = append(names, t.ServiceName)
+	}
+	hostname, err := t.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	if hostname != "" && hostname != t.ServiceName {
+		names = append(names, hostname)
+	}
+	return names, nil
+}
@@ -0,0 +1,113 @@
+package cluster
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"docker-impl/pkg/timeutil"
+	"github.com/sirupsen/logrus"
+)
+
+const nodeIdentityFile = "node.json"
+
+// NodeIdentity is what makes a node the same node across restarts. It is
+// written once under the cluster data dir and reused on every start.
+type NodeIdentity struct {
+	ID         string             `json:"id"`
+	PublicKey  ed25519.PublicKey  `json:"public_key"`
+	PrivateKey ed25519.PrivateKey `json:"private_key"`
+	CreatedAt  time.Time          `json:"created_at"`
+}
+
+// LoadNodeIdentity reads the identity stored in dataDir, creating and
+// persisting a new one the first time the node starts, stamped by clock.
+func LoadNodeIdentity(dataDir string, clock Clock) (*NodeIdentity, error) {
+	path := filepath.Join(dataDir, nodeIdentityFile)
+
+	data, err := os.ReadFile(path)
+	if err == nil {
+		var identity NodeIdentity
+		if _, err := timeutil.Unmarshal(data, &identity, recordTimeKeys...); err != nil {
+			return nil, fmt.Errorf("failed to parse node identity %s: %v", path, err)
+		}
+		if identity.ID == "" || len(identity.PrivateKey) != ed25519.PrivateKeySize {
+			return nil, fmt.Errorf("node identity %s is incomplete", path)
+		}
+		return &identity, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read node identity: %v", err)
+	}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate node key: %v", err)
+	}
+
+	identity := &NodeIdentity{
+		ID:         generateNodeID(),
+		PublicKey:  publicKey,
+		PrivateKey: privateKey,
+		CreatedAt:  clock.Now(),
+	}
+
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %v", err)
+	}
+	data, err = json.MarshalIndent(identity, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal node identity: %v", err)
+	}
+
+	// Write to a temp file first so a crash never leaves a half-written
+	// identity behind.
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return nil, fmt.Errorf("failed to write node identity: %v", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return nil, fmt.Errorf("failed to write node identity: %v", err)
+	}
+
+	logrus.Infof("Created node identity %s", identity.ID)
+	return identity, nil
+}
+
+// reconcileNodeTasks runs when a node registers with an ID the cluster has
+// seen before. Tasks still assigned to it are adopted again instead of
+// being orphaned; tasks that were orphaned while it was away are restarted,
+// and tasks that should have stopped are marked shut down.
+func (cm *ClusterManager) reconcileNodeTasks(nodeID string) {
+	tasks, err := cm.TaskManager.GetTasksByNode(nodeID)
+	if err != nil {
+		logrus.Warnf("Failed to get tasks for node %s: %v", nodeID, err)
+		return
+	}
+
+	adopted := 0
+	for _, task := range tasks {
+		switch {
+		case task.Status == TaskComplete || task.Status == TaskFailed ||
+			task.Status == TaskShutdown || task.Status == TaskRejected:
+			continue
+		case task.DesiredState != "" && task.DesiredState != TaskRunning:
+			cm.TaskManager.updateTaskStatus(task.ID, TaskShutdown)
+		case task.Status == TaskOrphaned:
+			logrus.Infof("Restarting orphaned task %s on returning node %s", task.ID, nodeID)
+			if err := cm.TaskManager.RestartTask(task.ID); err != nil {
+				logrus.Errorf("Failed to restart task %s: %v", task.ID, err)
+			}
+		default:
+			adopted++
+		}
+	}
+
+	if adopted > 0 {
+		logrus.Infof("Node %s re-registered with %d assigned task(s)", nodeID, adopted)
+	}
+}
@@ -0,0 +1,505 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const imageGCStateFile = "image-gc.json"
+
+const (
+	defaultImageGCRetention = 24 * time.Hour
+	defaultImageGCInterval  = time.Hour
+)
+
+// ImageGCPolicy controls how each node removes the images none of its
+// tasks use.
+type ImageGCPolicy struct {
+	Enabled bool `json:"enabled"`
+	// Retention is how long an image must have gone unused (default 24h)
+	Retention time.Duration `json:"retention,omitempty"`
+	// Interval is how often nodes collect (default 1h)
+	Interval time.Duration `json:"interval,omitempty"`
+	// Pinned images are never collected, on top of those prepulled
+	Pinned []string `json:"pinned,omitempty"`
+}
+
+func (p ImageGCPolicy) withDefaults() ImageGCPolicy {
+	if p.Retention <= 0 {
+		p.Retention = defaultImageGCRetention
+	}
+	if p.Interval <= 0 {
+		p.Interval = defaultImageGCInterval
+	}
+	return p
+}
+
+// LocalImage is an image on this node as the image GC sees it.
+type LocalImage struct {
+	ID    string   `json:"id"`
+	Names []string `json:"names,omitempty"`
+	Size  int64    `json:"size"`
+}
+
+// LocalImageStore reaches the images of the node this process runs on.
+// The cluster package doesn't own images, so whoever does registers one
+// with SetLocalImageStore.
+type LocalImageStore interface {
+	ListImages() ([]LocalImage, error)
+	// ResolveImage returns the ID of the local image ref names
+	ResolveImage(ref string) (string, error)
+	// RemoveImages removes images with the layers no other image uses,
+	// keeping those a container still uses, and returns the IDs removed
+	// and the space reclaimed.
+	RemoveImages(ids []string) ([]string, int64, error)
+	PullImage(ref string) error
+}
+
+type ImageGCReport struct {
+	NodeID         string   `json:"node_id"`
+	ImagesDeleted  []string `json:"images_deleted"`
+	SpaceReclaimed int64    `json:"space_reclaimed"`
+	InUse          int      `json:"in_use"`
+	Pinned         int      `json:"pinned"`
+	// Retained are unused images still within the retention period
+	Retained int    `json:"retained"`
+	Error    string `json:"error,omitempty"`
+	Time     string `json:"time"`
+}
+
+type imageGCState struct {
+	Policy ImageGCPolicy `json:"policy"`
+	// Prepulled holds the images pinned by cluster prepull
+	Prepulled []string `json:"prepulled,omitempty"`
+}
+
+// ImageGC removes the images on this node that no local task has used for
+// the retention period. Images pinned by policy or by a prepull are kept,
+// and so is anything a container uses.
+type ImageGC struct {
+	manager *ClusterManager
+	store   LocalImageStore
+	state   imageGCState
+	// lastUsed holds when each local image was last used by a task or, if
+	// it never was, when it was first seen
+	lastUsed map[string]time.Time
+	last     *ImageGCReport
+	reset    chan struct{}
+	mu       sync.Mutex
+	// collectMu keeps collections from overlapping
+	collectMu sync.Mutex
+}
+
+func NewImageGC(manager *ClusterManager) *ImageGC {
+	gc := &ImageGC{
+		manager:  manager,
+		lastUsed: make(map[string]time.Time),
+		reset:    make(chan struct{}, 1),
+	}
+	gc.load()
+	return gc
+}
+
+func (gc *ImageGC) statePath() string {
+	return filepath.Join(gc.manager.Config.DataDir, imageGCStateFile)
+}
+
+func (gc *ImageGC) load() {
+	data, err := os.ReadFile(gc.statePath())
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(data, &gc.state); err != nil {
+		logrus.Warnf("Failed to parse image GC state: %v", err)
+	}
+}
+
+// save writes the state. The caller holds mu.
+func (gc *ImageGC) save() error {
+	data, err := json.MarshalIndent(gc.state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal image GC state: %v", err)
+	}
+	if err := os.MkdirAll(gc.manager.Config.DataDir, 0755); err != nil {
+		return fmt.Errorf("failed to create data directory: %v", err)
+	}
+	if err := os.WriteFile(gc.statePath(), data, 0644); err != nil {
+		return fmt.Errorf("failed to save image GC state: %v", err)
+	}
+	return nil
+}
+
+// SetLocalImageStore registers how this node's images are reached by the
+// image GC and prepulls.
+func (cm *ClusterManager) SetLocalImageStore(store LocalImageStore) {
+	cm.ImageGC.mu.Lock()
+	defer cm.ImageGC.mu.Unlock()
+	cm.ImageGC.store = store
+}
+
+func (gc *ImageGC) Policy() ImageGCPolicy {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	return gc.state.Policy
+}
+
+// SetPolicy changes the policy of this node, taking effect at once.
+func (gc *ImageGC) SetPolicy(policy ImageGCPolicy) error {
+	if policy.Retention < 0 || policy.Interval < 0 {
+		return fmt.Errorf("retention and interval can't be negative")
+	}
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	gc.state.Policy = policy
+	if err := gc.save(); err != nil {
+		return err
+	}
+	select {
+	case gc.reset <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Pin keeps images from being collected, or stops keeping them.
+func (gc *ImageGC) Pin(images []string, pinned bool) error {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	set := make(map[string]bool)
+	for _, image := range gc.state.Prepulled {
+		set[image] = true
+	}
+	for _, image := range images {
+		set[image] = pinned
+	}
+	gc.state.Prepulled = nil
+	for image, keep := range set {
+		if keep {
+			gc.state.Prepulled = append(gc.state.Prepulled, image)
+		}
+	}
+	sort.Strings(gc.state.Prepulled)
+	return gc.save()
+}
+
+type ImageGCStatus struct {
+	Policy    ImageGCPolicy  `json:"policy"`
+	Prepulled []string       `json:"prepulled,omitempty"`
+	Last      *ImageGCReport `json:"last,omitempty"`
+}
+
+// Status returns the policy, the prepulled images and the report of the
+// latest collection, if any.
+func (gc *ImageGC) Status() *ImageGCStatus {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	return &ImageGCStatus{
+		Policy:    gc.state.Policy,
+		Prepulled: append([]string(nil), gc.state.Prepulled...),
+		Last:      gc.last,
+	}
+}
+
+// Start collects on the interval of the policy while it is enabled.
+func (gc *ImageGC) Start() {
+	go gc.loop()
+}
+
+func (gc *ImageGC) loop() {
+	for {
+		policy := gc.Policy().withDefaults()
+		ticker := gc.manager.Clock.NewTicker(policy.Interval)
+		select {
+		case <-ticker.C():
+			if gc.Policy().Enabled {
+				if _, err := gc.Collect(); err != nil {
+					logrus.Warnf("Image GC failed: %v", err)
+				}
+			}
+		case <-gc.reset:
+		case <-gc.manager.shutdown:
+			ticker.Stop()
+			return
+		}
+		ticker.Stop()
+	}
+}
+
+// Collect removes the local images that no local task has used for the
+// retention period and that aren't pinned, whether or not the policy is
+// enabled.
+func (gc *ImageGC) Collect() (*ImageGCReport, error) {
+	gc.collectMu.Lock()
+	defer gc.collectMu.Unlock()
+
+	gc.mu.Lock()
+	store := gc.store
+	policy := gc.state.Policy.withDefaults()
+	pins := append(append([]string(nil), gc.state.Prepulled...), policy.Pinned...)
+	gc.mu.Unlock()
+	if store == nil {
+		return nil, fmt.Errorf("this node has no local image store")
+	}
+
+	nodeID := gc.manager.localNodeID()
+	now := gc.manager.Clock.Now()
+	report := &ImageGCReport{NodeID: nodeID, Time: now.Format(time.RFC3339)}
+
+	images, err := store.ListImages()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list images: %v", err)
+	}
+
+	inUse := make(map[string]bool)
+	tasks, err := gc.manager.TaskManager.ListTasks()
+	if err != nil {
+		return nil, err
+	}
+	for _, task := range tasks {
+		if task.NodeID != nodeID || task.Image == "" || task.Status == TaskRemove {
+			continue
+		}
+		if id, err := store.ResolveImage(task.Image); err == nil {
+			inUse[id] = true
+		}
+	}
+	pinned := make(map[string]bool)
+	for _, ref := range pins {
+		if id, err := store.ResolveImage(ref); err == nil {
+			pinned[id] = true
+		}
+	}
+
+	var candidates []string
+	names := make(map[string]string)
+	gc.mu.Lock()
+	present := make(map[string]bool, len(images))
+	for _, image := range images {
+		present[image.ID] = true
+		names[image.ID] = strings.Join(image.Names, ",")
+		lastUsed, seen := gc.lastUsed[image.ID]
+		switch {
+		case inUse[image.ID]:
+			gc.lastUsed[image.ID] = now
+			report.InUse++
+		case pinned[image.ID]:
+			report.Pinned++
+		case !seen:
+			gc.lastUsed[image.ID] = now
+			report.Retained++
+		case now.Sub(lastUsed) < policy.Retention:
+			report.Retained++
+		default:
+			candidates = append(candidates, image.ID)
+		}
+	}
+	for id := range gc.lastUsed {
+		if !present[id] {
+			delete(gc.lastUsed, id)
+		}
+	}
+	gc.mu.Unlock()
+
+	if len(candidates) > 0 {
+		removed, reclaimed, err := store.RemoveImages(candidates)
+		report.ImagesDeleted = removed
+		report.SpaceReclaimed = reclaimed
+		if err != nil {
+			report.Error = err.Error()
+		}
+	}
+	sort.Strings(report.ImagesDeleted)
+
+	for _, id := range report.ImagesDeleted {
+		gc.manager.NodeManager.RecordEvent(nodeID, "image_gc_remove", fmt.Sprintf("Removed unused image %s", shortImageID(id)),
+			map[string]string{"image": id, "names": names[id]})
+	}
+	message := fmt.Sprintf("Image GC removed %d image(s), reclaimed %d bytes; %d in use, %d pinned, %d within retention",
+		len(report.ImagesDeleted), report.SpaceReclaimed, report.InUse, report.Pinned, report.Retained)
+	attributes := map[string]string{
+		"removed":   strconv.Itoa(len(report.ImagesDeleted)),
+		"reclaimed": strconv.FormatInt(report.SpaceReclaimed, 10),
+	}
+	if report.Error != "" {
+		message += ": " + report.Error
+		attributes["error"] = report.Error
+	}
+	gc.manager.NodeManager.RecordEvent(nodeID, "image_gc", message, attributes)
+	logrus.Info(message)
+
+	gc.mu.Lock()
+	gc.last = report
+	gc.mu.Unlock()
+	return report, nil
+}
+
+func shortImageID(id string) string {
+	id = strings.TrimPrefix(id, "sha256:")
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// PrepullRequest asks nodes to pull images and keep them from the image
+// GC, or with Unpin to let it collect them again.
+// prepullParallelism is how many images a node prepulls at once.
+const prepullParallelism = 4
+
+type PrepullRequest struct {
+	Images []string `json:"images"`
+	Unpin  bool     `json:"unpin,omitempty"`
+}
+
+type NodePrepullResult struct {
+	NodeID string   `json:"node_id"`
+	Pulled []string `json:"pulled,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// prepullLocal pins the images of request on this node and pulls them.
+func (cm *ClusterManager) prepullLocal(request PrepullRequest) (*NodePrepullResult, error) {
+	if err := cm.ImageGC.Pin(request.Images, !request.Unpin); err != nil {
+		return nil, err
+	}
+	result := &NodePrepullResult{NodeID: cm.localNodeID()}
+	if request.Unpin {
+		return result, nil
+	}
+
+	cm.ImageGC.mu.Lock()
+	store := cm.ImageGC.store
+	cm.ImageGC.mu.Unlock()
+	if store == nil {
+		return nil, fmt.Errorf("this node has no local image store")
+	}
+
+	// Images are pulled a few at a time, and reported in the order asked
+	errs := make([]error, len(request.Images))
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, prepullParallelism)
+	for i, image := range request.Images {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, image string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			errs[i] = store.PullImage(image)
+		}(i, image)
+	}
+	wg.Wait()
+
+	var failures []string
+	for i, image := range request.Images {
+		if errs[i] != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", image, errs[i]))
+			continue
+		}
+		result.Pulled = append(result.Pulled, image)
+		cm.NodeManager.RecordEvent(result.NodeID, "image_prepull", fmt.Sprintf("Prepulled and pinned image %s", image),
+			map[string]string{"image": image})
+	}
+	if len(failures) > 0 {
+		result.Error = strings.Join(failures, "; ")
+	}
+	return result, nil
+}
+
+// Prepull pulls images on every reachable node and pins them there, so
+// the image GC keeps them until they are unpinned.
+func (cm *ClusterManager) Prepull(request PrepullRequest) ([]*NodePrepullResult, error) {
+	if len(request.Images) == 0 {
+		return nil, fmt.Errorf("no images to prepull")
+	}
+
+	var mu sync.Mutex
+	pulled := make(map[string][]string)
+	failures, err := cm.forEachNode(func(node *Node) error {
+		result := &NodePrepullResult{}
+		var err error
+		if cm.isLocalNode(node) {
+			result, err = cm.prepullLocal(request)
+		} else {
+			err = callNode(node, http.MethodPost, "/node/prepull", request, result)
+		}
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		pulled[node.ID] = result.Pulled
+		mu.Unlock()
+		if result.Error != "" {
+			return fmt.Errorf("%s", result.Error)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*NodePrepullResult
+	for _, failure := range failures {
+		results = append(results, &NodePrepullResult{NodeID: failure.NodeID, Pulled: pulled[failure.NodeID], Error: failure.Error})
+	}
+	return results, nil
+}
+
+// NodeResult is how a request sent to every node went on one of them.
+type NodeResult struct {
+	NodeID string `json:"node_id"`
+	Error  string `json:"error,omitempty"`
+}
+
+// SetImageGCPolicy sets the image GC policy of every reachable node.
+func (cm *ClusterManager) SetImageGCPolicy(policy ImageGCPolicy) ([]*NodeResult, error) {
+	if policy.Retention < 0 || policy.Interval < 0 {
+		return nil, fmt.Errorf("retention and interval can't be negative")
+	}
+	return cm.forEachNode(func(node *Node) error {
+		if cm.isLocalNode(node) {
+			return cm.ImageGC.SetPolicy(policy)
+		}
+		return callNode(node, http.MethodPut, "/node/image-gc", policy, nil)
+	})
+}
+
+// forEachNode runs do on every reachable node in parallel and returns how
+// it went on each node, ordered by node ID. Nodes that are down fail.
+func (cm *ClusterManager) forEachNode(do func(node *Node) error) ([]*NodeResult, error) {
+	nodes, err := cm.NodeManager.ListNodes()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+
+	results := make([]*NodeResult, len(nodes))
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		results[i] = &NodeResult{NodeID: node.ID}
+		if node.Status == StatusDown || node.Status == StatusUnknown {
+			results[i].Error = fmt.Sprintf("node is %s", node.Status)
+			continue
+		}
+		wg.Add(1)
+		go func(result *NodeResult, node *Node) {
+			defer wg.Done()
+			if err := do(node); err != nil {
+				logrus.Warnf("Request to node %s failed: %v", node.ID, err)
+				result.Error = err.Error()
+			}
+		}(results[i], node)
+	}
+	wg.Wait()
+	return results, nil
+}
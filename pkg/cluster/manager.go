@@ -1,15 +1,17 @@
 package cluster
 
 import (
-	"crypto/tls"
+	"bytes"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"sync"
 	"time"
 
-	"github.com/gorilla/mux"
+	"docker-impl/pkg/ids"
 	"github.com/sirupsen/logrus"
 )
 
@@ -20,25 +22,80 @@ type ClusterManager struct {
 	Config      *ClusterConfig    `json:"config"`
 	NodeManager *NodeManager      `json:"-"`
 	TaskManager *TaskManager      `json:"-"`
+	Services    *ServiceManager   `json:"-"`
 	Scheduler   *Scheduler        `json:"-"`
 	APIServer   *APIServer        `json:"-"`
 	Discovery   *DiscoveryService `json:"-"`
+	Identity    *NodeIdentity     `json:"-"`
+	SecretManager *SecretManager  `json:"-"`
+	Rebalancer  *Rebalancer       `json:"-"`
+	Budgets     *DisruptionBudgets `json:"-"`
+	SLOs        *SLOTracker        `json:"-"`
+	ImageGC     *ImageGC           `json:"-"`
+	Clock       Clock              `json:"-"`
+	Faults      *FaultInjector     `json:"-"`
+	Metrics     *ClusterMetrics    `json:"-"`
+	Usage       *UsageTracker      `json:"-"`
+	Heartbeats  *HeartbeatMonitor  `json:"-"`
+	Auth        *APIAuth           `json:"-"`
+	SchedulerPlugins *SchedulerPlugins `json:"-"`
+	Strategies  *SchedulingStrategies `json:"-"`
+	Overlays    *OverlayNetworks   `json:"-"`
+	// State persists nodes, tasks, services and tokens under the data dir
+	State       *StateStore        `json:"-"`
+	// Replicator copies the state to the other managers
+	Replicator  *StateReplicator   `json:"-"`
 	mu          sync.RWMutex
 	started     bool
+	startedAt   time.Time
 	shutdown    chan struct{}
+	// joinSecrets sign the join tokens of each role; rotating one revokes
+	// the tokens issued for that role
+	joinSecrets map[NodeRole][]byte
+	// joinTokens are the join tokens handed out, by role
+	joinTokens  map[NodeRole]string
+	localPruner LocalPruneFunc
+	localTaskRunner LocalTaskRunner
+	agentResolver AgentImageResolver
+	agentRestarter AgentRestarter
+	agent       *taskAgent
+	// joinAddr is the manager this node joined; empty on the manager
+	// that initialized the cluster
+	joinAddr    string
+	// leaderID is the node ID of the manager this node joined, the only
+	// one it takes replicas of the cluster state from
+	leaderID    string
 }
 
 type ClusterConfig struct {
 	AdvertiseAddr    string            `json:"advertise_addr"`
 	AdvertisePort    int               `json:"advertise_port"`
 	DataDir          string            `json:"data_dir"`
+	// JoinToken is the cluster token the nodes present to each other.
+	// Nodes join with a join token and are handed this one in exchange.
 	JoinToken        string            `json:"join_token"`
+	// JoinTokenTTL is how long join tokens are good for; 0 never expires
+	JoinTokenTTL     time.Duration     `json:"join_token_ttl"`
 	HeartbeatInterval time.Duration   `json:"heartbeat_interval"`
+	// HeartbeatMisses is how many heartbeats in a row a node may miss
+	// before it is marked down and its tasks are rescheduled
+	HeartbeatMisses  int             `json:"heartbeat_misses"`
 	ElectionTimeout  time.Duration   `json:"election_timeout"`
 	TaskTimeout      time.Duration   `json:"task_timeout"`
 	HealthCheckInterval time.Duration `json:"health_check_interval"`
 	Discovery        DiscoveryConfig   `json:"discovery"`
 	Security         SecurityConfig    `json:"security"`
+	// SchedulingStrategy places the tasks of services that don't pick
+	// one: spread (default), binpack or random
+	SchedulingStrategy string        `json:"scheduling_strategy"`
+	// Clock replaces the real clock, for tests
+	Clock Clock `json:"-"`
+	// Listener serves the API instead of listening on the advertised
+	// address, for tests that bind the socket themselves
+	Listener net.Listener `json:"-"`
+	// ForceNewCluster takes over the cluster from the replica of its
+	// state this manager holds, once the leader is lost
+	ForceNewCluster bool `json:"force_new_cluster,omitempty"`
 }
 
 type DiscoveryConfig struct {
@@ -52,6 +109,8 @@ type SecurityConfig struct {
 	TLSCertFile string `json:"tls_cert_file"`
 	TLSKeyFile  string `json:"tls_key_file"`
 	Token       string `json:"token"`
+	// Auth adds ways for users to authenticate to the API
+	Auth        AuthConfig `json:"auth"`
 }
 
 type ClusterStatus struct {
@@ -64,8 +123,8 @@ type ClusterStatus struct {
 	ActiveTasks  int               `json:"active_tasks"`
 	CompletedTasks int             `json:"completed_tasks"`
 	Uptime       string            `json:"uptime"`
-	CreatedAt    string            `json:"created_at"`
-	UpdatedAt    string            `json:"updated_at"`
+	CreatedAt    time.Time         `json:"created_at"`
+	UpdatedAt    time.Time         `json:"updated_at"`
 }
 
 var (
@@ -80,6 +139,7 @@ func GetClusterManager() *ClusterManager {
 			AdvertisePort:       2377,
 			DataDir:            "/var/lib/mydocker/cluster",
 			HeartbeatInterval:   5 * time.Second,
+			HeartbeatMisses:     3,
 			ElectionTimeout:    10 * time.Second,
 			TaskTimeout:        30 * time.Second,
 			HealthCheckInterval: 10 * time.Second,
@@ -104,12 +164,42 @@ func NewClusterManager(config *ClusterConfig) *ClusterManager {
 		Version:  "1.0.0",
 		Config:   config,
 		shutdown: make(chan struct{}),
+		joinSecrets: map[NodeRole][]byte{
+			RoleWorker:  ids.GenerateSecret(),
+			RoleManager: ids.GenerateSecret(),
+		},
+		joinTokens:  make(map[NodeRole]string),
+	}
+
+	cm.Clock = config.Clock
+	if cm.Clock == nil {
+		cm.Clock = realClock{}
+	}
+	cm.State = NewStateStore(cm)
+	cm.Replicator = NewStateReplicator(cm)
+	cm.agent = newTaskAgent(cm)
+	cm.Faults = NewFaultInjector(cm)
+	cm.Metrics = NewClusterMetrics(cm)
+	cm.Auth = NewAPIAuth(cm)
+	if err := cm.Auth.Configure(config.Security.Auth); err != nil {
+		logrus.Errorf("Failed to configure API authentication: %v", err)
 	}
 
 	// Initialize components
 	cm.NodeManager = NewNodeManager(cm)
+	cm.SchedulerPlugins = NewSchedulerPlugins(cm)
+	cm.Strategies = NewSchedulingStrategies(cm)
 	cm.TaskManager = NewTaskManager(cm)
+	cm.Services = NewServiceManager(cm)
+	cm.Overlays = NewOverlayNetworks(cm)
+	cm.SecretManager = NewSecretManager(cm)
 	cm.Scheduler = NewScheduler(cm)
+	cm.Rebalancer = NewRebalancer(cm)
+	cm.Budgets = NewDisruptionBudgets(cm)
+	cm.SLOs = NewSLOTracker(cm)
+	cm.Usage = NewUsageTracker(cm)
+	cm.Heartbeats = NewHeartbeatMonitor(cm)
+	cm.ImageGC = NewImageGC(cm)
 	cm.APIServer = NewAPIServer(cm)
 	cm.Discovery = NewDiscoveryService(cm, config.Discovery)
 
@@ -126,6 +216,15 @@ func (cm *ClusterManager) Initialize() error {
 		return fmt.Errorf("cluster manager is already initialized")
 	}
 
+	if _, err := cm.Strategies.Get(cm.Config.SchedulingStrategy); err != nil {
+		return err
+	}
+
+	// Restore the cluster state from the last run
+	if err := cm.State.Open(); err != nil {
+		return fmt.Errorf("failed to open cluster state: %v", err)
+	}
+
 	// Initialize discovery service
 	if err := cm.Discovery.Initialize(); err != nil {
 		return fmt.Errorf("failed to initialize discovery service: %v", err)
@@ -141,12 +240,25 @@ func (cm *ClusterManager) Initialize() error {
 		return fmt.Errorf("failed to start scheduler: %v", err)
 	}
 
+	cm.ImageGC.Start()
+	cm.Usage.Start()
+	cm.Heartbeats.Start()
+	cm.Services.Start()
+	cm.Replicator.Start()
+	cm.agent.start()
+
+	// A node that updated its agent reports the version it updated to
+	if version := cm.loadAgentVersion(); version != "" {
+		cm.Version = version
+	}
+
 	// Register this node
 	if err := cm.registerLocalNode(); err != nil {
 		return fmt.Errorf("failed to register local node: %v", err)
 	}
 
 	cm.started = true
+	cm.startedAt = cm.Clock.Now()
 	logrus.Info("Cluster manager initialized successfully")
 
 	return nil
@@ -181,6 +293,10 @@ func (cm *ClusterManager) Shutdown() error {
 		cm.NodeManager.Shutdown()
 	}
 
+	if err := cm.State.Close(); err != nil {
+		logrus.Errorf("Failed to close cluster state: %v", err)
+	}
+
 	cm.started = false
 	logrus.Info("Cluster manager shutdown successfully")
 
@@ -188,35 +304,96 @@ func (cm *ClusterManager) Shutdown() error {
 }
 
 func (cm *ClusterManager) JoinCluster(joinAddr, joinToken string) error {
-	cm.mu.Lock()
-	defer cm.mu.Unlock()
-
 	logrus.Infof("Joining cluster at %s", joinAddr)
 
-	if cm.started {
-		return fmt.Errorf("cluster manager is already initialized")
-	}
-
 	// Validate join token
 	if joinToken == "" {
 		return fmt.Errorf("join token is required")
 	}
+	role, err := ids.JoinTokenRole(joinToken)
+	if err != nil {
+		return err
+	}
+
+	cm.mu.Lock()
+	if cm.started {
+		cm.mu.Unlock()
+		return fmt.Errorf("cluster manager is already initialized")
+	}
 
 	// Set join token in config
 	cm.Config.JoinToken = joinToken
+	cm.joinAddr = joinAddr
 
 	// Initialize discovery with join address
 	cm.Config.Discovery.Endpoints = []string{joinAddr}
+	cm.mu.Unlock()
 
 	// Initialize cluster
 	if err := cm.Initialize(); err != nil {
 		return fmt.Errorf("failed to initialize cluster: %v", err)
 	}
 
+	if err := cm.registerWithManager(joinAddr, joinToken, NodeRole(role)); err != nil {
+		cm.Shutdown()
+		return fmt.Errorf("failed to register with manager at %s: %v", joinAddr, err)
+	}
+
 	logrus.Infof("Successfully joined cluster at %s", joinAddr)
 	return nil
 }
 
+// registerWithManager announces this node in the role of its join token
+// to the manager it joined, which then schedules tasks onto it and probes
+// its health. The manager verifies the token and hands back the cluster
+// token, which this node uses from then on.
+func (cm *ClusterManager) registerWithManager(joinAddr, joinToken string, role NodeRole) error {
+	local, err := cm.NodeManager.GetNode(cm.Identity.ID)
+	if err != nil {
+		return err
+	}
+
+	node := *local
+	node.Role = role
+	node.Capabilities = map[string]bool{"worker": true}
+	body, err := json.Marshal(&node)
+	if err != nil {
+		return fmt.Errorf("failed to marshal node: %v", err)
+	}
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("http://%s/nodes", joinAddr), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Cluster-Token", joinToken)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var registration NodeRegistration
+	response := APIResponse{Data: &registration}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return fmt.Errorf("failed to decode response: %v", err)
+	}
+	if !response.Success {
+		return fmt.Errorf("manager returned status %d: %s", resp.StatusCode, response.Error)
+	}
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.leaderID = registration.LeaderID
+	if registration.ClusterToken != "" {
+		cm.Config.JoinToken = registration.ClusterToken
+		cm.State.putTokens()
+	}
+	return nil
+}
+
 func (cm *ClusterManager) LeaveCluster(force bool) error {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
@@ -283,7 +460,7 @@ func (cm *ClusterManager) GetStatus() *ClusterStatus {
 	for _, task := range tasks {
 		if task.Status == TaskRunning {
 			activeTasks++
-		} else if task.Status == TaskCompleted {
+		} else if task.Status == TaskComplete {
 			completedTasks++
 		}
 	}
@@ -297,8 +474,8 @@ func (cm *ClusterManager) GetStatus() *ClusterStatus {
 		Workers:       len(workers),
 		ActiveTasks:   activeTasks,
 		CompletedTasks: completedTasks,
-		CreatedAt:     "now", // Would be stored during initialization
-		UpdatedAt:     time.Now().Format(time.RFC3339),
+		CreatedAt:     cm.startedAt,
+		UpdatedAt:     cm.Clock.Now(),
 	}
 }
 
@@ -372,7 +549,7 @@ func (cm *ClusterManager) addWorkerNode() error {
 	// For demonstration, we'll simulate adding a worker
 	node := &Node{
 		ID:      generateNodeID(),
-		Name:    fmt.Sprintf("worker-%d", time.Now().Unix()),
+		Name:    fmt.Sprintf("worker-%d", cm.Clock.Now().Unix()),
 		Address: "127.0.0.1", // Would be actual IP
 		Port:    2376,
 		Role:    RoleWorker,
@@ -392,11 +569,17 @@ func (cm *ClusterManager) removeWorkerNode(nodeID string) error {
 }
 
 func (cm *ClusterManager) registerLocalNode() error {
+	identity, err := LoadNodeIdentity(cm.Config.DataDir, cm.Clock)
+	if err != nil {
+		return err
+	}
+	cm.Identity = identity
+
 	// Get local system resources
 	resources := cm.getLocalResources()
 
 	node := &Node{
-		ID:      getLocalNodeID(),
+		ID:      identity.ID,
 		Name:    getLocalHostname(),
 		Address: cm.Config.AdvertiseAddr,
 		Port:    cm.Config.AdvertisePort,
@@ -410,7 +593,15 @@ func (cm *ClusterManager) registerLocalNode() error {
 		Version: cm.Version,
 	}
 
-	return cm.NodeManager.RegisterNode(node)
+	_, err = cm.NodeManager.GetNode(node.ID)
+	rejoined := err == nil
+	if err := cm.NodeManager.RegisterNode(node); err != nil {
+		return err
+	}
+	if rejoined {
+		cm.reconcileNodeTasks(node.ID)
+	}
+	return nil
 }
 
 func (cm *ClusterManager) getLocalResources() Resources {
@@ -427,41 +618,156 @@ func (cm *ClusterManager) getLocalResources() Resources {
 	}
 }
 
-func (cm *ClusterManager) GetJoinToken() (string, error) {
-	cm.mu.RLock()
-	defer cm.mu.RUnlock()
+// GetJoinToken returns the token for nodes to join the cluster in role,
+// issuing a new one if there is none yet or it expired. Issuing the first
+// one closes the cluster to requests without the cluster token.
+func (cm *ClusterManager) GetJoinToken(role NodeRole) (string, error) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
 
 	if !cm.started {
 		return "", fmt.Errorf("cluster manager is not initialized")
 	}
+	secret, ok := cm.joinSecrets[role]
+	if !ok {
+		return "", fmt.Errorf("invalid node role: %s", role)
+	}
 
-	if cm.Config.JoinToken == "" {
-		cm.Config.JoinToken = generateJoinToken()
+	if token := cm.joinTokens[role]; token != "" {
+		if _, err := ids.VerifyJoinToken(secret, cm.ID, token, cm.Clock.Now()); err == nil {
+			return token, nil
+		}
 	}
+	cm.joinTokens[role] = cm.issueJoinToken(role)
+	cm.State.putTokens()
 
-	return cm.Config.JoinToken, nil
+	return cm.joinTokens[role], nil
 }
 
-func (cm *ClusterManager) RotateJoinToken() (string, error) {
+// RotateJoinToken replaces the join token of role, revoking every token
+// issued for it before. Nodes that already joined are unaffected.
+func (cm *ClusterManager) RotateJoinToken(role NodeRole) (string, error) {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
 
 	if !cm.started {
 		return "", fmt.Errorf("cluster manager is not initialized")
 	}
+	if _, ok := cm.joinSecrets[role]; !ok {
+		return "", fmt.Errorf("invalid node role: %s", role)
+	}
+
+	cm.joinSecrets[role] = ids.GenerateSecret()
+	cm.joinTokens[role] = cm.issueJoinToken(role)
+	cm.State.putTokens()
+	logrus.Infof("Join token for %s nodes rotated", role)
+
+	return cm.joinTokens[role], nil
+}
+
+// issueJoinToken signs a join token for role that lasts the configured
+// TTL, creating the cluster token too if there is none. Callers hold
+// cm.mu.
+func (cm *ClusterManager) issueJoinToken(role NodeRole) string {
+	if cm.Config.JoinToken == "" {
+		cm.Config.JoinToken = ids.NewClusterToken()
+	}
+	var expiresAt time.Time
+	if ttl := cm.Config.JoinTokenTTL; ttl > 0 {
+		expiresAt = cm.Clock.Now().Add(ttl)
+	}
+	return ids.NewJoinToken(cm.joinSecrets[role], cm.ID, string(role), expiresAt)
+}
+
+func (cm *ClusterManager) clusterToken() string {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	return cm.Config.JoinToken
+}
+
+// nodeToken is the token node presents to the cluster. Managers hold the
+// cluster token; workers hold a token of their own, which is only good
+// for the requests of their agent. Callers hold cm.mu.
+func (cm *ClusterManager) nodeToken(node *Node) string {
+	if node.Role == RoleManager || cm.Config.JoinToken == "" {
+		return cm.Config.JoinToken
+	}
+	return ids.NewNodeToken([]byte(cm.Config.JoinToken), node.ID)
+}
+
+// VerifyNodeToken checks the token of a worker and returns the node it
+// was issued to. Removing the node revokes its token.
+func (cm *ClusterManager) VerifyNodeToken(token string) (string, error) {
+	cm.mu.RLock()
+	secret := cm.Config.JoinToken
+	cm.mu.RUnlock()
+	if secret == "" {
+		return "", fmt.Errorf("no cluster token issued yet")
+	}
 
-	cm.Config.JoinToken = generateJoinToken()
-	logrus.Info("Join token rotated")
+	nodeID, err := ids.VerifyNodeToken([]byte(secret), token)
+	if err != nil {
+		return "", err
+	}
+	nm := cm.NodeManager
+	nm.mu.RLock()
+	defer nm.mu.RUnlock()
+	node, exists := nm.nodes[nodeID]
+	if !exists {
+		return "", fmt.Errorf("node not found: %s", nodeID)
+	}
+	if node.Role != RoleWorker {
+		return "", fmt.Errorf("node %s is not a worker", nodeID)
+	}
+	return nodeID, nil
+}
+
+// ValidateClusterToken accepts the cluster token. With no token issued
+// yet the cluster is open.
+func (cm *ClusterManager) ValidateClusterToken(token string) error {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	if cm.Config.JoinToken == "" {
+		return nil
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(cm.Config.JoinToken)) == 1 {
+		return nil
+	}
+	return fmt.Errorf("invalid cluster token")
+}
+
+// VerifyJoinToken checks a join token against the current secret of the
+// role it claims and returns that role. Tokens of another cluster,
+// expired or revoked by rotation are refused.
+func (cm *ClusterManager) VerifyJoinToken(token string) (NodeRole, error) {
+	claimed, err := ids.JoinTokenRole(token)
+	if err != nil {
+		return "", err
+	}
 
-	return cm.Config.JoinToken, nil
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	secret, ok := cm.joinSecrets[NodeRole(claimed)]
+	if !ok {
+		return "", fmt.Errorf("invalid join token role: %s", claimed)
+	}
+	role, err := ids.VerifyJoinToken(secret, cm.ID, token, cm.Clock.Now())
+	if err != nil {
+		return "", err
+	}
+	return NodeRole(role), nil
 }
 
+// HandleNodeFailure marks a node down and reschedules the tasks it was
+// running on the rest of the cluster. The heartbeat monitor calls it for
+// nodes that stopped sending heartbeats.
 func (cm *ClusterManager) HandleNodeFailure(nodeID string) error {
 	logrus.Warnf("Handling node failure: %s", nodeID)
 
 	// Get failed node
-	node, err := cm.NodeManager.GetNode(nodeID)
-	if err != nil {
+	if _, err := cm.NodeManager.GetNode(nodeID); err != nil {
 		return fmt.Errorf("failed to get node %s: %v", nodeID, err)
 	}
 
@@ -477,7 +783,8 @@ func (cm *ClusterManager) HandleNodeFailure(nodeID string) error {
 	}
 
 	for _, task := range tasks {
-		if task.Status == TaskRunning {
+		// Tasks rescheduled before are no longer meant to run
+		if taskHoldsResources(task.Status) && task.DesiredState == TaskRunning {
 			logrus.Infof("Rescheduling task %s from failed node %s", task.ID, nodeID)
 			if err := cm.TaskManager.RestartTask(task.ID); err != nil {
 				logrus.Errorf("Failed to restart task %s: %v", task.ID, err)
@@ -490,19 +797,11 @@ func (cm *ClusterManager) HandleNodeFailure(nodeID string) error {
 }
 
 func generateClusterID() string {
-	return fmt.Sprintf("cluster-%x", time.Now().UnixNano())[:12]
+	return ids.NewID("cluster")
 }
 
 func generateNodeID() string {
-	return fmt.Sprintf("node-%x", time.Now().UnixNano())[:12]
-}
-
-func generateJoinToken() string {
-	return fmt.Sprintf("SWMTKN-1-%x", time.Now().UnixNano())
-}
-
-func getLocalNodeID() string {
-	return generateNodeID()
+	return ids.NewID("node")
 }
 
 func getLocalHostname() string {
@@ -0,0 +1,200 @@
+package cluster
+
+import (
+	"sync"
+	"time"
+)
+
+// ClusterMetrics keeps the counts dashboards poll for. The node and task
+// managers report every change as it happens, so a snapshot costs no scan
+// of the cluster.
+type ClusterMetrics struct {
+	manager *ClusterManager
+	nodes   map[NodeStatus]int
+	tasks   map[TaskStatus]int
+	// failedJoins counts nodes turned away when registering
+	failedJoins    int
+	lastFailedJoin time.Time
+	upgrade        *UpgradeProgress
+	updatedAt      time.Time
+	mu             sync.Mutex
+}
+
+// UpgradeProgress is how far the last rolling upgrade got.
+type UpgradeProgress struct {
+	Version string `json:"version"`
+	// State is running, completed or failed
+	State     string    `json:"state"`
+	Total     int       `json:"total"`
+	Upgraded  int       `json:"upgraded"`
+	Skipped   int       `json:"skipped"`
+	FailedOn  string    `json:"failed_on,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// MetricsSnapshot is the document served at /cluster/metrics.
+type MetricsSnapshot struct {
+	Nodes     NodeMetrics      `json:"nodes"`
+	Tasks     TaskMetrics      `json:"tasks"`
+	Scheduler SchedulerMetrics `json:"scheduler"`
+	Joins     JoinMetrics      `json:"joins"`
+	Upgrade   *UpgradeProgress `json:"rolling_update,omitempty"`
+	UpdatedAt time.Time        `json:"updated_at"`
+}
+
+type NodeMetrics struct {
+	Total    int                `json:"total"`
+	ByStatus map[NodeStatus]int `json:"by_status"`
+}
+
+type TaskMetrics struct {
+	Total   int                `json:"total"`
+	ByState map[TaskStatus]int `json:"by_state"`
+}
+
+type SchedulerMetrics struct {
+	// QueueDepth is the number of tasks waiting for a node
+	QueueDepth    int `json:"queue_depth"`
+	QueueCapacity int `json:"queue_capacity"`
+}
+
+type JoinMetrics struct {
+	Failed     int        `json:"failed"`
+	LastFailed *time.Time `json:"last_failed,omitempty"`
+}
+
+func NewClusterMetrics(manager *ClusterManager) *ClusterMetrics {
+	return &ClusterMetrics{
+		manager: manager,
+		nodes:   make(map[NodeStatus]int),
+		tasks:   make(map[TaskStatus]int),
+	}
+}
+
+// NodeStatusChanged moves a node from one status to another. An empty
+// from is a node joining, an empty to one leaving.
+func (m *ClusterMetrics) NodeStatusChanged(from, to NodeStatus) {
+	if from == to {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if from != "" {
+		if m.nodes[from]--; m.nodes[from] <= 0 {
+			delete(m.nodes, from)
+		}
+	}
+	if to != "" {
+		m.nodes[to]++
+	}
+	m.updatedAt = m.manager.Clock.Now()
+}
+
+// TaskStatusChanged moves a task from one state to another. An empty from
+// is a new task, an empty to a removed one.
+func (m *ClusterMetrics) TaskStatusChanged(from, to TaskStatus) {
+	if from == to {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if from != "" {
+		if m.tasks[from]--; m.tasks[from] <= 0 {
+			delete(m.tasks, from)
+		}
+	}
+	if to != "" {
+		m.tasks[to]++
+	}
+	m.updatedAt = m.manager.Clock.Now()
+}
+
+// JoinFailed counts a node that was refused when registering.
+func (m *ClusterMetrics) JoinFailed() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failedJoins++
+	m.lastFailedJoin = m.manager.Clock.Now()
+	m.updatedAt = m.lastFailedJoin
+}
+
+func (m *ClusterMetrics) upgradeStarted(version string, total, skipped int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.manager.Clock.Now()
+	m.upgrade = &UpgradeProgress{
+		Version:   version,
+		State:     "running",
+		Total:     total,
+		Skipped:   skipped,
+		StartedAt: now,
+		UpdatedAt: now,
+	}
+	m.updatedAt = now
+}
+
+func (m *ClusterMetrics) nodeUpgraded() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.upgrade == nil {
+		return
+	}
+	m.upgrade.Upgraded++
+	m.upgrade.UpdatedAt = m.manager.Clock.Now()
+	m.updatedAt = m.upgrade.UpdatedAt
+}
+
+// upgradeFinished ends the upgrade in progress, as failed on failedOn if
+// that is set.
+func (m *ClusterMetrics) upgradeFinished(failedOn string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.upgrade == nil {
+		return
+	}
+	m.upgrade.State = "completed"
+	if failedOn != "" {
+		m.upgrade.State = "failed"
+		m.upgrade.FailedOn = failedOn
+	}
+	m.upgrade.UpdatedAt = m.manager.Clock.Now()
+	m.updatedAt = m.upgrade.UpdatedAt
+}
+
+// Snapshot returns the current metrics.
+func (m *ClusterMetrics) Snapshot() *MetricsSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	snapshot := &MetricsSnapshot{
+		Nodes:     NodeMetrics{ByStatus: make(map[NodeStatus]int)},
+		Tasks:     TaskMetrics{ByState: make(map[TaskStatus]int)},
+		Joins:     JoinMetrics{Failed: m.failedJoins},
+		UpdatedAt: m.updatedAt,
+	}
+	for status, count := range m.nodes {
+		snapshot.Nodes.ByStatus[status] = count
+		snapshot.Nodes.Total += count
+	}
+	for status, count := range m.tasks {
+		snapshot.Tasks.ByState[status] = count
+		snapshot.Tasks.Total += count
+	}
+	if !m.lastFailedJoin.IsZero() {
+		lastFailed := m.lastFailedJoin
+		snapshot.Joins.LastFailed = &lastFailed
+	}
+	if m.upgrade != nil {
+		upgrade := *m.upgrade
+		snapshot.Upgrade = &upgrade
+	}
+
+	if tm := m.manager.TaskManager; tm != nil {
+		snapshot.Scheduler = SchedulerMetrics{
+			QueueDepth:    len(tm.queue),
+			QueueCapacity: cap(tm.queue),
+		}
+	}
+	return snapshot
+}
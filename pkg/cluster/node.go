@@ -1,15 +1,10 @@
 package cluster
 
 import (
-	"crypto/tls"
-	"encoding/json"
 	"fmt"
-	"net"
-	"net/http"
 	"sync"
 	"time"
 
-	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
 )
 
@@ -23,9 +18,9 @@ type Node struct {
 	Capabilities map[string]bool  `json:"capabilities"`
 	Labels       map[string]string `json:"labels"`
 	Resources    Resources         `json:"resources"`
-	LastSeen     string            `json:"last_seen"`
-	CreatedAt    string            `json:"created_at"`
-	UpdatedAt    string            `json:"updated_at"`
+	LastSeen     time.Time         `json:"last_seen"`
+	CreatedAt    time.Time         `json:"created_at"`
+	UpdatedAt    time.Time         `json:"updated_at"`
 	Version      string            `json:"version"`
 	Manager      *ClusterManager   `json:"-"`
 }
@@ -82,12 +77,16 @@ type NodeManager struct {
 	mu          sync.RWMutex
 	manager     *ClusterManager
 	healthCheck *HealthChecker
+	// events holds the latest events of each node by node ID
+	events      map[string][]NodeEvent
+	eventsMu    sync.Mutex
 }
 
 func NewNodeManager(manager *ClusterManager) *NodeManager {
 	nm := &NodeManager{
 		nodes:   make(map[string]*Node),
 		manager: manager,
+		events:  make(map[string][]NodeEvent),
 	}
 
 	nm.healthCheck = NewHealthChecker(nm)
@@ -103,15 +102,23 @@ func (nm *NodeManager) RegisterNode(node *Node) error {
 	logrus.Infof("Registering node: %s (%s)", node.ID, node.Address)
 
 	// Check if node already exists
-	if existingNode, exists := nm.nodes[node.ID]; exists {
+	existingNode, exists := nm.nodes[node.ID]
+	var previousStatus NodeStatus
+	if exists {
+		previousStatus = existingNode.Status
 		// Update existing node
 		node.CreatedAt = existingNode.CreatedAt
-		node.UpdatedAt = time.Now().Format(time.RFC3339)
+		node.UpdatedAt = nm.manager.Clock.Now()
+		// Labels set on the manager outlive the node joining again
+		if len(node.Labels) == 0 {
+			node.Labels = existingNode.Labels
+		}
 	} else {
 		// New node
-		node.CreatedAt = time.Now().Format(time.RFC3339)
-		node.UpdatedAt = time.Now().Format(time.RFC3339)
+		node.CreatedAt = nm.manager.Clock.Now()
+		node.UpdatedAt = nm.manager.Clock.Now()
 	}
+	node.LastSeen = nm.manager.Clock.Now()
 
 	// Set node manager reference
 	node.Manager = nm.manager
@@ -123,8 +130,13 @@ func (nm *NodeManager) RegisterNode(node *Node) error {
 
 	// Add to nodes map
 	nm.nodes[node.ID] = node
+	nm.manager.Metrics.NodeStatusChanged(previousStatus, node.Status)
+	nm.manager.State.putNode(node)
 
 	logrus.Infof("Node registered successfully: %s", node.ID)
+	if !exists && nm.manager != nil && nm.manager.Rebalancer != nil {
+		nm.manager.Rebalancer.NodeJoined(node.ID)
+	}
 	return nil
 }
 
@@ -149,6 +161,8 @@ func (nm *NodeManager) UnregisterNode(nodeID string) error {
 
 	// Remove from nodes map
 	delete(nm.nodes, nodeID)
+	nm.manager.Metrics.NodeStatusChanged(node.Status, "")
+	nm.manager.State.deleteNode(nodeID)
 
 	logrus.Infof("Node unregistered successfully: %s", nodeID)
 	return nil
@@ -187,14 +201,37 @@ func (nm *NodeManager) UpdateNodeStatus(nodeID string, status NodeStatus) error
 		return fmt.Errorf("node not found: %s", nodeID)
 	}
 
+	nm.manager.Metrics.NodeStatusChanged(node.Status, status)
 	node.Status = status
-	node.UpdatedAt = time.Now().Format(time.RFC3339)
-	node.LastSeen = time.Now().Format(time.RFC3339)
+	node.UpdatedAt = nm.manager.Clock.Now()
+	nm.manager.State.putNode(node)
 
 	logrus.Infof("Updated node %s status to %s", nodeID, status)
 	return nil
 }
 
+// Heartbeat records that a node was heard from. A node that was down is
+// ready again.
+func (nm *NodeManager) Heartbeat(nodeID string) error {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	node, exists := nm.nodes[nodeID]
+	if !exists {
+		return fmt.Errorf("node not found: %s", nodeID)
+	}
+
+	node.LastSeen = nm.manager.Clock.Now()
+	if node.Status == StatusDown {
+		nm.manager.Metrics.NodeStatusChanged(node.Status, StatusReady)
+		node.Status = StatusReady
+		node.UpdatedAt = node.LastSeen
+		nm.manager.State.putNode(node)
+		logrus.Infof("Node %s is sending heartbeats again", nodeID)
+	}
+	return nil
+}
+
 func (nm *NodeManager) GetManagerNodes() []*Node {
 	nm.mu.RLock()
 	defer nm.mu.RUnlock()
@@ -252,47 +289,55 @@ func (nm *NodeManager) GetNodesByRole(role NodeRole) []*Node {
 }
 
 func (nm *NodeManager) SelectNodeForTask(task *Task) (*Node, error) {
-	nm.mu.RLock()
-	defer nm.mu.RUnlock()
+	usage := nm.manager.TaskManager.nodeUsage(task.ID)
 
-	// Filter ready nodes
+	nm.mu.RLock()
+	// Filter ready nodes, copied so plugins see them as they are now
 	var candidateNodes []*Node
+	byID := make(map[string]*Node)
 	for _, node := range nm.nodes {
+		// Draining, paused and down nodes take no new tasks
 		if node.Status == StatusReady || node.Status == StatusActive {
-			if nm.nodeHasCapacity(node, task) {
-				candidateNodes = append(candidateNodes, node)
+			if nm.nodeHasCapacity(node, task, usage[node.ID]) {
+				candidate := *node
+				candidateNodes = append(candidateNodes, &candidate)
+				byID[node.ID] = node
 			}
 		}
 	}
+	nm.mu.RUnlock()
 
 	if len(candidateNodes) == 0 {
 		return nil, fmt.Errorf("no available nodes with sufficient capacity")
 	}
 
-	// Simple scheduling: select node with most available resources
-	selectedNode := nm.selectNodeByResources(candidateNodes, task)
+	// Select the node ranked best by the strategy and plugins
+	selectedNode, err := nm.pickNode(task, candidateNodes, usage)
+	if err != nil {
+		return nil, err
+	}
 
 	logrus.Infof("Selected node %s for task %s", selectedNode.ID, task.ID)
-	return selectedNode, nil
+	return byID[selectedNode.ID], nil
 }
 
-func (nm *NodeManager) nodeHasCapacity(node *Node, task *Task) bool {
-	// Check if node has sufficient resources for the task
-	return node.Resources.CPU >= task.Resources.CPU &&
-		node.Resources.Memory >= task.Resources.Memory &&
-		node.Resources.Disk >= task.Resources.Disk
+func (nm *NodeManager) nodeHasCapacity(node *Node, task *Task, usage NodeUsage) bool {
+	// Check if node has sufficient resources left for the task, after
+	// what its tasks reserve
+	available := subtractResources(node.Resources, usage.Reserved)
+	return available.CPU >= task.Resources.CPU &&
+		available.Memory >= task.Resources.Memory &&
+		available.Disk >= task.Resources.Disk
 }
 
-func (nm *NodeManager) selectNodeByResources(nodes []*Node, task *Task) *Node {
-	// Simple selection based on available CPU and memory
+// selectNodeByScore adds the scores of the scheduler plugins, by node
+// ID, to that of the scheduling strategy.
+func (nm *NodeManager) selectNodeByScore(nodes []*Node, task *Task, strategy SchedulingStrategy, usage map[string]NodeUsage, pluginScores map[string]float64) *Node {
 	var bestNode *Node
 	bestScore := -1.0
 
 	for _, node := range nodes {
-		// Calculate score based on available resources
-		cpuScore := float64(node.Resources.CPU-task.Resources.CPU) / float64(node.Resources.CPU)
-		memoryScore := float64(node.Resources.Memory-task.Resources.Memory) / float64(node.Resources.Memory)
-		totalScore := (cpuScore + memoryScore) / 2.0
+		totalScore := strategy.Score(task, node, usage[node.ID]) + pluginScores[node.ID]
 
 		if totalScore > bestScore {
 			bestScore = totalScore
@@ -307,6 +352,12 @@ func (nm *NodeManager) GetNodeHealth(nodeID string) (*NodeHealth, error) {
 	return nm.healthCheck.GetNodeHealth(nodeID)
 }
 
+// CheckNodeHealth probes the node now instead of waiting for the next
+// scheduled health check.
+func (nm *NodeManager) CheckNodeHealth(nodeID string) error {
+	return nm.healthCheck.ForceCheck(nodeID)
+}
+
 func (nm *NodeManager) GetAllNodesHealth() map[string]*NodeHealth {
 	return nm.healthCheck.GetAllNodesHealth()
 }
@@ -385,24 +436,38 @@ func (nm *NodeManager) GetClusterStats() map[string]interface{} {
 	return stats
 }
 
+// DrainNode stops placing tasks on a node and moves the tasks it runs
+// elsewhere; DrainStatus reports how far that got. Managers keep their
+// role while drained of tasks.
 func (nm *NodeManager) DrainNode(nodeID string) error {
-	nm.mu.Lock()
-	defer nm.mu.Unlock()
+	// Draining takes the node's replicas down, which budgets must allow
+	if nm.manager != nil && nm.manager.Budgets != nil {
+		if err := nm.manager.Budgets.CheckNode(nodeID); err != nil {
+			return fmt.Errorf("cannot drain node %s: %v", nodeID, err)
+		}
+	}
 
+	// Tasks being placed on the node get there before it drains, so
+	// they are evicted with the rest
+	nm.manager.TaskManager.placing.Lock()
+	nm.mu.Lock()
 	node, exists := nm.nodes[nodeID]
 	if !exists {
+		nm.mu.Unlock()
+		nm.manager.TaskManager.placing.Unlock()
 		return fmt.Errorf("node not found: %s", nodeID)
 	}
 
-	if node.Role == RoleManager {
-		return fmt.Errorf("cannot drain manager node")
-	}
-
 	// Set node to draining status
+	nm.manager.Metrics.NodeStatusChanged(node.Status, StatusDraining)
 	node.Status = StatusDraining
-	node.UpdatedAt = time.Now().Format(time.RFC3339)
+	node.UpdatedAt = nm.manager.Clock.Now()
+	nm.manager.State.putNode(node)
+	nm.mu.Unlock()
+	nm.manager.TaskManager.placing.Unlock()
 
 	logrus.Infof("Node %s set to draining mode", nodeID)
+	nm.manager.evictTasks(nodeID)
 	return nil
 }
 
@@ -416,9 +481,11 @@ func (nm *NodeManager) ActivateNode(nodeID string) error {
 	}
 
 	// Set node to active status
+	nm.manager.Metrics.NodeStatusChanged(node.Status, StatusActive)
 	node.Status = StatusActive
-	node.UpdatedAt = time.Now().Format(time.RFC3339)
-	node.LastSeen = time.Now().Format(time.RFC3339)
+	node.UpdatedAt = nm.manager.Clock.Now()
+	node.LastSeen = nm.manager.Clock.Now()
+	nm.manager.State.putNode(node)
 
 	logrus.Infof("Node %s activated", nodeID)
 	return nil
@@ -434,12 +501,35 @@ func (nm *NodeManager) UpdateNodeResources(nodeID string, resources Resources) e
 	}
 
 	node.Resources = resources
-	node.UpdatedAt = time.Now().Format(time.RFC3339)
+	node.UpdatedAt = nm.manager.Clock.Now()
+	nm.manager.State.putNode(node)
 
 	logrus.Infof("Updated resources for node %s", nodeID)
 	return nil
 }
 
+// SetNodeLabels replaces the labels of a node, which placement
+// constraints and preferences match on.
+func (nm *NodeManager) SetNodeLabels(nodeID string, labels map[string]string) error {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	node, exists := nm.nodes[nodeID]
+	if !exists {
+		return fmt.Errorf("node not found: %s", nodeID)
+	}
+
+	node.Labels = make(map[string]string, len(labels))
+	for key, value := range labels {
+		node.Labels[key] = value
+	}
+	node.UpdatedAt = nm.manager.Clock.Now()
+	nm.manager.State.putNode(node)
+
+	logrus.Infof("Updated labels for node %s", nodeID)
+	return nil
+}
+
 func (nm *NodeManager) Shutdown() {
 	if nm.healthCheck != nil {
 		nm.healthCheck.Stop()
@@ -0,0 +1,135 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"docker-impl/pkg/events"
+)
+
+// maxNodeEvents is how many events are kept per node
+const maxNodeEvents = 200
+
+// NodeEvent is something a node did on its own, e.g. garbage-collecting
+// images.
+type NodeEvent struct {
+	NodeID     string            `json:"node_id"`
+	Action     string            `json:"action"`
+	Message    string            `json:"message"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Time       time.Time         `json:"time"`
+}
+
+// RecordEvent adds an event to the log of a node and publishes it on the
+// event bus.
+func (nm *NodeManager) RecordEvent(nodeID, action, message string, attributes map[string]string) {
+	now := nm.manager.Clock.Now()
+	event := NodeEvent{
+		NodeID:     nodeID,
+		Action:     action,
+		Message:    message,
+		Attributes: attributes,
+		Time:       now,
+	}
+
+	nm.eventsMu.Lock()
+	nodeEvents := append(nm.events[nodeID], event)
+	if len(nodeEvents) > maxNodeEvents {
+		nodeEvents = nodeEvents[len(nodeEvents)-maxNodeEvents:]
+	}
+	nm.events[nodeID] = nodeEvents
+	nm.eventsMu.Unlock()
+
+	busAttributes := map[string]string{"message": message}
+	for key, value := range attributes {
+		busAttributes[key] = value
+	}
+	events.Publish(events.Event{
+		Type:       events.TypeNode,
+		Action:     action,
+		ID:         nodeID,
+		Attributes: busAttributes,
+		Time:       now,
+	})
+}
+
+// Events returns the events recorded by this process for a node, oldest
+// first.
+func (nm *NodeManager) Events(nodeID string) []NodeEvent {
+	nm.eventsMu.Lock()
+	defer nm.eventsMu.Unlock()
+	return append([]NodeEvent(nil), nm.events[nodeID]...)
+}
+
+// NodeEvents returns the events of a node. Nodes record their own events,
+// so those of other nodes are asked for over their API.
+func (cm *ClusterManager) NodeEvents(nodeID string) ([]NodeEvent, error) {
+	node, err := cm.NodeManager.GetNode(nodeID)
+	if err != nil {
+		return nil, err
+	}
+	if cm.isLocalNode(node) {
+		return cm.NodeManager.Events(node.ID), nil
+	}
+
+	var nodeEvents []NodeEvent
+	if err := callNode(node, http.MethodGet, "/node/events", nil, &nodeEvents); err != nil {
+		return nil, fmt.Errorf("failed to get events of node %s: %v", node.ID, err)
+	}
+	return nodeEvents, nil
+}
+
+// localNodeID returns the ID this node is registered under, if it is.
+func (cm *ClusterManager) localNodeID() string {
+	if cm.Identity != nil {
+		return cm.Identity.ID
+	}
+	nodes, _ := cm.NodeManager.ListNodes()
+	for _, node := range nodes {
+		if cm.isLocalNode(node) {
+			return node.ID
+		}
+	}
+	return ""
+}
+
+var nodeClient = &http.Client{Timeout: 5 * time.Minute}
+
+// callNode sends a request to the API of node and decodes the data of the
+// response into result, unless it is nil.
+func callNode(node *Node, method, path string, body interface{}, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, fmt.Sprintf("http://%s:%d%s", node.Address, node.Port, path), reader)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := nodeClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	response := APIResponse{Data: result}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return fmt.Errorf("failed to decode response: %v", err)
+	}
+	if !response.Success {
+		return fmt.Errorf("node returned status %d: %s", resp.StatusCode, response.Error)
+	}
+	return nil
+}
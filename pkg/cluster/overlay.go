@@ -0,0 +1,430 @@
+package cluster
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"docker-impl/pkg/ids"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// overlayPool is carved into the subnets of overlay networks created
+	// without one
+	overlayPool       = "10.0.0.0/8"
+	overlaySubnetBits = 24
+	// firstOverlayVNI is the first VXLAN ID handed out, as nodes do for
+	// networks of their own
+	firstOverlayVNI = 4096
+	maxOverlayVNI   = 1<<24 - 1
+
+	// discoveryOverlayEndpoints is the discovery message announcing the
+	// endpoints of an overlay network
+	discoveryOverlayEndpoints = "overlay-endpoints"
+)
+
+// OverlayNetwork is a network spanning the cluster's nodes. Every node a
+// task on it runs on creates it with the same subnet and VXLAN ID, and
+// tunnels to the endpoints on the other nodes.
+type OverlayNetwork struct {
+	ID        string            `json:"id"`
+	Name      string            `json:"name"`
+	Subnet    string            `json:"subnet"`
+	Gateway   string            `json:"gateway"`
+	VNI       int               `json:"vni"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	// Endpoints holds the endpoints of the tasks on the network by task ID
+	Endpoints map[string]OverlayEndpoint `json:"endpoints"`
+}
+
+// OverlayEndpoint is a task's attachment to an overlay network.
+type OverlayEndpoint struct {
+	TaskID   string `json:"task_id"`
+	TaskName string `json:"task_name"`
+	NodeID   string `json:"node_id"`
+	// IPAddress is the task's address with the subnet's prefix
+	IPAddress string `json:"ip_address"`
+	// VTEP is the address of the task's node, where its traffic is
+	// tunneled to
+	VTEP string `json:"vtep"`
+}
+
+type OverlayNetworkOptions struct {
+	Name    string            `json:"name"`
+	Subnet  string            `json:"subnet,omitempty"`
+	Gateway string            `json:"gateway,omitempty"`
+	VNI     int               `json:"vni,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// LocalOverlayDriver sets overlay networks up on the node this process
+// runs on. Like tasks, the cluster package leaves that to whoever
+// registers one with SetLocalOverlayDriver.
+type LocalOverlayDriver interface {
+	// EnsureNetwork creates the network on the node unless it exists
+	EnsureNetwork(network *OverlayNetwork) error
+	// SyncPeers sets the endpoints of the network on other nodes
+	SyncPeers(network *OverlayNetwork, peers []OverlayEndpoint) error
+}
+
+// OverlayNetworks allocates the overlay networks of the cluster and the
+// addresses of the tasks on them, and propagates where each endpoint is
+// to the nodes.
+type OverlayNetworks struct {
+	manager  *ClusterManager
+	networks map[string]*OverlayNetwork
+	driver   LocalOverlayDriver
+	mu       sync.RWMutex
+}
+
+func NewOverlayNetworks(manager *ClusterManager) *OverlayNetworks {
+	return &OverlayNetworks{
+		manager:  manager,
+		networks: make(map[string]*OverlayNetwork),
+	}
+}
+
+// SetLocalOverlayDriver registers how this node sets overlay networks up.
+func (cm *ClusterManager) SetLocalOverlayDriver(driver LocalOverlayDriver) {
+	cm.Overlays.mu.Lock()
+	defer cm.Overlays.mu.Unlock()
+	cm.Overlays.driver = driver
+}
+
+// Create allocates an overlay network. The subnet is the next free /24 of
+// 10.0.0.0/8 and the VXLAN ID the next free one unless given.
+func (o *OverlayNetworks) Create(opts OverlayNetworkOptions) (*OverlayNetwork, error) {
+	if opts.Name == "" {
+		return nil, fmt.Errorf("network name is required")
+	}
+	if opts.VNI < 0 || opts.VNI > maxOverlayVNI {
+		return nil, fmt.Errorf("invalid VNI %d", opts.VNI)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if _, err := o.find(opts.Name); err == nil {
+		return nil, fmt.Errorf("network %s already exists", opts.Name)
+	}
+
+	subnet, err := o.allocateSubnet(opts.Subnet)
+	if err != nil {
+		return nil, err
+	}
+	gateway := firstHost(subnet)
+	if opts.Gateway != "" {
+		gateway = net.ParseIP(opts.Gateway).To4()
+		if gateway == nil || !subnet.Contains(gateway) {
+			return nil, fmt.Errorf("gateway %s is not in subnet %s", opts.Gateway, subnet)
+		}
+	}
+
+	vni := opts.VNI
+	if vni == 0 {
+		vni = firstOverlayVNI
+		for o.vniUsed(vni) {
+			vni++
+		}
+	} else if o.vniUsed(vni) {
+		return nil, fmt.Errorf("VNI %d is already in use", vni)
+	}
+
+	network := &OverlayNetwork{
+		ID:        ids.NewID("net"),
+		Name:      opts.Name,
+		Subnet:    subnet.String(),
+		Gateway:   gateway.String(),
+		VNI:       vni,
+		Labels:    opts.Labels,
+		CreatedAt: o.manager.Clock.Now(),
+		Endpoints: make(map[string]OverlayEndpoint),
+	}
+	o.networks[network.ID] = network
+
+	logrus.Infof("Created overlay network %s (%s, VNI %d)", network.Name, network.Subnet, network.VNI)
+	return network.copy(), nil
+}
+
+func (o *OverlayNetworks) vniUsed(vni int) bool {
+	for _, network := range o.networks {
+		if network.VNI == vni {
+			return true
+		}
+	}
+	return false
+}
+
+// allocateSubnet checks the requested subnet against those of the other
+// networks, or picks a free one.
+func (o *OverlayNetworks) allocateSubnet(requested string) (*net.IPNet, error) {
+	var taken []*net.IPNet
+	for _, network := range o.networks {
+		if _, subnet, err := net.ParseCIDR(network.Subnet); err == nil {
+			taken = append(taken, subnet)
+		}
+	}
+	overlapsTaken := func(subnet *net.IPNet) bool {
+		for _, other := range taken {
+			if subnet.Contains(other.IP) || other.Contains(subnet.IP) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if requested != "" {
+		_, subnet, err := net.ParseCIDR(requested)
+		if err != nil || subnet.IP.To4() == nil {
+			return nil, fmt.Errorf("invalid subnet %s", requested)
+		}
+		if ones, _ := subnet.Mask.Size(); ones > 30 {
+			return nil, fmt.Errorf("subnet %s is too small", requested)
+		}
+		if overlapsTaken(subnet) {
+			return nil, fmt.Errorf("subnet %s overlaps with another overlay network", requested)
+		}
+		return subnet, nil
+	}
+
+	_, pool, _ := net.ParseCIDR(overlayPool)
+	mask := net.CIDRMask(overlaySubnetBits, 32)
+	poolOnes, _ := pool.Mask.Size()
+	start := binary.BigEndian.Uint32(pool.IP.To4())
+	for i := uint32(0); i < 1<<(overlaySubnetBits-poolOnes); i++ {
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, start+i<<(32-overlaySubnetBits))
+		subnet := &net.IPNet{IP: ip, Mask: mask}
+		if !overlapsTaken(subnet) {
+			return subnet, nil
+		}
+	}
+	return nil, fmt.Errorf("no free subnet left in %s", overlayPool)
+}
+
+// firstHost returns the first address of subnet after its network address.
+func firstHost(subnet *net.IPNet) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(subnet.IP.To4())+1)
+	return ip
+}
+
+// find must be called with mu held.
+func (o *OverlayNetworks) find(ref string) (*OverlayNetwork, error) {
+	if network, ok := o.networks[ref]; ok {
+		return network, nil
+	}
+	for _, network := range o.networks {
+		if network.Name == ref {
+			return network, nil
+		}
+	}
+	return nil, fmt.Errorf("overlay network %s not found", ref)
+}
+
+// Get looks an overlay network up by ID or name.
+func (o *OverlayNetworks) Get(ref string) (*OverlayNetwork, error) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	network, err := o.find(ref)
+	if err != nil {
+		return nil, err
+	}
+	return network.copy(), nil
+}
+
+// List returns the overlay networks sorted by name.
+func (o *OverlayNetworks) List() []*OverlayNetwork {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	networks := make([]*OverlayNetwork, 0, len(o.networks))
+	for _, network := range o.networks {
+		networks = append(networks, network.copy())
+	}
+	sort.Slice(networks, func(i, j int) bool { return networks[i].Name < networks[j].Name })
+	return networks
+}
+
+// Remove deletes an overlay network no task is attached to.
+func (o *OverlayNetworks) Remove(ref string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	network, err := o.find(ref)
+	if err != nil {
+		return err
+	}
+	if len(network.Endpoints) > 0 {
+		var tasks []string
+		for _, endpoint := range network.Endpoints {
+			tasks = append(tasks, endpoint.TaskName)
+		}
+		sort.Strings(tasks)
+		return fmt.Errorf("network %s is in use by tasks: %s", network.Name, strings.Join(tasks, ", "))
+	}
+	delete(o.networks, network.ID)
+
+	logrus.Infof("Removed overlay network %s", network.Name)
+	return nil
+}
+
+func (n *OverlayNetwork) copy() *OverlayNetwork {
+	c := *n
+	c.Endpoints = make(map[string]OverlayEndpoint, len(n.Endpoints))
+	for id, endpoint := range n.Endpoints {
+		c.Endpoints[id] = endpoint
+	}
+	return &c
+}
+
+// attachTask gives a task scheduled on node an address on each of its
+// networks, keeping the one it had if it is rescheduled, and tells the
+// nodes where it is.
+func (o *OverlayNetworks) attachTask(task *Task, node *Node) error {
+	if len(task.Networks) == 0 {
+		return nil
+	}
+
+	o.mu.Lock()
+	var changed []*OverlayNetwork
+	for i, config := range task.Networks {
+		network, err := o.find(config.Target)
+		if err != nil {
+			o.mu.Unlock()
+			o.detachTask(task.ID)
+			return err
+		}
+
+		endpoint, ok := network.Endpoints[task.ID]
+		if !ok {
+			ip, err := network.allocateAddress(config.Address)
+			if err != nil {
+				o.mu.Unlock()
+				o.detachTask(task.ID)
+				return fmt.Errorf("failed to allocate an address on network %s: %v", network.Name, err)
+			}
+			_, subnet, _ := net.ParseCIDR(network.Subnet)
+			endpoint.IPAddress = (&net.IPNet{IP: ip, Mask: subnet.Mask}).String()
+		}
+		endpoint.TaskID = task.ID
+		endpoint.TaskName = task.Name
+		endpoint.NodeID = node.ID
+		endpoint.VTEP = node.Address
+		network.Endpoints[task.ID] = endpoint
+
+		ip, _, _ := net.ParseCIDR(endpoint.IPAddress)
+		task.Networks[i].Address = ip.String()
+		changed = append(changed, network.copy())
+	}
+	driver := o.driver
+	o.mu.Unlock()
+
+	if driver != nil && o.manager.isLocalNode(node) {
+		for _, network := range changed {
+			if err := driver.EnsureNetwork(network); err != nil {
+				o.detachTask(task.ID)
+				return fmt.Errorf("failed to create network %s on node %s: %v", network.Name, node.ID, err)
+			}
+		}
+	}
+	for _, network := range changed {
+		o.publish(network)
+	}
+	return nil
+}
+
+// allocateAddress returns requested, or the first free address of the
+// network, which must be called with mu held.
+func (n *OverlayNetwork) allocateAddress(requested string) (net.IP, error) {
+	_, subnet, err := net.ParseCIDR(n.Subnet)
+	if err != nil {
+		return nil, err
+	}
+	used := map[string]bool{n.Gateway: true}
+	for _, endpoint := range n.Endpoints {
+		ip, _, _ := net.ParseCIDR(endpoint.IPAddress)
+		used[ip.String()] = true
+	}
+
+	if requested != "" {
+		ip := net.ParseIP(requested).To4()
+		if ip == nil || !subnet.Contains(ip) {
+			return nil, fmt.Errorf("address %s is not in subnet %s", requested, subnet)
+		}
+		if used[ip.String()] {
+			return nil, fmt.Errorf("address %s is already in use", ip)
+		}
+		return ip, nil
+	}
+
+	ones, bits := subnet.Mask.Size()
+	base := binary.BigEndian.Uint32(subnet.IP.To4())
+	// Skip the network and broadcast addresses
+	for i := uint32(1); i < 1<<(bits-ones)-1; i++ {
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, base+i)
+		if !used[ip.String()] {
+			return ip, nil
+		}
+	}
+	return nil, fmt.Errorf("no free address left in %s", subnet)
+}
+
+// detachTask releases the addresses of a task, e.g. once it ended.
+func (o *OverlayNetworks) detachTask(taskID string) {
+	o.mu.Lock()
+	var changed []*OverlayNetwork
+	for _, network := range o.networks {
+		if _, ok := network.Endpoints[taskID]; ok {
+			delete(network.Endpoints, taskID)
+			changed = append(changed, network.copy())
+		}
+	}
+	o.mu.Unlock()
+
+	for _, network := range changed {
+		o.publish(network)
+	}
+}
+
+// publish announces the endpoints of a network to the cluster and gives
+// this node's driver those on other nodes.
+func (o *OverlayNetworks) publish(network *OverlayNetwork) {
+	if o.manager.Discovery != nil {
+		o.manager.Discovery.Publish(discoveryOverlayEndpoints, network)
+	}
+
+	o.mu.RLock()
+	driver := o.driver
+	o.mu.RUnlock()
+	if driver == nil {
+		return
+	}
+
+	local := o.manager.localNodeID()
+	var peers []OverlayEndpoint
+	hasLocal := false
+	for _, endpoint := range network.Endpoints {
+		if endpoint.NodeID == local {
+			hasLocal = true
+			continue
+		}
+		peers = append(peers, endpoint)
+	}
+	// Nodes without tasks on the network don't have it
+	if !hasLocal {
+		return
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].IPAddress < peers[j].IPAddress })
+	if err := driver.SyncPeers(network, peers); err != nil {
+		logrus.Warnf("Failed to update the endpoints of network %s: %v", network.Name, err)
+	}
+}
@@ -0,0 +1,211 @@
+package cluster
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Constraint operators
+const (
+	ConstraintEqual    = "=="
+	ConstraintNotEqual = "!="
+)
+
+// nodeLabelPrefix starts the constraint and preference keys that name a
+// node label
+const nodeLabelPrefix = "node.labels."
+
+// ParseConstraint parses a placement constraint such as node.role==worker
+// or node.labels.zone!=a. The keys are node.id, node.hostname, node.role
+// and node.labels.<label>.
+func ParseConstraint(expr string) (Constraint, error) {
+	for _, op := range []string{ConstraintEqual, ConstraintNotEqual} {
+		if key, value, found := strings.Cut(expr, op); found {
+			constraint := Constraint{
+				Operator: op,
+				Key:      strings.TrimSpace(key),
+				Value:    strings.TrimSpace(value),
+			}
+			return constraint, constraint.validate()
+		}
+	}
+	return Constraint{}, fmt.Errorf("invalid constraint %q: expected KEY==VALUE or KEY!=VALUE", expr)
+}
+
+func (c Constraint) validate() error {
+	if c.Operator != ConstraintEqual && c.Operator != ConstraintNotEqual {
+		return fmt.Errorf("invalid constraint operator %q", c.Operator)
+	}
+	switch c.Key {
+	case "node.id", "node.hostname", "node.role":
+	default:
+		if !strings.HasPrefix(c.Key, nodeLabelPrefix) || c.Key == nodeLabelPrefix {
+			return fmt.Errorf("invalid constraint key %q", c.Key)
+		}
+	}
+	if c.Value == "" {
+		return fmt.Errorf("constraint %s needs a value", c.Key)
+	}
+	return nil
+}
+
+func (c Constraint) String() string {
+	return c.Key + c.Operator + c.Value
+}
+
+// matches reports whether the node satisfies the constraint. A node
+// without the label never equals a value.
+func (c Constraint) matches(node *Node) bool {
+	var value string
+	var found bool
+	switch c.Key {
+	case "node.id":
+		value, found = node.ID, true
+	case "node.hostname":
+		value, found = node.Name, true
+	case "node.role":
+		// Roles match regardless of case, like node.role==Manager
+		return strings.EqualFold(string(node.Role), c.Value) == (c.Operator == ConstraintEqual)
+	default:
+		value, found = node.Labels[strings.TrimPrefix(c.Key, nodeLabelPrefix)]
+	}
+
+	if c.Operator == ConstraintEqual {
+		return found && value == c.Value
+	}
+	return !found || value != c.Value
+}
+
+// constraints returns all the constraints of a task: its own and those
+// of its placement, parsed.
+func (t *Task) constraints() ([]Constraint, error) {
+	constraints := append([]Constraint(nil), t.Constraints...)
+	for _, expr := range t.Placement.Constraints {
+		constraint, err := ParseConstraint(expr)
+		if err != nil {
+			return nil, err
+		}
+		constraints = append(constraints, constraint)
+	}
+	return constraints, nil
+}
+
+// validatePlacement checks the constraints and preferences of a task.
+func (t *Task) validatePlacement() error {
+	constraints, err := t.constraints()
+	if err != nil {
+		return err
+	}
+	for _, constraint := range constraints {
+		if err := constraint.validate(); err != nil {
+			return err
+		}
+	}
+	for _, preference := range t.Placement.Preferences {
+		if !strings.HasPrefix(preference.Spread, nodeLabelPrefix) || preference.Spread == nodeLabelPrefix {
+			return fmt.Errorf("invalid placement preference %q: only spread over node.labels.<label> is supported", preference.Spread)
+		}
+	}
+	if t.Placement.MaxReplicas < 0 {
+		return fmt.Errorf("max replicas per node must not be negative")
+	}
+	return nil
+}
+
+// filterPlacement narrows the candidate nodes for a task down to those
+// satisfying its constraints that run fewer than its max replicas of the
+// service. Each spread preference then keeps the nodes whose label value
+// has the fewest tasks of the service, in order of the preferences.
+func (nm *NodeManager) filterPlacement(task *Task, candidates []*Node) ([]*Node, error) {
+	constraints, err := task.constraints()
+	if err != nil {
+		return nil, err
+	}
+	if len(constraints) > 0 {
+		var matching []*Node
+		for _, node := range candidates {
+			if nodeMatches(node, constraints) {
+				matching = append(matching, node)
+			}
+		}
+		if len(matching) == 0 {
+			return nil, fmt.Errorf("no node among %d candidate(s) satisfies the constraints %v", len(candidates), constraints)
+		}
+		candidates = matching
+	}
+
+	placement := task.Placement
+	if task.ServiceID == "" || (placement.MaxReplicas == 0 && len(placement.Preferences) == 0) {
+		return candidates, nil
+	}
+	perNode := nm.manager.TaskManager.serviceTasksByNode(task.ServiceID, task.ID)
+
+	if placement.MaxReplicas > 0 {
+		var room []*Node
+		for _, node := range candidates {
+			if perNode[node.ID] < placement.MaxReplicas {
+				room = append(room, node)
+			}
+		}
+		if len(room) == 0 {
+			return nil, fmt.Errorf("all %d candidate node(s) already run %d replica(s) of the service", len(candidates), placement.MaxReplicas)
+		}
+		candidates = room
+	}
+
+	for _, preference := range placement.Preferences {
+		label := strings.TrimPrefix(preference.Spread, nodeLabelPrefix)
+		// Tasks are counted by the label value of their node; nodes
+		// without the label share the empty value
+		perValue := make(map[string]int)
+		nm.mu.RLock()
+		for nodeID, count := range perNode {
+			if node, ok := nm.nodes[nodeID]; ok {
+				perValue[node.Labels[label]] += count
+			}
+		}
+		nm.mu.RUnlock()
+
+		fewest := -1
+		for _, node := range candidates {
+			if count := perValue[node.Labels[label]]; fewest < 0 || count < fewest {
+				fewest = count
+			}
+		}
+		var spread []*Node
+		for _, node := range candidates {
+			if perValue[node.Labels[label]] == fewest {
+				spread = append(spread, node)
+			}
+		}
+		candidates = spread
+	}
+	return candidates, nil
+}
+
+func nodeMatches(node *Node, constraints []Constraint) bool {
+	for _, constraint := range constraints {
+		if !constraint.matches(node) {
+			return false
+		}
+	}
+	return true
+}
+
+// serviceTasksByNode counts the tasks of a service placed on each node
+// that are meant to run, leaving out the task being placed.
+func (tm *TaskManager) serviceTasksByNode(serviceID, excludeID string) map[string]int {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+
+	perNode := make(map[string]int)
+	for _, task := range tm.tasks {
+		if task.ServiceID != serviceID || task.ID == excludeID || task.NodeID == "" {
+			continue
+		}
+		if task.DesiredState == TaskRunning && !isTerminalTaskStatus(task.Status) {
+			perNode[task.NodeID]++
+		}
+	}
+	return perNode
+}
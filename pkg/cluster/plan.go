@@ -0,0 +1,203 @@
+package cluster
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PlanTask is a hypothetical task spec submitted to the scheduler dry run.
+type PlanTask struct {
+	Task
+	Replicas int `json:"replicas"`
+}
+
+type PlanRequest struct {
+	Tasks []PlanTask `json:"tasks"`
+}
+
+type PlanPlacement struct {
+	Task     string `json:"task"`
+	Replica  int    `json:"replica"`
+	NodeID   string `json:"node_id,omitempty"`
+	NodeName string `json:"node_name,omitempty"`
+	Fits     bool   `json:"fits"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+type PlanNodeUsage struct {
+	NodeID    string    `json:"node_id"`
+	NodeName  string    `json:"node_name"`
+	Capacity  Resources `json:"capacity"`
+	Allocated Resources `json:"allocated"`
+	Planned   Resources `json:"planned"`
+	Available Resources `json:"available"`
+}
+
+type PlanResult struct {
+	Feasible   bool            `json:"feasible"`
+	Placements []PlanPlacement `json:"placements"`
+	Nodes      []PlanNodeUsage `json:"nodes"`
+}
+
+// Plan places the given tasks against current capacity without creating
+// them. Resources held by active tasks are subtracted first, and each
+// planned replica reduces the capacity left for the ones after it.
+func (s *Scheduler) Plan(request PlanRequest) (*PlanResult, error) {
+	if len(request.Tasks) == 0 {
+		return nil, fmt.Errorf("at least one task is required")
+	}
+
+	nodes, err := s.manager.NodeManager.ListNodes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nodes: %v", err)
+	}
+
+	tasks, err := s.manager.TaskManager.ListTasks()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tasks: %v", err)
+	}
+
+	allocated := make(map[string]Resources)
+	for _, task := range tasks {
+		if task.NodeID == "" || !taskHoldsResources(task.Status) {
+			continue
+		}
+		allocated[task.NodeID] = addResources(allocated[task.NodeID], task.Resources)
+	}
+
+	usage := make(map[string]*PlanNodeUsage)
+	var candidates []*Node
+	for _, node := range nodes {
+		u := &PlanNodeUsage{
+			NodeID:    node.ID,
+			NodeName:  node.Name,
+			Capacity:  node.Resources,
+			Allocated: allocated[node.ID],
+		}
+		u.Available = subtractResources(node.Resources, u.Allocated)
+		usage[node.ID] = u
+
+		if node.Status == StatusReady || node.Status == StatusActive {
+			candidates = append(candidates, node)
+		}
+	}
+
+	// Strategies rank the nodes by what their tasks take, planned ones
+	// included
+	nodeUsage := s.manager.TaskManager.nodeUsage("")
+
+	result := &PlanResult{Feasible: true}
+	for _, spec := range request.Tasks {
+		replicas := spec.Replicas
+		if replicas <= 0 {
+			replicas = 1
+		}
+		name := spec.Name
+		if name == "" {
+			name = spec.Image
+		}
+
+		for replica := 1; replica <= replicas; replica++ {
+			placement := PlanPlacement{Task: name, Replica: replica}
+
+			node, reason := s.planNode(candidates, usage, nodeUsage, &spec.Task)
+			if node == nil {
+				placement.Reason = reason
+				result.Feasible = false
+			} else {
+				u := usage[node.ID]
+				u.Planned = addResources(u.Planned, spec.Resources)
+				u.Available = subtractResources(u.Available, spec.Resources)
+				n := nodeUsage[node.ID]
+				n.Tasks++
+				n.Reserved = addResources(n.Reserved, spec.Resources)
+				n.Used = addResources(n.Used, spec.Resources)
+				nodeUsage[node.ID] = n
+
+				placement.NodeID = node.ID
+				placement.NodeName = node.Name
+				placement.Fits = true
+			}
+			result.Placements = append(result.Placements, placement)
+		}
+	}
+
+	for _, node := range nodes {
+		result.Nodes = append(result.Nodes, *usage[node.ID])
+	}
+
+	return result, nil
+}
+
+// planNode picks a node using the regular scoring, scheduler plugins
+// included, but against the capacity still available in the plan rather
+// than the node's total.
+func (s *Scheduler) planNode(candidates []*Node, usage map[string]*PlanNodeUsage, nodeUsage map[string]NodeUsage, task *Task) (*Node, string) {
+	if len(candidates) == 0 {
+		return nil, "no ready nodes in the cluster"
+	}
+
+	var fitting []*Node
+	byID := make(map[string]*Node)
+	var reasons []string
+	for _, node := range candidates {
+		if missing := missingResources(usage[node.ID].Available, task.Resources); missing != "" {
+			reasons = append(reasons, fmt.Sprintf("%s: insufficient %s", node.Name, missing))
+			continue
+		}
+		candidate := *node
+		fitting = append(fitting, &candidate)
+		byID[node.ID] = node
+	}
+
+	if len(fitting) == 0 {
+		return nil, "no node has sufficient capacity (" + strings.Join(reasons, "; ") + ")"
+	}
+
+	selected, err := s.manager.NodeManager.pickNode(task, fitting, nodeUsage)
+	if err != nil {
+		return nil, err.Error()
+	}
+	return byID[selected.ID], ""
+}
+
+func taskHoldsResources(status TaskStatus) bool {
+	switch status {
+	case TaskAssigned, TaskAccepted, TaskPreparing, TaskReady, TaskStarting, TaskRunning:
+		return true
+	}
+	return false
+}
+
+func missingResources(available, required Resources) string {
+	var missing []string
+	if available.CPU < required.CPU {
+		missing = append(missing, "cpu")
+	}
+	if available.Memory < required.Memory {
+		missing = append(missing, "memory")
+	}
+	if available.Disk < required.Disk {
+		missing = append(missing, "disk")
+	}
+	if available.GPU < required.GPU {
+		missing = append(missing, "gpu")
+	}
+	return strings.Join(missing, ", ")
+}
+
+func addResources(a, b Resources) Resources {
+	a.CPU += b.CPU
+	a.Memory += b.Memory
+	a.Disk += b.Disk
+	a.GPU += b.GPU
+	return a
+}
+
+func subtractResources(a, b Resources) Resources {
+	a.CPU -= b.CPU
+	a.Memory -= b.Memory
+	a.Disk -= b.Disk
+	a.GPU -= b.GPU
+	return a
+}
@@ -0,0 +1,321 @@
+package cluster
+
+import (
+	"time"
+
+	"docker-impl/pkg/timeutil"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Nodes and tasks are encoded for application/x-protobuf list responses
+// with the schema in cluster.proto. Only the fields list views need are
+// carried; GET /nodes/{id} and /tasks/{id} return the full objects.
+
+type protoMessage interface {
+	marshalProto() []byte
+	unmarshalProto(b []byte) error
+}
+
+func (r *Resources) marshalProto() []byte {
+	var b []byte
+	b = appendProtoInt(b, 1, r.CPU)
+	b = appendProtoInt(b, 2, r.Memory)
+	b = appendProtoInt(b, 3, r.Disk)
+	b = appendProtoInt(b, 4, int64(r.GPU))
+	return b
+}
+
+func (r *Resources) unmarshalProto(b []byte) error {
+	return consumeProtoFields(b, func(f protoField) error {
+		switch f.num {
+		case 1:
+			r.CPU = int64(f.varint)
+		case 2:
+			r.Memory = int64(f.varint)
+		case 3:
+			r.Disk = int64(f.varint)
+		case 4:
+			r.GPU = int(int64(f.varint))
+		}
+		return nil
+	})
+}
+
+func (p *PortConfig) marshalProto() []byte {
+	var b []byte
+	b = appendProtoString(b, 1, p.Protocol)
+	b = appendProtoInt(b, 2, int64(p.TargetPort))
+	b = appendProtoInt(b, 3, int64(p.PublishedPort))
+	return b
+}
+
+func (p *PortConfig) unmarshalProto(b []byte) error {
+	return consumeProtoFields(b, func(f protoField) error {
+		switch f.num {
+		case 1:
+			p.Protocol = string(f.bytes)
+		case 2:
+			p.TargetPort = int(int64(f.varint))
+		case 3:
+			p.PublishedPort = int(int64(f.varint))
+		}
+		return nil
+	})
+}
+
+func (n *Node) marshalProto() []byte {
+	var b []byte
+	b = appendProtoString(b, 1, n.ID)
+	b = appendProtoString(b, 2, n.Name)
+	b = appendProtoString(b, 3, n.Address)
+	b = appendProtoInt(b, 4, int64(n.Port))
+	b = appendProtoString(b, 5, string(n.Role))
+	b = appendProtoString(b, 6, string(n.Status))
+	b = appendProtoMap(b, 7, n.Labels)
+	b = appendProtoMessage(b, 8, n.Resources.marshalProto())
+	b = appendProtoTime(b, 9, n.LastSeen)
+	b = appendProtoTime(b, 10, n.CreatedAt)
+	b = appendProtoTime(b, 11, n.UpdatedAt)
+	b = appendProtoString(b, 12, n.Version)
+	return b
+}
+
+func (n *Node) unmarshalProto(b []byte) error {
+	return consumeProtoFields(b, func(f protoField) error {
+		switch f.num {
+		case 1:
+			n.ID = string(f.bytes)
+		case 2:
+			n.Name = string(f.bytes)
+		case 3:
+			n.Address = string(f.bytes)
+		case 4:
+			n.Port = int(int64(f.varint))
+		case 5:
+			n.Role = NodeRole(f.bytes)
+		case 6:
+			n.Status = NodeStatus(f.bytes)
+		case 7:
+			if n.Labels == nil {
+				n.Labels = make(map[string]string)
+			}
+			return consumeProtoMapEntry(f.bytes, n.Labels)
+		case 8:
+			return n.Resources.unmarshalProto(f.bytes)
+		case 9:
+			n.LastSeen = timeutil.ParseLegacy(string(f.bytes))
+		case 10:
+			n.CreatedAt = timeutil.ParseLegacy(string(f.bytes))
+		case 11:
+			n.UpdatedAt = timeutil.ParseLegacy(string(f.bytes))
+		case 12:
+			n.Version = string(f.bytes)
+		}
+		return nil
+	})
+}
+
+func (t *Task) marshalProto() []byte {
+	var b []byte
+	b = appendProtoString(b, 1, t.ID)
+	b = appendProtoString(b, 2, t.Name)
+	b = appendProtoString(b, 3, string(t.Type))
+	b = appendProtoString(b, 4, t.Image)
+	for _, arg := range t.Command {
+		b = protowire.AppendTag(b, 5, protowire.BytesType)
+		b = protowire.AppendString(b, arg)
+	}
+	for _, env := range t.Env {
+		b = protowire.AppendTag(b, 6, protowire.BytesType)
+		b = protowire.AppendString(b, env)
+	}
+	b = appendProtoMessage(b, 7, t.Resources.marshalProto())
+	b = appendProtoMap(b, 8, t.Labels)
+	b = appendProtoString(b, 9, string(t.Status))
+	b = appendProtoString(b, 10, t.NodeID)
+	b = appendProtoString(b, 11, string(t.DesiredState))
+	b = appendProtoTime(b, 12, t.CreatedAt)
+	b = appendProtoTime(b, 13, t.UpdatedAt)
+	b = appendProtoTime(b, 14, t.StartedAt)
+	b = appendProtoTime(b, 15, t.CompletedAt)
+	b = appendProtoString(b, 16, t.ServiceID)
+	b = appendProtoInt(b, 17, int64(t.Slot))
+	b = appendProtoString(b, 18, t.ServiceName)
+	b = appendProtoString(b, 19, t.Namespace)
+	if t.MetadataEnv {
+		b = appendProtoInt(b, 20, 1)
+	}
+	b = appendProtoString(b, 21, t.HostnameTemplate)
+	b = appendProtoString(b, 22, t.Error)
+	for i := range t.Ports {
+		b = appendProtoMessage(b, 23, t.Ports[i].marshalProto())
+	}
+	b = appendProtoInt(b, 24, int64(t.ServiceVersion))
+	return b
+}
+
+func (t *Task) unmarshalProto(b []byte) error {
+	return consumeProtoFields(b, func(f protoField) error {
+		switch f.num {
+		case 1:
+			t.ID = string(f.bytes)
+		case 2:
+			t.Name = string(f.bytes)
+		case 3:
+			t.Type = TaskType(f.bytes)
+		case 4:
+			t.Image = string(f.bytes)
+		case 5:
+			t.Command = append(t.Command, string(f.bytes))
+		case 6:
+			t.Env = append(t.Env, string(f.bytes))
+		case 7:
+			return t.Resources.unmarshalProto(f.bytes)
+		case 8:
+			if t.Labels == nil {
+				t.Labels = make(map[string]string)
+			}
+			return consumeProtoMapEntry(f.bytes, t.Labels)
+		case 9:
+			t.Status = TaskStatus(f.bytes)
+		case 10:
+			t.NodeID = string(f.bytes)
+		case 11:
+			t.DesiredState = TaskStatus(f.bytes)
+		case 12:
+			t.CreatedAt = timeutil.ParseLegacy(string(f.bytes))
+		case 13:
+			t.UpdatedAt = timeutil.ParseLegacy(string(f.bytes))
+		case 14:
+			t.StartedAt = timeutil.ParseLegacy(string(f.bytes))
+		case 15:
+			t.CompletedAt = timeutil.ParseLegacy(string(f.bytes))
+		case 16:
+			t.ServiceID = string(f.bytes)
+		case 17:
+			t.Slot = int(int64(f.varint))
+		case 18:
+			t.ServiceName = string(f.bytes)
+		case 19:
+			t.Namespace = string(f.bytes)
+		case 20:
+			t.MetadataEnv = f.varint != 0
+		case 21:
+			t.HostnameTemplate = string(f.bytes)
+		case 22:
+			t.Error = string(f.bytes)
+		case 23:
+			var port PortConfig
+			if err := port.unmarshalProto(f.bytes); err != nil {
+				return err
+			}
+			t.Ports = append(t.Ports, port)
+		case 24:
+			t.ServiceVersion = f.varint
+		}
+		return nil
+	})
+}
+
+func appendProtoString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// appendProtoTime encodes a time as an RFC3339 string, leaving zero times
+// out like empty strings.
+func appendProtoTime(b []byte, num protowire.Number, t time.Time) []byte {
+	if t.IsZero() {
+		return b
+	}
+	return appendProtoString(b, num, t.Format(time.RFC3339Nano))
+}
+
+func appendProtoInt(b []byte, num protowire.Number, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(v))
+}
+
+func appendProtoMessage(b []byte, num protowire.Number, msg []byte) []byte {
+	if len(msg) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+// appendProtoMap writes a map<string, string> as repeated key/value entries.
+func appendProtoMap(b []byte, num protowire.Number, m map[string]string) []byte {
+	for key, value := range m {
+		var entry []byte
+		entry = appendProtoString(entry, 1, key)
+		entry = appendProtoString(entry, 2, value)
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	return b
+}
+
+func consumeProtoMapEntry(b []byte, m map[string]string) error {
+	var key, value string
+	err := consumeProtoFields(b, func(f protoField) error {
+		switch f.num {
+		case 1:
+			key = string(f.bytes)
+		case 2:
+			value = string(f.bytes)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	m[key] = value
+	return nil
+}
+
+type protoField struct {
+	num    protowire.Number
+	varint uint64
+	bytes  []byte
+}
+
+// consumeProtoFields calls fn for every varint and length-delimited field
+// in b and skips fields of other wire types.
+func consumeProtoFields(b []byte, fn func(protoField) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		field := protoField{num: num}
+		switch typ {
+		case protowire.VarintType:
+			field.varint, n = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			field.bytes, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if typ != protowire.VarintType && typ != protowire.BytesType {
+			continue
+		}
+		if err := fn(field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
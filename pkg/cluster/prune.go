@@ -0,0 +1,163 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// PrunePolicy selects what every node cleans up.
+type PrunePolicy struct {
+	Containers bool `json:"containers"`
+	Images     bool `json:"images"`
+	// AllImages removes every unused image instead of only dangling ones
+	AllImages bool `json:"all_images"`
+	Volumes   bool `json:"volumes"`
+	// Until keeps anything created more recently than this
+	Until time.Duration `json:"until,omitempty"`
+}
+
+type NodePruneResult struct {
+	NodeID            string `json:"node_id"`
+	ContainersDeleted int    `json:"containers_deleted"`
+	ImagesDeleted     int    `json:"images_deleted"`
+	VolumesDeleted    int    `json:"volumes_deleted"`
+	SpaceReclaimed    int64  `json:"space_reclaimed"`
+	Error             string `json:"error,omitempty"`
+}
+
+type PruneReport struct {
+	Nodes          []*NodePruneResult `json:"nodes"`
+	SpaceReclaimed int64              `json:"space_reclaimed"`
+	Failed         int                `json:"failed"`
+	StartedAt      time.Time          `json:"started_at"`
+	EndedAt        time.Time          `json:"ended_at"`
+}
+
+// NodePruner runs the cleanup on a single node.
+type NodePruner interface {
+	PruneNode(node *Node, policy PrunePolicy) (*NodePruneResult, error)
+}
+
+// LocalPruneFunc cleans up the node this process runs on. The cluster
+// package doesn't own images, containers or volumes, so whoever does
+// registers one with SetLocalPruner.
+type LocalPruneFunc func(policy PrunePolicy) (*NodePruneResult, error)
+
+// agentPruner runs the local pruner for this node and asks every other
+// node's API to prune itself.
+type agentPruner struct {
+	manager *ClusterManager
+	client  *http.Client
+}
+
+func (p *agentPruner) PruneNode(node *Node, policy PrunePolicy) (*NodePruneResult, error) {
+	if p.manager.isLocalNode(node) {
+		return p.manager.pruneLocal(policy)
+	}
+
+	body, err := json.Marshal(policy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal prune policy: %v", err)
+	}
+
+	url := fmt.Sprintf("http://%s:%d/node/prune", node.Address, node.Port)
+	resp, err := p.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	result := &NodePruneResult{}
+	response := APIResponse{Data: result}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %v", err)
+	}
+	if !response.Success {
+		return nil, fmt.Errorf("node returned status %d: %s", resp.StatusCode, response.Error)
+	}
+	return result, nil
+}
+
+// SetLocalPruner registers the cleanup this node runs for a cluster prune.
+func (cm *ClusterManager) SetLocalPruner(prune LocalPruneFunc) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.localPruner = prune
+}
+
+func (cm *ClusterManager) pruneLocal(policy PrunePolicy) (*NodePruneResult, error) {
+	cm.mu.RLock()
+	prune := cm.localPruner
+	cm.mu.RUnlock()
+
+	if prune == nil {
+		return nil, fmt.Errorf("this node has no local pruner")
+	}
+	return prune(policy)
+}
+
+// Prune runs the policy on every reachable node in parallel. A node that
+// fails doesn't stop the others; its error is recorded in the report.
+func (cm *ClusterManager) Prune(policy PrunePolicy, pruner NodePruner) (*PruneReport, error) {
+	if !policy.Containers && !policy.Images && !policy.Volumes {
+		return nil, fmt.Errorf("nothing to prune")
+	}
+	if pruner == nil {
+		pruner = &agentPruner{manager: cm, client: &http.Client{Timeout: 5 * time.Minute}}
+	}
+
+	nodes, err := cm.NodeManager.ListNodes()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &PruneReport{StartedAt: cm.Clock.Now()}
+
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+	for _, node := range nodes {
+		if node.Status == StatusDown || node.Status == StatusUnknown {
+			report.Nodes = append(report.Nodes, &NodePruneResult{NodeID: node.ID, Error: fmt.Sprintf("node is %s", node.Status)})
+			continue
+		}
+
+		wg.Add(1)
+		go func(node *Node) {
+			defer wg.Done()
+
+			result, err := pruner.PruneNode(node, policy)
+			if err != nil {
+				logrus.Warnf("Failed to prune node %s: %v", node.ID, err)
+				result = &NodePruneResult{Error: err.Error()}
+			}
+			result.NodeID = node.ID
+
+			mu.Lock()
+			report.Nodes = append(report.Nodes, result)
+			mu.Unlock()
+		}(node)
+	}
+	wg.Wait()
+
+	sort.Slice(report.Nodes, func(i, j int) bool { return report.Nodes[i].NodeID < report.Nodes[j].NodeID })
+	for _, result := range report.Nodes {
+		if result.Error != "" {
+			report.Failed++
+			continue
+		}
+		report.SpaceReclaimed += result.SpaceReclaimed
+	}
+	report.EndedAt = cm.Clock.Now()
+
+	logrus.Infof("Pruned %d node(s), reclaimed %d bytes, %d failed", len(report.Nodes)-report.Failed, report.SpaceReclaimed, report.Failed)
+	return report, nil
+}
@@ -0,0 +1,320 @@
+package cluster
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// rebalanceThreshold is the load gap between the busiest and idlest
+	// node below which the cluster counts as balanced.
+	rebalanceThreshold = 0.1
+	// rebalanceInterval separates rounds while replicas are still moving
+	rebalanceInterval = 30 * time.Second
+)
+
+// RebalancePolicy opts a service into having its replicas moved from
+// heavily loaded nodes to underutilized ones. Services without a policy
+// are never moved, and moves stay within the service's disruption budget.
+type RebalancePolicy struct {
+	Enabled bool `json:"enabled"`
+	// MaxMoves is how many replicas may move per round (default 1)
+	MaxMoves int `json:"max_moves,omitempty"`
+	// Delay is the pause after each move of the service
+	Delay time.Duration `json:"delay,omitempty"`
+}
+
+type RebalanceMove struct {
+	ServiceID   string `json:"service_id"`
+	TaskID      string `json:"task_id"`
+	Replacement string `json:"replacement,omitempty"`
+	From        string `json:"from"`
+	To          string `json:"to"`
+	Error       string `json:"error,omitempty"`
+}
+
+type RebalanceReport struct {
+	Moves     []RebalanceMove `json:"moves"`
+	StartedAt time.Time       `json:"started_at"`
+	EndedAt   time.Time       `json:"ended_at"`
+}
+
+type Rebalancer struct {
+	manager *ClusterManager
+	// policies holds the rebalance policy of each service by service ID
+	policies map[string]RebalancePolicy
+	// running is set while rounds triggered by a node join are in progress
+	running bool
+	// round serializes rounds, whether triggered or requested
+	round sync.Mutex
+	mu    sync.Mutex
+}
+
+func NewRebalancer(manager *ClusterManager) *Rebalancer {
+	return &Rebalancer{
+		manager:  manager,
+		policies: make(map[string]RebalancePolicy),
+	}
+}
+
+func (r *Rebalancer) SetPolicy(serviceID string, policy RebalancePolicy) error {
+	if serviceID == "" {
+		return fmt.Errorf("service ID is required")
+	}
+	if policy.MaxMoves < 0 {
+		return fmt.Errorf("max moves must not be negative")
+	}
+	if policy.Delay < 0 {
+		return fmt.Errorf("delay must not be negative")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !policy.Enabled {
+		delete(r.policies, serviceID)
+		return nil
+	}
+	if policy.MaxMoves == 0 {
+		policy.MaxMoves = 1
+	}
+	r.policies[serviceID] = policy
+
+	logrus.Infof("Rebalancing enabled for service %s", serviceID)
+	return nil
+}
+
+func (r *Rebalancer) GetPolicy(serviceID string) RebalancePolicy {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.policies[serviceID]
+}
+
+// NodeJoined starts moving replicas onto a new node in the background.
+// Rounds repeat until one finds nothing left to move.
+func (r *Rebalancer) NodeJoined(nodeID string) {
+	r.mu.Lock()
+	if r.running || len(r.policies) == 0 {
+		r.mu.Unlock()
+		return
+	}
+	r.running = true
+	r.mu.Unlock()
+
+	logrus.Infof("Node %s joined, rebalancing services", nodeID)
+	go func() {
+		defer func() {
+			r.mu.Lock()
+			r.running = false
+			r.mu.Unlock()
+		}()
+
+		for {
+			report := r.Rebalance()
+			if len(report.Moves) == 0 {
+				return
+			}
+			select {
+			case <-r.manager.Clock.After(rebalanceInterval):
+			case <-r.manager.shutdown:
+				return
+			}
+		}
+	}()
+}
+
+// Rebalance runs one round. Each step moves one replica from the most to
+// the least loaded node, waiting for it to run on the new node before the
+// next step, until the nodes are within rebalanceThreshold of each other
+// or no service may move another replica.
+func (r *Rebalancer) Rebalance() *RebalanceReport {
+	r.round.Lock()
+	defer r.round.Unlock()
+
+	report := &RebalanceReport{
+		Moves:     []RebalanceMove{},
+		StartedAt: r.manager.Clock.Now(),
+	}
+	defer func() {
+		report.EndedAt = r.manager.Clock.Now()
+	}()
+
+	r.mu.Lock()
+	policies := make(map[string]RebalancePolicy, len(r.policies))
+	for serviceID, policy := range r.policies {
+		policies[serviceID] = policy
+	}
+	r.mu.Unlock()
+	for serviceID := range policies {
+		if r.manager.SLOs.UpdatesPaused(serviceID) {
+			logrus.Warnf("Not rebalancing service %s: error budget exhausted", serviceID)
+			delete(policies, serviceID)
+		}
+	}
+	if len(policies) == 0 {
+		return report
+	}
+
+	moves := make(map[string]int)
+	for {
+		move, policy := r.nextMove(policies, moves)
+		if move == nil {
+			return report
+		}
+		moves[move.ServiceID]++
+
+		r.moveReplica(move)
+		report.Moves = append(report.Moves, *move)
+		if move.Error != "" {
+			// Leave the service alone for the rest of the round
+			moves[move.ServiceID] = policy.MaxMoves
+			continue
+		}
+		if policy.Delay > 0 {
+			r.manager.Clock.Sleep(policy.Delay)
+		}
+	}
+}
+
+type nodeLoad struct {
+	node      *Node
+	allocated Resources
+}
+
+func (l *nodeLoad) load() float64 {
+	cpu := float64(l.allocated.CPU) / float64(l.node.Resources.CPU)
+	memory := float64(l.allocated.Memory) / float64(l.node.Resources.Memory)
+	if cpu > memory {
+		return cpu
+	}
+	return memory
+}
+
+// nextMove picks the replica whose move narrows the gap between the most
+// and least loaded nodes, or returns nil when none should move.
+func (r *Rebalancer) nextMove(policies map[string]RebalancePolicy, moves map[string]int) (*RebalanceMove, RebalancePolicy) {
+	nodes, err := r.manager.NodeManager.ListNodes()
+	if err != nil {
+		return nil, RebalancePolicy{}
+	}
+	tasks, err := r.manager.TaskManager.ListTasks()
+	if err != nil {
+		return nil, RebalancePolicy{}
+	}
+
+	loads := make(map[string]*nodeLoad)
+	schedulable := make(map[string]bool)
+	var ordered []*nodeLoad
+	for _, node := range nodes {
+		if !nodeSchedulable(node) {
+			continue
+		}
+		schedulable[node.ID] = true
+		if node.Resources.CPU <= 0 || node.Resources.Memory <= 0 {
+			continue
+		}
+		l := &nodeLoad{node: node}
+		loads[node.ID] = l
+		ordered = append(ordered, l)
+	}
+	if len(ordered) < 2 {
+		return nil, RebalancePolicy{}
+	}
+
+	r.manager.TaskManager.mu.RLock()
+	unavailable := make(map[string]int)
+	var movable []*Task
+	for _, task := range tasks {
+		// Tasks being stopped are about to free their resources
+		if l, ok := loads[task.NodeID]; ok && taskHoldsResources(task.Status) && task.DesiredState != TaskComplete {
+			l.allocated = addResources(l.allocated, task.Resources)
+		}
+		if task.ServiceID == "" || task.DesiredState != TaskRunning {
+			continue
+		}
+		if task.Status != TaskRunning || !schedulable[task.NodeID] {
+			unavailable[task.ServiceID]++
+			continue
+		}
+		movable = append(movable, task)
+	}
+	r.manager.TaskManager.mu.RUnlock()
+
+	sort.Slice(ordered, func(i, j int) bool {
+		return ordered[i].load() < ordered[j].load()
+	})
+	target := ordered[0]
+	sort.Slice(movable, func(i, j int) bool {
+		return movable[i].ID < movable[j].ID
+	})
+
+	// Try the busiest source first, then the next busiest
+	for i := len(ordered) - 1; i > 0; i-- {
+		source := ordered[i]
+		if source.load()-target.load() <= rebalanceThreshold {
+			break
+		}
+
+		for _, task := range movable {
+			if task.NodeID != source.node.ID {
+				continue
+			}
+			policy, ok := policies[task.ServiceID]
+			if !ok || moves[task.ServiceID] >= policy.MaxMoves {
+				continue
+			}
+			// Without a disruption budget only one replica may be down
+			maxUnavailable := r.manager.Budgets.Get(task.ServiceID)
+			if maxUnavailable == 0 {
+				maxUnavailable = 1
+			}
+			if unavailable[task.ServiceID]+1 > maxUnavailable {
+				continue
+			}
+
+			available := subtractResources(target.node.Resources, target.allocated)
+			if missingResources(available, task.Resources) != "" {
+				continue
+			}
+
+			// Only move when it leaves the pair closer together
+			after := &nodeLoad{node: target.node, allocated: addResources(target.allocated, task.Resources)}
+			if after.load() >= source.load() {
+				continue
+			}
+
+			return &RebalanceMove{
+				ServiceID: task.ServiceID,
+				TaskID:    task.ID,
+				From:      source.node.ID,
+				To:        target.node.ID,
+			}, policy
+		}
+	}
+	return nil, RebalancePolicy{}
+}
+
+func (r *Rebalancer) moveReplica(move *RebalanceMove) {
+	logrus.Infof("Moving task %s of service %s from node %s to %s", move.TaskID, move.ServiceID, move.From, move.To)
+
+	replacement, err := r.manager.TaskManager.replaceTask(move.TaskID, move.To)
+	if err != nil {
+		move.Error = err.Error()
+		logrus.Errorf("Failed to move task %s: %v", move.TaskID, err)
+		return
+	}
+	move.Replacement = replacement.ID
+
+	timeout := r.manager.Config.TaskTimeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	if err := r.manager.TaskManager.waitForTaskRunning(replacement.ID, timeout); err != nil {
+		move.Error = err.Error()
+		logrus.Errorf("Moved task %s did not start: %v", move.TaskID, err)
+	}
+}
@@ -0,0 +1,275 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// stateReplicaFile holds the last copy of the cluster state a manager
+	// received from the leader
+	stateReplicaFile = "state.replica.json"
+
+	// replicationInterval is how often the state is sent again to the
+	// managers that missed a change, e.g. while they were down
+	replicationInterval = 10 * time.Second
+)
+
+// stateReplica is the cluster state as a leader sends it to the other
+// managers.
+type stateReplica struct {
+	// Leader is the node ID of the manager sending the state
+	Leader string          `json:"leader"`
+	State  json.RawMessage `json:"state"`
+}
+
+// StateReplicator copies the cluster state to the other managers. There
+// is no election: the manager that initialized the cluster is the only
+// one that schedules and records changes, and the others keep a replica
+// of its state. When it is lost, a manager started with ForceNewCluster
+// takes over the cluster from its replica, and the workers join it.
+type StateReplicator struct {
+	manager *ClusterManager
+	// client has its own connections, so none sent to a manager while
+	// this one shuts down is handed to another request
+	client  *http.Client
+	changed chan struct{}
+	// sent holds, by node ID, the index of the state each manager last
+	// received
+	sent map[string]uint64
+	mu   sync.Mutex
+}
+
+func NewStateReplicator(manager *ClusterManager) *StateReplicator {
+	return &StateReplicator{
+		manager: manager,
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: http.DefaultTransport.(*http.Transport).Clone(),
+		},
+		changed: make(chan struct{}, 1),
+		sent:    make(map[string]uint64),
+	}
+}
+
+func (r *StateReplicator) Start() {
+	go r.loop()
+}
+
+// notify has the state sent to the managers that don't have it yet.
+func (r *StateReplicator) notify() {
+	if r == nil {
+		return
+	}
+	select {
+	case r.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (r *StateReplicator) loop() {
+	ticker := r.manager.Clock.NewTicker(replicationInterval)
+	defer ticker.Stop()
+	defer r.client.CloseIdleConnections()
+	for {
+		select {
+		case <-r.changed:
+		case <-ticker.C():
+		case <-r.manager.shutdown:
+			return
+		}
+		r.replicate()
+	}
+}
+
+// replicate sends the state to each manager that is up and hasn't
+// received it as of the last change.
+func (r *StateReplicator) replicate() {
+	cm := r.manager
+	var managers []Node
+	cm.NodeManager.mu.RLock()
+	for _, node := range cm.NodeManager.nodes {
+		if node.Role == RoleManager && node.Status != StatusDown && !cm.isLocalNode(node) {
+			managers = append(managers, *node)
+		}
+	}
+	cm.NodeManager.mu.RUnlock()
+	if len(managers) == 0 {
+		return
+	}
+
+	state, index, err := cm.State.export()
+	if err != nil {
+		logrus.Debugf("Not replicating the cluster state: %v", err)
+		return
+	}
+	token := cm.clusterToken()
+	replica := stateReplica{Leader: cm.localNodeID(), State: state}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, node := range managers {
+		if r.sent[node.ID] >= index {
+			continue
+		}
+		url := fmt.Sprintf("http://%s:%d/cluster/state", node.Address, node.Port)
+		if err := postClusterRequest(r.client, url, token, &replica); err != nil {
+			logrus.Debugf("Failed to replicate the cluster state to manager %s: %v", node.ID, err)
+			continue
+		}
+		r.sent[node.ID] = index
+	}
+}
+
+// export returns the state as recorded now and its index.
+func (s *StateStore) export() (json.RawMessage, uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.log == nil {
+		return nil, 0, fmt.Errorf("state store is not open")
+	}
+	data, err := json.Marshal(&s.state)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to encode cluster state: %v", err)
+	}
+	return data, s.state.Index, nil
+}
+
+// saveReplica keeps a copy of the state sent by the leader. The leader
+// must be a manager in that state and in the replica kept already, and
+// the state must be no older than that replica.
+func (s *StateStore) saveReplica(leaderID string, state *stateSnapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if state.ClusterID == "" {
+		return fmt.Errorf("cluster state has no cluster ID")
+	}
+	if !state.hasManager(leaderID) {
+		return fmt.Errorf("%s is not a manager of cluster %s", leaderID, state.ClusterID)
+	}
+	current, err := readStateFile(filepath.Join(s.dir, stateReplicaFile))
+	if err == nil && current.ClusterID == state.ClusterID {
+		if !current.hasManager(leaderID) {
+			return fmt.Errorf("%s was not a manager of cluster %s", leaderID, state.ClusterID)
+		}
+		if state.Term < current.Term || state.Term == current.Term && state.Index < current.Index {
+			return fmt.Errorf("cluster state at term %d, index %d is older than the replica at term %d, index %d", state.Term, state.Index, current.Term, current.Index)
+		}
+	}
+	return writeStateFile(filepath.Join(s.dir, stateReplicaFile), state)
+}
+
+// hasManager reports whether the node is a manager in the state.
+func (state *stateSnapshot) hasManager(nodeID string) bool {
+	data, exists := state.Nodes[nodeID]
+	if !exists {
+		return false
+	}
+	var node Node
+	if err := json.Unmarshal(data, &node); err != nil {
+		return false
+	}
+	return node.Role == RoleManager
+}
+
+// ReplicaIndex returns the index of the replica of the leader's state
+// this manager holds, 0 if it holds none.
+func (s *StateStore) ReplicaIndex() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	replica, err := readStateFile(filepath.Join(s.dir, stateReplicaFile))
+	if err != nil {
+		return 0
+	}
+	return replica.Index
+}
+
+// takeOver replaces the manager's own state with its replica of the
+// leader's, for ForceNewCluster, and starts a new term so the managers
+// that hold a replica refuse the state of the deposed leader. Callers
+// hold s.mu.
+func (s *StateStore) takeOver() error {
+	replica, err := readStateFile(filepath.Join(s.dir, stateReplicaFile))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("no replica of the cluster state to take over with: only managers that joined with a manager token hold one")
+	}
+	if err != nil {
+		return err
+	}
+	replica.Term++
+	if err := writeStateFile(filepath.Join(s.dir, stateSnapshotFile), replica); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(s.dir, stateLogFile)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove state log: %v", err)
+	}
+	logrus.Warnf("Taking over cluster %s from the replica of its state at index %d, as term %d", replica.ClusterID, replica.Index, replica.Term)
+	return nil
+}
+
+func readStateFile(path string) (*stateSnapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var state stateSnapshot
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", filepath.Base(path), err)
+	}
+	return &state, nil
+}
+
+// writeStateFile replaces the file at path with state at once.
+func writeStateFile(path string, state *stateSnapshot) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to encode cluster state: %v", err)
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %v", filepath.Base(path), err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to write %s: %v", filepath.Base(path), err)
+	}
+	return nil
+}
+
+// handleReplicateState keeps the state the leader sends this manager.
+// Only the manager this node joined is taken for the leader.
+func (api *APIServer) handleReplicateState(w http.ResponseWriter, r *http.Request) {
+	var replica stateReplica
+	if err := json.NewDecoder(r.Body).Decode(&replica); err != nil {
+		api.writeErrorResponse(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	var state stateSnapshot
+	if err := json.Unmarshal(replica.State, &state); err != nil {
+		api.writeErrorResponse(w, http.StatusBadRequest, "Invalid cluster state")
+		return
+	}
+
+	api.manager.mu.RLock()
+	leaderID := api.manager.leaderID
+	api.manager.mu.RUnlock()
+	if leaderID == "" || replica.Leader != leaderID {
+		api.writeErrorResponse(w, http.StatusForbidden, fmt.Sprintf("%q is not the manager this node joined", replica.Leader))
+		return
+	}
+
+	if err := api.manager.State.saveReplica(replica.Leader, &state); err != nil {
+		api.writeErrorResponse(w, http.StatusConflict, err.Error())
+		return
+	}
+	api.writeJSONResponse(w, http.StatusOK, APIResponse{Success: true})
+}
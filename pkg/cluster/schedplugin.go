@@ -0,0 +1,332 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"plugin"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultSchedulerPluginTimeout = 2 * time.Second
+	// maxPluginScore is the best score a plugin can give a node
+	maxPluginScore = 100
+	// schedulerPluginSymbol is the variable a Go plugin exports its
+	// SchedulerPlugin as
+	schedulerPluginSymbol = "SchedulerPlugin"
+)
+
+// SchedulerPlugin takes part in placing tasks, encoding placement rules
+// the built-in scheduler doesn't know about. It sees the nodes that are
+// ready and have the capacity for the task.
+type SchedulerPlugin interface {
+	Name() string
+	// Filter returns the nodes that may run the task
+	Filter(ctx context.Context, task *Task, nodes []*Node) ([]*Node, error)
+	// Score rates nodes by ID from 0 to 100, higher being better; nodes
+	// left out score 0
+	Score(ctx context.Context, task *Task, nodes []*Node) (map[string]float64, error)
+}
+
+// SchedulerPluginConfig sets up a plugin: an HTTP extender at URL, or a
+// Go plugin built with -buildmode=plugin at Path, which exports a
+// SchedulerPlugin variable.
+type SchedulerPluginConfig struct {
+	URL  string `json:"url,omitempty"`
+	Path string `json:"path,omitempty"`
+	// Timeout bounds each call to the plugin (default 2s)
+	Timeout time.Duration `json:"timeout,omitempty"`
+	// Weight scales the plugin's scores against the built-in one, which
+	// weighs as much as a plugin of weight 1 (default 1)
+	Weight float64 `json:"weight,omitempty"`
+}
+
+type schedulerPlugin struct {
+	SchedulerPlugin
+	timeout time.Duration
+	weight  float64
+}
+
+// SchedulerPlugins are the plugins consulted, in order, when placing a
+// task. A plugin that fails or times out is left out of that placement,
+// so the built-in scheduler carries on without it.
+type SchedulerPlugins struct {
+	manager *ClusterManager
+	plugins []schedulerPlugin
+	mu      sync.RWMutex
+}
+
+func NewSchedulerPlugins(manager *ClusterManager) *SchedulerPlugins {
+	return &SchedulerPlugins{manager: manager}
+}
+
+// Configure replaces the plugins with those of configs.
+func (s *SchedulerPlugins) Configure(configs []SchedulerPluginConfig) error {
+	var plugins []schedulerPlugin
+	for _, config := range configs {
+		var p SchedulerPlugin
+		var err error
+		switch {
+		case config.URL != "" && config.Path != "":
+			return fmt.Errorf("scheduler plugin has both a URL and a path")
+		case config.URL != "":
+			p, err = NewHTTPSchedulerPlugin(config.URL)
+		case config.Path != "":
+			p, err = LoadSchedulerPlugin(config.Path)
+		default:
+			return fmt.Errorf("scheduler plugin needs a URL or a path")
+		}
+		if err != nil {
+			return err
+		}
+		if config.Weight < 0 {
+			return fmt.Errorf("invalid weight %v of scheduler plugin %s", config.Weight, p.Name())
+		}
+		plugins = append(plugins, newSchedulerPlugin(p, config.Timeout, config.Weight))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.plugins = plugins
+	return nil
+}
+
+// Register adds a plugin, consulted after those configured.
+func (s *SchedulerPlugins) Register(p SchedulerPlugin, timeout time.Duration, weight float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.plugins = append(s.plugins, newSchedulerPlugin(p, timeout, weight))
+}
+
+func newSchedulerPlugin(p SchedulerPlugin, timeout time.Duration, weight float64) schedulerPlugin {
+	if timeout <= 0 {
+		timeout = defaultSchedulerPluginTimeout
+	}
+	if weight == 0 {
+		weight = 1
+	}
+	return schedulerPlugin{SchedulerPlugin: p, timeout: timeout, weight: weight}
+}
+
+// Names returns the names of the plugins.
+func (s *SchedulerPlugins) Names() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.plugins))
+	for _, p := range s.plugins {
+		names = append(names, p.Name())
+	}
+	return names
+}
+
+func (s *SchedulerPlugins) list() []schedulerPlugin {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.plugins
+}
+
+// Filter narrows nodes down to those every plugin accepts. Nodes a plugin
+// returns that weren't among those it was given are ignored.
+func (s *SchedulerPlugins) Filter(task *Task, nodes []*Node) ([]*Node, error) {
+	for _, p := range s.list() {
+		ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+		accepted, err := p.Filter(ctx, task, nodes)
+		cancel()
+		if err != nil {
+			logrus.Warnf("Scheduler plugin %s failed to filter nodes for task %s, ignoring it: %v", p.Name(), task.ID, err)
+			continue
+		}
+
+		kept := make(map[string]bool, len(accepted))
+		for _, node := range accepted {
+			kept[node.ID] = true
+		}
+		var filtered []*Node
+		for _, node := range nodes {
+			if kept[node.ID] {
+				filtered = append(filtered, node)
+			}
+		}
+		if len(filtered) == 0 {
+			return nil, fmt.Errorf("scheduler plugin %s rejected all %d candidate nodes", p.Name(), len(nodes))
+		}
+		nodes = filtered
+	}
+	return nodes, nil
+}
+
+// Score returns the weighted scores of nodes summed over the plugins, each
+// plugin's best score counting as 1.
+func (s *SchedulerPlugins) Score(task *Task, nodes []*Node) map[string]float64 {
+	scores := make(map[string]float64)
+	for _, p := range s.list() {
+		ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+		pluginScores, err := p.Score(ctx, task, nodes)
+		cancel()
+		if err != nil {
+			logrus.Warnf("Scheduler plugin %s failed to score nodes for task %s, ignoring it: %v", p.Name(), task.ID, err)
+			continue
+		}
+		for _, node := range nodes {
+			score := pluginScores[node.ID]
+			if score < 0 {
+				score = 0
+			} else if score > maxPluginScore {
+				score = maxPluginScore
+			}
+			scores[node.ID] += p.weight * score / maxPluginScore
+		}
+	}
+	return scores
+}
+
+// pickNode places a task on one of candidates, the nodes with the
+// capacity for it, that its placement allows, after the plugins have
+// filtered them. The node is the best by the task's scheduling strategy,
+// given what the tasks on each node take from it, and the plugins' scores.
+func (nm *NodeManager) pickNode(task *Task, candidates []*Node, usage map[string]NodeUsage) (*Node, error) {
+	strategy, err := nm.manager.Strategies.forTask(task)
+	if err != nil {
+		return nil, err
+	}
+	candidates, err = nm.filterPlacement(task, candidates)
+	if err != nil {
+		return nil, err
+	}
+	plugins := nm.manager.SchedulerPlugins
+	candidates, err = plugins.Filter(task, candidates)
+	if err != nil {
+		return nil, err
+	}
+	return nm.selectNodeByScore(candidates, task, strategy, usage, plugins.Score(task, candidates)), nil
+}
+
+// HTTPSchedulerPlugin asks an HTTP extender to filter and score nodes. The
+// extender is sent a SchedulerPluginRequest by POST to URL/filter, which
+// answers with the IDs of the nodes that may run the task as
+// {"nodes": [...]}, and URL/score, which answers with {"scores": {ID:
+// score}}. An extender that only filters or only scores answers the
+// other with 404.
+type HTTPSchedulerPlugin struct {
+	URL    string
+	Client *http.Client
+}
+
+// SchedulerPluginRequest is what an HTTP extender is asked about.
+type SchedulerPluginRequest struct {
+	Task  *Task   `json:"task"`
+	Nodes []*Node `json:"nodes"`
+}
+
+type schedulerFilterResponse struct {
+	Nodes []string `json:"nodes"`
+}
+
+type schedulerScoreResponse struct {
+	Scores map[string]float64 `json:"scores"`
+}
+
+func NewHTTPSchedulerPlugin(rawURL string) (*HTTPSchedulerPlugin, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid scheduler plugin URL %q", rawURL)
+	}
+	return &HTTPSchedulerPlugin{
+		URL:    strings.TrimSuffix(rawURL, "/"),
+		Client: &http.Client{},
+	}, nil
+}
+
+func (p *HTTPSchedulerPlugin) Name() string {
+	return p.URL
+}
+
+func (p *HTTPSchedulerPlugin) Filter(ctx context.Context, task *Task, nodes []*Node) ([]*Node, error) {
+	var response schedulerFilterResponse
+	found, err := p.call(ctx, "filter", task, nodes, &response)
+	if err != nil || !found {
+		return nodes, err
+	}
+
+	byID := make(map[string]*Node, len(nodes))
+	for _, node := range nodes {
+		byID[node.ID] = node
+	}
+	var accepted []*Node
+	for _, id := range response.Nodes {
+		if node, ok := byID[id]; ok {
+			accepted = append(accepted, node)
+		}
+	}
+	return accepted, nil
+}
+
+func (p *HTTPSchedulerPlugin) Score(ctx context.Context, task *Task, nodes []*Node) (map[string]float64, error) {
+	var response schedulerScoreResponse
+	if _, err := p.call(ctx, "score", task, nodes, &response); err != nil {
+		return nil, err
+	}
+	return response.Scores, nil
+}
+
+// call posts the task and nodes to the endpoint and decodes the answer
+// into v. It reports whether the extender has the endpoint.
+func (p *HTTPSchedulerPlugin) call(ctx context.Context, endpoint string, task *Task, nodes []*Node, v interface{}) (bool, error) {
+	body, err := json.Marshal(SchedulerPluginRequest{Task: task, Nodes: nodes})
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal request: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.URL+"/"+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("%s returned status %d", endpoint, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return false, fmt.Errorf("failed to decode %s response: %v", endpoint, err)
+	}
+	return true, nil
+}
+
+// LoadSchedulerPlugin opens a Go plugin exporting a SchedulerPlugin
+// variable, e.g. var SchedulerPlugin cluster.SchedulerPlugin = &MyPlugin{}.
+func LoadSchedulerPlugin(path string) (SchedulerPlugin, error) {
+	lib, err := plugin.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open scheduler plugin %s: %v", filepath.Base(path), err)
+	}
+	sym, err := lib.Lookup(schedulerPluginSymbol)
+	if err != nil {
+		return nil, fmt.Errorf("scheduler plugin %s doesn't export %s", filepath.Base(path), schedulerPluginSymbol)
+	}
+	switch p := sym.(type) {
+	case *SchedulerPlugin:
+		if *p != nil {
+			return *p, nil
+		}
+	case SchedulerPlugin:
+		return p, nil
+	}
+	return nil, fmt.Errorf("%s of scheduler plugin %s is not a SchedulerPlugin", schedulerPluginSymbol, filepath.Base(path))
+}
@@ -0,0 +1,391 @@
+package cluster
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"docker-impl/pkg/ids"
+	"github.com/sirupsen/logrus"
+)
+
+type SecretKind string
+
+const (
+	KindSecret SecretKind = "secret"
+	KindConfig SecretKind = "config"
+)
+
+// Secret holds the payload of a secret or a config. Tasks refer to it by ID
+// or name, so rotating it changes what every referencing task receives.
+type Secret struct {
+	ID        string            `json:"id"`
+	Name      string            `json:"name"`
+	Kind      SecretKind        `json:"kind"`
+	Data      []byte            `json:"data,omitempty"`
+	Digest    string            `json:"digest"`
+	Version   int               `json:"version"`
+	Labels    map[string]string `json:"labels"`
+	CreatedAt time.Time         `json:"created_at"`
+	UpdatedAt time.Time         `json:"updated_at"`
+}
+
+type ReloadAction string
+
+const (
+	ReloadNone    ReloadAction = "none"
+	ReloadSignal  ReloadAction = "signal"
+	ReloadRestart ReloadAction = "restart"
+)
+
+// ReloadPolicy decides what happens to a service's running tasks when a
+// secret or config they use is rotated.
+type ReloadPolicy struct {
+	Action ReloadAction `json:"action"`
+	// Signal is sent with ReloadSignal; it defaults to SIGHUP
+	Signal string `json:"signal,omitempty"`
+	// Delay is the pause between task restarts with ReloadRestart
+	Delay time.Duration `json:"delay,omitempty"`
+}
+
+type RotationReport struct {
+	Secret     *Secret  `json:"secret"`
+	Signaled   []string `json:"signaled"`
+	Restarting []string `json:"restarting"`
+	Unchanged  []string `json:"unchanged"`
+}
+
+type SecretManager struct {
+	secrets map[string]*Secret
+	// policies holds the reload policy of each service by service ID
+	policies map[string]ReloadPolicy
+	mu       sync.RWMutex
+	manager  *ClusterManager
+}
+
+var reloadSignals = map[string]bool{
+	"SIGHUP": true, "SIGINT": true, "SIGQUIT": true, "SIGUSR1": true,
+	"SIGUSR2": true, "SIGTERM": true, "SIGWINCH": true,
+}
+
+func NewSecretManager(manager *ClusterManager) *SecretManager {
+	return &SecretManager{
+		secrets:  make(map[string]*Secret),
+		policies: make(map[string]ReloadPolicy),
+		manager:  manager,
+	}
+}
+
+func (sm *SecretManager) Create(kind SecretKind, name string, data []byte, labels map[string]string) (*Secret, error) {
+	if kind != KindSecret && kind != KindConfig {
+		return nil, fmt.Errorf("unknown kind: %s", kind)
+	}
+	if name == "" {
+		return nil, fmt.Errorf("%s name is required", kind)
+	}
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if _, err := sm.find(kind, name); err == nil {
+		return nil, fmt.Errorf("%s %s already exists", kind, name)
+	}
+
+	now := sm.manager.Clock.Now()
+	secret := &Secret{
+		ID:        ids.NewID(string(kind)),
+		Name:      name,
+		Kind:      kind,
+		Data:      data,
+		Digest:    digestData(data),
+		Version:   1,
+		Labels:    labels,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	sm.secrets[secret.ID] = secret
+
+	logrus.Infof("Created %s %s (%s)", kind, name, secret.ID)
+	return secret, nil
+}
+
+// Get looks a secret or config up by ID or name.
+func (sm *SecretManager) Get(kind SecretKind, ref string) (*Secret, error) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	return sm.find(kind, ref)
+}
+
+func (sm *SecretManager) List(kind SecretKind) []*Secret {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	var secrets []*Secret
+	for _, secret := range sm.secrets {
+		if secret.Kind == kind {
+			secrets = append(secrets, secret)
+		}
+	}
+	sort.Slice(secrets, func(i, j int) bool { return secrets[i].Name < secrets[j].Name })
+	return secrets
+}
+
+func (sm *SecretManager) Remove(kind SecretKind, ref string) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	secret, err := sm.find(kind, ref)
+	if err != nil {
+		return err
+	}
+	if tasks := sm.referencingTasks(secret); len(tasks) > 0 {
+		return fmt.Errorf("%s %s is in use by %d task(s)", kind, secret.Name, len(tasks))
+	}
+
+	delete(sm.secrets, secret.ID)
+	logrus.Infof("Removed %s %s", kind, secret.Name)
+	return nil
+}
+
+// Rotate replaces the payload and applies each affected service's reload
+// policy to its running tasks. Restarts continue in the background, one
+// task at a time.
+func (sm *SecretManager) Rotate(kind SecretKind, ref string, data []byte) (*RotationReport, error) {
+	sm.mu.Lock()
+	secret, err := sm.find(kind, ref)
+	if err != nil {
+		sm.mu.Unlock()
+		return nil, err
+	}
+
+	digest := digestData(data)
+	if digest == secret.Digest {
+		sm.mu.Unlock()
+		return nil, fmt.Errorf("%s %s already has this content", kind, secret.Name)
+	}
+	secret.Data = data
+	secret.Digest = digest
+	secret.Version++
+	secret.UpdatedAt = sm.manager.Clock.Now()
+
+	report := &RotationReport{Secret: secret.Redacted()}
+	tasks := sm.referencingTasks(secret)
+	policies := make(map[string]ReloadPolicy, len(sm.policies))
+	for serviceID, policy := range sm.policies {
+		policies[serviceID] = policy
+	}
+	sm.mu.Unlock()
+
+	logrus.Infof("Rotated %s %s to version %d", kind, report.Secret.Name, report.Secret.Version)
+
+	restarts := make(map[string][]*Task)
+	for _, task := range tasks {
+		policy, ok := policies[task.ServiceID]
+		if !ok || task.ServiceID == "" {
+			policy = ReloadPolicy{Action: ReloadNone}
+		}
+
+		switch policy.Action {
+		case ReloadSignal:
+			if err := sm.manager.TaskManager.SignalTask(task.ID, policy.Signal); err != nil {
+				logrus.Warnf("Failed to signal task %s: %v", task.ID, err)
+				report.Unchanged = append(report.Unchanged, task.ID)
+				continue
+			}
+			report.Signaled = append(report.Signaled, task.ID)
+		case ReloadRestart:
+			restarts[task.ServiceID] = append(restarts[task.ServiceID], task)
+			report.Restarting = append(report.Restarting, task.ID)
+		default:
+			report.Unchanged = append(report.Unchanged, task.ID)
+		}
+	}
+
+	for serviceID, serviceTasks := range restarts {
+		go sm.rollingRestart(serviceID, serviceTasks, policies[serviceID].Delay)
+	}
+
+	return report, nil
+}
+
+// SetReloadPolicy selects how a service reacts to rotated secrets and
+// configs.
+func (sm *SecretManager) SetReloadPolicy(serviceID string, policy ReloadPolicy) error {
+	if serviceID == "" {
+		return fmt.Errorf("service ID is required")
+	}
+
+	switch policy.Action {
+	case "", ReloadNone:
+		sm.mu.Lock()
+		delete(sm.policies, serviceID)
+		sm.mu.Unlock()
+		return nil
+	case ReloadSignal:
+		signal, err := normalizeSignal(policy.Signal)
+		if err != nil {
+			return err
+		}
+		policy.Signal = signal
+	case ReloadRestart:
+		if policy.Delay < 0 {
+			return fmt.Errorf("restart delay must not be negative")
+		}
+	default:
+		return fmt.Errorf("unknown reload action: %s", policy.Action)
+	}
+
+	sm.mu.Lock()
+	sm.policies[serviceID] = policy
+	sm.mu.Unlock()
+
+	logrus.Infof("Service %s now reacts to rotation with %s", serviceID, policy.Action)
+	return nil
+}
+
+func (sm *SecretManager) GetReloadPolicy(serviceID string) ReloadPolicy {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	if policy, ok := sm.policies[serviceID]; ok {
+		return policy
+	}
+	return ReloadPolicy{Action: ReloadNone}
+}
+
+// rollingRestart replaces tasks one by one, waiting for each replacement to
+// run before moving on so the service keeps serving.
+func (sm *SecretManager) rollingRestart(serviceID string, tasks []*Task, delay time.Duration) {
+	timeout := sm.manager.Config.TaskTimeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+
+	for i, task := range tasks {
+		if sm.manager.SLOs.UpdatesPaused(serviceID) {
+			logrus.Warnf("Rolling restart of service %s paused at task %s: error budget exhausted", serviceID, task.ID)
+			return
+		}
+		if err := sm.manager.Budgets.WaitForTask(task, timeout); err != nil {
+			logrus.Errorf("Rolling restart of service %s stopped at task %s: %v", serviceID, task.ID, err)
+			return
+		}
+		replacement, err := sm.manager.TaskManager.restartTask(task.ID)
+		if err != nil {
+			logrus.Errorf("Rolling restart of service %s stopped at task %s: %v", serviceID, task.ID, err)
+			return
+		}
+		if err := sm.manager.TaskManager.waitForTaskRunning(replacement.ID, timeout); err != nil {
+			logrus.Errorf("Rolling restart of service %s stopped: %v", serviceID, err)
+			return
+		}
+		if delay > 0 && i < len(tasks)-1 {
+			sm.manager.Clock.Sleep(delay)
+		}
+	}
+
+	logrus.Infof("Restarted %d task(s) of service %s after rotation", len(tasks), serviceID)
+}
+
+// Redacted returns a copy that is safe to hand out: secret payloads are
+// dropped, config payloads are kept.
+func (s *Secret) Redacted() *Secret {
+	copied := *s
+	if s.Kind == KindSecret {
+		copied.Data = nil
+	}
+	return &copied
+}
+
+func (sm *SecretManager) find(kind SecretKind, ref string) (*Secret, error) {
+	if secret, ok := sm.secrets[ref]; ok && secret.Kind == kind {
+		return secret, nil
+	}
+	for _, secret := range sm.secrets {
+		if secret.Kind == kind && secret.Name == ref {
+			return secret, nil
+		}
+	}
+	return nil, fmt.Errorf("%s not found: %s", kind, ref)
+}
+
+// referencingTasks returns the tasks that should be running and use secret.
+func (sm *SecretManager) referencingTasks(secret *Secret) []*Task {
+	tasks, err := sm.manager.TaskManager.ListTasks()
+	if err != nil {
+		return nil
+	}
+
+	var result []*Task
+	for _, task := range tasks {
+		if task.DesiredState != TaskRunning || !isActiveTask(task) {
+			continue
+		}
+		if taskUses(task, secret) {
+			result = append(result, task)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Slot < result[j].Slot })
+	return result
+}
+
+func taskUses(task *Task, secret *Secret) bool {
+	matches := func(ref string) bool { return ref == secret.ID || ref == secret.Name }
+
+	if secret.Kind == KindSecret {
+		for _, ref := range task.Secrets {
+			if matches(ref.SecretID) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, ref := range task.Configs {
+		if matches(ref.ConfigID) {
+			return true
+		}
+	}
+	return false
+}
+
+func isActiveTask(task *Task) bool {
+	switch task.Status {
+	case TaskComplete, TaskFailed, TaskShutdown, TaskRejected, TaskRemove:
+		return false
+	}
+	return true
+}
+
+// normalizeSignal accepts HUP, SIGHUP or a signal number and returns the
+// SIG-prefixed name, defaulting to SIGHUP.
+func normalizeSignal(signal string) (string, error) {
+	if signal == "" {
+		return "SIGHUP", nil
+	}
+	if n, err := strconv.Atoi(signal); err == nil {
+		if n <= 0 || n > 64 {
+			return "", fmt.Errorf("invalid signal number: %d", n)
+		}
+		return signal, nil
+	}
+
+	name := strings.ToUpper(signal)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	if !reloadSignals[name] {
+		return "", fmt.Errorf("unsupported reload signal: %s", signal)
+	}
+	return name, nil
+}
+
+func digestData(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
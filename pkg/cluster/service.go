@@ -0,0 +1,814 @@
+package cluster
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"docker-impl/pkg/ids"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// serviceReconcileInterval is how often the reconciler checks every
+	// service even when no task ended
+	serviceReconcileInterval = 5 * time.Second
+
+	// serviceTaskHistory is how many ended tasks are kept per slot
+	serviceTaskHistory = 5
+
+	// defaultRestartDelay is how long a slot stays empty after its task
+	// ended when the restart policy sets no delay
+	defaultRestartDelay = 5 * time.Second
+
+	// defaultUpdateMonitor is how long a task started by an update has to
+	// keep running before it counts as updated
+	defaultUpdateMonitor = 5 * time.Second
+)
+
+// Restart conditions of a service's RestartPolicy
+const (
+	RestartConditionAny       = "any"
+	RestartConditionOnFailure = "on-failure"
+	RestartConditionNone      = "none"
+)
+
+// Failure actions of a service's UpdateConfig
+const (
+	UpdateFailurePause    = "pause"
+	UpdateFailureContinue = "continue"
+	UpdateFailureRollback = "rollback"
+)
+
+// UpdateState is how far the update of a service got.
+type UpdateState string
+
+const (
+	UpdateStateUpdating          UpdateState = "updating"
+	UpdateStatePaused            UpdateState = "paused"
+	UpdateStateCompleted         UpdateState = "completed"
+	UpdateStateRollbackStarted   UpdateState = "rollback_started"
+	UpdateStateRollbackPaused    UpdateState = "rollback_paused"
+	UpdateStateRollbackCompleted UpdateState = "rollback_completed"
+)
+
+var serviceNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// Service keeps Replicas tasks of the same spec running, one per slot
+// numbered from 1. Tasks that end are replaced as the RestartPolicy
+// allows.
+type Service struct {
+	ID            string            `json:"id"`
+	Name          string            `json:"name"`
+	Namespace     string            `json:"namespace,omitempty"`
+	Image         string            `json:"image"`
+	Command       []string          `json:"command,omitempty"`
+	Env           []string          `json:"env,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	Replicas      int               `json:"replicas"`
+	Resources     Resources         `json:"resources"`
+	Constraints   []Constraint      `json:"constraints,omitempty"`
+	Placement     Placement         `json:"placement"`
+	RestartPolicy RestartPolicy     `json:"restart_policy"`
+	UpdateConfig  UpdateConfig      `json:"update_config"`
+	Networks      []NetworkConfig   `json:"networks,omitempty"`
+	Ports         []PortConfig      `json:"ports,omitempty"`
+	// MetadataEnv and HostnameTemplate are passed on to the tasks
+	MetadataEnv      bool   `json:"metadata_env,omitempty"`
+	HostnameTemplate string `json:"hostname_template,omitempty"`
+	// MaxUnavailable is the service's disruption budget: how many of its
+	// replicas drains, rebalancing and rolling restarts may take down at
+	// once. Zero leaves the service without a budget.
+	MaxUnavailable int `json:"max_unavailable,omitempty"`
+	// Version goes up with every change to what the tasks run; scaling
+	// leaves it alone
+	Version uint64 `json:"version"`
+	// SpecVersion is the Version whose spec the tasks run. A rollback
+	// goes back to the spec, and so the tasks, of an earlier version.
+	SpecVersion uint64 `json:"spec_version"`
+	// PreviousSpec is the service before its last update or rollback,
+	// which RollbackService returns to
+	PreviousSpec *Service      `json:"previous_spec,omitempty"`
+	UpdateStatus *UpdateStatus `json:"update_status,omitempty"`
+	CreatedAt    time.Time     `json:"created_at"`
+	UpdatedAt    time.Time     `json:"updated_at"`
+}
+
+// UpdateConfig says how the tasks of a service are replaced when its spec
+// changes.
+type UpdateConfig struct {
+	// Parallelism is how many tasks are replaced at once; 1 when unset
+	Parallelism int `json:"parallelism"`
+	// Delay is the pause between batches
+	Delay time.Duration `json:"delay"`
+	// FailureAction is pause, continue or rollback; pause when unset
+	FailureAction string `json:"failure_action,omitempty"`
+	// Monitor is how long a new task has to run, and pass its health
+	// probes, to count as updated
+	Monitor time.Duration `json:"monitor"`
+	// MaxFailureRatio is the share of the replicas that may fail during
+	// the update before the FailureAction is taken
+	MaxFailureRatio float64 `json:"max_failure_ratio"`
+}
+
+// UpdateStatus follows the update or rollback of a service.
+type UpdateStatus struct {
+	State       UpdateState `json:"state"`
+	StartedAt   time.Time   `json:"started_at"`
+	CompletedAt time.Time   `json:"completed_at,omitempty"`
+	Message     string      `json:"message,omitempty"`
+}
+
+// ServiceManager holds the services of the cluster and reconciles their
+// tasks with them.
+type ServiceManager struct {
+	manager  *ClusterManager
+	services map[string]*Service
+	mu       sync.RWMutex
+	// wakeup asks the reconciler for a pass before its next tick
+	wakeup chan struct{}
+	// unhealthy holds the tasks of each service that failed a health
+	// probe since the service was last updated
+	unhealthy map[string]map[string]bool
+}
+
+func NewServiceManager(manager *ClusterManager) *ServiceManager {
+	return &ServiceManager{
+		manager:   manager,
+		services:  make(map[string]*Service),
+		wakeup:    make(chan struct{}, 1),
+		unhealthy: make(map[string]map[string]bool),
+	}
+}
+
+func (sm *ServiceManager) Start() {
+	go sm.loop()
+}
+
+func (sm *ServiceManager) loop() {
+	ticker := sm.manager.Clock.NewTicker(serviceReconcileInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			sm.reconcileAll()
+		case <-sm.wakeup:
+			sm.reconcileAll()
+		case <-sm.manager.shutdown:
+			return
+		}
+	}
+}
+
+// wake has the reconciler look at the services now.
+func (sm *ServiceManager) wake() {
+	select {
+	case sm.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// CreateService adds a service; its tasks are started in the background.
+func (sm *ServiceManager) CreateService(service *Service) (*Service, error) {
+	if err := sm.validateService(service); err != nil {
+		return nil, fmt.Errorf("service validation failed: %v", err)
+	}
+
+	sm.mu.Lock()
+	for _, existing := range sm.services {
+		if existing.Name == service.Name {
+			sm.mu.Unlock()
+			return nil, fmt.Errorf("service %s already exists", service.Name)
+		}
+	}
+
+	created := *service
+	created.ID = generateServiceID()
+	created.Version = 1
+	created.SpecVersion = 1
+	created.PreviousSpec = nil
+	created.UpdateStatus = nil
+	created.CreatedAt = sm.manager.Clock.Now()
+	created.UpdatedAt = created.CreatedAt
+	sm.services[created.ID] = &created
+	sm.manager.State.putService(&created)
+	result := created
+	sm.mu.Unlock()
+
+	logrus.Infof("Created service %s (%s) with %d replica(s)", created.Name, created.ID, created.Replicas)
+	sm.wake()
+	return &result, nil
+}
+
+func (sm *ServiceManager) validateService(service *Service) error {
+	if !serviceNamePattern.MatchString(service.Name) {
+		return fmt.Errorf("invalid service name %q", service.Name)
+	}
+	if service.Replicas < 0 {
+		return fmt.Errorf("replicas must not be negative")
+	}
+	if service.MaxUnavailable < 0 {
+		return fmt.Errorf("max unavailable must not be negative")
+	}
+	switch service.RestartPolicy.Condition {
+	case "", RestartConditionAny, RestartConditionOnFailure, RestartConditionNone:
+	default:
+		return fmt.Errorf("invalid restart condition %q", service.RestartPolicy.Condition)
+	}
+	if service.RestartPolicy.Delay != "" {
+		if _, err := time.ParseDuration(service.RestartPolicy.Delay); err != nil {
+			return fmt.Errorf("invalid restart delay: %v", err)
+		}
+	}
+	switch service.UpdateConfig.FailureAction {
+	case "", UpdateFailurePause, UpdateFailureContinue, UpdateFailureRollback:
+	default:
+		return fmt.Errorf("invalid update failure action %q", service.UpdateConfig.FailureAction)
+	}
+	if service.UpdateConfig.Parallelism < 0 || service.UpdateConfig.Delay < 0 || service.UpdateConfig.Monitor < 0 {
+		return fmt.Errorf("update parallelism, delay and monitor must not be negative")
+	}
+	if ratio := service.UpdateConfig.MaxFailureRatio; ratio < 0 || ratio > 1 {
+		return fmt.Errorf("update max failure ratio must be between 0 and 1")
+	}
+
+	// The tasks of the service have to be valid too
+	return sm.manager.TaskManager.validateTask(service.newTask(1))
+}
+
+// GetService finds a service by ID, name or unique ID prefix.
+func (sm *ServiceManager) GetService(ref string) (*Service, error) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	service, err := sm.lookup(ref)
+	if err != nil {
+		return nil, err
+	}
+	result := *service
+	return &result, nil
+}
+
+// lookup finds a service. Callers hold sm.mu.
+func (sm *ServiceManager) lookup(ref string) (*Service, error) {
+	if service, ok := sm.services[ref]; ok {
+		return service, nil
+	}
+	var found *Service
+	for id, service := range sm.services {
+		if service.Name == ref {
+			return service, nil
+		}
+		if strings.HasPrefix(id, ref) {
+			if found != nil {
+				return nil, fmt.Errorf("service reference %s is ambiguous", ref)
+			}
+			found = service
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("service not found: %s", ref)
+	}
+	return found, nil
+}
+
+// ListServices returns the services sorted by name.
+func (sm *ServiceManager) ListServices() []*Service {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	services := make([]*Service, 0, len(sm.services))
+	for _, service := range sm.services {
+		result := *service
+		services = append(services, &result)
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+	return services
+}
+
+// ScaleService changes how many replicas of a service run.
+func (sm *ServiceManager) ScaleService(ref string, replicas int) (*Service, error) {
+	if replicas < 0 {
+		return nil, fmt.Errorf("replicas must not be negative")
+	}
+
+	sm.mu.Lock()
+	service, err := sm.lookup(ref)
+	if err != nil {
+		sm.mu.Unlock()
+		return nil, err
+	}
+	service.Replicas = replicas
+	service.UpdatedAt = sm.manager.Clock.Now()
+	sm.manager.State.putService(service)
+	result := *service
+	sm.mu.Unlock()
+
+	logrus.Infof("Scaled service %s to %d replica(s)", result.Name, replicas)
+	sm.wake()
+	return &result, nil
+}
+
+// SetMaxUnavailable changes the disruption budget of a service. Like
+// scaling, it leaves the tasks and the service's version alone.
+func (sm *ServiceManager) SetMaxUnavailable(ref string, maxUnavailable int) (*Service, error) {
+	if maxUnavailable < 0 {
+		return nil, fmt.Errorf("max unavailable must not be negative")
+	}
+
+	sm.mu.Lock()
+	service, err := sm.lookup(ref)
+	if err != nil {
+		sm.mu.Unlock()
+		return nil, err
+	}
+	service.MaxUnavailable = maxUnavailable
+	service.UpdatedAt = sm.manager.Clock.Now()
+	sm.manager.State.putService(service)
+	result := *service
+	sm.mu.Unlock()
+
+	if maxUnavailable > 0 {
+		logrus.Infof("Service %s allows %d unavailable replica(s) during disruptions", result.Name, maxUnavailable)
+	} else {
+		logrus.Infof("Removed the disruption budget of service %s", result.Name)
+	}
+	return &result, nil
+}
+
+// UpdateService replaces the spec of a service and starts rolling its
+// tasks over to it, as the spec's UpdateConfig says. The replaced spec is
+// kept for RollbackService. Updating a service to the spec it has still
+// replaces all of its tasks.
+func (sm *ServiceManager) UpdateService(ref string, spec *Service) (*Service, error) {
+	sm.mu.Lock()
+	service, err := sm.lookup(ref)
+	if err != nil {
+		sm.mu.Unlock()
+		return nil, err
+	}
+	if spec.Name != "" && spec.Name != service.Name {
+		sm.mu.Unlock()
+		return nil, fmt.Errorf("services cannot be renamed")
+	}
+
+	updated := *spec
+	updated.ID = service.ID
+	updated.Name = service.Name
+	updated.CreatedAt = service.CreatedAt
+	if err := sm.validateService(&updated); err != nil {
+		sm.mu.Unlock()
+		return nil, fmt.Errorf("service validation failed: %v", err)
+	}
+	updated.Version = service.Version + 1
+	updated.SpecVersion = updated.Version
+	result := sm.replaceSpec(service, &updated, UpdateStateUpdating, "update in progress")
+	sm.mu.Unlock()
+
+	logrus.Infof("Updating service %s to version %d", result.Name, result.Version)
+	sm.wake()
+	return result, nil
+}
+
+// RollbackService returns a service to its spec before the last update
+// and rolls its tasks back to it.
+func (sm *ServiceManager) RollbackService(ref string) (*Service, error) {
+	sm.mu.Lock()
+	service, err := sm.lookup(ref)
+	if err != nil {
+		sm.mu.Unlock()
+		return nil, err
+	}
+	if service.PreviousSpec == nil {
+		sm.mu.Unlock()
+		return nil, fmt.Errorf("service %s has no previous spec to roll back to", service.Name)
+	}
+	result := sm.rollback(service, "rollback requested")
+	sm.mu.Unlock()
+
+	sm.wake()
+	return result, nil
+}
+
+// rollback swaps a service's spec for its previous one. Callers hold
+// sm.mu.
+func (sm *ServiceManager) rollback(service *Service, message string) *Service {
+	rolled := *service.PreviousSpec
+	rolled.Version = service.Version + 1
+	logrus.Infof("Rolling service %s back to the spec of version %d: %s", service.Name, rolled.SpecVersion, message)
+	return sm.replaceSpec(service, &rolled, UpdateStateRollbackStarted, message)
+}
+
+// replaceSpec stores the next spec of a service, keeping the current one
+// as its previous spec, and returns a copy. Callers hold sm.mu.
+func (sm *ServiceManager) replaceSpec(service, next *Service, state UpdateState, message string) *Service {
+	now := sm.manager.Clock.Now()
+	previous := *service
+	previous.PreviousSpec = nil
+	previous.UpdateStatus = nil
+
+	next.PreviousSpec = &previous
+	next.UpdateStatus = &UpdateStatus{State: state, StartedAt: now, Message: message}
+	next.UpdatedAt = now
+	sm.services[service.ID] = next
+	delete(sm.unhealthy, service.ID)
+	sm.manager.State.putService(next)
+
+	result := *next
+	return &result
+}
+
+// setUpdateState records how the update of a service goes on, unless the
+// service changed since the reconciler looked at it.
+func (sm *ServiceManager) setUpdateState(serviceID string, version uint64, state UpdateState, message string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	service, ok := sm.services[serviceID]
+	if !ok || service.Version != version || service.UpdateStatus == nil {
+		return
+	}
+	status := *service.UpdateStatus
+	status.State = state
+	status.Message = message
+	if state == UpdateStateCompleted || state == UpdateStateRollbackCompleted {
+		status.CompletedAt = sm.manager.Clock.Now()
+	}
+	service.UpdateStatus = &status
+	sm.manager.State.putService(service)
+	logrus.Infof("Update of service %s is %s: %s", service.Name, state, message)
+}
+
+// taskUnhealthy records that a task failed a health probe, which fails
+// the task during an update of its service.
+func (sm *ServiceManager) taskUnhealthy(serviceID, taskID string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if _, ok := sm.services[serviceID]; !ok {
+		return
+	}
+	if sm.unhealthy[serviceID] == nil {
+		sm.unhealthy[serviceID] = make(map[string]bool)
+	}
+	sm.unhealthy[serviceID][taskID] = true
+}
+
+func (sm *ServiceManager) isUnhealthy(serviceID, taskID string) bool {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return sm.unhealthy[serviceID][taskID]
+}
+
+// RemoveService removes a service and shuts its tasks down.
+func (sm *ServiceManager) RemoveService(ref string) error {
+	sm.mu.Lock()
+	service, err := sm.lookup(ref)
+	if err != nil {
+		sm.mu.Unlock()
+		return err
+	}
+	delete(sm.services, service.ID)
+	delete(sm.unhealthy, service.ID)
+	sm.manager.State.deleteService(service.ID)
+	sm.mu.Unlock()
+
+	for _, task := range sm.ServiceTasks(service.ID) {
+		if isTerminalTaskStatus(task.Status) {
+			if err := sm.manager.TaskManager.RemoveTask(task.ID); err != nil {
+				logrus.Warnf("Failed to remove task %s: %v", task.ID, err)
+			}
+			continue
+		}
+		if err := sm.manager.TaskManager.ShutdownTask(task.ID); err != nil {
+			logrus.Warnf("Failed to shut down task %s: %v", task.ID, err)
+		}
+	}
+
+	logrus.Infof("Removed service %s (%s)", service.Name, service.ID)
+	return nil
+}
+
+// ServiceTasks returns copies of the tasks of a service by slot, newest
+// first within a slot.
+func (sm *ServiceManager) ServiceTasks(serviceID string) []*Task {
+	tm := sm.manager.TaskManager
+	tm.mu.RLock()
+	var tasks []*Task
+	for _, task := range tm.tasks {
+		if task.ServiceID == serviceID {
+			copied := *task
+			tasks = append(tasks, &copied)
+		}
+	}
+	tm.mu.RUnlock()
+
+	sort.Slice(tasks, func(i, j int) bool {
+		if tasks[i].Slot != tasks[j].Slot {
+			return tasks[i].Slot < tasks[j].Slot
+		}
+		return tasks[i].CreatedAt.After(tasks[j].CreatedAt)
+	})
+	return tasks
+}
+
+// RunningReplicas counts the tasks of a service that are running.
+func (sm *ServiceManager) RunningReplicas(serviceID string) int {
+	running := 0
+	for _, task := range sm.ServiceTasks(serviceID) {
+		if task.Status == TaskRunning && task.DesiredState == TaskRunning {
+			running++
+		}
+	}
+	return running
+}
+
+func (sm *ServiceManager) reconcileAll() {
+	for _, service := range sm.ListServices() {
+		sm.reconcile(service)
+	}
+}
+
+// reconcile starts a task in every slot of the service that has none,
+// as far as the restart policy allows, and shuts down the tasks of slots
+// past the replica count and duplicates within a slot.
+func (sm *ServiceManager) reconcile(service *Service) {
+	sm.progressUpdate(service)
+
+	slots := make(map[int][]*Task)
+	for _, task := range sm.ServiceTasks(service.ID) {
+		slots[task.Slot] = append(slots[task.Slot], task)
+	}
+
+	for slot := 1; slot <= service.Replicas; slot++ {
+		tasks := slots[slot]
+		live := 0
+		for _, task := range tasks {
+			if task.DesiredState != TaskRunning || isTerminalTaskStatus(task.Status) {
+				continue
+			}
+			// Tasks are newest first; older ones in the slot are extra
+			if live++; live > 1 {
+				sm.shutdown(task)
+			}
+		}
+		if live == 0 && sm.shouldRestart(service, tasks) {
+			sm.startTask(service, slot)
+		}
+	}
+
+	for slot, tasks := range slots {
+		if slot > service.Replicas {
+			for _, task := range tasks {
+				if task.DesiredState == TaskRunning && !isTerminalTaskStatus(task.Status) {
+					sm.shutdown(task)
+				}
+			}
+		}
+		sm.pruneHistory(service, tasks)
+	}
+}
+
+// progressUpdate moves the update of a service on: it shuts down the next
+// batch of tasks still running an older spec, for reconcile to replace,
+// once the tasks of the last batch have run for the monitor period and
+// the update delay has passed. Batches are held back by the service's
+// disruption budget and, for updates, while its SLO pauses them. When
+// too many new tasks fail it takes the update's failure action.
+func (sm *ServiceManager) progressUpdate(service *Service) {
+	status := service.UpdateStatus
+	if status == nil || (status.State != UpdateStateUpdating && status.State != UpdateStateRollbackStarted) {
+		return
+	}
+	rollingBack := status.State == UpdateStateRollbackStarted
+
+	config := service.UpdateConfig
+	parallelism := config.Parallelism
+	if parallelism <= 0 {
+		parallelism = 1
+	}
+	monitor := config.Monitor
+	if monitor == 0 {
+		monitor = defaultUpdateMonitor
+	}
+
+	now := sm.manager.Clock.Now()
+	var outdated []*Task
+	var lastUpdated time.Time
+	inFlight, failures := 0, 0
+	for _, task := range sm.ServiceTasks(service.ID) {
+		if task.ServiceVersion != service.SpecVersion {
+			if task.Slot <= service.Replicas && task.DesiredState == TaskRunning && !isTerminalTaskStatus(task.Status) {
+				outdated = append(outdated, task)
+			}
+			continue
+		}
+		// Tasks that already ran this spec before a rollback are kept
+		if task.CreatedAt.Before(status.StartedAt) {
+			continue
+		}
+		switch {
+		case task.Status == TaskFailed || task.Status == TaskRejected || sm.isUnhealthy(service.ID, task.ID):
+			failures++
+		case task.DesiredState != TaskRunning || isTerminalTaskStatus(task.Status):
+		case task.Status != TaskRunning || now.Sub(task.StartedAt) < monitor:
+			inFlight++
+		default:
+			if updated := task.StartedAt.Add(monitor); updated.After(lastUpdated) {
+				lastUpdated = updated
+			}
+		}
+	}
+
+	if failures > int(config.MaxFailureRatio*float64(service.Replicas)) && config.FailureAction != UpdateFailureContinue {
+		message := fmt.Sprintf("%d task(s) failed", failures)
+		switch {
+		case rollingBack:
+			sm.setUpdateState(service.ID, service.Version, UpdateStateRollbackPaused, "rollback paused: "+message)
+		case config.FailureAction == UpdateFailureRollback && service.PreviousSpec != nil:
+			sm.mu.Lock()
+			if current, ok := sm.services[service.ID]; ok && current.Version == service.Version {
+				sm.rollback(current, "update failed: "+message)
+			}
+			sm.mu.Unlock()
+		default:
+			sm.setUpdateState(service.ID, service.Version, UpdateStatePaused, "update paused: "+message)
+		}
+		return
+	}
+
+	if inFlight > 0 {
+		return
+	}
+	if len(outdated) == 0 {
+		if rollingBack {
+			sm.setUpdateState(service.ID, service.Version, UpdateStateRollbackCompleted, "rollback completed")
+		} else {
+			sm.setUpdateState(service.ID, service.Version, UpdateStateCompleted, "update completed")
+		}
+		return
+	}
+	if now.Sub(lastUpdated) < config.Delay {
+		return
+	}
+
+	held, progressing := "update held", "update in progress"
+	if rollingBack {
+		held, progressing = "rollback held", "rollback in progress"
+	}
+	// Rollbacks return to a spec that worked, and failing updates spend
+	// the error budget, so only updates wait for it
+	if !rollingBack && sm.manager.SLOs.UpdatesPaused(service.ID) {
+		sm.noteUpdate(service, held+": error budget exhausted")
+		return
+	}
+
+	if len(outdated) > parallelism {
+		outdated = outdated[:parallelism]
+	}
+	replaced := 0
+	for _, task := range outdated {
+		// A replaced task is down until its replacement runs
+		if err := sm.manager.Budgets.CheckTask(task); err != nil {
+			if replaced == 0 {
+				sm.noteUpdate(service, held+": "+err.Error())
+			}
+			break
+		}
+		logrus.Infof("Replacing task %s of service %s with version %d", task.ID, service.Name, service.SpecVersion)
+		sm.shutdown(task)
+		replaced++
+	}
+	if replaced > 0 && strings.HasPrefix(status.Message, held) {
+		sm.noteUpdate(service, progressing)
+	}
+}
+
+// noteUpdate records why the update of a service waits, or that it goes
+// on again, leaving its state alone.
+func (sm *ServiceManager) noteUpdate(service *Service, message string) {
+	if service.UpdateStatus.Message == message {
+		return
+	}
+	sm.setUpdateState(service.ID, service.Version, service.UpdateStatus.State, message)
+}
+
+// shouldRestart reports whether an empty slot gets a new task. The slot's
+// tasks are newest first.
+func (sm *ServiceManager) shouldRestart(service *Service, tasks []*Task) bool {
+	var last *Task
+	ended := 0
+	for _, task := range tasks {
+		// Tasks shut down by the cluster don't count against the policy
+		if task.DesiredState != TaskRunning {
+			continue
+		}
+		if task.Status == TaskComplete || task.Status == TaskFailed || task.Status == TaskRejected {
+			if last == nil {
+				last = task
+			}
+			ended++
+		}
+	}
+	if last == nil {
+		return true
+	}
+
+	policy := service.RestartPolicy
+	switch policy.Condition {
+	case RestartConditionNone:
+		return false
+	case RestartConditionOnFailure:
+		if last.Status == TaskComplete {
+			return false
+		}
+	}
+	if policy.MaxAttempts > 0 && ended > policy.MaxAttempts {
+		return false
+	}
+
+	delay := defaultRestartDelay
+	if policy.Delay != "" {
+		delay, _ = time.ParseDuration(policy.Delay)
+	}
+	// Tasks that never got to a node have no completion time
+	endedAt := last.CompletedAt
+	if endedAt.IsZero() {
+		endedAt = last.UpdatedAt
+	}
+	return sm.manager.Clock.Since(endedAt) >= delay
+}
+
+// pruneHistory removes the oldest ended tasks of a slot beyond what is
+// kept for `service ps` and the restart policy.
+func (sm *ServiceManager) pruneHistory(service *Service, tasks []*Task) {
+	keep := serviceTaskHistory
+	if service.RestartPolicy.MaxAttempts >= keep {
+		keep = service.RestartPolicy.MaxAttempts + 1
+	}
+
+	ended := 0
+	for _, task := range tasks {
+		if !isTerminalTaskStatus(task.Status) {
+			continue
+		}
+		if ended++; ended > keep {
+			if err := sm.manager.TaskManager.RemoveTask(task.ID); err != nil {
+				logrus.Warnf("Failed to remove task %s of service %s: %v", task.ID, service.Name, err)
+			}
+		}
+	}
+}
+
+func (sm *ServiceManager) startTask(service *Service, slot int) {
+	task := service.newTask(slot)
+	logrus.Infof("Starting task %s for slot %d of service %s", task.ID, slot, service.Name)
+	if err := sm.manager.TaskManager.CreateTask(task); err != nil {
+		logrus.Errorf("Failed to create task for service %s: %v", service.Name, err)
+	}
+}
+
+func (sm *ServiceManager) shutdown(task *Task) {
+	if err := sm.manager.TaskManager.ShutdownTask(task.ID); err != nil {
+		logrus.Errorf("Failed to shut down task %s: %v", task.ID, err)
+	}
+}
+
+// newTask makes the task for a slot of the service.
+func (s *Service) newTask(slot int) *Task {
+	task := &Task{
+		ID:               generateTaskID(),
+		Name:             fmt.Sprintf("%s.%d", s.Name, slot),
+		Type:             TaskTypeService,
+		Image:            s.Image,
+		Command:          append([]string(nil), s.Command...),
+		Env:              append([]string(nil), s.Env...),
+		Resources:        s.Resources,
+		Constraints:      append([]Constraint(nil), s.Constraints...),
+		Placement:        s.Placement,
+		RestartPolicy:    s.RestartPolicy,
+		Networks:         append([]NetworkConfig(nil), s.Networks...),
+		Ports:            append([]PortConfig(nil), s.Ports...),
+		ServiceID:        s.ID,
+		ServiceVersion:   s.SpecVersion,
+		ServiceName:      s.Name,
+		Slot:             slot,
+		Namespace:        s.Namespace,
+		MetadataEnv:      s.MetadataEnv,
+		HostnameTemplate: s.HostnameTemplate,
+	}
+	if s.Labels != nil {
+		task.Labels = make(map[string]string, len(s.Labels))
+		for key, value := range s.Labels {
+			task.Labels[key] = value
+		}
+	}
+	return task
+}
+
+func generateServiceID() string {
+	return ids.NewID("service")
+}
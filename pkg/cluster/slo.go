@@ -0,0 +1,292 @@
+package cluster
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// defaultSLOWindow is the rolling window of services without a policy
+const defaultSLOWindow = time.Hour
+
+// SLOPolicy sets the objective a service is held to. Task starts and
+// health probes are the events it is measured by: a failed start or probe
+// spends the error budget, which is the share of events allowed to fail.
+type SLOPolicy struct {
+	// Objective is the share of events that must succeed, e.g. 0.99
+	Objective float64 `json:"objective"`
+	// Window is how far back events count (default 1h)
+	Window time.Duration `json:"window,omitempty"`
+	// PauseUpdates holds back rolling restarts and rebalancing of the
+	// service while its error budget is exhausted
+	PauseUpdates bool `json:"pause_updates,omitempty"`
+}
+
+type sloEventKind int
+
+const (
+	sloTaskStarted sloEventKind = iota
+	sloTaskFailed
+	sloProbePassed
+	sloProbeFailed
+	sloTaskRestarted
+)
+
+type sloEvent struct {
+	at   time.Time
+	kind sloEventKind
+}
+
+// SLOStatus is how a service did over its window.
+type SLOStatus struct {
+	ServiceID     string        `json:"service_id"`
+	Window        time.Duration `json:"window"`
+	TaskStarts    int           `json:"task_starts"`
+	TaskFailures  int           `json:"task_failures"`
+	ProbeChecks   int           `json:"probe_checks"`
+	ProbeFailures int           `json:"probe_failures"`
+	Restarts      int           `json:"restarts"`
+	// FailureRate is the share of task starts and probes that failed
+	FailureRate float64 `json:"failure_rate"`
+	Objective   float64 `json:"objective,omitempty"`
+	// BudgetRemaining is the share of the error budget left, down to 0
+	BudgetRemaining float64 `json:"budget_remaining"`
+	Exhausted       bool    `json:"exhausted"`
+	UpdatesPaused   bool    `json:"updates_paused"`
+}
+
+// SLOTracker records how the tasks of each service fare over rolling
+// windows. Every service is tracked; a policy adds an objective to
+// measure against.
+type SLOTracker struct {
+	manager *ClusterManager
+	// policies holds the SLO policy of each service by service ID
+	policies map[string]SLOPolicy
+	// events holds the events within the window by service ID
+	events map[string][]sloEvent
+	mu     sync.Mutex
+}
+
+func NewSLOTracker(manager *ClusterManager) *SLOTracker {
+	return &SLOTracker{
+		manager:  manager,
+		policies: make(map[string]SLOPolicy),
+		events:   make(map[string][]sloEvent),
+	}
+}
+
+// SetPolicy sets the SLO of a service; an objective of zero removes it.
+func (s *SLOTracker) SetPolicy(serviceID string, policy SLOPolicy) error {
+	if serviceID == "" {
+		return fmt.Errorf("service ID is required")
+	}
+	if policy.Objective < 0 || policy.Objective >= 1 {
+		return fmt.Errorf("objective must be at least 0 and below 1")
+	}
+	if policy.Window < 0 {
+		return fmt.Errorf("window must not be negative")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if policy.Objective == 0 {
+		delete(s.policies, serviceID)
+		return nil
+	}
+	if policy.Window == 0 {
+		policy.Window = defaultSLOWindow
+	}
+	s.policies[serviceID] = policy
+
+	logrus.Infof("Service %s has an objective of %.4g%% over %s", serviceID, policy.Objective*100, policy.Window)
+	return nil
+}
+
+// GetPolicy returns the SLO policy of a service, or a zero one.
+func (s *SLOTracker) GetPolicy(serviceID string) SLOPolicy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.policies[serviceID]
+}
+
+func (s *SLOTracker) window(serviceID string) time.Duration {
+	if policy, ok := s.policies[serviceID]; ok {
+		return policy.Window
+	}
+	return defaultSLOWindow
+}
+
+func (s *SLOTracker) record(task *Task, kind sloEventKind) {
+	if task.ServiceID == "" {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.manager.Clock.Now()
+	s.events[task.ServiceID] = append(s.prune(task.ServiceID, now), sloEvent{at: now, kind: kind})
+}
+
+// prune drops the events of a service that fell out of its window.
+func (s *SLOTracker) prune(serviceID string, now time.Time) []sloEvent {
+	events := s.events[serviceID]
+	cutoff := now.Add(-s.window(serviceID))
+	i := sort.Search(len(events), func(i int) bool { return events[i].at.After(cutoff) })
+	events = events[i:]
+	if len(events) == 0 {
+		delete(s.events, serviceID)
+	} else {
+		s.events[serviceID] = events
+	}
+	return events
+}
+
+// TaskStatusChanged records the start or failure of a task.
+func (s *SLOTracker) TaskStatusChanged(task *Task, status TaskStatus) {
+	switch status {
+	case TaskRunning:
+		s.record(task, sloTaskStarted)
+	case TaskFailed, TaskRejected:
+		s.record(task, sloTaskFailed)
+	}
+}
+
+// TaskRestarted records that a task was replaced.
+func (s *SLOTracker) TaskRestarted(task *Task) {
+	s.record(task, sloTaskRestarted)
+}
+
+// ProbeResult records the outcome of a health probe of a task.
+func (s *SLOTracker) ProbeResult(task *Task, healthy bool) {
+	if healthy {
+		s.record(task, sloProbePassed)
+	} else {
+		s.record(task, sloProbeFailed)
+	}
+}
+
+// Status reports how a service did over its window.
+func (s *SLOTracker) Status(serviceID string) *SLOStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status(serviceID)
+}
+
+func (s *SLOTracker) status(serviceID string) *SLOStatus {
+	policy, hasPolicy := s.policies[serviceID]
+	status := &SLOStatus{
+		ServiceID:       serviceID,
+		Window:          s.window(serviceID),
+		Objective:       policy.Objective,
+		BudgetRemaining: 1,
+	}
+
+	for _, event := range s.prune(serviceID, s.manager.Clock.Now()) {
+		switch event.kind {
+		case sloTaskStarted:
+			status.TaskStarts++
+		case sloTaskFailed:
+			status.TaskFailures++
+		case sloProbePassed:
+			status.ProbeChecks++
+		case sloProbeFailed:
+			status.ProbeChecks++
+			status.ProbeFailures++
+		case sloTaskRestarted:
+			status.Restarts++
+		}
+	}
+
+	total := status.TaskStarts + status.TaskFailures + status.ProbeChecks
+	if total > 0 {
+		status.FailureRate = float64(status.TaskFailures+status.ProbeFailures) / float64(total)
+	}
+	if hasPolicy {
+		budget := 1 - policy.Objective
+		status.BudgetRemaining = 1 - status.FailureRate/budget
+		if status.BudgetRemaining <= 0 {
+			status.BudgetRemaining = 0
+			status.Exhausted = true
+		}
+		status.UpdatesPaused = status.Exhausted && policy.PauseUpdates
+	}
+	return status
+}
+
+// UpdatesPaused reports whether automatic updates of a service are held
+// back because it ran out of error budget.
+func (s *SLOTracker) UpdatesPaused(serviceID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.policies[serviceID]; !ok {
+		return false
+	}
+	return s.status(serviceID).UpdatesPaused
+}
+
+// List reports every service with a policy or events in its window,
+// ordered by service ID.
+func (s *SLOTracker) List() []*SLOStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	serviceIDs := make(map[string]bool)
+	for serviceID := range s.policies {
+		serviceIDs[serviceID] = true
+	}
+	for serviceID := range s.events {
+		serviceIDs[serviceID] = true
+	}
+
+	statuses := make([]*SLOStatus, 0, len(serviceIDs))
+	for serviceID := range serviceIDs {
+		statuses = append(statuses, s.status(serviceID))
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ServiceID < statuses[j].ServiceID })
+	return statuses
+}
+
+// WriteMetrics writes the status of every service in the Prometheus text
+// format.
+func (s *SLOTracker) WriteMetrics(w io.Writer) error {
+	statuses := s.List()
+	metrics := []struct {
+		name  string
+		kind  string
+		help  string
+		value func(*SLOStatus) float64
+	}{
+		{"mydocker_service_task_starts", "gauge", "Task starts within the SLO window.",
+			func(s *SLOStatus) float64 { return float64(s.TaskStarts) }},
+		{"mydocker_service_task_failures", "gauge", "Task failures within the SLO window.",
+			func(s *SLOStatus) float64 { return float64(s.TaskFailures) }},
+		{"mydocker_service_probe_checks", "gauge", "Health probes within the SLO window.",
+			func(s *SLOStatus) float64 { return float64(s.ProbeChecks) }},
+		{"mydocker_service_probe_failures", "gauge", "Failed health probes within the SLO window.",
+			func(s *SLOStatus) float64 { return float64(s.ProbeFailures) }},
+		{"mydocker_service_restarts", "gauge", "Task restarts within the SLO window.",
+			func(s *SLOStatus) float64 { return float64(s.Restarts) }},
+		{"mydocker_service_failure_rate", "gauge", "Share of task starts and probes that failed.",
+			func(s *SLOStatus) float64 { return s.FailureRate }},
+		{"mydocker_service_error_budget_remaining", "gauge", "Share of the error budget left.",
+			func(s *SLOStatus) float64 { return s.BudgetRemaining }},
+	}
+
+	for _, metric := range metrics {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind); err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			if _, err := fmt.Fprintf(w, "%s{service=%q} %g\n", metric.name, status.ServiceID, metric.value(status)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,522 @@
+package cluster
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	stateLogFile      = "state.log"
+	stateSnapshotFile = "state.snapshot.json"
+
+	// snapshotThreshold is how many log entries are written before the
+	// state is snapshotted and the log started over
+	snapshotThreshold = 1000
+)
+
+// Operations recorded in the state log
+const (
+	opCluster       = "cluster"
+	opPutNode       = "put-node"
+	opDeleteNode    = "delete-node"
+	opPutTask       = "put-task"
+	opDeleteTask    = "delete-task"
+	opTokens        = "tokens"
+	opPutService    = "put-service"
+	opDeleteService = "delete-service"
+)
+
+// StateEntry is one change to the cluster state, as appended to the log.
+type StateEntry struct {
+	Index uint64          `json:"index"`
+	Op    string          `json:"op"`
+	ID    string          `json:"id,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+// clusterTokens are the cluster token and, by role, the join tokens and
+// the secrets that sign them.
+type clusterTokens struct {
+	JoinToken  string              `json:"join_token"`
+	JoinTokens map[NodeRole]string `json:"join_tokens,omitempty"`
+	Secrets    map[NodeRole][]byte `json:"secrets,omitempty"`
+	// Secret signed the tokens of every role before each had its own. It
+	// is only read, from state saved by older versions.
+	Secret []byte `json:"secret,omitempty"`
+}
+
+// stateSnapshot is the whole cluster state as of a log index.
+type stateSnapshot struct {
+	Index     uint64                     `json:"index"`
+	ClusterID string                     `json:"cluster_id"`
+	Tokens    *clusterTokens             `json:"tokens,omitempty"`
+	Nodes     map[string]json.RawMessage `json:"nodes"`
+	Tasks     map[string]json.RawMessage `json:"tasks"`
+	Services  map[string]json.RawMessage `json:"services"`
+	// Term counts the take-overs of the cluster, so the state of a
+	// deposed leader is told apart from that of the leader after it
+	Term uint64 `json:"term,omitempty"`
+}
+
+// StateStore keeps the cluster state (nodes, tasks, services and tokens)
+// under the cluster data dir, so a manager comes back with it after a
+// restart. Every change is appended to a log; once the log grows long the
+// state is written to a snapshot and the log starts over. The store keeps the last
+// recorded form of each object, so snapshots never wait on the node and
+// task managers. Only the leader's state is the cluster's; the other
+// managers hold a replica of it, see StateReplicator.
+type StateStore struct {
+	manager *ClusterManager
+	mu      sync.Mutex
+	dir     string
+	log     *os.File
+	// entries counts the log entries written since the last snapshot
+	entries int
+	state   stateSnapshot
+}
+
+func NewStateStore(manager *ClusterManager) *StateStore {
+	return &StateStore{
+		manager: manager,
+		dir:     manager.Config.DataDir,
+		state:   newStateSnapshot(),
+	}
+}
+
+func newStateSnapshot() stateSnapshot {
+	return stateSnapshot{
+		Nodes:    make(map[string]json.RawMessage),
+		Tasks:    make(map[string]json.RawMessage),
+		Services: make(map[string]json.RawMessage),
+	}
+}
+
+// Open reads the snapshot and replays the log after it, restores the
+// cluster from them and starts recording changes. A log cut short by a
+// crash is truncated after its last complete entry.
+func (s *StateStore) Open() error {
+	restored, err := s.open()
+	if err != nil {
+		return err
+	}
+	// Restoring takes the node and task managers' locks, which are held
+	// while recording changes, so it happens outside s.mu
+	if restored != nil {
+		s.restore(restored)
+	}
+	return nil
+}
+
+// open loads the state and starts the log. It returns a copy of the state
+// when there was one to restore.
+func (s *StateStore) open() (*stateSnapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.log != nil {
+		return nil, fmt.Errorf("state store is already open")
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %v", err)
+	}
+	if s.manager.Config.ForceNewCluster {
+		if err := s.takeOver(); err != nil {
+			return nil, err
+		}
+	}
+
+	state := newStateSnapshot()
+	data, err := os.ReadFile(filepath.Join(s.dir, stateSnapshotFile))
+	if err == nil {
+		if err := json.Unmarshal(data, &state); err != nil {
+			return nil, fmt.Errorf("failed to parse state snapshot: %v", err)
+		}
+		if state.Nodes == nil {
+			state.Nodes = make(map[string]json.RawMessage)
+		}
+		if state.Tasks == nil {
+			state.Tasks = make(map[string]json.RawMessage)
+		}
+		if state.Services == nil {
+			state.Services = make(map[string]json.RawMessage)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read state snapshot: %v", err)
+	}
+	s.state = state
+
+	log, err := os.OpenFile(filepath.Join(s.dir, stateLogFile), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state log: %v", err)
+	}
+	replayed, size, err := s.replay(log)
+	if err != nil {
+		log.Close()
+		return nil, err
+	}
+	if err := log.Truncate(size); err != nil {
+		log.Close()
+		return nil, fmt.Errorf("failed to truncate state log: %v", err)
+	}
+	if _, err := log.Seek(size, io.SeekStart); err != nil {
+		log.Close()
+		return nil, fmt.Errorf("failed to seek state log: %v", err)
+	}
+	s.log = log
+	s.entries = replayed
+
+	logrus.Infof("Opened cluster state at index %d (%d nodes, %d tasks, %d services)", s.state.Index, len(s.state.Nodes), len(s.state.Tasks), len(s.state.Services))
+	if s.state.ClusterID == "" {
+		s.append(opCluster, s.manager.ID, nil)
+		s.saveTokens()
+		return nil, nil
+	}
+
+	restored := s.state
+	restored.Nodes = make(map[string]json.RawMessage, len(s.state.Nodes))
+	for id, data := range s.state.Nodes {
+		restored.Nodes[id] = data
+	}
+	restored.Tasks = make(map[string]json.RawMessage, len(s.state.Tasks))
+	for id, data := range s.state.Tasks {
+		restored.Tasks[id] = data
+	}
+	restored.Services = make(map[string]json.RawMessage, len(s.state.Services))
+	for id, data := range s.state.Services {
+		restored.Services[id] = data
+	}
+	return &restored, nil
+}
+
+// replay applies the log entries after the snapshot to the state. It
+// returns how many entries it applied and where the last complete one
+// ends.
+func (s *StateStore) replay(log *os.File) (int, int64, error) {
+	reader := bufio.NewReader(log)
+	var applied int
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				logrus.Warnf("Dropping incomplete entry at the end of the state log")
+			}
+			return applied, offset, nil
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to read state log: %v", err)
+		}
+
+		var entry StateEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			logrus.Warnf("Dropping the state log after offset %d: %v", offset, err)
+			return applied, offset, nil
+		}
+		offset += int64(len(line))
+		if entry.Index <= s.state.Index {
+			continue
+		}
+		s.apply(&entry)
+		applied++
+	}
+}
+
+// apply records an entry in the state.
+func (s *StateStore) apply(entry *StateEntry) {
+	switch entry.Op {
+	case opCluster:
+		s.state.ClusterID = entry.ID
+	case opPutNode:
+		s.state.Nodes[entry.ID] = entry.Data
+	case opDeleteNode:
+		delete(s.state.Nodes, entry.ID)
+	case opPutTask:
+		s.state.Tasks[entry.ID] = entry.Data
+	case opDeleteTask:
+		delete(s.state.Tasks, entry.ID)
+	case opPutService:
+		s.state.Services[entry.ID] = entry.Data
+	case opDeleteService:
+		delete(s.state.Services, entry.ID)
+	case opTokens:
+		var tokens clusterTokens
+		if err := json.Unmarshal(entry.Data, &tokens); err != nil {
+			logrus.Warnf("Skipping state entry %d: %v", entry.Index, err)
+			return
+		}
+		s.state.Tokens = &tokens
+	default:
+		logrus.Warnf("Skipping state entry %d with unknown operation %q", entry.Index, entry.Op)
+		return
+	}
+	s.state.Index = entry.Index
+}
+
+// restore hands the recorded cluster, nodes, tasks, services and tokens
+// to the manager. Tasks that were waiting to be scheduled are queued again.
+func (s *StateStore) restore(state *stateSnapshot) {
+	cm := s.manager
+	cm.ID = state.ClusterID
+	if tokens := state.Tokens; tokens != nil {
+		cm.Config.JoinToken = tokens.JoinToken
+		for role, token := range tokens.JoinTokens {
+			cm.joinTokens[role] = token
+		}
+		for role, secret := range tokens.Secrets {
+			if len(secret) > 0 {
+				cm.joinSecrets[role] = secret
+			}
+		}
+		if len(tokens.Secrets) == 0 && len(tokens.Secret) > 0 {
+			// The secret keeps signing the tokens of both roles until
+			// they are rotated. The cluster token is unchanged, so the
+			// nodes that joined stay in the cluster.
+			logrus.Warnf("Cluster state predates role-scoped join tokens: worker and manager join tokens are signed with its secret until rotated, and join tokens issued before must be replaced")
+			cm.joinSecrets[RoleWorker] = tokens.Secret
+			cm.joinSecrets[RoleManager] = tokens.Secret
+			s.putTokens()
+		}
+	}
+
+	nm := cm.NodeManager
+	nm.mu.Lock()
+	for id, data := range state.Nodes {
+		var node Node
+		if err := json.Unmarshal(data, &node); err != nil {
+			logrus.Warnf("Skipping stored node %s: %v", id, err)
+			continue
+		}
+		node.Manager = cm
+		nm.nodes[id] = &node
+		cm.Metrics.NodeStatusChanged("", node.Status)
+	}
+	nm.mu.Unlock()
+
+	tm := cm.TaskManager
+	var queued []*Task
+	tm.mu.Lock()
+	for id, data := range state.Tasks {
+		var task Task
+		if err := json.Unmarshal(data, &task); err != nil {
+			logrus.Warnf("Skipping stored task %s: %v", id, err)
+			continue
+		}
+		tm.tasks[id] = &task
+		cm.Metrics.TaskStatusChanged("", task.Status)
+		if task.Status == TaskNew || task.Status == TaskPending {
+			queued = append(queued, &task)
+		}
+	}
+	tm.mu.Unlock()
+
+	sm := cm.Services
+	sm.mu.Lock()
+	for id, data := range state.Services {
+		var service Service
+		if err := json.Unmarshal(data, &service); err != nil {
+			logrus.Warnf("Skipping stored service %s: %v", id, err)
+			continue
+		}
+		sm.services[id] = &service
+	}
+	sm.mu.Unlock()
+
+	sort.Slice(queued, func(i, j int) bool { return queued[i].CreatedAt.Before(queued[j].CreatedAt) })
+	for _, task := range queued {
+		select {
+		case tm.queue <- task:
+		default:
+			go func(task *Task) { tm.queue <- task }(task)
+		}
+	}
+}
+
+// putNode records the node as it is now. Callers hold the node manager's
+// lock, so the node does not change while it is encoded.
+func (s *StateStore) putNode(node *Node) {
+	s.put(opPutNode, node.ID, node)
+}
+
+func (s *StateStore) deleteNode(nodeID string) {
+	s.put(opDeleteNode, nodeID, nil)
+}
+
+// putTask records the task as it is now. Callers hold the task manager's
+// lock.
+func (s *StateStore) putTask(task *Task) {
+	s.put(opPutTask, task.ID, task)
+}
+
+func (s *StateStore) deleteTask(taskID string) {
+	s.put(opDeleteTask, taskID, nil)
+}
+
+// putService records the service as it is now. Callers hold the service
+// manager's lock.
+func (s *StateStore) putService(service *Service) {
+	s.put(opPutService, service.ID, service)
+}
+
+func (s *StateStore) deleteService(serviceID string) {
+	s.put(opDeleteService, serviceID, nil)
+}
+
+// putTokens records the manager's join token and signing secret. Callers
+// hold the manager's lock.
+func (s *StateStore) putTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.log != nil {
+		s.saveTokens()
+	}
+}
+
+func (s *StateStore) saveTokens() {
+	data, err := json.Marshal(&clusterTokens{
+		JoinToken:  s.manager.Config.JoinToken,
+		JoinTokens: s.manager.joinTokens,
+		Secrets:    s.manager.joinSecrets,
+	})
+	if err != nil {
+		logrus.Errorf("Failed to encode join tokens: %v", err)
+		return
+	}
+	s.append(opTokens, "", data)
+}
+
+func (s *StateStore) put(op, id string, value interface{}) {
+	if s == nil {
+		return
+	}
+	var data json.RawMessage
+	if value != nil {
+		var err error
+		if data, err = json.Marshal(value); err != nil {
+			logrus.Errorf("Failed to encode %s %s: %v", op, id, err)
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Changes made before the store is opened are part of starting up,
+	// e.g. registering the local node, and are recorded again later
+	if s.log == nil {
+		return
+	}
+	s.append(op, id, data)
+}
+
+// append writes an entry to the log and applies it, snapshotting once
+// enough entries have been written. Callers hold s.mu.
+func (s *StateStore) append(op, id string, data json.RawMessage) {
+	entry := StateEntry{Index: s.state.Index + 1, Op: op, ID: id, Data: data}
+	line, err := json.Marshal(&entry)
+	if err != nil {
+		logrus.Errorf("Failed to encode state entry: %v", err)
+		return
+	}
+	if _, err := s.log.Write(append(line, '\n')); err != nil {
+		logrus.Errorf("Failed to write state entry %d: %v", entry.Index, err)
+		return
+	}
+	if err := s.log.Sync(); err != nil {
+		logrus.Errorf("Failed to sync state log: %v", err)
+	}
+	s.apply(&entry)
+	s.manager.Replicator.notify()
+
+	s.entries++
+	if s.entries >= snapshotThreshold {
+		if err := s.snapshot(); err != nil {
+			logrus.Errorf("Failed to snapshot cluster state: %v", err)
+		}
+	}
+}
+
+// Snapshot writes the whole state to the snapshot and starts the log
+// over.
+func (s *StateStore) Snapshot() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.log == nil {
+		return fmt.Errorf("state store is not open")
+	}
+	return s.snapshot()
+}
+
+func (s *StateStore) snapshot() error {
+	data, err := json.Marshal(&s.state)
+	if err != nil {
+		return fmt.Errorf("failed to encode state snapshot: %v", err)
+	}
+
+	// The snapshot replaces the old one only once it is complete, and the
+	// log is emptied only after that; entries it still holds are at or
+	// below the snapshot's index and skipped on replay
+	path := filepath.Join(s.dir, stateSnapshotFile)
+	tmpPath := path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write state snapshot: %v", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write state snapshot: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write state snapshot: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write state snapshot: %v", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to write state snapshot: %v", err)
+	}
+
+	if err := s.log.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate state log: %v", err)
+	}
+	if _, err := s.log.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek state log: %v", err)
+	}
+	s.entries = 0
+
+	logrus.Debugf("Snapshotted cluster state at index %d", s.state.Index)
+	return nil
+}
+
+// Index returns the index of the last change recorded.
+func (s *StateStore) Index() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state.Index
+}
+
+// Close snapshots the state and stops recording changes.
+func (s *StateStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.log == nil {
+		return nil
+	}
+	err := s.snapshot()
+	if closeErr := s.log.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("failed to close state log: %v", closeErr)
+	}
+	s.log = nil
+	return err
+}
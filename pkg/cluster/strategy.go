@@ -0,0 +1,185 @@
+package cluster
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// Built-in scheduling strategies
+const (
+	// StrategySpread balances tasks over the nodes by count
+	StrategySpread = "spread"
+	// StrategyBinpack fills the busiest node that still fits the task
+	StrategyBinpack = "binpack"
+	// StrategyRandom places tasks on any node that fits them
+	StrategyRandom = "random"
+
+	defaultSchedulingStrategy = StrategySpread
+)
+
+// SchedulingStrategy ranks the nodes that may run a task. It sees the
+// nodes that passed placement and the scheduler plugins, and its score
+// is added to theirs.
+type SchedulingStrategy interface {
+	Name() string
+	// Score rates a node from 0 to 1, higher being better
+	Score(task *Task, node *Node, usage NodeUsage) float64
+}
+
+// NodeUsage is what the tasks placed on a node take from it.
+type NodeUsage struct {
+	// Tasks counts the tasks meant to run on the node
+	Tasks int `json:"tasks"`
+	// Reserved is what those tasks reserve
+	Reserved Resources `json:"reserved"`
+	// Used is what they were last seen using, counting a task as using
+	// at least its reservation
+	Used Resources `json:"used"`
+}
+
+// free is the share of the node's CPU and memory left once the task
+// runs there, by what its tasks use.
+func (u NodeUsage) free(node *Node, task *Task) float64 {
+	cpu := freeShare(node.Resources.CPU, u.Used.CPU+task.Resources.CPU)
+	memory := freeShare(node.Resources.Memory, u.Used.Memory+task.Resources.Memory)
+	return (cpu + memory) / 2
+}
+
+func freeShare(capacity, used int64) float64 {
+	if capacity <= 0 || used >= capacity {
+		return 0
+	}
+	return float64(capacity-used) / float64(capacity)
+}
+
+type spreadStrategy struct{}
+
+func (spreadStrategy) Name() string {
+	return StrategySpread
+}
+
+// Score favours nodes with fewer tasks; among nodes with as many, the
+// one with most resources free.
+func (spreadStrategy) Score(task *Task, node *Node, usage NodeUsage) float64 {
+	return (1 + usage.free(node, task)) / float64(2*(1+usage.Tasks))
+}
+
+type binpackStrategy struct{}
+
+func (binpackStrategy) Name() string {
+	return StrategyBinpack
+}
+
+// Score favours the nodes with least left once the task runs there, so
+// nodes fill up before the next one is used.
+func (binpackStrategy) Score(task *Task, node *Node, usage NodeUsage) float64 {
+	return 1 - usage.free(node, task)
+}
+
+type randomStrategy struct{}
+
+func (randomStrategy) Name() string {
+	return StrategyRandom
+}
+
+func (randomStrategy) Score(task *Task, node *Node, usage NodeUsage) float64 {
+	return rand.Float64()
+}
+
+// SchedulingStrategies are the strategies tasks may be placed by. A task
+// uses the strategy of its placement, or else the cluster's.
+type SchedulingStrategies struct {
+	manager    *ClusterManager
+	strategies map[string]SchedulingStrategy
+	mu         sync.RWMutex
+}
+
+func NewSchedulingStrategies(manager *ClusterManager) *SchedulingStrategies {
+	s := &SchedulingStrategies{
+		manager:    manager,
+		strategies: make(map[string]SchedulingStrategy),
+	}
+	for _, strategy := range []SchedulingStrategy{spreadStrategy{}, binpackStrategy{}, randomStrategy{}} {
+		s.strategies[strategy.Name()] = strategy
+	}
+	return s
+}
+
+// Register adds a strategy, replacing any of the same name.
+func (s *SchedulingStrategies) Register(strategy SchedulingStrategy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.strategies[strategy.Name()] = strategy
+}
+
+// Names returns the names of the strategies, sorted.
+func (s *SchedulingStrategies) Names() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.strategies))
+	for name := range s.strategies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Get returns the strategy named name; the empty name is the default.
+func (s *SchedulingStrategies) Get(name string) (SchedulingStrategy, error) {
+	if name == "" {
+		name = defaultSchedulingStrategy
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	strategy, ok := s.strategies[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown scheduling strategy %q", name)
+	}
+	return strategy, nil
+}
+
+// forTask returns the strategy a task is placed by.
+func (s *SchedulingStrategies) forTask(task *Task) (SchedulingStrategy, error) {
+	if task.Placement.Strategy != "" {
+		return s.Get(task.Placement.Strategy)
+	}
+	return s.Get(s.manager.Config.SchedulingStrategy)
+}
+
+// nodeUsage sums up, by node ID, the tasks placed on each node that are
+// meant to run, leaving out the task being placed. A task counts as
+// using what it was last seen using, or its reservation if that is more.
+func (tm *TaskManager) nodeUsage(excludeID string) map[string]NodeUsage {
+	readings := tm.manager.Usage.latest()
+
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+
+	usage := make(map[string]NodeUsage)
+	for _, task := range tm.tasks {
+		if task.ID == excludeID || task.NodeID == "" {
+			continue
+		}
+		if task.DesiredState != TaskRunning || isTerminalTaskStatus(task.Status) {
+			continue
+		}
+		used := task.Resources
+		if reading, ok := readings[task.ID]; ok {
+			if reading.cpu > used.CPU {
+				used.CPU = reading.cpu
+			}
+			if reading.memory > used.Memory {
+				used.Memory = reading.memory
+			}
+		}
+
+		u := usage[task.NodeID]
+		u.Tasks++
+		u.Reserved = addResources(u.Reserved, task.Resources)
+		u.Used = addResources(u.Used, used)
+		usage[task.NodeID] = u
+	}
+	return usage
+}
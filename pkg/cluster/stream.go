@@ -0,0 +1,307 @@
+package cluster
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"docker-impl/pkg/timeutil"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	ContentTypeJSON = "application/json"
+	// ContentTypeNDJSON streams one JSON object per line
+	ContentTypeNDJSON = "application/x-ndjson"
+	// ContentTypeProtobuf streams varint length-prefixed messages from
+	// cluster.proto
+	ContentTypeProtobuf = "application/x-protobuf"
+)
+
+const (
+	// streamFlushInterval is how many items are written between flushes,
+	// so clients can start printing before the whole list is sent.
+	streamFlushInterval = 500
+	maxStreamMessage    = 16 << 20
+)
+
+// recordTimeKeys are the timestamps of nodes, tasks and the other records
+// managers exchange. Managers that predate time.Time fields sent them as
+// free-form strings, which are read leniently.
+var recordTimeKeys = []string{"created_at", "updated_at", "last_seen", "started_at", "completed_at", "time"}
+
+// TaskFilter narrows a task list on the server instead of the client.
+type TaskFilter struct {
+	NodeID    string
+	Status    TaskStatus
+	ServiceID string
+	// Created bounds when the task was created
+	Created timeutil.Range
+}
+
+func (f TaskFilter) matches(task *Task) bool {
+	return (f.NodeID == "" || task.NodeID == f.NodeID) &&
+		(f.Status == "" || task.Status == f.Status) &&
+		(f.ServiceID == "" || task.ServiceID == f.ServiceID) &&
+		f.Created.Contains(task.CreatedAt)
+}
+
+func (f TaskFilter) query() url.Values {
+	query := rangeQuery(f.Created)
+	if f.NodeID != "" {
+		query.Set("node", f.NodeID)
+	}
+	if f.Status != "" {
+		query.Set("status", string(f.Status))
+	}
+	if f.ServiceID != "" {
+		query.Set("service", f.ServiceID)
+	}
+	return query
+}
+
+func taskFilterFromQuery(query url.Values, now time.Time) (TaskFilter, error) {
+	created, err := rangeFromQuery(query, now)
+	if err != nil {
+		return TaskFilter{}, err
+	}
+	return TaskFilter{
+		NodeID:    query.Get("node"),
+		Status:    TaskStatus(query.Get("status")),
+		ServiceID: query.Get("service"),
+		Created:   created,
+	}, nil
+}
+
+// NodeFilter narrows a node list on the server.
+type NodeFilter struct {
+	// Created bounds when the node first registered
+	Created timeutil.Range
+}
+
+func (f NodeFilter) matches(node *Node) bool {
+	return f.Created.Contains(node.CreatedAt)
+}
+
+func nodeFilterFromQuery(query url.Values, now time.Time) (NodeFilter, error) {
+	created, err := rangeFromQuery(query, now)
+	if err != nil {
+		return NodeFilter{}, err
+	}
+	return NodeFilter{Created: created}, nil
+}
+
+// rangeQuery sends the bounds of a range as absolute times, so relative
+// filters mean the same on the client and the server.
+func rangeQuery(r timeutil.Range) url.Values {
+	query := url.Values{}
+	if !r.Since.IsZero() {
+		query.Set("since", r.Since.Format(time.RFC3339Nano))
+	}
+	if !r.Until.IsZero() {
+		query.Set("until", r.Until.Format(time.RFC3339Nano))
+	}
+	return query
+}
+
+func rangeFromQuery(query url.Values, now time.Time) (timeutil.Range, error) {
+	return timeutil.ParseRange(query.Get("since"), query.Get("until"), now)
+}
+
+// listContentType picks the list encoding from the Accept header. A plain
+// JSON envelope stays the default for existing clients.
+func listContentType(r *http.Request) string {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, _ := strings.Cut(strings.TrimSpace(accept), ";")
+		switch mediaType {
+		case ContentTypeNDJSON, ContentTypeProtobuf:
+			return mediaType
+		}
+	}
+	return ContentTypeJSON
+}
+
+// writeList sends items in the encoding the client asked for. Streamed
+// lists are written item by item rather than marshalled in one piece.
+func (api *APIServer) writeList(w http.ResponseWriter, r *http.Request, items []protoMessage) {
+	contentType := listContentType(r)
+	if contentType == ContentTypeJSON {
+		api.writeJSONResponse(w, http.StatusOK, APIResponse{
+			Success: true,
+			Data:    items,
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+
+	// Large lists can outlast the server's write timeout
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	bw := bufio.NewWriterSize(w, 64*1024)
+	encoder := json.NewEncoder(bw)
+	var prefix []byte
+	for i, item := range items {
+		var err error
+		if contentType == ContentTypeNDJSON {
+			err = encoder.Encode(item)
+		} else {
+			msg := item.marshalProto()
+			prefix = protowire.AppendVarint(prefix[:0], uint64(len(msg)))
+			if _, err = bw.Write(prefix); err == nil {
+				_, err = bw.Write(msg)
+			}
+		}
+		if err != nil {
+			logrus.Debugf("List stream to %s aborted: %v", r.RemoteAddr, err)
+			return
+		}
+
+		if (i+1)%streamFlushInterval == 0 {
+			if err := bw.Flush(); err != nil {
+				logrus.Debugf("List stream to %s aborted: %v", r.RemoteAddr, err)
+				return
+			}
+			rc.Flush()
+		}
+	}
+	bw.Flush()
+}
+
+// ListClient reads node and task lists from a manager's API as streams,
+// handing each item to the caller as soon as it is decoded.
+type ListClient struct {
+	Addr  string
+	Token string
+	// ContentType is ContentTypeNDJSON or ContentTypeProtobuf
+	ContentType string
+
+	client *http.Client
+}
+
+func NewListClient(addr, token string) *ListClient {
+	return &ListClient{
+		Addr:        addr,
+		Token:       token,
+		ContentType: ContentTypeNDJSON,
+		// No overall timeout: a large list may take a while to stream
+		client: &http.Client{},
+	}
+}
+
+func (c *ListClient) StreamNodes(filter NodeFilter, fn func(*Node) error) error {
+	return c.stream("/nodes", rangeQuery(filter.Created),
+		func() protoMessage { return &Node{} },
+		func(item protoMessage) error { return fn(item.(*Node)) })
+}
+
+func (c *ListClient) StreamTasks(filter TaskFilter, fn func(*Task) error) error {
+	return c.stream("/tasks", filter.query(),
+		func() protoMessage { return &Task{} },
+		func(item protoMessage) error { return fn(item.(*Task)) })
+}
+
+func (c *ListClient) stream(path string, query url.Values, newItem func() protoMessage, fn func(protoMessage) error) error {
+	u := url.URL{Scheme: "http", Host: c.Addr, Path: path, RawQuery: query.Encode()}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Accept", c.ContentType)
+	if c.Token != "" {
+		req.Header.Set("X-Cluster-Token", c.Token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	mediaType, _, _ := strings.Cut(resp.Header.Get("Content-Type"), ";")
+	if resp.StatusCode != http.StatusOK {
+		mediaType = ContentTypeJSON
+	}
+
+	switch strings.TrimSpace(mediaType) {
+	case ContentTypeNDJSON:
+		decoder := json.NewDecoder(resp.Body)
+		for {
+			var data json.RawMessage
+			if err := decoder.Decode(&data); err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return fmt.Errorf("failed to decode list: %v", err)
+			}
+			item := newItem()
+			if _, err := timeutil.Unmarshal(data, item, recordTimeKeys...); err != nil {
+				return fmt.Errorf("failed to decode list: %v", err)
+			}
+			if err := fn(item); err != nil {
+				return err
+			}
+		}
+
+	case ContentTypeProtobuf:
+		reader := bufio.NewReaderSize(resp.Body, 64*1024)
+		var buf []byte
+		for {
+			size, err := binary.ReadUvarint(reader)
+			if err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return fmt.Errorf("failed to decode list: %v", err)
+			}
+			if size > maxStreamMessage {
+				return fmt.Errorf("failed to decode list: message of %d bytes is too large", size)
+			}
+			if uint64(cap(buf)) < size {
+				buf = make([]byte, size)
+			}
+			buf = buf[:size]
+			if _, err := io.ReadFull(reader, buf); err != nil {
+				return fmt.Errorf("failed to decode list: %v", err)
+			}
+
+			item := newItem()
+			if err := item.unmarshalProto(buf); err != nil {
+				return fmt.Errorf("failed to decode list: %v", err)
+			}
+			if err := fn(item); err != nil {
+				return err
+			}
+		}
+
+	default:
+		// Servers without streaming, and errors, use the JSON envelope
+		var raw []json.RawMessage
+		response := APIResponse{Data: &raw}
+		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+			return fmt.Errorf("failed to decode response: %v", err)
+		}
+		if !response.Success {
+			return fmt.Errorf("server returned status %d: %s", resp.StatusCode, response.Error)
+		}
+		for _, data := range raw {
+			item := newItem()
+			if _, err := timeutil.Unmarshal(data, item, recordTimeKeys...); err != nil {
+				return fmt.Errorf("failed to decode list: %v", err)
+			}
+			if err := fn(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -1,11 +1,13 @@
 package cluster
 
 import (
-	"encoding/json"
 	"fmt"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"docker-impl/pkg/ids"
 	"github.com/sirupsen/logrus"
 )
 
@@ -21,6 +23,7 @@ type Task struct {
 	Placement    Placement         `json:"placement"`
 	RestartPolicy RestartPolicy    `json:"restart_policy"`
 	Networks     []NetworkConfig   `json:"networks"`
+	Ports        []PortConfig      `json:"ports,omitempty"`
 	Volumes      []VolumeConfig    `json:"volumes"`
 	Secrets      []SecretConfig    `json:"secrets"`
 	Configs      []ConfigConfig    `json:"configs"`
@@ -29,12 +32,30 @@ type Task struct {
 	Status       TaskStatus        `json:"status"`
 	NodeID       string            `json:"node_id"`
 	DesiredState TaskStatus        `json:"desired_state"`
-	CreatedAt    string            `json:"created_at"`
-	UpdatedAt    string            `json:"updated_at"`
-	StartedAt    string            `json:"started_at"`
-	CompletedAt  string            `json:"completed_at"`
+	CreatedAt    time.Time         `json:"created_at"`
+	UpdatedAt    time.Time         `json:"updated_at"`
+	StartedAt    time.Time         `json:"started_at"`
+	CompletedAt  time.Time         `json:"completed_at"`
+	// Error says why the task failed, as its node reported
+	Error        string            `json:"error,omitempty"`
 	ServiceID    string            `json:"service_id"`
+	ServiceName  string            `json:"service_name,omitempty"`
 	Slot         int               `json:"slot"`
+	// ServiceVersion is the spec version of the service the task runs
+	ServiceVersion uint64          `json:"service_version,omitempty"`
+	// Namespace groups the services of one application, like a stack
+	Namespace    string            `json:"namespace,omitempty"`
+	// MetadataEnv also passes the cluster metadata labels to the
+	// container as MYDOCKER_* environment variables
+	MetadataEnv  bool              `json:"metadata_env,omitempty"`
+	// PendingSignals are queued for the node running the task to deliver
+	PendingSignals []string        `json:"pending_signals,omitempty"`
+	// PinnedNode places the task on this node instead of letting the
+	// scheduler choose, as long as the node is ready
+	PinnedNode   string            `json:"pinned_node,omitempty"`
+	// HostnameTemplate names the task's container, e.g.
+	// "web-{{.Task.Slot}}"; see HostnameContext
+	HostnameTemplate string        `json:"hostname_template,omitempty"`
 }
 
 type TaskType string
@@ -64,6 +85,29 @@ const (
 	TaskRemove     TaskStatus = "remove"
 )
 
+// taskStatusOrder ranks the states a task goes through, so reports from
+// its node only ever move it forward.
+var taskStatusOrder = map[TaskStatus]int{
+	TaskNew:       1,
+	TaskPending:   2,
+	TaskAssigned:  3,
+	TaskAccepted:  4,
+	TaskPreparing: 5,
+	TaskReady:     6,
+	TaskStarting:  7,
+	TaskRunning:   8,
+	TaskComplete:  9,
+	TaskFailed:    9,
+	TaskShutdown:  9,
+	TaskRejected:  9,
+	TaskRemove:    9,
+}
+
+// isTerminalTaskStatus reports whether a task in status has ended.
+func isTerminalTaskStatus(status TaskStatus) bool {
+	return taskStatusOrder[status] == taskStatusOrder[TaskComplete]
+}
+
 type Constraint struct {
 	Operator string `json:"operator"`
 	Key      string `json:"key"`
@@ -74,6 +118,9 @@ type Placement struct {
 	Constraints []string `json:"constraints"`
 	Preferences []Preference `json:"preferences"`
 	MaxReplicas int       `json:"max_replicas"`
+	// Strategy ranks the nodes the task may run on, instead of the
+	// cluster's scheduling strategy
+	Strategy    string    `json:"strategy,omitempty"`
 }
 
 type Preference struct {
@@ -90,6 +137,59 @@ type RestartPolicy struct {
 type NetworkConfig struct {
 	Target string `json:"target"`
 	Alias  string `json:"alias"`
+	// Address is the task's address on the overlay network, requested or
+	// allocated when the task is scheduled
+	Address string `json:"address,omitempty"`
+}
+
+// PortConfig publishes a port of a task's container on the host of the
+// node running it.
+type PortConfig struct {
+	// Protocol is tcp or udp; tcp when empty
+	Protocol      string `json:"protocol,omitempty"`
+	TargetPort    int    `json:"target_port"`
+	// PublishedPort is the port on the host; 0 picks a free one
+	PublishedPort int    `json:"published_port,omitempty"`
+}
+
+// ParsePortConfig parses a port as given to --publish:
+// [PUBLISHED:]TARGET[/PROTOCOL], e.g. 8080:80 or 53/udp.
+func ParsePortConfig(value string) (PortConfig, error) {
+	var port PortConfig
+	spec, protocol, _ := strings.Cut(value, "/")
+	switch protocol {
+	case "", "tcp", "udp":
+		port.Protocol = protocol
+	default:
+		return port, fmt.Errorf("invalid protocol %q in port %q", protocol, value)
+	}
+
+	published, target, found := strings.Cut(spec, ":")
+	if !found {
+		published, target = "", spec
+	}
+	var err error
+	if port.TargetPort, err = strconv.Atoi(target); err != nil || port.TargetPort < 1 || port.TargetPort > 65535 {
+		return port, fmt.Errorf("invalid target port in %q", value)
+	}
+	if published != "" {
+		if port.PublishedPort, err = strconv.Atoi(published); err != nil || port.PublishedPort < 1 || port.PublishedPort > 65535 {
+			return port, fmt.Errorf("invalid published port in %q", value)
+		}
+	}
+	return port, nil
+}
+
+// String formats the port like ParsePortConfig takes it.
+func (p PortConfig) String() string {
+	protocol := p.Protocol
+	if protocol == "" {
+		protocol = "tcp"
+	}
+	if p.PublishedPort == 0 {
+		return fmt.Sprintf("%d/%s", p.TargetPort, protocol)
+	}
+	return fmt.Sprintf("%d:%d/%s", p.PublishedPort, p.TargetPort, protocol)
 }
 
 type VolumeConfig struct {
@@ -122,6 +222,9 @@ type TaskManager struct {
 	queue    chan *Task
 	workers  int
 	stopChan chan struct{}
+	// placing lets one task at a time be placed, so placements that count
+	// a service's tasks per node see the tasks placed just before
+	placing  sync.Mutex
 }
 
 func NewTaskManager(manager *ClusterManager) *TaskManager {
@@ -152,11 +255,16 @@ func (tm *TaskManager) CreateTask(task *Task) error {
 	// Set initial state
 	task.Status = TaskNew
 	task.DesiredState = TaskRunning
-	task.CreatedAt = time.Now().Format(time.RFC3339)
-	task.UpdatedAt = time.Now().Format(time.RFC3339)
+	task.CreatedAt = tm.manager.Clock.Now()
+	task.UpdatedAt = tm.manager.Clock.Now()
 
 	// Store task
+	if existing, exists := tm.tasks[task.ID]; exists {
+		tm.manager.Metrics.TaskStatusChanged(existing.Status, "")
+	}
 	tm.tasks[task.ID] = task
+	tm.manager.Metrics.TaskStatusChanged("", task.Status)
+	tm.manager.State.putTask(task)
 
 	// Queue task for processing
 	select {
@@ -216,7 +324,8 @@ func (tm *TaskManager) UpdateTask(taskID string, updates *Task) error {
 		task.Labels = updates.Labels
 	}
 
-	task.UpdatedAt = time.Now().Format(time.RFC3339)
+	task.UpdatedAt = tm.manager.Clock.Now()
+	tm.manager.State.putTask(task)
 
 	logrus.Infof("Updated task: %s", taskID)
 	return nil
@@ -237,6 +346,9 @@ func (tm *TaskManager) RemoveTask(taskID string) error {
 	}
 
 	delete(tm.tasks, taskID)
+	tm.manager.Metrics.TaskStatusChanged(task.Status, "")
+	tm.manager.State.deleteTask(taskID)
+	tm.manager.Overlays.detachTask(taskID)
 	logrus.Infof("Removed task: %s", taskID)
 
 	return nil
@@ -250,39 +362,136 @@ func (tm *TaskManager) StopTask(taskID string) error {
 	return tm.UpdateTask(taskID, &Task{DesiredState: TaskComplete})
 }
 
+// ShutdownTask stops a task for good. The node running it is told to stop
+// its container; a task that never reached a node, or whose node can't be
+// reached, is shut down right away.
+func (tm *TaskManager) ShutdownTask(taskID string) error {
+	tm.mu.Lock()
+	task, exists := tm.tasks[taskID]
+	if !exists {
+		tm.mu.Unlock()
+		return fmt.Errorf("task not found: %s", taskID)
+	}
+	task.DesiredState = TaskShutdown
+	task.UpdatedAt = tm.manager.Clock.Now()
+	tm.manager.State.putTask(task)
+	shutdown := *task
+	tm.mu.Unlock()
+
+	if isTerminalTaskStatus(shutdown.Status) {
+		return nil
+	}
+	if shutdown.NodeID == "" || taskStatusOrder[shutdown.Status] < taskStatusOrder[TaskAssigned] {
+		tm.advanceTaskStatus(taskID, TaskStatusReport{Status: TaskShutdown})
+		return nil
+	}
+
+	logrus.Infof("Shutting down task %s on node %s", taskID, shutdown.NodeID)
+	if err := tm.manager.shutdownTaskOnNode(&shutdown); err != nil {
+		// The node shuts the task down when it comes back
+		logrus.Warnf("Failed to shut down task %s on node %s: %v", taskID, shutdown.NodeID, err)
+		tm.advanceTaskStatus(taskID, TaskStatusReport{Status: TaskShutdown})
+	}
+	return nil
+}
+
 func (tm *TaskManager) RestartTask(taskID string) error {
+	_, err := tm.restartTask(taskID)
+	return err
+}
+
+// restartTask stops a task and queues a copy of it, returning the copy.
+func (tm *TaskManager) restartTask(taskID string) (*Task, error) {
+	return tm.replaceTask(taskID, "")
+}
+
+// replaceTask is restartTask with the copy pinned to nodeID, if given.
+func (tm *TaskManager) replaceTask(taskID, nodeID string) (*Task, error) {
 	tm.mu.Lock()
 	defer tm.mu.Unlock()
 
 	task, exists := tm.tasks[taskID]
 	if !exists {
-		return fmt.Errorf("task not found: %s", taskID)
+		return nil, fmt.Errorf("task not found: %s", taskID)
 	}
 
 	// Stop task
 	task.DesiredState = TaskComplete
-	task.UpdatedAt = time.Now().Format(time.RFC3339)
+	task.UpdatedAt = tm.manager.Clock.Now()
 
 	// Create new task with same configuration
 	newTask := *task
 	newTask.ID = generateTaskID()
 	newTask.Status = TaskNew
 	newTask.DesiredState = TaskRunning
-	newTask.CreatedAt = time.Now().Format(time.RFC3339)
-	newTask.UpdatedAt = time.Now().Format(time.RFC3339)
-	newTask.StartedAt = ""
-	newTask.CompletedAt = ""
+	newTask.CreatedAt = tm.manager.Clock.Now()
+	newTask.UpdatedAt = tm.manager.Clock.Now()
+	newTask.StartedAt = time.Time{}
+	newTask.CompletedAt = time.Time{}
+	newTask.PendingSignals = nil
+	newTask.PinnedNode = nodeID
 
 	// Store new task
 	tm.tasks[newTask.ID] = &newTask
+	tm.manager.Metrics.TaskStatusChanged("", newTask.Status)
+	tm.manager.State.putTask(task)
+	tm.manager.State.putTask(&newTask)
+	tm.manager.SLOs.TaskRestarted(task)
 
 	// Queue new task
 	tm.queue <- &newTask
 
 	logrus.Infof("Restarted task %s as %s", taskID, newTask.ID)
+	return &newTask, nil
+}
+
+// SignalTask queues a signal for the task's process. The node running the
+// task picks it up with the task and delivers it.
+func (tm *TaskManager) SignalTask(taskID, signal string) error {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	task, exists := tm.tasks[taskID]
+	if !exists {
+		return fmt.Errorf("task not found: %s", taskID)
+	}
+	if task.Status != TaskRunning {
+		return fmt.Errorf("task %s is not running", taskID)
+	}
+
+	task.PendingSignals = append(task.PendingSignals, signal)
+	task.UpdatedAt = tm.manager.Clock.Now()
+	tm.manager.State.putTask(task)
+
+	logrus.Infof("Queued %s for task %s on node %s", signal, taskID, task.NodeID)
 	return nil
 }
 
+func (tm *TaskManager) waitForTaskRunning(taskID string, timeout time.Duration) error {
+	deadline := tm.manager.Clock.Now().Add(timeout)
+	for {
+		task, err := tm.GetTask(taskID)
+		if err != nil {
+			return err
+		}
+
+		tm.mu.RLock()
+		status := task.Status
+		tm.mu.RUnlock()
+
+		switch status {
+		case TaskRunning, TaskComplete:
+			return nil
+		case TaskFailed, TaskRejected:
+			return fmt.Errorf("task %s %s", taskID, status)
+		}
+		if tm.manager.Clock.Now().After(deadline) {
+			return fmt.Errorf("task %s not running after %s (status %s)", taskID, timeout, status)
+		}
+		tm.manager.Clock.Sleep(500 * time.Millisecond)
+	}
+}
+
 func (tm *TaskManager) GetTasksByNode(nodeID string) ([]*Task, error) {
 	tm.mu.RLock()
 	defer tm.mu.RUnlock()
@@ -360,67 +569,194 @@ func (tm *TaskManager) worker(id int) {
 func (tm *TaskManager) processTask(task *Task) {
 	logrus.Infof("Processing task %s (worker)", task.ID)
 
+	// Tasks shut down while they were queued are left alone
+	tm.mu.RLock()
+	desired := task.DesiredState
+	tm.mu.RUnlock()
+	if desired != TaskRunning {
+		return
+	}
+
 	// Update task status
 	tm.updateTaskStatus(task.ID, TaskPending)
 
 	// Select node for task
-	node, err := tm.manager.NodeManager.SelectNodeForTask(task)
+	tm.placing.Lock()
+	node, err := tm.selectNode(task)
+	if err == nil {
+		tm.mu.Lock()
+		task.NodeID = node.ID
+		tm.mu.Unlock()
+	}
+	tm.placing.Unlock()
 	if err != nil {
 		logrus.Errorf("Failed to select node for task %s: %v", task.ID, err)
 		tm.updateTaskStatus(task.ID, TaskFailed)
 		return
 	}
 
+	// Give the task its addresses on the node
+	if err := tm.manager.Overlays.attachTask(task, node); err != nil {
+		logrus.Errorf("Failed to attach task %s to its networks: %v", task.ID, err)
+		tm.updateTaskStatus(task.ID, TaskFailed)
+		return
+	}
+
 	// Assign task to node
-	task.NodeID = node.ID
 	tm.updateTaskStatus(task.ID, TaskAssigned)
 
-	// Send task to node (simulation)
+	// Send task to node
 	if err := tm.sendTaskToNode(task, node); err != nil {
 		logrus.Errorf("Failed to send task %s to node %s: %v", task.ID, node.ID, err)
 		tm.updateTaskStatus(task.ID, TaskFailed)
 		return
 	}
 
-	// Update task status
-	tm.updateTaskStatus(task.ID, TaskRunning)
-	task.StartedAt = time.Now().Format(time.RFC3339)
+	// The node reports how the task fares from here on
+	tm.advanceTaskStatus(task.ID, TaskStatusReport{NodeID: node.ID, Status: TaskAccepted})
 
-	logrus.Infof("Task %s started on node %s", task.ID, node.ID)
+	logrus.Infof("Task %s accepted by node %s", task.ID, node.ID)
 }
 
+func (tm *TaskManager) selectNode(task *Task) (*Node, error) {
+	if task.PinnedNode != "" {
+		node, err := tm.manager.NodeManager.GetNode(task.PinnedNode)
+		if err == nil && (node.Status == StatusReady || node.Status == StatusActive) {
+			// Pinning doesn't override the task's constraints
+			if constraints, err := task.constraints(); err == nil && nodeMatches(node, constraints) {
+				return node, nil
+			}
+		}
+		logrus.Warnf("Pinned node %s for task %s is unavailable or excluded by its constraints, scheduling elsewhere", task.PinnedNode, task.ID)
+	}
+	return tm.manager.NodeManager.SelectNodeForTask(task)
+}
+
+// sendTaskToNode hands a task to the agent of its node: this node's own
+// agent, or another node's over its API.
 func (tm *TaskManager) sendTaskToNode(task *Task, node *Node) error {
-	// In real implementation, this would send the task to the node via API
-	// For simulation, we'll just wait and simulate success
-	time.Sleep(100 * time.Millisecond)
+	if err := tm.manager.Faults.dispatchFault(node.ID); err != nil {
+		return err
+	}
+
+	if tm.manager.isLocalNode(node) {
+		return tm.manager.agent.assign(task)
+	}
+	return tm.manager.dispatchTask(task, node)
+}
 
-	// Simulate task completion
-	go func() {
-		time.Sleep(5 * time.Second) // Simulate task running time
+func (tm *TaskManager) updateTaskStatus(taskID string, status TaskStatus) {
+	tm.mu.Lock()
+	if task, exists := tm.tasks[taskID]; exists {
+		tm.setTaskStatus(task, status)
+	}
+	tm.mu.Unlock()
 
-		tm.mu.Lock()
-		task, exists := tm.tasks[task.ID]
-		if exists {
-			task.Status = TaskComplete
-			task.CompletedAt = time.Now().Format(time.RFC3339)
-			task.UpdatedAt = time.Now().Format(time.RFC3339)
-		}
-		tm.mu.Unlock()
+	tm.taskStatusChanged(taskID, status)
+}
 
-		logrus.Infof("Task %s completed", task.ID)
-	}()
+// setTaskStatus moves a task to status. Callers hold tm.mu.
+func (tm *TaskManager) setTaskStatus(task *Task, status TaskStatus) {
+	if task.Status != status {
+		tm.manager.SLOs.TaskStatusChanged(task, status)
+		tm.manager.Metrics.TaskStatusChanged(task.Status, status)
+	}
+	task.Status = status
+	task.UpdatedAt = tm.manager.Clock.Now()
+	tm.manager.State.putTask(task)
+}
+
+func (tm *TaskManager) taskStatusChanged(taskID string, status TaskStatus) {
+	// Tasks that ended give their addresses back
+	if status == TaskFailed || status == TaskComplete || status == TaskShutdown {
+		tm.manager.Overlays.detachTask(taskID)
+	}
+	// and their services replace them
+	if isTerminalTaskStatus(status) {
+		tm.manager.Services.wake()
+	}
+}
+
+// ReportTaskStatus records how a task fares on the node it was assigned
+// to. Reports from a node the task was moved off are refused, and a
+// report older than the task's status is ignored.
+func (tm *TaskManager) ReportTaskStatus(taskID string, report TaskStatusReport) error {
+	switch report.Status {
+	case TaskPreparing, TaskReady, TaskStarting, TaskRunning,
+		TaskComplete, TaskFailed, TaskShutdown, TaskRejected:
+	default:
+		return fmt.Errorf("invalid task status: %s", report.Status)
+	}
+
+	tm.mu.RLock()
+	task, exists := tm.tasks[taskID]
+	var nodeID string
+	if exists {
+		nodeID = task.NodeID
+	}
+	tm.mu.RUnlock()
+
+	if !exists {
+		return fmt.Errorf("task not found: %s", taskID)
+	}
+	if report.NodeID != "" && report.NodeID != nodeID {
+		return fmt.Errorf("task %s is not assigned to node %s", taskID, report.NodeID)
+	}
 
+	if tm.advanceTaskStatus(taskID, report) {
+		logrus.Infof("Task %s is %s on node %s", taskID, report.Status, nodeID)
+	}
 	return nil
 }
 
-func (tm *TaskManager) updateTaskStatus(taskID string, status TaskStatus) {
+// advanceTaskStatus moves a task to the status of a report unless it is
+// already that far or has ended, and reports whether it did.
+func (tm *TaskManager) advanceTaskStatus(taskID string, report TaskStatusReport) bool {
 	tm.mu.Lock()
-	defer tm.mu.Unlock()
+	task, exists := tm.tasks[taskID]
+	if !exists || isTerminalTaskStatus(task.Status) ||
+		taskStatusOrder[report.Status] <= taskStatusOrder[task.Status] {
+		tm.mu.Unlock()
+		return false
+	}
 
-	if task, exists := tm.tasks[taskID]; exists {
-		task.Status = status
-		task.UpdatedAt = time.Now().Format(time.RFC3339)
+	now := tm.manager.Clock.Now()
+	if report.Status == TaskRunning {
+		task.StartedAt = now
+	}
+	if isTerminalTaskStatus(report.Status) {
+		task.CompletedAt = now
+		task.Error = report.Error
 	}
+	tm.setTaskStatus(task, report.Status)
+	tm.mu.Unlock()
+
+	tm.taskStatusChanged(taskID, report.Status)
+	return true
+}
+
+// ReportTaskHealth records the outcome of a health probe of a running
+// task, which counts towards its service's SLO.
+func (tm *TaskManager) ReportTaskHealth(taskID string, healthy bool) error {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+
+	task, exists := tm.tasks[taskID]
+	if !exists {
+		return fmt.Errorf("task not found: %s", taskID)
+	}
+	if task.Status != TaskRunning {
+		return fmt.Errorf("task %s is not running", taskID)
+	}
+
+	tm.manager.SLOs.ProbeResult(task, healthy)
+	if !healthy {
+		logrus.Warnf("Health probe of task %s failed", taskID)
+		if task.ServiceID != "" {
+			tm.manager.Services.taskUnhealthy(task.ServiceID, taskID)
+		}
+	}
+	return nil
 }
 
 func (tm *TaskManager) validateTask(task *Task) error {
@@ -444,6 +780,28 @@ func (tm *TaskManager) validateTask(task *Task) error {
 		return fmt.Errorf("task memory must be positive")
 	}
 
+	if task.HostnameTemplate != "" {
+		if err := ValidateHostnameTemplate(task.HostnameTemplate); err != nil {
+			return err
+		}
+	}
+
+	for _, network := range task.Networks {
+		if _, err := tm.manager.Overlays.Get(network.Target); err != nil {
+			return err
+		}
+	}
+
+	if err := task.validatePlacement(); err != nil {
+		return err
+	}
+
+	if task.Placement.Strategy != "" {
+		if _, err := tm.manager.Strategies.Get(task.Placement.Strategy); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -453,5 +811,5 @@ func (tm *TaskManager) Shutdown() {
 }
 
 func generateTaskID() string {
-	return fmt.Sprintf("task-%x", time.Now().UnixNano())[:12]
+	return ids.NewID("task")
 }
\ No newline at end of file
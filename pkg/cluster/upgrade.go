@@ -0,0 +1,244 @@
+package cluster
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// NodeUpdater performs the actual version change on a single node.
+type NodeUpdater interface {
+	UpdateNode(node *Node, version string) error
+}
+
+type UpgradeOptions struct {
+	Version       string        `json:"version"`
+	BatchSize     int           `json:"batch_size"`
+	HealthTimeout time.Duration `json:"health_timeout"`
+	Updater       NodeUpdater   `json:"-"`
+}
+
+type UpgradeReport struct {
+	Version   string    `json:"version"`
+	Upgraded  []string  `json:"upgraded"`
+	Skipped   []string  `json:"skipped"`
+	FailedOn  string    `json:"failed_on,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+	EndedAt   time.Time `json:"ended_at"`
+}
+
+// recordUpdater only records the new version on the node. Upgrade uses it
+// when no updater is given; UpdateAgents has agents replace their binary.
+type recordUpdater struct {
+	nodeManager *NodeManager
+}
+
+func (u *recordUpdater) UpdateNode(node *Node, version string) error {
+	u.nodeManager.mu.Lock()
+	defer u.nodeManager.mu.Unlock()
+
+	current, exists := u.nodeManager.nodes[node.ID]
+	if !exists {
+		return fmt.Errorf("node not found: %s", node.ID)
+	}
+	current.Version = version
+	current.UpdatedAt = u.nodeManager.manager.Clock.Now()
+	u.nodeManager.manager.State.putNode(current)
+	return nil
+}
+
+// Upgrade rolls the cluster to a new version. Managers go first, one at a
+// time and only while the rest keep quorum; workers follow in batches that
+// are drained, updated, checked and reactivated before the next batch.
+// The rollout stops at the first node that fails to come back healthy.
+func (cm *ClusterManager) Upgrade(options UpgradeOptions) (*UpgradeReport, error) {
+	if options.Version == "" {
+		return nil, fmt.Errorf("target version is required")
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = 1
+	}
+	if options.HealthTimeout <= 0 {
+		options.HealthTimeout = 60 * time.Second
+	}
+	if options.Updater == nil {
+		options.Updater = &recordUpdater{nodeManager: cm.NodeManager}
+	}
+
+	report := &UpgradeReport{
+		Version:   options.Version,
+		StartedAt: cm.Clock.Now(),
+	}
+	defer func() {
+		report.EndedAt = cm.Clock.Now()
+		cm.Metrics.upgradeFinished(report.FailedOn)
+	}()
+
+	var managers, workers []*Node
+	for _, node := range cm.NodeManager.GetManagerNodes() {
+		if node.Version == options.Version {
+			report.Skipped = append(report.Skipped, node.ID)
+			continue
+		}
+		managers = append(managers, node)
+	}
+	for _, node := range cm.NodeManager.GetWorkerNodes() {
+		if node.Version == options.Version {
+			report.Skipped = append(report.Skipped, node.ID)
+			continue
+		}
+		workers = append(workers, node)
+	}
+
+	cm.Metrics.upgradeStarted(options.Version, len(managers)+len(workers)+len(report.Skipped), len(report.Skipped))
+
+	// The manager this process runs on goes last so the rollout keeps its
+	// coordinator for as long as possible.
+	sort.SliceStable(managers, func(i, j int) bool {
+		return !cm.isLocalNode(managers[i]) && cm.isLocalNode(managers[j])
+	})
+
+	for _, node := range managers {
+		if err := cm.checkManagerQuorum(node); err != nil {
+			return report.fail(node, err)
+		}
+
+		logrus.Infof("Upgrading manager %s to %s", node.ID, options.Version)
+		if err := options.Updater.UpdateNode(node, options.Version); err != nil {
+			return report.fail(node, fmt.Errorf("failed to update manager: %v", err))
+		}
+		if err := cm.waitForNodeVersion(node.ID, options.Version, options.HealthTimeout); err != nil {
+			return report.fail(node, err)
+		}
+		report.Upgraded = append(report.Upgraded, node.ID)
+		cm.Metrics.nodeUpgraded()
+	}
+
+	for len(workers) > 0 {
+		batch, err := cm.drainBatch(workers, options.BatchSize, options.HealthTimeout)
+		if err != nil {
+			return report.fail(workers[len(batch)], fmt.Errorf("failed to drain worker: %v", err))
+		}
+		workers = workers[len(batch):]
+
+		logrus.Infof("Upgrading worker batch of %d, %d left", len(batch), len(workers))
+		for _, node := range batch {
+			if err := options.Updater.UpdateNode(node, options.Version); err != nil {
+				return report.fail(node, fmt.Errorf("failed to update worker: %v", err))
+			}
+		}
+
+		for _, node := range batch {
+			if err := cm.waitForNodeVersion(node.ID, options.Version, options.HealthTimeout); err != nil {
+				return report.fail(node, err)
+			}
+			if err := cm.NodeManager.ActivateNode(node.ID); err != nil {
+				return report.fail(node, fmt.Errorf("failed to reactivate worker: %v", err))
+			}
+			report.Upgraded = append(report.Upgraded, node.ID)
+			cm.Metrics.nodeUpgraded()
+		}
+	}
+
+	cm.mu.Lock()
+	cm.Version = options.Version
+	cm.mu.Unlock()
+
+	logrus.Infof("Cluster upgraded to %s: %d upgraded, %d already current", options.Version, len(report.Upgraded), len(report.Skipped))
+	return report, nil
+}
+
+// drainBatch drains up to size workers from the front of the queue. The
+// batch ends early at a worker whose replicas the disruption budgets
+// can't spare yet; the first worker waits up to timeout for them instead.
+func (cm *ClusterManager) drainBatch(workers []*Node, size int, timeout time.Duration) ([]*Node, error) {
+	var batch []*Node
+	for _, node := range workers {
+		if len(batch) == size {
+			break
+		}
+
+		err := cm.Budgets.CheckNode(node.ID)
+		if _, ok := err.(*BudgetError); ok && len(batch) > 0 {
+			break
+		}
+		deadline := cm.Clock.Now().Add(timeout)
+		for {
+			if _, ok := err.(*BudgetError); !ok || cm.Clock.Now().After(deadline) {
+				break
+			}
+			cm.Clock.Sleep(time.Second)
+			err = cm.Budgets.CheckNode(node.ID)
+		}
+		if err != nil {
+			return batch, err
+		}
+
+		if err := cm.NodeManager.DrainNode(node.ID); err != nil {
+			return batch, err
+		}
+		batch = append(batch, node)
+	}
+	return batch, nil
+}
+
+func (r *UpgradeReport) fail(node *Node, err error) (*UpgradeReport, error) {
+	r.FailedOn = node.ID
+	r.Error = err.Error()
+	logrus.Errorf("Upgrade halted at node %s: %v", node.ID, err)
+	return r, fmt.Errorf("upgrade halted at node %s: %v", node.ID, err)
+}
+
+// checkManagerQuorum refuses to take a manager down when the remaining
+// healthy managers would not form a majority.
+func (cm *ClusterManager) checkManagerQuorum(target *Node) error {
+	managers := cm.NodeManager.GetManagerNodes()
+	quorum := len(managers)/2 + 1
+
+	healthy := 0
+	for _, node := range managers {
+		if node.ID == target.ID {
+			continue
+		}
+		if node.Status == StatusReady || node.Status == StatusActive {
+			healthy++
+		}
+	}
+
+	// A single-manager cluster can't keep quorum during its own upgrade;
+	// allow it since there is nothing else to protect.
+	if len(managers) == 1 {
+		return nil
+	}
+	if healthy < quorum {
+		return fmt.Errorf("upgrading would lose quorum (%d healthy managers left, %d required)", healthy, quorum)
+	}
+	return nil
+}
+
+func (cm *ClusterManager) waitForNodeVersion(nodeID, version string, timeout time.Duration) error {
+	deadline := cm.Clock.Now().Add(timeout)
+	for {
+		node, err := cm.NodeManager.GetNode(nodeID)
+		if err != nil {
+			return err
+		}
+		if node.Version == version && node.Status != StatusDown && node.Status != StatusUnknown {
+			return nil
+		}
+		if cm.Clock.Now().After(deadline) {
+			return fmt.Errorf("node did not report version %s as healthy within %s (version %s, status %s)", version, timeout, node.Version, node.Status)
+		}
+		cm.Clock.Sleep(time.Second)
+	}
+}
+
+func (cm *ClusterManager) isLocalNode(node *Node) bool {
+	if cm.Identity != nil {
+		return node.ID == cm.Identity.ID
+	}
+	return node.Address == cm.Config.AdvertiseAddr && node.Port == cm.Config.AdvertisePort
+}
@@ -0,0 +1,329 @@
+package cluster
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// usageInterval is how often the usage of local tasks is sampled
+	usageInterval = time.Minute
+	// usageRetention is how much usage history recommendations draw on
+	usageRetention = 7 * 24 * time.Hour
+	// minRecommendationSamples is how many samples a service needs before
+	// its usage is trusted to size it
+	minRecommendationSamples = 30
+	// limitHeadroom is how far above p95 usage limits are set, so bursts
+	// aren't throttled or killed
+	limitHeadroom = 1.5
+
+	cpuGranularity    = 10          // millicores
+	memoryGranularity = 1024 * 1024 // bytes
+	minCPUReservation = cpuGranularity
+	minMemReservation = 4 * memoryGranularity
+)
+
+// TaskUsage is a reading of what a task's container has used: the CPU
+// time it consumed so far and the memory it holds now.
+type TaskUsage struct {
+	CPUTime time.Duration `json:"cpu_time"`
+	Memory  int64         `json:"memory"`
+}
+
+// LocalUsageSampler reads the usage of a task's container on the node
+// this process runs on. The cluster package leaves containers to whoever
+// registers one with SetLocalUsageSampler; remote nodes report theirs to
+// POST /tasks/{taskID}/usage.
+type LocalUsageSampler func(task *Task) (*TaskUsage, error)
+
+type usageSample struct {
+	at time.Time
+	// cpu is in millicores; the first reading of a task has none, since
+	// CPU use is measured between readings
+	cpu    int64
+	hasCPU bool
+	memory int64
+}
+
+type taskUsageHistory struct {
+	serviceID string
+	last      *TaskUsage
+	lastAt    time.Time
+	samples   []usageSample
+}
+
+// UsagePercentiles summarizes the usage of a resource over the samples.
+type UsagePercentiles struct {
+	P50 int64 `json:"p50"`
+	P95 int64 `json:"p95"`
+	P99 int64 `json:"p99"`
+	Max int64 `json:"max"`
+}
+
+// ResourceRecommendation sizes one resource of a service's tasks.
+type ResourceRecommendation struct {
+	// Current is what the service's tasks reserve now
+	Current     int64            `json:"current"`
+	Usage       UsagePercentiles `json:"usage"`
+	Reservation int64            `json:"reservation"`
+	Limit       int64            `json:"limit"`
+	// Reclaimable is what the service's running tasks would give back
+	// by reserving the recommendation instead
+	Reclaimable int64 `json:"reclaimable"`
+}
+
+// ServiceRecommendation suggests the reservations and limits of a
+// service's tasks from their usage: reservations at p95 and limits with
+// headroom above it, never below the peak seen.
+type ServiceRecommendation struct {
+	ServiceID string                 `json:"service_id"`
+	Samples   int                    `json:"samples"`
+	Tasks     int                    `json:"tasks"`
+	Since     time.Time              `json:"since"`
+	CPU       ResourceRecommendation `json:"cpu"`
+	Memory    ResourceRecommendation `json:"memory"`
+}
+
+// UsageTracker keeps the usage history of tasks, so services can be
+// sized by what they use rather than what they asked for.
+type UsageTracker struct {
+	manager *ClusterManager
+	// tasks holds the usage history by task ID
+	tasks   map[string]*taskUsageHistory
+	sampler LocalUsageSampler
+	mu      sync.Mutex
+}
+
+func NewUsageTracker(manager *ClusterManager) *UsageTracker {
+	return &UsageTracker{
+		manager: manager,
+		tasks:   make(map[string]*taskUsageHistory),
+	}
+}
+
+// SetLocalUsageSampler registers how this node reads the usage of task
+// containers.
+func (cm *ClusterManager) SetLocalUsageSampler(sampler LocalUsageSampler) {
+	cm.Usage.mu.Lock()
+	defer cm.Usage.mu.Unlock()
+	cm.Usage.sampler = sampler
+}
+
+func (u *UsageTracker) Start() {
+	go u.loop()
+}
+
+func (u *UsageTracker) loop() {
+	ticker := u.manager.Clock.NewTicker(usageInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			u.collect()
+		case <-u.manager.shutdown:
+			return
+		}
+	}
+}
+
+// collect samples the running tasks of this node.
+func (u *UsageTracker) collect() {
+	u.mu.Lock()
+	sampler := u.sampler
+	u.mu.Unlock()
+	if sampler == nil {
+		return
+	}
+
+	tasks, err := u.manager.TaskManager.GetTasksByNode(u.manager.localNodeID())
+	if err != nil {
+		return
+	}
+	for _, task := range tasks {
+		if task.Status != TaskRunning {
+			continue
+		}
+		usage, err := sampler(task)
+		if err != nil {
+			logrus.Debugf("Failed to sample usage of task %s: %v", task.ID, err)
+			continue
+		}
+		if err := u.Record(task.ID, *usage); err != nil {
+			logrus.Debugf("Failed to record usage of task %s: %v", task.ID, err)
+		}
+	}
+}
+
+// Record adds a usage reading of a task to its history.
+func (u *UsageTracker) Record(taskID string, usage TaskUsage) error {
+	task, err := u.manager.TaskManager.GetTask(taskID)
+	if err != nil {
+		return err
+	}
+	if usage.CPUTime < 0 || usage.Memory < 0 {
+		return fmt.Errorf("usage must not be negative")
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	now := u.manager.Clock.Now()
+	history, ok := u.tasks[taskID]
+	if !ok {
+		history = &taskUsageHistory{serviceID: task.ServiceID}
+		u.tasks[taskID] = history
+	}
+
+	sample := usageSample{at: now, memory: usage.Memory}
+	// CPU time going backwards means the container was restarted
+	if history.last != nil && usage.CPUTime >= history.last.CPUTime && now.After(history.lastAt) {
+		elapsed := now.Sub(history.lastAt)
+		sample.cpu = int64((usage.CPUTime - history.last.CPUTime) * 1000 / elapsed)
+		sample.hasCPU = true
+	}
+	history.last = &usage
+	history.lastAt = now
+	history.samples = append(history.samples, sample)
+	u.prune(now)
+	return nil
+}
+
+// prune drops the samples that fell out of the retention period, and the
+// tasks left without any.
+func (u *UsageTracker) prune(now time.Time) {
+	cutoff := now.Add(-usageRetention)
+	for taskID, history := range u.tasks {
+		samples := history.samples
+		i := sort.Search(len(samples), func(i int) bool { return samples[i].at.After(cutoff) })
+		history.samples = samples[i:]
+		if len(history.samples) == 0 {
+			delete(u.tasks, taskID)
+		}
+	}
+}
+
+// latest returns the last sample of each task by task ID.
+func (u *UsageTracker) latest() map[string]usageSample {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	readings := make(map[string]usageSample, len(u.tasks))
+	for taskID, history := range u.tasks {
+		if n := len(history.samples); n > 0 {
+			readings[taskID] = history.samples[n-1]
+		}
+	}
+	return readings
+}
+
+// Recommend sizes a service, named by ID or name, from the usage of its
+// tasks over the retention period.
+func (u *UsageTracker) Recommend(service string) (*ServiceRecommendation, error) {
+	tasks, err := u.manager.TaskManager.ListTasks()
+	if err != nil {
+		return nil, err
+	}
+	serviceID := service
+	var current *Task
+	running := 0
+	for _, task := range tasks {
+		if task.ServiceID != service && task.ServiceName != service {
+			continue
+		}
+		serviceID = task.ServiceID
+		if current == nil || task.CreatedAt.After(current.CreatedAt) {
+			current = task
+		}
+		if task.Status == TaskRunning {
+			running++
+		}
+	}
+
+	u.mu.Lock()
+	u.prune(u.manager.Clock.Now())
+	var cpu, memory []int64
+	rec := &ServiceRecommendation{ServiceID: serviceID}
+	for _, history := range u.tasks {
+		if history.serviceID != serviceID {
+			continue
+		}
+		rec.Tasks++
+		for _, sample := range history.samples {
+			if rec.Since.IsZero() || sample.at.Before(rec.Since) {
+				rec.Since = sample.at
+			}
+			memory = append(memory, sample.memory)
+			if sample.hasCPU {
+				cpu = append(cpu, sample.cpu)
+			}
+		}
+	}
+	u.mu.Unlock()
+
+	rec.Samples = len(memory)
+	if rec.Samples < minRecommendationSamples {
+		return nil, fmt.Errorf("not enough usage data for service %s: %d samples, need %d", service, rec.Samples, minRecommendationSamples)
+	}
+
+	rec.CPU = recommendResource(cpu, cpuGranularity, minCPUReservation)
+	rec.Memory = recommendResource(memory, memoryGranularity, minMemReservation)
+	if current != nil {
+		rec.CPU.setCurrent(current.Resources.CPU, running)
+		rec.Memory.setCurrent(current.Resources.Memory, running)
+	}
+	return rec, nil
+}
+
+func recommendResource(samples []int64, granularity, minimum int64) ResourceRecommendation {
+	usage := percentiles(samples)
+	reservation := roundUp(usage.P95, granularity)
+	if reservation < minimum {
+		reservation = minimum
+	}
+	limit := roundUp(int64(float64(usage.P95)*limitHeadroom), granularity)
+	if peak := roundUp(usage.Max, granularity); limit < peak {
+		limit = peak
+	}
+	if limit < reservation {
+		limit = reservation
+	}
+	return ResourceRecommendation{Usage: usage, Reservation: reservation, Limit: limit}
+}
+
+func (r *ResourceRecommendation) setCurrent(current int64, running int) {
+	r.Current = current
+	if current > r.Reservation {
+		r.Reclaimable = (current - r.Reservation) * int64(running)
+	}
+}
+
+// percentiles uses the nearest rank, so every value is one that was seen.
+func percentiles(samples []int64) UsagePercentiles {
+	if len(samples) == 0 {
+		return UsagePercentiles{}
+	}
+	sorted := append([]int64(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	rank := func(p float64) int64 {
+		i := int(math.Ceil(p*float64(len(sorted)))) - 1
+		if i < 0 {
+			i = 0
+		}
+		return sorted[i]
+	}
+	return UsagePercentiles{
+		P50: rank(0.50),
+		P95: rank(0.95),
+		P99: rank(0.99),
+		Max: sorted[len(sorted)-1],
+	}
+}
+
+func roundUp(value, granularity int64) int64 {
+	return (value + granularity - 1) / granularity * granularity
+}
@@ -0,0 +1,289 @@
+// Package compose loads compose files: it interpolates variables from the
+// environment and .env files, resolves extends, merges override files and
+// selects services by profile.
+package compose
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultFiles are looked for in the working directory, in order, when no
+// file is given.
+var DefaultFiles = []string{"compose.yaml", "compose.yml", "docker-compose.yaml", "docker-compose.yml"}
+
+// Options configure how a project is loaded.
+type Options struct {
+	// Files are merged in order, later files overriding earlier ones.
+	// Without any, the first of DefaultFiles in WorkingDir is used.
+	Files []string
+	// WorkingDir is the project directory; by default the directory of
+	// the first file
+	WorkingDir string
+	// EnvFiles are read for interpolation; by default WorkingDir/.env if
+	// it exists
+	EnvFiles []string
+	// Environment overrides the env files; nil uses the process
+	// environment
+	Environment map[string]string
+	// Profiles are activated along with those in COMPOSE_PROFILES
+	Profiles []string
+	// ProjectName overrides COMPOSE_PROJECT_NAME, the file's name field
+	// and the directory name
+	ProjectName string
+}
+
+var invalidProjectChars = regexp.MustCompile(`[^a-z0-9_-]+`)
+
+// Load reads, interpolates and merges the compose files and returns the
+// project with the services enabled by the active profiles.
+func Load(options Options) (*Project, error) {
+	files, workingDir, err := resolveFiles(options)
+	if err != nil {
+		return nil, err
+	}
+
+	lookup, err := environment(options, workingDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var merged map[string]interface{}
+	for _, file := range files {
+		config, err := loadFile(file, lookup)
+		if err != nil {
+			return nil, err
+		}
+		if err := resolveExtends(config, file, lookup); err != nil {
+			return nil, err
+		}
+		if merged == nil {
+			merged = config
+		} else {
+			merged = mergeMaps(merged, config)
+		}
+	}
+
+	project, err := decodeProject(merged)
+	if err != nil {
+		return nil, fmt.Errorf("invalid compose file: %v", err)
+	}
+
+	project.Name = projectName(options, lookup, project.Name, workingDir)
+	if project.Name == "" {
+		return nil, fmt.Errorf("project name must not be empty")
+	}
+
+	if err := applyProfiles(project, activeProfiles(options, lookup)); err != nil {
+		return nil, err
+	}
+	return project, nil
+}
+
+func resolveFiles(options Options) ([]string, string, error) {
+	workingDir := options.WorkingDir
+	if len(options.Files) == 0 {
+		if workingDir == "" {
+			workingDir = "."
+		}
+		for _, name := range DefaultFiles {
+			path := filepath.Join(workingDir, name)
+			if _, err := os.Stat(path); err == nil {
+				options.Files = []string{path}
+				break
+			}
+		}
+		if len(options.Files) == 0 {
+			return nil, "", fmt.Errorf("no compose file found in %s (tried %s)", workingDir, strings.Join(DefaultFiles, ", "))
+		}
+	}
+
+	var files []string
+	for _, file := range options.Files {
+		path, err := filepath.Abs(file)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to resolve %s: %v", file, err)
+		}
+		files = append(files, path)
+	}
+	if workingDir == "" {
+		workingDir = filepath.Dir(files[0])
+	}
+	workingDir, err := filepath.Abs(workingDir)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to resolve %s: %v", workingDir, err)
+	}
+	return files, workingDir, nil
+}
+
+// environment builds the variable lookup: the environment takes
+// precedence over env files, and later env files over earlier ones.
+func environment(options Options, workingDir string) (lookupFunc, error) {
+	overrides := options.Environment
+	if overrides == nil {
+		overrides = make(map[string]string)
+		for _, entry := range os.Environ() {
+			if key, value, ok := strings.Cut(entry, "="); ok {
+				overrides[key] = value
+			}
+		}
+	}
+
+	envFiles := options.EnvFiles
+	if envFiles == nil {
+		path := filepath.Join(workingDir, ".env")
+		if _, err := os.Stat(path); err == nil {
+			envFiles = []string{path}
+		}
+	}
+
+	vars := make(map[string]string)
+	lookup := func(name string) (string, bool) {
+		if value, ok := overrides[name]; ok {
+			return value, true
+		}
+		value, ok := vars[name]
+		return value, ok
+	}
+	for _, path := range envFiles {
+		env, err := readEnvFile(path, lookup)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range env {
+			vars[k] = v
+		}
+	}
+	return lookup, nil
+}
+
+// loadFile parses and interpolates one compose file.
+func loadFile(path string, lookup lookupFunc) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read compose file: %v", err)
+	}
+
+	config := make(map[string]interface{})
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	if _, err := interpolateTree(config, filepath.Base(path), lookup); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func decodeProject(config map[string]interface{}) (*Project, error) {
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	project := &Project{}
+	if err := yaml.Unmarshal(data, project); err != nil {
+		return nil, err
+	}
+	if project.Services == nil {
+		project.Services = make(map[string]*Service)
+	}
+	for name, service := range project.Services {
+		if service == nil {
+			service = &Service{}
+			project.Services[name] = service
+		}
+		service.Name = name
+		if service.Image == "" && service.Build == nil {
+			return nil, fmt.Errorf("service %q has neither an image nor a build context", name)
+		}
+	}
+	return project, nil
+}
+
+func projectName(options Options, lookup lookupFunc, fromFile, workingDir string) string {
+	name := options.ProjectName
+	if name == "" {
+		name, _ = lookup("COMPOSE_PROJECT_NAME")
+	}
+	if name == "" {
+		name = fromFile
+	}
+	if name == "" {
+		name = filepath.Base(workingDir)
+	}
+	return invalidProjectChars.ReplaceAllString(strings.ToLower(name), "")
+}
+
+func activeProfiles(options Options, lookup lookupFunc) map[string]bool {
+	active := make(map[string]bool)
+	for _, profile := range options.Profiles {
+		active[profile] = true
+	}
+	if env, ok := lookup("COMPOSE_PROFILES"); ok {
+		for _, profile := range strings.Split(env, ",") {
+			if profile = strings.TrimSpace(profile); profile != "" {
+				active[profile] = true
+			}
+		}
+	}
+	return active
+}
+
+// applyProfiles keeps services without profiles and those with an active
+// one ("*" activates all). An enabled service can't depend on a disabled
+// one.
+func applyProfiles(project *Project, active map[string]bool) error {
+	project.DisabledServices = make(map[string]*Service)
+	for name, service := range project.Services {
+		if !serviceEnabled(service, active) {
+			project.DisabledServices[name] = service
+			delete(project.Services, name)
+		}
+	}
+
+	names := make([]string, 0, len(project.Services))
+	for name := range project.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, dependency := range project.Services[name].DependsOn {
+			if _, ok := project.Services[dependency]; ok {
+				continue
+			}
+			if disabled, ok := project.DisabledServices[dependency]; ok {
+				return fmt.Errorf("service %q depends on %q, which needs one of the profiles %v", name, dependency, disabled.Profiles)
+			}
+			return fmt.Errorf("service %q depends on undefined service %q", name, dependency)
+		}
+	}
+	return nil
+}
+
+func serviceEnabled(service *Service, active map[string]bool) bool {
+	if len(service.Profiles) == 0 || active["*"] {
+		return true
+	}
+	for _, profile := range service.Profiles {
+		if active[profile] {
+			return true
+		}
+	}
+	return false
+}
+
+// ServiceNames returns the enabled services, sorted.
+func (p *Project) ServiceNames() []string {
+	names := make([]string, 0, len(p.Services))
+	for name := range p.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
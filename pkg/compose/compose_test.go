@@ -0,0 +1,242 @@
+package compose
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func TestInterpolate(t *testing.T) {
+	env := map[string]string{"SET": "value", "EMPTY": ""}
+	lookup := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+
+	for input, want := range map[string]string{
+		"$SET and ${SET}":            "value and value",
+		"${UNSET:-default}":          "default",
+		"${EMPTY:-default}":          "default",
+		"${EMPTY-default}":           "",
+		"${UNSET-default}":           "default",
+		"${SET:+alt}|${UNSET:+alt}":  "alt|",
+		"${EMPTY+alt}|${EMPTY:+alt}": "alt|",
+		"${UNSET:-${SET}-nested}":    "value-nested",
+		"$$SET costs $$5":            "$SET costs $5",
+		"$UNSET.":                    ".",
+		"price: 5$":                  "price: 5$",
+		"${SET:?must be set}/data":   "value/data",
+		"no variables at all":        "no variables at all",
+	} {
+		got, err := interpolate(input, lookup)
+		require.NoError(t, err, input)
+		assert.Equal(t, want, got, input)
+	}
+
+	_, err := interpolate("${EMPTY:?needs a value}", lookup)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "needs a value")
+
+	_, err = interpolate("${UNCLOSED", lookup)
+	assert.Error(t, err)
+	_, err = interpolate("${1BAD}", lookup)
+	assert.Error(t, err)
+}
+
+func TestLoadInterpolatesFromEnvFile(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, ".env", `# defaults
+TAG=1.0
+export REGISTRY=registry.local
+GREETING="hello ${USER_NAME:-world}"
+LITERAL='$TAG'
+PORT=8080 # the web port
+`)
+	writeFile(t, dir, "compose.yaml", `
+services:
+  web:
+    image: ${REGISTRY}/web:${TAG:-latest}
+    command: echo "$GREETING" $$HOME
+    environment:
+      - PORT=${PORT}
+      - LITERAL=${LITERAL}
+      - PASSTHROUGH
+    ports:
+      - "${PORT}:80"
+`)
+
+	project, err := Load(Options{WorkingDir: dir, Environment: map[string]string{"TAG": "2.0"}})
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Base(dir), project.Name)
+
+	web := project.Services["web"]
+	require.NotNil(t, web)
+	assert.Equal(t, "registry.local/web:2.0", web.Image, "The environment should override .env")
+	assert.Equal(t, ShellCommand{"echo", "hello world", "$HOME"}, web.Command)
+	assert.Equal(t, "8080", *web.Environment["PORT"])
+	assert.Equal(t, "$TAG", *web.Environment["LITERAL"], "Single-quoted values should not be interpolated")
+	assert.Nil(t, web.Environment["PASSTHROUGH"])
+	assert.Equal(t, []string{"8080:80"}, web.Ports)
+
+	writeFile(t, dir, "compose.yaml", "services:\n  web:\n    image: ${IMAGE:?set IMAGE to the image to run}\n")
+	_, err = Load(Options{WorkingDir: dir, Environment: map[string]string{}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "set IMAGE to the image to run")
+}
+
+func TestLoadProfiles(t *testing.T) {
+	dir := t.TempDir()
+	file := writeFile(t, dir, "compose.yaml", `
+name: Shop
+services:
+  web:
+    image: web
+    depends_on: [db]
+  db:
+    image: postgres
+  debug:
+    image: busybox
+    profiles: [debug]
+  metrics:
+    image: prometheus
+    profiles: [ops, debug]
+  admin:
+    image: admin
+    profiles: [admin]
+    depends_on:
+      db:
+        condition: service_started
+`)
+
+	project, err := Load(Options{Files: []string{file}, Environment: map[string]string{}})
+	require.NoError(t, err)
+	assert.Equal(t, "shop", project.Name)
+	assert.Equal(t, []string{"db", "web"}, project.ServiceNames())
+	assert.Contains(t, project.DisabledServices, "debug")
+
+	project, err = Load(Options{Files: []string{file}, Profiles: []string{"debug"}, Environment: map[string]string{}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"db", "debug", "metrics", "web"}, project.ServiceNames())
+
+	project, err = Load(Options{Files: []string{file}, Environment: map[string]string{"COMPOSE_PROFILES": "ops,admin"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"admin", "db", "metrics", "web"}, project.ServiceNames())
+	assert.Equal(t, KeyList{"db"}, project.Services["admin"].DependsOn)
+
+	project, err = Load(Options{Files: []string{file}, Profiles: []string{"*"}, Environment: map[string]string{}})
+	require.NoError(t, err)
+	assert.Len(t, project.Services, 5)
+
+	writeFile(t, dir, "compose.yaml", `
+services:
+  web:
+    image: web
+    depends_on: [debug]
+  debug:
+    image: busybox
+    profiles: [debug]
+`)
+	_, err = Load(Options{Files: []string{file}, Environment: map[string]string{}})
+	require.Error(t, err, "Enabled services should not depend on disabled ones")
+	assert.Contains(t, err.Error(), "debug")
+}
+
+func TestLoadExtends(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "common"), 0755))
+	writeFile(t, dir, "common/base.yaml", `
+services:
+  app:
+    build: ./app
+    environment:
+      LOG_LEVEL: info
+      REGION: ${REGION:-eu}
+    volumes:
+      - ./data:/data
+    labels: [team=core]
+`)
+	file := writeFile(t, dir, "compose.yaml", `
+services:
+  base:
+    image: base
+    command: ["serve"]
+    ports: ["80:80"]
+  web:
+    extends: base
+    command: serve --verbose
+    ports: ["443:443"]
+  worker:
+    extends:
+      file: common/base.yaml
+      service: app
+    environment:
+      - LOG_LEVEL=debug
+    labels:
+      role: worker
+`)
+
+	project, err := Load(Options{Files: []string{file}, Environment: map[string]string{"REGION": "us"}})
+	require.NoError(t, err)
+
+	web := project.Services["web"]
+	assert.Equal(t, "base", web.Image)
+	assert.Equal(t, ShellCommand{"serve", "--verbose"}, web.Command, "Commands should be replaced, not merged")
+	assert.Equal(t, []string{"80:80", "443:443"}, web.Ports)
+
+	worker := project.Services["worker"]
+	require.NotNil(t, worker.Build)
+	assert.Equal(t, filepath.Join(dir, "common", "app"), worker.Build.Context, "Paths should be relative to the extended file")
+	assert.Equal(t, []string{filepath.Join(dir, "common", "data") + ":/data"}, worker.Volumes)
+	assert.Equal(t, "debug", *worker.Environment["LOG_LEVEL"])
+	assert.Equal(t, "us", *worker.Environment["REGION"])
+	assert.Equal(t, "core", *worker.Labels["team"])
+	assert.Equal(t, "worker", *worker.Labels["role"])
+
+	writeFile(t, dir, "compose.yaml", `
+services:
+  a:
+    extends: b
+    image: a
+  b:
+    extends: a
+`)
+	_, err = Load(Options{Files: []string{file}, Environment: map[string]string{}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "circular")
+}
+
+func TestLoadOverrideFiles(t *testing.T) {
+	dir := t.TempDir()
+	base := writeFile(t, dir, "compose.yaml", `
+services:
+  web:
+    image: web:1
+    environment: [A=1, B=2]
+    ports: ["80:80"]
+`)
+	override := writeFile(t, dir, "compose.override.yaml", `
+services:
+  web:
+    image: web:2
+    environment:
+      B: "3"
+    ports: ["8080:8080"]
+`)
+
+	project, err := Load(Options{Files: []string{base, override}, Environment: map[string]string{}})
+	require.NoError(t, err)
+	web := project.Services["web"]
+	assert.Equal(t, "web:2", web.Image)
+	assert.Equal(t, "1", *web.Environment["A"])
+	assert.Equal(t, "3", *web.Environment["B"])
+	assert.Equal(t, []string{"80:80", "8080:8080"}, web.Ports)
+}
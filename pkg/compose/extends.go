@@ -0,0 +1,239 @@
+package compose
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// replacedLists are sequences an override replaces instead of extending.
+var replacedLists = map[string]bool{
+	"command":    true,
+	"entrypoint": true,
+	"profiles":   true,
+}
+
+// keyedLists may be written as KEY=VALUE lists or as maps, and merge by
+// key either way.
+var keyedLists = map[string]bool{
+	"environment": true,
+	"labels":      true,
+	"args":        true,
+}
+
+// resolveExtends replaces every service that extends another with the
+// other service merged with its own settings. path is the file the
+// services were loaded from, which extends.file is relative to.
+func resolveExtends(config map[string]interface{}, path string, lookup lookupFunc) error {
+	services, err := servicesOf(config, path)
+	if err != nil {
+		return err
+	}
+	for name := range services {
+		if _, err := resolveService(services, name, path, lookup, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func resolveService(services map[string]interface{}, name, path string, lookup lookupFunc, chain []string) (map[string]interface{}, error) {
+	raw, ok := services[name]
+	if !ok {
+		return nil, fmt.Errorf("cannot extend service %q: not defined in %s", name, filepath.Base(path))
+	}
+	service, ok := raw.(map[string]interface{})
+	if !ok {
+		if raw != nil {
+			return nil, fmt.Errorf("service %q must be a mapping", name)
+		}
+		service = make(map[string]interface{})
+		services[name] = service
+	}
+
+	extends, ok := service["extends"]
+	if !ok {
+		return service, nil
+	}
+
+	var baseName, baseFile string
+	switch extends := extends.(type) {
+	case string:
+		baseName = extends
+	case map[string]interface{}:
+		baseName, _ = extends["service"].(string)
+		baseFile, _ = extends["file"].(string)
+	}
+	if baseName == "" {
+		return nil, fmt.Errorf("service %q: extends requires a service", name)
+	}
+
+	link := path + ":" + name
+	for _, seen := range chain {
+		if seen == link {
+			return nil, fmt.Errorf("service %q: circular extends: %s", name, strings.Join(append(chain, link), " -> "))
+		}
+	}
+	chain = append(chain, link)
+
+	var base map[string]interface{}
+	if baseFile == "" {
+		resolved, err := resolveService(services, baseName, path, lookup, chain)
+		if err != nil {
+			return nil, err
+		}
+		base = deepCopy(resolved).(map[string]interface{})
+	} else {
+		basePath := baseFile
+		if !filepath.IsAbs(basePath) {
+			basePath = filepath.Join(filepath.Dir(path), basePath)
+		}
+		config, err := loadFile(basePath, lookup)
+		if err != nil {
+			return nil, fmt.Errorf("service %q: %v", name, err)
+		}
+		baseServices, err := servicesOf(config, basePath)
+		if err != nil {
+			return nil, err
+		}
+		resolved, err := resolveService(baseServices, baseName, basePath, lookup, chain)
+		if err != nil {
+			return nil, err
+		}
+		base = deepCopy(resolved).(map[string]interface{})
+		rebasePaths(base, filepath.Dir(basePath))
+	}
+
+	delete(service, "extends")
+	merged := mergeMaps(base, service)
+	services[name] = merged
+	return merged, nil
+}
+
+func servicesOf(config map[string]interface{}, path string) (map[string]interface{}, error) {
+	raw, ok := config["services"]
+	if !ok || raw == nil {
+		return map[string]interface{}{}, nil
+	}
+	services, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: services must be a mapping", filepath.Base(path))
+	}
+	return services, nil
+}
+
+// rebasePaths makes the relative build context and bind mount sources of
+// a service taken from another file relative to that file, by making
+// them absolute.
+func rebasePaths(service map[string]interface{}, dir string) {
+	rebase := func(p string) string {
+		if strings.HasPrefix(p, ".") {
+			return filepath.Join(dir, p)
+		}
+		return p
+	}
+
+	switch build := service["build"].(type) {
+	case string:
+		service["build"] = rebase(build)
+	case map[string]interface{}:
+		if context, ok := build["context"].(string); ok {
+			build["context"] = rebase(context)
+		}
+	}
+
+	if volumes, ok := service["volumes"].([]interface{}); ok {
+		for i, volume := range volumes {
+			if spec, ok := volume.(string); ok && strings.HasPrefix(spec, ".") {
+				volumes[i] = rebase(spec)
+			}
+		}
+	}
+}
+
+// mergeMaps merges override into base following the compose merge rules:
+// mappings merge recursively, most sequences are appended to without
+// duplicates, and everything else is replaced.
+func mergeMaps(base, override map[string]interface{}) map[string]interface{} {
+	for key, value := range override {
+		current, exists := base[key]
+		if !exists || current == nil {
+			base[key] = value
+			continue
+		}
+
+		if keyedLists[key] {
+			base[key] = mergeMaps(keyedMap(current), keyedMap(value))
+			continue
+		}
+
+		switch value := value.(type) {
+		case map[string]interface{}:
+			if current, ok := current.(map[string]interface{}); ok {
+				base[key] = mergeMaps(current, value)
+				continue
+			}
+		case []interface{}:
+			if current, ok := current.([]interface{}); ok && !replacedLists[key] {
+				base[key] = appendUnique(current, value)
+				continue
+			}
+		}
+		base[key] = value
+	}
+	return base
+}
+
+// keyedMap turns a KEY=VALUE list into a map; maps are returned as is.
+func keyedMap(value interface{}) map[string]interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		return value
+	case []interface{}:
+		result := make(map[string]interface{}, len(value))
+		for _, entry := range value {
+			key, v, ok := strings.Cut(fmt.Sprint(entry), "=")
+			if ok {
+				result[key] = v
+			} else {
+				result[key] = nil
+			}
+		}
+		return result
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+func appendUnique(base, items []interface{}) []interface{} {
+	seen := make(map[string]bool, len(base))
+	for _, item := range base {
+		seen[fmt.Sprint(item)] = true
+	}
+	for _, item := range items {
+		if key := fmt.Sprint(item); !seen[key] {
+			seen[key] = true
+			base = append(base, item)
+		}
+	}
+	return base
+}
+
+func deepCopy(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(value))
+		for k, v := range value {
+			result[k] = deepCopy(v)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(value))
+		for i, v := range value {
+			result[i] = deepCopy(v)
+		}
+		return result
+	default:
+		return value
+	}
+}
@@ -0,0 +1,239 @@
+package compose
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// lookupFunc returns the value of a variable and whether it is set.
+type lookupFunc func(name string) (string, bool)
+
+// interpolate substitutes variables in s the way the compose spec does:
+// $VAR and ${VAR}, ${VAR:-default} and ${VAR-default} when unset (or
+// empty, with the colon), ${VAR:?error} and ${VAR?error} to require a
+// value, and ${VAR:+replacement} and ${VAR+replacement} when set. $$ is a
+// literal $. Unset variables without a default become empty strings.
+func interpolate(s string, lookup lookupFunc) (string, error) {
+	if !strings.Contains(s, "$") {
+		return s, nil
+	}
+
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			out.WriteByte(s[i])
+			continue
+		}
+
+		switch next := s[i+1]; {
+		case next == '$':
+			out.WriteByte('$')
+			i++
+		case next == '{':
+			end := matchingBrace(s, i+2)
+			if end < 0 {
+				return "", fmt.Errorf("invalid interpolation format for %q: missing closing brace", s)
+			}
+			value, err := substitute(s[i+2:end], lookup)
+			if err != nil {
+				return "", err
+			}
+			out.WriteString(value)
+			i = end
+		case isNameStart(next):
+			end := i + 1
+			for end < len(s) && isNameChar(s[end]) {
+				end++
+			}
+			value, _ := lookupOrWarn(s[i+1:end], lookup)
+			out.WriteString(value)
+			i = end - 1
+		default:
+			out.WriteByte('$')
+		}
+	}
+	return out.String(), nil
+}
+
+// substitute resolves the inside of a ${...} expression.
+func substitute(expr string, lookup lookupFunc) (string, error) {
+	end := 0
+	for end < len(expr) && isNameChar(expr[end]) {
+		end++
+	}
+	name, rest := expr[:end], expr[end:]
+	if name == "" || !isNameStart(name[0]) {
+		return "", fmt.Errorf("invalid interpolation format for ${%s}: bad variable name", expr)
+	}
+	if rest == "" {
+		value, _ := lookupOrWarn(name, lookup)
+		return value, nil
+	}
+
+	colon := strings.HasPrefix(rest, ":")
+	op := strings.TrimPrefix(rest, ":")
+	if op == "" {
+		return "", fmt.Errorf("invalid interpolation format for ${%s}", expr)
+	}
+	operator, arg := op[0], op[1:]
+
+	value, set := lookup(name)
+	// With a colon, an empty value counts as unset
+	present := set && (!colon || value != "")
+
+	switch operator {
+	case '-':
+		if present {
+			return value, nil
+		}
+		return interpolate(arg, lookup)
+	case '?':
+		if present {
+			return value, nil
+		}
+		message, err := interpolate(arg, lookup)
+		if err != nil {
+			return "", err
+		}
+		if message == "" {
+			message = "required variable is missing a value"
+		}
+		return "", fmt.Errorf("required variable %s is missing a value: %s", name, message)
+	case '+':
+		if present {
+			return interpolate(arg, lookup)
+		}
+		return "", nil
+	default:
+		return "", fmt.Errorf("invalid interpolation format for ${%s}", expr)
+	}
+}
+
+// matchingBrace returns the index of the brace closing the expression
+// starting at start, allowing nested ${...} in defaults.
+func matchingBrace(s string, start int) int {
+	depth := 1
+	for i := start; i < len(s); i++ {
+		switch {
+		case s[i] == '$' && i+1 < len(s) && s[i+1] == '{':
+			depth++
+			i++
+		case s[i] == '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func lookupOrWarn(name string, lookup lookupFunc) (string, bool) {
+	value, ok := lookup(name)
+	if !ok {
+		logrus.Warnf("The %q variable is not set. Defaulting to a blank string.", name)
+	}
+	return value, ok
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isNameChar(c byte) bool {
+	return isNameStart(c) || (c >= '0' && c <= '9')
+}
+
+// interpolateTree interpolates every string value of a parsed file, but
+// not its keys.
+func interpolateTree(node interface{}, path string, lookup lookupFunc) (interface{}, error) {
+	switch value := node.(type) {
+	case string:
+		result, err := interpolate(value, lookup)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		return result, nil
+	case map[string]interface{}:
+		for k, v := range value {
+			result, err := interpolateTree(v, path+"."+k, lookup)
+			if err != nil {
+				return nil, err
+			}
+			value[k] = result
+		}
+		return value, nil
+	case []interface{}:
+		for i, v := range value {
+			result, err := interpolateTree(v, fmt.Sprintf("%s[%d]", path, i), lookup)
+			if err != nil {
+				return nil, err
+			}
+			value[i] = result
+		}
+		return value, nil
+	default:
+		return node, nil
+	}
+}
+
+// readEnvFile parses a .env file: KEY=VALUE lines, optionally prefixed
+// with export, with # comments. Single-quoted values are taken literally;
+// unquoted and double-quoted ones may refer to variables set before them.
+func readEnvFile(path string, lookup lookupFunc) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read env file: %v", err)
+	}
+	defer file.Close()
+
+	env := make(map[string]string)
+	scoped := func(name string) (string, bool) {
+		if value, ok := env[name]; ok {
+			return value, true
+		}
+		return lookup(name)
+	}
+
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("%s:%d: invalid line %q", path, lineNo, line)
+		}
+		value = strings.TrimSpace(value)
+
+		switch {
+		case len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'':
+			value = value[1 : len(value)-1]
+		case len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"':
+			value = strings.NewReplacer(`\n`, "\n", `\t`, "\t", `\"`, `"`, `\\`, `\`).Replace(value[1 : len(value)-1])
+			if value, err = interpolate(value, scoped); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, lineNo, err)
+			}
+		default:
+			if comment := strings.Index(value, " #"); comment >= 0 {
+				value = strings.TrimSpace(value[:comment])
+			}
+			if value, err = interpolate(value, scoped); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, lineNo, err)
+			}
+		}
+		env[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read env file: %v", err)
+	}
+	return env, nil
+}
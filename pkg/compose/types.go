@@ -0,0 +1,187 @@
+package compose
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Project is a loaded compose application: the services enabled by the
+// active profiles, with variables interpolated and extends resolved.
+type Project struct {
+	Name     string                 `yaml:"name"`
+	Services map[string]*Service    `yaml:"services"`
+	Networks map[string]interface{} `yaml:"networks,omitempty"`
+	Volumes  map[string]interface{} `yaml:"volumes,omitempty"`
+	// DisabledServices are left out by the active profiles
+	DisabledServices map[string]*Service `yaml:"-"`
+}
+
+// Service is one service of a compose file. Fields this implementation
+// doesn't model are dropped when the file is loaded.
+type Service struct {
+	Name        string            `yaml:"-"`
+	Image       string            `yaml:"image,omitempty"`
+	Build       *BuildConfig      `yaml:"build,omitempty"`
+	Command     ShellCommand      `yaml:"command,omitempty"`
+	Entrypoint  ShellCommand      `yaml:"entrypoint,omitempty"`
+	Environment MappingWithEquals `yaml:"environment,omitempty"`
+	Labels      MappingWithEquals `yaml:"labels,omitempty"`
+	Ports       []string          `yaml:"ports,omitempty"`
+	Volumes     []string          `yaml:"volumes,omitempty"`
+	Networks    KeyList           `yaml:"networks,omitempty"`
+	DependsOn   KeyList           `yaml:"depends_on,omitempty"`
+	Profiles    []string          `yaml:"profiles,omitempty"`
+	Restart     string            `yaml:"restart,omitempty"`
+	User        string            `yaml:"user,omitempty"`
+	WorkingDir  string            `yaml:"working_dir,omitempty"`
+	Hostname    string            `yaml:"hostname,omitempty"`
+}
+
+// BuildConfig is a service's build section, given either as a context
+// path or in full.
+type BuildConfig struct {
+	Context    string            `yaml:"context,omitempty"`
+	Dockerfile string            `yaml:"dockerfile,omitempty"`
+	Args       MappingWithEquals `yaml:"args,omitempty"`
+	Target     string            `yaml:"target,omitempty"`
+}
+
+func (b *BuildConfig) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		b.Context = node.Value
+		return nil
+	}
+	type plain BuildConfig
+	return node.Decode((*plain)(b))
+}
+
+// ShellCommand is a command given as a list, or as a string split like a
+// shell would.
+type ShellCommand []string
+
+func (c *ShellCommand) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		args, err := splitCommand(node.Value)
+		if err != nil {
+			return err
+		}
+		*c = args
+		return nil
+	}
+	var args []string
+	if err := node.Decode(&args); err != nil {
+		return err
+	}
+	*c = args
+	return nil
+}
+
+// MappingWithEquals is a mapping given either as a map or as a list of
+// KEY=VALUE strings. A nil value, from a bare KEY, is left for the
+// runtime to fill in.
+type MappingWithEquals map[string]*string
+
+func (m *MappingWithEquals) UnmarshalYAML(node *yaml.Node) error {
+	result := make(MappingWithEquals)
+	switch node.Kind {
+	case yaml.SequenceNode:
+		var entries []string
+		if err := node.Decode(&entries); err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			key, value, ok := strings.Cut(entry, "=")
+			if ok {
+				result[key] = &value
+			} else {
+				result[key] = nil
+			}
+		}
+	case yaml.MappingNode:
+		var entries map[string]*string
+		if err := node.Decode(&entries); err != nil {
+			return err
+		}
+		for key, value := range entries {
+			result[key] = value
+		}
+	default:
+		return fmt.Errorf("line %d: expected a list or a mapping", node.Line)
+	}
+	*m = result
+	return nil
+}
+
+// KeyList is a list of names, also accepting the long mapping syntax
+// (depends_on with conditions, networks with aliases) of which only the
+// keys are kept.
+type KeyList []string
+
+func (l *KeyList) UnmarshalYAML(node *yaml.Node) error {
+	var keys []string
+	switch node.Kind {
+	case yaml.SequenceNode:
+		if err := node.Decode(&keys); err != nil {
+			return err
+		}
+	case yaml.MappingNode:
+		for i := 0; i < len(node.Content); i += 2 {
+			keys = append(keys, node.Content[i].Value)
+		}
+		sort.Strings(keys)
+	default:
+		return fmt.Errorf("line %d: expected a list or a mapping", node.Line)
+	}
+	*l = keys
+	return nil
+}
+
+// splitCommand splits a command string into arguments, honoring single
+// and double quotes and backslash escapes.
+func splitCommand(s string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inArg := false
+	var quote byte
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else if c == '\\' && quote == '"' && i+1 < len(s) {
+				i++
+				current.WriteByte(s[i])
+			} else {
+				current.WriteByte(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inArg = true
+		case c == '\\' && i+1 < len(s):
+			i++
+			current.WriteByte(s[i])
+			inArg = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteByte(c)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in command %q", s)
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
@@ -0,0 +1,108 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"docker-impl/pkg/types"
+)
+
+const DefaultConfigPath = "/etc/mydocker/daemon.json"
+
+type DaemonConfig struct {
+	Hooks types.Hooks `json:"hooks"`
+	// Registry is the endpoint images are pulled from. When empty, pulls
+	// only create local placeholder images.
+	Registry string `json:"registry"`
+	// A container restarted CrashLoopThreshold times within CrashLoopWindow
+	// seconds is reported as crash looping.
+	CrashLoopThreshold int `json:"crash_loop_threshold"`
+	CrashLoopWindow    int `json:"crash_loop_window"`
+	// Telemetry enables the local operation log read by
+	// "mydocker system telemetry report". Nothing leaves the machine.
+	Telemetry bool `json:"telemetry"`
+	// SignaturePolicy is a trust policy file listing registries whose
+	// images must be signed. Verification is off when it is empty.
+	SignaturePolicy string `json:"signature_policy"`
+	// TrustOffline verifies signatures only against trust data cached by
+	// earlier online verifications, which stays valid for TrustCacheTTL
+	// seconds (7 days when zero). Covered images without valid cached
+	// trust data are refused.
+	TrustOffline  bool `json:"trust_offline"`
+	TrustCacheTTL int  `json:"trust_cache_ttl"`
+	// VulnerabilityDB is the URL "image scan --update-db" downloads the
+	// vulnerability database from.
+	VulnerabilityDB string `json:"vulnerability_db"`
+	// RegistryMirrors are tried in order before Registry.
+	RegistryMirrors []string `json:"registry_mirrors"`
+	// RegistryAttempts is how many times registry requests failing with a
+	// 429, a 5xx or a network error are tried (3 when zero), backing off
+	// exponentially up to RegistryMaxBackoff seconds (10 when zero). A
+	// registry failing repeatedly is skipped for a while.
+	RegistryAttempts   int `json:"registry_attempts"`
+	RegistryMaxBackoff int `json:"registry_max_backoff"`
+	// BlobCache is a directory caching pulled blobs by digest, so layers
+	// shared between images are only downloaded once. BlobCacheSize caps
+	// it in bytes; zero means unlimited.
+	BlobCache     string `json:"blob_cache"`
+	BlobCacheSize int64  `json:"blob_cache_size"`
+	// LazyPull pulls eStargz layers lazily: only their table of contents
+	// is downloaded, and files are fetched from the registry when read.
+	// PrefetchWorkers (4 when zero) fetch the files images need to start
+	// right after the pull.
+	LazyPull        bool `json:"lazy_pull"`
+	PrefetchWorkers int  `json:"prefetch_workers"`
+	// StorageDriver is the graph driver container filesystems are made
+	// with: overlay (the default), vfs or btrfs.
+	StorageDriver string `json:"storage_driver"`
+	// StorageQuotas lets containers (--storage-opt size=) and volumes (a
+	// size option) be given a size limit.
+	StorageQuotas bool `json:"storage_quotas"`
+	// VolumeDriver creates volumes that don't name a driver: local (the
+	// default), nfs, tmpfs or crypt.
+	VolumeDriver string `json:"volume_driver"`
+	// StorageEncryption keeps volume data in LUKS images (the crypt volume
+	// driver, the default then) and, with EncryptLayers, image and
+	// container layers too. Keys are derived from EncryptionKeyFile, or
+	// printed by EncryptionKeyCommand, e.g. a KMS client, given the key ID.
+	StorageEncryption    bool   `json:"storage_encryption"`
+	EncryptionKeyFile    string `json:"encryption_key_file"`
+	EncryptionKeyCommand string `json:"encryption_key_command"`
+	EncryptLayers        bool   `json:"encrypt_layers"`
+	// IPv6 gives the bridge the IPv6 subnet FixedCIDRv6 (fd00:17::/64 when
+	// empty), and publishes ports on both IPv4 and IPv6 unless --publish
+	// picks a family.
+	IPv6        bool   `json:"ipv6"`
+	FixedCIDRv6 string `json:"fixed_cidr_v6"`
+	// UserlandProxy serves published ports to the host and to containers
+	// with a proxy process per port. Otherwise NAT rules alone do, which
+	// keeps the clients' addresses but can't reach ports published on
+	// IPv6 from ::1.
+	UserlandProxy bool `json:"userland_proxy"`
+}
+
+func Load(path string) (*DaemonConfig, error) {
+	if path == "" {
+		path = os.Getenv("MYDOCKER_CONFIG")
+	}
+	if path == "" {
+		path = DefaultConfigPath
+	}
+
+	config := &DaemonConfig{}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return config, nil
+		}
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+
+	return config, nil
+}
@@ -0,0 +1,322 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"docker-impl/pkg/types"
+	"github.com/sirupsen/logrus"
+)
+
+const minMemoryLimit = 6 * 1024 * 1024
+
+var cgroupV1MemoryRoot = "/sys/fs/cgroup/memory/mydocker"
+
+// memoryCgroupSupport describes what the memory controller on this host
+// can enforce. version is 0 when no memory cgroup is usable.
+type memoryCgroupSupport struct {
+	version    int
+	swapLimit  bool
+	swappiness bool
+}
+
+func probeMemoryCgroup() memoryCgroupSupport {
+	if controllers, err := os.ReadFile("/sys/fs/cgroup/cgroup.controllers"); err == nil {
+		if !strings.Contains(string(controllers), "memory") || os.MkdirAll(cgroupRoot, 0755) != nil {
+			return memoryCgroupSupport{}
+		}
+		// memory.swap.max only exists in child cgroups when the kernel
+		// accounts swap; cgroup v2 has no per-cgroup swappiness
+		return memoryCgroupSupport{version: 2, swapLimit: fileExists(filepath.Join(cgroupRoot, "memory.swap.max"))}
+	}
+
+	if os.MkdirAll(cgroupV1MemoryRoot, 0755) != nil {
+		return memoryCgroupSupport{}
+	}
+	return memoryCgroupSupport{
+		version:    1,
+		swapLimit:  fileExists(filepath.Join(cgroupV1MemoryRoot, "memory.memsw.limit_in_bytes")),
+		swappiness: fileExists(filepath.Join(cgroupV1MemoryRoot, "memory.swappiness")),
+	}
+}
+
+// checkMemoryResources rejects invalid memory settings and drops the ones
+// the kernel can't enforce, returning a warning for each so they are not
+// silently ignored. Like docker, MemorySwap is the total of memory and
+// swap, -1 means unlimited swap and 0 means twice the memory limit.
+func checkMemoryResources(hostConfig *types.HostConfig) ([]string, error) {
+	if hostConfig.Memory < 0 {
+		return nil, fmt.Errorf("invalid memory limit: %d", hostConfig.Memory)
+	}
+	if hostConfig.Memory > 0 && hostConfig.Memory < minMemoryLimit {
+		return nil, fmt.Errorf("minimum memory limit allowed is 6MB")
+	}
+	if hostConfig.MemorySwap > 0 && hostConfig.Memory == 0 {
+		return nil, fmt.Errorf("you should always set the memory limit when using the memory-swap limit")
+	}
+	if hostConfig.MemorySwap > 0 && hostConfig.MemorySwap < hostConfig.Memory {
+		return nil, fmt.Errorf("minimum memory-swap limit should be larger than memory limit")
+	}
+	if hostConfig.MemorySwap < -1 {
+		return nil, fmt.Errorf("invalid memory-swap limit: %d", hostConfig.MemorySwap)
+	}
+	if s := hostConfig.MemorySwappiness; s != nil && (*s < 0 || *s > 100) {
+		return nil, fmt.Errorf("invalid value: %d, valid memory swappiness range is 0-100", *s)
+	}
+
+	if hostConfig.Memory == 0 && hostConfig.MemorySwappiness == nil {
+		return nil, nil
+	}
+
+	var warnings []string
+	support := probeMemoryCgroup()
+	if hostConfig.Memory > 0 && support.version == 0 {
+		warnings = append(warnings, "Your kernel does not support memory limit capabilities or the cgroup is not mounted. Limitation discarded.")
+		hostConfig.Memory = 0
+		hostConfig.MemorySwap = 0
+	}
+	if hostConfig.Memory > 0 && hostConfig.MemorySwap != -1 && !support.swapLimit {
+		warnings = append(warnings, "Your kernel does not support swap limit capabilities or the cgroup is not mounted. Memory limited without swap.")
+		hostConfig.MemorySwap = -1
+	}
+	if hostConfig.MemorySwappiness != nil && !support.swappiness {
+		warnings = append(warnings, "Your kernel does not support memory swappiness capabilities or the cgroup is not mounted. Memory swappiness discarded.")
+		hostConfig.MemorySwappiness = nil
+	}
+	return warnings, nil
+}
+
+// setupMemoryCgroup places pid in a cgroup for the container carrying its
+// memory limits. Containers without memory settings are left alone.
+func setupMemoryCgroup(container *types.Container, pid int) error {
+	hostConfig := container.HostConfig
+	if hostConfig.Memory == 0 && hostConfig.MemorySwappiness == nil {
+		return nil
+	}
+
+	swapTotal := hostConfig.MemorySwap
+	if swapTotal == 0 && hostConfig.Memory > 0 {
+		swapTotal = 2 * hostConfig.Memory
+	}
+
+	support := probeMemoryCgroup()
+	switch support.version {
+	case 2:
+		dir := filepath.Join(cgroupRoot, container.ID)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create cgroup: %v", err)
+		}
+		if hostConfig.Memory > 0 {
+			if err := writeCgroupFile(dir, "memory.max", strconv.FormatInt(hostConfig.Memory, 10)); err != nil {
+				return err
+			}
+			if support.swapLimit {
+				swapMax := "max"
+				if swapTotal > 0 {
+					swapMax = strconv.FormatInt(swapTotal-hostConfig.Memory, 10)
+				}
+				if err := writeCgroupFile(dir, "memory.swap.max", swapMax); err != nil {
+					return err
+				}
+			}
+		}
+		return writeCgroupFile(dir, "cgroup.procs", strconv.Itoa(pid))
+	case 1:
+		dir := filepath.Join(cgroupV1MemoryRoot, container.ID)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create cgroup: %v", err)
+		}
+		// memory.limit_in_bytes has to be set before memsw, which may
+		// never be lower than it
+		if hostConfig.Memory > 0 {
+			if err := writeCgroupFile(dir, "memory.limit_in_bytes", strconv.FormatInt(hostConfig.Memory, 10)); err != nil {
+				return err
+			}
+			if support.swapLimit {
+				if err := writeCgroupFile(dir, "memory.memsw.limit_in_bytes", strconv.FormatInt(swapTotal, 10)); err != nil {
+					return err
+				}
+			}
+		}
+		if hostConfig.MemorySwappiness != nil && support.swappiness {
+			if err := writeCgroupFile(dir, "memory.swappiness", strconv.FormatInt(*hostConfig.MemorySwappiness, 10)); err != nil {
+				return err
+			}
+		}
+		return writeCgroupFile(dir, "cgroup.procs", strconv.Itoa(pid))
+	default:
+		return fmt.Errorf("memory cgroup is not available")
+	}
+}
+
+// joinContainerCgroup adds pid to the memory cgroup of a container, if it
+// has one, so it counts against the container's limits.
+func joinContainerCgroup(containerID string, pid int) error {
+	for _, dir := range []string{filepath.Join(cgroupRoot, containerID), filepath.Join(cgroupV1MemoryRoot, containerID)} {
+		if fileExists(filepath.Join(dir, "cgroup.procs")) {
+			return writeCgroupFile(dir, "cgroup.procs", strconv.Itoa(pid))
+		}
+	}
+	return nil
+}
+
+func removeMemoryCgroup(containerID string) {
+	for _, dir := range []string{filepath.Join(cgroupRoot, containerID), filepath.Join(cgroupV1MemoryRoot, containerID)} {
+		if err := os.Remove(dir); err != nil && !os.IsNotExist(err) {
+			logrus.Debugf("Failed to remove cgroup %s: %v", dir, err)
+		}
+	}
+}
+
+// memoryStats reads memory and swap usage and limits of a container. Swap
+// usage is missing when the kernel doesn't account swap.
+func memoryStats(containerID string) map[string]interface{} {
+	stats := make(map[string]interface{})
+
+	dir := filepath.Join(cgroupRoot, containerID)
+	if fileExists(filepath.Join(dir, "memory.current")) {
+		setCgroupStat(stats, "memory_usage", dir, "memory.current")
+		setCgroupStat(stats, "memory_limit", dir, "memory.max")
+		setCgroupStat(stats, "swap_usage", dir, "memory.swap.current")
+		setCgroupStat(stats, "swap_limit", dir, "memory.swap.max")
+		return stats
+	}
+
+	dir = filepath.Join(cgroupV1MemoryRoot, containerID)
+	if !fileExists(filepath.Join(dir, "memory.usage_in_bytes")) {
+		return stats
+	}
+	setCgroupStat(stats, "memory_usage", dir, "memory.usage_in_bytes")
+	setCgroupStat(stats, "memory_limit", dir, "memory.limit_in_bytes")
+	// memsw counts memory and swap together
+	if total, err := readCgroupInt(dir, "memory.memsw.usage_in_bytes"); err == nil {
+		if usage, ok := stats["memory_usage"].(int64); ok {
+			stats["swap_usage"] = total - usage
+		}
+		if totalLimit, err := readCgroupInt(dir, "memory.memsw.limit_in_bytes"); err == nil {
+			if limit, ok := stats["memory_limit"].(int64); ok {
+				stats["swap_limit"] = totalLimit - limit
+			}
+		}
+	}
+	if swappiness, err := readCgroupInt(dir, "memory.swappiness"); err == nil {
+		stats["memory_swappiness"] = swappiness
+	}
+	return stats
+}
+
+// ResourceUsage reads the CPU time a running container has used so far and
+// the memory it holds. Without a cgroup to read them from, they are those
+// of the container's main process.
+func (m *Manager) ResourceUsage(containerID string) (time.Duration, int64, error) {
+	container, err := m.GetContainer(containerID)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get container: %v", err)
+	}
+	if container.Status != types.StatusRunning || container.PID == 0 {
+		return 0, 0, fmt.Errorf("container is not running")
+	}
+
+	cpuTime, err := containerCPUTime(container.ID, container.PID)
+	if err != nil {
+		return 0, 0, err
+	}
+	memory, ok := memoryStats(container.ID)["memory_usage"].(int64)
+	if !ok {
+		if memory, err = processMemory(container.PID); err != nil {
+			return 0, 0, err
+		}
+	}
+	return cpuTime, memory, nil
+}
+
+// containerCPUTime reads usage_usec from the container's cgroup v2
+// cpu.stat, which exists whichever controllers are enabled, or else the
+// user and system time of pid.
+func containerCPUTime(containerID string, pid int) (time.Duration, error) {
+	if data, err := os.ReadFile(filepath.Join(cgroupRoot, containerID, "cpu.stat")); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 2 && fields[0] == "usage_usec" {
+				usec, err := strconv.ParseInt(fields[1], 10, 64)
+				if err != nil {
+					return 0, fmt.Errorf("invalid cpu.stat: %v", err)
+				}
+				return time.Duration(usec) * time.Microsecond, nil
+			}
+		}
+	}
+
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read process stats: %v", err)
+	}
+	// The command may contain spaces, so fields are counted after it;
+	// utime and stime are fields 14 and 15, in clock ticks of 1/100s
+	stat := string(data)
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	if len(fields) < 13 {
+		return 0, fmt.Errorf("invalid process stats")
+	}
+	var ticks int64
+	for _, field := range fields[11:13] {
+		value, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid process stats: %v", err)
+		}
+		ticks += value
+	}
+	return time.Duration(ticks) * time.Second / 100, nil
+}
+
+// processMemory reads the resident set size of pid.
+func processMemory(pid int) (int64, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/statm", pid))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read process memory: %v", err)
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("invalid process memory stats")
+	}
+	pages, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid process memory stats: %v", err)
+	}
+	return pages * int64(os.Getpagesize()), nil
+}
+
+func setCgroupStat(stats map[string]interface{}, key, dir, file string) {
+	if value, err := readCgroupInt(dir, file); err == nil {
+		stats[key] = value
+	}
+}
+
+// readCgroupInt reads a single number; "max" reads as -1.
+func readCgroupInt(dir, file string) (int64, error) {
+	data, err := os.ReadFile(filepath.Join(dir, file))
+	if err != nil {
+		return 0, err
+	}
+	value := strings.TrimSpace(string(data))
+	if value == "max" {
+		return -1, nil
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+func writeCgroupFile(dir, file, value string) error {
+	if err := os.WriteFile(filepath.Join(dir, file), []byte(value), 0644); err != nil {
+		return fmt.Errorf("failed to set %s: %v", file, err)
+	}
+	return nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,405 @@
+package container
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"docker-impl/pkg/types"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	CheckpointsDir = "checkpoints"
+
+	checkpointFile = "checkpoint.json"
+	// autoCheckpointPrefix names the checkpoints taken for a checkpoint
+	// policy
+	autoCheckpointPrefix = "auto-"
+)
+
+// criuBinary is the CRIU executable checkpoints are taken and restored
+// with.
+var criuBinary = "criu"
+
+var checkpointNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// criuArgs are passed to both dump and restore. They let CRIU handle the
+// TCP connections, locks, unix sockets and host mounts containers
+// commonly have.
+var criuArgs = []string{"--shell-job", "--tcp-established", "--file-locks", "--ext-unix-sk", "--ext-mount-map", "auto"}
+
+func (m *Manager) checkpointDir(containerID, name string) string {
+	return filepath.Join(m.store.GetContainersDir(), containerID, CheckpointsDir, name)
+}
+
+func lookCRIU() (string, error) {
+	path, err := exec.LookPath(criuBinary)
+	if err != nil {
+		return "", fmt.Errorf("checkpoints need criu installed on the host: %v", err)
+	}
+	return path, nil
+}
+
+func runCRIU(criu string, args []string, extraFiles []*os.File) error {
+	cmd := exec.Command(criu, args...)
+	cmd.ExtraFiles = extraFiles
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("criu %s failed: %v: %s", args[0], err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func processAlive(pid int) bool {
+	return pid > 0 && syscall.Kill(pid, 0) == nil
+}
+
+// CreateCheckpoint saves the state of a running container's processes
+// under the given name. The container keeps running unless options.Exit
+// is set.
+func (m *Manager) CreateCheckpoint(containerID string, options types.CheckpointCreateOptions) (*types.Checkpoint, error) {
+	if options.Name == "" {
+		return nil, fmt.Errorf("checkpoint name is required")
+	}
+	return m.createCheckpoint(containerID, options, false, time.Now())
+}
+
+func (m *Manager) createCheckpoint(containerID string, options types.CheckpointCreateOptions, auto bool, now time.Time) (*types.Checkpoint, error) {
+	if !checkpointNamePattern.MatchString(options.Name) {
+		return nil, fmt.Errorf("invalid checkpoint name: %s", options.Name)
+	}
+
+	container, err := m.GetContainer(containerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get container: %v", err)
+	}
+	if container.Status != types.StatusRunning || !processAlive(container.PID) {
+		return nil, fmt.Errorf("container is not running")
+	}
+
+	dir := m.checkpointDir(containerID, options.Name)
+	if _, err := os.Stat(dir); err == nil {
+		return nil, fmt.Errorf("checkpoint %s already exists", options.Name)
+	}
+	criu, err := lookCRIU()
+	if err != nil {
+		return nil, err
+	}
+
+	// Dump into a temporary directory so a failed dump leaves nothing
+	// behind that looks like a checkpoint
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create checkpoints directory: %v", err)
+	}
+	tmpDir, err := os.MkdirTemp(filepath.Dir(dir), ".tmp-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create checkpoint directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	checkpoint := &types.Checkpoint{
+		Name:        options.Name,
+		ContainerID: containerID,
+		CreatedAt:   now,
+		Auto:        auto,
+		Exit:        options.Exit,
+	}
+	if target, err := os.Readlink(fmt.Sprintf("/proc/%d/fd/1", container.PID)); err == nil && target == container.LogPath {
+		checkpoint.LogPath = target
+	}
+
+	args := append([]string{"dump", "--tree", strconv.Itoa(container.PID), "--images-dir", tmpDir, "--log-file", "dump.log"}, criuArgs...)
+	if !options.Exit {
+		args = append(args, "--leave-running")
+	} else {
+		// The dump kills the process; keep the monitor from restarting it
+		m.mu.Lock()
+		m.stopping[containerID] = true
+		m.mu.Unlock()
+	}
+	if err := runCRIU(criu, args, nil); err != nil {
+		if options.Exit {
+			m.mu.Lock()
+			delete(m.stopping, containerID)
+			m.mu.Unlock()
+		}
+		return nil, err
+	}
+
+	checkpoint.Size = dirSize(tmpDir)
+	data, err := json.MarshalIndent(checkpoint, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal checkpoint: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, checkpointFile), data, 0644); err != nil {
+		return nil, fmt.Errorf("failed to save checkpoint: %v", err)
+	}
+	if err := os.Rename(tmpDir, dir); err != nil {
+		return nil, fmt.Errorf("failed to save checkpoint: %v", err)
+	}
+
+	if options.Exit {
+		m.mu.Lock()
+		delete(m.running, containerID)
+		m.mu.Unlock()
+
+		container.PID = 0
+		container.FinishedAt = now
+		transition(container, types.StatusStopped, "checkpoint "+options.Name, now)
+		if err := m.saveContainer(container); err != nil {
+			logrus.Warnf("Failed to save container state: %v", err)
+		}
+	}
+
+	logrus.Infof("Checkpointed container %s as %s (%d bytes)", containerID, options.Name, checkpoint.Size)
+	return checkpoint, nil
+}
+
+// ListCheckpoints returns the checkpoints of a container, oldest first.
+func (m *Manager) ListCheckpoints(containerID string) ([]*types.Checkpoint, error) {
+	if _, err := m.GetContainer(containerID); err != nil {
+		return nil, fmt.Errorf("failed to get container: %v", err)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(m.store.GetContainersDir(), containerID, CheckpointsDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list checkpoints: %v", err)
+	}
+
+	var checkpoints []*types.Checkpoint
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		checkpoint, err := m.GetCheckpoint(containerID, entry.Name())
+		if err != nil {
+			logrus.Warnf("Skipping checkpoint %s: %v", entry.Name(), err)
+			continue
+		}
+		checkpoints = append(checkpoints, checkpoint)
+	}
+	sort.Slice(checkpoints, func(i, j int) bool {
+		return checkpoints[i].CreatedAt.Before(checkpoints[j].CreatedAt)
+	})
+	return checkpoints, nil
+}
+
+func (m *Manager) GetCheckpoint(containerID, name string) (*types.Checkpoint, error) {
+	if !checkpointNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid checkpoint name: %s", name)
+	}
+	data, err := os.ReadFile(filepath.Join(m.checkpointDir(containerID, name), checkpointFile))
+	if err != nil {
+		return nil, fmt.Errorf("checkpoint %s not found", name)
+	}
+	var checkpoint types.Checkpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint %s: %v", name, err)
+	}
+	return &checkpoint, nil
+}
+
+func (m *Manager) RemoveCheckpoint(containerID, name string) error {
+	if _, err := m.GetCheckpoint(containerID, name); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(m.checkpointDir(containerID, name)); err != nil {
+		return fmt.Errorf("failed to remove checkpoint: %v", err)
+	}
+	logrus.Infof("Removed checkpoint %s of container %s", name, containerID)
+	return nil
+}
+
+// RestoreContainer starts a container from a checkpoint, the newest one
+// when name is empty. A container whose process is gone, such as after
+// its node crashed, can be restored even though it is recorded as
+// running.
+func (m *Manager) RestoreContainer(containerID, name string) error {
+	container, err := m.GetContainer(containerID)
+	if err != nil {
+		return fmt.Errorf("failed to get container: %v", err)
+	}
+	if container.Status == types.StatusRunning && processAlive(container.PID) {
+		return fmt.Errorf("container is running")
+	}
+	if container.Status == types.StatusRunning {
+		if err := transition(container, types.StatusDead, "process lost", time.Now()); err != nil {
+			return err
+		}
+	}
+	if err := checkTransition(container, types.StatusRunning); err != nil {
+		return err
+	}
+
+	var checkpoint *types.Checkpoint
+	if name == "" {
+		checkpoints, err := m.ListCheckpoints(containerID)
+		if err != nil {
+			return err
+		}
+		if len(checkpoints) == 0 {
+			return fmt.Errorf("container %s has no checkpoints", containerID)
+		}
+		checkpoint = checkpoints[len(checkpoints)-1]
+	} else if checkpoint, err = m.GetCheckpoint(containerID, name); err != nil {
+		return err
+	}
+
+	criu, err := lookCRIU()
+	if err != nil {
+		return err
+	}
+	if err := m.setupContainerFS(container); err != nil {
+		return fmt.Errorf("failed to setup container filesystem: %v", err)
+	}
+
+	containerDir := filepath.Join(m.store.GetContainersDir(), containerID)
+	pidFile := filepath.Join(containerDir, "restore.pid")
+	defer os.Remove(pidFile)
+
+	// Restored processes are our children thanks to --restore-sibling, so
+	// they can be waited for like started ones
+	args := append([]string{"restore",
+		"--images-dir", m.checkpointDir(containerID, checkpoint.Name),
+		"--work-dir", containerDir,
+		"--log-file", "restore.log",
+		"--root", m.RootfsDir(containerID),
+		"--pidfile", pidFile,
+		"--restore-detached", "--restore-sibling",
+	}, criuArgs...)
+	var extraFiles []*os.File
+	if checkpoint.LogPath != "" {
+		logFile, err := os.OpenFile(container.LogPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open log file: %v", err)
+		}
+		defer logFile.Close()
+		// The first extra file is fd 3 in criu
+		extraFiles = append(extraFiles, logFile)
+		args = append(args, "--inherit-fd", "fd[3]:"+strings.TrimPrefix(checkpoint.LogPath, "/"))
+	}
+	if err := runCRIU(criu, args, extraFiles); err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		return fmt.Errorf("failed to read restored process ID: %v", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("invalid restored process ID: %v", err)
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return fmt.Errorf("failed to find restored process: %v", err)
+	}
+	if err := setupMemoryCgroup(container, pid); err != nil {
+		logrus.Warnf("Failed to apply memory limits to restored container: %v", err)
+	}
+
+	exited := make(chan struct{})
+	m.mu.Lock()
+	m.running[containerID] = process
+	m.exited[containerID] = exited
+	m.mu.Unlock()
+
+	container.PID = pid
+	container.StartedAt = time.Now()
+	transition(container, types.StatusRunning, "restore "+checkpoint.Name, container.StartedAt)
+	if err := m.saveContainer(container); err != nil {
+		logrus.Warnf("Failed to save container state: %v", err)
+	}
+
+	go m.monitorContainer(containerID, process.Wait, exited)
+
+	logrus.Infof("Restored container %s from checkpoint %s", containerID, checkpoint.Name)
+	return nil
+}
+
+// RunCheckpointPolicies checkpoints the running containers that have a
+// checkpoint policy, checking every interval until ctx is done.
+func (m *Manager) RunCheckpointPolicies(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		m.applyCheckpointPolicies(time.Now())
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *Manager) applyCheckpointPolicies(now time.Time) {
+	containers, err := m.ListContainers(types.ContainerListOptions{All: true})
+	if err != nil {
+		logrus.Warnf("Failed to list containers: %v", err)
+		return
+	}
+
+	for _, container := range containers {
+		policy := container.HostConfig.CheckpointPolicy
+		if policy == nil || policy.Interval <= 0 || container.Status != types.StatusRunning {
+			continue
+		}
+
+		checkpoints, err := m.ListCheckpoints(container.ID)
+		if err != nil {
+			logrus.Warnf("Failed to list checkpoints of container %s: %v", container.ID, err)
+			continue
+		}
+		var auto []*types.Checkpoint
+		for _, checkpoint := range checkpoints {
+			if checkpoint.Auto {
+				auto = append(auto, checkpoint)
+			}
+		}
+		if len(auto) > 0 && now.Sub(auto[len(auto)-1].CreatedAt) < time.Duration(policy.Interval)*time.Second {
+			continue
+		}
+
+		name := autoCheckpointPrefix + now.UTC().Format("20060102-150405")
+		checkpoint, err := m.createCheckpoint(container.ID, types.CheckpointCreateOptions{Name: name}, true, now)
+		if err != nil {
+			logrus.Warnf("Failed to checkpoint container %s: %v", container.ID, err)
+			continue
+		}
+		auto = append(auto, checkpoint)
+
+		// Manual checkpoints are never pruned
+		if policy.Keep > 0 && len(auto) > policy.Keep {
+			for _, old := range auto[:len(auto)-policy.Keep] {
+				if err := m.RemoveCheckpoint(container.ID, old.Name); err != nil {
+					logrus.Warnf("Failed to prune checkpoint %s: %v", old.Name, err)
+				}
+			}
+		}
+	}
+}
+
+func dirSize(root string) int64 {
+	var size int64
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
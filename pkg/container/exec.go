@@ -0,0 +1,353 @@
+package container
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+
+	"docker-impl/pkg/ids"
+	"docker-impl/pkg/image"
+	"docker-impl/pkg/types"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// execInstance is a command created with CreateExec. It runs at most once
+// and is kept after it exits so its exit code can be read.
+type execInstance struct {
+	inspect types.ExecInspect
+	mu      sync.Mutex
+}
+
+// execNamespaces are the namespaces of the container a command is started
+// in, in the order they are entered. The mount namespace comes last since
+// entering it changes the root /proc is reached through.
+var execNamespaces = []struct {
+	name string
+	flag int
+}{
+	{"uts", unix.CLONE_NEWUTS},
+	{"pid", unix.CLONE_NEWPID},
+	{"net", unix.CLONE_NEWNET},
+	{"mnt", unix.CLONE_NEWNS},
+}
+
+// CreateExec sets up a command to run in a running container and returns
+// its ID. Nothing runs until StartExec.
+func (m *Manager) CreateExec(containerID string, config types.ExecConfig) (string, error) {
+	container, err := m.GetContainer(containerID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get container: %v", err)
+	}
+	if container.Status != types.StatusRunning || container.PID == 0 {
+		return "", fmt.Errorf("container %s is not running", containerID)
+	}
+	if len(config.Cmd) == 0 {
+		return "", fmt.Errorf("no command specified")
+	}
+
+	execID := ids.GenerateID()
+	m.mu.Lock()
+	m.execs[execID] = &execInstance{inspect: types.ExecInspect{
+		ID:          execID,
+		ContainerID: container.ID,
+		Config:      config,
+		CreatedAt:   time.Now(),
+	}}
+	m.mu.Unlock()
+	return execID, nil
+}
+
+func (m *Manager) getExec(execID string) (*execInstance, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	instance, ok := m.execs[execID]
+	if !ok {
+		return nil, fmt.Errorf("no such exec instance: %s", execID)
+	}
+	return instance, nil
+}
+
+// InspectExec returns the state of an exec instance, with its exit code
+// once the command has exited.
+func (m *Manager) InspectExec(execID string) (*types.ExecInspect, error) {
+	instance, err := m.getExec(execID)
+	if err != nil {
+		return nil, err
+	}
+	instance.mu.Lock()
+	defer instance.mu.Unlock()
+	inspect := instance.inspect
+	if inspect.ExitCode != nil {
+		exitCode := *inspect.ExitCode
+		inspect.ExitCode = &exitCode
+	}
+	return &inspect, nil
+}
+
+// StartExec runs an exec instance in its container and waits for it,
+// copying its output to stdout and stderr as it comes and returning its
+// exit code. Output not attached is discarded, and with a TTY both streams
+// go to stdout.
+func (m *Manager) StartExec(execID string, stdout, stderr io.Writer) (int, error) {
+	instance, err := m.getExec(execID)
+	if err != nil {
+		return -1, err
+	}
+	instance.mu.Lock()
+	if !instance.inspect.StartedAt.IsZero() {
+		instance.mu.Unlock()
+		return -1, fmt.Errorf("exec %s has already been started", execID)
+	}
+	instance.inspect.StartedAt = time.Now()
+	config := instance.inspect.Config
+	containerID := instance.inspect.ContainerID
+	instance.mu.Unlock()
+
+	cmd, console, terminal, err := m.createExecProcess(containerID, config, stdout, stderr)
+	if err == nil {
+		err = m.startExecProcess(containerID, cmd)
+	}
+	// The command has its own copy of the terminal, so the console sees EOF
+	// once the command exits
+	if terminal != nil {
+		terminal.Close()
+	}
+	if err != nil {
+		if console != nil {
+			console.Close()
+		}
+		m.finishExec(instance, -1, err.Error())
+		return -1, err
+	}
+
+	instance.mu.Lock()
+	instance.inspect.Running = true
+	instance.inspect.Pid = cmd.Process.Pid
+	instance.mu.Unlock()
+	logrus.Debugf("Started exec %s in container %s: %v", execID, containerID, config.Cmd)
+
+	var copied chan struct{}
+	if console != nil {
+		if stdout == nil || !config.AttachStdout {
+			stdout = io.Discard
+		}
+		// The console reads EIO once the command and its children have all
+		// closed the terminal
+		copied = make(chan struct{})
+		go func() {
+			defer close(copied)
+			io.Copy(stdout, console)
+		}()
+	}
+
+	waitErr := cmd.Wait()
+	if copied != nil {
+		<-copied
+		console.Close()
+	}
+
+	exitCode, errorMessage := exitStatus(cmd.ProcessState, waitErr)
+	m.finishExec(instance, exitCode, errorMessage)
+	return exitCode, nil
+}
+
+func (m *Manager) finishExec(instance *execInstance, exitCode int, errorMessage string) {
+	instance.mu.Lock()
+	defer instance.mu.Unlock()
+	instance.inspect.Running = false
+	instance.inspect.ExitCode = &exitCode
+	instance.inspect.Error = errorMessage
+	instance.inspect.FinishedAt = time.Now()
+}
+
+// exitStatus reads the exit code of a command the way recordExit does for
+// containers, 128 plus the signal for commands killed by one.
+func exitStatus(state *os.ProcessState, waitErr error) (int, string) {
+	if state == nil {
+		if waitErr != nil {
+			return -1, waitErr.Error()
+		}
+		return -1, ""
+	}
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal()), ""
+	}
+	return state.ExitCode(), ""
+}
+
+// createExecProcess prepares the command of an exec with the environment,
+// user and working directory of its container, unless the exec sets its
+// own. With a TTY, it returns the ends of the pseudo-terminal the command
+// runs on.
+func (m *Manager) createExecProcess(containerID string, config types.ExecConfig, stdout, stderr io.Writer) (*exec.Cmd, *os.File, *os.File, error) {
+	container, err := m.GetContainer(containerID)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to get container: %v", err)
+	}
+	rootfsDir := m.RootfsDir(container.ID)
+
+	cmd := exec.Command(config.Cmd[0], config.Cmd[1:]...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Chroot: rootfsDir}
+
+	user := config.User
+	if user == "" {
+		user = container.Config.User
+	}
+	if user != "" {
+		uid, gid, err := image.ResolveUser(rootfsDir, user)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uid, Gid: gid}
+	}
+
+	cmd.Env = append(append([]string(nil), container.Config.Env...), config.Env...)
+	cmd.Dir = config.WorkingDir
+	if cmd.Dir == "" {
+		cmd.Dir = container.Config.WorkingDir
+	}
+	if cmd.Dir == "" {
+		cmd.Dir = "/"
+	}
+
+	if !config.Tty {
+		if config.AttachStdout {
+			cmd.Stdout = stdout
+		}
+		if config.AttachStderr {
+			cmd.Stderr = stderr
+		}
+		return cmd, nil, nil, nil
+	}
+
+	console, terminal, err := openPty()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	cmd.Stdin = terminal
+	cmd.Stdout = terminal
+	cmd.Stderr = terminal
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+	return cmd, console, terminal, nil
+}
+
+// startExecProcess starts cmd in the namespaces of the container's process
+// and in its memory cgroup. It is started from a thread that enters the
+// namespaces and then goes back to the host's, which the thread exits with
+// if that fails.
+func (m *Manager) startExecProcess(containerID string, cmd *exec.Cmd) error {
+	container, err := m.GetContainer(containerID)
+	if err != nil {
+		return fmt.Errorf("failed to get container: %v", err)
+	}
+	if container.Status != types.StatusRunning || container.PID == 0 {
+		return fmt.Errorf("container %s is not running", containerID)
+	}
+	if err := syscall.Kill(container.PID, 0); err != nil {
+		return fmt.Errorf("container %s is not running: %v", containerID, err)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		// Never unlocked, see startProcess
+		runtime.LockOSThread()
+		errc <- startInNamespaces(cmd, container.PID)
+	}()
+	if err := <-errc; err != nil {
+		return err
+	}
+
+	if err := joinContainerCgroup(containerID, cmd.Process.Pid); err != nil {
+		logrus.Warnf("Failed to add exec process to the cgroup of container %s: %v", containerID, err)
+	}
+	return nil
+}
+
+// startInNamespaces starts cmd in the namespaces of pid. It runs on a
+// locked thread.
+func startInNamespaces(cmd *exec.Cmd, pid int) error {
+	tid := syscall.Gettid()
+	var hostNS, containerNS []*os.File
+	defer func() {
+		for _, file := range append(hostNS, containerNS...) {
+			file.Close()
+		}
+	}()
+	for _, ns := range execNamespaces {
+		host, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/%s", tid, ns.name))
+		if err != nil {
+			return fmt.Errorf("failed to open %s namespace: %v", ns.name, err)
+		}
+		hostNS = append(hostNS, host)
+		target, err := os.Open(fmt.Sprintf("/proc/%d/ns/%s", pid, ns.name))
+		if err != nil {
+			return fmt.Errorf("failed to open %s namespace of the container: %v", ns.name, err)
+		}
+		containerNS = append(containerNS, target)
+	}
+
+	// A thread sharing its filesystem context can't change mount namespace
+	if err := unix.Unshare(unix.CLONE_FS); err != nil {
+		return fmt.Errorf("failed to unshare filesystem context: %v", err)
+	}
+	entered := 0
+	defer func() {
+		for i := entered - 1; i >= 0; i-- {
+			if err := unix.Setns(int(hostNS[i].Fd()), execNamespaces[i].flag); err != nil {
+				logrus.Warnf("Failed to return to the host %s namespace: %v", execNamespaces[i].name, err)
+			}
+		}
+	}()
+	for i, ns := range execNamespaces {
+		if err := unix.Setns(int(containerNS[i].Fd()), ns.flag); err != nil {
+			return fmt.Errorf("failed to enter %s namespace of the container: %v", ns.name, err)
+		}
+		entered++
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start exec process: %v", err)
+	}
+	return nil
+}
+
+// openPty opens a new pseudo-terminal, returning its console and terminal
+// ends.
+func openPty() (*os.File, *os.File, error) {
+	console, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open pty: %v", err)
+	}
+	if err := unix.IoctlSetPointerInt(int(console.Fd()), unix.TIOCSPTLCK, 0); err != nil {
+		console.Close()
+		return nil, nil, fmt.Errorf("failed to unlock pty: %v", err)
+	}
+	n, err := unix.IoctlGetInt(int(console.Fd()), unix.TIOCGPTN)
+	if err != nil {
+		console.Close()
+		return nil, nil, fmt.Errorf("failed to get pty number: %v", err)
+	}
+	terminal, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		console.Close()
+		return nil, nil, fmt.Errorf("failed to open pty terminal: %v", err)
+	}
+	return console, terminal, nil
+}
+
+// removeExecs forgets the exec instances of a container.
+func (m *Manager) removeExecs(containerID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, instance := range m.execs {
+		if instance.inspect.ContainerID == containerID {
+			delete(m.execs, id)
+		}
+	}
+}
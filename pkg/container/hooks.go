@@ -0,0 +1,134 @@
+package container
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"docker-impl/pkg/types"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	HookStagePrestart  = "prestart"
+	HookStagePoststart = "poststart"
+	HookStagePrestop   = "prestop"
+
+	defaultHookTimeout = 30 * time.Second
+)
+
+// hookState mirrors the OCI runtime state passed to hooks on stdin.
+type hookState struct {
+	OCIVersion  string            `json:"ociVersion"`
+	ID          string            `json:"id"`
+	Status      string            `json:"status"`
+	Pid         int               `json:"pid,omitempty"`
+	Bundle      string            `json:"bundle"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+func (m *Manager) SetDefaultHooks(hooks types.Hooks) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.defaultHooks = hooks
+}
+
+func (m *Manager) hooksForStage(container *types.Container, stage string) []types.Hook {
+	m.mu.Lock()
+	defaults := m.defaultHooks
+	m.mu.Unlock()
+
+	var hooks []types.Hook
+	switch stage {
+	case HookStagePrestart:
+		hooks = append(hooks, defaults.Prestart...)
+		hooks = append(hooks, container.HostConfig.Hooks.Prestart...)
+	case HookStagePoststart:
+		hooks = append(hooks, defaults.Poststart...)
+		hooks = append(hooks, container.HostConfig.Hooks.Poststart...)
+	case HookStagePrestop:
+		hooks = append(hooks, defaults.Prestop...)
+		hooks = append(hooks, container.HostConfig.Hooks.Prestop...)
+	}
+
+	return hooks
+}
+
+func (m *Manager) runHooks(container *types.Container, stage string) error {
+	hooks := m.hooksForStage(container, stage)
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	state, err := json.Marshal(hookState{
+		OCIVersion:  "1.0.2",
+		ID:          container.ID,
+		Status:      string(container.Status),
+		Pid:         container.PID,
+		Bundle:      filepath.Join(m.store.GetContainersDir(), container.ID),
+		Annotations: container.Labels,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal hook state: %v", err)
+	}
+
+	for i, hook := range hooks {
+		if err := runHook(hook, state); err != nil {
+			if hookPolicy(hook, stage) == types.HookFailurePolicyIgnore {
+				logrus.Warnf("Ignoring failed %s hook %d (%s) for container %s: %v", stage, i, hook.Path, container.ID, err)
+				continue
+			}
+			return fmt.Errorf("%s hook %s failed: %v", stage, hook.Path, err)
+		}
+		logrus.Debugf("Ran %s hook %s for container %s", stage, hook.Path, container.ID)
+	}
+
+	return nil
+}
+
+func runHook(hook types.Hook, state []byte) error {
+	if hook.Path == "" {
+		return fmt.Errorf("hook path is required")
+	}
+
+	timeout := defaultHookTimeout
+	if hook.Timeout > 0 {
+		timeout = time.Duration(hook.Timeout) * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, hook.Path, hook.Args...)
+	cmd.Env = hook.Env
+	cmd.Stdin = bytes.NewReader(state)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("timed out after %s", timeout)
+		}
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	return nil
+}
+
+// hookPolicy returns the effective failure policy. Prestart hooks fail the
+// start by default; poststart and prestop hooks only log by default.
+func hookPolicy(hook types.Hook, stage string) types.HookFailurePolicy {
+	if hook.OnFailure != "" {
+		return hook.OnFailure
+	}
+	if stage == HookStagePrestart {
+		return types.HookFailurePolicyFail
+	}
+	return types.HookFailurePolicyIgnore
+}
@@ -0,0 +1,231 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"docker-impl/pkg/ids"
+	"docker-impl/pkg/network"
+	"docker-impl/pkg/types"
+)
+
+// linkHostsMarker ends the lines of /etc/hosts that name linked
+// containers, so starting again replaces them.
+const linkHostsMarker = "# mydocker link"
+
+var invalidEnvChars = regexp.MustCompile(`[^A-Z0-9_]`)
+
+// link is a container a container is linked to, by alias.
+type link struct {
+	alias  string
+	target *types.Container
+}
+
+// parseLink splits a --link value, NAME[:ALIAS]; the alias defaults to
+// the name.
+func parseLink(value string) (name, alias string, err error) {
+	name, alias, _ = strings.Cut(value, ":")
+	if alias == "" {
+		alias = name
+	}
+	if name == "" {
+		return "", "", fmt.Errorf("invalid link %q: expected NAME[:ALIAS]", value)
+	}
+	if err := network.CheckAliases([]string{alias}); err != nil {
+		return "", "", fmt.Errorf("invalid link %q: %v", value, err)
+	}
+	return name, alias, nil
+}
+
+// checkNetworking checks the network aliases and links of a container
+// about to be created, and records its links by the names of the
+// containers they are to.
+func (m *Manager) checkNetworking(hostConfig *types.HostConfig) error {
+	if err := network.CheckAliases(hostConfig.NetworkAliases); err != nil {
+		return err
+	}
+	isolated := hostConfig.NetworkMode == "host" || hostConfig.NetworkMode == "none" || strings.HasPrefix(hostConfig.NetworkMode, "container:")
+	if isolated && len(hostConfig.NetworkAliases) > 0 {
+		return fmt.Errorf("network aliases need a network of the container's own, not %s", hostConfig.NetworkMode)
+	}
+	if isolated && len(hostConfig.Links) > 0 {
+		return fmt.Errorf("links need a network of the container's own, not %s", hostConfig.NetworkMode)
+	}
+
+	links := make([]string, 0, len(hostConfig.Links))
+	for _, value := range hostConfig.Links {
+		name, alias, err := parseLink(value)
+		if err != nil {
+			return err
+		}
+		target, err := m.ResolveContainer(name)
+		if err != nil {
+			return fmt.Errorf("failed to link to %s: %v", name, err)
+		}
+		links = append(links, target.Name+":"+alias)
+	}
+	if len(links) > 0 {
+		hostConfig.Links = links
+	}
+	return nil
+}
+
+// resolveLinks finds the containers a container is linked to, which must
+// be running with an address.
+func (m *Manager) resolveLinks(container *types.Container) ([]link, error) {
+	var links []link
+	for _, value := range container.HostConfig.Links {
+		name, alias, err := parseLink(value)
+		if err != nil {
+			return nil, err
+		}
+		target, err := m.ResolveContainer(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find linked container %s: %v", name, err)
+		}
+		if target.Status != types.StatusRunning {
+			return nil, fmt.Errorf("cannot link to %s: it is not running", name)
+		}
+		if target.Network.IPAddress == "" {
+			return nil, fmt.Errorf("cannot link to %s: it has no IP address", name)
+		}
+		links = append(links, link{alias: alias, target: target})
+	}
+	return links, nil
+}
+
+// setupLinks makes the containers a container is linked to resolvable by
+// their aliases, in its /etc/hosts and by its DNS server when it has one,
+// and adds their addresses, ports and environment to env.
+func (m *Manager) setupLinks(container *types.Container, links []link, ownResolver bool, env []string) ([]string, error) {
+	if len(links) == 0 {
+		return env, nil
+	}
+	if err := writeLinkHosts(m.RootfsDir(container.ID), links); err != nil {
+		return nil, fmt.Errorf("failed to write links to /etc/hosts: %v", err)
+	}
+	if ownResolver {
+		targets := make(map[string]string, len(links))
+		for _, l := range links {
+			targets[l.alias] = l.target.ID
+		}
+		m.network().SetLinks(container.ID, targets)
+	}
+	return append(env, linkEnv(container.Name, links)...), nil
+}
+
+// writeLinkHosts names the linked containers in the container's
+// /etc/hosts, replacing the links of an earlier start.
+func writeLinkHosts(rootfsDir string, links []link) error {
+	etcDir := filepath.Join(rootfsDir, "etc")
+	if err := os.MkdirAll(etcDir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(etcDir, "hosts")
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		data, err = []byte("127.0.0.1\tlocalhost\n::1\tlocalhost ip6-localhost ip6-loopback\n"), nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if line != "" && !strings.HasSuffix(strings.TrimRight(line, "\n"), linkHostsMarker) {
+			b.WriteString(line)
+			if !strings.HasSuffix(line, "\n") {
+				b.WriteString("\n")
+			}
+		}
+	}
+	for _, l := range links {
+		names := []string{l.alias}
+		if l.target.Name != l.alias {
+			names = append(names, l.target.Name)
+		}
+		names = append(names, ids.TruncateID(l.target.ID))
+		fmt.Fprintf(&b, "%s\t%s\t%s\n", l.target.Network.IPAddress, strings.Join(names, " "), linkHostsMarker)
+	}
+	return os.WriteFile(path, []byte(b.String()), 0644)
+}
+
+// linkPort is a port a linked container serves on.
+type linkPort struct {
+	port     int
+	protocol string
+}
+
+// linkPorts returns the ports a container exposes or publishes, lowest
+// first.
+func linkPorts(target *types.Container) []linkPort {
+	seen := make(map[string]bool)
+	var ports []linkPort
+	add := func(key string) {
+		port, protocol, _ := strings.Cut(key, "/")
+		if protocol == "" {
+			protocol = "tcp"
+		}
+		number, err := strconv.Atoi(port)
+		if err != nil || seen[port+"/"+protocol] {
+			return
+		}
+		seen[port+"/"+protocol] = true
+		ports = append(ports, linkPort{port: number, protocol: protocol})
+	}
+	for key := range target.Config.ExposedPorts {
+		add(key)
+	}
+	for key := range target.HostConfig.PortBindings {
+		add(key)
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		if ports[i].port != ports[j].port {
+			return ports[i].port < ports[j].port
+		}
+		return ports[i].protocol < ports[j].protocol
+	})
+	return ports
+}
+
+// linkEnv returns the variables that describe the containers a container
+// is linked to, as Docker's legacy links do: for an alias db,
+// DB_NAME=/name/db, DB_PORT and DB_PORT_5432_TCP with its _ADDR, _PORT and
+// _PROTO for each port, and DB_ENV_X for the linked container's variables.
+func linkEnv(containerName string, links []link) []string {
+	var env []string
+	for _, l := range links {
+		prefix := invalidEnvChars.ReplaceAllString(strings.ToUpper(l.alias), "_")
+		ip := l.target.Network.IPAddress
+		env = append(env, fmt.Sprintf("%s_NAME=/%s/%s", prefix, containerName, l.alias))
+
+		for i, port := range linkPorts(l.target) {
+			url := fmt.Sprintf("%s://%s:%d", port.protocol, ip, port.port)
+			if i == 0 {
+				env = append(env, fmt.Sprintf("%s_PORT=%s", prefix, url))
+			}
+			portPrefix := fmt.Sprintf("%s_PORT_%d_%s", prefix, port.port, strings.ToUpper(port.protocol))
+			env = append(env,
+				fmt.Sprintf("%s=%s", portPrefix, url),
+				fmt.Sprintf("%s_ADDR=%s", portPrefix, ip),
+				fmt.Sprintf("%s_PORT=%d", portPrefix, port.port),
+				fmt.Sprintf("%s_PROTO=%s", portPrefix, port.protocol),
+			)
+		}
+
+		for _, variable := range l.target.Config.Env {
+			key, value, _ := strings.Cut(variable, "=")
+			switch key {
+			case "", "HOME", "HOSTNAME", "PATH":
+				continue
+			}
+			env = append(env, fmt.Sprintf("%s_ENV_%s=%s", prefix, key, value))
+		}
+	}
+	return env
+}
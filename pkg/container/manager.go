@@ -1,13 +1,11 @@
 package container
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
-	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -15,6 +13,9 @@ import (
 
 	"github.com/sirupsen/logrus"
 	"docker-impl/pkg/image"
+	"docker-impl/pkg/ids"
+	"docker-impl/pkg/network"
+	"docker-impl/pkg/storage"
 	"docker-impl/pkg/store"
 	"docker-impl/pkg/types"
 )
@@ -22,7 +23,22 @@ import (
 type Manager struct {
 	store       *store.Store
 	imageMgr    *image.Manager
-	running     map[string]*exec.Cmd
+	running     map[string]*os.Process
+	defaultHooks types.Hooks
+	stopping    map[string]bool
+	// exited is closed once the monitor of the running process is done
+	// with the container
+	exited      map[string]chan struct{}
+	// execs holds the exec instances of containers, by ID
+	execs       map[string]*execInstance
+	// storage mounts container filesystems from image layers; without it
+	// containers get an empty rootfs
+	storage     *storage.StorageManager
+	// network returns the network manager that connects bridge
+	// containers; without it containers share the host's network
+	network     func() *network.Manager
+	crashLoopThreshold int
+	crashLoopWindow    time.Duration
 	mu          sync.Mutex
 }
 
@@ -30,10 +46,21 @@ func NewManager(store *store.Store, imageMgr *image.Manager) *Manager {
 	return &Manager{
 		store:    store,
 		imageMgr: imageMgr,
-		running:  make(map[string]*exec.Cmd),
+		running:  make(map[string]*os.Process),
+		stopping: make(map[string]bool),
+		exited:   make(map[string]chan struct{}),
+		execs:    make(map[string]*execInstance),
+		crashLoopThreshold: defaultCrashLoopThreshold,
+		crashLoopWindow:    defaultCrashLoopWindow,
 	}
 }
 
+// SetStorage makes containers run on their image's layers, mounted by the
+// storage manager.
+func (m *Manager) SetStorage(storage *storage.StorageManager) {
+	m.storage = storage
+}
+
 func (m *Manager) CreateContainer(options types.ContainerCreateOptions) (*types.Container, error) {
 	logrus.Infof("Creating container with image: %s", options.Config.Image)
 
@@ -46,23 +73,63 @@ func (m *Manager) CreateContainer(options types.ContainerCreateOptions) (*types.
 	if !m.imageMgr.ImageExists(options.Config.Image) {
 		return nil, fmt.Errorf("image not found: %s", options.Config.Image)
 	}
+	img, err := m.imageMgr.GetImage(options.Config.Image)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get image: %v", err)
+	}
+	config := options.Config
+	applyImageDefaults(&config, img.Config)
+
+	if err := m.imageMgr.CheckTrust(options.Config.Image); err != nil {
+		return nil, err
+	}
+
+	warnings, err := checkMemoryResources(&options.HostConfig)
+	if err != nil {
+		return nil, err
+	}
+	for _, warning := range warnings {
+		logrus.Warn(warning)
+	}
+
+	if len(options.HostConfig.StorageOpt) > 0 {
+		if m.storage == nil || !m.storage.QuotasEnabled() {
+			return nil, fmt.Errorf("--storage-opt needs storage quotas to be enabled")
+		}
+		if _, err := storage.StorageOptSize(options.HostConfig.StorageOpt); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := checkDNS(options.HostConfig); err != nil {
+		return nil, err
+	}
+	if err := m.checkNetworking(&options.HostConfig); err != nil {
+		return nil, err
+	}
+
+	mounts, err := m.resolveMounts(options.HostConfig.Binds, options.HostConfig.Mounts, config.Volumes)
+	if err != nil {
+		return nil, err
+	}
 
 	now := time.Now()
 	container := &types.Container{
 		ID:          containerID,
 		Name:        containerName,
 		Image:       options.Config.Image,
-		Status:      types.StatusCreated,
 		PID:         0,
 		CreatedAt:   now,
-		Config:      options.Config,
+		Config:      config,
 		HostConfig:  options.HostConfig,
+		Mounts:      mounts,
 		Labels:      options.Labels,
 		Driver:      "overlay2",
 		Platform:    "linux",
 		LogPath:     filepath.Join(m.store.GetContainersDir(), containerID, "container.log"),
 		Network: types.NetworkSettings{
 			NetworkMode: options.HostConfig.NetworkMode,
+			Ports:       options.HostConfig.PortBindings,
 		},
 		RootFS: types.RootFS{
 			Type:   "layers",
@@ -70,6 +137,10 @@ func (m *Manager) CreateContainer(options types.ContainerCreateOptions) (*types.
 		},
 	}
 
+	if err := transition(container, types.StatusCreated, "create", now); err != nil {
+		return nil, err
+	}
+
 	if err := m.saveContainer(container); err != nil {
 		return nil, fmt.Errorf("failed to save container: %v", err)
 	}
@@ -78,6 +149,43 @@ func (m *Manager) CreateContainer(options types.ContainerCreateOptions) (*types.
 	return container, nil
 }
 
+// applyImageDefaults fills in what the image declared and the container
+// doesn't set itself: its user, volumes, labels and healthcheck.
+func applyImageDefaults(config *types.ContainerConfig, imageConfig types.ImageConfig) {
+	if config.User == "" {
+		config.User = imageConfig.User
+	}
+
+	if len(imageConfig.Volumes) > 0 {
+		volumes := make(map[string]struct{}, len(imageConfig.Volumes)+len(config.Volumes))
+		for volume := range imageConfig.Volumes {
+			volumes[volume] = struct{}{}
+		}
+		for volume := range config.Volumes {
+			volumes[volume] = struct{}{}
+		}
+		config.Volumes = volumes
+	}
+
+	if len(imageConfig.Labels) > 0 {
+		labels := make(map[string]string, len(imageConfig.Labels)+len(config.Labels))
+		for k, v := range imageConfig.Labels {
+			labels[k] = v
+		}
+		for k, v := range config.Labels {
+			labels[k] = v
+		}
+		config.Labels = labels
+	}
+
+	// HEALTHCHECK NONE in the image leaves the container without one
+	if hc := imageConfig.Healthcheck; config.Healthcheck == nil && hc != nil && !(len(hc.Test) == 1 && hc.Test[0] == "NONE") {
+		healthcheck := *hc
+		healthcheck.Test = append([]string(nil), hc.Test...)
+		config.Healthcheck = &healthcheck
+	}
+}
+
 func (m *Manager) StartContainer(containerID string) error {
 	logrus.Infof("Starting container: %s", containerID)
 
@@ -86,36 +194,78 @@ func (m *Manager) StartContainer(containerID string) error {
 		return fmt.Errorf("failed to get container: %v", err)
 	}
 
-	if container.Status == types.StatusRunning {
-		return fmt.Errorf("container is already running")
+	if err := checkTransition(container, types.StatusRunning); err != nil {
+		return err
 	}
 
 	if err := m.setupContainerFS(container); err != nil {
 		return fmt.Errorf("failed to setup container filesystem: %v", err)
 	}
+	if err := writeHostname(m.RootfsDir(container.ID), container.Config.Hostname); err != nil {
+		return fmt.Errorf("failed to set container hostname: %v", err)
+	}
+
+	if err := m.runHooks(container, HookStagePrestart); err != nil {
+		return err
+	}
 
 	cmd, err := m.createContainerProcess(container)
 	if err != nil {
 		return fmt.Errorf("failed to create container process: %v", err)
 	}
 
-	if err := cmd.Start(); err != nil {
+	links, err := m.resolveLinks(container)
+	if err != nil {
+		return err
+	}
+
+	netnsPath, err := m.setupNetwork(container)
+	if err != nil {
+		return fmt.Errorf("failed to set up container network: %v", err)
+	}
+	if err := writeResolvConf(m.RootfsDir(container.ID), container.HostConfig, usesOwnResolver(container, netnsPath)); err != nil {
+		m.releaseNetwork(container)
+		return fmt.Errorf("failed to write resolv.conf: %v", err)
+	}
+	if cmd.Env, err = m.setupLinks(container, links, usesOwnResolver(container, netnsPath), cmd.Env); err != nil {
+		m.releaseNetwork(container)
+		return err
+	}
+
+	if err := startProcess(cmd, m.RootfsDir(container.ID), container.Mounts, netnsPath); err != nil {
+		m.releaseNetwork(container)
 		return fmt.Errorf("failed to start container process: %v", err)
 	}
 
+	if err := setupMemoryCgroup(container, cmd.Process.Pid); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		m.releaseNetwork(container)
+		return fmt.Errorf("failed to apply memory limits: %v", err)
+	}
+
+	exited := make(chan struct{})
 	m.mu.Lock()
-	m.running[containerID] = cmd
+	m.running[containerID] = cmd.Process
+	m.exited[containerID] = exited
 	m.mu.Unlock()
 
-	container.Status = types.StatusRunning
 	container.PID = cmd.Process.Pid
 	container.StartedAt = time.Now()
+	transition(container, types.StatusRunning, "start", container.StartedAt)
 
 	if err := m.saveContainer(container); err != nil {
 		logrus.Warnf("Failed to save container state: %v", err)
 	}
 
-	go m.monitorContainer(containerID, cmd)
+	go m.monitorContainer(containerID, func() (*os.ProcessState, error) {
+		err := cmd.Wait()
+		return cmd.ProcessState, err
+	}, exited)
+
+	if err := m.runHooks(container, HookStagePoststart); err != nil {
+		logrus.Warnf("Poststart hooks failed for container %s: %v", containerID, err)
+	}
 
 	logrus.Infof("Container started successfully: %s", containerID)
 	return nil
@@ -133,28 +283,33 @@ func (m *Manager) StopContainer(containerID string, timeout int) error {
 		return fmt.Errorf("container is not running")
 	}
 
+	if err := m.runHooks(container, HookStagePrestop); err != nil {
+		return err
+	}
+
 	m.mu.Lock()
-	cmd, exists := m.running[containerID]
+	process, exists := m.running[containerID]
 	if !exists {
 		m.mu.Unlock()
 		return fmt.Errorf("container process not found")
 	}
 	delete(m.running, containerID)
+	m.stopping[containerID] = true
 	m.mu.Unlock()
 
 	if timeout > 0 {
 		time.Sleep(time.Duration(timeout) * time.Second)
 	}
 
-	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+	if err := process.Signal(syscall.SIGTERM); err != nil {
 		logrus.Warnf("Failed to send SIGTERM to container: %v", err)
-		if err := cmd.Process.Kill(); err != nil {
+		if err := process.Kill(); err != nil {
 			return fmt.Errorf("failed to kill container process: %v", err)
 		}
 	}
 
-	container.Status = types.StatusStopped
 	container.FinishedAt = time.Now()
+	transition(container, types.StatusStopped, "stop", container.FinishedAt)
 
 	if err := m.saveContainer(container); err != nil {
 		logrus.Warnf("Failed to save container state: %v", err)
@@ -164,6 +319,61 @@ func (m *Manager) StopContainer(containerID string, timeout int) error {
 	return nil
 }
 
+// RestartContainer stops a running container, waits for its process to
+// exit and starts it again. Containers that aren't running are started.
+func (m *Manager) RestartContainer(containerID string, timeout int) error {
+	container, err := m.GetContainer(containerID)
+	if err != nil {
+		return fmt.Errorf("failed to get container: %v", err)
+	}
+
+	if container.Status == types.StatusRunning {
+		m.mu.Lock()
+		exited := m.exited[containerID]
+		m.mu.Unlock()
+
+		if err := m.StopContainer(containerID, timeout); err != nil {
+			return err
+		}
+		if exited != nil {
+			select {
+			case <-exited:
+			case <-time.After(stopKillTimeout):
+				if container.PID > 0 {
+					syscall.Kill(container.PID, syscall.SIGKILL)
+				}
+				<-exited
+			}
+		}
+	}
+
+	return m.StartContainer(containerID)
+}
+
+// SignalContainer sends sig to the main process of a running container,
+// e.g. SIGHUP to make it reload its configuration.
+func (m *Manager) SignalContainer(containerID string, sig syscall.Signal) error {
+	m.mu.Lock()
+	process, exists := m.running[containerID]
+	m.mu.Unlock()
+	if exists {
+		return process.Signal(sig)
+	}
+
+	container, err := m.GetContainer(containerID)
+	if err != nil {
+		return fmt.Errorf("failed to get container: %v", err)
+	}
+	if container.Status != types.StatusRunning || container.PID == 0 {
+		return fmt.Errorf("container is not running")
+	}
+	// Started by another process, so signal it by PID
+	if err := syscall.Kill(container.PID, sig); err != nil {
+		return fmt.Errorf("failed to signal container: %v", err)
+	}
+	return nil
+}
+
 func (m *Manager) RemoveContainer(containerID string, options types.ContainerRemoveOptions) error {
 	logrus.Infof("Removing container: %s", containerID)
 
@@ -176,19 +386,52 @@ func (m *Manager) RemoveContainer(containerID string, options types.ContainerRem
 		if err := m.StopContainer(containerID, 0); err != nil {
 			logrus.Warnf("Failed to stop container: %v", err)
 		}
+		if container, err = m.GetContainer(containerID); err != nil {
+			return fmt.Errorf("failed to get container: %v", err)
+		}
 	} else if container.Status == types.StatusRunning {
 		return fmt.Errorf("cannot remove running container without force flag")
 	}
 
+	// Recorded first, so a removal cut short leaves the container dead
+	// rather than looking intact
+	if err := transition(container, types.StatusRemoving, "remove", time.Now()); err != nil {
+		return err
+	}
+	if err := m.saveContainer(container); err != nil {
+		return fmt.Errorf("failed to save container state: %v", err)
+	}
+
 	containerPath := filepath.Join("containers", fmt.Sprintf("%s.json", containerID))
 	if err := m.store.RemoveFile(containerPath); err != nil {
+		transition(container, types.StatusDead, fmt.Sprintf("removal failed: %v", err), time.Now())
+		if err := m.saveContainer(container); err != nil {
+			logrus.Warnf("Failed to save container state: %v", err)
+		}
 		return fmt.Errorf("failed to remove container file: %v", err)
 	}
+	if err := m.store.RemoveDocuments(store.KindContainer, containerID); err != nil {
+		logrus.Warnf("Failed to remove container %s from the search index: %v", containerID, err)
+	}
+
+	if m.storage != nil {
+		// Containers that never started have no storage
+		if _, err := m.storage.GetContainerStorage(containerID); err == nil {
+			if err := m.storage.RemoveContainerStorage(containerID); err != nil {
+				logrus.Warnf("Failed to remove container storage: %v", err)
+			}
+		}
+	}
+
+	if options.RemoveVolumes {
+		m.removeAnonymousVolumes(container)
+	}
 
 	containerDir := filepath.Join(m.store.GetContainersDir(), containerID)
 	if err := os.RemoveAll(containerDir); err != nil {
 		logrus.Warnf("Failed to remove container directory: %v", err)
 	}
+	m.removeExecs(containerID)
 
 	logrus.Infof("Container removed successfully: %s", containerID)
 	return nil
@@ -205,6 +448,36 @@ func (m *Manager) GetContainer(containerID string) (*types.Container, error) {
 	return &container, nil
 }
 
+// ResolveContainer finds a container by ID, name or unique ID prefix.
+func (m *Manager) ResolveContainer(ref string) (*types.Container, error) {
+	if container, err := m.GetContainer(ref); err == nil {
+		return container, nil
+	}
+
+	containers, err := m.ListContainers(types.ContainerListOptions{All: true})
+	if err != nil {
+		return nil, err
+	}
+	var matches []*types.Container
+	for _, container := range containers {
+		if container.Name == ref {
+			return container, nil
+		}
+		if len(ref) >= 3 && strings.HasPrefix(container.ID, ref) {
+			matches = append(matches, container)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no such container: %s", ref)
+	case 1:
+		return matches[0], nil
+	default:
+		return nil, fmt.Errorf("container ID prefix %s is ambiguous", ref)
+	}
+}
+
 func (m *Manager) ListContainers(options types.ContainerListOptions) ([]*types.Container, error) {
 	files, err := m.store.ListFiles("containers")
 	if err != nil {
@@ -224,6 +497,11 @@ func (m *Manager) ListContainers(options types.ContainerListOptions) ([]*types.C
 			if !options.All && container.Status != types.StatusRunning {
 				continue
 			}
+			if options.Size {
+				if err := m.FillSize(container); err != nil {
+					logrus.Warnf("Failed to measure container %s: %v", containerID, err)
+				}
+			}
 
 			containers = append(containers, container)
 		}
@@ -252,13 +530,73 @@ func (m *Manager) GetContainerLogs(containerID string) (string, error) {
 
 func (m *Manager) saveContainer(container *types.Container) error {
 	containerPath := filepath.Join("containers", fmt.Sprintf("%s.json", container.ID))
-	return m.store.SaveJSON(containerPath, container)
+	if err := m.store.SaveJSON(containerPath, container); err != nil {
+		return err
+	}
+	m.indexContainer(container)
+	return nil
 }
 
 func (m *Manager) generateContainerID() string {
-	data := fmt.Sprintf("container-%d", time.Now().UnixNano())
-	hash := sha256.Sum256([]byte(data))
-	return hex.EncodeToString(hash[:])
+	return ids.GenerateID()
+}
+
+// FillSize sets SizeRw and SizeRootFs of container. Without a storage
+// manager the container writes straight into its rootfs, so all of it
+// counts as written.
+func (m *Manager) FillSize(container *types.Container) error {
+	if m.storage == nil {
+		size := dirSize(m.RootfsDir(container.ID))
+		container.SizeRw = size
+		container.SizeRootFs = size
+		return nil
+	}
+	// Containers that never started have no filesystem yet
+	if _, err := m.storage.GetContainerStorage(container.ID); err != nil {
+		return nil
+	}
+	size, err := m.storage.ContainerSize(container.ID, false)
+	if err != nil {
+		return err
+	}
+	container.SizeRw = size.SizeRw
+	container.SizeRootFs = size.SizeRootFs
+	return nil
+}
+
+// BuildFrom builds an image from the current filesystem of a container,
+// with the instructions of options.Dockerfile applied on top. The
+// container's volumes are left out, as they are from its image.
+func (m *Manager) BuildFrom(ref string, options types.ImageBuildOptions) (*types.Image, error) {
+	container, err := m.ResolveContainer(ref)
+	if err != nil {
+		return nil, err
+	}
+	if m.storage != nil {
+		if _, err := m.storage.GetContainerStorage(container.ID); err != nil {
+			return nil, fmt.Errorf("container %s has no filesystem yet: start it first", ref)
+		}
+	}
+	img, err := m.imageMgr.ResolveImage(container.Image)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get image of container %s: %v", ref, err)
+	}
+
+	options.FromContainer = container.ID
+	options.FromImage = img.ID
+	options.ContainerRootfs = m.RootfsDir(container.ID)
+	for _, mount := range container.Mounts {
+		options.ContainerExclude = append(options.ContainerExclude, mount.Destination)
+	}
+	return m.imageMgr.BuildImage(options)
+}
+
+// RootfsDir is the directory a container's process is chrooted into.
+func (m *Manager) RootfsDir(containerID string) string {
+	if m.storage != nil {
+		return m.storage.ContainerMountPoint(containerID)
+	}
+	return filepath.Join(m.store.GetContainersDir(), containerID, "rootfs")
 }
 
 func (m *Manager) setupContainerFS(container *types.Container) error {
@@ -267,17 +605,74 @@ func (m *Manager) setupContainerFS(container *types.Container) error {
 		return fmt.Errorf("failed to create container directory: %v", err)
 	}
 
-	rootfsDir := filepath.Join(containerDir, "rootfs")
-	if err := os.MkdirAll(rootfsDir, 0755); err != nil {
-		return fmt.Errorf("failed to create rootfs directory: %v", err)
+	if m.storage == nil {
+		rootfsDir := filepath.Join(containerDir, "rootfs")
+		if err := os.MkdirAll(rootfsDir, 0755); err != nil {
+			return fmt.Errorf("failed to create rootfs directory: %v", err)
+		}
+		return nil
 	}
 
+	img, err := m.imageMgr.GetImage(container.Image)
+	if err != nil {
+		return fmt.Errorf("failed to get image: %v", err)
+	}
+
+	var layerIDs []string
+	parentID := ""
+	for _, layerID := range img.Layers {
+		dir, err := m.imageMgr.LayerContent(layerID)
+		if err != nil {
+			// Placeholder layers of images that were never pulled or
+			// built have nothing to mount
+			logrus.Warnf("Skipping layer %s: %v", layerID, err)
+			continue
+		}
+		if _, err := m.storage.ImportImageLayer(layerID, parentID, dir); err != nil {
+			return err
+		}
+		layerIDs = append(layerIDs, layerID)
+		parentID = layerID
+	}
+
+	size, err := storage.StorageOptSize(container.HostConfig.StorageOpt)
+	if err != nil {
+		return err
+	}
+	if size > 0 {
+		if err := m.storage.SetContainerQuota(container.ID, size); err != nil {
+			return err
+		}
+	}
+
+	// Mounting again after a stop keeps what the container wrote
+	if _, err := m.storage.CreateContainerStorage(container.ID, img.ID, layerIDs, volumeMounts(container.Mounts)); err != nil {
+		return fmt.Errorf("failed to create container storage: %v", err)
+	}
+	m.populateVolumes(container)
 	return nil
 }
 
+// writeHostname gives the container's /etc/hostname and /etc/hosts the
+// configured hostname, so it resolves to itself. Without one the image's
+// files are left alone.
+func writeHostname(rootfsDir, hostname string) error {
+	if hostname == "" {
+		return nil
+	}
+	etcDir := filepath.Join(rootfsDir, "etc")
+	if err := os.MkdirAll(etcDir, 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(etcDir, "hostname"), []byte(hostname+"\n"), 0644); err != nil {
+		return err
+	}
+	hosts := fmt.Sprintf("127.0.0.1\tlocalhost\n::1\tlocalhost ip6-localhost ip6-loopback\n127.0.1.1\t%s\n", hostname)
+	return os.WriteFile(filepath.Join(etcDir, "hosts"), []byte(hosts), 0644)
+}
+
 func (m *Manager) createContainerProcess(container *types.Container) (*exec.Cmd, error) {
-	containerDir := filepath.Join(m.store.GetContainersDir(), container.ID)
-	rootfsDir := filepath.Join(containerDir, "rootfs")
+	rootfsDir := m.RootfsDir(container.ID)
 
 	cmd := exec.Command("/bin/sh")
 	if len(container.Config.Cmd) > 0 {
@@ -289,6 +684,14 @@ func (m *Manager) createContainerProcess(container *types.Container) (*exec.Cmd,
 		Chroot:     rootfsDir,
 	}
 
+	if user := container.Config.User; user != "" {
+		uid, gid, err := image.ResolveUser(rootfsDir, user)
+		if err != nil {
+			return nil, err
+		}
+		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uid, Gid: gid}
+	}
+
 	cmd.Env = container.Config.Env
 	cmd.Dir = container.Config.WorkingDir
 	if cmd.Dir == "" {
@@ -306,11 +709,19 @@ func (m *Manager) createContainerProcess(container *types.Container) (*exec.Cmd,
 	return cmd, nil
 }
 
-func (m *Manager) monitorContainer(containerID string, cmd *exec.Cmd) {
-	err := cmd.Wait()
+// monitorContainer records how the container's process ended once wait
+// returns, and restarts it if its policy says so.
+func (m *Manager) monitorContainer(containerID string, wait func() (*os.ProcessState, error), exited chan struct{}) {
+	defer close(exited)
+	state, waitErr := wait()
 
 	m.mu.Lock()
 	delete(m.running, containerID)
+	stopped := m.stopping[containerID]
+	delete(m.stopping, containerID)
+	if m.exited[containerID] == exited {
+		delete(m.exited, containerID)
+	}
 	m.mu.Unlock()
 
 	container, err := m.GetContainer(containerID)
@@ -319,19 +730,38 @@ func (m *Manager) monitorContainer(containerID string, cmd *exec.Cmd) {
 		return
 	}
 
-	if err != nil {
-		container.Status = types.StatusExited
-		logrus.Errorf("Container %s exited with error: %v", containerID, err)
-	} else {
-		if cmd.ProcessState.Success() {
-			container.Status = types.StatusExited
-		} else {
-			container.Status = types.StatusDead
-		}
+	recordExit(container, state, waitErr)
+	removeMemoryCgroup(containerID)
+	m.releaseNetwork(container)
+
+	// Containers stopped on purpose, by this process or another, stay
+	// stopped
+	to, reason := types.StatusDead, "wait failed"
+	if stopped || container.Status == types.StatusStopped {
+		stopped = true
+		to, reason = types.StatusStopped, "stop"
+	} else if state != nil {
+		to, reason = types.StatusExited, fmt.Sprintf("process exited with code %d", container.ExitCode)
+	} else if container.Error != "" {
+		reason = "wait failed: " + container.Error
+	}
+
+	if container.ExitCode != 0 {
+		logrus.Errorf("Container %s exited with code %d (signal: %s, oom killed: %v)", containerID, container.ExitCode, container.Signal, container.OOMKilled)
 	}
 
 	container.FinishedAt = time.Now()
 	container.PID = 0
+	if err := transition(container, to, reason, container.FinishedAt); err != nil {
+		// Such as a container being removed
+		logrus.Debugf("Not recording the exit of container %s: %v", containerID, err)
+		return
+	}
+
+	if container.Status == types.StatusExited && shouldRestart(container) {
+		m.restartContainer(container)
+		return
+	}
 
 	if err := m.saveContainer(container); err != nil {
 		logrus.Warnf("Failed to save container state: %v", err)
@@ -358,26 +788,28 @@ func (m *Manager) GetContainerStats(containerID string) (map[string]interface{},
 		"image":   container.Image,
 		"uptime":  time.Since(container.StartedAt).String(),
 	}
+	for key, value := range memoryStats(container.ID) {
+		stats[key] = value
+	}
 
 	return stats, nil
 }
 
+// ExecContainer runs cmd in a running container with its output on ours,
+// failing if it exits non-zero.
 func (m *Manager) ExecContainer(containerID string, cmd []string) error {
-	container, err := m.GetContainer(containerID)
+	execID, err := m.CreateExec(containerID, types.ExecConfig{Cmd: cmd, AttachStdout: true, AttachStderr: true})
 	if err != nil {
-		return fmt.Errorf("failed to get container: %v", err)
+		return err
 	}
-
-	if container.Status != types.StatusRunning {
-		return fmt.Errorf("container is not running")
+	exitCode, err := m.StartExec(execID, os.Stdout, os.Stderr)
+	if err != nil {
+		return err
 	}
-
-	execCmd := exec.Command(cmd[0], cmd[1:]...)
-	execCmd.SysProcAttr = &syscall.SysProcAttr{
-		Cloneflags: syscall.CLONE_NEWUTS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNS,
+	if exitCode != 0 {
+		return fmt.Errorf("command exited with code %d", exitCode)
 	}
-
-	return execCmd.Run()
+	return nil
 }
 
 func (m *Manager) ResizeContainerTTY(containerID string, height, width uint16) error {
@@ -391,14 +823,14 @@ func (m *Manager) ResizeContainerTTY(containerID string, height, width uint16) e
 	}
 
 	m.mu.Lock()
-	cmd, exists := m.running[containerID]
+	process, exists := m.running[containerID]
 	m.mu.Unlock()
 
 	if !exists {
 		return fmt.Errorf("container process not found")
 	}
 
-	if cmd.Process == nil {
+	if process == nil {
 		return fmt.Errorf("container process not available")
 	}
 
@@ -412,7 +844,7 @@ func (m *Manager) ResizeContainerTTY(containerID string, height, width uint16) e
 
 	_, _, errno := syscall.Syscall(
 		syscall.SYS_IOCTL,
-		uintptr(cmd.Process.Pid),
+		uintptr(process.Pid),
 		uintptr(syscall.TIOCSWINSZ),
 		uintptr(unsafe.Pointer(ws)),
 	)
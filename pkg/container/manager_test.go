@@ -2,12 +2,15 @@ package container
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"docker-impl/pkg/image"
+	"docker-impl/pkg/storage"
 	"docker-impl/pkg/store"
 	"docker-impl/pkg/types"
 )
@@ -67,6 +70,41 @@ func TestCreateContainer(t *testing.T) {
 	assert.Equal(t, config.Cmd, container.Config.Cmd, "Command should match")
 }
 
+func TestCreateContainerImageDefaults(t *testing.T) {
+	store, err := store.NewStore(t.TempDir())
+	require.NoError(t, err)
+	imageMgr := image.NewManager(store)
+
+	testImage, err := imageMgr.CreateImage("defaults", "latest", types.ImageConfig{
+		User:        "app",
+		Volumes:     map[string]struct{}{"/data": {}},
+		Labels:      map[string]string{"tier": "web", "team": "infra"},
+		Healthcheck: &types.HealthConfig{Test: []string{"CMD-SHELL", "true"}, Retries: 2},
+	})
+	require.NoError(t, err)
+
+	manager := NewManager(store, imageMgr)
+	container, err := manager.CreateContainer(types.ContainerCreateOptions{
+		Config: types.ContainerConfig{
+			Image:  testImage.ID,
+			Labels: map[string]string{"tier": "api"},
+		},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, "app", container.Config.User)
+	assert.Equal(t, map[string]struct{}{"/data": {}}, container.Config.Volumes)
+	assert.Equal(t, map[string]string{"tier": "api", "team": "infra"}, container.Config.Labels, "Container labels should override the image's")
+	require.NotNil(t, container.Config.Healthcheck)
+	assert.Equal(t, 2, container.Config.Healthcheck.Retries)
+
+	container, err = manager.CreateContainer(types.ContainerCreateOptions{
+		Config: types.ContainerConfig{Image: testImage.ID, User: "root"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "root", container.Config.User, "An explicit user should win over the image's")
+}
+
 func TestCreateContainerWithDefaultName(t *testing.T) {
 	tempDir := t.TempDir()
 	store, err := store.NewStore(tempDir)
@@ -323,4 +361,379 @@ func TestGetContainerStats(t *testing.T) {
 	stats, err := manager.GetContainerStats(container.ID)
 	assert.Error(t, err, "Should return error for non-running container")
 	assert.Nil(t, stats, "Should return nil for non-running container")
-}
\ No newline at end of file
+}
+func TestRunHooksFailurePolicy(t *testing.T) {
+	tempDir := t.TempDir()
+	store, err := store.NewStore(tempDir)
+	require.NoError(t, err)
+
+	manager := NewManager(store, image.NewManager(store))
+	container := &types.Container{ID: "hook-test"}
+
+	container.HostConfig.Hooks.Prestart = []types.Hook{{Path: "/bin/false"}}
+	assert.Error(t, manager.runHooks(container, HookStagePrestart), "Prestart hooks should fail by default")
+
+	container.HostConfig.Hooks.Prestart[0].OnFailure = types.HookFailurePolicyIgnore
+	assert.NoError(t, manager.runHooks(container, HookStagePrestart), "Ignored hook failures should not return an error")
+
+	container.HostConfig.Hooks.Prestop = []types.Hook{{Path: "/bin/false"}}
+	assert.NoError(t, manager.runHooks(container, HookStagePrestop), "Prestop hooks should only warn by default")
+
+	manager.SetDefaultHooks(types.Hooks{Poststart: []types.Hook{{Path: "/bin/sleep", Args: []string{"5"}, Timeout: 1, OnFailure: types.HookFailurePolicyFail}}})
+	assert.Error(t, manager.runHooks(container, HookStagePoststart), "Hooks exceeding their timeout should fail")
+}
+
+func TestRestartPolicyAndCrashLoop(t *testing.T) {
+	tempDir := t.TempDir()
+	store, err := store.NewStore(tempDir)
+	require.NoError(t, err)
+
+	manager := NewManager(store, image.NewManager(store))
+	manager.SetCrashLoopPolicy(3, time.Minute)
+
+	container := &types.Container{ID: "restart-test", ExitCode: 137}
+	container.HostConfig.RestartPolicy = types.RestartPolicy{Name: "on-failure", MaximumRetryCount: 2}
+	assert.True(t, shouldRestart(container), "Should restart a failed container under on-failure")
+
+	now := time.Now()
+	assert.False(t, manager.recordRestart(container, now.Add(-2*time.Minute)), "First restart is not a crash loop")
+	assert.False(t, manager.recordRestart(container, now.Add(-2*time.Second)), "Restarts outside the window should be dropped")
+	assert.False(t, manager.recordRestart(container, now.Add(-time.Second)), "Two recent restarts are below the threshold")
+	assert.True(t, manager.recordRestart(container, now), "Third restart within the window should flag a crash loop")
+	assert.Equal(t, 4, container.RestartCount, "Restart count should include every restart")
+
+	assert.False(t, shouldRestart(container), "Should stop restarting after max retries")
+
+	container.ExitCode = 0
+	container.HostConfig.RestartPolicy = types.RestartPolicy{Name: "always"}
+	assert.True(t, shouldRestart(container), "Always policy should restart on clean exit")
+}
+
+func TestCheckMemoryResources(t *testing.T) {
+	swappiness := int64(150)
+	invalid := []types.HostConfig{
+		{Memory: 1024},
+		{MemorySwap: 512 * 1024 * 1024},
+		{Memory: 512 * 1024 * 1024, MemorySwap: 256 * 1024 * 1024},
+		{Memory: 512 * 1024 * 1024, MemorySwap: -2},
+		{MemorySwappiness: &swappiness},
+	}
+	for _, hostConfig := range invalid {
+		_, err := checkMemoryResources(&hostConfig)
+		assert.Error(t, err, "Invalid memory settings should be rejected: %+v", hostConfig)
+	}
+
+	hostConfig := types.HostConfig{}
+	warnings, err := checkMemoryResources(&hostConfig)
+	require.NoError(t, err)
+	assert.Empty(t, warnings, "No memory settings should not warn")
+}
+
+func TestCheckpointPolicy(t *testing.T) {
+	tempDir := t.TempDir()
+	store, err := store.NewStore(tempDir)
+	require.NoError(t, err)
+
+	// A stand-in for criu that writes an image file into the dump directory
+	criu := filepath.Join(tempDir, "criu")
+	script := "#!/bin/sh\nwhile [ $# -gt 0 ]; do\n  [ \"$1\" = --images-dir ] && echo pages > \"$2/pages-1.img\"\n  shift\ndone\n"
+	require.NoError(t, os.WriteFile(criu, []byte(script), 0755))
+	defer func(binary string) { criuBinary = binary }(criuBinary)
+	criuBinary = criu
+
+	manager := NewManager(store, image.NewManager(store))
+	container := &types.Container{ID: "checkpoint-test", Status: types.StatusRunning, PID: os.Getpid()}
+	container.HostConfig.CheckpointPolicy = &types.CheckpointPolicy{Interval: 60, Keep: 2}
+	require.NoError(t, manager.saveContainer(container))
+
+	_, err = manager.CreateCheckpoint(container.ID, types.CheckpointCreateOptions{Name: "../escape"})
+	assert.Error(t, err, "Checkpoint names should not leave the checkpoints directory")
+	manual, err := manager.CreateCheckpoint(container.ID, types.CheckpointCreateOptions{Name: "before-upgrade"})
+	require.NoError(t, err)
+	assert.Positive(t, manual.Size)
+	_, err = manager.CreateCheckpoint(container.ID, types.CheckpointCreateOptions{Name: "before-upgrade"})
+	assert.Error(t, err, "Checkpoint names should be unique")
+
+	start := time.Now().Add(time.Hour)
+	for _, offset := range []time.Duration{0, 30 * time.Second, 61 * time.Second, 122 * time.Second} {
+		manager.applyCheckpointPolicies(start.Add(offset))
+	}
+
+	checkpoints, err := manager.ListCheckpoints(container.ID)
+	require.NoError(t, err)
+	var names []string
+	for _, checkpoint := range checkpoints {
+		names = append(names, checkpoint.Name)
+	}
+	assert.Equal(t, []string{
+		"before-upgrade",
+		autoCheckpointPrefix + start.Add(61*time.Second).UTC().Format("20060102-150405"),
+		autoCheckpointPrefix + start.Add(122*time.Second).UTC().Format("20060102-150405"),
+	}, names, "Policy checkpoints should be taken once per interval and pruned to the newest two")
+
+	require.NoError(t, manager.RemoveCheckpoint(container.ID, "before-upgrade"))
+	_, err = manager.GetCheckpoint(container.ID, "before-upgrade")
+	assert.Error(t, err)
+}
+
+func TestContainerStateMachine(t *testing.T) {
+	tempDir := t.TempDir()
+	store, err := store.NewStore(tempDir)
+	require.NoError(t, err)
+
+	imageMgr := image.NewManager(store)
+	testImage, err := imageMgr.CreateImage("test-image", "latest", types.ImageConfig{Cmd: []string{"/bin/sh"}})
+	require.NoError(t, err)
+	manager := NewManager(store, imageMgr)
+
+	container, err := manager.CreateContainer(types.ContainerCreateOptions{Config: types.ContainerConfig{Image: testImage.ID}})
+	require.NoError(t, err)
+	require.Len(t, container.StateHistory, 1)
+	assert.Equal(t, types.StatusCreated, container.StateHistory[0].To)
+
+	now := time.Now()
+	assert.Error(t, transition(container, types.StatusPaused, "pause", now), "Created containers can't be paused")
+	assert.Equal(t, types.StatusCreated, container.Status, "A rejected transition should leave the status alone")
+	require.NoError(t, transition(container, types.StatusRunning, "start", now))
+	assert.EqualError(t, checkTransition(container, types.StatusRunning), "container is already running")
+	require.NoError(t, transition(container, types.StatusRunning, "start", now), "Staying in the same status is a no-op")
+	assert.Len(t, container.StateHistory, 2)
+
+	// A process that is gone and a removal cut short, as after a crash
+	container.PID = 1 << 30
+	require.NoError(t, manager.saveContainer(container))
+	removing := &types.Container{ID: "removing-test"}
+	require.NoError(t, transition(removing, types.StatusCreated, "create", now))
+	require.NoError(t, transition(removing, types.StatusRemoving, "remove", now))
+	require.NoError(t, manager.saveContainer(removing))
+
+	require.NoError(t, manager.RecoverContainers())
+	recovered, err := manager.GetContainer(container.ID)
+	require.NoError(t, err)
+	assert.Equal(t, types.StatusDead, recovered.Status)
+	assert.Equal(t, "process lost", recovered.StateHistory[len(recovered.StateHistory)-1].Reason)
+	recovered, err = manager.GetContainer(removing.ID)
+	require.NoError(t, err)
+	assert.Equal(t, types.StatusDead, recovered.Status)
+
+	require.NoError(t, manager.RemoveContainer(removing.ID, types.ContainerRemoveOptions{}), "Dead containers can be removed again")
+	_, err = manager.GetContainer(removing.ID)
+	assert.Error(t, err)
+}
+
+func TestWriteHostname(t *testing.T) {
+	rootfs := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(rootfs, "etc"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(rootfs, "etc/hosts"), []byte("image hosts\n"), 0644))
+
+	require.NoError(t, writeHostname(rootfs, ""))
+	data, err := os.ReadFile(filepath.Join(rootfs, "etc/hosts"))
+	require.NoError(t, err)
+	assert.Equal(t, "image hosts\n", string(data), "Without a hostname the image's files should be kept")
+
+	require.NoError(t, writeHostname(rootfs, "kafka-2"))
+	data, err = os.ReadFile(filepath.Join(rootfs, "etc/hostname"))
+	require.NoError(t, err)
+	assert.Equal(t, "kafka-2\n", string(data))
+	data, err = os.ReadFile(filepath.Join(rootfs, "etc/hosts"))
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "127.0.1.1\tkafka-2")
+}
+
+func TestWriteResolvConf(t *testing.T) {
+	rootfs := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(rootfs, "etc"), 0755))
+	require.NoError(t, os.Symlink("/run/systemd/resolve/stub-resolv.conf", filepath.Join(rootfs, "etc/resolv.conf")))
+
+	hostConfig := types.HostConfig{DNS: []string{"10.0.0.2"}, DNSSearch: []string{"corp.example"}, DNSOptions: []string{"ndots:2"}}
+	require.NoError(t, writeResolvConf(rootfs, hostConfig, true))
+	info, err := os.Lstat(filepath.Join(rootfs, "etc/resolv.conf"))
+	require.NoError(t, err)
+	assert.True(t, info.Mode().IsRegular(), "A linked resolv.conf should be replaced, not written through")
+	data, err := os.ReadFile(filepath.Join(rootfs, "etc/resolv.conf"))
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "nameserver 127.0.0.11\n")
+	assert.NotContains(t, string(data), "10.0.0.2", "The container's server forwards to --dns")
+	assert.Contains(t, string(data), "search corp.example\n")
+	assert.Contains(t, string(data), "options ndots:2\n")
+
+	require.NoError(t, writeResolvConf(rootfs, hostConfig, false))
+	data, err = os.ReadFile(filepath.Join(rootfs, "etc/resolv.conf"))
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "nameserver 10.0.0.2\n")
+	assert.NotContains(t, string(data), "127.0.0.11")
+}
+
+func TestLinks(t *testing.T) {
+	name, alias, err := parseLink("postgres")
+	require.NoError(t, err)
+	assert.Equal(t, "postgres", name)
+	assert.Equal(t, "postgres", alias)
+	_, _, err = parseLink(":db")
+	assert.Error(t, err)
+
+	target := &types.Container{
+		ID:   "0123456789abcdef",
+		Name: "postgres",
+		Config: types.ContainerConfig{
+			Env:          []string{"PATH=/usr/bin", "POSTGRES_DB=app"},
+			ExposedPorts: map[string]struct{}{"5432/tcp": {}},
+		},
+		Network: types.NetworkSettings{IPAddress: "172.17.0.5"},
+	}
+	links := []link{{alias: "db", target: target}}
+
+	env := linkEnv("web", links)
+	assert.Contains(t, env, "DB_NAME=/web/db")
+	assert.Contains(t, env, "DB_PORT=tcp://172.17.0.5:5432")
+	assert.Contains(t, env, "DB_PORT_5432_TCP_ADDR=172.17.0.5")
+	assert.Contains(t, env, "DB_ENV_POSTGRES_DB=app")
+	assert.NotContains(t, env, "DB_ENV_PATH=/usr/bin")
+
+	rootfs := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(rootfs, "etc"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(rootfs, "etc/hosts"), []byte("image hosts\n"), 0644))
+	require.NoError(t, writeLinkHosts(rootfs, links))
+	require.NoError(t, writeLinkHosts(rootfs, links))
+	data, err := os.ReadFile(filepath.Join(rootfs, "etc/hosts"))
+	require.NoError(t, err)
+	assert.Equal(t, "image hosts\n172.17.0.5\tdb postgres 0123456789ab\t"+linkHostsMarker+"\n", string(data), "Starting again should replace the links")
+}
+
+func TestParseBind(t *testing.T) {
+	mount, err := ParseBind("/srv/data:/data:ro")
+	require.NoError(t, err)
+	assert.Equal(t, MountTypeBind, mount.Type)
+	assert.Equal(t, "/srv/data", mount.Source)
+	assert.Equal(t, "/data", mount.Destination)
+	assert.False(t, mount.RW)
+
+	mount, err = ParseBind("cache:/var/cache")
+	require.NoError(t, err)
+	assert.Equal(t, MountTypeVolume, mount.Type)
+	assert.Equal(t, "cache", mount.Name)
+	assert.True(t, mount.RW)
+
+	mount, err = ParseBind("/var/lib/data/")
+	require.NoError(t, err)
+	assert.Equal(t, types.Mount{Type: MountTypeVolume, Destination: "/var/lib/data", RW: true, Anonymous: true}, mount)
+
+	for _, spec := range []string{"data", "/", "relative/path:/data", "/srv:data", "/srv:/", "/srv:/data:bogus", "cache:/data:rshared"} {
+		_, err := ParseBind(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestSecurePath(t *testing.T) {
+	rootfs := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(rootfs, "usr"), 0755))
+	require.NoError(t, os.Symlink("/usr", filepath.Join(rootfs, "abs")))
+	require.NoError(t, os.Symlink("../../../etc", filepath.Join(rootfs, "usr", "escape")))
+
+	path, err := securePath(rootfs, "/abs/lib")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(rootfs, "usr", "lib"), path)
+
+	path, err = securePath(rootfs, "/usr/escape/passwd")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(rootfs, "etc", "passwd"), path)
+}
+
+func TestParseMount(t *testing.T) {
+	mount, err := ParseMount("type=volume,src=data,dst=/data,ro,volume-driver=tmpfs,volume-opt=size=1m,volume-label=tier=db")
+	require.NoError(t, err)
+	assert.Equal(t, types.MountSpec{
+		Type:          MountTypeVolume,
+		Source:        "data",
+		Target:        "/data",
+		ReadOnly:      true,
+		VolumeDriver:  "tmpfs",
+		VolumeOptions: map[string]string{"size": "1m"},
+		VolumeLabels:  map[string]string{"tier": "db"},
+	}, mount)
+
+	mount, err = ParseMount("type=tmpfs,destination=/run,tmpfs-size=64m,tmpfs-mode=1777")
+	require.NoError(t, err)
+	assert.Equal(t, int64(64<<20), mount.TmpfsSize)
+	assert.Equal(t, "size=67108864,mode=1777", mountFromSpec(mount).Options)
+
+	mount, err = ParseMount(`type=bind,source=/srv,target=/srv,bind-propagation=rslave,readonly=false`)
+	require.NoError(t, err)
+	assert.False(t, mount.ReadOnly)
+	assert.Equal(t, "rslave", mount.Propagation)
+
+	for _, spec := range []string{
+		"src=data",
+		"type=bind,dst=/data",
+		"type=bind,src=relative,dst=/data",
+		"type=tmpfs,src=/srv,dst=/data",
+		"type=volume,src=data,dst=/data,tmpfs-size=1m",
+		"type=tmpfs,dst=/data,volume-driver=local",
+		"type=tmpfs,dst=/data,tmpfs-mode=999",
+		"type=overlay,dst=/data",
+		"type=volume,src=data,dst=/data,bogus=1",
+		"type=volume,src=data,dst=/",
+	} {
+		_, err := ParseMount(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestAnonymousVolumes(t *testing.T) {
+	tempDir := t.TempDir()
+	store, err := store.NewStore(tempDir)
+	require.NoError(t, err)
+	storageMgr, err := storage.NewStorageManager(&storage.StorageConfig{RootDir: filepath.Join(tempDir, "storage"), OverlayDriver: "vfs"})
+	require.NoError(t, err)
+
+	imageMgr := image.NewManager(store)
+	testImage, err := imageMgr.CreateImage("db", "latest", types.ImageConfig{
+		Volumes: map[string]struct{}{"/var/lib/db": {}, "/cache": {}},
+	})
+	require.NoError(t, err)
+	manager := NewManager(store, imageMgr)
+	manager.SetStorage(storageMgr)
+
+	create := func() *types.Container {
+		container, err := manager.CreateContainer(types.ContainerCreateOptions{
+			Config: types.ContainerConfig{Image: testImage.ID},
+			HostConfig: types.HostConfig{
+				Binds:  []string{"/scratch", "shared:/cache"},
+				Mounts: []types.MountSpec{{Type: MountTypeVolume, Target: "/logs", VolumeLabels: map[string]string{"tier": "logs"}}},
+			},
+		})
+		require.NoError(t, err)
+		return container
+	}
+
+	container := create()
+	anonymous := make(map[string]string)
+	for _, mount := range container.Mounts {
+		if mount.Anonymous {
+			anonymous[mount.Destination] = mount.Name
+		}
+	}
+	assert.Len(t, anonymous, 3, "-v /scratch, the --mount without a source and VOLUME /var/lib/db should get anonymous volumes")
+	assert.Contains(t, anonymous, "/var/lib/db")
+	assert.NotContains(t, anonymous, "/cache", "A volume mounted by the container replaces the one the image declares")
+
+	volume, err := storageMgr.GetVolume(anonymous["/logs"])
+	require.NoError(t, err)
+	assert.Contains(t, volume.Labels, AnonymousVolumeLabel)
+	assert.Equal(t, "logs", volume.Labels["tier"])
+
+	require.NoError(t, manager.RemoveContainer(container.ID, types.ContainerRemoveOptions{RemoveVolumes: true}))
+	for _, name := range anonymous {
+		_, err := storageMgr.GetVolume(name)
+		assert.Error(t, err, "Anonymous volumes should be removed with the container")
+	}
+	_, err = storageMgr.GetVolume("shared")
+	assert.NoError(t, err, "Named volumes should outlive the container")
+
+	container = create()
+	require.NoError(t, manager.RemoveContainer(container.ID, types.ContainerRemoveOptions{}))
+	for _, mount := range container.Mounts {
+		_, err := storageMgr.GetVolume(mount.Name)
+		assert.NoError(t, err, "Without --volumes the volumes should be kept")
+	}
+}
@@ -0,0 +1,595 @@
+package container
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"docker-impl/pkg/ids"
+	"docker-impl/pkg/storage"
+	"docker-impl/pkg/types"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	MountTypeBind   = "bind"
+	MountTypeVolume = "volume"
+	MountTypeTmpfs  = "tmpfs"
+)
+
+// AnonymousVolumeLabel marks the volumes created for a single container,
+// for a VOLUME of its image or a mount that names no volume.
+const AnonymousVolumeLabel = "com.docker.volume.anonymous"
+
+// volumeNamePattern is what named volumes may be called, which tells them
+// apart from host paths in -v
+var volumeNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// ParseBind parses a -v value, host-path:container-path[:options] for a
+// bind mount, volume-name:container-path[:options] for a named volume or
+// just container-path for an anonymous volume. Options are ro or rw and a
+// propagation mode such as rprivate.
+func ParseBind(spec string) (types.Mount, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) == 1 {
+		destination := filepath.Clean(spec)
+		if !filepath.IsAbs(spec) || destination == "/" {
+			return types.Mount{}, fmt.Errorf("invalid volume specification %q: an anonymous volume needs an absolute destination other than /", spec)
+		}
+		return types.Mount{Type: MountTypeVolume, Destination: destination, RW: true, Anonymous: true}, nil
+	}
+	if len(parts) > 3 {
+		return types.Mount{}, fmt.Errorf("invalid volume specification %q: expected source:destination[:options]", spec)
+	}
+
+	mount := types.Mount{
+		Source:      parts[0],
+		Destination: parts[1],
+		RW:          true,
+	}
+	switch {
+	case filepath.IsAbs(mount.Source):
+		mount.Type = MountTypeBind
+		mount.Source = filepath.Clean(mount.Source)
+		mount.Propagation = "rprivate"
+	case volumeNamePattern.MatchString(mount.Source):
+		mount.Type = MountTypeVolume
+		mount.Name = mount.Source
+		mount.Source = ""
+	default:
+		return types.Mount{}, fmt.Errorf("invalid volume specification %q: %q is neither an absolute path nor a volume name", spec, parts[0])
+	}
+	if !filepath.IsAbs(mount.Destination) {
+		return types.Mount{}, fmt.Errorf("invalid volume specification %q: destination must be an absolute path", spec)
+	}
+	mount.Destination = filepath.Clean(mount.Destination)
+	if mount.Destination == "/" {
+		return types.Mount{}, fmt.Errorf("invalid volume specification %q: destination can't be /", spec)
+	}
+
+	if len(parts) == 3 {
+		mount.Mode = parts[2]
+		for _, option := range strings.Split(parts[2], ",") {
+			switch option {
+			case "ro":
+				mount.RW = false
+			case "rw":
+				mount.RW = true
+			case "private", "rprivate", "shared", "rshared", "slave", "rslave":
+				if mount.Type != MountTypeBind {
+					return types.Mount{}, fmt.Errorf("invalid volume specification %q: propagation only applies to bind mounts", spec)
+				}
+				mount.Propagation = option
+			default:
+				return types.Mount{}, fmt.Errorf("invalid volume specification %q: unknown option %q", spec, option)
+			}
+		}
+	}
+	return mount, nil
+}
+
+// ParseMount parses a --mount value, comma-separated key=value pairs such
+// as type=volume,src=data,dst=/data,ro. Values holding commas can be
+// quoted as in CSV.
+func ParseMount(spec string) (types.MountSpec, error) {
+	fields, err := csv.NewReader(strings.NewReader(spec)).Read()
+	if err != nil {
+		return types.MountSpec{}, fmt.Errorf("invalid mount specification %q: %v", spec, err)
+	}
+
+	mount := types.MountSpec{Type: MountTypeVolume}
+	// options records which type each option given belongs to
+	options := make(map[string]string)
+	for _, field := range fields {
+		key, value, hasValue := strings.Cut(strings.TrimSpace(field), "=")
+		key = strings.ToLower(key)
+		if !hasValue && key != "readonly" && key != "ro" {
+			return types.MountSpec{}, fmt.Errorf("invalid mount specification %q: %s needs a value", spec, key)
+		}
+
+		switch key {
+		case "type":
+			mount.Type = value
+		case "source", "src":
+			mount.Source = value
+		case "target", "destination", "dst":
+			mount.Target = value
+		case "readonly", "ro":
+			mount.ReadOnly = true
+			if hasValue {
+				if mount.ReadOnly, err = strconv.ParseBool(value); err != nil {
+					return types.MountSpec{}, fmt.Errorf("invalid mount specification %q: invalid %s value %q", spec, key, value)
+				}
+			}
+		case "bind-propagation":
+			if _, ok := propagationFlags[value]; !ok {
+				return types.MountSpec{}, fmt.Errorf("invalid mount specification %q: unknown propagation %q", spec, value)
+			}
+			mount.Propagation = value
+			options[key] = MountTypeBind
+		case "volume-driver":
+			mount.VolumeDriver = value
+			options[key] = MountTypeVolume
+		case "volume-opt", "volume-label":
+			optionKey, optionValue, ok := strings.Cut(value, "=")
+			if !ok || optionKey == "" {
+				return types.MountSpec{}, fmt.Errorf("invalid mount specification %q: %s must be key=value", spec, key)
+			}
+			if key == "volume-opt" {
+				if mount.VolumeOptions == nil {
+					mount.VolumeOptions = make(map[string]string)
+				}
+				mount.VolumeOptions[optionKey] = optionValue
+			} else {
+				if mount.VolumeLabels == nil {
+					mount.VolumeLabels = make(map[string]string)
+				}
+				mount.VolumeLabels[optionKey] = optionValue
+			}
+			options[key] = MountTypeVolume
+		case "tmpfs-size":
+			if mount.TmpfsSize, err = storage.ParseSize(value); err != nil {
+				return types.MountSpec{}, fmt.Errorf("invalid mount specification %q: invalid tmpfs-size %q", spec, value)
+			}
+			options[key] = MountTypeTmpfs
+		case "tmpfs-mode":
+			mode, err := strconv.ParseUint(value, 8, 32)
+			if err != nil || mode > 07777 {
+				return types.MountSpec{}, fmt.Errorf("invalid mount specification %q: invalid tmpfs-mode %q, expected octal permissions", spec, value)
+			}
+			mount.TmpfsMode = uint32(mode)
+			options[key] = MountTypeTmpfs
+		default:
+			return types.MountSpec{}, fmt.Errorf("invalid mount specification %q: unknown option %q", spec, key)
+		}
+	}
+
+	if err := ValidateMountSpec(mount); err != nil {
+		return types.MountSpec{}, fmt.Errorf("invalid mount specification %q: %v", spec, err)
+	}
+	for option, optionType := range options {
+		if optionType != mount.Type {
+			return types.MountSpec{}, fmt.Errorf("invalid mount specification %q: %s can't be used with type=%s", spec, option, mount.Type)
+		}
+	}
+	return mount, nil
+}
+
+// ValidateMountSpec checks that a mount spec is complete and consistent,
+// as ParseMount does for the specs it returns.
+func ValidateMountSpec(spec types.MountSpec) error {
+	if spec.Target == "" {
+		return fmt.Errorf("target is required")
+	}
+	if !filepath.IsAbs(spec.Target) {
+		return fmt.Errorf("target %q must be an absolute path", spec.Target)
+	}
+	if filepath.Clean(spec.Target) == "/" {
+		return fmt.Errorf("target can't be /")
+	}
+
+	switch spec.Type {
+	case MountTypeBind:
+		if spec.Source == "" {
+			return fmt.Errorf("bind mounts need a source")
+		}
+		if !filepath.IsAbs(spec.Source) {
+			return fmt.Errorf("bind source %q must be an absolute path", spec.Source)
+		}
+		if _, ok := propagationFlags[spec.Propagation]; spec.Propagation != "" && !ok {
+			return fmt.Errorf("unknown propagation %q", spec.Propagation)
+		}
+	case MountTypeVolume:
+		// Without a source, an anonymous volume is created
+		if spec.Source != "" && !volumeNamePattern.MatchString(spec.Source) {
+			return fmt.Errorf("invalid volume name %q", spec.Source)
+		}
+	case MountTypeTmpfs:
+		if spec.Source != "" {
+			return fmt.Errorf("tmpfs mounts can't have a source")
+		}
+	default:
+		return fmt.Errorf("unknown mount type %q, expected bind, volume or tmpfs", spec.Type)
+	}
+	return nil
+}
+
+// mountFromSpec turns a --mount spec into the mount recorded on the
+// container.
+func mountFromSpec(spec types.MountSpec) types.Mount {
+	mount := types.Mount{
+		Type:        spec.Type,
+		Source:      spec.Source,
+		Destination: filepath.Clean(spec.Target),
+		RW:          !spec.ReadOnly,
+	}
+	switch spec.Type {
+	case MountTypeBind:
+		mount.Source = filepath.Clean(spec.Source)
+		mount.Propagation = spec.Propagation
+		if mount.Propagation == "" {
+			mount.Propagation = "rprivate"
+		}
+	case MountTypeVolume:
+		mount.Name = spec.Source
+		mount.Source = ""
+		mount.Anonymous = spec.Source == ""
+	case MountTypeTmpfs:
+		var options []string
+		if spec.TmpfsSize > 0 {
+			options = append(options, fmt.Sprintf("size=%d", spec.TmpfsSize))
+		}
+		if spec.TmpfsMode != 0 {
+			options = append(options, fmt.Sprintf("mode=%o", spec.TmpfsMode))
+		}
+		mount.Options = strings.Join(options, ",")
+	}
+	return mount
+}
+
+// resolveMounts parses the -v and --mount values of a container and adds
+// an anonymous volume for each VOLUME of its image nothing else is mounted
+// on. Missing host paths are created as directories and missing volumes
+// are created, with the default driver unless --mount names one, as Docker
+// does. If it fails, the anonymous volumes it created are removed.
+func (m *Manager) resolveMounts(binds []string, specs []types.MountSpec, imageVolumes map[string]struct{}) (mounts []types.Mount, err error) {
+	// volumeSpecs holds the --mount spec of each mount, nil for -v and
+	// image volumes
+	var volumeSpecs []*types.MountSpec
+	for _, bind := range binds {
+		mount, err := ParseBind(bind)
+		if err != nil {
+			return nil, err
+		}
+		mounts = append(mounts, mount)
+		volumeSpecs = append(volumeSpecs, nil)
+	}
+	for i := range specs {
+		if err := ValidateMountSpec(specs[i]); err != nil {
+			return nil, fmt.Errorf("invalid mount: %v", err)
+		}
+		mounts = append(mounts, mountFromSpec(specs[i]))
+		volumeSpecs = append(volumeSpecs, &specs[i])
+	}
+
+	destinations := make(map[string]bool)
+	for _, mount := range mounts {
+		if destinations[mount.Destination] {
+			return nil, fmt.Errorf("duplicate mount point: %s", mount.Destination)
+		}
+		destinations[mount.Destination] = true
+	}
+	// Without the storage manager containers get an empty rootfs, and
+	// nothing to keep in the volumes of the image
+	var declared []string
+	for path := range imageVolumes {
+		if m.storage == nil {
+			break
+		}
+		if path = filepath.Clean("/" + path); path != "/" && !destinations[path] {
+			destinations[path] = true
+			declared = append(declared, path)
+		}
+	}
+	sort.Strings(declared)
+	for _, path := range declared {
+		mounts = append(mounts, types.Mount{Type: MountTypeVolume, Destination: path, RW: true, Anonymous: true})
+		volumeSpecs = append(volumeSpecs, nil)
+	}
+
+	var anonymous []string
+	defer func() {
+		if err != nil {
+			for _, name := range anonymous {
+				if err := m.storage.RemoveVolume(name, false); err != nil {
+					logrus.Warnf("Failed to remove anonymous volume %s: %v", name, err)
+				}
+			}
+		}
+	}()
+	for i := range mounts {
+		mount := &mounts[i]
+
+		switch mount.Type {
+		case MountTypeBind:
+			if _, err := os.Stat(mount.Source); os.IsNotExist(err) {
+				if err := os.MkdirAll(mount.Source, 0755); err != nil {
+					return nil, fmt.Errorf("failed to create bind mount source %s: %v", mount.Source, err)
+				}
+			} else if err != nil {
+				return nil, fmt.Errorf("invalid bind mount source %s: %v", mount.Source, err)
+			}
+		case MountTypeVolume:
+			if m.storage == nil {
+				return nil, fmt.Errorf("volumes need the storage manager")
+			}
+			spec := volumeSpecs[i]
+			if spec == nil {
+				spec = &types.MountSpec{}
+			}
+			if mount.Anonymous {
+				labels := map[string]string{AnonymousVolumeLabel: ""}
+				for key, value := range spec.VolumeLabels {
+					labels[key] = value
+				}
+				volume, err := m.storage.CreateVolume(ids.GenerateID(), spec.VolumeDriver, spec.VolumeOptions, labels)
+				if err != nil {
+					return nil, fmt.Errorf("failed to create anonymous volume for %s: %v", mount.Destination, err)
+				}
+				anonymous = append(anonymous, volume.Name)
+				mount.Name = volume.Name
+				mount.Source = volume.Mountpoint
+				mount.Driver = volume.Driver
+				continue
+			}
+			volume, err := m.storage.GetVolume(mount.Name)
+			if err != nil {
+				if volume, err = m.storage.CreateVolume(mount.Name, spec.VolumeDriver, spec.VolumeOptions, spec.VolumeLabels); err != nil {
+					return nil, fmt.Errorf("failed to create volume %s: %v", mount.Name, err)
+				}
+			} else if spec.VolumeDriver != "" && spec.VolumeDriver != volume.Driver {
+				return nil, fmt.Errorf("volume %s already exists with driver %s, not %s", mount.Name, volume.Driver, spec.VolumeDriver)
+			}
+			mount.Source = volume.Mountpoint
+			mount.Driver = volume.Driver
+		}
+	}
+	return mounts, nil
+}
+
+// populateVolumes copies what the image has at the mount point of each
+// empty volume into it.
+func (m *Manager) populateVolumes(container *types.Container) {
+	rootfsDir := m.RootfsDir(container.ID)
+	for _, mount := range container.Mounts {
+		if mount.Type != MountTypeVolume {
+			continue
+		}
+		src, err := securePath(rootfsDir, mount.Destination)
+		if err != nil {
+			logrus.Warnf("Failed to populate volume %s: %v", mount.Name, err)
+			continue
+		}
+		if info, err := os.Stat(src); err != nil || !info.IsDir() {
+			continue
+		}
+		if err := m.storage.PopulateVolume(mount.Name, src); err != nil {
+			logrus.Warnf("Failed to populate volume %s: %v", mount.Name, err)
+		}
+	}
+}
+
+// removeAnonymousVolumes removes the anonymous volumes of a container
+// being removed. Volumes another container still uses are kept.
+func (m *Manager) removeAnonymousVolumes(container *types.Container) {
+	if m.storage == nil {
+		return
+	}
+	for _, mount := range container.Mounts {
+		if mount.Type != MountTypeVolume || !mount.Anonymous {
+			continue
+		}
+		if err := m.storage.RemoveVolume(mount.Name, false); err != nil {
+			logrus.Warnf("Failed to remove volume %s of container %s: %v", mount.Name, container.ID, err)
+		}
+	}
+}
+
+// volumeMounts lists the named volumes among mounts for the storage
+// manager, which counts the containers using each.
+func volumeMounts(mounts []types.Mount) []storage.VolumeMount {
+	var volumes []storage.VolumeMount
+	for _, mount := range mounts {
+		if mount.Type == MountTypeVolume {
+			volumes = append(volumes, storage.VolumeMount{
+				Name:     mount.Name,
+				Source:   mount.Source,
+				Target:   mount.Destination,
+				ReadOnly: !mount.RW,
+			})
+		}
+	}
+	return volumes
+}
+
+// startProcess starts the container's process. With mounts, it is started
+// from a thread with a mount namespace of its own where they are bind
+// mounted into the rootfs, so the process sees them while the host's
+// mount table stays untouched. With netnsPath, the thread enters that
+// network namespace first, which the process inherits.
+func startProcess(cmd *exec.Cmd, rootfsDir string, mounts []types.Mount, netnsPath string) error {
+	if len(mounts) == 0 && netnsPath == "" {
+		return cmd.Start()
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		// The thread is never unlocked, so it exits with the goroutine
+		// instead of going back to the scheduler with a filesystem context
+		// of its own
+		runtime.LockOSThread()
+
+		if netnsPath != "" {
+			hostNet, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", syscall.Gettid()))
+			if err != nil {
+				errc <- fmt.Errorf("failed to open network namespace: %v", err)
+				return
+			}
+			defer hostNet.Close()
+			containerNet, err := os.Open(netnsPath)
+			if err != nil {
+				errc <- fmt.Errorf("failed to open network namespace %s: %v", netnsPath, err)
+				return
+			}
+			defer containerNet.Close()
+			if err := unix.Setns(int(containerNet.Fd()), unix.CLONE_NEWNET); err != nil {
+				errc <- fmt.Errorf("failed to enter network namespace: %v", err)
+				return
+			}
+			defer unix.Setns(int(hostNet.Fd()), unix.CLONE_NEWNET)
+		}
+
+		hostNS, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/mnt", syscall.Gettid()))
+		if err != nil {
+			errc <- fmt.Errorf("failed to open mount namespace: %v", err)
+			return
+		}
+		defer hostNS.Close()
+		if err := syscall.Unshare(syscall.CLONE_NEWNS); err != nil {
+			errc <- fmt.Errorf("failed to create mount namespace: %v", err)
+			return
+		}
+		// The main thread is parked rather than exited, so the namespace
+		// is left once the process holds it
+		defer unix.Setns(int(hostNS.Fd()), unix.CLONE_NEWNS)
+		if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+			errc <- fmt.Errorf("failed to make mounts private: %v", err)
+			return
+		}
+		for _, mount := range mounts {
+			mountFunc := bindMount
+			if mount.Type == MountTypeTmpfs {
+				mountFunc = tmpfsMount
+			}
+			if err := mountFunc(rootfsDir, mount); err != nil {
+				errc <- err
+				return
+			}
+		}
+		errc <- cmd.Start()
+	}()
+	return <-errc
+}
+
+// bindMount mounts the source of mount at its destination in rootfsDir,
+// creating the destination as a file or directory to match the source.
+func bindMount(rootfsDir string, mount types.Mount) error {
+	target, err := securePath(rootfsDir, mount.Destination)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(mount.Source)
+	if err != nil {
+		return fmt.Errorf("invalid mount source %s: %v", mount.Source, err)
+	}
+	if info.IsDir() {
+		err = os.MkdirAll(target, 0755)
+	} else if err = os.MkdirAll(filepath.Dir(target), 0755); err == nil {
+		var file *os.File
+		if file, err = os.OpenFile(target, os.O_CREATE, 0644); err == nil {
+			file.Close()
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create mount point %s: %v", mount.Destination, err)
+	}
+
+	if err := syscall.Mount(mount.Source, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("failed to bind mount %s to %s: %v", mount.Source, mount.Destination, err)
+	}
+	// Read-only and propagation only take effect on a mount that exists
+	if !mount.RW {
+		if err := syscall.Mount("", target, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+			return fmt.Errorf("failed to make %s read-only: %v", mount.Destination, err)
+		}
+	}
+	if flag, ok := propagationFlags[mount.Propagation]; ok {
+		if err := syscall.Mount("", target, "", flag, ""); err != nil {
+			return fmt.Errorf("failed to set propagation of %s: %v", mount.Destination, err)
+		}
+	}
+	return nil
+}
+
+// tmpfsMount mounts a new tmpfs at the destination of mount in rootfsDir.
+// It lives in the container's mount namespace only, so its contents go
+// away with the container's process.
+func tmpfsMount(rootfsDir string, mount types.Mount) error {
+	target, err := securePath(rootfsDir, mount.Destination)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return fmt.Errorf("failed to create mount point %s: %v", mount.Destination, err)
+	}
+
+	flags := uintptr(syscall.MS_NOSUID | syscall.MS_NODEV)
+	if !mount.RW {
+		flags |= syscall.MS_RDONLY
+	}
+	if err := syscall.Mount("tmpfs", target, "tmpfs", flags, mount.Options); err != nil {
+		return fmt.Errorf("failed to mount tmpfs at %s: %v", mount.Destination, err)
+	}
+	return nil
+}
+
+var propagationFlags = map[string]uintptr{
+	"private":  syscall.MS_PRIVATE,
+	"rprivate": syscall.MS_PRIVATE | syscall.MS_REC,
+	"shared":   syscall.MS_SHARED,
+	"rshared":  syscall.MS_SHARED | syscall.MS_REC,
+	"slave":    syscall.MS_SLAVE,
+	"rslave":   syscall.MS_SLAVE | syscall.MS_REC,
+}
+
+// securePath joins path to rootfsDir, resolving symlinks in the rootfs
+// against it rather than the host, so a mount can't land outside it.
+func securePath(rootfsDir, path string) (string, error) {
+	current := rootfsDir
+	for _, part := range strings.Split(filepath.Clean("/"+path), "/") {
+		if part == "" {
+			continue
+		}
+		next := filepath.Join(current, part)
+		for i := 0; ; i++ {
+			if i > 40 {
+				return "", fmt.Errorf("too many symlinks in %s", path)
+			}
+			link, err := os.Readlink(next)
+			if err != nil {
+				break
+			}
+			if !filepath.IsAbs(link) {
+				dir, err := filepath.Rel(rootfsDir, filepath.Dir(next))
+				if err != nil {
+					return "", err
+				}
+				link = filepath.Join("/", dir, link)
+			}
+			// Cleaning from / stops .. at the rootfs
+			next = filepath.Join(rootfsDir, filepath.Clean("/"+link))
+		}
+		current = next
+	}
+	return current, nil
+}
@@ -0,0 +1,302 @@
+package container
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"docker-impl/pkg/network"
+	"docker-impl/pkg/types"
+	"github.com/sirupsen/logrus"
+)
+
+// SetNetwork connects containers on the bridge network through the network
+// manager get returns. It is only called when a container starts, so the
+// bridge isn't set up for commands that never start one.
+func (m *Manager) SetNetwork(get func() *network.Manager) {
+	m.network = get
+}
+
+// usesBridge reports whether the container is connected to the default
+// bridge network, which it is unless it asks for another mode.
+func usesBridge(container *types.Container) bool {
+	switch container.HostConfig.NetworkMode {
+	case "", "bridge", "default":
+		return true
+	}
+	return false
+}
+
+// userNetwork returns the user-defined network the container asks to run
+// on, or "" for the predefined modes.
+func userNetwork(container *types.Container) string {
+	switch mode := container.HostConfig.NetworkMode; mode {
+	case "", "bridge", "default", "host", "none":
+		return ""
+	default:
+		if strings.HasPrefix(mode, "container:") {
+			return ""
+		}
+		return mode
+	}
+}
+
+// usesOwnResolver reports whether the container has a DNS server in its
+// network namespace, which containers on the host network or without one
+// don't.
+func usesOwnResolver(container *types.Container, netns string) bool {
+	return netns != "" && container.HostConfig.NetworkMode != "none"
+}
+
+// setupNetwork gives a bridge container a network namespace with its end
+// of a veth pair, its address and its published ports, and records them
+// in container.Network. A container on a user-defined network gets a
+// namespace connected to that network instead. Either way a DNS server
+// in the namespace resolves the container's peers. A container on the
+// none network gets a namespace with only loopback in it, and one on the
+// host network none at all. It returns the namespace to start the
+// container's process in, or "" when it shares the host's.
+func (m *Manager) setupNetwork(container *types.Container) (string, error) {
+	if m.network == nil {
+		return "", nil
+	}
+	var netns string
+	var err error
+	switch mode := container.HostConfig.NetworkMode; {
+	case userNetwork(container) != "":
+		netns, err = m.setupUserNetwork(container, mode)
+	case usesBridge(container):
+		netns, err = m.setupBridgeNetwork(container)
+	case mode == "host" || mode == "none":
+		netns, err = m.setupIsolatedNetwork(container, network.NetworkMode(mode))
+	}
+	if err != nil || !usesOwnResolver(container, netns) {
+		return netns, err
+	}
+
+	if err := m.network().StartResolver(container.ID, netns, container.HostConfig.DNS); err != nil {
+		m.releaseNetwork(container)
+		return "", err
+	}
+	return netns, nil
+}
+
+func (m *Manager) setupBridgeNetwork(container *types.Container) (string, error) {
+	networkMgr := m.network()
+
+	config := &network.NetworkConfig{
+		Mode:         network.NetworkModeBridge,
+		NetworkName:  "bridge",
+		Hostname:     container.Config.Hostname,
+		Aliases:      container.HostConfig.NetworkAliases,
+		PortMappings: portMappings(container.HostConfig.PortBindings),
+	}
+	settings, err := networkMgr.CreateContainerNetwork(container.ID, container.Name, config)
+	if err != nil {
+		return "", err
+	}
+
+	container.Network.IPAddress = settings.IPAddress
+	container.Network.Gateway = settings.Gateway
+	container.Network.Bridge = "mydocker0"
+	container.Network.Ports = publishedPorts(settings.Ports)
+	container.Network.SandboxID = settings.SandboxID
+	container.Network.SandboxKey = settings.SandboxKey
+	return settings.SandboxKey, nil
+}
+
+// setupIsolatedNetwork puts the container on the host or none network,
+// neither of which has ports to publish.
+func (m *Manager) setupIsolatedNetwork(container *types.Container, mode network.NetworkMode) (string, error) {
+	if len(container.HostConfig.PortBindings) > 0 {
+		if mode == network.NetworkModeHost {
+			logrus.Warnf("Ports of container %s are not published: on the host network they are the host's", container.ID)
+		} else {
+			logrus.Warnf("Ports of container %s are not published: it has no network", container.ID)
+		}
+	}
+
+	settings, err := m.network().CreateContainerNetwork(container.ID, container.Name, &network.NetworkConfig{Mode: mode})
+	if err != nil {
+		return "", err
+	}
+	container.Network.SandboxID = settings.SandboxID
+	container.Network.SandboxKey = settings.SandboxKey
+	return settings.SandboxKey, nil
+}
+
+func (m *Manager) setupUserNetwork(container *types.Container, name string) (string, error) {
+	networkMgr := m.network()
+	userNet, err := networkMgr.GetNetwork(name)
+	if err != nil {
+		return "", err
+	}
+	if len(container.HostConfig.PortBindings) > 0 {
+		logrus.Warnf("Ports of container %s are not published: publishing is only supported on the default bridge", container.ID)
+	}
+
+	sandboxKey, err := network.CreateNetNS(container.ID)
+	if err != nil {
+		return "", fmt.Errorf("failed to create network namespace: %v", err)
+	}
+	endpoint, err := networkMgr.ConnectContainer(userNet.ID, container.ID, container.Name, "", container.HostConfig.NetworkAliases)
+	if err != nil {
+		network.DeleteNetNS(container.ID)
+		return "", err
+	}
+
+	ip, _, _ := net.ParseCIDR(endpoint.IPAddress)
+	container.Network.IPAddress = ip.String()
+	if !userNet.Internal {
+		container.Network.Gateway = userNet.Gateway
+	}
+	container.Network.Bridge, _ = userNet.Options["com.docker.network.bridge.name"].(string)
+	container.Network.SandboxID = container.ID
+	container.Network.SandboxKey = sandboxKey
+	return sandboxKey, nil
+}
+
+// releaseNetwork removes what setupNetwork set up once the container's
+// process is gone, along with its network namespace and its endpoints on
+// user-defined networks.
+func (m *Manager) releaseNetwork(container *types.Container) {
+	if m.network == nil || container.Network.SandboxKey == "" {
+		return
+	}
+	networkMgr := m.network()
+	networkMgr.StopResolver(container.ID)
+	if err := networkMgr.DisconnectAll(container.ID); err != nil {
+		logrus.Warnf("Failed to disconnect container %s from its networks: %v", container.ID, err)
+	}
+	if usesBridge(container) {
+		if err := networkMgr.RemoveContainerNetwork(container.ID, container.Name); err != nil {
+			logrus.Warnf("Failed to remove network of container %s: %v", container.ID, err)
+		}
+	} else if err := network.DeleteNetNS(container.ID); err != nil {
+		logrus.Warnf("Failed to delete network namespace of container %s: %v", container.ID, err)
+	}
+	container.Network.IPAddress = ""
+	container.Network.Gateway = ""
+	container.Network.SandboxKey = ""
+	container.Network.Ports = nil
+}
+
+// checkDNS fails unless the DNS servers of a container are IP addresses.
+func checkDNS(hostConfig types.HostConfig) error {
+	for _, server := range hostConfig.DNS {
+		if net.ParseIP(server) == nil {
+			return fmt.Errorf("invalid DNS server %q: not an IP address", server)
+		}
+	}
+	return nil
+}
+
+// writeResolvConf gives the container's /etc/resolv.conf the DNS server
+// in its network namespace when it has one, and the --dns servers or the
+// host's otherwise. The --dns-search and --dns-opt values, or the host's,
+// complete it; containers with their own server search their peers'
+// domain first.
+func writeResolvConf(rootfsDir string, hostConfig types.HostConfig, ownResolver bool) error {
+	nameservers, search, options := network.HostDNS()
+	if ownResolver {
+		nameservers = []string{network.ResolverAddress}
+		search = append([]string{"mydocker.local"}, search...)
+	} else if len(hostConfig.DNS) > 0 {
+		nameservers = hostConfig.DNS
+	}
+	if len(hostConfig.DNSSearch) > 0 {
+		search = hostConfig.DNSSearch
+	}
+	if len(hostConfig.DNSOptions) > 0 {
+		options = hostConfig.DNSOptions
+	}
+
+	etcDir := filepath.Join(rootfsDir, "etc")
+	if err := os.MkdirAll(etcDir, 0755); err != nil {
+		return err
+	}
+	// Images often link resolv.conf to somewhere else, which may not be in
+	// the rootfs
+	path := filepath.Join(etcDir, "resolv.conf")
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(path, network.ResolvConf(nameservers, search, options), 0644)
+}
+
+// publishedPorts returns the host ports the network manager published a
+// container's ports on, which ephemeral ports and ranges were resolved to.
+func publishedPorts(ports map[string][]network.PortBinding) map[string][]types.PortBinding {
+	if len(ports) == 0 {
+		return nil
+	}
+	published := make(map[string][]types.PortBinding, len(ports))
+	for key, bindings := range ports {
+		for _, binding := range bindings {
+			published[key] = append(published[key], types.PortBinding{HostIP: binding.HostIP, HostPort: binding.HostPort})
+		}
+	}
+	return published
+}
+
+// portMappings turns the port bindings of a container back into the
+// mappings the network manager publishes. A host address picks the
+// family of a binding; a port published on both families without one has
+// its IPv4 binding first.
+func portMappings(bindings map[string][]types.PortBinding) []network.PortMapping {
+	var mappings []network.PortMapping
+	for key, portBindings := range bindings {
+		port, protocol := key, "tcp"
+		if i := strings.Index(key, "/"); i >= 0 {
+			port, protocol = key[:i], key[i+1:]
+		}
+		containerPort, err := strconv.Atoi(port)
+		if err != nil {
+			logrus.Warnf("Skipping invalid port binding %s", key)
+			continue
+		}
+
+		unbound := 0
+		for _, binding := range portBindings {
+			mapping := network.PortMapping{
+				ContainerPort: containerPort,
+				Protocol:      protocol,
+				HostIP:        binding.HostIP,
+				Family:        network.FamilyIPv4,
+			}
+			if binding.HostPort != "" {
+				// A range publishes on any free port of it
+				first, last, isRange := strings.Cut(binding.HostPort, "-")
+				hostPort, err := strconv.Atoi(first)
+				if err != nil {
+					logrus.Warnf("Skipping invalid host port %s of %s", binding.HostPort, key)
+					continue
+				}
+				mapping.HostPort = hostPort
+				if isRange {
+					if mapping.HostPortEnd, err = strconv.Atoi(last); err != nil {
+						logrus.Warnf("Skipping invalid host port %s of %s", binding.HostPort, key)
+						continue
+					}
+				}
+			}
+			if ip := net.ParseIP(binding.HostIP); ip != nil {
+				if ip.To4() == nil {
+					mapping.Family = network.FamilyIPv6
+				}
+			} else {
+				if unbound > 0 {
+					mapping.Family = network.FamilyIPv6
+				}
+				unbound++
+			}
+			mappings = append(mappings, mapping)
+		}
+	}
+	return mappings
+}
@@ -0,0 +1,172 @@
+package container
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"docker-impl/pkg/events"
+	"docker-impl/pkg/types"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultCrashLoopThreshold = 5
+	defaultCrashLoopWindow    = 5 * time.Minute
+
+	// stopKillTimeout is how long RestartContainer waits for a stopped
+	// process to exit before killing it
+	stopKillTimeout = 10 * time.Second
+
+	maxRestartDelay = 30 * time.Second
+)
+
+var cgroupRoot = "/sys/fs/cgroup/mydocker"
+
+// SetCrashLoopPolicy sets how many restarts within window count as a crash loop.
+func (m *Manager) SetCrashLoopPolicy(threshold int, window time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if threshold > 0 {
+		m.crashLoopThreshold = threshold
+	}
+	if window > 0 {
+		m.crashLoopWindow = window
+	}
+}
+
+// recordExit fills in the exit diagnostics from a finished process.
+func recordExit(container *types.Container, state *os.ProcessState, waitErr error) {
+	container.ExitCode = 0
+	container.Signal = ""
+	container.Error = ""
+
+	if state == nil {
+		container.ExitCode = -1
+		if waitErr != nil {
+			container.Error = waitErr.Error()
+		}
+		return
+	}
+
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		container.Signal = status.Signal().String()
+		container.ExitCode = 128 + int(status.Signal())
+	} else {
+		container.ExitCode = state.ExitCode()
+	}
+
+	container.OOMKilled = detectOOMKill(container.ID)
+}
+
+// detectOOMKill checks the container's cgroup v2 memory.events for OOM kills.
+func detectOOMKill(containerID string) bool {
+	file, err := os.Open(filepath.Join(cgroupRoot, containerID, "memory.events"))
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			count, _ := strconv.Atoi(fields[1])
+			return count > 0
+		}
+	}
+
+	return false
+}
+
+func shouldRestart(container *types.Container) bool {
+	policy := container.HostConfig.RestartPolicy
+
+	switch policy.Name {
+	case "always", "unless-stopped":
+		return true
+	case "on-failure":
+		if container.ExitCode == 0 {
+			return false
+		}
+		return policy.MaximumRetryCount == 0 || container.RestartCount < policy.MaximumRetryCount
+	default:
+		return false
+	}
+}
+
+// restartDelay doubles from 100ms per consecutive restart, like the docker daemon.
+func restartDelay(restartCount int) time.Duration {
+	delay := 100 * time.Millisecond
+	for i := 0; i < restartCount && delay < maxRestartDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRestartDelay {
+		delay = maxRestartDelay
+	}
+	return delay
+}
+
+// recordRestart bumps the restart count and reports whether the restarts
+// within the crash loop window reached the threshold.
+func (m *Manager) recordRestart(container *types.Container, now time.Time) bool {
+	m.mu.Lock()
+	threshold := m.crashLoopThreshold
+	window := m.crashLoopWindow
+	m.mu.Unlock()
+
+	container.RestartCount++
+
+	recent := []time.Time{now}
+	for _, t := range container.RestartTimes {
+		if now.Sub(t) < window {
+			recent = append(recent, t)
+		}
+	}
+	container.RestartTimes = recent
+
+	return len(recent) >= threshold
+}
+
+func (m *Manager) restartContainer(container *types.Container) {
+	now := time.Now()
+	if m.recordRestart(container, now) {
+		logrus.Warnf("Container %s is crash looping: %d recent restarts, last exit code %d",
+			container.ID, len(container.RestartTimes), container.ExitCode)
+		events.Publish(events.Event{
+			Type:   events.TypeContainer,
+			Action: "crashloop",
+			ID:     container.ID,
+			Attributes: map[string]string{
+				"name":         container.Name,
+				"exitCode":     strconv.Itoa(container.ExitCode),
+				"restartCount": strconv.Itoa(container.RestartCount),
+			},
+			Time: now,
+		})
+	}
+
+	transition(container, types.StatusRestarting, "restart policy "+container.HostConfig.RestartPolicy.Name, now)
+	if err := m.saveContainer(container); err != nil {
+		logrus.Warnf("Failed to save container state: %v", err)
+	}
+
+	time.Sleep(restartDelay(len(container.RestartTimes) - 1))
+
+	if err := m.StartContainer(container.ID); err != nil {
+		logrus.Errorf("Failed to restart container %s: %v", container.ID, err)
+		// Left restarting, it would look like it is about to run
+		if container, err := m.GetContainer(container.ID); err == nil {
+			if transition(container, types.StatusExited, "restart failed", time.Now()) == nil {
+				if err := m.saveContainer(container); err != nil {
+					logrus.Warnf("Failed to save container state: %v", err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package container
+
+import (
+	"sort"
+
+	"docker-impl/pkg/store"
+	"docker-impl/pkg/types"
+	"github.com/sirupsen/logrus"
+)
+
+// containerDocument describes a container to the search index.
+func containerDocument(container *types.Container) *store.IndexDocument {
+	var labels []string
+	seen := make(map[string]bool)
+	for _, m := range []map[string]string{container.Labels, container.Config.Labels} {
+		for key, value := range m {
+			if pair := key + "=" + value; !seen[pair] {
+				seen[pair] = true
+				labels = append(labels, pair)
+			}
+		}
+	}
+	sort.Strings(labels)
+
+	return &store.IndexDocument{
+		Kind: store.KindContainer,
+		ID:   container.ID,
+		Name: container.Name,
+		Fields: map[string][]string{
+			"name":  {container.Name},
+			"label": labels,
+			"image": {container.Image},
+			"env":   container.Config.Env,
+		},
+	}
+}
+
+// indexContainer updates the search index entry of a container. The index
+// only helps searching, so failures are logged rather than returned.
+func (m *Manager) indexContainer(container *types.Container) {
+	if err := m.store.IndexDocuments(containerDocument(container)); err != nil {
+		logrus.Warnf("Failed to index container %s: %v", container.ID, err)
+	}
+}
+
+// RebuildIndex replaces the search index entries of containers with
+// entries for every container.
+func (m *Manager) RebuildIndex() error {
+	containers, err := m.ListContainers(types.ContainerListOptions{All: true})
+	if err != nil {
+		return err
+	}
+	docs := make([]*store.IndexDocument, 0, len(containers))
+	for _, container := range containers {
+		docs = append(docs, containerDocument(container))
+	}
+	return m.store.ReplaceDocuments(store.KindContainer, docs)
+}
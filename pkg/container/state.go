@@ -0,0 +1,136 @@
+package container
+
+import (
+	"fmt"
+	"time"
+
+	"docker-impl/pkg/types"
+	"github.com/sirupsen/logrus"
+)
+
+// maxStateHistory is how many transitions a container keeps.
+const maxStateHistory = 50
+
+// stateTransitions lists the statuses each status may lead to. A
+// container is created, runs, may be paused, stops or exits, possibly
+// restarts, and is finally removed; dead is where containers end up when
+// what happened to their process is unknown.
+var stateTransitions = map[types.ContainerStatus][]types.ContainerStatus{
+	"":                     {types.StatusCreated},
+	types.StatusCreated:    {types.StatusRunning, types.StatusRemoving},
+	types.StatusRunning:    {types.StatusPaused, types.StatusStopped, types.StatusExited, types.StatusDead},
+	types.StatusPaused:     {types.StatusRunning, types.StatusStopped, types.StatusExited, types.StatusDead},
+	types.StatusStopped:    {types.StatusRunning, types.StatusRemoving},
+	types.StatusExited:     {types.StatusRunning, types.StatusRestarting, types.StatusRemoving},
+	types.StatusRestarting: {types.StatusRunning, types.StatusExited, types.StatusDead},
+	types.StatusRemoving:   {types.StatusDead},
+	types.StatusDead:       {types.StatusRunning, types.StatusRemoving},
+}
+
+// canTransition reports whether a container may go from one status to
+// another.
+func canTransition(from, to types.ContainerStatus) bool {
+	for _, next := range stateTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTransition fails if container can't go to status from its current
+// one, without changing it. Staying in the same status fails too.
+func checkTransition(container *types.Container, to types.ContainerStatus) error {
+	if canTransition(container.Status, to) {
+		return nil
+	}
+	if container.Status == types.StatusRunning && to == types.StatusRunning {
+		return fmt.Errorf("container is already running")
+	}
+	return fmt.Errorf("cannot move container %s from %s to %s", container.ID, statusName(container.Status), to)
+}
+
+// transition moves container to status for reason and records it in its
+// history; staying in the same status records nothing. The caller saves
+// the container.
+func transition(container *types.Container, to types.ContainerStatus, reason string, now time.Time) error {
+	if container.Status == to {
+		return nil
+	}
+	if err := checkTransition(container, to); err != nil {
+		return err
+	}
+
+	container.StateHistory = append(container.StateHistory, types.StateTransition{
+		From:   container.Status,
+		To:     to,
+		Time:   now,
+		Reason: reason,
+	})
+	if len(container.StateHistory) > maxStateHistory {
+		container.StateHistory = container.StateHistory[len(container.StateHistory)-maxStateHistory:]
+	}
+	container.Status = to
+	return nil
+}
+
+func statusName(status types.ContainerStatus) string {
+	if status == "" {
+		return "no status"
+	}
+	return string(status)
+}
+
+// RecoverContainers repairs the status of containers left behind by a
+// mydocker process that went away mid-transition: running and paused
+// containers whose process is gone are dead, restarts that never happened
+// leave the container exited, and interrupted removals leave it dead, so
+// it can be removed again.
+func (m *Manager) RecoverContainers() error {
+	containers, err := m.ListContainers(types.ContainerListOptions{All: true})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, container := range containers {
+		m.mu.Lock()
+		_, monitored := m.running[container.ID]
+		m.mu.Unlock()
+		if monitored {
+			continue
+		}
+
+		var to types.ContainerStatus
+		var reason string
+		switch container.Status {
+		case types.StatusRunning, types.StatusPaused:
+			if processAlive(container.PID) {
+				continue
+			}
+			to, reason = types.StatusDead, "process lost"
+			container.PID = 0
+			container.FinishedAt = now
+		case types.StatusRestarting:
+			// The restart may just be waiting out its delay
+			if now.Sub(container.FinishedAt) < 2*maxRestartDelay {
+				continue
+			}
+			to, reason = types.StatusExited, "restart interrupted"
+		case types.StatusRemoving:
+			to, reason = types.StatusDead, "removal interrupted"
+		default:
+			continue
+		}
+
+		if err := transition(container, to, reason, now); err != nil {
+			logrus.Warnf("Failed to recover container %s: %v", container.ID, err)
+			continue
+		}
+		logrus.Warnf("Container %s was left %s: now %s", container.ID, container.StateHistory[len(container.StateHistory)-1].From, to)
+		if err := m.saveContainer(container); err != nil {
+			logrus.Warnf("Failed to save container state: %v", err)
+		}
+	}
+	return nil
+}
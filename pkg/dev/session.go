@@ -0,0 +1,167 @@
+package dev
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"docker-impl/pkg/container"
+	"docker-impl/pkg/types"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// SyncCopy copies changed files into the container's filesystem
+	SyncCopy = "copy"
+	// SyncBind bind mounts the directory into the container's
+	// filesystem, so changes are visible without copying
+	SyncBind = "bind"
+
+	ActionRestart = "restart"
+	// ActionReload signals the container instead of restarting it
+	ActionReload = "reload"
+	// ActionNone only syncs, for servers that reload by themselves
+	ActionNone = "none"
+)
+
+// Options configure a watch session.
+type Options struct {
+	// Path is the host directory to watch
+	Path string
+	// Target is the directory inside the container it is synced to
+	Target   string
+	Mode     string
+	Action   string
+	Signal   syscall.Signal
+	Interval time.Duration
+	Debounce time.Duration
+	Ignore   []string
+	// StopTimeout is passed to StopContainer on restarts
+	StopTimeout int
+	// OnSync, when set, is called after every sync
+	OnSync func(SyncReport)
+}
+
+// SyncReport describes one round of syncing and the action taken.
+type SyncReport struct {
+	Changes []Change
+	Action  string
+	Err     error
+}
+
+// Watch syncs Path into the container at Target and then, until ctx is
+// done, syncs every batch of changes and restarts or reloads the
+// container. Failed syncs and restarts are reported through OnSync
+// rather than ending the session, since a broken build is part of the
+// loop.
+func Watch(ctx context.Context, containers *container.Manager, containerID string, options Options) error {
+	if err := validateOptions(&options); err != nil {
+		return err
+	}
+	ctr, err := containers.GetContainer(containerID)
+	if err != nil {
+		return err
+	}
+
+	source, err := filepath.Abs(options.Path)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %v", options.Path, err)
+	}
+	if info, err := os.Stat(source); err != nil || !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", options.Path)
+	}
+	target := filepath.Join(containers.RootfsDir(ctr.ID), filepath.Clean(options.Target))
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return fmt.Errorf("failed to create %s in the container: %v", options.Target, err)
+	}
+
+	watcher, err := NewWatcher(source, options.Ignore, options.Interval, options.Debounce)
+	if err != nil {
+		return err
+	}
+
+	switch options.Mode {
+	case SyncBind:
+		// The container sees the mount right away when the host's mounts
+		// propagate into its mount namespace, and after a restart
+		// otherwise
+		if err := syscall.Mount(source, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("failed to bind mount %s: %v", source, err)
+		}
+		defer func() {
+			if err := syscall.Unmount(target, syscall.MNT_DETACH); err != nil {
+				logrus.Warnf("Failed to unmount %s: %v", target, err)
+			}
+		}()
+	case SyncCopy:
+		if err := SyncAll(source, target, options.Ignore); err != nil {
+			return fmt.Errorf("initial sync failed: %v", err)
+		}
+	}
+	logrus.Infof("Watching %s for changes to sync to %s:%s", source, ctr.Name, options.Target)
+
+	return watcher.Run(ctx, func(changes []Change) error {
+		report := SyncReport{Changes: changes, Action: options.Action}
+		if options.Mode == SyncCopy {
+			report.Err = SyncChanges(source, target, changes)
+		}
+		if report.Err == nil {
+			report.Err = applyAction(containers, ctr.ID, options)
+		}
+		if report.Err != nil {
+			logrus.Warnf("Sync to %s failed: %v", ctr.Name, report.Err)
+		}
+		if options.OnSync != nil {
+			options.OnSync(report)
+		}
+		return nil
+	})
+}
+
+func validateOptions(options *Options) error {
+	if options.Path == "" {
+		return fmt.Errorf("a path to watch is required")
+	}
+	if !filepath.IsAbs(options.Target) {
+		return fmt.Errorf("sync target %q must be an absolute path in the container", options.Target)
+	}
+	switch options.Mode {
+	case "":
+		options.Mode = SyncCopy
+	case SyncCopy, SyncBind:
+	default:
+		return fmt.Errorf("unknown sync mode %q (use %s or %s)", options.Mode, SyncCopy, SyncBind)
+	}
+	switch options.Action {
+	case "":
+		options.Action = ActionRestart
+	case ActionRestart, ActionReload, ActionNone:
+	default:
+		return fmt.Errorf("unknown action %q (use %s, %s or %s)", options.Action, ActionRestart, ActionReload, ActionNone)
+	}
+	if options.Action == ActionReload && options.Signal == 0 {
+		options.Signal = syscall.SIGHUP
+	}
+	return nil
+}
+
+func applyAction(containers *container.Manager, containerID string, options Options) error {
+	switch options.Action {
+	case ActionRestart:
+		return containers.RestartContainer(containerID, options.StopTimeout)
+	case ActionReload:
+		ctr, err := containers.GetContainer(containerID)
+		if err != nil {
+			return err
+		}
+		// Nothing to reload; start it so the change can be tried
+		if ctr.Status != types.StatusRunning {
+			return containers.StartContainer(containerID)
+		}
+		return containers.SignalContainer(containerID, options.Signal)
+	}
+	return nil
+}
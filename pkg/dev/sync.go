@@ -0,0 +1,133 @@
+package dev
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SyncAll copies the tree under src to dst, skipping ignored paths. It is
+// the first sync of a watch session.
+func SyncAll(src, dst string, ignore []string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if rel != "." && ignored(filepath.ToSlash(rel), ignore) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		return syncPath(path, filepath.Join(dst, rel), info)
+	})
+}
+
+// SyncChanges applies changes made under src to dst: created and modified
+// paths are copied and removed ones deleted.
+func SyncChanges(src, dst string, changes []Change) error {
+	for _, change := range changes {
+		rel := filepath.FromSlash(change.Path)
+		if rel == "" || strings.HasPrefix(filepath.Clean(rel), "..") || filepath.IsAbs(rel) {
+			return fmt.Errorf("invalid change path %q", change.Path)
+		}
+		target := filepath.Join(dst, rel)
+
+		if change.Removed {
+			if err := os.RemoveAll(target); err != nil {
+				return fmt.Errorf("failed to remove %s: %v", change.Path, err)
+			}
+			continue
+		}
+
+		info, err := os.Lstat(filepath.Join(src, rel))
+		if os.IsNotExist(err) {
+			// Removed again since the change was seen
+			os.RemoveAll(target)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to sync %s: %v", change.Path, err)
+		}
+		if err := syncPath(filepath.Join(src, rel), target, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncPath copies one file, symlink or directory entry. Files are written
+// next to the target and renamed over it, so the container never reads a
+// partially written file.
+func syncPath(src, dst string, info os.FileInfo) error {
+	switch {
+	case info.IsDir():
+		if existing, err := os.Lstat(dst); err == nil && !existing.IsDir() {
+			os.Remove(dst)
+		}
+		if err := os.MkdirAll(dst, info.Mode().Perm()); err != nil {
+			return fmt.Errorf("failed to create directory %s: %v", dst, err)
+		}
+		return os.Chmod(dst, info.Mode().Perm())
+
+	case info.Mode()&os.ModeSymlink != 0:
+		link, err := os.Readlink(src)
+		if err != nil {
+			return fmt.Errorf("failed to read symlink %s: %v", src, err)
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		os.RemoveAll(dst)
+		return os.Symlink(link, dst)
+
+	case info.Mode().IsRegular():
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		return copyFileAtomic(src, dst, info.Mode().Perm())
+
+	default:
+		// Sockets, pipes and devices have no place in a source tree
+		return nil
+	}
+}
+
+func copyFileAtomic(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", src, err)
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".sync-")
+	if err != nil {
+		return fmt.Errorf("failed to create file in %s: %v", filepath.Dir(dst), err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to copy %s: %v", src, err)
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if existing, err := os.Lstat(dst); err == nil && existing.IsDir() {
+		os.RemoveAll(dst)
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return fmt.Errorf("failed to replace %s: %v", dst, err)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+// Package dev implements the developer inner loop: watching a source
+// directory and syncing its changes into a container, which is then
+// restarted or reloaded.
+package dev
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Change is a path, relative to the watched directory and slash
+// separated, that was created, modified or removed.
+type Change struct {
+	Path    string
+	Removed bool
+}
+
+type fileState struct {
+	mode    os.FileMode
+	size    int64
+	modTime int64
+	link    string
+}
+
+// Watcher polls a directory tree for changes. Polling works on every
+// filesystem, including network shares and bind mounts from VMs where
+// inotify events never arrive.
+type Watcher struct {
+	root     string
+	ignore   []string
+	interval time.Duration
+	debounce time.Duration
+	state    map[string]fileState
+}
+
+// NewWatcher records the current state of root; later polls report what
+// changed since. Paths whose base name or relative path match one of the
+// ignore patterns are left out, and so is everything under ignored
+// directories.
+func NewWatcher(root string, ignore []string, interval, debounce time.Duration) (*Watcher, error) {
+	if interval <= 0 {
+		interval = 500 * time.Millisecond
+	}
+	w := &Watcher{
+		root:     root,
+		ignore:   ignore,
+		interval: interval,
+		debounce: debounce,
+	}
+	state, err := w.scan()
+	if err != nil {
+		return nil, err
+	}
+	w.state = state
+	return w, nil
+}
+
+// Ignored reports whether a relative path is excluded from watching.
+func (w *Watcher) Ignored(rel string) bool {
+	return ignored(rel, w.ignore)
+}
+
+func ignored(rel string, patterns []string) bool {
+	base := filepath.Base(rel)
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, base); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, rel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *Watcher) scan() (map[string]fileState, error) {
+	state := make(map[string]fileState)
+	err := filepath.Walk(w.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Files removed while walking are picked up by the next poll
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(w.root, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if w.Ignored(rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		fs := fileState{mode: info.Mode(), size: info.Size(), modTime: info.ModTime().UnixNano()}
+		if info.IsDir() {
+			// Directory times change with their entries, which are
+			// reported on their own
+			fs.size, fs.modTime = 0, 0
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			fs.link, _ = os.Readlink(path)
+		}
+		state[rel] = fs
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan %s: %v", w.root, err)
+	}
+	return state, nil
+}
+
+// Poll rescans the tree and returns what changed since the last poll,
+// sorted by path.
+func (w *Watcher) Poll() ([]Change, error) {
+	state, err := w.scan()
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []Change
+	for path, current := range state {
+		if previous, ok := w.state[path]; !ok || previous != current {
+			changes = append(changes, Change{Path: path})
+		}
+	}
+	for path := range w.state {
+		if _, ok := state[path]; !ok {
+			changes = append(changes, Change{Path: path, Removed: true})
+		}
+	}
+	w.state = state
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, nil
+}
+
+// Run polls until ctx is done and calls onChange with each batch of
+// changes. A batch is delivered once the tree has been quiet for the
+// debounce period, so saving many files at once triggers one sync.
+func (w *Watcher) Run(ctx context.Context, onChange func([]Change) error) error {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	pending := make(map[string]Change)
+	var lastChange time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			changes, err := w.Poll()
+			if err != nil {
+				return err
+			}
+			for _, change := range changes {
+				pending[change.Path] = change
+			}
+			if len(changes) > 0 {
+				lastChange = now
+			}
+
+			if len(pending) == 0 || now.Sub(lastChange) < w.debounce {
+				continue
+			}
+			batch := make([]Change, 0, len(pending))
+			for _, change := range pending {
+				batch = append(batch, change)
+			}
+			sort.Slice(batch, func(i, j int) bool { return batch[i].Path < batch[j].Path })
+			pending = make(map[string]Change)
+
+			if err := onChange(batch); err != nil {
+				return err
+			}
+		}
+	}
+}
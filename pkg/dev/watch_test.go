@@ -0,0 +1,126 @@
+package dev
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+}
+
+func TestWatcherPoll(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "main.go"), "package main")
+	writeFile(t, filepath.Join(root, "lib/util.go"), "package lib")
+	writeFile(t, filepath.Join(root, "old.txt"), "old")
+	writeFile(t, filepath.Join(root, ".git/HEAD"), "ref: refs/heads/main")
+
+	watcher, err := NewWatcher(root, []string{".git", "*.swp"}, 0, 0)
+	require.NoError(t, err)
+
+	changes, err := watcher.Poll()
+	require.NoError(t, err)
+	assert.Empty(t, changes, "Nothing changed since the watcher was created")
+
+	writeFile(t, filepath.Join(root, "main.go"), "package main // edited")
+	writeFile(t, filepath.Join(root, "lib/new.go"), "package lib")
+	writeFile(t, filepath.Join(root, ".main.go.swp"), "swap")
+	writeFile(t, filepath.Join(root, ".git/HEAD"), "ref: refs/heads/feature")
+	require.NoError(t, os.Remove(filepath.Join(root, "old.txt")))
+
+	changes, err = watcher.Poll()
+	require.NoError(t, err)
+	assert.Equal(t, []Change{
+		{Path: "lib/new.go"},
+		{Path: "main.go"},
+		{Path: "old.txt", Removed: true},
+	}, changes)
+
+	changes, err = watcher.Poll()
+	require.NoError(t, err)
+	assert.Empty(t, changes, "Changes should only be reported once")
+}
+
+func TestWatcherRunDebounces(t *testing.T) {
+	root := t.TempDir()
+	watcher, err := NewWatcher(root, nil, 10*time.Millisecond, 150*time.Millisecond)
+	require.NoError(t, err)
+
+	var mu sync.Mutex
+	var batches [][]Change
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- watcher.Run(ctx, func(changes []Change) error {
+			mu.Lock()
+			batches = append(batches, changes)
+			mu.Unlock()
+			return nil
+		})
+	}()
+
+	for _, name := range []string{"a.go", "b.go", "c.go"} {
+		writeFile(t, filepath.Join(root, name), name)
+		time.Sleep(30 * time.Millisecond)
+	}
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(batches) > 0
+	}, 2*time.Second, 10*time.Millisecond)
+	cancel()
+	require.NoError(t, <-done)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, batches, 1, "Changes in quick succession should be synced together")
+	assert.Equal(t, []Change{{Path: "a.go"}, {Path: "b.go"}, {Path: "c.go"}}, batches[0])
+}
+
+func TestSync(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(src, "app.py"), "print('v1')")
+	writeFile(t, filepath.Join(src, "static/style.css"), "body {}")
+	writeFile(t, filepath.Join(src, "node_modules/pkg/index.js"), "module.exports = {}")
+	require.NoError(t, os.Symlink("app.py", filepath.Join(src, "main.py")))
+
+	require.NoError(t, SyncAll(src, dst, []string{"node_modules"}))
+	data, err := os.ReadFile(filepath.Join(dst, "static/style.css"))
+	require.NoError(t, err)
+	assert.Equal(t, "body {}", string(data))
+	link, err := os.Readlink(filepath.Join(dst, "main.py"))
+	require.NoError(t, err)
+	assert.Equal(t, "app.py", link)
+	_, err = os.Stat(filepath.Join(dst, "node_modules"))
+	assert.True(t, os.IsNotExist(err), "Ignored paths should not be synced")
+
+	writeFile(t, filepath.Join(src, "app.py"), "print('v2')")
+	require.NoError(t, os.RemoveAll(filepath.Join(src, "static")))
+	require.NoError(t, os.Chmod(filepath.Join(src, "app.py"), 0755))
+	require.NoError(t, SyncChanges(src, dst, []Change{
+		{Path: "app.py"},
+		{Path: "static", Removed: true},
+		{Path: "static/style.css", Removed: true},
+		{Path: "gone.txt"},
+	}))
+
+	data, err = os.ReadFile(filepath.Join(dst, "app.py"))
+	require.NoError(t, err)
+	assert.Equal(t, "print('v2')", string(data))
+	info, err := os.Stat(filepath.Join(dst, "app.py"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+	_, err = os.Stat(filepath.Join(dst, "static"))
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Error(t, SyncChanges(src, dst, []Change{{Path: "../escape"}}))
+}
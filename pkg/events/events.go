@@ -0,0 +1,144 @@
+package events
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	TypeContainer = "container"
+	TypeImage     = "image"
+	TypeNetwork   = "network"
+	TypeNode      = "node"
+)
+
+// historySize is how many recent events a bus keeps for subscribers that
+// resume where they left off.
+const historySize = 1024
+
+type Event struct {
+	// Seq numbers the events of a bus in the order they were published
+	Seq        uint64            `json:"seq,omitempty"`
+	Type       string            `json:"type"`
+	Action     string            `json:"action"`
+	ID         string            `json:"id"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Time       time.Time         `json:"time"`
+}
+
+// Bus fans events out to subscribers. Slow subscribers drop events rather
+// than block publishers; the recent ones can be read again from the
+// history with SubscribeSince.
+type Bus struct {
+	subscribers map[int]chan Event
+	nextID      int
+	seq         uint64
+	history     []Event
+	mu          sync.RWMutex
+}
+
+var (
+	defaultBus *Bus
+	once       sync.Once
+)
+
+func GetEventBus() *Bus {
+	once.Do(func() {
+		defaultBus = NewBus()
+	})
+	return defaultBus
+}
+
+func NewBus() *Bus {
+	return &Bus{
+		subscribers: make(map[int]chan Event),
+	}
+}
+
+func (b *Bus) Publish(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq++
+	event.Seq = b.seq
+	b.history = append(b.history, event)
+	if len(b.history) > historySize {
+		b.history = b.history[len(b.history)-historySize:]
+	}
+
+	for _, ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel of events and a function that cancels the
+// subscription and closes the channel.
+func (b *Bus) Subscribe() (<-chan Event, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.subscribe()
+}
+
+// SubscribeSince subscribes like Subscribe, and also returns the events
+// in the history published after seq, so a subscriber that reconnects
+// misses none in between. Events older than the history are gone; a gap
+// in the sequence numbers shows it.
+func (b *Bus) SubscribeSince(seq uint64) ([]Event, <-chan Event, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch, cancel := b.subscribe()
+	return b.since(seq), ch, cancel
+}
+
+// History returns the events in the history published after seq, e.g.
+// those a slow subscriber dropped.
+func (b *Bus) History(seq uint64) []Event {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.since(seq)
+}
+
+// LastSeq returns the sequence number of the last event published.
+func (b *Bus) LastSeq() uint64 {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.seq
+}
+
+// since must be called with mu held.
+func (b *Bus) since(seq uint64) []Event {
+	i := sort.Search(len(b.history), func(i int) bool { return b.history[i].Seq > seq })
+	return append([]Event(nil), b.history[i:]...)
+}
+
+// subscribe must be called with mu held.
+func (b *Bus) subscribe() (<-chan Event, func()) {
+	id := b.nextID
+	b.nextID++
+	ch := make(chan Event, 64)
+	b.subscribers[id] = ch
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		if sub, ok := b.subscribers[id]; ok {
+			delete(b.subscribers, id)
+			close(sub)
+		}
+	}
+}
+
+func Publish(event Event) {
+	GetEventBus().Publish(event)
+}
@@ -0,0 +1,89 @@
+// Package ids generates random identifiers and join tokens.
+package ids
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	// idBytes of randomness gives 128 bits for prefixed IDs
+	idBytes       = 16
+	checksumChars = 4
+	shortIDLength = 12
+)
+
+// encoding is lowercase base32 without padding, so IDs stay readable and
+// safe to use in file names and URLs.
+var encoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// GenerateID returns a random 64 character hex ID, the format used for
+// containers and images. The short form is never all digits so that it
+// can't be mistaken for a number.
+func GenerateID() string {
+	for {
+		b := randomBytes(32)
+		id := hex.EncodeToString(b)
+		if _, err := strconv.ParseUint(id[:shortIDLength], 10, 64); err == nil {
+			continue
+		}
+		return id
+	}
+}
+
+// NewID returns "<prefix>-<random><checksum>". The checksum lets
+// ValidateID reject mistyped or truncated IDs.
+func NewID(prefix string) string {
+	body := encoding.EncodeToString(randomBytes(idBytes))
+	return prefix + "-" + body + checksum(prefix, body)
+}
+
+// ValidateID checks that id was produced by NewID with the given prefix.
+func ValidateID(prefix, id string) error {
+	if !strings.HasPrefix(id, prefix+"-") {
+		return fmt.Errorf("invalid %s ID: %s", prefix, id)
+	}
+
+	rest := strings.TrimPrefix(id, prefix+"-")
+	if len(rest) != encoding.EncodedLen(idBytes)+checksumChars {
+		return fmt.Errorf("invalid %s ID length: %s", prefix, id)
+	}
+
+	body, sum := rest[:len(rest)-checksumChars], rest[len(rest)-checksumChars:]
+	if checksum(prefix, body) != sum {
+		return fmt.Errorf("invalid %s ID checksum: %s", prefix, id)
+	}
+	return nil
+}
+
+// TruncateID returns the short form of an ID.
+func TruncateID(id string) string {
+	if i := strings.IndexByte(id, ':'); i >= 0 {
+		id = id[i+1:]
+	}
+	if len(id) > shortIDLength {
+		id = id[:shortIDLength]
+	}
+	return id
+}
+
+func checksum(prefix, body string) string {
+	sum := sha256.Sum256([]byte(prefix + "-" + body))
+	return encoding.EncodeToString(sum[:])[:checksumChars]
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		// crypto/rand only fails if the kernel can't provide entropy,
+		// and nothing sensible can be done without it
+		panic(fmt.Sprintf("failed to read random bytes: %v", err))
+	}
+	return b
+}
@@ -0,0 +1,102 @@
+package ids
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateID(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id := GenerateID()
+		assert.Len(t, id, 64)
+		assert.False(t, seen[id], "IDs should not repeat")
+		seen[id] = true
+	}
+
+	assert.Equal(t, "0123456789ab", TruncateID("sha256:0123456789abcdef"))
+}
+
+func TestNewIDChecksum(t *testing.T) {
+	id := NewID("node")
+	assert.True(t, strings.HasPrefix(id, "node-"))
+	require.NoError(t, ValidateID("node", id))
+
+	assert.Error(t, ValidateID("task", id), "Prefix mismatch should be rejected")
+	assert.Error(t, ValidateID("node", id[:len(id)-1]), "Truncated ID should be rejected")
+
+	corrupted := []byte(id)
+	if corrupted[6] == 'a' {
+		corrupted[6] = 'b'
+	} else {
+		corrupted[6] = 'a'
+	}
+	assert.Error(t, ValidateID("node", string(corrupted)), "Checksum should catch a changed character")
+}
+
+func TestJoinToken(t *testing.T) {
+	secret := GenerateSecret()
+	now := time.Now()
+	token := NewJoinToken(secret, "cluster-a", "worker", time.Time{})
+
+	role, err := VerifyJoinToken(secret, "cluster-a", token, now)
+	require.NoError(t, err)
+	assert.Equal(t, "worker", role)
+
+	role, err = JoinTokenRole(token)
+	require.NoError(t, err)
+	assert.Equal(t, "worker", role)
+
+	_, err = VerifyJoinToken(GenerateSecret(), "cluster-a", token, now)
+	assert.Error(t, err, "Token signed with another secret should be rejected")
+
+	_, err = VerifyJoinToken(secret, "cluster-b", token, now)
+	assert.Error(t, err, "Token issued for another cluster should be rejected")
+
+	forged := strings.Replace(token, "-worker-", "-manager-", 1)
+	_, err = VerifyJoinToken(secret, "cluster-a", forged, now)
+	assert.Error(t, err, "Changing the role should invalidate the signature")
+
+	_, err = VerifyJoinToken(secret, "cluster-a", "SWMTKN-1-abc", now)
+	assert.Error(t, err)
+}
+
+func TestJoinTokenExpiry(t *testing.T) {
+	secret := GenerateSecret()
+	now := time.Now()
+	token := NewJoinToken(secret, "cluster-a", "manager", now.Add(time.Hour))
+
+	_, err := VerifyJoinToken(secret, "cluster-a", token, now)
+	require.NoError(t, err)
+
+	_, err = VerifyJoinToken(secret, "cluster-a", token, now.Add(2*time.Hour))
+	assert.Error(t, err, "Expired token should be rejected")
+
+	parts := strings.Split(token, "-")
+	parts[3] = "0"
+	_, err = VerifyJoinToken(secret, "cluster-a", strings.Join(parts, "-"), now.Add(2*time.Hour))
+	assert.Error(t, err, "Removing the expiry should invalidate the signature")
+}
+
+func TestNodeToken(t *testing.T) {
+	secret := GenerateSecret()
+	token := NewNodeToken(secret, "node-a1")
+
+	nodeID, err := VerifyNodeToken(secret, token)
+	require.NoError(t, err)
+	assert.Equal(t, "node-a1", nodeID)
+
+	_, err = VerifyNodeToken(GenerateSecret(), token)
+	assert.Error(t, err, "Token signed with another secret should be rejected")
+
+	forged := strings.TrimSuffix(token, "a1") + "b2"
+	_, err = VerifyNodeToken(secret, forged)
+	assert.Error(t, err, "Changing the node should invalidate the signature")
+
+	_, err = VerifyNodeToken(secret, NewJoinToken(secret, "cluster-a", "worker", time.Time{}))
+	assert.Error(t, err, "Join tokens aren't node tokens")
+}
@@ -0,0 +1,126 @@
+package ids
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	TokenPrefix     = "SWMTKN"
+	NodeTokenPrefix = "SWMNODE"
+	tokenVersion    = "2"
+	secretBytes     = 32
+	nonceBytes      = 16
+	macBytes        = 16
+)
+
+// GenerateSecret returns a new key for signing join tokens.
+func GenerateSecret() []byte {
+	return randomBytes(secretBytes)
+}
+
+// NewClusterToken returns a random token for the nodes of a cluster to
+// present to each other.
+func NewClusterToken() string {
+	return encoding.EncodeToString(randomBytes(secretBytes))
+}
+
+// NewJoinToken returns "SWMTKN-2-<role>-<expiry>-<nonce>-<mac>", where
+// expiry is the Unix time the token lapses at in hex, 0 for never, and
+// mac is an HMAC-SHA256 over the version, cluster ID, role, expiry and
+// nonce keyed by secret. Anyone holding the secret can verify a token
+// without keeping a list of them, a token is only good for the cluster
+// it was issued for, and replacing the secret revokes every token issued
+// with it.
+func NewJoinToken(secret []byte, clusterID, role string, expiresAt time.Time) string {
+	expiry := "0"
+	if !expiresAt.IsZero() {
+		expiry = strconv.FormatInt(expiresAt.Unix(), 16)
+	}
+	nonce := encoding.EncodeToString(randomBytes(nonceBytes))
+	return strings.Join([]string{TokenPrefix, tokenVersion, role, expiry, nonce, tokenMAC(secret, clusterID, role, expiry, nonce)}, "-")
+}
+
+// JoinTokenRole returns the role a token claims to grant, without
+// verifying it.
+func JoinTokenRole(token string) (string, error) {
+	parts, err := splitJoinToken(token)
+	if err != nil {
+		return "", err
+	}
+	return parts[2], nil
+}
+
+// VerifyJoinToken checks the token's signature for the cluster and that
+// it hasn't expired by now, and returns the role it grants.
+func VerifyJoinToken(secret []byte, clusterID, token string, now time.Time) (string, error) {
+	parts, err := splitJoinToken(token)
+	if err != nil {
+		return "", err
+	}
+
+	role, expiry, nonce, mac := parts[2], parts[3], parts[4], parts[5]
+	if !hmac.Equal([]byte(mac), []byte(tokenMAC(secret, clusterID, role, expiry, nonce))) {
+		return "", fmt.Errorf("invalid join token")
+	}
+	expiresAt, err := strconv.ParseInt(expiry, 16, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid join token expiry")
+	}
+	if expiresAt != 0 && now.Unix() >= expiresAt {
+		return "", fmt.Errorf("join token expired at %s", time.Unix(expiresAt, 0).UTC().Format(time.RFC3339))
+	}
+	return role, nil
+}
+
+// NewNodeToken returns "SWMNODE-<mac>-<nodeID>", where mac is an
+// HMAC-SHA256 over the node ID keyed by secret. It tells a manager which
+// node presents it without the manager keeping a list of them.
+func NewNodeToken(secret []byte, nodeID string) string {
+	return strings.Join([]string{NodeTokenPrefix, nodeTokenMAC(secret, nodeID), nodeID}, "-")
+}
+
+// VerifyNodeToken checks the token's signature and returns the node it
+// was issued to.
+func VerifyNodeToken(secret []byte, token string) (string, error) {
+	parts := strings.SplitN(token, "-", 3)
+	if len(parts) != 3 || parts[0] != NodeTokenPrefix || parts[2] == "" {
+		return "", fmt.Errorf("invalid node token format")
+	}
+	mac, nodeID := parts[1], parts[2]
+	if !hmac.Equal([]byte(mac), []byte(nodeTokenMAC(secret, nodeID))) {
+		return "", fmt.Errorf("invalid node token")
+	}
+	return nodeID, nil
+}
+
+func splitJoinToken(token string) ([]string, error) {
+	parts := strings.Split(token, "-")
+	if len(parts) < 2 || parts[0] != TokenPrefix {
+		return nil, fmt.Errorf("invalid join token format")
+	}
+	if parts[1] != tokenVersion {
+		return nil, fmt.Errorf("unsupported join token version: %s", parts[1])
+	}
+	if len(parts) != 6 {
+		return nil, fmt.Errorf("invalid join token format")
+	}
+	return parts, nil
+}
+
+func tokenMAC(secret []byte, clusterID, role, expiry, nonce string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(tokenVersion + ":" + clusterID + ":" + role + ":" + expiry + ":" + nonce))
+	return hex.EncodeToString(mac.Sum(nil)[:macBytes])
+}
+
+func nodeTokenMAC(secret []byte, nodeID string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("node:" + nodeID))
+	return hex.EncodeToString(mac.Sum(nil)[:macBytes])
+}
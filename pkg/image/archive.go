@@ -0,0 +1,649 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"docker-impl/pkg/types"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	ArchiveFormatDocker = "docker-archive"
+	ArchiveFormatOCI    = "oci"
+
+	ociLayoutFile      = "oci-layout"
+	ociIndexFile       = "index.json"
+	dockerManifestFile = "manifest.json"
+
+	annotationRefName   = "org.opencontainers.image.ref.name"
+	annotationImageName = "io.containerd.image.name"
+)
+
+// archiveManifestEntry is one image in a docker-archive manifest.json.
+type archiveManifestEntry struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// archiveSink receives the files that make up an archive: entries of a tar
+// stream, or files in an OCI layout directory.
+type archiveSink interface {
+	writeFile(name string, size int64, r io.Reader) error
+}
+
+type tarSink struct {
+	tw *tar.Writer
+}
+
+func (s *tarSink) writeFile(name string, size int64, r io.Reader) error {
+	hdr := &tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	}
+	if err := s.tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("failed to write %s: %v", name, err)
+	}
+	if _, err := io.Copy(s.tw, r); err != nil {
+		return fmt.Errorf("failed to write %s: %v", name, err)
+	}
+	return nil
+}
+
+type dirSink struct {
+	root string
+}
+
+func (s *dirSink) writeFile(name string, size int64, r io.Reader) error {
+	path := filepath.Join(s.root, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %v", name, err)
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", name, err)
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(file, r); err != nil {
+		return fmt.Errorf("failed to write %s: %v", name, err)
+	}
+	return nil
+}
+
+// SaveImages writes images to w as a tarball in the given format.
+func (m *Manager) SaveImages(images []*types.Image, format string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	if err := m.exportImages(images, format, &tarSink{tw: tw}); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to finish archive: %v", err)
+	}
+	return nil
+}
+
+// SaveImagesToDir writes images as an OCI image layout directory.
+func (m *Manager) SaveImagesToDir(images []*types.Image, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %v", dir, err)
+	}
+	return m.exportImages(images, ArchiveFormatOCI, &dirSink{root: dir})
+}
+
+func (m *Manager) exportImages(images []*types.Image, format string, sink archiveSink) error {
+	if format != ArchiveFormatDocker && format != ArchiveFormatOCI {
+		return fmt.Errorf("unsupported archive format: %s", format)
+	}
+	if len(images) == 0 {
+		return fmt.Errorf("no images to save")
+	}
+
+	spoolDir, err := m.tempDir("save-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(spoolDir)
+
+	// Layers shared between images are written once
+	written := make(map[string]Descriptor)
+	blobs := make(map[string]bool)
+	var manifest []archiveManifestEntry
+	index := ManifestList{SchemaVersion: 2, MediaType: MediaTypeOCIIndex}
+
+	for _, image := range images {
+		var layers []Descriptor
+		var diffIDs, layerPaths []string
+
+		for _, layerID := range image.Layers {
+			desc, ok := written[layerID]
+			if !ok {
+				digest, size, err := m.exportLayer(layerID, spoolDir, format, sink, blobs)
+				if err != nil {
+					return err
+				}
+				desc = Descriptor{MediaType: MediaTypeOCILayer, Digest: digest, Size: size}
+				written[layerID] = desc
+			}
+
+			diffIDs = append(diffIDs, desc.Digest)
+			layerPaths = append(layerPaths, strings.TrimPrefix(desc.Digest, "sha256:")+"/layer.tar")
+			layers = append(layers, desc)
+		}
+
+		configData, err := json.Marshal(newImageConfigBlob(image, diffIDs))
+		if err != nil {
+			return fmt.Errorf("failed to marshal image config: %v", err)
+		}
+		configDigest := digestBytes(configData)
+		configHex := strings.TrimPrefix(configDigest, "sha256:")
+
+		ref := imageReference(image)
+		if format == ArchiveFormatDocker {
+			if err := writeBytes(sink, configHex+".json", configData); err != nil {
+				return err
+			}
+			entry := archiveManifestEntry{Config: configHex + ".json", Layers: layerPaths}
+			if ref != "" {
+				entry.RepoTags = []string{ref}
+			}
+			manifest = append(manifest, entry)
+			continue
+		}
+
+		if err := writeBytes(sink, blobPath(configDigest), configData); err != nil {
+			return err
+		}
+		imageManifest := Manifest{
+			SchemaVersion: 2,
+			MediaType:     MediaTypeOCIManifest,
+			Config:        Descriptor{MediaType: MediaTypeOCIConfig, Digest: configDigest, Size: int64(len(configData))},
+			Layers:        layers,
+		}
+		manifestData, err := json.Marshal(imageManifest)
+		if err != nil {
+			return fmt.Errorf("failed to marshal image manifest: %v", err)
+		}
+		manifestDigest := digestBytes(manifestData)
+		if err := writeBytes(sink, blobPath(manifestDigest), manifestData); err != nil {
+			return err
+		}
+
+		desc := Descriptor{MediaType: MediaTypeOCIManifest, Digest: manifestDigest, Size: int64(len(manifestData))}
+		platform := image.Platform
+		if platform.OS != "" {
+			desc.Platform = &platform
+		}
+		if ref != "" {
+			desc.Annotations = map[string]string{
+				annotationImageName: ref,
+				annotationRefName:   image.Tag,
+			}
+		}
+		index.Manifests = append(index.Manifests, desc)
+	}
+
+	if format == ArchiveFormatDocker {
+		data, err := json.Marshal(manifest)
+		if err != nil {
+			return fmt.Errorf("failed to marshal archive manifest: %v", err)
+		}
+		return writeBytes(sink, dockerManifestFile, data)
+	}
+
+	if err := writeBytes(sink, ociLayoutFile, []byte(`{"imageLayoutVersion":"1.0.0"}`)); err != nil {
+		return err
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		return fmt.Errorf("failed to marshal image index: %v", err)
+	}
+	return writeBytes(sink, ociIndexFile, data)
+}
+
+// exportLayer writes a layer's tar to the sink and returns its digest. The
+// tar is spooled to disk first because both formats need the digest (and
+// tar entries the size) before the content can be written. Layers whose
+// digest is already in blobs are not written again.
+func (m *Manager) exportLayer(layerID, spoolDir, format string, sink archiveSink, blobs map[string]bool) (string, int64, error) {
+	spool, err := os.CreateTemp(spoolDir, "layer-")
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create layer spool file: %v", err)
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	layerDir := ""
+	if m.LayerExists(layerID) {
+		layerDir = m.GetLayerDir(layerID)
+	} else {
+		logrus.Warnf("Layer %s has no content on disk, saving it as an empty layer", layerID)
+	}
+
+	hash := sha256.New()
+	if err := writeLayerTar(io.MultiWriter(spool, hash), layerDir); err != nil {
+		return "", 0, fmt.Errorf("failed to archive layer %s: %v", layerID, err)
+	}
+	digest := "sha256:" + hex.EncodeToString(hash.Sum(nil))
+
+	size, err := spool.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to read layer spool file: %v", err)
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return "", 0, fmt.Errorf("failed to read layer spool file: %v", err)
+	}
+
+	if blobs[digest] {
+		return digest, size, nil
+	}
+	blobs[digest] = true
+
+	name := strings.TrimPrefix(digest, "sha256:") + "/layer.tar"
+	if format == ArchiveFormatOCI {
+		name = blobPath(digest)
+	}
+	if err := sink.writeFile(name, size, spool); err != nil {
+		return "", 0, err
+	}
+
+	return digest, size, nil
+}
+
+// writeLayerTar archives a layer directory. Whiteout files are stored as
+// they are on disk, which matches the convention used in image tarballs.
+// An empty layerDir produces an empty archive.
+func writeLayerTar(w io.Writer, layerDir string) error {
+	tw := tar.NewWriter(w)
+	if layerDir == "" {
+		return tw.Close()
+	}
+
+	err := filepath.Walk(layerDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(layerDir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.Uname, hdr.Gname = "", ""
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(tw, file)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// LoadImages reads a docker-archive or OCI layout tarball. The archive is
+// unpacked to a scratch directory entry by entry, so layers are never held
+// in memory.
+func (m *Manager) LoadImages(r io.Reader) ([]*types.Image, error) {
+	stageDir, err := m.tempDir("load-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(stageDir)
+
+	if _, err := extractArchiveStream(r, "image archive", stageDir); err != nil {
+		return nil, err
+	}
+
+	return m.LoadImagesFromDir(stageDir)
+}
+
+// LoadImagesFromDir loads images from an OCI layout directory or an
+// unpacked docker-archive.
+func (m *Manager) LoadImagesFromDir(dir string) ([]*types.Image, error) {
+	if _, err := os.Stat(filepath.Join(dir, ociLayoutFile)); err == nil {
+		return m.loadOCILayout(dir)
+	}
+	if _, err := os.Stat(filepath.Join(dir, dockerManifestFile)); err == nil {
+		return m.loadDockerArchive(dir)
+	}
+	return nil, fmt.Errorf("%s is neither an OCI image layout nor a docker archive", dir)
+}
+
+func (m *Manager) loadDockerArchive(dir string) ([]*types.Image, error) {
+	var manifest []archiveManifestEntry
+	if err := readJSONFile(dir, dockerManifestFile, &manifest); err != nil {
+		return nil, err
+	}
+
+	var loaded []*types.Image
+	for _, entry := range manifest {
+		var blob imageConfigBlob
+		if err := readJSONFile(dir, entry.Config, &blob); err != nil {
+			return nil, err
+		}
+		if len(blob.RootFS.DiffIDs) > 0 && len(blob.RootFS.DiffIDs) != len(entry.Layers) {
+			return nil, fmt.Errorf("image config lists %d layers but the archive has %d", len(blob.RootFS.DiffIDs), len(entry.Layers))
+		}
+
+		var layers []string
+		var sizes []int64
+		for i, layerPath := range entry.Layers {
+			expected := ""
+			if len(blob.RootFS.DiffIDs) > 0 {
+				expected = blob.RootFS.DiffIDs[i]
+			}
+			layerID, layerSize, err := m.importLayer(dir, layerPath, expected)
+			if err != nil {
+				return nil, err
+			}
+			layers = append(layers, layerID)
+			sizes = append(sizes, layerSize)
+		}
+
+		configPath, err := archivePath(dir, entry.Config)
+		if err != nil {
+			return nil, err
+		}
+		configDigest, err := digestFile(configPath)
+		if err != nil {
+			return nil, err
+		}
+
+		images, err := m.registerLoadedImage(&blob, configDigest, entry.RepoTags, layers, sizes, "")
+		if err != nil {
+			return nil, err
+		}
+		loaded = append(loaded, images...)
+	}
+
+	return loaded, nil
+}
+
+func (m *Manager) loadOCILayout(dir string) ([]*types.Image, error) {
+	var index ManifestList
+	if err := readJSONFile(dir, ociIndexFile, &index); err != nil {
+		return nil, err
+	}
+
+	var loaded []*types.Image
+	for _, desc := range index.Manifests {
+		if desc.MediaType != MediaTypeOCIManifest && desc.MediaType != MediaTypeDockerManifest {
+			logrus.Warnf("Skipping %s entry %s in OCI index", desc.MediaType, desc.Digest)
+			continue
+		}
+
+		if err := verifyBlob(dir, desc.Digest); err != nil {
+			return nil, err
+		}
+		var manifest Manifest
+		if err := readJSONFile(dir, blobPath(desc.Digest), &manifest); err != nil {
+			return nil, err
+		}
+
+		if err := verifyBlob(dir, manifest.Config.Digest); err != nil {
+			return nil, err
+		}
+		var blob imageConfigBlob
+		if err := readJSONFile(dir, blobPath(manifest.Config.Digest), &blob); err != nil {
+			return nil, err
+		}
+
+		var layers []string
+		var sizes []int64
+		for _, layer := range manifest.Layers {
+			layerID, layerSize, err := m.importLayer(dir, blobPath(layer.Digest), layer.Digest)
+			if err != nil {
+				return nil, err
+			}
+			layers = append(layers, layerID)
+			sizes = append(sizes, layerSize)
+		}
+
+		var refs []string
+		if ref := ociReference(desc.Annotations); ref != "" {
+			refs = append(refs, ref)
+		}
+		images, err := m.registerLoadedImage(&blob, manifest.Config.Digest, refs, layers, sizes, desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		loaded = append(loaded, images...)
+	}
+
+	return loaded, nil
+}
+
+// importLayer unpacks a layer tar from the archive into the layer store,
+// checking it against the expected digest when one is given. The layer is
+// keyed by the digest of its tar, so loading the same layer twice is a
+// no-op.
+func (m *Manager) importLayer(dir, name, expected string) (string, int64, error) {
+	path, err := archivePath(dir, name)
+	if err != nil {
+		return "", 0, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", 0, fmt.Errorf("layer %s is missing from the archive: %v", name, err)
+	}
+
+	digest, err := digestFile(path)
+	if err != nil {
+		return "", 0, err
+	}
+	if expected != "" && digest != expected {
+		return "", 0, fmt.Errorf("layer %s has digest %s, expected %s", name, digest, expected)
+	}
+
+	layerID := strings.TrimPrefix(digest, "sha256:")
+	if m.LayerExists(layerID) {
+		return layerID, info.Size(), nil
+	}
+
+	layersDir := filepath.Join(m.store.GetDataDir(), LayersDir)
+	if err := os.MkdirAll(layersDir, 0755); err != nil {
+		return "", 0, fmt.Errorf("failed to create layers directory: %v", err)
+	}
+	tmpDir, err := os.MkdirTemp(layersDir, "tmp-")
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create layer directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if _, err := extractArchive(path, tmpDir); err != nil {
+		return "", 0, err
+	}
+	if err := os.Rename(tmpDir, m.GetLayerDir(layerID)); err != nil {
+		return "", 0, fmt.Errorf("failed to commit layer: %v", err)
+	}
+
+	logrus.Debugf("Loaded layer %s", layerID)
+	return layerID, info.Size(), nil
+}
+
+// registerLoadedImage stores a loaded image under the digest of its config
+// and returns it once per reference, or once as <none>:<none> when it has
+// none.
+func (m *Manager) registerLoadedImage(blob *imageConfigBlob, configDigest string, refs []string, layers []string, sizes []int64, digest string) ([]*types.Image, error) {
+	image := &types.Image{
+		CreatedAt: blob.Created,
+		Config:    blob.imageConfig(),
+		Labels:    blob.Config.Labels,
+		Layers:    layers,
+		History:   blob.imageHistory(layers, sizes),
+		Platform:  blob.platform(),
+		Digest:    digest,
+	}
+	if image.CreatedAt.IsZero() {
+		image.CreatedAt = time.Now()
+	}
+	for _, size := range sizes {
+		image.Size += size
+	}
+
+	var tags []string
+	for _, ref := range refs {
+		tag, err := normalizeTag(ref)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+
+	image, err := m.registerImage(image, configDigest, tags, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create image during load: %v", err)
+	}
+
+	loaded := []*types.Image{image}
+	for _, tag := range tags[min(1, len(tags)):] {
+		tagged := *image
+		tagged.Name, tagged.Tag = parseNameTag(tag)
+		loaded = append(loaded, &tagged)
+	}
+
+	logrus.Infof("Loaded image %s:%s (%s)", image.Name, image.Tag, image.ID[:12])
+	return loaded, nil
+}
+
+func (m *Manager) tempDir(pattern string) (string, error) {
+	tmpRoot := filepath.Join(m.store.GetDataDir(), "tmp")
+	if err := os.MkdirAll(tmpRoot, 0755); err != nil {
+		return "", fmt.Errorf("failed to create temporary directory: %v", err)
+	}
+	dir, err := os.MkdirTemp(tmpRoot, pattern)
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary directory: %v", err)
+	}
+	return dir, nil
+}
+
+func imageReference(image *types.Image) string {
+	if image.Name == "" || image.Name == "<none>" {
+		return ""
+	}
+	tag := image.Tag
+	if tag == "" || tag == "<none>" {
+		tag = "latest"
+	}
+	return image.Name + ":" + tag
+}
+
+// ociReference reads the image name from index annotations. The standard
+// ref.name annotation often holds only a tag, which on its own can't name
+// an image.
+func ociReference(annotations map[string]string) string {
+	if name := annotations[annotationImageName]; name != "" {
+		return name
+	}
+	if ref := annotations[annotationRefName]; strings.ContainsAny(ref, ":/") {
+		return ref
+	}
+	return ""
+}
+
+func blobPath(digest string) string {
+	algorithm, hexDigest, ok := strings.Cut(digest, ":")
+	if !ok {
+		return filepath.ToSlash(filepath.Join("blobs", "sha256", digest))
+	}
+	return "blobs/" + algorithm + "/" + hexDigest
+}
+
+// archivePath resolves a path named inside an archive, refusing anything
+// that would escape the archive root.
+func archivePath(root, name string) (string, error) {
+	path := filepath.Join(root, filepath.FromSlash(name))
+	if rel, err := filepath.Rel(root, path); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid path in archive: %s", name)
+	}
+	return path, nil
+}
+
+func readJSONFile(root, name string, v interface{}) error {
+	path, err := archivePath(root, name)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s from archive: %v", name, err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", name, err)
+	}
+	return nil
+}
+
+func verifyBlob(root, digest string) error {
+	path, err := archivePath(root, blobPath(digest))
+	if err != nil {
+		return err
+	}
+	actual, err := digestFile(path)
+	if err != nil {
+		return err
+	}
+	if actual != digest {
+		return fmt.Errorf("blob %s has digest %s", digest, actual)
+	}
+	return nil
+}
+
+func writeBytes(sink archiveSink, name string, data []byte) error {
+	return sink.writeFile(name, int64(len(data)), bytes.NewReader(data))
+}
+
+func digestBytes(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func digestFile(path string) (string, error) {
+	hash := sha256.New()
+	if err := hashFile(hash, path); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,208 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const blobCacheStatsFile = "stats.json"
+
+// BlobCacheStats are kept on disk so they add up across invocations.
+type BlobCacheStats struct {
+	Hits        int64 `json:"hits"`
+	Misses      int64 `json:"misses"`
+	BytesServed int64 `json:"bytes_served"`
+	Entries     int   `json:"entries"`
+	Size        int64 `json:"size"`
+	MaxSize     int64 `json:"max_size,omitempty"`
+}
+
+// BlobCache is an on-disk pull-through cache of registry blobs keyed by
+// digest, shared by every repository so images with common layers only
+// download them once. When MaxSize is set the least recently used blobs
+// are evicted to stay under it.
+type BlobCache struct {
+	dir     string
+	maxSize int64
+	mu      sync.Mutex
+}
+
+func NewBlobCache(dir string, maxSize int64) (*BlobCache, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "sha256"), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create blob cache: %v", err)
+	}
+	return &BlobCache{dir: dir, maxSize: maxSize}, nil
+}
+
+func (c *BlobCache) Dir() string {
+	return c.dir
+}
+
+func (c *BlobCache) path(digest string) (string, bool) {
+	algorithm, hexDigest, ok := strings.Cut(digest, ":")
+	if !ok || algorithm != "sha256" || len(hexDigest) != 64 || strings.ContainsAny(hexDigest, `/\.`) {
+		return "", false
+	}
+	return filepath.Join(c.dir, algorithm, hexDigest), true
+}
+
+// Get returns a cached blob. Entries that no longer match their digest
+// are dropped and reported as a miss.
+func (c *BlobCache) Get(digest string) ([]byte, bool) {
+	path, ok := c.path(digest)
+	if !ok {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data, err := os.ReadFile(path)
+	if err == nil && digestBytes(data) != digest {
+		logrus.Warnf("Removing corrupt cached blob %s", digest)
+		os.Remove(path)
+		err = fmt.Errorf("digest mismatch")
+	}
+	if err != nil {
+		c.updateStats(func(stats *BlobCacheStats) { stats.Misses++ })
+		return nil, false
+	}
+
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	c.updateStats(func(stats *BlobCacheStats) {
+		stats.Hits++
+		stats.BytesServed += int64(len(data))
+	})
+	return data, true
+}
+
+// Put stores a blob after checking it against its digest.
+func (c *BlobCache) Put(digest string, data []byte) error {
+	path, ok := c.path(digest)
+	if !ok {
+		return fmt.Errorf("unsupported blob digest: %s", digest)
+	}
+	if actual := digestBytes(data); actual != digest {
+		return fmt.Errorf("blob %s has digest %s", digest, actual)
+	}
+	if c.maxSize > 0 && int64(len(data)) > c.maxSize {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".blob-")
+	if err != nil {
+		return fmt.Errorf("failed to cache blob %s: %v", digest, err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to cache blob %s: %v", digest, err)
+	}
+	tmp.Close()
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to cache blob %s: %v", digest, err)
+	}
+
+	c.evict()
+	return nil
+}
+
+type cachedBlob struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+func (c *BlobCache) entries() ([]cachedBlob, int64) {
+	files, _ := os.ReadDir(filepath.Join(c.dir, "sha256"))
+	var blobs []cachedBlob
+	var total int64
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		blobs = append(blobs, cachedBlob{
+			path:    filepath.Join(c.dir, "sha256", file.Name()),
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+		total += info.Size()
+	}
+	return blobs, total
+}
+
+// evict removes the least recently used blobs until the cache fits in
+// maxSize.
+func (c *BlobCache) evict() {
+	if c.maxSize <= 0 {
+		return
+	}
+	blobs, total := c.entries()
+	if total <= c.maxSize {
+		return
+	}
+
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].modTime.Before(blobs[j].modTime)
+	})
+	for _, blob := range blobs {
+		if total <= c.maxSize {
+			break
+		}
+		if err := os.Remove(blob.path); err != nil {
+			continue
+		}
+		total -= blob.size
+		logrus.Debugf("Evicted cached blob %s", filepath.Base(blob.path))
+	}
+}
+
+func (c *BlobCache) Stats() BlobCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.readStats()
+	blobs, total := c.entries()
+	stats.Entries = len(blobs)
+	stats.Size = total
+	stats.MaxSize = c.maxSize
+	return stats
+}
+
+func (c *BlobCache) readStats() BlobCacheStats {
+	var stats BlobCacheStats
+	if data, err := os.ReadFile(filepath.Join(c.dir, blobCacheStatsFile)); err == nil {
+		json.Unmarshal(data, &stats)
+	}
+	return stats
+}
+
+// updateStats must be called with mu held.
+func (c *BlobCache) updateStats(update func(*BlobCacheStats)) {
+	stats := c.readStats()
+	update(&stats)
+	data, err := json.Marshal(stats)
+	if err != nil {
+		return
+	}
+	if err := os.WriteFile(filepath.Join(c.dir, blobCacheStatsFile), data, 0644); err != nil {
+		logrus.Debugf("Failed to update blob cache stats: %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package image
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const BuildCacheDir = "build-cache"
+
+// buildCacheEntry maps a step's cache key to the layer it produced. Layer is
+// empty when the step did not change the filesystem.
+type buildCacheEntry struct {
+	Key       string    `json:"key"`
+	Layer     string    `json:"layer"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func hashStrings(parts ...string) string {
+	hash := sha256.New()
+	for _, part := range parts {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func (m *Manager) loadBuildCache(key string) (*buildCacheEntry, bool) {
+	cachePath := filepath.Join(BuildCacheDir, key+".json")
+	if !m.store.FileExists(cachePath) {
+		return nil, false
+	}
+
+	var entry buildCacheEntry
+	if err := m.store.LoadJSON(cachePath, &entry); err != nil {
+		return nil, false
+	}
+	if entry.Layer != "" && !m.LayerExists(entry.Layer) {
+		return nil, false
+	}
+	return &entry, true
+}
+
+func (m *Manager) saveBuildCache(entry buildCacheEntry) error {
+	cachePath := filepath.Join(BuildCacheDir, entry.Key+".json")
+	if err := m.store.SaveJSON(cachePath, entry); err != nil {
+		return fmt.Errorf("failed to save build cache entry: %v", err)
+	}
+	return nil
+}
+
+// PruneBuildCache removes all build cache entries and returns how many were removed.
+func (m *Manager) PruneBuildCache() (int, error) {
+	files, err := m.store.ListFiles(BuildCacheDir)
+	if err != nil {
+		return 0, nil
+	}
+
+	removed := 0
+	for _, file := range files {
+		if err := m.store.RemoveFile(filepath.Join(BuildCacheDir, file)); err != nil {
+			return removed, fmt.Errorf("failed to remove build cache entry %s: %v", file, err)
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// sourceChecksum hashes the paths, modes and contents of every file a
+// COPY/ADD source matches, skipping files excluded by .dockerignore.
+func (b *builder) sourceChecksum(source copySource, srcs []string) (string, error) {
+	hash := sha256.New()
+
+	for _, src := range srcs {
+		matches, err := b.sourceMatches(source, src)
+		if err != nil {
+			return "", err
+		}
+
+		for _, match := range matches {
+			var files []string
+			err := filepath.Walk(match, func(p string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				rel, _ := filepath.Rel(source.root, p)
+				if source.ignore.Ignored(rel) {
+					if info.IsDir() && p != match && !source.ignore.HasExceptions() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				files = append(files, p)
+				return nil
+			})
+			if err != nil {
+				return "", fmt.Errorf("failed to checksum %s: %v", src, err)
+			}
+
+			sort.Strings(files)
+			for _, file := range files {
+				info, err := os.Lstat(file)
+				if err != nil {
+					return "", err
+				}
+				rel, _ := filepath.Rel(match, file)
+				fmt.Fprintf(hash, "%s %s %o\n", src, rel, info.Mode())
+				if info.Mode().IsRegular() {
+					if err := hashFile(hash, file); err != nil {
+						return "", err
+					}
+				} else if info.Mode()&os.ModeSymlink != 0 {
+					link, _ := os.Readlink(file)
+					fmt.Fprintf(hash, "-> %s\n", link)
+				}
+			}
+		}
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
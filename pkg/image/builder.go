@@ -0,0 +1,1358 @@
+package image
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"docker-impl/pkg/reference"
+	"docker-impl/pkg/types"
+	"github.com/sirupsen/logrus"
+)
+
+const defaultPathEnv = "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// predefinedArgs may be passed with --build-arg without a matching ARG. They
+// reach RUN steps but are left out of the cache key and the image config.
+var predefinedArgs = map[string]bool{
+	"HTTP_PROXY": true, "http_proxy": true,
+	"HTTPS_PROXY": true, "https_proxy": true,
+	"FTP_PROXY": true, "ftp_proxy": true,
+	"NO_PROXY": true, "no_proxy": true,
+	"ALL_PROXY": true, "all_proxy": true,
+}
+
+type buildState struct {
+	name   string
+	config types.ImageConfig
+	layers []string
+	size   int64
+	rootfs string
+	cmdSet bool
+	// args holds the ARGs declared in this stage as KEY=value. They are
+	// visible to later instructions but never stored in the image.
+	args []string
+	// cacheKey chains every instruction so far; a step's cache key is
+	// derived from it plus the step's own inputs.
+	cacheKey string
+	history  []types.ImageHistory
+	// parent is the ID of the image the stage started from
+	parent string
+	// baseLayers and baseSize describe what the stage inherited from its
+	// FROM, which --squash leaves alone
+	baseLayers int
+	baseSize   int64
+}
+
+type builder struct {
+	manager    *Manager
+	options    types.ImageBuildOptions
+	contextDir string
+	ignore     *DockerIgnore
+	progress   func(types.BuildEvent)
+	// progressMu serializes events, since a RUN's stdout and stderr are
+	// copied concurrently
+	progressMu sync.Mutex
+	// step is the number of the instruction being built
+	step    int
+	state   *buildState
+	stages  []*buildState
+	workDir string
+	// fromImages caches image roots materialized for COPY --from=<image>
+	fromImages map[string]string
+	// globalArgs are ARGs declared before the first FROM; only FROM lines
+	// see them unless a stage redeclares them.
+	globalArgs []string
+	usedArgs   map[string]bool
+
+	cacheHits   int
+	cacheMisses int
+}
+
+func newBuilder(m *Manager, options types.ImageBuildOptions) (*builder, error) {
+	contextDir, err := filepath.Abs(options.ContextDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve build context: %v", err)
+	}
+	if info, err := os.Stat(contextDir); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("build context is not a directory: %s", options.ContextDir)
+	}
+
+	ignore, err := LoadDockerIgnore(contextDir)
+	if err != nil {
+		return nil, err
+	}
+
+	progress := options.Progress
+	if progress == nil {
+		progress = PlainProgress(os.Stdout)
+	}
+
+	return &builder{
+		manager:    m,
+		options:    options,
+		contextDir: contextDir,
+		ignore:     ignore,
+		progress:   progress,
+		fromImages: make(map[string]string),
+		usedArgs:   make(map[string]bool),
+	}, nil
+}
+
+func (b *builder) emit(event types.BuildEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	b.progressMu.Lock()
+	defer b.progressMu.Unlock()
+	b.progress(event)
+}
+
+func (b *builder) dockerfilePath() string {
+	dockerfile := b.options.Dockerfile
+	if dockerfile == "" {
+		dockerfile = "Dockerfile"
+	}
+	if filepath.IsAbs(dockerfile) {
+		return dockerfile
+	}
+	return filepath.Join(b.contextDir, dockerfile)
+}
+
+func (b *builder) build() (*types.Image, error) {
+	instructions, err := ParseDockerfileFile(b.dockerfilePath())
+	if err != nil {
+		return nil, err
+	}
+	if b.options.FromContainer != "" {
+		// The container takes the place of FROM
+		for _, inst := range instructions {
+			if inst.Command == "FROM" {
+				return nil, fmt.Errorf("a Dockerfile applied to a container cannot have FROM")
+			}
+		}
+		if b.options.Target != "" {
+			return nil, fmt.Errorf("a build from a container has no stages to target")
+		}
+	} else {
+		for _, inst := range instructions {
+			if inst.Command == "FROM" {
+				break
+			}
+			if inst.Command != "ARG" {
+				return nil, fmt.Errorf("the first instruction must be FROM, got %s", inst.Command)
+			}
+		}
+
+		instructions, err = selectTargetStage(instructions, b.options.Target)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tmpRoot := filepath.Join(b.manager.store.GetDataDir(), "tmp")
+	if err := os.MkdirAll(tmpRoot, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create build directory: %v", err)
+	}
+	workDir, err := os.MkdirTemp(tmpRoot, "build-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create build directory: %v", err)
+	}
+	defer os.RemoveAll(workDir)
+	b.workDir = workDir
+
+	if b.options.FromContainer != "" {
+		if err := b.dispatchContainerBase(filepath.Join(workDir, "stage-0")); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, inst := range instructions {
+		b.step = i + 1
+		b.emit(types.BuildEvent{Type: BuildEventStep, Step: b.step, Total: len(instructions), Instruction: inst.Original})
+
+		if b.state == nil && inst.Command == "ARG" {
+			if err := b.dispatchGlobalArg(inst); err != nil {
+				return nil, fmt.Errorf("step %d (%s): %v", i+1, inst.Command, err)
+			}
+			continue
+		}
+
+		if inst.Command == "FROM" {
+			rootfs := filepath.Join(workDir, fmt.Sprintf("stage-%d", len(b.stages)))
+			if err := b.dispatchFrom(inst, rootfs); err != nil {
+				return nil, fmt.Errorf("step %d (%s): %v", i+1, inst.Command, err)
+			}
+			continue
+		}
+
+		layers, size := len(b.state.layers), b.state.size
+		if err := b.dispatch(inst); err != nil {
+			return nil, fmt.Errorf("step %d (%s): %v", i+1, inst.Command, err)
+		}
+		b.recordHistory(inst, len(b.state.layers) > layers, b.state.size-size)
+	}
+	if b.state == nil {
+		return nil, fmt.Errorf("the Dockerfile has no FROM instruction")
+	}
+
+	b.warnUnusedArgs()
+	return b.commitImage()
+}
+
+func (b *builder) dispatch(inst Instruction) error {
+	switch inst.Command {
+	case "RUN":
+		return b.dispatchRun(inst)
+	case "COPY", "ADD":
+		return b.dispatchCopy(inst)
+	case "ARG":
+		return b.dispatchArg(inst)
+	case "ENV":
+		if err := b.dispatchEnv(inst); err != nil {
+			return err
+		}
+	case "LABEL":
+		if err := b.dispatchLabel(inst); err != nil {
+			return err
+		}
+	case "CMD":
+		b.state.config.Cmd = commandArgs(inst)
+		b.state.cmdSet = true
+	case "ENTRYPOINT":
+		b.state.config.Entrypoint = commandArgs(inst)
+		if !b.state.cmdSet {
+			b.state.config.Cmd = nil
+		}
+	case "WORKDIR":
+		return b.dispatchWorkdir(inst)
+	case "EXPOSE":
+		if err := b.dispatchExpose(inst); err != nil {
+			return err
+		}
+	case "USER":
+		b.state.config.User = expandVars(inst.Args[0], b.buildEnv())
+	case "VOLUME":
+		if err := b.dispatchVolume(inst); err != nil {
+			return err
+		}
+	case "HEALTHCHECK":
+		if err := b.dispatchHealthcheck(inst); err != nil {
+			return err
+		}
+	case "ONBUILD":
+		if err := b.dispatchOnBuild(inst); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown instruction: %s", inst.Command)
+	}
+
+	// Metadata-only instructions still feed the cache chain so that, e.g.,
+	// an ENV change invalidates the RUN steps after it.
+	b.state.cacheKey = hashStrings(b.state.cacheKey, inst.Original)
+	return nil
+}
+
+func (b *builder) recordHistory(inst Instruction, addedLayer bool, size int64) {
+	entry := types.ImageHistory{
+		Created:    time.Now(),
+		CreatedBy:  inst.Original,
+		EmptyLayer: !addedLayer,
+	}
+	if addedLayer {
+		entry.LayerID = b.state.layers[len(b.state.layers)-1]
+		entry.Size = size
+	}
+	b.state.history = append(b.state.history, entry)
+}
+
+func (b *builder) dispatchFrom(inst Instruction, rootfs string) error {
+	if err := os.MkdirAll(rootfs, 0755); err != nil {
+		return fmt.Errorf("failed to create rootfs: %v", err)
+	}
+
+	ref, name, err := parseFromArgs(inst.Args)
+	if err != nil {
+		return err
+	}
+	ref = expandVars(ref, b.globalArgs)
+
+	b.state = &buildState{name: name, rootfs: rootfs, cacheKey: hashStrings("FROM", "scratch")}
+	b.stages = append(b.stages, b.state)
+	if ref == "scratch" {
+		return nil
+	}
+
+	if parent := b.findStage(ref); parent != nil && parent != b.state {
+		b.state.config = copyImageConfig(parent.config)
+		b.state.layers = append([]string(nil), parent.layers...)
+		b.state.history = append([]types.ImageHistory(nil), parent.history...)
+		b.state.size = parent.size
+		b.state.parent = parent.parent
+		b.state.cacheKey = hashStrings("FROM", parent.cacheKey)
+		b.state.baseLayers, b.state.baseSize = parent.baseLayers, parent.baseSize
+		if err := b.manager.materializeLayers(b.state.layers, rootfs); err != nil {
+			return err
+		}
+		return b.runTriggers()
+	}
+
+	base, err := b.manager.resolveBaseImage(ref)
+	if err != nil {
+		return err
+	}
+
+	b.state.config = copyImageConfig(base.Config)
+	b.state.layers = append([]string(nil), base.Layers...)
+	b.state.history = append([]types.ImageHistory(nil), base.History...)
+	b.state.size = base.Size
+	b.state.parent = base.ID
+	b.state.cacheKey = hashStrings("FROM", base.ID)
+	b.state.baseLayers, b.state.baseSize = len(base.Layers), base.Size
+
+	if err := b.manager.materializeLayers(b.state.layers, rootfs); err != nil {
+		return err
+	}
+	return b.runTriggers()
+}
+
+// runTriggers runs the ONBUILD instructions of the image a stage starts
+// from. They apply to this build only and are not passed on.
+func (b *builder) runTriggers() error {
+	triggers := b.state.config.OnBuild
+	b.state.config.OnBuild = nil
+
+	for _, text := range triggers {
+		inst, err := parseInstruction(text)
+		if err != nil {
+			return fmt.Errorf("invalid ONBUILD trigger %q: %v", text, err)
+		}
+		b.emit(types.BuildEvent{Type: BuildEventTrigger, Step: b.step, Instruction: text})
+
+		layers, size := len(b.state.layers), b.state.size
+		if err := b.dispatch(inst); err != nil {
+			return fmt.Errorf("ONBUILD trigger %q: %v", text, err)
+		}
+		b.recordHistory(inst, len(b.state.layers) > layers, b.state.size-size)
+	}
+	return nil
+}
+
+func (b *builder) dispatchRun(inst Instruction) error {
+	if len(inst.Args) == 0 {
+		return fmt.Errorf("RUN requires a command")
+	}
+
+	argv := inst.Args
+	if !inst.JSON {
+		if _, err := os.Stat(filepath.Join(b.state.rootfs, "bin", "sh")); err != nil {
+			return fmt.Errorf("RUN in shell form requires /bin/sh in the image")
+		}
+		argv = []string{"/bin/sh", "-c", inst.Args[0]}
+	}
+
+	key := hashStrings(b.state.cacheKey, inst.Original)
+	if b.useCache(key) {
+		return nil
+	}
+
+	before, err := takeSnapshot(b.state.rootfs)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Chroot: b.state.rootfs,
+	}
+	if user := b.state.config.User; user != "" {
+		uid, gid, err := ResolveUser(b.state.rootfs, user)
+		if err != nil {
+			return err
+		}
+		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uid, Gid: gid}
+	}
+	cmd.Env = b.runEnv()
+	cmd.Dir = b.state.config.WorkingDir
+	if cmd.Dir == "" {
+		cmd.Dir = "/"
+	}
+	cmd.Stdout = &buildOutput{b: b, stream: "stdout"}
+	cmd.Stderr = &buildOutput{b: b, stream: "stderr"}
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("command '%s' failed: %v", strings.Join(argv, " "), err)
+	}
+
+	return b.commitStep(before, key)
+}
+
+func (b *builder) dispatchCopy(inst Instruction) error {
+	from, hasFrom := inst.Flags["from"]
+	if hasFrom && inst.Command == "ADD" {
+		return fmt.Errorf("ADD does not support --from")
+	}
+	if len(inst.Args) < 2 {
+		return fmt.Errorf("%s requires at least a source and a destination", inst.Command)
+	}
+
+	var uid, gid = -1, -1
+	if chown, ok := inst.Flags["chown"]; ok {
+		var err error
+		if uid, gid, err = parseChown(chown); err != nil {
+			return err
+		}
+	}
+
+	args := make([]string, len(inst.Args))
+	for i, arg := range inst.Args {
+		args[i] = expandVars(arg, b.buildEnv())
+	}
+	srcs, dest := args[:len(args)-1], args[len(args)-1]
+
+	destIsDir := strings.HasSuffix(dest, "/") || len(srcs) > 1
+	if !path.IsAbs(dest) {
+		dest = path.Join(b.workingDir(), dest)
+	}
+	target := filepath.Join(b.state.rootfs, dest)
+	if info, err := os.Stat(target); err == nil && info.IsDir() {
+		destIsDir = true
+	}
+
+	source := b.contextSource()
+	if hasFrom {
+		var err error
+		if source, err = b.fromSource(expandVars(from, b.buildEnv())); err != nil {
+			return err
+		}
+	}
+
+	// Remote ADD sources are not cached since their content is unknown
+	// until downloaded.
+	key := ""
+	if !containsRemoteURL(srcs) || inst.Command != "ADD" {
+		checksum, err := b.sourceChecksum(source, srcs)
+		if err != nil {
+			return err
+		}
+		key = hashStrings(b.state.cacheKey, inst.Original, checksum)
+	}
+	if b.useCache(key) {
+		return nil
+	}
+
+	before, err := takeSnapshot(b.state.rootfs)
+	if err != nil {
+		return err
+	}
+
+	var copied []string
+	for _, src := range srcs {
+		if inst.Command == "ADD" && isRemoteURL(src) {
+			file, err := b.download(src, target, destIsDir)
+			if err != nil {
+				return err
+			}
+			copied = append(copied, file)
+			continue
+		}
+
+		matches, err := b.sourceMatches(source, src)
+		if err != nil {
+			return err
+		}
+		if len(matches) > 1 {
+			destIsDir = true
+		}
+
+		for _, match := range matches {
+			files, err := b.copyFromSource(source, match, target, destIsDir, inst.Command == "ADD")
+			if err != nil {
+				return err
+			}
+			copied = append(copied, files...)
+		}
+	}
+
+	if uid >= 0 {
+		for _, file := range copied {
+			if err := os.Lchown(file, uid, gid); err != nil {
+				return fmt.Errorf("failed to chown %s: %v", file, err)
+			}
+		}
+	}
+
+	return b.commitStep(before, key)
+}
+
+func (b *builder) dispatchEnv(inst Instruction) error {
+	args := make([]string, len(inst.Args))
+	for i, arg := range inst.Args {
+		args[i] = expandVars(arg, b.buildEnv())
+	}
+
+	values, order, err := parseKeyValues(args)
+	if err != nil {
+		return err
+	}
+	for _, key := range order {
+		b.state.config.Env = setEnv(b.state.config.Env, key, values[key])
+	}
+	return nil
+}
+
+func (b *builder) dispatchLabel(inst Instruction) error {
+	args := make([]string, len(inst.Args))
+	for i, arg := range inst.Args {
+		args[i] = expandVars(arg, b.buildEnv())
+	}
+
+	values, order, err := parseKeyValues(args)
+	if err != nil {
+		return err
+	}
+	if b.state.config.Labels == nil {
+		b.state.config.Labels = make(map[string]string)
+	}
+	for _, key := range order {
+		b.state.config.Labels[key] = values[key]
+	}
+	return nil
+}
+
+// dispatchGlobalArg handles ARGs that appear before the first FROM.
+func (b *builder) dispatchGlobalArg(inst Instruction) error {
+	for _, arg := range inst.Args {
+		name, value, ok, err := b.resolveArg(arg, b.globalArgs, nil)
+		if err != nil {
+			return err
+		}
+		if ok {
+			b.globalArgs = setEnv(b.globalArgs, name, value)
+		}
+	}
+	return nil
+}
+
+// dispatchArg declares build arguments for the current stage. The value
+// comes from --build-arg, then the default in the Dockerfile, then a global
+// ARG of the same name. Resolved values feed the cache key so that changing
+// a build arg invalidates the steps after it.
+func (b *builder) dispatchArg(inst Instruction) error {
+	parts := []string{"ARG"}
+	for _, arg := range inst.Args {
+		name, value, ok, err := b.resolveArg(arg, b.buildEnv(), b.globalArgs)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			parts = append(parts, name)
+			continue
+		}
+		b.state.args = setEnv(b.state.args, name, value)
+		parts = append(parts, name+"="+value)
+	}
+
+	b.state.cacheKey = hashStrings(append([]string{b.state.cacheKey}, parts...)...)
+	return nil
+}
+
+// resolveArg parses "NAME" or "NAME=default" and returns the value the
+// argument takes. ok is false when the argument has no value at all.
+func (b *builder) resolveArg(arg string, env, inherited []string) (string, string, bool, error) {
+	name, def, hasDefault := strings.Cut(arg, "=")
+	if name == "" {
+		return "", "", false, fmt.Errorf("invalid ARG: %s", arg)
+	}
+
+	if value, ok := b.options.BuildArgs[name]; ok {
+		b.usedArgs[name] = true
+		return name, value, true, nil
+	}
+	if hasDefault {
+		return name, expandVars(def, env), true, nil
+	}
+	for _, kv := range inherited {
+		if strings.HasPrefix(kv, name+"=") {
+			return name, strings.TrimPrefix(kv, name+"="), true, nil
+		}
+	}
+	return name, "", false, nil
+}
+
+// buildEnv is the environment used for variable substitution: the stage's
+// ARGs overridden by its ENV values.
+func (b *builder) buildEnv() []string {
+	env := append([]string(nil), b.state.args...)
+	return append(env, b.state.config.Env...)
+}
+
+// runEnv is the environment RUN commands execute with. Build args are
+// exported alongside ENV but, unlike ENV, do not persist in the image.
+func (b *builder) runEnv() []string {
+	env := append([]string(nil), b.state.config.Env...)
+	for _, kv := range b.state.args {
+		name := strings.SplitN(kv, "=", 2)[0]
+		if !hasEnv(env, name) {
+			env = append(env, kv)
+		}
+	}
+	for name, value := range b.options.BuildArgs {
+		if predefinedArgs[name] && !hasEnv(env, name) {
+			env = append(env, name+"="+value)
+		}
+	}
+	if !hasEnv(env, "PATH") {
+		env = append(env, defaultPathEnv)
+	}
+	return env
+}
+
+func (b *builder) warnUnusedArgs() {
+	var unused []string
+	for name := range b.options.BuildArgs {
+		if !b.usedArgs[name] && !predefinedArgs[name] {
+			unused = append(unused, name)
+		}
+	}
+	if len(unused) == 0 {
+		return
+	}
+
+	sort.Strings(unused)
+	b.emit(types.BuildEvent{Type: BuildEventWarning, Message: fmt.Sprintf("One or more build-args %v were not consumed", unused)})
+	logrus.Warnf("Build args were not consumed: %s", strings.Join(unused, ", "))
+}
+
+func (b *builder) dispatchWorkdir(inst Instruction) error {
+	dir := expandVars(inst.Args[0], b.buildEnv())
+	if !path.IsAbs(dir) {
+		dir = path.Join(b.workingDir(), dir)
+	}
+	b.state.config.WorkingDir = path.Clean(dir)
+
+	key := hashStrings(b.state.cacheKey, inst.Original)
+	if b.useCache(key) {
+		return nil
+	}
+
+	before, err := takeSnapshot(b.state.rootfs)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(b.state.rootfs, dir), 0755); err != nil {
+		return fmt.Errorf("failed to create working directory: %v", err)
+	}
+	return b.commitStep(before, key)
+}
+
+func (b *builder) dispatchExpose(inst Instruction) error {
+	if b.state.config.ExposedPorts == nil {
+		b.state.config.ExposedPorts = make(map[string]struct{})
+	}
+
+	for _, arg := range inst.Args {
+		port := expandVars(arg, b.buildEnv())
+		proto := "tcp"
+		if i := strings.Index(port, "/"); i >= 0 {
+			port, proto = port[:i], strings.ToLower(port[i+1:])
+		}
+		if proto != "tcp" && proto != "udp" && proto != "sctp" {
+			return fmt.Errorf("invalid protocol in EXPOSE: %s", arg)
+		}
+		for _, p := range strings.SplitN(port, "-", 2) {
+			if n, err := strconv.Atoi(p); err != nil || n < 1 || n > 65535 {
+				return fmt.Errorf("invalid port in EXPOSE: %s", arg)
+			}
+		}
+		b.state.config.ExposedPorts[port+"/"+proto] = struct{}{}
+	}
+	return nil
+}
+
+func (b *builder) dispatchVolume(inst Instruction) error {
+	if b.state.config.Volumes == nil {
+		b.state.config.Volumes = make(map[string]struct{})
+	}
+
+	for _, arg := range inst.Args {
+		volume := expandVars(arg, b.buildEnv())
+		if volume == "" {
+			return fmt.Errorf("VOLUME path must not be empty")
+		}
+		if !path.IsAbs(volume) {
+			volume = path.Join(b.workingDir(), volume)
+		}
+		b.state.config.Volumes[path.Clean(volume)] = struct{}{}
+	}
+	return nil
+}
+
+// dispatchHealthcheck handles HEALTHCHECK [OPTIONS] CMD command and
+// HEALTHCHECK NONE, which disables a check inherited from the base image.
+func (b *builder) dispatchHealthcheck(inst Instruction) error {
+	kind, command, _ := strings.Cut(strings.TrimSpace(inst.Args[0]), " ")
+	command = strings.TrimSpace(command)
+
+	switch strings.ToUpper(kind) {
+	case "NONE":
+		if command != "" || len(inst.Flags) > 0 {
+			return fmt.Errorf("HEALTHCHECK NONE takes no options or arguments")
+		}
+		b.state.config.Healthcheck = &types.HealthConfig{Test: []string{"NONE"}}
+		return nil
+	case "CMD":
+		if command == "" {
+			return fmt.Errorf("HEALTHCHECK CMD requires a command")
+		}
+	default:
+		return fmt.Errorf("HEALTHCHECK must be followed by CMD or NONE, got %s", kind)
+	}
+
+	health := &types.HealthConfig{Test: []string{"CMD-SHELL", command}}
+	var args []string
+	if strings.HasPrefix(command, "[") && json.Unmarshal([]byte(command), &args) == nil {
+		health.Test = append([]string{"CMD"}, args...)
+	}
+
+	for name, value := range inst.Flags {
+		switch name {
+		case "interval", "timeout", "start-period":
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return fmt.Errorf("invalid HEALTHCHECK --%s: %s", name, value)
+			}
+			switch name {
+			case "interval":
+				health.Interval = d
+			case "timeout":
+				health.Timeout = d
+			default:
+				health.StartPeriod = d
+			}
+		case "retries":
+			retries, err := strconv.Atoi(value)
+			if err != nil || retries < 0 {
+				return fmt.Errorf("invalid HEALTHCHECK --retries: %s", value)
+			}
+			health.Retries = retries
+		default:
+			return fmt.Errorf("unknown HEALTHCHECK option: --%s", name)
+		}
+	}
+
+	b.state.config.Healthcheck = health
+	return nil
+}
+
+// dispatchOnBuild records an instruction to run when another build uses
+// this image as its base.
+func (b *builder) dispatchOnBuild(inst Instruction) error {
+	trigger, err := parseInstruction(inst.Args[0])
+	if err != nil {
+		return err
+	}
+	switch trigger.Command {
+	case "ONBUILD", "FROM", "MAINTAINER":
+		return fmt.Errorf("%s isn't allowed as an ONBUILD trigger", trigger.Command)
+	}
+
+	b.state.config.OnBuild = append(b.state.config.OnBuild, trigger.Original)
+	return nil
+}
+
+// useCache applies the cached result of a step when one exists. An empty
+// key marks a step that cannot be cached.
+func (b *builder) useCache(key string) bool {
+	if key == "" || b.options.NoCache {
+		return false
+	}
+
+	entry, ok := b.manager.loadBuildCache(key)
+	if !ok {
+		b.cacheMisses++
+		return false
+	}
+
+	if entry.Layer != "" {
+		if err := b.manager.materializeLayers([]string{entry.Layer}, b.state.rootfs); err != nil {
+			logrus.Warnf("Failed to apply cached layer %s: %v", entry.Layer, err)
+			b.cacheMisses++
+			return false
+		}
+		b.state.layers = append(b.state.layers, entry.Layer)
+		b.state.size += entry.Size
+	}
+
+	b.cacheHits++
+	b.state.cacheKey = hashStrings(key, entry.Layer)
+	b.emit(types.BuildEvent{Type: BuildEventCache, Step: b.step, Layer: entry.Layer, Size: entry.Size})
+	return true
+}
+
+// commitStep turns the changes since before into a layer on the current
+// stage and records it in the build cache under key.
+func (b *builder) commitStep(before snapshot, key string) error {
+	changed, deleted, err := diffSnapshot(b.state.rootfs, before)
+	if err != nil {
+		return err
+	}
+
+	layerID, size, err := b.manager.commitLayer(b.state.rootfs, changed, deleted)
+	if err != nil {
+		return err
+	}
+	if layerID != "" {
+		b.state.layers = append(b.state.layers, layerID)
+		b.state.size += size
+	}
+	b.emit(types.BuildEvent{Type: BuildEventLayer, Step: b.step, Layer: layerID, Size: size})
+
+	if key != "" {
+		entry := buildCacheEntry{Key: key, Layer: layerID, Size: size, CreatedAt: time.Now()}
+		if err := b.manager.saveBuildCache(entry); err != nil {
+			logrus.Warnf("%v", err)
+		}
+	} else {
+		key = b.state.cacheKey
+	}
+	b.state.cacheKey = hashStrings(key, layerID)
+	return nil
+}
+
+func (b *builder) commitImage() (*types.Image, error) {
+	var tags []string
+	for _, ref := range b.options.Tags {
+		tag, err := normalizeTag(ref)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+
+	config := b.state.config
+	if len(b.options.Labels) > 0 {
+		if config.Labels == nil {
+			config.Labels = make(map[string]string)
+		}
+		for k, v := range b.options.Labels {
+			config.Labels[k] = v
+		}
+	}
+
+	image := &types.Image{
+		CreatedAt: time.Now(),
+		Config:    config,
+		Layers:    b.state.layers,
+		Labels:    config.Labels,
+		Size:      b.state.size,
+		History:   b.state.history,
+		Parent:    b.state.parent,
+		Platform:  DefaultPlatform(),
+	}
+	if b.options.Squash {
+		if err := b.squash(image); err != nil {
+			return nil, err
+		}
+	}
+
+	image, err := b.manager.registerImage(image, "", tags, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create image during build: %v", err)
+	}
+
+	if !b.options.NoCache {
+		b.emit(types.BuildEvent{Type: BuildEventInfo, Message: fmt.Sprintf("Build cache: %d hits, %d misses", b.cacheHits, b.cacheMisses)})
+	}
+	b.emit(types.BuildEvent{Type: BuildEventComplete, ImageID: image.ID, Tags: tags})
+	return image, nil
+}
+
+// squash merges the layers the final stage added on top of its base image
+// into one, keeping the base layers so they stay shared.
+func (b *builder) squash(image *types.Image) error {
+	added := image.Layers[b.state.baseLayers:]
+	if len(added) <= 1 {
+		return nil
+	}
+
+	layers, size, err := b.manager.squashLayers(image.Layers, b.state.baseLayers)
+	if err != nil {
+		return fmt.Errorf("failed to squash image: %v", err)
+	}
+	var layerID string
+	if len(layers) > b.state.baseLayers {
+		layerID = layers[len(layers)-1]
+	}
+
+	image.Layers = layers
+	image.Size = b.state.baseSize + size
+	image.History = squashHistory(image.History, added, layerID, size, fmt.Sprintf("squashed %d layers", len(added)))
+	b.emit(types.BuildEvent{Type: BuildEventInfo, Message: fmt.Sprintf("Squashed %d layers into %s", len(added), shortLayerID(layerID))})
+	return nil
+}
+
+// findStage looks a stage up by name or by its zero-based index.
+func (b *builder) findStage(ref string) *buildState {
+	for _, stage := range b.stages {
+		if stage.name != "" && strings.EqualFold(stage.name, ref) {
+			return stage
+		}
+	}
+	if i, err := strconv.Atoi(ref); err == nil && i >= 0 && i < len(b.stages) {
+		return b.stages[i]
+	}
+	return nil
+}
+
+// fromSource resolves COPY --from to an earlier stage or, failing that, an
+// image whose layers are unpacked into a scratch directory.
+func (b *builder) fromSource(ref string) (copySource, error) {
+	if stage := b.findStage(ref); stage != nil {
+		if stage == b.state {
+			return copySource{}, fmt.Errorf("COPY --from cannot reference the current stage")
+		}
+		return copySource{root: stage.rootfs}, nil
+	}
+
+	image, err := b.manager.resolveBaseImage(ref)
+	if err != nil {
+		return copySource{}, fmt.Errorf("invalid --from reference %s: %v", ref, err)
+	}
+
+	root, ok := b.fromImages[image.ID]
+	if !ok {
+		root = filepath.Join(b.workDir, "from-"+image.ID[:12])
+		if err := os.MkdirAll(root, 0755); err != nil {
+			return copySource{}, fmt.Errorf("failed to create directory for %s: %v", ref, err)
+		}
+		if err := b.manager.materializeLayers(image.Layers, root); err != nil {
+			return copySource{}, err
+		}
+		b.fromImages[image.ID] = root
+	}
+	return copySource{root: root}, nil
+}
+
+func (b *builder) workingDir() string {
+	if b.state.config.WorkingDir == "" {
+		return "/"
+	}
+	return b.state.config.WorkingDir
+}
+
+// copySource is where COPY/ADD reads from: the build context (filtered by
+// .dockerignore) or, for --from, the root filesystem of a stage or image.
+type copySource struct {
+	root   string
+	ignore *DockerIgnore
+}
+
+func (b *builder) contextSource() copySource {
+	return copySource{root: b.contextDir, ignore: b.ignore}
+}
+
+// sourceMatches expands a COPY source (which may contain wildcards) to
+// paths inside the source root, dropping anything .dockerignore excludes.
+func (b *builder) sourceMatches(source copySource, src string) ([]string, error) {
+	pattern := filepath.Join(source.root, filepath.FromSlash(src))
+	if rel, err := filepath.Rel(source.root, pattern); err != nil || strings.HasPrefix(rel, "..") {
+		return nil, fmt.Errorf("forbidden path outside the build context: %s", src)
+	}
+
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source pattern %s: %v", src, err)
+	}
+
+	var result []string
+	for _, match := range matches {
+		rel, _ := filepath.Rel(source.root, match)
+		if source.ignore.Ignored(rel) && !source.ignore.HasExceptions() {
+			continue
+		}
+		result = append(result, match)
+	}
+
+	if len(result) == 0 {
+		return nil, fmt.Errorf("%s: no such file or directory in the build context", src)
+	}
+	return result, nil
+}
+
+// copyFromSource copies one source path into the rootfs and returns the
+// paths it created. Directories contribute their contents, not themselves.
+func (b *builder) copyFromSource(source copySource, src, target string, destIsDir, extract bool) ([]string, error) {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat %s: %v", src, err)
+	}
+
+	if !info.IsDir() {
+		rel, _ := filepath.Rel(source.root, src)
+		if source.ignore.Ignored(rel) {
+			return nil, nil
+		}
+		if extract && info.Mode().IsRegular() {
+			if ok, err := isArchive(src); err != nil {
+				return nil, err
+			} else if ok {
+				return extractArchive(src, target)
+			}
+		}
+
+		dst := target
+		if destIsDir {
+			dst = filepath.Join(target, filepath.Base(src))
+		}
+		if err := copyPath(src, dst, info, false); err != nil {
+			return nil, err
+		}
+		return []string{dst}, nil
+	}
+
+	var copied []string
+	err = filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(source.root, p)
+		if p != src && source.ignore.Ignored(rel) {
+			if fi.IsDir() && !source.ignore.HasExceptions() {
+				return filepath.SkipDir
+			}
+			if !fi.IsDir() {
+				return nil
+			}
+		}
+
+		sub, _ := filepath.Rel(src, p)
+		dst := filepath.Join(target, sub)
+		if err := copyPath(p, dst, fi, false); err != nil {
+			return err
+		}
+		copied = append(copied, dst)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy %s: %v", src, err)
+	}
+	return copied, nil
+}
+
+func (b *builder) download(rawURL, target string, destIsDir bool) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid URL %s: %v", rawURL, err)
+	}
+
+	dst := target
+	if destIsDir {
+		name := path.Base(u.Path)
+		if name == "/" || name == "." {
+			return "", fmt.Errorf("cannot determine a filename for %s", rawURL)
+		}
+		dst = filepath.Join(target, name)
+	}
+
+	resp, err := http.Get(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to download %s: %v", rawURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to download %s: %s", rawURL, resp.Status)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", fmt.Errorf("failed to create directory for %s: %v", dst, err)
+	}
+	file, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", fmt.Errorf("failed to create %s: %v", dst, err)
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(file, resp.Body); err != nil {
+		return "", fmt.Errorf("failed to download %s: %v", rawURL, err)
+	}
+	return dst, nil
+}
+
+// resolveBaseImage finds a FROM image locally by ID or name:tag, pulling it
+// when it is not present.
+func (m *Manager) resolveBaseImage(ref string) (*types.Image, error) {
+	if image, err := m.ResolveImage(ref); err == nil {
+		return image, nil
+	}
+
+	parsed, err := reference.ParseNormalized(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	logrus.Infof("Base image %s not found locally, pulling", ref)
+	return m.PullReference(parsed, "")
+}
+
+// parseFromArgs splits "FROM image [AS name]".
+func parseFromArgs(args []string) (string, string, error) {
+	switch {
+	case len(args) == 1:
+		return args[0], "", nil
+	case len(args) == 3 && strings.EqualFold(args[1], "AS"):
+		return args[0], args[2], nil
+	default:
+		return "", "", fmt.Errorf("FROM requires either one argument or three arguments (FROM image AS name)")
+	}
+}
+
+// selectTargetStage truncates the instructions after the stage named target.
+func selectTargetStage(instructions []Instruction, target string) ([]Instruction, error) {
+	if target == "" {
+		return instructions, nil
+	}
+
+	inTarget := false
+	for i, inst := range instructions {
+		if inst.Command != "FROM" {
+			continue
+		}
+		if inTarget {
+			return instructions[:i], nil
+		}
+		if _, name, err := parseFromArgs(inst.Args); err == nil && strings.EqualFold(name, target) {
+			inTarget = true
+		}
+	}
+
+	if !inTarget {
+		return nil, fmt.Errorf("target stage %s could not be found", target)
+	}
+	return instructions, nil
+}
+
+func parseNameTag(ref string) (string, string) {
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		return ref[:i], ref[i+1:]
+	}
+	return ref, "latest"
+}
+
+func commandArgs(inst Instruction) []string {
+	if len(inst.Args) == 0 {
+		return nil
+	}
+	if inst.JSON {
+		return inst.Args
+	}
+	return []string{"/bin/sh", "-c", inst.Args[0]}
+}
+
+func setEnv(env []string, key, value string) []string {
+	result := make([]string, 0, len(env)+1)
+	for _, kv := range env {
+		if strings.HasPrefix(kv, key+"=") {
+			continue
+		}
+		result = append(result, kv)
+	}
+	return append(result, key+"="+value)
+}
+
+func hasEnv(env []string, key string) bool {
+	for _, kv := range env {
+		if strings.HasPrefix(kv, key+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+func copyImageConfig(config types.ImageConfig) types.ImageConfig {
+	copied := config
+	copied.Env = append([]string(nil), config.Env...)
+	copied.Cmd = append([]string(nil), config.Cmd...)
+	copied.Entrypoint = append([]string(nil), config.Entrypoint...)
+	if config.ExposedPorts != nil {
+		copied.ExposedPorts = make(map[string]struct{}, len(config.ExposedPorts))
+		for k := range config.ExposedPorts {
+			copied.ExposedPorts[k] = struct{}{}
+		}
+	}
+	if config.Volumes != nil {
+		copied.Volumes = make(map[string]struct{}, len(config.Volumes))
+		for k := range config.Volumes {
+			copied.Volumes[k] = struct{}{}
+		}
+	}
+	if config.Labels != nil {
+		copied.Labels = make(map[string]string, len(config.Labels))
+		for k, v := range config.Labels {
+			copied.Labels[k] = v
+		}
+	}
+	if config.Healthcheck != nil {
+		healthcheck := *config.Healthcheck
+		healthcheck.Test = append([]string(nil), config.Healthcheck.Test...)
+		copied.Healthcheck = &healthcheck
+	}
+	copied.OnBuild = append([]string(nil), config.OnBuild...)
+	return copied
+}
+
+func parseChown(value string) (int, int, error) {
+	parts := strings.SplitN(value, ":", 2)
+	uid, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("only numeric --chown values are supported: %s", value)
+	}
+	gid := uid
+	if len(parts) == 2 {
+		if gid, err = strconv.Atoi(parts[1]); err != nil {
+			return 0, 0, fmt.Errorf("only numeric --chown values are supported: %s", value)
+		}
+	}
+	return uid, gid, nil
+}
+
+func containsRemoteURL(srcs []string) bool {
+	for _, src := range srcs {
+		if isRemoteURL(src) {
+			return true
+		}
+	}
+	return false
+}
+
+func shortLayerID(layerID string) string {
+	if layerID == "" {
+		return "<no changes>"
+	}
+	return layerID[:12]
+}
+
+func isRemoteURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// isArchive sniffs gzip, bzip2 and plain tar files.
+func isArchive(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer file.Close()
+
+	header := make([]byte, 262)
+	n, _ := io.ReadFull(file, header)
+	header = header[:n]
+
+	switch {
+	case n >= 2 && header[0] == 0x1f && header[1] == 0x8b:
+		return true, nil
+	case n >= 3 && string(header[:3]) == "BZh":
+		return true, nil
+	case n >= 262 && string(header[257:262]) == "ustar":
+		return true, nil
+	}
+	return false, nil
+}
+
+func extractArchive(src, dest string) ([]string, error) {
+	file, err := os.Open(src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", src, err)
+	}
+	defer file.Close()
+
+	return extractArchiveStream(file, src, dest)
+}
+
+// extractArchiveStream unpacks a tar stream, optionally gzip or bzip2
+// compressed, into dest. src is only used in error messages.
+func extractArchiveStream(r io.Reader, src, dest string) ([]string, error) {
+	buffered := bufio.NewReader(r)
+	magic, _ := buffered.Peek(3)
+
+	var reader io.Reader = buffered
+	switch {
+	case len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b:
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", src, err)
+		}
+		defer gz.Close()
+		reader = gz
+	case string(magic) == "BZh":
+		reader = bzip2.NewReader(buffered)
+	}
+
+	var extracted []string
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read archive %s: %v", src, err)
+		}
+
+		target := filepath.Join(dest, filepath.Clean("/"+hdr.Name))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create directory for %s: %v", target, err)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, os.FileMode(hdr.Mode).Perm()); err != nil {
+				return nil, fmt.Errorf("failed to create %s: %v", target, err)
+			}
+		case tar.TypeReg:
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(hdr.Mode).Perm())
+			if err != nil {
+				return nil, fmt.Errorf("failed to create %s: %v", target, err)
+			}
+			_, err = io.Copy(out, tr)
+			out.Close()
+			if err != nil {
+				return nil, fmt.Errorf("failed to extract %s: %v", hdr.Name, err)
+			}
+		case tar.TypeSymlink:
+			os.Remove(target)
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return nil, fmt.Errorf("failed to create symlink %s: %v", target, err)
+			}
+		case tar.TypeLink:
+			os.Remove(target)
+			if err := os.Link(filepath.Join(dest, filepath.Clean("/"+hdr.Linkname)), target); err != nil {
+				return nil, fmt.Errorf("failed to create hard link %s: %v", target, err)
+			}
+		default:
+			continue
+		}
+		extracted = append(extracted, target)
+	}
+
+	return extracted, nil
+}
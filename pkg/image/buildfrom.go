@@ -0,0 +1,241 @@
+package image
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"docker-impl/pkg/types"
+)
+
+// runtimeFiles are written into a container's rootfs when it starts, so
+// they are left out of what a container changed.
+var runtimeFiles = []string{"etc/hostname", "etc/hosts", "etc/resolv.conf"}
+
+// dispatchContainerBase starts the only stage of a build from a
+// container: its image, plus a layer holding what the container changed.
+func (b *builder) dispatchContainerBase(rootfs string) error {
+	if err := os.MkdirAll(rootfs, 0755); err != nil {
+		return fmt.Errorf("failed to create rootfs: %v", err)
+	}
+
+	base, err := b.manager.GetImage(b.options.FromImage)
+	if err != nil {
+		return fmt.Errorf("failed to get image of container %s: %v", b.options.FromContainer, err)
+	}
+
+	b.state = &buildState{
+		rootfs:     rootfs,
+		config:     copyImageConfig(base.Config),
+		layers:     append([]string(nil), base.Layers...),
+		history:    append([]types.ImageHistory(nil), base.History...),
+		size:       base.Size,
+		parent:     base.ID,
+		baseLayers: len(base.Layers),
+		baseSize:   base.Size,
+	}
+	b.stages = append(b.stages, b.state)
+	if err := b.manager.materializeLayers(b.state.layers, rootfs); err != nil {
+		return err
+	}
+
+	exclude := make(map[string]bool)
+	for _, path := range append(runtimeFiles, b.options.ContainerExclude...) {
+		exclude[strings.Trim(filepath.Clean("/"+path), "/")] = true
+	}
+	changed, deleted, err := diffTrees(rootfs, b.options.ContainerRootfs, exclude)
+	if err != nil {
+		return err
+	}
+	if err := applyTreeDiff(b.options.ContainerRootfs, rootfs, changed, deleted); err != nil {
+		return err
+	}
+	layerID, size, err := b.manager.commitLayer(rootfs, changed, deleted)
+	if err != nil {
+		return err
+	}
+
+	entry := types.ImageHistory{
+		Created:    time.Now(),
+		CreatedBy:  "buildfrom container " + b.options.FromContainer,
+		EmptyLayer: layerID == "",
+	}
+	if layerID != "" {
+		b.state.layers = append(b.state.layers, layerID)
+		b.state.size += size
+		entry.LayerID, entry.Size = layerID, size
+	}
+	b.state.history = append(b.state.history, entry)
+	// The container's changes aren't worth caching, but steps on top of
+	// the same changes are
+	b.state.cacheKey = hashStrings("FROM", base.ID, layerID)
+
+	b.emit(types.BuildEvent{Type: BuildEventLayer, Layer: layerID, Size: size,
+		Message: fmt.Sprintf("container %s: %d changed, %d deleted", b.options.FromContainer, len(changed), len(deleted))})
+	return nil
+}
+
+// diffTrees returns the paths under target that are new or differ from
+// base, and the paths of base missing from target, skipping the excluded
+// paths in both. Unlike diffSnapshot it compares contents, since the two
+// trees were written independently.
+func diffTrees(base, target string, exclude map[string]bool) ([]string, []string, error) {
+	seen := make(map[string]bool)
+	var changed []string
+
+	err := filepath.Walk(target, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(target, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		if exclude[rel] {
+			return skipEntry(info)
+		}
+		seen[rel] = true
+
+		same, err := sameEntry(filepath.Join(base, rel), path, info)
+		if err != nil {
+			return err
+		}
+		if !same {
+			changed = append(changed, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to compare %s: %v", target, err)
+	}
+
+	var deleted []string
+	err = filepath.Walk(base, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(base, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		if exclude[rel] {
+			return skipEntry(info)
+		}
+		if !seen[rel] {
+			deleted = append(deleted, rel)
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to compare %s: %v", base, err)
+	}
+
+	sort.Strings(changed)
+	sort.Strings(deleted)
+	return changed, prunePaths(deleted), nil
+}
+
+func skipEntry(info os.FileInfo) error {
+	if info.IsDir() {
+		return filepath.SkipDir
+	}
+	return nil
+}
+
+// sameEntry reports whether the entry at path in the base tree matches
+// the one described by info.
+func sameEntry(path, targetPath string, info os.FileInfo) (bool, error) {
+	baseInfo, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if baseInfo.Mode() != info.Mode() {
+		return false, nil
+	}
+
+	switch {
+	case info.IsDir():
+		return true, nil
+	case info.Mode()&os.ModeSymlink != 0:
+		baseLink, _ := os.Readlink(path)
+		link, _ := os.Readlink(targetPath)
+		return baseLink == link, nil
+	case info.Mode().IsRegular():
+		if baseInfo.Size() != info.Size() {
+			return false, nil
+		}
+		return sameContent(path, targetPath)
+	default:
+		// Special files aren't carried into layers either way
+		return true, nil
+	}
+}
+
+func sameContent(a, b string) (bool, error) {
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+
+	bufA, bufB := make([]byte, 32*1024), make([]byte, 32*1024)
+	for {
+		na, errA := io.ReadFull(fa, bufA)
+		nb, errB := io.ReadFull(fb, bufB)
+		if na != nb || !bytes.Equal(bufA[:na], bufB[:nb]) {
+			return false, nil
+		}
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			return errB == io.EOF || errB == io.ErrUnexpectedEOF, nil
+		}
+		if errA != nil {
+			return false, errA
+		}
+		if errB != nil {
+			return false, errB
+		}
+	}
+}
+
+// applyTreeDiff makes root match src by copying the changed paths over
+// and removing the deleted ones.
+func applyTreeDiff(src, root string, changed, deleted []string) error {
+	for _, rel := range deleted {
+		if err := os.RemoveAll(filepath.Join(root, rel)); err != nil {
+			return fmt.Errorf("failed to remove %s: %v", rel, err)
+		}
+	}
+	for _, rel := range changed {
+		info, err := os.Lstat(filepath.Join(src, rel))
+		if err != nil {
+			return fmt.Errorf("failed to stat %s: %v", rel, err)
+		}
+		dst := filepath.Join(root, rel)
+		// A path that changed type is replaced rather than copied over
+		if existing, err := os.Lstat(dst); err == nil && existing.IsDir() != info.IsDir() {
+			if err := os.RemoveAll(dst); err != nil {
+				return fmt.Errorf("failed to replace %s: %v", rel, err)
+			}
+		}
+		if err := copyPath(filepath.Join(src, rel), dst, info, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
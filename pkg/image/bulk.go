@@ -0,0 +1,123 @@
+package image
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"docker-impl/pkg/reference"
+	"docker-impl/pkg/types"
+)
+
+// DefaultPullParallelism is how many images PullAll pulls at once unless
+// told otherwise.
+const DefaultPullParallelism = 4
+
+// ReadPullList reads the images of a pull list: one reference per line,
+// by tag or digest, with blank lines and # comments skipped. References
+// listed twice are pulled once.
+func ReadPullList(r io.Reader) ([]string, error) {
+	var refs []string
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = text[:i]
+		}
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		ref, err := reference.ParseNormalized(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if !seen[ref.String()] {
+			seen[ref.String()] = true
+			refs = append(refs, text)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read pull list: %v", err)
+	}
+	return refs, nil
+}
+
+// PullEvent reports the progress of PullAll: an image starting or
+// finishing, with how many of Total are done.
+type PullEvent struct {
+	Reference string
+	// Status is pulling, pulled or failed
+	Status   string
+	Image    *types.Image
+	Error    error
+	Duration time.Duration
+	Done     int
+	Total    int
+}
+
+// PullResult is how the pull of one image went.
+type PullResult struct {
+	Reference string
+	Image     *types.Image
+	Error     error
+	Duration  time.Duration
+}
+
+// PullAll pulls refs for platform, parallel of them at once, and returns
+// how each went in the order given. progress, if set, is called as each
+// pull starts and ends, never concurrently.
+func (m *Manager) PullAll(refs []string, platform string, parallel int, progress func(PullEvent)) []PullResult {
+	if parallel <= 0 {
+		parallel = DefaultPullParallelism
+	}
+
+	results := make([]PullResult, len(refs))
+	var mu sync.Mutex
+	done := 0
+	report := func(event PullEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		if event.Status != "pulling" {
+			done++
+		}
+		event.Done, event.Total = done, len(refs)
+		if progress != nil {
+			progress(event)
+		}
+	}
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, parallel)
+	for i, arg := range refs {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, arg string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			report(PullEvent{Reference: arg, Status: "pulling"})
+			start := time.Now()
+			result := PullResult{Reference: arg}
+			ref, err := reference.ParseNormalized(arg)
+			if err == nil {
+				result.Image, err = m.PullReference(ref, platform)
+			}
+			result.Error = err
+			result.Duration = time.Since(start)
+			results[i] = result
+
+			status := "pulled"
+			if err != nil {
+				status = "failed"
+			}
+			report(PullEvent{Reference: arg, Status: status, Image: result.Image, Error: err, Duration: result.Duration})
+		}(i, arg)
+	}
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,265 @@
+package image
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Instruction is a single parsed Dockerfile instruction.
+type Instruction struct {
+	Command  string
+	Args     []string
+	Flags    map[string]string
+	JSON     bool
+	Original string
+	Line     int
+}
+
+func ParseDockerfileFile(path string) ([]Instruction, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open Dockerfile: %v", err)
+	}
+	defer file.Close()
+
+	return ParseDockerfile(file)
+}
+
+// ParseDockerfile splits a Dockerfile into instructions, joining continuation
+// lines and separating leading --flags from the arguments.
+func ParseDockerfile(r io.Reader) ([]Instruction, error) {
+	var instructions []Instruction
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var (
+		current   strings.Builder
+		startLine int
+		lineNo    int
+	)
+
+	flush := func() error {
+		text := strings.TrimSpace(current.String())
+		current.Reset()
+		if text == "" {
+			return nil
+		}
+
+		inst, err := parseInstruction(text)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", startLine, err)
+		}
+		inst.Line = startLine
+		instructions = append(instructions, inst)
+		return nil
+	}
+
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		trimmed := strings.TrimSpace(line)
+
+		if strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if current.Len() == 0 {
+			if trimmed == "" {
+				continue
+			}
+			startLine = lineNo
+		}
+
+		if strings.HasSuffix(line, "\\") {
+			current.WriteString(strings.TrimSuffix(line, "\\"))
+			current.WriteString(" ")
+			continue
+		}
+
+		current.WriteString(line)
+		if err := flush(); err != nil {
+			return nil, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read Dockerfile: %v", err)
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+
+	if len(instructions) == 0 {
+		return nil, fmt.Errorf("the Dockerfile has no instructions")
+	}
+
+	return instructions, nil
+}
+
+func parseInstruction(text string) (Instruction, error) {
+	fields := strings.SplitN(text, " ", 2)
+	inst := Instruction{
+		Command:  strings.ToUpper(fields[0]),
+		Flags:    make(map[string]string),
+		Original: text,
+	}
+
+	rest := ""
+	if len(fields) == 2 {
+		rest = strings.TrimSpace(fields[1])
+	}
+
+	// Leading --name=value flags, e.g. COPY --from=builder or ADD --chown=1:1
+	for strings.HasPrefix(rest, "--") {
+		parts := strings.SplitN(rest, " ", 2)
+		flag := strings.TrimPrefix(parts[0], "--")
+		kv := strings.SplitN(flag, "=", 2)
+		if len(kv) == 2 {
+			inst.Flags[kv[0]] = kv[1]
+		} else {
+			inst.Flags[kv[0]] = "true"
+		}
+
+		rest = ""
+		if len(parts) == 2 {
+			rest = strings.TrimSpace(parts[1])
+		}
+	}
+
+	if strings.HasPrefix(rest, "[") {
+		var args []string
+		if err := json.Unmarshal([]byte(rest), &args); err == nil {
+			inst.Args = args
+			inst.JSON = true
+			return inst, nil
+		}
+	}
+
+	switch inst.Command {
+	case "RUN", "CMD", "ENTRYPOINT", "HEALTHCHECK", "ONBUILD":
+		// Shell form keeps the command line intact, as do instructions
+		// that wrap another command or instruction
+		if rest != "" {
+			inst.Args = []string{rest}
+		}
+	default:
+		args, err := splitWords(rest)
+		if err != nil {
+			return inst, err
+		}
+		inst.Args = args
+	}
+
+	if len(inst.Args) == 0 && inst.Command != "CMD" && inst.Command != "ENTRYPOINT" {
+		return inst, fmt.Errorf("%s requires at least one argument", inst.Command)
+	}
+
+	return inst, nil
+}
+
+// splitWords splits on whitespace, honoring single and double quotes.
+func splitWords(s string) ([]string, error) {
+	var (
+		words   []string
+		current strings.Builder
+		quote   rune
+		inWord  bool
+		escaped bool
+	)
+
+	for _, r := range s {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, current.String())
+				current.Reset()
+				inWord = false
+			}
+		default:
+			current.WriteRune(r)
+			inWord = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in %q", s)
+	}
+	if inWord {
+		words = append(words, current.String())
+	}
+
+	return words, nil
+}
+
+// expandVars substitutes $VAR, ${VAR}, ${VAR:-default} and ${VAR:+alt}.
+func expandVars(s string, env []string) string {
+	values := make(map[string]string)
+	for _, kv := range env {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 {
+			values[parts[0]] = parts[1]
+		}
+	}
+
+	return os.Expand(s, func(name string) string {
+		if i := strings.Index(name, ":-"); i >= 0 {
+			if v := values[name[:i]]; v != "" {
+				return v
+			}
+			return name[i+2:]
+		}
+		if i := strings.Index(name, ":+"); i >= 0 {
+			if values[name[:i]] != "" {
+				return name[i+2:]
+			}
+			return ""
+		}
+		return values[name]
+	})
+}
+
+// parseKeyValues handles both "KEY=value KEY2=value2" and the legacy
+// "KEY value with spaces" forms used by ENV and LABEL.
+func parseKeyValues(args []string) (map[string]string, []string, error) {
+	values := make(map[string]string)
+	var order []string
+
+	if len(args) > 0 && !strings.Contains(args[0], "=") {
+		if len(args) < 2 {
+			return nil, nil, fmt.Errorf("missing value for %s", args[0])
+		}
+		values[args[0]] = strings.Join(args[1:], " ")
+		return values, []string{args[0]}, nil
+	}
+
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, nil, fmt.Errorf("invalid key=value pair: %s", arg)
+		}
+		if _, exists := values[parts[0]]; !exists {
+			order = append(order, parts[0])
+		}
+		values[parts[0]] = parts[1]
+	}
+
+	return values, order, nil
+}
@@ -0,0 +1,163 @@
+package image
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+type ignorePattern struct {
+	re      *regexp.Regexp
+	exclude bool
+}
+
+// DockerIgnore matches build context paths against .dockerignore rules.
+// Later rules win, and "!" re-includes a previously ignored path.
+type DockerIgnore struct {
+	patterns []ignorePattern
+}
+
+func LoadDockerIgnore(contextDir string) (*DockerIgnore, error) {
+	file, err := os.Open(filepath.Join(contextDir, ".dockerignore"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &DockerIgnore{}, nil
+		}
+		return nil, fmt.Errorf("failed to read .dockerignore: %v", err)
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read .dockerignore: %v", err)
+	}
+
+	return NewDockerIgnore(lines)
+}
+
+func NewDockerIgnore(lines []string) (*DockerIgnore, error) {
+	ignore := &DockerIgnore{}
+
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		exclude := false
+		if strings.HasPrefix(line, "!") {
+			exclude = true
+			line = strings.TrimSpace(line[1:])
+		}
+
+		pattern := filepath.ToSlash(filepath.Clean(line))
+		pattern = strings.TrimPrefix(pattern, "/")
+
+		re, err := regexp.Compile(globToRegexp(pattern))
+		if err != nil {
+			return nil, fmt.Errorf("invalid .dockerignore pattern %q: %v", line, err)
+		}
+		ignore.patterns = append(ignore.patterns, ignorePattern{re: re, exclude: exclude})
+	}
+
+	return ignore, nil
+}
+
+// Ignored reports whether a context-relative path is excluded. A path is
+// also excluded when one of its parent directories matches.
+func (d *DockerIgnore) Ignored(relPath string) bool {
+	if d == nil || len(d.patterns) == 0 {
+		return false
+	}
+
+	relPath = filepath.ToSlash(filepath.Clean(relPath))
+	if relPath == "." {
+		return false
+	}
+
+	ignored := false
+	for _, p := range d.patterns {
+		if matchPathOrParent(p.re, relPath) {
+			ignored = !p.exclude
+		}
+	}
+	return ignored
+}
+
+// HasExceptions reports whether any "!" rule exists, in which case ignored
+// directories still have to be walked to find re-included files.
+func (d *DockerIgnore) HasExceptions() bool {
+	if d == nil {
+		return false
+	}
+	for _, p := range d.patterns {
+		if p.exclude {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPathOrParent(re *regexp.Regexp, relPath string) bool {
+	for path := relPath; path != "." && path != "/"; path = filepath.ToSlash(filepath.Dir(path)) {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+func globToRegexp(pattern string) string {
+	var b strings.Builder
+	b.WriteString("^")
+
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				i++
+				if i+1 < len(pattern) && pattern[i+1] == '/' {
+					// "**/" matches zero or more directories
+					i++
+					b.WriteString("(.*/)?")
+				} else {
+					b.WriteString(".*")
+				}
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			j := strings.IndexByte(pattern[i:], ']')
+			if j < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+j]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += j
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				b.WriteString(regexp.QuoteMeta(string(pattern[i])))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	b.WriteString("$")
+	return b.String()
+}
@@ -0,0 +1,202 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// eStargz layers are gzip tarballs in which every file starts a new gzip
+// member, followed by a table of contents (TOC) locating each file and a
+// footer locating the TOC. A reader can fetch the footer and TOC with range
+// requests and then any file on its own, without the rest of the blob.
+const (
+	// AnnotationTOCDigest on a layer descriptor is the digest of the
+	// layer's uncompressed TOC JSON. Lazy pulling requires it, since it is
+	// what ties lazily fetched content to the (signed) manifest.
+	AnnotationTOCDigest = "containerd.io/snapshot/stargz/toc.digest"
+
+	estargzTOCName = "stargz.index.json"
+	// Files before the prefetch landmark are the ones the image needs to
+	// start and are fetched in one go; the no-prefetch landmark says there
+	// are none.
+	prefetchLandmark   = ".prefetch.landmark"
+	noPrefetchLandmark = ".no.prefetch.landmark"
+
+	estargzFooterSize = 51
+	// legacyFooterSize is the footer of the original stargz format
+	legacyFooterSize = 47
+)
+
+type estargzTOC struct {
+	Version int             `json:"version"`
+	Entries []*estargzEntry `json:"entries"`
+}
+
+// estargzEntry is one TOC entry. Regular files larger than the chunk size
+// are split into a "reg" entry followed by "chunk" entries of the same
+// name, each in its own gzip member starting at Offset.
+type estargzEntry struct {
+	Name        string            `json:"name"`
+	Type        string            `json:"type"`
+	Size        int64             `json:"size,omitempty"`
+	LinkName    string            `json:"linkName,omitempty"`
+	Mode        int64             `json:"mode,omitempty"`
+	UID         int               `json:"uid,omitempty"`
+	GID         int               `json:"gid,omitempty"`
+	Offset      int64             `json:"offset,omitempty"`
+	Digest      string            `json:"digest,omitempty"`
+	ChunkOffset int64             `json:"chunkOffset,omitempty"`
+	ChunkSize   int64             `json:"chunkSize,omitempty"`
+	ChunkDigest string            `json:"chunkDigest,omitempty"`
+	Xattrs      map[string][]byte `json:"xattrs,omitempty"`
+}
+
+// chunkLength is the uncompressed size of the entry's chunk; zero
+// ChunkSize means the rest of the file.
+func (e *estargzEntry) chunkLength(fileSize int64) int64 {
+	if e.ChunkSize > 0 {
+		return e.ChunkSize
+	}
+	return fileSize - e.ChunkOffset
+}
+
+// parseEstargzFooter returns the offset of the TOC and the size of the
+// footer found at the end of p, which must hold at least the last
+// estargzFooterSize bytes of the blob.
+func parseEstargzFooter(p []byte) (int64, int64, error) {
+	if len(p) >= estargzFooterSize {
+		extra, err := gzipExtra(p[len(p)-estargzFooterSize:])
+		if err == nil && len(extra) >= 4 && extra[0] == 'S' && extra[1] == 'G' &&
+			int(binary.LittleEndian.Uint16(extra[2:4])) == len(extra)-4 {
+			if offset, err := parseTOCOffset(extra[4:]); err == nil {
+				return offset, estargzFooterSize, nil
+			}
+		}
+	}
+	if len(p) >= legacyFooterSize {
+		extra, err := gzipExtra(p[len(p)-legacyFooterSize:])
+		if err == nil {
+			if offset, err := parseTOCOffset(extra); err == nil {
+				return offset, legacyFooterSize, nil
+			}
+		}
+	}
+	return 0, 0, fmt.Errorf("not an estargz layer: no footer found")
+}
+
+func gzipExtra(p []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(p))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return zr.Header.Extra, nil
+}
+
+// parseTOCOffset parses the footer's "%016xSTARGZ" field.
+func parseTOCOffset(field []byte) (int64, error) {
+	if len(field) != 22 || !bytes.HasSuffix(field, []byte("STARGZ")) {
+		return 0, fmt.Errorf("invalid footer field")
+	}
+	return strconv.ParseInt(string(field[:16]), 16, 64)
+}
+
+// parseEstargzTOC reads the TOC from its gzip member and checks it against
+// the digest from the layer descriptor.
+func parseEstargzTOC(member []byte, expected string) (*estargzTOC, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(member))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress TOC: %v", err)
+	}
+	defer zr.Close()
+
+	tr := tar.NewReader(zr)
+	header, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TOC: %v", err)
+	}
+	if header.Name != estargzTOCName {
+		return nil, fmt.Errorf("unexpected TOC entry %q", header.Name)
+	}
+	data, err := io.ReadAll(tr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TOC: %v", err)
+	}
+
+	if digest := digestBytes(data); digest != expected {
+		return nil, fmt.Errorf("TOC digest %s does not match %s", digest, expected)
+	}
+
+	var toc estargzTOC
+	if err := json.Unmarshal(data, &toc); err != nil {
+		return nil, fmt.Errorf("failed to parse TOC: %v", err)
+	}
+	for _, entry := range toc.Entries {
+		entry.Name = strings.TrimPrefix(strings.TrimPrefix(entry.Name, "./"), "/")
+	}
+	return &toc, nil
+}
+
+// chunkEnds maps the start of every gzip member holding file content to
+// the start of the next member, which bounds the range to fetch for it.
+// The TOC follows the last one.
+func (toc *estargzTOC) chunkEnds(tocOffset int64) map[int64]int64 {
+	var offsets []int64
+	for _, entry := range toc.Entries {
+		if entry.Offset > 0 {
+			offsets = append(offsets, entry.Offset)
+		}
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	ends := make(map[int64]int64, len(offsets))
+	for i, offset := range offsets {
+		if i+1 < len(offsets) {
+			ends[offset] = offsets[i+1]
+		} else {
+			ends[offset] = tocOffset
+		}
+	}
+	return ends
+}
+
+// prefetchEnd is the offset up to which the blob holds the files needed to
+// start the image, or zero when the layer has no prefetch landmark.
+func (toc *estargzTOC) prefetchEnd() int64 {
+	for _, entry := range toc.Entries {
+		switch entry.Name {
+		case prefetchLandmark:
+			return entry.Offset
+		case noPrefetchLandmark:
+			return 0
+		}
+	}
+	return 0
+}
+
+// decompressChunk returns the first length bytes of the gzip member at
+// the start of p and checks them against digest when it is known.
+func decompressChunk(p []byte, length int64, digest string) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(p))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress chunk: %v", err)
+	}
+	defer zr.Close()
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(zr, data); err != nil {
+		return nil, fmt.Errorf("failed to decompress chunk: %v", err)
+	}
+	if digest != "" && digestBytes(data) != digest {
+		return nil, fmt.Errorf("chunk does not match its digest %s", digest)
+	}
+	return data, nil
+}
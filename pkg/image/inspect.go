@@ -0,0 +1,102 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"docker-impl/pkg/types"
+)
+
+// InspectImage returns the config, layers and sizes of an image.
+func (m *Manager) InspectImage(ref string) (*types.ImageInspect, error) {
+	image, err := m.ResolveImage(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	diffIDs := imageDiffIDs(image)
+	config, err := json.Marshal(newImageConfigBlob(image, diffIDs))
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal image config: %v", err)
+	}
+
+	inspect := &types.ImageInspect{
+		ID:           image.ID,
+		RepoTags:     nonNil(image.RepoTags),
+		RepoDigests:  nonNil(image.RepoDigests),
+		Parent:       image.Parent,
+		Created:      image.CreatedAt,
+		Platform:     image.Platform,
+		Config:       config,
+		RootFS:       types.ImageRootFS{Type: "layers", DiffIDs: diffIDs},
+		Layers:       []types.ImageLayer{},
+		Labels:       image.Labels,
+		ExposedPorts: []string{},
+		SignedBy:     image.SignedBy,
+	}
+	for port := range image.Config.ExposedPorts {
+		inspect.ExposedPorts = append(inspect.ExposedPorts, port)
+	}
+	sort.Strings(inspect.ExposedPorts)
+
+	// Layers are shared with the parent as a prefix of the layer list
+	shared := 0
+	if image.Parent != "" {
+		if parent, err := m.GetImage(image.Parent); err == nil {
+			for shared < len(parent.Layers) && shared < len(image.Layers) && parent.Layers[shared] == image.Layers[shared] {
+				shared++
+			}
+		}
+	}
+
+	for i, layerID := range image.Layers {
+		layer := types.ImageLayer{
+			Digest: layerID,
+			DiffID: diffIDs[i],
+			Shared: i < shared,
+		}
+		for _, entry := range image.History {
+			if entry.LayerID == layerID {
+				layer.Size = entry.Size
+				layer.CreatedBy = entry.CreatedBy
+				break
+			}
+		}
+		if layer.Size == 0 {
+			layer.Size = m.layerSize(layerID)
+		}
+
+		inspect.Layers = append(inspect.Layers, layer)
+		inspect.VirtualSize += layer.Size
+		if !layer.Shared {
+			inspect.Size += layer.Size
+		}
+	}
+
+	// Images created before layer sizes were recorded only know the total
+	if inspect.VirtualSize == 0 && image.Size > 0 {
+		inspect.VirtualSize = image.Size
+		inspect.Size = image.Size
+	}
+
+	return inspect, nil
+}
+
+// layerSize measures a layer stored on disk. Layers of pulled images are
+// not extracted and have no directory.
+func (m *Manager) layerSize(layerID string) int64 {
+	dir := m.GetLayerDir(layerID)
+	if _, err := os.Stat(dir); err != nil {
+		return 0
+	}
+	return dirSize(dir)
+}
+
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
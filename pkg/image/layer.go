@@ -0,0 +1,344 @@
+package image
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	LayersDir = "layers"
+
+	whiteoutPrefix = ".wh."
+)
+
+type fileState struct {
+	mode    os.FileMode
+	size    int64
+	modTime int64
+	link    string
+}
+
+// snapshot records the state of every path under root so a later call to
+// diffSnapshot can tell what a build step changed.
+type snapshot map[string]fileState
+
+func (m *Manager) GetLayerDir(layerID string) string {
+	return filepath.Join(m.store.GetDataDir(), LayersDir, layerID)
+}
+
+func (m *Manager) LayerExists(layerID string) bool {
+	info, err := os.Stat(m.GetLayerDir(layerID))
+	return err == nil && info.IsDir()
+}
+
+func takeSnapshot(root string) (snapshot, error) {
+	snap := make(snapshot)
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		state := fileState{mode: info.Mode(), size: info.Size(), modTime: info.ModTime().UnixNano()}
+		if info.Mode()&os.ModeSymlink != 0 {
+			state.link, _ = os.Readlink(path)
+		}
+		snap[rel] = state
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to snapshot %s: %v", root, err)
+	}
+
+	return snap, nil
+}
+
+// diffSnapshot returns the paths added or modified since before, and the
+// paths that were removed.
+func diffSnapshot(root string, before snapshot) ([]string, []string, error) {
+	after, err := takeSnapshot(root)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var changed, deleted []string
+	for path, state := range after {
+		if old, ok := before[path]; !ok || old != state {
+			// A directory whose only change is its mtime is skipped; the
+			// children that changed are recorded on their own.
+			if state.mode.IsDir() && ok && old.mode == state.mode {
+				continue
+			}
+			changed = append(changed, path)
+		}
+	}
+	for path := range before {
+		if _, ok := after[path]; !ok {
+			deleted = append(deleted, path)
+		}
+	}
+
+	sort.Strings(changed)
+	sort.Strings(deleted)
+	return changed, prunePaths(deleted), nil
+}
+
+// prunePaths drops paths whose parent directory is also in the list.
+func prunePaths(paths []string) []string {
+	var result []string
+	for _, path := range paths {
+		if len(result) > 0 && strings.HasPrefix(path, result[len(result)-1]+string(filepath.Separator)) {
+			continue
+		}
+		result = append(result, path)
+	}
+	return result
+}
+
+// commitLayer copies the changed paths out of root into a new layer
+// directory, records deletions as whiteout files, and returns the layer ID
+// (a digest of the layer contents) and its size. An empty diff returns "".
+func (m *Manager) commitLayer(root string, changed, deleted []string) (string, int64, error) {
+	if len(changed) == 0 && len(deleted) == 0 {
+		return "", 0, nil
+	}
+
+	layersDir := filepath.Join(m.store.GetDataDir(), LayersDir)
+	if err := os.MkdirAll(layersDir, 0755); err != nil {
+		return "", 0, fmt.Errorf("failed to create layers directory: %v", err)
+	}
+
+	tmpDir, err := os.MkdirTemp(layersDir, "tmp-")
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create layer directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	hash := sha256.New()
+	var size int64
+
+	for _, rel := range changed {
+		info, err := os.Lstat(filepath.Join(root, rel))
+		if err != nil {
+			return "", 0, fmt.Errorf("failed to stat %s: %v", rel, err)
+		}
+		if err := copyPath(filepath.Join(root, rel), filepath.Join(tmpDir, rel), info, false); err != nil {
+			return "", 0, err
+		}
+
+		fmt.Fprintf(hash, "%s %o %d\n", rel, info.Mode(), info.Size())
+		if info.Mode().IsRegular() {
+			size += info.Size()
+			if err := hashFile(hash, filepath.Join(root, rel)); err != nil {
+				return "", 0, err
+			}
+		} else if info.Mode()&os.ModeSymlink != 0 {
+			link, _ := os.Readlink(filepath.Join(root, rel))
+			fmt.Fprintf(hash, "-> %s\n", link)
+		}
+	}
+
+	for _, rel := range deleted {
+		whiteout := filepath.Join(tmpDir, filepath.Dir(rel), whiteoutPrefix+filepath.Base(rel))
+		if err := os.MkdirAll(filepath.Dir(whiteout), 0755); err != nil {
+			return "", 0, fmt.Errorf("failed to create whiteout directory: %v", err)
+		}
+		if err := os.WriteFile(whiteout, nil, 0644); err != nil {
+			return "", 0, fmt.Errorf("failed to create whiteout for %s: %v", rel, err)
+		}
+		fmt.Fprintf(hash, "delete %s\n", rel)
+	}
+
+	layerID := hex.EncodeToString(hash.Sum(nil))
+	layerDir := m.GetLayerDir(layerID)
+	if m.LayerExists(layerID) {
+		return layerID, size, nil
+	}
+
+	if err := os.Rename(tmpDir, layerDir); err != nil {
+		return "", 0, fmt.Errorf("failed to commit layer: %v", err)
+	}
+
+	logrus.Debugf("Committed layer %s (%d bytes)", layerID, size)
+	return layerID, size, nil
+}
+
+// LayerContent returns the directory holding a layer's files, with .wh.
+// files for deletions. A lazily pulled layer is fetched in full and stored
+// first, since whoever asks needs all of it.
+func (m *Manager) LayerContent(layerID string) (string, error) {
+	if m.LayerExists(layerID) {
+		return m.GetLayerDir(layerID), nil
+	}
+	lazy, err := m.lazyLayer(layerID)
+	if err != nil {
+		return "", err
+	}
+	if lazy == nil {
+		return "", fmt.Errorf("layer %s has no content on disk", layerID)
+	}
+
+	layersDir := filepath.Join(m.store.GetDataDir(), LayersDir)
+	if err := os.MkdirAll(layersDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create layers directory: %v", err)
+	}
+	tmpDir, err := os.MkdirTemp(layersDir, "tmp-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create layer directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if err := lazy.apply(tmpDir, true); err != nil {
+		return "", fmt.Errorf("failed to fetch layer %s: %v", layerID, err)
+	}
+	if err := os.Rename(tmpDir, m.GetLayerDir(layerID)); err != nil && !m.LayerExists(layerID) {
+		return "", fmt.Errorf("failed to store layer %s: %v", layerID, err)
+	}
+	return m.GetLayerDir(layerID), nil
+}
+
+// materializeLayers applies the given layers in order onto dest.
+func (m *Manager) materializeLayers(layers []string, dest string) error {
+	for _, layerID := range layers {
+		layerDir := m.GetLayerDir(layerID)
+		if !m.LayerExists(layerID) {
+			lazy, err := m.lazyLayer(layerID)
+			if err != nil {
+				return err
+			}
+			if lazy == nil {
+				logrus.Warnf("Layer %s has no content on disk, skipping", layerID)
+				continue
+			}
+			if err := lazy.apply(dest, false); err != nil {
+				return fmt.Errorf("failed to apply layer %s: %v", layerID, err)
+			}
+			continue
+		}
+
+		err := filepath.Walk(layerDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(layerDir, path)
+			if err != nil || rel == "." {
+				return err
+			}
+
+			target := filepath.Join(dest, rel)
+			if name := filepath.Base(rel); strings.HasPrefix(name, whiteoutPrefix) {
+				deleted := filepath.Join(filepath.Dir(target), strings.TrimPrefix(name, whiteoutPrefix))
+				return os.RemoveAll(deleted)
+			}
+
+			if info.IsDir() {
+				if existing, err := os.Lstat(target); err == nil && !existing.IsDir() {
+					os.Remove(target)
+				}
+				if err := os.MkdirAll(target, info.Mode().Perm()); err != nil {
+					return err
+				}
+				return os.Chmod(target, info.Mode().Perm())
+			}
+
+			os.RemoveAll(target)
+			return copyPath(path, target, info, false)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to apply layer %s: %v", layerID, err)
+		}
+	}
+
+	return nil
+}
+
+// copyPath copies a single file, symlink or directory entry. Directories are
+// copied recursively only when recursive is set.
+func copyPath(src, dst string, info os.FileInfo, recursive bool) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %v", dst, err)
+	}
+
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		link, err := os.Readlink(src)
+		if err != nil {
+			return fmt.Errorf("failed to read symlink %s: %v", src, err)
+		}
+		os.Remove(dst)
+		return os.Symlink(link, dst)
+	case info.IsDir():
+		if err := os.MkdirAll(dst, info.Mode().Perm()); err != nil {
+			return fmt.Errorf("failed to create directory %s: %v", dst, err)
+		}
+		if err := os.Chmod(dst, info.Mode().Perm()); err != nil {
+			return err
+		}
+		if !recursive {
+			return nil
+		}
+		entries, err := os.ReadDir(src)
+		if err != nil {
+			return fmt.Errorf("failed to read directory %s: %v", src, err)
+		}
+		for _, entry := range entries {
+			childInfo, err := os.Lstat(filepath.Join(src, entry.Name()))
+			if err != nil {
+				return err
+			}
+			if err := copyPath(filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name()), childInfo, true); err != nil {
+				return err
+			}
+		}
+		return nil
+	case info.Mode().IsRegular():
+		return copyFile(src, dst, info.Mode().Perm())
+	default:
+		// Device nodes, sockets and pipes are not carried into layers
+		return nil
+	}
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", src, err)
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", dst, err)
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return fmt.Errorf("failed to copy %s: %v", src, err)
+	}
+	return os.Chmod(dst, mode)
+}
+
+func hashFile(w io.Writer, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(w, file); err != nil {
+		return fmt.Errorf("failed to hash %s: %v", path, err)
+	}
+	return nil
+}
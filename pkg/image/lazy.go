@@ -0,0 +1,380 @@
+package image
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"docker-impl/pkg/performance"
+	"github.com/sirupsen/logrus"
+)
+
+// LazyLayersDir holds the TOC and the fetched chunks of lazily pulled
+// layers.
+const LazyLayersDir = "lazy"
+
+// LazyLayer is an eStargz layer whose content stays in the registry until
+// it is read. Each file is fetched with a range request on first use and
+// its decompressed chunks are kept on disk.
+type LazyLayer struct {
+	Repository string `json:"repository"`
+	Digest     string `json:"digest"`
+	Size       int64  `json:"size"`
+	TOCDigest  string `json:"toc_digest"`
+	TOCOffset  int64  `json:"toc_offset"`
+
+	dir   string
+	toc   *estargzTOC
+	ends  map[int64]int64
+	files map[string][]*estargzEntry
+	fetch func(offset, length int64) ([]byte, error)
+}
+
+// SetLazyPull makes pulls fetch only the table of contents of eStargz
+// layers that carry a TOC digest; their files are fetched when read.
+// Other layers are pulled as before.
+func (m *Manager) SetLazyPull(enabled bool) {
+	m.lazyPull = enabled
+}
+
+// SetPrefetcher has the prefetch workers fetch the files a lazily pulled
+// image needs to start, as marked by its prefetch landmark, right after
+// the pull.
+func (m *Manager) SetPrefetcher(prefetcher *performance.PrefetchManager) {
+	m.prefetcher = prefetcher
+}
+
+func lazyLayerPath(digest, name string) string {
+	return filepath.Join(LazyLayersDir, strings.Replace(digest, ":", "_", 1), name)
+}
+
+// prepareLazyLayers fetches the footer and TOC of the eStargz layers of a
+// manifest, checking each TOC against the digest in its descriptor.
+func (m *Manager) prepareLazyLayers(repository string, layers []Descriptor) ([]*LazyLayer, error) {
+	var prepared []*LazyLayer
+	for _, desc := range layers {
+		tocDigest := desc.Annotations[AnnotationTOCDigest]
+		if tocDigest == "" || m.LayerExists(desc.Digest) {
+			logrus.Debugf("Layer %s is not a lazily pullable eStargz layer", desc.Digest)
+			continue
+		}
+
+		layer, err := m.lazyLayer(desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		if layer == nil {
+			if layer, err = m.openLazyLayer(repository, desc, tocDigest); err != nil {
+				return nil, fmt.Errorf("failed to lazily pull layer %s: %v", desc.Digest, err)
+			}
+		} else if layer.TOCDigest != tocDigest {
+			return nil, fmt.Errorf("layer %s has TOC digest %s, not %s", desc.Digest, layer.TOCDigest, tocDigest)
+		}
+		prepared = append(prepared, layer)
+	}
+	return prepared, nil
+}
+
+func (m *Manager) openLazyLayer(repository string, desc Descriptor, tocDigest string) (*LazyLayer, error) {
+	if desc.Size < estargzFooterSize {
+		return nil, fmt.Errorf("layer is too small to be an eStargz layer")
+	}
+	footer, err := m.registry.GetBlobRange(repository, desc.Digest, desc.Size-estargzFooterSize, estargzFooterSize)
+	if err != nil {
+		return nil, err
+	}
+	tocOffset, footerSize, err := parseEstargzFooter(footer)
+	if err != nil {
+		return nil, err
+	}
+	if tocOffset <= 0 || tocOffset >= desc.Size-footerSize {
+		return nil, fmt.Errorf("TOC offset %d is out of range", tocOffset)
+	}
+
+	member, err := m.registry.GetBlobRange(repository, desc.Digest, tocOffset, desc.Size-footerSize-tocOffset)
+	if err != nil {
+		return nil, err
+	}
+	toc, err := parseEstargzTOC(member, tocDigest)
+	if err != nil {
+		return nil, err
+	}
+
+	layer := &LazyLayer{
+		Repository: repository,
+		Digest:     desc.Digest,
+		Size:       desc.Size,
+		TOCDigest:  tocDigest,
+		TOCOffset:  tocOffset,
+	}
+	if err := m.store.SaveJSON(lazyLayerPath(desc.Digest, "toc.json"), toc); err != nil {
+		return nil, fmt.Errorf("failed to save TOC: %v", err)
+	}
+	if err := m.store.SaveJSON(lazyLayerPath(desc.Digest, "layer.json"), layer); err != nil {
+		return nil, fmt.Errorf("failed to save lazy layer: %v", err)
+	}
+
+	m.initLazyLayer(layer, toc)
+	logrus.Infof("Lazily pulled layer %s (%d entries)", desc.Digest, len(toc.Entries))
+	return layer, nil
+}
+
+// lazyLayer returns the lazily pulled layer with the given digest, or nil
+// if the layer wasn't pulled lazily.
+func (m *Manager) lazyLayer(digest string) (*LazyLayer, error) {
+	m.lazyMu.Lock()
+	layer := m.lazyLayers[digest]
+	m.lazyMu.Unlock()
+	if layer != nil {
+		return layer, nil
+	}
+
+	if !m.store.FileExists(lazyLayerPath(digest, "layer.json")) {
+		return nil, nil
+	}
+	layer = &LazyLayer{}
+	if err := m.store.LoadJSON(lazyLayerPath(digest, "layer.json"), layer); err != nil {
+		return nil, fmt.Errorf("failed to load lazy layer %s: %v", digest, err)
+	}
+	var toc estargzTOC
+	if err := m.store.LoadJSON(lazyLayerPath(digest, "toc.json"), &toc); err != nil {
+		return nil, fmt.Errorf("failed to load TOC of layer %s: %v", digest, err)
+	}
+	m.initLazyLayer(layer, &toc)
+	return layer, nil
+}
+
+func (m *Manager) initLazyLayer(layer *LazyLayer, toc *estargzTOC) {
+	layer.dir = filepath.Join(m.store.GetDataDir(), lazyLayerPath(layer.Digest, ""))
+	layer.toc = toc
+	layer.ends = toc.chunkEnds(layer.TOCOffset)
+	layer.files = make(map[string][]*estargzEntry)
+	for _, entry := range toc.Entries {
+		switch entry.Type {
+		case "reg":
+			layer.files[entry.Name] = []*estargzEntry{entry}
+		case "chunk":
+			layer.files[entry.Name] = append(layer.files[entry.Name], entry)
+		}
+	}
+	layer.fetch = func(offset, length int64) ([]byte, error) {
+		if m.registry == nil {
+			return nil, fmt.Errorf("layer %s is only partially pulled and no registry is configured", layer.Digest)
+		}
+		return m.registry.GetBlobRange(layer.Repository, layer.Digest, offset, length)
+	}
+
+	m.lazyMu.Lock()
+	if m.lazyLayers == nil {
+		m.lazyLayers = make(map[string]*LazyLayer)
+	}
+	m.lazyLayers[layer.Digest] = layer
+	m.lazyMu.Unlock()
+}
+
+func (m *Manager) removeLazyLayer(digest string) {
+	m.lazyMu.Lock()
+	delete(m.lazyLayers, digest)
+	m.lazyMu.Unlock()
+	os.RemoveAll(filepath.Join(m.store.GetDataDir(), lazyLayerPath(digest, "")))
+}
+
+// prefetchLazyLayers queues the startup files of the layers with the
+// prefetcher, when there is one.
+func (m *Manager) prefetchLazyLayers(layers []*LazyLayer) {
+	if m.prefetcher == nil {
+		return
+	}
+	for _, layer := range layers {
+		if layer.toc.prefetchEnd() > 0 {
+			m.prefetcher.Prefetch(performance.PrefetchJob{Key: layer.Digest, Fetch: layer.prefetch})
+		}
+	}
+}
+
+// ReadFile returns the content of a regular file of the layer, fetching
+// the chunks not on disk yet.
+func (l *LazyLayer) ReadFile(name string) ([]byte, error) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	chunks, ok := l.files[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: no such file in layer %s", name, l.Digest)
+	}
+
+	size := chunks[0].Size
+	data := make([]byte, 0, size)
+	for _, chunk := range chunks {
+		part, err := l.readChunk(chunk, size)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", name, err)
+		}
+		data = append(data, part...)
+	}
+	if int64(len(data)) != size {
+		return nil, fmt.Errorf("failed to read %s: got %d of %d bytes", name, len(data), size)
+	}
+	return data, nil
+}
+
+func (l *LazyLayer) chunkPath(offset int64) string {
+	return filepath.Join(l.dir, "chunks", strconv.FormatInt(offset, 10))
+}
+
+// chunkDigest is the digest the chunk's content must match: its own, or
+// the file's when the file is a single chunk.
+func chunkDigest(entry *estargzEntry, fileSize int64) string {
+	if entry.ChunkDigest != "" {
+		return entry.ChunkDigest
+	}
+	if entry.ChunkOffset == 0 && entry.chunkLength(fileSize) == fileSize {
+		return entry.Digest
+	}
+	return ""
+}
+
+func (l *LazyLayer) readChunk(entry *estargzEntry, fileSize int64) ([]byte, error) {
+	length := entry.chunkLength(fileSize)
+	if length == 0 {
+		return nil, nil
+	}
+	if data, err := os.ReadFile(l.chunkPath(entry.Offset)); err == nil && int64(len(data)) == length {
+		return data, nil
+	}
+
+	end, ok := l.ends[entry.Offset]
+	if !ok || entry.Offset == 0 {
+		return nil, fmt.Errorf("no content offset for chunk at %d", entry.ChunkOffset)
+	}
+	compressed, err := l.fetch(entry.Offset, end-entry.Offset)
+	if err != nil {
+		return nil, err
+	}
+	data, err := decompressChunk(compressed, length, chunkDigest(entry, fileSize))
+	if err != nil {
+		return nil, err
+	}
+	return data, l.storeChunk(entry.Offset, data)
+}
+
+func (l *LazyLayer) storeChunk(offset int64, data []byte) error {
+	target := l.chunkPath(offset)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("failed to create chunk directory: %v", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(target), "tmp-")
+	if err != nil {
+		return fmt.Errorf("failed to store chunk: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to store chunk: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to store chunk: %v", err)
+	}
+	return os.Rename(tmp.Name(), target)
+}
+
+// prefetch fetches the files before the prefetch landmark, which eStargz
+// places at the start of the blob, with a single range request.
+func (l *LazyLayer) prefetch() error {
+	end := l.toc.prefetchEnd()
+	if end <= 0 {
+		return nil
+	}
+	blob, err := l.fetch(0, end)
+	if err != nil {
+		return err
+	}
+
+	for _, chunks := range l.files {
+		size := chunks[0].Size
+		for _, chunk := range chunks {
+			chunkEnd := l.ends[chunk.Offset]
+			if chunk.Offset == 0 || chunkEnd > end {
+				continue
+			}
+			data, err := decompressChunk(blob[chunk.Offset:chunkEnd], chunk.chunkLength(size), chunkDigest(chunk, size))
+			if err != nil {
+				return fmt.Errorf("failed to prefetch %s: %v", chunk.Name, err)
+			}
+			if err := l.storeChunk(chunk.Offset, data); err != nil {
+				return err
+			}
+		}
+	}
+	logrus.Debugf("Prefetched %d bytes of layer %s", end, l.Digest)
+	return nil
+}
+
+// apply writes the layer's files onto dest, fetching their content as it
+// goes. Whiteouts delete what lower layers put there, unless keepWhiteouts
+// is set and they are written as files like the rest.
+func (l *LazyLayer) apply(dest string, keepWhiteouts bool) error {
+	for _, entry := range l.toc.Entries {
+		name := entry.Name
+		if name == "" || name == prefetchLandmark || name == noPrefetchLandmark || entry.Type == "chunk" {
+			continue
+		}
+
+		target := filepath.Join(dest, filepath.Clean("/"+name))
+		if base := filepath.Base(target); strings.HasPrefix(base, whiteoutPrefix) && !keepWhiteouts {
+			if err := os.RemoveAll(filepath.Join(filepath.Dir(target), strings.TrimPrefix(base, whiteoutPrefix))); err != nil {
+				return err
+			}
+			continue
+		}
+		if entry.Type != "dir" {
+			os.RemoveAll(target)
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+		}
+
+		mode := os.FileMode(entry.Mode).Perm()
+		switch entry.Type {
+		case "dir":
+			if existing, err := os.Lstat(target); err == nil && !existing.IsDir() {
+				os.Remove(target)
+			}
+			if mode == 0 {
+				mode = 0755
+			}
+			if err := os.MkdirAll(target, mode); err != nil {
+				return err
+			}
+			if err := os.Chmod(target, mode); err != nil {
+				return err
+			}
+		case "reg":
+			data, err := l.ReadFile(name)
+			if err != nil {
+				return err
+			}
+			if mode == 0 {
+				mode = 0644
+			}
+			if err := os.WriteFile(target, data, mode); err != nil {
+				return err
+			}
+			if err := os.Chmod(target, mode); err != nil {
+				return err
+			}
+		case "symlink":
+			if err := os.Symlink(entry.LinkName, target); err != nil {
+				return err
+			}
+		case "hardlink":
+			if err := os.Link(filepath.Join(dest, filepath.Clean("/"+entry.LinkName)), target); err != nil {
+				return err
+			}
+		default:
+			logrus.Debugf("Skipping %s entry %s of layer %s", entry.Type, name, l.Digest)
+		}
+	}
+	return nil
+}
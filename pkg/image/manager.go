@@ -1,20 +1,33 @@
 package image
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"docker-impl/pkg/performance"
+	"docker-impl/pkg/reference"
 	"docker-impl/pkg/store"
 	"docker-impl/pkg/types"
 )
 
 type Manager struct {
-	store *store.Store
+	store    *store.Store
+	registry *RegistryClient
+	// refMu serializes updates to the references file
+	refMu    sync.Mutex
+	trust    *TrustPolicy
+	// trustTTL is how long cached trust data stays valid offline
+	trustTTL     time.Duration
+	trustOffline bool
+	lazyPull     bool
+	prefetcher   *performance.PrefetchManager
+	lazyMu       sync.Mutex
+	lazyLayers   map[string]*LazyLayer
 }
 
 func NewManager(store *store.Store) *Manager {
@@ -23,15 +36,20 @@ func NewManager(store *store.Store) *Manager {
 	}
 }
 
+// SetRegistry enables pulling from a remote registry. Without one, pulls
+// create a local placeholder image.
+func (m *Manager) SetRegistry(registry *RegistryClient) {
+	m.registry = registry
+}
+
+func (m *Manager) Registry() *RegistryClient {
+	return m.registry
+}
+
 func (m *Manager) CreateImage(imageName, tag string, config types.ImageConfig) (*types.Image, error) {
 	logrus.Infof("Creating image: %s:%s", imageName, tag)
 
-	imageID := m.generateImageID(imageName, tag)
-
 	image := &types.Image{
-		ID:        imageID,
-		Name:      imageName,
-		Tag:       tag,
 		Size:      0,
 		CreatedAt: time.Now(),
 		Config:    config,
@@ -39,16 +57,36 @@ func (m *Manager) CreateImage(imageName, tag string, config types.ImageConfig) (
 		Labels:    config.Labels,
 	}
 
-	imagePath := filepath.Join("images", fmt.Sprintf("%s.json", imageID))
-	if err := m.store.SaveJSON(imagePath, image); err != nil {
-		return nil, fmt.Errorf("failed to save image metadata: %v", err)
+	var tags []string
+	if imageName != "" && imageName != "<none>" {
+		tags = append(tags, imageName+":"+tag)
 	}
 
-	logrus.Infof("Image created successfully: %s", imageID)
+	image, err := m.registerImage(image, "", tags, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	logrus.Infof("Image created successfully: %s", image.ID)
 	return image, nil
 }
 
 func (m *Manager) GetImage(imageID string) (*types.Image, error) {
+	image, err := m.loadImageRecord(imageID)
+	if err != nil {
+		return nil, err
+	}
+
+	refs, err := m.loadReferences()
+	if err != nil {
+		return nil, err
+	}
+	refs.decorate(image)
+
+	return image, nil
+}
+
+func (m *Manager) loadImageRecord(imageID string) (*types.Image, error) {
 	imagePath := filepath.Join("images", fmt.Sprintf("%s.json", imageID))
 
 	var image types.Image
@@ -60,22 +98,26 @@ func (m *Manager) GetImage(imageID string) (*types.Image, error) {
 }
 
 func (m *Manager) ListImages() ([]*types.Image, error) {
-	imagesDir := m.store.GetImagesDir()
-
 	files, err := m.store.ListFiles("images")
 	if err != nil {
 		return nil, fmt.Errorf("failed to list images: %v", err)
 	}
 
+	refs, err := m.loadReferences()
+	if err != nil {
+		return nil, err
+	}
+
 	var images []*types.Image
 	for _, file := range files {
 		if filepath.Ext(file) == ".json" {
 			imageID := file[:len(file)-5]
-			image, err := m.GetImage(imageID)
+			image, err := m.loadImageRecord(imageID)
 			if err != nil {
 				logrus.Warnf("Failed to load image %s: %v", imageID, err)
 				continue
 			}
+			refs.decorate(image)
 			images = append(images, image)
 		}
 	}
@@ -96,12 +138,49 @@ func (m *Manager) RemoveImage(imageID string) error {
 		return fmt.Errorf("failed to remove image file: %v", err)
 	}
 
+	if err := m.removeReferences(image.ID); err != nil {
+		return err
+	}
+
 	logrus.Infof("Image removed successfully: %s", image.Name)
 	return nil
 }
 
 func (m *Manager) PullImage(imageName, tag string) (*types.Image, error) {
-	logrus.Infof("Pulling image: %s:%s", imageName, tag)
+	return m.PullImageForPlatform(imageName, tag, "")
+}
+
+// PullImageForPlatform pulls imageName with a tag, or with a digest when
+// tag contains a colon.
+func (m *Manager) PullImageForPlatform(imageName, tag, platform string) (*types.Image, error) {
+	ref, err := normalizeReference(imageName, tag)
+	if err != nil {
+		return nil, err
+	}
+	return m.PullReference(ref, platform)
+}
+
+// PullReference pulls a normalized reference. Local references are kept
+// under the familiar name, so docker.io/library/alpine and alpine are the
+// same image.
+func (m *Manager) PullReference(ref *reference.Reference, platform string) (*types.Image, error) {
+	logrus.Infof("Pulling image: %s", ref)
+
+	target, err := ParsePlatform(platform)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.registry != nil {
+		return m.pullFromRegistry(ref, target)
+	}
+	if ref.Digest != "" {
+		return nil, fmt.Errorf("pulling %s by digest requires a registry", ref.FamiliarString())
+	}
+	if _, err := m.verifyPull(ref, ""); err != nil {
+		return nil, err
+	}
+	imageName, tag := ref.FamiliarName(), ref.Tag
 
 	config := types.ImageConfig{
 		Env:        []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"},
@@ -112,7 +191,21 @@ func (m *Manager) PullImage(imageName, tag string) (*types.Image, error) {
 		},
 	}
 
-	image, err := m.CreateImage(imageName, tag, config)
+	image := &types.Image{
+		CreatedAt: time.Now(),
+		Config:    config,
+		Layers:    []string{"base-layer"},
+		Labels:    config.Labels,
+		Platform:  target,
+	}
+	image.History = []types.ImageHistory{{
+		LayerID:   image.Layers[0],
+		Created:   image.CreatedAt,
+		CreatedBy: fmt.Sprintf("pull %s:%s", imageName, tag),
+		Comment:   "placeholder layer, no registry configured",
+	}}
+
+	image, err = m.registerImage(image, "", []string{imageName + ":" + tag}, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create image during pull: %v", err)
 	}
@@ -121,24 +214,140 @@ func (m *Manager) PullImage(imageName, tag string) (*types.Image, error) {
 	return image, nil
 }
 
-func (m *Manager) BuildImage(options types.ImageBuildOptions) (*types.Image, error) {
-	logrus.Infof("Building image with context: %s", options.ContextDir)
+func (m *Manager) pullFromRegistry(ref *reference.Reference, target types.Platform) (*types.Image, error) {
+	imageName, repository := ref.FamiliarName(), ref.Path
 
-	config := types.ImageConfig{
-		Env:        []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"},
-		Cmd:        []string{"/bin/sh"},
-		WorkingDir: "/",
-		Labels:     options.Labels,
+	data, mediaType, digest, err := m.registry.GetManifest(repository, ref.TagOrDigest())
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch manifest for %s: %v", ref.FamiliarString(), err)
+	}
+
+	// Signatures are verified over the manifest as received, never over
+	// a digest the registry only claims for it
+	digest, err = manifestDigest(data, digest)
+	if err != nil {
+		return nil, fmt.Errorf("manifest for %s: %v", ref.FamiliarString(), err)
+	}
+	byDigest := ref.Digest != ""
+	if byDigest && strings.HasPrefix(ref.Digest, "sha256:") && digest != ref.Digest {
+		return nil, fmt.Errorf("manifest for %s does not match its digest", ref.FamiliarString())
+	}
+	digests := []string{imageName + "@" + digest}
+
+	signedBy, err := m.verifyPull(ref, digest)
+	if err != nil {
+		return nil, err
+	}
+
+	if IsManifestList(mediaType) {
+		var list ManifestList
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, fmt.Errorf("failed to parse manifest list: %v", err)
+		}
+
+		desc, err := SelectManifest(&list, target)
+		if err != nil {
+			return nil, err
+		}
+		logrus.Infof("Resolved %s to %s for platform %s", ref.FamiliarString(), desc.Digest, desc.Platform)
+
+		data, mediaType, digest, err = m.registry.GetManifest(repository, desc.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch manifest %s: %v", desc.Digest, err)
+		}
+		// The list was verified, so the manifest must be the one it names
+		digest, err = manifestDigest(data, digest)
+		if err != nil {
+			return nil, fmt.Errorf("manifest %s: %v", desc.Digest, err)
+		}
+		if digest != desc.Digest {
+			return nil, fmt.Errorf("manifest %s does not match its digest in the manifest list, got %s", desc.Digest, digest)
+		}
+		digests = append(digests, imageName+"@"+digest)
+	}
+
+	if mediaType != MediaTypeDockerManifest && mediaType != MediaTypeOCIManifest {
+		return nil, fmt.Errorf("unsupported manifest media type: %s", mediaType)
 	}
 
-	tag := "latest"
-	if len(options.Tags) > 0 {
-		tag = options.Tags[0]
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %v", err)
 	}
 
-	image, err := m.CreateImage("built-image", tag, config)
+	configData, err := m.registry.GetBlob(repository, manifest.Config.Digest)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create image during build: %v", err)
+		return nil, fmt.Errorf("failed to fetch image config: %v", err)
+	}
+
+	var blob imageConfigBlob
+	if err := json.Unmarshal(configData, &blob); err != nil {
+		return nil, fmt.Errorf("failed to parse image config: %v", err)
+	}
+
+	resolved := blob.platform()
+	if !platformMatches(target, resolved) {
+		return nil, fmt.Errorf("image %s is %s, which does not match requested platform %s", ref.FamiliarString(), resolved, target)
+	}
+
+	image := &types.Image{
+		CreatedAt: blob.Created,
+		Config:    blob.imageConfig(),
+		Labels:    blob.Config.Labels,
+		Platform:  resolved,
+		Digest:    digest,
+		SignedBy:  signedBy,
+		DiffIDs:   blob.RootFS.DiffIDs,
+	}
+	if image.CreatedAt.IsZero() {
+		image.CreatedAt = time.Now()
+	}
+	var sizes []int64
+	for _, layer := range manifest.Layers {
+		image.Layers = append(image.Layers, layer.Digest)
+		image.Size += layer.Size
+		sizes = append(sizes, layer.Size)
+	}
+	image.History = blob.imageHistory(image.Layers, sizes)
+
+	var lazyLayers []*LazyLayer
+	if m.lazyPull {
+		if lazyLayers, err = m.prepareLazyLayers(repository, manifest.Layers); err != nil {
+			return nil, err
+		}
+	}
+
+	var tags []string
+	if !byDigest {
+		tags = append(tags, imageName+":"+ref.Tag)
+	}
+
+	// The image ID is the digest of the config as served
+	image, err = m.registerImage(image, digestBytes(configData), tags, digests)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create image during pull: %v", err)
+	}
+	if err := m.markSigned(image, signedBy); err != nil {
+		return nil, err
+	}
+	m.prefetchLazyLayers(lazyLayers)
+
+	logrus.Infof("Image pulled successfully: %s (%s)", image.ID, resolved)
+	return image, nil
+}
+
+func (m *Manager) BuildImage(options types.ImageBuildOptions) (*types.Image, error) {
+	logrus.Infof("Building image with context: %s", options.ContextDir)
+
+	b, err := newBuilder(m, options)
+	if err != nil {
+		return nil, err
+	}
+
+	image, err := b.build()
+	if err != nil {
+		b.emit(types.BuildEvent{Type: BuildEventError, Step: b.step, Message: err.Error()})
+		return nil, fmt.Errorf("failed to build image: %v", err)
 	}
 
 	logrus.Infof("Image built successfully: %s", image.ID)
@@ -148,22 +357,134 @@ func (m *Manager) BuildImage(options types.ImageBuildOptions) (*types.Image, err
 func (m *Manager) TagImage(sourceImageID, targetRepository, targetTag string) error {
 	logrus.Infof("Tagging image %s as %s:%s", sourceImageID, targetRepository, targetTag)
 
+	ref, err := normalizeReference(targetRepository, targetTag)
+	if err != nil {
+		return err
+	}
+	if ref.Digest != "" {
+		return fmt.Errorf("cannot tag an image with a digest: %s", ref.FamiliarString())
+	}
+
 	sourceImage, err := m.GetImage(sourceImageID)
 	if err != nil {
 		return fmt.Errorf("failed to get source image: %v", err)
 	}
 
-	newImage := *sourceImage
-	newImage.Name = targetRepository
-	newImage.Tag = targetTag
-	newImage.ID = m.generateImageID(targetRepository, targetTag)
+	if err := m.addReferences(sourceImage.ID, []string{ref.FamiliarString()}, nil); err != nil {
+		return fmt.Errorf("failed to tag image: %v", err)
+	}
+
+	logrus.Infof("Image tagged successfully: %s", sourceImage.ID)
+	return nil
+}
+
+// UntagImage removes one tag or digest reference and returns the ID of the
+// image it named. The image itself stays, even without references.
+func (m *Manager) UntagImage(ref string) (string, error) {
+	parsed, err := reference.ParseNormalized(ref)
+	if err != nil {
+		return "", err
+	}
+
+	imageID, err := m.removeReference(parsed)
+	if err != nil {
+		return "", err
+	}
+
+	logrus.Infof("Untagged %s from image %s", parsed.FamiliarString(), imageID)
+	return imageID, nil
+}
+
+// RemoveImageReference removes what ref names. A tag or digest only loses
+// that reference; the image goes with its last tag unless other images
+// were built on it. An image ID removes the image and every reference to
+// it, which takes force when it is tagged in more than one repository.
+func (m *Manager) RemoveImageReference(ref string, force bool) (*types.ImageDeleteReport, error) {
+	report := &types.ImageDeleteReport{Untagged: []string{}}
+
+	if id := strings.TrimPrefix(ref, "sha256:"); m.ImageExists(id) {
+		image, err := m.GetImage(id)
+		if err != nil {
+			return nil, err
+		}
+
+		repositories := make(map[string]bool)
+		for _, tag := range image.RepoTags {
+			name, _ := parseNameTag(tag)
+			repositories[name] = true
+		}
+		if len(repositories) > 1 && !force {
+			return nil, fmt.Errorf("image %s is referenced in %d repositories, remove it with force or untag it first", image.ID[:12], len(repositories))
+		}
+		if err := m.checkNoChildren(image.ID); err != nil {
+			return nil, err
+		}
+
+		if err := m.RemoveImage(image.ID); err != nil {
+			return nil, err
+		}
+		report.Untagged = append(report.Untagged, image.RepoTags...)
+		report.Untagged = append(report.Untagged, image.RepoDigests...)
+		report.Deleted = image.ID
+		return report, nil
+	}
+
+	parsed, err := reference.ParseNormalized(ref)
+	if err != nil {
+		return nil, err
+	}
+	imageID, err := m.UntagImage(ref)
+	if err != nil {
+		return nil, err
+	}
+	report.Untagged = append(report.Untagged, parsed.FamiliarString())
+
+	image, err := m.GetImage(imageID)
+	if err != nil {
+		return nil, err
+	}
+	if len(image.RepoTags) > 0 {
+		return report, nil
+	}
+	if err := m.checkNoChildren(image.ID); err != nil {
+		logrus.Infof("Keeping untagged image %s: %v", image.ID, err)
+		return report, nil
+	}
 
-	imagePath := filepath.Join("images", fmt.Sprintf("%s.json", newImage.ID))
-	if err := m.store.SaveJSON(imagePath, newImage); err != nil {
-		return fmt.Errorf("failed to save tagged image: %v", err)
+	if err := m.RemoveImage(image.ID); err != nil {
+		return nil, err
 	}
+	report.Untagged = append(report.Untagged, image.RepoDigests...)
+	report.Deleted = image.ID
+	return report, nil
+}
 
-	logrus.Infof("Image tagged successfully: %s", newImage.ID)
+// checkNoChildren fails when another image was built on imageID.
+func (m *Manager) checkNoChildren(imageID string) error {
+	images, err := m.ListImages()
+	if err != nil {
+		return err
+	}
+	for _, image := range images {
+		if image.Parent == imageID {
+			return fmt.Errorf("image %s has dependent child image %s", imageID[:12], image.ID[:12])
+		}
+	}
+	return nil
+}
+
+// saveImage writes the image record. References live in their own file, so
+// the names on image are not stored.
+func (m *Manager) saveImage(image *types.Image) error {
+	record := *image
+	record.Name, record.Tag = "", ""
+	record.RepoTags, record.RepoDigests = nil, nil
+
+	imagePath := filepath.Join("images", fmt.Sprintf("%s.json", image.ID))
+	if err := m.store.SaveJSON(imagePath, record); err != nil {
+		return fmt.Errorf("failed to save image metadata: %v", err)
+	}
+	m.indexImages(image.ID)
 	return nil
 }
 
@@ -172,25 +493,59 @@ func (m *Manager) ImageExists(imageID string) bool {
 	return m.store.FileExists(imagePath)
 }
 
+// GetImageByName looks up imageName with a tag, or with a digest when tag
+// contains a colon.
 func (m *Manager) GetImageByName(imageName, tag string) (*types.Image, error) {
-	images, err := m.ListImages()
+	ref, err := normalizeReference(imageName, tag)
 	if err != nil {
-		return nil, fmt.Errorf("failed to list images: %v", err)
+		return nil, err
 	}
+	imageName, tag = ref.FamiliarName(), ref.TagOrDigest()
 
-	for _, image := range images {
-		if image.Name == imageName && image.Tag == tag {
-			return image, nil
-		}
+	refs, err := m.loadReferences()
+	if err != nil {
+		return nil, err
+	}
+
+	imageID, ok := refs.Tags[imageName+":"+tag]
+	if ref.Digest != "" {
+		imageID, ok = refs.Digests[imageName+"@"+tag]
+	}
+	if !ok {
+		return nil, fmt.Errorf("image not found: %s", ref.FamiliarString())
+	}
+
+	image, err := m.loadImageRecord(imageID)
+	if err != nil {
+		return nil, err
+	}
+	refs.decorate(image)
+	if ref.Digest == "" {
+		image.Name, image.Tag = imageName, tag
 	}
 
-	return nil, fmt.Errorf("image not found: %s:%s", imageName, tag)
+	return image, nil
 }
 
-func (m *Manager) generateImageID(name, tag string) string {
-	data := fmt.Sprintf("%s:%s:%d", name, tag, time.Now().UnixNano())
-	hash := sha256.Sum256([]byte(data))
-	return hex.EncodeToString(hash[:])
+// GetHistory returns the steps that produced an image, newest first. Images
+// recorded before history was kept get one entry per layer.
+func (m *Manager) GetHistory(imageID string) ([]types.ImageHistory, error) {
+	image, err := m.GetImage(imageID)
+	if err != nil {
+		return nil, err
+	}
+
+	history := append([]types.ImageHistory(nil), image.History...)
+	if len(history) == 0 {
+		for _, layerID := range image.Layers {
+			history = append(history, types.ImageHistory{LayerID: layerID, Created: image.CreatedAt})
+		}
+	}
+
+	for i, j := 0, len(history)-1; i < j; i, j = i+1, j-1 {
+		history[i], history[j] = history[j], history[i]
+	}
+	return history, nil
 }
 
 func (m *Manager) GetImageDataDir(imageID string) string {
@@ -205,8 +560,7 @@ func (m *Manager) SaveImageLayers(imageID string, layers []string) error {
 
 	image.Layers = layers
 
-	imagePath := filepath.Join("images", fmt.Sprintf("%s.json", imageID))
-	if err := m.store.SaveJSON(imagePath, image); err != nil {
+	if err := m.saveImage(image); err != nil {
 		return fmt.Errorf("failed to save image with layers: %v", err)
 	}
 
@@ -1,11 +1,32 @@
 package image
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"docker-impl/pkg/performance"
 	"docker-impl/pkg/store"
 	"docker-impl/pkg/types"
 )
@@ -166,6 +187,41 @@ func TestPullImage(t *testing.T) {
 	assert.Contains(t, image.Config.Env, "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin", "Should have default PATH")
 }
 
+func TestPullAll(t *testing.T) {
+	list := `# lab images
+alpine
+docker.io/library/alpine:latest   # same as alpine
+busybox:1.36
+
+redis@sha256:` + strings.Repeat("a", 64) + "\n"
+	refs, err := ReadPullList(strings.NewReader(list))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"alpine", "busybox:1.36", "redis@sha256:" + strings.Repeat("a", 64)}, refs)
+
+	_, err = ReadPullList(strings.NewReader("alpine\nNot A Reference\n"))
+	assert.ErrorContains(t, err, "line 2")
+
+	store, err := store.NewStore(t.TempDir())
+	require.NoError(t, err)
+	manager := NewManager(store)
+
+	var events []PullEvent
+	results := manager.PullAll(refs, "", 2, func(event PullEvent) {
+		events = append(events, event)
+	})
+	require.Len(t, results, 3)
+	assert.NoError(t, results[0].Error)
+	assert.Equal(t, "alpine", results[0].Image.Name)
+	assert.NoError(t, results[1].Error)
+	assert.Equal(t, "1.36", results[1].Image.Tag)
+	assert.ErrorContains(t, results[2].Error, "requires a registry", "Pulls by digest fail without a registry")
+
+	require.Len(t, events, 6, "Each pull should report its start and end")
+	last := events[len(events)-1]
+	assert.Equal(t, 3, last.Done)
+	assert.Equal(t, 3, last.Total)
+}
+
 func TestTagImage(t *testing.T) {
 	tempDir := t.TempDir()
 	store, err := store.NewStore(tempDir)
@@ -188,6 +244,85 @@ func TestTagImage(t *testing.T) {
 	assert.Equal(t, "v1", targetImage.Tag, "Target image tag should be correct")
 }
 
+func TestUntagAndRemoveReference(t *testing.T) {
+	store, err := store.NewStore(t.TempDir())
+	require.NoError(t, err)
+	manager := NewManager(store)
+
+	image, err := manager.CreateImage("app", "v1", types.ImageConfig{Env: []string{"PATH=/bin"}})
+	require.NoError(t, err)
+	require.NoError(t, manager.TagImage(image.ID, "app", "latest"))
+	require.NoError(t, manager.TagImage(image.ID, "mirror/app", "v1"))
+
+	tagged, err := manager.GetImage(image.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"app:latest", "app:v1", "mirror/app:v1"}, tagged.RepoTags)
+
+	_, err = manager.RemoveImageReference(image.ID, false)
+	assert.Error(t, err, "Removing by ID should need force when several repositories tag the image")
+
+	imageID, err := manager.UntagImage("mirror/app:v1")
+	require.NoError(t, err)
+	assert.Equal(t, image.ID, imageID)
+	_, err = manager.UntagImage("mirror/app:v1")
+	assert.Error(t, err, "Untagging twice should fail")
+
+	report, err := manager.RemoveImageReference("app:v1", false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"app:v1"}, report.Untagged)
+	assert.Empty(t, report.Deleted, "The image should stay while it has tags")
+	assert.True(t, manager.ImageExists(image.ID))
+
+	report, err = manager.RemoveImageReference("app", false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"app:latest"}, report.Untagged)
+	assert.Equal(t, image.ID, report.Deleted, "Removing the last tag should remove the image")
+	assert.False(t, manager.ImageExists(image.ID))
+}
+
+func TestSearchIndex(t *testing.T) {
+	store, err := store.NewStore(t.TempDir())
+	require.NoError(t, err)
+	manager := NewManager(store)
+
+	web, err := manager.CreateImage("shop/web", "v1", types.ImageConfig{
+		Env:    []string{"NGINX_VERSION=1.25"},
+		Labels: map[string]string{"maintainer": "alice"},
+	})
+	require.NoError(t, err)
+	_, err = manager.CreateImage("shop/worker", "v1", types.ImageConfig{
+		Labels: map[string]string{"maintainer": "bob"},
+	})
+	require.NoError(t, err)
+
+	results, err := store.Search("shop", "")
+	require.NoError(t, err)
+	assert.Len(t, results, 2)
+
+	results, err = store.Search("maintainer ali", "image")
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, web.ID, results[0].ID)
+	assert.Equal(t, "shop/web:v1", results[0].Name)
+	assert.Equal(t, []string{"label:maintainer=alice"}, results[0].Matches)
+
+	results, err = store.Search("nginx", "container")
+	require.NoError(t, err)
+	assert.Empty(t, results, "Images should not be found when searching containers")
+
+	// Tags are indexed as they change
+	require.NoError(t, manager.TagImage(web.ID, "storefront", "latest"))
+	results, err = store.Search("storefront", "")
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, web.ID, results[0].ID)
+
+	require.NoError(t, manager.RemoveImage(web.ID))
+	results, err = store.Search("nginx", "")
+	require.NoError(t, err)
+	assert.Empty(t, results, "Removed images should leave the index")
+}
+
 func TestGetImageByName(t *testing.T) {
 	tempDir := t.TempDir()
 	store, err := store.NewStore(tempDir)
@@ -226,8 +361,23 @@ func TestBuildImage(t *testing.T) {
 
 	manager := NewManager(store)
 
+	contextDir := t.TempDir()
+	dockerfile := `# test image
+FROM scratch
+ENV APP_HOME=/app \
+    GREETING="hello world"
+WORKDIR $APP_HOME
+COPY . ./
+EXPOSE 8080 53/udp
+CMD ["/app/run.sh"]
+`
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "Dockerfile"), []byte(dockerfile), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "run.sh"), []byte("#!/bin/sh\n"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "secret.env"), []byte("TOKEN=x\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, ".dockerignore"), []byte("*.env\nDockerfile\n"), 0644))
+
 	options := types.ImageBuildOptions{
-		ContextDir: "/tmp",
+		ContextDir: contextDir,
 		Dockerfile: "Dockerfile",
 		Tags:       []string{"test-build:latest"},
 		Labels: map[string]string{
@@ -239,9 +389,584 @@ func TestBuildImage(t *testing.T) {
 	require.NoError(t, err)
 	require.NotNil(t, image)
 
-	assert.Equal(t, "built-image", image.Name, "Image name should be built-image")
+	assert.Equal(t, "test-build", image.Name, "Image name should come from the tag")
 	assert.Equal(t, "latest", image.Tag, "Image tag should be latest")
 	assert.Equal(t, "test", image.Labels["build"], "Build label should be set")
+	assert.Equal(t, "/app", image.Config.WorkingDir, "WORKDIR should expand ENV variables")
+	assert.Contains(t, image.Config.Env, "GREETING=hello world", "ENV should handle quoted values")
+	assert.Equal(t, []string{"/app/run.sh"}, image.Config.Cmd, "CMD should use the exec form")
+	assert.Contains(t, image.Config.ExposedPorts, "8080/tcp", "EXPOSE should default to tcp")
+	assert.Contains(t, image.Config.ExposedPorts, "53/udp", "EXPOSE should keep the protocol")
+	require.NotEmpty(t, image.Layers, "COPY should produce a layer")
+
+	rootfs := t.TempDir()
+	require.NoError(t, manager.materializeLayers(image.Layers, rootfs))
+	assert.FileExists(t, filepath.Join(rootfs, "app", "run.sh"), "Copied file should be in the image")
+	assert.NoFileExists(t, filepath.Join(rootfs, "app", "secret.env"), ".dockerignore should exclude files")
+	assert.NoFileExists(t, filepath.Join(rootfs, "app", "Dockerfile"), ".dockerignore should exclude the Dockerfile")
+}
+
+func TestBuildImageCache(t *testing.T) {
+	tempDir := t.TempDir()
+	store, err := store.NewStore(tempDir)
+	require.NoError(t, err)
+
+	manager := NewManager(store)
+
+	contextDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "Dockerfile"), []byte("FROM scratch\nWORKDIR /app\nCOPY app.txt .\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "app.txt"), []byte("v1"), 0644))
+
+	build := func(noCache bool) (*types.Image, *builder) {
+		b, err := newBuilder(manager, types.ImageBuildOptions{ContextDir: contextDir, NoCache: noCache})
+		require.NoError(t, err)
+		b.progress = func(types.BuildEvent) {}
+		image, err := b.build()
+		require.NoError(t, err)
+		return image, b
+	}
+
+	first, b := build(false)
+	assert.Equal(t, 0, b.cacheHits, "First build should not hit the cache")
+	assert.Equal(t, 2, b.cacheMisses, "WORKDIR and COPY should miss")
+
+	second, b := build(false)
+	assert.Equal(t, 2, b.cacheHits, "Unchanged build should hit the cache")
+	assert.Equal(t, first.Layers, second.Layers, "Cached build should reuse the same layers")
+
+	_, b = build(true)
+	assert.Equal(t, 0, b.cacheHits, "--no-cache should bypass the cache")
+
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "app.txt"), []byte("v2"), 0644))
+	third, b := build(false)
+	assert.Equal(t, 1, b.cacheHits, "Only the WORKDIR step should hit after the file changed")
+	assert.NotEqual(t, first.Layers[len(first.Layers)-1], third.Layers[len(third.Layers)-1], "Changed COPY input should produce a new layer")
+}
+
+func TestBuildImageMultiStage(t *testing.T) {
+	tempDir := t.TempDir()
+	store, err := store.NewStore(tempDir)
+	require.NoError(t, err)
+
+	manager := NewManager(store)
+
+	contextDir := t.TempDir()
+	dockerfile := `FROM scratch AS builder
+COPY src/ /build/
+FROM scratch
+COPY --from=builder /build/app.bin /usr/bin/app
+FROM scratch AS debug
+COPY --from=0 /build /debug
+`
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "Dockerfile"), []byte(dockerfile), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(contextDir, "src"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "src", "app.bin"), []byte("binary"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "src", "main.c"), []byte("int main() {}"), 0644))
+
+	image, err := manager.BuildImage(types.ImageBuildOptions{ContextDir: contextDir, Tags: []string{"multi:latest"}})
+	require.NoError(t, err)
+
+	rootfs := t.TempDir()
+	require.NoError(t, manager.materializeLayers(image.Layers, rootfs))
+	assert.FileExists(t, filepath.Join(rootfs, "debug", "main.c"), "Final stage should copy from stage index 0")
+	assert.NoDirExists(t, filepath.Join(rootfs, "build"), "Final image should not contain earlier stage files")
+
+	image, err = manager.BuildImage(types.ImageBuildOptions{ContextDir: contextDir, Target: "builder"})
+	require.NoError(t, err)
+	rootfs = t.TempDir()
+	require.NoError(t, manager.materializeLayers(image.Layers, rootfs))
+	assert.FileExists(t, filepath.Join(rootfs, "build", "main.c"), "--target should stop at the named stage")
+
+	contextDir2 := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir2, "Dockerfile"), []byte("FROM multi:latest\nFROM scratch\nCOPY --from=multi:latest /debug/app.bin /app\n"), 0644))
+	image, err = manager.BuildImage(types.ImageBuildOptions{ContextDir: contextDir2})
+	require.NoError(t, err)
+	rootfs = t.TempDir()
+	require.NoError(t, manager.materializeLayers(image.Layers, rootfs))
+	assert.FileExists(t, filepath.Join(rootfs, "app"), "COPY --from should accept an image reference")
+
+	_, err = manager.BuildImage(types.ImageBuildOptions{ContextDir: contextDir, Target: "missing"})
+	assert.Error(t, err, "Unknown target stage should fail")
+}
+
+func TestBuildFromContainer(t *testing.T) {
+	tempDir := t.TempDir()
+	store, err := store.NewStore(tempDir)
+	require.NoError(t, err)
+
+	manager := NewManager(store)
+
+	contextDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "Dockerfile"), []byte("FROM scratch\nCOPY app/ /app/\nCMD [\"/app/run\"]\n"), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(contextDir, "app"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "app", "run"), []byte("v1"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "app", "old.conf"), []byte("old"), 0644))
+	base, err := manager.BuildImage(types.ImageBuildOptions{ContextDir: contextDir, Tags: []string{"base:latest"}})
+	require.NoError(t, err)
+
+	// What the container changed, plus files it shouldn't pass on
+	containerRootfs := t.TempDir()
+	require.NoError(t, manager.materializeLayers(base.Layers, containerRootfs))
+	require.NoError(t, os.WriteFile(filepath.Join(containerRootfs, "app", "run"), []byte("v2"), 0755))
+	require.NoError(t, os.Remove(filepath.Join(containerRootfs, "app", "old.conf")))
+	require.NoError(t, os.MkdirAll(filepath.Join(containerRootfs, "etc"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(containerRootfs, "etc", "hostname"), []byte("debug\n"), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(containerRootfs, "data"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(containerRootfs, "data", "db"), []byte("volume"), 0644))
+
+	snippetDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(snippetDir, "Dockerfile.partial"), []byte("ENV DEBUG=1\nCOPY extra.txt /app/\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(snippetDir, "extra.txt"), []byte("extra"), 0644))
+
+	image, err := manager.BuildImage(types.ImageBuildOptions{
+		ContextDir:       snippetDir,
+		Dockerfile:       "Dockerfile.partial",
+		Tags:             []string{"debug:latest"},
+		FromContainer:    "abc123",
+		FromImage:        base.ID,
+		ContainerRootfs:  containerRootfs,
+		ContainerExclude: []string{"/data"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, base.ID, image.Parent)
+	assert.Equal(t, base.Layers, image.Layers[:len(base.Layers)], "The base image's layers should be shared")
+	assert.Equal(t, []string{"/app/run"}, image.Config.Cmd, "The base image's config should carry over")
+	assert.Contains(t, image.Config.Env, "DEBUG=1")
+
+	rootfs := t.TempDir()
+	require.NoError(t, manager.materializeLayers(image.Layers, rootfs))
+	content, err := os.ReadFile(filepath.Join(rootfs, "app", "run"))
+	require.NoError(t, err)
+	assert.Equal(t, "v2", string(content), "Changes of the container should be in the image")
+	assert.NoFileExists(t, filepath.Join(rootfs, "app", "old.conf"), "Deletions of the container should be in the image")
+	assert.FileExists(t, filepath.Join(rootfs, "app", "extra.txt"), "The snippet should apply on top")
+	assert.NoFileExists(t, filepath.Join(rootfs, "etc", "hostname"), "Files written by the runtime should be left out")
+	assert.NoDirExists(t, filepath.Join(rootfs, "data"), "Volumes should be left out")
+
+	require.NoError(t, os.WriteFile(filepath.Join(snippetDir, "Dockerfile.partial"), []byte("FROM scratch\n"), 0644))
+	_, err = manager.BuildImage(types.ImageBuildOptions{ContextDir: snippetDir, Dockerfile: "Dockerfile.partial", FromContainer: "abc123", FromImage: base.ID, ContainerRootfs: containerRootfs})
+	assert.Error(t, err, "A snippet applied to a container can't have FROM")
+}
+
+func TestBuildImageArgs(t *testing.T) {
+	tempDir := t.TempDir()
+	store, err := store.NewStore(tempDir)
+	require.NoError(t, err)
+
+	manager := NewManager(store)
+
+	contextDir := t.TempDir()
+	dockerfile := `ARG BASE=scratch
+FROM ${BASE}
+ARG VERSION=1.0
+ARG NAME
+ENV APP_VERSION=$VERSION LEAKED=${BASE}
+LABEL version=${VERSION} name=${NAME:-none}
+WORKDIR /opt/$VERSION
+`
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "Dockerfile"), []byte(dockerfile), 0644))
+
+	image, err := manager.BuildImage(types.ImageBuildOptions{
+		ContextDir: contextDir,
+		BuildArgs:  map[string]string{"VERSION": "2.0", "UNUSED": "x"},
+	})
+	require.NoError(t, err)
+
+	assert.Contains(t, image.Config.Env, "APP_VERSION=2.0", "--build-arg should override the ARG default")
+	assert.Contains(t, image.Config.Env, "LEAKED=", "Global ARGs should not be visible inside a stage")
+	assert.NotContains(t, image.Config.Env, "VERSION=2.0", "ARG values should not persist in the image")
+	assert.Equal(t, "2.0", image.Config.Labels["version"])
+	assert.Equal(t, "none", image.Config.Labels["name"])
+	assert.Equal(t, "/opt/2.0", image.Config.WorkingDir)
+
+	image, err = manager.BuildImage(types.ImageBuildOptions{ContextDir: contextDir})
+	require.NoError(t, err)
+	assert.Equal(t, "/opt/1.0", image.Config.WorkingDir, "ARG default should apply without --build-arg")
+
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "Dockerfile"), []byte("RUN true\nFROM scratch\n"), 0644))
+	_, err = manager.BuildImage(types.ImageBuildOptions{ContextDir: contextDir})
+	assert.Error(t, err, "Only ARG may precede the first FROM")
+}
+
+func TestBuildProgressEvents(t *testing.T) {
+	store, err := store.NewStore(t.TempDir())
+	require.NoError(t, err)
+	manager := NewManager(store)
+
+	contextDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "Dockerfile"), []byte("FROM scratch\nWORKDIR /app\nCOPY app.txt .\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "app.txt"), []byte("app"), 0644))
+
+	build := func() (*types.Image, []types.BuildEvent) {
+		var output bytes.Buffer
+		image, err := manager.BuildImage(types.ImageBuildOptions{
+			ContextDir: contextDir,
+			Tags:       []string{"progress:1"},
+			Progress:   JSONProgress(&output),
+		})
+		require.NoError(t, err)
+
+		var events []types.BuildEvent
+		decoder := json.NewDecoder(&output)
+		for decoder.More() {
+			var event types.BuildEvent
+			require.NoError(t, decoder.Decode(&event))
+			events = append(events, event)
+		}
+		return image, events
+	}
+	ofType := func(events []types.BuildEvent, eventType string) []types.BuildEvent {
+		var matched []types.BuildEvent
+		for _, event := range events {
+			if event.Type == eventType {
+				matched = append(matched, event)
+			}
+		}
+		return matched
+	}
+
+	image, events := build()
+	steps := ofType(events, BuildEventStep)
+	require.Len(t, steps, 3)
+	assert.Equal(t, 3, steps[2].Step)
+	assert.Equal(t, 3, steps[2].Total)
+	assert.Equal(t, "COPY app.txt .", steps[2].Instruction)
+
+	layers := ofType(events, BuildEventLayer)
+	require.NotEmpty(t, layers)
+	assert.Equal(t, image.Layers[len(image.Layers)-1], layers[len(layers)-1].Layer, "Layer events should carry the committed layer")
+	assert.Equal(t, 3, layers[len(layers)-1].Step)
+
+	complete := events[len(events)-1]
+	assert.Equal(t, BuildEventComplete, complete.Type)
+	assert.Equal(t, image.ID, complete.ImageID)
+	assert.Equal(t, []string{"progress:1"}, complete.Tags)
+	assert.False(t, complete.Time.IsZero())
+
+	_, events = build()
+	assert.Len(t, ofType(events, BuildEventCache), 2, "A rebuild should report cache hits")
+
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "Dockerfile"), []byte("FROM scratch\nCOPY missing.txt .\n"), 0644))
+	var failed []types.BuildEvent
+	_, err = manager.BuildImage(types.ImageBuildOptions{
+		ContextDir: contextDir,
+		Progress:   func(event types.BuildEvent) { failed = append(failed, event) },
+	})
+	require.Error(t, err)
+	require.NotEmpty(t, failed)
+	assert.Equal(t, BuildEventError, failed[len(failed)-1].Type)
+	assert.Equal(t, 2, failed[len(failed)-1].Step, "Errors should name the failing step")
+
+	var plain bytes.Buffer
+	progress, err := NewBuildProgress("plain", &plain)
+	require.NoError(t, err)
+	progress(types.BuildEvent{Type: BuildEventStep, Step: 1, Total: 2, Instruction: "FROM scratch"})
+	progress(types.BuildEvent{Type: BuildEventOutput, Stream: "stdout", Message: "hello\n"})
+	assert.Equal(t, "Step 1/2 : FROM scratch\nhello\n", plain.String())
+
+	_, err = NewBuildProgress("tty", io.Discard)
+	assert.Error(t, err)
+}
+
+func TestBuildImageMetadataInstructions(t *testing.T) {
+	store, err := store.NewStore(t.TempDir())
+	require.NoError(t, err)
+	manager := NewManager(store)
+
+	baseDir := t.TempDir()
+	dockerfile := `FROM scratch
+ENV DATA=/data
+USER 1000:1000
+VOLUME ["$DATA", "/cache"]
+LABEL tier=base
+HEALTHCHECK --interval=5s --retries=3 CMD ["/bin/check", "--quick"]
+ONBUILD COPY app.txt /app.txt
+ONBUILD LABEL tier=app
+`
+	require.NoError(t, os.WriteFile(filepath.Join(baseDir, "Dockerfile"), []byte(dockerfile), 0644))
+
+	base, err := manager.BuildImage(types.ImageBuildOptions{ContextDir: baseDir, Tags: []string{"base:1"}})
+	require.NoError(t, err)
+	assert.Equal(t, "1000:1000", base.Config.User)
+	assert.Equal(t, map[string]struct{}{"/data": {}, "/cache": {}}, base.Config.Volumes)
+	require.NotNil(t, base.Config.Healthcheck)
+	assert.Equal(t, []string{"CMD", "/bin/check", "--quick"}, base.Config.Healthcheck.Test)
+	assert.Equal(t, 5*time.Second, base.Config.Healthcheck.Interval)
+	assert.Equal(t, 3, base.Config.Healthcheck.Retries)
+	assert.Equal(t, []string{"COPY app.txt /app.txt", "LABEL tier=app"}, base.Config.OnBuild)
+	assert.Empty(t, base.Layers, "ONBUILD should not run in the image that declares it")
+
+	appDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(appDir, "Dockerfile"), []byte("FROM base:1\nHEALTHCHECK NONE\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(appDir, "app.txt"), []byte("app"), 0644))
+
+	app, err := manager.BuildImage(types.ImageBuildOptions{ContextDir: appDir})
+	require.NoError(t, err)
+	assert.Len(t, app.Layers, 1, "The COPY trigger should add a layer")
+	assert.Equal(t, "app", app.Config.Labels["tier"], "Triggers should run before the child's own instructions")
+	assert.Empty(t, app.Config.OnBuild, "Triggers should not be inherited")
+	assert.Equal(t, "1000:1000", app.Config.User)
+	assert.Equal(t, []string{"NONE"}, app.Config.Healthcheck.Test)
+
+	require.NoError(t, os.WriteFile(filepath.Join(appDir, "Dockerfile"), []byte("FROM scratch\nONBUILD FROM scratch\n"), 0644))
+	_, err = manager.BuildImage(types.ImageBuildOptions{ContextDir: appDir})
+	assert.Error(t, err, "FROM is not allowed as a trigger")
+
+	require.NoError(t, os.WriteFile(filepath.Join(appDir, "Dockerfile"), []byte("FROM scratch\nHEALTHCHECK --interval=soon CMD true\n"), 0644))
+	_, err = manager.BuildImage(types.ImageBuildOptions{ContextDir: appDir})
+	assert.Error(t, err, "Invalid durations should be rejected")
+}
+
+func TestResolveUser(t *testing.T) {
+	rootfs := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(rootfs, "etc"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(rootfs, "etc", "passwd"), []byte("root:x:0:0:root:/root:/bin/sh\napp:x:1000:1001::/home/app:/bin/sh\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(rootfs, "etc", "group"), []byte("root:x:0:\nstaff:x:50:app\n"), 0644))
+
+	for user, want := range map[string][2]uint32{
+		"app":       {1000, 1001},
+		"1000":      {1000, 1001},
+		"app:staff": {1000, 50},
+		"2000:3000": {2000, 3000},
+		"2000":      {2000, 0},
+	} {
+		uid, gid, err := ResolveUser(rootfs, user)
+		require.NoError(t, err, user)
+		assert.Equal(t, want, [2]uint32{uid, gid}, user)
+	}
+
+	_, _, err := ResolveUser(rootfs, "nobody")
+	assert.Error(t, err)
+	_, _, err = ResolveUser(rootfs, "app:wheel")
+	assert.Error(t, err)
+}
+
+func TestImageHistory(t *testing.T) {
+	store, err := store.NewStore(t.TempDir())
+	require.NoError(t, err)
+	manager := NewManager(store)
+
+	contextDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "Dockerfile"), []byte("FROM scratch\nENV A=1\nCOPY data.txt /data.txt\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "data.txt"), []byte("12345"), 0644))
+
+	image, err := manager.BuildImage(types.ImageBuildOptions{ContextDir: contextDir})
+	require.NoError(t, err)
+
+	history, err := manager.GetHistory(image.ID)
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+
+	assert.Equal(t, "COPY data.txt /data.txt", history[0].CreatedBy, "Newest step should come first")
+	assert.False(t, history[0].EmptyLayer)
+	assert.Equal(t, image.Layers[0], history[0].LayerID)
+	assert.Equal(t, int64(5), history[0].Size)
+
+	assert.Equal(t, "ENV A=1", history[1].CreatedBy)
+	assert.True(t, history[1].EmptyLayer)
+	assert.Empty(t, history[1].LayerID)
+
+	pulled, err := manager.PullImage("alpine", "latest")
+	require.NoError(t, err)
+	history, err = manager.GetHistory(pulled.ID)
+	require.NoError(t, err)
+	assert.Len(t, history, 1)
+}
+
+func TestPruneImages(t *testing.T) {
+	store, err := store.NewStore(t.TempDir())
+	require.NoError(t, err)
+	manager := NewManager(store)
+
+	build := func(dockerfile, data, tag string) *types.Image {
+		contextDir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(contextDir, "Dockerfile"), []byte(dockerfile), 0644))
+		require.NoError(t, os.WriteFile(filepath.Join(contextDir, "data.txt"), []byte(data), 0644))
+		image, err := manager.BuildImage(types.ImageBuildOptions{ContextDir: contextDir, Tags: []string{tag}})
+		require.NoError(t, err)
+		return image
+	}
+
+	old := build("FROM scratch\nCOPY data.txt /data.txt\n", "12345", "app:v1")
+	current := build("FROM scratch\nCOPY data.txt /data.txt\n", "123456789", "app:v1")
+	child := build("FROM app:v1\nCOPY data.txt /extra.txt\n", "abc", "child:latest")
+	assert.Equal(t, current.ID, child.Parent, "Child should record the image it was built from")
+
+	old, err = manager.GetImage(old.ID)
+	require.NoError(t, err)
+	assert.True(t, IsDangling(old), "Rebuilding a tag should leave the old image dangling")
+
+	report, err := manager.PruneImages(types.ImagePruneOptions{Until: time.Hour}, nil)
+	require.NoError(t, err)
+	assert.Empty(t, report.ImagesDeleted, "Images newer than until should be kept")
+
+	report, err = manager.PruneImages(types.ImagePruneOptions{}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{old.ID}, report.ImagesDeleted)
+	assert.Equal(t, old.Layers, report.LayersDeleted)
+	assert.Equal(t, int64(5), report.SpaceReclaimed)
+	assert.False(t, manager.LayerExists(old.Layers[0]))
+
+	report, err = manager.PruneImages(types.ImagePruneOptions{All: true}, map[string]bool{child.ID: true})
+	require.NoError(t, err)
+	assert.Empty(t, report.ImagesDeleted, "Images in use and their parents should be kept")
+
+	report, err = manager.PruneImages(types.ImagePruneOptions{All: true}, nil)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{current.ID, child.ID}, report.ImagesDeleted)
+	assert.Equal(t, int64(12), report.SpaceReclaimed)
+}
+
+func TestContentAddressableImages(t *testing.T) {
+	configData := []byte(`{"os":"linux","architecture":"amd64","config":{"Cmd":["/bin/sh"]}}`)
+	manifestData, err := json.Marshal(Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIManifest,
+		Config:        Descriptor{Digest: digestBytes(configData)},
+	})
+	require.NoError(t, err)
+	manifestDigest := digestBytes(manifestData)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/library/alpine/manifests/latest", "/v2/library/alpine/manifests/" + manifestDigest:
+			w.Header().Set("Content-Type", MediaTypeOCIManifest)
+			w.Write(manifestData)
+		case "/v2/library/alpine/blobs/" + digestBytes(configData):
+			w.Write(configData)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	store, err := store.NewStore(t.TempDir())
+	require.NoError(t, err)
+	manager := NewManager(store)
+	manager.SetRegistry(NewRegistryClient(server.URL))
+
+	pulled, err := manager.PullImage("alpine", "latest")
+	require.NoError(t, err)
+	assert.Equal(t, "sha256:"+pulled.ID, digestBytes(configData), "Image ID should be the config digest")
+	assert.Equal(t, []string{"alpine@" + manifestDigest}, pulled.RepoDigests)
+
+	byDigest, err := manager.PullImage("alpine", manifestDigest)
+	require.NoError(t, err)
+	assert.Equal(t, pulled.ID, byDigest.ID, "Pulling the same image again should not duplicate it")
+
+	resolved, err := manager.ResolveImage("alpine@" + manifestDigest)
+	require.NoError(t, err)
+	assert.Equal(t, pulled.ID, resolved.ID)
+	resolved, err = manager.ResolveImage("sha256:" + pulled.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"alpine:latest"}, resolved.RepoTags)
+
+	require.NoError(t, manager.TagImage(pulled.ID, "mirror/alpine", "3"))
+	images, err := manager.ListImages()
+	require.NoError(t, err)
+	require.Len(t, images, 1, "Tagging should add a reference, not a copy")
+	assert.Equal(t, []string{"alpine:latest", "mirror/alpine:3"}, images[0].RepoTags)
+
+	_, err = manager.PullImage("alpine", "sha256:"+strings.Repeat("0", 64))
+	assert.Error(t, err, "Unknown digests should not resolve")
+
+	require.NoError(t, manager.RemoveImage(pulled.ID))
+	_, err = manager.GetImageByName("mirror/alpine", "3")
+	assert.Error(t, err, "Removing an image should drop its references")
+}
+
+func TestSaveLoadImages(t *testing.T) {
+	srcStore, err := store.NewStore(t.TempDir())
+	require.NoError(t, err)
+	src := NewManager(srcStore)
+
+	contextDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "Dockerfile"), []byte("FROM scratch\nCOPY hello.txt /hello.txt\nCMD [\"/hello\"]\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "hello.txt"), []byte("hello"), 0644))
+
+	built, err := src.BuildImage(types.ImageBuildOptions{ContextDir: contextDir, Tags: []string{"saved:1.0"}})
+	require.NoError(t, err)
+
+	for _, format := range []string{ArchiveFormatDocker, ArchiveFormatOCI} {
+		t.Run(format, func(t *testing.T) {
+			var archive bytes.Buffer
+			require.NoError(t, src.SaveImages([]*types.Image{built}, format, &archive))
+
+			dstStore, err := store.NewStore(t.TempDir())
+			require.NoError(t, err)
+			dst := NewManager(dstStore)
+
+			loaded, err := dst.LoadImages(&archive)
+			require.NoError(t, err)
+			require.Len(t, loaded, 1)
+			assert.Equal(t, "saved", loaded[0].Name)
+			assert.Equal(t, "1.0", loaded[0].Tag)
+			assert.Equal(t, []string{"/hello"}, loaded[0].Config.Cmd)
+			assert.Len(t, loaded[0].Layers, len(built.Layers))
+			assert.Len(t, loaded[0].History, len(built.History), "History should survive save and load")
+
+			rootfs := t.TempDir()
+			require.NoError(t, dst.materializeLayers(loaded[0].Layers, rootfs))
+			data, err := os.ReadFile(filepath.Join(rootfs, "hello.txt"))
+			require.NoError(t, err)
+			assert.Equal(t, "hello", string(data))
+		})
+	}
+
+	layoutDir := filepath.Join(t.TempDir(), "layout")
+	require.NoError(t, src.SaveImagesToDir([]*types.Image{built}, layoutDir))
+	assert.FileExists(t, filepath.Join(layoutDir, "oci-layout"))
+	assert.FileExists(t, filepath.Join(layoutDir, "index.json"))
+
+	loaded, err := src.LoadImagesFromDir(layoutDir)
+	require.NoError(t, err)
+	require.Len(t, loaded, 1)
+
+	// Layer tars are the only blobs bigger than a tar block; corrupting one
+	// must be caught by the digest check
+	blobs, err := filepath.Glob(filepath.Join(layoutDir, "blobs", "sha256", "*"))
+	require.NoError(t, err)
+	for _, blob := range blobs {
+		if info, err := os.Stat(blob); err == nil && info.Size() > 1024 {
+			require.NoError(t, os.WriteFile(blob, []byte("corrupt"), 0644))
+		}
+	}
+	_, err = src.LoadImagesFromDir(layoutDir)
+	assert.Error(t, err, "Digest mismatch should be rejected")
+}
+
+func TestParseDockerfile(t *testing.T) {
+	dockerfile := `FROM alpine:3.19
+RUN apk add --no-cache \
+    curl
+COPY --chown=1000:1000 src/ /src/
+ENTRYPOINT ["/bin/app", "--serve"]
+`
+	instructions, err := ParseDockerfile(strings.NewReader(dockerfile))
+	require.NoError(t, err)
+	require.Len(t, instructions, 4)
+
+	assert.Equal(t, "RUN", instructions[1].Command)
+	assert.Equal(t, []string{"apk add --no-cache      curl"}, instructions[1].Args, "Continuation lines should be joined")
+	assert.Equal(t, 2, instructions[1].Line, "Should record the starting line")
+	assert.Equal(t, "1000:1000", instructions[2].Flags["chown"], "Should parse instruction flags")
+	assert.Equal(t, []string{"src/", "/src/"}, instructions[2].Args)
+	assert.True(t, instructions[3].JSON, "Should detect exec form")
+
+	_, err = ParseDockerfile(strings.NewReader("# only a comment\n"))
+	assert.Error(t, err, "Should reject an empty Dockerfile")
+}
+
+func TestDockerIgnore(t *testing.T) {
+	ignore, err := NewDockerIgnore([]string{"# comment", "*.log", "**/node_modules", "docs", "!docs/README.md"})
+	require.NoError(t, err)
+
+	assert.True(t, ignore.Ignored("debug.log"), "Should match simple globs")
+	assert.False(t, ignore.Ignored("logs/debug.log"), "Single star should not cross directories")
+	assert.True(t, ignore.Ignored("web/node_modules/lib/index.js"), "Double star should match nested directories")
+	assert.True(t, ignore.Ignored("docs/guide.md"), "Files under an ignored directory should be ignored")
+	assert.False(t, ignore.Ignored("docs/README.md"), "Exceptions should re-include files")
+	assert.False(t, ignore.Ignored("main.go"), "Unmatched files should be kept")
 }
 
 func TestImageExists(t *testing.T) {
@@ -300,4 +1025,699 @@ func TestGetImageManifest(t *testing.T) {
 	assert.Equal(t, 2.0, manifest["schemaVersion"], "Schema version should be 2")
 	assert.Contains(t, manifest, "config", "Manifest should contain config")
 	assert.Contains(t, manifest, "layers", "Manifest should contain layers")
-}
\ No newline at end of file
+}
+func TestParsePlatform(t *testing.T) {
+	platform, err := ParsePlatform("linux/arm64/v8")
+	require.NoError(t, err)
+	assert.Equal(t, types.Platform{OS: "linux", Architecture: "arm64"}, platform, "arm64/v8 should normalize to arm64")
+
+	platform, err = ParsePlatform("x86_64")
+	require.NoError(t, err)
+	assert.Equal(t, "linux/amd64", platform.String(), "Bare architecture should assume linux")
+
+	_, err = ParsePlatform("linux//v7")
+	assert.Error(t, err, "Should reject empty platform components")
+}
+
+func TestPullImageManifestList(t *testing.T) {
+	armv7, err := json.Marshal(Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIManifest,
+		Config:        Descriptor{Digest: "sha256:armv7-config"},
+		Layers:        []Descriptor{{Digest: "sha256:layer", Size: 100}},
+	})
+	require.NoError(t, err)
+	armv7Digest := digestBytes(armv7)
+	list := ManifestList{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIIndex,
+		Manifests: []Descriptor{
+			{MediaType: MediaTypeOCIManifest, Digest: "sha256:amd64", Platform: &types.Platform{OS: "linux", Architecture: "amd64"}},
+			{MediaType: MediaTypeOCIManifest, Digest: armv7Digest, Platform: &types.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}},
+		},
+	}
+	// tampered serves another manifest under the digest the list names
+	tampered, err := json.Marshal(Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIManifest,
+		Config:        Descriptor{Digest: "sha256:armv7-config"},
+		Layers:        []Descriptor{{Digest: "sha256:planted", Size: 100}},
+	})
+	require.NoError(t, err)
+	var tamper atomic.Bool
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/library/alpine/manifests/latest":
+			w.Header().Set("Content-Type", MediaTypeOCIIndex)
+			json.NewEncoder(w).Encode(list)
+		case "/v2/library/alpine/manifests/" + armv7Digest:
+			w.Header().Set("Content-Type", MediaTypeOCIManifest)
+			if tamper.Load() {
+				w.Write(tampered)
+				return
+			}
+			w.Header().Set("Docker-Content-Digest", armv7Digest)
+			w.Write(armv7)
+		case "/v2/library/alpine/blobs/sha256:armv7-config":
+			w.Write([]byte(`{"os":"linux","architecture":"arm","variant":"v7","config":{"Cmd":["/bin/sh"]}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	tempDir := t.TempDir()
+	store, err := store.NewStore(tempDir)
+	require.NoError(t, err)
+
+	manager := NewManager(store)
+	manager.SetRegistry(NewRegistryClient(server.URL))
+
+	image, err := manager.PullImageForPlatform("alpine", "latest", "linux/arm/v7")
+	require.NoError(t, err)
+
+	assert.Equal(t, "linux/arm/v7", image.Platform.String(), "Should record the resolved platform")
+	assert.Equal(t, armv7Digest, image.Digest, "Should record the resolved manifest digest")
+	assert.Equal(t, []string{"sha256:layer"}, image.Layers, "Should use the manifest layers")
+
+	_, err = manager.PullImageForPlatform("alpine", "latest", "linux/s390x")
+	assert.Error(t, err, "Should fail when no manifest matches the platform")
+
+	tamper.Store(true)
+	_, err = manager.PullImageForPlatform("alpine", "latest", "linux/arm/v7")
+	assert.Error(t, err, "Should fail when the platform manifest is not the one the list names")
+}
+
+// signedRegistry serves a signed myorg/app and unsigned images, with a
+// policy trusting the signing key for docker.io/myorg.
+type signedRegistry struct {
+	*httptest.Server
+	policy *TrustPolicy
+	// withholdSignatures serves images without their signatures, like a
+	// mirror that only copied the images
+	withholdSignatures atomic.Bool
+	// spoofDigest serves an unsigned manifest for myorg/app, reporting
+	// the digest of the signed one for it
+	spoofDigest atomic.Bool
+}
+
+func newSignedRegistry(t *testing.T, enforce bool) *signedRegistry {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	keyPath := filepath.Join(t.TempDir(), "cosign.pub")
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644))
+
+	configData := []byte(`{"os":"linux","architecture":"amd64","config":{"Cmd":["/bin/sh"]}}`)
+	manifestData, err := json.Marshal(Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIManifest,
+		Config:        Descriptor{Digest: digestBytes(configData)},
+	})
+	require.NoError(t, err)
+	manifestDigest := digestBytes(manifestData)
+
+	payload := []byte(`{"critical":{"identity":{"docker-reference":"docker.io/myorg/app"},"image":{"docker-manifest-digest":"` + manifestDigest + `"},"type":"cosign container image signature"},"optional":null}`)
+	sum := sha256.Sum256(payload)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, sum[:])
+	require.NoError(t, err)
+	sigManifest, err := json.Marshal(Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIManifest,
+		Layers: []Descriptor{{
+			Digest:      digestBytes(payload),
+			Annotations: map[string]string{CosignSignatureAnnotation: base64.StdEncoding.EncodeToString(signature)},
+		}},
+	})
+	require.NoError(t, err)
+	sigTag := strings.Replace(manifestDigest, ":", "-", 1) + ".sig"
+	unsignedData, err := json.Marshal(Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIManifest,
+		Config:        Descriptor{Digest: digestBytes(configData)},
+		Layers:        []Descriptor{{Digest: digestBytes([]byte("planted")), Size: 7}},
+	})
+	require.NoError(t, err)
+
+	registry := &signedRegistry{}
+	registry.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		repo, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v2/"), "/manifests/")
+		switch {
+		case rest == "latest" && repo == "myorg/app" && registry.spoofDigest.Load():
+			w.Header().Set("Content-Type", MediaTypeOCIManifest)
+			w.Header().Set("Docker-Content-Digest", manifestDigest)
+			w.Write(unsignedData)
+		case rest == "latest":
+			w.Header().Set("Content-Type", MediaTypeOCIManifest)
+			w.Write(manifestData)
+		case rest == sigTag && repo == "myorg/app" && !registry.withholdSignatures.Load():
+			w.Header().Set("Content-Type", MediaTypeOCIManifest)
+			w.Write(sigManifest)
+		case strings.HasSuffix(r.URL.Path, "/blobs/"+digestBytes(configData)):
+			w.Write(configData)
+		case strings.HasSuffix(r.URL.Path, "/blobs/"+digestBytes(payload)):
+			w.Write(payload)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(registry.Close)
+
+	policyPath := filepath.Join(t.TempDir(), "policy.json")
+	policy := fmt.Sprintf(`{"enforce":%t,"registries":[{"scope":"docker.io/myorg","keys":["%s"]}]}`, enforce, keyPath)
+	require.NoError(t, os.WriteFile(policyPath, []byte(policy), 0644))
+	registry.policy, err = LoadTrustPolicy(policyPath)
+	require.NoError(t, err)
+
+	return registry
+}
+
+func TestSignatureVerification(t *testing.T) {
+	registry := newSignedRegistry(t, true)
+
+	store, err := store.NewStore(t.TempDir())
+	require.NoError(t, err)
+	manager := NewManager(store)
+	manager.SetRegistry(NewRegistryClient(registry.URL))
+	manager.SetTrustPolicy(registry.policy)
+
+	signed, err := manager.PullImage("myorg/app", "latest")
+	require.NoError(t, err)
+	assert.NotEmpty(t, signed.SignedBy, "Verified images should record the signing key")
+	assert.NoError(t, manager.CheckTrust(signed.ID))
+
+	_, err = manager.PullImage("myorg/other", "latest")
+	assert.Error(t, err, "Unsigned images in an enforced scope should not be pulled")
+
+	_, err = manager.PullImage("alpine", "latest")
+	require.NoError(t, err, "Images outside the policy should not need a signature")
+
+	local, err := manager.CreateImage("myorg/local", "latest", types.ImageConfig{Cmd: []string{"/bin/true"}})
+	require.NoError(t, err)
+	assert.Error(t, manager.CheckTrust(local.ID), "Unsigned images named into a signed scope should not run")
+}
+
+func TestPullVerifiesManifestReceived(t *testing.T) {
+	registry := newSignedRegistry(t, true)
+
+	store, err := store.NewStore(t.TempDir())
+	require.NoError(t, err)
+	manager := NewManager(store)
+	manager.SetRegistry(NewRegistryClient(registry.URL))
+	manager.SetTrustPolicy(registry.policy)
+
+	registry.spoofDigest.Store(true)
+	_, err = manager.PullImage("myorg/app", "latest")
+	require.Error(t, err, "An unsigned manifest should not pass for the signed one the registry reports")
+	assert.Contains(t, err.Error(), "registry reported digest")
+
+	registry.spoofDigest.Store(false)
+	signed, err := manager.PullImage("myorg/app", "latest")
+	require.NoError(t, err)
+	assert.NotEmpty(t, signed.SignedBy)
+}
+
+func TestOfflineTrustVerification(t *testing.T) {
+	registry := newSignedRegistry(t, false)
+
+	store, err := store.NewStore(t.TempDir())
+	require.NoError(t, err)
+	manager := NewManager(store)
+	manager.SetRegistry(NewRegistryClient(registry.URL))
+	manager.SetTrustPolicy(registry.policy)
+
+	registry.withholdSignatures.Store(true)
+	manager.SetTrustOffline(true)
+	_, err = manager.PullImage("myorg/app", "latest")
+	assert.Error(t, err, "Offline pulls should fail closed without cached trust data, even when not enforced")
+
+	registry.withholdSignatures.Store(false)
+	manager.SetTrustOffline(false)
+	signed, err := manager.PullImage("myorg/app", "latest")
+	require.NoError(t, err)
+	require.NotEmpty(t, signed.SignedBy)
+
+	// From here on the registry has no signatures to offer
+	registry.withholdSignatures.Store(true)
+	manager.SetTrustOffline(true)
+	keyID, err := manager.VerifyImage("myorg/app")
+	require.NoError(t, err, "Previously verified images should verify offline")
+	assert.Equal(t, signed.SignedBy, keyID)
+
+	repulled, err := manager.PullImage("myorg/app", "latest")
+	require.NoError(t, err, "Offline pulls should use the cached trust data")
+	assert.Equal(t, signed.SignedBy, repulled.SignedBy)
+
+	_, err = manager.VerifyImage("alpine")
+	assert.Error(t, err, "Images outside the policy have nothing to verify")
+
+	// Online verification refreshes the cache with the new expiry
+	registry.withholdSignatures.Store(false)
+	manager.SetTrustOffline(false)
+	manager.SetTrustCacheTTL(time.Millisecond)
+	_, err = manager.VerifyImage("myorg/app")
+	require.NoError(t, err)
+
+	time.Sleep(10 * time.Millisecond)
+	manager.SetTrustOffline(true)
+	_, err = manager.VerifyImage("myorg/app")
+	require.Error(t, err, "Expired trust data should not verify")
+	assert.Contains(t, err.Error(), "expired")
+}
+
+func TestRegistryMirrorsAndBlobCache(t *testing.T) {
+	configData := []byte(`{"os":"linux","architecture":"amd64"}`)
+	configDigest := digestBytes(configData)
+	manifestData, err := json.Marshal(Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIManifest,
+		Config:        Descriptor{Digest: configDigest},
+	})
+	require.NoError(t, err)
+
+	var mirrorRequests, blobRequests int
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrorRequests++
+		http.NotFound(w, r)
+	}))
+	defer mirror.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/library/alpine/manifests/latest", "/v2/mirror/alpine/manifests/latest":
+			w.Header().Set("Content-Type", MediaTypeOCIManifest)
+			w.Write(manifestData)
+		case "/v2/library/alpine/blobs/" + configDigest, "/v2/mirror/alpine/blobs/" + configDigest:
+			blobRequests++
+			w.Write(configData)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	cache, err := NewBlobCache(t.TempDir(), 0)
+	require.NoError(t, err)
+
+	pull := func(name string) {
+		store, err := store.NewStore(t.TempDir())
+		require.NoError(t, err)
+		registry := NewRegistryClient(server.URL)
+		registry.SetMirrors([]string{mirror.URL + "/"})
+		registry.SetCache(cache)
+		manager := NewManager(store)
+		manager.SetRegistry(registry)
+
+		_, err = manager.PullImage(name, "latest")
+		require.NoError(t, err)
+	}
+
+	pull("alpine")
+	assert.Equal(t, 1, blobRequests)
+	assert.NotZero(t, mirrorRequests, "Mirrors should be tried before the registry")
+
+	pull("mirror/alpine")
+	assert.Equal(t, 1, blobRequests, "Blobs shared between images should come from the cache")
+
+	stats := cache.Stats()
+	assert.Equal(t, int64(1), stats.Hits)
+	assert.Equal(t, int64(1), stats.Misses)
+	assert.Equal(t, 1, stats.Entries)
+	assert.Equal(t, int64(len(configData)), stats.Size)
+
+	assert.Error(t, cache.Put(configDigest, []byte("tampered")), "Blobs not matching their digest should be refused")
+}
+
+func TestRegistryRetry(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch n := atomic.AddInt32(&requests, 1); {
+		case r.URL.Path == "/v2/missing/blobs/sha256:abc":
+			http.NotFound(w, r)
+		case r.URL.Path == "/v2/down/blobs/sha256:abc":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case n == 1:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case n == 2:
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			w.Write([]byte("blob"))
+		}
+	}))
+	defer server.Close()
+
+	registry := NewRegistryClient(server.URL)
+	registry.SetRetryPolicy(RetryPolicy{Attempts: 3, InitialBackoff: time.Millisecond, BreakerThreshold: 4, BreakerCooldown: time.Hour})
+
+	data, err := registry.GetBlob("flaky", "sha256:abc")
+	require.NoError(t, err)
+	assert.Equal(t, "blob", string(data))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+
+	atomic.StoreInt32(&requests, 0)
+	_, err = registry.GetBlob("missing", "sha256:abc")
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests), "Errors other than 429 and 5xx should not be retried")
+
+	atomic.StoreInt32(&requests, 0)
+	_, err = registry.GetBlob("down", "sha256:abc")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "attempt 3: registry returned 503")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+
+	// The fourth failure in a row opens the circuit
+	_, err = registry.GetBlob("down", "sha256:abc")
+	require.Error(t, err)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&requests))
+	_, err = registry.GetBlob("flaky", "sha256:abc")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "circuit open")
+	assert.Equal(t, int32(4), atomic.LoadInt32(&requests))
+}
+
+func TestInspectImage(t *testing.T) {
+	store, err := store.NewStore(t.TempDir())
+	require.NoError(t, err)
+	manager := NewManager(store)
+
+	contextDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "Dockerfile"), []byte("FROM scratch\nCOPY hello.txt /hello.txt\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "hello.txt"), []byte("hello"), 0644))
+	base, err := manager.BuildImage(types.ImageBuildOptions{ContextDir: contextDir, Tags: []string{"base:1"}})
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "Dockerfile"), []byte("FROM base:1\nCOPY more.txt /more.txt\nEXPOSE 80/tcp 443/tcp\nLABEL tier=web\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "more.txt"), []byte("more data"), 0644))
+	_, err = manager.BuildImage(types.ImageBuildOptions{ContextDir: contextDir, Tags: []string{"child:1"}})
+	require.NoError(t, err)
+
+	inspect, err := manager.InspectImage("child:1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"child:1"}, inspect.RepoTags)
+	assert.Equal(t, base.ID, inspect.Parent)
+	assert.Equal(t, []string{"443/tcp", "80/tcp"}, inspect.ExposedPorts)
+	assert.Equal(t, "web", inspect.Labels["tier"])
+
+	require.Len(t, inspect.Layers, 2)
+	assert.True(t, inspect.Layers[0].Shared)
+	assert.False(t, inspect.Layers[1].Shared)
+	assert.Equal(t, inspect.RootFS.DiffIDs[1], inspect.Layers[1].DiffID)
+	assert.Equal(t, int64(5), inspect.Layers[0].Size)
+	assert.Equal(t, int64(9), inspect.Layers[1].Size)
+	assert.Equal(t, int64(9), inspect.Size, "Size should only count the layers added to the parent")
+	assert.Equal(t, int64(14), inspect.VirtualSize)
+
+	var config imageConfigBlob
+	require.NoError(t, json.Unmarshal(inspect.Config, &config))
+	assert.Equal(t, inspect.RootFS.DiffIDs, config.RootFS.DiffIDs)
+	assert.Equal(t, "sha256:"+inspect.ID, digestBytes(inspect.Config), "Config should be the JSON the image ID is computed from")
+}
+
+func TestSquashAndFlattenImage(t *testing.T) {
+	store, err := store.NewStore(t.TempDir())
+	require.NoError(t, err)
+	manager := NewManager(store)
+
+	contextDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "Dockerfile"), []byte("FROM scratch\nCOPY hello.txt /hello.txt\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "hello.txt"), []byte("hello"), 0644))
+	base, err := manager.BuildImage(types.ImageBuildOptions{ContextDir: contextDir, Tags: []string{"base:1"}})
+	require.NoError(t, err)
+
+	dockerfile := "FROM base:1\nCOPY secret.txt /secret.txt\nCOPY more.txt /more.txt\nCOPY blank.txt /secret.txt\nENV MODE=prod\n"
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "Dockerfile"), []byte(dockerfile), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "secret.txt"), []byte("hunter2"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "more.txt"), []byte("more data"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "blank.txt"), nil, 0644))
+
+	plain, err := manager.BuildImage(types.ImageBuildOptions{ContextDir: contextDir, Tags: []string{"app:plain"}})
+	require.NoError(t, err)
+	require.Len(t, plain.Layers, 4)
+
+	squashed, err := manager.BuildImage(types.ImageBuildOptions{ContextDir: contextDir, Tags: []string{"app:squashed"}, Squash: true})
+	require.NoError(t, err)
+	require.Len(t, squashed.Layers, 2, "The build's layers should be merged on top of the base layer")
+	assert.Equal(t, base.Layers[0], squashed.Layers[0])
+	assert.Equal(t, base.ID, squashed.Parent)
+	assert.Equal(t, []string{"MODE=prod"}, squashed.Config.Env)
+	assert.Equal(t, int64(5+9), squashed.Size)
+
+	merged := manager.GetLayerDir(squashed.Layers[1])
+	data, err := os.ReadFile(filepath.Join(merged, "secret.txt"))
+	require.NoError(t, err)
+	assert.Empty(t, data, "Overwritten content should not survive the squash")
+	assert.NoFileExists(t, filepath.Join(merged, "hello.txt"))
+
+	history, err := manager.GetHistory(squashed.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "squash", history[0].CreatedBy)
+	assert.Equal(t, squashed.Layers[1], history[0].LayerID)
+	for _, entry := range history[1:4] {
+		assert.True(t, entry.EmptyLayer, entry.CreatedBy)
+	}
+
+	flat, err := manager.FlattenImage("app:plain", []string{"app:flat"})
+	require.NoError(t, err)
+	require.Len(t, flat.Layers, 1)
+	assert.Empty(t, flat.Parent)
+	assert.Equal(t, []string{"app:flat"}, flat.RepoTags)
+	assert.Equal(t, plain.Config.Env, flat.Config.Env)
+	assert.Equal(t, int64(5+9), flat.Size)
+	assert.FileExists(t, filepath.Join(manager.GetLayerDir(flat.Layers[0]), "hello.txt"))
+
+	unchanged, err := manager.ResolveImage("app:plain")
+	require.NoError(t, err)
+	assert.Equal(t, plain.Layers, unchanged.Layers, "Flattening should leave the source image alone")
+}
+
+func TestGarbageCollectLayers(t *testing.T) {
+	store, err := store.NewStore(t.TempDir())
+	require.NoError(t, err)
+	manager := NewManager(store)
+
+	contextDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "Dockerfile"), []byte("FROM scratch\nCOPY a.txt /a.txt\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "a.txt"), []byte("aaaa"), 0644))
+	kept, err := manager.BuildImage(types.ImageBuildOptions{ContextDir: contextDir, Tags: []string{"kept:1"}})
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "Dockerfile"), []byte("FROM kept:1\nCOPY b.txt /b.txt\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(contextDir, "b.txt"), []byte("bbbbbbbb"), 0644))
+	removed, err := manager.BuildImage(types.ImageBuildOptions{ContextDir: contextDir, Tags: []string{"removed:1"}})
+	require.NoError(t, err)
+	require.Len(t, removed.Layers, 2)
+	orphan := removed.Layers[1]
+
+	require.NoError(t, manager.RemoveImage(removed.ID))
+	refs, err := manager.LayerReferences()
+	require.NoError(t, err)
+	assert.Equal(t, 2, refs[kept.Layers[0]], "The layer is used by an image and a build cache entry")
+	assert.Equal(t, 1, refs[orphan], "Only the build cache refers to the layer")
+
+	report, err := manager.GarbageCollectLayers()
+	require.NoError(t, err)
+	assert.Empty(t, report.LayersDeleted, "Layers in the build cache should be kept")
+
+	_, err = manager.PruneBuildCache()
+	require.NoError(t, err)
+	report, err = manager.GarbageCollectLayers()
+	require.NoError(t, err)
+	assert.Equal(t, []string{orphan}, report.LayersDeleted)
+	assert.Equal(t, int64(8), report.SpaceReclaimed)
+	assert.False(t, manager.LayerExists(orphan))
+	assert.True(t, manager.LayerExists(kept.Layers[0]), "Layers of remaining images must survive")
+}
+
+type estargzFile struct {
+	name     string
+	typeflag byte
+	content  string
+	link     string
+}
+
+// buildEstargz writes files as an eStargz blob: each file's content in its
+// own gzip member, then the TOC and the footer pointing at it. It returns
+// the blob and the digest of its TOC.
+func buildEstargz(t *testing.T, files []estargzFile) ([]byte, string) {
+	var blob bytes.Buffer
+	var gz *gzip.Writer
+	newMember := func() {
+		if gz != nil {
+			require.NoError(t, gz.Close())
+		}
+		gz = gzip.NewWriter(&blob)
+	}
+	tw := tar.NewWriter(writerFunc(func(p []byte) (int, error) { return gz.Write(p) }))
+
+	toc := estargzTOC{Version: 1}
+	for _, file := range files {
+		newMember()
+		header := &tar.Header{Name: file.name, Typeflag: file.typeflag, Mode: 0644, Linkname: file.link}
+		entry := &estargzEntry{Name: file.name, Mode: 0644, LinkName: file.link}
+		switch file.typeflag {
+		case tar.TypeDir:
+			header.Mode, entry.Mode, entry.Type = 0755, 0755, "dir"
+		case tar.TypeSymlink:
+			entry.Type = "symlink"
+		case tar.TypeLink:
+			entry.Type = "hardlink"
+		default:
+			header.Size, entry.Size, entry.Type = int64(len(file.content)), int64(len(file.content)), "reg"
+		}
+		require.NoError(t, tw.WriteHeader(header))
+		if file.typeflag == tar.TypeReg {
+			newMember()
+			entry.Offset = int64(blob.Len())
+			entry.Digest = digestBytes([]byte(file.content))
+			_, err := tw.Write([]byte(file.content))
+			require.NoError(t, err)
+			require.NoError(t, tw.Flush())
+		}
+		toc.Entries = append(toc.Entries, entry)
+	}
+
+	tocData, err := json.Marshal(toc)
+	require.NoError(t, err)
+	newMember()
+	tocOffset := blob.Len()
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: estargzTOCName, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(tocData))}))
+	_, err = tw.Write(tocData)
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+
+	// The footer is an empty gzip member whose extra field holds the TOC
+	// offset, spelled out to get the 51 bytes readers expect
+	field := fmt.Sprintf("%016xSTARGZ", tocOffset)
+	footer := []byte{0x1f, 0x8b, 8, 4, 0, 0, 0, 0, 0, 0xff, byte(len(field) + 4), 0, 'S', 'G', byte(len(field)), 0}
+	footer = append(footer, field...)
+	footer = append(footer, 1, 0, 0, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0)
+	require.Len(t, footer, estargzFooterSize)
+	blob.Write(footer)
+
+	return blob.Bytes(), digestBytes(tocData)
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+func TestLazyPullEstargz(t *testing.T) {
+	bigFile := strings.Repeat("configuration line\n", 5000)
+	layer, tocDigest := buildEstargz(t, []estargzFile{
+		{name: "bin/", typeflag: tar.TypeDir},
+		{name: "bin/app", typeflag: tar.TypeReg, content: "#!/bin/sh\necho hello\n"},
+		{name: prefetchLandmark, typeflag: tar.TypeReg, content: "\x0f"},
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/app.conf", typeflag: tar.TypeReg, content: bigFile},
+		{name: "etc/empty", typeflag: tar.TypeReg},
+		{name: "etc/current", typeflag: tar.TypeSymlink, link: "app.conf"},
+		{name: "bin/app-link", typeflag: tar.TypeLink, link: "bin/app"},
+	})
+	layerDigest := digestBytes(layer)
+	footer := layer[len(layer)-estargzFooterSize:]
+	tocOffset, _, err := parseEstargzFooter(footer)
+	require.NoError(t, err)
+
+	configData := []byte(`{"os":"linux","architecture":"amd64","config":{"Cmd":["/bin/app"]}}`)
+	manifest := func(tocDigest string) []byte {
+		data, err := json.Marshal(Manifest{
+			SchemaVersion: 2,
+			MediaType:     MediaTypeOCIManifest,
+			Config:        Descriptor{Digest: digestBytes(configData)},
+			Layers: []Descriptor{{
+				MediaType:   "application/vnd.oci.image.layer.v1.tar+gzip",
+				Digest:      layerDigest,
+				Size:        int64(len(layer)),
+				Annotations: map[string]string{AnnotationTOCDigest: tocDigest},
+			}},
+		})
+		require.NoError(t, err)
+		return data
+	}
+
+	var mu sync.Mutex
+	var ranges []string
+	var fullDownloads int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/library/app/manifests/latest":
+			w.Header().Set("Content-Type", MediaTypeOCIManifest)
+			w.Write(manifest(tocDigest))
+		case "/v2/library/tampered/manifests/latest":
+			w.Header().Set("Content-Type", MediaTypeOCIManifest)
+			w.Write(manifest(digestBytes([]byte("another toc"))))
+		case "/v2/library/app/blobs/" + digestBytes(configData), "/v2/library/tampered/blobs/" + digestBytes(configData):
+			w.Write(configData)
+		case "/v2/library/app/blobs/" + layerDigest, "/v2/library/tampered/blobs/" + layerDigest:
+			mu.Lock()
+			if r.Header.Get("Range") == "" {
+				fullDownloads++
+			}
+			ranges = append(ranges, r.Header.Get("Range"))
+			mu.Unlock()
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(layer))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	requests := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), ranges...)
+	}
+
+	store, err := store.NewStore(t.TempDir())
+	require.NoError(t, err)
+	manager := NewManager(store)
+	manager.SetRegistry(NewRegistryClient(server.URL))
+	manager.SetLazyPull(true)
+	prefetcher := performance.NewPrefetchManager(2)
+	prefetcher.Start()
+	defer prefetcher.Stop()
+	manager.SetPrefetcher(prefetcher)
+
+	image, err := manager.PullImage("app", "latest")
+	require.NoError(t, err)
+	prefetcher.Wait()
+
+	lazy, err := manager.lazyLayer(layerDigest)
+	require.NoError(t, err)
+	require.NotNil(t, lazy, "The layer should have been pulled lazily")
+	assert.Equal(t, []string{
+		fmt.Sprintf("bytes=%d-%d", len(layer)-estargzFooterSize, len(layer)-1),
+		fmt.Sprintf("bytes=%d-%d", tocOffset, len(layer)-estargzFooterSize-1),
+		fmt.Sprintf("bytes=0-%d", lazy.toc.prefetchEnd()-1),
+	}, requests(), "Only the footer, the TOC and the startup files should be fetched")
+
+	data, err := lazy.ReadFile("/bin/app")
+	require.NoError(t, err)
+	assert.Equal(t, "#!/bin/sh\necho hello\n", string(data))
+	assert.Len(t, requests(), 3, "Prefetched files should be read from disk")
+
+	root := t.TempDir()
+	require.NoError(t, manager.materializeLayers(image.Layers, root))
+	assert.Len(t, requests(), 4, "Files should be fetched on demand, one range each")
+	assert.Zero(t, fullDownloads, "The blob should never be downloaded in full")
+
+	content, err := os.ReadFile(filepath.Join(root, "etc/app.conf"))
+	require.NoError(t, err)
+	assert.Equal(t, bigFile, string(content))
+	content, err = os.ReadFile(filepath.Join(root, "bin/app-link"))
+	require.NoError(t, err)
+	assert.Equal(t, "#!/bin/sh\necho hello\n", string(content))
+	target, err := os.Readlink(filepath.Join(root, "etc/current"))
+	require.NoError(t, err)
+	assert.Equal(t, "app.conf", target)
+	info, err := os.Stat(filepath.Join(root, "etc/empty"))
+	require.NoError(t, err)
+	assert.Zero(t, info.Size())
+	_, err = os.Stat(filepath.Join(root, prefetchLandmark))
+	assert.True(t, os.IsNotExist(err), "Landmarks should not be part of the filesystem")
+
+	_, err = manager.PullImage("tampered", "latest")
+	assert.Error(t, err, "A TOC not matching the manifest should fail the pull")
+}
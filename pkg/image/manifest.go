@@ -0,0 +1,238 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"docker-impl/pkg/types"
+)
+
+const (
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+	MediaTypeOCIConfig          = "application/vnd.oci.image.config.v1+json"
+	MediaTypeOCILayer           = "application/vnd.oci.image.layer.v1.tar"
+)
+
+type Descriptor struct {
+	MediaType string          `json:"mediaType"`
+	Digest    string          `json:"digest"`
+	Size      int64           `json:"size"`
+	Platform  *types.Platform `json:"platform,omitempty"`
+	// Annotations carry the image reference in OCI layout indexes
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type Manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Config        Descriptor   `json:"config"`
+	Layers        []Descriptor `json:"layers"`
+}
+
+type ManifestList struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Manifests     []Descriptor `json:"manifests"`
+}
+
+// imageConfigBlob is the subset of the image config JSON that we keep.
+type imageConfigBlob struct {
+	Created      time.Time `json:"created"`
+	OS           string    `json:"os"`
+	Architecture string    `json:"architecture"`
+	Variant      string    `json:"variant"`
+	Config       struct {
+		Env          []string            `json:"Env"`
+		Cmd          []string            `json:"Cmd"`
+		Entrypoint   []string            `json:"Entrypoint"`
+		WorkingDir   string              `json:"WorkingDir"`
+		ExposedPorts map[string]struct{} `json:"ExposedPorts"`
+		Volumes      map[string]struct{} `json:"Volumes"`
+		Labels       map[string]string   `json:"Labels"`
+		StopSignal   string              `json:"StopSignal"`
+		User         string              `json:"User,omitempty"`
+		Healthcheck  *healthConfigBlob   `json:"Healthcheck,omitempty"`
+		OnBuild      []string            `json:"OnBuild,omitempty"`
+	} `json:"config"`
+	RootFS struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+	History []configHistory `json:"history,omitempty"`
+}
+
+// healthConfigBlob is a HealthConfig as Docker writes it, durations in
+// nanoseconds.
+type healthConfigBlob struct {
+	Test        []string      `json:"Test,omitempty"`
+	Interval    time.Duration `json:"Interval,omitempty"`
+	Timeout     time.Duration `json:"Timeout,omitempty"`
+	StartPeriod time.Duration `json:"StartPeriod,omitempty"`
+	Retries     int           `json:"Retries,omitempty"`
+}
+
+type configHistory struct {
+	Created    time.Time `json:"created"`
+	CreatedBy  string    `json:"created_by,omitempty"`
+	Comment    string    `json:"comment,omitempty"`
+	EmptyLayer bool      `json:"empty_layer,omitempty"`
+}
+
+func newImageConfigBlob(image *types.Image, diffIDs []string) *imageConfigBlob {
+	platform := image.Platform
+	if platform.OS == "" {
+		platform = DefaultPlatform()
+	}
+
+	blob := &imageConfigBlob{
+		Created:      image.CreatedAt,
+		OS:           platform.OS,
+		Architecture: platform.Architecture,
+		Variant:      platform.Variant,
+	}
+	blob.Config.Env = image.Config.Env
+	blob.Config.Cmd = image.Config.Cmd
+	blob.Config.Entrypoint = image.Config.Entrypoint
+	blob.Config.WorkingDir = image.Config.WorkingDir
+	blob.Config.ExposedPorts = image.Config.ExposedPorts
+	blob.Config.Volumes = image.Config.Volumes
+	blob.Config.Labels = image.Config.Labels
+	blob.Config.StopSignal = image.Config.StopSignal
+	blob.Config.User = image.Config.User
+	blob.Config.OnBuild = image.Config.OnBuild
+	if hc := image.Config.Healthcheck; hc != nil {
+		blob.Config.Healthcheck = &healthConfigBlob{
+			Test:        hc.Test,
+			Interval:    hc.Interval,
+			Timeout:     hc.Timeout,
+			StartPeriod: hc.StartPeriod,
+			Retries:     hc.Retries,
+		}
+	}
+	blob.RootFS.Type = "layers"
+	blob.RootFS.DiffIDs = diffIDs
+	for _, h := range image.History {
+		blob.History = append(blob.History, configHistory{
+			Created:    h.Created,
+			CreatedBy:  h.CreatedBy,
+			Comment:    h.Comment,
+			EmptyLayer: h.EmptyLayer,
+		})
+	}
+	return blob
+}
+
+func (b *imageConfigBlob) imageConfig() types.ImageConfig {
+	config := types.ImageConfig{
+		Env:          b.Config.Env,
+		Cmd:          b.Config.Cmd,
+		Entrypoint:   b.Config.Entrypoint,
+		WorkingDir:   b.Config.WorkingDir,
+		ExposedPorts: b.Config.ExposedPorts,
+		Volumes:      b.Config.Volumes,
+		Labels:       b.Config.Labels,
+		StopSignal:   b.Config.StopSignal,
+		User:         b.Config.User,
+		OnBuild:      b.Config.OnBuild,
+	}
+	if hc := b.Config.Healthcheck; hc != nil {
+		config.Healthcheck = &types.HealthConfig{
+			Test:        hc.Test,
+			Interval:    hc.Interval,
+			Timeout:     hc.Timeout,
+			StartPeriod: hc.StartPeriod,
+			Retries:     hc.Retries,
+		}
+	}
+	return config
+}
+
+// imageHistory pairs the config's history with the image layers: each entry
+// that isn't an empty layer takes the next layer and its size.
+func (b *imageConfigBlob) imageHistory(layers []string, sizes []int64) []types.ImageHistory {
+	var history []types.ImageHistory
+	next := 0
+	for _, h := range b.History {
+		entry := types.ImageHistory{
+			Created:    h.Created,
+			CreatedBy:  h.CreatedBy,
+			Comment:    h.Comment,
+			EmptyLayer: h.EmptyLayer,
+		}
+		if !h.EmptyLayer && next < len(layers) {
+			entry.LayerID = layers[next]
+			if next < len(sizes) {
+				entry.Size = sizes[next]
+			}
+			next++
+		}
+		history = append(history, entry)
+	}
+	return history
+}
+
+func (b *imageConfigBlob) platform() types.Platform {
+	return types.Platform{OS: b.OS, Architecture: b.Architecture, Variant: b.Variant}
+}
+
+func IsManifestList(mediaType string) bool {
+	return mediaType == MediaTypeDockerManifestList || mediaType == MediaTypeOCIIndex
+}
+
+// manifestDigest returns the digest of a manifest as received. The digest
+// the registry reported for it, if any, must be the same.
+func manifestDigest(data []byte, reported string) (string, error) {
+	digest := digestBytes(data)
+	if reported != "" && reported != digest {
+		return "", fmt.Errorf("registry reported digest %s, but the manifest received is %s", reported, digest)
+	}
+	return digest, nil
+}
+
+// detectMediaType falls back to the mediaType field in the body when the
+// registry did not send a usable Content-Type.
+func detectMediaType(contentType string, data []byte) string {
+	switch contentType {
+	case MediaTypeDockerManifest, MediaTypeDockerManifestList, MediaTypeOCIManifest, MediaTypeOCIIndex:
+		return contentType
+	}
+
+	var probe struct {
+		MediaType string            `json:"mediaType"`
+		Manifests []json.RawMessage `json:"manifests"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return contentType
+	}
+	if probe.MediaType != "" {
+		return probe.MediaType
+	}
+	if probe.Manifests != nil {
+		return MediaTypeOCIIndex
+	}
+	return MediaTypeOCIManifest
+}
+
+func SelectManifest(list *ManifestList, platform types.Platform) (*Descriptor, error) {
+	for i := range list.Manifests {
+		desc := &list.Manifests[i]
+		if desc.Platform == nil {
+			continue
+		}
+		if platformMatches(platform, *desc.Platform) {
+			return desc, nil
+		}
+	}
+
+	var available []string
+	for _, desc := range list.Manifests {
+		if desc.Platform != nil {
+			available = append(available, desc.Platform.String())
+		}
+	}
+	return nil, fmt.Errorf("no matching manifest for %s in the manifest list entries (available: %v)", platform, available)
+}
@@ -0,0 +1,74 @@
+package image
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+
+	"docker-impl/pkg/types"
+)
+
+// ParsePlatform parses an "os/arch[/variant]" string. A bare architecture
+// such as "arm64" is accepted and assumes linux.
+func ParsePlatform(s string) (types.Platform, error) {
+	if s == "" {
+		return DefaultPlatform(), nil
+	}
+
+	parts := strings.Split(strings.ToLower(s), "/")
+	for _, part := range parts {
+		if part == "" {
+			return types.Platform{}, fmt.Errorf("invalid platform: %s", s)
+		}
+	}
+
+	var platform types.Platform
+	switch len(parts) {
+	case 1:
+		platform = types.Platform{OS: "linux", Architecture: parts[0]}
+	case 2:
+		platform = types.Platform{OS: parts[0], Architecture: parts[1]}
+	case 3:
+		platform = types.Platform{OS: parts[0], Architecture: parts[1], Variant: parts[2]}
+	default:
+		return types.Platform{}, fmt.Errorf("invalid platform: %s", s)
+	}
+
+	return normalizePlatform(platform), nil
+}
+
+func DefaultPlatform() types.Platform {
+	platform := types.Platform{OS: "linux", Architecture: runtime.GOARCH}
+	if runtime.GOARCH == "arm" {
+		platform.Variant = "v7"
+	}
+	return normalizePlatform(platform)
+}
+
+func normalizePlatform(p types.Platform) types.Platform {
+	switch p.Architecture {
+	case "x86_64", "x86-64", "amd64":
+		p.Architecture = "amd64"
+		p.Variant = ""
+	case "aarch64", "arm64":
+		p.Architecture = "arm64"
+		if p.Variant == "v8" {
+			p.Variant = ""
+		}
+	case "i386", "386":
+		p.Architecture = "386"
+	}
+	return p
+}
+
+// platformMatches reports whether a manifest platform satisfies the wanted one.
+// An unset variant on the wanted side matches any variant.
+func platformMatches(want, have types.Platform) bool {
+	want = normalizePlatform(want)
+	have = normalizePlatform(have)
+
+	if want.OS != have.OS || want.Architecture != have.Architecture {
+		return false
+	}
+	return want.Variant == "" || want.Variant == have.Variant
+}
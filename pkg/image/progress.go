@@ -0,0 +1,80 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"docker-impl/pkg/types"
+)
+
+// Build event types.
+const (
+	BuildEventStep     = "step"
+	BuildEventOutput   = "output"
+	BuildEventCache    = "cache"
+	BuildEventLayer    = "layer"
+	BuildEventTrigger  = "trigger"
+	BuildEventInfo     = "info"
+	BuildEventWarning  = "warning"
+	BuildEventComplete = "complete"
+	BuildEventError    = "error"
+)
+
+// NewBuildProgress returns a build progress writer for mode: plain, the
+// human-readable output, or json, one event object per line.
+func NewBuildProgress(mode string, w io.Writer) (func(types.BuildEvent), error) {
+	switch mode {
+	case "", "plain":
+		return PlainProgress(w), nil
+	case "json":
+		return JSONProgress(w), nil
+	default:
+		return nil, fmt.Errorf("invalid progress mode %q: must be plain or json", mode)
+	}
+}
+
+// PlainProgress writes build events as the classic step-by-step output.
+// Errors are left to the caller, which gets them from the build.
+func PlainProgress(w io.Writer) func(types.BuildEvent) {
+	return func(event types.BuildEvent) {
+		switch event.Type {
+		case BuildEventStep:
+			fmt.Fprintf(w, "Step %d/%d : %s\n", event.Step, event.Total, event.Instruction)
+		case BuildEventOutput:
+			io.WriteString(w, event.Message)
+		case BuildEventCache:
+			fmt.Fprintf(w, " ---> Using cache %s\n", shortLayerID(event.Layer))
+		case BuildEventLayer:
+			fmt.Fprintf(w, " ---> %s\n", shortLayerID(event.Layer))
+		case BuildEventTrigger:
+			fmt.Fprintf(w, " ---> Running trigger: %s\n", event.Instruction)
+		case BuildEventInfo:
+			fmt.Fprintln(w, event.Message)
+		case BuildEventWarning:
+			fmt.Fprintf(w, "[Warning] %s\n", event.Message)
+		case BuildEventComplete:
+			fmt.Fprintf(w, "Successfully built %s\n", event.ImageID[:12])
+		}
+	}
+}
+
+// JSONProgress writes each build event as a JSON object on its own line.
+func JSONProgress(w io.Writer) func(types.BuildEvent) {
+	encoder := json.NewEncoder(w)
+	return func(event types.BuildEvent) {
+		encoder.Encode(event)
+	}
+}
+
+// buildOutput turns what a RUN writes to one stream into output events as
+// it arrives, rather than once the command finishes.
+type buildOutput struct {
+	b      *builder
+	stream string
+}
+
+func (o *buildOutput) Write(p []byte) (int, error) {
+	o.b.emit(types.BuildEvent{Type: BuildEventOutput, Step: o.b.step, Stream: o.stream, Message: string(p)})
+	return len(p), nil
+}
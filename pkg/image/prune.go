@@ -0,0 +1,200 @@
+package image
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"docker-impl/pkg/types"
+	"github.com/sirupsen/logrus"
+)
+
+// IsDangling reports whether an image has lost its name, usually because a
+// newer build or pull took over its tag.
+func IsDangling(image *types.Image) bool {
+	return image.Name == "" || image.Name == "<none>"
+}
+
+// GetChildren returns the images that were built on top of imageID.
+func (m *Manager) GetChildren(imageID string) ([]*types.Image, error) {
+	images, err := m.ListImages()
+	if err != nil {
+		return nil, err
+	}
+
+	var children []*types.Image
+	for _, image := range images {
+		if image.Parent == imageID {
+			children = append(children, image)
+		}
+	}
+	return children, nil
+}
+
+// PruneImages removes dangling images, or with options.All every image,
+// that no container in inUse refers to. An image that other images were
+// built from is kept until its children are gone, so pruning repeats until
+// nothing else qualifies. Layers left without an image are deleted and
+// count towards the reclaimed space.
+func (m *Manager) PruneImages(options types.ImagePruneOptions, inUse map[string]bool) (*types.ImagePruneReport, error) {
+	images, err := m.ListImages()
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := time.Now().Add(-options.Until)
+	remaining := make(map[string]*types.Image, len(images))
+	for _, image := range images {
+		remaining[image.ID] = image
+	}
+
+	report := &types.ImagePruneReport{}
+	removed := make(map[string]*types.Image)
+	for {
+		children := make(map[string]int)
+		for _, image := range remaining {
+			if image.Parent != "" {
+				children[image.Parent]++
+			}
+		}
+
+		var candidates []*types.Image
+		for _, image := range remaining {
+			if inUse[image.ID] || children[image.ID] > 0 {
+				continue
+			}
+			if !options.All && !IsDangling(image) {
+				continue
+			}
+			if options.Until > 0 && image.CreatedAt.After(cutoff) {
+				continue
+			}
+			candidates = append(candidates, image)
+		}
+		if len(candidates) == 0 {
+			break
+		}
+
+		for _, image := range candidates {
+			if err := m.RemoveImage(image.ID); err != nil {
+				return report, err
+			}
+			delete(remaining, image.ID)
+			removed[image.ID] = image
+			report.ImagesDeleted = append(report.ImagesDeleted, image.ID)
+		}
+	}
+	sort.Strings(report.ImagesDeleted)
+
+	referenced := make(map[string]bool)
+	for _, image := range remaining {
+		for _, layerID := range image.Layers {
+			referenced[layerID] = true
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, image := range removed {
+		for _, layerID := range image.Layers {
+			if referenced[layerID] || seen[layerID] {
+				continue
+			}
+			seen[layerID] = true
+			m.removeLazyLayer(layerID)
+			if !m.LayerExists(layerID) {
+				continue
+			}
+
+			size := dirSize(m.GetLayerDir(layerID))
+			if err := os.RemoveAll(m.GetLayerDir(layerID)); err != nil {
+				return report, fmt.Errorf("failed to remove layer %s: %v", layerID, err)
+			}
+			report.LayersDeleted = append(report.LayersDeleted, layerID)
+			report.SpaceReclaimed += size
+		}
+	}
+	sort.Strings(report.LayersDeleted)
+
+	logrus.Infof("Pruned %d images and %d layers, reclaimed %d bytes", len(report.ImagesDeleted), len(report.LayersDeleted), report.SpaceReclaimed)
+	return report, nil
+}
+
+func dirSize(root string) int64 {
+	var size int64
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// LayerReferences counts, for every layer on disk, the images and build
+// cache entries that use it. Layers nothing refers to count as zero.
+func (m *Manager) LayerReferences() (map[string]int, error) {
+	refs := make(map[string]int)
+	entries, err := os.ReadDir(filepath.Join(m.store.GetDataDir(), LayersDir))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to list layers: %v", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), "tmp-") {
+			refs[entry.Name()] = 0
+		}
+	}
+
+	images, err := m.ListImages()
+	if err != nil {
+		return nil, err
+	}
+	for _, image := range images {
+		seen := make(map[string]bool)
+		for _, layerID := range image.Layers {
+			if !seen[layerID] {
+				seen[layerID] = true
+				refs[layerID]++
+			}
+		}
+	}
+
+	files, _ := m.store.ListFiles(BuildCacheDir)
+	for _, file := range files {
+		var entry buildCacheEntry
+		if err := m.store.LoadJSON(filepath.Join(BuildCacheDir, file), &entry); err != nil || entry.Layer == "" {
+			continue
+		}
+		refs[entry.Layer]++
+	}
+	return refs, nil
+}
+
+// GarbageCollectLayers deletes the layers on disk that no image or build
+// cache entry refers to, such as those left behind by removed images.
+func (m *Manager) GarbageCollectLayers() (*types.ImagePruneReport, error) {
+	refs, err := m.LayerReferences()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &types.ImagePruneReport{}
+	for layerID, count := range refs {
+		if count > 0 || !m.LayerExists(layerID) {
+			continue
+		}
+
+		size := dirSize(m.GetLayerDir(layerID))
+		if err := os.RemoveAll(m.GetLayerDir(layerID)); err != nil {
+			return report, fmt.Errorf("failed to remove layer %s: %v", layerID, err)
+		}
+		report.LayersDeleted = append(report.LayersDeleted, layerID)
+		report.SpaceReclaimed += size
+	}
+	sort.Strings(report.LayersDeleted)
+
+	logrus.Infof("Layer garbage collection removed %d layers, reclaimed %d bytes", len(report.LayersDeleted), report.SpaceReclaimed)
+	return report, nil
+}
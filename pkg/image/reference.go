@@ -0,0 +1,284 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"docker-impl/pkg/reference"
+	"docker-impl/pkg/types"
+	"github.com/sirupsen/logrus"
+)
+
+// ReferencesFile maps repository references to image IDs.
+const ReferencesFile = "repositories.json"
+
+// references points tags (name:tag) and digests (name@sha256:...) at image
+// IDs. An image is stored once under the digest of its config no matter
+// how many references it has.
+type references struct {
+	Tags    map[string]string `json:"tags"`
+	Digests map[string]string `json:"digests"`
+}
+
+// ResolveImage finds a local image by ID, sha256:<ID>, name[:tag] or
+// name@digest.
+func (m *Manager) ResolveImage(ref string) (*types.Image, error) {
+	if id := strings.TrimPrefix(ref, "sha256:"); m.ImageExists(id) {
+		return m.GetImage(id)
+	}
+
+	parsed, err := reference.ParseNormalized(ref)
+	if err != nil {
+		return nil, err
+	}
+	return m.GetImageByName(parsed.FamiliarName(), parsed.TagOrDigest())
+}
+
+// normalizeReference parses name with a tag, or with a digest when
+// tagOrDigest contains a colon.
+func normalizeReference(name, tagOrDigest string) (*reference.Reference, error) {
+	switch {
+	case tagOrDigest == "":
+	case strings.Contains(tagOrDigest, ":"):
+		name += "@" + tagOrDigest
+	default:
+		name += ":" + tagOrDigest
+	}
+	return reference.ParseNormalized(name)
+}
+
+// normalizeTag turns a user supplied name[:tag] into the familiar
+// name:tag that local tags are stored under.
+func normalizeTag(ref string) (string, error) {
+	parsed, err := reference.ParseNormalized(ref)
+	if err != nil {
+		return "", err
+	}
+	if parsed.Digest != "" {
+		return "", fmt.Errorf("tag must not contain a digest: %s", ref)
+	}
+	return parsed.FamiliarString(), nil
+}
+
+// registerImage stores image under the digest of its config and points the
+// given references at it. An image that is already stored is reused rather
+// than written again. configDigest may be empty, in which case it is
+// computed from the image.
+func (m *Manager) registerImage(image *types.Image, configDigest string, tags, digests []string) (*types.Image, error) {
+	if configDigest == "" {
+		digest, err := imageConfigDigest(image)
+		if err != nil {
+			return nil, err
+		}
+		configDigest = digest
+	}
+	image.ID = strings.TrimPrefix(configDigest, "sha256:")
+
+	if existing, err := m.loadImageRecord(image.ID); err == nil {
+		logrus.Debugf("Image %s is already stored", image.ID)
+		image = existing
+	} else if err := m.saveImage(image); err != nil {
+		return nil, err
+	}
+
+	if err := m.addReferences(image.ID, tags, digests); err != nil {
+		return nil, err
+	}
+
+	refs, err := m.loadReferences()
+	if err != nil {
+		return nil, err
+	}
+	refs.decorate(image)
+	if len(tags) > 0 {
+		image.Name, image.Tag = parseNameTag(tags[0])
+	}
+	return image, nil
+}
+
+// imageConfigDigest hashes the config blob of a locally created image, whose
+// layer IDs stand in for diff IDs.
+func imageConfigDigest(image *types.Image) (string, error) {
+	data, err := json.Marshal(newImageConfigBlob(image, imageDiffIDs(image)))
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal image config: %v", err)
+	}
+	return digestBytes(data), nil
+}
+
+// imageDiffIDs returns the diff IDs of an image. Pulled images record
+// them; the layer IDs of built and loaded images are their diff IDs.
+func imageDiffIDs(image *types.Image) []string {
+	if len(image.DiffIDs) > 0 && len(image.DiffIDs) == len(image.Layers) {
+		return image.DiffIDs
+	}
+	diffIDs := make([]string, 0, len(image.Layers))
+	for _, layerID := range image.Layers {
+		if !strings.HasPrefix(layerID, "sha256:") {
+			layerID = "sha256:" + layerID
+		}
+		diffIDs = append(diffIDs, layerID)
+	}
+	return diffIDs
+}
+
+func (m *Manager) loadReferences() (*references, error) {
+	refs := &references{Tags: make(map[string]string), Digests: make(map[string]string)}
+	if !m.store.FileExists(ReferencesFile) {
+		return refs, m.migrateReferences(refs)
+	}
+
+	if err := m.store.LoadJSON(ReferencesFile, refs); err != nil {
+		return nil, fmt.Errorf("failed to load image references: %v", err)
+	}
+	if refs.Tags == nil {
+		refs.Tags = make(map[string]string)
+	}
+	if refs.Digests == nil {
+		refs.Digests = make(map[string]string)
+	}
+	return refs, nil
+}
+
+// migrateReferences fills refs from the names kept in image records by
+// stores created before references existed.
+func (m *Manager) migrateReferences(refs *references) error {
+	files, err := m.store.ListFiles("images")
+	if err != nil {
+		return nil
+	}
+
+	for _, file := range files {
+		if filepath.Ext(file) != ".json" {
+			continue
+		}
+		image, err := m.loadImageRecord(strings.TrimSuffix(file, ".json"))
+		if err != nil || image.Name == "" || image.Name == "<none>" {
+			continue
+		}
+		tag := image.Tag
+		if tag == "" || tag == "<none>" {
+			tag = "latest"
+		}
+		refs.Tags[image.Name+":"+tag] = image.ID
+	}
+
+	if len(refs.Tags) == 0 {
+		return nil
+	}
+	logrus.Infof("Migrated %d image tags to %s", len(refs.Tags), ReferencesFile)
+	var imageIDs []string
+	for _, id := range refs.Tags {
+		imageIDs = append(imageIDs, id)
+	}
+	return m.saveReferences(refs, imageIDs...)
+}
+
+// saveReferences writes refs and updates the search index entries of the
+// images whose references changed.
+func (m *Manager) saveReferences(refs *references, changed ...string) error {
+	if err := m.store.SaveJSON(ReferencesFile, refs); err != nil {
+		return fmt.Errorf("failed to save image references: %v", err)
+	}
+	m.indexImages(changed...)
+	return nil
+}
+
+// addReferences points tags and digests at imageID. A tag that belonged to
+// another image moves, leaving that image without it.
+func (m *Manager) addReferences(imageID string, tags, digests []string) error {
+	if len(tags) == 0 && len(digests) == 0 {
+		return nil
+	}
+
+	m.refMu.Lock()
+	defer m.refMu.Unlock()
+
+	refs, err := m.loadReferences()
+	if err != nil {
+		return err
+	}
+	changed := []string{imageID}
+	for _, tag := range tags {
+		if previous, ok := refs.Tags[tag]; ok && previous != imageID {
+			logrus.Infof("Moving tag %s from image %s", tag, previous)
+			changed = append(changed, previous)
+		}
+		refs.Tags[tag] = imageID
+	}
+	for _, digest := range digests {
+		refs.Digests[digest] = imageID
+	}
+	return m.saveReferences(refs, changed...)
+}
+
+func (m *Manager) removeReferences(imageID string) error {
+	m.refMu.Lock()
+	defer m.refMu.Unlock()
+
+	refs, err := m.loadReferences()
+	if err != nil {
+		return err
+	}
+	for ref, id := range refs.Tags {
+		if id == imageID {
+			delete(refs.Tags, ref)
+		}
+	}
+	for ref, id := range refs.Digests {
+		if id == imageID {
+			delete(refs.Digests, ref)
+		}
+	}
+	return m.saveReferences(refs, imageID)
+}
+
+// removeReference drops a single tag or digest and returns the ID of the
+// image it pointed at.
+func (m *Manager) removeReference(ref *reference.Reference) (string, error) {
+	m.refMu.Lock()
+	defer m.refMu.Unlock()
+
+	refs, err := m.loadReferences()
+	if err != nil {
+		return "", err
+	}
+
+	table, key := refs.Tags, ref.FamiliarName()+":"+ref.Tag
+	if ref.Digest != "" {
+		table, key = refs.Digests, ref.FamiliarName()+"@"+ref.Digest
+	}
+	imageID, ok := table[key]
+	if !ok {
+		return "", fmt.Errorf("no such image reference: %s", key)
+	}
+	delete(table, key)
+
+	return imageID, m.saveReferences(refs, imageID)
+}
+
+// decorate fills in the references of image. Name and Tag come from the
+// first tag, or are <none> when the image has none.
+func (refs *references) decorate(image *types.Image) {
+	image.RepoTags = refsFor(refs.Tags, image.ID)
+	image.RepoDigests = refsFor(refs.Digests, image.ID)
+
+	image.Name, image.Tag = "<none>", "<none>"
+	if len(image.RepoTags) > 0 {
+		image.Name, image.Tag = parseNameTag(image.RepoTags[0])
+	}
+}
+
+func refsFor(refs map[string]string, imageID string) []string {
+	var result []string
+	for ref, id := range refs {
+		if id == imageID {
+			result = append(result, ref)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,306 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const DefaultRegistry = "https://registry-1.docker.io"
+
+var manifestAcceptTypes = []string{
+	MediaTypeDockerManifestList,
+	MediaTypeOCIIndex,
+	MediaTypeDockerManifest,
+	MediaTypeOCIManifest,
+}
+
+type RegistryClient struct {
+	endpoint string
+	// mirrors are tried in order before the endpoint
+	mirrors []string
+	cache   *BlobCache
+	client  *http.Client
+	// tokens holds bearer tokens by registry and repository
+	tokens map[string]string
+	retry  RetryPolicy
+	// breakers holds the circuit breakers of failing registry hosts
+	breakers map[string]*circuitBreaker
+	mu       sync.Mutex
+}
+
+func NewRegistryClient(endpoint string) *RegistryClient {
+	if endpoint == "" {
+		endpoint = DefaultRegistry
+	}
+
+	return &RegistryClient{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		client:   &http.Client{Timeout: 60 * time.Second},
+		tokens:   make(map[string]string),
+		retry:    DefaultRetryPolicy,
+		breakers: make(map[string]*circuitBreaker),
+	}
+}
+
+func (r *RegistryClient) Endpoint() string {
+	return r.endpoint
+}
+
+// SetMirrors sets registries serving the same content as the endpoint.
+// Requests go to each mirror in turn and fall back to the endpoint when
+// none of them has what was asked for.
+func (r *RegistryClient) SetMirrors(mirrors []string) {
+	r.mirrors = nil
+	for _, mirror := range mirrors {
+		if mirror = strings.TrimSuffix(strings.TrimSpace(mirror), "/"); mirror != "" {
+			r.mirrors = append(r.mirrors, mirror)
+		}
+	}
+}
+
+func (r *RegistryClient) Mirrors() []string {
+	return r.mirrors
+}
+
+// SetCache makes blob downloads go through an on-disk cache.
+func (r *RegistryClient) SetCache(cache *BlobCache) {
+	r.cache = cache
+}
+
+func (r *RegistryClient) Cache() *BlobCache {
+	return r.cache
+}
+
+// GetManifest returns the raw manifest, its media type and its digest.
+func (r *RegistryClient) GetManifest(repository, reference string) ([]byte, string, string, error) {
+	path := fmt.Sprintf("/v2/%s/manifests/%s", repository, reference)
+	resp, err := r.do(repository, path, http.Header{"Accept": manifestAcceptTypes})
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("failed to read manifest: %v", err)
+	}
+
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" && strings.HasPrefix(reference, "sha256:") {
+		digest = reference
+	}
+
+	return data, detectMediaType(resp.Header.Get("Content-Type"), data), digest, nil
+}
+
+// GetBlob downloads a blob, serving it from the cache when one is set.
+// Blobs are content addressed, so any repository's copy will do.
+func (r *RegistryClient) GetBlob(repository, digest string) ([]byte, error) {
+	if r.cache != nil {
+		if data, ok := r.cache.Get(digest); ok {
+			logrus.Debugf("Blob %s served from cache", digest)
+			return data, nil
+		}
+	}
+
+	resp, err := r.do(repository, fmt.Sprintf("/v2/%s/blobs/%s", repository, digest), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blob %s: %v", digest, err)
+	}
+
+	if r.cache != nil {
+		if err := r.cache.Put(digest, data); err != nil {
+			logrus.Warnf("Failed to cache blob: %v", err)
+		}
+	}
+	return data, nil
+}
+
+// GetBlobRange returns length bytes of a blob starting at offset, using
+// an HTTP range request so lazily pulled layers only download what is
+// read. Registries that ignore the range send the whole blob, which is
+// cut down here.
+func (r *RegistryClient) GetBlobRange(repository, digest string, offset, length int64) ([]byte, error) {
+	if offset < 0 || length <= 0 {
+		return nil, fmt.Errorf("invalid range %d+%d for blob %s", offset, length, digest)
+	}
+	if r.cache != nil {
+		if data, ok := r.cache.Get(digest); ok && offset+length <= int64(len(data)) {
+			return data[offset : offset+length], nil
+		}
+	}
+
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)}}
+	resp, err := r.do(repository, fmt.Sprintf("/v2/%s/blobs/%s", repository, digest), header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body := io.Reader(resp.Body)
+	if resp.StatusCode == http.StatusOK {
+		if _, err := io.CopyN(io.Discard, body, offset); err != nil {
+			return nil, fmt.Errorf("failed to read blob %s: %v", digest, err)
+		}
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(body, data); err != nil {
+		return nil, fmt.Errorf("failed to read range of blob %s: %v", digest, err)
+	}
+	return data, nil
+}
+
+// do sends a GET to each mirror and then the endpoint, returning the
+// first successful response. When all of them fail, the error says how
+// each one did.
+func (r *RegistryClient) do(repository, path string, header http.Header) (*http.Response, error) {
+	var failures []string
+	for _, mirror := range r.mirrors {
+		resp, err := r.doWithRetry(mirror, repository, path, header)
+		if err == nil {
+			return resp, nil
+		}
+		logrus.Debugf("Mirror %s failed, trying next: %v", mirror, err)
+		failures = append(failures, fmt.Sprintf("mirror %s: %v", mirror, err))
+	}
+
+	resp, err := r.doWithRetry(r.endpoint, repository, path, header)
+	if err != nil && len(failures) > 0 {
+		failures = append(failures, fmt.Sprintf("registry %s: %v", r.endpoint, err))
+		return nil, fmt.Errorf("failed to fetch %s from any registry:\n  %s", path, strings.Join(failures, "\n  "))
+	}
+	return resp, err
+}
+
+func (r *RegistryClient) doRegistry(registry, repository, path string, header http.Header) (*http.Response, error) {
+	resp, err := r.request(registry, repository, path, header)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+
+		if err := r.authenticate(registry, repository, challenge); err != nil {
+			return nil, err
+		}
+		if resp, err = r.request(registry, repository, path, header); err != nil {
+			return nil, err
+		}
+	}
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		err := fmt.Errorf("registry returned %s for %s", resp.Status, path)
+		if isTransientStatus(resp.StatusCode) {
+			return nil, &transientError{err: err, retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+		}
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+func (r *RegistryClient) request(registry, repository, path string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, registry+path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	for key, values := range header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+
+	r.mu.Lock()
+	token := r.tokens[registry+"/"+repository]
+	r.mu.Unlock()
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, &transientError{err: fmt.Errorf("failed to contact registry: %v", err)}
+	}
+	return resp, nil
+}
+
+// authenticate handles the anonymous bearer token flow used by Docker Hub
+// and most distribution registries.
+func (r *RegistryClient) authenticate(registry, repository, challenge string) error {
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return fmt.Errorf("unsupported registry auth challenge: %s", challenge)
+	}
+
+	params := make(map[string]string)
+	for _, part := range strings.Split(strings.TrimPrefix(challenge, "Bearer "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) == 2 {
+			params[kv[0]] = strings.Trim(kv[1], `"`)
+		}
+	}
+
+	realm := params["realm"]
+	if realm == "" {
+		return fmt.Errorf("auth challenge has no realm")
+	}
+
+	query := url.Values{}
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = fmt.Sprintf("repository:%s:pull", repository)
+	}
+	query.Set("scope", scope)
+
+	resp, err := r.client.Get(realm + "?" + query.Encode())
+	if err != nil {
+		return &transientError{err: fmt.Errorf("failed to fetch registry token: %v", err)}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("token endpoint returned %s", resp.Status)
+		if isTransientStatus(resp.StatusCode) {
+			return &transientError{err: err, retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+		}
+		return err
+	}
+
+	var tokenResp struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return fmt.Errorf("failed to decode registry token: %v", err)
+	}
+
+	token := tokenResp.Token
+	if token == "" {
+		token = tokenResp.AccessToken
+	}
+
+	r.mu.Lock()
+	r.tokens[registry+"/"+repository] = token
+	r.mu.Unlock()
+
+	return nil
+}
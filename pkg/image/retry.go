@@ -0,0 +1,205 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RetryPolicy says how registry requests failing with a transient error,
+// i.e. a 429, a 5xx or a network error, are retried.
+type RetryPolicy struct {
+	// Attempts is how many times a request is tried; 1 disables retries
+	Attempts int
+	// The delay between attempts doubles from InitialBackoff up to
+	// MaxBackoff, unless the registry sent a Retry-After
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// After BreakerThreshold transient failures in a row, requests to the
+	// registry fail right away for BreakerCooldown
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:         3,
+	InitialBackoff:   500 * time.Millisecond,
+	MaxBackoff:       10 * time.Second,
+	BreakerThreshold: 5,
+	BreakerCooldown:  30 * time.Second,
+}
+
+// transientError is a failure that may not happen again, with the delay
+// the registry asked for, if any.
+type transientError struct {
+	err        error
+	retryAfter time.Duration
+}
+
+func (e *transientError) Error() string {
+	return e.err.Error()
+}
+
+func isTransientStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as a date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
+
+// backoff is the delay before the attempt after attempt, with jitter so
+// clients failing together don't retry together.
+func (p RetryPolicy) backoff(attempt int, retryAfter time.Duration) time.Duration {
+	delay := retryAfter
+	if delay == 0 {
+		delay = p.InitialBackoff << (attempt - 1)
+		if delay > 0 {
+			delay += time.Duration(rand.Int63n(int64(delay)/2 + 1))
+		}
+	}
+	if p.MaxBackoff > 0 && (delay > p.MaxBackoff || delay < 0) {
+		delay = p.MaxBackoff
+	}
+	return delay
+}
+
+// circuitBreaker counts the transient failures in a row of one registry
+// host. Once open, the first request after the cooldown goes through and
+// closes it again if it succeeds.
+type circuitBreaker struct {
+	failures  int
+	openUntil time.Time
+}
+
+// SetRetryPolicy changes how transient failures are retried. Zero fields
+// keep their default.
+func (r *RegistryClient) SetRetryPolicy(policy RetryPolicy) {
+	if policy.Attempts <= 0 {
+		policy.Attempts = DefaultRetryPolicy.Attempts
+	}
+	if policy.InitialBackoff <= 0 {
+		policy.InitialBackoff = DefaultRetryPolicy.InitialBackoff
+	}
+	if policy.MaxBackoff <= 0 {
+		policy.MaxBackoff = DefaultRetryPolicy.MaxBackoff
+	}
+	if policy.BreakerThreshold <= 0 {
+		policy.BreakerThreshold = DefaultRetryPolicy.BreakerThreshold
+	}
+	if policy.BreakerCooldown <= 0 {
+		policy.BreakerCooldown = DefaultRetryPolicy.BreakerCooldown
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.retry = policy
+}
+
+func (r *RegistryClient) RetryPolicy() RetryPolicy {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.retry
+}
+
+func registryHost(registry string) string {
+	if u, err := url.Parse(registry); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return registry
+}
+
+// allow returns how long requests to host are still refused for.
+func (r *RegistryClient) allow(host string) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if breaker := r.breakers[host]; breaker != nil {
+		if wait := time.Until(breaker.openUntil); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
+
+// recordResult updates the breaker of host after a request, returning
+// whether it is now open.
+func (r *RegistryClient) recordResult(host string, transient bool) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	breaker := r.breakers[host]
+	if !transient {
+		if breaker != nil && breaker.failures >= r.retry.BreakerThreshold {
+			logrus.Infof("Registry %s is reachable again", host)
+		}
+		delete(r.breakers, host)
+		return false
+	}
+
+	if breaker == nil {
+		breaker = &circuitBreaker{}
+		r.breakers[host] = breaker
+	}
+	breaker.failures++
+	if breaker.failures < r.retry.BreakerThreshold {
+		return false
+	}
+	if breaker.failures == r.retry.BreakerThreshold {
+		logrus.Warnf("Registry %s failed %d times in a row, pausing requests for %s", host, breaker.failures, r.retry.BreakerCooldown)
+	}
+	breaker.openUntil = time.Now().Add(r.retry.BreakerCooldown)
+	return true
+}
+
+// doWithRetry sends a request to registry, retrying transient failures.
+// The error lists every failed attempt.
+func (r *RegistryClient) doWithRetry(registry, repository, path string, header http.Header) (*http.Response, error) {
+	host := registryHost(registry)
+	policy := r.RetryPolicy()
+
+	var failures []string
+	for attempt := 1; ; attempt++ {
+		if wait := r.allow(host); wait > 0 {
+			failures = append(failures, fmt.Sprintf("circuit open after repeated failures, next try in %s", wait.Round(time.Second)))
+			break
+		}
+
+		resp, err := r.doRegistry(registry, repository, path, header)
+		var transient *transientError
+		if err == nil || !errors.As(err, &transient) {
+			// The registry answered, so it is up even if it refused
+			r.recordResult(host, false)
+			if err != nil && len(failures) > 0 {
+				err = fmt.Errorf("%s; attempt %d: %v", strings.Join(failures, "; "), attempt, err)
+			}
+			return resp, err
+		}
+
+		failures = append(failures, fmt.Sprintf("attempt %d: %v", attempt, err))
+		if r.recordResult(host, true) || attempt >= policy.Attempts {
+			break
+		}
+		delay := policy.backoff(attempt, transient.retryAfter)
+		logrus.Debugf("Registry %s request for %s failed, retrying in %s: %v", host, path, delay, err)
+		time.Sleep(delay)
+	}
+	return nil, fmt.Errorf("%s", strings.Join(failures, "; "))
+}
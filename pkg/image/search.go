@@ -0,0 +1,94 @@
+package image
+
+import (
+	"sort"
+
+	"docker-impl/pkg/store"
+	"docker-impl/pkg/types"
+	"github.com/sirupsen/logrus"
+)
+
+// imageDocument describes an image with its references to the search
+// index.
+func imageDocument(image *types.Image) *store.IndexDocument {
+	doc := &store.IndexDocument{
+		Kind:   store.KindImage,
+		ID:     image.ID,
+		Name:   image.ID,
+		Fields: make(map[string][]string),
+	}
+	if len(image.ID) > 12 {
+		doc.Name = image.ID[:12]
+	}
+	if len(image.RepoTags) > 0 {
+		doc.Name = image.RepoTags[0]
+	}
+	doc.Fields["name"] = append(append([]string{}, image.RepoTags...), image.RepoDigests...)
+	doc.Fields["label"] = labelValues(image.Labels, image.Config.Labels)
+	doc.Fields["env"] = image.Config.Env
+	return doc
+}
+
+// labelValues returns the labels of every map as sorted key=value pairs.
+func labelValues(maps ...map[string]string) []string {
+	seen := make(map[string]bool)
+	var values []string
+	for _, labels := range maps {
+		for key, value := range labels {
+			if pair := key + "=" + value; !seen[pair] {
+				seen[pair] = true
+				values = append(values, pair)
+			}
+		}
+	}
+	sort.Strings(values)
+	return values
+}
+
+// indexImages updates the search index entries of images, dropping those
+// of images that no longer exist. The index only helps searching, so
+// failures are logged rather than returned.
+func (m *Manager) indexImages(imageIDs ...string) {
+	refs, err := m.loadReferences()
+	if err != nil {
+		logrus.Warnf("Failed to index images: %v", err)
+		return
+	}
+
+	var docs []*store.IndexDocument
+	var removed []string
+	for _, imageID := range imageIDs {
+		image, err := m.loadImageRecord(imageID)
+		if err != nil {
+			removed = append(removed, imageID)
+			continue
+		}
+		refs.decorate(image)
+		docs = append(docs, imageDocument(image))
+	}
+
+	if len(docs) > 0 {
+		if err := m.store.IndexDocuments(docs...); err != nil {
+			logrus.Warnf("Failed to index images: %v", err)
+		}
+	}
+	if len(removed) > 0 {
+		if err := m.store.RemoveDocuments(store.KindImage, removed...); err != nil {
+			logrus.Warnf("Failed to index images: %v", err)
+		}
+	}
+}
+
+// RebuildIndex replaces the search index entries of images with entries
+// for every local image.
+func (m *Manager) RebuildIndex() error {
+	images, err := m.ListImages()
+	if err != nil {
+		return err
+	}
+	docs := make([]*store.IndexDocument, 0, len(images))
+	for _, image := range images {
+		docs = append(docs, imageDocument(image))
+	}
+	return m.store.ReplaceDocuments(store.KindImage, docs)
+}
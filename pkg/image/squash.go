@@ -0,0 +1,149 @@
+package image
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"docker-impl/pkg/types"
+	"github.com/sirupsen/logrus"
+)
+
+// squashLayers merges layers[from:] into one layer on top of layers[:from].
+// Files that an upper layer deleted or overwrote are not carried into the
+// merged layer, so secrets removed later in a build do not survive in it.
+// It returns the new layer list and the size of the merged layer.
+func (m *Manager) squashLayers(layers []string, from int) ([]string, int64, error) {
+	if from < 0 || from > len(layers) {
+		return nil, 0, fmt.Errorf("invalid squash start %d for %d layers", from, len(layers))
+	}
+	base := append([]string(nil), layers[:from]...)
+	if len(layers)-from <= 1 {
+		return layers, 0, nil
+	}
+
+	tmpRoot := filepath.Join(m.store.GetDataDir(), "tmp")
+	if err := os.MkdirAll(tmpRoot, 0755); err != nil {
+		return nil, 0, fmt.Errorf("failed to create squash directory: %v", err)
+	}
+	root, err := os.MkdirTemp(tmpRoot, "squash-")
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create squash directory: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	if err := m.materializeLayers(base, root); err != nil {
+		return nil, 0, err
+	}
+	before, err := takeSnapshot(root)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := m.materializeLayers(layers[from:], root); err != nil {
+		return nil, 0, err
+	}
+	changed, deleted, err := diffSnapshot(root, before)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	layerID, size, err := m.commitLayer(root, changed, deleted)
+	if err != nil {
+		return nil, 0, err
+	}
+	if layerID != "" {
+		base = append(base, layerID)
+	}
+	return base, size, nil
+}
+
+// squashHistory marks the history entries of squashed layers as empty and
+// appends one entry for the merged layer.
+func squashHistory(history []types.ImageHistory, squashed []string, layerID string, size int64, comment string) []types.ImageHistory {
+	merged := make(map[string]bool, len(squashed))
+	for _, id := range squashed {
+		merged[id] = true
+	}
+
+	result := make([]types.ImageHistory, 0, len(history)+1)
+	for _, entry := range history {
+		if merged[entry.LayerID] {
+			entry.LayerID = ""
+			entry.Size = 0
+			entry.EmptyLayer = true
+		}
+		result = append(result, entry)
+	}
+	if layerID != "" {
+		result = append(result, types.ImageHistory{
+			LayerID:   layerID,
+			Created:   time.Now(),
+			CreatedBy: "squash",
+			Size:      size,
+			Comment:   comment,
+		})
+	}
+	return result
+}
+
+// FlattenImage combines all layers of an image into a single layer. The
+// new image keeps the config of the original but has no parent, and is
+// tagged with tags if any are given; the original image is left untouched.
+func (m *Manager) FlattenImage(ref string, tags []string) (*types.Image, error) {
+	image, err := m.ResolveImage(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	var normalized []string
+	for _, tag := range tags {
+		tag, err := normalizeTag(tag)
+		if err != nil {
+			return nil, err
+		}
+		normalized = append(normalized, tag)
+	}
+
+	if len(image.Layers) == 0 {
+		return nil, fmt.Errorf("image %s has no layers to flatten", image.ID[:12])
+	}
+	for _, layerID := range image.Layers {
+		if !m.LayerExists(layerID) {
+			return nil, fmt.Errorf("layer %s of image %s has no content on disk", shortLayerID(layerID), image.ID[:12])
+		}
+	}
+
+	layers, size, history := image.Layers, image.Size, image.History
+	if len(image.Layers) > 1 {
+		layers, size, err = m.squashLayers(image.Layers, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to flatten image %s: %v", image.ID[:12], err)
+		}
+		var layerID string
+		if len(layers) > 0 {
+			layerID = layers[0]
+		}
+		comment := fmt.Sprintf("flattened %d layers of %s", len(image.Layers), image.ID[:12])
+		history = squashHistory(image.History, image.Layers, layerID, size, comment)
+	}
+
+	config := copyImageConfig(image.Config)
+	flattened := &types.Image{
+		CreatedAt: time.Now(),
+		Config:    config,
+		Layers:    layers,
+		Labels:    config.Labels,
+		Size:      size,
+		History:   history,
+		Platform:  image.Platform,
+	}
+
+	flattened, err = m.registerImage(flattened, "", normalized, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store flattened image: %v", err)
+	}
+
+	logrus.Infof("Flattened image %s (%d layers) into %s", image.ID, len(image.Layers), flattened.ID)
+	return flattened, nil
+}
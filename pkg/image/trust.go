@@ -0,0 +1,341 @@
+package image
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+
+	"docker-impl/pkg/reference"
+	"docker-impl/pkg/types"
+	"github.com/sirupsen/logrus"
+)
+
+// CosignSignatureAnnotation holds the base64 signature on each layer of a
+// cosign signature manifest.
+const CosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+
+// TrustPolicy lists the registries and repositories whose images must be
+// signed. Without Enforce, failed verifications are only logged.
+type TrustPolicy struct {
+	Enforce bool         `json:"enforce"`
+	Scopes  []TrustScope `json:"registries"`
+}
+
+// TrustScope requires a signature from one of Keys for every image under
+// Scope, a registry (ghcr.io) or repository prefix (docker.io/myorg).
+type TrustScope struct {
+	Scope string   `json:"scope"`
+	Keys  []string `json:"keys"`
+
+	publicKeys map[string]crypto.PublicKey
+}
+
+// simpleSigning is the payload cosign signs: it binds a repository to a
+// manifest digest.
+type simpleSigning struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+// LoadTrustPolicy reads a policy file and the public keys it refers to.
+func LoadTrustPolicy(path string) (*TrustPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trust policy: %v", err)
+	}
+
+	policy := &TrustPolicy{}
+	if err := json.Unmarshal(data, policy); err != nil {
+		return nil, fmt.Errorf("failed to parse trust policy %s: %v", path, err)
+	}
+
+	for i := range policy.Scopes {
+		scope := &policy.Scopes[i]
+		scope.Scope = strings.TrimSuffix(scope.Scope, "/")
+		if scope.Scope == "" {
+			return nil, fmt.Errorf("trust policy entry %d has no scope", i)
+		}
+		if len(scope.Keys) == 0 {
+			return nil, fmt.Errorf("trust policy for %s has no keys", scope.Scope)
+		}
+
+		scope.publicKeys = make(map[string]crypto.PublicKey, len(scope.Keys))
+		for _, keyPath := range scope.Keys {
+			keyID, key, err := loadPublicKey(keyPath)
+			if err != nil {
+				return nil, fmt.Errorf("trust policy for %s: %v", scope.Scope, err)
+			}
+			scope.publicKeys[keyID] = key
+		}
+	}
+	return policy, nil
+}
+
+// SetTrustPolicy makes pulls verify signatures for images the policy
+// covers. A nil policy turns verification off.
+func (m *Manager) SetTrustPolicy(policy *TrustPolicy) {
+	m.trust = policy
+}
+
+// scopeFor returns the most specific scope covering ref, or nil.
+func (p *TrustPolicy) scopeFor(ref *reference.Reference) *TrustScope {
+	if p == nil {
+		return nil
+	}
+
+	name := ref.Name()
+	var best *TrustScope
+	for i := range p.Scopes {
+		scope := &p.Scopes[i]
+		if name != scope.Scope && !strings.HasPrefix(name, scope.Scope+"/") {
+			continue
+		}
+		if best == nil || len(scope.Scope) > len(best.Scope) {
+			best = scope
+		}
+	}
+	return best
+}
+
+// verifyPull checks the signature of a pulled manifest digest. It returns
+// the ID of the key that signed it, or an empty ID when ref needs no
+// signature or the policy is not enforced. Offline, a failed verification
+// is always an error: without trust data nothing can be vouched for.
+func (m *Manager) verifyPull(ref *reference.Reference, digest string) (string, error) {
+	scope := m.trust.scopeFor(ref)
+	if scope == nil {
+		return "", nil
+	}
+
+	keyID, err := m.verifyTrust(ref, scope, digest)
+	if err == nil {
+		logrus.Infof("Verified signature of %s with key %s", ref.FamiliarString(), keyID)
+		return keyID, nil
+	}
+	if m.trust.Enforce || m.trustOffline {
+		return "", fmt.Errorf("signature verification failed for %s: %v", ref.FamiliarString(), err)
+	}
+	logrus.Warnf("Signature verification failed for %s: %v", ref.FamiliarString(), err)
+	return "", nil
+}
+
+// verifyTrust verifies digest against trust data fetched from the
+// registry, caching it on success, or only against the cache when
+// offline.
+func (m *Manager) verifyTrust(ref *reference.Reference, scope *TrustScope, digest string) (string, error) {
+	if m.trustOffline {
+		return m.verifyCachedTrust(ref, scope, digest)
+	}
+
+	record, err := m.fetchTrustData(ref, digest)
+	if err != nil {
+		return "", err
+	}
+	keyID, err := verifySignatures(ref, scope, digest, record)
+	if err != nil {
+		return "", err
+	}
+	m.cacheTrust(record, keyID)
+	return keyID, nil
+}
+
+// fetchTrustData fetches the cosign signature manifest stored next to the
+// image as sha256-<hex>.sig and the payloads it signs.
+func (m *Manager) fetchTrustData(ref *reference.Reference, digest string) (*TrustRecord, error) {
+	if m.registry == nil {
+		return nil, fmt.Errorf("no registry to fetch signatures from")
+	}
+	if !strings.HasPrefix(digest, "sha256:") {
+		return nil, fmt.Errorf("unsupported digest: %s", digest)
+	}
+
+	sigTag := strings.Replace(digest, ":", "-", 1) + ".sig"
+	data, _, _, err := m.registry.GetManifest(ref.Path, sigTag)
+	if err != nil {
+		return nil, fmt.Errorf("no signature found: %v", err)
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse signature manifest: %v", err)
+	}
+
+	record := &TrustRecord{
+		Name:              ref.Name(),
+		Digest:            digest,
+		SignatureManifest: data,
+		Payloads:          make(map[string][]byte),
+	}
+	for _, layer := range manifest.Layers {
+		if layer.Annotations[CosignSignatureAnnotation] == "" {
+			continue
+		}
+		// Payloads that can't be fetched are left out and fail
+		// verification below
+		if payload, err := m.registry.GetBlob(ref.Path, layer.Digest); err == nil {
+			record.Payloads[layer.Digest] = payload
+		}
+	}
+	return record, nil
+}
+
+// verifySignatures accepts the first layer of the record's signature
+// manifest signed by a trusted key whose payload names this repository
+// and digest.
+func verifySignatures(ref *reference.Reference, scope *TrustScope, digest string, record *TrustRecord) (string, error) {
+	var manifest Manifest
+	if err := json.Unmarshal(record.SignatureManifest, &manifest); err != nil {
+		return "", fmt.Errorf("failed to parse signature manifest: %v", err)
+	}
+
+	var lastErr error = fmt.Errorf("signature manifest has no signatures")
+	for _, layer := range manifest.Layers {
+		encoded := layer.Annotations[CosignSignatureAnnotation]
+		if encoded == "" {
+			continue
+		}
+		signature, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			lastErr = fmt.Errorf("invalid signature encoding: %v", err)
+			continue
+		}
+
+		payload, ok := record.Payloads[layer.Digest]
+		if !ok {
+			lastErr = fmt.Errorf("signature payload %s is missing", layer.Digest)
+			continue
+		}
+		if digestBytes(payload) != layer.Digest {
+			lastErr = fmt.Errorf("signature payload does not match its digest")
+			continue
+		}
+
+		keyID, err := scope.verify(payload, signature)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if err := checkSignedPayload(payload, ref, digest); err != nil {
+			lastErr = err
+			continue
+		}
+		return keyID, nil
+	}
+	return "", lastErr
+}
+
+func (s *TrustScope) verify(payload, signature []byte) (string, error) {
+	sum := sha256.Sum256(payload)
+	for keyID, key := range s.publicKeys {
+		var ok bool
+		switch key := key.(type) {
+		case *ecdsa.PublicKey:
+			ok = ecdsa.VerifyASN1(key, sum[:], signature)
+		case ed25519.PublicKey:
+			ok = ed25519.Verify(key, payload, signature)
+		case *rsa.PublicKey:
+			ok = rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], signature) == nil ||
+				rsa.VerifyPSS(key, crypto.SHA256, sum[:], signature, nil) == nil
+		}
+		if ok {
+			return keyID, nil
+		}
+	}
+	return "", fmt.Errorf("signature does not match any trusted key")
+}
+
+func checkSignedPayload(payload []byte, ref *reference.Reference, digest string) error {
+	var signed simpleSigning
+	if err := json.Unmarshal(payload, &signed); err != nil {
+		return fmt.Errorf("failed to parse signature payload: %v", err)
+	}
+	if signed.Critical.Image.DockerManifestDigest != digest {
+		return fmt.Errorf("signature is for %s, not %s", signed.Critical.Image.DockerManifestDigest, digest)
+	}
+
+	signedRef, err := reference.ParseNormalized(signed.Critical.Identity.DockerReference)
+	if err != nil {
+		return fmt.Errorf("signature names an invalid reference: %v", err)
+	}
+	if signedRef.Name() != ref.Name() {
+		return fmt.Errorf("signature is for %s, not %s", signedRef.Name(), ref.Name())
+	}
+	return nil
+}
+
+// CheckTrust refuses images that an enforced policy requires to be signed
+// but that were not verified when pulled, including local images named
+// into a signed scope.
+func (m *Manager) CheckTrust(imageID string) error {
+	if m.trust == nil || !m.trust.Enforce {
+		return nil
+	}
+
+	image, err := m.GetImage(imageID)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range append(append([]string{}, image.RepoTags...), image.RepoDigests...) {
+		ref, err := reference.ParseNormalized(name)
+		if err != nil {
+			continue
+		}
+		scope := m.trust.scopeFor(ref)
+		if scope == nil {
+			continue
+		}
+		if _, trusted := scope.publicKeys[image.SignedBy]; !trusted {
+			return fmt.Errorf("image %s is not signed by a key trusted for %s", name, scope.Scope)
+		}
+	}
+	return nil
+}
+
+// markSigned records the key that verified an image already stored
+// without one.
+func (m *Manager) markSigned(image *types.Image, keyID string) error {
+	if keyID == "" || image.SignedBy == keyID {
+		return nil
+	}
+	image.SignedBy = keyID
+	return m.saveImage(image)
+}
+
+// loadPublicKey reads a PEM public key and returns it with its ID, the
+// sha256 of the DER encoding.
+func loadPublicKey(path string) (string, crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read key: %v", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return "", nil, fmt.Errorf("no PEM data in %s", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to parse key %s: %v", path, err)
+	}
+
+	sum := sha256.Sum256(block.Bytes)
+	return "sha256:" + hex.EncodeToString(sum[:]), key, nil
+}
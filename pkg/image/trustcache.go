@@ -0,0 +1,129 @@
+package image
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"docker-impl/pkg/reference"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultTrustCacheTTL is how long verified trust data can be used offline
+// before the image has to be verified against the registry again.
+const DefaultTrustCacheTTL = 7 * 24 * time.Hour
+
+const trustCacheDir = "trust"
+
+// TrustRecord is the trust data that verified a manifest digest. It keeps
+// the signature manifest and payloads rather than just the outcome, so
+// offline verification still checks them against the policy's current
+// keys.
+type TrustRecord struct {
+	Name              string            `json:"name"`
+	Digest            string            `json:"digest"`
+	KeyID             string            `json:"key_id"`
+	VerifiedAt        time.Time         `json:"verified_at"`
+	ExpiresAt         time.Time         `json:"expires_at"`
+	SignatureManifest []byte            `json:"signature_manifest"`
+	Payloads          map[string][]byte `json:"payloads"`
+}
+
+// SetTrustCacheTTL sets how long trust data cached by later verifications
+// stays valid offline. Zero or less uses DefaultTrustCacheTTL.
+func (m *Manager) SetTrustCacheTTL(ttl time.Duration) {
+	m.trustTTL = ttl
+}
+
+// SetTrustOffline makes verification use only cached trust data, for
+// air-gapped hosts. Images the policy covers fail verification when their
+// trust data is missing or expired, whether or not the policy is enforced.
+func (m *Manager) SetTrustOffline(offline bool) {
+	m.trustOffline = offline
+}
+
+// VerifyImage checks the signature of a local image under the trust
+// policy, from the registry or, offline, from cached trust data. It
+// returns the ID of the key that signed it.
+func (m *Manager) VerifyImage(name string) (string, error) {
+	ref, err := reference.ParseNormalized(name)
+	if err != nil {
+		return "", err
+	}
+	scope := m.trust.scopeFor(ref)
+	if scope == nil {
+		return "", fmt.Errorf("no trust policy covers %s", ref.Name())
+	}
+
+	image, err := m.ResolveImage(name)
+	if err != nil {
+		return "", err
+	}
+
+	digests := []string{ref.Digest}
+	if ref.Digest == "" {
+		digests = nil
+		for _, repoDigest := range image.RepoDigests {
+			if repo, digest, ok := strings.Cut(repoDigest, "@"); ok && repo == ref.FamiliarName() {
+				digests = append(digests, digest)
+			}
+		}
+	}
+	if len(digests) == 0 {
+		return "", fmt.Errorf("image %s has no digest in %s to verify", image.ID, ref.FamiliarName())
+	}
+
+	// An image pulled through a manifest list has a digest for the list
+	// and one for its platform's manifest; either may be the signed one
+	var lastErr error
+	for _, digest := range digests {
+		keyID, err := m.verifyTrust(ref, scope, digest)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if err := m.markSigned(image, keyID); err != nil {
+			return "", err
+		}
+		return keyID, nil
+	}
+	return "", fmt.Errorf("signature verification failed for %s: %v", ref.FamiliarString(), lastErr)
+}
+
+// verifyCachedTrust verifies digest against the trust data cached when it
+// was last verified online.
+func (m *Manager) verifyCachedTrust(ref *reference.Reference, scope *TrustScope, digest string) (string, error) {
+	if digest == "" {
+		return "", fmt.Errorf("no digest to look up cached trust data for")
+	}
+	record := &TrustRecord{}
+	if err := m.store.LoadJSON(trustRecordPath(ref.Name(), digest), record); err != nil {
+		return "", fmt.Errorf("no cached trust data for %s@%s", ref.Name(), digest)
+	}
+	if time.Now().After(record.ExpiresAt) {
+		return "", fmt.Errorf("cached trust data for %s@%s expired at %s", ref.Name(), digest, record.ExpiresAt.Format(time.RFC3339))
+	}
+	return verifySignatures(ref, scope, digest, record)
+}
+
+// cacheTrust saves verified trust data. Failing to cache only costs
+// offline verification later, so it doesn't fail the verification.
+func (m *Manager) cacheTrust(record *TrustRecord, keyID string) {
+	ttl := m.trustTTL
+	if ttl <= 0 {
+		ttl = DefaultTrustCacheTTL
+	}
+	record.KeyID = keyID
+	record.VerifiedAt = time.Now()
+	record.ExpiresAt = record.VerifiedAt.Add(ttl)
+
+	if err := m.store.SaveJSON(trustRecordPath(record.Name, record.Digest), record); err != nil {
+		logrus.Warnf("Failed to cache trust data for %s@%s: %v", record.Name, record.Digest, err)
+	}
+}
+
+func trustRecordPath(name, digest string) string {
+	key := strings.TrimPrefix(digestBytes([]byte(name+"@"+digest)), "sha256:")
+	return filepath.Join(trustCacheDir, key+".json")
+}
@@ -0,0 +1,76 @@
+package image
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ResolveUser turns a USER value (user, uid, user:group or uid:gid) into
+// numeric IDs. Names are looked up in /etc/passwd and /etc/group under
+// rootfs; without a group the user's primary group is used.
+func ResolveUser(rootfs, user string) (uint32, uint32, error) {
+	name, group, hasGroup := strings.Cut(user, ":")
+	if name == "" {
+		return 0, 0, fmt.Errorf("invalid user: %q", user)
+	}
+
+	var uid, gid uint32
+	if id, err := strconv.ParseUint(name, 10, 32); err == nil {
+		uid = uint32(id)
+		// A numeric user need not exist, but takes its group when it does
+		if entry, ok := lookupIDFile(filepath.Join(rootfs, "etc", "passwd"), name, 2); ok {
+			gid = parseID(entry[3])
+		}
+	} else {
+		entry, ok := lookupIDFile(filepath.Join(rootfs, "etc", "passwd"), name, 0)
+		if !ok {
+			return 0, 0, fmt.Errorf("unable to find user %s: no matching entries in passwd file", name)
+		}
+		uid, gid = parseID(entry[2]), parseID(entry[3])
+	}
+
+	if !hasGroup {
+		return uid, gid, nil
+	}
+	if id, err := strconv.ParseUint(group, 10, 32); err == nil {
+		return uid, uint32(id), nil
+	}
+	entry, ok := lookupIDFile(filepath.Join(rootfs, "etc", "group"), group, 0)
+	if !ok {
+		return 0, 0, fmt.Errorf("unable to find group %s: no matching entries in group file", group)
+	}
+	return uid, parseID(entry[2]), nil
+}
+
+// lookupIDFile returns the fields of the first passwd or group line whose
+// field at index matches value.
+func lookupIDFile(path, value string, index int) ([]string, bool) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, false
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) < 4 || fields[index] != value {
+			continue
+		}
+		return fields, true
+	}
+	return nil, false
+}
+
+func parseID(s string) uint32 {
+	id, _ := strconv.ParseUint(s, 10, 32)
+	return uint32(id)
+}
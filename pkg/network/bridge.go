@@ -4,9 +4,7 @@ import (
 	"fmt"
 	"net"
 	"os"
-	"os/exec"
 	"strconv"
-	"strings"
 	"sync"
 
 	"github.com/sirupsen/logrus"
@@ -16,32 +14,49 @@ type BridgeManager struct {
 	bridgeName string
 	subnet     *net.IPNet
 	gateway    net.IP
-	usedIPs    map[string]bool
-	mu         sync.RWMutex
+	// subnet6 and gateway6 are set once IPv6 is enabled on the bridge
+	subnet6  *net.IPNet
+	gateway6 net.IP
+	// ipam allocates the addresses of containers on the bridge
+	ipam *IPAMAllocator
+	mu   sync.RWMutex
+	// rules installs and tracks the iptables rules of the bridge
+	rules *RuleStore
+	// userlandProxy has published ports served to the host and the
+	// containers on the bridge by proxy processes rather than NAT alone
+	userlandProxy bool
 }
 
-func NewBridgeManager() (*BridgeManager, error) {
-	defaultSubnet := "172.17.0.0/16"
-	_, ipNet, err := net.ParseCIDR(defaultSubnet)
+// bridgeNetwork is the network the rules of the bridge are recorded under
+const bridgeNetwork = "bridge"
+
+func NewBridgeManager(rules *RuleStore, ipam *IPAMAllocator) (*BridgeManager, error) {
+	// Reserve the bridge's subnet and gateway
+	ipNet, gateway, err := ipam.RequestPool(bridgeNetwork, "172.17.0.0/16", "172.17.0.1")
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse subnet: %v", err)
+		return nil, fmt.Errorf("failed to reserve bridge subnet: %v", err)
 	}
 
-	gateway := net.ParseIP("172.17.0.1")
-	if gateway == nil {
-		return nil, fmt.Errorf("failed to parse gateway IP")
+	// Containers that went away without releasing their address, e.g.
+	// killed along with the process that started them, have no network
+	// namespace left
+	released, err := ipam.ReleaseStale(bridgeNetwork, func(containerID string) bool {
+		return isNetNS(NetNSPath(containerID))
+	})
+	if err != nil {
+		logrus.Warnf("Failed to release stale bridge addresses: %v", err)
+	} else if len(released) > 0 {
+		logrus.Infof("Released %d stale bridge addresses", len(released))
 	}
 
 	bm := &BridgeManager{
 		bridgeName: "mydocker0",
 		subnet:     ipNet,
 		gateway:    gateway,
-		usedIPs:    make(map[string]bool),
+		ipam:       ipam,
+		rules:      rules,
 	}
 
-	// Reserve gateway IP
-	bm.usedIPs[bm.gateway.String()] = true
-
 	if err := bm.createBridge(); err != nil {
 		return nil, fmt.Errorf("failed to create bridge: %v", err)
 	}
@@ -57,20 +72,18 @@ func (bm *BridgeManager) createBridge() error {
 	}
 
 	// Create bridge
-	cmd := exec.Command("ip", "link", "add", "name", bm.bridgeName, "type", "bridge")
-	if err := cmd.Run(); err != nil {
+	if err := addBridge(bm.bridgeName); err != nil {
 		return fmt.Errorf("failed to create bridge: %v", err)
 	}
 
 	// Bring bridge up
-	cmd = exec.Command("ip", "link", "set", "dev", bm.bridgeName, "up")
-	if err := cmd.Run(); err != nil {
+	if err := setLinkUp(bm.bridgeName); err != nil {
 		return fmt.Errorf("failed to bring bridge up: %v", err)
 	}
 
 	// Assign IP to bridge
-	cmd = exec.Command("ip", "addr", "add", bm.gateway.String()+"/16", "dev", bm.bridgeName)
-	if err := cmd.Run(); err != nil {
+	address := &net.IPNet{IP: bm.gateway, Mask: bm.subnet.Mask}
+	if err := replaceAddr(bm.bridgeName, address, false); err != nil {
 		return fmt.Errorf("failed to assign IP to bridge: %v", err)
 	}
 
@@ -88,74 +101,128 @@ func (bm *BridgeManager) createBridge() error {
 	return nil
 }
 
-func (bm *BridgeManager) bridgeExists() bool {
-	cmd := exec.Command("ip", "link", "show", bm.bridgeName)
-	return cmd.Run() == nil
-}
+// DefaultIPv6Subnet is the unique local subnet of the bridge when IPv6 is
+// enabled without one.
+const DefaultIPv6Subnet = "fd00:17::/64"
 
-func (bm *BridgeManager) enableIPForwarding() error {
-	// Enable IPv4 forwarding
-	return os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0644)
-}
+// EnableIPv6 adds an IPv6 subnet to the bridge, so containers get an
+// address of each family and ports can be published on both.
+func (bm *BridgeManager) EnableIPv6(subnet string) error {
+	if subnet == "" {
+		subnet = DefaultIPv6Subnet
+	}
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil || ipNet.IP.To4() != nil {
+		return fmt.Errorf("invalid IPv6 subnet: %s", subnet)
+	}
+	if ones, _ := ipNet.Mask.Size(); ones > 96 {
+		return fmt.Errorf("IPv6 subnet %s is smaller than /96", subnet)
+	}
 
-func (bm *BridgeManager) configureIptables() error {
-	// Add NAT rule for outbound traffic
-	cmd := exec.Command("iptables", "-t", "nat", "-A", "POSTROUTING", "-s", bm.subnet.String(), "!", "-o", bm.bridgeName, "-j", "MASQUERADE")
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to add NAT rule: %v", err)
+	gateway := make(net.IP, net.IPv6len)
+	copy(gateway, ipNet.IP)
+	gateway[net.IPv6len-1] |= 1
+
+	if err := replaceAddr(bm.bridgeName, &net.IPNet{IP: gateway, Mask: ipNet.Mask}, true); err != nil {
+		return fmt.Errorf("failed to assign IPv6 address to bridge: %v", err)
 	}
 
-	// Add forwarding rules
-	cmd = exec.Command("iptables", "-A", "FORWARD", "-i", bm.bridgeName, "-j", "ACCEPT")
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to add forward rule: %v", err)
+	if err := os.WriteFile("/proc/sys/net/ipv6/conf/all/forwarding", []byte("1"), 0644); err != nil {
+		logrus.Warnf("Failed to enable IPv6 forwarding: %v", err)
 	}
 
-	cmd = exec.Command("iptables", "-A", "FORWARD", "-o", bm.bridgeName, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT")
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to add forward rule: %v", err)
+	err = bm.rules.Install(Rule{
+		Binary:  "ip6tables",
+		Table:   "nat",
+		Chain:   "POSTROUTING",
+		Args:    []string{"-s", ipNet.String(), "!", "-o", bm.bridgeName, "-j", "MASQUERADE"},
+		Network: bridgeNetwork,
+		Purpose: "masquerade",
+	})
+	if err != nil {
+		logrus.Warnf("Failed to configure ip6tables: %v", err)
 	}
 
+	bm.mu.Lock()
+	bm.subnet6 = ipNet
+	bm.gateway6 = gateway
+	bm.mu.Unlock()
+
+	logrus.Infof("Enabled IPv6 on bridge %s with subnet %s", bm.bridgeName, ipNet)
 	return nil
 }
 
-func (bm *BridgeManager) AllocateIP() (net.IP, error) {
-	bm.mu.Lock()
-	defer bm.mu.Unlock()
-
-	// Find available IP in subnet
-	for ip := bm.nextIP(bm.gateway); bm.subnet.Contains(ip); ip = bm.nextIP(ip) {
-		ipStr := ip.String()
-		if !bm.usedIPs[ipStr] {
-			bm.usedIPs[ipStr] = true
-			return ip, nil
-		}
+// IPv6Enabled reports whether the bridge has an IPv6 subnet.
+func (bm *BridgeManager) IPv6Enabled() bool {
+	bm.mu.RLock()
+	defer bm.mu.RUnlock()
+	return bm.subnet6 != nil
+}
+
+// IPv6Gateway returns the IPv6 address of the bridge, or nil.
+func (bm *BridgeManager) IPv6Gateway() net.IP {
+	bm.mu.RLock()
+	defer bm.mu.RUnlock()
+	return bm.gateway6
+}
+
+// ContainerIPv6 derives the IPv6 address of a container from its IPv4
+// one, which keeps the two unique together without a second allocator.
+// It returns nil when IPv6 is not enabled.
+func (bm *BridgeManager) ContainerIPv6(ip net.IP) net.IP {
+	bm.mu.RLock()
+	defer bm.mu.RUnlock()
+
+	ip4 := ip.To4()
+	if bm.subnet6 == nil || ip4 == nil {
+		return nil
 	}
+	ip6 := make(net.IP, net.IPv6len)
+	copy(ip6, bm.subnet6.IP)
+	copy(ip6[net.IPv6len-net.IPv4len:], ip4)
+	return ip6
+}
 
-	return nil, fmt.Errorf("no available IP in subnet")
+func (bm *BridgeManager) bridgeExists() bool {
+	return linkExists(bm.bridgeName)
 }
 
-func (bm *BridgeManager) nextIP(ip net.IP) net.IP {
-	nextIP := make(net.IP, len(ip))
-	copy(nextIP, ip)
+func (bm *BridgeManager) enableIPForwarding() error {
+	// Enable IPv4 forwarding
+	return os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0644)
+}
 
-	for j := len(nextIP) - 1; j >= 0; j-- {
-		nextIP[j]++
-		if nextIP[j] > 0 {
-			break
+func (bm *BridgeManager) configureIptables() error {
+	rules := []Rule{
+		// NAT for outbound traffic
+		{Table: "nat", Chain: "POSTROUTING", Purpose: "masquerade",
+			Args: []string{"-s", bm.subnet.String(), "!", "-o", bm.bridgeName, "-j", "MASQUERADE"}},
+		{Table: "filter", Chain: "FORWARD", Purpose: "forward",
+			Args: []string{"-i", bm.bridgeName, "-j", "ACCEPT"}},
+		{Table: "filter", Chain: "FORWARD", Purpose: "forward",
+			Args: []string{"-o", bm.bridgeName, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"}},
+	}
+	for _, rule := range rules {
+		rule.Binary = "iptables"
+		rule.Network = bridgeNetwork
+		if err := bm.rules.Install(rule); err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	return nextIP
+// AllocateIP allocates the address of a container on the bridge.
+func (bm *BridgeManager) AllocateIP(containerID string) (net.IP, error) {
+	return bm.ipam.RequestAddress(bridgeNetwork, containerID, "")
 }
 
 func (bm *BridgeManager) ReleaseIP(ip net.IP) {
-	bm.mu.Lock()
-	defer bm.mu.Unlock()
-
-	ipStr := ip.String()
-	delete(bm.usedIPs, ipStr)
-	logrus.Debugf("Released IP: %s", ipStr)
+	if err := bm.ipam.ReleaseAddress(bridgeNetwork, ip); err != nil {
+		logrus.Warnf("Failed to release IP %s: %v", ip, err)
+		return
+	}
+	logrus.Debugf("Released IP: %s", ip)
 }
 
 func (bm *BridgeManager) CreateVethPair(containerID string) (string, string, error) {
@@ -163,20 +230,17 @@ func (bm *BridgeManager) CreateVethPair(containerID string) (string, string, err
 	vethContainer := "veth" + containerID[:8] + "c"
 
 	// Create veth pair
-	cmd := exec.Command("ip", "link", "add", vethHost, "type", "veth", "peer", "name", vethContainer)
-	if err := cmd.Run(); err != nil {
+	if err := addVethPair(vethHost, vethContainer); err != nil {
 		return "", "", fmt.Errorf("failed to create veth pair: %v", err)
 	}
 
 	// Connect host end to bridge
-	cmd = exec.Command("ip", "link", "set", vethHost, "master", bm.bridgeName)
-	if err := cmd.Run(); err != nil {
+	if err := setLinkMaster(vethHost, bm.bridgeName); err != nil {
 		return "", "", fmt.Errorf("failed to connect veth to bridge: %v", err)
 	}
 
 	// Bring host end up
-	cmd = exec.Command("ip", "link", "set", "dev", vethHost, "up")
-	if err := cmd.Run(); err != nil {
+	if err := setLinkUp(vethHost); err != nil {
 		return "", "", fmt.Errorf("failed to bring veth host up: %v", err)
 	}
 
@@ -184,15 +248,45 @@ func (bm *BridgeManager) CreateVethPair(containerID string) (string, string, err
 	return vethHost, vethContainer, nil
 }
 
+// ConfigureContainerNetwork moves the container end of the veth pair into
+// the container's network namespace as eth0, and gives it the container's
+// addresses and a default route through the bridge.
 func (bm *BridgeManager) ConfigureContainerNetwork(containerID, vethContainer string, containerIP net.IP) error {
+	netns := NetNSPath(containerID)
+
+	if err := setLinkHardwareAddr(vethContainer, endpointMAC(containerIP)); err != nil {
+		return fmt.Errorf("failed to set MAC address of veth: %v", err)
+	}
+
 	// Move veth to container network namespace
-	// This would typically be done when the container is created
-	// For now, we'll just prepare the veth interface
+	if err := setLinkNetNS(vethContainer, netns); err != nil {
+		return fmt.Errorf("failed to move veth into netns %s: %v", NetNSName(containerID), err)
+	}
 
-	// Bring container veth up
-	cmd := exec.Command("ip", "link", "set", "dev", vethContainer, "up")
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to bring veth container up: %v", err)
+	containerIPv6 := bm.ContainerIPv6(containerIP)
+	err := EnterNetNS(netns, func() error {
+		if err := renameLink(vethContainer, "eth0"); err != nil {
+			return err
+		}
+		if err := replaceAddr("eth0", &net.IPNet{IP: containerIP, Mask: bm.subnet.Mask}, false); err != nil {
+			return err
+		}
+		if err := setLinkUp("eth0"); err != nil {
+			return err
+		}
+		if err := addDefaultRoute(bm.gateway); err != nil {
+			return err
+		}
+		if containerIPv6 == nil {
+			return nil
+		}
+		if err := replaceAddr("eth0", &net.IPNet{IP: containerIPv6, Mask: bm.subnet6.Mask}, true); err != nil {
+			return err
+		}
+		return addDefaultRoute(bm.IPv6Gateway())
+	})
+	if err != nil {
+		return fmt.Errorf("failed to configure container network: %v", err)
 	}
 
 	logrus.Infof("Configured container network: %s -> %s", containerID, containerIP)
@@ -209,18 +303,61 @@ func (bm *BridgeManager) SetupPortMapping(containerID string, portMappings []Por
 	return nil
 }
 
-func (bm *BridgeManager) addPortMapping(containerID string, mapping PortMapping) error {
-	// Add iptables rule for port mapping
-	rule := fmt.Sprintf("-t nat -A PREROUTING -p %s --dport %d -j DNAT --to-destination %s:%d",
-		mapping.Protocol, mapping.HostPort, mapping.ContainerIP, mapping.ContainerPort)
+// portMappingRules returns the rules publishing a container's mapping.
+// Traffic from elsewhere to the host is DNAT'd to the container. Without
+// the userland proxy so is the host's own, including that to localhost,
+// and a container reaching its own published port is masqueraded so the
+// replies come back through the host. With the proxy, which listens on
+// the host port, the host's traffic and that of containers on the bridge
+// go through it instead. IPv6 mappings go through ip6tables.
+func (bm *BridgeManager) portMappingRules(containerID string, mapping PortMapping) []Rule {
+	binary := "iptables"
+	if mapping.Family == FamilyIPv6 {
+		binary = "ip6tables"
+	}
+
+	match := []string{"-p", mapping.Protocol}
+	if ip := net.ParseIP(mapping.HostIP); ip != nil && !ip.IsUnspecified() {
+		match = append(match, "-d", ip.String())
+	} else {
+		// Only traffic to the host: other destinations on the port are
+		// left alone
+		match = append(match, "-m", "addrtype", "--dst-type", "LOCAL")
+	}
+	destination := net.JoinHostPort(mapping.ContainerIP, strconv.Itoa(mapping.ContainerPort))
+	dnat := append(match, "--dport", strconv.Itoa(mapping.HostPort), "-j", "DNAT", "--to-destination", destination)
+
+	rule := func(chain string, args ...string) Rule {
+		return Rule{
+			Binary:      binary,
+			Table:       "nat",
+			Chain:       chain,
+			Args:        args,
+			Network:     bridgeNetwork,
+			ContainerID: containerID,
+			Purpose:     "port",
+		}
+	}
+	if bm.userlandProxy && proxied(mapping) {
+		return []Rule{rule("PREROUTING", append([]string{"!", "-i", bm.bridgeName}, dnat...)...)}
+	}
+	return []Rule{
+		rule("PREROUTING", dnat...),
+		rule("OUTPUT", dnat...),
+		rule("POSTROUTING", "-p", mapping.Protocol, "-s", mapping.ContainerIP, "-d", mapping.ContainerIP,
+			"--dport", strconv.Itoa(mapping.ContainerPort), "-j", "MASQUERADE"),
+	}
+}
 
-	cmd := exec.Command("iptables", strings.Fields(rule)...)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to add port mapping rule: %v", err)
+func (bm *BridgeManager) addPortMapping(containerID string, mapping PortMapping) error {
+	for _, rule := range bm.portMappingRules(containerID, mapping) {
+		if err := bm.rules.Install(rule); err != nil {
+			return fmt.Errorf("failed to add port mapping rule: %v", err)
+		}
 	}
 
-	logrus.Infof("Added port mapping: %s:%d -> %s:%d",
-		"0.0.0.0", mapping.HostPort, mapping.ContainerIP, mapping.ContainerPort)
+	logrus.Infof("Added port mapping: %s -> %s",
+		mapping.HostAddress(), net.JoinHostPort(mapping.ContainerIP, strconv.Itoa(mapping.ContainerPort)))
 	return nil
 }
 
@@ -231,29 +368,63 @@ func (bm *BridgeManager) RemovePortMapping(containerID string, portMappings []Po
 }
 
 func (bm *BridgeManager) removePortMapping(containerID string, mapping PortMapping) {
-	rule := fmt.Sprintf("-t nat -D PREROUTING -p %s --dport %d -j DNAT --to-destination %s:%d",
-		mapping.Protocol, mapping.HostPort, mapping.ContainerIP, mapping.ContainerPort)
+	for _, rule := range bm.portMappingRules(containerID, mapping) {
+		if err := bm.rules.Remove(rule.sameAs); err != nil {
+			logrus.Warnf("Failed to remove port mapping %v: %v", mapping, err)
+		}
+	}
+}
+
+// enableHairpinNAT lets the host reach the ports published on the bridge
+// without the userland proxy: traffic to localhost DNAT'd to a container
+// may leave through the bridge, masqueraded as the bridge's address.
+func (bm *BridgeManager) enableHairpinNAT() error {
+	routeLocalnet := fmt.Sprintf("/proc/sys/net/ipv4/conf/%s/route_localnet", bm.bridgeName)
+	if err := os.WriteFile(routeLocalnet, []byte("1"), 0644); err != nil {
+		return fmt.Errorf("failed to route localhost traffic to bridge %s: %v", bm.bridgeName, err)
+	}
+	return bm.rules.Install(Rule{
+		Binary:  "iptables",
+		Table:   "nat",
+		Chain:   "POSTROUTING",
+		Args:    []string{"-o", bm.bridgeName, "-m", "addrtype", "--src-type", "LOCAL", "-j", "MASQUERADE"},
+		Network: bridgeNetwork,
+		Purpose: "hairpin",
+	})
+}
 
-	cmd := exec.Command("iptables", strings.Fields(rule)...)
-	if err := cmd.Run(); err != nil {
-		logrus.Warnf("Failed to remove port mapping %v: %v", mapping, err)
+// setHairpinMode lets traffic a container sends to its own published
+// port, DNAT'd back to it, out of the bridge port it came in through.
+// Containers reaching their peers' published ports need the bridged
+// traffic to go through iptables, so the replies are translated back.
+func setHairpinMode(hostInterface string) {
+	path := fmt.Sprintf("/sys/class/net/%s/brport/hairpin_mode", hostInterface)
+	if err := os.WriteFile(path, []byte("1"), 0644); err != nil {
+		logrus.Warnf("Failed to set hairpin mode on %s, so the container can't reach its own published ports: %v", hostInterface, err)
+	}
+	if err := os.WriteFile(bridgeNetfilter, []byte("1"), 0644); err != nil {
+		logrus.Warnf("Failed to pass bridged traffic through iptables, so containers can't reach their peers' published ports (is br_netfilter loaded?): %v", err)
 	}
 }
 
 func (bm *BridgeManager) GetBridgeInfo() map[string]interface{} {
-	return map[string]interface{}{
-		"name":    bm.bridgeName,
-		"subnet":  bm.subnet.String(),
-		"gateway": bm.gateway.String(),
-		"used_ips": len(bm.usedIPs),
+	info := map[string]interface{}{
+		"name":     bm.bridgeName,
+		"subnet":   bm.subnet.String(),
+		"gateway":  bm.gateway.String(),
+		"used_ips": bm.ipam.Allocated(bridgeNetwork),
+	}
+	if bm.subnet6 != nil {
+		info["subnet_v6"] = bm.subnet6.String()
+		info["gateway_v6"] = bm.gateway6.String()
 	}
+	return info
 }
 
 func (bm *BridgeManager) Cleanup() {
 	// Remove bridge if it exists
 	if bm.bridgeExists() {
-		cmd := exec.Command("ip", "link", "del", bm.bridgeName)
-		if err := cmd.Run(); err != nil {
+		if err := deleteLink(bm.bridgeName); err != nil {
 			logrus.Warnf("Failed to remove bridge: %v", err)
 		}
 	}
@@ -262,17 +433,14 @@ func (bm *BridgeManager) Cleanup() {
 	bm.cleanupIptables()
 }
 
+// cleanupIptables removes the rules installed for the bridge and its
+// containers, leaving the rest of the host's rules alone.
 func (bm *BridgeManager) cleanupIptables() {
-	// This is a simplified cleanup - in practice, you'd want to remove specific rules
-	// rather than flushing entire chains
-	cmd := exec.Command("iptables", "-t", "nat", "-F")
-	if err := cmd.Run(); err != nil {
-		logrus.Warnf("Failed to flush iptables nat table: %v", err)
-	}
-
-	cmd = exec.Command("iptables", "-F")
-	if err := cmd.Run(); err != nil {
-		logrus.Warnf("Failed to flush iptables filter table: %v", err)
+	err := bm.rules.Remove(func(rule Rule) bool {
+		return rule.Network == bridgeNetwork
+	})
+	if err != nil {
+		logrus.Warnf("Failed to remove bridge rules: %v", err)
 	}
 }
 
@@ -284,4 +452,4 @@ func (bm *BridgeManager) GetContainerNetworkStats(containerID string) map[string
 		"bridge":       bm.bridgeName,
 		"network_mode": "bridge",
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,242 @@
+package network
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	captureSnapLen    = 262144
+	pcapLinkTypeEther = 1
+)
+
+type CaptureOptions struct {
+	// PID is any process inside the network namespace to capture in
+	PID int
+	// Interface defaults to every interface in the namespace
+	Interface string
+	Duration  time.Duration
+	// Filter is a BPF expression; it needs tcpdump on the host
+	Filter string
+}
+
+// Capture writes packets seen in the network namespace of opts.PID to w in
+// pcap format until the duration elapses or ctx is cancelled. It uses
+// tcpdump through nsenter when both are installed and otherwise captures
+// with a raw packet socket opened inside the namespace.
+func Capture(ctx context.Context, opts CaptureOptions, w io.Writer) error {
+	if opts.PID <= 0 {
+		return fmt.Errorf("a process ID is required to find the network namespace")
+	}
+	if _, err := os.Stat(netnsPath(opts.PID)); err != nil {
+		return fmt.Errorf("network namespace of process %d is not available: %v", opts.PID, err)
+	}
+
+	if opts.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Duration)
+		defer cancel()
+	}
+
+	nsenter, nsenterErr := exec.LookPath("nsenter")
+	tcpdump, tcpdumpErr := exec.LookPath("tcpdump")
+	if nsenterErr == nil && tcpdumpErr == nil {
+		return captureWithTcpdump(ctx, nsenter, tcpdump, opts, w)
+	}
+
+	if opts.Filter != "" {
+		return fmt.Errorf("capture filters need nsenter and tcpdump installed on the host")
+	}
+	logrus.Debugf("nsenter or tcpdump not found, capturing with a packet socket")
+	return captureWithSocket(ctx, opts, w)
+}
+
+func captureWithTcpdump(ctx context.Context, nsenter, tcpdump string, opts CaptureOptions, w io.Writer) error {
+	iface := opts.Interface
+	if iface == "" {
+		iface = "any"
+	}
+
+	args := []string{"-t", strconv.Itoa(opts.PID), "-n", "--", tcpdump, "-i", iface, "-U", "-s", strconv.Itoa(captureSnapLen), "-w", "-"}
+	if opts.Filter != "" {
+		args = append(args, opts.Filter)
+	}
+
+	cmd := exec.Command(nsenter, args...)
+	cmd.Stdout = w
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start tcpdump: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("tcpdump failed: %v", err)
+		}
+		return nil
+	case <-ctx.Done():
+		// SIGINT lets tcpdump flush what it has buffered
+		cmd.Process.Signal(syscall.SIGINT)
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			cmd.Process.Kill()
+			<-done
+		}
+		return nil
+	}
+}
+
+func captureWithSocket(ctx context.Context, opts CaptureOptions, w io.Writer) error {
+	fd, err := openPacketSocket(opts.PID, opts.Interface)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	// Wake up regularly so cancellation is noticed on an idle link
+	timeout := syscall.NsecToTimeval((200 * time.Millisecond).Nanoseconds())
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &timeout); err != nil {
+		return fmt.Errorf("failed to set socket timeout: %v", err)
+	}
+
+	if err := writePcapHeader(w); err != nil {
+		return err
+	}
+
+	buf := make([]byte, captureSnapLen)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			if err == syscall.EAGAIN || err == syscall.EINTR {
+				continue
+			}
+			return fmt.Errorf("failed to read packet: %v", err)
+		}
+		if err := writePcapPacket(w, time.Now(), buf[:n]); err != nil {
+			return err
+		}
+	}
+}
+
+// openPacketSocket creates an AF_PACKET socket inside the target network
+// namespace. A socket stays bound to the namespace it was created in, so
+// the thread can switch back right after.
+func openPacketSocket(pid int, iface string) (int, error) {
+	runtime.LockOSThread()
+
+	hostNS, err := os.Open("/proc/thread-self/ns/net")
+	if err != nil {
+		runtime.UnlockOSThread()
+		return -1, fmt.Errorf("failed to open current network namespace: %v", err)
+	}
+	defer hostNS.Close()
+
+	targetNS, err := os.Open(netnsPath(pid))
+	if err != nil {
+		runtime.UnlockOSThread()
+		return -1, fmt.Errorf("failed to open network namespace of process %d: %v", pid, err)
+	}
+	defer targetNS.Close()
+
+	if err := setns(targetNS.Fd()); err != nil {
+		runtime.UnlockOSThread()
+		return -1, fmt.Errorf("failed to enter network namespace: %v", err)
+	}
+	fd, sockErr := newPacketSocket(iface)
+	if err := setns(hostNS.Fd()); err != nil {
+		// Leave the thread locked so the runtime discards it instead of
+		// reusing a thread stuck in the container's namespace
+		if sockErr == nil {
+			syscall.Close(fd)
+		}
+		return -1, fmt.Errorf("failed to return to host network namespace: %v", err)
+	}
+	runtime.UnlockOSThread()
+
+	return fd, sockErr
+}
+
+func newPacketSocket(iface string) (int, error) {
+	protocol := htons(syscall.ETH_P_ALL)
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(protocol))
+	if err != nil {
+		return -1, fmt.Errorf("failed to open packet socket: %v", err)
+	}
+	if iface == "" || iface == "any" {
+		return fd, nil
+	}
+
+	link, err := net.InterfaceByName(iface)
+	if err != nil {
+		syscall.Close(fd)
+		return -1, fmt.Errorf("interface %s not found in the container: %v", iface, err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: protocol, Ifindex: link.Index}); err != nil {
+		syscall.Close(fd)
+		return -1, fmt.Errorf("failed to bind to %s: %v", iface, err)
+	}
+	return fd, nil
+}
+
+func setns(fd uintptr) error {
+	return unix.Setns(int(fd), unix.CLONE_NEWNET)
+}
+
+func netnsPath(pid int) string {
+	return fmt.Sprintf("/proc/%d/ns/net", pid)
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+func writePcapHeader(w io.Writer) error {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], captureSnapLen)
+	binary.LittleEndian.PutUint32(header[20:], pcapLinkTypeEther)
+	if _, err := w.Write(header); err != nil {
+		return fmt.Errorf("failed to write pcap header: %v", err)
+	}
+	return nil
+}
+
+func writePcapPacket(w io.Writer, ts time.Time, data []byte) error {
+	header := make([]byte, 16)
+	binary.LittleEndian.PutUint32(header[0:], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(header[4:], uint32(ts.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(header[8:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(header[12:], uint32(len(data)))
+	if _, err := w.Write(header); err != nil {
+		return fmt.Errorf("failed to write packet: %v", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("failed to write packet: %v", err)
+	}
+	return nil
+}
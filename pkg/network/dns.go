@@ -5,19 +5,45 @@ import (
 	"net"
 	"strings"
 	"sync"
-	"time"
 
+	"docker-impl/pkg/ids"
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	// localDomain is the search domain of containers: name.mydocker.local
+	// is the peer called name
+	localDomain = "mydocker.local"
+
+	// peerTTL is how long the addresses of peers may be cached
+	peerTTL = 300
+)
+
+// DNSManager answers the DNS queries of containers. Each container has its
+// own server, listening in its network namespace, so the manager knows
+// who asks: a container resolves the containers it shares a network with
+// and the static records, while other names are forwarded to upstream
+// resolvers.
 type DNSManager struct {
-	server      *dns.Server
-	records     map[string][]string
-	aliases     map[string]string
-	containerIP map[string]string
-	mu          sync.RWMutex
-	listenAddr  string
+	records map[string][]string
+	aliases map[string]string
+	// bridge holds the containers on the default bridge by ID; only the
+	// process that started them knows them
+	bridge map[string]dnsEndpoint
+	// networks lists the user-defined networks, whose endpoints are found
+	// by the name of their container
+	networks func() ([]*Network, error)
+	// resolvers are the servers of the containers by container ID
+	resolvers map[string]*resolver
+	cache     *dnsCache
+	// services answers about the services registered with it, once there
+	// is one
+	services *ServiceDiscovery
+	// links holds the --link aliases of containers by container ID: the
+	// IDs of the containers they name, for the linking container alone
+	links map[string]map[string]string
+	mu        sync.RWMutex
 }
 
 type DNSRecord struct {
@@ -27,37 +53,44 @@ type DNSRecord struct {
 	TTL   uint32
 }
 
-func NewDNSManager(listenAddr string) *DNSManager {
+// dnsEndpoint is a container on the default bridge and the names it is
+// found by.
+type dnsEndpoint struct {
+	ip    string
+	names []string
+}
+
+// NewDNSManager resolves the endpoints of the networks listed by networks,
+// which may be nil, besides those registered with RegisterContainer.
+func NewDNSManager(networks func() ([]*Network, error)) *DNSManager {
 	return &DNSManager{
-		server:      &dns.Server{Addr: listenAddr, Net: "udp"},
-		records:     make(map[string][]string),
-		aliases:     make(map[string]string),
-		containerIP: make(map[string]string),
-		listenAddr:  listenAddr,
+		records:   make(map[string][]string),
+		aliases:   make(map[string]string),
+		bridge:    make(map[string]dnsEndpoint),
+		networks:  networks,
+		resolvers: make(map[string]*resolver),
+		cache:     newDNSCache(),
+		links:     make(map[string]map[string]string),
 	}
 }
 
+// Start sets up the static records. Containers are served once their
+// servers are started with StartResolver.
 func (dm *DNSManager) Start() error {
 	// Set up default records
 	dm.addDefaultRecords()
-
-	// Configure DNS handler
-	dns.HandleFunc(".", dm.handleDNSRequest)
-
-	// Start DNS server
-	go func() {
-		if err := dm.server.ListenAndServe(); err != nil {
-			logrus.Errorf("DNS server error: %v", err)
-		}
-	}()
-
-	logrus.Infof("DNS server started on %s", dm.listenAddr)
 	return nil
 }
 
+// Stop stops the servers of every container.
 func (dm *DNSManager) Stop() error {
-	if dm.server != nil {
-		return dm.server.Shutdown()
+	dm.mu.Lock()
+	resolvers := dm.resolvers
+	dm.resolvers = make(map[string]*resolver)
+	dm.mu.Unlock()
+
+	for _, r := range resolvers {
+		r.stop()
 	}
 	return nil
 }
@@ -68,110 +101,170 @@ func (dm *DNSManager) addDefaultRecords() {
 	dm.AddRecord("localhost", "AAAA", "::1", 3600)
 
 	// Add container DNS domain
-	dm.AddRecord("mydocker.local", "A", "172.17.0.1", 3600)
+	dm.AddRecord(localDomain, "A", "172.17.0.1", 3600)
 }
 
-func (dm *DNSManager) handleDNSRequest(w dns.ResponseWriter, r *dns.Msg) {
-	m := new(dns.Msg)
-	m.SetReply(r)
-	m.Compress = false
-
-	for _, q := range r.Question {
-		logrus.Debugf("DNS query: %s %s", q.Name, q.Qtype)
-
-		switch q.Qtype {
-		case dns.TypeA:
-			records := dm.getARecords(q.Name)
-			for _, record := range records {
-				rr := &dns.A{
-					Hdr: dns.RR_Header{
-						Name:   q.Name,
-						Rrtype: dns.TypeA,
-						Class:  dns.ClassINET,
-						Ttl:    3600,
-					},
-					A: net.ParseIP(record),
-				}
-				m.Answer = append(m.Answer, rr)
-			}
+// handleDNSRequest answers a query of a container from the services, its
+// peers and the static records, and forwards it to upstreams when the name
+// is none of theirs.
+func (dm *DNSManager) handleDNSRequest(containerID string, upstreams []string, w dns.ResponseWriter, r *dns.Msg) {
+	if len(r.Question) != 1 {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeFormatError)
+		w.WriteMsg(m)
+		return
+	}
+	q := r.Question[0]
+	logrus.Debugf("DNS query of container %s: %s %s", ids.TruncateID(containerID), q.Name, dns.TypeToString[q.Qtype])
 
-		case dns.TypeAAAA:
-			records := dm.getAAAARecords(q.Name)
-			for _, record := range records {
-				rr := &dns.AAAA{
-					Hdr: dns.RR_Header{
-						Name:   q.Name,
-						Rrtype: dns.TypeAAAA,
-						Class:  dns.ClassINET,
-						Ttl:    3600,
-					},
-					AAAA: net.ParseIP(record),
-				}
-				m.Answer = append(m.Answer, rr)
-			}
+	answer, extra, rcode, ok := dm.answerService(q)
+	if !ok {
+		answer, rcode, ok = dm.answerLocal(containerID, q)
+	}
+	if ok {
+		m := new(dns.Msg)
+		m.SetRcode(r, rcode)
+		m.Authoritative = true
+		m.RecursionAvailable = true
+		m.Answer = answer
+		m.Extra = extra
+		w.WriteMsg(m)
+		return
+	}
+	w.WriteMsg(dm.forward(r, upstreams))
+}
 
-		case dns.TypeCNAME:
-			if alias, exists := dm.getAlias(q.Name); exists {
-				rr := &dns.CNAME{
-					Hdr: dns.RR_Header{
-						Name:   q.Name,
-						Rrtype: dns.TypeCNAME,
-						Class:  dns.ClassINET,
-						Ttl:    3600,
-					},
-					Target: alias,
-				}
-				m.Answer = append(m.Answer, rr)
-			}
+// answerLocal answers a question about a peer of a container or a static
+// record. It reports false when the name is neither, except in the
+// containers' own domain, where unknown names don't exist.
+func (dm *DNSManager) answerLocal(containerID string, q dns.Question) ([]dns.RR, int, bool) {
+	name, inDomain := localName(q.Name)
+	header := func(rrtype uint16, ttl uint32) dns.RR_Header {
+		return dns.RR_Header{Name: q.Name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: ttl}
+	}
+
+	addresses := dm.peerAddresses(containerID, name)
+	dm.mu.RLock()
+	static := append(append([]string(nil), dm.records[name+":A"]...), dm.records[name+":AAAA"]...)
+	txt := dm.records[name+":TXT"]
+	alias, hasAlias := dm.aliases[name]
+	dm.mu.RUnlock()
+	for _, record := range static {
+		if ip := net.ParseIP(record); ip != nil {
+			addresses = append(addresses, ip)
+		}
+	}
+
+	if len(addresses) == 0 && len(txt) == 0 && !hasAlias {
+		return nil, dns.RcodeNameError, inDomain
+	}
 
-		case dns.TypeTXT:
-			// Add TXT records for service discovery
-			txtRecord := &dns.TXT{
-				Hdr: dns.RR_Header{
-					Name:   q.Name,
-					Rrtype: dns.TypeTXT,
-					Class:  dns.ClassINET,
-					Ttl:    3600,
-				},
-				Txt: []string{"mydocker-container"},
+	var answer []dns.RR
+	switch q.Qtype {
+	case dns.TypeA:
+		for _, ip := range addresses {
+			if ip4 := ip.To4(); ip4 != nil {
+				answer = append(answer, &dns.A{Hdr: header(dns.TypeA, peerTTL), A: ip4})
 			}
-			m.Answer = append(m.Answer, txtRecord)
+		}
+	case dns.TypeAAAA:
+		for _, ip := range addresses {
+			if ip.To4() == nil {
+				answer = append(answer, &dns.AAAA{Hdr: header(dns.TypeAAAA, peerTTL), AAAA: ip})
+			}
+		}
+	case dns.TypeCNAME:
+		if hasAlias {
+			answer = append(answer, &dns.CNAME{Hdr: header(dns.TypeCNAME, 3600), Target: dns.Fqdn(alias)})
+		}
+	case dns.TypeTXT:
+		for _, record := range txt {
+			answer = append(answer, &dns.TXT{Hdr: header(dns.TypeTXT, 3600), Txt: []string{record}})
 		}
 	}
+	return answer, dns.RcodeSuccess, true
+}
 
-	w.WriteMsg(m)
+// localName normalizes a queried name into the name of a peer or record,
+// and reports whether it was in the containers' domain.
+func localName(name string) (string, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if trimmed := strings.TrimSuffix(name, "."+localDomain); trimmed != name {
+		return trimmed, true
+	}
+	return name, name == localDomain
 }
 
-func (dm *DNSManager) getARecords(name string) []string {
+// peerAddresses returns the addresses of the containers called name that
+// share a network with containerID, on the networks they share. A link
+// alias of containerID names the linked container.
+func (dm *DNSManager) peerAddresses(containerID, name string) []net.IP {
+	var addresses []net.IP
 	dm.mu.RLock()
-	defer dm.mu.RUnlock()
-
-	// Normalize domain name
-	name = strings.TrimSuffix(name, ".")
-
-	if records, exists := dm.records[name]; exists {
-		return records
+	if target, ok := dm.links[containerID][name]; ok {
+		name = ids.TruncateID(target)
 	}
-
-	// Try to resolve container name
-	if ip, exists := dm.containerIP[name]; exists {
-		return []string{ip}
+	if _, ok := dm.bridge[containerID]; ok {
+		for _, endpoint := range dm.bridge {
+			for _, endpointName := range endpoint.names {
+				if strings.EqualFold(endpointName, name) {
+					addresses = append(addresses, net.ParseIP(endpoint.ip))
+					break
+				}
+			}
+		}
 	}
+	dm.mu.RUnlock()
 
-	return []string{}
+	if dm.networks == nil {
+		return addresses
+	}
+	networks, err := dm.networks()
+	if err != nil {
+		logrus.Warnf("Failed to list networks for DNS: %v", err)
+		return addresses
+	}
+	for _, network := range networks {
+		if _, ok := network.Containers[containerID]; !ok {
+			continue
+		}
+		for id, endpoint := range network.Containers {
+			if !endpointNamed(id, endpoint, name) {
+				continue
+			}
+			if ip, _, err := net.ParseCIDR(endpoint.IPAddress); err == nil {
+				addresses = append(addresses, ip)
+			}
+		}
+	}
+	return addresses
 }
 
-func (dm *DNSManager) getAAAARecords(name string) []string {
-	// For now, return empty - IPv6 support can be added later
-	return []string{}
+// endpointNamed reports whether the endpoint of containerID on a network
+// is found by name there: its container's name, short ID or an alias.
+func endpointNamed(containerID string, endpoint Endpoint, name string) bool {
+	if strings.EqualFold(endpoint.ContainerName, name) || ids.TruncateID(containerID) == name {
+		return true
+	}
+	for _, alias := range endpoint.Aliases {
+		if strings.EqualFold(alias, name) {
+			return true
+		}
+	}
+	return false
 }
 
-func (dm *DNSManager) getAlias(name string) (string, bool) {
-	dm.mu.RLock()
-	defer dm.mu.RUnlock()
-
-	alias, exists := dm.aliases[name]
-	return alias, exists
+// SetLinks makes each alias in links, a --link of containerID, resolve
+// to the container of the ID it maps to, for containerID alone. The links
+// go when its server is stopped.
+func (dm *DNSManager) SetLinks(containerID string, links map[string]string) {
+	aliases := make(map[string]string, len(links))
+	for alias, target := range links {
+		aliases[strings.ToLower(alias)] = target
+	}
+	dm.mu.Lock()
+	dm.links[containerID] = aliases
+	dm.mu.Unlock()
 }
 
 func (dm *DNSManager) AddRecord(name, recordType, value string, ttl uint32) {
@@ -212,39 +305,35 @@ func (dm *DNSManager) RemoveRecord(name, recordType, value string) {
 	logrus.Debugf("Removed DNS record: %s %s -> %s", name, recordType, value)
 }
 
-func (dm *DNSManager) RegisterContainer(containerID, containerName, ip string) {
-	dm.mu.Lock()
-	defer dm.mu.Unlock()
-
-	// Register container IP
-	dm.containerIP[containerName] = ip
-	dm.containerIP[containerID] = ip
-
-	// Add A record for container name
-	dm.AddRecord(containerName, "A", ip, 300)
+// RegisterContainer makes a container on the default bridge resolvable by
+// the other containers there, by its name, short ID and names, e.g. its
+// hostname, aliases and the service it is a replica of. A service name
+// resolves to every replica. Empty names are skipped.
+func (dm *DNSManager) RegisterContainer(containerID, containerName, ip string, names ...string) {
+	dm.register(containerID, containerName, ip, names)
+	logrus.Infof("Registered container DNS: %s -> %s", containerName, ip)
+}
 
-	// Add records for service discovery
-	serviceName := fmt.Sprintf("%s.mydocker.local", containerName)
-	dm.AddRecord(serviceName, "A", ip, 300)
+func (dm *DNSManager) register(containerID, containerName, ip string, names []string) {
+	endpoint := dnsEndpoint{ip: ip, names: []string{containerName, ids.TruncateID(containerID)}}
+	for _, name := range names {
+		if name != "" {
+			endpoint.names = append(endpoint.names, name)
+		}
+	}
 
-	logrus.Infof("Registered container DNS: %s -> %s", containerName, ip)
+	dm.mu.Lock()
+	dm.bridge[containerID] = endpoint
+	dm.mu.Unlock()
 }
 
 func (dm *DNSManager) UnregisterContainer(containerID, containerName string) {
 	dm.mu.Lock()
-	defer dm.mu.Unlock()
-
-	// Remove container IP
-	if ip, exists := dm.containerIP[containerName]; exists {
-		delete(dm.containerIP, containerName)
-		delete(dm.containerIP, containerID)
-
-		// Remove DNS records
-		dm.RemoveRecord(containerName, "A", ip)
-
-		serviceName := fmt.Sprintf("%s.mydocker.local", containerName)
-		dm.RemoveRecord(serviceName, "A", ip)
+	_, exists := dm.bridge[containerID]
+	delete(dm.bridge, containerID)
+	dm.mu.Unlock()
 
+	if exists {
 		logrus.Infof("Unregistered container DNS: %s", containerName)
 	}
 }
@@ -269,11 +358,13 @@ func (dm *DNSManager) RemoveAlias(name string) {
 	logrus.Infof("Removed DNS alias: %s", name)
 }
 
+// Resolve looks a name up in the static records and among the containers
+// on the default bridge.
 func (dm *DNSManager) Resolve(name string) ([]string, error) {
 	dm.mu.RLock()
 	defer dm.mu.RUnlock()
 
-	name = strings.TrimSuffix(name, ".")
+	name, _ = localName(name)
 
 	// Check direct records
 	keyA := fmt.Sprintf("%s:A", name)
@@ -281,9 +372,18 @@ func (dm *DNSManager) Resolve(name string) ([]string, error) {
 		return records, nil
 	}
 
-	// Check container IP
-	if ip, exists := dm.containerIP[name]; exists {
-		return []string{ip}, nil
+	// Check containers
+	var addresses []string
+	for _, endpoint := range dm.bridge {
+		for _, endpointName := range endpoint.names {
+			if strings.EqualFold(endpointName, name) {
+				addresses = append(addresses, endpoint.ip)
+				break
+			}
+		}
+	}
+	if len(addresses) > 0 {
+		return addresses, nil
 	}
 
 	// Check aliases
@@ -319,98 +419,3 @@ func (dm *DNSManager) ListRecords() []DNSRecord {
 
 	return records
 }
-
-func (dm *DNSManager) GetDNSConfig() string {
-	return fmt.Sprintf("nameserver %s\nsearch mydocker.local\noptions ndots:0", dm.listenAddr[:strings.Index(dm.listenAddr, ":")])
-}
-
-func (dm *DNSManager) CreateResolvConf(containerID string) string {
-	return fmt.Sprintf("# Generated by mydocker\nnameserver %s\nsearch mydocker.local\noptions ndots:0 timeout:1 attempts:3", dm.listenAddr[:strings.Index(dm.listenAddr, ":")])
-}
-
-type ServiceDiscovery struct {
-	dnsManager *DNSManager
-	services    map[string]ServiceRecord
-	mu          sync.RWMutex
-}
-
-type ServiceRecord struct {
-	Name      string
-	Addresses []string
-	Port      int
-	Protocol  string
-	Metadata  map[string]string
-	Timestamp time.Time
-}
-
-func NewServiceDiscovery(dnsManager *DNSManager) *ServiceDiscovery {
-	return &ServiceDiscovery{
-		dnsManager: dnsManager,
-		services:   make(map[string]ServiceRecord),
-	}
-}
-
-func (sd *ServiceDiscovery) RegisterService(serviceName, containerIP string, port int, protocol string, metadata map[string]string) {
-	sd.mu.Lock()
-	defer sd.mu.Unlock()
-
-	serviceKey := fmt.Sprintf("%s.%s.%s", serviceName, protocol, port)
-
-	record := ServiceRecord{
-		Name:      serviceName,
-		Addresses: []string{containerIP},
-		Port:      port,
-		Protocol:  protocol,
-		Metadata:  metadata,
-		Timestamp: time.Now(),
-	}
-
-	sd.services[serviceKey] = record
-
-	// Register DNS SRV record
-	srvValue := fmt.Sprintf("0 0 %d %s", port, containerIP)
-	sd.dnsManager.AddRecord(serviceName, "SRV", srvValue, 300)
-
-	logrus.Infof("Registered service: %s -> %s:%d (%s)", serviceName, containerIP, port, protocol)
-}
-
-func (sd *ServiceDiscovery) UnregisterService(serviceName, protocol string, port int) {
-	sd.mu.Lock()
-	defer sd.mu.Unlock()
-
-	serviceKey := fmt.Sprintf("%s.%s.%s", serviceName, protocol, port)
-
-	delete(sd.services, serviceKey)
-
-	// Remove DNS SRV record
-	sd.dnsManager.RemoveRecord(serviceName, "SRV", "")
-
-	logrus.Infof("Unregistered service: %s (%s:%d)", serviceName, protocol, port)
-}
-
-func (sd *ServiceDiscovery) DiscoverService(serviceName string) ([]ServiceRecord, error) {
-	sd.mu.RLock()
-	defer sd.mu.RUnlock()
-
-	var services []ServiceRecord
-
-	for key, record := range sd.services {
-		if strings.HasPrefix(key, serviceName+".") {
-			services = append(services, record)
-		}
-	}
-
-	return services, nil
-}
-
-func (sd *ServiceDiscovery) ListServices() []ServiceRecord {
-	sd.mu.RLock()
-	defer sd.mu.RUnlock()
-
-	var services []ServiceRecord
-	for _, record := range sd.services {
-		services = append(services, record)
-	}
-
-	return services
-}
\ No newline at end of file
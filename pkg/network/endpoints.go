@@ -0,0 +1,158 @@
+package network
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// EndpointsFile records the network settings of the containers on the
+// default bridge.
+const EndpointsFile = "endpoints.json"
+
+// endpointStore keeps the network settings of the containers on the
+// default bridge by container ID, in a state file shared by every
+// mydocker process on the host, so each sees the containers the others
+// started.
+type endpointStore struct {
+	state *stateFile
+	// settings holds the settings when there is no file
+	settings map[string]*NetworkSettings
+	mu       sync.Mutex
+}
+
+func newEndpointStore(dir string) *endpointStore {
+	s := &endpointStore{settings: make(map[string]*NetworkSettings)}
+	if dir != "" {
+		s.state = &stateFile{path: filepath.Join(dir, EndpointsFile), what: "endpoints"}
+	}
+	return s
+}
+
+// load must be called with mu held.
+func (s *endpointStore) load() (map[string]*NetworkSettings, error) {
+	if s.state == nil {
+		return s.settings, nil
+	}
+	settings := make(map[string]*NetworkSettings)
+	if err := s.state.read(&settings); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// get returns the settings of a container.
+func (s *endpointStore) get(containerID string) (*NetworkSettings, error) {
+	all, err := s.all()
+	if err != nil {
+		return nil, err
+	}
+	settings, ok := all[containerID]
+	if !ok {
+		return nil, fmt.Errorf("network settings not found for container %s", containerID)
+	}
+	return settings, nil
+}
+
+// all returns the settings of every container by ID.
+func (s *endpointStore) all() (map[string]*NetworkSettings, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	settings, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	copied := make(map[string]*NetworkSettings, len(settings))
+	for id, containerSettings := range settings {
+		copied[id] = containerSettings
+	}
+	return copied, nil
+}
+
+// update applies fn to the settings and saves them unless it fails.
+func (s *endpointStore) update(fn func(settings map[string]*NetworkSettings) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state == nil {
+		return fn(s.settings)
+	}
+	unlock, err := s.state.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	settings, err := s.load()
+	if err != nil {
+		return err
+	}
+	if err := fn(settings); err != nil {
+		return err
+	}
+	return s.state.write(settings)
+}
+
+// bridgeEndpoints returns the endpoints of the containers on the default
+// bridge by container ID.
+func (m *Manager) bridgeEndpoints() map[string]Endpoint {
+	all, err := m.endpoints.all()
+	if err != nil {
+		logrus.Warnf("Failed to list the endpoints of the default bridge: %v", err)
+		return nil
+	}
+	ones, _ := defaultSubnet.Mask.Size()
+	endpoints := make(map[string]Endpoint, len(all))
+	for id, settings := range all {
+		if settings.IPAddress == "" {
+			continue
+		}
+		endpoints[id] = Endpoint{
+			ContainerName: settings.ContainerName,
+			EndpointID:    settings.EndpointID,
+			IPAddress:     fmt.Sprintf("%s/%d", settings.IPAddress, ones),
+			MacAddress:    settings.MacAddress,
+			Interface:     "eth0",
+			HostInterface: settings.HostInterface,
+		}
+	}
+	return endpoints
+}
+
+// restoreEndpoints forgets the containers on the default bridge whose
+// network namespace is gone, e.g. those killed along with the process that
+// started them, and makes those still running resolvable again by the
+// containers this process starts.
+func (m *Manager) restoreEndpoints() {
+	var released []string
+	alive := make(map[string]*NetworkSettings)
+	err := m.endpoints.update(func(settings map[string]*NetworkSettings) error {
+		for id, containerSettings := range settings {
+			if !isNetNS(NetNSPath(id)) {
+				released = append(released, containerSettings.ContainerName)
+				delete(settings, id)
+			} else {
+				alive[id] = containerSettings
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logrus.Warnf("Failed to release stale endpoints: %v", err)
+		return
+	}
+	if len(released) > 0 {
+		sort.Strings(released)
+		logrus.Infof("Released stale endpoints of containers %s", strings.Join(released, ", "))
+	}
+	for id, settings := range alive {
+		if settings.IPAddress != "" {
+			m.dnsManager.register(id, settings.ContainerName, settings.IPAddress, settings.dnsNames())
+		}
+	}
+}
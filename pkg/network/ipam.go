@@ -0,0 +1,347 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// IPAMFile records the subnets of the host's networks and the addresses
+// allocated in them.
+const IPAMFile = "ipam.json"
+
+// gatewayOwner owns the gateway address of a subnet.
+const gatewayOwner = "gateway"
+
+// AddressPool is a range that subnets of Size bits are carved from for
+// networks created without a subnet, e.g. 192.168.0.0/16 in /20s.
+type AddressPool struct {
+	Base string `json:"base"`
+	Size int    `json:"size"`
+}
+
+// DefaultAddressPools are Docker's: 172.17-31.0.0/16, then
+// 192.168.0.0/16 in /20s.
+var DefaultAddressPools = func() []AddressPool {
+	var pools []AddressPool
+	for i := 17; i <= 31; i++ {
+		pools = append(pools, AddressPool{Base: fmt.Sprintf("172.%d.0.0/16", i), Size: 16})
+	}
+	return append(pools, AddressPool{Base: "192.168.0.0/16", Size: 20})
+}()
+
+// addressSpace is the subnet of one network and what is allocated in it.
+type addressSpace struct {
+	Subnet  string `json:"subnet"`
+	Gateway string `json:"gateway"`
+	// Addresses holds the owner of each allocated address, e.g. the
+	// container it was given to
+	Addresses map[string]string `json:"addresses"`
+}
+
+// IPAMAllocator hands out subnets to networks and addresses within them.
+// Each network has its own address space, so allocations never collide
+// across networks, and spaces never overlap. Allocations are recorded in
+// IPAMFile, so they survive restarts and are seen by every process.
+type IPAMAllocator struct {
+	state *stateFile
+	pools []AddressPool
+	// spaces holds the address spaces by network when there is no file
+	spaces map[string]*addressSpace
+	mu     sync.Mutex
+}
+
+// NewIPAMAllocator keeps its allocations in dir, or in memory when dir is
+// empty. Subnets are picked from pools, or DefaultAddressPools.
+func NewIPAMAllocator(dir string, pools []AddressPool) (*IPAMAllocator, error) {
+	if len(pools) == 0 {
+		pools = DefaultAddressPools
+	}
+	for _, pool := range pools {
+		ip, base, err := net.ParseCIDR(pool.Base)
+		if err != nil || ip.To4() == nil {
+			return nil, fmt.Errorf("invalid address pool base: %s", pool.Base)
+		}
+		if ones, _ := base.Mask.Size(); pool.Size < ones || pool.Size > 30 {
+			return nil, fmt.Errorf("invalid size %d of address pool %s: must be between /%d and /30", pool.Size, pool.Base, ones)
+		}
+	}
+
+	a := &IPAMAllocator{
+		pools:  pools,
+		spaces: make(map[string]*addressSpace),
+	}
+	if dir != "" {
+		a.state = &stateFile{path: filepath.Join(dir, IPAMFile), what: "address allocations"}
+	}
+	return a, nil
+}
+
+// update applies fn to the address spaces and saves them unless it fails.
+func (a *IPAMAllocator) update(fn func(spaces map[string]*addressSpace) error) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.state == nil {
+		return fn(a.spaces)
+	}
+	unlock, err := a.state.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	spaces := make(map[string]*addressSpace)
+	if err := a.state.read(&spaces); err != nil {
+		return err
+	}
+	if err := fn(spaces); err != nil {
+		return err
+	}
+	return a.state.write(spaces)
+}
+
+// RequestPool gives a network its address space: subnet, or the first
+// free subnet of the pools, with gateway, or the subnet's first address,
+// reserved. A network that has one keeps it if subnet and gateway are
+// empty or the same.
+func (a *IPAMAllocator) RequestPool(networkID, subnet, gateway string) (*net.IPNet, net.IP, error) {
+	var poolNet *net.IPNet
+	var poolGateway net.IP
+	err := a.update(func(spaces map[string]*addressSpace) error {
+		if space, ok := spaces[networkID]; ok {
+			if subnet != "" && subnet != space.Subnet || gateway != "" && gateway != space.Gateway {
+				return fmt.Errorf("network %s already has subnet %s with gateway %s", networkID, space.Subnet, space.Gateway)
+			}
+			_, poolNet, _ = net.ParseCIDR(space.Subnet)
+			poolGateway = net.ParseIP(space.Gateway).To4()
+			return nil
+		}
+
+		var taken []*net.IPNet
+		for _, space := range spaces {
+			if _, ipNet, err := net.ParseCIDR(space.Subnet); err == nil {
+				taken = append(taken, ipNet)
+			}
+		}
+
+		if subnet != "" {
+			ip, ipNet, err := net.ParseCIDR(subnet)
+			if err != nil || ip.To4() == nil {
+				return fmt.Errorf("invalid subnet: %s", subnet)
+			}
+			if ones, _ := ipNet.Mask.Size(); ones > 30 {
+				return fmt.Errorf("subnet %s is smaller than /30", subnet)
+			}
+			if overlaps(ipNet, taken) {
+				return fmt.Errorf("subnet %s overlaps with another network", ipNet)
+			}
+			poolNet = ipNet
+		} else {
+			if gateway != "" {
+				return fmt.Errorf("a gateway needs a subnet")
+			}
+			poolNet = a.freeSubnet(taken)
+			if poolNet == nil {
+				return fmt.Errorf("no free subnet left in the address pools")
+			}
+		}
+
+		poolGateway = nextIP(poolNet.IP.To4())
+		if gateway != "" {
+			poolGateway = net.ParseIP(gateway).To4()
+			if !isHostAddress(poolNet, poolGateway) {
+				return fmt.Errorf("gateway %s is not a host address of subnet %s", gateway, poolNet)
+			}
+		}
+		spaces[networkID] = &addressSpace{
+			Subnet:    poolNet.String(),
+			Gateway:   poolGateway.String(),
+			Addresses: map[string]string{poolGateway.String(): gatewayOwner},
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return poolNet, poolGateway, nil
+}
+
+// freeSubnet returns the first subnet of the pools that overlaps none
+// taken, or nil.
+func (a *IPAMAllocator) freeSubnet(taken []*net.IPNet) *net.IPNet {
+	for _, pool := range a.pools {
+		_, base, _ := net.ParseCIDR(pool.Base)
+		ones, _ := base.Mask.Size()
+		count := uint32(1) << uint(pool.Size-ones)
+		step := uint32(1) << uint(32-pool.Size)
+		start := binary.BigEndian.Uint32(base.IP.To4())
+		for i := uint32(0); i < count; i++ {
+			ip := make(net.IP, net.IPv4len)
+			binary.BigEndian.PutUint32(ip, start+i*step)
+			candidate := &net.IPNet{IP: ip, Mask: net.CIDRMask(pool.Size, 32)}
+			if !overlaps(candidate, taken) {
+				return candidate
+			}
+		}
+	}
+	return nil
+}
+
+// ReleasePool drops the address space of a network with everything
+// allocated in it.
+func (a *IPAMAllocator) ReleasePool(networkID string) error {
+	return a.update(func(spaces map[string]*addressSpace) error {
+		delete(spaces, networkID)
+		return nil
+	})
+}
+
+// RequestAddress allocates requested, or the first free host address, in
+// the address space of a network to owner.
+func (a *IPAMAllocator) RequestAddress(networkID, owner, requested string) (net.IP, error) {
+	var allocated net.IP
+	err := a.update(func(spaces map[string]*addressSpace) error {
+		space, ok := spaces[networkID]
+		if !ok {
+			return fmt.Errorf("network %s has no address space", networkID)
+		}
+		_, subnet, err := net.ParseCIDR(space.Subnet)
+		if err != nil {
+			return fmt.Errorf("invalid subnet of network %s: %v", networkID, err)
+		}
+		if space.Addresses == nil {
+			space.Addresses = make(map[string]string)
+		}
+
+		if requested != "" {
+			ip := net.ParseIP(requested).To4()
+			if !isHostAddress(subnet, ip) {
+				return fmt.Errorf("address %s is not a host address of subnet %s", requested, subnet)
+			}
+			if _, used := space.Addresses[ip.String()]; used {
+				return fmt.Errorf("address %s is already in use", requested)
+			}
+			allocated = ip
+		} else {
+			last := broadcast(subnet)
+			for ip := nextIP(subnet.IP.To4()); !ip.Equal(last); ip = nextIP(ip) {
+				if _, used := space.Addresses[ip.String()]; !used {
+					allocated = ip
+					break
+				}
+			}
+			if allocated == nil {
+				return fmt.Errorf("no available IP in subnet %s", subnet)
+			}
+		}
+		space.Addresses[allocated.String()] = owner
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return allocated, nil
+}
+
+// ReleaseAddress frees an address of a network. The gateway stays
+// reserved.
+func (a *IPAMAllocator) ReleaseAddress(networkID string, ip net.IP) error {
+	return a.update(func(spaces map[string]*addressSpace) error {
+		if space, ok := spaces[networkID]; ok && space.Addresses[ip.String()] != gatewayOwner {
+			delete(space.Addresses, ip.String())
+		}
+		return nil
+	})
+}
+
+// ReleaseStale frees the addresses of a network whose owners are no
+// longer alive, e.g. those of containers whose process went away without
+// releasing them. It returns the addresses freed.
+func (a *IPAMAllocator) ReleaseStale(networkID string, alive func(owner string) bool) ([]string, error) {
+	var released []string
+	err := a.update(func(spaces map[string]*addressSpace) error {
+		space, ok := spaces[networkID]
+		if !ok {
+			return nil
+		}
+		for ip, owner := range space.Addresses {
+			if owner != gatewayOwner && !alive(owner) {
+				delete(space.Addresses, ip)
+				released = append(released, ip)
+			}
+		}
+		return nil
+	})
+	sort.Strings(released)
+	return released, err
+}
+
+// Allocated returns the number of addresses allocated in the address
+// space of a network, the gateway included.
+func (a *IPAMAllocator) Allocated(networkID string) int {
+	spaces, err := a.view()
+	if err != nil {
+		return 0
+	}
+	if space, ok := spaces[networkID]; ok {
+		return len(space.Addresses)
+	}
+	return 0
+}
+
+// view returns the address spaces without locking the file, which is
+// only ever replaced whole.
+func (a *IPAMAllocator) view() (map[string]*addressSpace, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.state == nil {
+		return a.spaces, nil
+	}
+	spaces := make(map[string]*addressSpace)
+	if err := a.state.read(&spaces); err != nil {
+		return nil, err
+	}
+	return spaces, nil
+}
+
+func overlaps(subnet *net.IPNet, taken []*net.IPNet) bool {
+	for _, t := range taken {
+		if t.Contains(subnet.IP) || subnet.Contains(t.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// isHostAddress reports whether ip is in subnet and neither its network
+// nor its broadcast address.
+func isHostAddress(subnet *net.IPNet, ip net.IP) bool {
+	return ip != nil && subnet.Contains(ip) && !ip.Equal(subnet.IP) && !ip.Equal(broadcast(subnet))
+}
+
+// nextIP returns the address after ip.
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for j := len(next) - 1; j >= 0; j-- {
+		next[j]++
+		if next[j] > 0 {
+			break
+		}
+	}
+	return next
+}
+
+// broadcast returns the last address of an IPv4 subnet.
+func broadcast(subnet *net.IPNet) net.IP {
+	ip := subnet.IP.To4()
+	last := binary.BigEndian.Uint32(ip) | ^binary.BigEndian.Uint32(net.IP(subnet.Mask).To4())
+	out := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(out, last)
+	return out
+}
@@ -0,0 +1,318 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewIPAMAllocatorPools(t *testing.T) {
+	tests := []struct {
+		name  string
+		pools []AddressPool
+		err   bool
+	}{
+		{name: "default pools"},
+		{name: "valid pool", pools: []AddressPool{{Base: "10.10.0.0/16", Size: 24}}},
+		{name: "invalid base", pools: []AddressPool{{Base: "10.10.0.0", Size: 24}}, err: true},
+		{name: "IPv6 base", pools: []AddressPool{{Base: "fd00::/64", Size: 64}}, err: true},
+		{name: "size larger than the base", pools: []AddressPool{{Base: "10.10.0.0/16", Size: 8}}, err: true},
+		{name: "size smaller than /30", pools: []AddressPool{{Base: "10.10.0.0/16", Size: 31}}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewIPAMAllocator("", tt.pools)
+			if tt.err {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestIPAMRequestPool(t *testing.T) {
+	pools := []AddressPool{{Base: "10.10.0.0/16", Size: 24}}
+
+	tests := []struct {
+		name string
+		// existing are the subnets of networks created before
+		existing []string
+		subnet   string
+		gateway  string
+		expected string
+		// expectedGateway is reserved in the subnet
+		expectedGateway string
+		err             bool
+	}{
+		{
+			name:            "first subnet of the pool",
+			expected:        "10.10.0.0/24",
+			expectedGateway: "10.10.0.1",
+		},
+		{
+			name:            "next free subnet of the pool",
+			existing:        []string{"10.10.0.0/24", "10.10.2.0/24"},
+			expected:        "10.10.1.0/24",
+			expectedGateway: "10.10.1.1",
+		},
+		{
+			name:            "pool subnet skips a larger subnet taken",
+			existing:        []string{"10.10.0.0/23"},
+			expected:        "10.10.2.0/24",
+			expectedGateway: "10.10.2.1",
+		},
+		{
+			name:            "requested subnet",
+			subnet:          "192.168.5.0/24",
+			expected:        "192.168.5.0/24",
+			expectedGateway: "192.168.5.1",
+		},
+		{
+			name:            "requested gateway",
+			subnet:          "192.168.5.0/24",
+			gateway:         "192.168.5.254",
+			expected:        "192.168.5.0/24",
+			expectedGateway: "192.168.5.254",
+		},
+		{
+			name:     "subnet overlapping a smaller one",
+			existing: []string{"10.10.3.0/24"},
+			subnet:   "10.10.0.0/16",
+			err:      true,
+		},
+		{
+			name:     "subnet overlapping a larger one",
+			existing: []string{"10.10.0.0/16"},
+			subnet:   "10.10.3.0/24",
+			err:      true,
+		},
+		{
+			name:     "same subnet as another network",
+			existing: []string{"192.168.5.0/24"},
+			subnet:   "192.168.5.0/24",
+			err:      true,
+		},
+		{name: "invalid subnet", subnet: "192.168.5.0", err: true},
+		{name: "IPv6 subnet", subnet: "fd00::/64", err: true},
+		{name: "subnet smaller than /30", subnet: "192.168.5.0/31", err: true},
+		{name: "gateway without a subnet", gateway: "10.10.0.1", err: true},
+		{name: "gateway outside the subnet", subnet: "192.168.5.0/24", gateway: "192.168.6.1", err: true},
+		{name: "gateway on the network address", subnet: "192.168.5.0/24", gateway: "192.168.5.0", err: true},
+		{name: "gateway on the broadcast address", subnet: "192.168.5.0/24", gateway: "192.168.5.255", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := NewIPAMAllocator("", pools)
+			require.NoError(t, err)
+			for i, subnet := range tt.existing {
+				_, _, err := a.RequestPool(fmt.Sprintf("existing-%d", i), subnet, "")
+				require.NoError(t, err)
+			}
+
+			subnet, gateway, err := a.RequestPool("net", tt.subnet, tt.gateway)
+			if tt.err {
+				assert.Error(t, err)
+				assert.Zero(t, a.Allocated("net"), "A refused network should get no address space")
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, subnet.String())
+			assert.Equal(t, tt.expectedGateway, gateway.String())
+			assert.Equal(t, 1, a.Allocated("net"), "The gateway should be reserved")
+		})
+	}
+}
+
+func TestIPAMRequestPoolAgain(t *testing.T) {
+	a, err := NewIPAMAllocator("", nil)
+	require.NoError(t, err)
+	subnet, gateway, err := a.RequestPool("net", "192.168.5.0/24", "")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		subnet  string
+		gateway string
+		err     bool
+	}{
+		{name: "without a subnet"},
+		{name: "same subnet", subnet: "192.168.5.0/24"},
+		{name: "same subnet and gateway", subnet: "192.168.5.0/24", gateway: "192.168.5.1"},
+		{name: "another subnet", subnet: "192.168.6.0/24", err: true},
+		{name: "another gateway", subnet: "192.168.5.0/24", gateway: "192.168.5.2", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			again, againGateway, err := a.RequestPool("net", tt.subnet, tt.gateway)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, subnet.String(), again.String())
+			assert.Equal(t, gateway.String(), againGateway.String())
+		})
+	}
+}
+
+func TestIPAMPoolExhausted(t *testing.T) {
+	a, err := NewIPAMAllocator("", []AddressPool{{Base: "10.10.0.0/23", Size: 24}})
+	require.NoError(t, err)
+
+	for i, expected := range []string{"10.10.0.0/24", "10.10.1.0/24"} {
+		subnet, _, err := a.RequestPool(fmt.Sprintf("net-%d", i), "", "")
+		require.NoError(t, err)
+		assert.Equal(t, expected, subnet.String())
+	}
+	_, _, err = a.RequestPool("net", "", "")
+	assert.Error(t, err, "The pool should be exhausted")
+
+	// Released subnets are handed out again
+	require.NoError(t, a.ReleasePool("net-0"))
+	subnet, _, err := a.RequestPool("net", "", "")
+	require.NoError(t, err)
+	assert.Equal(t, "10.10.0.0/24", subnet.String())
+}
+
+func TestIPAMRequestAddress(t *testing.T) {
+	tests := []struct {
+		name string
+		// allocated are requested first, in order
+		allocated []string
+		requested string
+		expected  string
+		err       bool
+	}{
+		{name: "first address after the gateway", expected: "10.0.0.2"},
+		{name: "first free address", allocated: []string{"10.0.0.2", "10.0.0.4"}, expected: "10.0.0.3"},
+		{name: "requested address", requested: "10.0.0.5", expected: "10.0.0.5"},
+		{name: "address in use", allocated: []string{"10.0.0.5"}, requested: "10.0.0.5", err: true},
+		{name: "gateway", requested: "10.0.0.1", err: true},
+		{name: "network address", requested: "10.0.0.0", err: true},
+		{name: "broadcast address", requested: "10.0.0.7", err: true},
+		{name: "outside the subnet", requested: "10.0.1.2", err: true},
+		{name: "invalid address", requested: "10.0.0", err: true},
+		{
+			name:      "subnet full",
+			allocated: []string{"10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6"},
+			err:       true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := NewIPAMAllocator("", nil)
+			require.NoError(t, err)
+			_, _, err = a.RequestPool("net", "10.0.0.0/29", "")
+			require.NoError(t, err)
+			for _, ip := range tt.allocated {
+				_, err := a.RequestAddress("net", "other", ip)
+				require.NoError(t, err)
+			}
+
+			ip, err := a.RequestAddress("net", "container", tt.requested)
+			if tt.err {
+				assert.Error(t, err)
+				assert.Equal(t, 1+len(tt.allocated), a.Allocated("net"))
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, ip.String())
+			assert.Equal(t, 2+len(tt.allocated), a.Allocated("net"))
+		})
+	}
+
+	a, err := NewIPAMAllocator("", nil)
+	require.NoError(t, err)
+	_, err = a.RequestAddress("missing", "container", "")
+	assert.Error(t, err, "A network without an address space has no addresses")
+}
+
+func TestIPAMRelease(t *testing.T) {
+	a, err := NewIPAMAllocator("", nil)
+	require.NoError(t, err)
+	_, gateway, err := a.RequestPool("net", "10.0.0.0/24", "")
+	require.NoError(t, err)
+	first, err := a.RequestAddress("net", "a", "")
+	require.NoError(t, err)
+	_, err = a.RequestAddress("net", "b", "")
+	require.NoError(t, err)
+
+	// Released addresses are handed out again, the gateway never
+	require.NoError(t, a.ReleaseAddress("net", first))
+	require.NoError(t, a.ReleaseAddress("net", gateway))
+	assert.Equal(t, 2, a.Allocated("net"))
+	again, err := a.RequestAddress("net", "c", "")
+	require.NoError(t, err)
+	assert.Equal(t, first.String(), again.String())
+	_, err = a.RequestAddress("net", "d", gateway.String())
+	assert.Error(t, err, "The gateway should stay reserved")
+
+	// Releasing in a network without an address space is a no-op
+	assert.NoError(t, a.ReleaseAddress("missing", first))
+
+	// Stale owners lose their addresses, the gateway stays
+	released, err := a.ReleaseStale("net", func(owner string) bool { return owner == "b" })
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.2"}, released)
+	assert.Equal(t, 2, a.Allocated("net"))
+
+	require.NoError(t, a.ReleasePool("net"))
+	assert.Zero(t, a.Allocated("net"))
+	_, err = a.RequestAddress("net", "a", "")
+	assert.Error(t, err, "A released network should have no address space")
+}
+
+func TestIPAMPersistence(t *testing.T) {
+	dir := t.TempDir()
+	a, err := NewIPAMAllocator(dir, nil)
+	require.NoError(t, err)
+	subnet, _, err := a.RequestPool("net", "", "")
+	require.NoError(t, err)
+	ip, err := a.RequestAddress("net", "container", "")
+	require.NoError(t, err)
+	assert.FileExists(t, filepath.Join(dir, IPAMFile))
+
+	// Another allocator on the same directory, as after a restart or in
+	// another process, sees the allocations
+	b, err := NewIPAMAllocator(dir, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 2, b.Allocated("net"))
+	again, _, err := b.RequestPool("net", "", "")
+	require.NoError(t, err)
+	assert.Equal(t, subnet.String(), again.String())
+	next, _, err := b.RequestPool("other", "", "")
+	require.NoError(t, err)
+	assert.False(t, next.Contains(subnet.IP) || subnet.Contains(next.IP), "Subnets should not overlap across allocators")
+	_, err = b.RequestAddress("net", "other", ip.String())
+	assert.Error(t, err, "An address allocated by another allocator should be in use")
+
+	// And changes go both ways
+	require.NoError(t, b.ReleaseAddress("net", ip))
+	assert.Equal(t, 1, a.Allocated("net"))
+	_, err = a.RequestAddress("net", "container", ip.String())
+	assert.NoError(t, err)
+}
+
+func TestBroadcast(t *testing.T) {
+	tests := []struct {
+		subnet   string
+		expected string
+	}{
+		{"10.0.0.0/8", "10.255.255.255"},
+		{"172.17.0.0/16", "172.17.255.255"},
+		{"192.168.16.0/20", "192.168.31.255"},
+		{"192.168.5.4/30", "192.168.5.7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.subnet, func(t *testing.T) {
+			_, subnet, err := net.ParseCIDR(tt.subnet)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, broadcast(subnet).String())
+		})
+	}
+}
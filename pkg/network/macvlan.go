@@ -0,0 +1,177 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"docker-impl/pkg/ids"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// MacvlanDriver gives each container its own MAC address on a host
+	// interface, so it shows up on the physical network as a host of its own
+	MacvlanDriver = "macvlan"
+
+	// IpvlanDriver gives each container its own address on a host
+	// interface, sharing the interface's MAC address
+	IpvlanDriver = "ipvlan"
+
+	// ParentOption names the host interface of a macvlan or ipvlan network
+	ParentOption = "parent"
+)
+
+// The modes of macvlan and ipvlan devices, by the values of the kernel's
+// MACVLAN_MODE_* and IPVLAN_MODE_*, which golang.org/x/sys lacks. The
+// first of each is the default.
+var (
+	macvlanModes = map[string]uint32{"bridge": 4, "private": 1, "vepa": 2, "passthru": 8}
+	ipvlanModes  = map[string]uint32{"l2": 0, "l3": 1, "l3s": 2}
+)
+
+// isSubinterfaceDriver reports whether networks of driver put containers
+// directly on a host interface rather than behind a bridge.
+func isSubinterfaceDriver(driver string) bool {
+	return driver == MacvlanDriver || driver == IpvlanDriver
+}
+
+// modeOption is the option setting the mode of the devices of driver.
+func modeOption(driver string) string {
+	return driver + "_mode"
+}
+
+// subinterfaceOptions checks the options of a macvlan or ipvlan network
+// and returns them as the network records them, with the mode defaulted.
+func subinterfaceOptions(driver string, opts map[string]string) (map[string]interface{}, error) {
+	modes, mode := macvlanModes, "bridge"
+	if driver == IpvlanDriver {
+		modes, mode = ipvlanModes, "l2"
+	}
+
+	options := map[string]interface{}{modeOption(driver): mode}
+	for key, value := range opts {
+		switch key {
+		case ParentOption:
+			if value == "" {
+				return nil, fmt.Errorf("the %s option needs an interface", ParentOption)
+			}
+		case modeOption(driver):
+			if _, ok := modes[value]; !ok {
+				var valid []string
+				for name := range modes {
+					valid = append(valid, name)
+				}
+				sort.Strings(valid)
+				return nil, fmt.Errorf("invalid %s mode %q (valid: %s)", driver, value, strings.Join(valid, ", "))
+			}
+		default:
+			return nil, fmt.Errorf("unknown option %s of the %s driver", key, driver)
+		}
+		options[key] = value
+	}
+	if options[ParentOption] == nil {
+		return nil, fmt.Errorf("%s networks need a parent interface: -o %s=IFACE", driver, ParentOption)
+	}
+	return options, nil
+}
+
+// parent is the host interface of a macvlan or ipvlan network.
+func (n *Network) parent() string {
+	parent, _ := n.Options[ParentOption].(string)
+	return parent
+}
+
+// subinterfaceMode is the mode of the devices of a macvlan or ipvlan
+// network.
+func (n *Network) subinterfaceMode() uint32 {
+	modes := macvlanModes
+	if n.Driver == IpvlanDriver {
+		modes = ipvlanModes
+	}
+	mode, _ := n.Options[modeOption(n.Driver)].(string)
+	return modes[mode]
+}
+
+// setupSubinterface checks the parent interface of a macvlan or ipvlan
+// network and brings it up. There is no bridge and there are no rules:
+// the containers' traffic leaves through the parent as that of any other
+// host on its network, and the network's gateway is its router.
+func (m *Manager) setupSubinterface(network *Network) error {
+	parent := network.parent()
+	if !linkExists(parent) {
+		return fmt.Errorf("parent interface %s of network %s not found", parent, network.Name)
+	}
+	if err := setLinkUp(parent); err != nil {
+		return fmt.Errorf("failed to bring parent interface %s up: %v", parent, err)
+	}
+	return nil
+}
+
+// attachSubinterface creates the container's device on the parent of a
+// macvlan or ipvlan network and configures it as the next free ethN in
+// netns. The device has no end on the host, which, as the kernel
+// intends, can't reach the container through the parent.
+func attachSubinterface(network *Network, subnet *net.IPNet, containerID, netns string, ip net.IP) (*Endpoint, error) {
+	name := "sub" + endpointHash(containerID, network.ID)
+	if err := addSubinterface(name, network.parent(), network.Driver, network.subinterfaceMode()); err != nil {
+		return nil, fmt.Errorf("failed to create %s device on %s: %v", network.Driver, network.parent(), err)
+	}
+	ok := false
+	defer func() {
+		if !ok {
+			deleteLink(name)
+		}
+	}()
+
+	// ipvlan devices share the MAC address of their parent
+	mac := endpointMAC(ip)
+	if network.Driver == MacvlanDriver {
+		if err := setLinkHardwareAddr(name, mac); err != nil {
+			return nil, fmt.Errorf("failed to set MAC address of %s device: %v", network.Driver, err)
+		}
+	} else {
+		parentMAC, err := linkHardwareAddr(network.parent())
+		if err != nil {
+			return nil, err
+		}
+		mac = parentMAC
+	}
+	if err := setLinkNetNS(name, netns); err != nil {
+		return nil, fmt.Errorf("failed to move %s device into netns %s: %v", network.Driver, NetNSName(containerID), err)
+	}
+	ok = true
+
+	iface, err := configureEndpoint(network, subnet, netns, name, ip)
+	if err != nil {
+		EnterNetNS(netns, func() error {
+			// The device is renamed to iface once that is picked
+			if deleteLink(name) != nil && iface != "" {
+				deleteLink(iface)
+			}
+			return nil
+		})
+		return nil, err
+	}
+
+	ones, _ := subnet.Mask.Size()
+	return &Endpoint{
+		EndpointID: ids.GenerateID(),
+		IPAddress:  fmt.Sprintf("%s/%d", ip, ones),
+		Interface:  iface,
+		MacAddress: mac.String(),
+	}, nil
+}
+
+// detachSubinterface deletes the device of an endpoint on a macvlan or
+// ipvlan network from the container's network namespace.
+func detachSubinterface(containerID string, endpoint Endpoint) {
+	err := EnterNetNS(NetNSPath(containerID), func() error {
+		return deleteLink(endpoint.Interface)
+	})
+	// The device is already gone when the container's namespace was
+	if err != nil {
+		logrus.Debugf("Failed to delete %s of container %s: %v", endpoint.Interface, containerID, err)
+	}
+}
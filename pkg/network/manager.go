@@ -3,7 +3,9 @@ package network
 import (
 	"fmt"
 	"net"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -19,10 +21,17 @@ const (
 
 type PortMapping struct {
 	HostPort      int    `json:"host_port"`
+	// HostPortEnd makes HostPort the first of a range of host ports, any
+	// free one of which is published
+	HostPortEnd   int    `json:"host_port_end,omitempty"`
 	ContainerPort int    `json:"container_port"`
 	Protocol      string `json:"protocol"`
 	ContainerIP   string `json:"container_ip"`
 	HostIP        string `json:"host_ip"`
+	// Family is the address family the port is published on, ipv4 or ipv6
+	Family string `json:"family,omitempty"`
+	// ProxyPID is the userland proxy serving the port, if any
+	ProxyPID int `json:"proxy_pid,omitempty"`
 }
 
 type NetworkConfig struct {
@@ -35,6 +44,24 @@ type NetworkConfig struct {
 	Aliases       []string      `json:"aliases"`
 	Hostname      string        `json:"hostname"`
 	DomainName    string        `json:"domain_name"`
+	// ServiceName is resolved to every replica of a service, while
+	// Hostname resolves to this container alone
+	ServiceName   string        `json:"service_name,omitempty"`
+	// EnableIPv6 gives the bridge an IPv6 subnet (IPv6Subnet, or
+	// DefaultIPv6Subnet); it is read when the manager is created
+	EnableIPv6 bool   `json:"enable_ipv6,omitempty"`
+	IPv6Subnet string `json:"ipv6_subnet,omitempty"`
+	// StateDir keeps the state of the host's networks, such as the
+	// iptables rules installed (DefaultStateDir when empty)
+	StateDir string `json:"state_dir,omitempty"`
+	// AddressPools are where the subnets of networks created without one
+	// are picked from (DefaultAddressPools when empty)
+	AddressPools []AddressPool `json:"address_pools,omitempty"`
+	// UserlandProxy serves published ports to the host and the containers
+	// on the bridge with a proxy process per port; otherwise NAT rules do,
+	// localhost included. Either way other hosts reach them through NAT.
+	// It is read when the manager is created.
+	UserlandProxy bool `json:"userland_proxy,omitempty"`
 }
 
 type NetworkSettings struct {
@@ -47,6 +74,27 @@ type NetworkSettings struct {
 	NetworkID   string            `json:"network_id"`
 	EndpointID  string            `json:"endpoint_id"`
 	SandboxID   string            `json:"sandbox_id"`
+	Hostname    string            `json:"hostname,omitempty"`
+	ServiceName string            `json:"service_name,omitempty"`
+	GlobalIPv6Address string `json:"global_ipv6_address,omitempty"`
+	IPv6Gateway       string `json:"ipv6_gateway,omitempty"`
+	// SandboxKey is the network namespace the container's process is
+	// started in; empty when it shares the host's
+	SandboxKey string `json:"sandbox_key,omitempty"`
+	// ContainerName and HostInterface, the host's end of the container's
+	// veth pair, are listed by network inspect
+	ContainerName string `json:"container_name,omitempty"`
+	HostInterface string `json:"host_interface,omitempty"`
+	// Aliases are the other names the container is found by on the bridge
+	Aliases []string `json:"aliases,omitempty"`
+	// PortMappings are the mappings published for the container
+	PortMappings []PortMapping `json:"port_mappings,omitempty"`
+}
+
+// dnsNames are the names a container on the default bridge is found by
+// besides its name and short ID.
+func (s *NetworkSettings) dnsNames() []string {
+	return append([]string{s.Hostname, s.ServiceName}, s.Aliases...)
 }
 
 type PortBinding struct {
@@ -59,7 +107,16 @@ type Manager struct {
 	dnsManager    *DNSManager
 	serviceDisc   *ServiceDiscovery
 	networks      map[string]*NetworkConfig
-	containerNet map[string]*NetworkSettings
+	// endpoints holds the settings of the containers on the default bridge
+	endpoints *endpointStore
+	rules         *RuleStore
+	// ipam allocates the subnets of networks and the addresses in them
+	ipam *IPAMAllocator
+	// ports allocates the host ports containers publish
+	ports *PortAllocator
+	// userNetworks holds the user-defined networks
+	userNetworks *networkStore
+	created      time.Time
 	mu            sync.RWMutex
 	config        *NetworkConfig
 }
@@ -71,9 +128,21 @@ type Network struct {
 	Scope    string          `json:"scope"`
 	Subnet   string          `json:"subnet"`
 	Gateway  string          `json:"gateway"`
-	Created  string          `json:"created"`
+	Created  time.Time       `json:"created"`
 	Options  map[string]interface{} `json:"options"`
 	IPAM     IPAM            `json:"ipam"`
+	// Internal networks have no route out of their bridge
+	Internal bool              `json:"internal,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	// Containers holds the endpoints of the connected containers by
+	// container ID
+	Containers map[string]Endpoint `json:"containers,omitempty"`
+	// VNI is the VXLAN ID of an overlay network, the same on every node
+	VNI int `json:"vni,omitempty"`
+	// Peers are the endpoints of an overlay network on other nodes
+	Peers []RemoteEndpoint `json:"peers,omitempty"`
+	// Policies allow or deny traffic into the network, in its policy chain
+	Policies []Policy `json:"policies,omitempty"`
 }
 
 type IPAM struct {
@@ -91,14 +160,20 @@ type IPAMConfig struct {
 var (
 	networkManager *Manager
 	managerOnce    sync.Once
+	// managerConfig is what GetNetworkManager creates the manager with
+	managerConfig = NetworkConfig{Mode: NetworkModeBridge}
 )
 
+// Configure sets what GetNetworkManager creates the manager with, e.g. from
+// the daemon config. It has no effect once the manager is created.
+func Configure(config NetworkConfig) {
+	managerConfig = config
+}
+
 func GetNetworkManager() *Manager {
 	managerOnce.Do(func() {
-		config := &NetworkConfig{
-			Mode: NetworkModeBridge,
-		}
-		networkManager = NewManager(config)
+		config := managerConfig
+		networkManager = NewManager(&config)
 	})
 	return networkManager
 }
@@ -107,25 +182,66 @@ func NewManager(config *NetworkConfig) *Manager {
 	m := &Manager{
 		config:       config,
 		networks:     make(map[string]*NetworkConfig),
-		containerNet: make(map[string]*NetworkSettings),
+		created:      time.Now(),
 	}
 
+	stateDir := config.StateDir
+	if stateDir == "" {
+		stateDir = DefaultStateDir
+	}
+	rules, err := LoadRuleStore(stateDir)
+	if err != nil {
+		logrus.Errorf("Failed to load network rules, keeping them in memory: %v", err)
+		rules, _ = LoadRuleStore("")
+	}
+	m.rules = rules
+	m.userNetworks = newNetworkStore(stateDir)
+	m.endpoints = newEndpointStore(stateDir)
+
+	ipam, err := NewIPAMAllocator(stateDir, config.AddressPools)
+	if err != nil {
+		logrus.Errorf("Invalid address pools, using the default ones: %v", err)
+		ipam, _ = NewIPAMAllocator(stateDir, nil)
+	}
+	m.ipam = ipam
+	m.ports = NewPortAllocator(stateDir)
+
 	// Initialize bridge manager
 	if config.Mode == NetworkModeBridge {
-		bridgeMgr, err := NewBridgeManager()
+		bridgeMgr, err := NewBridgeManager(rules, ipam)
 		if err != nil {
 			logrus.Errorf("Failed to create bridge manager: %v", err)
 		} else {
 			m.bridgeManager = bridgeMgr
+			bridgeMgr.userlandProxy = config.UserlandProxy
+			if !config.UserlandProxy {
+				if err := bridgeMgr.enableHairpinNAT(); err != nil {
+					logrus.Warnf("Failed to let the host reach published ports: %v", err)
+				}
+			}
+			if config.EnableIPv6 {
+				if err := bridgeMgr.EnableIPv6(config.IPv6Subnet); err != nil {
+					logrus.Errorf("Failed to enable IPv6: %v", err)
+				}
+			}
 		}
 	}
 
 	// Initialize DNS manager
-	m.dnsManager = NewDNSManager("172.17.0.1:53")
+	m.dnsManager = NewDNSManager(m.userNetworks.list)
 	if err := m.dnsManager.Start(); err != nil {
 		logrus.Errorf("Failed to start DNS manager: %v", err)
 	}
 
+	// Containers that went away without unpublishing their ports or
+	// removing their endpoints, e.g. killed along with the process that
+	// started them, are released, and those still running are found again
+	if m.bridgeManager != nil {
+		m.releaseStalePorts()
+		m.restoreEndpoints()
+	}
+	m.restoreNetworks()
+
 	// Initialize service discovery
 	m.serviceDisc = NewServiceDiscovery(m.dnsManager)
 
@@ -137,30 +253,6 @@ func NewManager(config *NetworkConfig) *Manager {
 }
 
 func (m *Manager) createDefaultNetwork() {
-	defaultNetwork := &Network{
-		ID:      "mydocker0",
-		Name:    "bridge",
-		Driver:  "bridge",
-		Scope:   "local",
-		Subnet:  "172.17.0.0/16",
-		Gateway: "172.17.0.1",
-		Created: "now",
-		Options: map[string]interface{}{
-			"com.docker.network.bridge.default_bridge": "true",
-			"com.docker.network.bridge.enable_icc":     "true",
-			"com.docker.network.bridge.name":          "mydocker0",
-		},
-		IPAM: IPAM{
-			Driver: "default",
-			Config: []IPAMConfig{
-				{
-					Subnet:  "172.17.0.0/16",
-					Gateway: "172.17.0.1",
-				},
-			},
-		},
-	}
-
 	// Store network configuration
 	m.networks["bridge"] = &NetworkConfig{
 		Mode:        NetworkModeBridge,
@@ -189,7 +281,7 @@ func (m *Manager) CreateContainerNetwork(containerID, containerName string, conf
 	case NetworkModeHost:
 		return m.setupHostNetwork(settings)
 	case NetworkModeNone:
-		return m.setupNoneNetwork(settings)
+		return m.setupNoneNetwork(containerID, settings)
 	default:
 		return nil, fmt.Errorf("unsupported network mode: %s", config.Mode)
 	}
@@ -200,15 +292,24 @@ func (m *Manager) setupBridgeNetwork(containerID, containerName string, config *
 		return nil, fmt.Errorf("bridge manager not available")
 	}
 
+	// Create the container's network namespace first: addresses of
+	// containers without one are taken to be leaked
+	sandboxKey, err := CreateNetNS(containerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create network namespace: %v", err)
+	}
+
 	// Allocate IP for container
-	containerIP, err := m.bridgeManager.AllocateIP()
+	containerIP, err := m.bridgeManager.AllocateIP(containerID)
 	if err != nil {
+		DeleteNetNS(containerID)
 		return nil, fmt.Errorf("failed to allocate IP: %v", err)
 	}
 
 	// Create veth pair
 	vethHost, vethContainer, err := m.bridgeManager.CreateVethPair(containerID)
 	if err != nil {
+		DeleteNetNS(containerID)
 		m.bridgeManager.ReleaseIP(containerIP)
 		return nil, fmt.Errorf("failed to create veth pair: %v", err)
 	}
@@ -216,70 +317,129 @@ func (m *Manager) setupBridgeNetwork(containerID, containerName string, config *
 	// Configure container network
 	err = m.bridgeManager.ConfigureContainerNetwork(containerID, vethContainer, containerIP)
 	if err != nil {
+		// Deleting either end removes the pair
+		deleteLink(vethHost)
+		DeleteNetNS(containerID)
 		m.bridgeManager.ReleaseIP(containerIP)
 		return nil, fmt.Errorf("failed to configure container network: %v", err)
 	}
 
+	containerIPv6 := m.bridgeManager.ContainerIPv6(containerIP)
+
 	// Setup port mappings
 	if len(config.PortMappings) > 0 {
 		settings.Ports = make(map[string][]PortBinding)
 		for _, mapping := range config.PortMappings {
-			// Update mapping with container IP
-			mapping.ContainerIP = containerIP.String()
+			// Update mapping with the container IP of its family
+			if mapping.Family == FamilyIPv6 {
+				if containerIPv6 == nil {
+					logrus.Warnf("Skipping port mapping %v: IPv6 is not enabled", mapping)
+					continue
+				}
+				mapping.ContainerIP = containerIPv6.String()
+			} else {
+				mapping.ContainerIP = containerIP.String()
+			}
 
-			// Add port mapping to bridge
-			err = m.bridgeManager.SetupPortMapping(containerID, []PortMapping{mapping})
+			// Allocate the host port, so no two containers publish the
+			// same one
+			hostPort, err := m.ports.RequestPort(containerID, mapping)
+			if err == nil {
+				mapping.HostPort = hostPort
+				mapping.HostPortEnd = 0
+				if m.bridgeManager.userlandProxy && proxied(mapping) {
+					mapping.ProxyPID, err = startProxy(containerID, mapping)
+				}
+			}
 			if err != nil {
+				stopProxies(settings.PortMappings)
+				m.unpublishPorts(containerID)
+				deleteLink(vethHost)
+				DeleteNetNS(containerID)
+				m.bridgeManager.ReleaseIP(containerIP)
+				return nil, err
+			}
+
+			// Add port mapping to bridge
+			if err := m.bridgeManager.addPortMapping(containerID, mapping); err != nil {
 				logrus.Warnf("Failed to setup port mapping %v: %v", mapping, err)
+				stopProxies([]PortMapping{mapping})
 				continue
 			}
 
-			// Add to settings
-			portKey := fmt.Sprintf("%d/%s", mapping.ContainerPort, mapping.Protocol)
-			settings.Ports[portKey] = []PortBinding{
-				{
-					HostIP:   mapping.HostIP,
-					HostPort: fmt.Sprintf("%d", mapping.HostPort),
-				},
-			}
+			settings.PortMappings = append(settings.PortMappings, mapping)
+
+			// Add to settings; a port published on both families has a
+			// binding for each
+			portKey := mapping.PortKey()
+			settings.Ports[portKey] = append(settings.Ports[portKey], PortBinding{
+				HostIP:   mapping.HostIP,
+				HostPort: fmt.Sprintf("%d", mapping.HostPort),
+			})
 		}
 	}
 
+	if len(settings.PortMappings) > 0 && !m.bridgeManager.userlandProxy {
+		setHairpinMode(vethHost)
+	}
+
 	// Set network settings
 	settings.IPAddress = containerIP.String()
 	settings.Gateway = m.bridgeManager.gateway.String()
-	settings.EndpointID = vethHost[:12] // Use first 12 chars as endpoint ID
-
-	// Register container DNS
-	m.dnsManager.RegisterContainer(containerID, containerName, containerIP.String())
-
-	// Register aliases
-	for _, alias := range config.Aliases {
-		m.dnsManager.AddAlias(alias, containerName)
+	if containerIPv6 != nil {
+		settings.GlobalIPv6Address = containerIPv6.String()
+		settings.IPv6Gateway = m.bridgeManager.IPv6Gateway().String()
 	}
+	settings.EndpointID = vethHost[:12] // Use first 12 chars as endpoint ID
+	settings.HostInterface = vethHost
+	settings.MacAddress = endpointMAC(containerIP).String()
+	settings.SandboxKey = sandboxKey
+	settings.ContainerName = containerName
+
+	// Register container DNS. Replicas of a service are found by the
+	// service name and their own hostname
+	settings.Hostname = config.Hostname
+	settings.ServiceName = config.ServiceName
+	settings.Aliases = config.Aliases
+	m.dnsManager.RegisterContainer(containerID, containerName, containerIP.String(), settings.dnsNames()...)
 
 	// Store network settings
-	m.containerNet[containerID] = settings
+	err = m.endpoints.update(func(all map[string]*NetworkSettings) error {
+		all[containerID] = settings
+		return nil
+	})
+	if err != nil {
+		logrus.Warnf("Failed to record the endpoint of container %s: %v", containerID, err)
+	}
+	m.refreshPoliciesOf(containerID)
 
 	logrus.Infof("Bridge network created for container %s: %s", containerID, containerIP)
 	return settings, nil
 }
 
+// setupHostNetwork leaves the container in the host's network namespace:
+// there is no SandboxKey, so its process is started without a namespace
+// of its own and shares the host's interfaces, addresses and ports.
 func (m *Manager) setupHostNetwork(settings *NetworkSettings) (*NetworkSettings, error) {
-	// For host network, container uses host's network stack
 	settings.NetworkMode = "host"
-	settings.IPAddress = "127.0.0.1" // This would be host's IP in reality
+	settings.NetworkID = "host"
 
-	logrus.Infof("Host network created for container")
+	logrus.Infof("Host network created for container %s", settings.SandboxID)
 	return settings, nil
 }
 
-func (m *Manager) setupNoneNetwork(settings *NetworkSettings) (*NetworkSettings, error) {
-	// For none network, container has no network access
+// setupNoneNetwork gives the container a network namespace of its own
+// with nothing in it but loopback, which is up.
+func (m *Manager) setupNoneNetwork(containerID string, settings *NetworkSettings) (*NetworkSettings, error) {
+	sandboxKey, err := CreateNetNS(containerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create network namespace: %v", err)
+	}
 	settings.NetworkMode = "none"
-	settings.IPAddress = ""
+	settings.NetworkID = "none"
+	settings.SandboxKey = sandboxKey
 
-	logrus.Infof("None network created for container")
+	logrus.Infof("None network created for container %s", containerID)
 	return settings, nil
 }
 
@@ -289,18 +449,17 @@ func (m *Manager) RemoveContainerNetwork(containerID, containerName string) erro
 
 	logrus.Infof("Removing network for container %s", containerID)
 
-	settings, exists := m.containerNet[containerID]
-	if !exists {
-		return fmt.Errorf("network settings not found for container %s", containerID)
+	settings, err := m.endpoints.get(containerID)
+	if err != nil {
+		return err
 	}
 
 	// Unregister DNS
 	m.dnsManager.UnregisterContainer(containerID, containerName)
+	m.serviceDisc.UnregisterContainer(containerID)
 
 	// Remove port mappings
-	if m.bridgeManager != nil {
-		m.bridgeManager.RemovePortMapping(containerID, nil)
-	}
+	m.unpublishPorts(containerID)
 
 	// Release IP if using bridge network
 	if settings.NetworkMode == "bridge" && m.bridgeManager != nil {
@@ -312,58 +471,70 @@ func (m *Manager) RemoveContainerNetwork(containerID, containerName string) erro
 		}
 	}
 
+	// The container's end of the veth pair goes with its namespace, and
+	// the host's end with it
+	if settings.SandboxKey != "" {
+		if err := DeleteNetNS(containerID); err != nil {
+			logrus.Warnf("Failed to delete network namespace of container %s: %v", containerID, err)
+		}
+	}
+
 	// Remove network settings
-	delete(m.containerNet, containerID)
+	err = m.endpoints.update(func(all map[string]*NetworkSettings) error {
+		delete(all, containerID)
+		return nil
+	})
+	if err != nil {
+		logrus.Warnf("Failed to remove the endpoint of container %s: %v", containerID, err)
+	}
+	m.refreshPoliciesOf(containerID)
 
 	logrus.Infof("Network removed for container %s", containerID)
 	return nil
 }
 
-func (m *Manager) GetContainerNetwork(containerID string) (*NetworkSettings, error) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-
-	settings, exists := m.containerNet[containerID]
-	if !exists {
-		return nil, fmt.Errorf("network settings not found for container %s", containerID)
+// unpublishPorts removes the port mappings of a container, stops their
+// proxies and frees its host ports. The rules are found in the rule
+// store and the proxies in the endpoint store, so those of a container
+// another process started go too. It must be called with mu held.
+func (m *Manager) unpublishPorts(containerID string) {
+	if settings, err := m.endpoints.get(containerID); err == nil {
+		stopProxies(settings.PortMappings)
+	}
+	err := m.rules.Remove(func(rule Rule) bool {
+		return rule.Purpose == "port" && rule.ContainerID == containerID
+	})
+	if err != nil {
+		logrus.Warnf("Failed to remove port mappings of container %s: %v", containerID, err)
 	}
+	if err := m.ports.ReleasePorts(containerID); err != nil {
+		logrus.Warnf("Failed to release host ports of container %s: %v", containerID, err)
+	}
+}
 
-	return settings, nil
+func (m *Manager) GetContainerNetwork(containerID string) (*NetworkSettings, error) {
+	return m.endpoints.get(containerID)
 }
 
+// ListNetworks returns the default bridge followed by the user-defined
+// networks.
 func (m *Manager) ListNetworks() []Network {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-
-	var networks []Network
+	networks := []Network{m.defaultNetwork()}
 
-	// Add default bridge network
-	bridgeNetwork := Network{
-		ID:      "mydocker0",
-		Name:    "bridge",
-		Driver:  "bridge",
-		Scope:   "local",
-		Subnet:  "172.17.0.0/16",
-		Gateway: "172.17.0.1",
-		Created: "now",
-		Options: map[string]interface{}{
-			"com.docker.network.bridge.default_bridge": "true",
-			"com.docker.network.bridge.enable_icc":     "true",
-		},
+	userNetworks, err := m.userNetworks.list()
+	if err != nil {
+		logrus.Warnf("Failed to list networks: %v", err)
+	}
+	for _, network := range userNetworks {
+		networks = append(networks, *network)
 	}
-
-	networks = append(networks, bridgeNetwork)
-
 	return networks
 }
 
 func (m *Manager) GetNetworkStats(containerID string) (map[string]interface{}, error) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-
-	settings, exists := m.containerNet[containerID]
-	if !exists {
-		return nil, fmt.Errorf("network settings not found for container %s", containerID)
+	settings, err := m.endpoints.get(containerID)
+	if err != nil {
+		return nil, err
 	}
 
 	stats := map[string]interface{}{
@@ -383,29 +554,65 @@ func (m *Manager) GetNetworkStats(containerID string) (map[string]interface{}, e
 	return stats, nil
 }
 
-func (m *Manager) GetDNSConfig(containerID string) string {
-	return m.dnsManager.GetDNSConfig()
+// StartResolver starts the DNS server of a container in its network
+// namespace netns, forwarding to upstreams or the host's resolvers; see
+// DNSManager.StartResolver.
+func (m *Manager) StartResolver(containerID, netns string, upstreams []string) error {
+	return m.dnsManager.StartResolver(containerID, netns, upstreams)
 }
 
-func (m *Manager) CreateResolvConf(containerID string) string {
-	return m.dnsManager.CreateResolvConf(containerID)
+// StopResolver stops the DNS server of a container.
+func (m *Manager) StopResolver(containerID string) {
+	m.dnsManager.StopResolver(containerID)
 }
 
-func (m *Manager) RegisterService(serviceName, containerID string, port int, protocol string, metadata map[string]string) error {
-	m.mu.RLock()
-	settings, exists := m.containerNet[containerID]
-	m.mu.RUnlock()
+// SetLinks makes the --link aliases of a container resolve to the IDs of
+// the containers they map to; see DNSManager.SetLinks.
+func (m *Manager) SetLinks(containerID string, links map[string]string) {
+	m.dnsManager.SetLinks(containerID, links)
+}
 
-	if !exists {
-		return fmt.Errorf("container %s not found", containerID)
+// RegisterService registers a container as an instance of a service on
+// port for ttl, on its address on the default bridge, or else on the
+// first of its user-defined networks. See ServiceDiscovery.RegisterService.
+func (m *Manager) RegisterService(serviceName, containerID string, port int, protocol string, metadata map[string]string, ttl time.Duration) error {
+	ip, err := m.serviceAddress(containerID)
+	if err != nil {
+		return err
 	}
+	return m.serviceDisc.RegisterService(serviceName, containerID, ip, port, protocol, metadata, ttl)
+}
 
-	if settings.IPAddress == "" {
-		return fmt.Errorf("container %s has no IP address", containerID)
+// serviceAddress is the address a container serves its services on.
+func (m *Manager) serviceAddress(containerID string) (string, error) {
+	if settings, err := m.endpoints.get(containerID); err == nil && settings.IPAddress != "" {
+		return settings.IPAddress, nil
+	}
+	networks, err := m.userNetworks.list()
+	if err != nil {
+		return "", err
 	}
+	sort.Slice(networks, func(i, j int) bool { return networks[i].Name < networks[j].Name })
+	for _, network := range networks {
+		if endpoint, ok := network.Containers[containerID]; ok {
+			if ip, _, err := net.ParseCIDR(endpoint.IPAddress); err == nil {
+				return ip.String(), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("container %s has no IP address", containerID)
+}
 
-	m.serviceDisc.RegisterService(serviceName, settings.IPAddress, port, protocol, metadata)
-	return nil
+// UnregisterService removes an instance of a service before its
+// registration expires.
+func (m *Manager) UnregisterService(serviceName, containerID, protocol string, port int) error {
+	return m.serviceDisc.UnregisterService(serviceName, containerID, protocol, port)
+}
+
+// SetServiceHealth marks the service instances of a container healthy or
+// not; DNS only answers with healthy ones.
+func (m *Manager) SetServiceHealth(containerID string, healthy bool) {
+	m.serviceDisc.SetHealth(containerID, healthy)
 }
 
 func (m *Manager) DiscoverService(serviceName string) ([]ServiceRecord, error) {
@@ -416,6 +623,12 @@ func (m *Manager) ListServices() []ServiceRecord {
 	return m.serviceDisc.ListServices()
 }
 
+// Rules returns the iptables rules installed for a network or container;
+// see RuleStore.List.
+func (m *Manager) Rules(network, containerID string) []Rule {
+	return m.rules.List(network, containerID)
+}
+
 func (m *Manager) Cleanup() {
 	if m.bridgeManager != nil {
 		m.bridgeManager.Cleanup()
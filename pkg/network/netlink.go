@@ -0,0 +1,441 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// The link, address and route changes of the bridge drivers are made over
+// rtnetlink rather than by running ip. Each call works in the network
+// namespace of the calling thread, so changes inside a container's are
+// made from EnterNetNS.
+
+// vethInfoPeer is VETH_INFO_PEER, which golang.org/x/sys lacks.
+const vethInfoPeer = 1
+
+var netlinkSeq uint32
+
+// nlAttr is a netlink attribute: data, followed by children when nested.
+type nlAttr struct {
+	typ      uint16
+	data     []byte
+	children []nlAttr
+}
+
+func stringAttr(typ uint16, s string) nlAttr {
+	return nlAttr{typ: typ, data: append([]byte(s), 0)}
+}
+
+func uint32Attr(typ uint16, v uint32) nlAttr {
+	data := make([]byte, 4)
+	binary.NativeEndian.PutUint32(data, v)
+	return nlAttr{typ: typ, data: data}
+}
+
+func (a nlAttr) encode() []byte {
+	payload := a.data
+	for _, child := range a.children {
+		payload = append(payload, child.encode()...)
+	}
+	length := unix.SizeofRtAttr + len(payload)
+	buf := make([]byte, nlAlign(length))
+	binary.NativeEndian.PutUint16(buf[0:], uint16(length))
+	binary.NativeEndian.PutUint16(buf[2:], a.typ)
+	copy(buf[unix.SizeofRtAttr:], payload)
+	return buf
+}
+
+func nlAlign(length int) int {
+	return (length + 3) &^ 3
+}
+
+// ifInfoMsg encodes a struct ifinfomsg.
+func ifInfoMsg(family uint8, index int32, flags, change uint32) []byte {
+	buf := make([]byte, unix.SizeofIfInfomsg)
+	buf[0] = family
+	binary.NativeEndian.PutUint32(buf[4:], uint32(index))
+	binary.NativeEndian.PutUint32(buf[8:], flags)
+	binary.NativeEndian.PutUint32(buf[12:], change)
+	return buf
+}
+
+// netlinkRequest sends a request to the kernel and waits for its answer.
+// Dump requests return the messages dumped; others return none once the
+// kernel acknowledged them.
+func netlinkRequest(typ, flags uint16, body []byte, attrs ...nlAttr) ([]syscall.NetlinkMessage, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netlink socket: %v", err)
+	}
+	defer unix.Close(fd)
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, fmt.Errorf("failed to bind netlink socket: %v", err)
+	}
+
+	dump := flags&unix.NLM_F_DUMP == unix.NLM_F_DUMP
+	flags |= unix.NLM_F_REQUEST
+	if !dump {
+		flags |= unix.NLM_F_ACK
+	}
+	seq := atomic.AddUint32(&netlinkSeq, 1)
+
+	msg := make([]byte, unix.SizeofNlMsghdr, 256)
+	msg = append(msg, body...)
+	for _, attr := range attrs {
+		msg = append(msg, attr.encode()...)
+	}
+	binary.NativeEndian.PutUint32(msg[0:], uint32(len(msg)))
+	binary.NativeEndian.PutUint16(msg[4:], typ)
+	binary.NativeEndian.PutUint16(msg[6:], flags)
+	binary.NativeEndian.PutUint32(msg[8:], seq)
+	if err := unix.Sendto(fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, fmt.Errorf("failed to send netlink request: %v", err)
+	}
+
+	var dumped []syscall.NetlinkMessage
+	buf := make([]byte, os.Getpagesize()*8)
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read netlink answer: %v", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse netlink answer: %v", err)
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != seq {
+				continue
+			}
+			switch m.Header.Type {
+			case unix.NLMSG_DONE:
+				return dumped, nil
+			case unix.NLMSG_ERROR:
+				if len(m.Data) < 4 {
+					return nil, fmt.Errorf("short netlink error message")
+				}
+				if errno := -int32(binary.NativeEndian.Uint32(m.Data)); errno != 0 {
+					return nil, syscall.Errno(errno)
+				}
+				return dumped, nil
+			default:
+				// Each message is parsed from buf, which the next read
+				// overwrites
+				m.Data = append([]byte(nil), m.Data...)
+				dumped = append(dumped, m)
+			}
+		}
+	}
+}
+
+// linkIndex returns the index of the link called name.
+func linkIndex(name string) (int32, error) {
+	msgs, err := netlinkRequest(unix.RTM_GETLINK, 0, ifInfoMsg(unix.AF_UNSPEC, 0, 0, 0),
+		stringAttr(unix.IFLA_IFNAME, name))
+	if err == nil && len(msgs) == 0 {
+		err = unix.ENODEV
+	}
+	if err != nil {
+		return 0, fmt.Errorf("link %s: %v", name, err)
+	}
+	if len(msgs[0].Data) < unix.SizeofIfInfomsg {
+		return 0, fmt.Errorf("link %s: short netlink message", name)
+	}
+	return int32(binary.NativeEndian.Uint32(msgs[0].Data[4:])), nil
+}
+
+// linkExists reports whether there is a link called name.
+func linkExists(name string) bool {
+	_, err := linkIndex(name)
+	return err == nil
+}
+
+// addBridge creates a bridge called name.
+func addBridge(name string) error {
+	_, err := netlinkRequest(unix.RTM_NEWLINK, unix.NLM_F_CREATE|unix.NLM_F_EXCL, ifInfoMsg(unix.AF_UNSPEC, 0, 0, 0),
+		stringAttr(unix.IFLA_IFNAME, name),
+		nlAttr{typ: unix.IFLA_LINKINFO, children: []nlAttr{stringAttr(unix.IFLA_INFO_KIND, "bridge")}})
+	return err
+}
+
+// addVethPair creates a veth pair of name and peer.
+func addVethPair(name, peer string) error {
+	peerInfo := nlAttr{
+		typ:      vethInfoPeer,
+		data:     ifInfoMsg(unix.AF_UNSPEC, 0, 0, 0),
+		children: []nlAttr{stringAttr(unix.IFLA_IFNAME, peer)},
+	}
+	_, err := netlinkRequest(unix.RTM_NEWLINK, unix.NLM_F_CREATE|unix.NLM_F_EXCL, ifInfoMsg(unix.AF_UNSPEC, 0, 0, 0),
+		stringAttr(unix.IFLA_IFNAME, name),
+		nlAttr{typ: unix.IFLA_LINKINFO, children: []nlAttr{
+			stringAttr(unix.IFLA_INFO_KIND, "veth"),
+			{typ: unix.IFLA_INFO_DATA, children: []nlAttr{peerInfo}},
+		}})
+	return err
+}
+
+// setLink changes the link called name.
+func setLink(name string, flags, change uint32, attrs ...nlAttr) error {
+	index, err := linkIndex(name)
+	if err != nil {
+		return err
+	}
+	_, err = netlinkRequest(unix.RTM_NEWLINK, 0, ifInfoMsg(unix.AF_UNSPEC, index, flags, change), attrs...)
+	return err
+}
+
+// setLinkUp brings the link called name up.
+func setLinkUp(name string) error {
+	return setLink(name, unix.IFF_UP, unix.IFF_UP)
+}
+
+// setLinkMaster enslaves the link called name to the bridge master.
+func setLinkMaster(name, master string) error {
+	index, err := linkIndex(master)
+	if err != nil {
+		return err
+	}
+	return setLink(name, 0, 0, uint32Attr(unix.IFLA_MASTER, uint32(index)))
+}
+
+// renameLink renames a link, which must be down.
+func renameLink(name, newName string) error {
+	return setLink(name, 0, 0, stringAttr(unix.IFLA_IFNAME, newName))
+}
+
+// setLinkNetNS moves the link called name into the network namespace
+// mounted at path.
+func setLinkNetNS(name, path string) error {
+	ns, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %s: %v", path, err)
+	}
+	defer ns.Close()
+	return setLink(name, 0, 0, uint32Attr(unix.IFLA_NET_NS_FD, uint32(ns.Fd())))
+}
+
+// deleteLink deletes the link called name; deleting either end of a veth
+// pair deletes both.
+func deleteLink(name string) error {
+	_, err := netlinkRequest(unix.RTM_DELLINK, 0, ifInfoMsg(unix.AF_UNSPEC, 0, 0, 0),
+		stringAttr(unix.IFLA_IFNAME, name))
+	if err != nil {
+		return fmt.Errorf("link %s: %v", name, err)
+	}
+	return nil
+}
+
+// replaceAddr gives the link called name the address, replacing it if it
+// is already there. nodad skips duplicate address detection of IPv6
+// addresses, which are otherwise unusable for a while.
+func replaceAddr(name string, address *net.IPNet, nodad bool) error {
+	index, err := linkIndex(name)
+	if err != nil {
+		return err
+	}
+
+	family, ip := uint8(unix.AF_INET), address.IP.To4()
+	if ip == nil {
+		family, ip = unix.AF_INET6, address.IP.To16()
+	}
+	ones, _ := address.Mask.Size()
+	body := make([]byte, unix.SizeofIfAddrmsg)
+	body[0] = family
+	body[1] = uint8(ones)
+	if nodad {
+		body[2] = unix.IFA_F_NODAD
+	}
+	binary.NativeEndian.PutUint32(body[4:], uint32(index))
+
+	_, err = netlinkRequest(unix.RTM_NEWADDR, unix.NLM_F_CREATE|unix.NLM_F_REPLACE, body,
+		nlAttr{typ: unix.IFA_LOCAL, data: ip},
+		nlAttr{typ: unix.IFA_ADDRESS, data: ip})
+	return err
+}
+
+// routeMsg encodes a struct rtmsg of the main table.
+func routeMsg(family uint8) []byte {
+	body := make([]byte, unix.SizeofRtMsg)
+	body[0] = family
+	body[4] = unix.RT_TABLE_MAIN
+	body[5] = unix.RTPROT_BOOT
+	body[6] = unix.RT_SCOPE_UNIVERSE
+	body[7] = unix.RTN_UNICAST
+	return body
+}
+
+// addDefaultRoute adds a default route through gateway.
+func addDefaultRoute(gateway net.IP) error {
+	family, ip := uint8(unix.AF_INET), gateway.To4()
+	if ip == nil {
+		family, ip = unix.AF_INET6, gateway.To16()
+	}
+	_, err := netlinkRequest(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_EXCL, routeMsg(family),
+		nlAttr{typ: unix.RTA_GATEWAY, data: ip})
+	return err
+}
+
+// linkNames returns the names of the links.
+func linkNames() ([]string, error) {
+	msgs, err := netlinkRequest(unix.RTM_GETLINK, unix.NLM_F_DUMP, ifInfoMsg(unix.AF_UNSPEC, 0, 0, 0))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list links: %v", err)
+	}
+	var names []string
+	for i := range msgs {
+		attrs, err := syscall.ParseNetlinkRouteAttr(&msgs[i])
+		if err != nil {
+			continue
+		}
+		for _, attr := range attrs {
+			if attr.Attr.Type == unix.IFLA_IFNAME {
+				names = append(names, string(bytesBeforeNul(attr.Value)))
+			}
+		}
+	}
+	return names, nil
+}
+
+// hasDefaultRoute reports whether there is an IPv4 default route.
+func hasDefaultRoute() (bool, error) {
+	msgs, err := netlinkRequest(unix.RTM_GETROUTE, unix.NLM_F_DUMP, routeMsg(unix.AF_INET))
+	if err != nil {
+		return false, fmt.Errorf("failed to list routes: %v", err)
+	}
+	for _, m := range msgs {
+		// rtm_dst_len, rtm_table and rtm_type
+		if len(m.Data) >= unix.SizeofRtMsg && m.Data[1] == 0 && m.Data[4] == unix.RT_TABLE_MAIN && m.Data[7] == unix.RTN_UNICAST {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func bytesBeforeNul(b []byte) []byte {
+	for i, c := range b {
+		if c == 0 {
+			return b[:i]
+		}
+	}
+	return b
+}
+
+// linkHardwareAddr returns the MAC address of the link called name.
+func linkHardwareAddr(name string) (net.HardwareAddr, error) {
+	msgs, err := netlinkRequest(unix.RTM_GETLINK, 0, ifInfoMsg(unix.AF_UNSPEC, 0, 0, 0),
+		stringAttr(unix.IFLA_IFNAME, name))
+	if err == nil && len(msgs) == 0 {
+		err = unix.ENODEV
+	}
+	if err != nil {
+		return nil, fmt.Errorf("link %s: %v", name, err)
+	}
+	attrs, err := syscall.ParseNetlinkRouteAttr(&msgs[0])
+	if err != nil {
+		return nil, fmt.Errorf("link %s: %v", name, err)
+	}
+	for _, attr := range attrs {
+		if attr.Attr.Type == unix.IFLA_ADDRESS {
+			return net.HardwareAddr(attr.Value), nil
+		}
+	}
+	return nil, fmt.Errorf("link %s has no MAC address", name)
+}
+
+// setLinkHardwareAddr sets the MAC address of the link called name.
+func setLinkHardwareAddr(name string, mac net.HardwareAddr) error {
+	return setLink(name, 0, 0, nlAttr{typ: unix.IFLA_ADDRESS, data: mac})
+}
+
+// addVxlan creates a VXLAN device called name for vni, sending to port.
+// The device learns where remote MAC addresses are from the traffic it
+// receives; fdbAdd tells it where to send the rest.
+func addVxlan(name string, vni uint32, port uint16) error {
+	portData := make([]byte, 2)
+	binary.BigEndian.PutUint16(portData, port)
+	_, err := netlinkRequest(unix.RTM_NEWLINK, unix.NLM_F_CREATE|unix.NLM_F_EXCL, ifInfoMsg(unix.AF_UNSPEC, 0, 0, 0),
+		stringAttr(unix.IFLA_IFNAME, name),
+		nlAttr{typ: unix.IFLA_LINKINFO, children: []nlAttr{
+			stringAttr(unix.IFLA_INFO_KIND, "vxlan"),
+			{typ: unix.IFLA_INFO_DATA, children: []nlAttr{
+				uint32Attr(unix.IFLA_VXLAN_ID, vni),
+				{typ: unix.IFLA_VXLAN_LEARNING, data: []byte{1}},
+				{typ: unix.IFLA_VXLAN_PORT, data: portData},
+			}},
+		}})
+	return err
+}
+
+// fdbRequest adds or deletes the forwarding entry of a VXLAN device that
+// sends mac to the tunnel endpoint dst. The all-zero MAC address is
+// where broadcasts and unknown addresses go, and may have many entries.
+func fdbRequest(typ, flags uint16, name string, mac net.HardwareAddr, dst net.IP) error {
+	index, err := linkIndex(name)
+	if err != nil {
+		return err
+	}
+	ip := dst.To4()
+	if ip == nil {
+		ip = dst.To16()
+	}
+
+	body := make([]byte, unix.SizeofNdMsg)
+	body[0] = unix.AF_BRIDGE
+	binary.NativeEndian.PutUint32(body[4:], uint32(index))
+	binary.NativeEndian.PutUint16(body[8:], unix.NUD_PERMANENT)
+	body[10] = unix.NTF_SELF
+	_, err = netlinkRequest(typ, flags, body,
+		nlAttr{typ: unix.NDA_LLADDR, data: mac},
+		nlAttr{typ: unix.NDA_DST, data: ip})
+	return err
+}
+
+func fdbAdd(name string, mac net.HardwareAddr, dst net.IP) error {
+	flags := uint16(unix.NLM_F_CREATE | unix.NLM_F_REPLACE)
+	if isZeroMAC(mac) {
+		flags = unix.NLM_F_CREATE | unix.NLM_F_APPEND
+	}
+	return fdbRequest(unix.RTM_NEWNEIGH, flags, name, mac, dst)
+}
+
+func fdbDel(name string, mac net.HardwareAddr, dst net.IP) error {
+	return fdbRequest(unix.RTM_DELNEIGH, 0, name, mac, dst)
+}
+
+func isZeroMAC(mac net.HardwareAddr) bool {
+	for _, b := range mac {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// addSubinterface creates a macvlan or ipvlan device called name on top of
+// the link parent. mode is a MACVLAN_MODE_* or IPVLAN_MODE_* value; the
+// kernel takes the first as 32 bits and the second as 16.
+func addSubinterface(name, parent, kind string, mode uint32) error {
+	index, err := linkIndex(parent)
+	if err != nil {
+		return err
+	}
+	modeAttr := uint32Attr(unix.IFLA_MACVLAN_MODE, mode)
+	if kind == "ipvlan" {
+		modeAttr = nlAttr{typ: unix.IFLA_IPVLAN_MODE, data: make([]byte, 2)}
+		binary.NativeEndian.PutUint16(modeAttr.data, uint16(mode))
+	}
+	_, err = netlinkRequest(unix.RTM_NEWLINK, unix.NLM_F_CREATE|unix.NLM_F_EXCL, ifInfoMsg(unix.AF_UNSPEC, 0, 0, 0),
+		stringAttr(unix.IFLA_IFNAME, name),
+		uint32Attr(unix.IFLA_LINK, uint32(index)),
+		nlAttr{typ: unix.IFLA_LINKINFO, children: []nlAttr{
+			stringAttr(unix.IFLA_INFO_KIND, kind),
+			{typ: unix.IFLA_INFO_DATA, children: []nlAttr{modeAttr}},
+		}})
+	return err
+}
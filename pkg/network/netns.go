@@ -0,0 +1,149 @@
+package network
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// NetNSDir holds the network namespaces of containers, where ip netns
+// finds them too.
+var NetNSDir = "/run/netns"
+
+// NetNSName is the name of a container's network namespace.
+func NetNSName(containerID string) string {
+	if len(containerID) > 12 {
+		containerID = containerID[:12]
+	}
+	return "mydocker-" + containerID
+}
+
+// NetNSPath is where the network namespace of a container is mounted.
+func NetNSPath(containerID string) string {
+	return filepath.Join(NetNSDir, NetNSName(containerID))
+}
+
+// CreateNetNS creates a network namespace for a container and bind mounts
+// it at NetNSPath, so it outlives the thread that created it and the
+// container's process can be started in it. A namespace that is already
+// mounted is reused.
+func CreateNetNS(containerID string) (string, error) {
+	path := NetNSPath(containerID)
+	if isNetNS(path) {
+		return path, nil
+	}
+
+	if err := os.MkdirAll(NetNSDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create netns directory: %v", err)
+	}
+	file, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE|os.O_EXCL, 0444)
+	if err != nil && !os.IsExist(err) {
+		return "", fmt.Errorf("failed to create netns file: %v", err)
+	}
+	if file != nil {
+		file.Close()
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		// The thread is only unlocked once it is back in the host's
+		// namespace; otherwise it exits with the goroutine
+		runtime.LockOSThread()
+
+		origin, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+		if err != nil {
+			errc <- fmt.Errorf("failed to open current netns: %v", err)
+			return
+		}
+		defer origin.Close()
+
+		if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			errc <- fmt.Errorf("failed to create netns: %v", err)
+			return
+		}
+		source := fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid())
+		mountErr := unix.Mount(source, path, "none", unix.MS_BIND, "")
+		if err := unix.Setns(int(origin.Fd()), unix.CLONE_NEWNET); err != nil {
+			errc <- fmt.Errorf("failed to return to the host netns: %v", err)
+			return
+		}
+		runtime.UnlockOSThread()
+
+		if mountErr != nil {
+			errc <- fmt.Errorf("failed to mount netns: %v", mountErr)
+			return
+		}
+		errc <- nil
+	}()
+	if err := <-errc; err != nil {
+		os.Remove(path)
+		return "", err
+	}
+
+	// Loopback starts down in a new namespace
+	if err := EnterNetNS(path, func() error { return setLinkUp("lo") }); err != nil {
+		DeleteNetNS(containerID)
+		return "", err
+	}
+	return path, nil
+}
+
+// DeleteNetNS unmounts and removes the network namespace of a container,
+// which takes the interfaces in it along once its processes are gone.
+func DeleteNetNS(containerID string) error {
+	path := NetNSPath(containerID)
+	if err := unix.Unmount(path, unix.MNT_DETACH); err != nil && err != unix.EINVAL && err != unix.ENOENT {
+		return fmt.Errorf("failed to unmount netns: %v", err)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove netns: %v", err)
+	}
+	return nil
+}
+
+// EnterNetNS runs fn on a thread in the network namespace at path.
+// Processes fn starts are started in the namespace.
+func EnterNetNS(path string, fn func() error) error {
+	errc := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+
+		origin, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+		if err != nil {
+			errc <- fmt.Errorf("failed to open current netns: %v", err)
+			return
+		}
+		defer origin.Close()
+		target, err := os.Open(path)
+		if err != nil {
+			errc <- fmt.Errorf("failed to open netns %s: %v", path, err)
+			return
+		}
+		defer target.Close()
+
+		if err := unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+			errc <- fmt.Errorf("failed to enter netns %s: %v", path, err)
+			return
+		}
+		fnErr := fn()
+		if err := unix.Setns(int(origin.Fd()), unix.CLONE_NEWNET); err != nil {
+			errc <- fmt.Errorf("failed to return to the host netns: %v", err)
+			return
+		}
+		runtime.UnlockOSThread()
+		errc <- fnErr
+	}()
+	return <-errc
+}
+
+// isNetNS reports whether a network namespace is mounted at path.
+func isNetNS(path string) bool {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return false
+	}
+	return st.Type == unix.NSFS_MAGIC
+}
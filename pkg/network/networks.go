@@ -0,0 +1,738 @@
+package network
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"docker-impl/pkg/ids"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// NetworksFile lists the user-defined networks of the host
+	NetworksFile = "networks.json"
+
+	// DefaultNetworkName is the bridge containers join unless they ask for
+	// another network
+	DefaultNetworkName = "bridge"
+
+	// userBridgePrefix starts the bridge names of user-defined networks;
+	// the isolation rules match all of them by it
+	userBridgePrefix = "br-"
+)
+
+// predefinedNetworks can't be created or removed by users.
+var predefinedNetworks = map[string]bool{
+	DefaultNetworkName: true,
+	"default":          true,
+	"host":             true,
+	"none":             true,
+}
+
+var validNetworkName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// defaultSubnet is the subnet of the default bridge, which user-defined
+// networks must not overlap.
+var defaultSubnet = mustParseCIDR("172.17.0.0/16")
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return ipNet
+}
+
+// Endpoint is a container's attachment to a network.
+type Endpoint struct {
+	ContainerName string `json:"container_name"`
+	EndpointID    string `json:"endpoint_id"`
+	// IPAddress is the container's address with the subnet's prefix
+	IPAddress string `json:"ip_address"`
+	// Interface is the name of the endpoint inside the container
+	Interface string `json:"interface"`
+	// HostInterface is the host's end of the endpoint's veth pair
+	HostInterface string `json:"host_interface"`
+	MacAddress    string `json:"mac_address,omitempty"`
+	// Aliases are the other names the container is found by on the
+	// network, by the containers on it alone
+	Aliases []string `json:"aliases,omitempty"`
+}
+
+// CreateNetworkOptions describes a user-defined network. Subnet and
+// Gateway are picked when empty.
+type CreateNetworkOptions struct {
+	Name     string            `json:"name"`
+	Driver   string            `json:"driver,omitempty"`
+	Subnet   string            `json:"subnet,omitempty"`
+	Gateway  string            `json:"gateway,omitempty"`
+	Internal bool              `json:"internal,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	// VNI is the VXLAN ID of an overlay network (default: the next free
+	// one). Every node must use the same.
+	VNI int `json:"vni,omitempty"`
+	// Options are those of the driver, e.g. the parent interface of a
+	// macvlan network
+	Options map[string]string `json:"options,omitempty"`
+}
+
+// networkStore keeps the user-defined networks in a state file shared by
+// every mydocker process on the host.
+type networkStore struct {
+	state *stateFile
+	// networks holds the networks by ID when there is no file
+	networks map[string]*Network
+	mu       sync.Mutex
+}
+
+func newNetworkStore(dir string) *networkStore {
+	s := &networkStore{networks: make(map[string]*Network)}
+	if dir != "" {
+		s.state = &stateFile{path: filepath.Join(dir, NetworksFile), what: "networks"}
+	}
+	return s
+}
+
+// load must be called with mu held.
+func (s *networkStore) load() (map[string]*Network, error) {
+	if s.state == nil {
+		return s.networks, nil
+	}
+	networks := make(map[string]*Network)
+	if err := s.state.read(&networks); err != nil {
+		return nil, err
+	}
+	return networks, nil
+}
+
+// list returns the networks sorted by name.
+func (s *networkStore) list() ([]*Network, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	networks, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*Network, 0, len(networks))
+	for _, network := range networks {
+		list = append(list, network)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// update applies fn to the networks and saves them unless it fails.
+func (s *networkStore) update(fn func(networks map[string]*Network) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state == nil {
+		return fn(s.networks)
+	}
+	unlock, err := s.state.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	networks, err := s.load()
+	if err != nil {
+		return err
+	}
+	if err := fn(networks); err != nil {
+		return err
+	}
+	return s.state.write(networks)
+}
+
+// findNetwork resolves a network by ID, name or unique ID prefix.
+func findNetwork(networks map[string]*Network, ref string) (*Network, error) {
+	if network, ok := networks[ref]; ok {
+		return network, nil
+	}
+	for _, network := range networks {
+		if network.Name == ref {
+			return network, nil
+		}
+	}
+	var found *Network
+	for id, network := range networks {
+		if strings.HasPrefix(id, ref) {
+			if found != nil {
+				return nil, fmt.Errorf("network ID prefix %s is ambiguous", ref)
+			}
+			found = network
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("network %s not found", ref)
+	}
+	return found, nil
+}
+
+// bridgeName is the bridge of a user-defined network.
+func (n *Network) bridgeName() string {
+	return userBridgePrefix + ids.TruncateID(n.ID)
+}
+
+// defaultNetwork describes the default bridge and the containers on it.
+func (m *Manager) defaultNetwork() Network {
+	return Network{
+		ID:      "mydocker0",
+		Name:    DefaultNetworkName,
+		Driver:  "bridge",
+		Scope:   "local",
+		Subnet:  defaultSubnet.String(),
+		Gateway: "172.17.0.1",
+		Created: m.created,
+		Options: map[string]interface{}{
+			"com.docker.network.bridge.default_bridge": "true",
+			"com.docker.network.bridge.enable_icc":     "true",
+			"com.docker.network.bridge.name":           "mydocker0",
+		},
+		IPAM: IPAM{
+			Driver: "default",
+			Config: []IPAMConfig{{Subnet: defaultSubnet.String(), Gateway: "172.17.0.1"}},
+		},
+		Containers: m.bridgeEndpoints(),
+	}
+}
+
+// CreateNetwork creates a user-defined bridge network with its own bridge,
+// subnet and rules. Containers on it reach each other and, unless it is
+// internal, the outside world, but not containers on other networks.
+// Overlay networks extend the bridge to other nodes through VXLAN, while
+// macvlan and ipvlan networks put containers directly on the network of a
+// host interface, which Subnet and Gateway must then describe.
+func (m *Manager) CreateNetwork(opts CreateNetworkOptions) (*Network, error) {
+	if !validNetworkName.MatchString(opts.Name) {
+		return nil, fmt.Errorf("invalid network name %q", opts.Name)
+	}
+	if predefinedNetworks[opts.Name] {
+		return nil, fmt.Errorf("%s is a pre-defined network and cannot be created", opts.Name)
+	}
+	if opts.Driver == "" {
+		opts.Driver = "bridge"
+	}
+	if opts.Driver != "bridge" && opts.Driver != OverlayDriver && !isSubinterfaceDriver(opts.Driver) {
+		return nil, fmt.Errorf("unsupported network driver: %s", opts.Driver)
+	}
+	var driverOptions map[string]interface{}
+	if isSubinterfaceDriver(opts.Driver) {
+		if opts.Subnet == "" {
+			return nil, fmt.Errorf("%s networks need the subnet of their parent interface", opts.Driver)
+		}
+		var err error
+		if driverOptions, err = subinterfaceOptions(opts.Driver, opts.Options); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if driverOptions, err = bridgeOptions(opts.Driver, opts.Options); err != nil {
+			return nil, err
+		}
+	}
+	if opts.VNI != 0 && opts.Driver != OverlayDriver {
+		return nil, fmt.Errorf("a VNI can only be set on overlay networks")
+	}
+	if opts.VNI < 0 || opts.VNI > maxVNI {
+		return nil, fmt.Errorf("invalid VNI %d", opts.VNI)
+	}
+
+	var created *Network
+	err := m.userNetworks.update(func(networks map[string]*Network) error {
+		for _, network := range networks {
+			if network.Name == opts.Name {
+				return fmt.Errorf("network with name %s already exists", opts.Name)
+			}
+		}
+
+		id := ids.GenerateID()
+		subnet, gateway, err := m.ipam.RequestPool(id, opts.Subnet, opts.Gateway)
+		if err != nil {
+			return err
+		}
+
+		network := &Network{
+			ID:         id,
+			Name:       opts.Name,
+			Driver:     opts.Driver,
+			Scope:      "local",
+			Subnet:     subnet.String(),
+			Gateway:    gateway.String(),
+			Created:    time.Now(),
+			Internal:   opts.Internal,
+			Labels:     opts.Labels,
+			Containers: make(map[string]Endpoint),
+			IPAM: IPAM{
+				Driver: "default",
+				Config: []IPAMConfig{{Subnet: subnet.String(), Gateway: gateway.String()}},
+			},
+		}
+		network.Options = driverOptions
+		if !isSubinterfaceDriver(network.Driver) {
+			network.Options["com.docker.network.bridge.name"] = network.bridgeName()
+		}
+		if network.Driver == OverlayDriver {
+			network.Scope = "swarm"
+			network.VNI = opts.VNI
+			if network.VNI == 0 {
+				network.VNI = freeVNI(networks)
+			}
+			for _, other := range networks {
+				if other.VNI == network.VNI {
+					m.ipam.ReleasePool(id)
+					return fmt.Errorf("VNI %d is already used by network %s", network.VNI, other.Name)
+				}
+			}
+			network.Options["com.docker.network.driver.overlay.vxlanid_list"] = strconv.Itoa(network.VNI)
+		}
+		if err := m.setupNetwork(network); err != nil {
+			m.teardownUserBridge(network)
+			m.ipam.ReleasePool(id)
+			return err
+		}
+		networks[network.ID] = network
+		created = network
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	device := created.bridgeName()
+	if isSubinterfaceDriver(created.Driver) {
+		device = created.parent()
+	}
+	logrus.Infof("Created network %s (%s) on %s", created.Name, created.Subnet, device)
+	return created, nil
+}
+
+// setupNetwork sets up what a network needs on the host, as its driver
+// does it.
+func (m *Manager) setupNetwork(network *Network) error {
+	switch {
+	case isSubinterfaceDriver(network.Driver):
+		return m.setupSubinterface(network)
+	case network.Driver == OverlayDriver:
+		return m.setupOverlay(network)
+	default:
+		return m.setupUserBridge(network)
+	}
+}
+
+// setupUserBridge creates the bridge of a network and installs its rules.
+func (m *Manager) setupUserBridge(network *Network) error {
+	bridge := network.bridgeName()
+	_, subnet, err := net.ParseCIDR(network.Subnet)
+	if err != nil {
+		return fmt.Errorf("invalid subnet of network %s: %v", network.Name, err)
+	}
+	gateway := &net.IPNet{IP: net.ParseIP(network.Gateway), Mask: subnet.Mask}
+
+	if !linkExists(bridge) {
+		if err := addBridge(bridge); err != nil {
+			return fmt.Errorf("failed to create bridge: %v", err)
+		}
+	}
+	if err := replaceAddr(bridge, gateway, false); err != nil {
+		return fmt.Errorf("failed to assign IP to bridge: %v", err)
+	}
+	if err := setLinkUp(bridge); err != nil {
+		return fmt.Errorf("failed to bring bridge up: %v", err)
+	}
+	if err := os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0644); err != nil {
+		logrus.Warnf("Failed to enable IP forwarding: %v", err)
+	}
+
+	m.installUserBridgeRules(network, subnet.String(), network.Internal)
+	return nil
+}
+
+// installUserBridgeRules installs the rules of a network, its policy chain
+// first, which the rules jump to.
+func (m *Manager) installUserBridgeRules(network *Network, subnet string, internal bool) {
+	if err := m.applyPolicies(network, map[string]*Network{network.ID: network}); err != nil {
+		logrus.Warnf("Failed to configure iptables for network %s: %v", network.Name, err)
+		return
+	}
+	for _, rule := range userBridgeRules(network, subnet, internal) {
+		if err := m.rules.Install(rule); err != nil {
+			logrus.Warnf("Failed to configure iptables for network %s: %v", network.Name, err)
+			break
+		}
+	}
+}
+
+// userBridgeRules are the rules of a user-defined network. Rules added
+// later are inserted above earlier ones, so the jump to the network's
+// policy chain, which keeps out the traffic of other bridges, comes first.
+func userBridgeRules(network *Network, subnet string, internal bool) []Rule {
+	bridge := network.bridgeName()
+	var rules []Rule
+	if internal {
+		rules = append(rules,
+			Rule{Table: "filter", Chain: "FORWARD", Purpose: "internal", Insert: true,
+				Args: []string{"-i", bridge, "!", "-o", bridge, "-j", "DROP"}},
+			Rule{Table: "filter", Chain: "FORWARD", Purpose: "internal", Insert: true,
+				Args: []string{"!", "-i", bridge, "-o", bridge, "-j", "DROP"}},
+		)
+	} else {
+		rules = append(rules,
+			Rule{Table: "nat", Chain: "POSTROUTING", Purpose: "masquerade",
+				Args: []string{"-s", subnet, "!", "-o", bridge, "-j", "MASQUERADE"}},
+			Rule{Table: "filter", Chain: "FORWARD", Purpose: "forward",
+				Args: []string{"-i", bridge, "-j", "ACCEPT"}},
+			Rule{Table: "filter", Chain: "FORWARD", Purpose: "forward",
+				Args: []string{"-o", bridge, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"}},
+		)
+	}
+	rules = append(rules,
+		Rule{Table: "filter", Chain: "FORWARD", Purpose: "isolation", Insert: true,
+			Args: []string{"-i", bridge, "-o", "mydocker0", "-j", "DROP"}},
+		Rule{Table: "filter", Chain: "FORWARD", Purpose: "policy", Insert: true,
+			Args: []string{"-o", bridge, "-j", chainPrefix + network.policyChain()}},
+	)
+	for i := range rules {
+		rules[i].Binary = "iptables"
+		rules[i].Network = network.Name
+	}
+	return rules
+}
+
+// teardownUserBridge removes the rules and bridge of a network, and the
+// VXLAN device of an overlay network. Macvlan and ipvlan networks leave
+// their parent interface as it is.
+func (m *Manager) teardownUserBridge(network *Network) {
+	err := m.rules.Remove(func(rule Rule) bool {
+		return rule.Network == network.Name
+	})
+	if err != nil {
+		logrus.Warnf("Failed to remove rules of network %s: %v", network.Name, err)
+	}
+	if isSubinterfaceDriver(network.Driver) {
+		return
+	}
+	if network.Driver == OverlayDriver {
+		if err := deleteLink(network.vxlanName()); err != nil {
+			logrus.Debugf("Failed to remove VXLAN device of network %s: %v", network.Name, err)
+		}
+	}
+	if err := deleteLink(network.bridgeName()); err != nil {
+		logrus.Debugf("Failed to remove bridge of network %s: %v", network.Name, err)
+	}
+}
+
+// RemoveNetwork removes a user-defined network, which must have no
+// containers connected.
+func (m *Manager) RemoveNetwork(ref string) error {
+	if predefinedNetworks[ref] {
+		return fmt.Errorf("%s is a pre-defined network and cannot be removed", ref)
+	}
+
+	var removed *Network
+	err := m.userNetworks.update(func(networks map[string]*Network) error {
+		network, err := findNetwork(networks, ref)
+		if err != nil {
+			return err
+		}
+		if len(network.Containers) > 0 {
+			var names []string
+			for _, endpoint := range network.Containers {
+				names = append(names, endpoint.ContainerName)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("network %s has active endpoints: %s", network.Name, strings.Join(names, ", "))
+		}
+		m.teardownUserBridge(network)
+		if err := m.ipam.ReleasePool(network.ID); err != nil {
+			logrus.Warnf("Failed to release the subnet of network %s: %v", network.Name, err)
+		}
+		delete(networks, network.ID)
+		m.forgetNetworkPolicies(networks, network)
+		removed = network
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("Removed network %s", removed.Name)
+	return nil
+}
+
+// GetNetwork returns a network by ID, name or unique ID prefix.
+func (m *Manager) GetNetwork(ref string) (*Network, error) {
+	if ref == DefaultNetworkName || ref == "default" || ref == "mydocker0" {
+		network := m.defaultNetwork()
+		return &network, nil
+	}
+
+	networks, err := m.userNetworks.list()
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]*Network, len(networks))
+	for _, network := range networks {
+		byID[network.ID] = network
+	}
+	return findNetwork(byID, ref)
+}
+
+// ConnectContainer attaches a running container to a user-defined network
+// with a veth pair from the network's bridge into the container's network
+// namespace. The container gets ip, or the next free address, and a
+// default route through the network unless it already has one. Its peers
+// on the network find it by its name, its short ID and aliases.
+func (m *Manager) ConnectContainer(ref, containerID, containerName, ip string, aliases []string) (*Endpoint, error) {
+	if predefinedNetworks[ref] {
+		return nil, fmt.Errorf("containers can only be connected to user-defined networks at runtime")
+	}
+	if err := CheckAliases(aliases); err != nil {
+		return nil, err
+	}
+	netns := NetNSPath(containerID)
+	if !isNetNS(netns) {
+		return nil, fmt.Errorf("container %s has no network namespace; is it running?", containerName)
+	}
+
+	var connected Endpoint
+	err := m.userNetworks.update(func(networks map[string]*Network) error {
+		network, err := findNetwork(networks, ref)
+		if err != nil {
+			return err
+		}
+		if _, ok := network.Containers[containerID]; ok {
+			return fmt.Errorf("container %s is already connected to network %s", containerName, network.Name)
+		}
+
+		_, subnet, err := net.ParseCIDR(network.Subnet)
+		if err != nil {
+			return fmt.Errorf("invalid subnet of network %s: %v", network.Name, err)
+		}
+		address, err := m.ipam.RequestAddress(network.ID, containerID, ip)
+		if err != nil {
+			return fmt.Errorf("failed to allocate IP on network %s: %v", network.Name, err)
+		}
+
+		endpoint, err := attachEndpoint(network, subnet, containerID, netns, address)
+		if err != nil {
+			m.ipam.ReleaseAddress(network.ID, address)
+			return err
+		}
+		endpoint.ContainerName = containerName
+		endpoint.Aliases = aliases
+		if network.Containers == nil {
+			network.Containers = make(map[string]Endpoint)
+		}
+		network.Containers[containerID] = *endpoint
+		connected = *endpoint
+		m.refreshPolicies(networks, containerID)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	logrus.Infof("Connected container %s to network %s as %s", containerID, ref, connected.IPAddress)
+	return &connected, nil
+}
+
+// CheckAliases fails unless aliases are names a container can be found by.
+func CheckAliases(aliases []string) error {
+	for _, alias := range aliases {
+		if !validNetworkName.MatchString(alias) {
+			return fmt.Errorf("invalid alias %q: only [a-zA-Z0-9][a-zA-Z0-9_.-] are allowed", alias)
+		}
+	}
+	return nil
+}
+
+// attachEndpoint creates the veth pair of an endpoint and configures the
+// container's end as the next free ethN in netns.
+func attachEndpoint(network *Network, subnet *net.IPNet, containerID, netns string, ip net.IP) (*Endpoint, error) {
+	if isSubinterfaceDriver(network.Driver) {
+		return attachSubinterface(network, subnet, containerID, netns, ip)
+	}
+	hostVeth, peerVeth := endpointVethNames(containerID, network.ID)
+	if err := addVethPair(hostVeth, peerVeth); err != nil {
+		return nil, fmt.Errorf("failed to create veth pair: %v", err)
+	}
+	ok := false
+	defer func() {
+		if !ok {
+			// Deleting either end removes the pair
+			deleteLink(hostVeth)
+		}
+	}()
+
+	if err := setLinkMaster(hostVeth, network.bridgeName()); err != nil {
+		return nil, fmt.Errorf("failed to connect veth to bridge: %v", err)
+	}
+	if err := setLinkUp(hostVeth); err != nil {
+		return nil, fmt.Errorf("failed to bring veth host up: %v", err)
+	}
+	// Other nodes derive the MAC address of an overlay endpoint from its
+	// IP address
+	if err := setLinkHardwareAddr(peerVeth, endpointMAC(ip)); err != nil {
+		return nil, fmt.Errorf("failed to set MAC address of veth: %v", err)
+	}
+	if err := setLinkNetNS(peerVeth, netns); err != nil {
+		return nil, fmt.Errorf("failed to move veth into netns %s: %v", NetNSName(containerID), err)
+	}
+
+	iface, err := configureEndpoint(network, subnet, netns, peerVeth, ip)
+	if err != nil {
+		return nil, err
+	}
+
+	ones, _ := subnet.Mask.Size()
+	ok = true
+	return &Endpoint{
+		EndpointID:    ids.GenerateID(),
+		IPAddress:     fmt.Sprintf("%s/%d", ip, ones),
+		Interface:     iface,
+		HostInterface: hostVeth,
+		MacAddress:    endpointMAC(ip).String(),
+	}, nil
+}
+
+// configureEndpoint renames link, already moved into netns, to the next
+// free ethN there, gives it ip and brings it up, with a default route
+// through the network unless the container has one. It returns the name
+// the link got, even when a later step fails.
+func configureEndpoint(network *Network, subnet *net.IPNet, netns, link string, ip net.IP) (string, error) {
+	var iface string
+	err := EnterNetNS(netns, func() error {
+		name, hasDefault, err := inspectNetNS()
+		if err != nil {
+			return err
+		}
+		if err := renameLink(link, name); err != nil {
+			return err
+		}
+		iface = name
+		if err := replaceAddr(iface, &net.IPNet{IP: ip, Mask: subnet.Mask}, false); err != nil {
+			return err
+		}
+		if err := setLinkUp(iface); err != nil {
+			return err
+		}
+		// Overlay networks have no way out of the cluster
+		if hasDefault || network.Internal || network.Driver == OverlayDriver {
+			return nil
+		}
+		return addDefaultRoute(net.ParseIP(network.Gateway))
+	})
+	if err != nil {
+		return iface, fmt.Errorf("failed to configure container network: %v", err)
+	}
+	return iface, nil
+}
+
+// endpointVethNames derives the names of an endpoint's veth pair from the
+// container and network, within the 15 characters interface names allow.
+func endpointVethNames(containerID, networkID string) (string, string) {
+	name := "veth" + endpointHash(containerID, networkID)
+	return name, name + "c"
+}
+
+// endpointHash is a short hash of an endpoint's container and network,
+// for naming its links.
+func endpointHash(containerID, networkID string) string {
+	h := fnv.New32a()
+	h.Write([]byte(containerID + networkID))
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+// inspectNetNS returns the first ethN free in the network namespace of
+// the calling thread and whether it has a default route.
+func inspectNetNS() (string, bool, error) {
+	links, err := linkNames()
+	if err != nil {
+		return "", false, err
+	}
+	names := make(map[string]bool)
+	for _, name := range links {
+		names[name] = true
+	}
+	iface := ""
+	for i := 0; ; i++ {
+		if name := fmt.Sprintf("eth%d", i); !names[name] {
+			iface = name
+			break
+		}
+	}
+
+	hasDefault, err := hasDefaultRoute()
+	if err != nil {
+		return "", false, err
+	}
+	return iface, hasDefault, nil
+}
+
+// DisconnectContainer detaches a container from a user-defined network.
+// The container's end of the veth pair goes with the host's.
+func (m *Manager) DisconnectContainer(ref, containerID string) error {
+	return m.userNetworks.update(func(networks map[string]*Network) error {
+		network, err := findNetwork(networks, ref)
+		if err != nil {
+			return err
+		}
+		endpoint, ok := network.Containers[containerID]
+		if !ok {
+			return fmt.Errorf("container %s is not connected to network %s", containerID, network.Name)
+		}
+		m.detachEndpoint(network, containerID, endpoint)
+		m.refreshPolicies(networks, containerID)
+		return nil
+	})
+}
+
+// DisconnectAll detaches a container from every user-defined network it
+// is connected to, e.g. once it stopped, and forgets the services it
+// served there.
+func (m *Manager) DisconnectAll(containerID string) error {
+	m.serviceDisc.UnregisterContainer(containerID)
+	return m.userNetworks.update(func(networks map[string]*Network) error {
+		for _, network := range networks {
+			if endpoint, ok := network.Containers[containerID]; ok {
+				m.detachEndpoint(network, containerID, endpoint)
+			}
+		}
+		m.refreshPolicies(networks, containerID)
+		return nil
+	})
+}
+
+func (m *Manager) detachEndpoint(network *Network, containerID string, endpoint Endpoint) {
+	if endpoint.HostInterface == "" {
+		detachSubinterface(containerID, endpoint)
+	} else if err := deleteLink(endpoint.HostInterface); err != nil {
+		// The pair is already gone when the container's namespace was
+		logrus.Debugf("Failed to delete veth %s: %v", endpoint.HostInterface, err)
+	}
+	err := m.rules.Remove(func(rule Rule) bool {
+		return rule.Network == network.Name && rule.ContainerID == containerID
+	})
+	if err != nil {
+		logrus.Warnf("Failed to remove rules of container %s on network %s: %v", containerID, network.Name, err)
+	}
+	if ip, _, err := net.ParseCIDR(endpoint.IPAddress); err == nil {
+		if err := m.ipam.ReleaseAddress(network.ID, ip); err != nil {
+			logrus.Warnf("Failed to release %s on network %s: %v", ip, network.Name, err)
+		}
+	}
+	delete(network.Containers, containerID)
+	logrus.Infof("Disconnected container %s from network %s", containerID, network.Name)
+}
@@ -0,0 +1,182 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	"docker-impl/pkg/ids"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// OverlayDriver is the driver of networks spanning cluster nodes
+	OverlayDriver = "overlay"
+
+	// VXLANPort is the UDP port VXLAN traffic between nodes goes to
+	VXLANPort = 4789
+
+	// firstVNI is where automatically picked VXLAN IDs start, leaving the
+	// lower ones to be set explicitly
+	firstVNI = 4096
+	maxVNI   = 1<<24 - 1
+
+	vxlanPrefix = "vx-"
+)
+
+// RemoteEndpoint is an endpoint of an overlay network on another node.
+type RemoteEndpoint struct {
+	Name string `json:"name,omitempty"`
+	// IPAddress is the endpoint's address with the subnet's prefix
+	IPAddress string `json:"ip_address"`
+	// VTEP is the address of the node the endpoint is on, where its
+	// traffic is tunneled to
+	VTEP string `json:"vtep"`
+}
+
+// vxlanName is the VXLAN device of an overlay network.
+func (n *Network) vxlanName() string {
+	return vxlanPrefix + ids.TruncateID(n.ID)
+}
+
+// freeVNI returns the lowest automatic VXLAN ID no network uses.
+func freeVNI(networks map[string]*Network) int {
+	used := make(map[int]bool, len(networks))
+	for _, network := range networks {
+		used[network.VNI] = true
+	}
+	vni := firstVNI
+	for used[vni] {
+		vni++
+	}
+	return vni
+}
+
+// endpointMAC derives the MAC address of an endpoint from its IPv4
+// address, so nodes can forward to endpoints on other nodes knowing only
+// their addresses.
+func endpointMAC(ip net.IP) net.HardwareAddr {
+	mac := net.HardwareAddr{0x02, 0x42, 0, 0, 0, 0}
+	if ip4 := ip.To4(); ip4 != nil {
+		copy(mac[2:], ip4)
+	}
+	return mac
+}
+
+// setupOverlay creates the bridge of an overlay network with a VXLAN
+// device on it. The bridge has no address: the gateway is left unused, as
+// every node would answer for it. Like an internal network, the overlay's
+// containers reach only each other.
+func (m *Manager) setupOverlay(network *Network) error {
+	bridge := network.bridgeName()
+	_, subnet, err := net.ParseCIDR(network.Subnet)
+	if err != nil {
+		return fmt.Errorf("invalid subnet of network %s: %v", network.Name, err)
+	}
+
+	if !linkExists(bridge) {
+		if err := addBridge(bridge); err != nil {
+			return fmt.Errorf("failed to create bridge: %v", err)
+		}
+	}
+	vxlan := network.vxlanName()
+	if !linkExists(vxlan) {
+		if err := addVxlan(vxlan, uint32(network.VNI), VXLANPort); err != nil {
+			return fmt.Errorf("failed to create VXLAN device: %v", err)
+		}
+	}
+	if err := setLinkMaster(vxlan, bridge); err != nil {
+		return fmt.Errorf("failed to connect VXLAN device to bridge: %v", err)
+	}
+	for _, link := range []string{vxlan, bridge} {
+		if err := setLinkUp(link); err != nil {
+			return fmt.Errorf("failed to bring %s up: %v", link, err)
+		}
+	}
+
+	m.installUserBridgeRules(network, subnet.String(), true)
+	return m.installPeers(network, nil, network.Peers)
+}
+
+// SyncOverlayPeers sets the endpoints of an overlay network on other
+// nodes, so traffic to them is tunneled to their node. Endpoints no longer
+// listed are forgotten.
+func (m *Manager) SyncOverlayPeers(ref string, peers []RemoteEndpoint) error {
+	sorted := append([]RemoteEndpoint(nil), peers...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].IPAddress < sorted[j].IPAddress })
+
+	return m.userNetworks.update(func(networks map[string]*Network) error {
+		network, err := findNetwork(networks, ref)
+		if err != nil {
+			return err
+		}
+		if network.Driver != OverlayDriver {
+			return fmt.Errorf("network %s is not an overlay network", network.Name)
+		}
+		if err := m.installPeers(network, network.Peers, sorted); err != nil {
+			return err
+		}
+		network.Peers = sorted
+		logrus.Debugf("Network %s has %d endpoints on other nodes", network.Name, len(sorted))
+		return nil
+	})
+}
+
+// fdbEntry forwards a MAC address to a node.
+type fdbEntry struct {
+	mac  string
+	vtep string
+}
+
+// peerEntries are the forwarding entries of peers: one per endpoint, and
+// one per node for broadcasts such as ARP.
+func peerEntries(peers []RemoteEndpoint) (map[fdbEntry]bool, error) {
+	entries := make(map[fdbEntry]bool)
+	flood := net.HardwareAddr{0, 0, 0, 0, 0, 0}.String()
+	for _, peer := range peers {
+		ip, _, err := net.ParseCIDR(peer.IPAddress)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q of endpoint %s: %v", peer.IPAddress, peer.Name, err)
+		}
+		if net.ParseIP(peer.VTEP) == nil {
+			return nil, fmt.Errorf("invalid node address %q of endpoint %s", peer.VTEP, peer.Name)
+		}
+		entries[fdbEntry{mac: endpointMAC(ip).String(), vtep: peer.VTEP}] = true
+		entries[fdbEntry{mac: flood, vtep: peer.VTEP}] = true
+	}
+	return entries, nil
+}
+
+// installPeers replaces the forwarding entries of the old peers of an
+// overlay network with those of the new ones.
+func (m *Manager) installPeers(network *Network, old, peers []RemoteEndpoint) error {
+	current, err := peerEntries(old)
+	if err != nil {
+		current = nil
+	}
+	wanted, err := peerEntries(peers)
+	if err != nil {
+		return err
+	}
+
+	vxlan := network.vxlanName()
+	for entry := range current {
+		if wanted[entry] {
+			continue
+		}
+		mac, _ := net.ParseMAC(entry.mac)
+		if err := fdbDel(vxlan, mac, net.ParseIP(entry.vtep)); err != nil {
+			logrus.Debugf("Failed to remove forwarding of %s to %s: %v", entry.mac, entry.vtep, err)
+		}
+	}
+	for entry := range wanted {
+		if current[entry] {
+			continue
+		}
+		mac, _ := net.ParseMAC(entry.mac)
+		if err := fdbAdd(vxlan, mac, net.ParseIP(entry.vtep)); err != nil {
+			return fmt.Errorf("failed to forward %s to node %s: %v", entry.mac, entry.vtep, err)
+		}
+	}
+	return nil
+}
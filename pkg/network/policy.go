@@ -0,0 +1,420 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"docker-impl/pkg/ids"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// ICCOption turns inter-container communication on a network on or
+	// off. Without it, the network's containers only reach each other as
+	// its policies allow.
+	ICCOption = "com.docker.network.bridge.enable_icc"
+
+	// PolicyAllow and PolicyDeny are the actions of a policy
+	PolicyAllow = "allow"
+	PolicyDeny  = "deny"
+
+	// PeerContainer and PeerNetwork are the kinds of PolicyPeer
+	PeerContainer = "container"
+	PeerNetwork   = "network"
+
+	// policyChainPrefix names the chain of a network's policies,
+	// MYDOCKER-NET-<short network ID>
+	policyChainPrefix = "NET-"
+
+	// bridgeNetfilter passes the traffic between the ports of a bridge
+	// through iptables, without which ICC can't be turned off
+	bridgeNetfilter = "/proc/sys/net/bridge/bridge-nf-call-iptables"
+)
+
+// PolicyPeer is a container or network that a policy names.
+type PolicyPeer struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+func (p PolicyPeer) String() string {
+	return p.Type + " " + p.Name
+}
+
+// Policy allows or denies the traffic from a container or a network into
+// a network, to one of its containers or to all of them. Deny policies
+// win over allow ones, which win over the network's ICC setting.
+type Policy struct {
+	ID     string     `json:"id"`
+	Action string     `json:"action"`
+	From   PolicyPeer `json:"from"`
+	// To is a container of the network; nil for all of them
+	To *PolicyPeer `json:"to,omitempty"`
+}
+
+// mentions reports whether the policy names a container.
+func (p Policy) mentions(containerID string) bool {
+	return p.From.Type == PeerContainer && p.From.ID == containerID || p.To != nil && p.To.ID == containerID
+}
+
+// bridgeOptions checks the options of a bridge or overlay network and
+// returns them as the network records them, with ICC on by default.
+func bridgeOptions(driver string, opts map[string]string) (map[string]interface{}, error) {
+	options := map[string]interface{}{ICCOption: "true"}
+	for key, value := range opts {
+		if key != ICCOption {
+			return nil, fmt.Errorf("unknown option %s of the %s driver", key, driver)
+		}
+		icc, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s value %q", ICCOption, value)
+		}
+		options[key] = strconv.FormatBool(icc)
+	}
+	return options, nil
+}
+
+// icc reports whether the containers of a network reach each other
+// without a policy allowing it.
+func (n *Network) icc() bool {
+	icc, _ := n.Options[ICCOption].(string)
+	return icc != "false"
+}
+
+// policyChain is the subchain of FORWARD that the traffic into the bridge
+// of a network goes through.
+func (n *Network) policyChain() string {
+	return policyChainPrefix + ids.TruncateID(n.ID)
+}
+
+// policyRules are the rules of the policy chain of a network, in order:
+// replies to allowed traffic are let through, then the deny and allow
+// policies apply, then ICC, and the traffic from other bridges is dropped.
+// Traffic from anywhere else returns to FORWARD. Policies naming a
+// container that isn't connected have no rules.
+func (m *Manager) policyRules(network *Network, networks map[string]*Network) []Rule {
+	bridge := network.bridgeName()
+	rules := []Rule{
+		{Args: []string{"-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"}},
+	}
+	for _, action := range []string{PolicyDeny, PolicyAllow} {
+		target := "ACCEPT"
+		if action == PolicyDeny {
+			target = "DROP"
+		}
+		for _, policy := range network.Policies {
+			if policy.Action != action {
+				continue
+			}
+			var destination []string
+			if policy.To != nil {
+				endpoint, ok := network.Containers[policy.To.ID]
+				if !ok {
+					continue
+				}
+				ip, _, err := net.ParseCIDR(endpoint.IPAddress)
+				if err != nil {
+					continue
+				}
+				destination = []string{"-d", ip.String()}
+			}
+			for _, source := range m.policySources(policy.From, networks) {
+				args := append(append(source, destination...), "-j", target)
+				rules = append(rules, Rule{Args: args})
+			}
+		}
+	}
+
+	icc := "ACCEPT"
+	if !network.icc() {
+		icc = "DROP"
+	}
+	rules = append(rules,
+		Rule{Args: []string{"-i", bridge, "-j", icc}},
+		Rule{Args: []string{"-i", userBridgePrefix + "+", "-j", "DROP"}},
+		Rule{Args: []string{"-i", "mydocker0", "-j", "DROP"}},
+	)
+	for i := range rules {
+		rules[i].Binary = "iptables"
+		rules[i].Table = "filter"
+		rules[i].Chain = "FORWARD"
+		rules[i].Subchain = network.policyChain()
+		rules[i].Network = network.Name
+		rules[i].Purpose = "policy"
+	}
+	return rules
+}
+
+// policySources returns the matches of the traffic from a policy's peer:
+// the bridge of a network, or the address of a container on each bridge
+// it is connected to.
+func (m *Manager) policySources(peer PolicyPeer, networks map[string]*Network) [][]string {
+	if peer.Type == PeerNetwork {
+		if peer.ID == "mydocker0" {
+			return [][]string{{"-i", "mydocker0"}}
+		}
+		if network, ok := networks[peer.ID]; ok && !isSubinterfaceDriver(network.Driver) {
+			return [][]string{{"-i", network.bridgeName()}}
+		}
+		return nil
+	}
+
+	var sources [][]string
+	if settings, err := m.endpoints.get(peer.ID); err == nil && settings.IPAddress != "" {
+		sources = append(sources, []string{"-i", "mydocker0", "-s", settings.IPAddress})
+	}
+	var names []string
+	byName := make(map[string]*Network, len(networks))
+	for _, network := range networks {
+		names = append(names, network.Name)
+		byName[network.Name] = network
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		network := byName[name]
+		endpoint, ok := network.Containers[peer.ID]
+		if !ok || isSubinterfaceDriver(network.Driver) {
+			continue
+		}
+		if ip, _, err := net.ParseCIDR(endpoint.IPAddress); err == nil {
+			sources = append(sources, []string{"-i", network.bridgeName(), "-s", ip.String()})
+		}
+	}
+	return sources
+}
+
+// applyPolicies rebuilds the policy chain of a network from its ICC
+// setting and policies. networks are all the user-defined networks, where
+// the containers the policies name are found. A chain that already has
+// the rules is left as it is, but for rules gone missing.
+func (m *Manager) applyPolicies(network *Network, networks map[string]*Network) error {
+	chain := network.policyChain()
+	rules := m.policyRules(network, networks)
+
+	var installed []Rule
+	for _, rule := range m.rules.List(network.Name, "") {
+		if rule.Subchain == chain {
+			installed = append(installed, rule)
+		}
+	}
+	same := len(installed) == len(rules)
+	for i := 0; same && i < len(rules); i++ {
+		same = installed[i].sameAs(rules[i])
+	}
+	if !same {
+		err := m.rules.Remove(func(rule Rule) bool {
+			return rule.Network == network.Name && rule.Subchain == chain
+		})
+		if err != nil {
+			return fmt.Errorf("failed to remove policies of network %s: %v", network.Name, err)
+		}
+	}
+	for _, rule := range rules {
+		if err := m.rules.Install(rule); err != nil {
+			return fmt.Errorf("failed to apply policies of network %s: %v", network.Name, err)
+		}
+	}
+
+	if !network.icc() || len(network.Policies) > 0 {
+		if err := os.WriteFile(bridgeNetfilter, []byte("1"), 0644); err != nil {
+			logrus.Warnf("Failed to pass bridged traffic through iptables, so policies within network %s are not enforced (is br_netfilter loaded?): %v", network.Name, err)
+		}
+	}
+	return nil
+}
+
+// refreshPolicies rebuilds the policy chains that name a container, whose
+// addresses changed as it was connected or disconnected.
+func (m *Manager) refreshPolicies(networks map[string]*Network, containerID string) {
+	for _, network := range networks {
+		for _, policy := range network.Policies {
+			if !policy.mentions(containerID) {
+				continue
+			}
+			if err := m.applyPolicies(network, networks); err != nil {
+				logrus.Warnf("Failed to refresh policies: %v", err)
+			}
+			break
+		}
+	}
+}
+
+// refreshPoliciesOf is refreshPolicies for changes on the default bridge,
+// outside an update of the user-defined networks.
+func (m *Manager) refreshPoliciesOf(containerID string) {
+	list, err := m.userNetworks.list()
+	if err != nil {
+		logrus.Warnf("Failed to list networks to refresh policies: %v", err)
+		return
+	}
+	networks := make(map[string]*Network, len(list))
+	for _, network := range list {
+		networks[network.ID] = network
+	}
+	m.refreshPolicies(networks, containerID)
+}
+
+// policyNetwork resolves the network a policy lets traffic come from.
+func policyNetwork(networks map[string]*Network, ref string) (*PolicyPeer, error) {
+	if ref == DefaultNetworkName || ref == "default" || ref == "mydocker0" {
+		return &PolicyPeer{Type: PeerNetwork, ID: "mydocker0", Name: DefaultNetworkName}, nil
+	}
+	network, err := findNetwork(networks, ref)
+	if err != nil {
+		return nil, err
+	}
+	if isSubinterfaceDriver(network.Driver) {
+		return nil, fmt.Errorf("%s network %s has no bridge to match its traffic by", network.Driver, network.Name)
+	}
+	return &PolicyPeer{Type: PeerNetwork, ID: network.ID, Name: network.Name}, nil
+}
+
+// policyTarget resolves a network whose policies change.
+func policyTarget(networks map[string]*Network, ref string) (*Network, error) {
+	if predefinedNetworks[ref] {
+		return nil, fmt.Errorf("%s is a pre-defined network and has no policies", ref)
+	}
+	network, err := findNetwork(networks, ref)
+	if err != nil {
+		return nil, err
+	}
+	if isSubinterfaceDriver(network.Driver) {
+		return nil, fmt.Errorf("%s networks have no bridge to apply policies on", network.Driver)
+	}
+	return network, nil
+}
+
+// SetICC turns inter-container communication on a network on or off.
+func (m *Manager) SetICC(ref string, enabled bool) error {
+	var name string
+	err := m.userNetworks.update(func(networks map[string]*Network) error {
+		network, err := policyTarget(networks, ref)
+		if err != nil {
+			return err
+		}
+		previous := network.Options[ICCOption]
+		network.Options[ICCOption] = strconv.FormatBool(enabled)
+		if err := m.applyPolicies(network, networks); err != nil {
+			network.Options[ICCOption] = previous
+			m.applyPolicies(network, networks)
+			return err
+		}
+		name = network.Name
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("Set ICC of network %s to %t", name, enabled)
+	return nil
+}
+
+// AddPolicy adds a policy to a network. A network peer is given by ID,
+// name or unique ID prefix; container peers by their ID and name.
+func (m *Manager) AddPolicy(ref string, policy Policy) (*Policy, error) {
+	if policy.Action != PolicyAllow && policy.Action != PolicyDeny {
+		return nil, fmt.Errorf("invalid policy action %q", policy.Action)
+	}
+	if policy.From.Type != PeerContainer && policy.From.Type != PeerNetwork {
+		return nil, fmt.Errorf("policies apply to traffic from a container or a network")
+	}
+	if policy.To != nil && policy.To.Type != PeerContainer {
+		return nil, fmt.Errorf("policies apply to traffic to a container")
+	}
+
+	var added Policy
+	err := m.userNetworks.update(func(networks map[string]*Network) error {
+		network, err := policyTarget(networks, ref)
+		if err != nil {
+			return err
+		}
+		if policy.From.Type == PeerNetwork {
+			from, err := policyNetwork(networks, policy.From.ID)
+			if err != nil {
+				return err
+			}
+			// Replies from an internal network can't leave its bridge
+			if network.Internal && policy.Action == PolicyAllow && from.ID != network.ID {
+				return fmt.Errorf("network %s is internal: only its own containers can reach it", network.Name)
+			}
+			policy.From = *from
+		}
+		policy.ID = ids.TruncateID(ids.GenerateID())
+
+		network.Policies = append(network.Policies, policy)
+		if err := m.applyPolicies(network, networks); err != nil {
+			network.Policies = network.Policies[:len(network.Policies)-1]
+			m.applyPolicies(network, networks)
+			return err
+		}
+		added = policy
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	logrus.Infof("Added policy %s to network %s", added.ID, ref)
+	return &added, nil
+}
+
+// RemovePolicy removes a policy of a network by ID or unique ID prefix.
+func (m *Manager) RemovePolicy(ref, id string) error {
+	if id == "" {
+		return fmt.Errorf("policy ID is required")
+	}
+	return m.userNetworks.update(func(networks map[string]*Network) error {
+		network, err := policyTarget(networks, ref)
+		if err != nil {
+			return err
+		}
+		index := -1
+		for i, policy := range network.Policies {
+			if strings.HasPrefix(policy.ID, id) {
+				if index >= 0 {
+					return fmt.Errorf("policy ID prefix %s is ambiguous", id)
+				}
+				index = i
+			}
+		}
+		if index < 0 {
+			return fmt.Errorf("policy %s not found on network %s", id, network.Name)
+		}
+
+		policies := network.Policies
+		network.Policies = append(append([]Policy(nil), policies[:index]...), policies[index+1:]...)
+		if err := m.applyPolicies(network, networks); err != nil {
+			network.Policies = policies
+			m.applyPolicies(network, networks)
+			return err
+		}
+		logrus.Infof("Removed policy %s from network %s", policies[index].ID, network.Name)
+		return nil
+	})
+}
+
+// forgetNetworkPolicies drops the policies naming a removed network from
+// the others.
+func (m *Manager) forgetNetworkPolicies(networks map[string]*Network, removed *Network) {
+	for _, network := range networks {
+		var kept []Policy
+		for _, policy := range network.Policies {
+			if policy.From.Type != PeerNetwork || policy.From.ID != removed.ID {
+				kept = append(kept, policy)
+			}
+		}
+		if len(kept) == len(network.Policies) {
+			continue
+		}
+		network.Policies = kept
+		if err := m.applyPolicies(network, networks); err != nil {
+			logrus.Warnf("Failed to refresh policies: %v", err)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package network
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBridgeOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     map[string]string
+		expected string
+		err      bool
+	}{
+		{name: "ICC on by default", expected: "true"},
+		{name: "ICC off", opts: map[string]string{ICCOption: "false"}, expected: "false"},
+		{name: "ICC off as a number", opts: map[string]string{ICCOption: "0"}, expected: "false"},
+		{name: "invalid ICC value", opts: map[string]string{ICCOption: "maybe"}, err: true},
+		{name: "unknown option", opts: map[string]string{"com.docker.network.bridge.name": "br0"}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options, err := bridgeOptions("bridge", tt.opts)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, map[string]interface{}{ICCOption: tt.expected}, options)
+			assert.Equal(t, tt.expected == "true", (&Network{Options: options}).icc())
+		})
+	}
+}
+
+func TestPolicyRules(t *testing.T) {
+	frontend := &Network{
+		ID:      "aaaaaaaaaaaa0001",
+		Name:    "frontend",
+		Driver:  "bridge",
+		Options: map[string]interface{}{ICCOption: "true"},
+		Containers: map[string]Endpoint{
+			"web": {ContainerName: "web", IPAddress: "10.1.0.2/24"},
+		},
+	}
+	backend := &Network{
+		ID:      "bbbbbbbbbbbb0002",
+		Name:    "backend",
+		Driver:  "bridge",
+		Options: map[string]interface{}{ICCOption: "false"},
+		Containers: map[string]Endpoint{
+			"db":  {ContainerName: "db", IPAddress: "10.2.0.2/24"},
+			"web": {ContainerName: "web", IPAddress: "10.2.0.3/24"},
+		},
+	}
+	lan := &Network{ID: "cccccccccccc0003", Name: "lan", Driver: MacvlanDriver}
+	networks := map[string]*Network{frontend.ID: frontend, backend.ID: backend, lan.ID: lan}
+
+	m := &Manager{endpoints: newEndpointStore("")}
+	require.NoError(t, m.endpoints.update(func(settings map[string]*NetworkSettings) error {
+		settings["web"] = &NetworkSettings{IPAddress: "172.17.0.5"}
+		return nil
+	}))
+
+	established := []string{"-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"}
+	tail := func(bridge, icc string) [][]string {
+		return [][]string{
+			{"-i", bridge, "-j", icc},
+			{"-i", "br-+", "-j", "DROP"},
+			{"-i", "mydocker0", "-j", "DROP"},
+		}
+	}
+	db := &PolicyPeer{Type: PeerContainer, ID: "db", Name: "db"}
+
+	tests := []struct {
+		name     string
+		network  *Network
+		policies []Policy
+		expected [][]string
+	}{
+		{
+			name:     "ICC on without policies",
+			network:  frontend,
+			expected: append([][]string{established}, tail("br-aaaaaaaaaaaa", "ACCEPT")...),
+		},
+		{
+			name:     "ICC off without policies",
+			network:  backend,
+			expected: append([][]string{established}, tail("br-bbbbbbbbbbbb", "DROP")...),
+		},
+		{
+			name:    "container to a container, on every bridge it is on",
+			network: backend,
+			policies: []Policy{
+				{Action: PolicyAllow, From: PolicyPeer{Type: PeerContainer, ID: "web", Name: "web"}, To: db},
+			},
+			expected: append([][]string{
+				established,
+				{"-i", "mydocker0", "-s", "172.17.0.5", "-d", "10.2.0.2", "-j", "ACCEPT"},
+				{"-i", "br-bbbbbbbbbbbb", "-s", "10.2.0.3", "-d", "10.2.0.2", "-j", "ACCEPT"},
+				{"-i", "br-aaaaaaaaaaaa", "-s", "10.1.0.2", "-d", "10.2.0.2", "-j", "ACCEPT"},
+			}, tail("br-bbbbbbbbbbbb", "DROP")...),
+		},
+		{
+			name:    "deny before allow",
+			network: backend,
+			policies: []Policy{
+				{Action: PolicyAllow, From: PolicyPeer{Type: PeerNetwork, ID: frontend.ID, Name: "frontend"}},
+				{Action: PolicyDeny, From: PolicyPeer{Type: PeerNetwork, ID: "mydocker0", Name: DefaultNetworkName}, To: db},
+			},
+			expected: append([][]string{
+				established,
+				{"-i", "mydocker0", "-d", "10.2.0.2", "-j", "DROP"},
+				{"-i", "br-aaaaaaaaaaaa", "-j", "ACCEPT"},
+			}, tail("br-bbbbbbbbbbbb", "DROP")...),
+		},
+		{
+			name:    "peers without a bridge or address",
+			network: backend,
+			policies: []Policy{
+				{Action: PolicyAllow, From: PolicyPeer{Type: PeerNetwork, ID: lan.ID, Name: "lan"}},
+				{Action: PolicyAllow, From: PolicyPeer{Type: PeerNetwork, ID: "gone", Name: "gone"}},
+				{Action: PolicyAllow, From: PolicyPeer{Type: PeerContainer, ID: "gone", Name: "gone"}},
+				{Action: PolicyAllow, From: PolicyPeer{Type: PeerContainer, ID: "web", Name: "web"}, To: &PolicyPeer{Type: PeerContainer, ID: "gone"}},
+			},
+			expected: append([][]string{established}, tail("br-bbbbbbbbbbbb", "DROP")...),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			network := *tt.network
+			network.Policies = tt.policies
+			rules := m.policyRules(&network, networks)
+
+			var args [][]string
+			for _, rule := range rules {
+				args = append(args, rule.Args)
+				assert.Equal(t, "iptables", rule.Binary)
+				assert.Equal(t, "filter", rule.Table)
+				assert.Equal(t, "FORWARD", rule.Chain)
+				assert.Equal(t, "NET-"+network.ID[:12], rule.Subchain)
+				assert.Equal(t, network.Name, rule.Network)
+				assert.Equal(t, "policy", rule.Purpose)
+			}
+			assert.Equal(t, tt.expected, args)
+		})
+	}
+}
+
+func TestPolicyPeers(t *testing.T) {
+	frontend := &Network{ID: "aaaaaaaaaaaa0001", Name: "frontend", Driver: "bridge"}
+	lan := &Network{ID: "cccccccccccc0003", Name: "lan", Driver: IpvlanDriver}
+	networks := map[string]*Network{frontend.ID: frontend, lan.ID: lan}
+
+	sources := []struct {
+		ref      string
+		expected *PolicyPeer
+		err      bool
+	}{
+		{ref: DefaultNetworkName, expected: &PolicyPeer{Type: PeerNetwork, ID: "mydocker0", Name: DefaultNetworkName}},
+		{ref: "default", expected: &PolicyPeer{Type: PeerNetwork, ID: "mydocker0", Name: DefaultNetworkName}},
+		{ref: "frontend", expected: &PolicyPeer{Type: PeerNetwork, ID: frontend.ID, Name: "frontend"}},
+		{ref: "aaaa", expected: &PolicyPeer{Type: PeerNetwork, ID: frontend.ID, Name: "frontend"}},
+		{ref: "lan", err: true},
+		{ref: "missing", err: true},
+	}
+	for _, tt := range sources {
+		t.Run("from "+tt.ref, func(t *testing.T) {
+			peer, err := policyNetwork(networks, tt.ref)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, peer)
+		})
+	}
+
+	targets := []struct {
+		ref string
+		err bool
+	}{
+		{ref: "frontend"},
+		{ref: frontend.ID},
+		{ref: DefaultNetworkName, err: true},
+		{ref: "host", err: true},
+		{ref: "lan", err: true},
+		{ref: "missing", err: true},
+	}
+	for _, tt := range targets {
+		t.Run("to "+tt.ref, func(t *testing.T) {
+			network, err := policyTarget(networks, tt.ref)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, frontend, network)
+		})
+	}
+}
+
+func TestPolicyMentions(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   Policy
+		expected bool
+	}{
+		{
+			name:     "from the container",
+			policy:   Policy{From: PolicyPeer{Type: PeerContainer, ID: "web"}},
+			expected: true,
+		},
+		{
+			name:     "to the container",
+			policy:   Policy{From: PolicyPeer{Type: PeerNetwork, ID: "web"}, To: &PolicyPeer{Type: PeerContainer, ID: "web"}},
+			expected: true,
+		},
+		{
+			name:   "from a network of the same ID",
+			policy: Policy{From: PolicyPeer{Type: PeerNetwork, ID: "web"}},
+		},
+		{
+			name:   "between other containers",
+			policy: Policy{From: PolicyPeer{Type: PeerContainer, ID: "api"}, To: &PolicyPeer{Type: PeerContainer, ID: "db"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, tt.policy.mentions("web"))
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"docker-impl/pkg/ids"
+	"github.com/sirupsen/logrus"
+)
+
+// PortsFile records the host ports published by containers.
+const PortsFile = "ports.json"
+
+// Ephemeral host ports come from the kernel's local port range, or this
+// one if it can't be read.
+const (
+	defaultEphemeralBegin = 49153
+	defaultEphemeralEnd   = 65535
+)
+
+var ephemeralRangeFile = "/proc/sys/net/ipv4/ip_local_port_range"
+
+// portAllocation is a host port published by a container.
+type portAllocation struct {
+	Protocol string `json:"protocol"`
+	HostIP   string `json:"host_ip"`
+	Port     int    `json:"port"`
+	// Owner is the container the port was allocated to
+	Owner string `json:"owner"`
+}
+
+func (p portAllocation) address() string {
+	return net.JoinHostPort(hostIP(p.HostIP).String(), fmt.Sprint(p.Port))
+}
+
+// conflicts reports whether p and other can't both be bound: the same
+// port and protocol on the same address, or on any address of a family
+// where one of them is bound to all of its addresses.
+func (p portAllocation) conflicts(other portAllocation) bool {
+	if p.Port != other.Port || p.Protocol != other.Protocol {
+		return false
+	}
+	ip, otherIP := hostIP(p.HostIP), hostIP(other.HostIP)
+	if (ip.To4() == nil) != (otherIP.To4() == nil) {
+		return false
+	}
+	return ip.Equal(otherIP) || ip.IsUnspecified() || otherIP.IsUnspecified()
+}
+
+// hostIP parses the host address of a mapping, all IPv4 addresses when
+// there is none.
+func hostIP(address string) net.IP {
+	if ip := net.ParseIP(address); ip != nil {
+		return ip
+	}
+	return net.IPv4zero
+}
+
+// PortAllocator hands out the host ports containers publish, so no two
+// containers claim the same one. Allocations are recorded in PortsFile,
+// so they survive restarts and are seen by every process.
+type PortAllocator struct {
+	state *stateFile
+	// allocations holds the ports when there is no file
+	allocations []portAllocation
+	// begin and end bound the ephemeral ports
+	begin int
+	end   int
+	mu    sync.Mutex
+}
+
+// NewPortAllocator keeps its allocations in dir, or in memory when dir is
+// empty.
+func NewPortAllocator(dir string) *PortAllocator {
+	a := &PortAllocator{}
+	if dir != "" {
+		a.state = &stateFile{path: filepath.Join(dir, PortsFile), what: "port allocations"}
+	}
+	a.begin, a.end = ephemeralRange()
+	return a
+}
+
+// ephemeralRange returns the range ports published without a host port
+// are picked from.
+func ephemeralRange() (int, int) {
+	data, err := os.ReadFile(ephemeralRangeFile)
+	if err == nil {
+		var begin, end int
+		if _, err := fmt.Sscan(string(data), &begin, &end); err == nil && begin > 0 && begin <= end && end <= 65535 {
+			return begin, end
+		}
+	}
+	return defaultEphemeralBegin, defaultEphemeralEnd
+}
+
+// update applies fn to the allocations and saves them unless it fails.
+func (a *PortAllocator) update(fn func(allocations []portAllocation) ([]portAllocation, error)) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.state == nil {
+		allocations, err := fn(a.allocations)
+		if err != nil {
+			return err
+		}
+		a.allocations = allocations
+		return nil
+	}
+	unlock, err := a.state.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	var allocations []portAllocation
+	if err := a.state.read(&allocations); err != nil {
+		return err
+	}
+	allocations, err = fn(allocations)
+	if err != nil {
+		return err
+	}
+	return a.state.write(allocations)
+}
+
+// RequestPort allocates the host port of mapping to owner: HostPort, the
+// first free port from HostPort to HostPortEnd, or an ephemeral port when
+// HostPort is 0. It fails if the port is already allocated for the same
+// protocol on an overlapping address.
+func (a *PortAllocator) RequestPort(owner string, mapping PortMapping) (int, error) {
+	protocol := mapping.Protocol
+	if protocol == "" {
+		protocol = "tcp"
+	}
+	begin, end := mapping.HostPort, mapping.HostPortEnd
+	if begin == 0 {
+		begin, end = a.begin, a.end
+	} else if end < begin {
+		end = begin
+	}
+
+	var allocated int
+	err := a.update(func(allocations []portAllocation) ([]portAllocation, error) {
+		var conflict *portAllocation
+		for port := begin; port <= end; port++ {
+			candidate := portAllocation{Protocol: protocol, HostIP: mapping.HostIP, Port: port, Owner: owner}
+			conflict = nil
+			for i := range allocations {
+				if allocations[i].conflicts(candidate) {
+					conflict = &allocations[i]
+					break
+				}
+			}
+			if conflict == nil {
+				allocated = port
+				return append(allocations, candidate), nil
+			}
+		}
+
+		if begin == end {
+			return nil, fmt.Errorf("bind for %s failed: port is already allocated to container %s",
+				net.JoinHostPort(hostIP(mapping.HostIP).String(), fmt.Sprint(begin)), ids.TruncateID(conflict.Owner))
+		}
+		return nil, fmt.Errorf("no free %s port between %d and %d on %s", protocol, begin, end, hostIP(mapping.HostIP))
+	})
+	if err != nil {
+		return 0, err
+	}
+	return allocated, nil
+}
+
+// ReleasePorts frees the host ports of owner.
+func (a *PortAllocator) ReleasePorts(owner string) error {
+	_, err := a.release(func(allocation portAllocation) bool {
+		return allocation.Owner == owner
+	})
+	return err
+}
+
+// ReleaseStale frees the host ports whose owners are no longer alive,
+// e.g. those of containers killed along with the process that started
+// them. It returns the addresses freed.
+func (a *PortAllocator) ReleaseStale(alive func(owner string) bool) ([]string, error) {
+	return a.release(func(allocation portAllocation) bool {
+		return !alive(allocation.Owner)
+	})
+}
+
+func (a *PortAllocator) release(match func(portAllocation) bool) ([]string, error) {
+	var released []string
+	err := a.update(func(allocations []portAllocation) ([]portAllocation, error) {
+		var kept []portAllocation
+		for _, allocation := range allocations {
+			if match(allocation) {
+				released = append(released, allocation.Protocol+"/"+allocation.address())
+			} else {
+				kept = append(kept, allocation)
+			}
+		}
+		return kept, nil
+	})
+	sort.Strings(released)
+	return released, err
+}
+
+// releaseStalePorts frees the host ports of containers whose network
+// namespace is gone. Their port rules go with the other stale rules, see
+// restoreNetworks.
+func (m *Manager) releaseStalePorts() {
+	released, err := m.ports.ReleaseStale(func(containerID string) bool {
+		return isNetNS(NetNSPath(containerID))
+	})
+	if err != nil {
+		logrus.Warnf("Failed to release stale host ports: %v", err)
+	} else if len(released) > 0 {
+		logrus.Infof("Released stale host ports: %s", strings.Join(released, ", "))
+	}
+}
@@ -0,0 +1,174 @@
+package network
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortAllocatorRequestPort(t *testing.T) {
+	tests := []struct {
+		name string
+		// allocated are published by another container first
+		allocated []PortMapping
+		mapping   PortMapping
+		expected  int
+		err       bool
+	}{
+		{
+			name:     "host port",
+			mapping:  PortMapping{HostPort: 8080, Protocol: "tcp"},
+			expected: 8080,
+		},
+		{
+			name:      "port taken on all addresses",
+			allocated: []PortMapping{{HostPort: 8080, Protocol: "tcp"}},
+			mapping:   PortMapping{HostPort: 8080, Protocol: "tcp", HostIP: "127.0.0.1"},
+			err:       true,
+		},
+		{
+			name:      "all addresses with the port taken on one",
+			allocated: []PortMapping{{HostPort: 8080, Protocol: "tcp", HostIP: "127.0.0.1"}},
+			mapping:   PortMapping{HostPort: 8080, Protocol: "tcp", HostIP: "0.0.0.0"},
+			err:       true,
+		},
+		{
+			name:      "port taken on another address",
+			allocated: []PortMapping{{HostPort: 8080, Protocol: "tcp", HostIP: "127.0.0.1"}},
+			mapping:   PortMapping{HostPort: 8080, Protocol: "tcp", HostIP: "127.0.0.2"},
+			expected:  8080,
+		},
+		{
+			name:      "port taken for another protocol",
+			allocated: []PortMapping{{HostPort: 53, Protocol: "udp"}},
+			mapping:   PortMapping{HostPort: 53, Protocol: "tcp"},
+			expected:  53,
+		},
+		{
+			name:      "port taken on another family",
+			allocated: []PortMapping{{HostPort: 8080, Protocol: "tcp", HostIP: "0.0.0.0"}},
+			mapping:   PortMapping{HostPort: 8080, Protocol: "tcp", HostIP: "::"},
+			expected:  8080,
+		},
+		{
+			name:      "protocol defaults to tcp",
+			allocated: []PortMapping{{HostPort: 8080, Protocol: "tcp"}},
+			mapping:   PortMapping{HostPort: 8080},
+			err:       true,
+		},
+		{
+			name:      "first free port of a range",
+			allocated: []PortMapping{{HostPort: 8000, Protocol: "tcp"}, {HostPort: 8001, Protocol: "tcp"}},
+			mapping:   PortMapping{HostPort: 8000, HostPortEnd: 8002, Protocol: "tcp"},
+			expected:  8002,
+		},
+		{
+			name: "range taken",
+			allocated: []PortMapping{
+				{HostPort: 8000, Protocol: "tcp"},
+				{HostPort: 8001, Protocol: "tcp"},
+				{HostPort: 8002, Protocol: "tcp"},
+			},
+			mapping: PortMapping{HostPort: 8000, HostPortEnd: 8002, Protocol: "tcp"},
+			err:     true,
+		},
+		{
+			name:     "ephemeral port",
+			mapping:  PortMapping{Protocol: "tcp"},
+			expected: 40000,
+		},
+		{
+			name:      "next ephemeral port",
+			allocated: []PortMapping{{Protocol: "tcp"}},
+			mapping:   PortMapping{Protocol: "tcp"},
+			expected:  40001,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewPortAllocator("")
+			a.begin, a.end = 40000, 40009
+			for _, mapping := range tt.allocated {
+				_, err := a.RequestPort("other", mapping)
+				require.NoError(t, err)
+			}
+
+			port, err := a.RequestPort("container", tt.mapping)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, port)
+		})
+	}
+}
+
+func TestPortAllocatorRelease(t *testing.T) {
+	a := NewPortAllocator("")
+	for _, owner := range []string{"a", "b"} {
+		_, err := a.RequestPort(owner, PortMapping{HostPort: 8000, HostPortEnd: 8010, Protocol: "tcp"})
+		require.NoError(t, err)
+	}
+	_, err := a.RequestPort("b", PortMapping{HostPort: 53, Protocol: "udp", HostIP: "::1"})
+	require.NoError(t, err)
+
+	require.NoError(t, a.ReleasePorts("a"))
+	port, err := a.RequestPort("c", PortMapping{HostPort: 8000, HostPortEnd: 8010, Protocol: "tcp"})
+	require.NoError(t, err)
+	assert.Equal(t, 8000, port, "A released port should be handed out again")
+
+	released, err := a.ReleaseStale(func(owner string) bool { return owner == "c" })
+	require.NoError(t, err)
+	assert.Equal(t, []string{"tcp/0.0.0.0:8001", "udp/[::1]:53"}, released)
+}
+
+func TestPortAllocatorPersistence(t *testing.T) {
+	dir := t.TempDir()
+	a := NewPortAllocator(dir)
+	_, err := a.RequestPort("container", PortMapping{HostPort: 8080, Protocol: "tcp"})
+	require.NoError(t, err)
+	assert.FileExists(t, filepath.Join(dir, PortsFile))
+
+	// Another allocator on the same directory, as after a restart or in
+	// another process, sees the allocations
+	b := NewPortAllocator(dir)
+	_, err = b.RequestPort("other", PortMapping{HostPort: 8080, Protocol: "tcp"})
+	assert.Error(t, err)
+	require.NoError(t, b.ReleasePorts("container"))
+	_, err = a.RequestPort("other", PortMapping{HostPort: 8080, Protocol: "tcp"})
+	assert.NoError(t, err)
+}
+
+func TestEphemeralRange(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		begin   int
+		end     int
+	}{
+		{name: "kernel range", content: "32768\t60999\n", begin: 32768, end: 60999},
+		{name: "reversed range", content: "60999 32768\n", begin: defaultEphemeralBegin, end: defaultEphemeralEnd},
+		{name: "out of range", content: "32768 70000\n", begin: defaultEphemeralBegin, end: defaultEphemeralEnd},
+		{name: "garbage", content: "none\n", begin: defaultEphemeralBegin, end: defaultEphemeralEnd},
+	}
+	saved := ephemeralRangeFile
+	defer func() { ephemeralRangeFile = saved }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ephemeralRangeFile = filepath.Join(t.TempDir(), "ip_local_port_range")
+			require.NoError(t, os.WriteFile(ephemeralRangeFile, []byte(tt.content), 0644))
+			begin, end := ephemeralRange()
+			assert.Equal(t, tt.begin, begin)
+			assert.Equal(t, tt.end, end)
+		})
+	}
+
+	ephemeralRangeFile = filepath.Join(t.TempDir(), "missing")
+	begin, end := ephemeralRange()
+	assert.Equal(t, defaultEphemeralBegin, begin)
+	assert.Equal(t, defaultEphemeralEnd, end)
+}
@@ -0,0 +1,237 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+	// FamilyDual publishes a port on both families
+	FamilyDual = "dual"
+)
+
+// ParsePublish parses a --publish value into one mapping per port and
+// address family the port is published on. Both the short syntax,
+// [host-ip:][host-port:]container-port[/protocol] with IPv6 host addresses
+// in brackets, and the long one, e.g.
+// target=80,published=8080,protocol=tcp,family=ipv6, are accepted. A host
+// address picks its family; otherwise ports are published on IPv4, and on
+// IPv6 too when ipv6 is set, unless family says otherwise.
+//
+// Ports may be ranges: 8000-8010:8000-8010 publishes each port on the
+// same host port, 8000-8010:80 publishes port 80 on a free port of the
+// range, and a container port alone is published on an ephemeral port.
+func ParsePublish(spec string, ipv6 bool) ([]PortMapping, error) {
+	var hostIP, hostPort, containerPort, protocol, family string
+	var err error
+	if strings.Contains(spec, "=") {
+		hostIP, hostPort, containerPort, protocol, family, err = parseLongPublish(spec)
+	} else {
+		hostIP, hostPort, containerPort, protocol, err = parseShortPublish(spec)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	mapping := PortMapping{Protocol: strings.ToLower(protocol)}
+	if mapping.Protocol == "" {
+		mapping.Protocol = "tcp"
+	}
+	if mapping.Protocol != "tcp" && mapping.Protocol != "udp" && mapping.Protocol != "sctp" {
+		return nil, fmt.Errorf("invalid protocol in %q: %s", spec, protocol)
+	}
+	containerBegin, containerEnd, err := parsePortRange(containerPort)
+	if err != nil {
+		return nil, fmt.Errorf("invalid container port in %q: %v", spec, err)
+	}
+	var hostBegin, hostEnd int
+	if hostPort != "" {
+		if hostBegin, hostEnd, err = parsePortRange(hostPort); err != nil {
+			return nil, fmt.Errorf("invalid host port in %q: %v", spec, err)
+		}
+		if containerEnd > containerBegin && hostEnd-hostBegin != containerEnd-containerBegin {
+			return nil, fmt.Errorf("invalid ranges in %q: host and container ranges must be the same size", spec)
+		}
+	}
+
+	var families []string
+	if hostIP != "" {
+		ip := net.ParseIP(hostIP)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid host address in %q: %s", spec, hostIP)
+		}
+		ipFamily := FamilyIPv6
+		if ip.To4() != nil {
+			ipFamily = FamilyIPv4
+		}
+		if family != "" && family != ipFamily {
+			return nil, fmt.Errorf("host address %s of %q is not %s", hostIP, spec, family)
+		}
+		mapping.HostIP = ip.String()
+		families = []string{ipFamily}
+	} else {
+		switch family {
+		case "":
+			families = []string{FamilyIPv4}
+			if ipv6 {
+				families = append(families, FamilyIPv6)
+			}
+		case FamilyIPv4, FamilyIPv6:
+			families = []string{family}
+		case FamilyDual:
+			families = []string{FamilyIPv4, FamilyIPv6}
+		default:
+			return nil, fmt.Errorf("invalid family in %q: %s (expected ipv4, ipv6 or dual)", spec, family)
+		}
+	}
+	var mappings []PortMapping
+	for port := containerBegin; port <= containerEnd; port++ {
+		mapping.ContainerPort = port
+		switch {
+		case hostBegin == 0:
+			// Published on an ephemeral port
+		case containerEnd > containerBegin:
+			mapping.HostPort = hostBegin + port - containerBegin
+		default:
+			mapping.HostPort = hostBegin
+			if hostEnd > hostBegin {
+				mapping.HostPortEnd = hostEnd
+			}
+		}
+
+		for _, f := range families {
+			if f == FamilyIPv6 && !ipv6 {
+				return nil, fmt.Errorf("cannot publish %q on IPv6: IPv6 is not enabled", spec)
+			}
+			m := mapping
+			m.Family = f
+			if m.HostIP == "" {
+				m.HostIP = "0.0.0.0"
+				if f == FamilyIPv6 {
+					m.HostIP = "::"
+				}
+			}
+			mappings = append(mappings, m)
+		}
+	}
+	return mappings, nil
+}
+
+func parseShortPublish(spec string) (hostIP, hostPort, containerPort, protocol string, err error) {
+	rest := spec
+	if i := strings.LastIndex(rest, "/"); i >= 0 {
+		rest, protocol = rest[:i], rest[i+1:]
+	}
+
+	if strings.HasPrefix(rest, "[") {
+		end := strings.Index(rest, "]")
+		if end < 0 || len(rest) == end+1 || rest[end+1] != ':' {
+			return "", "", "", "", fmt.Errorf("invalid port specification: %s", spec)
+		}
+		hostIP, rest = rest[1:end], rest[end+2:]
+	}
+
+	parts := strings.Split(rest, ":")
+	switch {
+	case len(parts) == 1:
+		containerPort = parts[0]
+	case len(parts) == 2:
+		hostPort, containerPort = parts[0], parts[1]
+	case len(parts) == 3 && hostIP == "":
+		hostIP, hostPort, containerPort = parts[0], parts[1], parts[2]
+	default:
+		return "", "", "", "", fmt.Errorf("invalid port specification: %s", spec)
+	}
+	if hostIP != "" && hostPort == "" && len(parts) == 1 {
+		return "", "", "", "", fmt.Errorf("invalid port specification: %s", spec)
+	}
+	return hostIP, hostPort, containerPort, protocol, nil
+}
+
+func parseLongPublish(spec string) (hostIP, hostPort, containerPort, protocol, family string, err error) {
+	for _, field := range strings.Split(spec, ",") {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return "", "", "", "", "", fmt.Errorf("invalid field %q in %q: expected key=value", field, spec)
+		}
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "target":
+			containerPort = value
+		case "published":
+			hostPort = value
+		case "protocol":
+			protocol = value
+		case "host_ip", "host-ip":
+			hostIP = strings.Trim(value, "[]")
+		case "family":
+			family = strings.ToLower(value)
+		case "mode":
+			// Only ports published on the host are supported
+			if value != "host" && value != "ingress" {
+				return "", "", "", "", "", fmt.Errorf("invalid mode in %q: %s", spec, value)
+			}
+		default:
+			return "", "", "", "", "", fmt.Errorf("unknown field %q in %q", key, spec)
+		}
+	}
+	if containerPort == "" {
+		return "", "", "", "", "", fmt.Errorf("missing target port in %q", spec)
+	}
+	return hostIP, hostPort, containerPort, protocol, family, nil
+}
+
+func parsePort(value string) (int, error) {
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("port must be between 1 and 65535: %s", value)
+	}
+	return port, nil
+}
+
+// parsePortRange parses a port or a range of ports such as 8000-8010.
+func parsePortRange(value string) (int, int, error) {
+	first, last, isRange := strings.Cut(value, "-")
+	begin, err := parsePort(first)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !isRange {
+		return begin, begin, nil
+	}
+	end, err := parsePort(last)
+	if err != nil {
+		return 0, 0, err
+	}
+	if end < begin {
+		return 0, 0, fmt.Errorf("invalid range: %s", value)
+	}
+	return begin, end, nil
+}
+
+// HostPortRange is the host port of a binding: the port, the range a
+// free port is picked from, or "" for an ephemeral port.
+func (m PortMapping) HostPortRange() string {
+	switch {
+	case m.HostPort == 0:
+		return ""
+	case m.HostPortEnd > m.HostPort:
+		return fmt.Sprintf("%d-%d", m.HostPort, m.HostPortEnd)
+	default:
+		return strconv.Itoa(m.HostPort)
+	}
+}
+
+// PortKey is the key of a mapping's bindings in port maps, e.g. 80/tcp.
+func (m PortMapping) PortKey() string {
+	return fmt.Sprintf("%d/%s", m.ContainerPort, m.Protocol)
+}
+
+// HostAddress is where the port is published, e.g. 0.0.0.0:8080 or
+// [::]:8080.
+func (m PortMapping) HostAddress() string {
+	return net.JoinHostPort(m.HostIP, strconv.Itoa(m.HostPort))
+}
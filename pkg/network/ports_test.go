@@ -0,0 +1,173 @@
+package network
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePublish(t *testing.T) {
+	tests := []struct {
+		name     string
+		spec     string
+		ipv6     bool
+		expected []PortMapping
+		err      bool
+	}{
+		{
+			name: "container port",
+			spec: "80",
+			expected: []PortMapping{
+				{ContainerPort: 80, Protocol: "tcp", HostIP: "0.0.0.0", Family: FamilyIPv4},
+			},
+		},
+		{
+			name: "host and container port",
+			spec: "8080:80",
+			expected: []PortMapping{
+				{HostPort: 8080, ContainerPort: 80, Protocol: "tcp", HostIP: "0.0.0.0", Family: FamilyIPv4},
+			},
+		},
+		{
+			name: "host address and protocol",
+			spec: "127.0.0.1:5353:53/UDP",
+			expected: []PortMapping{
+				{HostPort: 5353, ContainerPort: 53, Protocol: "udp", HostIP: "127.0.0.1", Family: FamilyIPv4},
+			},
+		},
+		{
+			name: "host address without a host port",
+			spec: "127.0.0.1::80",
+			expected: []PortMapping{
+				{ContainerPort: 80, Protocol: "tcp", HostIP: "127.0.0.1", Family: FamilyIPv4},
+			},
+		},
+		{
+			name: "IPv6 host address",
+			spec: "[::1]:8080:80",
+			ipv6: true,
+			expected: []PortMapping{
+				{HostPort: 8080, ContainerPort: 80, Protocol: "tcp", HostIP: "::1", Family: FamilyIPv6},
+			},
+		},
+		{
+			name: "both families with IPv6 enabled",
+			spec: "8080:80",
+			ipv6: true,
+			expected: []PortMapping{
+				{HostPort: 8080, ContainerPort: 80, Protocol: "tcp", HostIP: "0.0.0.0", Family: FamilyIPv4},
+				{HostPort: 8080, ContainerPort: 80, Protocol: "tcp", HostIP: "::", Family: FamilyIPv6},
+			},
+		},
+		{
+			name: "port range to the same range",
+			spec: "8000-8001:9000-9001",
+			expected: []PortMapping{
+				{HostPort: 8000, ContainerPort: 9000, Protocol: "tcp", HostIP: "0.0.0.0", Family: FamilyIPv4},
+				{HostPort: 8001, ContainerPort: 9001, Protocol: "tcp", HostIP: "0.0.0.0", Family: FamilyIPv4},
+			},
+		},
+		{
+			name: "port on a free port of a range",
+			spec: "8000-8010:80",
+			expected: []PortMapping{
+				{HostPort: 8000, HostPortEnd: 8010, ContainerPort: 80, Protocol: "tcp", HostIP: "0.0.0.0", Family: FamilyIPv4},
+			},
+		},
+		{
+			name: "long syntax",
+			spec: "target=80,published=8080,protocol=sctp,mode=host",
+			expected: []PortMapping{
+				{HostPort: 8080, ContainerPort: 80, Protocol: "sctp", HostIP: "0.0.0.0", Family: FamilyIPv4},
+			},
+		},
+		{
+			name: "long syntax on IPv6 only",
+			spec: "target=80,published=8080,family=ipv6",
+			ipv6: true,
+			expected: []PortMapping{
+				{HostPort: 8080, ContainerPort: 80, Protocol: "tcp", HostIP: "::", Family: FamilyIPv6},
+			},
+		},
+		{
+			name: "long syntax on both families",
+			spec: "target=80,family=dual",
+			ipv6: true,
+			expected: []PortMapping{
+				{ContainerPort: 80, Protocol: "tcp", HostIP: "0.0.0.0", Family: FamilyIPv4},
+				{ContainerPort: 80, Protocol: "tcp", HostIP: "::", Family: FamilyIPv6},
+			},
+		},
+		{
+			name: "long syntax with an IPv6 host address",
+			spec: "target=80,published=8080,host_ip=[::1]",
+			ipv6: true,
+			expected: []PortMapping{
+				{HostPort: 8080, ContainerPort: 80, Protocol: "tcp", HostIP: "::1", Family: FamilyIPv6},
+			},
+		},
+		{name: "invalid protocol", spec: "80/icmp", err: true},
+		{name: "port out of range", spec: "70000", err: true},
+		{name: "port zero", spec: "0:80", err: true},
+		{name: "reversed range", spec: "8010-8000:80", err: true},
+		{name: "ranges of different sizes", spec: "8000-8002:9000-9001", err: true},
+		{name: "invalid host address", spec: "localhost:8080:80", err: true},
+		{name: "unclosed IPv6 host address", spec: "[::1:8080:80", ipv6: true, err: true},
+		{name: "too many fields", spec: "1:2:3:4", err: true},
+		{name: "IPv6 host address without IPv6", spec: "[::1]:8080:80", err: true},
+		{name: "IPv6 family without IPv6", spec: "target=80,family=ipv6", err: true},
+		{name: "host address of another family", spec: "target=80,host_ip=127.0.0.1,family=ipv6", ipv6: true, err: true},
+		{name: "invalid family", spec: "target=80,family=ipx", err: true},
+		{name: "invalid mode", spec: "target=80,mode=vip", err: true},
+		{name: "unknown field", spec: "target=80,color=blue", err: true},
+		{name: "field without a value", spec: "target=80,published", err: true},
+		{name: "long syntax without a target", spec: "published=8080", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mappings, err := ParsePublish(tt.spec, tt.ipv6)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, mappings)
+		})
+	}
+}
+
+func TestPortMappingAddresses(t *testing.T) {
+	tests := []struct {
+		mapping   PortMapping
+		hostPorts string
+		key       string
+		address   string
+	}{
+		{
+			mapping:   PortMapping{ContainerPort: 80, Protocol: "tcp", HostIP: "0.0.0.0"},
+			hostPorts: "",
+			key:       "80/tcp",
+			address:   "0.0.0.0:0",
+		},
+		{
+			mapping:   PortMapping{HostPort: 8080, ContainerPort: 80, Protocol: "tcp", HostIP: "0.0.0.0"},
+			hostPorts: "8080",
+			key:       "80/tcp",
+			address:   "0.0.0.0:8080",
+		},
+		{
+			mapping:   PortMapping{HostPort: 8000, HostPortEnd: 8010, ContainerPort: 53, Protocol: "udp", HostIP: "::"},
+			hostPorts: "8000-8010",
+			key:       "53/udp",
+			address:   "[::]:8000",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key+" on "+tt.address, func(t *testing.T) {
+			assert.Equal(t, tt.hostPorts, tt.mapping.HostPortRange())
+			assert.Equal(t, tt.key, tt.mapping.PortKey())
+			assert.Equal(t, tt.address, tt.mapping.HostAddress())
+		})
+	}
+}
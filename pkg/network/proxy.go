@@ -0,0 +1,270 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ProxyCommand is the first argument the mydocker binary is started with
+// to run the userland proxy of a published port; see RunProxy.
+const ProxyCommand = "port-proxy"
+
+const (
+	// proxyDialTimeout bounds connecting to the container
+	proxyDialTimeout = 5 * time.Second
+
+	// proxyUDPTimeout is how long a UDP client is remembered without
+	// traffic
+	proxyUDPTimeout = 90 * time.Second
+
+	// proxyCheckInterval is how often a proxy checks its container is
+	// still there
+	proxyCheckInterval = time.Second
+)
+
+// proxied reports whether a mapping is served by a userland proxy when
+// the bridge uses them; SCTP is left to NAT.
+func proxied(mapping PortMapping) bool {
+	return mapping.Protocol == "tcp" || mapping.Protocol == "udp"
+}
+
+// proxyNetwork is the network a proxy of mapping listens and dials on.
+func proxyNetwork(mapping PortMapping) string {
+	if mapping.Family == FamilyIPv6 {
+		return mapping.Protocol + "6"
+	}
+	return mapping.Protocol + "4"
+}
+
+// proxyListenAddress is where the proxy of mapping listens: its host
+// address, or every address of its family.
+func proxyListenAddress(mapping PortMapping) string {
+	host := mapping.HostIP
+	if host == "" {
+		host = "0.0.0.0"
+		if mapping.Family == FamilyIPv6 {
+			host = "::"
+		}
+	}
+	return net.JoinHostPort(host, strconv.Itoa(mapping.HostPort))
+}
+
+// startProxy starts the userland proxy of a container's mapping in a
+// process of its own, which outlives the one starting it and exits along
+// with the container's network namespace. It returns once the proxy
+// listens, with its PID.
+func startProxy(containerID string, mapping PortMapping) (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, fmt.Errorf("failed to find the proxy executable: %v", err)
+	}
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer ready.Close()
+
+	cmd := exec.Command(exe, ProxyCommand,
+		"-container", containerID,
+		"-proto", proxyNetwork(mapping),
+		"-listen", proxyListenAddress(mapping),
+		"-target", net.JoinHostPort(mapping.ContainerIP, strconv.Itoa(mapping.ContainerPort)),
+	)
+	cmd.ExtraFiles = []*os.File{readyWriter}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	readyWriter.Close()
+	if err != nil {
+		return 0, fmt.Errorf("failed to start proxy for %s: %v", mapping.HostAddress(), err)
+	}
+	// Reap the proxy should it exit while this process still runs
+	go cmd.Wait()
+
+	status, _ := bufio.NewReader(ready).ReadString('\n')
+	if status != "ok\n" {
+		cmd.Process.Kill()
+		if status = strings.TrimSpace(status); status == "" {
+			status = "proxy exited"
+		}
+		return 0, fmt.Errorf("failed to proxy %s: %s", mapping.HostAddress(), status)
+	}
+	logrus.Debugf("Started proxy %d for %s of container %s", cmd.Process.Pid, mapping.HostAddress(), containerID)
+	return cmd.Process.Pid, nil
+}
+
+// stopProxies stops the userland proxies of mappings. A PID no longer a
+// proxy's, its proxy having exited, is left alone.
+func stopProxies(mappings []PortMapping) {
+	for _, mapping := range mappings {
+		if mapping.ProxyPID <= 0 {
+			continue
+		}
+		cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", mapping.ProxyPID))
+		if err != nil || !bytes.Contains(cmdline, []byte("\x00"+ProxyCommand+"\x00")) {
+			continue
+		}
+		if err := syscall.Kill(mapping.ProxyPID, syscall.SIGTERM); err != nil {
+			logrus.Warnf("Failed to stop proxy %d of %s: %v", mapping.ProxyPID, mapping.HostAddress(), err)
+		}
+	}
+}
+
+// RunProxy runs a userland proxy started by startProxy, with the
+// arguments after ProxyCommand, and returns its exit code. It reports
+// whether it listens on file descriptor 3, then forwards what reaches its
+// address to the container until its network namespace goes or it is
+// told to stop.
+func RunProxy(args []string) int {
+	flags := flag.NewFlagSet(ProxyCommand, flag.ContinueOnError)
+	containerID := flags.String("container", "", "container the port is published for")
+	proto := flags.String("proto", "tcp4", "tcp4, tcp6, udp4 or udp6")
+	listen := flags.String("listen", "", "host address to listen on")
+	target := flags.String("target", "", "container address to forward to")
+	ready := os.NewFile(3, "ready")
+	if err := flags.Parse(args); err != nil {
+		fmt.Fprintf(ready, "%v\n", err)
+		return 2
+	}
+
+	var serve func() error
+	var closer io.Closer
+	if strings.HasPrefix(*proto, "udp") {
+		conn, err := net.ListenPacket(*proto, *listen)
+		if err != nil {
+			fmt.Fprintf(ready, "%v\n", err)
+			return 1
+		}
+		closer = conn
+		serve = func() error { return proxyUDP(conn, *proto, *target) }
+	} else {
+		ln, err := net.Listen(*proto, *listen)
+		if err != nil {
+			fmt.Fprintf(ready, "%v\n", err)
+			return 1
+		}
+		closer = ln
+		serve = func() error { return proxyTCP(ln, *proto, *target) }
+	}
+	fmt.Fprint(ready, "ok\n")
+	ready.Close()
+
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+		ticker := time.NewTicker(proxyCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-signals:
+				closer.Close()
+				return
+			case <-ticker.C:
+				if *containerID != "" && !isNetNS(NetNSPath(*containerID)) {
+					closer.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	if err := serve(); err != nil && !errors.Is(err, net.ErrClosed) {
+		fmt.Fprintf(os.Stderr, "proxy %s: %v\n", *listen, err)
+		return 1
+	}
+	return 0
+}
+
+// proxyTCP forwards each connection ln accepts to target, each way until
+// that side closes.
+func proxyTCP(ln net.Listener, proto, target string) error {
+	for {
+		client, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer client.Close()
+			backend, err := net.DialTimeout(proto, target, proxyDialTimeout)
+			if err != nil {
+				return
+			}
+			defer backend.Close()
+
+			var wg sync.WaitGroup
+			pipe := func(dst, src net.Conn) {
+				defer wg.Done()
+				io.Copy(dst, src)
+				if conn, ok := dst.(*net.TCPConn); ok {
+					conn.CloseWrite()
+				}
+			}
+			wg.Add(2)
+			go pipe(backend, client)
+			go pipe(client, backend)
+			wg.Wait()
+		}()
+	}
+}
+
+// proxyUDP forwards the datagrams conn receives to target, each client
+// from a socket of its own, and the replies back to the client, until
+// the client is quiet for proxyUDPTimeout.
+func proxyUDP(conn net.PacketConn, proto, target string) error {
+	targetAddr, err := net.ResolveUDPAddr(proto, target)
+	if err != nil {
+		return err
+	}
+	var mu sync.Mutex
+	clients := make(map[string]*net.UDPConn)
+	buf := make([]byte, 65535)
+	for {
+		n, client, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		backend, ok := clients[client.String()]
+		if !ok {
+			backend, err = net.DialUDP(proto, nil, targetAddr)
+			if err != nil {
+				mu.Unlock()
+				continue
+			}
+			clients[client.String()] = backend
+			go func(client net.Addr, backend *net.UDPConn) {
+				defer func() {
+					mu.Lock()
+					delete(clients, client.String())
+					mu.Unlock()
+					backend.Close()
+				}()
+				reply := make([]byte, 65535)
+				for {
+					backend.SetReadDeadline(time.Now().Add(proxyUDPTimeout))
+					n, err := backend.Read(reply)
+					if err != nil {
+						return
+					}
+					conn.WriteTo(reply[:n], client)
+				}
+			}(client, backend)
+		}
+		mu.Unlock()
+		backend.Write(buf[:n])
+	}
+}
@@ -0,0 +1,288 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// ResolverAddress is where a container finds its DNS server: an address
+// of the loopback interface of its own network namespace.
+const ResolverAddress = "127.0.0.11"
+
+// DefaultUpstreams are where names are forwarded when neither the
+// container nor the host has resolvers.
+var DefaultUpstreams = []string{"8.8.8.8", "8.8.4.4"}
+
+var hostResolvConf = "/etc/resolv.conf"
+
+const (
+	upstreamTimeout = 2 * time.Second
+
+	// Answers of upstream resolvers are cached for their TTL, up to
+	// maxCacheTTL; names that don't exist for negativeCacheTTL
+	maxCacheTTL      = 5 * time.Minute
+	negativeCacheTTL = 30 * time.Second
+	maxCacheEntries  = 4096
+)
+
+// resolver is the DNS server of a container.
+type resolver struct {
+	servers []*dns.Server
+	conn    net.PacketConn
+	ln      net.Listener
+}
+
+func (r *resolver) stop() {
+	for _, server := range r.servers {
+		server.Shutdown()
+	}
+	// Shutting down a server that isn't serving yet leaves its socket open
+	r.conn.Close()
+	r.ln.Close()
+}
+
+// StartResolver starts the DNS server of a container on ResolverAddress in
+// its network namespace netns. Names that are not its peers' are forwarded
+// to upstreams, or to the host's resolvers when there are none. The
+// forwarding happens from the host's namespace, so containers without a
+// way out can resolve too.
+func (dm *DNSManager) StartResolver(containerID, netns string, upstreams []string) error {
+	if len(upstreams) == 0 {
+		upstreams, _, _ = HostDNS()
+	}
+
+	r := &resolver{}
+	err := EnterNetNS(netns, func() error {
+		var err error
+		address := net.JoinHostPort(ResolverAddress, "53")
+		if r.conn, err = net.ListenPacket("udp", address); err != nil {
+			return err
+		}
+		if r.ln, err = net.Listen("tcp", address); err != nil {
+			r.conn.Close()
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to listen for DNS queries of container %s: %v", containerID, err)
+	}
+
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+		dm.handleDNSRequest(containerID, upstreams, w, m)
+	})
+	r.servers = []*dns.Server{
+		{PacketConn: r.conn, Handler: handler},
+		{Listener: r.ln, Handler: handler},
+	}
+	for _, server := range r.servers {
+		go func(server *dns.Server) {
+			if err := server.ActivateAndServe(); err != nil {
+				logrus.Debugf("DNS server of container %s stopped: %v", containerID, err)
+			}
+		}(server)
+	}
+
+	dm.mu.Lock()
+	previous := dm.resolvers[containerID]
+	dm.resolvers[containerID] = r
+	dm.mu.Unlock()
+	if previous != nil {
+		previous.stop()
+	}
+	logrus.Debugf("Started DNS server of container %s, forwarding to %s", containerID, strings.Join(upstreams, ", "))
+	return nil
+}
+
+// StopResolver stops the DNS server of a container and forgets its links.
+func (dm *DNSManager) StopResolver(containerID string) {
+	dm.mu.Lock()
+	r := dm.resolvers[containerID]
+	delete(dm.resolvers, containerID)
+	delete(dm.links, containerID)
+	dm.mu.Unlock()
+	if r != nil {
+		r.stop()
+	}
+}
+
+// forward asks upstreams in turn, answering from the cache when it can.
+// A truncated answer is asked again over TCP.
+func (dm *DNSManager) forward(r *dns.Msg, upstreams []string) *dns.Msg {
+	q := r.Question[0]
+	key := fmt.Sprintf("%s/%d/%d/%s", strings.ToLower(q.Name), q.Qtype, q.Qclass, strings.Join(upstreams, ","))
+	if cached := dm.cache.get(key); cached != nil {
+		cached.Id = r.Id
+		return cached
+	}
+
+	var lastErr error
+	for _, upstream := range upstreams {
+		if _, _, err := net.SplitHostPort(upstream); err != nil {
+			upstream = net.JoinHostPort(upstream, "53")
+		}
+		client := &dns.Client{Net: "udp", Timeout: upstreamTimeout}
+		answer, _, err := client.Exchange(r.Copy(), upstream)
+		if err == nil && answer.Truncated {
+			client.Net = "tcp"
+			answer, _, err = client.Exchange(r.Copy(), upstream)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		dm.cache.put(key, answer)
+		return answer
+	}
+
+	logrus.Debugf("Failed to forward DNS query %s: %v", q.Name, lastErr)
+	failed := new(dns.Msg)
+	failed.SetRcode(r, dns.RcodeServerFailure)
+	failed.RecursionAvailable = true
+	return failed
+}
+
+// dnsCache holds the answers of upstream resolvers.
+type dnsCache struct {
+	entries map[string]cacheEntry
+	mu      sync.Mutex
+}
+
+type cacheEntry struct {
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+}
+
+func newDNSCache() *dnsCache {
+	return &dnsCache{entries: make(map[string]cacheEntry)}
+}
+
+// get returns a copy of the answer cached for key, with its TTLs reduced
+// by the time it spent in the cache.
+func (c *dnsCache) get(key string) *dns.Msg {
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if ok && !time.Now().Before(entry.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	msg := entry.msg.Copy()
+	elapsed := uint32(time.Since(entry.stored) / time.Second)
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if header := rr.Header(); header.Rrtype != dns.TypeOPT {
+				if header.Ttl > elapsed {
+					header.Ttl -= elapsed
+				} else {
+					header.Ttl = 0
+				}
+			}
+		}
+	}
+	return msg
+}
+
+// put caches answers that found the name, for the lowest TTL of their
+// records, and answers that it doesn't exist. Failures are not cached.
+func (c *dnsCache) put(key string, msg *dns.Msg) {
+	var ttl time.Duration
+	switch {
+	case msg.Rcode == dns.RcodeNameError || msg.Rcode == dns.RcodeSuccess && len(msg.Answer) == 0:
+		ttl = negativeCacheTTL
+	case msg.Rcode == dns.RcodeSuccess:
+		ttl = maxCacheTTL
+		for _, rr := range msg.Answer {
+			if recordTTL := time.Duration(rr.Header().Ttl) * time.Second; recordTTL < ttl {
+				ttl = recordTTL
+			}
+		}
+	}
+	if ttl <= 0 || msg.Truncated {
+		return
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxCacheEntries {
+		for k, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		// Still full: make room at random
+		for k := range c.entries {
+			if len(c.entries) < maxCacheEntries {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = cacheEntry{msg: msg.Copy(), stored: now, expires: now.Add(ttl)}
+}
+
+// HostDNS returns the nameservers, search domains and options of the
+// host's resolv.conf. The nameservers are DefaultUpstreams when it lists
+// none.
+func HostDNS() (nameservers, search, options []string) {
+	data, err := os.ReadFile(hostResolvConf)
+	if err != nil {
+		logrus.Debugf("Failed to read host resolv.conf: %v", err)
+	}
+	var domain []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			nameservers = append(nameservers, fields[1])
+		case "search":
+			search = fields[1:]
+		case "domain":
+			domain = fields[1:2]
+		case "options":
+			options = append(options, fields[1:]...)
+		}
+	}
+	if search == nil {
+		search = domain
+	}
+	if len(nameservers) == 0 {
+		nameservers = DefaultUpstreams
+	}
+	return nameservers, search, options
+}
+
+// ResolvConf renders the resolv.conf of a container.
+func ResolvConf(nameservers, search, options []string) []byte {
+	var b bytes.Buffer
+	b.WriteString("# Generated by mydocker\n")
+	for _, nameserver := range nameservers {
+		fmt.Fprintf(&b, "nameserver %s\n", nameserver)
+	}
+	if len(search) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(search, " "))
+	}
+	if len(options) > 0 {
+		fmt.Fprintf(&b, "options %s\n", strings.Join(options, " "))
+	}
+	return b.Bytes()
+}
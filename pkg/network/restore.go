@@ -0,0 +1,112 @@
+package network
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// restoreNetworks reconciles the recorded user-defined networks with the
+// host, e.g. after a reboot or a crash of the process that changed them.
+// Endpoints of containers whose network namespace is gone are detached,
+// releasing their addresses and rules, and networks whose devices are
+// missing are set up again. Rules of networks and containers that no
+// longer exist are removed.
+func (m *Manager) restoreNetworks() {
+	alive := func(containerID string) bool {
+		return isNetNS(NetNSPath(containerID))
+	}
+
+	var released, restored []string
+	err := m.userNetworks.update(func(networks map[string]*Network) error {
+		var detached []string
+		for _, network := range networks {
+			for id, endpoint := range network.Containers {
+				if !alive(id) {
+					m.detachEndpoint(network, id, endpoint)
+					detached = append(detached, id)
+					released = append(released, endpoint.ContainerName+" on "+network.Name)
+				}
+			}
+			if addresses, err := m.ipam.ReleaseStale(network.ID, alive); err != nil {
+				logrus.Warnf("Failed to release stale addresses of network %s: %v", network.Name, err)
+			} else if len(addresses) > 0 {
+				logrus.Infof("Released %d stale addresses of network %s", len(addresses), network.Name)
+			}
+		}
+		for _, id := range detached {
+			m.refreshPolicies(networks, id)
+		}
+
+		for _, network := range networks {
+			if networkDevicesExist(network) {
+				continue
+			}
+			if err := m.setupNetwork(network); err != nil {
+				logrus.Warnf("Failed to restore network %s: %v", network.Name, err)
+				continue
+			}
+			restored = append(restored, network.Name)
+		}
+
+		// Under the lock, so rules of a network being created aren't taken
+		// for stale ones
+		m.releaseStaleRules(networks, alive)
+		return nil
+	})
+	if err != nil {
+		logrus.Warnf("Failed to restore networks: %v", err)
+		return
+	}
+
+	if len(released) > 0 {
+		sort.Strings(released)
+		logrus.Infof("Released stale endpoints of containers %s", strings.Join(released, ", "))
+	}
+	if len(restored) > 0 {
+		sort.Strings(restored)
+		logrus.Infof("Restored networks %s", strings.Join(restored, ", "))
+	}
+}
+
+// networkDevicesExist reports whether the devices of a network are on the
+// host. Macvlan and ipvlan networks have none of their own.
+func networkDevicesExist(network *Network) bool {
+	switch {
+	case isSubinterfaceDriver(network.Driver):
+		return true
+	case network.Driver == OverlayDriver:
+		return linkExists(network.bridgeName()) && linkExists(network.vxlanName())
+	default:
+		return linkExists(network.bridgeName())
+	}
+}
+
+// releaseStaleRules removes the rules of networks that aren't among
+// networks or the default bridge, and those of containers that aren't
+// alive.
+func (m *Manager) releaseStaleRules(networks map[string]*Network, alive func(containerID string) bool) {
+	names := map[string]bool{bridgeNetwork: true}
+	for _, network := range networks {
+		names[network.Name] = true
+	}
+	stale := func(rule Rule) bool {
+		return !names[rule.Network] || rule.ContainerID != "" && !alive(rule.ContainerID)
+	}
+
+	var count int
+	for _, rule := range m.rules.List("", "") {
+		if stale(rule) {
+			count++
+		}
+	}
+	if count == 0 {
+		return
+	}
+	if err := m.rules.Remove(stale); err != nil {
+		logrus.Warnf("Failed to remove stale rules: %v", err)
+		return
+	}
+	logrus.Infof("Removed %d stale rules", count)
+}
@@ -0,0 +1,419 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"docker-impl/pkg/ids"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultStateDir is where the network state of the host is kept
+	DefaultStateDir = "/var/lib/mydocker/network"
+	// RulesFile lists the iptables rules installed on the host
+	RulesFile = "rules.json"
+
+	// ruleCommentPrefix starts the comment every installed rule carries,
+	// which ties the live rule back to its record
+	ruleCommentPrefix = "mydocker:"
+
+	// chainPrefix names the chains rules are installed in: a rule of
+	// FORWARD goes in MYDOCKER-FORWARD, which FORWARD jumps to, so
+	// mydocker's rules can be removed without touching anyone else's
+	chainPrefix = "MYDOCKER-"
+	// jumpComment is the comment of the jumps to mydocker's chains
+	jumpComment = "mydocker"
+)
+
+// ruleComment matches the comment of an installed rule in iptables -S
+// output: mydocker:<rule ID>:<network>[:<container ID>]
+var ruleComment = regexp.MustCompile(`mydocker:([0-9a-f]+):([^:"\s]*)(?::([0-9a-f]+))?`)
+
+// Rule is an iptables rule installed for a network, or for one container
+// on it when ContainerID is set.
+type Rule struct {
+	ID     string `json:"id"`
+	Binary string `json:"binary"`
+	Table  string `json:"table"`
+	// Chain is the built-in chain the rule applies to; the rule itself is
+	// installed in mydocker's chain for it
+	Chain string `json:"chain"`
+	// Subchain, when set, puts the rule in a chain of its own instead,
+	// MYDOCKER-<Subchain>, which is only reached through the rules of
+	// Chain that jump to it, e.g. the policy chain of a network
+	Subchain    string   `json:"subchain,omitempty"`
+	Args        []string `json:"args"`
+	Network     string   `json:"network"`
+	ContainerID string   `json:"container_id,omitempty"`
+	// Purpose says what the rule is for, e.g. masquerade or port
+	Purpose string `json:"purpose"`
+	// Insert puts the rule at the top of its chain instead of the end,
+	// for rules that must win over those appended, e.g. isolation
+	Insert bool `json:"insert,omitempty"`
+}
+
+func (r Rule) comment() string {
+	comment := ruleCommentPrefix + r.ID + ":" + r.Network
+	if r.ContainerID != "" {
+		comment += ":" + r.ContainerID
+	}
+	return comment
+}
+
+// command returns the arguments that run action (-A, -I, -D or -C) on
+// the rule, including its comment.
+func (r Rule) command(action string) []string {
+	args := []string{"-t", r.Table, action, r.chain()}
+	args = append(args, r.Args...)
+	return append(args, "-m", "comment", "--comment", r.comment())
+}
+
+// chain is the chain the rule is installed in.
+func (r Rule) chain() string {
+	if r.Subchain != "" {
+		return chainPrefix + r.Subchain
+	}
+	return chainPrefix + r.Chain
+}
+
+// addAction is how the rule is added to its chain.
+func (r Rule) addAction() string {
+	if r.Insert {
+		return "-I"
+	}
+	return "-A"
+}
+
+// String is the rule as it would be added, without its comment.
+func (r Rule) String() string {
+	return strings.Join(append([]string{r.Binary, "-t", r.Table, r.addAction(), r.chain()}, r.Args...), " ")
+}
+
+func (r Rule) sameAs(other Rule) bool {
+	return r.sameChain(other) && r.Network == other.Network && r.ContainerID == other.ContainerID &&
+		strings.Join(r.Args, "\x00") == strings.Join(other.Args, "\x00")
+}
+
+func (r Rule) sameChain(other Rule) bool {
+	return r.Binary == other.Binary && r.Table == other.Table && r.Chain == other.Chain && r.Subchain == other.Subchain
+}
+
+// jump returns the arguments that run action (-I, -D or -C) on the jump
+// from the rule's built-in chain to mydocker's. The jump goes first, so
+// mydocker's rules are seen before the host's.
+func (r Rule) jump(action string) []string {
+	return []string{"-t", r.Table, action, r.Chain, "-j", r.chain(), "-m", "comment", "--comment", jumpComment}
+}
+
+// ensureChain creates mydocker's chain for the rule and the jump to it,
+// unless they are there already. The jumps to a subchain are rules of
+// their own.
+func ensureChain(rule Rule) error {
+	if exec.Command(rule.Binary, "-t", rule.Table, "-n", "-L", rule.chain()).Run() != nil {
+		output, err := exec.Command(rule.Binary, "-t", rule.Table, "-N", rule.chain()).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed to create chain %s: %v: %s", rule.chain(), err, strings.TrimSpace(string(output)))
+		}
+	}
+	if rule.Subchain != "" {
+		return nil
+	}
+	if exec.Command(rule.Binary, rule.jump("-C")...).Run() == nil {
+		return nil
+	}
+	output, err := exec.Command(rule.Binary, rule.jump("-I")...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to add jump from %s to %s: %v: %s", rule.Chain, rule.chain(), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// removeChain deletes mydocker's chain for the rule and the jump to it,
+// along with whatever is left in the chain. A subchain that is still
+// jumped to is only emptied.
+func removeChain(rule Rule) {
+	commands := [][]string{
+		{"-t", rule.Table, "-F", rule.chain()},
+		{"-t", rule.Table, "-X", rule.chain()},
+	}
+	if rule.Subchain == "" {
+		commands = append([][]string{rule.jump("-D")}, commands...)
+	}
+	for _, args := range commands {
+		if output, err := exec.Command(rule.Binary, args...).CombinedOutput(); err != nil {
+			logrus.Debugf("Failed to remove chain %s: %v: %s", rule.chain(), err, strings.TrimSpace(string(output)))
+		}
+	}
+}
+
+// RuleStore installs iptables rules and records them in a file, so the
+// rules mydocker put on the host can be listed, checked and removed
+// exactly, by this process or a later one.
+type RuleStore struct {
+	path  string
+	rules []Rule
+	mu    sync.Mutex
+}
+
+// LoadRuleStore reads the rules recorded in dir. An empty dir keeps them
+// in memory only.
+func LoadRuleStore(dir string) (*RuleStore, error) {
+	s := &RuleStore{}
+	if dir == "" {
+		return s, nil
+	}
+	s.path = filepath.Join(dir, RulesFile)
+
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read network rules: %v", err)
+	}
+	if err := json.Unmarshal(data, &s.rules); err != nil {
+		return nil, fmt.Errorf("failed to parse network rules: %v", err)
+	}
+	return s, nil
+}
+
+// save must be called with mu held.
+func (s *RuleStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("failed to create network state directory: %v", err)
+	}
+	data, err := json.MarshalIndent(s.rules, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal network rules: %v", err)
+	}
+	if err := os.WriteFile(s.path, data, 0644); err != nil {
+		return fmt.Errorf("failed to save network rules: %v", err)
+	}
+	return nil
+}
+
+// Install adds the rule to its chain and records it. A rule that is
+// already recorded is only added again if it went missing, e.g. after a
+// reboot, so setting up a network twice doesn't duplicate its rules.
+func (s *RuleStore) Install(rule Rule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := ensureChain(rule); err != nil {
+		return err
+	}
+
+	for _, existing := range s.rules {
+		if existing.sameAs(rule) {
+			if exec.Command(existing.Binary, existing.command("-C")...).Run() == nil {
+				return nil
+			}
+			rule.ID = existing.ID
+			break
+		}
+	}
+
+	recorded := rule.ID != ""
+	if !recorded {
+		rule.ID = ids.TruncateID(ids.GenerateID())
+	}
+	output, err := exec.Command(rule.Binary, rule.command(rule.addAction())...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to add rule %q: %v: %s", rule.String(), err, strings.TrimSpace(string(output)))
+	}
+	if recorded {
+		return nil
+	}
+	s.rules = append(s.rules, rule)
+	return s.save()
+}
+
+// Remove deletes every recorded rule that matches from the kernel and the
+// record. Rules that are already gone are just forgotten. Chains left
+// without rules are removed along with their jumps.
+func (s *RuleStore) Remove(match func(Rule) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var kept, removed []Rule
+	for _, rule := range s.rules {
+		if !match(rule) {
+			kept = append(kept, rule)
+			continue
+		}
+		if output, err := exec.Command(rule.Binary, rule.command("-D")...).CombinedOutput(); err != nil {
+			logrus.Warnf("Failed to remove rule %q: %v: %s", rule.String(), err, strings.TrimSpace(string(output)))
+		}
+		removed = append(removed, rule)
+	}
+	s.rules = kept
+
+	for i, rule := range removed {
+		if chainUsed(kept, rule) || chainUsed(removed[:i], rule) {
+			continue
+		}
+		removeChain(rule)
+	}
+	return s.save()
+}
+
+// chainUsed reports whether any of rules is installed in the chain of rule.
+func chainUsed(rules []Rule, rule Rule) bool {
+	for _, other := range rules {
+		if other.sameChain(rule) {
+			return true
+		}
+	}
+	return false
+}
+
+// List returns the recorded rules of a network and of a container, either
+// of which may be empty to match all.
+func (s *RuleStore) List(network, containerID string) []Rule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var rules []Rule
+	for _, rule := range s.rules {
+		if (network == "" || rule.Network == network) && (containerID == "" || rule.ContainerID == containerID) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// LiveRule is a rule found in the kernel.
+type LiveRule struct {
+	ID          string `json:"id"`
+	Binary      string `json:"binary"`
+	Table       string `json:"table"`
+	Network     string `json:"network"`
+	ContainerID string `json:"container_id,omitempty"`
+	// Spec is the rule as iptables -S prints it
+	Spec string `json:"spec"`
+}
+
+// RuleDiff compares the recorded rules with the kernel. Missing rules are
+// recorded but not installed; Stale ones carry mydocker's comment but
+// aren't recorded, e.g. left behind by a crash.
+type RuleDiff struct {
+	Missing []Rule     `json:"missing"`
+	Stale   []LiveRule `json:"stale"`
+}
+
+// InSync reports whether the kernel has exactly the recorded rules.
+func (d *RuleDiff) InSync() bool {
+	return len(d.Missing) == 0 && len(d.Stale) == 0
+}
+
+// ruleTables are the tables rules are installed in, which Verify reads.
+var ruleTables = []string{"nat", "filter"}
+
+// Verify compares the recorded rules of a network and container with the
+// rules in the kernel.
+func (s *RuleStore) Verify(network, containerID string) (*RuleDiff, error) {
+	rules := s.List(network, containerID)
+
+	binaries := map[string]bool{"iptables": true}
+	for _, rule := range rules {
+		binaries[rule.Binary] = true
+	}
+	live := make(map[string]LiveRule)
+	// jumped holds the chains jumped to, without which their rules don't
+	// apply
+	jumped := make(map[string]bool)
+	for binary := range binaries {
+		for _, table := range ruleTables {
+			output, err := exec.Command(binary, "-t", table, "-S").CombinedOutput()
+			if err != nil {
+				// ip6tables may be unavailable on hosts without IPv6
+				if binary != "iptables" {
+					logrus.Warnf("Failed to read %s %s table: %v", binary, table, err)
+					continue
+				}
+				return nil, fmt.Errorf("failed to read %s %s table: %v: %s", binary, table, err, strings.TrimSpace(string(output)))
+			}
+			for _, rule := range parseLiveRules(binary, table, string(output)) {
+				live[rule.ID] = rule
+			}
+			for _, chain := range parseJumps(string(output)) {
+				jumped[binary+" "+table+" "+chain] = true
+			}
+		}
+	}
+
+	diff := &RuleDiff{Missing: []Rule{}, Stale: []LiveRule{}}
+	recorded := make(map[string]bool)
+	for _, rule := range s.List("", "") {
+		recorded[rule.ID] = true
+	}
+	for _, rule := range rules {
+		if _, ok := live[rule.ID]; !ok || !jumped[rule.Binary+" "+rule.Table+" "+rule.chain()] {
+			diff.Missing = append(diff.Missing, rule)
+		}
+	}
+	for id, rule := range live {
+		if recorded[id] {
+			continue
+		}
+		if (network == "" || rule.Network == network) && (containerID == "" || rule.ContainerID == containerID) {
+			diff.Stale = append(diff.Stale, rule)
+		}
+	}
+	sort.Slice(diff.Stale, func(i, j int) bool { return diff.Stale[i].Spec < diff.Stale[j].Spec })
+	return diff, nil
+}
+
+// parseLiveRules picks the rules carrying mydocker's comment out of
+// iptables -S output.
+func parseLiveRules(binary, table, output string) []LiveRule {
+	var rules []LiveRule
+	for _, line := range strings.Split(output, "\n") {
+		if !strings.HasPrefix(line, "-A ") {
+			continue
+		}
+		match := ruleComment.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		rules = append(rules, LiveRule{
+			ID:          match[1],
+			Binary:      binary,
+			Table:       table,
+			Network:     match[2],
+			ContainerID: match[3],
+			Spec:        line,
+		})
+	}
+	return rules
+}
+
+// parseJumps returns the chains of mydocker that other chains jump to in
+// iptables -S output: built-in chains to mydocker's, and those to the
+// subchains.
+func parseJumps(output string) []string {
+	var chains []string
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[0] != "-A" {
+			continue
+		}
+		for i := 2; i < len(fields)-1; i++ {
+			if fields[i] == "-j" && strings.HasPrefix(fields[i+1], chainPrefix) {
+				chains = append(chains, fields[i+1])
+			}
+		}
+	}
+	return chains
+}
@@ -0,0 +1,380 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"docker-impl/pkg/ids"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultServiceTTL is how long a service registration lives unless it
+	// is renewed by registering again
+	DefaultServiceTTL = 60 * time.Second
+
+	// serviceTTL is how long answers about services may be cached; short,
+	// so clients soon stop using instances that turn unhealthy
+	serviceTTL = 5
+)
+
+// validServiceName matches the names services may have: a DNS label, so
+// _name._proto.mydocker.local is a name RFC 2782 would give them.
+var validServiceName = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// ServiceDiscovery keeps the instances of services: the containers that
+// registered to serve one on a port. The DNS servers of containers answer
+// SRV and TXT queries about _name._proto.mydocker.local from it, and A and
+// AAAA queries about a service's name with its healthy instances in turn.
+// A registration expires unless it is renewed within its TTL.
+type ServiceDiscovery struct {
+	dnsManager *DNSManager
+	// services holds the instances by serviceKey
+	services map[string]*ServiceRecord
+	// next is where the next answer about a service starts
+	next map[string]int
+	mu   sync.Mutex
+}
+
+// ServiceRecord is an instance of a service.
+type ServiceRecord struct {
+	Name        string
+	ContainerID string
+	Address     string
+	Port        int
+	Protocol    string
+	Metadata    map[string]string
+	Healthy     bool
+	// Timestamp is when the instance was last registered or renewed, and
+	// Expires when it goes unless it is renewed again
+	Timestamp time.Time
+	Expires   time.Time
+}
+
+func serviceKey(name, protocol string, port int, containerID string) string {
+	return fmt.Sprintf("%s/%s/%d/%s", name, protocol, port, containerID)
+}
+
+// target is the name the SRV records of an instance point at.
+func (r *ServiceRecord) target() string {
+	return dns.Fqdn(ids.TruncateID(r.ContainerID) + "." + localDomain)
+}
+
+// txt is the TXT record of an instance: which one it is, its port and its
+// metadata, as key=value strings. Pairs too long for a string are left out.
+func (r *ServiceRecord) txt() []string {
+	txt := []string{"instance=" + ids.TruncateID(r.ContainerID), fmt.Sprintf("port=%d", r.Port)}
+	keys := make([]string, 0, len(r.Metadata))
+	for key := range r.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if pair := key + "=" + r.Metadata[key]; len(pair) <= 255 {
+			txt = append(txt, pair)
+		}
+	}
+	return txt
+}
+
+// NewServiceDiscovery makes the services it keeps resolvable through
+// dnsManager, which may be nil.
+func NewServiceDiscovery(dnsManager *DNSManager) *ServiceDiscovery {
+	sd := &ServiceDiscovery{
+		dnsManager: dnsManager,
+		services:   make(map[string]*ServiceRecord),
+		next:       make(map[string]int),
+	}
+	if dnsManager != nil {
+		dnsManager.mu.Lock()
+		dnsManager.services = sd
+		dnsManager.mu.Unlock()
+	}
+	return sd
+}
+
+// validateService checks the name, protocol and port of a service.
+func validateService(serviceName, protocol string, port int) error {
+	if !validServiceName.MatchString(serviceName) {
+		return fmt.Errorf("invalid service name %q: only letters, digits and inner dashes are allowed", serviceName)
+	}
+	if protocol != "tcp" && protocol != "udp" {
+		return fmt.Errorf("invalid protocol %q of service %s (valid: tcp, udp)", protocol, serviceName)
+	}
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("invalid port %d of service %s", port, serviceName)
+	}
+	return nil
+}
+
+// RegisterService registers containerID, at containerIP, as an instance of
+// serviceName on port over protocol, tcp unless given, for ttl, or
+// DefaultServiceTTL when it is 0. Registering an instance again renews it
+// and replaces its address and metadata but keeps its health; new
+// instances are healthy.
+func (sd *ServiceDiscovery) RegisterService(serviceName, containerID, containerIP string, port int, protocol string, metadata map[string]string, ttl time.Duration) error {
+	serviceName, protocol = strings.ToLower(serviceName), strings.ToLower(protocol)
+	if protocol == "" {
+		protocol = "tcp"
+	}
+	if err := validateService(serviceName, protocol, port); err != nil {
+		return err
+	}
+	if containerID == "" {
+		return fmt.Errorf("an instance of service %s needs a container", serviceName)
+	}
+	if net.ParseIP(containerIP) == nil {
+		return fmt.Errorf("invalid address %q of service %s", containerIP, serviceName)
+	}
+	if ttl <= 0 {
+		ttl = DefaultServiceTTL
+	}
+
+	now := time.Now()
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	key := serviceKey(serviceName, protocol, port, containerID)
+	record, renewed := sd.services[key]
+	if !renewed {
+		record = &ServiceRecord{
+			Name:        serviceName,
+			ContainerID: containerID,
+			Port:        port,
+			Protocol:    protocol,
+			Healthy:     true,
+		}
+		sd.services[key] = record
+	}
+	record.Address = containerIP
+	record.Metadata = metadata
+	record.Timestamp = now
+	record.Expires = now.Add(ttl)
+
+	if renewed {
+		logrus.Debugf("Renewed service %s instance %s for %v", serviceName, ids.TruncateID(containerID), ttl)
+	} else {
+		logrus.Infof("Registered service: %s -> %s:%d (%s)", serviceName, containerIP, port, protocol)
+	}
+	return nil
+}
+
+// UnregisterService removes the instance of serviceName that containerID
+// registered on port over protocol.
+func (sd *ServiceDiscovery) UnregisterService(serviceName, containerID, protocol string, port int) error {
+	serviceName, protocol = strings.ToLower(serviceName), strings.ToLower(protocol)
+	if protocol == "" {
+		protocol = "tcp"
+	}
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	key := serviceKey(serviceName, protocol, port, containerID)
+	if _, ok := sd.services[key]; !ok {
+		return fmt.Errorf("container %s is no instance of service %s on %d/%s", ids.TruncateID(containerID), serviceName, port, protocol)
+	}
+	delete(sd.services, key)
+
+	logrus.Infof("Unregistered service: %s (%s:%d) of container %s", serviceName, protocol, port, ids.TruncateID(containerID))
+	return nil
+}
+
+// UnregisterContainer removes every instance containerID registered.
+func (sd *ServiceDiscovery) UnregisterContainer(containerID string) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	for key, record := range sd.services {
+		if record.ContainerID == containerID {
+			delete(sd.services, key)
+			logrus.Infof("Unregistered service: %s (%s:%d) of container %s", record.Name, record.Protocol, record.Port, ids.TruncateID(containerID))
+		}
+	}
+}
+
+// SetHealth marks the instances containerID registered healthy or not;
+// only healthy instances are answered with.
+func (sd *ServiceDiscovery) SetHealth(containerID string, healthy bool) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	for _, record := range sd.services {
+		if record.ContainerID == containerID && record.Healthy != healthy {
+			record.Healthy = healthy
+			logrus.Infof("Service %s instance %s is now %s", record.Name, ids.TruncateID(containerID), healthString(healthy))
+		}
+	}
+}
+
+func healthString(healthy bool) string {
+	if healthy {
+		return "healthy"
+	}
+	return "unhealthy"
+}
+
+// expire removes the instances that were not renewed in time. It must be
+// called with mu held.
+func (sd *ServiceDiscovery) expire(now time.Time) {
+	for key, record := range sd.services {
+		if now.After(record.Expires) {
+			delete(sd.services, key)
+			logrus.Infof("Expired stale registration of service %s instance %s", record.Name, ids.TruncateID(record.ContainerID))
+		}
+	}
+}
+
+// list returns copies of the instances matched by match, sorted by
+// service, protocol, port and container. It must be called with mu held.
+func (sd *ServiceDiscovery) list(match func(record *ServiceRecord) bool) []ServiceRecord {
+	sd.expire(time.Now())
+	var records []ServiceRecord
+	for _, record := range sd.services {
+		if match(record) {
+			records = append(records, *record)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Protocol != b.Protocol {
+			return a.Protocol < b.Protocol
+		}
+		if a.Port != b.Port {
+			return a.Port < b.Port
+		}
+		return a.ContainerID < b.ContainerID
+	})
+	return records
+}
+
+// DiscoverService returns the instances of a service, healthy or not.
+func (sd *ServiceDiscovery) DiscoverService(serviceName string) ([]ServiceRecord, error) {
+	serviceName = strings.ToLower(serviceName)
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	return sd.list(func(record *ServiceRecord) bool {
+		return record.Name == serviceName
+	}), nil
+}
+
+// ListServices returns the instances of every service.
+func (sd *ServiceDiscovery) ListServices() []ServiceRecord {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	return sd.list(func(record *ServiceRecord) bool {
+		return true
+	})
+}
+
+// healthy returns the healthy instances of a service, over protocol unless
+// it is empty, starting one further each time it is asked, and reports
+// whether the service has instances at all.
+func (sd *ServiceDiscovery) healthy(serviceName, protocol string) ([]ServiceRecord, bool) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	found := false
+	instances := sd.list(func(record *ServiceRecord) bool {
+		if record.Name != serviceName || protocol != "" && record.Protocol != protocol {
+			return false
+		}
+		found = true
+		return record.Healthy
+	})
+	if len(instances) == 0 {
+		return nil, found
+	}
+
+	key := serviceName + "/" + protocol
+	start := sd.next[key] % len(instances)
+	sd.next[key] = start + 1
+	return append(instances[start:], instances[:start]...), true
+}
+
+// srvName splits a name of the form _service._proto, as RFC 2782 names
+// the servers of a service, and reports whether it was one.
+func srvName(name string) (serviceName, protocol string, ok bool) {
+	labels := strings.Split(name, ".")
+	if len(labels) != 2 || !strings.HasPrefix(labels[0], "_") || !strings.HasPrefix(labels[1], "_") {
+		return "", "", false
+	}
+	return labels[0][1:], labels[1][1:], true
+}
+
+// answerService answers questions about the services of ServiceDiscovery:
+// SRV and TXT ones about _service._proto.mydocker.local, with the glue
+// addresses of the SRV targets in extra, and A and AAAA ones about the
+// name of a service. Only healthy instances are answered with. It reports
+// false when the name is no service's, except in the containers' own
+// domain, where unknown services don't exist.
+func (dm *DNSManager) answerService(q dns.Question) (answer, extra []dns.RR, rcode int, ok bool) {
+	dm.mu.RLock()
+	sd := dm.services
+	dm.mu.RUnlock()
+	if sd == nil {
+		return nil, nil, 0, false
+	}
+
+	name, inDomain := localName(q.Name)
+	serviceName, protocol, isSRV := srvName(name)
+	if !isSRV {
+		if q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA {
+			return nil, nil, 0, false
+		}
+		serviceName = name
+	}
+	instances, found := sd.healthy(serviceName, protocol)
+	if !found {
+		// Nothing else is called _service._proto in the containers' domain
+		return nil, nil, dns.RcodeNameError, isSRV && inDomain
+	}
+
+	header := func(name string, rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: serviceTTL}
+	}
+	address := func(name string, ip net.IP) dns.RR {
+		if ip4 := ip.To4(); ip4 != nil {
+			return &dns.A{Hdr: header(name, dns.TypeA), A: ip4}
+		}
+		return &dns.AAAA{Hdr: header(name, dns.TypeAAAA), AAAA: ip}
+	}
+
+	seen := make(map[string]bool)
+	for i := range instances {
+		instance := &instances[i]
+		ip := net.ParseIP(instance.Address)
+		switch {
+		case isSRV && q.Qtype == dns.TypeSRV:
+			answer = append(answer, &dns.SRV{
+				Hdr:    header(q.Name, dns.TypeSRV),
+				Port:   uint16(instance.Port),
+				Target: instance.target(),
+			})
+			if !seen[instance.target()] {
+				seen[instance.target()] = true
+				extra = append(extra, address(instance.target(), ip))
+			}
+		case isSRV && q.Qtype == dns.TypeTXT:
+			answer = append(answer, &dns.TXT{Hdr: header(q.Name, dns.TypeTXT), Txt: instance.txt()})
+		case !isSRV && (ip.To4() != nil) == (q.Qtype == dns.TypeA):
+			// An instance serving on several ports is one address
+			if !seen[instance.Address] {
+				seen[instance.Address] = true
+				answer = append(answer, address(q.Name, ip))
+			}
+		}
+	}
+	return answer, extra, dns.RcodeSuccess, true
+}
@@ -0,0 +1,320 @@
+package network
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	webContainer   = "aaaaaaaaaaaa0001"
+	web2Container  = "bbbbbbbbbbbb0002"
+	cacheContainer = "cccccccccccc0003"
+)
+
+// newTestServices registers two web instances, one of them serving on two
+// ports, and an IPv6 cache instance over udp.
+func newTestServices(t *testing.T) (*DNSManager, *ServiceDiscovery) {
+	dm := NewDNSManager(nil)
+	sd := NewServiceDiscovery(dm)
+	require.NoError(t, sd.RegisterService("web", webContainer, "10.0.0.2", 80, "", map[string]string{"version": "2", "path": "/"}, 0))
+	require.NoError(t, sd.RegisterService("web", webContainer, "10.0.0.2", 8080, "tcp", nil, 0))
+	require.NoError(t, sd.RegisterService("web", web2Container, "10.0.0.3", 80, "tcp", nil, 0))
+	require.NoError(t, sd.RegisterService("cache", cacheContainer, "fd00::3", 11211, "udp", nil, 0))
+	return dm, sd
+}
+
+func TestRegisterServiceValidation(t *testing.T) {
+	tests := []struct {
+		name        string
+		serviceName string
+		containerID string
+		address     string
+		port        int
+		protocol    string
+		err         bool
+	}{
+		{name: "valid", serviceName: "web", containerID: webContainer, address: "10.0.0.2", port: 80},
+		{name: "names are case insensitive", serviceName: "Web", containerID: webContainer, address: "10.0.0.2", port: 80, protocol: "TCP"},
+		{name: "IPv6 address", serviceName: "web", containerID: webContainer, address: "fd00::2", port: 80},
+		{name: "name with a dot", serviceName: "web.api", containerID: webContainer, address: "10.0.0.2", port: 80, err: true},
+		{name: "name with a trailing dash", serviceName: "web-", containerID: webContainer, address: "10.0.0.2", port: 80, err: true},
+		{name: "name with an underscore", serviceName: "_web", containerID: webContainer, address: "10.0.0.2", port: 80, err: true},
+		{name: "name too long", serviceName: strings.Repeat("a", 64), containerID: webContainer, address: "10.0.0.2", port: 80, err: true},
+		{name: "unknown protocol", serviceName: "web", containerID: webContainer, address: "10.0.0.2", port: 80, protocol: "sctp", err: true},
+		{name: "port zero", serviceName: "web", containerID: webContainer, address: "10.0.0.2", port: 0, err: true},
+		{name: "port out of range", serviceName: "web", containerID: webContainer, address: "10.0.0.2", port: 65536, err: true},
+		{name: "no container", serviceName: "web", address: "10.0.0.2", port: 80, err: true},
+		{name: "invalid address", serviceName: "web", containerID: webContainer, address: "10.0.0", port: 80, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sd := NewServiceDiscovery(nil)
+			err := sd.RegisterService(tt.serviceName, tt.containerID, tt.address, tt.port, tt.protocol, nil, 0)
+			if tt.err {
+				assert.Error(t, err)
+				assert.Empty(t, sd.ListServices())
+				return
+			}
+			require.NoError(t, err)
+			records, err := sd.DiscoverService(tt.serviceName)
+			require.NoError(t, err)
+			require.Len(t, records, 1)
+			assert.Equal(t, "web", records[0].Name)
+			assert.Equal(t, "tcp", records[0].Protocol)
+			assert.True(t, records[0].Healthy)
+		})
+	}
+}
+
+func TestSRVName(t *testing.T) {
+	tests := []struct {
+		name        string
+		serviceName string
+		protocol    string
+		ok          bool
+	}{
+		{name: "_web._tcp", serviceName: "web", protocol: "tcp", ok: true},
+		{name: "_cache._udp", serviceName: "cache", protocol: "udp", ok: true},
+		{name: "web._tcp"},
+		{name: "_web.tcp"},
+		{name: "_web"},
+		{name: "_a._b._c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serviceName, protocol, ok := srvName(tt.name)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.serviceName, serviceName)
+			assert.Equal(t, tt.protocol, protocol)
+		})
+	}
+}
+
+func TestAnswerService(t *testing.T) {
+	webTarget := "aaaaaaaaaaaa.mydocker.local."
+	web2Target := "bbbbbbbbbbbb.mydocker.local."
+	cacheTarget := "cccccccccccc.mydocker.local."
+
+	tests := []struct {
+		name  string
+		qname string
+		qtype uint16
+		// answer and extra are the records as text, ignoring the order
+		answer []string
+		extra  []string
+		rcode  int
+		ok     bool
+	}{
+		{
+			name:  "SRV records of a service",
+			qname: "_web._tcp.mydocker.local.",
+			qtype: dns.TypeSRV,
+			answer: []string{
+				"_web._tcp.mydocker.local.\t5\tIN\tSRV\t0 0 80 " + webTarget,
+				"_web._tcp.mydocker.local.\t5\tIN\tSRV\t0 0 8080 " + webTarget,
+				"_web._tcp.mydocker.local.\t5\tIN\tSRV\t0 0 80 " + web2Target,
+			},
+			extra: []string{
+				webTarget + "\t5\tIN\tA\t10.0.0.2",
+				web2Target + "\t5\tIN\tA\t10.0.0.3",
+			},
+			ok: true,
+		},
+		{
+			name:   "SRV records with IPv6 glue",
+			qname:  "_cache._udp.mydocker.local.",
+			qtype:  dns.TypeSRV,
+			answer: []string{"_cache._udp.mydocker.local.\t5\tIN\tSRV\t0 0 11211 " + cacheTarget},
+			extra:  []string{cacheTarget + "\t5\tIN\tAAAA\tfd00::3"},
+			ok:     true,
+		},
+		{
+			name:  "TXT records of a service",
+			qname: "_web._tcp.mydocker.local.",
+			qtype: dns.TypeTXT,
+			answer: []string{
+				"_web._tcp.mydocker.local.\t5\tIN\tTXT\t\"instance=aaaaaaaaaaaa\" \"port=80\" \"path=/\" \"version=2\"",
+				"_web._tcp.mydocker.local.\t5\tIN\tTXT\t\"instance=aaaaaaaaaaaa\" \"port=8080\"",
+				"_web._tcp.mydocker.local.\t5\tIN\tTXT\t\"instance=bbbbbbbbbbbb\" \"port=80\"",
+			},
+			ok: true,
+		},
+		{
+			name:  "SRV name outside the domain",
+			qname: "_web._tcp.",
+			qtype: dns.TypeSRV,
+			answer: []string{
+				"_web._tcp.\t5\tIN\tSRV\t0 0 80 " + webTarget,
+				"_web._tcp.\t5\tIN\tSRV\t0 0 8080 " + webTarget,
+				"_web._tcp.\t5\tIN\tSRV\t0 0 80 " + web2Target,
+			},
+			extra: []string{
+				webTarget + "\t5\tIN\tA\t10.0.0.2",
+				web2Target + "\t5\tIN\tA\t10.0.0.3",
+			},
+			ok: true,
+		},
+		{
+			name:  "A records of a service, one per instance",
+			qname: "web.mydocker.local.",
+			qtype: dns.TypeA,
+			answer: []string{
+				"web.mydocker.local.\t5\tIN\tA\t10.0.0.2",
+				"web.mydocker.local.\t5\tIN\tA\t10.0.0.3",
+			},
+			ok: true,
+		},
+		{
+			name:   "AAAA records of a service",
+			qname:  "cache.",
+			qtype:  dns.TypeAAAA,
+			answer: []string{"cache.\t5\tIN\tAAAA\tfd00::3"},
+			ok:     true,
+		},
+		{
+			name:  "no AAAA records of an IPv4 service",
+			qname: "web.",
+			qtype: dns.TypeAAAA,
+			ok:    true,
+		},
+		{
+			name:  "service over another protocol",
+			qname: "_web._udp.mydocker.local.",
+			qtype: dns.TypeSRV,
+			rcode: dns.RcodeNameError,
+			ok:    true,
+		},
+		{
+			name:  "unknown service in the domain",
+			qname: "_db._tcp.mydocker.local.",
+			qtype: dns.TypeSRV,
+			rcode: dns.RcodeNameError,
+			ok:    true,
+		},
+		{
+			name:  "unknown service outside the domain",
+			qname: "_db._tcp.",
+			qtype: dns.TypeSRV,
+			rcode: dns.RcodeNameError,
+		},
+		{
+			name:  "SRV name of another domain",
+			qname: "_web._tcp.example.com.",
+			qtype: dns.TypeSRV,
+		},
+		{
+			name:  "unknown name",
+			qname: "db.",
+			qtype: dns.TypeA,
+			rcode: dns.RcodeNameError,
+		},
+		{
+			name:  "MX query about a service",
+			qname: "web.",
+			qtype: dns.TypeMX,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dm, _ := newTestServices(t)
+			answer, extra, rcode, ok := dm.answerService(dns.Question{Name: tt.qname, Qtype: tt.qtype, Qclass: dns.ClassINET})
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.rcode, rcode)
+			assert.ElementsMatch(t, tt.answer, rrStrings(answer))
+			assert.ElementsMatch(t, tt.extra, rrStrings(extra))
+		})
+	}
+}
+
+func TestAnswerServiceInstances(t *testing.T) {
+	dm, sd := newTestServices(t)
+	query := func() []string {
+		answer, _, _, _ := dm.answerService(dns.Question{Name: "web.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+		return rrStrings(answer)
+	}
+
+	// Instances are answered with in turn
+	first, second := query(), query()
+	require.Len(t, first, 2)
+	assert.NotEqual(t, first[0], second[0], "Answers should start one instance further each time")
+	assert.ElementsMatch(t, first, second)
+
+	// Unhealthy instances are left out until they recover
+	sd.SetHealth(webContainer, false)
+	assert.Equal(t, []string{"web.\t5\tIN\tA\t10.0.0.3"}, query())
+	sd.SetHealth(web2Container, false)
+	answer, _, rcode, ok := dm.answerService(dns.Question{Name: "_web._tcp.mydocker.local.", Qtype: dns.TypeSRV, Qclass: dns.ClassINET})
+	assert.True(t, ok)
+	assert.Equal(t, dns.RcodeSuccess, rcode, "A service without healthy instances still exists")
+	assert.Empty(t, answer)
+	sd.SetHealth(webContainer, true)
+	assert.Equal(t, []string{"web.\t5\tIN\tA\t10.0.0.2"}, query())
+
+	// Renewing keeps the health
+	require.NoError(t, sd.RegisterService("web", web2Container, "10.0.0.4", 80, "tcp", nil, 0))
+	assert.Equal(t, []string{"web.\t5\tIN\tA\t10.0.0.2"}, query())
+
+	// Registrations that aren't renewed expire
+	sd.mu.Lock()
+	for _, record := range sd.services {
+		if record.ContainerID == webContainer {
+			record.Expires = time.Now().Add(-time.Second)
+		}
+	}
+	sd.mu.Unlock()
+	assert.Empty(t, query())
+	records, err := sd.DiscoverService("web")
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, web2Container, records[0].ContainerID)
+
+	// And unregistering removes them
+	sd.UnregisterContainer(web2Container)
+	_, _, rcode, _ = dm.answerService(dns.Question{Name: "_web._tcp.mydocker.local.", Qtype: dns.TypeSRV, Qclass: dns.ClassINET})
+	assert.Equal(t, dns.RcodeNameError, rcode)
+	assert.Error(t, sd.UnregisterService("cache", cacheContainer, "tcp", 11211), "The cache is served over udp")
+	assert.NoError(t, sd.UnregisterService("cache", cacheContainer, "udp", 11211))
+	assert.Empty(t, sd.ListServices())
+}
+
+func TestServiceRecordTXT(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata map[string]string
+		expected []string
+	}{
+		{
+			name:     "no metadata",
+			expected: []string{"instance=aaaaaaaaaaaa", "port=80"},
+		},
+		{
+			name:     "metadata sorted by key",
+			metadata: map[string]string{"zone": "b", "version": "2"},
+			expected: []string{"instance=aaaaaaaaaaaa", "port=80", "version=2", "zone=b"},
+		},
+		{
+			name:     "pair too long for a string",
+			metadata: map[string]string{"blob": strings.Repeat("x", 251), "zone": "b"},
+			expected: []string{"instance=aaaaaaaaaaaa", "port=80", "zone=b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record := ServiceRecord{ContainerID: webContainer, Port: 80, Metadata: tt.metadata}
+			assert.Equal(t, tt.expected, record.txt())
+		})
+	}
+}
+
+func rrStrings(rrs []dns.RR) []string {
+	var out []string
+	for _, rr := range rrs {
+		out = append(out, rr.String())
+	}
+	return out
+}
@@ -0,0 +1,69 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// stateFile is a JSON file of network state shared by every mydocker
+// process on the host. Changes hold its lock from reading it to writing
+// it back, so processes don't overwrite each other's.
+type stateFile struct {
+	path string
+	// what is written in errors, e.g. "networks"
+	what string
+}
+
+// lock takes the lock of the file until the returned function is called.
+func (f stateFile) lock() (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create network state directory: %v", err)
+	}
+	lock, err := os.OpenFile(f.path+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock %s: %v", f.what, err)
+	}
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("failed to lock %s: %v", f.what, err)
+	}
+	return func() {
+		unix.Flock(int(lock.Fd()), unix.LOCK_UN)
+		lock.Close()
+	}, nil
+}
+
+// read decodes the file into v, which is left alone if there is no file.
+func (f stateFile) read(v interface{}) error {
+	data, err := os.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", f.what, err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", f.what, err)
+	}
+	return nil
+}
+
+// write replaces the file with v at once, so readers never see half of it.
+func (f stateFile) write(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %v", f.what, err)
+	}
+	tmp := f.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to save %s: %v", f.what, err)
+	}
+	if err := os.Rename(tmp, f.path); err != nil {
+		return fmt.Errorf("failed to save %s: %v", f.what, err)
+	}
+	return nil
+}
@@ -168,7 +168,7 @@ func (c *ContainerCache) GetNetwork(containerID string) (interface{}, bool) {
 	return c.networks.Get(containerID)
 }
 
-func (c *NetworkCache) SetNetwork(containerID string, network interface{}) {
+func (c *ContainerCache) SetNetwork(containerID string, network interface{}) {
 	c.networks.Set(containerID, network)
 	logrus.Debugf("Cached network info for container: %s", containerID)
 }
@@ -189,12 +189,24 @@ func (c *ContainerCache) Clear() {
 	logrus.Info("Container cache cleared")
 }
 
+// PrefetchJob warms one item, such as the hot files of a lazily pulled
+// layer, before it is first used.
+type PrefetchJob struct {
+	Key   string
+	Fetch func() error
+}
+
 type PrefetchManager struct {
 	imageCache    *ImageCache
 	containerCache *ContainerCache
 	prefetchQueue chan string
+	jobQueue      chan PrefetchJob
+	pending       sync.WaitGroup
+	completed     int64
+	failed        int64
 	workers       int
 	stopChan      chan struct{}
+	mu            sync.Mutex
 }
 
 func NewPrefetchManager(workers int) *PrefetchManager {
@@ -202,6 +214,7 @@ func NewPrefetchManager(workers int) *PrefetchManager {
 		imageCache:    NewImageCache(),
 		containerCache: NewContainerCache(),
 		prefetchQueue: make(chan string, 100),
+		jobQueue:      make(chan PrefetchJob, 1000),
 		workers:       workers,
 		stopChan:      make(chan struct{}),
 	}
@@ -228,6 +241,44 @@ func (p *PrefetchManager) PrefetchImage(imageID string) {
 	}
 }
 
+// Prefetch queues a job for the workers. It returns false when the queue
+// is full; the item is then fetched when first used instead.
+func (p *PrefetchManager) Prefetch(job PrefetchJob) bool {
+	p.pending.Add(1)
+	select {
+	case p.jobQueue <- job:
+		logrus.Debugf("Queued prefetch of %s", job.Key)
+		return true
+	default:
+		p.pending.Done()
+		logrus.Warnf("Prefetch queue full, skipping prefetch of %s", job.Key)
+		return false
+	}
+}
+
+// Wait blocks until every queued job has run.
+func (p *PrefetchManager) Wait() {
+	p.pending.Wait()
+}
+
+func (p *PrefetchManager) runJob(id int, job PrefetchJob) {
+	defer p.pending.Done()
+
+	start := time.Now()
+	err := job.Fetch()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		p.failed++
+		logrus.Warnf("Worker %d failed to prefetch %s: %v", id, job.Key, err)
+		return
+	}
+	p.completed++
+	p.imageCache.SetLayer(job.Key, time.Since(start))
+	logrus.Debugf("Worker %d prefetched %s in %s", id, job.Key, time.Since(start))
+}
+
 func (p *PrefetchManager) prefetchWorker(id int) {
 	for {
 		select {
@@ -242,6 +293,9 @@ func (p *PrefetchManager) prefetchWorker(id int) {
 				"timestamp":   time.Now(),
 			})
 
+		case job := <-p.jobQueue:
+			p.runJob(id, job)
+
 		case <-p.stopChan:
 			logrus.Debugf("Prefetch worker %d stopped", id)
 			return
@@ -250,6 +304,10 @@ func (p *PrefetchManager) prefetchWorker(id int) {
 }
 
 func (p *PrefetchManager) GetCacheStats() map[string]interface{} {
+	p.mu.Lock()
+	completed, failed := p.completed, p.failed
+	p.mu.Unlock()
+
 	return map[string]interface{}{
 		"image_cache": map[string]interface{}{
 			"layers_hit_rate":    p.imageCache.GetHitRate(),
@@ -264,6 +322,9 @@ func (p *PrefetchManager) GetCacheStats() map[string]interface{} {
 		},
 		"prefetch_queue": map[string]interface{}{
 			"queue_length": len(p.prefetchQueue),
+			"jobs_queued":  len(p.jobQueue),
+			"jobs_done":    completed,
+			"jobs_failed":  failed,
 			"workers":      p.workers,
 		},
 	}
@@ -16,8 +16,8 @@ type MetricsCollector struct {
 	cpuUsage              *prometheus.GaugeVec
 	diskIO                *prometheus.CounterVec
 	networkIO             *prometheus.CounterVec
-	activeContainers      *prometheus.Gauge
-	activeImages          *prometheus.Gauge
+	activeContainers      prometheus.Gauge
+	activeImages          prometheus.Gauge
 	containerStartCounter *prometheus.CounterVec
 }
 
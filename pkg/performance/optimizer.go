@@ -151,7 +151,6 @@ func (o *Optimizer) OptimizeContainerStart(imageID string, startFunc func() erro
 	}
 
 	// Use worker pool for container start
-	var err error
 	workerErr := make(chan error, 1)
 
 	work := func() {
@@ -181,7 +180,7 @@ func (o *Optimizer) OptimizeImagePull(imageID string, pullFunc func() error) err
 	startTime := time.Now()
 
 	// Check cache first
-	if cachedConfig, found := o.imageCache.GetConfig(imageID); found {
+	if _, found := o.imageCache.GetConfig(imageID); found {
 		logrus.Infof("Using cached config for image: %s", imageID)
 		return nil
 	}
@@ -0,0 +1,170 @@
+// Package reference parses image references such as alpine,
+// docker.io/library/alpine:3.19 and localhost:5000/app@sha256:...
+package reference
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	DefaultDomain = "docker.io"
+	DefaultTag    = "latest"
+
+	legacyDomain       = "index.docker.io"
+	officialRepoPrefix = "library/"
+	maxNameLength      = 255
+)
+
+var (
+	domainRegexp    = regexp.MustCompile(`^(?:localhost|[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)*)(?::[0-9]+)?$`)
+	componentRegexp = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*$`)
+	tagRegexp       = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	digestRegexp    = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[a-zA-Z0-9=_-]{32,}$`)
+)
+
+// Reference is a parsed image reference. Domain and Tag are empty when the
+// input didn't name them; ParseNormalized fills in the defaults.
+type Reference struct {
+	Domain string
+	Path   string
+	Tag    string
+	Digest string
+}
+
+// Parse splits and validates a reference without applying defaults.
+func Parse(s string) (*Reference, error) {
+	if s == "" {
+		return nil, fmt.Errorf("invalid reference format: empty reference")
+	}
+
+	ref := &Reference{}
+	name := s
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, ref.Digest = name[:i], name[i+1:]
+		if err := ValidateDigest(ref.Digest); err != nil {
+			return nil, err
+		}
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, ref.Tag = name[:i], name[i+1:]
+		if !tagRegexp.MatchString(ref.Tag) {
+			return nil, fmt.Errorf("invalid reference format: invalid tag %q", ref.Tag)
+		}
+	}
+
+	if first, rest, ok := strings.Cut(name, "/"); ok && isDomain(first) {
+		if !domainRegexp.MatchString(first) {
+			return nil, fmt.Errorf("invalid reference format: invalid registry %q", first)
+		}
+		ref.Domain, name = first, rest
+	}
+
+	if name == "" {
+		return nil, fmt.Errorf("invalid reference format: repository name is required")
+	}
+	if len(ref.Domain)+len(name) > maxNameLength {
+		return nil, fmt.Errorf("invalid reference format: repository name must not be more than %d characters", maxNameLength)
+	}
+	for _, component := range strings.Split(name, "/") {
+		if componentRegexp.MatchString(component) {
+			continue
+		}
+		if componentRegexp.MatchString(strings.ToLower(component)) {
+			return nil, fmt.Errorf("invalid reference format: repository name %q must be lowercase", name)
+		}
+		return nil, fmt.Errorf("invalid reference format: invalid repository name %q", name)
+	}
+	ref.Path = name
+
+	return ref, nil
+}
+
+// ParseNormalized parses s and fills in what Docker assumes: the docker.io
+// registry, the library/ namespace for official images and the latest tag
+// when neither a tag nor a digest is given.
+func ParseNormalized(s string) (*Reference, error) {
+	ref, err := Parse(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if ref.Domain == "" || ref.Domain == legacyDomain {
+		ref.Domain = DefaultDomain
+	}
+	if ref.Domain == DefaultDomain && !strings.Contains(ref.Path, "/") {
+		ref.Path = officialRepoPrefix + ref.Path
+	}
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = DefaultTag
+	}
+	return ref, nil
+}
+
+// ValidateDigest checks algorithm:hex, requiring 64 hex digits for sha256.
+func ValidateDigest(digest string) error {
+	if !digestRegexp.MatchString(digest) {
+		return fmt.Errorf("invalid reference format: invalid digest %q", digest)
+	}
+	if hex, ok := strings.CutPrefix(digest, "sha256:"); ok {
+		if len(hex) != 64 || strings.Trim(hex, "0123456789abcdef") != "" {
+			return fmt.Errorf("invalid reference format: invalid sha256 digest %q", digest)
+		}
+	}
+	return nil
+}
+
+// Name returns the repository including its registry.
+func (r *Reference) Name() string {
+	if r.Domain == "" {
+		return r.Path
+	}
+	return r.Domain + "/" + r.Path
+}
+
+// FamiliarName returns the short form users type: docker.io and the
+// library/ namespace of official images are left out.
+func (r *Reference) FamiliarName() string {
+	if r.Domain != "" && r.Domain != DefaultDomain && r.Domain != legacyDomain {
+		return r.Domain + "/" + r.Path
+	}
+	if path, ok := strings.CutPrefix(r.Path, officialRepoPrefix); ok && !strings.Contains(path, "/") {
+		return path
+	}
+	return r.Path
+}
+
+// TagOrDigest returns the digest when there is one, otherwise the tag.
+func (r *Reference) TagOrDigest() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
+
+func (r *Reference) String() string {
+	return r.Name() + r.suffix()
+}
+
+// FamiliarString is the familiar name followed by the tag or digest.
+func (r *Reference) FamiliarString() string {
+	return r.FamiliarName() + r.suffix()
+}
+
+func (r *Reference) suffix() string {
+	var s string
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+// isDomain reports whether the first path component names a registry
+// rather than a namespace.
+func isDomain(component string) bool {
+	return strings.ContainsAny(component, ".:") || component == "localhost" || strings.ToLower(component) != component
+}
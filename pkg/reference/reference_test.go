@@ -0,0 +1,74 @@
+package reference
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseNormalized(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("ab", 32)
+
+	tests := []struct {
+		input    string
+		name     string
+		familiar string
+		tag      string
+		digest   string
+	}{
+		{"alpine", "docker.io/library/alpine", "alpine", "latest", ""},
+		{"alpine:3.19", "docker.io/library/alpine", "alpine", "3.19", ""},
+		{"docker.io/library/alpine:3.19", "docker.io/library/alpine", "alpine", "3.19", ""},
+		{"index.docker.io/alpine", "docker.io/library/alpine", "alpine", "latest", ""},
+		{"user/app", "docker.io/user/app", "user/app", "latest", ""},
+		{"localhost:5000/foo@" + digest, "localhost:5000/foo", "localhost:5000/foo", "", digest},
+		{"localhost/foo:dev", "localhost/foo", "localhost/foo", "dev", ""},
+		{"ghcr.io/org/team/app:v1@" + digest, "ghcr.io/org/team/app", "ghcr.io/org/team/app", "v1", digest},
+	}
+
+	for _, tt := range tests {
+		ref, err := ParseNormalized(tt.input)
+		require.NoError(t, err, tt.input)
+		assert.Equal(t, tt.name, ref.Name(), tt.input)
+		assert.Equal(t, tt.familiar, ref.FamiliarName(), tt.input)
+		assert.Equal(t, tt.tag, ref.Tag, tt.input)
+		assert.Equal(t, tt.digest, ref.Digest, tt.input)
+	}
+}
+
+func TestParseKeepsInput(t *testing.T) {
+	ref, err := Parse("alpine")
+	require.NoError(t, err)
+	assert.Equal(t, "", ref.Domain)
+	assert.Equal(t, "alpine", ref.Path)
+	assert.Equal(t, "", ref.Tag)
+	assert.Equal(t, "alpine", ref.String())
+
+	ref, err = ParseNormalized("alpine")
+	require.NoError(t, err)
+	assert.Equal(t, "docker.io/library/alpine:latest", ref.String())
+	assert.Equal(t, "alpine:latest", ref.FamiliarString())
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, input := range []string{
+		"",
+		"Alpine",
+		"alpine:",
+		"alpine:-bad",
+		"alpine@sha256:1234",
+		"alpine@sha256:" + strings.Repeat("A", 64),
+		"foo//bar",
+		"localhost:5000/",
+		"-app",
+		strings.Repeat("a", 256),
+	} {
+		_, err := ParseNormalized(input)
+		assert.Error(t, err, input)
+	}
+
+	_, err := Parse("Alpine")
+	assert.Contains(t, err.Error(), "must be lowercase")
+}
@@ -0,0 +1,134 @@
+package scan
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DatabaseFile is where the downloaded vulnerability DB is kept in the
+// data directory.
+const DatabaseFile = "vulndb.json"
+
+// Vulnerability affects Package in an OS ecosystem (the os-release ID,
+// e.g. alpine or debian) from Introduced up to, but not including, Fixed.
+// An empty Fixed means no fix is available yet.
+type Vulnerability struct {
+	ID          string   `json:"id"`
+	Ecosystem   string   `json:"ecosystem"`
+	OSVersion   string   `json:"os_version,omitempty"`
+	Package     string   `json:"package"`
+	Introduced  string   `json:"introduced,omitempty"`
+	Fixed       string   `json:"fixed,omitempty"`
+	Severity    Severity `json:"severity"`
+	Description string   `json:"description,omitempty"`
+}
+
+type Database struct {
+	UpdatedAt       time.Time       `json:"updated_at"`
+	Vulnerabilities []Vulnerability `json:"vulnerabilities"`
+
+	index map[string][]*Vulnerability
+}
+
+func LoadDatabase(path string) (*Database, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no vulnerability database at %s, run the scan with --update-db", path)
+		}
+		return nil, fmt.Errorf("failed to read vulnerability database: %v", err)
+	}
+	return parseDatabase(data)
+}
+
+// DownloadDatabase fetches the DB from url and saves it to path once it
+// has been parsed successfully.
+func DownloadDatabase(url, path string) (*Database, error) {
+	client := &http.Client{Timeout: 5 * time.Minute}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download vulnerability database: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download vulnerability database: %s", resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download vulnerability database: %v", err)
+	}
+
+	db, err := parseDatabase(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create database directory: %v", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return nil, fmt.Errorf("failed to save vulnerability database: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, fmt.Errorf("failed to save vulnerability database: %v", err)
+	}
+	return db, nil
+}
+
+func parseDatabase(data []byte) (*Database, error) {
+	db := &Database{}
+	if err := json.Unmarshal(data, db); err != nil {
+		return nil, fmt.Errorf("failed to parse vulnerability database: %v", err)
+	}
+
+	db.index = make(map[string][]*Vulnerability)
+	for i := range db.Vulnerabilities {
+		vuln := &db.Vulnerabilities[i]
+		key := indexKey(vuln.Ecosystem, vuln.Package)
+		db.index[key] = append(db.index[key], vuln)
+	}
+	return db, nil
+}
+
+// lookup returns the entries for a package by its binary or source name.
+func (db *Database) lookup(osInfo OSInfo, pkg Package) []*Vulnerability {
+	names := []string{pkg.Name}
+	if pkg.Source != "" && pkg.Source != pkg.Name {
+		names = append(names, pkg.Source)
+	}
+
+	var result []*Vulnerability
+	seen := make(map[string]bool)
+	for _, name := range names {
+		for _, vuln := range db.index[indexKey(osInfo.ID, name)] {
+			if vuln.OSVersion != "" && !strings.HasPrefix(osInfo.VersionID, vuln.OSVersion) {
+				continue
+			}
+			if seen[vuln.ID] {
+				continue
+			}
+			seen[vuln.ID] = true
+			result = append(result, vuln)
+		}
+	}
+	return result
+}
+
+func (v *Vulnerability) affects(pkg Package) bool {
+	if v.Introduced != "" && compareVersions(pkg.Type, pkg.Version, v.Introduced) < 0 {
+		return false
+	}
+	return v.Fixed == "" || compareVersions(pkg.Type, pkg.Version, v.Fixed) < 0
+}
+
+func indexKey(ecosystem, name string) string {
+	return strings.ToLower(ecosystem) + "/" + name
+}
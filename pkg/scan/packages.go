@@ -0,0 +1,328 @@
+package scan
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	PackageAPK = "apk"
+	PackageDeb = "deb"
+	PackageRPM = "rpm"
+
+	whiteoutPrefix = ".wh."
+	opaqueWhiteout = ".wh..wh..opq"
+)
+
+var rpmDBDirs = []string{"var/lib/rpm", "usr/lib/sysimage/rpm"}
+
+type OSInfo struct {
+	ID        string
+	VersionID string
+}
+
+type Package struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	// Source is the source package, which vulnerability DBs often use
+	Source string `json:"source,omitempty"`
+	Type   string `json:"type"`
+}
+
+// collectPackages reads /etc/os-release and the apk, dpkg and rpm
+// databases from the merged view of layers, the bottom layer first.
+func collectPackages(layers []string) (OSInfo, []Package, []string) {
+	var (
+		osInfo   OSInfo
+		packages []Package
+		warnings []string
+	)
+
+	for _, rel := range []string{"etc/os-release", "usr/lib/os-release"} {
+		if file := resolvePath(layers, rel); file != "" {
+			osInfo = parseOSRelease(file)
+			break
+		}
+	}
+
+	if file := resolvePath(layers, "lib/apk/db/installed"); file != "" {
+		pkgs, err := readAPKDatabase(file)
+		if err != nil {
+			warnings = append(warnings, err.Error())
+		}
+		packages = append(packages, pkgs...)
+	}
+
+	if file := resolvePath(layers, "var/lib/dpkg/status"); file != "" {
+		pkgs, err := readDpkgStatus(file)
+		if err != nil {
+			warnings = append(warnings, err.Error())
+		}
+		packages = append(packages, pkgs...)
+	}
+	// distroless images keep one status file per package instead
+	for _, file := range listMerged(layers, "var/lib/dpkg/status.d") {
+		pkgs, err := readDpkgStatus(file)
+		if err != nil {
+			warnings = append(warnings, err.Error())
+		}
+		packages = append(packages, pkgs...)
+	}
+
+	for _, dir := range rpmDBDirs {
+		files := listMerged(layers, dir)
+		if len(files) == 0 {
+			continue
+		}
+		pkgs, err := readRPMDatabase(files)
+		if err != nil {
+			warnings = append(warnings, err.Error())
+		}
+		packages = append(packages, pkgs...)
+		break
+	}
+
+	return osInfo, packages, warnings
+}
+
+// resolvePath returns the file that rel refers to in the topmost layer,
+// or "" when it is missing or was deleted by a whiteout.
+func resolvePath(layers []string, rel string) string {
+	for i := len(layers) - 1; i >= 0; i-- {
+		file := filepath.Join(layers[i], rel)
+		if info, err := os.Stat(file); err == nil && info.Mode().IsRegular() {
+			return file
+		}
+		if hiddenInLayer(layers[i], rel) {
+			return ""
+		}
+	}
+	return ""
+}
+
+// listMerged lists the regular files directly in dir across layers, with
+// upper layers hiding lower ones.
+func listMerged(layers []string, dir string) []string {
+	seen := make(map[string]bool)
+	var files []string
+	for i := len(layers) - 1; i >= 0; i-- {
+		entries, err := os.ReadDir(filepath.Join(layers[i], dir))
+		if err == nil {
+			opaque := false
+			for _, entry := range entries {
+				name := entry.Name()
+				if name == opaqueWhiteout {
+					opaque = true
+					continue
+				}
+				if strings.HasPrefix(name, whiteoutPrefix) {
+					seen[strings.TrimPrefix(name, whiteoutPrefix)] = true
+					continue
+				}
+				if seen[name] || !entry.Type().IsRegular() {
+					continue
+				}
+				seen[name] = true
+				files = append(files, filepath.Join(layers[i], dir, name))
+			}
+			if opaque {
+				break
+			}
+		}
+		if hiddenInLayer(layers[i], dir) {
+			break
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// hiddenInLayer reports whether layer deletes rel or one of its parents.
+func hiddenInLayer(layer, rel string) bool {
+	for p := rel; p != "." && p != "/" && p != ""; p = path.Dir(p) {
+		whiteout := filepath.Join(layer, path.Dir(p), whiteoutPrefix+path.Base(p))
+		if _, err := os.Lstat(whiteout); err == nil {
+			return true
+		}
+		if p != rel {
+			if _, err := os.Lstat(filepath.Join(layer, p, opaqueWhiteout)); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func parseOSRelease(file string) OSInfo {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return OSInfo{}
+	}
+
+	var info OSInfo
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok {
+			continue
+		}
+		value = strings.Trim(value, `"'`)
+		switch key {
+		case "ID":
+			info.ID = value
+		case "VERSION_ID":
+			info.VersionID = value
+		}
+	}
+	return info
+}
+
+// readAPKDatabase parses lib/apk/db/installed: blank-line separated
+// records with P: name, V: version and o: origin lines.
+func readAPKDatabase(file string) ([]Package, error) {
+	var packages []Package
+	err := readRecords(file, ':', func(fields map[string]string) {
+		if fields["P"] == "" {
+			return
+		}
+		packages = append(packages, Package{
+			Name:    fields["P"],
+			Version: fields["V"],
+			Source:  fields["o"],
+			Type:    PackageAPK,
+		})
+	})
+	if err != nil {
+		return packages, fmt.Errorf("failed to read apk database: %v", err)
+	}
+	return packages, nil
+}
+
+// readDpkgStatus parses a dpkg status file, keeping installed packages.
+func readDpkgStatus(file string) ([]Package, error) {
+	var packages []Package
+	err := readRecords(file, ':', func(fields map[string]string) {
+		if fields["Package"] == "" {
+			return
+		}
+		if status := fields["Status"]; status != "" && !strings.HasSuffix(status, " installed") {
+			return
+		}
+		// Source may carry its own version: "openssl (3.0.11-1)"
+		source, _, _ := strings.Cut(fields["Source"], " ")
+		packages = append(packages, Package{
+			Name:    fields["Package"],
+			Version: fields["Version"],
+			Source:  source,
+			Type:    PackageDeb,
+		})
+	})
+	if err != nil {
+		return packages, fmt.Errorf("failed to read dpkg status: %v", err)
+	}
+	return packages, nil
+}
+
+// readRecords calls fn for every blank-line separated record of
+// "key<sep>value" lines. Continuation lines are ignored.
+func readRecords(file string, sep byte, fn func(map[string]string)) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fields := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			if len(fields) > 0 {
+				fn(fields)
+				fields = make(map[string]string)
+			}
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			continue
+		}
+		if i := strings.IndexByte(line, sep); i > 0 {
+			fields[line[:i]] = strings.TrimSpace(line[i+1:])
+		}
+	}
+	if len(fields) > 0 {
+		fn(fields)
+	}
+	return scanner.Err()
+}
+
+// readRPMDatabase queries the rpm database with the host's rpm binary,
+// since the BerkeleyDB, NDB and SQLite formats are not parsed here. The
+// files are copied into one directory first because layers may split them.
+func readRPMDatabase(files []string) ([]Package, error) {
+	rpmPath, err := exec.LookPath("rpm")
+	if err != nil {
+		return nil, fmt.Errorf("found an rpm database but rpm is not installed, rpm packages were not scanned")
+	}
+
+	dbDir, err := os.MkdirTemp("", "mydocker-rpmdb-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create rpm database directory: %v", err)
+	}
+	defer os.RemoveAll(dbDir)
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read rpm database: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dbDir, filepath.Base(file)), data, 0644); err != nil {
+			return nil, fmt.Errorf("failed to copy rpm database: %v", err)
+		}
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(rpmPath, "--dbpath", dbDir, "-qa", "--qf", `%{NAME}\t%{EPOCHNUM}:%{VERSION}-%{RELEASE}\t%{SOURCERPM}\n`)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("failed to query rpm database: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var packages []Package
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 2 || fields[0] == "" {
+			continue
+		}
+		version := strings.TrimPrefix(fields[1], "0:")
+		pkg := Package{Name: fields[0], Version: version, Type: PackageRPM}
+		if len(fields) > 2 {
+			pkg.Source = sourceRPMName(fields[2])
+		}
+		packages = append(packages, pkg)
+	}
+	return packages, nil
+}
+
+// sourceRPMName strips version, release and suffix from a source rpm
+// file name such as openssl-3.0.7-24.el9.src.rpm.
+func sourceRPMName(srpm string) string {
+	name := strings.TrimSuffix(srpm, ".src.rpm")
+	for i := 0; i < 2; i++ {
+		if j := strings.LastIndex(name, "-"); j > 0 {
+			name = name[:j]
+		}
+	}
+	if name == "(none)" {
+		return ""
+	}
+	return name
+}
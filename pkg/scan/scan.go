@@ -0,0 +1,198 @@
+// Package scan finds known vulnerabilities in the packages installed in an
+// image.
+package scan
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"docker-impl/pkg/types"
+)
+
+type Severity string
+
+const (
+	SeverityUnknown  Severity = "UNKNOWN"
+	SeverityLow      Severity = "LOW"
+	SeverityMedium   Severity = "MEDIUM"
+	SeverityHigh     Severity = "HIGH"
+	SeverityCritical Severity = "CRITICAL"
+)
+
+var severityRanks = map[Severity]int{
+	SeverityUnknown:  0,
+	SeverityLow:      1,
+	SeverityMedium:   2,
+	SeverityHigh:     3,
+	SeverityCritical: 4,
+}
+
+// ParseSeverity accepts a severity name in any case.
+func ParseSeverity(s string) (Severity, error) {
+	severity := Severity(strings.ToUpper(s))
+	if _, ok := severityRanks[severity]; !ok {
+		return "", fmt.Errorf("unknown severity: %s", s)
+	}
+	return severity, nil
+}
+
+func (s Severity) rank() int {
+	return severityRanks[Severity(strings.ToUpper(string(s)))]
+}
+
+// Target is an image and its layer directories, bottom layer first.
+type Target struct {
+	Image  *types.Image
+	Layers []string
+}
+
+type Finding struct {
+	VulnerabilityID  string   `json:"vulnerability_id"`
+	Package          string   `json:"package"`
+	InstalledVersion string   `json:"installed_version"`
+	FixedVersion     string   `json:"fixed_version,omitempty"`
+	Severity         Severity `json:"severity"`
+	Description      string   `json:"description,omitempty"`
+}
+
+type Report struct {
+	ImageID  string    `json:"image_id"`
+	OS       string    `json:"os,omitempty"`
+	Scanner  string    `json:"scanner"`
+	Packages int       `json:"packages"`
+	Findings []Finding `json:"findings"`
+	Warnings []string  `json:"warnings,omitempty"`
+}
+
+// Scanner produces a report for an image. BuiltinScanner matches package
+// databases against a local vulnerability DB; ExternalScanner hands the
+// image to another program.
+type Scanner interface {
+	Name() string
+	Scan(target Target) (*Report, error)
+}
+
+// Filter drops findings below min.
+func (r *Report) Filter(min Severity) {
+	var kept []Finding
+	for _, finding := range r.Findings {
+		if finding.Severity.rank() >= min.rank() {
+			kept = append(kept, finding)
+		}
+	}
+	r.Findings = kept
+}
+
+// Counts returns the number of findings per severity.
+func (r *Report) Counts() map[Severity]int {
+	counts := make(map[Severity]int)
+	for _, finding := range r.Findings {
+		counts[finding.Severity]++
+	}
+	return counts
+}
+
+type BuiltinScanner struct {
+	db *Database
+}
+
+func NewBuiltinScanner(db *Database) *BuiltinScanner {
+	return &BuiltinScanner{db: db}
+}
+
+func (s *BuiltinScanner) Name() string {
+	return "builtin"
+}
+
+func (s *BuiltinScanner) Scan(target Target) (*Report, error) {
+	if len(target.Layers) == 0 {
+		return nil, fmt.Errorf("image %s has no local layers to scan", target.Image.ID)
+	}
+
+	osInfo, packages, warnings := collectPackages(target.Layers)
+	report := &Report{
+		ImageID:  target.Image.ID,
+		OS:       strings.TrimSpace(osInfo.ID + " " + osInfo.VersionID),
+		Scanner:  s.Name(),
+		Packages: len(packages),
+		Findings: []Finding{},
+		Warnings: warnings,
+	}
+	if osInfo.ID == "" && len(packages) > 0 {
+		report.Warnings = append(report.Warnings, "could not detect the OS from /etc/os-release")
+	}
+
+	for _, pkg := range packages {
+		for _, vuln := range s.db.lookup(osInfo, pkg) {
+			if !vuln.affects(pkg) {
+				continue
+			}
+			severity := vuln.Severity
+			if severity == "" {
+				severity = SeverityUnknown
+			}
+			report.Findings = append(report.Findings, Finding{
+				VulnerabilityID:  vuln.ID,
+				Package:          pkg.Name,
+				InstalledVersion: pkg.Version,
+				FixedVersion:     vuln.Fixed,
+				Severity:         Severity(strings.ToUpper(string(severity))),
+				Description:      vuln.Description,
+			})
+		}
+	}
+
+	sort.Slice(report.Findings, func(i, j int) bool {
+		a, b := report.Findings[i], report.Findings[j]
+		if a.Severity.rank() != b.Severity.rank() {
+			return a.Severity.rank() > b.Severity.rank()
+		}
+		if a.Package != b.Package {
+			return a.Package < b.Package
+		}
+		return a.VulnerabilityID < b.VulnerabilityID
+	})
+	return report, nil
+}
+
+// ExternalScanner runs Path with the image ID as its argument. The image
+// and its layer directories (bottom first, separated by the OS path list
+// separator) are passed in MYDOCKER_IMAGE_ID and MYDOCKER_IMAGE_LAYERS,
+// and the program prints a JSON Report on stdout.
+type ExternalScanner struct {
+	Path string
+}
+
+func (s *ExternalScanner) Name() string {
+	return s.Path
+}
+
+func (s *ExternalScanner) Scan(target Target) (*Report, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(s.Path, target.Image.ID)
+	cmd.Env = append(os.Environ(),
+		"MYDOCKER_IMAGE_ID="+target.Image.ID,
+		"MYDOCKER_IMAGE_LAYERS="+strings.Join(target.Layers, string(os.PathListSeparator)),
+	)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("scanner %s failed: %v: %s", s.Path, err, strings.TrimSpace(stderr.String()))
+	}
+
+	report := &Report{}
+	if err := json.Unmarshal(stdout.Bytes(), report); err != nil {
+		return nil, fmt.Errorf("failed to parse report from %s: %v", s.Path, err)
+	}
+	if report.ImageID == "" {
+		report.ImageID = target.Image.ID
+	}
+	report.Scanner = s.Name()
+	return report, nil
+}
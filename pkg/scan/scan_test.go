@@ -0,0 +1,84 @@
+package scan
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"docker-impl/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		pkgType string
+		a, b    string
+		want    int
+	}{
+		{PackageDeb, "1.0-1", "1.0-1", 0},
+		{PackageDeb, "1.0~rc1-1", "1.0-1", -1},
+		{PackageDeb, "1:0.9-1", "2.0-1", 1},
+		{PackageDeb, "3.0.11-1~deb12u1", "3.0.11-1~deb12u2", -1},
+		{PackageDeb, "1.10-1", "1.9-1", 1},
+		{PackageAPK, "3.1.4-r5", "3.1.4-r6", -1},
+		{PackageAPK, "1.2.3_rc1-r0", "1.2.3-r0", -1},
+		{PackageAPK, "1.36.1-r2", "1.36.1-r15", -1},
+		{PackageRPM, "3.0.7-24.el9", "3.0.7-25.el9", -1},
+		{PackageRPM, "1.0a", "1.0", 1},
+		{PackageRPM, "1.0~beta", "1.0", -1},
+		{PackageRPM, "2:1.0-1", "1:9.0-1", 1},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, compareVersions(tt.pkgType, tt.a, tt.b), "%s %s vs %s", tt.pkgType, tt.a, tt.b)
+		assert.Equal(t, -tt.want, compareVersions(tt.pkgType, tt.b, tt.a), "%s %s vs %s", tt.pkgType, tt.b, tt.a)
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+}
+
+func TestBuiltinScanner(t *testing.T) {
+	base := t.TempDir()
+	top := t.TempDir()
+
+	writeFile(t, filepath.Join(base, "etc/os-release"), "ID=alpine\nVERSION_ID=3.18.4\n")
+	writeFile(t, filepath.Join(base, "lib/apk/db/installed"),
+		"P:musl\nV:1.2.4-r1\no:musl\n\nP:libssl3\nV:3.1.3-r0\no:openssl\n\nP:busybox\nV:1.36.1-r5\no:busybox\n")
+	// The top layer upgrades openssl and removes a stale dpkg database
+	writeFile(t, filepath.Join(base, "var/lib/dpkg/status"), "Package: bash\nVersion: 5.2-1\nStatus: install ok installed\n")
+	writeFile(t, filepath.Join(top, "lib/apk/db/installed"),
+		"P:musl\nV:1.2.4-r1\no:musl\n\nP:libssl3\nV:3.1.4-r0\no:openssl\n\nP:busybox\nV:1.36.1-r5\no:busybox\n")
+	writeFile(t, filepath.Join(top, "var/lib/dpkg/.wh.status"), "")
+
+	db, err := parseDatabase([]byte(`{
+		"vulnerabilities": [
+			{"id": "CVE-2023-0001", "ecosystem": "alpine", "package": "openssl", "fixed": "3.1.4-r0", "severity": "high"},
+			{"id": "CVE-2023-0002", "ecosystem": "alpine", "package": "openssl", "fixed": "3.1.5-r0", "severity": "medium"},
+			{"id": "CVE-2023-0003", "ecosystem": "alpine", "os_version": "3.19", "package": "busybox", "severity": "critical"},
+			{"id": "CVE-2023-0004", "ecosystem": "alpine", "package": "busybox", "introduced": "1.36.0-r0", "severity": "low"},
+			{"id": "CVE-2023-0005", "ecosystem": "debian", "package": "bash", "severity": "critical"}
+		]
+	}`))
+	require.NoError(t, err)
+
+	scanner := NewBuiltinScanner(db)
+	report, err := scanner.Scan(Target{Image: &types.Image{ID: "sha256:abc"}, Layers: []string{base, top}})
+	require.NoError(t, err)
+
+	assert.Equal(t, "alpine 3.18.4", report.OS)
+	assert.Equal(t, 3, report.Packages)
+	require.Len(t, report.Findings, 2)
+	assert.Equal(t, "CVE-2023-0002", report.Findings[0].VulnerabilityID)
+	assert.Equal(t, "libssl3", report.Findings[0].Package)
+	assert.Equal(t, SeverityMedium, report.Findings[0].Severity)
+	assert.Equal(t, "CVE-2023-0004", report.Findings[1].VulnerabilityID)
+	assert.Equal(t, SeverityLow, report.Findings[1].Severity)
+
+	report.Filter(SeverityMedium)
+	require.Len(t, report.Findings, 1)
+	assert.Equal(t, 1, report.Counts()[SeverityMedium])
+}
@@ -0,0 +1,224 @@
+package scan
+
+import (
+	"strconv"
+	"strings"
+)
+
+// compareVersions orders two versions of a package of the given type and
+// returns -1, 0 or 1.
+func compareVersions(pkgType, a, b string) int {
+	switch pkgType {
+	case PackageDeb:
+		return compareDebian(a, b)
+	case PackageAPK:
+		return compareRPM(apkToRPM(a), apkToRPM(b))
+	default:
+		return compareRPM(a, b)
+	}
+}
+
+// splitEpoch splits [epoch:]version-release at the last hyphen.
+func splitEpoch(v string) (int, string, string) {
+	epoch := 0
+	if i := strings.Index(v, ":"); i >= 0 {
+		epoch, _ = strconv.Atoi(v[:i])
+		v = v[i+1:]
+	}
+	if i := strings.LastIndex(v, "-"); i >= 0 {
+		return epoch, v[:i], v[i+1:]
+	}
+	return epoch, v, ""
+}
+
+func compareDebian(a, b string) int {
+	epochA, upstreamA, revisionA := splitEpoch(a)
+	epochB, upstreamB, revisionB := splitEpoch(b)
+	if epochA != epochB {
+		return compareInts(epochA, epochB)
+	}
+	if c := compareDebianPart(upstreamA, upstreamB); c != 0 {
+		return c
+	}
+	return compareDebianPart(revisionA, revisionB)
+}
+
+// compareDebianPart implements the dpkg algorithm: alternating non-digit
+// runs, compared with ~ sorting before everything and letters before
+// other characters, and digit runs compared numerically.
+func compareDebianPart(a, b string) int {
+	for a != "" || b != "" {
+		var textA, textB string
+		textA, a = splitRun(a, false)
+		textB, b = splitRun(b, false)
+		if c := compareDebianText(textA, textB); c != 0 {
+			return c
+		}
+
+		var numA, numB string
+		numA, a = splitRun(a, true)
+		numB, b = splitRun(b, true)
+		if c := compareNumeric(numA, numB); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func compareDebianText(a, b string) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var ca, cb int
+		if i < len(a) {
+			ca = debianOrder(a[i])
+		}
+		if i < len(b) {
+			cb = debianOrder(b[i])
+		}
+		if ca != cb {
+			return compareInts(ca, cb)
+		}
+	}
+	return 0
+}
+
+func debianOrder(c byte) int {
+	switch {
+	case c == '~':
+		return -1
+	case isLetter(c):
+		return int(c)
+	default:
+		return int(c) + 256
+	}
+}
+
+func compareRPM(a, b string) int {
+	epochA, versionA, releaseA := splitEpoch(a)
+	epochB, versionB, releaseB := splitEpoch(b)
+	if epochA != epochB {
+		return compareInts(epochA, epochB)
+	}
+	if c := rpmvercmp(versionA, versionB); c != 0 {
+		return c
+	}
+	return rpmvercmp(releaseA, releaseB)
+}
+
+// rpmvercmp compares alternating numeric and alphabetic segments. Numeric
+// segments are newer than alphabetic ones and ~ sorts before anything,
+// even the end of the string.
+func rpmvercmp(a, b string) int {
+	for {
+		a = strings.TrimLeftFunc(a, isRPMSeparator)
+		b = strings.TrimLeftFunc(b, isRPMSeparator)
+
+		tildeA, tildeB := strings.HasPrefix(a, "~"), strings.HasPrefix(b, "~")
+		if tildeA || tildeB {
+			if !tildeA {
+				return 1
+			}
+			if !tildeB {
+				return -1
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+		if a == "" || b == "" {
+			break
+		}
+
+		numeric := isDigit(a[0])
+		var segA, segB string
+		segA, a = splitRPMSegment(a, numeric)
+		segB, b = splitRPMSegment(b, numeric)
+		if segB == "" {
+			if numeric {
+				return 1
+			}
+			return -1
+		}
+
+		var c int
+		if numeric {
+			c = compareNumeric(segA, segB)
+		} else {
+			c = strings.Compare(segA, segB)
+		}
+		if c != 0 {
+			return c
+		}
+	}
+
+	switch {
+	case a == "" && b == "":
+		return 0
+	case a == "":
+		return -1
+	default:
+		return 1
+	}
+}
+
+// apkToRPM rewrites apk pre-release suffixes (_alpha, _beta, _pre, _rc)
+// so they sort before the release, and the -rN package release so it
+// compares like an rpm release.
+func apkToRPM(v string) string {
+	for _, suffix := range []string{"_alpha", "_beta", "_pre", "_rc"} {
+		v = strings.ReplaceAll(v, suffix, "~"+suffix[1:])
+	}
+	v = strings.ReplaceAll(v, "_", ".")
+	if i := strings.LastIndex(v, "-r"); i >= 0 {
+		v = v[:i] + "-" + v[i+2:]
+	}
+	return v
+}
+
+// splitRun splits off the leading run of digits, or of non-digits.
+func splitRun(s string, digits bool) (string, string) {
+	i := 0
+	for i < len(s) && isDigit(s[i]) == digits {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+// splitRPMSegment splits off the leading run of digits, or of letters.
+func splitRPMSegment(s string, digits bool) (string, string) {
+	i := 0
+	for i < len(s) && ((digits && isDigit(s[i])) || (!digits && isLetter(s[i]))) {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+func compareNumeric(a, b string) int {
+	a = strings.TrimLeft(a, "0")
+	b = strings.TrimLeft(b, "0")
+	if len(a) != len(b) {
+		return compareInts(len(a), len(b))
+	}
+	return strings.Compare(a, b)
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isRPMSeparator(r rune) bool {
+	return r >= 128 || (!isDigit(byte(r)) && !isLetter(byte(r)) && r != '~')
+}
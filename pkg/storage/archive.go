@@ -0,0 +1,501 @@
+package storage
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// xattrPrefix marks extended attributes in PAX records, as GNU tar and
+// Docker write them
+const xattrPrefix = "SCHILY.xattr."
+
+// extractTar unpacks a layer tar stream, plain or gzip compressed, into
+// dir. Whiteouts are kept as the .wh. files they arrive as. Entries are
+// recorded in stats as added or deleted; exists reports whether a path is
+// present in the layers below, which makes an added path a modification.
+func extractTar(r io.Reader, dir string, stats *Diff, exists func(string) bool) (int64, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return 0, fmt.Errorf("failed to decompress layer: %v", err)
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+
+	type dirTimes struct {
+		path  string
+		mtime time.Time
+	}
+	var dirs []dirTimes
+	var size int64
+	privileged := os.Geteuid() == 0
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return size, fmt.Errorf("failed to read layer: %v", err)
+		}
+
+		rel := strings.TrimPrefix(filepath.Clean("/"+hdr.Name), "/")
+		if rel == "" {
+			continue
+		}
+		target, err := safeJoin(dir, rel)
+		if err != nil {
+			return size, err
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return size, err
+		}
+
+		base := filepath.Base(rel)
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			if base != opaqueWhiteout {
+				stats.Deleted = append(stats.Deleted, "/"+filepath.Join(filepath.Dir(rel), strings.TrimPrefix(base, whiteoutPrefix)))
+			}
+		} else if hdr.Typeflag != tar.TypeDir || !exists(rel) {
+			if exists(rel) {
+				stats.Modified = append(stats.Modified, "/"+rel)
+			} else {
+				stats.Added = append(stats.Added, "/"+rel)
+			}
+		}
+
+		// Entries replace what an earlier entry of the stream put there,
+		// except that directories merge
+		if existing, err := os.Lstat(target); err == nil && !(existing.IsDir() && hdr.Typeflag == tar.TypeDir) {
+			if err := os.RemoveAll(target); err != nil {
+				return size, err
+			}
+		}
+
+		mode := os.FileMode(hdr.Mode).Perm()
+		if hdr.Mode&04000 != 0 {
+			mode |= os.ModeSetuid
+		}
+		if hdr.Mode&02000 != 0 {
+			mode |= os.ModeSetgid
+		}
+		if hdr.Mode&01000 != 0 {
+			mode |= os.ModeSticky
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return size, err
+			}
+			dirs = append(dirs, dirTimes{target, hdr.ModTime})
+		case tar.TypeReg, tar.TypeRegA:
+			file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+			if err != nil {
+				return size, err
+			}
+			n, err := io.Copy(file, tr)
+			file.Close()
+			if err != nil {
+				return size, fmt.Errorf("failed to extract %s: %v", rel, err)
+			}
+			size += n
+		case tar.TypeSymlink:
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return size, err
+			}
+		case tar.TypeLink:
+			linkRel := strings.TrimPrefix(filepath.Clean("/"+hdr.Linkname), "/")
+			source, err := safeJoin(dir, linkRel)
+			if err != nil {
+				return size, err
+			}
+			if err := os.Link(source, target); err != nil {
+				return size, fmt.Errorf("failed to link %s to %s: %v", rel, hdr.Linkname, err)
+			}
+			continue
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			devMode := uint32(syscall.S_IFIFO)
+			switch hdr.Typeflag {
+			case tar.TypeChar:
+				devMode = syscall.S_IFCHR
+			case tar.TypeBlock:
+				devMode = syscall.S_IFBLK
+			}
+			dev := int(unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor)))
+			if err := unix.Mknod(target, devMode|uint32(mode.Perm()), dev); err != nil {
+				if !privileged {
+					logrus.Warnf("Skipping device %s: %v", rel, err)
+					continue
+				}
+				return size, fmt.Errorf("failed to create device %s: %v", rel, err)
+			}
+		default:
+			logrus.Debugf("Skipping %s of unsupported type %c", rel, hdr.Typeflag)
+			continue
+		}
+
+		if privileged {
+			if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+				return size, fmt.Errorf("failed to chown %s: %v", rel, err)
+			}
+		}
+		for key, value := range hdr.PAXRecords {
+			if !strings.HasPrefix(key, xattrPrefix) {
+				continue
+			}
+			name := strings.TrimPrefix(key, xattrPrefix)
+			if err := unix.Lsetxattr(target, name, []byte(value), 0); err != nil {
+				// trusted.* and security.* need privileges, and some
+				// filesystems have no xattrs at all
+				logrus.Debugf("Failed to set xattr %s on %s: %v", name, rel, err)
+			}
+		}
+		if hdr.Typeflag == tar.TypeSymlink {
+			times := []unix.Timespec{unix.NsecToTimespec(hdr.ModTime.UnixNano()), unix.NsecToTimespec(hdr.ModTime.UnixNano())}
+			unix.UtimesNanoAt(unix.AT_FDCWD, target, times, unix.AT_SYMLINK_NOFOLLOW)
+			continue
+		}
+		// After chown, which clears setuid and setgid bits
+		if err := os.Chmod(target, mode); err != nil {
+			return size, err
+		}
+		if hdr.Typeflag != tar.TypeDir {
+			os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+		}
+	}
+
+	// Directory times change as entries are added, so set them last
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Chtimes(dirs[i].path, dirs[i].mtime, dirs[i].mtime)
+	}
+	return size, nil
+}
+
+// safeJoin joins rel to root, refusing paths that would leave root,
+// including through symlinks an earlier entry created.
+func safeJoin(root, rel string) (string, error) {
+	parts := strings.Split(rel, string(filepath.Separator))
+	current := root
+	for i, part := range parts {
+		if part == ".." {
+			return "", fmt.Errorf("invalid path in layer: %s", rel)
+		}
+		current = filepath.Join(current, part)
+		if i == len(parts)-1 {
+			break
+		}
+		if info, err := os.Lstat(current); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("path in layer goes through a symlink: %s", rel)
+		}
+	}
+	return current, nil
+}
+
+// tarWriter writes the files of a diff as a layer tar stream, turning
+// overlayfs whiteouts into .wh. files and hard links into link entries.
+type tarWriter struct {
+	tw     *tar.Writer
+	inodes map[uint64]string
+}
+
+func newTarWriter(w io.Writer) *tarWriter {
+	return &tarWriter{tw: tar.NewWriter(w), inodes: make(map[uint64]string)}
+}
+
+// pipeTar returns the tar stream archive writes, produced as it is read.
+func pipeTar(archive func(t *tarWriter) error) io.ReadCloser {
+	reader, writer := io.Pipe()
+	go func() {
+		t := newTarWriter(writer)
+		err := archive(t)
+		if closeErr := t.Close(); err == nil {
+			err = closeErr
+		}
+		writer.CloseWithError(err)
+	}()
+	return reader
+}
+
+// addWhiteout records the deletion of rel.
+func (t *tarWriter) addWhiteout(rel string) error {
+	return t.tw.WriteHeader(&tar.Header{
+		Name:     filepath.Join(filepath.Dir(rel), whiteoutPrefix+filepath.Base(rel)),
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		ModTime:  time.Unix(0, 0),
+		Format:   tar.FormatPAX,
+	})
+}
+
+// add writes the entry at path under the name rel.
+func (t *tarWriter) add(path, rel string, info os.FileInfo) error {
+	if name, ok := whiteoutTarget(info); ok {
+		if name == "" {
+			return nil
+		}
+		return t.addWhiteout(filepath.Join(filepath.Dir(rel), name))
+	}
+
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		link = target
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return fmt.Errorf("failed to archive %s: %v", rel, err)
+	}
+	hdr.Name = rel
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	hdr.Format = tar.FormatPAX
+	// Ownership is numeric; names would be looked up on the host
+	hdr.Uname, hdr.Gname = "", ""
+
+	stat, _ := info.Sys().(*syscall.Stat_t)
+	if stat != nil && info.Mode().IsRegular() && stat.Nlink > 1 {
+		if first, ok := t.inodes[stat.Ino]; ok {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = first
+			hdr.Size = 0
+		} else {
+			t.inodes[stat.Ino] = rel
+		}
+	}
+
+	if info.Mode()&os.ModeSymlink == 0 {
+		for name, value := range readXattrs(path) {
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = make(map[string]string)
+			}
+			hdr.PAXRecords[xattrPrefix+name] = value
+		}
+	}
+
+	if err := t.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if hdr.Typeflag == tar.TypeReg && hdr.Size > 0 {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if _, err := io.Copy(t.tw, file); err != nil {
+			return fmt.Errorf("failed to archive %s: %v", rel, err)
+		}
+	}
+
+	if info.IsDir() && opaqueDir(path) {
+		return t.addWhiteout(filepath.Join(rel, whiteoutPrefix+".opq"))
+	}
+	return nil
+}
+
+func (t *tarWriter) Close() error {
+	return t.tw.Close()
+}
+
+// readXattrs returns the extended attributes of path, leaving out the
+// ones overlayfs keeps for itself.
+func readXattrs(path string) map[string]string {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil || size == 0 {
+		return nil
+	}
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(path, buf)
+	if err != nil {
+		return nil
+	}
+
+	xattrs := make(map[string]string)
+	for _, name := range strings.Split(string(bytes.TrimRight(buf[:size], "\x00")), "\x00") {
+		if name == "" || strings.HasPrefix(name, "trusted.overlay.") {
+			continue
+		}
+		n, err := unix.Lgetxattr(path, name, nil)
+		if err != nil {
+			continue
+		}
+		value := make([]byte, n)
+		if n, err = unix.Lgetxattr(path, name, value); err == nil {
+			xattrs[name] = string(value[:n])
+		}
+	}
+	return xattrs
+}
+
+// archiveDir writes every entry under dir to t.
+func archiveDir(t *tarWriter, dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		return t.add(path, rel, info)
+	})
+}
+
+// lowerEntry is a path as the layers below a mount present it.
+type lowerEntry struct {
+	path string
+	info os.FileInfo
+}
+
+// mergeLowers indexes the paths the layers in lowerDirs, lowest first,
+// add up to, honoring their whiteouts.
+func mergeLowers(lowerDirs []string) (map[string]lowerEntry, error) {
+	merged := make(map[string]lowerEntry)
+	for _, dir := range lowerDirs {
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(dir, path)
+			if err != nil || rel == "." {
+				return err
+			}
+			removePrefix := func(prefix string) {
+				for key := range merged {
+					if key == prefix || strings.HasPrefix(key, prefix+"/") {
+						delete(merged, key)
+					}
+				}
+			}
+			if name, ok := whiteoutTarget(info); ok {
+				if name != "" {
+					removePrefix(filepath.Join(filepath.Dir(rel), name))
+				}
+				return nil
+			}
+			if existing, ok := merged[rel]; ok && (!existing.info.IsDir() || !info.IsDir() || opaqueDir(path)) {
+				removePrefix(rel)
+			}
+			merged[rel] = lowerEntry{path: path, info: info}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return merged, nil
+}
+
+// archiveChanges writes what differs between dir and the layers below it
+// to t: new and changed entries, and whiteouts for removed ones. It is
+// how diffs are taken of copied mounts, which have no upper directory.
+func archiveChanges(t *tarWriter, dir string, lowerDirs []string) error {
+	lower, err := mergeLowers(lowerDirs)
+	if err != nil {
+		return err
+	}
+
+	// seen holds the paths at dir, and whether each is a directory
+	seen := make(map[string]bool)
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		seen[rel] = info.IsDir()
+		if entry, ok := lower[rel]; ok && sameEntry(path, info, entry) {
+			return nil
+		}
+		return t.add(path, rel, info)
+	})
+	if err != nil {
+		return err
+	}
+
+	var removed []string
+	for rel := range lower {
+		if _, ok := seen[rel]; ok {
+			continue
+		}
+		// Whiting out a directory covers what is below it
+		if parent := filepath.Dir(rel); parent == "." || seen[parent] {
+			removed = append(removed, rel)
+		}
+	}
+	sort.Strings(removed)
+	for _, rel := range removed {
+		if err := t.addWhiteout(rel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sameEntry reports whether the entry at path is unchanged from the one
+// the layers below hold. Copies get new times, so contents are compared.
+func sameEntry(path string, info os.FileInfo, entry lowerEntry) bool {
+	if info.Mode() != entry.info.Mode() {
+		return false
+	}
+	switch {
+	case info.IsDir():
+		return true
+	case info.Mode()&os.ModeSymlink != 0:
+		a, errA := os.Readlink(path)
+		b, errB := os.Readlink(entry.path)
+		return errA == nil && errB == nil && a == b
+	case info.Mode().IsRegular():
+		return info.Size() == entry.info.Size() && sameContent(path, entry.path)
+	}
+	return true
+}
+
+func sameContent(a, b string) bool {
+	fa, err := os.Open(a)
+	if err != nil {
+		return false
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return false
+	}
+	defer fb.Close()
+
+	bufA, bufB := make([]byte, 32*1024), make([]byte, 32*1024)
+	for {
+		na, errA := io.ReadFull(fa, bufA)
+		nb, errB := io.ReadFull(fb, bufB)
+		if na != nb || !bytes.Equal(bufA[:na], bufB[:nb]) {
+			return false
+		}
+		if errA != nil || errB != nil {
+			return errA == errB || (errA == io.ErrUnexpectedEOF && errB == io.ErrUnexpectedEOF)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"docker-impl/pkg/store"
+)
+
+// BenchOptions sizes the storage benchmarks. Zero values take the
+// defaults.
+type BenchOptions struct {
+	// Dir is where scratch data is written; it should be on the
+	// filesystem being measured
+	Dir             string
+	LayerFiles      int
+	LayerFileSize   int
+	MountIterations int
+	VolumeSize      int64
+	StoreOps        int
+}
+
+// BenchResult is the outcome of one measurement next to the number a
+// reference host gets.
+type BenchResult struct {
+	Name     string  `json:"name"`
+	Value    float64 `json:"value"`
+	Unit     string  `json:"unit"`
+	Baseline float64 `json:"baseline"`
+	// LowerIsBetter is set for latencies
+	LowerIsBetter bool   `json:"lower_is_better,omitempty"`
+	Detail        string `json:"detail,omitempty"`
+}
+
+// Ratio compares the result with its baseline; above 1 is faster than
+// the reference host.
+func (r BenchResult) Ratio() float64 {
+	if r.Value == 0 || r.Baseline == 0 {
+		return 0
+	}
+	if r.LowerIsBetter {
+		return r.Baseline / r.Value
+	}
+	return r.Value / r.Baseline
+}
+
+// benchBaselines are the results of a 4 core host with a local NVMe SSD,
+// ext4 and native overlay mounts.
+var benchBaselines = map[string]float64{
+	"layer extract": 250,
+	"overlay mount": 4,
+	"volume write":  600,
+	"volume read":   2000,
+	"store write":   8000,
+	"store read":    25000,
+}
+
+func (o *BenchOptions) setDefaults() {
+	if o.LayerFiles <= 0 {
+		o.LayerFiles = 2000
+	}
+	if o.LayerFileSize <= 0 {
+		o.LayerFileSize = 32 * 1024
+	}
+	if o.MountIterations <= 0 {
+		o.MountIterations = 20
+	}
+	if o.VolumeSize <= 0 {
+		o.VolumeSize = 128 * 1024 * 1024
+	}
+	if o.StoreOps <= 0 {
+		o.StoreOps = 2000
+	}
+}
+
+// RunBench measures layer extraction throughput, mount latency, volume IO
+// and metadata store operations in a scratch directory under
+// options.Dir, which is removed afterwards.
+func RunBench(options BenchOptions) ([]BenchResult, error) {
+	options.setDefaults()
+	if err := os.MkdirAll(options.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create bench directory: %v", err)
+	}
+	dir, err := os.MkdirTemp(options.Dir, "bench-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create bench directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	driver, err := NewOverlayDriver(filepath.Join(dir, "overlay"))
+	if err != nil {
+		return nil, err
+	}
+	defer driver.Cleanup()
+
+	var results []BenchResult
+	extract, layerID, err := benchLayerExtract(driver, options)
+	if err != nil {
+		return nil, fmt.Errorf("layer extract: %v", err)
+	}
+	results = append(results, extract)
+
+	mount, err := benchMount(driver, layerID, filepath.Join(dir, "mounts"), options)
+	if err != nil {
+		return nil, fmt.Errorf("overlay mount: %v", err)
+	}
+	results = append(results, mount)
+
+	volume, err := benchVolume(filepath.Join(dir, "volumes"), options)
+	if err != nil {
+		return nil, fmt.Errorf("volume io: %v", err)
+	}
+	results = append(results, volume...)
+
+	metadata, err := benchStore(filepath.Join(dir, "store"), options)
+	if err != nil {
+		return nil, fmt.Errorf("metadata store: %v", err)
+	}
+	results = append(results, metadata...)
+
+	for i := range results {
+		results[i].Baseline = benchBaselines[results[i].Name]
+	}
+	return results, nil
+}
+
+func megabytesPerSecond(bytes int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(bytes) / (1024 * 1024) / elapsed.Seconds()
+}
+
+func benchLayerExtract(driver *OverlayDriver, options BenchOptions) (BenchResult, string, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	content := bytes.Repeat([]byte("x"), options.LayerFileSize)
+	for i := 0; i < options.LayerFiles; i++ {
+		hdr := &tar.Header{
+			Name:     fmt.Sprintf("usr/lib/bench/%03d/file-%d", i%100, i),
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Size:     int64(len(content)),
+			ModTime:  time.Now(),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return BenchResult{}, "", err
+		}
+		if _, err := tw.Write(content); err != nil {
+			return BenchResult{}, "", err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return BenchResult{}, "", err
+	}
+
+	layer, err := driver.CreateLayer("", fmt.Sprintf("sha256:%x", sha256.Sum256(buf.Bytes())))
+	if err != nil {
+		return BenchResult{}, "", err
+	}
+	start := time.Now()
+	diff, err := driver.ApplyDiff(layer.ID, &buf)
+	if err != nil {
+		return BenchResult{}, "", err
+	}
+	elapsed := time.Since(start)
+
+	return BenchResult{
+		Name:   "layer extract",
+		Value:  megabytesPerSecond(diff.Size, elapsed),
+		Unit:   "MB/s",
+		Detail: fmt.Sprintf("%d files in %s", len(diff.Added), elapsed.Round(time.Millisecond)),
+	}, layer.ID, nil
+}
+
+func benchMount(driver *OverlayDriver, layerID, dir string, options BenchOptions) (BenchResult, error) {
+	var total time.Duration
+	for i := 0; i < options.MountIterations; i++ {
+		mountPoint := filepath.Join(dir, fmt.Sprintf("%d", i))
+		start := time.Now()
+		if err := driver.Mount([]string{layerID}, mountPoint); err != nil {
+			return BenchResult{}, err
+		}
+		total += time.Since(start)
+		if err := driver.Unmount(mountPoint); err != nil {
+			return BenchResult{}, err
+		}
+	}
+
+	detail := "overlayfs"
+	if !driver.native {
+		detail = "copying layers, overlayfs is not available"
+	}
+	return BenchResult{
+		Name:          "overlay mount",
+		Value:         float64(total.Microseconds()) / 1000 / float64(options.MountIterations),
+		Unit:          "ms",
+		LowerIsBetter: true,
+		Detail:        detail,
+	}, nil
+}
+
+func benchVolume(dir string, options BenchOptions) ([]BenchResult, error) {
+	volumes, err := NewVolumeManager(dir)
+	if err != nil {
+		return nil, err
+	}
+	volume, err := volumes.CreateVolume("bench", "local", map[string]string{}, nil)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(volume.Mountpoint, "data")
+
+	chunk := bytes.Repeat([]byte{0xa5}, 1024*1024)
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	var written int64
+	for written < options.VolumeSize {
+		n, err := file.Write(chunk)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		written += int64(n)
+	}
+	// Count the time to reach the disk, not just the page cache
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	writeTime := time.Since(start)
+	file.Close()
+
+	file, err = os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	start = time.Now()
+	var read int64
+	for {
+		n, err := file.Read(chunk)
+		read += int64(n)
+		if err != nil {
+			break
+		}
+	}
+	readTime := time.Since(start)
+
+	return []BenchResult{
+		{Name: "volume write", Value: megabytesPerSecond(written, writeTime), Unit: "MB/s", Detail: "sequential, fsync"},
+		{Name: "volume read", Value: megabytesPerSecond(read, readTime), Unit: "MB/s", Detail: "sequential, may be cached"},
+	}, nil
+}
+
+func benchStore(dir string, options BenchOptions) ([]BenchResult, error) {
+	s, err := store.NewStore(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Roughly the size of a container's metadata
+	record := map[string]interface{}{
+		"id":      fmt.Sprintf("%x", sha256.Sum256([]byte("bench"))),
+		"name":    "bench",
+		"image":   "docker.io/library/alpine:latest",
+		"command": []string{"/bin/sh", "-c", "sleep infinity"},
+		"labels":  map[string]string{"com.example.bench": "true"},
+		"env":     []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"},
+	}
+	const keys = 100
+
+	start := time.Now()
+	for i := 0; i < options.StoreOps; i++ {
+		if err := s.SaveJSON(filepath.Join("bench", fmt.Sprintf("%d.json", i%keys)), record); err != nil {
+			return nil, err
+		}
+	}
+	writeTime := time.Since(start)
+
+	start = time.Now()
+	for i := 0; i < options.StoreOps; i++ {
+		var loaded map[string]interface{}
+		if err := s.LoadJSON(filepath.Join("bench", fmt.Sprintf("%d.json", i%keys)), &loaded); err != nil {
+			return nil, err
+		}
+	}
+	readTime := time.Since(start)
+
+	return []BenchResult{
+		{Name: "store write", Value: float64(options.StoreOps) / writeTime.Seconds(), Unit: "ops/s"},
+		{Name: "store read", Value: float64(options.StoreOps) / readTime.Seconds(), Unit: "ops/s"},
+	}, nil
+}
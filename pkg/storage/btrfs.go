@@ -0,0 +1,291 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// btrfsBinary is the btrfs-progs command subvolumes are managed with
+var btrfsBinary = "btrfs"
+
+const btrfsSuperMagic = 0x9123683e
+
+// BtrfsDriver keeps a subvolume per layer, holding the layer and everything
+// below it, made by snapshotting the subvolume of its parent and applying
+// the layer on top. A container's filesystem is a snapshot of its top
+// layer's subvolume, so creating one costs the same however big the image
+// is. baseDir must be on a btrfs filesystem.
+type BtrfsDriver struct {
+	*OverlayDriver
+}
+
+func NewBtrfsDriver(baseDir string) (*BtrfsDriver, error) {
+	if err := os.MkdirAll(baseDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory %s: %v", baseDir, err)
+	}
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(baseDir, &fs); err != nil {
+		return nil, fmt.Errorf("failed to stat filesystem of %s: %v", baseDir, err)
+	}
+	if uint32(fs.Type) != btrfsSuperMagic {
+		return nil, fmt.Errorf("btrfs driver needs %s to be on a btrfs filesystem", baseDir)
+	}
+	if _, err := exec.LookPath(btrfsBinary); err != nil {
+		return nil, fmt.Errorf("btrfs driver needs btrfs-progs: %v", err)
+	}
+
+	driver, err := newOverlayDriver("btrfs", baseDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(baseDir, "subvolumes"), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create subvolume directory: %v", err)
+	}
+	return &BtrfsDriver{OverlayDriver: driver}, nil
+}
+
+func btrfs(args ...string) error {
+	output, err := exec.Command(btrfsBinary, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("btrfs %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// layerSubvolume is the subvolume of the top layer of chain. Layers are
+// shared between images with different layers below them, so the
+// subvolume is named after the whole chain.
+func (d *BtrfsDriver) layerSubvolume(chain []string) string {
+	top := chain[len(chain)-1]
+	return filepath.Join(d.baseDir, "subvolumes", top, mountID(strings.Join(chain, "\n")))
+}
+
+// ensureSubvolume creates the subvolumes of chain that don't exist yet,
+// from the bottom up, and returns the one of its top layer.
+func (d *BtrfsDriver) ensureSubvolume(chain []string) (string, error) {
+	subvolume := d.layerSubvolume(chain)
+	if _, err := os.Stat(subvolume); err == nil {
+		return subvolume, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(subvolume), 0755); err != nil {
+		return "", fmt.Errorf("failed to create subvolume directory: %v", err)
+	}
+
+	if len(chain) == 1 {
+		if err := btrfs("subvolume", "create", subvolume); err != nil {
+			return "", err
+		}
+	} else {
+		parent, err := d.ensureSubvolume(chain[:len(chain)-1])
+		if err != nil {
+			return "", err
+		}
+		if err := btrfs("subvolume", "snapshot", parent, subvolume); err != nil {
+			return "", err
+		}
+	}
+
+	top := chain[len(chain)-1]
+	if err := applyLayerDiff(d.diffDir(top), subvolume); err != nil {
+		btrfs("subvolume", "delete", subvolume)
+		return "", fmt.Errorf("failed to apply layer %s: %v", top, err)
+	}
+	return subvolume, nil
+}
+
+// Mount snapshots the subvolume of the top layer and bind mounts the
+// snapshot at mountPoint. Mounting a mount point again reuses its
+// snapshot, so a container keeps its changes across restarts.
+func (d *BtrfsDriver) Mount(layers []string, mountPoint string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	logrus.Infof("Mounting layers %v to %s", layers, mountPoint)
+
+	var lowerDirs []string
+	for _, layerID := range layers {
+		if _, exists := d.layers[layerID]; !exists {
+			return fmt.Errorf("layer not found: %s", layerID)
+		}
+		lowerDirs = append(lowerDirs, d.diffDir(layerID))
+	}
+
+	if err := os.MkdirAll(mountPoint, 0755); err != nil {
+		return fmt.Errorf("failed to create mount point: %v", err)
+	}
+	mountDir := d.overlayDir(mountPoint)
+	if err := os.MkdirAll(mountDir, 0755); err != nil {
+		return fmt.Errorf("failed to create mount directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(mountDir, "lower"), []byte(strings.Join(lowerDirs, "\n")), 0644); err != nil {
+		return fmt.Errorf("failed to record mount layers: %v", err)
+	}
+
+	mounted, err := isMountPoint(mountPoint)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		d.mountPoints[mountPoint] = &mountInfo{overlayDir: mountDir, native: true}
+		return nil
+	}
+
+	snapshot := filepath.Join(mountDir, "rootfs")
+	if _, err := os.Stat(snapshot); os.IsNotExist(err) {
+		if len(layers) == 0 {
+			err = btrfs("subvolume", "create", snapshot)
+		} else {
+			var subvolume string
+			subvolume, err = d.ensureSubvolume(layers)
+			if err == nil {
+				err = btrfs("subvolume", "snapshot", subvolume, snapshot)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create container snapshot: %v", err)
+		}
+	}
+
+	if err := syscall.Mount(snapshot, mountPoint, "", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("failed to mount snapshot at %s: %v", mountPoint, err)
+	}
+	d.mountPoints[mountPoint] = &mountInfo{overlayDir: mountDir, native: true}
+	logrus.Infof("Mounted btrfs snapshot at %s", mountPoint)
+	return nil
+}
+
+// Unmount unmounts mountPoint and deletes its snapshot.
+func (d *BtrfsDriver) Unmount(mountPoint string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.unmount(mountPoint)
+}
+
+func (d *BtrfsDriver) unmount(mountPoint string) error {
+	logrus.Infof("Unmounting %s", mountPoint)
+
+	if err := unmountBelow(mountPoint); err != nil {
+		return err
+	}
+	mounted, err := isMountPoint(mountPoint)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		if err := syscall.Unmount(mountPoint, syscall.MNT_DETACH); err != nil {
+			return fmt.Errorf("failed to unmount: %v", err)
+		}
+	}
+	if err := os.RemoveAll(mountPoint); err != nil {
+		return fmt.Errorf("failed to remove mount point: %v", err)
+	}
+
+	mountDir := d.overlayDir(mountPoint)
+	snapshot := filepath.Join(mountDir, "rootfs")
+	if _, err := os.Stat(snapshot); err == nil {
+		if err := btrfs("subvolume", "delete", snapshot); err != nil {
+			return fmt.Errorf("failed to delete container snapshot: %v", err)
+		}
+	}
+	if err := os.RemoveAll(mountDir); err != nil {
+		logrus.Warnf("Failed to remove mount directory: %v", err)
+	}
+	delete(d.mountPoints, mountPoint)
+
+	logrus.Infof("Unmounted %s", mountPoint)
+	return nil
+}
+
+// Diff compares the container's snapshot with its layers.
+func (d *BtrfsDriver) Diff(mountPoint string) (io.ReadCloser, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	data, err := os.ReadFile(filepath.Join(d.overlayDir(mountPoint), "lower"))
+	if err != nil {
+		return nil, fmt.Errorf("mount point not found: %s", mountPoint)
+	}
+	var lowerDirs []string
+	if len(data) > 0 {
+		lowerDirs = strings.Split(string(data), "\n")
+	}
+	return pipeTar(func(t *tarWriter) error {
+		return archiveChanges(t, mountPoint, lowerDirs)
+	}), nil
+}
+
+// WritableDir is not supported: a snapshot shares its extents with the
+// layers, so what the container wrote can't be told apart by a quota on
+// a directory.
+func (d *BtrfsDriver) WritableDir(mountPoint string) (string, error) {
+	return "", fmt.Errorf("quotas are not supported by the btrfs driver")
+}
+
+// DeleteLayer deletes the layer along with its subvolumes.
+func (d *BtrfsDriver) DeleteLayer(layerID string) error {
+	if err := d.OverlayDriver.DeleteLayer(layerID); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.deleteSubvolumes(layerID)
+}
+
+func (d *BtrfsDriver) GarbageCollect() (*LayerPruneReport, error) {
+	report, err := d.OverlayDriver.GarbageCollect()
+	if report == nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, layerID := range report.LayersDeleted {
+		if err := d.deleteSubvolumes(layerID); err != nil {
+			logrus.Warnf("Failed to delete subvolumes of layer %s: %v", layerID, err)
+		}
+	}
+	return report, err
+}
+
+// deleteSubvolumes deletes the subvolumes of layerID, one for every chain
+// of layers below it that was mounted.
+func (d *BtrfsDriver) deleteSubvolumes(layerID string) error {
+	dir := filepath.Join(d.baseDir, "subvolumes", layerID)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		if err := btrfs("subvolume", "delete", filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(dir)
+}
+
+func (d *BtrfsDriver) Cleanup() error {
+	d.mu.Lock()
+	for mountPoint := range d.mountPoints {
+		if err := d.unmount(mountPoint); err != nil {
+			logrus.Warnf("Failed to unmount %s: %v", mountPoint, err)
+		}
+	}
+	for layerID := range d.layers {
+		if err := d.deleteSubvolumes(layerID); err != nil {
+			logrus.Warnf("Failed to delete subvolumes of layer %s: %v", layerID, err)
+		}
+	}
+	d.mu.Unlock()
+
+	return d.OverlayDriver.Cleanup()
+}
@@ -0,0 +1,384 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// cryptsetupBinary manages the dm-crypt devices encrypted volumes and the
+// encrypted layer store are opened with
+var cryptsetupBinary = "cryptsetup"
+
+const (
+	defaultCryptVolumeSize = 10 << 30
+	defaultLayerStoreSize  = 100 << 30
+	minMasterKeyLength     = 32
+)
+
+// KeyProvider hands out the key of an encrypted volume or of the layer
+// store by ID. The same ID must always give the same key.
+type KeyProvider interface {
+	Key(id string) ([]byte, error)
+}
+
+// NewKeyProvider reads keys from keyFile, or from keyCommand when it is
+// set, which lets them come from an external KMS.
+func NewKeyProvider(keyFile, keyCommand string) (KeyProvider, error) {
+	if keyCommand != "" {
+		args := strings.Fields(keyCommand)
+		if len(args) == 0 {
+			return nil, fmt.Errorf("invalid key command %q", keyCommand)
+		}
+		return &commandKeyProvider{command: args[0], args: args[1:]}, nil
+	}
+	if keyFile == "" {
+		return nil, fmt.Errorf("encryption needs a key file or a key command")
+	}
+	return newFileKeyProvider(keyFile)
+}
+
+// fileKeyProvider derives the key of every ID from one master key, so
+// a single file protects all volumes without them sharing a key.
+type fileKeyProvider struct {
+	master []byte
+}
+
+func newFileKeyProvider(path string) (*fileKeyProvider, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encryption key: %v", err)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("encryption key %s must not be accessible by group or others (mode %o)", path, info.Mode().Perm())
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encryption key: %v", err)
+	}
+	master := bytes.TrimSpace(data)
+	if len(master) < minMasterKeyLength {
+		return nil, fmt.Errorf("encryption key %s is too short: need at least %d bytes", path, minMasterKeyLength)
+	}
+	return &fileKeyProvider{master: master}, nil
+}
+
+func (p *fileKeyProvider) Key(id string) ([]byte, error) {
+	mac := hmac.New(sha256.New, p.master)
+	mac.Write([]byte(id))
+	return []byte(hex.EncodeToString(mac.Sum(nil))), nil
+}
+
+// commandKeyProvider runs a KMS hook with the key ID as its last argument
+// and reads the key from its output.
+type commandKeyProvider struct {
+	command string
+	args    []string
+}
+
+func (p *commandKeyProvider) Key(id string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(p.command, append(append([]string(nil), p.args...), id)...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("key command failed for %s: %v: %s", id, err, strings.TrimSpace(stderr.String()))
+	}
+	key := bytes.TrimSpace(stdout.Bytes())
+	if len(key) == 0 {
+		return nil, fmt.Errorf("key command returned no key for %s", id)
+	}
+	return key, nil
+}
+
+// encryptedFS is an ext4 filesystem in a LUKS image, opened with dm-crypt
+// and mounted on a directory. The image is created the first time it is
+// opened.
+type encryptedFS struct {
+	image      string
+	mountPoint string
+	size       int64
+}
+
+// device is the dm-crypt mapping of the image, named after its path so
+// that two images never share one.
+func (fs encryptedFS) device() string {
+	sum := sha256.Sum256([]byte(fs.image))
+	return "mydocker-" + hex.EncodeToString(sum[:8])
+}
+
+func (fs encryptedFS) devicePath() string {
+	return filepath.Join("/dev/mapper", fs.device())
+}
+
+func (fs encryptedFS) open(key []byte) error {
+	if mounted, err := isMountPoint(fs.mountPoint); err != nil || mounted {
+		return err
+	}
+
+	fresh := false
+	if _, err := os.Stat(fs.image); os.IsNotExist(err) {
+		// Whatever is already in the directory would be hidden by the mount
+		entries, err := os.ReadDir(fs.mountPoint)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return fmt.Errorf("%s is not empty", fs.mountPoint)
+		}
+		if err := fs.format(key); err != nil {
+			os.Remove(fs.image)
+			return err
+		}
+		fresh = true
+	}
+
+	opened := false
+	if _, err := os.Stat(fs.devicePath()); os.IsNotExist(err) {
+		if err := runCryptsetup(key, "open", "--type", "luks", "--key-file", "-", fs.image, fs.device()); err != nil {
+			if fresh {
+				os.Remove(fs.image)
+			}
+			return err
+		}
+		opened = true
+	}
+	fail := func(err error) error {
+		if opened {
+			runCryptsetup(nil, "close", fs.device())
+		}
+		if fresh {
+			os.Remove(fs.image)
+		}
+		return err
+	}
+
+	if fresh {
+		// No blocks are reserved for root, so all of size can be used
+		output, err := exec.Command(mkfsBinary, "-q", "-F", "-m", "0", fs.devicePath()).CombinedOutput()
+		if err != nil {
+			return fail(fmt.Errorf("%s: %v: %s", mkfsBinary, err, strings.TrimSpace(string(output))))
+		}
+	}
+	output, err := exec.Command("mount", fs.devicePath(), fs.mountPoint).CombinedOutput()
+	if err != nil {
+		return fail(fmt.Errorf("failed to mount %s: %v: %s", fs.image, err, strings.TrimSpace(string(output))))
+	}
+	if fresh {
+		os.RemoveAll(filepath.Join(fs.mountPoint, "lost+found"))
+	}
+	return nil
+}
+
+// format creates the image as a sparse file of size and formats it as
+// LUKS with key.
+func (fs encryptedFS) format(key []byte) error {
+	if err := os.MkdirAll(filepath.Dir(fs.image), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(fs.image, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(fs.size)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return runCryptsetup(key, "luksFormat", "--batch-mode", "--type", "luks2", "--key-file", "-", fs.image)
+}
+
+// close unmounts the filesystem and closes its device, deleting the image
+// as well with remove.
+func (fs encryptedFS) close(remove bool) error {
+	if mounted, _ := isMountPoint(fs.mountPoint); mounted {
+		if err := syscall.Unmount(fs.mountPoint, 0); err != nil {
+			return fmt.Errorf("failed to unmount %s: %v", fs.mountPoint, err)
+		}
+	}
+	if _, err := os.Stat(fs.devicePath()); err == nil {
+		if err := runCryptsetup(nil, "close", fs.device()); err != nil {
+			return err
+		}
+	}
+	if remove {
+		if err := os.Remove(fs.image); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// runCryptsetup runs cryptsetup, handing it key on stdin.
+func runCryptsetup(key []byte, args ...string) error {
+	cmd := exec.Command(cryptsetupBinary, args...)
+	cmd.Stdin = bytes.NewReader(key)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %v: %s", cryptsetupBinary, args[0], err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// CryptVolumeDriver keeps each volume in its own LUKS image, so volume
+// data is encrypted at rest with a key of its own. A volume stays open
+// while the daemon runs and is opened again on first use after a
+// restart. It takes the option size (10g by default); images are sparse.
+type CryptVolumeDriver struct {
+	baseDir string
+	keys    KeyProvider
+}
+
+func NewCryptVolumeDriver(baseDir string, keys KeyProvider) *CryptVolumeDriver {
+	return &CryptVolumeDriver{baseDir: baseDir, keys: keys}
+}
+
+func (d *CryptVolumeDriver) Name() string {
+	return "crypt"
+}
+
+func cryptVolumeSize(options map[string]string) (int64, error) {
+	for key := range options {
+		if key != "size" {
+			return 0, fmt.Errorf("unknown crypt volume option: %s", key)
+		}
+	}
+	value, ok := options["size"]
+	if !ok {
+		return defaultCryptVolumeSize, nil
+	}
+	size, err := ParseSize(value)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("invalid crypt volume size: %s", value)
+	}
+	return size, nil
+}
+
+func (d *CryptVolumeDriver) filesystem(volume *Volume) (encryptedFS, error) {
+	size, err := cryptVolumeSize(volume.Options)
+	if err != nil {
+		return encryptedFS{}, err
+	}
+	return encryptedFS{
+		image:      filepath.Join(d.baseDir, "crypt", volume.Name+".img"),
+		mountPoint: volume.Mountpoint,
+		size:       size,
+	}, nil
+}
+
+func (d *CryptVolumeDriver) open(volume *Volume) error {
+	fs, err := d.filesystem(volume)
+	if err != nil {
+		return err
+	}
+	key, err := d.keys.Key("volume:" + volume.Name)
+	if err != nil {
+		return err
+	}
+	return fs.open(key)
+}
+
+func (d *CryptVolumeDriver) Create(name string, options map[string]string) (*Volume, error) {
+	if _, err := cryptVolumeSize(options); err != nil {
+		return nil, err
+	}
+
+	volumePath := filepath.Join(d.baseDir, name)
+	if err := os.MkdirAll(volumePath, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create volume directory: %v", err)
+	}
+
+	volume := newVolume(name, "crypt", volumePath, options)
+	if err := d.open(volume); err != nil {
+		os.Remove(volumePath)
+		return nil, fmt.Errorf("failed to create encrypted volume: %v", err)
+	}
+
+	logrus.Infof("Created encrypted volume: %s at %s", name, volumePath)
+	return volume, nil
+}
+
+func (d *CryptVolumeDriver) Remove(volume *Volume) error {
+	if volume.UsageData.RefCount > 0 {
+		return fmt.Errorf("volume %s is still in use (%d references)", volume.Name, volume.UsageData.RefCount)
+	}
+
+	fs, err := d.filesystem(volume)
+	if err != nil {
+		return err
+	}
+	if err := fs.close(true); err != nil {
+		return fmt.Errorf("failed to close encrypted volume: %v", err)
+	}
+	if err := os.RemoveAll(volume.Mountpoint); err != nil {
+		return fmt.Errorf("failed to remove volume directory: %v", err)
+	}
+
+	logrus.Infof("Removed encrypted volume: %s", volume.Name)
+	return nil
+}
+
+func (d *CryptVolumeDriver) Mount(volume *Volume, target string) error {
+	if err := d.open(volume); err != nil {
+		return fmt.Errorf("failed to open encrypted volume: %v", err)
+	}
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return fmt.Errorf("failed to create mount target: %v", err)
+	}
+
+	logrus.Infof("Mounted encrypted volume %s to %s", volume.Name, target)
+	return nil
+}
+
+func (d *CryptVolumeDriver) Unmount(volume *Volume, target string) error {
+	// The volume stays open for the other containers using it
+	logrus.Infof("Unmounted encrypted volume %s from %s", volume.Name, target)
+	return nil
+}
+
+func (d *CryptVolumeDriver) GetPath(volume *Volume) string {
+	return volume.Mountpoint
+}
+
+func (d *CryptVolumeDriver) Usage(volume *Volume) (*UsageData, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(volume.Mountpoint, &stat); err != nil {
+		return nil, fmt.Errorf("failed to calculate volume size: %v", err)
+	}
+
+	volume.UsageData.Size = int64(stat.Blocks-stat.Bfree) * int64(stat.Bsize)
+	return volume.UsageData, nil
+}
+
+// openLayerStore mounts the encrypted filesystem image and container
+// layers are kept in, creating it the first time.
+func openLayerStore(baseDir string, size int64, keys KeyProvider) (string, error) {
+	if size <= 0 {
+		size = defaultLayerStoreSize
+	}
+	fs := encryptedFS{
+		image:      filepath.Join(baseDir, "layers.img"),
+		mountPoint: filepath.Join(baseDir, "encrypted"),
+		size:       size,
+	}
+	if err := os.MkdirAll(fs.mountPoint, 0700); err != nil {
+		return "", fmt.Errorf("failed to create layer store directory: %v", err)
+	}
+	key, err := keys.Key("layers")
+	if err != nil {
+		return "", err
+	}
+	if err := fs.open(key); err != nil {
+		return "", fmt.Errorf("failed to open encrypted layer store: %v", err)
+	}
+	return fs.mountPoint, nil
+}
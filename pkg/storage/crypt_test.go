@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileKeyProvider(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "key")
+	require.NoError(t, os.WriteFile(keyFile, []byte(strings.Repeat("k", 32)+"\n"), 0600))
+
+	keys, err := NewKeyProvider(keyFile, "")
+	require.NoError(t, err)
+	a, err := keys.Key("volume:a")
+	require.NoError(t, err)
+	again, err := keys.Key("volume:a")
+	require.NoError(t, err)
+	b, err := keys.Key("volume:b")
+	require.NoError(t, err)
+	assert.Equal(t, a, again)
+	assert.NotEqual(t, a, b, "each volume gets a key of its own")
+
+	require.NoError(t, os.Chmod(keyFile, 0644))
+	_, err = NewKeyProvider(keyFile, "")
+	assert.Error(t, err, "keys readable by others are refused")
+
+	require.NoError(t, os.WriteFile(keyFile, []byte("short"), 0600))
+	require.NoError(t, os.Chmod(keyFile, 0600))
+	_, err = NewKeyProvider(keyFile, "")
+	assert.Error(t, err)
+
+	_, err = NewKeyProvider("", "")
+	assert.Error(t, err)
+}
+
+func TestCommandKeyProvider(t *testing.T) {
+	keys, err := NewKeyProvider("", "echo kms-key")
+	require.NoError(t, err)
+	key, err := keys.Key("layers")
+	require.NoError(t, err)
+	assert.Equal(t, "kms-key layers", string(key))
+
+	keys, err = NewKeyProvider("", "false")
+	require.NoError(t, err)
+	_, err = keys.Key("layers")
+	assert.Error(t, err)
+
+	_, err = NewKeyProvider("", "   ")
+	assert.ErrorContains(t, err, "invalid key command", "a blank key command is refused")
+}
+
+func TestCryptVolumeSize(t *testing.T) {
+	size, err := cryptVolumeSize(nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(defaultCryptVolumeSize), size)
+
+	size, err = cryptVolumeSize(map[string]string{"size": "1g"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1<<30), size)
+
+	_, err = cryptVolumeSize(map[string]string{"cipher": "aes"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+// GraphDriver stores image layers and assembles container filesystems
+// from them.
+type GraphDriver interface {
+	Name() string
+
+	CreateLayer(parentID, diffID string) (*Layer, error)
+	ApplyDiff(layerID string, diff io.Reader) (*Diff, error)
+	ImportLayer(layerID, parentID, src string) (*Layer, error)
+	GetLayer(layerID string) (*Layer, error)
+	ListLayers() ([]*Layer, error)
+	DeleteLayer(layerID string) error
+	GetDiff(layerID string) (*Diff, error)
+	SquashLayers(layerIDs []string) (*Layer, error)
+
+	AddReferences(owner string, layerIDs []string) error
+	RemoveReferences(owner string) error
+	GarbageCollect() (*LayerPruneReport, error)
+
+	// Mount assembles layers, lowest first, at mountPoint with a writable
+	// layer on top; Unmount removes mountPoint with its writable layer.
+	Mount(layers []string, mountPoint string) error
+	Unmount(mountPoint string) error
+	// Diff returns a tar stream of the changes made at mountPoint.
+	Diff(mountPoint string) (io.ReadCloser, error)
+	// WritableDir is the directory that holds what is written at
+	// mountPoint, which quotas are set on before it is mounted.
+	WritableDir(mountPoint string) (string, error)
+
+	GetUsageStats() map[string]interface{}
+	Cleanup() error
+}
+
+// GraphDrivers are the names NewGraphDriver accepts.
+var GraphDrivers = []string{"overlay", "vfs", "btrfs"}
+
+// NewGraphDriver creates the driver called name, keeping its data in a
+// directory of that name under baseDir. An empty name is overlay.
+func NewGraphDriver(name, baseDir string) (GraphDriver, error) {
+	switch name {
+	case "", "overlay", "overlay2":
+		return NewOverlayDriver(filepath.Join(baseDir, "overlay"))
+	case "vfs":
+		return NewVFSDriver(filepath.Join(baseDir, "vfs"))
+	case "btrfs":
+		return NewBtrfsDriver(filepath.Join(baseDir, "btrfs"))
+	default:
+		return nil, fmt.Errorf("unsupported storage driver: %s (supported: %v)", name, GraphDrivers)
+	}
+}
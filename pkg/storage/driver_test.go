@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewGraphDriver(t *testing.T) {
+	driver, err := NewGraphDriver("vfs", t.TempDir())
+	require.NoError(t, err)
+	assert.Equal(t, "vfs", driver.Name())
+
+	_, err = NewGraphDriver("zfs", t.TempDir())
+	assert.Error(t, err)
+}
+
+func TestVFSDriver(t *testing.T) {
+	driver, err := NewVFSDriver(t.TempDir())
+	require.NoError(t, err)
+
+	lower, upper := t.TempDir(), t.TempDir()
+	writeLayer(t, lower, map[string]string{"etc/os-release": "v1", "bin/tool": "tool"})
+	writeLayer(t, upper, map[string]string{"bin/.wh.tool": ""})
+	_, err = driver.ImportLayer("sha256:lower", "", lower)
+	require.NoError(t, err)
+	_, err = driver.ImportLayer("sha256:upper", "sha256:lower", upper)
+	require.NoError(t, err)
+
+	mountPoint := filepath.Join(t.TempDir(), "rootfs")
+	require.NoError(t, driver.Mount([]string{"sha256:lower", "sha256:upper"}, mountPoint))
+	defer driver.Unmount(mountPoint)
+
+	mounted, err := isMountPoint(mountPoint)
+	require.NoError(t, err)
+	assert.False(t, mounted, "vfs should copy layers instead of mounting")
+	data, err := os.ReadFile(filepath.Join(mountPoint, "etc/os-release"))
+	require.NoError(t, err)
+	assert.Equal(t, "v1", string(data))
+	_, err = os.Lstat(filepath.Join(mountPoint, "bin/tool"))
+	assert.True(t, os.IsNotExist(err))
+
+	require.NoError(t, os.WriteFile(filepath.Join(mountPoint, "etc/os-release"), []byte("v2"), 0644))
+	diff, err := driver.Diff(mountPoint)
+	require.NoError(t, err)
+	headers := readTar(t, diff)
+	assert.Contains(t, headers, "etc/os-release")
+	assert.NotContains(t, headers, "bin/.wh.tool", "Deletions made by layers are not changes")
+}
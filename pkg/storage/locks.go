@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+// lockStripes is how many locks objects are spread over. Objects that
+// share a stripe wait on each other, which is rare enough with this many.
+const lockStripes = 64
+
+// stripedLocks locks layers, containers and volumes by key, so operations
+// on different objects run in parallel.
+type stripedLocks struct {
+	stripes [lockStripes]sync.RWMutex
+}
+
+func stripe(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % lockStripes)
+}
+
+// lock takes the stripes of write exclusively and those of read shared,
+// and returns the function that releases them. Stripes are always taken
+// in the same order, so callers can't deadlock each other whatever keys
+// they name.
+func (l *stripedLocks) lock(write, read []string) func() {
+	modes := make(map[int]bool)
+	for _, key := range read {
+		modes[stripe(key)] = false
+	}
+	for _, key := range write {
+		modes[stripe(key)] = true
+	}
+	order := make([]int, 0, len(modes))
+	for i := range modes {
+		order = append(order, i)
+	}
+	sort.Ints(order)
+
+	for _, i := range order {
+		if modes[i] {
+			l.stripes[i].Lock()
+		} else {
+			l.stripes[i].RLock()
+		}
+	}
+	return func() {
+		for j := len(order) - 1; j >= 0; j-- {
+			if i := order[j]; modes[i] {
+				l.stripes[i].Unlock()
+			} else {
+				l.stripes[i].RUnlock()
+			}
+		}
+	}
+}
+
+func layerKey(layerID string) string {
+	return "layer:" + layerID
+}
+
+// optionalLayerKeys locks the parent of a layer, when it has one.
+func optionalLayerKeys(layerID string) []string {
+	if layerID == "" {
+		return nil
+	}
+	return []string{layerKey(layerID)}
+}
+
+func layerKeys(layerIDs []string) []string {
+	keys := make([]string, 0, len(layerIDs))
+	for _, layerID := range layerIDs {
+		keys = append(keys, layerKey(layerID))
+	}
+	return keys
+}
+
+func volumeMountKeys(mounts []VolumeMount) []string {
+	keys := make([]string, 0, len(mounts))
+	for _, mount := range mounts {
+		keys = append(keys, volumeOwner(mount.Name))
+	}
+	return keys
+}
@@ -1,34 +1,78 @@
 package storage
 
 import (
+	"archive/tar"
+	"encoding/json"
 	"fmt"
 	"io"
+	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 
+	"docker-impl/pkg/timeutil"
 	"github.com/sirupsen/logrus"
 )
 
 type StorageManager struct {
-	overlayDriver *OverlayDriver
+	driver        GraphDriver
 	volumeManager *VolumeManager
-	baseDir       string
+	// quotas limits the size of containers and volumes; it is nil unless
+	// EnableQuotas is set
+	quotas  *QuotaController
+	baseDir string
+	// mu is held exclusively by operations across all objects, such as
+	// pruning, and shared by the rest, which also lock the layers,
+	// containers and volumes they touch in locks
 	mu            sync.RWMutex
+	locks         stripedLocks
+
+	// sizes caches ContainerSize, since measuring what a container wrote
+	// walks its whole writable layer
+	sizes   map[string]cachedContainerSize
+	sizesMu sync.Mutex
+}
+
+// ContainerSize is the disk usage of a container's filesystem. SizeRw is
+// what the container wrote itself; SizeRootFs adds the image layers it
+// shares with other containers, and is the size the container appears to
+// have.
+type ContainerSize struct {
+	SizeRw     int64 `json:"size_rw"`
+	SizeRootFs int64 `json:"size_root_fs"`
 }
 
+type cachedContainerSize struct {
+	size       ContainerSize
+	measuredAt time.Time
+}
+
+// containerSizeTTL is how long a measured container size is reused.
+const containerSizeTTL = 30 * time.Second
+
 type StorageConfig struct {
-	RootDir          string `json:"root_dir"`
+	RootDir string `json:"root_dir"`
+	// OverlayDriver names the graph driver: overlay, vfs or btrfs
 	OverlayDriver    string `json:"overlay_driver"`
 	VolumeDriver     string `json:"volume_driver"`
 	EnableQuotas     bool   `json:"enable_quotas"`
 	EnableEncryption bool   `json:"enable_encryption"`
+	// With EnableEncryption, volume keys are derived from the master key
+	// in EncryptionKeyFile, or printed by EncryptionKeyCommand given the
+	// key ID. EncryptLayers keeps the layer store in an encrypted image of
+	// LayerStoreSize bytes (100g when zero) as well.
+	EncryptionKeyFile    string `json:"encryption_key_file"`
+	EncryptionKeyCommand string `json:"encryption_key_command"`
+	EncryptLayers        bool   `json:"encrypt_layers"`
+	LayerStoreSize       int64  `json:"layer_store_size"`
 }
 
 type ImageLayer struct {
 	ID        string `json:"id"`
 	Digest    string `json:"digest"`
 	Size      int64  `json:"size"`
-	Created   string `json:"created"`
+	Created   time.Time `json:"created"`
 	ChainID   string `json:"chain_id"`
 	DiffID    string `json:"diff_id"`
 	ParentID  string `json:"parent_id"`
@@ -41,7 +85,7 @@ type ContainerStorage struct {
 	MountPoint   string   `json:"mount_point"`
 	VolumeMounts []VolumeMount `json:"volume_mounts"`
 	Size         int64    `json:"size"`
-	Created      string   `json:"created"`
+	Created      time.Time `json:"created"`
 }
 
 type VolumeMount struct {
@@ -62,6 +106,7 @@ func NewStorageManager(config *StorageConfig) (*StorageManager, error) {
 
 	sm := &StorageManager{
 		baseDir: config.RootDir,
+		sizes:   make(map[string]cachedContainerSize),
 	}
 
 	if err := sm.init(config); err != nil {
@@ -75,7 +120,6 @@ func (sm *StorageManager) init(config *StorageConfig) error {
 	// Create base directories
 	dirs := []string{
 		sm.baseDir,
-		filepath.Join(sm.baseDir, "overlay"),
 		filepath.Join(sm.baseDir, "volumes"),
 		filepath.Join(sm.baseDir, "images"),
 		filepath.Join(sm.baseDir, "containers"),
@@ -87,13 +131,34 @@ func (sm *StorageManager) init(config *StorageConfig) error {
 		}
 	}
 
-	// Initialize overlay driver
-	overlayDir := filepath.Join(sm.baseDir, "overlay")
-	overlayDriver, err := NewOverlayDriver(overlayDir)
+	var keys KeyProvider
+	if config.EnableEncryption {
+		var err error
+		if keys, err = NewKeyProvider(config.EncryptionKeyFile, config.EncryptionKeyCommand); err != nil {
+			return err
+		}
+	}
+
+	// Initialize graph driver
+	layerDir := sm.baseDir
+	if config.EncryptLayers {
+		if keys == nil {
+			return fmt.Errorf("encrypted layers need encryption to be enabled")
+		}
+		if config.OverlayDriver == "btrfs" {
+			return fmt.Errorf("encrypted layers are not supported with btrfs")
+		}
+		dir, err := openLayerStore(sm.baseDir, config.LayerStoreSize, keys)
+		if err != nil {
+			return err
+		}
+		layerDir = dir
+	}
+	driver, err := NewGraphDriver(config.OverlayDriver, layerDir)
 	if err != nil {
-		return fmt.Errorf("failed to create overlay driver: %v", err)
+		return fmt.Errorf("failed to create storage driver: %v", err)
 	}
-	sm.overlayDriver = overlayDriver
+	sm.driver = driver
 
 	// Initialize volume manager
 	volumeDir := filepath.Join(sm.baseDir, "volumes")
@@ -102,27 +167,66 @@ func (sm *StorageManager) init(config *StorageConfig) error {
 		return fmt.Errorf("failed to create volume manager: %v", err)
 	}
 	sm.volumeManager = volumeManager
+	if keys != nil {
+		volumeManager.AddDriver(NewCryptVolumeDriver(volumeDir, keys))
+		if config.VolumeDriver == "" {
+			config.VolumeDriver = "crypt"
+		}
+	}
+	if config.VolumeDriver != "" {
+		if err := volumeManager.SetDefaultDriver(config.VolumeDriver); err != nil {
+			return err
+		}
+	}
+
+	if config.EnableQuotas {
+		quotas, err := NewQuotaController(filepath.Join(sm.baseDir, "quotas"))
+		if err != nil {
+			return fmt.Errorf("failed to enable quotas: %v", err)
+		}
+		sm.quotas = quotas
+
+		// The images of loopback quotas aren't mounted after a reboot;
+		// containers set theirs again when they start
+		for _, quota := range quotas.ListQuotas() {
+			if strings.HasPrefix(quota.Owner, "volume:") {
+				if err := quotas.SetQuota(quota.Owner, quota.Path, quota.Size); err != nil {
+					logrus.Warnf("Failed to restore quota of %s: %v", quota.Owner, err)
+				}
+			}
+		}
+	}
 
 	logrus.Infof("Storage manager initialized with base directory: %s", sm.baseDir)
 	return nil
 }
 
+// lock locks the given objects for an operation that leaves the others
+// alone, returning the function that unlocks them.
+func (sm *StorageManager) lock(write, read []string) func() {
+	sm.mu.RLock()
+	unlock := sm.locks.lock(write, read)
+	return func() {
+		unlock()
+		sm.mu.RUnlock()
+	}
+}
+
 func (sm *StorageManager) CreateImageLayer(parentID, diffID string, diff io.Reader) (*ImageLayer, error) {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
+	defer sm.lock([]string{"diff:" + diffID}, optionalLayerKeys(parentID))()
 
 	logrus.Infof("Creating image layer with parent %s", parentID)
 
 	// Create layer
-	layer, err := sm.overlayDriver.CreateLayer(parentID, diffID)
+	layer, err := sm.driver.CreateLayer(parentID, diffID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create layer: %v", err)
 	}
 
 	// Apply diff
-	diffStats, err := sm.overlayDriver.ApplyDiff(layer.ID, diff)
+	diffStats, err := sm.driver.ApplyDiff(layer.ID, diff)
 	if err != nil {
-		sm.overlayDriver.DeleteLayer(layer.ID)
+		sm.driver.DeleteLayer(layer.ID)
 		return nil, fmt.Errorf("failed to apply diff: %v", err)
 	}
 
@@ -141,11 +245,31 @@ func (sm *StorageManager) CreateImageLayer(parentID, diffID string, diff io.Read
 	return imageLayer, nil
 }
 
+// ImportImageLayer stores a layer kept by the image manager, whose content
+// is the directory dir, so containers can be mounted from it.
+func (sm *StorageManager) ImportImageLayer(layerID, parentID, dir string) (*ImageLayer, error) {
+	defer sm.lock([]string{layerKey(layerID)}, optionalLayerKeys(parentID))()
+
+	layer, err := sm.driver.ImportLayer(layerID, parentID, dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to import layer: %v", err)
+	}
+
+	return &ImageLayer{
+		ID:       layer.ID,
+		Digest:   layer.Digest,
+		Size:     layer.Size,
+		Created:  layer.Created,
+		ChainID:  layer.ChainID,
+		DiffID:   layer.DiffID,
+		ParentID: layer.Parent,
+	}, nil
+}
+
 func (sm *StorageManager) GetImageLayer(layerID string) (*ImageLayer, error) {
-	sm.mu.RLock()
-	defer sm.mu.RUnlock()
+	defer sm.lock(nil, []string{layerKey(layerID)})()
 
-	layer, err := sm.overlayDriver.GetLayer(layerID)
+	layer, err := sm.driver.GetLayer(layerID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get layer: %v", err)
 	}
@@ -165,7 +289,7 @@ func (sm *StorageManager) ListImageLayers() ([]*ImageLayer, error) {
 	sm.mu.RLock()
 	defer sm.mu.RUnlock()
 
-	layers, err := sm.overlayDriver.ListLayers()
+	layers, err := sm.driver.ListLayers()
 	if err != nil {
 		return nil, fmt.Errorf("failed to list layers: %v", err)
 	}
@@ -187,12 +311,11 @@ func (sm *StorageManager) ListImageLayers() ([]*ImageLayer, error) {
 }
 
 func (sm *StorageManager) DeleteImageLayer(layerID string) error {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
+	defer sm.lock([]string{layerKey(layerID)}, nil)()
 
 	logrus.Infof("Deleting image layer: %s", layerID)
 
-	if err := sm.overlayDriver.DeleteLayer(layerID); err != nil {
+	if err := sm.driver.DeleteLayer(layerID); err != nil {
 		return fmt.Errorf("failed to delete layer: %v", err)
 	}
 
@@ -200,27 +323,97 @@ func (sm *StorageManager) DeleteImageLayer(layerID string) error {
 	return nil
 }
 
-func (sm *StorageManager) CreateContainerStorage(containerID, imageID string, layerIDs []string, volumeMounts []VolumeMount) (*ContainerStorage, error) {
+// ReferenceImageLayers records the layers an image is made of so garbage
+// collection keeps them while the image exists.
+func (sm *StorageManager) ReferenceImageLayers(imageID string, layerIDs []string) error {
+	defer sm.lock([]string{imageOwner(imageID)}, layerKeys(layerIDs))()
+
+	if err := sm.driver.AddReferences(imageOwner(imageID), layerIDs); err != nil {
+		return fmt.Errorf("failed to reference image layers: %v", err)
+	}
+	return nil
+}
+
+// ReleaseImageLayers drops the references of a removed image. Its layers
+// are reclaimed by the next PruneLayers unless something else uses them.
+func (sm *StorageManager) ReleaseImageLayers(imageID string) error {
+	defer sm.lock([]string{imageOwner(imageID)}, nil)()
+
+	if err := sm.driver.RemoveReferences(imageOwner(imageID)); err != nil {
+		return fmt.Errorf("failed to release image layers: %v", err)
+	}
+	return nil
+}
+
+// PruneLayers deletes the layers no image or container references and
+// reports the space freed.
+func (sm *StorageManager) PruneLayers() (*LayerPruneReport, error) {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
+	report, err := sm.driver.GarbageCollect()
+	if err != nil {
+		return report, fmt.Errorf("failed to prune layers: %v", err)
+	}
+	return report, nil
+}
+
+func imageOwner(imageID string) string {
+	return "image:" + imageID
+}
+
+func containerOwner(containerID string) string {
+	return "container:" + containerID
+}
+
+func volumeOwner(name string) string {
+	return "volume:" + name
+}
+
+// SquashImageLayers combines the given layers, lowest first, into a single
+// layer. The original layers are left in place.
+func (sm *StorageManager) SquashImageLayers(layerIDs []string) (*ImageLayer, error) {
+	defer sm.lock(nil, layerKeys(layerIDs))()
+
+	layer, err := sm.driver.SquashLayers(layerIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to squash layers: %v", err)
+	}
+
+	return &ImageLayer{
+		ID:       layer.ID,
+		Digest:   layer.Digest,
+		Size:     layer.Size,
+		Created:  layer.Created,
+		ChainID:  layer.ChainID,
+		DiffID:   layer.DiffID,
+		ParentID: layer.Parent,
+	}, nil
+}
+
+func (sm *StorageManager) CreateContainerStorage(containerID, imageID string, layerIDs []string, volumeMounts []VolumeMount) (*ContainerStorage, error) {
+	defer sm.lock([]string{containerOwner(containerID)}, append(layerKeys(layerIDs), volumeMountKeys(volumeMounts)...))()
+
 	logrus.Infof("Creating container storage for %s", containerID)
 
 	// Create container mount point
-	mountPoint := filepath.Join(sm.baseDir, "containers", containerID, "rootfs")
+	mountPoint := sm.ContainerMountPoint(containerID)
 	containerStorage := &ContainerStorage{
 		ID:           containerID,
 		ImageID:      imageID,
 		LayerIDs:     layerIDs,
 		MountPoint:   mountPoint,
 		VolumeMounts: volumeMounts,
-		Created:      getTimestamp(),
+		Created:      time.Now(),
 	}
 
 	// Mount overlay filesystem
-	if err := sm.overlayDriver.Mount(layerIDs, mountPoint); err != nil {
+	if err := sm.driver.Mount(layerIDs, mountPoint); err != nil {
 		return nil, fmt.Errorf("failed to mount overlay: %v", err)
 	}
+	if err := sm.driver.AddReferences(containerOwner(containerID), layerIDs); err != nil {
+		return nil, fmt.Errorf("failed to reference container layers: %v", err)
+	}
 
 	// Mount volumes
 	for _, volumeMount := range volumeMounts {
@@ -230,42 +423,106 @@ func (sm *StorageManager) CreateContainerStorage(containerID, imageID string, la
 		}
 	}
 
-	// Calculate total size
-	totalSize, err := sm.calculateContainerSize(containerStorage)
-	if err != nil {
-		logrus.Warnf("Failed to calculate container size: %v", err)
-	}
+	// Nothing has been written yet, so this is the size of the layers
+	totalSize := sm.layersSize(containerStorage)
 	containerStorage.Size = totalSize
 
+	if err := sm.saveContainerStorage(containerStorage); err != nil {
+		return nil, err
+	}
+
 	logrus.Infof("Created container storage for %s at %s (%d bytes)", containerID, mountPoint, totalSize)
 	return containerStorage, nil
 }
 
+// QuotasEnabled reports whether containers and volumes can be given a
+// size limit.
+func (sm *StorageManager) QuotasEnabled() bool {
+	return sm.quotas != nil
+}
+
+// SetContainerQuota limits what a container can write to size bytes. It
+// is called before the container's storage is created, and again on
+// every start.
+func (sm *StorageManager) SetContainerQuota(containerID string, size int64) error {
+	defer sm.lock([]string{containerOwner(containerID)}, nil)()
+
+	if sm.quotas == nil {
+		return fmt.Errorf("storage quotas are not enabled")
+	}
+	dir, err := sm.driver.WritableDir(sm.ContainerMountPoint(containerID))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create container directory: %v", err)
+	}
+	return sm.quotas.SetQuota(containerOwner(containerID), dir, size)
+}
+
+// GetQuota returns the quota of a container or volume, named by owner
+// such as container:<id> or volume:<name>, with its usage.
+func (sm *StorageManager) GetQuota(owner string) (*Quota, error) {
+	if sm.quotas == nil {
+		return nil, fmt.Errorf("storage quotas are not enabled")
+	}
+	return sm.quotas.GetQuota(owner)
+}
+
+// ContainerMountPoint is where the filesystem of a container is mounted.
+func (sm *StorageManager) ContainerMountPoint(containerID string) string {
+	return filepath.Join(sm.baseDir, "containers", containerID, "rootfs")
+}
+
+// ContainerDiff returns a tar stream of the changes a container made to
+// its image's filesystem.
+func (sm *StorageManager) ContainerDiff(containerID string) (io.ReadCloser, error) {
+	defer sm.lock(nil, []string{containerOwner(containerID)})()
+
+	if _, err := sm.loadContainerStorage(containerID); err != nil {
+		return nil, err
+	}
+	return sm.driver.Diff(sm.ContainerMountPoint(containerID))
+}
+
 func (sm *StorageManager) GetContainerStorage(containerID string) (*ContainerStorage, error) {
-	sm.mu.RLock()
-	defer sm.mu.RUnlock()
+	defer sm.lock(nil, []string{containerOwner(containerID)})()
 
-	// Load container storage from metadata
+	return sm.loadContainerStorage(containerID)
+}
+
+func (sm *StorageManager) loadContainerStorage(containerID string) (*ContainerStorage, error) {
 	metadataPath := filepath.Join(sm.baseDir, "containers", containerID, "storage.json")
-	if _, err := filepath.Stat(metadataPath); err != nil {
+	data, err := os.ReadFile(metadataPath)
+	if err != nil {
 		return nil, fmt.Errorf("container storage not found: %v", err)
 	}
 
-	// In real implementation, this would load from JSON
-	// For now, return basic structure
-	return &ContainerStorage{
-		ID:         containerID,
-		MountPoint: filepath.Join(sm.baseDir, "containers", containerID, "rootfs"),
-	}, nil
+	var containerStorage ContainerStorage
+	if _, err := timeutil.Unmarshal(data, &containerStorage, "created"); err != nil {
+		return nil, fmt.Errorf("failed to parse container storage: %v", err)
+	}
+	return &containerStorage, nil
+}
+
+func (sm *StorageManager) saveContainerStorage(containerStorage *ContainerStorage) error {
+	data, err := json.MarshalIndent(containerStorage, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal container storage: %v", err)
+	}
+	metadataPath := filepath.Join(sm.baseDir, "containers", containerStorage.ID, "storage.json")
+	if err := os.WriteFile(metadataPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to save container storage: %v", err)
+	}
+	return nil
 }
 
 func (sm *StorageManager) RemoveContainerStorage(containerID string) error {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
+	defer sm.lock([]string{containerOwner(containerID)}, nil)()
 
 	logrus.Infof("Removing container storage for %s", containerID)
 
-	containerStorage, err := sm.GetContainerStorage(containerID)
+	containerStorage, err := sm.loadContainerStorage(containerID)
 	if err != nil {
 		return fmt.Errorf("failed to get container storage: %v", err)
 	}
@@ -278,9 +535,17 @@ func (sm *StorageManager) RemoveContainerStorage(containerID string) error {
 	}
 
 	// Unmount overlay filesystem
-	if err := sm.overlayDriver.Unmount(containerStorage.MountPoint); err != nil {
+	if err := sm.driver.Unmount(containerStorage.MountPoint); err != nil {
 		logrus.Warnf("Failed to unmount overlay: %v", err)
 	}
+	if err := sm.driver.RemoveReferences(containerOwner(containerID)); err != nil {
+		logrus.Warnf("Failed to release container layers: %v", err)
+	}
+	if sm.quotas != nil {
+		if err := sm.quotas.RemoveQuota(containerOwner(containerID)); err != nil {
+			logrus.Warnf("Failed to remove container quota: %v", err)
+		}
+	}
 
 	// Remove container directory
 	containerDir := filepath.Join(sm.baseDir, "containers", containerID)
@@ -288,27 +553,68 @@ func (sm *StorageManager) RemoveContainerStorage(containerID string) error {
 		logrus.Warnf("Failed to remove container directory: %v", err)
 	}
 
+	sm.sizesMu.Lock()
+	delete(sm.sizes, containerID)
+	sm.sizesMu.Unlock()
+
 	logrus.Infof("Removed container storage for %s", containerID)
 	return nil
 }
 
-func (sm *StorageManager) CreateVolume(name string, options map[string]string, labels map[string]string) (*Volume, error) {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
+// CreateVolume creates a volume with driver, or the default volume driver
+// when it is empty.
+func (sm *StorageManager) CreateVolume(name, driver string, options map[string]string, labels map[string]string) (*Volume, error) {
+	defer sm.lock([]string{volumeOwner(name)}, nil)()
+
+	// A size option limits local volumes with a quota; other drivers
+	// read their own options
+	if driver == "" {
+		driver = sm.volumeManager.DefaultDriver()
+	}
+	var size int64
+	if value := options["size"]; value != "" && driver == "local" {
+		if sm.quotas == nil {
+			return nil, fmt.Errorf("volume size needs storage quotas to be enabled")
+		}
+		n, err := ParseSize(value)
+		if err != nil {
+			return nil, err
+		}
+		size = n
+	}
 
-	return sm.volumeManager.CreateVolume(name, options, labels)
+	volume, err := sm.volumeManager.CreateVolume(name, driver, options, labels)
+	if err != nil || size == 0 {
+		return volume, err
+	}
+	if err := sm.quotas.SetQuota(volumeOwner(name), volume.Mountpoint, size); err != nil {
+		sm.volumeManager.RemoveVolume(name, true)
+		return nil, err
+	}
+	return volume, nil
 }
 
 func (sm *StorageManager) RemoveVolume(name string, force bool) error {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
+	defer sm.lock([]string{volumeOwner(name)}, nil)()
+
+	if err := sm.volumeManager.RemoveVolume(name, force); err != nil {
+		return err
+	}
+	sm.removeVolumeQuota(name)
+	return nil
+}
 
-	return sm.volumeManager.RemoveVolume(name, force)
+func (sm *StorageManager) removeVolumeQuota(name string) {
+	if sm.quotas == nil {
+		return
+	}
+	if err := sm.quotas.RemoveQuota(volumeOwner(name)); err != nil {
+		logrus.Warnf("Failed to remove quota of volume %s: %v", name, err)
+	}
 }
 
 func (sm *StorageManager) GetVolume(name string) (*Volume, error) {
-	sm.mu.RLock()
-	defer sm.mu.RUnlock()
+	defer sm.lock(nil, []string{volumeOwner(name)})()
 
 	return sm.volumeManager.GetVolume(name)
 }
@@ -324,19 +630,36 @@ func (sm *StorageManager) PruneVolumes() (int64, error) {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
-	return sm.volumeManager.PruneVolumes()
+	before, err := sm.volumeManager.ListVolumes()
+	if err != nil {
+		return 0, err
+	}
+	reclaimed, err := sm.volumeManager.PruneVolumes()
+	if err != nil {
+		return reclaimed, err
+	}
+	for _, volume := range before {
+		if _, err := sm.volumeManager.GetVolume(volume.Name); err != nil {
+			sm.removeVolumeQuota(volume.Name)
+		}
+	}
+	return reclaimed, nil
 }
 
 func (sm *StorageManager) MountVolume(name, containerID, target string) error {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
+	defer sm.lock([]string{volumeOwner(name)}, nil)()
 
 	return sm.volumeManager.MountVolume(name, containerID, target)
 }
 
+func (sm *StorageManager) PopulateVolume(name, src string) error {
+	defer sm.lock([]string{volumeOwner(name)}, nil)()
+
+	return sm.volumeManager.PopulateVolume(name, src)
+}
+
 func (sm *StorageManager) UnmountVolume(name, containerID string) error {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
+	defer sm.lock([]string{volumeOwner(name)}, nil)()
 
 	return sm.volumeManager.UnmountVolume(name, containerID)
 }
@@ -345,14 +668,19 @@ func (sm *StorageManager) GetStorageStats() map[string]interface{} {
 	sm.mu.RLock()
 	defer sm.mu.RUnlock()
 
-	overlayStats := sm.overlayDriver.GetUsageStats()
+	overlayStats := sm.driver.GetUsageStats()
 	volumeStats := sm.volumeManager.GetUsageStats()
 
-	return map[string]interface{}{
+	stats := map[string]interface{}{
 		"overlay_driver": overlayStats,
 		"volume_manager": volumeStats,
 		"base_dir":       sm.baseDir,
+		"quotas_enabled": sm.quotas != nil,
+	}
+	if sm.quotas != nil {
+		stats["quotas"] = sm.quotas.GetUsageStats()
 	}
+	return stats
 }
 
 func (sm *StorageManager) Cleanup() error {
@@ -361,42 +689,95 @@ func (sm *StorageManager) Cleanup() error {
 
 	logrus.Info("Cleaning up storage manager")
 
-	if sm.overlayDriver != nil {
-		sm.overlayDriver.Cleanup()
+	if sm.driver != nil {
+		sm.driver.Cleanup()
 	}
 
 	logrus.Info("Storage manager cleaned up")
 	return nil
 }
 
-func (sm *StorageManager) calculateContainerSize(container *ContainerStorage) (int64, error) {
-	var totalSize int64
+// ContainerSize measures the filesystem of a container, reusing a recent
+// measurement unless refresh is set.
+func (sm *StorageManager) ContainerSize(containerID string, refresh bool) (*ContainerSize, error) {
+	sm.sizesMu.Lock()
+	cached, ok := sm.sizes[containerID]
+	sm.sizesMu.Unlock()
+	if ok && !refresh && time.Since(cached.measuredAt) < containerSizeTTL {
+		size := cached.size
+		return &size, nil
+	}
+
+	unlock := sm.lock(nil, []string{containerOwner(containerID)})
+	containerStorage, err := sm.loadContainerStorage(containerID)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	size, err := sm.calculateContainerSize(containerStorage)
+	unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	sm.sizesMu.Lock()
+	sm.sizes[containerID] = cachedContainerSize{size: size, measuredAt: time.Now()}
+	sm.sizesMu.Unlock()
+	return &size, nil
+}
+
+// calculateContainerSize counts each layer once, however many containers
+// share it. Volumes live outside the container's filesystem and are left
+// out.
+func (sm *StorageManager) calculateContainerSize(container *ContainerStorage) (ContainerSize, error) {
+	rw, err := sm.writableSize(container.MountPoint)
+	if err != nil {
+		return ContainerSize{}, err
+	}
+	return ContainerSize{SizeRw: rw, SizeRootFs: sm.layersSize(container) + rw}, nil
+}
 
-	// Add layer sizes
+func (sm *StorageManager) layersSize(container *ContainerStorage) int64 {
+	var size int64
 	for _, layerID := range container.LayerIDs {
-		layer, err := sm.overlayDriver.GetLayer(layerID)
+		layer, err := sm.driver.GetLayer(layerID)
 		if err != nil {
 			logrus.Warnf("Failed to get layer %s: %v", layerID, err)
 			continue
 		}
-		totalSize += layer.Size
+		size += layer.Size
 	}
+	return size
+}
 
-	// Add volume sizes
-	for _, volumeMount := range container.VolumeMounts {
-		volume, err := sm.volumeManager.GetVolume(volumeMount.Name)
+// writableSize adds up the files in the diff of mountPoint, which is what
+// the container wrote whichever driver assembled it. Deleted files are
+// whiteouts that take no space.
+func (sm *StorageManager) writableSize(mountPoint string) (int64, error) {
+	diff, err := sm.driver.Diff(mountPoint)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read container changes: %v", err)
+	}
+	defer diff.Close()
+
+	var size int64
+	tr := tar.NewReader(diff)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return size, nil
+		}
 		if err != nil {
-			logrus.Warnf("Failed to get volume %s: %v", volumeMount.Name, err)
-			continue
+			return 0, fmt.Errorf("failed to read container changes: %v", err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			size += header.Size
 		}
-		totalSize += volume.UsageData.Size
 	}
-
-	return totalSize, nil
 }
 
 func createDirectoryIfNotExists(path string) error {
-	if _, err := filepath.Stat(path); os.IsNotExist(err) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
 		return os.MkdirAll(path, 0755)
 	}
 	return nil
@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContainerSize(t *testing.T) {
+	sm, err := NewStorageManager(&StorageConfig{RootDir: t.TempDir(), OverlayDriver: "vfs"})
+	require.NoError(t, err)
+
+	layerDir := t.TempDir()
+	writeLayer(t, layerDir, map[string]string{"etc/os-release": strings.Repeat("x", 1000)})
+	layer, err := sm.ImportImageLayer("sha256:base", "", layerDir)
+	require.NoError(t, err)
+
+	// Two containers share the layer but each only counts what it wrote
+	for _, id := range []string{"c1", "c2"} {
+		_, err := sm.CreateContainerStorage(id, "image", []string{layer.ID}, nil)
+		require.NoError(t, err)
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(sm.ContainerMountPoint("c1"), "data"), []byte(strings.Repeat("y", 300)), 0644))
+
+	size, err := sm.ContainerSize("c1", false)
+	require.NoError(t, err)
+	assert.Equal(t, int64(300), size.SizeRw)
+	assert.Equal(t, layer.Size+300, size.SizeRootFs)
+
+	size, err = sm.ContainerSize("c2", false)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), size.SizeRw)
+	assert.Equal(t, layer.Size, size.SizeRootFs)
+
+	// Cached until refreshed
+	require.NoError(t, os.WriteFile(filepath.Join(sm.ContainerMountPoint("c2"), "data"), []byte("z"), 0644))
+	size, err = sm.ContainerSize("c2", false)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), size.SizeRw)
+	size, err = sm.ContainerSize("c2", true)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), size.SizeRw)
+
+	require.NoError(t, sm.RemoveContainerStorage("c2"))
+	_, err = sm.ContainerSize("c2", false)
+	assert.Error(t, err)
+}
+
+func TestSlowApplyDiffDoesNotBlockContainers(t *testing.T) {
+	sm, err := NewStorageManager(&StorageConfig{RootDir: t.TempDir(), OverlayDriver: "vfs"})
+	require.NoError(t, err)
+
+	layerDir := t.TempDir()
+	writeLayer(t, layerDir, map[string]string{"bin/sh": "sh"})
+	layer, err := sm.ImportImageLayer("sha256:base", "", layerDir)
+	require.NoError(t, err)
+
+	// The diff doesn't arrive until the container is created
+	diff, w := io.Pipe()
+	applied := make(chan error, 1)
+	go func() {
+		_, err := sm.CreateImageLayer("", strings.Repeat("a", 64), diff)
+		applied <- err
+	}()
+
+	created := make(chan error, 1)
+	go func() {
+		_, err := sm.CreateContainerStorage("c1", "image", []string{layer.ID}, nil)
+		created <- err
+	}()
+	select {
+	case err := <-created:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("container creation waited for an unrelated layer")
+	}
+
+	tw := tar.NewWriter(w)
+	require.NoError(t, tw.Close())
+	require.NoError(t, w.Close())
+	require.NoError(t, <-applied)
+}
+
+func TestStripedLocksOrder(t *testing.T) {
+	var locks stripedLocks
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 1000; i++ {
+			locks.lock([]string{"layer:a"}, []string{"container:b"})()
+		}
+		close(done)
+	}()
+	for i := 0; i < 1000; i++ {
+		locks.lock([]string{"container:b"}, []string{"layer:a", "layer:a"})()
+	}
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("locks deadlocked")
+	}
+}
@@ -0,0 +1,287 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// opaqueWhiteout in a directory hides everything lower layers have
+	// in it
+	opaqueWhiteout = whiteoutPrefix + whiteoutPrefix + ".opq"
+	opaqueXattr    = "trusted.overlay.opaque"
+
+	// vfsMarker in a mount's overlay directory records that the mount
+	// point holds a copy of the layers instead of an overlay mount
+	vfsMarker = "vfs"
+)
+
+type mountInfo struct {
+	overlayDir string
+	native     bool
+}
+
+// supportsOverlay reports whether overlayfs can be mounted, by mounting a
+// throwaway one under baseDir. It needs the overlay module and privileges
+// to mount, which unprivileged and some nested setups lack.
+func supportsOverlay(baseDir string) bool {
+	if os.Geteuid() != 0 {
+		return false
+	}
+	probe, err := os.MkdirTemp(baseDir, "probe-")
+	if err != nil {
+		return false
+	}
+	defer os.RemoveAll(probe)
+
+	dirs := map[string]string{}
+	for _, name := range []string{"lower", "upper", "work", "merged"} {
+		dirs[name] = filepath.Join(probe, name)
+		if err := os.Mkdir(dirs[name], 0755); err != nil {
+			return false
+		}
+	}
+	if err := mountOverlay([]string{dirs["lower"]}, dirs["upper"], dirs["work"], dirs["merged"]); err != nil {
+		logrus.Debugf("Overlay mounts are not available: %v", err)
+		return false
+	}
+	syscall.Unmount(dirs["merged"], 0)
+	return true
+}
+
+// mountOverlay mounts lowerDirs, lowest first, with upperDir on top at
+// target.
+func mountOverlay(lowerDirs []string, upperDir, workDir, target string) error {
+	// overlayfs lists the topmost lower directory first
+	lower := make([]string, len(lowerDirs))
+	for i, dir := range lowerDirs {
+		lower[len(lowerDirs)-1-i] = escapeOverlayPath(dir)
+	}
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s",
+		strings.Join(lower, ":"), escapeOverlayPath(upperDir), escapeOverlayPath(workDir))
+	if len(options) >= os.Getpagesize() {
+		return fmt.Errorf("too many layers for overlay mount options (%d bytes)", len(options))
+	}
+
+	if err := syscall.Mount("overlay", target, "overlay", 0, options); err != nil {
+		return fmt.Errorf("mount overlay at %s: %v", target, err)
+	}
+	return nil
+}
+
+// escapeOverlayPath escapes the separators of overlay mount options, which
+// layer IDs such as sha256:... contain.
+func escapeOverlayPath(path string) string {
+	return strings.NewReplacer(`\`, `\\`, ":", `\:`, ",", `\,`).Replace(path)
+}
+
+// vfsMount stands in for an overlay mount by copying lowerDirs, lowest
+// first, and then upperDir onto mountPoint.
+func vfsMount(lowerDirs []string, upperDir, mountPoint string) error {
+	for _, dir := range append(lowerDirs, upperDir) {
+		if err := applyLayerDiff(dir, mountPoint); err != nil {
+			return fmt.Errorf("failed to copy %s: %v", dir, err)
+		}
+	}
+	return nil
+}
+
+// isMountPoint reports whether path is the target of a mount.
+func isMountPoint(path string) (bool, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return false, err
+	}
+	mounts, err := listMounts()
+	if err != nil {
+		return false, err
+	}
+	for _, target := range mounts {
+		if target == path {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// listMounts returns the targets of the mounts in this mount namespace, in
+// the order they were mounted, according to /proc/self/mountinfo.
+func listMounts() ([]string, error) {
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mounts: %v", err)
+	}
+	defer file.Close()
+
+	var mounts []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 4 {
+			mounts = append(mounts, unescapeMountPath(fields[4]))
+		}
+	}
+	return mounts, scanner.Err()
+}
+
+// unmountBelow detaches everything mounted under path, newest first, so
+// removing path can't reach into bind mounted directories.
+func unmountBelow(path string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	mounts, err := listMounts()
+	if err != nil {
+		return err
+	}
+	for i := len(mounts) - 1; i >= 0; i-- {
+		if strings.HasPrefix(mounts[i], path+"/") {
+			if err := syscall.Unmount(mounts[i], syscall.MNT_DETACH); err != nil && err != syscall.EINVAL {
+				return fmt.Errorf("failed to unmount %s: %v", mounts[i], err)
+			}
+		}
+	}
+	return nil
+}
+
+// unescapeMountPath decodes the octal escapes mountinfo uses for spaces,
+// tabs, newlines and backslashes.
+func unescapeMountPath(path string) string {
+	if !strings.Contains(path, `\`) {
+		return path
+	}
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if n, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+// mountID names the overlay directory of a mount point. Container mount
+// points all end in rootfs, so their base names can't be used.
+func mountID(mountPoint string) string {
+	sum := sha256.Sum256([]byte(filepath.Clean(mountPoint)))
+	return fmt.Sprintf("%x", sum[:12])
+}
+
+// whiteoutTarget reports whether a diff entry marks a deletion, and the
+// name of the deleted entry next to it. Both the .wh. files images use
+// and the 0/0 character devices overlayfs uses are understood. The opaque
+// marker is a whiteout with an empty name; see opaqueDir.
+func whiteoutTarget(info os.FileInfo) (string, bool) {
+	name := info.Name()
+	if name == opaqueWhiteout {
+		return "", true
+	}
+	if strings.HasPrefix(name, whiteoutPrefix) {
+		return strings.TrimPrefix(name, whiteoutPrefix), true
+	}
+	if info.Mode()&os.ModeCharDevice != 0 {
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Rdev == 0 {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// opaqueDir reports whether the directory at path hides the contents lower
+// layers have in it.
+func opaqueDir(path string) bool {
+	if _, err := os.Lstat(filepath.Join(path, opaqueWhiteout)); err == nil {
+		return true
+	}
+	value := make([]byte, 1)
+	n, err := syscall.Getxattr(path, opaqueXattr, value)
+	return err == nil && n == 1 && value[0] == 'y'
+}
+
+// convertWhiteouts rewrites the .wh. files under dir into the character
+// devices and opaque attributes overlayfs understands.
+func convertWhiteouts(dir string) error {
+	var whiteouts []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), whiteoutPrefix) {
+			whiteouts = append(whiteouts, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, path := range whiteouts {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		parent, name := filepath.Dir(path), filepath.Base(path)
+		if name == opaqueWhiteout {
+			if err := syscall.Setxattr(parent, opaqueXattr, []byte("y"), 0); err != nil {
+				return fmt.Errorf("failed to mark %s opaque: %v", parent, err)
+			}
+			continue
+		}
+		deleted := filepath.Join(parent, strings.TrimPrefix(name, whiteoutPrefix))
+		if err := syscall.Mknod(deleted, syscall.S_IFCHR, 0); err != nil {
+			return fmt.Errorf("failed to create whiteout for %s: %v", deleted, err)
+		}
+	}
+	return nil
+}
+
+// copyTree copies the directory src to dst as is, whiteouts included.
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case info.IsDir():
+			if err := os.MkdirAll(target, info.Mode().Perm()); err != nil {
+				return err
+			}
+			return os.Chmod(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			if err := os.WriteFile(target, data, info.Mode().Perm()); err != nil {
+				return err
+			}
+			return os.Chmod(target, info.Mode().Perm())
+		default:
+			return nil
+		}
+	})
+}
@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	RegisterVolumeDriver("nfs", func(baseDir string) (VolumeDriver, error) {
+		return NewNFSVolumeDriver(baseDir), nil
+	})
+}
+
+// NFSVolumeDriver mounts volumes from remote NFS exports. It takes the
+// options addr (the server), device (the export, e.g. :/exports/data) and
+// o (further mount options, e.g. vers=4,soft). The export is mounted while
+// containers use the volume.
+type NFSVolumeDriver struct {
+	baseDir string
+}
+
+func NewNFSVolumeDriver(baseDir string) *NFSVolumeDriver {
+	return &NFSVolumeDriver{baseDir: baseDir}
+}
+
+func (d *NFSVolumeDriver) Name() string {
+	return "nfs"
+}
+
+// nfsMount returns the source and data to mount the export of a volume
+// with. The kernel only takes the server by address, so a host name is
+// resolved first.
+func nfsMount(options map[string]string) (string, string, error) {
+	for key := range options {
+		switch key {
+		case "addr", "device", "o":
+		default:
+			return "", "", fmt.Errorf("unknown nfs volume option: %s", key)
+		}
+	}
+
+	device := options["device"]
+	addr := options["addr"]
+	host, path, ok := strings.Cut(device, ":")
+	if !ok || !strings.HasPrefix(path, "/") {
+		return "", "", fmt.Errorf("nfs volumes need a device such as :/exports/data")
+	}
+	if host == "" {
+		host = addr
+	}
+	if host == "" {
+		return "", "", fmt.Errorf("nfs volumes need the server in addr or device")
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ips, err := net.LookupIP(host)
+		if err != nil || len(ips) == 0 {
+			return "", "", fmt.Errorf("failed to resolve nfs server %s: %v", host, err)
+		}
+		ip = ips[0]
+	}
+
+	data := "addr=" + ip.String()
+	if o := options["o"]; o != "" {
+		data += "," + o
+	}
+	return host + ":" + path, data, nil
+}
+
+func (d *NFSVolumeDriver) Create(name string, options map[string]string) (*Volume, error) {
+	if _, _, err := nfsMount(options); err != nil {
+		return nil, err
+	}
+
+	volumePath := filepath.Join(d.baseDir, name)
+	if err := os.MkdirAll(volumePath, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create volume directory: %v", err)
+	}
+
+	volume := newVolume(name, "nfs", volumePath, options)
+	volume.Status["export"] = options["device"]
+
+	logrus.Infof("Created nfs volume: %s for %s", name, options["device"])
+	return volume, nil
+}
+
+func (d *NFSVolumeDriver) Remove(volume *Volume) error {
+	if volume.UsageData.RefCount > 0 {
+		return fmt.Errorf("volume %s is still in use (%d references)", volume.Name, volume.UsageData.RefCount)
+	}
+
+	if mounted, _ := isMountPoint(volume.Mountpoint); mounted {
+		if err := syscall.Unmount(volume.Mountpoint, syscall.MNT_DETACH); err != nil {
+			return fmt.Errorf("failed to unmount volume: %v", err)
+		}
+	}
+	// Only the mountpoint is removed; the data stays on the server
+	if err := os.Remove(volume.Mountpoint); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove volume directory: %v", err)
+	}
+
+	logrus.Infof("Removed nfs volume: %s", volume.Name)
+	return nil
+}
+
+func (d *NFSVolumeDriver) Mount(volume *Volume, target string) error {
+	if mounted, _ := isMountPoint(volume.Mountpoint); !mounted {
+		source, data, err := nfsMount(volume.Options)
+		if err != nil {
+			return err
+		}
+		if err := syscall.Mount(source, volume.Mountpoint, "nfs", 0, data); err != nil {
+			return fmt.Errorf("failed to mount %s: %v", source, err)
+		}
+	}
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return fmt.Errorf("failed to create mount target: %v", err)
+	}
+
+	logrus.Infof("Mounted nfs volume %s to %s", volume.Name, target)
+	return nil
+}
+
+func (d *NFSVolumeDriver) Unmount(volume *Volume, target string) error {
+	// The export stays mounted while other containers use it
+	if volume.UsageData.RefCount > 1 {
+		return nil
+	}
+	if mounted, _ := isMountPoint(volume.Mountpoint); mounted {
+		if err := syscall.Unmount(volume.Mountpoint, 0); err != nil {
+			return fmt.Errorf("failed to unmount %s: %v", volume.Mountpoint, err)
+		}
+	}
+
+	logrus.Infof("Unmounted nfs volume %s from %s", volume.Name, target)
+	return nil
+}
+
+func (d *NFSVolumeDriver) GetPath(volume *Volume) string {
+	return volume.Mountpoint
+}
+
+func (d *NFSVolumeDriver) Usage(volume *Volume) (*UsageData, error) {
+	// Walking a remote export is slow, so the usage of mounted ones is
+	// taken from the filesystem
+	if mounted, _ := isMountPoint(volume.Mountpoint); mounted {
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(volume.Mountpoint, &stat); err != nil {
+			return nil, fmt.Errorf("failed to calculate volume size: %v", err)
+		}
+		volume.UsageData.Size = int64(stat.Blocks-stat.Bfree) * int64(stat.Bsize)
+	}
+	return volume.UsageData, nil
+}
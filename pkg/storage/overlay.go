@@ -1,24 +1,36 @@
 package storage
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
+// layerMetadataFile holds a layer's metadata in its directory
+const layerMetadataFile = "layer.json"
+
 type OverlayDriver struct {
+	name        string
 	baseDir     string
 	upperDir    string
 	workDir     string
 	mergedDir   string
 	layers      map[string]*Layer
 	mu          sync.RWMutex
-	mountPoints map[string]string
+	mountPoints map[string]*mountInfo
+	// native is set when overlayfs can be mounted; otherwise mounts copy
+	// the layers into the mount point
+	native bool
+	// refs holds the layers each image or container uses, keyed by owner
+	refs map[string][]string
 }
 
 type Layer struct {
@@ -26,7 +38,7 @@ type Layer struct {
 	Parent    string `json:"parent"`
 	Digest    string `json:"digest"`
 	Size      int64  `json:"size"`
-	Created   string `json:"created"`
+	Created   time.Time `json:"created"`
 	Path      string `json:"path"`
 	DiffID    string `json:"diff_id"`
 	ChainID   string `json:"chain_id"`
@@ -42,10 +54,19 @@ type Diff struct {
 }
 
 func NewOverlayDriver(baseDir string) (*OverlayDriver, error) {
+	return newOverlayDriver("overlay", baseDir)
+}
+
+// newOverlayDriver sets up the layer store other drivers build on. Only
+// the overlay driver itself mounts overlayfs; the others keep whiteouts
+// as .wh. files and assemble filesystems their own way.
+func newOverlayDriver(name, baseDir string) (*OverlayDriver, error) {
 	driver := &OverlayDriver{
+		name:        name,
 		baseDir:     baseDir,
 		layers:      make(map[string]*Layer),
-		mountPoints: make(map[string]string),
+		mountPoints: make(map[string]*mountInfo),
+		refs:        make(map[string][]string),
 	}
 
 	if err := driver.init(); err != nil {
@@ -69,10 +90,29 @@ func (d *OverlayDriver) init() error {
 		}
 	}
 
-	logrus.Infof("Overlay driver initialized with base directory: %s", d.baseDir)
+	if err := d.loadReferences(); err != nil {
+		return err
+	}
+	if err := d.loadLayers(); err != nil {
+		return err
+	}
+
+	if d.name == "overlay" {
+		d.native = supportsOverlay(d.baseDir)
+		if !d.native {
+			logrus.Warnf("Overlay filesystem not available, container filesystems will be copies of their layers")
+		}
+	}
+
+	logrus.Infof("%s driver initialized with base directory: %s", d.name, d.baseDir)
 	return nil
 }
 
+// Name is the name the driver is selected by.
+func (d *OverlayDriver) Name() string {
+	return d.name
+}
+
 func (d *OverlayDriver) CreateLayer(parentID, diffID string) (*Layer, error) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
@@ -91,7 +131,7 @@ func (d *OverlayDriver) CreateLayer(parentID, diffID string) (*Layer, error) {
 		Parent:  parentID,
 		DiffID:  diffID,
 		Size:    0,
-		Created: getTimestamp(),
+		Created: time.Now(),
 		Path:    layerPath,
 	}
 
@@ -117,11 +157,17 @@ func (d *OverlayDriver) CreateLayer(parentID, diffID string) (*Layer, error) {
 	return layer, nil
 }
 
+// ApplyDiff extracts a diff into a layer. The lock is only held around
+// the extraction, so other layers can be used meanwhile; the caller keeps
+// the layer itself from being used until it returns.
 func (d *OverlayDriver) ApplyDiff(layerID string, diff io.Reader) (*Diff, error) {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-
+	d.mu.RLock()
 	layer, exists := d.layers[layerID]
+	var parentHas func(string) bool
+	if exists {
+		parentHas = d.parentHas(layer.Parent)
+	}
+	d.mu.RUnlock()
 	if !exists {
 		return nil, fmt.Errorf("layer not found: %s", layerID)
 	}
@@ -135,14 +181,24 @@ func (d *OverlayDriver) ApplyDiff(layerID string, diff io.Reader) (*Diff, error)
 	// Track file changes
 	diffStats := &Diff{
 		ID:   layerID,
-		Type: "overlay",
+		Type: d.name,
 	}
 
-	// Apply diff (simplified - in real implementation would handle tar streams)
-	size, err := d.extractDiff(diff, diffDir, diffStats)
+	size, err := extractTar(diff, diffDir, diffStats, parentHas)
 	if err != nil {
 		return nil, fmt.Errorf("failed to extract diff: %v", err)
 	}
+	if d.native {
+		if err := convertWhiteouts(diffDir); err != nil {
+			return nil, fmt.Errorf("failed to convert whiteouts: %v", err)
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, exists := d.layers[layerID]; !exists {
+		return nil, fmt.Errorf("layer %s was deleted while applying its diff", layerID)
+	}
 
 	diffStats.Size = size
 	layer.Size = size
@@ -152,163 +208,249 @@ func (d *OverlayDriver) ApplyDiff(layerID string, diff io.Reader) (*Diff, error)
 		return nil, fmt.Errorf("failed to save layer metadata: %v", err)
 	}
 
-	logrus.Infof("Applied diff to layer %s: %d bytes, %d added, %d modified",
-		layerID, size, len(diffStats.Added), len(diffStats.Modified))
+	logrus.Infof("Applied diff to layer %s: %d bytes, %d added, %d modified, %d deleted",
+		layerID, size, len(diffStats.Added), len(diffStats.Modified), len(diffStats.Deleted))
 
 	return diffStats, nil
 }
 
-func (d *OverlayDriver) extractDiff(diff io.Reader, targetDir string, diffStats *Diff) (int64, error) {
-	// Simplified diff extraction
-	// In real implementation, this would handle tar streams with proper file operations
-	var totalSize int64
-
-	// Simulate extracting files
-	// For demo purposes, we'll just create some example files
-	exampleFiles := []struct {
-		path    string
-		content string
-	}{
-		{"bin/sh", "#!/bin/sh\necho 'Hello from container'\n"},
-		{"etc/hostname", "container-hostname\n"},
-		{"etc/hosts", "127.0.0.1 localhost\n::1 localhost\n"},
-		{"etc/resolv.conf", "nameserver 8.8.8.8\n"},
-	}
-
-	for _, file := range exampleFiles {
-		fullPath := filepath.Join(targetDir, file.path)
-		if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
-			return 0, fmt.Errorf("failed to create directory: %v", err)
+// parentHas returns a function reporting whether a path is present in
+// the layer parentID or any layer below it.
+func (d *OverlayDriver) parentHas(parentID string) func(string) bool {
+	var dirs []string
+	for id := parentID; id != ""; {
+		layer, exists := d.layers[id]
+		if !exists {
+			break
 		}
-
-		if err := os.WriteFile(fullPath, []byte(file.content), 0644); err != nil {
-			return 0, fmt.Errorf("failed to write file: %v", err)
+		dirs = append(dirs, d.diffDir(id))
+		id = layer.Parent
+	}
+	return func(rel string) bool {
+		for _, dir := range dirs {
+			if _, err := os.Lstat(filepath.Join(dir, rel)); err == nil {
+				return true
+			}
 		}
-
-		diffStats.Added = append(diffStats.Added, file.path)
-		totalSize += int64(len(file.content))
+		return false
 	}
-
-	return totalSize, nil
 }
 
+// Mount mounts layers, lowest first, at mountPoint with a writable layer
+// on top. When overlayfs can't be used the layers are copied into the
+// mount point instead, which is slower and takes space but behaves the
+// same. Mounting a mount point again reuses its writable layer, so a
+// container keeps its changes across restarts.
 func (d *OverlayDriver) Mount(layers []string, mountPoint string) error {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-
 	logrus.Infof("Mounting layers %v to %s", layers, mountPoint)
 
+	// Assembling the mount may copy every layer, so it is done without
+	// the lock; the caller keeps the mount point and its layers in place
+	d.mu.RLock()
+	var lowerDirs []string
+	for _, layerID := range layers {
+		if _, exists := d.layers[layerID]; !exists {
+			d.mu.RUnlock()
+			return fmt.Errorf("layer not found: %s", layerID)
+		}
+		lowerDirs = append(lowerDirs, d.diffDir(layerID))
+	}
+	d.mu.RUnlock()
+
+	info, err := d.mount(lowerDirs, mountPoint)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	d.mountPoints[mountPoint] = info
+	d.mu.Unlock()
+	return nil
+}
+
+func (d *OverlayDriver) mount(lowerDirs []string, mountPoint string) (*mountInfo, error) {
 	// Create mount point
 	if err := os.MkdirAll(mountPoint, 0755); err != nil {
-		return fmt.Errorf("failed to create mount point: %v", err)
+		return nil, fmt.Errorf("failed to create mount point: %v", err)
 	}
 
 	// Create overlay directories for this mount
-	overlayDir := filepath.Join(d.baseDir, "mounts", filepath.Base(mountPoint))
+	overlayDir := d.overlayDir(mountPoint)
 	upperDir := filepath.Join(overlayDir, "upper")
 	workDir := filepath.Join(overlayDir, "work")
 
 	for _, dir := range []string{overlayDir, upperDir, workDir} {
 		if err := os.MkdirAll(dir, 0755); err != nil {
-			return fmt.Errorf("failed to create overlay directory: %v", err)
+			return nil, fmt.Errorf("failed to create overlay directory: %v", err)
 		}
 	}
 
-	// Prepare lower directories
-	var lowerDirs []string
-	for _, layerID := range layers {
-		layer, exists := d.layers[layerID]
-		if !exists {
-			return fmt.Errorf("layer not found: %s", layerID)
+	if len(lowerDirs) == 0 {
+		// overlayfs needs at least one lower directory
+		emptyDir := filepath.Join(overlayDir, "empty")
+		if err := os.MkdirAll(emptyDir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create overlay directory: %v", err)
 		}
-		lowerDirs = append(lowerDirs, filepath.Join(d.baseDir, "diffs", layerID))
+		lowerDirs = append(lowerDirs, emptyDir)
 	}
 
-	lowerDir := strings.Join(lowerDirs, ":")
-
-	// Mount overlay filesystem
-	// Note: This requires overlay filesystem support and root privileges
-	// For demonstration, we'll simulate the mount
-	if err := d.simulateOverlayMount(lowerDir, upperDir, workDir, mountPoint); err != nil {
-		return fmt.Errorf("failed to mount overlay: %v", err)
+	// Diffs of copied mounts compare against the layers
+	if err := os.WriteFile(filepath.Join(overlayDir, "lower"), []byte(strings.Join(lowerDirs, "\n")), 0644); err != nil {
+		return nil, fmt.Errorf("failed to record mount layers: %v", err)
 	}
 
-	d.mountPoints[mountPoint] = overlayDir
-	logrus.Infof("Mounted overlay filesystem at %s", mountPoint)
-
-	return nil
-}
-
-func (d *OverlayDriver) simulateOverlayMount(lowerDir, upperDir, workDir, mountPoint string) error {
-	// In a real implementation, this would use the mount syscall:
-	// mount("overlay", mountPoint, "overlay", 0,
-	//     fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lowerDir, upperDir, workDir))
-
-	// For demonstration, we'll create a simple directory structure
-	// and copy files from lower layers to simulate overlay behavior
-
-	// Create basic structure
-	dirs := []string{
-		filepath.Join(mountPoint, "bin"),
-		filepath.Join(mountPoint, "etc"),
-		filepath.Join(mountPoint, "usr"),
-		filepath.Join(mountPoint, "var"),
+	mounted, err := isMountPoint(mountPoint)
+	if err != nil {
+		return nil, err
 	}
-
-	for _, dir := range dirs {
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			return fmt.Errorf("failed to create mount directory: %v", err)
-		}
+	// Without overlayfs, a mount there is the filesystem of a quota the
+	// copy goes into
+	if mounted && d.native {
+		return &mountInfo{overlayDir: overlayDir, native: true}, nil
 	}
-
-	// Create basic files
-	files := []struct {
-		path    string
-		content string
-	}{
-		{filepath.Join(mountPoint, "etc", "hostname"), "mydocker-container\n"},
-		{filepath.Join(mountPoint, "etc", "hosts"), "127.0.0.1 localhost\n"},
-		{filepath.Join(mountPoint, "etc", "resolv.conf"), "nameserver 8.8.8.8\n"},
-		{filepath.Join(mountPoint, "bin", "sh"), "#!/bin/sh\n"},
+	if _, err := os.Stat(filepath.Join(overlayDir, vfsMarker)); err == nil {
+		// The copy an earlier mount made holds the container's changes
+		return &mountInfo{overlayDir: overlayDir}, nil
 	}
 
-	for _, file := range files {
-		if err := os.WriteFile(file.path, []byte(file.content), 0644); err != nil {
-			return fmt.Errorf("failed to create mount file: %v", err)
+	if d.native {
+		err := mountOverlay(lowerDirs, upperDir, workDir, mountPoint)
+		if err == nil {
+			logrus.Infof("Mounted overlay filesystem at %s", mountPoint)
+			return &mountInfo{overlayDir: overlayDir, native: true}, nil
 		}
+		logrus.Warnf("Failed to mount overlay at %s, copying layers instead: %v", mountPoint, err)
 	}
 
-	logrus.Debugf("Simulated overlay mount at %s", mountPoint)
-	return nil
+	if err := vfsMount(lowerDirs, upperDir, mountPoint); err != nil {
+		return nil, fmt.Errorf("failed to copy layers: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(overlayDir, vfsMarker), nil, 0644); err != nil {
+		return nil, fmt.Errorf("failed to record mount: %v", err)
+	}
+	logrus.Infof("Copied layers to %s", mountPoint)
+	return &mountInfo{overlayDir: overlayDir}, nil
 }
 
+// Unmount unmounts mountPoint and removes it along with its writable
+// layer.
 func (d *OverlayDriver) Unmount(mountPoint string) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
+	return d.unmount(mountPoint)
+}
 
+func (d *OverlayDriver) unmount(mountPoint string) error {
 	logrus.Infof("Unmounting %s", mountPoint)
 
-	// Simulate unmount
-	if err := d.simulateOverlayUnmount(mountPoint); err != nil {
-		return fmt.Errorf("failed to unmount: %v", err)
+	if err := unmountBelow(mountPoint); err != nil {
+		return err
+	}
+	mounted, err := isMountPoint(mountPoint)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		if err := syscall.Unmount(mountPoint, 0); err != nil {
+			if err != syscall.EBUSY {
+				return fmt.Errorf("failed to unmount: %v", err)
+			}
+			// Held open by a process that outlived its container; the
+			// mount goes away once it exits
+			if err := syscall.Unmount(mountPoint, syscall.MNT_DETACH); err != nil {
+				return fmt.Errorf("failed to unmount: %v", err)
+			}
+		}
 	}
 
-	// Clean up overlay directories
-	if overlayDir, exists := d.mountPoints[mountPoint]; exists {
-		if err := os.RemoveAll(overlayDir); err != nil {
-			logrus.Warnf("Failed to remove overlay directory: %v", err)
+	// Left is the empty mount point, or the copy a fallback mount made
+	if err := os.RemoveAll(mountPoint); err != nil {
+		return fmt.Errorf("failed to remove mount point: %v", err)
+	}
+	overlayDir := d.overlayDir(mountPoint)
+	if mounted, _ := isMountPoint(overlayDir); mounted {
+		// The writable layer is on the filesystem of a quota
+		if err := syscall.Unmount(overlayDir, syscall.MNT_DETACH); err != nil {
+			logrus.Warnf("Failed to unmount %s: %v", overlayDir, err)
 		}
-		delete(d.mountPoints, mountPoint)
 	}
+	if err := os.RemoveAll(overlayDir); err != nil {
+		logrus.Warnf("Failed to remove overlay directory: %v", err)
+	}
+	delete(d.mountPoints, mountPoint)
 
 	logrus.Infof("Unmounted %s", mountPoint)
 	return nil
 }
 
-func (d *OverlayDriver) simulateOverlayUnmount(mountPoint string) error {
-	// In real implementation, this would use umount syscall
-	// For demonstration, just remove the mount point
-	return os.RemoveAll(mountPoint)
+// ImportLayer adds a layer whose content is the directory src, laid out
+// the way images are: files as they are, with .wh. files for deletions.
+// The content is copied, so src may go away afterwards. Importing a layer
+// that is already present does nothing.
+func (d *OverlayDriver) ImportLayer(layerID, parentID, src string) (*Layer, error) {
+	d.mu.RLock()
+	layer, exists := d.layers[layerID]
+	d.mu.RUnlock()
+	if exists {
+		return layer, nil
+	}
+
+	// The copy is made without the lock; the caller keeps the layer from
+	// being imported twice at once
+	diffDir := d.diffDir(layerID)
+	if _, err := os.Stat(diffDir); os.IsNotExist(err) {
+		tmpDir, err := os.MkdirTemp(filepath.Join(d.baseDir, "diffs"), "tmp-")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create diff directory: %v", err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		if err := copyTree(src, tmpDir); err != nil {
+			return nil, fmt.Errorf("failed to copy layer %s: %v", layerID, err)
+		}
+		if d.native {
+			if err := convertWhiteouts(tmpDir); err != nil {
+				return nil, fmt.Errorf("failed to convert whiteouts of layer %s: %v", layerID, err)
+			}
+		}
+		if err := os.Rename(tmpDir, diffDir); err != nil {
+			return nil, fmt.Errorf("failed to store layer %s: %v", layerID, err)
+		}
+	}
+
+	size := dirSize(diffDir)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if layer, exists := d.layers[layerID]; exists {
+		return layer, nil
+	}
+	layer = &Layer{
+		ID:      layerID,
+		Parent:  parentID,
+		DiffID:  layerID,
+		Size:    size,
+		Created: time.Now(),
+		Path:    filepath.Join(d.baseDir, "layers", layerID),
+		ChainID: layerID,
+	}
+	if parent, exists := d.layers[parentID]; exists {
+		layer.ChainID = fmt.Sprintf("%s-%s", parent.ChainID, layerID)
+	}
+	if err := d.saveLayerMetadata(layer); err != nil {
+		return nil, fmt.Errorf("failed to save layer metadata: %v", err)
+	}
+
+	d.layers[layerID] = layer
+	logrus.Debugf("Imported layer %s", layerID)
+	return layer, nil
+}
+
+func (d *OverlayDriver) diffDir(layerID string) string {
+	return filepath.Join(d.baseDir, "diffs", layerID)
+}
+
+func (d *OverlayDriver) overlayDir(mountPoint string) string {
+	return filepath.Join(d.baseDir, "mounts", mountID(mountPoint))
 }
 
 func (d *OverlayDriver) GetLayer(layerID string) (*Layer, error) {
@@ -343,6 +485,9 @@ func (d *OverlayDriver) DeleteLayer(layerID string) error {
 	if !exists {
 		return fmt.Errorf("layer not found: %s", layerID)
 	}
+	if count := d.refCount(layerID); count > 0 {
+		return fmt.Errorf("layer %s is in use by %d images or containers", layerID, count)
+	}
 
 	// Remove layer files
 	if err := os.RemoveAll(layer.Path); err != nil {
@@ -362,16 +507,97 @@ func (d *OverlayDriver) DeleteLayer(layerID string) error {
 	return nil
 }
 
+// GetDiff lists the changes the layer makes to the layers below it.
 func (d *OverlayDriver) GetDiff(layerID string) (*Diff, error) {
-	// Simplified diff generation
-	// In real implementation, this would calculate actual differences
-	return &Diff{
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	layer, exists := d.layers[layerID]
+	if !exists {
+		return nil, fmt.Errorf("layer not found: %s", layerID)
+	}
+
+	diff := &Diff{
 		ID:       layerID,
-		Type:     "overlay",
-		Added:    []string{"/bin/sh", "/etc/hostname", "/etc/hosts"},
-		Modified: []string{"/etc/resolv.conf"},
+		Type:     d.name,
+		Added:    []string{},
+		Modified: []string{},
 		Deleted:  []string{},
-	}, nil
+	}
+	parentHas := d.parentHas(layer.Parent)
+	diffDir := d.diffDir(layerID)
+	err := filepath.Walk(diffDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(diffDir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		if name, ok := whiteoutTarget(info); ok {
+			if name != "" {
+				diff.Deleted = append(diff.Deleted, "/"+filepath.Join(filepath.Dir(rel), name))
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			diff.Size += info.Size()
+		}
+		if parentHas(rel) {
+			if !info.IsDir() {
+				diff.Modified = append(diff.Modified, "/"+rel)
+			}
+		} else {
+			diff.Added = append(diff.Added, "/"+rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read layer %s: %v", layerID, err)
+	}
+	return diff, nil
+}
+
+// Diff returns a tar stream of the changes made at mountPoint on top of
+// its layers, in the layout images use, for committing or pushing a
+// container's filesystem.
+func (d *OverlayDriver) Diff(mountPoint string) (io.ReadCloser, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	overlayDir := d.overlayDir(mountPoint)
+	upperDir := filepath.Join(overlayDir, "upper")
+	if _, err := os.Stat(upperDir); err != nil {
+		return nil, fmt.Errorf("mount point not found: %s", mountPoint)
+	}
+
+	var archive func(t *tarWriter) error
+	if _, err := os.Stat(filepath.Join(overlayDir, vfsMarker)); err == nil {
+		data, err := os.ReadFile(filepath.Join(overlayDir, "lower"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read mount layers: %v", err)
+		}
+		lowerDirs := strings.Split(string(data), "\n")
+		archive = func(t *tarWriter) error {
+			return archiveChanges(t, mountPoint, lowerDirs)
+		}
+	} else {
+		archive = func(t *tarWriter) error {
+			return archiveDir(t, upperDir)
+		}
+	}
+
+	return pipeTar(archive), nil
+}
+
+// WritableDir is the directory of the upper and work directories of
+// overlay mounts, which have to be on the same filesystem, and the mount
+// point itself for copies.
+func (d *OverlayDriver) WritableDir(mountPoint string) (string, error) {
+	if d.native {
+		return d.overlayDir(mountPoint), nil
+	}
+	return mountPoint, nil
 }
 
 func (d *OverlayDriver) GetUsageStats() map[string]interface{} {
@@ -390,16 +616,126 @@ func (d *OverlayDriver) GetUsageStats() map[string]interface{} {
 		"total_size_bytes": totalSize,
 		"layer_count":      layerCount,
 		"mount_count":      mountCount,
-		"driver":           "overlay",
+		"driver":           d.name,
+		"native":           d.native,
 		"base_dir":         d.baseDir,
 	}
 }
 
+// saveLayerMetadata writes layer.json into the layer's directory, through
+// a temporary file so a crash never leaves half of it.
 func (d *OverlayDriver) saveLayerMetadata(layer *Layer) error {
-	metadataPath := filepath.Join(layer.Path, "layer.json")
-	// In real implementation, this would save JSON metadata
-	// For now, just create the directory structure
-	return os.MkdirAll(layer.Path, 0755)
+	if err := os.MkdirAll(layer.Path, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(layer, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(layer.Path, layerMetadataFile)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// loadLayers reads the metadata of the layers stored before a restart,
+// then reconciles the diff directories with it: leftovers of interrupted
+// imports are removed, and so are diffs without metadata unless an image
+// or container still references them, in which case they are adopted.
+func (d *OverlayDriver) loadLayers() error {
+	layersDir := filepath.Join(d.baseDir, "layers")
+	entries, err := os.ReadDir(layersDir)
+	if err != nil {
+		return fmt.Errorf("failed to read layers: %v", err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(layersDir, entry.Name(), layerMetadataFile))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read layer %s: %v", entry.Name(), err)
+		}
+		var layer Layer
+		if err := json.Unmarshal(data, &layer); err != nil {
+			logrus.Warnf("Skipping layer %s with invalid metadata: %v", entry.Name(), err)
+			continue
+		}
+		// The store may have moved since, e.g. into an encrypted image
+		layer.Path = filepath.Join(layersDir, entry.Name())
+		d.layers[layer.ID] = &layer
+	}
+
+	diffsDir := filepath.Join(d.baseDir, "diffs")
+	entries, err = os.ReadDir(diffsDir)
+	if err != nil {
+		return fmt.Errorf("failed to read layer diffs: %v", err)
+	}
+	parents := d.referencedParents()
+	for _, entry := range entries {
+		layerID := entry.Name()
+		if _, exists := d.layers[layerID]; exists {
+			continue
+		}
+		diffDir := filepath.Join(diffsDir, layerID)
+		parent, referenced := parents[layerID]
+		if strings.HasPrefix(layerID, "tmp-") || !referenced {
+			logrus.Warnf("Removing orphaned layer diff %s", layerID)
+			if err := os.RemoveAll(diffDir); err != nil {
+				logrus.Warnf("Failed to remove %s: %v", diffDir, err)
+			}
+			continue
+		}
+
+		layer := &Layer{
+			ID:      layerID,
+			Parent:  parent,
+			DiffID:  layerID,
+			Size:    dirSize(diffDir),
+			Path:    filepath.Join(layersDir, layerID),
+			ChainID: layerID,
+		}
+		if info, err := entry.Info(); err == nil {
+			layer.Created = info.ModTime()
+		}
+		if err := d.saveLayerMetadata(layer); err != nil {
+			return fmt.Errorf("failed to save layer metadata: %v", err)
+		}
+		d.layers[layerID] = layer
+		logrus.Warnf("Adopted layer %s, whose metadata was missing", layerID)
+	}
+
+	// Chain IDs need the parents, so they are filled in once all are known
+	for _, layer := range d.layers {
+		if layer.ChainID == layer.ID && layer.Parent != "" {
+			if parent, exists := d.layers[layer.Parent]; exists {
+				layer.ChainID = fmt.Sprintf("%s-%s", parent.ChainID, layer.ID)
+			}
+		}
+	}
+
+	logrus.Debugf("Loaded %d layers", len(d.layers))
+	return nil
+}
+
+// referencedParents maps every referenced layer to the layer below it.
+// References list an owner's layers lowest first.
+func (d *OverlayDriver) referencedParents() map[string]string {
+	parents := make(map[string]string)
+	for _, layers := range d.refs {
+		for i, layerID := range layers {
+			if i > 0 {
+				parents[layerID] = layers[i-1]
+			} else if _, ok := parents[layerID]; !ok {
+				parents[layerID] = ""
+			}
+		}
+	}
+	return parents
 }
 
 func (d *OverlayDriver) generateLayerID(diffID string) string {
@@ -415,7 +751,7 @@ func (d *OverlayDriver) Cleanup() error {
 
 	// Unmount all mount points
 	for mountPoint := range d.mountPoints {
-		if err := d.Unmount(mountPoint); err != nil {
+		if err := d.unmount(mountPoint); err != nil {
 			logrus.Warnf("Failed to unmount %s: %v", mountPoint, err)
 		}
 	}
@@ -428,8 +764,3 @@ func (d *OverlayDriver) Cleanup() error {
 	logrus.Info("Overlay driver cleaned up")
 	return nil
 }
-
-func getTimestamp() string {
-	// Simplified timestamp generation
-	return "now"
-}
\ No newline at end of file
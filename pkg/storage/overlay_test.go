@@ -0,0 +1,267 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeLayer(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	}
+}
+
+func testMount(t *testing.T, native bool) {
+	driver, err := NewOverlayDriver(filepath.Join(t.TempDir(), "overlay"))
+	require.NoError(t, err)
+	if native && !driver.native {
+		t.Skip("overlay mounts are not available")
+	}
+	driver.native = native
+
+	lower, upper := t.TempDir(), t.TempDir()
+	writeLayer(t, lower, map[string]string{
+		"etc/os-release": "v1",
+		"bin/tool":       "tool",
+		"cache/old":      "old",
+	})
+	writeLayer(t, upper, map[string]string{
+		"etc/os-release":     "v2",
+		"bin/.wh.tool":       "",
+		"cache/.wh..wh..opq": "",
+		"cache/new":          "new",
+	})
+	_, err = driver.ImportLayer("sha256:lower", "", lower)
+	require.NoError(t, err)
+	_, err = driver.ImportLayer("sha256:upper", "sha256:lower", upper)
+	require.NoError(t, err)
+
+	mountPoint := filepath.Join(t.TempDir(), "containers", "c1", "rootfs")
+	require.NoError(t, driver.Mount([]string{"sha256:lower", "sha256:upper"}, mountPoint))
+	defer driver.Unmount(mountPoint)
+
+	mounted, err := isMountPoint(mountPoint)
+	require.NoError(t, err)
+	assert.Equal(t, native, mounted)
+
+	data, err := os.ReadFile(filepath.Join(mountPoint, "etc/os-release"))
+	require.NoError(t, err)
+	assert.Equal(t, "v2", string(data))
+	_, err = os.Lstat(filepath.Join(mountPoint, "bin/tool"))
+	assert.True(t, os.IsNotExist(err), "Whited out files should be hidden")
+	entries, err := os.ReadDir(filepath.Join(mountPoint, "cache"))
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "Opaque directories should hide lower contents")
+	assert.Equal(t, "new", entries[0].Name())
+
+	// Writes survive mounting again, as when a stopped container starts
+	require.NoError(t, os.WriteFile(filepath.Join(mountPoint, "written"), []byte("data"), 0644))
+	if native {
+		require.NoError(t, syscall.Unmount(mountPoint, 0))
+	}
+	require.NoError(t, driver.Mount([]string{"sha256:lower", "sha256:upper"}, mountPoint))
+	data, err = os.ReadFile(filepath.Join(mountPoint, "written"))
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+
+	lowerData, err := os.ReadFile(filepath.Join(driver.diffDir("sha256:lower"), "etc/os-release"))
+	require.NoError(t, err)
+	assert.Equal(t, "v1", string(lowerData), "Layers should not change")
+
+	require.NoError(t, driver.Unmount(mountPoint))
+	_, err = os.Stat(mountPoint)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(driver.overlayDir(mountPoint))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestOverlayMount(t *testing.T) {
+	testMount(t, true)
+}
+
+func TestOverlayMountFallback(t *testing.T) {
+	testMount(t, false)
+}
+
+type tarEntry struct {
+	name     string
+	typeflag byte
+	content  string
+	link     string
+}
+
+func buildTar(t *testing.T, entries []tarEntry) *bytes.Buffer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		hdr := &tar.Header{
+			Name:     entry.name,
+			Typeflag: entry.typeflag,
+			Mode:     0644,
+			Size:     int64(len(entry.content)),
+			Linkname: entry.link,
+		}
+		if entry.typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		if entry.typeflag != tar.TypeReg {
+			hdr.Size = 0
+		}
+		require.NoError(t, tw.WriteHeader(hdr))
+		_, err := tw.Write([]byte(entry.content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return &buf
+}
+
+func readTar(t *testing.T, r io.Reader) map[string]*tar.Header {
+	headers := make(map[string]*tar.Header)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return headers
+		}
+		require.NoError(t, err)
+		headers[hdr.Name] = hdr
+	}
+}
+
+func digest(content string) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(content)))
+}
+
+func testDiff(t *testing.T, native bool) {
+	driver, err := NewOverlayDriver(filepath.Join(t.TempDir(), "overlay"))
+	require.NoError(t, err)
+	if native && !driver.native {
+		t.Skip("overlay mounts are not available")
+	}
+	driver.native = native
+
+	base, err := driver.CreateLayer("", digest("base"))
+	require.NoError(t, err)
+	stats, err := driver.ApplyDiff(base.ID, buildTar(t, []tarEntry{
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/passwd", typeflag: tar.TypeReg, content: "root:x:0:0"},
+		{name: "bin/busybox", typeflag: tar.TypeReg, content: "binary"},
+		{name: "bin/sh", typeflag: tar.TypeLink, link: "bin/busybox"},
+		{name: "bin/ls", typeflag: tar.TypeSymlink, link: "busybox"},
+		{name: "tmp/junk", typeflag: tar.TypeReg, content: "junk"},
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, int64(len("root:x:0:0")+len("binary")+len("junk")), stats.Size)
+
+	upper, err := driver.CreateLayer(base.ID, digest("upper"))
+	require.NoError(t, err)
+	stats, err = driver.ApplyDiff(upper.ID, buildTar(t, []tarEntry{
+		{name: "tmp/.wh.junk", typeflag: tar.TypeReg},
+		{name: "etc/passwd", typeflag: tar.TypeReg, content: "root:x:0:0:root"},
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/tmp/junk"}, stats.Deleted)
+	assert.Equal(t, []string{"/etc/passwd"}, stats.Modified)
+
+	mountPoint := filepath.Join(t.TempDir(), "rootfs")
+	require.NoError(t, driver.Mount([]string{base.ID, upper.ID}, mountPoint))
+	defer driver.Unmount(mountPoint)
+
+	sh, err := os.Stat(filepath.Join(mountPoint, "bin/sh"))
+	require.NoError(t, err)
+	busybox, err := os.Stat(filepath.Join(mountPoint, "bin/busybox"))
+	require.NoError(t, err)
+	if native {
+		assert.True(t, os.SameFile(sh, busybox), "Hard links should be kept")
+	}
+	link, err := os.Readlink(filepath.Join(mountPoint, "bin/ls"))
+	require.NoError(t, err)
+	assert.Equal(t, "busybox", link)
+	_, err = os.Lstat(filepath.Join(mountPoint, "tmp/junk"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Change the container's filesystem and take its diff
+	require.NoError(t, os.WriteFile(filepath.Join(mountPoint, "etc/hostname"), []byte("box"), 0644))
+	require.NoError(t, os.Remove(filepath.Join(mountPoint, "etc/passwd")))
+
+	diff, err := driver.Diff(mountPoint)
+	require.NoError(t, err)
+	headers := readTar(t, diff)
+	require.NoError(t, diff.Close())
+
+	require.Contains(t, headers, "etc/hostname")
+	assert.Equal(t, int64(3), headers["etc/hostname"].Size)
+	assert.Contains(t, headers, "etc/.wh.passwd")
+	assert.NotContains(t, headers, "bin/busybox", "Unchanged files should be left out")
+
+	// The diff applies as a layer of its own
+	diff, err = driver.Diff(mountPoint)
+	require.NoError(t, err)
+	top, err := driver.CreateLayer(upper.ID, digest("top"))
+	require.NoError(t, err)
+	stats, err = driver.ApplyDiff(top.ID, diff)
+	require.NoError(t, err)
+	assert.Contains(t, stats.Added, "/etc/hostname")
+	assert.Equal(t, []string{"/etc/passwd"}, stats.Deleted)
+}
+
+func TestOverlayDiff(t *testing.T) {
+	testDiff(t, true)
+}
+
+func TestOverlayDiffFallback(t *testing.T) {
+	testDiff(t, false)
+}
+
+func TestLayerMetadataReload(t *testing.T) {
+	baseDir := filepath.Join(t.TempDir(), "overlay")
+	driver, err := NewOverlayDriver(baseDir)
+	require.NoError(t, err)
+
+	lower, upper := t.TempDir(), t.TempDir()
+	writeLayer(t, lower, map[string]string{"etc/os-release": "v1"})
+	writeLayer(t, upper, map[string]string{"app/run": "run"})
+	_, err = driver.ImportLayer("sha256:lower", "", lower)
+	require.NoError(t, err)
+	_, err = driver.ImportLayer("sha256:upper", "sha256:lower", upper)
+	require.NoError(t, err)
+	require.NoError(t, driver.AddReferences("image1", []string{"sha256:lower", "sha256:upper"}))
+
+	// A referenced diff whose metadata was lost, an unreferenced one and
+	// the leftover of an interrupted import
+	require.NoError(t, os.Remove(filepath.Join(baseDir, "layers", "sha256:upper", layerMetadataFile)))
+	writeLayer(t, driver.diffDir("sha256:orphan"), map[string]string{"file": "x"})
+	writeLayer(t, filepath.Join(baseDir, "diffs", "tmp-123"), map[string]string{"file": "x"})
+
+	reloaded, err := NewOverlayDriver(baseDir)
+	require.NoError(t, err)
+
+	lowerLayer, err := reloaded.GetLayer("sha256:lower")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), lowerLayer.Size)
+	assert.False(t, lowerLayer.Created.IsZero())
+
+	upperLayer, err := reloaded.GetLayer("sha256:upper")
+	require.NoError(t, err, "Referenced diffs should be adopted")
+	assert.Equal(t, "sha256:lower", upperLayer.Parent, "The parent should come from the references")
+	assert.Equal(t, "sha256:lower-sha256:upper", upperLayer.ChainID)
+	assert.FileExists(t, filepath.Join(baseDir, "layers", "sha256:upper", layerMetadataFile))
+
+	_, err = reloaded.GetLayer("sha256:orphan")
+	assert.Error(t, err)
+	assert.NoDirExists(t, reloaded.diffDir("sha256:orphan"), "Unreferenced diffs should be removed")
+	assert.NoDirExists(t, filepath.Join(baseDir, "diffs", "tmp-123"))
+	assert.Equal(t, 2, reloaded.RefCount("sha256:lower")+reloaded.RefCount("sha256:upper"))
+}
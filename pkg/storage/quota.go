@@ -0,0 +1,462 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/sirupsen/logrus"
+)
+
+// mkfsBinary formats the images of loopback quotas
+var mkfsBinary = "mkfs.ext4"
+
+const (
+	QuotaBackendProject  = "project"
+	QuotaBackendLoopback = "loopback"
+
+	// Generic quotactl interface, see quotactl(2)
+	qGetQuota   = 0x800007
+	qSetQuota   = 0x800008
+	prjQuota    = 2
+	qifBLimits  = 1
+	qifSpace    = 4
+	qifBlockLen = 1024
+
+	fsIocFsGetXattr     = 0x801c581f
+	fsIocFsSetXattr     = 0x401c5820
+	fsXflagProjInherit  = 0x200
+	firstQuotaProjectID = 100000
+)
+
+// ifDqblk is struct if_dqblk of the generic quotactl interface
+type ifDqblk struct {
+	bhardlimit uint64
+	bsoftlimit uint64
+	curspace   uint64
+	ihardlimit uint64
+	isoftlimit uint64
+	curinodes  uint64
+	btime      uint64
+	itime      uint64
+	valid      uint32
+}
+
+type fsxattr struct {
+	xflags     uint32
+	extsize    uint32
+	nextents   uint32
+	projid     uint32
+	cowextsize uint32
+	pad        [8]byte
+}
+
+// Quota limits how much a container's writable layer or a volume can
+// hold.
+type Quota struct {
+	Owner   string `json:"owner"`
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	Backend string `json:"backend"`
+	// ProjectID is the project of project quotas
+	ProjectID uint32 `json:"project_id,omitempty"`
+	// Image is the filesystem image of loopback quotas
+	Image string `json:"image,omitempty"`
+	Used  int64  `json:"used"`
+}
+
+// QuotaController enforces size limits on directories. It uses project
+// quotas when the filesystem has them enabled (xfs or ext4 mounted with
+// prjquota), and otherwise mounts a fixed size ext4 image on the
+// directory.
+type QuotaController struct {
+	dir     string
+	backend string
+	// device is a block device node of the filesystem project quotas are
+	// set on
+	device        string
+	quotas        map[string]*Quota
+	nextProjectID uint32
+	mu            sync.Mutex
+}
+
+type quotaState struct {
+	NextProjectID uint32   `json:"next_project_id"`
+	Quotas        []*Quota `json:"quotas"`
+}
+
+// NewQuotaController keeps its state and images in dir, and picks the
+// backend for the filesystem dir is on.
+func NewQuotaController(dir string) (*QuotaController, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create quota directory: %v", err)
+	}
+
+	qc := &QuotaController{
+		dir:           dir,
+		quotas:        make(map[string]*Quota),
+		nextProjectID: firstQuotaProjectID,
+	}
+	if err := qc.load(); err != nil {
+		return nil, err
+	}
+
+	if device, err := projectQuotaDevice(dir); err == nil {
+		qc.backend = QuotaBackendProject
+		qc.device = device
+	} else {
+		logrus.Debugf("Project quotas are not available: %v", err)
+		if _, err := exec.LookPath(mkfsBinary); err != nil {
+			return nil, fmt.Errorf("quotas need a filesystem with project quotas enabled or %s for loopback images", mkfsBinary)
+		}
+		qc.backend = QuotaBackendLoopback
+	}
+
+	logrus.Infof("Storage quotas enabled using %s quotas", qc.backend)
+	return qc, nil
+}
+
+// Backend is the way quotas are enforced: project or loopback.
+func (qc *QuotaController) Backend() string {
+	return qc.backend
+}
+
+// projectQuotaDevice makes a device node for the block device of the
+// filesystem dir is on and checks it has project quotas turned on.
+func projectQuotaDevice(dir string) (string, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(dir, &st); err != nil {
+		return "", err
+	}
+	device := filepath.Join(dir, "backingFsBlockDev")
+	os.Remove(device)
+	if err := syscall.Mknod(device, syscall.S_IFBLK|0600, int(st.Dev)); err != nil {
+		return "", fmt.Errorf("failed to create device node: %v", err)
+	}
+	var dq ifDqblk
+	if err := quotactl(qGetQuota, device, 0, &dq); err != nil {
+		os.Remove(device)
+		return "", err
+	}
+	return device, nil
+}
+
+func quotactl(cmd int, device string, id uint32, dq *ifDqblk) error {
+	path, err := syscall.BytePtrFromString(device)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_QUOTACTL, uintptr(cmd<<8|prjQuota),
+		uintptr(unsafe.Pointer(path)), uintptr(id), uintptr(unsafe.Pointer(dq)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// setProjectID puts dir in project id, and has what is created in it
+// inherit the project.
+func setProjectID(dir string, id uint32) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var attr fsxattr
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), fsIocFsGetXattr, uintptr(unsafe.Pointer(&attr))); errno != 0 {
+		return fmt.Errorf("failed to get project of %s: %v", dir, errno)
+	}
+	attr.projid = id
+	attr.xflags |= fsXflagProjInherit
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), fsIocFsSetXattr, uintptr(unsafe.Pointer(&attr))); errno != 0 {
+		return fmt.Errorf("failed to set project of %s: %v", dir, errno)
+	}
+	return nil
+}
+
+// SetQuota limits path to size bytes on behalf of owner. Setting the
+// quota of an owner again re-applies it, e.g. to mount its image after a
+// reboot.
+func (qc *QuotaController) SetQuota(owner, path string, size int64) error {
+	if size <= 0 {
+		return fmt.Errorf("invalid quota size: %d", size)
+	}
+
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+
+	quota, exists := qc.quotas[owner]
+	if exists && quota.Size != size && quota.Backend == QuotaBackendLoopback {
+		return fmt.Errorf("quota of %s is already %d bytes", owner, quota.Size)
+	}
+	if !exists {
+		quota = &Quota{Owner: owner, Path: path, Size: size, Backend: qc.backend}
+	}
+	quota.Size = size
+
+	var err error
+	if quota.Backend == QuotaBackendProject {
+		err = qc.setProjectQuota(quota)
+	} else {
+		err = qc.setLoopbackQuota(quota)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set quota of %s: %v", owner, err)
+	}
+
+	qc.quotas[owner] = quota
+	return qc.save()
+}
+
+func (qc *QuotaController) setProjectQuota(quota *Quota) error {
+	if quota.ProjectID == 0 {
+		quota.ProjectID = qc.nextProjectID
+		qc.nextProjectID++
+	}
+	if err := setProjectID(quota.Path, quota.ProjectID); err != nil {
+		return err
+	}
+	blocks := uint64((quota.Size + qifBlockLen - 1) / qifBlockLen)
+	dq := ifDqblk{bhardlimit: blocks, bsoftlimit: blocks, valid: qifBLimits}
+	return quotactl(qSetQuota, qc.device, quota.ProjectID, &dq)
+}
+
+func (qc *QuotaController) setLoopbackQuota(quota *Quota) error {
+	if quota.Image == "" {
+		quota.Image = filepath.Join(qc.dir, strings.NewReplacer(":", "-", "/", "-").Replace(quota.Owner)+".img")
+	}
+	mounted, err := isMountPoint(quota.Path)
+	if err != nil || mounted {
+		return err
+	}
+
+	fresh := false
+	if _, err := os.Stat(quota.Image); os.IsNotExist(err) {
+		// Whatever is already in path would be hidden by the mount
+		entries, err := os.ReadDir(quota.Path)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return fmt.Errorf("%s is not empty", quota.Path)
+		}
+		if err := createFilesystemImage(quota.Image, quota.Size); err != nil {
+			return err
+		}
+		fresh = true
+	}
+
+	output, err := exec.Command("mount", "-o", "loop", quota.Image, quota.Path).CombinedOutput()
+	if err != nil {
+		if fresh {
+			os.Remove(quota.Image)
+		}
+		return fmt.Errorf("failed to mount %s: %v: %s", quota.Image, err, strings.TrimSpace(string(output)))
+	}
+	if fresh {
+		os.RemoveAll(filepath.Join(quota.Path, "lost+found"))
+	}
+	return nil
+}
+
+func createFilesystemImage(image string, size int64) error {
+	f, err := os.Create(image)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(size)
+	f.Close()
+	if err != nil {
+		os.Remove(image)
+		return err
+	}
+	// No blocks are reserved for root, so all of size can be used
+	output, err := exec.Command(mkfsBinary, "-q", "-F", "-m", "0", image).CombinedOutput()
+	if err != nil {
+		os.Remove(image)
+		return fmt.Errorf("%s: %v: %s", mkfsBinary, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// RemoveQuota lifts the quota of owner and frees what it took. Loopback
+// quotas lose their content, so it is called once their directory is no
+// longer needed.
+func (qc *QuotaController) RemoveQuota(owner string) error {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+
+	quota, exists := qc.quotas[owner]
+	if !exists {
+		return nil
+	}
+
+	if quota.Backend == QuotaBackendProject {
+		dq := ifDqblk{valid: qifBLimits}
+		if err := quotactl(qSetQuota, qc.device, quota.ProjectID, &dq); err != nil {
+			logrus.Warnf("Failed to clear quota of project %d: %v", quota.ProjectID, err)
+		}
+	} else {
+		if mounted, _ := isMountPoint(quota.Path); mounted {
+			if err := syscall.Unmount(quota.Path, syscall.MNT_DETACH); err != nil {
+				return fmt.Errorf("failed to unmount quota of %s: %v", owner, err)
+			}
+		}
+		if err := os.Remove(quota.Image); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove quota image: %v", err)
+		}
+	}
+
+	delete(qc.quotas, owner)
+	return qc.save()
+}
+
+// GetQuota returns the quota of owner with its current usage.
+func (qc *QuotaController) GetQuota(owner string) (*Quota, error) {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+
+	quota, exists := qc.quotas[owner]
+	if !exists {
+		return nil, fmt.Errorf("no quota for %s", owner)
+	}
+	return qc.withUsage(quota), nil
+}
+
+// ListQuotas returns every quota with its current usage, ordered by
+// owner.
+func (qc *QuotaController) ListQuotas() []*Quota {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+
+	var quotas []*Quota
+	for _, quota := range qc.quotas {
+		quotas = append(quotas, qc.withUsage(quota))
+	}
+	sort.Slice(quotas, func(i, j int) bool { return quotas[i].Owner < quotas[j].Owner })
+	return quotas
+}
+
+func (qc *QuotaController) withUsage(quota *Quota) *Quota {
+	q := *quota
+	if q.Backend == QuotaBackendProject {
+		var dq ifDqblk
+		if err := quotactl(qGetQuota, qc.device, q.ProjectID, &dq); err == nil && dq.valid&qifSpace != 0 {
+			q.Used = int64(dq.curspace)
+		}
+	} else if mounted, _ := isMountPoint(q.Path); mounted {
+		var fs syscall.Statfs_t
+		if err := syscall.Statfs(q.Path, &fs); err == nil {
+			q.Used = int64(fs.Blocks-fs.Bfree) * int64(fs.Bsize)
+		}
+	}
+	return &q
+}
+
+// GetUsageStats summarizes the quotas for storage stats.
+func (qc *QuotaController) GetUsageStats() map[string]interface{} {
+	quotas := qc.ListQuotas()
+	var limit, used int64
+	for _, quota := range quotas {
+		limit += quota.Size
+		used += quota.Used
+	}
+	return map[string]interface{}{
+		"backend":           qc.backend,
+		"quota_count":       len(quotas),
+		"total_limit_bytes": limit,
+		"total_used_bytes":  used,
+		"quotas":            quotas,
+	}
+}
+
+func (qc *QuotaController) load() error {
+	data, err := os.ReadFile(filepath.Join(qc.dir, "quotas.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read quotas: %v", err)
+	}
+	var state quotaState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("failed to parse quotas: %v", err)
+	}
+	if state.NextProjectID > qc.nextProjectID {
+		qc.nextProjectID = state.NextProjectID
+	}
+	for _, quota := range state.Quotas {
+		qc.quotas[quota.Owner] = quota
+	}
+	return nil
+}
+
+func (qc *QuotaController) save() error {
+	state := quotaState{NextProjectID: qc.nextProjectID}
+	for _, quota := range qc.quotas {
+		state.Quotas = append(state.Quotas, quota)
+	}
+	sort.Slice(state.Quotas, func(i, j int) bool { return state.Quotas[i].Owner < state.Quotas[j].Owner })
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal quotas: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(qc.dir, "quotas.json"), data, 0644); err != nil {
+		return fmt.Errorf("failed to save quotas: %v", err)
+	}
+	return nil
+}
+
+// StorageOptSize reads the size limit from the storage options of a
+// container, e.g. size=10G. It is zero when no size is given.
+func StorageOptSize(opts map[string]string) (int64, error) {
+	var size int64
+	for key, value := range opts {
+		switch strings.ToLower(key) {
+		case "size":
+			n, err := ParseSize(value)
+			if err != nil {
+				return 0, err
+			}
+			size = n
+		default:
+			return 0, fmt.Errorf("unknown storage option: %s", key)
+		}
+	}
+	return size, nil
+}
+
+// ParseSize parses sizes such as 512m or 10G using binary units.
+func ParseSize(value string) (int64, error) {
+	s := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(value)), "b")
+	multiplier := int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'k':
+			multiplier = 1 << 10
+		case 'm':
+			multiplier = 1 << 20
+		case 'g':
+			multiplier = 1 << 30
+		case 't':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size: %s", value)
+	}
+	return int64(n * float64(multiplier)), nil
+}
@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStorageOptSize(t *testing.T) {
+	size, err := StorageOptSize(map[string]string{"size": "10G"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(10<<30), size)
+
+	size, err = StorageOptSize(nil)
+	require.NoError(t, err)
+	assert.Zero(t, size)
+
+	_, err = StorageOptSize(map[string]string{"size": "lots"})
+	assert.Error(t, err)
+	_, err = StorageOptSize(map[string]string{"inodes": "100"})
+	assert.Error(t, err)
+}
+
+func TestLoopbackQuota(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("loopback quotas need root")
+	}
+	if _, err := exec.LookPath(mkfsBinary); err != nil {
+		t.Skip("mkfs.ext4 not available")
+	}
+
+	qc, err := NewQuotaController(filepath.Join(t.TempDir(), "quotas"))
+	require.NoError(t, err)
+	if qc.Backend() != QuotaBackendLoopback {
+		t.Skip("filesystem has project quotas")
+	}
+
+	dir := t.TempDir()
+	require.NoError(t, qc.SetQuota("volume:data", dir, 8<<20))
+	defer qc.RemoveQuota("volume:data")
+
+	_, err = os.Stat(filepath.Join(dir, "lost+found"))
+	assert.True(t, os.IsNotExist(err))
+	err = os.WriteFile(filepath.Join(dir, "big"), make([]byte, 16<<20), 0644)
+	assert.Error(t, err, "writes past the quota should fail")
+
+	quota, err := qc.GetQuota("volume:data")
+	require.NoError(t, err)
+	assert.Equal(t, int64(8<<20), quota.Size)
+	assert.NotZero(t, quota.Used)
+
+	// Setting it again, as on a restart, is a no-op
+	require.NoError(t, qc.SetQuota("volume:data", dir, 8<<20))
+	assert.Error(t, qc.SetQuota("volume:data", dir, 16<<20))
+
+	require.NoError(t, qc.RemoveQuota("volume:data"))
+	mounted, err := isMountPoint(dir)
+	require.NoError(t, err)
+	assert.False(t, mounted)
+	_, err = os.Stat(quota.Image)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+)
+
+const referencesFile = "refs.json"
+
+// LayerPruneReport lists the layers removed by a garbage collection and
+// the bytes their diffs took up.
+type LayerPruneReport struct {
+	LayersDeleted  []string `json:"layers_deleted"`
+	SpaceReclaimed int64    `json:"space_reclaimed"`
+}
+
+// AddReferences records that owner (an image or a container) uses the
+// given layers, replacing whatever the owner referenced before.
+func (d *OverlayDriver) AddReferences(owner string, layerIDs []string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, layerID := range layerIDs {
+		if _, exists := d.layers[layerID]; !exists {
+			return fmt.Errorf("layer not found: %s", layerID)
+		}
+	}
+	d.refs[owner] = append([]string(nil), layerIDs...)
+	return d.saveReferences()
+}
+
+// RemoveReferences drops every reference held by owner. The layers stay on
+// disk until the next garbage collection.
+func (d *OverlayDriver) RemoveReferences(owner string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.refs[owner]; !ok {
+		return nil
+	}
+	delete(d.refs, owner)
+	return d.saveReferences()
+}
+
+// RefCount returns how many images and containers use the layer.
+func (d *OverlayDriver) RefCount(layerID string) int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.refCount(layerID)
+}
+
+func (d *OverlayDriver) refCount(layerID string) int {
+	count := 0
+	for _, layers := range d.refs {
+		for _, id := range layers {
+			if id == layerID {
+				count++
+				break
+			}
+		}
+	}
+	return count
+}
+
+// GarbageCollect deletes every layer that no image or container references,
+// directly or as the parent of a referenced layer.
+func (d *OverlayDriver) GarbageCollect() (*LayerPruneReport, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	live := make(map[string]bool)
+	for _, layers := range d.refs {
+		for _, layerID := range layers {
+			// Parents are needed to mount their children
+			for id := layerID; id != "" && !live[id]; {
+				live[id] = true
+				layer, exists := d.layers[id]
+				if !exists {
+					break
+				}
+				id = layer.Parent
+			}
+		}
+	}
+
+	report := &LayerPruneReport{LayersDeleted: []string{}}
+	for layerID, layer := range d.layers {
+		if live[layerID] {
+			continue
+		}
+		diffDir := filepath.Join(d.baseDir, "diffs", layerID)
+		size := dirSize(diffDir) + dirSize(layer.Path)
+
+		if err := os.RemoveAll(diffDir); err != nil {
+			return report, fmt.Errorf("failed to remove diff of layer %s: %v", layerID, err)
+		}
+		if err := os.RemoveAll(layer.Path); err != nil {
+			return report, fmt.Errorf("failed to remove layer %s: %v", layerID, err)
+		}
+		delete(d.layers, layerID)
+
+		report.LayersDeleted = append(report.LayersDeleted, layerID)
+		report.SpaceReclaimed += size
+	}
+	sort.Strings(report.LayersDeleted)
+
+	logrus.Infof("Layer garbage collection removed %d layers, reclaimed %d bytes", len(report.LayersDeleted), report.SpaceReclaimed)
+	return report, nil
+}
+
+func (d *OverlayDriver) loadReferences() error {
+	data, err := os.ReadFile(filepath.Join(d.baseDir, referencesFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read layer references: %v", err)
+	}
+	if err := json.Unmarshal(data, &d.refs); err != nil {
+		return fmt.Errorf("failed to parse layer references: %v", err)
+	}
+	if d.refs == nil {
+		d.refs = make(map[string][]string)
+	}
+	return nil
+}
+
+// saveReferences must be called with mu held.
+func (d *OverlayDriver) saveReferences() error {
+	data, err := json.MarshalIndent(d.refs, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal layer references: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(d.baseDir, referencesFile), data, 0644); err != nil {
+		return fmt.Errorf("failed to save layer references: %v", err)
+	}
+	return nil
+}
+
+func dirSize(root string) int64 {
+	var size int64
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
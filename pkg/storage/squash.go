@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const whiteoutPrefix = ".wh."
+
+// SquashLayers merges the diffs of the given layers, lowest first, into a
+// new layer without a parent. Files deleted by an upper layer are left out
+// rather than carried over as whiteouts.
+func (d *OverlayDriver) SquashLayers(layerIDs []string) (*Layer, error) {
+	if len(layerIDs) == 0 {
+		return nil, fmt.Errorf("no layers to squash")
+	}
+
+	d.mu.RLock()
+	var diffIDs []string
+	for _, layerID := range layerIDs {
+		layer, exists := d.layers[layerID]
+		if !exists {
+			d.mu.RUnlock()
+			return nil, fmt.Errorf("layer not found: %s", layerID)
+		}
+		diffIDs = append(diffIDs, layer.DiffID)
+	}
+	d.mu.RUnlock()
+
+	diffID := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(strings.Join(diffIDs, "\n"))))
+	layer, err := d.CreateLayer("", diffID)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	diffDir := filepath.Join(d.baseDir, "diffs", layer.ID)
+	if err := os.MkdirAll(diffDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create diff directory: %v", err)
+	}
+	for _, layerID := range layerIDs {
+		if err := applyLayerDiff(filepath.Join(d.baseDir, "diffs", layerID), diffDir); err != nil {
+			os.RemoveAll(diffDir)
+			return nil, fmt.Errorf("failed to squash layer %s: %v", layerID, err)
+		}
+	}
+
+	size := dirSize(diffDir)
+	layer.Size = size
+
+	if err := d.saveLayerMetadata(layer); err != nil {
+		return nil, fmt.Errorf("failed to save layer metadata: %v", err)
+	}
+
+	logrus.Infof("Squashed %d layers into %s (%d bytes)", len(layerIDs), layer.ID, size)
+	return layer, nil
+}
+
+// applyLayerDiff copies a diff directory onto dest, removing the paths its
+// whiteouts name and the contents of directories it makes opaque.
+func applyLayerDiff(diffDir, dest string) error {
+	if _, err := os.Stat(diffDir); os.IsNotExist(err) {
+		return nil
+	}
+
+	return filepath.Walk(diffDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(diffDir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		target := filepath.Join(dest, rel)
+		if name, ok := whiteoutTarget(info); ok {
+			if name == "" {
+				return nil
+			}
+			return os.RemoveAll(filepath.Join(filepath.Dir(target), name))
+		}
+
+		switch {
+		case info.IsDir():
+			if existing, err := os.Lstat(target); err == nil && (!existing.IsDir() || opaqueDir(path)) {
+				os.RemoveAll(target)
+			}
+			return os.MkdirAll(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			os.RemoveAll(target)
+			return os.Symlink(link, target)
+		default:
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			os.RemoveAll(target)
+			return os.WriteFile(target, data, info.Mode().Perm())
+		}
+	})
+}
@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	RegisterVolumeDriver("tmpfs", func(baseDir string) (VolumeDriver, error) {
+		return NewTmpfsVolumeDriver(baseDir), nil
+	})
+}
+
+// TmpfsVolumeDriver keeps volumes in memory. A volume is a tmpfs mounted
+// when it is created, so its data is shared by the containers using it
+// until it is removed or the host restarts. It takes the options size
+// (e.g. 64m), mode (octal, e.g. 1777), uid and gid.
+type TmpfsVolumeDriver struct {
+	baseDir string
+}
+
+func NewTmpfsVolumeDriver(baseDir string) *TmpfsVolumeDriver {
+	return &TmpfsVolumeDriver{baseDir: baseDir}
+}
+
+func (d *TmpfsVolumeDriver) Name() string {
+	return "tmpfs"
+}
+
+// tmpfsMountData turns volume options into tmpfs mount options.
+func tmpfsMountData(options map[string]string) (string, error) {
+	var data []string
+	for _, key := range []string{"size", "mode", "uid", "gid"} {
+		value, ok := options[key]
+		if !ok {
+			continue
+		}
+		switch key {
+		case "size":
+			size, err := ParseSize(value)
+			if err != nil || size <= 0 {
+				return "", fmt.Errorf("invalid tmpfs size: %s", value)
+			}
+			value = strconv.FormatInt(size, 10)
+		case "mode":
+			if _, err := strconv.ParseUint(value, 8, 32); err != nil {
+				return "", fmt.Errorf("invalid tmpfs mode: %s", value)
+			}
+		default:
+			if _, err := strconv.ParseUint(value, 10, 32); err != nil {
+				return "", fmt.Errorf("invalid tmpfs %s: %s", key, value)
+			}
+		}
+		data = append(data, key+"="+value)
+	}
+	for key := range options {
+		switch key {
+		case "size", "mode", "uid", "gid":
+		default:
+			return "", fmt.Errorf("unknown tmpfs volume option: %s", key)
+		}
+	}
+	return strings.Join(data, ","), nil
+}
+
+func (d *TmpfsVolumeDriver) Create(name string, options map[string]string) (*Volume, error) {
+	if _, err := tmpfsMountData(options); err != nil {
+		return nil, err
+	}
+
+	volumePath := filepath.Join(d.baseDir, name)
+	if err := os.MkdirAll(volumePath, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create volume directory: %v", err)
+	}
+
+	volume := newVolume(name, "tmpfs", volumePath, options)
+	if err := d.mount(volume); err != nil {
+		os.Remove(volumePath)
+		return nil, err
+	}
+
+	logrus.Infof("Created tmpfs volume: %s at %s", name, volumePath)
+	return volume, nil
+}
+
+// mount mounts the tmpfs of a volume unless it already is, e.g. again
+// after a restart.
+func (d *TmpfsVolumeDriver) mount(volume *Volume) error {
+	if mounted, _ := isMountPoint(volume.Mountpoint); mounted {
+		return nil
+	}
+	data, err := tmpfsMountData(volume.Options)
+	if err != nil {
+		return err
+	}
+	if err := syscall.Mount("tmpfs", volume.Mountpoint, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, data); err != nil {
+		return fmt.Errorf("failed to mount tmpfs: %v", err)
+	}
+	return nil
+}
+
+func (d *TmpfsVolumeDriver) Remove(volume *Volume) error {
+	if volume.UsageData.RefCount > 0 {
+		return fmt.Errorf("volume %s is still in use (%d references)", volume.Name, volume.UsageData.RefCount)
+	}
+
+	if mounted, _ := isMountPoint(volume.Mountpoint); mounted {
+		if err := syscall.Unmount(volume.Mountpoint, syscall.MNT_DETACH); err != nil {
+			return fmt.Errorf("failed to unmount volume: %v", err)
+		}
+	}
+	if err := os.RemoveAll(volume.Mountpoint); err != nil {
+		return fmt.Errorf("failed to remove volume directory: %v", err)
+	}
+
+	logrus.Infof("Removed tmpfs volume: %s", volume.Name)
+	return nil
+}
+
+func (d *TmpfsVolumeDriver) Mount(volume *Volume, target string) error {
+	if err := d.mount(volume); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return fmt.Errorf("failed to create mount target: %v", err)
+	}
+
+	logrus.Infof("Mounted tmpfs volume %s to %s", volume.Name, target)
+	return nil
+}
+
+func (d *TmpfsVolumeDriver) Unmount(volume *Volume, target string) error {
+	// The tmpfs stays mounted so its data outlives the container
+	logrus.Infof("Unmounted tmpfs volume %s from %s", volume.Name, target)
+	return nil
+}
+
+func (d *TmpfsVolumeDriver) GetPath(volume *Volume) string {
+	return volume.Mountpoint
+}
+
+func (d *TmpfsVolumeDriver) Usage(volume *Volume) (*UsageData, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(volume.Mountpoint, &stat); err != nil {
+		return nil, fmt.Errorf("failed to calculate volume size: %v", err)
+	}
+
+	volume.UsageData.Size = int64(stat.Blocks-stat.Bfree) * int64(stat.Bsize)
+	return volume.UsageData, nil
+}
@@ -0,0 +1,17 @@
+package storage
+
+// VFSDriver never mounts anything: a container's filesystem is a plain
+// directory holding a copy of its layers. It is slow to create containers
+// and uses a lot of space, but works on every filesystem and without
+// privileges.
+type VFSDriver struct {
+	*OverlayDriver
+}
+
+func NewVFSDriver(baseDir string) (*VFSDriver, error) {
+	driver, err := newOverlayDriver("vfs", baseDir)
+	if err != nil {
+		return nil, err
+	}
+	return &VFSDriver{OverlayDriver: driver}, nil
+}
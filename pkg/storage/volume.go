@@ -5,9 +5,12 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
+	"syscall"
 	"time"
 
+	"docker-impl/pkg/timeutil"
 	"github.com/sirupsen/logrus"
 )
 
@@ -16,7 +19,7 @@ type Volume struct {
 	Name        string            `json:"name"`
 	Driver      string            `json:"driver"`
 	Mountpoint  string            `json:"mountpoint"`
-	CreatedAt   string            `json:"created_at"`
+	CreatedAt   time.Time         `json:"created_at"`
 	Status      map[string]string `json:"status"`
 	Labels      map[string]string `json:"labels"`
 	Options     map[string]string `json:"options"`
@@ -27,7 +30,7 @@ type Volume struct {
 type UsageData struct {
 	Size        int64   `json:"size"`
 	RefCount    int     `json:"ref_count"`
-	LastUsed    string  `json:"last_used"`
+	LastUsed    time.Time `json:"last_used"`
 	AccessCount int     `json:"access_count"`
 }
 
@@ -36,10 +39,14 @@ type VolumeManager struct {
 	volumes   map[string]*Volume
 	mounts    map[string][]string // volumeID -> containerIDs
 	mu        sync.RWMutex
-	driver    VolumeDriver
+	// drivers holds the drivers created so far by name; defaultDriver
+	// creates volumes that don't name one
+	drivers       map[string]VolumeDriver
+	defaultDriver string
 }
 
 type VolumeDriver interface {
+	Name() string
 	Create(name string, options map[string]string) (*Volume, error)
 	Remove(volume *Volume) error
 	Mount(volume *Volume, target string) error
@@ -48,6 +55,50 @@ type VolumeDriver interface {
 	Usage(volume *Volume) (*UsageData, error)
 }
 
+// VolumeDriverFactory creates a volume driver whose volumes live under
+// baseDir.
+type VolumeDriverFactory func(baseDir string) (VolumeDriver, error)
+
+var (
+	volumeDriverFactories = make(map[string]VolumeDriverFactory)
+	volumeDriversMu       sync.RWMutex
+)
+
+// RegisterVolumeDriver makes a volume driver available by name, e.g. to
+// "volume create --driver".
+func RegisterVolumeDriver(name string, factory VolumeDriverFactory) error {
+	volumeDriversMu.Lock()
+	defer volumeDriversMu.Unlock()
+
+	if name == "" || factory == nil {
+		return fmt.Errorf("volume driver needs a name and a factory")
+	}
+	if _, exists := volumeDriverFactories[name]; exists {
+		return fmt.Errorf("volume driver %s is already registered", name)
+	}
+	volumeDriverFactories[name] = factory
+	return nil
+}
+
+// VolumeDrivers returns the names of the registered volume drivers.
+func VolumeDrivers() []string {
+	volumeDriversMu.RLock()
+	defer volumeDriversMu.RUnlock()
+
+	names := make([]string, 0, len(volumeDriverFactories))
+	for name := range volumeDriverFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	RegisterVolumeDriver("local", func(baseDir string) (VolumeDriver, error) {
+		return NewLocalVolumeDriver(baseDir), nil
+	})
+}
+
 type LocalVolumeDriver struct {
 	baseDir string
 }
@@ -56,30 +107,34 @@ func NewLocalVolumeDriver(baseDir string) *LocalVolumeDriver {
 	return &LocalVolumeDriver{baseDir: baseDir}
 }
 
-func (d *LocalVolumeDriver) Create(name string, options map[string]string) (*Volume, error) {
-	volumePath := filepath.Join(d.baseDir, name)
-
-	if err := os.MkdirAll(volumePath, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create volume directory: %v", err)
-	}
+func (d *LocalVolumeDriver) Name() string {
+	return "local"
+}
 
-	volume := &Volume{
+// newVolume describes a volume of driver mounted at volumePath.
+func newVolume(name, driver, volumePath string, options map[string]string) *Volume {
+	return &Volume{
 		ID:         generateVolumeID(name),
 		Name:       name,
-		Driver:     "local",
+		Driver:     driver,
 		Mountpoint: volumePath,
-		CreatedAt:  time.Now().Format(time.RFC3339),
+		CreatedAt:  time.Now(),
 		Status:     make(map[string]string),
 		Labels:     make(map[string]string),
 		Options:    options,
 		Scope:      "local",
-		UsageData: &UsageData{
-			Size:        0,
-			RefCount:    0,
-			LastUsed:    "",
-			AccessCount: 0,
-		},
+		UsageData:  &UsageData{},
 	}
+}
+
+func (d *LocalVolumeDriver) Create(name string, options map[string]string) (*Volume, error) {
+	volumePath := filepath.Join(d.baseDir, name)
+
+	if err := os.MkdirAll(volumePath, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create volume directory: %v", err)
+	}
+
+	volume := newVolume(name, "local", volumePath, options)
 
 	// Set default options
 	if _, ok := options["type"]; !ok {
@@ -95,6 +150,12 @@ func (d *LocalVolumeDriver) Remove(volume *Volume) error {
 		return fmt.Errorf("volume %s is still in use (%d references)", volume.Name, volume.UsageData.RefCount)
 	}
 
+	// Volumes with a size limit are the mount of a filesystem image
+	if mounted, _ := isMountPoint(volume.Mountpoint); mounted {
+		if err := syscall.Unmount(volume.Mountpoint, syscall.MNT_DETACH); err != nil {
+			return fmt.Errorf("failed to unmount volume: %v", err)
+		}
+	}
 	if err := os.RemoveAll(volume.Mountpoint); err != nil {
 		return fmt.Errorf("failed to remove volume directory: %v", err)
 	}
@@ -151,10 +212,11 @@ func (d *LocalVolumeDriver) calculateDirectorySize(path string) (int64, error) {
 
 func NewVolumeManager(baseDir string) (*VolumeManager, error) {
 	vm := &VolumeManager{
-		baseDir: baseDir,
-		volumes: make(map[string]*Volume),
-		mounts:   make(map[string][]string),
-		driver:  NewLocalVolumeDriver(baseDir),
+		baseDir:       baseDir,
+		volumes:       make(map[string]*Volume),
+		mounts:        make(map[string][]string),
+		drivers:       make(map[string]VolumeDriver),
+		defaultDriver: "local",
 	}
 
 	if err := vm.init(); err != nil {
@@ -186,7 +248,60 @@ func (vm *VolumeManager) init() error {
 	return nil
 }
 
-func (vm *VolumeManager) CreateVolume(name string, options map[string]string, labels map[string]string) (*Volume, error) {
+// SetDefaultDriver sets the driver of volumes created without one.
+func (vm *VolumeManager) SetDefaultDriver(name string) error {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+
+	if _, err := vm.getDriver(name); err != nil {
+		return err
+	}
+	vm.defaultDriver = name
+	return nil
+}
+
+// AddDriver makes a driver created outside the registry, such as one
+// holding keys, available by its name.
+func (vm *VolumeManager) AddDriver(driver VolumeDriver) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	vm.drivers[driver.Name()] = driver
+}
+
+// DefaultDriver returns the driver of volumes created without one.
+func (vm *VolumeManager) DefaultDriver() string {
+	vm.mu.RLock()
+	defer vm.mu.RUnlock()
+	return vm.defaultDriver
+}
+
+// getDriver returns the driver called name, creating it on first use.
+// Volumes saved before drivers were recorded are local.
+func (vm *VolumeManager) getDriver(name string) (VolumeDriver, error) {
+	if name == "" {
+		name = "local"
+	}
+	if driver, ok := vm.drivers[name]; ok {
+		return driver, nil
+	}
+
+	volumeDriversMu.RLock()
+	factory, ok := volumeDriverFactories[name]
+	volumeDriversMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown volume driver: %s (available: %v)", name, VolumeDrivers())
+	}
+	driver, err := factory(vm.baseDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create volume driver %s: %v", name, err)
+	}
+	vm.drivers[name] = driver
+	return driver, nil
+}
+
+// CreateVolume creates a volume with driver, or the default driver when
+// it is empty.
+func (vm *VolumeManager) CreateVolume(name, driverName string, options map[string]string, labels map[string]string) (*Volume, error) {
 	vm.mu.Lock()
 	defer vm.mu.Unlock()
 
@@ -195,8 +310,19 @@ func (vm *VolumeManager) CreateVolume(name string, options map[string]string, la
 		return nil, fmt.Errorf("volume %s already exists", name)
 	}
 
+	if driverName == "" {
+		driverName = vm.defaultDriver
+	}
+	driver, err := vm.getDriver(driverName)
+	if err != nil {
+		return nil, err
+	}
+	if options == nil {
+		options = make(map[string]string)
+	}
+
 	// Create volume using driver
-	volume, err := vm.driver.Create(name, options)
+	volume, err := driver.Create(name, options)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create volume: %v", err)
 	}
@@ -206,7 +332,7 @@ func (vm *VolumeManager) CreateVolume(name string, options map[string]string, la
 
 	// Save volume metadata
 	if err := vm.saveVolumeMetadata(volume); err != nil {
-		vm.driver.Remove(volume)
+		driver.Remove(volume)
 		return nil, fmt.Errorf("failed to save volume metadata: %v", err)
 	}
 
@@ -240,7 +366,11 @@ func (vm *VolumeManager) RemoveVolume(name string, force bool) error {
 	}
 
 	// Remove volume
-	if err := vm.driver.Remove(volume); err != nil {
+	driver, err := vm.getDriver(volume.Driver)
+	if err != nil {
+		return err
+	}
+	if err := driver.Remove(volume); err != nil {
 		return fmt.Errorf("failed to remove volume: %v", err)
 	}
 
@@ -266,17 +396,21 @@ func (vm *VolumeManager) MountVolume(name, containerID, target string) error {
 	}
 
 	// Mount volume
-	if err := vm.driver.Mount(volume, target); err != nil {
+	driver, err := vm.getDriver(volume.Driver)
+	if err != nil {
+		return err
+	}
+	if err := driver.Mount(volume, target); err != nil {
 		return fmt.Errorf("failed to mount volume: %v", err)
 	}
 
-	// Update usage data
-	volume.UsageData.RefCount++
-	volume.UsageData.LastUsed = time.Now().Format(time.RFC3339)
+	// Update usage data; a container started again is counted once
+	volume.UsageData.LastUsed = time.Now()
 	volume.UsageData.AccessCount++
-
-	// Record mount
-	vm.mounts[containerID] = append(vm.mounts[containerID], volume.ID)
+	if !containsString(vm.mounts[containerID], volume.ID) {
+		volume.UsageData.RefCount++
+		vm.mounts[containerID] = append(vm.mounts[containerID], volume.ID)
+	}
 
 	// Save metadata
 	if err := vm.saveVolumeMetadata(volume); err != nil {
@@ -287,6 +421,40 @@ func (vm *VolumeManager) MountVolume(name, containerID, target string) error {
 	return nil
 }
 
+// PopulateVolume copies the directory src into a volume that is still
+// empty. A volume mounted over a directory of the image starts out with
+// its content this way, as in Docker.
+func (vm *VolumeManager) PopulateVolume(name, src string) error {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+
+	volume, exists := vm.volumes[name]
+	if !exists {
+		return fmt.Errorf("volume %s not found", name)
+	}
+	driver, err := vm.getDriver(volume.Driver)
+	if err != nil {
+		return err
+	}
+	dir := driver.GetPath(volume)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read volume %s: %v", name, err)
+	}
+	if len(entries) > 0 {
+		return nil
+	}
+	if entries, err := os.ReadDir(src); err != nil || len(entries) == 0 {
+		return nil
+	}
+	if err := copyTree(src, dir); err != nil {
+		return fmt.Errorf("failed to copy %s into volume %s: %v", src, name, err)
+	}
+	logrus.Infof("Populated volume %s from %s", name, src)
+	return nil
+}
+
 func (vm *VolumeManager) UnmountVolume(name, containerID string) error {
 	vm.mu.Lock()
 	defer vm.mu.Unlock()
@@ -307,8 +475,12 @@ func (vm *VolumeManager) UnmountVolume(name, containerID string) error {
 	}
 
 	// Unmount volume
-	target := vm.driver.GetPath(volume)
-	if err := vm.driver.Unmount(volume, target); err != nil {
+	driver, err := vm.getDriver(volume.Driver)
+	if err != nil {
+		return err
+	}
+	target := driver.GetPath(volume)
+	if err := driver.Unmount(volume, target); err != nil {
 		return fmt.Errorf("failed to unmount volume: %v", err)
 	}
 
@@ -366,7 +538,12 @@ func (vm *VolumeManager) PruneVolumes() (int64, error) {
 
 	// Remove unused volumes
 	for _, name := range removedVolumes {
-		if err := vm.driver.Remove(vm.volumes[name]); err != nil {
+		driver, err := vm.getDriver(vm.volumes[name].Driver)
+		if err != nil {
+			logrus.Warnf("Failed to remove volume %s: %v", name, err)
+			continue
+		}
+		if err := driver.Remove(vm.volumes[name]); err != nil {
 			logrus.Warnf("Failed to remove volume %s: %v", name, err)
 			continue
 		}
@@ -411,10 +588,16 @@ func (vm *VolumeManager) loadVolumes() error {
 			}
 
 			var volume Volume
-			if err := json.Unmarshal(data, &volume); err != nil {
+			migrated, err := timeutil.Unmarshal(data, &volume, "created_at", "last_used")
+			if err != nil {
 				logrus.Warnf("Failed to unmarshal volume metadata %s: %v", file.Name(), err)
 				continue
 			}
+			if migrated {
+				if err := vm.saveVolumeMetadata(&volume); err != nil {
+					logrus.Warnf("Failed to migrate volume metadata %s: %v", file.Name(), err)
+				}
+			}
 
 			vm.volumes[volume.Name] = &volume
 			logrus.Debugf("Loaded volume: %s", volume.Name)
@@ -447,11 +630,21 @@ func (vm *VolumeManager) GetUsageStats() map[string]interface{} {
 		"in_use_volumes":     inUseVolumes,
 		"unused_volumes":     totalVolumes - inUseVolumes,
 		"total_mounts":       totalMounts,
-		"driver":             "local",
+		"driver":             vm.defaultDriver,
+		"drivers":            VolumeDrivers(),
 		"base_dir":           vm.baseDir,
 	}
 }
 
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
 func generateVolumeID(name string) string {
 	// Simplified volume ID generation
 	return fmt.Sprintf("vol-%x", name)[:12]
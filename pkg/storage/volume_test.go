@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVolumeDrivers(t *testing.T) {
+	assert.Subset(t, VolumeDrivers(), []string{"local", "nfs", "tmpfs"})
+	assert.Error(t, RegisterVolumeDriver("local", func(string) (VolumeDriver, error) { return nil, nil }))
+
+	vm, err := NewVolumeManager(t.TempDir())
+	require.NoError(t, err)
+
+	_, err = vm.CreateVolume("data", "nosuchdriver", nil, nil)
+	assert.Error(t, err)
+
+	volume, err := vm.CreateVolume("data", "", nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "local", volume.Driver)
+
+	// The export is checked before anything is created
+	_, err = vm.CreateVolume("remote", "nfs", map[string]string{"device": "/exports"}, nil)
+	assert.Error(t, err)
+	_, err = vm.CreateVolume("remote", "nfs", map[string]string{"device": ":/exports", "addr": "192.0.2.1", "bogus": "1"}, nil)
+	assert.Error(t, err)
+	volume, err = vm.CreateVolume("remote", "nfs", map[string]string{"device": ":/exports", "addr": "192.0.2.1"}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "nfs", volume.Driver)
+	require.NoError(t, vm.RemoveVolume("remote", false))
+}
+
+func TestTmpfsVolume(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("tmpfs volumes need root")
+	}
+
+	vm, err := NewVolumeManager(t.TempDir())
+	require.NoError(t, err)
+
+	_, err = vm.CreateVolume("cache", "tmpfs", map[string]string{"size": "lots"}, nil)
+	assert.Error(t, err)
+
+	volume, err := vm.CreateVolume("cache", "tmpfs", map[string]string{"size": "1m"}, nil)
+	require.NoError(t, err)
+	mounted, err := isMountPoint(volume.Mountpoint)
+	require.NoError(t, err)
+	assert.True(t, mounted)
+
+	// Writes beyond the size fail
+	require.NoError(t, os.WriteFile(filepath.Join(volume.Mountpoint, "small"), make([]byte, 512<<10), 0644))
+	assert.Error(t, os.WriteFile(filepath.Join(volume.Mountpoint, "large"), make([]byte, 1<<20), 0644))
+
+	require.NoError(t, vm.RemoveVolume("cache", false))
+	_, err = os.Stat(volume.Mountpoint)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestPopulateVolume(t *testing.T) {
+	vm, err := NewVolumeManager(t.TempDir())
+	require.NoError(t, err)
+	volume, err := vm.CreateVolume("data", "", nil, nil)
+	require.NoError(t, err)
+
+	src := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "conf"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "conf", "db.conf"), []byte("image"), 0644))
+
+	require.NoError(t, vm.PopulateVolume("data", src))
+	data, err := os.ReadFile(filepath.Join(volume.Mountpoint, "conf", "db.conf"))
+	require.NoError(t, err)
+	assert.Equal(t, "image", string(data))
+
+	// A volume with data is left alone
+	require.NoError(t, os.WriteFile(filepath.Join(volume.Mountpoint, "conf", "db.conf"), []byte("written"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "new"), nil, 0644))
+	require.NoError(t, vm.PopulateVolume("data", src))
+	data, err = os.ReadFile(filepath.Join(volume.Mountpoint, "conf", "db.conf"))
+	require.NoError(t, err)
+	assert.Equal(t, "written", string(data))
+	assert.NoFileExists(t, filepath.Join(volume.Mountpoint, "new"))
+}
+
+func TestLoadLegacyVolumeMetadata(t *testing.T) {
+	baseDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(baseDir, "metadata"), 0755))
+	legacy := `{"id":"old","name":"old","driver":"local","created_at":"2024-03-01T12:00:00Z","usage_data":{"size":0,"ref_count":0,"last_used":"","access_count":0}}`
+	metadataPath := filepath.Join(baseDir, "metadata", "old.json")
+	require.NoError(t, os.WriteFile(metadataPath, []byte(legacy), 0644))
+
+	vm, err := NewVolumeManager(baseDir)
+	require.NoError(t, err)
+	volume, err := vm.GetVolume("old")
+	require.NoError(t, err)
+	assert.Equal(t, 2024, volume.CreatedAt.Year())
+	assert.True(t, volume.UsageData.LastUsed.IsZero())
+
+	// The record is written back in the current format
+	data, err := os.ReadFile(metadataPath)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"last_used": "0001-01-01T00:00:00Z"`)
+}
@@ -0,0 +1,313 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// IndexFile holds the documents of the search index. The term lookup is
+// rebuilt from them when the store is first searched.
+const IndexFile = "index.json"
+
+// Kinds of documents in the search index
+const (
+	KindImage     = "image"
+	KindContainer = "container"
+)
+
+// IndexDocument is what the search index knows about an object, e.g. an
+// image or a container.
+type IndexDocument struct {
+	Kind string `json:"kind"`
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Fields holds the searchable text by field, e.g. name, label or env
+	Fields map[string][]string `json:"fields"`
+}
+
+func (d *IndexDocument) key() string {
+	return d.Kind + "/" + d.ID
+}
+
+// SearchResult is a document matching every term of a query. Matches
+// lists the values that matched, e.g. label:maintainer=alice.
+type SearchResult struct {
+	Kind    string   `json:"kind"`
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	Matches []string `json:"matches"`
+	Score   int      `json:"score"`
+}
+
+type indexFile struct {
+	Documents []*IndexDocument `json:"documents"`
+}
+
+// searchIndex maps the terms of documents to the keys of the documents
+// holding them.
+type searchIndex struct {
+	documents map[string]*IndexDocument
+	terms     map[string]map[string]bool
+	// sorted holds the terms in order for prefix lookups; nil when stale
+	sorted []string
+}
+
+// tokenize splits text into lowercase terms at anything that is not a
+// letter or digit.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func (idx *searchIndex) add(doc *IndexDocument) {
+	idx.remove(doc.key())
+	idx.documents[doc.key()] = doc
+	for _, term := range doc.terms() {
+		if idx.terms[term] == nil {
+			idx.terms[term] = make(map[string]bool)
+		}
+		idx.terms[term][doc.key()] = true
+	}
+	idx.sorted = nil
+}
+
+func (idx *searchIndex) remove(key string) {
+	doc, ok := idx.documents[key]
+	if !ok {
+		return
+	}
+	for _, term := range doc.terms() {
+		delete(idx.terms[term], key)
+		if len(idx.terms[term]) == 0 {
+			delete(idx.terms, term)
+		}
+	}
+	delete(idx.documents, key)
+	idx.sorted = nil
+}
+
+func (d *IndexDocument) terms() []string {
+	terms := tokenize(d.Name + " " + d.ID)
+	for _, values := range d.Fields {
+		for _, value := range values {
+			terms = append(terms, tokenize(value)...)
+		}
+	}
+	return terms
+}
+
+// lookup returns the keys of documents with a term starting with prefix.
+func (idx *searchIndex) lookup(prefix string) map[string]bool {
+	if idx.sorted == nil {
+		idx.sorted = make([]string, 0, len(idx.terms))
+		for term := range idx.terms {
+			idx.sorted = append(idx.sorted, term)
+		}
+		sort.Strings(idx.sorted)
+	}
+
+	keys := make(map[string]bool)
+	for i := sort.SearchStrings(idx.sorted, prefix); i < len(idx.sorted) && strings.HasPrefix(idx.sorted[i], prefix); i++ {
+		for key := range idx.terms[idx.sorted[i]] {
+			keys[key] = true
+		}
+	}
+	return keys
+}
+
+// loadIndex reads the index on first use. The caller holds indexMu.
+func (s *Store) loadIndex() (*searchIndex, error) {
+	if s.index != nil {
+		return s.index, nil
+	}
+
+	idx := &searchIndex{
+		documents: make(map[string]*IndexDocument),
+		terms:     make(map[string]map[string]bool),
+	}
+	if s.FileExists(IndexFile) {
+		var file indexFile
+		if err := s.LoadJSON(IndexFile, &file); err != nil {
+			return nil, fmt.Errorf("failed to load search index: %v", err)
+		}
+		for _, doc := range file.Documents {
+			idx.add(doc)
+		}
+	}
+	s.index = idx
+	return idx, nil
+}
+
+func (s *Store) saveIndex(idx *searchIndex) error {
+	file := indexFile{Documents: make([]*IndexDocument, 0, len(idx.documents))}
+	for _, doc := range idx.documents {
+		file.Documents = append(file.Documents, doc)
+	}
+	sort.Slice(file.Documents, func(i, j int) bool { return file.Documents[i].key() < file.Documents[j].key() })
+
+	if err := s.SaveJSON(IndexFile, file); err != nil {
+		return fmt.Errorf("failed to save search index: %v", err)
+	}
+	return nil
+}
+
+// IndexExists reports whether the search index was written, which stores
+// created before it existed need a ReplaceDocuments of every kind for.
+func (s *Store) IndexExists() bool {
+	_, err := os.Stat(filepath.Join(s.dataDir, IndexFile))
+	return err == nil
+}
+
+// IndexDocuments adds documents to the search index, replacing those with
+// the same kind and ID. The index is only written when one changed.
+func (s *Store) IndexDocuments(docs ...*IndexDocument) error {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+
+	idx, err := s.loadIndex()
+	if err != nil {
+		return err
+	}
+	changed := false
+	for _, doc := range docs {
+		if existing, ok := idx.documents[doc.key()]; ok && reflect.DeepEqual(existing, doc) {
+			continue
+		}
+		idx.add(doc)
+		changed = true
+	}
+	if !changed && s.IndexExists() {
+		return nil
+	}
+	return s.saveIndex(idx)
+}
+
+// RemoveDocuments drops documents of kind from the search index.
+func (s *Store) RemoveDocuments(kind string, ids ...string) error {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+
+	idx, err := s.loadIndex()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		idx.remove(kind + "/" + id)
+	}
+	return s.saveIndex(idx)
+}
+
+// ReplaceDocuments makes docs the only documents of kind in the search
+// index.
+func (s *Store) ReplaceDocuments(kind string, docs []*IndexDocument) error {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+
+	idx, err := s.loadIndex()
+	if err != nil {
+		return err
+	}
+	for key, doc := range idx.documents {
+		if doc.Kind == kind {
+			idx.remove(key)
+		}
+	}
+	for _, doc := range docs {
+		idx.add(doc)
+	}
+	return s.saveIndex(idx)
+}
+
+// Search finds the documents holding a term starting with each term of
+// query, of kind unless it is empty. Results are ordered by score, which
+// favours matches in names, then by kind and name.
+func (s *Store) Search(query, kind string) ([]*SearchResult, error) {
+	queryTerms := tokenize(query)
+	if len(queryTerms) == 0 {
+		return nil, fmt.Errorf("search query is empty")
+	}
+
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+
+	idx, err := s.loadIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	var keys map[string]bool
+	for _, term := range queryTerms {
+		found := idx.lookup(term)
+		if keys == nil {
+			keys = found
+			continue
+		}
+		for key := range keys {
+			if !found[key] {
+				delete(keys, key)
+			}
+		}
+	}
+
+	var results []*SearchResult
+	for key := range keys {
+		doc := idx.documents[key]
+		if kind != "" && doc.Kind != kind {
+			continue
+		}
+		results = append(results, doc.match(queryTerms))
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		if results[i].Kind != results[j].Kind {
+			return results[i].Kind < results[j].Kind
+		}
+		return results[i].Name < results[j].Name
+	})
+	return results, nil
+}
+
+// match scores doc against the terms of a query and lists the values that
+// hold one.
+func (d *IndexDocument) match(queryTerms []string) *SearchResult {
+	result := &SearchResult{Kind: d.Kind, ID: d.ID, Name: d.Name}
+	matches := func(text string) bool {
+		for _, term := range tokenize(text) {
+			for _, queryTerm := range queryTerms {
+				if strings.HasPrefix(term, queryTerm) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	if matches(d.Name) {
+		result.Score += 3
+	}
+	if matches(d.ID) {
+		result.Score += 2
+	}
+	fields := make([]string, 0, len(d.Fields))
+	for field := range d.Fields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		for _, value := range d.Fields[field] {
+			if matches(value) {
+				result.Matches = append(result.Matches, field+":"+value)
+				result.Score++
+			}
+		}
+	}
+	return result
+}
@@ -19,6 +19,9 @@ const (
 type Store struct {
 	dataDir string
 	mu      sync.RWMutex
+	// index is the search index, loaded on first use
+	index   *searchIndex
+	indexMu sync.Mutex
 }
 
 func NewStore(dataDir string) (*Store, error) {
@@ -0,0 +1,161 @@
+// Package telemetry keeps an opt-in, local-only log of CLI operations:
+// which command ran, how long it took, whether it failed and how many
+// resources existed afterwards. Arguments, names and error messages are
+// never recorded.
+package telemetry
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	FileName = "telemetry.jsonl"
+
+	ResultOK    = "ok"
+	ResultError = "error"
+)
+
+type Record struct {
+	Time       time.Time      `json:"time"`
+	Command    string         `json:"command"`
+	DurationMS int64          `json:"duration_ms"`
+	Result     string         `json:"result"`
+	Counts     map[string]int `json:"counts,omitempty"`
+}
+
+// Summary aggregates the records of one command.
+type Summary struct {
+	Command string        `json:"command"`
+	Count   int           `json:"count"`
+	Errors  int           `json:"errors"`
+	Mean    time.Duration `json:"mean"`
+	P50     time.Duration `json:"p50"`
+	P95     time.Duration `json:"p95"`
+	Max     time.Duration `json:"max"`
+}
+
+// Recorder appends records to a JSON lines file.
+type Recorder struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewRecorder(path string) *Recorder {
+	return &Recorder{path: path}
+}
+
+func (r *Recorder) Path() string {
+	return r.path
+}
+
+func (r *Recorder) Record(record Record) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal telemetry record: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		return fmt.Errorf("failed to create telemetry directory: %v", err)
+	}
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open telemetry file: %v", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write telemetry record: %v", err)
+	}
+	return nil
+}
+
+// Load reads every record in the file, skipping lines that don't parse. A
+// missing file yields no records.
+func Load(path string) ([]Record, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to open telemetry file: %v", err)
+	}
+	defer file.Close()
+
+	var records []Record
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read telemetry file: %v", err)
+	}
+
+	return records, nil
+}
+
+// Summarize groups records by command, slowest mean first.
+func Summarize(records []Record, since time.Time) []Summary {
+	durations := make(map[string][]time.Duration)
+	errors := make(map[string]int)
+
+	for _, record := range records {
+		if record.Time.Before(since) {
+			continue
+		}
+		durations[record.Command] = append(durations[record.Command], time.Duration(record.DurationMS)*time.Millisecond)
+		if record.Result == ResultError {
+			errors[record.Command]++
+		}
+	}
+
+	var summaries []Summary
+	for command, values := range durations {
+		sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+		var total time.Duration
+		for _, d := range values {
+			total += d
+		}
+
+		summaries = append(summaries, Summary{
+			Command: command,
+			Count:   len(values),
+			Errors:  errors[command],
+			Mean:    total / time.Duration(len(values)),
+			P50:     percentile(values, 50),
+			P95:     percentile(values, 95),
+			Max:     values[len(values)-1],
+		})
+	}
+
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].Mean != summaries[j].Mean {
+			return summaries[i].Mean > summaries[j].Mean
+		}
+		return summaries[i].Command < summaries[j].Command
+	})
+	return summaries
+}
+
+// percentile uses the nearest-rank method on sorted values.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
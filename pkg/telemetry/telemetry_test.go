@@ -0,0 +1,45 @@
+package telemetry
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordAndSummarize(t *testing.T) {
+	recorder := NewRecorder(filepath.Join(t.TempDir(), FileName))
+	now := time.Now()
+
+	for i, ms := range []int64{10, 20, 30, 40} {
+		result := ResultOK
+		if i == 3 {
+			result = ResultError
+		}
+		require.NoError(t, recorder.Record(Record{Time: now, Command: "image build", DurationMS: ms, Result: result}))
+	}
+	require.NoError(t, recorder.Record(Record{Time: now, Command: "image list", DurationMS: 1, Result: ResultOK}))
+	require.NoError(t, recorder.Record(Record{Time: now.Add(-48 * time.Hour), Command: "container run", DurationMS: 500, Result: ResultOK}))
+
+	records, err := Load(recorder.Path())
+	require.NoError(t, err)
+	assert.Len(t, records, 6)
+
+	summaries := Summarize(records, now.Add(-time.Hour))
+	require.Len(t, summaries, 2, "Records older than since should be dropped")
+
+	build := summaries[0]
+	assert.Equal(t, "image build", build.Command, "Slowest command should come first")
+	assert.Equal(t, 4, build.Count)
+	assert.Equal(t, 1, build.Errors)
+	assert.Equal(t, 25*time.Millisecond, build.Mean)
+	assert.Equal(t, 20*time.Millisecond, build.P50)
+	assert.Equal(t, 40*time.Millisecond, build.P95)
+	assert.Equal(t, 40*time.Millisecond, build.Max)
+
+	records, err = Load(filepath.Join(t.TempDir(), "missing.jsonl"))
+	require.NoError(t, err)
+	assert.Empty(t, records)
+}
@@ -0,0 +1,415 @@
+// Package testcluster runs several cluster nodes inside one test process,
+// so join, scheduling, failover and rolling updates can be exercised in CI
+// without VMs. Each node has its own data dir and API port; with
+// Options.NetNS it also gets its own network namespace.
+package testcluster
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"docker-impl/pkg/cluster"
+)
+
+// Options configure a test cluster.
+type Options struct {
+	// Nodes is how many nodes to start, the first one being the leader;
+	// 3 by default
+	Nodes int
+	// Clock drives every node, so tests control heartbeats and timeouts by
+	// advancing it; nil runs the nodes on the real clock
+	Clock *cluster.FakeClock
+	// NetNS puts each node in its own network namespace, connected to the
+	// others through a bridge. It needs root and iproute2; tests asking
+	// for it are skipped without them.
+	NetNS bool
+	// Timeout bounds each wait, in real time; 30s by default
+	Timeout time.Duration
+}
+
+// Cluster is a set of in-process nodes. The first node initializes the
+// cluster and the others join it as workers.
+type Cluster struct {
+	Nodes []*Node
+	Clock *cluster.FakeClock
+
+	t       testing.TB
+	dir     string
+	timeout time.Duration
+	token   string
+	network *namespaceNetwork
+}
+
+// Node is one member of a test cluster.
+type Node struct {
+	Name    string
+	DataDir string
+	// Addr and Port are where the node's API listens and what it
+	// advertises; the port is picked on first start and kept on restarts
+	Addr string
+	Port int
+	// NetNS is the node's network namespace, if it has one
+	NetNS   string
+	Manager *cluster.ClusterManager
+
+	running bool
+	// takeOver starts the node with ForceNewCluster
+	takeOver bool
+}
+
+// New starts a cluster of opts.Nodes nodes and stops it when the test
+// ends.
+func New(t testing.TB, opts Options) *Cluster {
+	t.Helper()
+
+	if opts.Nodes <= 0 {
+		opts.Nodes = 3
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 30 * time.Second
+	}
+
+	c := &Cluster{
+		Clock:   opts.Clock,
+		t:       t,
+		dir:     t.TempDir(),
+		timeout: opts.Timeout,
+	}
+	if opts.NetNS {
+		if err := checkNetNS(); err != nil {
+			t.Skipf("network namespaces unavailable: %v", err)
+		}
+		network, err := newNamespaceNetwork()
+		if err != nil {
+			t.Fatalf("failed to set up network namespaces: %v", err)
+		}
+		c.network = network
+	}
+	t.Cleanup(c.Close)
+
+	for i := 0; i < opts.Nodes; i++ {
+		c.AddNode()
+	}
+	return c
+}
+
+// Leader returns the node that initialized the cluster. It holds the
+// cluster state: nodes, tasks and services.
+func (c *Cluster) Leader() *Node {
+	return c.Nodes[0]
+}
+
+// AddNode starts a new node and, unless it is the first, joins it to the
+// leader.
+func (c *Cluster) AddNode() *Node {
+	c.t.Helper()
+
+	index := len(c.Nodes)
+	node := &Node{
+		Name:    fmt.Sprintf("node-%d", index),
+		DataDir: filepath.Join(c.dir, fmt.Sprintf("node-%d", index)),
+		Addr:    "127.0.0.1",
+	}
+	if c.network != nil {
+		ns, addr, err := c.network.addNamespace(index)
+		if err != nil {
+			c.t.Fatalf("failed to create namespace for %s: %v", node.Name, err)
+		}
+		node.NetNS = ns
+		node.Addr = addr
+	}
+
+	c.Nodes = append(c.Nodes, node)
+	c.StartNode(node)
+	return node
+}
+
+// StartNode starts a stopped node again with its data dir and address, as
+// a restarted agent would, so it comes back with the same identity. Nodes
+// other than the leader rejoin it. A restarted leader comes back with the
+// cluster state it stored in its data dir.
+func (c *Cluster) StartNode(node *Node) {
+	c.t.Helper()
+
+	if node.running {
+		c.t.Fatalf("node %s is already running", node.Name)
+	}
+
+	listener, err := c.listen(node)
+	if err != nil {
+		c.t.Fatalf("failed to listen for %s: %v", node.Name, err)
+	}
+	node.Port = listener.Addr().(*net.TCPAddr).Port
+	// The nodes share a connection pool, unlike separate processes, so
+	// drop the connections to the node's last run before a POST picks one
+	http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+
+	config := &cluster.ClusterConfig{
+		AdvertiseAddr:       node.Addr,
+		AdvertisePort:       node.Port,
+		DataDir:             node.DataDir,
+		HeartbeatInterval:   5 * time.Second,
+		ElectionTimeout:     10 * time.Second,
+		TaskTimeout:         30 * time.Second,
+		HealthCheckInterval: 10 * time.Second,
+		Discovery: cluster.DiscoveryConfig{
+			Mode: "static",
+		},
+		Listener: listener,
+	}
+	if c.Clock != nil {
+		config.Clock = c.Clock
+	}
+	config.ForceNewCluster = node.takeOver
+	node.takeOver = false
+	node.Manager = cluster.NewClusterManager(config)
+
+	if node == c.Leader() {
+		err = node.Manager.Initialize()
+		if err == nil {
+			c.token, err = node.Manager.GetJoinToken(cluster.RoleWorker)
+		}
+	} else {
+		err = node.Manager.JoinCluster(c.Leader().Endpoint(), c.token)
+	}
+	if err != nil {
+		listener.Close()
+		c.t.Fatalf("failed to start %s: %v", node.Name, err)
+	}
+	node.running = true
+}
+
+// StopNode shuts the node down as if its agent crashed. The leader keeps
+// it registered until a health check notices.
+func (c *Cluster) StopNode(node *Node) {
+	c.t.Helper()
+
+	if !node.running {
+		return
+	}
+	node.running = false
+	if err := node.Manager.Shutdown(); err != nil {
+		c.t.Errorf("failed to stop %s: %v", node.Name, err)
+	}
+}
+
+// Promote makes a manager the leader, as once the leader is lost: the
+// node is restarted to take over the cluster from its replica of the
+// leader's state. Nodes added from then on join it.
+func (c *Cluster) Promote(node *Node) {
+	c.t.Helper()
+
+	c.StopNode(node)
+	for i, n := range c.Nodes {
+		if n == node {
+			c.Nodes[0], c.Nodes[i] = node, c.Nodes[0]
+		}
+	}
+	node.takeOver = true
+	c.StartNode(node)
+}
+
+// FailNode stops the node and waits until the leader marks it down. Once
+// the node missed enough heartbeats the leader also reschedules its
+// running tasks on the rest of the cluster.
+func (c *Cluster) FailNode(node *Node) {
+	c.t.Helper()
+
+	c.StopNode(node)
+	c.WaitForNodeStatus(node, cluster.StatusDown)
+}
+
+// Partition cuts the node off from the cluster without stopping it. With
+// network namespaces the node's link to the bridge goes down; otherwise
+// the leader's health probes of the node fail.
+func (c *Cluster) Partition(node *Node) {
+	c.t.Helper()
+
+	if c.network != nil {
+		if err := c.network.setLink(node.NetNS, false); err != nil {
+			c.t.Fatalf("failed to partition %s: %v", node.Name, err)
+		}
+		return
+	}
+	c.Leader().Manager.Faults.DropHeartbeats(node.ID(), true)
+}
+
+// Heal reconnects a partitioned node.
+func (c *Cluster) Heal(node *Node) {
+	c.t.Helper()
+
+	if c.network != nil {
+		if err := c.network.setLink(node.NetNS, true); err != nil {
+			c.t.Fatalf("failed to heal %s: %v", node.Name, err)
+		}
+		return
+	}
+	c.Leader().Manager.Faults.DropHeartbeats(node.ID(), false)
+}
+
+// CheckHealth has the leader probe every node now instead of at its next
+// scheduled health check.
+func (c *Cluster) CheckHealth() {
+	c.t.Helper()
+
+	leader := c.Leader().Manager
+	nodes, err := leader.NodeManager.ListNodes()
+	if err != nil {
+		c.t.Fatalf("failed to list nodes: %v", err)
+	}
+	for _, node := range nodes {
+		if err := leader.NodeManager.CheckNodeHealth(node.ID); err != nil {
+			c.t.Errorf("failed to check health of node %s: %v", node.ID, err)
+		}
+	}
+}
+
+// WaitFor polls cond until it holds and fails the test once the timeout
+// passes. On a fake clock each poll advances it by a second, so whatever
+// the nodes are waiting on fires while the test waits.
+func (c *Cluster) WaitFor(what string, cond func() bool) {
+	c.t.Helper()
+
+	deadline := time.Now().Add(c.timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			c.t.Fatalf("timed out after %s waiting for %s", c.timeout, what)
+		}
+		c.tick()
+	}
+}
+
+// WaitForNodeStatus waits until the leader sees the node in one of the
+// given states.
+func (c *Cluster) WaitForNodeStatus(node *Node, statuses ...cluster.NodeStatus) {
+	c.t.Helper()
+
+	c.WaitFor(fmt.Sprintf("%s to be %v", node.Name, statuses), func() bool {
+		current, err := c.Leader().Manager.NodeManager.GetNode(node.ID())
+		if err != nil {
+			return false
+		}
+		for _, status := range statuses {
+			if current.Status == status {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// RunTask creates a task on the leader and waits until it runs. It returns
+// the task as the leader tracks it.
+func (c *Cluster) RunTask(task *cluster.Task) *cluster.Task {
+	c.t.Helper()
+
+	tasks := c.Leader().Manager.TaskManager
+	if err := tasks.CreateTask(task); err != nil {
+		c.t.Fatalf("failed to create task %s: %v", task.ID, err)
+	}
+	c.WaitForTaskStatus(task.ID, cluster.TaskRunning)
+
+	running, err := tasks.GetTask(task.ID)
+	if err != nil {
+		c.t.Fatalf("failed to get task %s: %v", task.ID, err)
+	}
+	return running
+}
+
+// WaitForTaskStatus waits until the leader sees the task in the given
+// state.
+func (c *Cluster) WaitForTaskStatus(taskID string, status cluster.TaskStatus) {
+	c.t.Helper()
+
+	c.WaitFor(fmt.Sprintf("task %s to be %s", taskID, status), func() bool {
+		task, err := c.Leader().Manager.TaskManager.GetTask(taskID)
+		return err == nil && task.Status == status
+	})
+}
+
+// WaitForReplicas waits until the leader sees the given number of tasks
+// of a service running, counting tasks still being shut down.
+func (c *Cluster) WaitForReplicas(serviceID string, replicas int) {
+	c.t.Helper()
+
+	c.WaitFor(fmt.Sprintf("service %s to run %d replica(s)", serviceID, replicas), func() bool {
+		running := 0
+		for _, task := range c.Leader().Manager.Services.ServiceTasks(serviceID) {
+			if task.Status == cluster.TaskRunning {
+				running++
+			}
+		}
+		return running == replicas
+	})
+}
+
+// RollingUpdate rolls the cluster to a new version from the leader. On a
+// fake clock the clock keeps advancing while the update waits on drains
+// and health checks.
+func (c *Cluster) RollingUpdate(options cluster.UpgradeOptions) (*cluster.UpgradeReport, error) {
+	var report *cluster.UpgradeReport
+	var err error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		report, err = c.Leader().Manager.Upgrade(options)
+	}()
+
+	for {
+		select {
+		case <-done:
+			return report, err
+		default:
+			c.tick()
+		}
+	}
+}
+
+// Close stops every node and removes the namespaces. New registers it as
+// a test cleanup.
+func (c *Cluster) Close() {
+	for i := len(c.Nodes) - 1; i >= 0; i-- {
+		c.StopNode(c.Nodes[i])
+	}
+	if c.network != nil {
+		if err := c.network.remove(); err != nil {
+			c.t.Errorf("failed to remove network namespaces: %v", err)
+		}
+		c.network = nil
+	}
+}
+
+// ID returns the node's persistent identity, which it registers under.
+func (n *Node) ID() string {
+	return n.Manager.Identity.ID
+}
+
+// Endpoint returns the host:port of the node's API.
+func (n *Node) Endpoint() string {
+	return net.JoinHostPort(n.Addr, strconv.Itoa(n.Port))
+}
+
+// Running reports whether the node is started.
+func (n *Node) Running() bool {
+	return n.running
+}
+
+func (c *Cluster) listen(node *Node) (net.Listener, error) {
+	addr := net.JoinHostPort(node.Addr, strconv.Itoa(node.Port))
+	if node.NetNS != "" {
+		return listenInNamespace(node.NetNS, addr)
+	}
+	return net.Listen("tcp", addr)
+}
+
+func (c *Cluster) tick() {
+	if c.Clock != nil {
+		c.Clock.Advance(time.Second)
+	}
+	time.Sleep(10 * time.Millisecond)
+}
@@ -0,0 +1,1667 @@
+package testcluster
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"docker-impl/pkg/cluster"
+	"docker-impl/pkg/ids"
+)
+
+func newTask(name string) *cluster.Task {
+	return &cluster.Task{
+		ID:    fmt.Sprintf("task-%s", name),
+		Name:  name,
+		Image: "alpine:latest",
+		Resources: cluster.Resources{
+			CPU:    100,
+			Memory: 64 * 1024 * 1024,
+		},
+	}
+}
+
+func TestJoin(t *testing.T) {
+	c := New(t, Options{Nodes: 3, Clock: cluster.NewFakeClock(time.Now())})
+
+	nodes, err := c.Leader().Manager.NodeManager.ListNodes()
+	if err != nil {
+		t.Fatalf("Failed to list nodes: %v", err)
+	}
+	if len(nodes) != 3 {
+		t.Fatalf("Expected 3 nodes, got %d", len(nodes))
+	}
+	if workers := c.Leader().Manager.NodeManager.GetWorkerNodes(); len(workers) != 2 {
+		t.Errorf("Expected 2 workers, got %d", len(workers))
+	}
+
+	c.CheckHealth()
+	for _, node := range c.Nodes {
+		c.WaitForNodeStatus(node, cluster.StatusActive, cluster.StatusReady)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	c := New(t, Options{Nodes: 3, Clock: cluster.NewFakeClock(time.Now())})
+	failed := c.Nodes[1]
+	// Keep the task running instead of simulating it to completion
+	failed.Manager.SetLocalTaskRunner(func(task *cluster.Task) error {
+		return nil
+	})
+
+	task := newTask("web")
+	task.PinnedNode = failed.ID()
+	task = c.RunTask(task)
+	if task.NodeID != failed.ID() {
+		t.Fatalf("Expected task on %s, got %s", failed.ID(), task.NodeID)
+	}
+
+	c.FailNode(failed)
+	c.WaitForNodeStatus(failed, cluster.StatusDown)
+
+	c.WaitFor("task to be rescheduled", func() bool {
+		tasks, err := c.Leader().Manager.TaskManager.ListTasks()
+		if err != nil {
+			return false
+		}
+		for _, replacement := range tasks {
+			if replacement.ID != task.ID && replacement.Name == task.Name &&
+				replacement.NodeID != "" && replacement.NodeID != failed.ID() {
+				return true
+			}
+		}
+		return false
+	})
+
+	// The node comes back under the same identity and recovers
+	c.StartNode(failed)
+	c.CheckHealth()
+	c.WaitForNodeStatus(failed, cluster.StatusReady, cluster.StatusActive)
+}
+
+func TestLeaderRestart(t *testing.T) {
+	c := New(t, Options{Nodes: 2, Clock: cluster.NewFakeClock(time.Now())})
+	leader := c.Leader()
+	clusterID := leader.Manager.ID
+	token := c.token
+
+	task := newTask("web")
+	task.PinnedNode = c.Nodes[1].ID()
+	task = c.RunTask(task)
+
+	c.StopNode(leader)
+	c.StartNode(leader)
+
+	if leader.Manager.ID != clusterID {
+		t.Errorf("Expected cluster %s after restart, got %s", clusterID, leader.Manager.ID)
+	}
+	if c.token != token {
+		t.Errorf("Expected join token to survive the restart")
+	}
+	nodes, err := leader.Manager.NodeManager.ListNodes()
+	if err != nil {
+		t.Fatalf("Failed to list nodes: %v", err)
+	}
+	if len(nodes) != 2 {
+		t.Errorf("Expected 2 nodes after restart, got %d", len(nodes))
+	}
+	restored, err := leader.Manager.TaskManager.GetTask(task.ID)
+	if err != nil {
+		t.Fatalf("Expected task %s after restart: %v", task.ID, err)
+	}
+	if restored.NodeID != task.NodeID {
+		t.Errorf("Expected task on %s after restart, got %s", task.NodeID, restored.NodeID)
+	}
+}
+
+func TestManagerTakeOver(t *testing.T) {
+	c := New(t, Options{Nodes: 2, Clock: cluster.NewFakeClock(time.Now())})
+	leader := c.Leader()
+	workerToken := c.token
+	managerToken, err := leader.Manager.GetJoinToken(cluster.RoleManager)
+	if err != nil {
+		t.Fatalf("Failed to get the manager join token: %v", err)
+	}
+	c.token = managerToken
+	standby := c.AddNode()
+	c.token = workerToken
+	for _, node := range c.Nodes {
+		node.Manager.SetLocalTaskRunner(func(task *cluster.Task) error {
+			return nil
+		})
+	}
+
+	service, err := leader.Manager.Services.CreateService(&cluster.Service{
+		Name:     "web",
+		Image:    "alpine:latest",
+		Replicas: 2,
+		Resources: cluster.Resources{
+			CPU:    100,
+			Memory: 64 * 1024 * 1024,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	c.WaitForReplicas(service.ID, 2)
+
+	// The standby doesn't run the cluster, but keeps up with its state
+	if _, err := standby.Manager.Services.GetService(service.ID); err == nil {
+		t.Errorf("Expected only the leader to hold the cluster state before a take over")
+	}
+	index := leader.Manager.State.Index()
+	c.WaitFor("the state to reach the standby manager", func() bool {
+		return standby.Manager.State.ReplicaIndex() >= index
+	})
+
+	// Workers hold no replica to take over with
+	worker := c.Nodes[1]
+	if index := worker.Manager.State.ReplicaIndex(); index != 0 {
+		t.Errorf("Expected the worker to hold no replica, got one at index %d", index)
+	}
+
+	clusterID := leader.Manager.ID
+	c.StopNode(leader)
+	c.Promote(standby)
+	if c.Leader() != standby {
+		t.Fatalf("Expected %s to lead the cluster", standby.Name)
+	}
+
+	manager := standby.Manager
+	if manager.ID != clusterID {
+		t.Errorf("Expected cluster %s after the take over, got %s", clusterID, manager.ID)
+	}
+	restored, err := manager.Services.GetService(service.ID)
+	if err != nil {
+		t.Fatalf("Expected the service to survive the take over: %v", err)
+	}
+	if restored.Replicas != 2 {
+		t.Errorf("Expected 2 replicas, got %d", restored.Replicas)
+	}
+	tasks, err := manager.TaskManager.ListTasks()
+	if err != nil {
+		t.Fatalf("Failed to list tasks: %v", err)
+	}
+	replicas := 0
+	for _, task := range tasks {
+		if task.ServiceID == service.ID {
+			replicas++
+		}
+	}
+	if replicas < 2 {
+		t.Errorf("Expected the tasks of the service to survive the take over, got %d", replicas)
+	}
+	if _, err := manager.NodeManager.GetNode(worker.ID()); err != nil {
+		t.Errorf("Expected the worker to survive the take over: %v", err)
+	}
+	if role, err := manager.VerifyJoinToken(workerToken); err != nil || role != cluster.RoleWorker {
+		t.Errorf("Expected the worker join token to survive the take over: %v", err)
+	}
+
+	// New nodes join the new leader
+	joined := c.AddNode()
+	if _, err := manager.NodeManager.GetNode(joined.ID()); err != nil {
+		t.Errorf("Expected %s to join the new leader: %v", joined.Name, err)
+	}
+}
+
+// Managers only keep the state of the manager they joined, and never an
+// older one than they hold
+func TestReplicaFromLeaderOnly(t *testing.T) {
+	c := New(t, Options{Nodes: 2, Clock: cluster.NewFakeClock(time.Now())})
+	leader, worker := c.Leader(), c.Nodes[1]
+	workerToken := c.token
+	managerToken, err := leader.Manager.GetJoinToken(cluster.RoleManager)
+	if err != nil {
+		t.Fatalf("Failed to get the manager join token: %v", err)
+	}
+	c.token = managerToken
+	standby := c.AddNode()
+	c.token = workerToken
+
+	index := leader.Manager.State.Index()
+	c.WaitFor("the state to reach the standby manager", func() bool {
+		return standby.Manager.State.ReplicaIndex() >= index
+	})
+	index = standby.Manager.State.ReplicaIndex()
+
+	replica := func(sender string, term, index uint64, managers ...string) map[string]interface{} {
+		nodes := map[string]interface{}{}
+		for _, id := range managers {
+			nodes[id] = map[string]string{"id": id, "role": string(cluster.RoleManager)}
+		}
+		return map[string]interface{}{
+			"leader": sender,
+			"state": map[string]interface{}{
+				"index":      index,
+				"term":       term,
+				"cluster_id": leader.Manager.ID,
+				"nodes":      nodes,
+			},
+		}
+	}
+	send := func(token string, v interface{}) int {
+		body, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("Failed to marshal replica: %v", err)
+		}
+		req, err := http.NewRequest(http.MethodPost, "http://"+standby.Endpoint()+"/cluster/state", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Cluster-Token", token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to send replica: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	clusterToken := leader.Manager.Config.JoinToken
+
+	tests := []struct {
+		name    string
+		token   string
+		replica map[string]interface{}
+		status  int
+	}{
+		{
+			name:    "from a worker",
+			token:   worker.Manager.Config.JoinToken,
+			replica: replica(worker.ID(), 0, index+10, worker.ID()),
+			status:  http.StatusUnauthorized,
+		},
+		{
+			name:    "claiming another sender",
+			token:   clusterToken,
+			replica: replica(worker.ID(), 0, index+10, worker.ID()),
+			status:  http.StatusForbidden,
+		},
+		{
+			name:    "leader that is no manager in the state",
+			token:   clusterToken,
+			replica: replica(leader.ID(), 0, index+10),
+			status:  http.StatusConflict,
+		},
+		{
+			name:    "older than the replica",
+			token:   clusterToken,
+			replica: replica(leader.ID(), 0, index-1, leader.ID()),
+			status:  http.StatusConflict,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status := send(tt.token, tt.replica); status != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, status)
+			}
+			if got := standby.Manager.State.ReplicaIndex(); got != index {
+				t.Errorf("Expected the replica to stay at index %d, got %d", index, got)
+			}
+		})
+	}
+
+	// A later term wins over a higher index, and the state of the term
+	// before is refused from then on
+	if status := send(clusterToken, replica(leader.ID(), 1, 1, leader.ID())); status != http.StatusOK {
+		t.Fatalf("Expected the state of a later term to be kept, got status %d", status)
+	}
+	if status := send(clusterToken, replica(leader.ID(), 0, index+10, leader.ID())); status != http.StatusConflict {
+		t.Errorf("Expected the state of an earlier term to be refused, got status %d", status)
+	}
+}
+
+func TestRollingUpdate(t *testing.T) {
+	c := New(t, Options{Nodes: 4, Clock: cluster.NewFakeClock(time.Now())})
+
+	report, err := c.RollingUpdate(cluster.UpgradeOptions{Version: "2.0.0", BatchSize: 2})
+	if err != nil {
+		t.Fatalf("Rolling update failed: %v", err)
+	}
+	if len(report.Upgraded) != 4 {
+		t.Errorf("Expected 4 upgraded nodes, got %d", len(report.Upgraded))
+	}
+	if report.StartedAt.IsZero() || report.EndedAt.Before(report.StartedAt) {
+		t.Errorf("Expected the update to start and end in order, got %v and %v", report.StartedAt, report.EndedAt)
+	}
+
+	for _, node := range c.Nodes {
+		current, err := c.Leader().Manager.NodeManager.GetNode(node.ID())
+		if err != nil {
+			t.Fatalf("Failed to get %s: %v", node.Name, err)
+		}
+		if current.Version != "2.0.0" {
+			t.Errorf("Expected %s at 2.0.0, got %s", node.Name, current.Version)
+		}
+		if current.Status == cluster.StatusDraining {
+			t.Errorf("Expected %s to be reactivated", node.Name)
+		}
+	}
+}
+
+func TestPartitionInNamespaces(t *testing.T) {
+	c := New(t, Options{Nodes: 2, NetNS: true})
+	worker := c.Nodes[1]
+
+	c.CheckHealth()
+	c.WaitForNodeStatus(worker, cluster.StatusActive, cluster.StatusReady)
+
+	c.Partition(worker)
+	c.CheckHealth()
+	c.WaitForNodeStatus(worker, cluster.StatusDown)
+
+	c.Heal(worker)
+	c.CheckHealth()
+	c.WaitForNodeStatus(worker, cluster.StatusReady)
+}
+
+func TestTaskMetadata(t *testing.T) {
+	c := New(t, Options{Nodes: 2, Clock: cluster.NewFakeClock(time.Now())})
+	leader := c.Leader()
+
+	started := make(chan *cluster.Task, 1)
+	leader.Manager.SetLocalTaskRunner(func(task *cluster.Task) error {
+		started <- task
+		return nil
+	})
+
+	task := newTask("web")
+	task.ServiceID = "svc-1"
+	task.ServiceName = "web"
+	task.Slot = 2
+	task.Namespace = "shop"
+	task.MetadataEnv = true
+	task.Labels = map[string]string{"tier": "frontend", cluster.LabelNodeID: "spoofed"}
+	task.Env = []string{"MYDOCKER_NAMESPACE=override"}
+	task.PinnedNode = leader.ID()
+	c.RunTask(task)
+
+	var run *cluster.Task
+	select {
+	case run = <-started:
+	default:
+		t.Fatalf("Expected the local runner to start the task")
+	}
+
+	labels := run.ContainerLabels()
+	for key, want := range map[string]string{
+		cluster.LabelServiceID:   "svc-1",
+		cluster.LabelServiceName: "web",
+		cluster.LabelTaskID:      task.ID,
+		cluster.LabelTaskSlot:    "2",
+		cluster.LabelNodeID:      leader.ID(),
+		cluster.LabelNamespace:   "shop",
+		"tier":                   "frontend",
+	} {
+		if labels[key] != want {
+			t.Errorf("Expected label %s=%s, got %q", key, want, labels[key])
+		}
+	}
+
+	env := run.ContainerEnv()
+	if env[len(env)-1] != "MYDOCKER_NAMESPACE=override" {
+		t.Errorf("Expected the task's own env last, got %v", env)
+	}
+	found := false
+	for _, e := range env {
+		if e == cluster.EnvNodeID+"="+leader.ID() {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected %s in %v", cluster.EnvNodeID, env)
+	}
+	if name := run.ContainerName(); name != "web.2."+task.ID {
+		t.Errorf("Expected container name web.2.%s, got %s", task.ID, name)
+	}
+}
+
+func TestAgentReportsTaskExit(t *testing.T) {
+	c := New(t, Options{Nodes: 2, Clock: cluster.NewFakeClock(time.Now())})
+	worker := c.Nodes[1]
+
+	exited := make(chan struct{})
+	worker.Manager.SetLocalTaskRunner(func(task *cluster.Task) error {
+		return nil
+	})
+	worker.Manager.SetLocalTaskInspector(func(task *cluster.Task) (*cluster.TaskStatusReport, error) {
+		select {
+		case <-exited:
+			return &cluster.TaskStatusReport{Status: cluster.TaskFailed, Error: "container exited with code 1"}, nil
+		default:
+			return &cluster.TaskStatusReport{Status: cluster.TaskRunning}, nil
+		}
+	})
+
+	task := newTask("batch")
+	task.PinnedNode = worker.ID()
+	running := c.RunTask(task)
+	if running.NodeID != worker.ID() {
+		t.Fatalf("Expected the task on %s, got %s", worker.ID(), running.NodeID)
+	}
+
+	close(exited)
+	c.WaitForTaskStatus(task.ID, cluster.TaskFailed)
+
+	failed, err := c.Leader().Manager.TaskManager.GetTask(task.ID)
+	if err != nil {
+		t.Fatalf("Failed to get task: %v", err)
+	}
+	if failed.Error != "container exited with code 1" {
+		t.Errorf("Expected the exit reported by the agent, got %q", failed.Error)
+	}
+}
+
+func TestServiceReplicas(t *testing.T) {
+	c := New(t, Options{Nodes: 3, Clock: cluster.NewFakeClock(time.Now())})
+
+	// Keep tasks running until the test fails one of them
+	var mu sync.Mutex
+	failed := make(map[string]bool)
+	for _, node := range c.Nodes {
+		node.Manager.SetLocalTaskRunner(func(task *cluster.Task) error {
+			return nil
+		})
+		node.Manager.SetLocalTaskInspector(func(task *cluster.Task) (*cluster.TaskStatusReport, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if failed[task.ID] {
+				return &cluster.TaskStatusReport{Status: cluster.TaskFailed, Error: "container exited with code 1"}, nil
+			}
+			return &cluster.TaskStatusReport{Status: cluster.TaskRunning}, nil
+		})
+	}
+
+	services := c.Leader().Manager.Services
+	service, err := services.CreateService(&cluster.Service{
+		Name:     "web",
+		Image:    "alpine:latest",
+		Replicas: 3,
+		Resources: cluster.Resources{
+			CPU:    100,
+			Memory: 64 * 1024 * 1024,
+		},
+		RestartPolicy: cluster.RestartPolicy{Condition: cluster.RestartConditionAny, Delay: "1s"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	c.WaitForReplicas(service.ID, 3)
+
+	// A failed task is replaced in its slot
+	victim := services.ServiceTasks(service.ID)[0]
+	mu.Lock()
+	failed[victim.ID] = true
+	mu.Unlock()
+	c.WaitForTaskStatus(victim.ID, cluster.TaskFailed)
+	c.WaitForReplicas(service.ID, 3)
+	replaced := false
+	for _, task := range services.ServiceTasks(service.ID) {
+		if task.ID != victim.ID && task.Slot == victim.Slot && task.Status == cluster.TaskRunning {
+			replaced = true
+		}
+	}
+	if !replaced {
+		t.Errorf("Expected slot %d to be running again", victim.Slot)
+	}
+
+	if _, err := services.ScaleService("web", 1); err != nil {
+		t.Fatalf("Failed to scale service: %v", err)
+	}
+	c.WaitForReplicas(service.ID, 1)
+
+	if err := services.RemoveService(service.ID); err != nil {
+		t.Fatalf("Failed to remove service: %v", err)
+	}
+	c.WaitForReplicas(service.ID, 0)
+}
+
+func TestServiceRollingUpdate(t *testing.T) {
+	c := New(t, Options{Nodes: 3, Clock: cluster.NewFakeClock(time.Now())})
+	for _, node := range c.Nodes {
+		// Tasks of the broken image fail to start; the rest keep running
+		node.Manager.SetLocalTaskRunner(func(task *cluster.Task) error {
+			if task.Image == "broken:latest" {
+				return fmt.Errorf("image broken:latest not found")
+			}
+			return nil
+		})
+		node.Manager.SetLocalTaskInspector(func(task *cluster.Task) (*cluster.TaskStatusReport, error) {
+			return &cluster.TaskStatusReport{Status: cluster.TaskRunning}, nil
+		})
+	}
+
+	services := c.Leader().Manager.Services
+	service, err := services.CreateService(&cluster.Service{
+		Name:     "web",
+		Image:    "alpine:3.18",
+		Replicas: 3,
+		Resources: cluster.Resources{
+			CPU:    100,
+			Memory: 64 * 1024 * 1024,
+		},
+		UpdateConfig: cluster.UpdateConfig{
+			Parallelism:   1,
+			Delay:         2 * time.Second,
+			FailureAction: cluster.UpdateFailureRollback,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	c.WaitForReplicas(service.ID, 3)
+
+	waitForImage := func(state cluster.UpdateState, image string) {
+		c.WaitFor(fmt.Sprintf("service to be %s on %s", state, image), func() bool {
+			current, err := services.GetService(service.ID)
+			if err != nil || current.UpdateStatus == nil || current.UpdateStatus.State != state {
+				return false
+			}
+			running := 0
+			for _, task := range services.ServiceTasks(service.ID) {
+				if task.Status == cluster.TaskRunning {
+					if task.Image != image {
+						return false
+					}
+					running++
+				}
+			}
+			return running == 3
+		})
+	}
+
+	spec, err := services.GetService(service.ID)
+	if err != nil {
+		t.Fatalf("Failed to get service: %v", err)
+	}
+	spec.Image = "alpine:3.19"
+	if _, err := services.UpdateService(service.ID, spec); err != nil {
+		t.Fatalf("Failed to update service: %v", err)
+	}
+	waitForImage(cluster.UpdateStateCompleted, "alpine:3.19")
+
+	// A failing update is rolled back to the spec before it
+	spec.Image = "broken:latest"
+	if _, err := services.UpdateService(service.ID, spec); err != nil {
+		t.Fatalf("Failed to update service: %v", err)
+	}
+	waitForImage(cluster.UpdateStateRollbackCompleted, "alpine:3.19")
+
+	current, err := services.GetService(service.ID)
+	if err != nil {
+		t.Fatalf("Failed to get service: %v", err)
+	}
+	if current.PreviousSpec == nil || current.PreviousSpec.Image != "broken:latest" {
+		t.Errorf("Expected the failed spec to be kept as the previous spec, got %+v", current.PreviousSpec)
+	}
+}
+
+func TestServiceUpdateDisruptionBudget(t *testing.T) {
+	c := New(t, Options{Nodes: 3, Clock: cluster.NewFakeClock(time.Now())})
+
+	// Keep tasks running until the test fails one of them
+	var mu sync.Mutex
+	failed := make(map[string]bool)
+	for _, node := range c.Nodes {
+		node.Manager.SetLocalTaskRunner(func(task *cluster.Task) error {
+			return nil
+		})
+		node.Manager.SetLocalTaskInspector(func(task *cluster.Task) (*cluster.TaskStatusReport, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if failed[task.ID] {
+				return &cluster.TaskStatusReport{Status: cluster.TaskFailed, Error: "container exited with code 1"}, nil
+			}
+			return &cluster.TaskStatusReport{Status: cluster.TaskRunning}, nil
+		})
+	}
+
+	services := c.Leader().Manager.Services
+	service, err := services.CreateService(&cluster.Service{
+		Name:     "web",
+		Image:    "alpine:3.18",
+		Replicas: 3,
+		Resources: cluster.Resources{
+			CPU:    100,
+			Memory: 64 * 1024 * 1024,
+		},
+		RestartPolicy:  cluster.RestartPolicy{Condition: cluster.RestartConditionAny, Delay: "1m"},
+		UpdateConfig:   cluster.UpdateConfig{Parallelism: 3},
+		MaxUnavailable: 1,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	c.WaitForReplicas(service.ID, 3)
+
+	// With a replica down the budget is spent, so the update waits
+	victim := services.ServiceTasks(service.ID)[0]
+	mu.Lock()
+	failed[victim.ID] = true
+	mu.Unlock()
+	c.WaitForTaskStatus(victim.ID, cluster.TaskFailed)
+
+	spec, err := services.GetService(service.ID)
+	if err != nil {
+		t.Fatalf("Failed to get service: %v", err)
+	}
+	spec.Image = "alpine:3.19"
+	if _, err := services.UpdateService(service.ID, spec); err != nil {
+		t.Fatalf("Failed to update service: %v", err)
+	}
+	c.WaitFor("the update to be held", func() bool {
+		current, err := services.GetService(service.ID)
+		return err == nil && current.UpdateStatus != nil && strings.HasPrefix(current.UpdateStatus.Message, "update held")
+	})
+	for _, task := range services.ServiceTasks(service.ID) {
+		if task.ID != victim.ID && (task.DesiredState != cluster.TaskRunning || task.Image != "alpine:3.18") {
+			t.Errorf("Expected task %s to keep running on alpine:3.18 while the budget is spent", task.ID)
+		}
+	}
+
+	// Once the failed slot runs again the update replaces one replica at
+	// a time, despite its parallelism
+	fewest := 3
+	c.WaitFor("the update to complete", func() bool {
+		running, updated := 0, 0
+		for _, task := range services.ServiceTasks(service.ID) {
+			if task.DesiredState == cluster.TaskRunning && task.Status == cluster.TaskRunning {
+				running++
+				if task.Image == "alpine:3.19" {
+					updated++
+				}
+			}
+		}
+		if running < fewest {
+			fewest = running
+		}
+		current, err := services.GetService(service.ID)
+		return err == nil && current.UpdateStatus.State == cluster.UpdateStateCompleted && updated == 3
+	})
+	if fewest < 2 {
+		t.Errorf("Expected at most one replica down during the update, got %d running", fewest)
+	}
+}
+
+func TestServiceUpdateSLOPause(t *testing.T) {
+	c := New(t, Options{Nodes: 3, Clock: cluster.NewFakeClock(time.Now())})
+	for _, node := range c.Nodes {
+		node.Manager.SetLocalTaskRunner(func(task *cluster.Task) error {
+			return nil
+		})
+		node.Manager.SetLocalTaskInspector(func(task *cluster.Task) (*cluster.TaskStatusReport, error) {
+			return &cluster.TaskStatusReport{Status: cluster.TaskRunning}, nil
+		})
+	}
+	manager := c.Leader().Manager
+
+	services := manager.Services
+	service, err := services.CreateService(&cluster.Service{
+		Name:     "web",
+		Image:    "alpine:3.18",
+		Replicas: 3,
+		Resources: cluster.Resources{
+			CPU:    100,
+			Memory: 64 * 1024 * 1024,
+		},
+		UpdateConfig: cluster.UpdateConfig{Parallelism: 1},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	c.WaitForReplicas(service.ID, 3)
+
+	// A failed probe spends the error budget of a 99% objective
+	if err := manager.SLOs.SetPolicy(service.ID, cluster.SLOPolicy{Objective: 0.99, Window: time.Minute, PauseUpdates: true}); err != nil {
+		t.Fatalf("Failed to set SLO policy: %v", err)
+	}
+	manager.SLOs.ProbeResult(services.ServiceTasks(service.ID)[0], false)
+	if !manager.SLOs.UpdatesPaused(service.ID) {
+		t.Fatalf("Expected updates of the service to be paused")
+	}
+
+	spec, err := services.GetService(service.ID)
+	if err != nil {
+		t.Fatalf("Failed to get service: %v", err)
+	}
+	spec.Image = "alpine:3.19"
+	if _, err := services.UpdateService(service.ID, spec); err != nil {
+		t.Fatalf("Failed to update service: %v", err)
+	}
+	c.WaitFor("the update to be held", func() bool {
+		current, err := services.GetService(service.ID)
+		return err == nil && current.UpdateStatus != nil && current.UpdateStatus.Message == "update held: error budget exhausted"
+	})
+	for _, task := range services.ServiceTasks(service.ID) {
+		if task.DesiredState != cluster.TaskRunning || task.Image != "alpine:3.18" {
+			t.Errorf("Expected task %s to keep running on alpine:3.18 while updates are paused", task.ID)
+		}
+	}
+
+	// Once the failure leaves the window the update goes on
+	c.WaitFor("the update to complete", func() bool {
+		current, err := services.GetService(service.ID)
+		if err != nil || current.UpdateStatus.State != cluster.UpdateStateCompleted {
+			return false
+		}
+		for _, task := range services.ServiceTasks(service.ID) {
+			if task.Status == cluster.TaskRunning && task.Image != "alpine:3.19" {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestServicePlacement(t *testing.T) {
+	c := New(t, Options{Nodes: 4, Clock: cluster.NewFakeClock(time.Now())})
+	nodes := c.Leader().Manager.NodeManager
+	zones := map[string]string{c.Nodes[1].ID(): "a", c.Nodes[2].ID(): "b", c.Nodes[3].ID(): "b"}
+	for nodeID, zone := range zones {
+		if err := nodes.SetNodeLabels(nodeID, map[string]string{"zone": zone}); err != nil {
+			t.Fatalf("Failed to label node: %v", err)
+		}
+	}
+	for _, node := range c.Nodes {
+		node.Manager.SetLocalTaskRunner(func(task *cluster.Task) error {
+			return nil
+		})
+	}
+
+	services := c.Leader().Manager.Services
+	service, err := services.CreateService(&cluster.Service{
+		Name:     "web",
+		Image:    "alpine:latest",
+		Replicas: 4,
+		Resources: cluster.Resources{
+			CPU:    100,
+			Memory: 64 * 1024 * 1024,
+		},
+		Placement: cluster.Placement{
+			Constraints: []string{"node.role==worker"},
+			Preferences: []cluster.Preference{{Spread: "node.labels.zone"}},
+			MaxReplicas: 2,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	c.WaitForReplicas(service.ID, 4)
+
+	perZone := make(map[string]int)
+	perNode := make(map[string]int)
+	for _, task := range services.ServiceTasks(service.ID) {
+		if task.Status != cluster.TaskRunning {
+			continue
+		}
+		if task.NodeID == c.Leader().ID() {
+			t.Errorf("Expected no task on the manager, got %s", task.ID)
+		}
+		perZone[zones[task.NodeID]]++
+		perNode[task.NodeID]++
+	}
+	if perZone["a"] != 2 || perZone["b"] != 2 {
+		t.Errorf("Expected the tasks spread 2/2 over the zones, got %v", perZone)
+	}
+	for nodeID, count := range perNode {
+		if count > 2 {
+			t.Errorf("Expected at most 2 tasks on %s, got %d", nodeID, count)
+		}
+	}
+
+	if _, err := cluster.ParseConstraint("node.zone~a"); err == nil {
+		t.Errorf("Expected an invalid constraint to be rejected")
+	}
+}
+
+func TestSchedulingStrategies(t *testing.T) {
+	c := New(t, Options{Nodes: 3, Clock: cluster.NewFakeClock(time.Now())})
+	for _, node := range c.Nodes {
+		node.Manager.SetLocalTaskRunner(func(task *cluster.Task) error {
+			return nil
+		})
+	}
+
+	services := c.Leader().Manager.Services
+	create := func(name string, replicas int, cpu int64, strategy string) map[string]int {
+		t.Helper()
+		service, err := services.CreateService(&cluster.Service{
+			Name:     name,
+			Image:    "alpine:latest",
+			Replicas: replicas,
+			Resources: cluster.Resources{
+				CPU:    cpu,
+				Memory: 64 * 1024 * 1024,
+			},
+			Placement: cluster.Placement{Strategy: strategy},
+		})
+		if err != nil {
+			t.Fatalf("Failed to create service %s: %v", name, err)
+		}
+		c.WaitForReplicas(service.ID, replicas)
+
+		perNode := make(map[string]int)
+		for _, task := range services.ServiceTasks(service.ID) {
+			if task.Status == cluster.TaskRunning {
+				perNode[task.NodeID]++
+			}
+		}
+		return perNode
+	}
+
+	// Spread, the default, puts one task on each node
+	if perNode := create("web", 3, 100, ""); len(perNode) != 3 {
+		t.Errorf("Expected the tasks spread over 3 nodes, got %v", perNode)
+	}
+
+	// Binpack fills a node until its reservations leave no room
+	perNode := create("batch", 3, 1500, cluster.StrategyBinpack)
+	busiest := ""
+	for nodeID, count := range perNode {
+		if count == 2 {
+			busiest = nodeID
+		}
+	}
+	if len(perNode) != 2 || busiest == "" {
+		t.Fatalf("Expected 2 tasks on one node and 1 on another, got %v", perNode)
+	}
+
+	// The cluster's strategy applies to services without one
+	c.Leader().Manager.Config.SchedulingStrategy = cluster.StrategyBinpack
+	if perNode := create("cache", 2, 100, ""); perNode[busiest] != 2 {
+		t.Errorf("Expected both tasks on the busiest node %s, got %v", busiest, perNode)
+	}
+
+	_, err := services.CreateService(&cluster.Service{
+		Name:      "bad",
+		Image:     "alpine:latest",
+		Replicas:  1,
+		Resources: cluster.Resources{CPU: 100, Memory: 64 * 1024 * 1024},
+		Placement: cluster.Placement{Strategy: "fastest"},
+	})
+	if err == nil {
+		t.Errorf("Expected an unknown strategy to be rejected")
+	}
+}
+
+func TestDrainEvictsTasks(t *testing.T) {
+	c := New(t, Options{Nodes: 3, Clock: cluster.NewFakeClock(time.Now())})
+	for _, node := range c.Nodes {
+		node.Manager.SetLocalTaskRunner(func(task *cluster.Task) error {
+			return nil
+		})
+	}
+	manager := c.Leader().Manager
+
+	services := manager.Services
+	service, err := services.CreateService(&cluster.Service{
+		Name:     "web",
+		Image:    "alpine:latest",
+		Replicas: 3,
+		Resources: cluster.Resources{
+			CPU:    100,
+			Memory: 64 * 1024 * 1024,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	c.WaitForReplicas(service.ID, 3)
+
+	// Standalone tasks pinned to the manager: one is rescheduled, the
+	// other's restart policy keeps it from running again
+	leaderID := c.Leader().ID()
+	moved := newTask("moved")
+	moved.PinnedNode = leaderID
+	moved = c.RunTask(moved)
+	stopped := newTask("stopped")
+	stopped.PinnedNode = leaderID
+	stopped.RestartPolicy.Condition = cluster.RestartConditionNone
+	stopped = c.RunTask(stopped)
+
+	// The manager is drained of tasks but stays a manager
+	if err := manager.NodeManager.DrainNode(leaderID); err != nil {
+		t.Fatalf("Failed to drain the manager: %v", err)
+	}
+	c.WaitFor("the manager to drain", func() bool {
+		status, err := manager.DrainStatus(leaderID)
+		return err == nil && status.Complete
+	})
+	c.WaitForReplicas(service.ID, 3)
+	// Standalone tasks start again elsewhere after the drain completes
+	c.WaitFor(fmt.Sprintf("task %s to run again", moved.Name), func() bool {
+		tasks, err := manager.TaskManager.ListTasks()
+		if err != nil {
+			return false
+		}
+		for _, task := range tasks {
+			if task.Name == moved.Name && task.ID != moved.ID && task.Status == cluster.TaskRunning {
+				return true
+			}
+		}
+		return false
+	})
+
+	node, err := manager.NodeManager.GetNode(leaderID)
+	if err != nil {
+		t.Fatalf("Failed to get the manager: %v", err)
+	}
+	if node.Role != cluster.RoleManager || node.Status != cluster.StatusDraining {
+		t.Errorf("Expected a draining manager, got a %s that is %s", node.Role, node.Status)
+	}
+
+	tasks, err := manager.TaskManager.ListTasks()
+	if err != nil {
+		t.Fatalf("Failed to list tasks: %v", err)
+	}
+	rescheduled := false
+	for _, task := range tasks {
+		if task.Status != cluster.TaskRunning {
+			continue
+		}
+		if task.NodeID == leaderID {
+			t.Errorf("Expected task %s off the drained manager", task.ID)
+		}
+		if task.Name == moved.Name && task.ID != moved.ID {
+			rescheduled = true
+		}
+		if task.Name == stopped.Name {
+			t.Errorf("Expected task %s not to run again, got %s", stopped.Name, task.ID)
+		}
+	}
+	if !rescheduled {
+		t.Errorf("Expected task %s to run again on another node", moved.Name)
+	}
+
+	// No new task lands on the drained node
+	placed := c.RunTask(newTask("placed"))
+	if placed.NodeID == leaderID {
+		t.Errorf("Expected no new task on the drained manager")
+	}
+}
+
+func TestJoinTokens(t *testing.T) {
+	c := New(t, Options{Nodes: 2, Clock: cluster.NewFakeClock(time.Now())})
+	for _, node := range c.Nodes {
+		node.Manager.SetLocalTaskRunner(func(task *cluster.Task) error {
+			return nil
+		})
+	}
+	manager := c.Leader().Manager
+
+	workerToken := c.token
+	managerToken, err := manager.GetJoinToken(cluster.RoleManager)
+	if err != nil {
+		t.Fatalf("Failed to get the manager join token: %v", err)
+	}
+	if role, err := manager.VerifyJoinToken(managerToken); err != nil || role != cluster.RoleManager {
+		t.Fatalf("Expected a manager token, got %q: %v", role, err)
+	}
+
+	// A worker token doesn't admit managers
+	worker, err := manager.NodeManager.GetNode(c.Nodes[1].ID())
+	if err != nil {
+		t.Fatalf("Failed to get worker: %v", err)
+	}
+	node := *worker
+	node.Role = cluster.RoleManager
+	body, err := json.Marshal(&node)
+	if err != nil {
+		t.Fatalf("Failed to marshal node: %v", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, "http://"+c.Leader().Endpoint()+"/nodes", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("X-Cluster-Token", workerToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to register: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected a manager registering with a worker token to be refused, got status %d", resp.StatusCode)
+	}
+
+	// Rotating revokes the old worker token, but not the manager token
+	// or the nodes that already joined
+	rotated, err := manager.RotateJoinToken(cluster.RoleWorker)
+	if err != nil {
+		t.Fatalf("Failed to rotate the worker token: %v", err)
+	}
+	if _, err := manager.VerifyJoinToken(workerToken); err == nil {
+		t.Errorf("Expected the rotated worker token to be revoked")
+	}
+	if _, err := manager.VerifyJoinToken(managerToken); err != nil {
+		t.Errorf("Expected the manager token to survive a worker rotation: %v", err)
+	}
+	task := newTask("after-rotation")
+	task.PinnedNode = c.Nodes[1].ID()
+	if ran := c.RunTask(task); ran.NodeID != c.Nodes[1].ID() {
+		t.Errorf("Expected the joined worker to keep running tasks, got node %s", ran.NodeID)
+	}
+
+	c.token = rotated
+	c.AddNode()
+	c.token = managerToken
+	joined := c.AddNode()
+	if node, err := manager.NodeManager.GetNode(joined.ID()); err != nil || node.Role != cluster.RoleManager {
+		t.Errorf("Expected %s to join as a manager: %v", joined.Name, err)
+	}
+
+	// Tokens lapse after their TTL, and a fresh one is issued
+	manager.Config.JoinTokenTTL = time.Minute
+	expiring, err := manager.RotateJoinToken(cluster.RoleWorker)
+	if err != nil {
+		t.Fatalf("Failed to rotate the worker token: %v", err)
+	}
+	c.Clock.Advance(2 * time.Minute)
+	if _, err := manager.VerifyJoinToken(expiring); err == nil {
+		t.Errorf("Expected the worker token to expire")
+	}
+	fresh, err := manager.GetJoinToken(cluster.RoleWorker)
+	if err != nil {
+		t.Fatalf("Failed to get the worker token: %v", err)
+	}
+	if _, err := manager.VerifyJoinToken(fresh); fresh == expiring || err != nil {
+		t.Errorf("Expected a fresh worker token: %v", err)
+	}
+}
+
+// Workers are handed a token of their own, which is only good for the
+// requests of their agent
+func TestWorkerToken(t *testing.T) {
+	c := New(t, Options{Nodes: 3, Clock: cluster.NewFakeClock(time.Now())})
+	for _, node := range c.Nodes {
+		node.Manager.SetLocalTaskRunner(func(task *cluster.Task) error {
+			return nil
+		})
+	}
+	leader, worker := c.Leader(), c.Nodes[1]
+	workerToken := worker.Manager.Config.JoinToken
+	if workerToken == "" || workerToken == leader.Manager.Config.JoinToken {
+		t.Fatalf("Expected the worker to be handed a token of its own")
+	}
+
+	task := newTask("worker-token")
+	task.PinnedNode = worker.ID()
+	task = c.RunTask(task)
+	other := newTask("other-worker")
+	other.PinnedNode = c.Nodes[2].ID()
+	other = c.RunTask(other)
+
+	asWorker := func(method, path string, v interface{}) int {
+		body, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("Failed to marshal request: %v", err)
+		}
+		req, err := http.NewRequest(method, "http://"+leader.Endpoint()+path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Cluster-Token", workerToken)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to %s %s: %v", method, path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	node, err := leader.Manager.NodeManager.GetNode(worker.ID())
+	if err != nil {
+		t.Fatalf("Failed to get worker: %v", err)
+	}
+	promoted := *node
+	promoted.Role = cluster.RoleManager
+	running := cluster.TaskStatusReport{NodeID: worker.ID(), Status: cluster.TaskRunning}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   interface{}
+		status int
+	}{
+		{name: "heartbeat", method: http.MethodPost, path: "/nodes/" + worker.ID() + "/heartbeat", body: struct{}{}, status: http.StatusOK},
+		{name: "status of its task", method: http.MethodPost, path: "/tasks/" + task.ID + "/status", body: running, status: http.StatusOK},
+		{name: "heartbeat of another node", method: http.MethodPost, path: "/nodes/" + c.Nodes[2].ID() + "/heartbeat", body: struct{}{}, status: http.StatusForbidden},
+		{name: "status of another node's task", method: http.MethodPost, path: "/tasks/" + other.ID + "/status", body: running, status: http.StatusForbidden},
+		{name: "register as a manager", method: http.MethodPost, path: "/nodes", body: &promoted, status: http.StatusForbidden},
+		{name: "prune the cluster", method: http.MethodPost, path: "/cluster/prune", body: struct{}{}, status: http.StatusForbidden},
+		{name: "run a task on the leader", method: http.MethodPost, path: "/agent/tasks", body: newTask("planted"), status: http.StatusForbidden},
+		{name: "create a service", method: http.MethodPost, path: "/services", body: struct{}{}, status: http.StatusForbidden},
+		{name: "list nodes", method: http.MethodGet, path: "/nodes", status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status := asWorker(tt.method, tt.path, tt.body); status != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, status)
+			}
+		})
+	}
+
+	// Managers still hold the cluster token
+	managerToken, err := leader.Manager.GetJoinToken(cluster.RoleManager)
+	if err != nil {
+		t.Fatalf("Failed to get the manager join token: %v", err)
+	}
+	c.token = managerToken
+	standby := c.AddNode()
+	if standby.Manager.Config.JoinToken != leader.Manager.Config.JoinToken {
+		t.Errorf("Expected %s to be handed the cluster token", standby.Name)
+	}
+
+	// Removing the worker revokes its token
+	if err := leader.Manager.NodeManager.UnregisterNode(worker.ID()); err != nil {
+		t.Fatalf("Failed to remove the worker: %v", err)
+	}
+	if status := asWorker(http.MethodPost, "/nodes/"+worker.ID()+"/heartbeat", struct{}{}); status != http.StatusUnauthorized {
+		t.Errorf("Expected the token of a removed worker to be refused, got status %d", status)
+	}
+}
+
+// State saved before join tokens were scoped by role holds one secret for
+// all of them
+func TestLegacyJoinTokenRestore(t *testing.T) {
+	c := New(t, Options{Nodes: 2, Clock: cluster.NewFakeClock(time.Now())})
+	leader := c.Leader()
+	clusterID := leader.Manager.ID
+	clusterToken := leader.Manager.Config.JoinToken
+	worker, err := leader.Manager.NodeManager.GetNode(c.Nodes[1].ID())
+	if err != nil {
+		t.Fatalf("Failed to get worker: %v", err)
+	}
+	c.StopNode(leader)
+
+	secret := ids.GenerateSecret()
+	workerData, err := json.Marshal(worker)
+	if err != nil {
+		t.Fatalf("Failed to marshal worker: %v", err)
+	}
+	snapshot, err := json.Marshal(map[string]interface{}{
+		"index":      10,
+		"cluster_id": clusterID,
+		"tokens": map[string]interface{}{
+			"join_token": clusterToken,
+			"secret":     secret,
+		},
+		"nodes": map[string]json.RawMessage{worker.ID: workerData},
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal snapshot: %v", err)
+	}
+	if err := os.Remove(filepath.Join(leader.DataDir, "state.log")); err != nil {
+		t.Fatalf("Failed to remove state log: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(leader.DataDir, "state.snapshot.json"), snapshot, 0600); err != nil {
+		t.Fatalf("Failed to write snapshot: %v", err)
+	}
+	c.StartNode(leader)
+	manager := leader.Manager
+
+	// The nodes that joined keep their cluster token
+	if err := manager.ValidateClusterToken(clusterToken); err != nil {
+		t.Errorf("Expected the cluster token to survive the restore: %v", err)
+	}
+	if _, err := manager.NodeManager.GetNode(worker.ID); err != nil {
+		t.Errorf("Expected the worker to survive the restore: %v", err)
+	}
+
+	// The secret signs the tokens of both roles
+	if _, err := ids.VerifyJoinToken(secret, clusterID, c.token, c.Clock.Now()); err != nil {
+		t.Errorf("Expected the worker token to be signed with the restored secret: %v", err)
+	}
+	managerToken := ids.NewJoinToken(secret, clusterID, string(cluster.RoleManager), time.Time{})
+	if role, err := manager.VerifyJoinToken(managerToken); err != nil || role != cluster.RoleManager {
+		t.Errorf("Expected a manager token signed with the restored secret, got %q: %v", role, err)
+	}
+	c.AddNode()
+
+	// The secrets are saved by role, so the next restart needs no migration
+	c.StopNode(leader)
+	c.StartNode(leader)
+	if _, err := leader.Manager.VerifyJoinToken(managerToken); err != nil {
+		t.Errorf("Expected the restored secret to survive another restart: %v", err)
+	}
+}
+
+func TestAPIAuth(t *testing.T) {
+	start := time.Now()
+	c := New(t, Options{Nodes: 1, Clock: cluster.NewFakeClock(start)})
+	manager := c.Leader().Manager
+
+	sum := sha1.Sum([]byte("s3cret"))
+	htpasswd := filepath.Join(t.TempDir(), "htpasswd")
+	users := "alice:{SHA}" + base64.StdEncoding.EncodeToString(sum[:]) + "\nbob:{SHA}" + base64.StdEncoding.EncodeToString(sum[:]) + "\n"
+	if err := os.WriteFile(htpasswd, []byte(users), 0600); err != nil {
+		t.Fatalf("Failed to write htpasswd file: %v", err)
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate signing key: %v", err)
+	}
+	var issuer *httptest.Server
+	issuer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"issuer": issuer.URL, "jwks_uri": issuer.URL + "/keys"})
+		case "/keys":
+			json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer issuer.Close()
+	idToken := func(subject string, groups ...string) string {
+		header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test"})
+		claims, _ := json.Marshal(map[string]interface{}{
+			"iss":    issuer.URL,
+			"aud":    "mydocker",
+			"sub":    subject,
+			"groups": groups,
+			"exp":    start.Add(time.Hour).Unix(),
+		})
+		signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+		digest := sha256.Sum256([]byte(signed))
+		signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatalf("Failed to sign token: %v", err)
+		}
+		return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+	}
+
+	config := cluster.AuthConfig{
+		HtpasswdFile: htpasswd,
+		OIDC:         &cluster.OIDCConfig{IssuerURL: issuer.URL, ClientID: "mydocker"},
+		Roles: map[string]cluster.APIRole{
+			"alice":        cluster.APIRoleOperator,
+			"group:admins": cluster.APIRoleAdmin,
+			"group:ops":    cluster.APIRoleViewer,
+		},
+	}
+	if err := manager.Auth.Configure(config); err != nil {
+		t.Fatalf("Failed to configure authentication: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		setup     func(r *http.Request)
+		principal string
+		provider  string
+		role      cluster.APIRole
+		err       bool
+	}{
+		{
+			name:      "htpasswd user",
+			setup:     func(r *http.Request) { r.SetBasicAuth("alice", "s3cret") },
+			principal: "alice",
+			provider:  "htpasswd",
+			role:      cluster.APIRoleOperator,
+		},
+		{
+			name:      "htpasswd user without a role",
+			setup:     func(r *http.Request) { r.SetBasicAuth("bob", "s3cret") },
+			principal: "bob",
+			provider:  "htpasswd",
+		},
+		{
+			name:  "wrong password",
+			setup: func(r *http.Request) { r.SetBasicAuth("alice", "guess") },
+			err:   true,
+		},
+		{
+			name:      "OIDC user by group",
+			setup:     func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+idToken("carol", "ops", "admins")) },
+			principal: "carol",
+			provider:  "oidc",
+			role:      cluster.APIRoleAdmin,
+		},
+		{
+			name: "forged OIDC token",
+			setup: func(r *http.Request) {
+				token := idToken("carol", "admins")
+				r.Header.Set("Authorization", "Bearer "+token[:len(token)-4]+"AAAA")
+			},
+			err: true,
+		},
+		{
+			name:      "cluster token",
+			setup:     func(r *http.Request) { r.Header.Set("X-Cluster-Token", manager.Config.JoinToken) },
+			principal: "cluster-token",
+			provider:  "token",
+			role:      cluster.APIRoleAdmin,
+		},
+		{
+			name:  "arbitrary token",
+			setup: func(r *http.Request) { r.Header.Set("X-Cluster-Token", "letmein") },
+			err:   true,
+		},
+		{
+			name:  "no credentials",
+			setup: func(r *http.Request) {},
+			err:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/nodes", nil)
+			tt.setup(req)
+			principal, err := manager.Auth.Authenticate(req)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("Expected the request to be refused, authenticated as %+v", principal)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to authenticate: %v", err)
+			}
+			if principal.Name != tt.principal || principal.Provider != tt.provider || principal.Role != tt.role {
+				t.Errorf("Expected %s by %s as %q, got %s by %s as %q", tt.principal, tt.provider, tt.role, principal.Name, principal.Provider, principal.Role)
+			}
+		})
+	}
+
+	// Roles are enforced by the API
+	request := func(method, path string, setup func(r *http.Request)) int {
+		req, err := http.NewRequest(method, "http://"+c.Leader().Endpoint()+path, nil)
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		setup(req)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to %s %s: %v", method, path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	alice := func(r *http.Request) { r.SetBasicAuth("alice", "s3cret") }
+	if status := request(http.MethodGet, "/nodes", alice); status != http.StatusOK {
+		t.Errorf("Expected an operator to list nodes, got status %d", status)
+	}
+	if status := request(http.MethodPost, "/cluster/prune", alice); status != http.StatusForbidden {
+		t.Errorf("Expected an operator to be refused a cluster change, got status %d", status)
+	}
+	bob := func(r *http.Request) { r.SetBasicAuth("bob", "s3cret") }
+	if status := request(http.MethodGet, "/nodes", bob); status != http.StatusForbidden {
+		t.Errorf("Expected a user without a role to be refused, got status %d", status)
+	}
+
+	// A cluster that issued no token yet doesn't take any token for one
+	// once providers are configured
+	fresh := cluster.NewClusterManager(&cluster.ClusterConfig{
+		DataDir:  t.TempDir(),
+		Security: cluster.SecurityConfig{Auth: config},
+	})
+	req := httptest.NewRequest(http.MethodGet, "/nodes", nil)
+	req.Header.Set("X-Cluster-Token", "letmein")
+	if principal, err := fresh.Auth.Authenticate(req); err == nil {
+		t.Errorf("Expected an arbitrary token to be refused, authenticated as %+v", principal)
+	}
+	req.Header.Del("X-Cluster-Token")
+	req.SetBasicAuth("alice", "s3cret")
+	if principal, err := fresh.Auth.Authenticate(req); err != nil || principal.Role != cluster.APIRoleOperator {
+		t.Errorf("Expected alice to authenticate as an operator: %v", err)
+	}
+}
+
+func TestDisruptionBudgets(t *testing.T) {
+	c := New(t, Options{Nodes: 3, Clock: cluster.NewFakeClock(time.Now())})
+
+	// Keep tasks running until the test fails one of them
+	var mu sync.Mutex
+	failed := make(map[string]bool)
+	for _, node := range c.Nodes {
+		node.Manager.SetLocalTaskRunner(func(task *cluster.Task) error {
+			return nil
+		})
+		node.Manager.SetLocalTaskInspector(func(task *cluster.Task) (*cluster.TaskStatusReport, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if failed[task.ID] {
+				return &cluster.TaskStatusReport{Status: cluster.TaskFailed, Error: "container exited with code 1"}, nil
+			}
+			return &cluster.TaskStatusReport{Status: cluster.TaskRunning}, nil
+		})
+	}
+	leader := c.Leader()
+	manager := leader.Manager
+
+	service, err := manager.Services.CreateService(&cluster.Service{
+		Name:     "web",
+		Image:    "alpine:latest",
+		Replicas: 2,
+		Resources: cluster.Resources{
+			CPU:    100,
+			Memory: 64 * 1024 * 1024,
+		},
+		Placement:      cluster.Placement{MaxReplicas: 1},
+		RestartPolicy:  cluster.RestartPolicy{Condition: cluster.RestartConditionAny, Delay: "1m"},
+		MaxUnavailable: 1,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	c.WaitForReplicas(service.ID, 2)
+	if got := manager.Budgets.Get(service.ID); got != 1 {
+		t.Fatalf("Expected a budget of 1 from the spec, got %d", got)
+	}
+
+	// Fail one replica and keep the other's node, off the leader, to drain
+	var victim, kept *cluster.Task
+	for _, task := range manager.Services.ServiceTasks(service.ID) {
+		if kept == nil && task.NodeID != leader.ID() {
+			kept = task
+		} else {
+			victim = task
+		}
+	}
+	mu.Lock()
+	failed[victim.ID] = true
+	mu.Unlock()
+	c.WaitForTaskStatus(victim.ID, cluster.TaskFailed)
+
+	// With one replica down the budget holds the other up
+	var budgetErr *cluster.BudgetError
+	if err := manager.Budgets.CheckNode(kept.NodeID); !errors.As(err, &budgetErr) {
+		t.Fatalf("Expected the budget to block disrupting %s, got %v", kept.NodeID, err)
+	}
+	if budgetErr.Unavailable != 1 || budgetErr.Disrupted != 1 {
+		t.Errorf("Expected 1 unavailable and 1 disrupted replica, got %d and %d", budgetErr.Unavailable, budgetErr.Disrupted)
+	}
+	if err := manager.NodeManager.DrainNode(kept.NodeID); err == nil {
+		t.Fatalf("Expected the drain of %s to be refused", kept.NodeID)
+	}
+	node, err := manager.NodeManager.GetNode(kept.NodeID)
+	if err != nil {
+		t.Fatalf("Failed to get node: %v", err)
+	}
+	if node.Status == cluster.StatusDraining {
+		t.Errorf("Expected %s not to drain while the budget is spent", kept.NodeID)
+	}
+
+	// Once the failed replica is replaced the budget allows the drain
+	c.WaitForReplicas(service.ID, 2)
+	if err := manager.Budgets.CheckNode(kept.NodeID); err != nil {
+		t.Fatalf("Expected the budget to allow disrupting %s: %v", kept.NodeID, err)
+	}
+	if err := manager.NodeManager.DrainNode(kept.NodeID); err != nil {
+		t.Fatalf("Failed to drain %s: %v", kept.NodeID, err)
+	}
+	c.WaitFor("the node to drain", func() bool {
+		status, err := manager.DrainStatus(kept.NodeID)
+		return err == nil && status.Complete
+	})
+
+	// The budget is stored with the service and survives a restart
+	if err := manager.Budgets.Set(service.ID, 2); err != nil {
+		t.Fatalf("Failed to set budget: %v", err)
+	}
+	c.StopNode(leader)
+	c.StartNode(leader)
+	if got := leader.Manager.Budgets.Get(service.ID); got != 2 {
+		t.Errorf("Expected a budget of 2 after restart, got %d", got)
+	}
+	restored, err := leader.Manager.Services.GetService(service.ID)
+	if err != nil {
+		t.Fatalf("Expected service %s after restart: %v", service.ID, err)
+	}
+	if restored.MaxUnavailable != 2 {
+		t.Errorf("Expected the spec to keep max unavailable 2, got %d", restored.MaxUnavailable)
+	}
+}
+
+func TestAgentUpdate(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := New(t, Options{Nodes: 2, Clock: cluster.NewFakeClock(start)})
+	leader, worker := c.Leader(), c.Nodes[1]
+
+	// Identities are stamped by the cluster clock and kept over restarts
+	identity := *worker.Manager.Identity
+	if identity.CreatedAt.Before(start) || identity.CreatedAt.After(c.Clock.Now()) {
+		t.Errorf("Expected the identity created on the fake clock, got %s", identity.CreatedAt)
+	}
+
+	binary := []byte("#!/bin/sh\necho agent\n")
+	sum := sha256.Sum256(binary)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(binary)
+	}))
+	defer server.Close()
+
+	// Agents restart by being stopped and started again on their data
+	// dir, unless the test makes them crash
+	var mu sync.Mutex
+	version, crash := "2.0", false
+	restarts := make(chan *Node, len(c.Nodes))
+	setup := func(node *Node) {
+		node.Manager.SetAgentImageResolver(func(ref string) (*cluster.AgentImage, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			return &cluster.AgentImage{
+				Ref:     ref,
+				Version: version,
+				Labels: map[string]string{
+					cluster.AgentBinaryURLLabel:    server.URL,
+					cluster.AgentBinaryDigestLabel: hex.EncodeToString(sum[:]),
+				},
+				SignedBy: "test-key",
+			}, nil
+		})
+		node.Manager.SetAgentRestarter(func(state *cluster.AgentState) {
+			restarts <- node
+		})
+	}
+	restart := func(node *Node) {
+		c.StopNode(node)
+		mu.Lock()
+		crashed := crash
+		mu.Unlock()
+		if !crashed {
+			c.StartNode(node)
+			setup(node)
+		}
+	}
+	for _, node := range c.Nodes {
+		setup(node)
+	}
+	updateAgents := func(options cluster.AgentUpdateOptions) (*cluster.UpgradeReport, error) {
+		var report *cluster.UpgradeReport
+		var err error
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			report, err = leader.Manager.UpdateAgents(options)
+		}()
+		for {
+			select {
+			case <-done:
+				return report, err
+			case node := <-restarts:
+				restart(node)
+			default:
+				c.tick()
+			}
+		}
+	}
+
+	// The update request is held on the worker's clock before it answers
+	worker.Manager.Faults.DelayAPI("/agent/update", 5*time.Second)
+	report, err := updateAgents(cluster.AgentUpdateOptions{Image: "agent:2.0", HealthTimeout: 30 * time.Second})
+	if err != nil {
+		t.Fatalf("Failed to update agents: %v", err)
+	}
+	if len(report.Upgraded) != 2 {
+		t.Errorf("Expected both nodes upgraded, got %v", report.Upgraded)
+	}
+	if worker.Manager.Version != "2.0" {
+		t.Errorf("Expected the worker to come back at 2.0, got %s", worker.Manager.Version)
+	}
+	if worker.Manager.Identity.ID != identity.ID || !worker.Manager.Identity.CreatedAt.Equal(identity.CreatedAt) {
+		t.Errorf("Expected the worker to keep its identity over the restart")
+	}
+
+	// The leader restarts last, a second after the rollout on its clock
+	time.Sleep(1500 * time.Millisecond)
+	select {
+	case <-restarts:
+		t.Fatalf("Expected the leader to wait for the clock before restarting")
+	default:
+	}
+	c.WaitFor("the leader to restart", func() bool {
+		select {
+		case node := <-restarts:
+			restart(node)
+			return node == leader
+		default:
+			return false
+		}
+	})
+	if leader.Manager.Version != "2.0" {
+		t.Errorf("Expected the leader to come back at 2.0, got %s", leader.Manager.Version)
+	}
+
+	// An agent that doesn't come back halts the rollout once the health
+	// timeout passes on the clock
+	mu.Lock()
+	version, crash = "3.0", true
+	mu.Unlock()
+	began := c.Clock.Now()
+	report, err = updateAgents(cluster.AgentUpdateOptions{Image: "agent:3.0", HealthTimeout: 30 * time.Second})
+	if err == nil {
+		t.Fatalf("Expected the rollout to halt at the crashed agent")
+	}
+	if report.FailedOn != worker.ID() {
+		t.Errorf("Expected the rollout to halt at %s, got %q", worker.ID(), report.FailedOn)
+	}
+	if elapsed := c.Clock.Since(began); elapsed < 30*time.Second {
+		t.Errorf("Expected the rollout to wait out the health timeout, gave up after %s", elapsed)
+	}
+}
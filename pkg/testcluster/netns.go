@@ -0,0 +1,180 @@
+package testcluster
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// namespaceNetwork gives each node a network namespace with a veth pair
+// into a bridge. The bridge holds the gateway address in the host
+// namespace, so the test process reaches every node over its link.
+type namespaceNetwork struct {
+	prefix string
+	bridge string
+	// subnet is the first three octets of the /24 the nodes live in
+	subnet string
+	// links maps each namespace to the host end of its veth pair
+	links map[string]string
+}
+
+func checkNetNS() error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("must run as root")
+	}
+	if _, err := exec.LookPath("ip"); err != nil {
+		return fmt.Errorf("ip command not found: %v", err)
+	}
+	return nil
+}
+
+func newNamespaceNetwork() (*namespaceNetwork, error) {
+	// Random names and subnet keep parallel test processes apart
+	id := make([]byte, 3)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("failed to generate network name: %v", err)
+	}
+
+	n := &namespaceNetwork{
+		prefix: fmt.Sprintf("tc%x", id),
+		subnet: fmt.Sprintf("10.213.%d", int(id[0])%254+1),
+		links:  make(map[string]string),
+	}
+	n.bridge = n.prefix + "br"
+
+	if err := runIP("link", "add", "name", n.bridge, "type", "bridge"); err != nil {
+		return nil, err
+	}
+	for _, args := range [][]string{
+		{"addr", "add", n.subnet + ".1/24", "dev", n.bridge},
+		{"link", "set", n.bridge, "up"},
+	} {
+		if err := runIP(args...); err != nil {
+			n.remove()
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// addNamespace creates the namespace of the node with the given index and
+// returns its name and address.
+func (n *namespaceNetwork) addNamespace(index int) (string, string, error) {
+	if index+2 > 254 {
+		return "", "", fmt.Errorf("too many nodes for a /24")
+	}
+
+	ns := fmt.Sprintf("%s-%d", n.prefix, index)
+	veth := fmt.Sprintf("%sv%d", n.prefix, index)
+	addr := fmt.Sprintf("%s.%d", n.subnet, index+2)
+
+	if err := runIP("netns", "add", ns); err != nil {
+		return "", "", err
+	}
+	n.links[ns] = veth
+
+	for _, args := range [][]string{
+		{"link", "add", veth, "type", "veth", "peer", "name", "eth0", "netns", ns},
+		{"link", "set", veth, "master", n.bridge},
+		{"link", "set", veth, "up"},
+		{"-n", ns, "addr", "add", addr + "/24", "dev", "eth0"},
+		{"-n", ns, "link", "set", "eth0", "up"},
+		{"-n", ns, "link", "set", "lo", "up"},
+	} {
+		if err := runIP(args...); err != nil {
+			return "", "", err
+		}
+	}
+	return ns, addr, nil
+}
+
+// setLink brings the host end of the namespace's link up or down.
+func (n *namespaceNetwork) setLink(ns string, up bool) error {
+	veth, ok := n.links[ns]
+	if !ok {
+		return fmt.Errorf("unknown namespace: %s", ns)
+	}
+	state := "down"
+	if up {
+		state = "up"
+	}
+	return runIP("link", "set", veth, state)
+}
+
+// remove deletes the namespaces, which takes their veth pairs with them,
+// and the bridge.
+func (n *namespaceNetwork) remove() error {
+	var errs []string
+	for ns := range n.links {
+		if err := runIP("netns", "del", ns); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	n.links = make(map[string]string)
+
+	if err := runIP("link", "del", n.bridge); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// listenInNamespace opens a TCP listener inside the named namespace. The
+// socket stays in that namespace after the thread switches back, so the
+// node's API is only reachable over its own link.
+func listenInNamespace(ns, addr string) (net.Listener, error) {
+	runtime.LockOSThread()
+
+	origin, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+	if err != nil {
+		runtime.UnlockOSThread()
+		return nil, fmt.Errorf("failed to open current namespace: %v", err)
+	}
+	defer origin.Close()
+
+	target, err := os.Open(filepath.Join("/run/netns", ns))
+	if err != nil {
+		runtime.UnlockOSThread()
+		return nil, fmt.Errorf("failed to open namespace %s: %v", ns, err)
+	}
+	defer target.Close()
+
+	if err := unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+		runtime.UnlockOSThread()
+		return nil, fmt.Errorf("failed to enter namespace %s: %v", ns, err)
+	}
+
+	listener, listenErr := net.Listen("tcp", addr)
+
+	// A thread that can't switch back stays locked, so Go retires it
+	// instead of running other goroutines in the wrong namespace
+	if err := unix.Setns(int(origin.Fd()), unix.CLONE_NEWNET); err != nil {
+		if listener != nil {
+			listener.Close()
+		}
+		return nil, fmt.Errorf("failed to leave namespace %s: %v", ns, err)
+	}
+	runtime.UnlockOSThread()
+
+	if listenErr != nil {
+		return nil, listenErr
+	}
+	return listener, nil
+}
+
+func runIP(args ...string) error {
+	output, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ip %s failed: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+// Package timeutil reads the timestamps of stored records and the
+// --since/--until filters of list commands.
+package timeutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// zeroTime is how time.Time{} is written in JSON.
+const zeroTime = "0001-01-01T00:00:00Z"
+
+// ParseLegacy reads a timestamp written before records stored time.Time:
+// RFC3339 or unix seconds. Anything else, such as the "now" placeholder some
+// records were created with, gives the zero time.
+func ParseLegacy(value string) time.Time {
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0).UTC()
+	}
+	return time.Time{}
+}
+
+// MigrateJSON rewrites the string values of the given keys, at any depth,
+// so that they decode into time.Time. It returns whether anything changed.
+func MigrateJSON(data []byte, keys ...string) ([]byte, bool, error) {
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, false, err
+	}
+	timeKeys := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		timeKeys[key] = true
+	}
+	if !migrateValue(doc, timeKeys) {
+		return data, false, nil
+	}
+	migrated, err := json.Marshal(doc)
+	if err != nil {
+		return nil, false, err
+	}
+	return migrated, true, nil
+}
+
+func migrateValue(value interface{}, keys map[string]bool) bool {
+	changed := false
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if s, ok := field.(string); ok && keys[key] {
+				if _, err := time.Parse(time.RFC3339Nano, s); err != nil {
+					v[key] = formatLegacy(s)
+					changed = true
+				}
+				continue
+			}
+			if migrateValue(field, keys) {
+				changed = true
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if migrateValue(item, keys) {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+func formatLegacy(value string) string {
+	t := ParseLegacy(value)
+	if t.IsZero() {
+		return zeroTime
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+// Unmarshal decodes a stored record into v, migrating the timestamps under
+// keys first. It returns whether the record was migrated and so should be
+// written back.
+func Unmarshal(data []byte, v interface{}, keys ...string) (bool, error) {
+	if err := json.Unmarshal(data, v); err == nil {
+		return false, nil
+	}
+	migrated, changed, err := MigrateJSON(data, keys...)
+	if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(migrated, v); err != nil {
+		return false, err
+	}
+	return changed, nil
+}
+
+// ParseFilterTime reads the value of a --since or --until filter: an
+// RFC3339 timestamp, a date, unix seconds, or a duration meaning that long
+// before now.
+func ParseFilterTime(value string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q: use RFC3339, YYYY-MM-DD, unix seconds or a duration like 24h", value)
+}
+
+// Range is the window of a --since/--until filter. A zero bound is open.
+type Range struct {
+	Since time.Time
+	Until time.Time
+}
+
+// ParseRange reads the bounds of a filter, either of which may be empty.
+func ParseRange(since, until string, now time.Time) (Range, error) {
+	var r Range
+	var err error
+	if since != "" {
+		if r.Since, err = ParseFilterTime(since, now); err != nil {
+			return Range{}, fmt.Errorf("invalid since: %v", err)
+		}
+	}
+	if until != "" {
+		if r.Until, err = ParseFilterTime(until, now); err != nil {
+			return Range{}, fmt.Errorf("invalid until: %v", err)
+		}
+	}
+	return r, nil
+}
+
+// IsZero reports whether the range lets everything through.
+func (r Range) IsZero() bool {
+	return r.Since.IsZero() && r.Until.IsZero()
+}
+
+// Contains reports whether t is within the range. Records without a time
+// only match an open range.
+func (r Range) Contains(t time.Time) bool {
+	if r.IsZero() {
+		return true
+	}
+	if t.IsZero() {
+		return false
+	}
+	return (r.Since.IsZero() || !t.Before(r.Since)) && (r.Until.IsZero() || !t.After(r.Until))
+}
@@ -0,0 +1,77 @@
+package timeutil
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLegacy(t *testing.T) {
+	assert.Equal(t, time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC), ParseLegacy("2024-03-01T12:00:00Z").UTC())
+	assert.Equal(t, time.Unix(1700000000, 0).UTC(), ParseLegacy("1700000000"))
+	assert.True(t, ParseLegacy("now").IsZero())
+	assert.True(t, ParseLegacy("").IsZero())
+}
+
+func TestUnmarshalMigratesLegacyRecords(t *testing.T) {
+	type usage struct {
+		LastUsed time.Time `json:"last_used"`
+	}
+	type record struct {
+		Name      string    `json:"name"`
+		CreatedAt time.Time `json:"created_at"`
+		Usage     *usage    `json:"usage"`
+	}
+
+	var current record
+	migrated, err := Unmarshal([]byte(`{"name":"a","created_at":"2024-03-01T12:00:00Z","usage":{"last_used":"0001-01-01T00:00:00Z"}}`), &current, "created_at", "last_used")
+	require.NoError(t, err)
+	assert.False(t, migrated)
+
+	var legacy record
+	migrated, err = Unmarshal([]byte(`{"name":"b","created_at":"now","usage":{"last_used":""}}`), &legacy, "created_at", "last_used")
+	require.NoError(t, err)
+	assert.True(t, migrated)
+	assert.Equal(t, "b", legacy.Name)
+	assert.True(t, legacy.CreatedAt.IsZero())
+	assert.True(t, legacy.Usage.LastUsed.IsZero())
+
+	_, err = Unmarshal([]byte(`{"name":`), &legacy, "created_at")
+	assert.Error(t, err)
+}
+
+func TestParseFilterTime(t *testing.T) {
+	now := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+
+	got, err := ParseFilterTime("2024-03-01T12:00:00Z", now)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC), got.UTC())
+
+	got, err = ParseFilterTime("24h", now)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(-24*time.Hour), got)
+
+	got, err = ParseFilterTime("1700000000", now)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1700000000), got.Unix())
+
+	_, err = ParseFilterTime("yesterday", now)
+	assert.Error(t, err)
+}
+
+func TestRangeContains(t *testing.T) {
+	now := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+	r, err := ParseRange("48h", "24h", now)
+	require.NoError(t, err)
+
+	assert.True(t, r.Contains(now.Add(-36*time.Hour)))
+	assert.False(t, r.Contains(now.Add(-72*time.Hour)))
+	assert.False(t, r.Contains(now.Add(-time.Hour)))
+	assert.False(t, r.Contains(time.Time{}), "records without a time only match an open range")
+	assert.True(t, Range{}.Contains(time.Time{}))
+
+	_, err = ParseRange("soon", "", now)
+	assert.Error(t, err)
+}
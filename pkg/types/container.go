@@ -14,6 +14,7 @@ const (
 	StatusExited    ContainerStatus = "exited"
 	StatusRemoving  ContainerStatus = "removing"
 	StatusDead      ContainerStatus = "dead"
+	StatusRestarting ContainerStatus = "restarting"
 )
 
 type Container struct {
@@ -34,6 +35,26 @@ type Container struct {
 	Driver        string            `json:"driver"`
 	Platform      string            `json:"platform"`
 	RootFS        RootFS            `json:"root_fs"`
+	ExitCode      int               `json:"exit_code"`
+	Signal        string            `json:"signal,omitempty"`
+	OOMKilled     bool              `json:"oom_killed"`
+	Error         string            `json:"error,omitempty"`
+	RestartCount  int               `json:"restart_count"`
+	RestartTimes  []time.Time       `json:"restart_times,omitempty"`
+	// SizeRw and SizeRootFs are only filled in when asked for, see
+	// ContainerListOptions.Size
+	SizeRw        int64             `json:"size_rw,omitempty"`
+	SizeRootFs    int64             `json:"size_root_fs,omitempty"`
+	// StateHistory holds the latest changes of Status, oldest first
+	StateHistory  []StateTransition `json:"state_history,omitempty"`
+}
+
+// StateTransition is a change of a container's status and why it happened.
+type StateTransition struct {
+	From   ContainerStatus `json:"from,omitempty"`
+	To     ContainerStatus `json:"to"`
+	Time   time.Time       `json:"time"`
+	Reason string          `json:"reason,omitempty"`
 }
 
 type ContainerConfig struct {
@@ -48,6 +69,8 @@ type ContainerConfig struct {
 	WorkingDir   string                 `json:"working_dir"`
 	ExposedPorts map[string]struct{}    `json:"exposed_ports"`
 	StopSignal   string                 `json:"stop_signal"`
+	Volumes      map[string]struct{}    `json:"volumes,omitempty"`
+	Healthcheck  *HealthConfig          `json:"healthcheck,omitempty"`
 	Tty          bool                   `json:"tty"`
 	OpenStdin    bool                   `json:"open_stdin"`
 	StdinOnce    bool                   `json:"stdin_once"`
@@ -66,8 +89,78 @@ type HostConfig struct {
 	CPUShares       int64               `json:"cpu_shares"`
 	Memory          int64               `json:"memory"`
 	MemorySwap      int64               `json:"memory_swap"`
+	MemorySwappiness *int64             `json:"memory_swappiness,omitempty"`
 	RestartPolicy   RestartPolicy       `json:"restart_policy"`
 	VolumesFrom     []string            `json:"volumes_from"`
+	Hooks           Hooks               `json:"hooks"`
+	CheckpointPolicy *CheckpointPolicy  `json:"checkpoint_policy,omitempty"`
+	// StorageOpt holds storage driver options, e.g. size=10G to limit
+	// what the container can write
+	StorageOpt map[string]string `json:"storage_opt,omitempty"`
+	// Mounts are the --mount values, on top of Binds
+	Mounts []MountSpec `json:"mounts,omitempty"`
+	// DNS are the resolvers names the container's peers don't have are
+	// forwarded to (default: the host's), and DNSSearch and DNSOptions the
+	// search domains and options of its resolv.conf
+	DNS        []string `json:"dns,omitempty"`
+	DNSSearch  []string `json:"dns_search,omitempty"`
+	DNSOptions []string `json:"dns_options,omitempty"`
+	// NetworkAliases are the other names the container is found by on its
+	// network
+	NetworkAliases []string `json:"network_aliases,omitempty"`
+	// Links are the containers the container is linked to, as NAME:ALIAS;
+	// it resolves them by their aliases and gets their addresses, ports and
+	// environment in its own
+	Links []string `json:"links,omitempty"`
+}
+
+// MountSpec asks for a bind, volume or tmpfs mount, e.g. with --mount
+// type=volume,src=data,dst=/data.
+type MountSpec struct {
+	Type     string `json:"type"`
+	Source   string `json:"source,omitempty"`
+	Target   string `json:"target"`
+	ReadOnly bool   `json:"read_only,omitempty"`
+	// Propagation applies to bind mounts
+	Propagation string `json:"propagation,omitempty"`
+	// A volume missing when the container is created is created with
+	// VolumeDriver, VolumeOptions and VolumeLabels
+	VolumeDriver  string            `json:"volume_driver,omitempty"`
+	VolumeOptions map[string]string `json:"volume_options,omitempty"`
+	VolumeLabels  map[string]string `json:"volume_labels,omitempty"`
+	// TmpfsSize (bytes, 0 for the kernel default) and TmpfsMode apply to
+	// tmpfs mounts
+	TmpfsSize int64  `json:"tmpfs_size,omitempty"`
+	TmpfsMode uint32 `json:"tmpfs_mode,omitempty"`
+}
+
+// CheckpointPolicy has a running container checkpointed every Interval
+// seconds, keeping the newest Keep automatic checkpoints.
+type CheckpointPolicy struct {
+	Interval int `json:"interval"`
+	Keep     int `json:"keep"`
+}
+
+// Checkpoint is a named snapshot of a container's processes, taken with
+// CRIU, that the container can be restored from.
+type Checkpoint struct {
+	Name        string    `json:"name"`
+	ContainerID string    `json:"container_id"`
+	CreatedAt   time.Time `json:"created_at"`
+	Size        int64     `json:"size"`
+	// Auto is set on checkpoints taken for the checkpoint policy
+	Auto bool `json:"auto,omitempty"`
+	// Exit is set when taking the checkpoint stopped the container
+	Exit bool `json:"exit,omitempty"`
+	// LogPath is the file the process wrote its output to, which is
+	// handed back to it on restore
+	LogPath string `json:"log_path,omitempty"`
+}
+
+type CheckpointCreateOptions struct {
+	Name string `json:"name"`
+	// Exit stops the container once it is checkpointed
+	Exit bool `json:"exit"`
 }
 
 type RestartPolicy struct {
@@ -75,6 +168,29 @@ type RestartPolicy struct {
 	MaximumRetryCount int    `json:"maximum_retry_count"`
 }
 
+type HookFailurePolicy string
+
+const (
+	HookFailurePolicyFail   HookFailurePolicy = "fail"
+	HookFailurePolicyIgnore HookFailurePolicy = "ignore"
+)
+
+// Hook is a host command run at a container lifecycle point. Like OCI hooks,
+// it receives the container state as JSON on stdin.
+type Hook struct {
+	Path      string            `json:"path"`
+	Args      []string          `json:"args"`
+	Env       []string          `json:"env"`
+	Timeout   int               `json:"timeout"`
+	OnFailure HookFailurePolicy `json:"on_failure"`
+}
+
+type Hooks struct {
+	Prestart  []Hook `json:"prestart"`
+	Poststart []Hook `json:"poststart"`
+	Prestop   []Hook `json:"prestop"`
+}
+
 type PortBinding struct {
 	HostIP   string `json:"host_ip"`
 	HostPort string `json:"host_port"`
@@ -88,6 +204,8 @@ type NetworkSettings struct {
 	MacAddress  string            `json:"mac_address"`
 	Bridge      string            `json:"bridge"`
 	SandboxID   string            `json:"sandbox_id"`
+	// SandboxKey is the network namespace of a container on the bridge
+	SandboxKey string `json:"sandbox_key,omitempty"`
 }
 
 type Mount struct {
@@ -97,6 +215,13 @@ type Mount struct {
 	Mode        string `json:"mode"`
 	RW          bool   `json:"rw"`
 	Propagation string `json:"propagation"`
+	// Name and Driver are set for named volumes
+	Name   string `json:"name,omitempty"`
+	Driver string `json:"driver,omitempty"`
+	// Options holds the mount options of a tmpfs, e.g. size=65536
+	Options string `json:"options,omitempty"`
+	// Anonymous volumes were created for the container, which owns them
+	Anonymous bool `json:"anonymous,omitempty"`
 }
 
 type RootFS struct {
@@ -118,6 +243,8 @@ type ContainerListOptions struct {
 	Since   string            `json:"since"`
 	Before  string            `json:"before"`
 	Filters map[string][]string `json:"filters"`
+	// Size measures the filesystem of each container
+	Size bool `json:"size"`
 }
 
 type ContainerStartOptions struct {
@@ -132,4 +259,29 @@ type ContainerRemoveOptions struct {
 	Force      bool `json:"force"`
 	RemoveVolumes bool `json:"remove_volumes"`
 	RemoveLinks   bool `json:"remove_links"`
-}
\ No newline at end of file
+}
+// ExecConfig describes a command to run in a running container. Env, User
+// and WorkingDir default to those of the container.
+type ExecConfig struct {
+	Cmd          []string `json:"cmd"`
+	Env          []string `json:"env,omitempty"`
+	User         string   `json:"user,omitempty"`
+	WorkingDir   string   `json:"working_dir,omitempty"`
+	Tty          bool     `json:"tty"`
+	AttachStdout bool     `json:"attach_stdout"`
+	AttachStderr bool     `json:"attach_stderr"`
+}
+
+type ExecInspect struct {
+	ID          string     `json:"id"`
+	ContainerID string     `json:"container_id"`
+	Config      ExecConfig `json:"config"`
+	Running     bool       `json:"running"`
+	Pid         int        `json:"pid"`
+	// ExitCode is nil until the command has exited
+	ExitCode   *int      `json:"exit_code"`
+	Error      string    `json:"error,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+}
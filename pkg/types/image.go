@@ -1,6 +1,7 @@
 package types
 
 import (
+	"encoding/json"
 	"time"
 )
 
@@ -12,7 +13,82 @@ type Image struct {
 	CreatedAt   time.Time         `json:"created_at"`
 	Config      ImageConfig       `json:"config"`
 	Layers      []string          `json:"layers"`
+	// DiffIDs are the uncompressed layer digests of pulled images, whose
+	// Layers hold the compressed digests from the manifest
+	DiffIDs     []string          `json:"diff_ids,omitempty"`
 	Labels      map[string]string `json:"labels"`
+	Platform    Platform          `json:"platform"`
+	Digest      string            `json:"digest"`
+	History     []ImageHistory    `json:"history,omitempty"`
+	// Parent is the image this one was built from
+	Parent      string            `json:"parent,omitempty"`
+	// RepoTags and RepoDigests list every reference to the image
+	RepoTags    []string          `json:"repo_tags,omitempty"`
+	RepoDigests []string          `json:"repo_digests,omitempty"`
+	// SignedBy is the ID of the key whose signature was verified on pull
+	SignedBy    string            `json:"signed_by,omitempty"`
+}
+
+// ImageHistory records the step that produced a layer, or a metadata-only
+// step when EmptyLayer is set.
+type ImageHistory struct {
+	LayerID    string    `json:"layer_id,omitempty"`
+	Created    time.Time `json:"created"`
+	CreatedBy  string    `json:"created_by"`
+	Size       int64     `json:"size"`
+	Comment    string    `json:"comment,omitempty"`
+	EmptyLayer bool      `json:"empty_layer,omitempty"`
+}
+
+type Platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+func (p Platform) String() string {
+	if p.OS == "" && p.Architecture == "" {
+		return ""
+	}
+	if p.Variant != "" {
+		return p.OS + "/" + p.Architecture + "/" + p.Variant
+	}
+	return p.OS + "/" + p.Architecture
+}
+
+// ImageInspect is the detailed view returned by "image inspect".
+type ImageInspect struct {
+	ID          string    `json:"id"`
+	RepoTags    []string  `json:"repo_tags"`
+	RepoDigests []string  `json:"repo_digests"`
+	Parent      string    `json:"parent,omitempty"`
+	Created     time.Time `json:"created"`
+	Platform    Platform  `json:"platform"`
+	// Config is the image config in OCI format
+	Config       json.RawMessage   `json:"config"`
+	RootFS       ImageRootFS       `json:"rootfs"`
+	Layers       []ImageLayer      `json:"layers"`
+	Labels       map[string]string `json:"labels"`
+	ExposedPorts []string          `json:"exposed_ports"`
+	// Size counts the layers the image adds to its parent, VirtualSize
+	// every layer
+	Size        int64  `json:"size"`
+	VirtualSize int64  `json:"virtual_size"`
+	SignedBy    string `json:"signed_by,omitempty"`
+}
+
+type ImageRootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+type ImageLayer struct {
+	Digest    string `json:"digest"`
+	DiffID    string `json:"diff_id"`
+	Size      int64  `json:"size"`
+	CreatedBy string `json:"created_by,omitempty"`
+	// Shared is set for layers inherited from the parent image
+	Shared bool `json:"shared,omitempty"`
 }
 
 type ImageConfig struct {
@@ -24,6 +100,22 @@ type ImageConfig struct {
 	Volumes      map[string]struct{}    `json:"volumes"`
 	Labels       map[string]string      `json:"labels"`
 	StopSignal   string                 `json:"stop_signal"`
+	User         string                 `json:"user,omitempty"`
+	Healthcheck  *HealthConfig          `json:"healthcheck,omitempty"`
+	// OnBuild holds instructions that run when another build starts
+	// FROM this image
+	OnBuild      []string               `json:"on_build,omitempty"`
+}
+
+// HealthConfig describes how to check that a container is healthy. Test is
+// ["CMD", args...], ["CMD-SHELL", command] or ["NONE"], which turns off a
+// check inherited from the base image.
+type HealthConfig struct {
+	Test        []string      `json:"test,omitempty"`
+	Interval    time.Duration `json:"interval,omitempty"`
+	Timeout     time.Duration `json:"timeout,omitempty"`
+	StartPeriod time.Duration `json:"start_period,omitempty"`
+	Retries     int           `json:"retries,omitempty"`
 }
 
 type ImageFilter struct {
@@ -31,6 +123,26 @@ type ImageFilter struct {
 	Labels map[string]string
 }
 
+type ImagePruneOptions struct {
+	// All removes every image without a container, not just dangling ones
+	All   bool
+	// Until only removes images created at least this long ago
+	Until time.Duration
+}
+
+type ImagePruneReport struct {
+	ImagesDeleted  []string `json:"images_deleted"`
+	LayersDeleted  []string `json:"layers_deleted"`
+	SpaceReclaimed int64    `json:"space_reclaimed"`
+}
+
+// ImageDeleteReport lists the references an image removal untagged and the
+// image it deleted, if any.
+type ImageDeleteReport struct {
+	Untagged []string `json:"untagged"`
+	Deleted  string   `json:"deleted,omitempty"`
+}
+
 type ImageCreateOptions struct {
 	FromImage string `json:"from_image"`
 	Tag       string `json:"tag"`
@@ -44,4 +156,36 @@ type ImageBuildOptions struct {
 	NoCache     bool              `json:"no_cache"`
 	Remove      bool              `json:"remove"`
 	ForceRemove bool              `json:"force_remove"`
+	Target      string            `json:"target"`
+	BuildArgs   map[string]string `json:"build_args"`
+	// Squash merges the layers added by the build into one
+	Squash bool `json:"squash,omitempty"`
+	// FromContainer builds on a container instead of a FROM: the files
+	// under ContainerRootfs, but for ContainerExclude (its volumes), become
+	// a layer on top of FromImage, the image the container was created
+	// from. The Dockerfile then has no FROM.
+	FromContainer    string   `json:"from_container,omitempty"`
+	FromImage        string   `json:"from_image,omitempty"`
+	ContainerRootfs  string   `json:"container_rootfs,omitempty"`
+	ContainerExclude []string `json:"container_exclude,omitempty"`
+	// Progress receives build events as they happen. Without it the
+	// build prints plain progress to stdout.
+	Progress func(BuildEvent) `json:"-"`
+}
+
+// BuildEvent is one event of a build's progress: a step starting, output
+// of a RUN, a cache hit, a committed layer, a message, or the outcome.
+type BuildEvent struct {
+	Type        string    `json:"type"`
+	Time        time.Time `json:"time"`
+	Step        int       `json:"step,omitempty"`
+	Total       int       `json:"total,omitempty"`
+	Instruction string    `json:"instruction,omitempty"`
+	// Stream is stdout or stderr for RUN output
+	Stream  string   `json:"stream,omitempty"`
+	Message string   `json:"message,omitempty"`
+	Layer   string   `json:"layer,omitempty"`
+	Size    int64    `json:"size,omitempty"`
+	ImageID string   `json:"image_id,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
 }
\ No newline at end of file
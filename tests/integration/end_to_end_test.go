@@ -39,7 +39,7 @@ func TestEndToEndWorkflow(t *testing.T) {
 	assert.Contains(t, output, "my-alpine:v1.0", "Container should show correct image")
 
 	// 6. Get container logs
-	containerID := getContainerIDFromOutput(t, output)
+	containerID := ts.containerID(t, "test-container")
 	output, err = ts.runCommand("container", "logs", containerID)
 	require.NoError(t, err, "Failed to get container logs: %s", output)
 	assert.Contains(t, output, "Hello from container", "Container logs should contain the output")
@@ -103,11 +103,7 @@ func TestMultipleContainersWorkflow(t *testing.T) {
 
 	for i, name := range containerNames {
 		img := images[i%len(images)]
-		output, err := ts.runCommand("container", "run", "--name", name, img, "echo", "Hello from "+name)
-		require.NoError(t, err, "Failed to run container %s: %s", name, output)
-
-		// In real implementation, extract container ID from output
-		containerIDs = append(containerIDs, "container-id-"+name)
+		containerIDs = append(containerIDs, ts.runContainer(t, "--name", name, img, "echo", "Hello from "+name))
 	}
 
 	// List all containers
@@ -205,7 +201,7 @@ func TestDataPersistenceWorkflow(t *testing.T) {
 	assert.NotEmpty(t, containerFiles, "Should have container files")
 
 	// Stop and remove container
-	containerID := getContainerIDFromOutput(t, output)
+	containerID := ts.containerID(t, "persistent-test")
 	output, err = ts.runCommand("container", "stop", containerID)
 	require.NoError(t, err, "Failed to stop container: %s", output)
 
@@ -236,17 +232,10 @@ func TestResourceLimitsWorkflow(t *testing.T) {
 	assert.Contains(t, output, "resource-test", "Resource test container should be in list")
 
 	// Stop and remove container
-	containerID := getContainerIDFromOutput(t, output)
+	containerID := ts.containerID(t, "resource-test")
 	output, err = ts.runCommand("container", "stop", containerID)
 	require.NoError(t, err, "Failed to stop container: %s", output)
 
 	output, err = ts.runCommand("container", "remove", containerID)
 	require.NoError(t, err, "Failed to remove container: %s", output)
 }
-
-func getContainerIDFromOutput(t *testing.T, output string) string {
-	// In a real implementation, this would parse the output to extract the container ID
-	// For now, return a placeholder
-	t.Log("Extracting container ID from output:", output)
-	return "test-container-id"
-}
\ No newline at end of file
@@ -1,12 +1,15 @@
 package integration
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
-	"time"
+
+	"docker-impl/pkg/types"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -45,7 +48,7 @@ func setupTestSuite(t *testing.T) *TestSuite {
 	}
 }
 
-func (ts *TestSuite) runCommand(t *testing.T, args ...string) (string, error) {
+func (ts *TestSuite) runCommand(args ...string) (string, error) {
 	cmd := exec.Command(ts.binaryPath, args...)
 	cmd.Env = append(os.Environ(), "MYDOCKER_DATA_DIR="+ts.dataDir)
 
@@ -53,6 +56,45 @@ func (ts *TestSuite) runCommand(t *testing.T, args ...string) (string, error) {
 	return string(output), err
 }
 
+// runStdout runs a command and returns only its standard output, so log
+// lines on stderr can't get in the way of parsing it.
+func (ts *TestSuite) runStdout(t *testing.T, args ...string) string {
+	t.Helper()
+	cmd := exec.Command(ts.binaryPath, args...)
+	cmd.Env = append(os.Environ(), "MYDOCKER_DATA_DIR="+ts.dataDir)
+
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	require.NoError(t, err, "Command %v failed: %s", args, stderr.String())
+	return string(output)
+}
+
+// runContainer runs a container and returns its ID.
+func (ts *TestSuite) runContainer(t *testing.T, args ...string) string {
+	t.Helper()
+	output := ts.runStdout(t, append([]string{"container", "run", "--format", "{{.ID}}"}, args...)...)
+	id := strings.TrimSpace(output)
+	require.NotEmpty(t, id, "container run printed no ID")
+	return id
+}
+
+// containerID looks a container up by name.
+func (ts *TestSuite) containerID(t *testing.T, name string) string {
+	t.Helper()
+	var containers []types.Container
+	output := ts.runStdout(t, "container", "list", "--all", "--json")
+	require.NoError(t, json.Unmarshal([]byte(output), &containers), "Invalid JSON from container list: %s", output)
+
+	for _, container := range containers {
+		if container.Name == name {
+			return container.ID
+		}
+	}
+	require.Failf(t, "container not found", "no container named %s in %s", name, output)
+	return ""
+}
+
 func (ts *TestSuite) cleanup() {
 	if ts.tempDir != "" {
 		os.RemoveAll(ts.tempDir)
@@ -143,15 +185,14 @@ func TestContainerStartStop(t *testing.T) {
 	output, err := ts.runCommand("image", "pull", testImageName, "--tag", testTagName)
 	require.NoError(t, err, "Failed to pull image: %s", output)
 
-	output, err = ts.runCommand("container", "run", testImageName, "sleep", "10")
-	require.NoError(t, err, "Failed to run container: %s", output)
+	containerID := ts.runContainer(t, testImageName, "sleep", "10")
 
-	// Get container ID from list
-	output, err = ts.runCommand("container", "list", "--all")
+	// The ID printed by run should show up in the list
+	output, err = ts.runCommand("container", "list", "--all", "--format", "{{.ID}}")
 	require.NoError(t, err, "Failed to list containers: %s", output)
+	assert.Contains(t, output, containerID, "Container should be in the list")
 
-	// Stop the container (this will extract container ID properly in real implementation)
-	containerID := "test-container-id" // This would be extracted from output in real implementation
+	// Stop the container
 	output, err = ts.runCommand("container", "stop", containerID)
 	require.NoError(t, err, "Failed to stop container: %s", output)
 }
@@ -164,11 +205,9 @@ func TestContainerRemove(t *testing.T) {
 	output, err := ts.runCommand("image", "pull", testImageName, "--tag", testTagName)
 	require.NoError(t, err, "Failed to pull image: %s", output)
 
-	output, err = ts.runCommand("container", "run", testImageName, "echo", "test")
-	require.NoError(t, err, "Failed to run container: %s", output)
+	containerID := ts.runContainer(t, testImageName, "echo", "test")
 
 	// Remove the container
-	containerID := "test-container-id" // This would be extracted from output in real implementation
 	output, err = ts.runCommand("container", "remove", containerID)
 	require.NoError(t, err, "Failed to remove container: %s", output)
 
@@ -186,11 +225,9 @@ func TestContainerLogs(t *testing.T) {
 	output, err := ts.runCommand("image", "pull", testImageName, "--tag", testTagName)
 	require.NoError(t, err, "Failed to pull image: %s", output)
 
-	output, err = ts.runCommand("container", "run", testImageName, "echo", "test message")
-	require.NoError(t, err, "Failed to run container: %s", output)
+	containerID := ts.runContainer(t, testImageName, "echo", "test message")
 
 	// Get container logs
-	containerID := "test-container-id" // This would be extracted from output in real implementation
 	output, err = ts.runCommand("container", "logs", containerID)
 	require.NoError(t, err, "Failed to get container logs: %s", output)
 	assert.Contains(t, output, "test message", "Container logs should contain the test message")
@@ -214,11 +251,9 @@ func TestContainerInspect(t *testing.T) {
 	output, err := ts.runCommand("image", "pull", testImageName, "--tag", testTagName)
 	require.NoError(t, err, "Failed to pull image: %s", output)
 
-	output, err = ts.runCommand("container", "run", testImageName, "echo", "test")
-	require.NoError(t, err, "Failed to run container: %s", output)
+	containerID := ts.runContainer(t, testImageName, "echo", "test")
 
 	// Inspect the container
-	containerID := "test-container-id" // This would be extracted from output in real implementation
 	output, err = ts.runCommand("container", "inspect", containerID)
 	require.NoError(t, err, "Failed to inspect container: %s", output)
 	assert.Contains(t, output, containerID, "Container inspect should contain container ID")
@@ -341,7 +376,7 @@ func BenchmarkImagePull(b *testing.B) {
 	b.ResetTimer()
 
 	for i := 0; i < b.N; i++ {
-		_, err := ts.runCommand(b, "image", "pull", "alpine")
+		_, err := ts.runCommand("image", "pull", "alpine")
 		require.NoError(b, err)
 	}
 }
@@ -362,13 +397,13 @@ func BenchmarkContainerRun(b *testing.B) {
 	require.NoError(b, err, "Failed to build binary: %s", string(output))
 
 	// Pull image first
-	_, err = ts.runCommand(b, "image", "pull", "alpine")
+	_, err = ts.runCommand("image", "pull", "alpine")
 	require.NoError(b, err)
 
 	b.ResetTimer()
 
 	for i := 0; i < b.N; i++ {
-		_, err := ts.runCommand(b, "container", "run", "alpine", "echo", "test")
+		_, err := ts.runCommand("container", "run", "alpine", "echo", "test")
 		require.NoError(b, err)
 	}
 }
\ No newline at end of file